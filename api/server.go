@@ -0,0 +1,532 @@
+// Package api serves the multiwallet over HTTP with a JSON API and pushes
+// transaction events to websocket clients. It's intended for web frontends
+// which can't link the multiwallet directly.
+//
+// Every request must carry the configured API token as a bearer token in
+// the Authorization header. Browsers can't set headers on websockets so
+// /v1/ws also accepts it in the access_token query parameter. Requests
+// from origins which aren't allowed are rejected and POST bodies must be
+// JSON, so a page on another site can't spend from the wallet.
+//
+// The endpoints are:
+//
+//	GET  /v1/{coin}/address       the wallet's current receiving address
+//	GET  /v1/{coin}/balance       the wallet's unconfirmed and confirmed balance
+//	GET  /v1/{coin}/transactions  the wallet's transactions, paged with limit and after
+//	POST /v1/{coin}/spend         send to an address
+//	GET  /v1/{coin}/privacy       a report of how linkable the wallet's addresses and utxos are
+//	GET  /v1/transactions         the transactions of every wallet, paged with limit and offset
+//	GET  /v1/ws                   a websocket stream of transaction events
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"github.com/cpacia/multiwallet"
+	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/multiwallet/log"
+	iwallet "github.com/cpacia/wallet-interface"
+	"github.com/gorilla/websocket"
+	"math/big"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// DefaultPageSize is the number of transactions returned when the
+	// request doesn't set a limit.
+	DefaultPageSize = 50
+
+	// MaxPageSize is the largest limit a request may set.
+	MaxPageSize = 500
+
+	// MaxOffset is the largest offset a request for the transactions of
+	// every wallet may set. They're merged in memory so deeper pages are
+	// read per wallet with its cursor.
+	MaxOffset = 10000
+
+	// DefaultListenAddr is the address served on when the config doesn't
+	// set one. It's only reachable from the local machine.
+	DefaultListenAddr = "127.0.0.1:8080"
+)
+
+// ErrNoAPIToken is returned by ListenAndServe when the config has no API
+// token.
+var ErrNoAPIToken = errors.New("api token is required")
+
+// Wallets is the part of the Multiwallet used by the Server.
+type Wallets interface {
+	CoinTypes() []iwallet.CoinType
+	Wallet(coinType iwallet.CoinType) (iwallet.Wallet, error)
+	Transactions(limit int) ([]multiwallet.CoinTransaction, error)
+	SubscribeTransactions() <-chan multiwallet.CoinTransaction
+}
+
+// Config configures a Server.
+type Config struct {
+	// ListenAddr is the address passed to http.ListenAndServe. It
+	// defaults to DefaultListenAddr and to 127.0.0.1 if it has no host.
+	ListenAddr string
+
+	// APIToken is the bearer token every request must carry. It's
+	// required; without it every request is rejected.
+	APIToken string
+
+	// AllowedOrigins are the origins allowed to make cross origin
+	// requests and open websockets. "*" allows any origin. If empty only
+	// same origin requests are allowed. Requests from other origins are
+	// rejected.
+	AllowedOrigins []string
+
+	Logger log.Logger
+}
+
+// Server is an HTTP server for the wallets.
+type Server struct {
+	wallets  Wallets
+	cfg      Config
+	logger   log.Logger
+	upgrader websocket.Upgrader
+	httpSrv  *http.Server
+
+	mtx      sync.Mutex
+	clients  map[*wsClient]struct{}
+	started  bool
+	shutdown chan struct{}
+}
+
+// NewServer returns a new Server for the wallets.
+func NewServer(wallets Wallets, cfg Config) *Server {
+	logger := cfg.Logger
+	if logger == nil {
+		logger = log.New("api")
+	}
+	if cfg.ListenAddr == "" {
+		cfg.ListenAddr = DefaultListenAddr
+	} else if host, port, err := net.SplitHostPort(cfg.ListenAddr); err == nil && host == "" {
+		cfg.ListenAddr = net.JoinHostPort("127.0.0.1", port)
+	}
+	s := &Server{
+		wallets:  wallets,
+		cfg:      cfg,
+		logger:   logger,
+		clients:  make(map[*wsClient]struct{}),
+		shutdown: make(chan struct{}),
+	}
+	s.upgrader = websocket.Upgrader{CheckOrigin: s.checkOrigin}
+	return s
+}
+
+// Start subscribes to the wallets' transactions so they can be pushed to
+// websocket clients. It's called by ListenAndServe and only needs to be
+// called directly when the Handler is served some other way.
+func (s *Server) Start() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.started {
+		return
+	}
+	s.started = true
+	go s.pushTransactions(s.wallets.SubscribeTransactions())
+}
+
+// ListenAndServe starts the server and serves the API on cfg.ListenAddr.
+// It blocks until the server is closed.
+func (s *Server) ListenAndServe() error {
+	if s.cfg.APIToken == "" {
+		return ErrNoAPIToken
+	}
+	s.Start()
+	s.mtx.Lock()
+	s.httpSrv = &http.Server{Addr: s.cfg.ListenAddr, Handler: s.Handler()}
+	s.mtx.Unlock()
+
+	err := s.httpSrv.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Close stops the server and disconnects the websocket clients.
+func (s *Server) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	select {
+	case <-s.shutdown:
+		return nil
+	default:
+	}
+	close(s.shutdown)
+	for c := range s.clients {
+		c.close()
+	}
+	if s.httpSrv != nil {
+		return s.httpSrv.Close()
+	}
+	return nil
+}
+
+// Handler returns the http.Handler serving the API.
+func (s *Server) Handler() http.Handler {
+	return s.cors(s.authenticate(http.HandlerFunc(s.route)))
+}
+
+func (s *Server) route(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 2 || parts[0] != "v1" {
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	switch {
+	case len(parts) == 2 && parts[1] == "transactions":
+		s.allowMethod(w, r, http.MethodGet, s.handleTransactions)
+	case len(parts) == 2 && parts[1] == "ws":
+		s.allowMethod(w, r, http.MethodGet, s.handleWebsocket)
+	case len(parts) == 3:
+		ct, wl, err := s.walletFor(parts[1])
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		switch parts[2] {
+		case "address":
+			s.allowMethod(w, r, http.MethodGet, walletHandler(ct, wl, handleAddress))
+		case "balance":
+			s.allowMethod(w, r, http.MethodGet, walletHandler(ct, wl, handleBalance))
+		case "transactions":
+			s.allowMethod(w, r, http.MethodGet, walletHandler(ct, wl, handleWalletTransactions))
+		case "spend":
+			s.allowMethod(w, r, http.MethodPost, walletHandler(ct, wl, handleSpend))
+		case "privacy":
+			s.allowMethod(w, r, http.MethodGet, walletHandler(ct, wl, handlePrivacy))
+		default:
+			writeError(w, http.StatusNotFound, errors.New("not found"))
+		}
+	default:
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+func (s *Server) allowMethod(w http.ResponseWriter, r *http.Request, method string, handler http.HandlerFunc) {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	handler(w, r)
+}
+
+// walletFor returns the wallet for the currency code in a request path.
+// The testnet code, such as TBTC, is also matched by the mainnet code.
+func (s *Server) walletFor(currencyCode string) (iwallet.CoinType, iwallet.Wallet, error) {
+	code := strings.ToUpper(currencyCode)
+	for _, ct := range s.wallets.CoinTypes() {
+		if cc := strings.ToUpper(ct.CurrencyCode()); cc == code || cc == "T"+code {
+			wl, err := s.wallets.Wallet(ct)
+			return ct, wl, err
+		}
+	}
+	return "", nil, multiwallet.ErrUnsuppertedCoin
+}
+
+func walletHandler(ct iwallet.CoinType, wl iwallet.Wallet, handler func(iwallet.CoinType, iwallet.Wallet, http.ResponseWriter, *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handler(ct, wl, w, r)
+	}
+}
+
+// cors rejects requests from origins which aren't allowed, adds the CORS
+// headers for allowed cross origin requests and answers preflight
+// requests.
+func (s *Server) cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.checkOrigin(r) {
+			writeError(w, http.StatusForbidden, errors.New("origin not allowed"))
+			return
+		}
+		if origin := r.Header.Get("Origin"); origin != "" && s.originAllowed(origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Add("Vary", "Origin")
+			if r.Method == http.MethodOptions {
+				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+				w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authenticate rejects requests without the API token and POSTs whose
+// body isn't JSON.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var token string
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			token = strings.TrimPrefix(auth, "Bearer ")
+		} else if auth == "" && r.URL.Path == "/v1/ws" {
+			token = r.URL.Query().Get("access_token")
+		}
+		if s.cfg.APIToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.APIToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, errors.New("invalid api token"))
+			return
+		}
+		if r.Method == http.MethodPost {
+			mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil || mediaType != "application/json" {
+				writeError(w, http.StatusUnsupportedMediaType, errors.New("content type must be application/json"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) originAllowed(origin string) bool {
+	for _, allowed := range s.cfg.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOrigin allows requests and websockets without an origin, from the
+// same host or from an allowed origin.
+func (s *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if s.originAllowed(origin) {
+		return true
+	}
+	return strings.EqualFold(strings.TrimPrefix(strings.TrimPrefix(origin, "https://"), "http://"), r.Host)
+}
+
+// Transaction is a wallet transaction along with its coin.
+type Transaction struct {
+	Coin string `json:"coin"`
+	iwallet.Transaction
+}
+
+type transactionsResponse struct {
+	Transactions []Transaction `json:"transactions"`
+	NextOffset   int           `json:"nextOffset,omitempty"`
+}
+
+func (s *Server) handleTransactions(w http.ResponseWriter, r *http.Request) {
+	limit, err := pageLimit(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	offset := 0
+	if o := r.URL.Query().Get("offset"); o != "" {
+		offset, err = strconv.Atoi(o)
+		if err != nil || offset < 0 || offset > MaxOffset {
+			writeError(w, http.StatusBadRequest, errors.New("offset must be between 0 and "+strconv.Itoa(MaxOffset)))
+			return
+		}
+	}
+	// Fetch one extra to know whether there is another page.
+	txs, err := s.wallets.Transactions(offset + limit + 1)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	resp := transactionsResponse{Transactions: []Transaction{}}
+	if len(txs) > offset+limit {
+		if offset+limit <= MaxOffset {
+			resp.NextOffset = offset + limit
+		}
+		txs = txs[:offset+limit]
+	}
+	if offset < len(txs) {
+		for _, tx := range txs[offset:] {
+			resp.Transactions = append(resp.Transactions, Transaction{Coin: tx.CoinType.CurrencyCode(), Transaction: tx.Transaction})
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func handleAddress(ct iwallet.CoinType, wl iwallet.Wallet, w http.ResponseWriter, r *http.Request) {
+	addr, err := wl.CurrentAddress()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Address string `json:"address"`
+	}{addr.String()})
+}
+
+func handleBalance(ct iwallet.CoinType, wl iwallet.Wallet, w http.ResponseWriter, r *http.Request) {
+	unconfirmed, confirmed, err := wl.Balance()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Unconfirmed string `json:"unconfirmed"`
+		Confirmed   string `json:"confirmed"`
+	}{unconfirmed.String(), confirmed.String()})
+}
+
+// privacyReporter is implemented by wallets which can analyze their
+// privacy.
+type privacyReporter interface {
+	PrivacyReport() (base.PrivacyReport, error)
+}
+
+func handlePrivacy(ct iwallet.CoinType, wl iwallet.Wallet, w http.ResponseWriter, r *http.Request) {
+	reporter, ok := wl.(privacyReporter)
+	if !ok {
+		writeError(w, http.StatusNotImplemented, errors.New("wallet does not support privacy reports"))
+		return
+	}
+	report, err := reporter.PrivacyReport()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+type walletTransactionsResponse struct {
+	Transactions []Transaction `json:"transactions"`
+	Next         string        `json:"next,omitempty"`
+}
+
+func handleWalletTransactions(ct iwallet.CoinType, wl iwallet.Wallet, w http.ResponseWriter, r *http.Request) {
+	limit, err := pageLimit(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	after := iwallet.TransactionID(r.URL.Query().Get("after"))
+	txs, err := wl.Transactions(limit+1, after)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	resp := walletTransactionsResponse{Transactions: []Transaction{}}
+	if len(txs) > limit {
+		txs = txs[:limit]
+		resp.Next = txs[limit-1].ID.String()
+	}
+	for _, tx := range txs {
+		resp.Transactions = append(resp.Transactions, Transaction{Coin: ct.CurrencyCode(), Transaction: tx})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+type spendRequest struct {
+	Address  string `json:"address"`
+	Amount   string `json:"amount"`
+	FeeLevel string `json:"feeLevel"`
+}
+
+func handleSpend(ct iwallet.CoinType, wl iwallet.Wallet, w http.ResponseWriter, r *http.Request) {
+	var req spendRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	feeLevel, err := parseFeeLevel(req.FeeLevel)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if amount, ok := new(big.Int).SetString(req.Amount, 10); !ok || amount.Sign() <= 0 {
+		writeError(w, http.StatusBadRequest, errors.New("amount must be a positive integer in the coin's base unit"))
+		return
+	}
+	if req.Address == "" {
+		writeError(w, http.StatusBadRequest, errors.New("address is required"))
+		return
+	}
+
+	to := iwallet.NewAddress(req.Address, ct)
+	if err := wl.ValidateAddress(to); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	wtx, err := wl.Begin()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	txid, err := wl.Spend(wtx, to, iwallet.NewAmount(req.Amount), feeLevel)
+	if err != nil {
+		wtx.Rollback()
+		writeError(w, spendErrorStatus(err), err)
+		return
+	}
+	if err := wtx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Txid string `json:"txid"`
+	}{txid.String()})
+}
+
+func spendErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, base.ErrInsufficientFunds):
+		return http.StatusBadRequest
+	case errors.Is(err, base.ErrEncryptedKeychain):
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func parseFeeLevel(level string) (iwallet.FeeLevel, error) {
+	switch strings.ToLower(level) {
+	case "", "normal":
+		return iwallet.FlNormal, nil
+	case "priority":
+		return iwallet.FlPriority, nil
+	case "economic":
+		return iwallet.FlEconomic, nil
+	default:
+		return 0, errors.New("feeLevel must be priority, normal or economic")
+	}
+}
+
+func pageLimit(r *http.Request) (int, error) {
+	l := r.URL.Query().Get("limit")
+	if l == "" {
+		return DefaultPageSize, nil
+	}
+	limit, err := strconv.Atoi(l)
+	if err != nil || limit < 1 || limit > MaxPageSize {
+		return 0, errors.New("limit must be between 1 and " + strconv.Itoa(MaxPageSize))
+	}
+	return limit, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
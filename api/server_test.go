@@ -0,0 +1,331 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/cpacia/multiwallet"
+	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/multiwallet/testutil"
+	iwallet "github.com/cpacia/wallet-interface"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testWallets struct {
+	wallet *testutil.Wallet
+	txChan chan multiwallet.CoinTransaction
+}
+
+func (tw *testWallets) CoinTypes() []iwallet.CoinType {
+	return []iwallet.CoinType{iwallet.CtMock}
+}
+
+func (tw *testWallets) Wallet(coinType iwallet.CoinType) (iwallet.Wallet, error) {
+	if coinType != iwallet.CtMock {
+		return nil, multiwallet.ErrUnsuppertedCoin
+	}
+	return tw.wallet, nil
+}
+
+func (tw *testWallets) Transactions(limit int) ([]multiwallet.CoinTransaction, error) {
+	txs, err := tw.wallet.Transactions(limit, "")
+	if err != nil {
+		return nil, err
+	}
+	coinTxs := make([]multiwallet.CoinTransaction, 0, len(txs))
+	for _, tx := range txs {
+		coinTxs = append(coinTxs, multiwallet.CoinTransaction{CoinType: iwallet.CtMock, Transaction: tx})
+	}
+	return coinTxs, nil
+}
+
+func (tw *testWallets) SubscribeTransactions() <-chan multiwallet.CoinTransaction {
+	return tw.txChan
+}
+
+const testAPIToken = "test-token"
+
+func newTestServer(t *testing.T, chain *testutil.Chain, cfg Config) (*Server, *testWallets) {
+	if cfg.APIToken == "" {
+		cfg.APIToken = testAPIToken
+	}
+	w, err := testutil.NewTestWallet(chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := &testWallets{wallet: w, txChan: make(chan multiwallet.CoinTransaction)}
+	s := NewServer(tw, cfg)
+	s.Start()
+	return s, tw
+}
+
+func doRequest(t *testing.T, s *Server, method, path string, body interface{}, resp interface{}) int {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, path, &buf)
+	req.Header.Set("Authorization", "Bearer "+testAPIToken)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+	if resp != nil {
+		if err := json.NewDecoder(rec.Body).Decode(resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rec.Code
+}
+
+func TestServer_Address(t *testing.T) {
+	s, tw := newTestServer(t, testutil.NewChain(), Config{})
+	defer s.Close()
+
+	expected, err := tw.wallet.CurrentAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp struct {
+		Address string `json:"address"`
+	}
+	code := doRequest(t, s, http.MethodGet, "/v1/"+strings.ToLower(iwallet.CtMock.CurrencyCode())+"/address", nil, &resp)
+	if code != http.StatusOK || resp.Address != expected.String() {
+		t.Errorf("Expected address %s, got %d %s", expected, code, resp.Address)
+	}
+
+	if code := doRequest(t, s, http.MethodGet, "/v1/xyz/address", nil, nil); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown coin, got %d", code)
+	}
+	if code := doRequest(t, s, http.MethodPost, "/v1/"+iwallet.CtMock.CurrencyCode()+"/address", nil, nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405, got %d", code)
+	}
+}
+
+func TestServer_SpendAndTransactions(t *testing.T) {
+	chain := testutil.NewChain()
+	s, tw := newTestServer(t, chain, Config{})
+	defer s.Close()
+
+	addr, err := tw.wallet.CurrentAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chain.Fund(addr, iwallet.NewAmount(100000)); err != nil {
+		t.Fatal(err)
+	}
+	chain.MineBlocks(1)
+	if err := tw.wallet.WaitForBalance(iwallet.NewAmount(0), iwallet.NewAmount(100000), time.Second*10); err != nil {
+		t.Fatal(err)
+	}
+
+	spendPath := "/v1/" + iwallet.CtMock.CurrencyCode() + "/spend"
+	to := strings.Repeat("ab", 20)
+	if code := doRequest(t, s, http.MethodPost, spendPath, spendRequest{Address: to, Amount: "-1"}, nil); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a negative amount, got %d", code)
+	}
+	if code := doRequest(t, s, http.MethodPost, spendPath, spendRequest{Address: to, Amount: "1000000"}, nil); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for insufficient funds, got %d", code)
+	}
+
+	var spendResp struct {
+		Txid string `json:"txid"`
+	}
+	code := doRequest(t, s, http.MethodPost, spendPath, spendRequest{Address: to, Amount: "40000", FeeLevel: "economic"}, &spendResp)
+	if code != http.StatusOK || spendResp.Txid == "" {
+		t.Fatalf("Expected spend to succeed, got %d", code)
+	}
+	if err := tw.wallet.WaitForTransaction(iwallet.TransactionID(spendResp.Txid), 0, time.Second*10); err != nil {
+		t.Fatal(err)
+	}
+
+	var page transactionsResponse
+	if code := doRequest(t, s, http.MethodGet, "/v1/transactions?limit=1", nil, &page); code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", code)
+	}
+	if len(page.Transactions) != 1 || page.NextOffset != 1 {
+		t.Fatalf("Expected one transaction and a next page, got %+v", page)
+	}
+	if page.Transactions[0].Coin != iwallet.CtMock.CurrencyCode() || page.Transactions[0].ID.String() != spendResp.Txid {
+		t.Errorf("Expected the spend first, got %+v", page.Transactions[0])
+	}
+	if code := doRequest(t, s, http.MethodGet, "/v1/transactions?limit=1&offset=1", nil, &page); code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", code)
+	}
+	if len(page.Transactions) != 1 || page.NextOffset != 0 {
+		t.Errorf("Expected the last page with one transaction, got %+v", page)
+	}
+
+	var walletPage walletTransactionsResponse
+	if code := doRequest(t, s, http.MethodGet, "/v1/"+iwallet.CtMock.CurrencyCode()+"/transactions?limit=1", nil, &walletPage); code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", code)
+	}
+	if len(walletPage.Transactions) != 1 || walletPage.Next != spendResp.Txid {
+		t.Errorf("Expected a cursor after the spend, got %+v", walletPage)
+	}
+	if code := doRequest(t, s, http.MethodGet, "/v1/transactions?limit=0", nil, nil); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid limit, got %d", code)
+	}
+	if code := doRequest(t, s, http.MethodGet, "/v1/transactions?offset="+strconv.Itoa(MaxOffset+1), nil, nil); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an offset above the maximum, got %d", code)
+	}
+}
+
+func TestServer_Privacy(t *testing.T) {
+	s, _ := newTestServer(t, testutil.NewChain(), Config{})
+	defer s.Close()
+
+	var report base.PrivacyReport
+	code := doRequest(t, s, http.MethodGet, "/v1/"+iwallet.CtMock.CurrencyCode()+"/privacy", nil, &report)
+	if code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", code)
+	}
+	if report.Score != 100 || report.Utxos != 0 {
+		t.Errorf("Expected a perfect score for an empty wallet, got %+v", report)
+	}
+}
+
+func TestServer_CORS(t *testing.T) {
+	s, _ := newTestServer(t, testutil.NewChain(), Config{AllowedOrigins: []string{"https://example.com"}})
+	defer s.Close()
+
+	for _, test := range []struct {
+		origin  string
+		allowed bool
+	}{
+		{"https://example.com", true},
+		{"https://evil.com", false},
+	} {
+		req := httptest.NewRequest(http.MethodOptions, "/v1/transactions", nil)
+		req.Header.Set("Origin", test.origin)
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, req)
+
+		allowed := rec.Header().Get("Access-Control-Allow-Origin") == test.origin
+		if allowed != test.allowed {
+			t.Errorf("Origin %s: expected allowed %v", test.origin, test.allowed)
+		}
+		if test.allowed && rec.Code != http.StatusNoContent {
+			t.Errorf("Expected 204 for preflight, got %d", rec.Code)
+		}
+	}
+}
+
+func TestServer_Websocket(t *testing.T) {
+	s, tw := newTestServer(t, testutil.NewChain(), Config{})
+	defer s.Close()
+
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/v1/ws"
+	if _, _, err := websocket.DefaultDialer.Dial(wsURL, nil); err == nil {
+		t.Error("Expected dialing without the api token to fail")
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?access_token="+testAPIToken, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Wait for the server to register the client.
+	err = testutil.WaitFor(time.Second*10, func() bool {
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		return len(s.clients) == 1
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tw.txChan <- multiwallet.CoinTransaction{
+		CoinType:    iwallet.CtMock,
+		Transaction: iwallet.Transaction{ID: "abc"},
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second * 10))
+	var evt Event
+	if err := conn.ReadJSON(&evt); err != nil {
+		t.Fatal(err)
+	}
+	if evt.Type != "transaction" || evt.Transaction == nil || evt.Transaction.ID != "abc" || evt.Transaction.Coin != iwallet.CtMock.CurrencyCode() {
+		t.Errorf("Unexpected event %+v", evt)
+	}
+}
+
+func TestServer_Auth(t *testing.T) {
+	s, _ := newTestServer(t, testutil.NewChain(), Config{AllowedOrigins: []string{"https://app.example.net"}})
+	defer s.Close()
+
+	// httptest requests are to example.com.
+	spendPath := "/v1/" + iwallet.CtMock.CurrencyCode() + "/spend"
+	body := `{"address":"` + strings.Repeat("ab", 20) + `","amount":"1000"}`
+	for _, test := range []struct {
+		name        string
+		method      string
+		path        string
+		auth        string
+		contentType string
+		origin      string
+		code        int
+	}{
+		{"no token", http.MethodGet, "/v1/transactions", "", "", "", http.StatusUnauthorized},
+		{"wrong token", http.MethodGet, "/v1/transactions", "Bearer wrong", "", "", http.StatusUnauthorized},
+		{"not bearer", http.MethodGet, "/v1/transactions", testAPIToken, "", "", http.StatusUnauthorized},
+		{"query token", http.MethodGet, "/v1/transactions?access_token=" + testAPIToken, "", "", "", http.StatusUnauthorized},
+		{"form post", http.MethodPost, spendPath, "Bearer " + testAPIToken, "application/x-www-form-urlencoded", "", http.StatusUnsupportedMediaType},
+		{"no content type", http.MethodPost, spendPath, "Bearer " + testAPIToken, "", "", http.StatusUnsupportedMediaType},
+		{"other origin", http.MethodPost, spendPath, "Bearer " + testAPIToken, "application/json", "https://evil.com", http.StatusForbidden},
+		{"allowed origin", http.MethodGet, "/v1/transactions", "Bearer " + testAPIToken, "", "https://app.example.net", http.StatusOK},
+		{"same origin", http.MethodGet, "/v1/transactions", "Bearer " + testAPIToken, "", "http://example.com", http.StatusOK},
+	} {
+		req := httptest.NewRequest(test.method, test.path, strings.NewReader(body))
+		if test.auth != "" {
+			req.Header.Set("Authorization", test.auth)
+		}
+		if test.contentType != "" {
+			req.Header.Set("Content-Type", test.contentType)
+		}
+		if test.origin != "" {
+			req.Header.Set("Origin", test.origin)
+		}
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, req)
+		if rec.Code != test.code {
+			t.Errorf("%s: expected %d, got %d", test.name, test.code, rec.Code)
+		}
+	}
+
+	// Without a token nothing is served.
+	noToken := NewServer(&testWallets{}, Config{})
+	if err := noToken.ListenAndServe(); err != ErrNoAPIToken {
+		t.Errorf("Expected ErrNoAPIToken, got %v", err)
+	}
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/v1/transactions", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	noToken.Handler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a configured token, got %d", rec.Code)
+	}
+}
+
+func TestNewServer_ListenAddr(t *testing.T) {
+	for addr, expected := range map[string]string{
+		"":             DefaultListenAddr,
+		":9000":        "127.0.0.1:9000",
+		"0.0.0.0:9000": "0.0.0.0:9000",
+	} {
+		if s := NewServer(&testWallets{}, Config{ListenAddr: addr}); s.cfg.ListenAddr != expected {
+			t.Errorf("%q: expected %s, got %s", addr, expected, s.cfg.ListenAddr)
+		}
+	}
+}
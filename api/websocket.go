@@ -0,0 +1,134 @@
+package api
+
+import (
+	"github.com/cpacia/multiwallet"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// wsSendBuffer is the number of events queued for a websocket client.
+	// Clients which fall further behind are disconnected so they can't
+	// block the wallets.
+	wsSendBuffer = 64
+
+	wsWriteTimeout = time.Second * 10
+	wsPingInterval = time.Second * 30
+)
+
+// Event is a message pushed to websocket clients.
+type Event struct {
+	Type        string       `json:"type"`
+	Transaction *Transaction `json:"transaction,omitempty"`
+}
+
+type wsClient struct {
+	conn      *websocket.Conn
+	send      chan Event
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func (c *wsClient) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// writeLoop writes the client's events and keeps the connection alive
+// with pings.
+func (c *wsClient) writeLoop() {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	defer c.close()
+
+	for {
+		select {
+		case evt := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := c.conn.WriteJSON(evt); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// readLoop discards messages from the client until the connection closes.
+func (c *wsClient) readLoop() {
+	defer c.close()
+	for {
+		if _, _, err := c.conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) handleWebsocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already replied with an error.
+		return
+	}
+	c := &wsClient{
+		conn: conn,
+		send: make(chan Event, wsSendBuffer),
+		done: make(chan struct{}),
+	}
+
+	s.mtx.Lock()
+	select {
+	case <-s.shutdown:
+		s.mtx.Unlock()
+		conn.Close()
+		return
+	default:
+	}
+	s.clients[c] = struct{}{}
+	s.mtx.Unlock()
+
+	go c.writeLoop()
+	c.readLoop()
+
+	s.mtx.Lock()
+	delete(s.clients, c)
+	s.mtx.Unlock()
+}
+
+// pushTransactions sends each transaction from the wallets to every
+// websocket client. The multiwallet's subscriptions can't be cancelled so
+// once the server is closed the transactions are drained instead, or the
+// wallets would block.
+func (s *Server) pushTransactions(txChan <-chan multiwallet.CoinTransaction) {
+	for {
+		select {
+		case tx := <-txChan:
+			evt := Event{
+				Type:        "transaction",
+				Transaction: &Transaction{Coin: tx.CoinType.CurrencyCode(), Transaction: tx.Transaction},
+			}
+			s.mtx.Lock()
+			for c := range s.clients {
+				select {
+				case c.send <- evt:
+				default:
+					s.logger.Warningf("Disconnecting websocket client %s which fell behind", c.conn.RemoteAddr())
+					c.close()
+				}
+			}
+			s.mtx.Unlock()
+		case <-s.shutdown:
+			for range txChan {
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,817 @@
+// Package atomicswap trades coins between two of the wallet's UTXO coins
+// and another party without a trusted intermediary. Each side locks its
+// coins in an HTLC (see base.HTLC) on its own chain using the same secret
+// hash:
+//
+//  1. The participant calls NewParticipant and gives the initiator its
+//     public key.
+//  2. The initiator calls Initiate, which generates the secret and funds a
+//     contract paying the participant, refundable after 48 hours. The
+//     contract and its txid are sent to the participant.
+//  3. The participant calls Participate with them. Once the initiator's
+//     contract is audited it funds a contract with the same secret hash
+//     paying the initiator, refundable after 24 hours, and sends it back.
+//  4. The initiator calls Redeem with the participant's contract, which
+//     reveals the secret on chain.
+//  5. The participant's Manager sees the redemption, extracts the secret
+//     and redeems the initiator's contract.
+//
+// Contracts which are never redeemed are refunded once their lock time
+// passes. Swaps and their secrets are kept in the database so a Manager
+// resumes them after a restart. Each swap's key is derived from the
+// keychain of the wallet's own coin and only its public key is saved, so
+// that wallet must be unlocked for the Manager to act on the swap.
+package atomicswap
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcutil"
+	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/multiwallet/database"
+	"github.com/cpacia/multiwallet/log"
+	iwallet "github.com/cpacia/wallet-interface"
+	"gorm.io/gorm"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// InitiatorLockTime is how long the initiator's contract is locked
+	// for and ParticipantLockTime the participant's. The participant's
+	// must expire first so the initiator can't wait for it to be
+	// refunded and then redeem with the secret.
+	InitiatorLockTime   = time.Hour * 48
+	ParticipantLockTime = time.Hour * 24
+
+	// minLockTimeGap is how much later than its own contract the
+	// participant requires the initiator's contract to expire. It's the
+	// time the participant has to redeem once the secret is revealed.
+	minLockTimeGap = time.Hour * 12
+
+	// minRedeemWindow is how long before the participant's contract
+	// expires the initiator must redeem it.
+	minRedeemWindow = time.Hour * 2
+
+	// pollInterval is how often the Manager checks for revealed secrets
+	// and expired contracts.
+	pollInterval = time.Minute
+
+	// actionFeeLevel is the fee level of the redeems and refunds the
+	// Manager makes on its own, which are time sensitive.
+	actionFeeLevel = iwallet.FlPriority
+)
+
+var (
+	// ErrUnknownWallet is returned for a coin the Manager has no wallet
+	// for.
+	ErrUnknownWallet = errors.New("no wallet for atomic swap coin")
+
+	// ErrSwapNotFound is returned for an unknown swap ID.
+	ErrSwapNotFound = errors.New("atomic swap not found")
+
+	// ErrInvalidState is returned when a swap isn't at the step the
+	// call is for.
+	ErrInvalidState = errors.New("atomic swap is not in the expected state")
+
+	// ErrContractRejected is returned when the counterparty's contract
+	// fails the audit. The error wrapping it has the reason.
+	ErrContractRejected = errors.New("counterparty contract rejected")
+)
+
+// Role is which side of a swap the wallet is.
+type Role string
+
+const (
+	// RoleInitiator generates the secret and locks its coins first.
+	RoleInitiator Role = "initiator"
+
+	// RoleParticipant locks its coins once it has audited the
+	// initiator's contract.
+	RoleParticipant Role = "participant"
+)
+
+// State is the progress of a swap.
+type State string
+
+const (
+	// StateNew swaps have a key but no contract has been funded.
+	StateNew State = "new"
+
+	// StateInitiated swaps have funded the initiator's contract.
+	StateInitiated State = "initiated"
+
+	// StateParticipated swaps have funded the participant's contract.
+	StateParticipated State = "participated"
+
+	// StateRedeemed swaps have redeemed the counterparty's contract.
+	StateRedeemed State = "redeemed"
+
+	// StateRefunded swaps have refunded the wallet's own contract.
+	StateRefunded State = "refunded"
+
+	// StateFailed swaps failed before their contract was funded. Error
+	// is set to the reason.
+	StateFailed State = "failed"
+)
+
+// Wallet is the part of a wallet used for atomic swaps. Contracts are
+// funded with Spend and the wallet watches its own contract's address so
+// the counterparty's redemption is seen.
+type Wallet interface {
+	base.HTLCWallet
+
+	Begin() (iwallet.Tx, error)
+	Spend(wtx iwallet.Tx, to iwallet.Address, amt iwallet.Amount, feeLevel iwallet.FeeLevel) (iwallet.TransactionID, error)
+	WatchAddress(wtx iwallet.Tx, addrs ...iwallet.Address) error
+	GetTransaction(id iwallet.TransactionID) (iwallet.Transaction, error)
+	GetAddressTransactions(addr iwallet.Address) ([]iwallet.Transaction, error)
+	GetRawTransaction(id iwallet.TransactionID) ([]byte, error)
+}
+
+// Swap is an atomic swap of OwnAmount of OwnCoin for OtherAmount of
+// OtherCoin. The own contract is the one the wallet funds, the other
+// contract the counterparty's. PublicKey is the wallet's key in both.
+type Swap struct {
+	ID                   string
+	Role                 Role
+	State                State
+	OwnCoin              iwallet.CoinType
+	OtherCoin            iwallet.CoinType
+	OwnAmount            iwallet.Amount
+	OtherAmount          iwallet.Amount
+	PublicKey            []byte
+	SecretHash           []byte
+	OwnContract          []byte
+	OwnContractAddress   iwallet.Address
+	OwnContractTxid      iwallet.TransactionID
+	OtherContract        []byte
+	OtherContractAddress iwallet.Address
+	OtherContractTxid    iwallet.TransactionID
+	RedeemTxid           iwallet.TransactionID
+	RefundTxid           iwallet.TransactionID
+	LockTime             time.Time
+	Error                string
+	CreatedAt            time.Time
+	UpdatedAt            time.Time
+}
+
+// UpdatedEvent is emitted each time a swap changes state.
+type UpdatedEvent struct {
+	Swap Swap
+}
+
+// Manager runs atomic swaps between its wallets. The participant's
+// redemption depends on HandleTransaction being called with each
+// transaction pushed by the wallets, with Poll as a fallback.
+//
+// Events are emitted on Bus as *UpdatedEvent.
+type Manager struct {
+	Bus base.Bus
+
+	db      database.Database
+	wallets map[iwallet.CoinType]Wallet
+	logger  log.Logger
+
+	shutdownMtx sync.Mutex
+	shutdown    chan struct{}
+
+	// mtx serializes changes to swaps so a redeem or refund isn't made
+	// twice by HandleTransaction and Poll.
+	mtx sync.Mutex
+}
+
+// NewManager returns a new Manager swapping between the wallets.
+func NewManager(db database.Database, logger log.Logger, wallets map[iwallet.CoinType]Wallet) *Manager {
+	if logger == nil {
+		logger = log.New("atomicswap")
+	}
+	return &Manager{
+		Bus:      base.NewBus(),
+		db:       db,
+		wallets:  wallets,
+		logger:   logger.Module("atomicswap"),
+		shutdown: make(chan struct{}),
+	}
+}
+
+// Start resumes the swaps in progress and then polls them in the
+// background until Stop is called. The Manager can be started again once
+// it's stopped.
+func (m *Manager) Start() {
+	m.shutdownMtx.Lock()
+	shutdown := m.shutdown
+	m.shutdownMtx.Unlock()
+
+	go m.pollLoop(shutdown)
+}
+
+func (m *Manager) pollLoop(shutdown <-chan struct{}) {
+	if err := m.Poll(); err != nil {
+		m.logger.Errorf("Error resuming atomic swaps: %s", err)
+	}
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := m.Poll(); err != nil {
+				m.logger.Errorf("Error polling atomic swaps: %s", err)
+			}
+		case <-shutdown:
+			return
+		}
+	}
+}
+
+// Stop will shutdown the Manager.
+func (m *Manager) Stop() {
+	m.shutdownMtx.Lock()
+	defer m.shutdownMtx.Unlock()
+
+	close(m.shutdown)
+	m.shutdown = make(chan struct{})
+}
+
+// NewParticipant starts a swap as the participant. The returned swap's
+// PublicKey must be given to the initiator for its contract.
+func (m *Manager) NewParticipant(ownCoin, otherCoin iwallet.CoinType, ownAmount, otherAmount iwallet.Amount) (Swap, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	record, key, err := m.newRecord(RoleParticipant, ownCoin, otherCoin, ownAmount, otherAmount)
+	if err != nil {
+		return Swap{}, err
+	}
+	base.ZeroPrivKey(key)
+	if err := m.save(record); err != nil {
+		return Swap{}, err
+	}
+	return swapFromRecord(record), nil
+}
+
+// Initiate starts a swap as the initiator, funding a contract which pays
+// the participant's key if it reveals the secret. The returned swap's
+// OwnContract and OwnContractTxid must be given to the participant.
+func (m *Manager) Initiate(ownCoin, otherCoin iwallet.CoinType, ownAmount, otherAmount iwallet.Amount, participantKey *btcec.PublicKey, feeLevel iwallet.FeeLevel) (Swap, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	record, key, err := m.newRecord(RoleInitiator, ownCoin, otherCoin, ownAmount, otherAmount)
+	if err != nil {
+		return Swap{}, err
+	}
+	defer base.ZeroPrivKey(key)
+	secret := make([]byte, base.HTLCSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return Swap{}, err
+	}
+	secretHash := sha256.Sum256(secret)
+	record.Secret = hex.EncodeToString(secret)
+	record.SecretHash = hex.EncodeToString(secretHash[:])
+
+	contract, err := base.NewHTLC(secretHash[:], participantKey, key.PubKey(), time.Now().Add(InitiatorLockTime).Unix())
+	if err != nil {
+		return Swap{}, err
+	}
+	if err := m.fundContract(record, contract, feeLevel); err != nil {
+		return swapFromRecord(record), err
+	}
+	return swapFromRecord(record), nil
+}
+
+// Participate audits the initiator's contract and funds the participant's
+// contract with the same secret hash. The initiator's contract must pay
+// the swap's key at least OtherAmount, be confirmed and expire well after
+// the participant's. The returned swap's OwnContract and OwnContractTxid
+// must be given to the initiator.
+func (m *Manager) Participate(id string, initiatorContract []byte, contractTxid iwallet.TransactionID, feeLevel iwallet.FeeLevel) (Swap, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	record, err := m.record(id)
+	if err != nil {
+		return Swap{}, err
+	}
+	if Role(record.Role) != RoleParticipant || State(record.State) != StateNew {
+		return Swap{}, ErrInvalidState
+	}
+	key, err := m.recordKey(record)
+	if err != nil {
+		return Swap{}, err
+	}
+	defer base.ZeroPrivKey(key)
+
+	lockTime := time.Now().Add(ParticipantLockTime)
+	other, addr, err := m.auditContract(record, initiatorContract, contractTxid, key, lockTime.Add(minLockTimeGap))
+	if err != nil {
+		return Swap{}, err
+	}
+	record.SecretHash = hex.EncodeToString(other.SecretHash[:])
+	record.OtherContract = initiatorContract
+	record.OtherContractAddr = addr.String()
+	record.OtherContractTxid = contractTxid.String()
+
+	// The initiator's refund key is the one it redeems with.
+	contract := base.HTLC{
+		SecretHash: other.SecretHash,
+		Recipient:  other.Refund,
+		LockTime:   lockTime.Unix(),
+	}
+	copy(contract.Refund[:], btcutil.Hash160(key.PubKey().SerializeCompressed()))
+	if err := m.fundContract(record, contract, feeLevel); err != nil {
+		return swapFromRecord(record), err
+	}
+	return swapFromRecord(record), nil
+}
+
+// Redeem audits the participant's contract and redeems it with the
+// secret, completing the initiator's side of the swap. The contract must
+// pay the swap's key at least OtherAmount, be confirmed and not expire for
+// at least two hours.
+func (m *Manager) Redeem(id string, participantContract []byte, contractTxid iwallet.TransactionID, feeLevel iwallet.FeeLevel) (Swap, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	record, err := m.record(id)
+	if err != nil {
+		return Swap{}, err
+	}
+	if Role(record.Role) != RoleInitiator || State(record.State) != StateInitiated {
+		return Swap{}, ErrInvalidState
+	}
+	key, err := m.recordKey(record)
+	if err != nil {
+		return Swap{}, err
+	}
+	defer base.ZeroPrivKey(key)
+	other, addr, err := m.auditContract(record, participantContract, contractTxid, key, time.Now().Add(minRedeemWindow))
+	if err != nil {
+		return Swap{}, err
+	}
+	if hex.EncodeToString(other.SecretHash[:]) != record.SecretHash {
+		return Swap{}, fmt.Errorf("%w: secret hash does not match", ErrContractRejected)
+	}
+	record.OtherContract = participantContract
+	record.OtherContractAddr = addr.String()
+	record.OtherContractTxid = contractTxid.String()
+
+	if err := m.redeem(record, feeLevel); err != nil {
+		return Swap{}, err
+	}
+	return swapFromRecord(record), nil
+}
+
+// HandleTransaction redeems the initiator's contract of any participant
+// swap whose own contract the transaction redeems, using the secret it
+// reveals. It should be called with each transaction pushed by the
+// wallets.
+func (m *Manager) HandleTransaction(coinType iwallet.CoinType, tx iwallet.Transaction) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	records, err := m.records()
+	if err != nil {
+		return err
+	}
+	for i := range records {
+		record := &records[i]
+		if record.OwnCoin != coinType.CurrencyCode() || !waitingForSecret(record) {
+			continue
+		}
+		for _, from := range tx.From {
+			if from.Address.String() != record.OwnContractAddr {
+				continue
+			}
+			if err := m.handleContractSpend(record, tx.ID); err != nil {
+				m.logger.Errorf("Error redeeming atomic swap %s: %s", record.ID, err)
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// Poll moves each swap in progress on: participants look up whether their
+// contract has been redeemed while they weren't watching, secrets which
+// have been learned but not yet used are redeemed with, and contracts past
+// their lock time are refunded.
+func (m *Manager) Poll() error {
+	return m.poll(time.Now())
+}
+
+func (m *Manager) poll(now time.Time) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	records, err := m.records()
+	if err != nil {
+		return err
+	}
+	for i := range records {
+		record := &records[i]
+		if err := m.pollRecord(record, now); err != nil {
+			m.logger.Errorf("Error polling atomic swap %s: %s", record.ID, err)
+		}
+	}
+	return nil
+}
+
+func (m *Manager) pollRecord(record *database.AtomicSwapRecord, now time.Time) error {
+	if waitingForSecret(record) {
+		wallet, ok := m.wallets[iwallet.CoinType(record.OwnCoin)]
+		if !ok {
+			return ErrUnknownWallet
+		}
+		txs, err := wallet.GetAddressTransactions(iwallet.NewAddress(record.OwnContractAddr, iwallet.CoinType(record.OwnCoin)))
+		if err != nil {
+			return err
+		}
+		for _, tx := range txs {
+			if !waitingForSecret(record) {
+				break
+			}
+			for _, from := range tx.From {
+				if from.Address.String() == record.OwnContractAddr {
+					if err := m.handleContractSpend(record, tx.ID); err != nil {
+						return err
+					}
+					break
+				}
+			}
+		}
+	}
+
+	// A participant which learned the secret but crashed before
+	// redeeming.
+	if State(record.State) == StateParticipated && record.Secret != "" {
+		return m.redeem(record, actionFeeLevel)
+	}
+
+	if (State(record.State) == StateInitiated || State(record.State) == StateParticipated) &&
+		record.RefundTxid == "" && !now.Before(record.LockTime) {
+		return m.refund(record)
+	}
+	return nil
+}
+
+// waitingForSecret returns whether the swap is a participant's which
+// hasn't yet learned the secret.
+func waitingForSecret(record *database.AtomicSwapRecord) bool {
+	return Role(record.Role) == RoleParticipant && State(record.State) == StateParticipated && record.Secret == ""
+}
+
+// handleContractSpend extracts the secret from a transaction spending the
+// participant's contract and redeems the initiator's contract with it.
+// Refunds reveal nothing and are ignored.
+func (m *Manager) handleContractSpend(record *database.AtomicSwapRecord, txid iwallet.TransactionID) error {
+	wallet, ok := m.wallets[iwallet.CoinType(record.OwnCoin)]
+	if !ok {
+		return ErrUnknownWallet
+	}
+	raw, err := wallet.GetRawTransaction(txid)
+	if err != nil {
+		return err
+	}
+	secret, err := base.ExtractHTLCSecret(raw, record.OwnContract)
+	if errors.Is(err, base.ErrNoHTLCSecret) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// The secret is saved first so it isn't lost if the redeem fails.
+	record.Secret = hex.EncodeToString(secret)
+	if err := m.save(record); err != nil {
+		return err
+	}
+	return m.redeem(record, actionFeeLevel)
+}
+
+// newRecord returns a swap record with the next swap key of the own coin's
+// wallet. It isn't saved. The caller must zero the key.
+func (m *Manager) newRecord(role Role, ownCoin, otherCoin iwallet.CoinType, ownAmount, otherAmount iwallet.Amount) (*database.AtomicSwapRecord, *btcec.PrivateKey, error) {
+	if ownCoin == otherCoin {
+		return nil, nil, errors.New("can't swap a coin for itself")
+	}
+	if m.wallets[ownCoin] == nil || m.wallets[otherCoin] == nil {
+		return nil, nil, ErrUnknownWallet
+	}
+	zero := iwallet.NewAmount(0)
+	if ownAmount.Cmp(zero) <= 0 || otherAmount.Cmp(zero) <= 0 {
+		return nil, nil, errors.New("swap amounts must be positive")
+	}
+	index, err := m.nextKeyIndex(ownCoin)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := m.wallets[ownCoin].SwapKey(index)
+	if err != nil {
+		return nil, nil, err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		base.ZeroPrivKey(key)
+		return nil, nil, err
+	}
+	now := time.Now()
+	return &database.AtomicSwapRecord{
+		ID:          hex.EncodeToString(id),
+		Role:        string(role),
+		State:       string(StateNew),
+		OwnCoin:     ownCoin.CurrencyCode(),
+		OtherCoin:   otherCoin.CurrencyCode(),
+		OwnAmount:   ownAmount.String(),
+		OtherAmount: otherAmount.String(),
+		KeyIndex:    index,
+		PublicKey:   hex.EncodeToString(key.PubKey().SerializeCompressed()),
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}, key, nil
+}
+
+// fundContract watches the contract's address and sends OwnAmount to it
+// from the own wallet. The record is saved before the contract is funded
+// so the key needed to refund it is never lost.
+func (m *Manager) fundContract(record *database.AtomicSwapRecord, contract base.HTLC, feeLevel iwallet.FeeLevel) error {
+	wallet := m.wallets[iwallet.CoinType(record.OwnCoin)]
+	script, err := contract.Script()
+	if err != nil {
+		return err
+	}
+	addr, err := wallet.HTLCAddress(script)
+	if err != nil {
+		return err
+	}
+	record.OwnContract = script
+	record.OwnContractAddr = addr.String()
+	record.LockTime = time.Unix(contract.LockTime, 0)
+	if err := m.save(record); err != nil {
+		return err
+	}
+
+	fail := func(err error) error {
+		record.State, record.Error = string(StateFailed), err.Error()
+		if serr := m.save(record); serr != nil {
+			m.logger.Errorf("Error saving failed atomic swap %s: %s", record.ID, serr)
+		}
+		return err
+	}
+
+	wtx, err := wallet.Begin()
+	if err != nil {
+		return fail(err)
+	}
+	if err := wallet.WatchAddress(wtx, addr); err != nil {
+		wtx.Rollback()
+		return fail(err)
+	}
+	if err := wtx.Commit(); err != nil {
+		return fail(err)
+	}
+
+	wtx, err = wallet.Begin()
+	if err != nil {
+		return fail(err)
+	}
+	txid, err := wallet.Spend(wtx, addr, iwallet.NewAmount(record.OwnAmount), feeLevel)
+	if err != nil {
+		wtx.Rollback()
+		return fail(err)
+	}
+	if err := wtx.Commit(); err != nil {
+		return fail(err)
+	}
+
+	record.OwnContractTxid = txid.String()
+	if Role(record.Role) == RoleInitiator {
+		record.State = string(StateInitiated)
+	} else {
+		record.State = string(StateParticipated)
+	}
+	return m.save(record)
+}
+
+// auditContract checks the counterparty's contract pays the swap's key at
+// least OtherAmount in a confirmed transaction and can't be refunded
+// before minLockTime.
+func (m *Manager) auditContract(record *database.AtomicSwapRecord, script []byte, txid iwallet.TransactionID, key *btcec.PrivateKey, minLockTime time.Time) (base.HTLC, iwallet.Address, error) {
+	wallet := m.wallets[iwallet.CoinType(record.OtherCoin)]
+	if wallet == nil {
+		return base.HTLC{}, iwallet.Address{}, ErrUnknownWallet
+	}
+	contract, err := base.ParseHTLCScript(script)
+	if err != nil {
+		return base.HTLC{}, iwallet.Address{}, fmt.Errorf("%w: %s", ErrContractRejected, err)
+	}
+	var ownHash [20]byte
+	copy(ownHash[:], btcutil.Hash160(key.PubKey().SerializeCompressed()))
+	if contract.Recipient != ownHash {
+		return contract, iwallet.Address{}, fmt.Errorf("%w: contract does not pay the swap key", ErrContractRejected)
+	}
+	if time.Unix(contract.LockTime, 0).Before(minLockTime) {
+		return contract, iwallet.Address{}, fmt.Errorf("%w: lock time %s is too soon", ErrContractRejected, time.Unix(contract.LockTime, 0))
+	}
+
+	addr, err := wallet.HTLCAddress(script)
+	if err != nil {
+		return contract, addr, err
+	}
+	tx, err := wallet.GetTransaction(txid)
+	if err != nil {
+		return contract, addr, err
+	}
+	if tx.Height == 0 {
+		return contract, addr, fmt.Errorf("%w: contract transaction is unconfirmed", ErrContractRejected)
+	}
+	out, err := base.HTLCOutput(tx, addr)
+	if err != nil {
+		return contract, addr, fmt.Errorf("%w: %s", ErrContractRejected, err)
+	}
+	if out.Amount.Cmp(iwallet.NewAmount(record.OtherAmount)) < 0 {
+		return contract, addr, fmt.Errorf("%w: contract pays %s, expected %s", ErrContractRejected, out.Amount, record.OtherAmount)
+	}
+	return contract, addr, nil
+}
+
+// redeem spends the counterparty's contract with the secret.
+func (m *Manager) redeem(record *database.AtomicSwapRecord, feeLevel iwallet.FeeLevel) error {
+	wallet, ok := m.wallets[iwallet.CoinType(record.OtherCoin)]
+	if !ok {
+		return ErrUnknownWallet
+	}
+	secret, err := hex.DecodeString(record.Secret)
+	if err != nil {
+		return err
+	}
+	txid, err := m.spendContract(wallet, record, record.OtherContract, iwallet.TransactionID(record.OtherContractTxid), secret, feeLevel)
+	if err != nil {
+		return err
+	}
+	record.State, record.RedeemTxid = string(StateRedeemed), txid.String()
+	return m.save(record)
+}
+
+// refund spends the wallet's own contract back to itself.
+func (m *Manager) refund(record *database.AtomicSwapRecord) error {
+	wallet, ok := m.wallets[iwallet.CoinType(record.OwnCoin)]
+	if !ok {
+		return ErrUnknownWallet
+	}
+	txid, err := m.spendContract(wallet, record, record.OwnContract, iwallet.TransactionID(record.OwnContractTxid), nil, actionFeeLevel)
+	if err != nil {
+		return err
+	}
+	record.State, record.RefundTxid = string(StateRefunded), txid.String()
+	return m.save(record)
+}
+
+func (m *Manager) spendContract(wallet Wallet, record *database.AtomicSwapRecord, script []byte, contractTxid iwallet.TransactionID, secret []byte, feeLevel iwallet.FeeLevel) (iwallet.TransactionID, error) {
+	key, err := m.recordKey(record)
+	if err != nil {
+		return "", err
+	}
+	defer base.ZeroPrivKey(key)
+	contractTx, err := wallet.GetTransaction(contractTxid)
+	if err != nil {
+		return "", err
+	}
+	wtx, err := wallet.Begin()
+	if err != nil {
+		return "", err
+	}
+	txid, err := wallet.SpendHTLC(wtx, contractTx, script, secret, *key, feeLevel)
+	if err != nil {
+		wtx.Rollback()
+		return "", err
+	}
+	if err := wtx.Commit(); err != nil {
+		return "", err
+	}
+	return txid, nil
+}
+
+// Get returns the swap with the given ID.
+func (m *Manager) Get(id string) (Swap, error) {
+	record, err := m.record(id)
+	if err != nil {
+		return Swap{}, err
+	}
+	return swapFromRecord(record), nil
+}
+
+// List returns every swap, newest first.
+func (m *Manager) List() ([]Swap, error) {
+	records, err := m.records()
+	if err != nil {
+		return nil, err
+	}
+	swaps := make([]Swap, 0, len(records))
+	for i := range records {
+		swaps = append(swaps, swapFromRecord(&records[i]))
+	}
+	sort.Slice(swaps, func(i, j int) bool {
+		return swaps[i].CreatedAt.After(swaps[j].CreatedAt)
+	})
+	return swaps, nil
+}
+
+func (m *Manager) record(id string) (*database.AtomicSwapRecord, error) {
+	var record database.AtomicSwapRecord
+	err := m.db.View(func(dbtx database.Tx) error {
+		return dbtx.Read().Where("id=?", id).First(&record).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrSwapNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func (m *Manager) records() ([]database.AtomicSwapRecord, error) {
+	var records []database.AtomicSwapRecord
+	err := m.db.View(func(dbtx database.Tx) error {
+		return dbtx.Read().Find(&records).Error
+	})
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	return records, nil
+}
+
+// save saves the record and emits an UpdatedEvent for it.
+func (m *Manager) save(record *database.AtomicSwapRecord) error {
+	record.UpdatedAt = time.Now()
+	err := m.db.Update(func(dbtx database.Tx) error {
+		return dbtx.Save(record)
+	})
+	if err != nil {
+		return err
+	}
+	m.logger.Infof("Atomic swap %s of %s for %s is %s", record.ID, record.OwnCoin, record.OtherCoin, record.State)
+	m.Bus.Emit(&UpdatedEvent{Swap: swapFromRecord(record)})
+	return nil
+}
+
+// nextKeyIndex returns the index of the coin's next swap key. Indexes are
+// never reused once a swap is saved, even if it fails.
+func (m *Manager) nextKeyIndex(coin iwallet.CoinType) (uint32, error) {
+	records, err := m.records()
+	if err != nil {
+		return 0, err
+	}
+	var next uint32
+	for _, record := range records {
+		if record.OwnCoin == coin.CurrencyCode() && record.KeyIndex >= next {
+			next = record.KeyIndex + 1
+		}
+	}
+	return next, nil
+}
+
+// recordKey derives the swap's key from the own coin's wallet. It fails
+// with base.ErrEncryptedKeychain while the wallet is locked. The caller
+// must zero the key.
+func (m *Manager) recordKey(record *database.AtomicSwapRecord) (*btcec.PrivateKey, error) {
+	wallet, ok := m.wallets[iwallet.CoinType(record.OwnCoin)]
+	if !ok {
+		return nil, ErrUnknownWallet
+	}
+	return wallet.SwapKey(record.KeyIndex)
+}
+
+func swapFromRecord(record *database.AtomicSwapRecord) Swap {
+	own, other := iwallet.CoinType(record.OwnCoin), iwallet.CoinType(record.OtherCoin)
+	s := Swap{
+		ID:                   record.ID,
+		Role:                 Role(record.Role),
+		State:                State(record.State),
+		OwnCoin:              own,
+		OtherCoin:            other,
+		OwnAmount:            iwallet.NewAmount(record.OwnAmount),
+		OtherAmount:          iwallet.NewAmount(record.OtherAmount),
+		OwnContract:          record.OwnContract,
+		OwnContractAddress:   iwallet.NewAddress(record.OwnContractAddr, own),
+		OwnContractTxid:      iwallet.TransactionID(record.OwnContractTxid),
+		OtherContract:        record.OtherContract,
+		OtherContractAddress: iwallet.NewAddress(record.OtherContractAddr, other),
+		OtherContractTxid:    iwallet.TransactionID(record.OtherContractTxid),
+		RedeemTxid:           iwallet.TransactionID(record.RedeemTxid),
+		RefundTxid:           iwallet.TransactionID(record.RefundTxid),
+		LockTime:             record.LockTime,
+		Error:                record.Error,
+		CreatedAt:            record.CreatedAt,
+		UpdatedAt:            record.UpdatedAt,
+	}
+	s.PublicKey, _ = hex.DecodeString(record.PublicKey)
+	s.SecretHash, _ = hex.DecodeString(record.SecretHash)
+	return s
+}
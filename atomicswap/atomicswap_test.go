@@ -0,0 +1,372 @@
+package atomicswap
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	hd "github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/multiwallet/database"
+	"github.com/cpacia/multiwallet/database/memorydb"
+	iwallet "github.com/cpacia/wallet-interface"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockChain holds the transactions of one coin shared by both parties'
+// wallets.
+type mockChain struct {
+	coin iwallet.CoinType
+	txs  map[iwallet.TransactionID]iwallet.Transaction
+	raw  map[iwallet.TransactionID][]byte
+}
+
+func newMockChain(coin iwallet.CoinType) *mockChain {
+	return &mockChain{
+		coin: coin,
+		txs:  make(map[iwallet.TransactionID]iwallet.Transaction),
+		raw:  make(map[iwallet.TransactionID][]byte),
+	}
+}
+
+type mockWallet struct {
+	mtx    sync.Mutex
+	chain  *mockChain
+	master *hd.ExtendedKey
+	locked bool
+}
+
+func newMockWallet(t *testing.T, chain *mockChain) *mockWallet {
+	seed, err := hd.GenerateSeed(hd.RecommendedSeedLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	master, err := hd.NewMaster(seed, &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &mockWallet{chain: chain, master: master}
+}
+
+func (w *mockWallet) SwapKey(index uint32) (*btcec.PrivateKey, error) {
+	if w.locked {
+		return nil, base.ErrEncryptedKeychain
+	}
+	child, err := w.master.Child(hd.HardenedKeyStart + index)
+	if err != nil {
+		return nil, err
+	}
+	return child.ECPrivKey()
+}
+
+func (w *mockWallet) Begin() (iwallet.Tx, error) {
+	w.mtx.Lock()
+	return base.NewDBTx(&w.mtx), nil
+}
+
+func (w *mockWallet) HTLCAddress(script []byte) (iwallet.Address, error) {
+	if _, err := base.ParseHTLCScript(script); err != nil {
+		return iwallet.Address{}, err
+	}
+	return iwallet.NewAddress(hex.EncodeToString(btcutil.Hash160(script)), w.chain.coin), nil
+}
+
+func (w *mockWallet) Spend(wtx iwallet.Tx, to iwallet.Address, amt iwallet.Amount, feeLevel iwallet.FeeLevel) (iwallet.TransactionID, error) {
+	var h chainhash.Hash
+	if _, err := rand.Read(h[:]); err != nil {
+		return "", err
+	}
+	txn := iwallet.Transaction{
+		ID:     iwallet.TransactionID(h.String()),
+		Height: 1,
+		To: []iwallet.SpendInfo{{
+			ID:      append(h[:], 0, 0, 0, 0),
+			Address: to,
+			Amount:  amt,
+		}},
+	}
+	wtx.(*base.DBTx).OnCommit = func() error {
+		w.chain.txs[txn.ID] = txn
+		return nil
+	}
+	return txn.ID, nil
+}
+
+func (w *mockWallet) SpendHTLC(wtx iwallet.Tx, contractTx iwallet.Transaction, script, secret []byte, key btcec.PrivateKey, feeLevel iwallet.FeeLevel) (iwallet.TransactionID, error) {
+	addr, err := w.HTLCAddress(script)
+	if err != nil {
+		return "", err
+	}
+	out, err := base.HTLCOutput(contractTx, addr)
+	if err != nil {
+		return "", err
+	}
+	sig, pubKey := make([]byte, 72), key.PubKey().SerializeCompressed()
+	var sigScript []byte
+	if secret != nil {
+		sigScript, err = base.HTLCRedeemSigScript(sig, pubKey, secret, script)
+	} else {
+		sigScript, err = base.HTLCRefundSigScript(sig, pubKey, script)
+	}
+	if err != nil {
+		return "", err
+	}
+	tx := wire.NewMsgTx(1)
+	tx.AddTxIn(wire.NewTxIn(&wire.OutPoint{}, sigScript, nil))
+	tx.AddTxOut(wire.NewTxOut(out.Amount.Int64(), []byte{0x51}))
+	var buf bytes.Buffer
+	if err := tx.Serialize(&buf); err != nil {
+		return "", err
+	}
+	txn := iwallet.Transaction{
+		ID:   iwallet.TransactionID(tx.TxHash().String()),
+		From: []iwallet.SpendInfo{out},
+	}
+	wtx.(*base.DBTx).OnCommit = func() error {
+		w.chain.txs[txn.ID] = txn
+		w.chain.raw[txn.ID] = buf.Bytes()
+		return nil
+	}
+	return txn.ID, nil
+}
+
+func (w *mockWallet) WatchAddress(wtx iwallet.Tx, addrs ...iwallet.Address) error {
+	return nil
+}
+
+func (w *mockWallet) GetTransaction(id iwallet.TransactionID) (iwallet.Transaction, error) {
+	txn, ok := w.chain.txs[id]
+	if !ok {
+		return txn, errors.New("not found")
+	}
+	return txn, nil
+}
+
+func (w *mockWallet) GetAddressTransactions(addr iwallet.Address) ([]iwallet.Transaction, error) {
+	var txs []iwallet.Transaction
+	for _, txn := range w.chain.txs {
+		for _, info := range append(txn.From, txn.To...) {
+			if info.Address.String() == addr.String() {
+				txs = append(txs, txn)
+				break
+			}
+		}
+	}
+	return txs, nil
+}
+
+func (w *mockWallet) GetRawTransaction(id iwallet.TransactionID) ([]byte, error) {
+	raw, ok := w.chain.raw[id]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return raw, nil
+}
+
+func newTestManager(t *testing.T, chains ...*mockChain) (*Manager, database.Database) {
+	db, err := memorydb.NewMemoryDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.InitializeDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+	wallets := make(map[iwallet.CoinType]Wallet)
+	for _, chain := range chains {
+		wallets[chain.coin] = newMockWallet(t, chain)
+	}
+	return NewManager(db, nil, wallets), db
+}
+
+func TestManager_Swap(t *testing.T) {
+	btc, ltc := newMockChain(iwallet.CtBitcoin), newMockChain(iwallet.CtLitecoin)
+	initiator, _ := newTestManager(t, btc, ltc)
+	participant, participantDB := newTestManager(t, btc, ltc)
+
+	// The participant trades 200 LTC sats for 100 BTC sats.
+	ps, err := participant.NewParticipant(iwallet.CtLitecoin, iwallet.CtBitcoin, iwallet.NewAmount(200), iwallet.NewAmount(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	participantKey, err := btcec.ParsePubKey(ps.PublicKey, btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	is, err := initiator.Initiate(iwallet.CtBitcoin, iwallet.CtLitecoin, iwallet.NewAmount(100), iwallet.NewAmount(200), participantKey, iwallet.FlNormal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if is.State != StateInitiated || is.OwnContractTxid == "" {
+		t.Fatalf("Unexpected initiated swap %+v", is)
+	}
+
+	// A participant expecting more than the contract pays rejects it.
+	greedy, err := participant.NewParticipant(iwallet.CtLitecoin, iwallet.CtBitcoin, iwallet.NewAmount(200), iwallet.NewAmount(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := participant.Participate(greedy.ID, is.OwnContract, is.OwnContractTxid, iwallet.FlNormal); !errors.Is(err, ErrContractRejected) {
+		t.Errorf("Expected ErrContractRejected, got %v", err)
+	}
+
+	ps, err = participant.Participate(ps.ID, is.OwnContract, is.OwnContractTxid, iwallet.FlNormal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ps.State != StateParticipated || !bytes.Equal(ps.SecretHash, is.SecretHash) {
+		t.Fatalf("Unexpected participated swap %+v", ps)
+	}
+	if !ps.LockTime.Before(is.LockTime) {
+		t.Errorf("Expected the participant's contract to expire first")
+	}
+
+	is, err = initiator.Redeem(is.ID, ps.OwnContract, ps.OwnContractTxid, iwallet.FlNormal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if is.State != StateRedeemed || ltc.raw[is.RedeemTxid] == nil {
+		t.Fatalf("Unexpected redeemed swap %+v", is)
+	}
+
+	// A participant restarted after the initiator redeemed finds the
+	// redemption and redeems the initiator's contract with its secret.
+	resumed := NewManager(participantDB, nil, participant.wallets)
+	if err := resumed.Poll(); err != nil {
+		t.Fatal(err)
+	}
+	ps, err = resumed.Get(ps.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ps.State != StateRedeemed {
+		t.Fatalf("Expected redeemed, got %s", ps.State)
+	}
+	raw := btc.raw[ps.RedeemTxid]
+	if _, err := base.ExtractHTLCSecret(raw, is.OwnContract); err != nil {
+		t.Errorf("Expected the initiator's contract to be redeemed with the secret: %s", err)
+	}
+
+	if _, err := initiator.Redeem(is.ID, ps.OwnContract, ps.OwnContractTxid, iwallet.FlNormal); err != ErrInvalidState {
+		t.Errorf("Expected ErrInvalidState, got %v", err)
+	}
+}
+
+func TestManager_Refund(t *testing.T) {
+	btc, ltc := newMockChain(iwallet.CtBitcoin), newMockChain(iwallet.CtLitecoin)
+	initiator, _ := newTestManager(t, btc, ltc)
+	participant, _ := newTestManager(t, btc, ltc)
+
+	ps, err := participant.NewParticipant(iwallet.CtLitecoin, iwallet.CtBitcoin, iwallet.NewAmount(200), iwallet.NewAmount(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	participantKey, err := btcec.ParsePubKey(ps.PublicKey, btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	is, err := initiator.Initiate(iwallet.CtBitcoin, iwallet.CtLitecoin, iwallet.NewAmount(100), iwallet.NewAmount(200), participantKey, iwallet.FlNormal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps, err = participant.Participate(ps.ID, is.OwnContract, is.OwnContractTxid, iwallet.FlNormal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The initiator never redeems. Nothing is refunded before the lock
+	// times.
+	if err := participant.poll(ps.LockTime.Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if ps, err = participant.Get(ps.ID); err != nil || ps.State != StateParticipated {
+		t.Fatalf("Expected participated, got %s, %v", ps.State, err)
+	}
+
+	if err := participant.poll(ps.LockTime); err != nil {
+		t.Fatal(err)
+	}
+	if ps, err = participant.Get(ps.ID); err != nil || ps.State != StateRefunded || ps.RefundTxid == "" {
+		t.Fatalf("Expected refunded, got %+v, %v", ps, err)
+	}
+	if _, err := base.ExtractHTLCSecret(ltc.raw[ps.RefundTxid], ps.OwnContract); !errors.Is(err, base.ErrNoHTLCSecret) {
+		t.Errorf("Expected a refund without the secret, got %v", err)
+	}
+
+	if err := initiator.poll(is.LockTime); err != nil {
+		t.Fatal(err)
+	}
+	if is, err = initiator.Get(is.ID); err != nil || is.State != StateRefunded || is.RefundTxid == "" {
+		t.Fatalf("Expected refunded, got %+v, %v", is, err)
+	}
+
+	swaps, err := initiator.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(swaps) != 1 || swaps[0].ID != is.ID {
+		t.Errorf("Unexpected swaps %+v", swaps)
+	}
+	if _, err := initiator.Get("unknown"); err != ErrSwapNotFound {
+		t.Errorf("Expected ErrSwapNotFound, got %v", err)
+	}
+}
+
+func TestManager_Locked(t *testing.T) {
+	btc, ltc := newMockChain(iwallet.CtBitcoin), newMockChain(iwallet.CtLitecoin)
+	participant, db := newTestManager(t, btc, ltc)
+
+	ps, err := participant.NewParticipant(iwallet.CtLitecoin, iwallet.CtBitcoin, iwallet.NewAmount(200), iwallet.NewAmount(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the public key is saved.
+	var record database.AtomicSwapRecord
+	err = db.View(func(dbtx database.Tx) error {
+		return dbtx.Read().Where("id=?", ps.ID).First(&record).Error
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := participant.wallets[iwallet.CtLitecoin].SwapKey(record.KeyIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ps.PublicKey, key.PubKey().SerializeCompressed()) {
+		t.Error("Expected the swap's public key to be the keychain's")
+	}
+
+	// Each swap gets its own key.
+	next, err := participant.NewParticipant(iwallet.CtLitecoin, iwallet.CtBitcoin, iwallet.NewAmount(200), iwallet.NewAmount(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(ps.PublicKey, next.PublicKey) {
+		t.Error("Expected a new key for each swap")
+	}
+
+	// Nothing can be done with the swap while the wallet is locked but
+	// it can still be read.
+	participant.wallets[iwallet.CtLitecoin].(*mockWallet).locked = true
+	if _, err := participant.Participate(ps.ID, nil, "", iwallet.FlNormal); !errors.Is(err, base.ErrEncryptedKeychain) {
+		t.Errorf("Expected ErrEncryptedKeychain, got %v", err)
+	}
+	if _, err := participant.NewParticipant(iwallet.CtLitecoin, iwallet.CtBitcoin, iwallet.NewAmount(200), iwallet.NewAmount(100)); !errors.Is(err, base.ErrEncryptedKeychain) {
+		t.Errorf("Expected ErrEncryptedKeychain, got %v", err)
+	}
+	got, err := participant.Get(ps.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.PublicKey, ps.PublicKey) {
+		t.Error("Expected the public key of a locked swap")
+	}
+}
@@ -0,0 +1,292 @@
+package base
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/cpacia/multiwallet/database"
+	"github.com/cpacia/multiwallet/log"
+	iwallet "github.com/cpacia/wallet-interface"
+	"gorm.io/gorm"
+	"time"
+)
+
+// AddressPolicy is whether spends to an address are allowed.
+type AddressPolicy string
+
+const (
+	// AddressAllowed addresses are on the allow list. Once any address
+	// is allowed the wallet only pays allowed addresses.
+	AddressAllowed AddressPolicy = "allow"
+
+	// AddressDenied addresses are never paid, such as those on a
+	// sanctions or known scam list.
+	AddressDenied AddressPolicy = "deny"
+)
+
+// ErrDestinationRejected is wrapped by every DestinationError so callers
+// can check for it with errors.Is.
+var ErrDestinationRejected = errors.New("destination rejected by address policy")
+
+// DestinationError is returned when a spend pays an address the wallet's
+// address policy doesn't permit. Denied is set if the address is on the
+// deny list, with the Reason it was added, otherwise it isn't on the allow
+// list.
+type DestinationError struct {
+	Address iwallet.Address
+	Denied  bool
+	Reason  string
+}
+
+func (e *DestinationError) Error() string {
+	if !e.Denied {
+		return fmt.Sprintf("%s: %s is not on the allow list", ErrDestinationRejected, e.Address)
+	}
+	if e.Reason == "" {
+		return fmt.Sprintf("%s: %s is denied", ErrDestinationRejected, e.Address)
+	}
+	return fmt.Sprintf("%s: %s is denied: %s", ErrDestinationRejected, e.Address, e.Reason)
+}
+
+// Unwrap returns ErrDestinationRejected.
+func (e *DestinationError) Unwrap() error {
+	return ErrDestinationRejected
+}
+
+// AddressPolicyEntry is an address on the allow or deny list.
+type AddressPolicyEntry struct {
+	Address   iwallet.Address
+	Policy    AddressPolicy
+	Reason    string
+	CreatedAt time.Time
+}
+
+// RejectedSpend is an audit log entry for a spend refused by the address
+// policy.
+type RejectedSpend struct {
+	ID        string
+	Address   iwallet.Address
+	Reason    string
+	Timestamp time.Time
+}
+
+// AddressPolicyStore keeps a coin's allow and deny lists and the audit log
+// of the spends they refused. WalletBase uses one for its coin. Wallets
+// built without WalletBase embed their own.
+type AddressPolicyStore struct {
+	DB       database.Database
+	CoinType iwallet.CoinType
+	Logger   log.Logger
+
+	// Normalize returns the canonical encoding of an address so every
+	// encoding of a destination, such as an upper case bech32 address,
+	// matches the same entry. If nil addresses are matched as given.
+	Normalize func(addr iwallet.Address) (iwallet.Address, error)
+}
+
+// normalize returns the canonical encodings of the addresses.
+func (s *AddressPolicyStore) normalize(addrs []iwallet.Address) ([]iwallet.Address, error) {
+	if s.Normalize == nil {
+		return addrs, nil
+	}
+	normalized := make([]iwallet.Address, 0, len(addrs))
+	for _, addr := range addrs {
+		n, err := s.Normalize(addr)
+		if err != nil {
+			return nil, err
+		}
+		normalized = append(normalized, n)
+	}
+	return normalized, nil
+}
+
+// SetAddressPolicy adds the addresses to the allow or deny list, replacing
+// any policy they already had. Reason is recorded with them, for example
+// the name of the list they came from.
+func (s *AddressPolicyStore) SetAddressPolicy(policy AddressPolicy, reason string, addrs ...iwallet.Address) error {
+	if policy != AddressAllowed && policy != AddressDenied {
+		return fmt.Errorf("unknown address policy %q", policy)
+	}
+	addrs, err := s.normalize(addrs)
+	if err != nil {
+		return err
+	}
+	return s.DB.Update(func(dbtx database.Tx) error {
+		now := time.Now()
+		for _, addr := range addrs {
+			err := dbtx.Save(&database.AddressPolicyRecord{
+				Addr:      addr.String(),
+				Coin:      s.CoinType.CurrencyCode(),
+				Policy:    string(policy),
+				Reason:    reason,
+				CreatedAt: now,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// RemoveAddressPolicy removes the addresses from the allow or deny list.
+func (s *AddressPolicyStore) RemoveAddressPolicy(addrs ...iwallet.Address) error {
+	addrs, err := s.normalize(addrs)
+	if err != nil {
+		return err
+	}
+	return s.DB.Update(func(dbtx database.Tx) error {
+		for _, addr := range addrs {
+			if err := dbtx.Delete("addr", addr.String(), &database.AddressPolicyRecord{}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// AddressPolicies returns the addresses on the allow and deny lists.
+func (s *AddressPolicyStore) AddressPolicies() ([]AddressPolicyEntry, error) {
+	var records []database.AddressPolicyRecord
+	err := s.DB.View(func(dbtx database.Tx) error {
+		return dbtx.Read().Where("coin=?", s.CoinType.CurrencyCode()).Find(&records).Error
+	})
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	entries := make([]AddressPolicyEntry, 0, len(records))
+	for _, rec := range records {
+		entries = append(entries, AddressPolicyEntry{
+			Address:   iwallet.NewAddress(rec.Addr, s.CoinType),
+			Policy:    AddressPolicy(rec.Policy),
+			Reason:    rec.Reason,
+			CreatedAt: rec.CreatedAt,
+		})
+	}
+	return entries, nil
+}
+
+// CheckDestinations returns a *DestinationError for the first address the
+// address policy doesn't permit. The rejection is saved to the audit log
+// returned by RejectedSpends. It must not be called inside another
+// database transaction.
+func (s *AddressPolicyStore) CheckDestinations(addrs ...iwallet.Address) error {
+	addrs, err := s.normalize(addrs)
+	if err != nil {
+		return err
+	}
+	var rejected *DestinationError
+	err = s.DB.View(func(dbtx database.Tx) error {
+		var allowList database.AddressPolicyRecord
+		err := dbtx.Read().Where("coin=?", s.CoinType.CurrencyCode()).Where("policy=?", string(AddressAllowed)).First(&allowList).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		hasAllowList := err == nil
+
+		for _, addr := range addrs {
+			var rec database.AddressPolicyRecord
+			err := dbtx.Read().Where("coin=?", s.CoinType.CurrencyCode()).Where("addr=?", addr.String()).First(&rec).Error
+			if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+				return err
+			}
+			found := err == nil
+			if found && rec.Policy == string(AddressDenied) {
+				rejected = &DestinationError{Address: addr, Denied: true, Reason: rec.Reason}
+				return nil
+			}
+			if hasAllowList && !found {
+				rejected = &DestinationError{Address: addr}
+				return nil
+			}
+		}
+		return nil
+	})
+	if err != nil || rejected == nil {
+		return err
+	}
+
+	s.Logger.Warningf("[%s] Spend rejected: %s", s.CoinType, rejected)
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	err = s.DB.Update(func(dbtx database.Tx) error {
+		return dbtx.Save(&database.RejectedSpendRecord{
+			ID:        hex.EncodeToString(id),
+			Coin:      s.CoinType.CurrencyCode(),
+			Addr:      rejected.Address.String(),
+			Reason:    rejected.Error(),
+			Timestamp: time.Now(),
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return rejected
+}
+
+// RejectedSpends returns the audit log of spends refused by the address
+// policy, newest first.
+func (s *AddressPolicyStore) RejectedSpends() ([]RejectedSpend, error) {
+	var records []database.RejectedSpendRecord
+	err := s.DB.View(func(dbtx database.Tx) error {
+		return dbtx.Read().Where("coin=?", s.CoinType.CurrencyCode()).Order("timestamp desc").Find(&records).Error
+	})
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	rejected := make([]RejectedSpend, 0, len(records))
+	for _, rec := range records {
+		rejected = append(rejected, RejectedSpend{
+			ID:        rec.ID,
+			Address:   iwallet.NewAddress(rec.Addr, s.CoinType),
+			Reason:    rec.Reason,
+			Timestamp: rec.Timestamp,
+		})
+	}
+	return rejected, nil
+}
+
+// addressPolicies returns the wallet's AddressPolicyStore.
+func (w *WalletBase) addressPolicies() *AddressPolicyStore {
+	return &AddressPolicyStore{DB: w.DB, CoinType: w.CoinType, Logger: w.Logger, Normalize: w.NormalizeAddress}
+}
+
+// SetAddressPolicy adds the addresses to the allow or deny list. See
+// AddressPolicyStore.SetAddressPolicy.
+func (w *WalletBase) SetAddressPolicy(policy AddressPolicy, reason string, addrs ...iwallet.Address) error {
+	return w.addressPolicies().SetAddressPolicy(policy, reason, addrs...)
+}
+
+// RemoveAddressPolicy removes the addresses from the allow or deny list.
+func (w *WalletBase) RemoveAddressPolicy(addrs ...iwallet.Address) error {
+	return w.addressPolicies().RemoveAddressPolicy(addrs...)
+}
+
+// AddressPolicies returns the addresses on the allow and deny lists.
+func (w *WalletBase) AddressPolicies() ([]AddressPolicyEntry, error) {
+	return w.addressPolicies().AddressPolicies()
+}
+
+// CheckDestinations returns a *DestinationError for the first address the
+// address policy doesn't permit. See AddressPolicyStore.CheckDestinations.
+func (w *WalletBase) CheckDestinations(addrs ...iwallet.Address) error {
+	return w.addressPolicies().CheckDestinations(addrs...)
+}
+
+// RejectedSpends returns the audit log of spends refused by the address
+// policy, newest first.
+func (w *WalletBase) RejectedSpends() ([]RejectedSpend, error) {
+	return w.addressPolicies().RejectedSpends()
+}
+
+// PaidAddresses returns the addresses paid by the transaction's outputs.
+func PaidAddresses(txn iwallet.Transaction) []iwallet.Address {
+	addrs := make([]iwallet.Address, 0, len(txn.To))
+	for _, out := range txn.To {
+		addrs = append(addrs, out.Address)
+	}
+	return addrs
+}
@@ -0,0 +1,118 @@
+package base
+
+import (
+	"errors"
+	iwallet "github.com/cpacia/wallet-interface"
+	"strings"
+	"testing"
+)
+
+func TestWalletBase_AddressPolicy(t *testing.T) {
+	w, err := setupWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		scam    = mockAddress()
+		payroll = mockAddress()
+		other   = mockAddress()
+	)
+
+	// Everything is allowed with no policy.
+	if err := w.CheckDestinations(scam, payroll, other); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.SetAddressPolicy(AddressDenied, "scam list", scam); err != nil {
+		t.Fatal(err)
+	}
+	err = w.CheckDestinations(other, scam)
+	var destErr *DestinationError
+	if !errors.As(err, &destErr) || !errors.Is(err, ErrDestinationRejected) {
+		t.Fatalf("Expected DestinationError, got %v", err)
+	}
+	if destErr.Address != scam || !destErr.Denied || destErr.Reason != "scam list" {
+		t.Errorf("Unexpected error %+v", destErr)
+	}
+	if err := w.CheckDestinations(other); err != nil {
+		t.Errorf("Expected address not on the deny list to be allowed, got %v", err)
+	}
+
+	// Once an address is allowed everything else is rejected.
+	if err := w.SetAddressPolicy(AddressAllowed, "payroll", payroll); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.CheckDestinations(payroll); err != nil {
+		t.Errorf("Expected allowed address to pass, got %v", err)
+	}
+	err = w.CheckDestinations(other)
+	if !errors.As(err, &destErr) || destErr.Denied || destErr.Address != other {
+		t.Errorf("Expected address not on the allow list to be rejected, got %v", err)
+	}
+
+	entries, err := w.AddressPolicies()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("Expected 2 entries, got %d", len(entries))
+	}
+
+	rejected, err := w.RejectedSpends()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rejected) != 2 || rejected[0].Address != other || rejected[1].Address != scam {
+		t.Errorf("Unexpected audit log %+v", rejected)
+	}
+
+	if err := w.RemoveAddressPolicy(payroll, scam); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.CheckDestinations(scam, other); err != nil {
+		t.Errorf("Expected removed policies to allow everything, got %v", err)
+	}
+
+	if err := w.SetAddressPolicy("maybe", "", other); err == nil {
+		t.Error("Expected unknown policy to fail")
+	}
+}
+
+func TestWalletBase_AddressPolicyNormalize(t *testing.T) {
+	w, err := setupWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.NormalizeAddress = func(addr iwallet.Address) (iwallet.Address, error) {
+		if addr.String() == "" {
+			return iwallet.Address{}, errors.New("invalid address")
+		}
+		return iwallet.NewAddress(strings.ToLower(addr.String()), iwallet.CtMock), nil
+	}
+
+	scam := mockAddress()
+	upper := iwallet.NewAddress(strings.ToUpper(scam.String()), iwallet.CtMock)
+	if err := w.SetAddressPolicy(AddressDenied, "scam list", upper); err != nil {
+		t.Fatal(err)
+	}
+	err = w.CheckDestinations(scam)
+	var destErr *DestinationError
+	if !errors.As(err, &destErr) || destErr.Address != scam {
+		t.Errorf("Expected upper case deny entry to reject lower case address, got %v", err)
+	}
+	if err := w.CheckDestinations(upper); !errors.Is(err, ErrDestinationRejected) {
+		t.Errorf("Expected upper case address to be rejected, got %v", err)
+	}
+
+	if err := w.CheckDestinations(iwallet.NewAddress("", iwallet.CtMock)); err == nil || errors.Is(err, ErrDestinationRejected) {
+		t.Errorf("Expected invalid address to fail to decode, got %v", err)
+	}
+
+	if err := w.RemoveAddressPolicy(scam); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.CheckDestinations(upper); err != nil {
+		t.Errorf("Expected removed policy to allow the address, got %v", err)
+	}
+}
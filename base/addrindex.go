@@ -0,0 +1,145 @@
+package base
+
+import (
+	"errors"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"gorm.io/gorm"
+	"sync"
+)
+
+// ScriptFunc returns the output script paying an encoded address.
+type ScriptFunc func(addr string) ([]byte, error)
+
+// AddressIndex is an in-memory index of the keychain's address records by
+// address and, if the keychain has a ScriptFunc, by output script. It
+// holds the addresses of both chains but not those of payment codes or
+// silent payments. Addresses are only ever added to the keychain so the
+// index is brought up to date by loading the records past the highest key
+// index it has on each chain. The ChainManager syncs it as it saves
+// transactions and the keychain syncs it as it derives new keys.
+type AddressIndex struct {
+	coinType   iwallet.CoinType
+	scriptFunc ScriptFunc
+
+	addrs   []iwallet.Address
+	paths   map[string]keyPath
+	scripts map[string]string
+	next    [2]int
+	mtx     sync.RWMutex
+}
+
+func newAddressIndex(coinType iwallet.CoinType, scriptFunc ScriptFunc) *AddressIndex {
+	return &AddressIndex{
+		coinType:   coinType,
+		scriptFunc: scriptFunc,
+		paths:      make(map[string]keyPath),
+		scripts:    make(map[string]string),
+	}
+}
+
+// sync adds the records saved since it was last called. If the index
+// still doesn't hold as many addresses as the database it's rebuilt.
+func (idx *AddressIndex) sync(dbtx database.Tx) error {
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+
+	for chain, change := range []bool{false, true} {
+		var records []database.AddressRecord
+		err := dbtx.Read().Order("key_index asc").Where("coin=?", idx.coinType.CurrencyCode()).Where("change=?", change).Where("key_index>=?", idx.next[chain]).Find(&records).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		idx.add(records)
+	}
+
+	var count int64
+	if err := dbtx.Read().Model(&database.AddressRecord{}).Where("coin=?", idx.coinType.CurrencyCode()).Count(&count).Error; err != nil {
+		return err
+	}
+	if int(count) == len(idx.addrs) {
+		return nil
+	}
+
+	var records []database.AddressRecord
+	err := dbtx.Read().Order("key_index asc").Where("coin=?", idx.coinType.CurrencyCode()).Find(&records).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+	idx.addrs = nil
+	idx.paths = make(map[string]keyPath)
+	idx.scripts = make(map[string]string)
+	idx.next = [2]int{}
+	idx.add(records)
+	return nil
+}
+
+func (idx *AddressIndex) add(records []database.AddressRecord) {
+	for _, rec := range records {
+		if _, ok := idx.paths[rec.Addr]; ok {
+			continue
+		}
+		if idx.scriptFunc != nil {
+			if script, err := idx.scriptFunc(rec.Addr); err == nil {
+				idx.scripts[string(script)] = rec.Addr
+			}
+		}
+		chain := 0
+		if rec.Change {
+			chain = 1
+		}
+		idx.paths[rec.Addr] = keyPath{change: rec.Change, index: uint32(rec.KeyIndex)}
+		idx.addrs = append(idx.addrs, rec.Address())
+		if rec.KeyIndex >= idx.next[chain] {
+			idx.next[chain] = rec.KeyIndex + 1
+		}
+	}
+}
+
+// Addresses returns every indexed address.
+func (idx *AddressIndex) Addresses() []iwallet.Address {
+	idx.mtx.RLock()
+	defer idx.mtx.RUnlock()
+
+	return append([]iwallet.Address(nil), idx.addrs...)
+}
+
+// Contains returns whether the address is in the index.
+func (idx *AddressIndex) Contains(addr iwallet.Address) bool {
+	_, ok := idx.path(addr.String())
+	return ok
+}
+
+// AddressForScript returns the address paid by the output script if it's
+// in the index. It always returns false if the keychain has no ScriptFunc.
+func (idx *AddressIndex) AddressForScript(script []byte) (iwallet.Address, bool) {
+	idx.mtx.RLock()
+	defer idx.mtx.RUnlock()
+
+	addr, ok := idx.scripts[string(script)]
+	if !ok {
+		return iwallet.Address{}, false
+	}
+	return iwallet.NewAddress(addr, idx.coinType), true
+}
+
+// IndexesScripts returns whether the index can look up output scripts.
+func (idx *AddressIndex) IndexesScripts() bool {
+	return idx.scriptFunc != nil
+}
+
+// Len returns the number of indexed addresses.
+func (idx *AddressIndex) Len() int {
+	idx.mtx.RLock()
+	defer idx.mtx.RUnlock()
+
+	return len(idx.addrs)
+}
+
+func (idx *AddressIndex) path(addr string) (keyPath, bool) {
+	idx.mtx.RLock()
+	defer idx.mtx.RUnlock()
+
+	path, ok := idx.paths[addr]
+	return path, ok
+}
@@ -0,0 +1,91 @@
+package base
+
+import (
+	"encoding/hex"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"testing"
+	"time"
+)
+
+func TestAddressIndex(t *testing.T) {
+	kc, err := setupKeychain(IndexScripts(hex.DecodeString))
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := kc.AddressIndex()
+	if index.Len() != defaultLookaheadWindow*2 {
+		t.Fatalf("Expected %d addresses, got %d", defaultLookaheadWindow*2, index.Len())
+	}
+
+	addr, err := kc.CurrentAddress(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !index.Contains(addr) {
+		t.Error("Expected the current address to be indexed")
+	}
+	script, err := hex.DecodeString(addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, ok := index.AddressForScript(script)
+	if !ok || found != addr {
+		t.Errorf("Expected script to map to %s, got %s", addr, found)
+	}
+
+	// Keys derived as the keychain is extended are added straight away.
+	err = kc.db.Update(func(tx database.Tx) error {
+		return kc.MarkAddressAsUsed(tx, addr)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index.Len() != defaultLookaheadWindow*2+1 {
+		t.Errorf("Expected %d addresses, got %d", defaultLookaheadWindow*2+1, index.Len())
+	}
+
+	// A record saved outside the keychain below the highest index, such
+	// as one restored from a backup, makes the index rebuild.
+	restored := iwallet.NewAddress("00", iwallet.CtMock)
+	err = kc.db.Update(func(tx database.Tx) error {
+		if err := tx.Save(&database.AddressRecord{
+			Addr:      restored.String(),
+			KeyIndex:  0,
+			Change:    true,
+			Coin:      iwallet.CtMock,
+			CreatedAt: time.Now(),
+		}); err != nil {
+			return err
+		}
+		return kc.SyncAddressIndex(tx)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !index.Contains(restored) {
+		t.Error("Expected the restored address to be indexed")
+	}
+	if found, ok := index.AddressForScript([]byte{0x00}); !ok || found != restored {
+		t.Error("Expected the restored address's script to be indexed")
+	}
+
+	addrs, err := kc.GetAddresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != index.Len() {
+		t.Errorf("Expected %d addresses, got %d", index.Len(), len(addrs))
+	}
+}
+
+func BenchmarkKeychain_GetAddresses(b *testing.B) {
+	kc := setupLargeKeychain(b, 50000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := kc.GetAddresses(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
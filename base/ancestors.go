@@ -0,0 +1,139 @@
+package base
+
+import (
+	"encoding/hex"
+	"errors"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+)
+
+// MaxUnconfirmedAncestors is the default mempool policy limit on the number
+// of unconfirmed transactions in a transaction's ancestry, counting the
+// transaction itself.
+const MaxUnconfirmedAncestors = 25
+
+// ErrTooManyUnconfirmedAncestors is returned when a transaction would have
+// more unconfirmed ancestors than the network will relay.
+var ErrTooManyUnconfirmedAncestors = errors.New("transaction would exceed the unconfirmed ancestor limit")
+
+// ancestorGraph maps each of the wallet's unconfirmed transactions to the
+// transactions it spends from.
+type ancestorGraph map[iwallet.TransactionID][]iwallet.TransactionID
+
+// loadAncestorGraph builds the graph from the wallet's unconfirmed
+// transaction records. Parents the wallet doesn't know about are not
+// counted.
+func (w *WalletBase) loadAncestorGraph(dbtx database.Tx) (ancestorGraph, error) {
+	var records []database.TransactionRecord
+	err := dbtx.Read().Where("coin=?", w.CoinType.CurrencyCode()).Where("block_height=?", 0).Find(&records).Error
+	if err != nil {
+		return nil, err
+	}
+	graph := make(ancestorGraph)
+	for _, rec := range records {
+		if rec.Dropped() {
+			continue
+		}
+		tx, err := rec.Transaction()
+		if err != nil {
+			return nil, err
+		}
+		parents := make([]iwallet.TransactionID, 0, len(tx.From))
+		for _, from := range tx.From {
+			if len(from.ID) < chainhash.HashSize {
+				continue
+			}
+			h, err := chainhash.NewHash(from.ID[:chainhash.HashSize])
+			if err != nil {
+				return nil, err
+			}
+			parents = append(parents, iwallet.TransactionID(h.String()))
+		}
+		graph[rec.TransactionID()] = parents
+	}
+	return graph, nil
+}
+
+// count returns the number of distinct unconfirmed transactions among the
+// txids and their ancestors.
+func (g ancestorGraph) count(txids ...iwallet.TransactionID) int {
+	seen := make(map[iwallet.TransactionID]bool)
+	for len(txids) > 0 {
+		txid := txids[0]
+		txids = txids[1:]
+		parents, ok := g[txid]
+		if !ok || seen[txid] {
+			continue
+		}
+		seen[txid] = true
+		txids = append(txids, parents...)
+	}
+	return len(seen)
+}
+
+// UnconfirmedAncestors returns the number of distinct unconfirmed
+// transactions among the txids and their ancestors. A transaction spending
+// outputs of the txids has this many unconfirmed ancestors plus itself.
+func (w *WalletBase) UnconfirmedAncestors(dbtx database.Tx, txids []iwallet.TransactionID) (int, error) {
+	graph, err := w.loadAncestorGraph(dbtx)
+	if err != nil {
+		return 0, err
+	}
+	return graph.count(txids...), nil
+}
+
+// HasAncestorLimitedCoins returns whether any utxo which would otherwise be
+// spendable was left out by GatherCoins because spending it would exceed
+// MaxUnconfirmedAncestors.
+func (w *WalletBase) HasAncestorLimitedCoins(dbtx database.Tx) (bool, error) {
+	var utxoRecords []database.UtxoRecord
+	err := dbtx.Read().Where("coin = ?", w.CoinType.CurrencyCode()).Where("height = ?", 0).Where("frozen = ?", false).Find(&utxoRecords).Error
+	if err != nil {
+		return false, err
+	}
+	if len(utxoRecords) == 0 {
+		return false, nil
+	}
+	graph, err := w.loadAncestorGraph(dbtx)
+	if err != nil {
+		return false, err
+	}
+	for _, u := range utxoRecords {
+		txid, err := outpointTxid(u.Outpoint)
+		if err != nil {
+			return false, err
+		}
+		if graph.count(txid) >= MaxUnconfirmedAncestors {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// outpointTxid returns the id of the transaction which created the hex
+// encoded outpoint.
+func outpointTxid(outpoint string) (iwallet.TransactionID, error) {
+	ser, err := hex.DecodeString(outpoint)
+	if err != nil {
+		return "", err
+	}
+	if len(ser) < chainhash.HashSize {
+		return "", errors.New("invalid outpoint length")
+	}
+	h, err := chainhash.NewHash(ser[:chainhash.HashSize])
+	if err != nil {
+		return "", err
+	}
+	return iwallet.TransactionID(h.String()), nil
+}
+
+// unconfirmedAncestorsOf returns the number of unconfirmed transactions in
+// the ancestry of the hex encoded outpoint.
+func (w *WalletBase) unconfirmedAncestorsOf(dbtx database.Tx, outpoint string) (int, error) {
+	txid, err := outpointTxid(outpoint)
+	if err != nil {
+		return 0, err
+	}
+	return w.UnconfirmedAncestors(dbtx, []iwallet.TransactionID{txid})
+}
@@ -0,0 +1,239 @@
+package base
+
+import (
+	"errors"
+	"github.com/cpacia/multiwallet/database"
+	"github.com/cpacia/multiwallet/log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultBackupInterval is used when the BackupConfig has no interval.
+	DefaultBackupInterval = time.Hour * 24
+
+	backupPrefix     = "multiwallet-"
+	backupSuffix     = ".mwbackup"
+	backupTimeFormat = "20060102T150405Z"
+)
+
+// BackupDestination stores backup files by name.
+type BackupDestination interface {
+	// Put writes the backup, replacing any with the same name.
+	Put(name string, data []byte) error
+
+	// List returns the names of the stored files.
+	List() ([]string, error)
+
+	// Delete removes the file. It's not an error if it doesn't exist.
+	Delete(name string) error
+}
+
+// BackupConfig configures the BackupScheduler.
+type BackupConfig struct {
+	// Destination is where the backups are written.
+	Destination BackupDestination
+
+	// Passphrase is the wallet passphrase the backups are encrypted
+	// with. It's owned by the caller and must not be destroyed while the
+	// scheduler is running.
+	Passphrase *SecureBytes
+
+	// Interval is the time between backups.
+	Interval time.Duration
+
+	// MaxCount is the number of backups kept. Zero keeps all of them.
+	MaxCount int
+
+	// MaxAge is how long backups are kept. Zero keeps them forever. The
+	// latest backup is never pruned.
+	MaxAge time.Duration
+}
+
+// BackupScheduler periodically writes an encrypted snapshot of the whole
+// database, in the format of database.ExportBackup, to a destination and
+// prunes old copies.
+type BackupScheduler struct {
+	db       database.Database
+	logger   log.Logger
+	cfg      BackupConfig
+	now      func() time.Time
+	shutdown chan struct{}
+}
+
+// NewBackupScheduler returns a new BackupScheduler.
+func NewBackupScheduler(db database.Database, logger log.Logger, cfg *BackupConfig) (*BackupScheduler, error) {
+	if cfg.Destination == nil {
+		return nil, errors.New("backup destination is required")
+	}
+	if cfg.Passphrase == nil || len(cfg.Passphrase.Bytes()) == 0 {
+		return nil, errors.New("backup passphrase is required")
+	}
+	s := &BackupScheduler{
+		db:       db,
+		logger:   logger.Module("backups"),
+		cfg:      *cfg,
+		now:      time.Now,
+		shutdown: make(chan struct{}),
+	}
+	if s.cfg.Interval <= 0 {
+		s.cfg.Interval = DefaultBackupInterval
+	}
+	return s, nil
+}
+
+// Start runs the scheduler until Stop is called. A backup is taken
+// immediately if the latest one is older than the interval.
+func (s *BackupScheduler) Start() {
+	latest, err := s.latest()
+	if err != nil {
+		s.logger.Errorf("Error listing backups: %s", err)
+	}
+	var next time.Duration
+	if since := s.now().Sub(latest); since < s.cfg.Interval {
+		next = s.cfg.Interval - since
+	}
+
+	timer := time.NewTimer(next)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			if name, err := s.Backup(); err != nil {
+				s.logger.Errorf("Error backing up database: %s", err)
+			} else {
+				s.logger.Infof("Wrote database backup %s", name)
+			}
+			timer.Reset(s.cfg.Interval)
+		case <-s.shutdown:
+			return
+		}
+	}
+}
+
+// Stop will shutdown the scheduler.
+func (s *BackupScheduler) Stop() {
+	close(s.shutdown)
+}
+
+// Backup writes a backup now, prunes old ones and returns the new backup's
+// name.
+func (s *BackupScheduler) Backup() (string, error) {
+	blob, err := database.ExportBackup(s.db, s.cfg.Passphrase.Bytes())
+	if err != nil {
+		return "", err
+	}
+	name := backupPrefix + s.now().UTC().Format(backupTimeFormat) + backupSuffix
+	if err := s.cfg.Destination.Put(name, blob); err != nil {
+		return "", err
+	}
+	if err := s.prune(name); err != nil {
+		s.logger.Errorf("Error pruning backups: %s", err)
+	}
+	return name, nil
+}
+
+// latest returns the time of the most recent backup.
+func (s *BackupScheduler) latest() (time.Time, error) {
+	backups, err := s.list()
+	if err != nil || len(backups) == 0 {
+		return time.Time{}, err
+	}
+	return backups[0].created, nil
+}
+
+type backupFile struct {
+	name    string
+	created time.Time
+}
+
+// list returns the backups at the destination, newest first. Files which
+// aren't backups are ignored.
+func (s *BackupScheduler) list() ([]backupFile, error) {
+	names, err := s.cfg.Destination.List()
+	if err != nil {
+		return nil, err
+	}
+	var backups []backupFile
+	for _, name := range names {
+		if !strings.HasPrefix(name, backupPrefix) || !strings.HasSuffix(name, backupSuffix) {
+			continue
+		}
+		created, err := time.Parse(backupTimeFormat, strings.TrimSuffix(strings.TrimPrefix(name, backupPrefix), backupSuffix))
+		if err != nil {
+			continue
+		}
+		backups = append(backups, backupFile{name: name, created: created})
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].created.After(backups[j].created)
+	})
+	return backups, nil
+}
+
+// prune deletes the backups over MaxCount or older than MaxAge, except for
+// keep.
+func (s *BackupScheduler) prune(keep string) error {
+	backups, err := s.list()
+	if err != nil {
+		return err
+	}
+	for i, backup := range backups {
+		if backup.name == keep {
+			continue
+		}
+		tooMany := s.cfg.MaxCount > 0 && i >= s.cfg.MaxCount
+		tooOld := s.cfg.MaxAge > 0 && s.now().Sub(backup.created) > s.cfg.MaxAge
+		if tooMany || tooOld {
+			if err := s.cfg.Destination.Delete(backup.name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// DirectoryDestination stores backups in a local directory.
+type DirectoryDestination struct {
+	Dir string
+}
+
+// Put writes the file atomically so a crash never leaves a partial backup.
+func (d *DirectoryDestination) Put(name string, data []byte) error {
+	if err := os.MkdirAll(d.Dir, 0700); err != nil {
+		return err
+	}
+	tmp := filepath.Join(d.Dir, name+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(d.Dir, name))
+}
+
+func (d *DirectoryDestination) List() ([]string, error) {
+	infos, err := ioutil.ReadDir(d.Dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, info := range infos {
+		if !info.IsDir() {
+			names = append(names, info.Name())
+		}
+	}
+	return names, nil
+}
+
+func (d *DirectoryDestination) Delete(name string) error {
+	err := os.Remove(filepath.Join(d.Dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
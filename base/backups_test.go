@@ -0,0 +1,191 @@
+package base
+
+import (
+	"github.com/cpacia/multiwallet/database"
+	"github.com/cpacia/multiwallet/database/memorydb"
+	"github.com/cpacia/multiwallet/log"
+	iwallet "github.com/cpacia/wallet-interface"
+	"github.com/jarcoal/httpmock"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackupScheduler_Backup(t *testing.T) {
+	db, err := memorydb.NewMemoryDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.InitializeDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx database.Tx) error {
+		return tx.Save(&database.CoinRecord{Coin: iwallet.CtMock.CurrencyCode(), BestBlockHeight: 100})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "backups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pw := NewSecureBytes([]byte("letmein"))
+	defer pw.Destroy()
+
+	scheduler, err := NewBackupScheduler(db, log.New("backups"), &BackupConfig{
+		Destination: &DirectoryDestination{Dir: dir},
+		Passphrase:  pw,
+		Interval:    time.Hour,
+		MaxCount:    3,
+		MaxAge:      time.Hour * 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A file which isn't a backup is left alone.
+	if err := ioutil.WriteFile(filepath.Join(dir, "notes.txt"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	var names []string
+	for i := 0; i < 5; i++ {
+		scheduler.now = func() time.Time { return start.Add(time.Hour * time.Duration(i)) }
+		name, err := scheduler.Backup()
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	if names[0] != "multiwallet-20200101T000000Z.mwbackup" {
+		t.Errorf("Unexpected backup name %s", names[0])
+	}
+
+	files, err := (&DirectoryDestination{Dir: dir}).List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	expected := append(names[2:], "notes.txt")
+	if strings.Join(files, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected files %v, got %v", expected, files)
+	}
+
+	// Backups older than MaxAge are pruned even under the count.
+	scheduler.cfg.MaxCount = 0
+	scheduler.now = func() time.Time { return start.Add(time.Hour * 8) }
+	if _, err := scheduler.Backup(); err != nil {
+		t.Fatal(err)
+	}
+	backups, err := scheduler.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 || backups[1].name != names[4] {
+		t.Errorf("Expected 2 backups, got %v", backups)
+	}
+
+	blob, err := ioutil.ReadFile(filepath.Join(dir, names[4]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup, err := database.DecryptBackup(blob, []byte("letmein"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backup.Coins) != 1 || backup.Coins[0].BestBlockHeight != 100 {
+		t.Errorf("Backup is missing the coin record")
+	}
+	if _, err := database.DecryptBackup(blob, []byte("wrong")); err != database.ErrInvalidBackup {
+		t.Errorf("Expected ErrInvalidBackup, got %v", err)
+	}
+}
+
+func TestNewBackupScheduler_Validation(t *testing.T) {
+	if _, err := NewBackupScheduler(nil, nil, &BackupConfig{Passphrase: NewSecureBytes([]byte("pw"))}); err == nil {
+		t.Error("Expected error without destination")
+	}
+	if _, err := NewBackupScheduler(nil, nil, &BackupConfig{Destination: &DirectoryDestination{}}); err == nil {
+		t.Error("Expected error without passphrase")
+	}
+}
+
+func TestS3Destination(t *testing.T) {
+	dest := &S3Destination{
+		Endpoint:  "https://s3.example.com",
+		Region:    "us-east-1",
+		Bucket:    "wallet",
+		AccessKey: "AKID",
+		SecretKey: "secret",
+		Prefix:    "backups/",
+	}
+
+	checkAuth := func(req *http.Request) bool {
+		auth := req.Header.Get("Authorization")
+		return strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") &&
+			strings.Contains(auth, "/us-east-1/s3/aws4_request") &&
+			req.Header.Get("x-amz-content-sha256") != "" && req.Header.Get("x-amz-date") != ""
+	}
+
+	var (
+		put     []byte
+		deleted string
+	)
+	httpmock.RegisterResponder("PUT", "https://s3.example.com/wallet/backups/a.mwbackup",
+		func(req *http.Request) (*http.Response, error) {
+			if !checkAuth(req) {
+				return httpmock.NewStringResponse(403, "unsigned"), nil
+			}
+			put, _ = ioutil.ReadAll(req.Body)
+			return httpmock.NewStringResponse(200, ""), nil
+		})
+	httpmock.RegisterResponder("GET", "https://s3.example.com/wallet?list-type=2&prefix=backups%2F",
+		func(req *http.Request) (*http.Response, error) {
+			if !checkAuth(req) {
+				return httpmock.NewStringResponse(403, "unsigned"), nil
+			}
+			return httpmock.NewStringResponse(200, `<ListBucketResult><Contents><Key>backups/a.mwbackup</Key></Contents><IsTruncated>false</IsTruncated></ListBucketResult>`), nil
+		})
+	httpmock.RegisterResponder("DELETE", "https://s3.example.com/wallet/backups/a.mwbackup",
+		func(req *http.Request) (*http.Response, error) {
+			deleted = req.URL.Path
+			return httpmock.NewStringResponse(204, ""), nil
+		})
+	httpmock.RegisterResponder("DELETE", "https://s3.example.com/wallet/backups/b.mwbackup",
+		httpmock.NewStringResponder(403, "AccessDenied"))
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	if err := dest.Put("a.mwbackup", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if string(put) != "data" {
+		t.Errorf("Expected body data, got %s", put)
+	}
+	names, err := dest.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || names[0] != "a.mwbackup" {
+		t.Errorf("Expected a.mwbackup, got %v", names)
+	}
+	if err := dest.Delete("a.mwbackup"); err != nil {
+		t.Fatal(err)
+	}
+	if deleted != "/wallet/backups/a.mwbackup" {
+		t.Errorf("Expected object to be deleted, got %s", deleted)
+	}
+	if err := dest.Delete("b.mwbackup"); err == nil {
+		t.Error("Expected error response to be returned")
+	}
+}
@@ -0,0 +1,195 @@
+package base
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"math/big"
+)
+
+// CoinbaseMaturity is the number of confirmations a coinbase output needs
+// before it can be spent.
+const CoinbaseMaturity = 100
+
+// nullOutpoint is the outpoint spent by coinbase transactions.
+var nullOutpoint = append(make([]byte, 32), 0xff, 0xff, 0xff, 0xff)
+
+// Balance breaks the wallet's funds down by whether they can be spent.
+type Balance struct {
+	// Confirmed and Unconfirmed are spendable funds. Confirmed funds
+	// have the Settled confirmations of the wallet's ConfirmationPolicy.
+	// When one confirmation settles, unconfirmed change from
+	// transactions whose inputs are confirmed counts as confirmed.
+	Confirmed   iwallet.Amount
+	Unconfirmed iwallet.Amount
+
+	// Immature is coinbase outputs with fewer than CoinbaseMaturity
+	// confirmations.
+	Immature iwallet.Amount
+
+	// WatchOnly is the unspent value held by watched addresses, such as
+	// escrows. It isn't spendable by the wallet alone.
+	WatchOnly iwallet.Amount
+
+	// Frozen is utxos excluded from coin selection by FreezeUtxo.
+	Frozen iwallet.Amount
+}
+
+// Total returns the wallet's own funds, excluding WatchOnly.
+func (b Balance) Total() iwallet.Amount {
+	return b.Confirmed.Add(b.Unconfirmed).Add(b.Immature).Add(b.Frozen)
+}
+
+// FiatBalance is a Balance converted to USD. Each value has two decimal
+// places.
+type FiatBalance struct {
+	Confirmed   string
+	Unconfirmed string
+	Immature    string
+	WatchOnly   string
+	Frozen      string
+}
+
+// USDValue converts the balance at the rate returned by an
+// ExchangeRateProvider for the coin.
+func (b Balance) USDValue(coinType iwallet.CoinType, rate iwallet.Amount) FiatBalance {
+	decimals := CoinDecimals(coinType)
+	return FiatBalance{
+		Confirmed:   fiatValue(b.Confirmed, rate, decimals),
+		Unconfirmed: fiatValue(b.Unconfirmed, rate, decimals),
+		Immature:    fiatValue(b.Immature, rate, decimals),
+		WatchOnly:   fiatValue(b.WatchOnly, rate, decimals),
+		Frozen:      fiatValue(b.Frozen, rate, decimals),
+	}
+}
+
+// Add returns the sum of the two fiat balances.
+func (f FiatBalance) Add(o FiatBalance) FiatBalance {
+	add := func(a, b string) string {
+		x, ok := new(big.Rat).SetString(a)
+		if !ok {
+			x = new(big.Rat)
+		}
+		y, ok := new(big.Rat).SetString(b)
+		if !ok {
+			y = new(big.Rat)
+		}
+		return x.Add(x, y).FloatString(2)
+	}
+	return FiatBalance{
+		Confirmed:   add(f.Confirmed, o.Confirmed),
+		Unconfirmed: add(f.Unconfirmed, o.Unconfirmed),
+		Immature:    add(f.Immature, o.Immature),
+		WatchOnly:   add(f.WatchOnly, o.WatchOnly),
+		Frozen:      add(f.Frozen, o.Frozen),
+	}
+}
+
+// Balances returns the wallet's balance broken down by whether the funds
+// are spendable. The watch only balance is fetched from the chain client.
+func (w *WalletBase) Balances() (Balance, error) {
+	balance := Balance{
+		Confirmed:   iwallet.NewAmount(0),
+		Unconfirmed: iwallet.NewAmount(0),
+		Immature:    iwallet.NewAmount(0),
+		WatchOnly:   iwallet.NewAmount(0),
+		Frozen:      iwallet.NewAmount(0),
+	}
+	bcInfo, err := w.BlockchainInfo()
+	if err != nil {
+		return balance, err
+	}
+
+	var watched []database.WatchedAddressRecord
+	err = w.DB.View(func(dbtx database.Tx) error {
+		var (
+			utxoRecords []database.UtxoRecord
+			txRecords   []database.TransactionRecord
+			txMap       = make(map[iwallet.TransactionID]iwallet.Transaction)
+		)
+		if err := dbtx.Read().Where("coin=?", w.CoinType.CurrencyCode()).Find(&utxoRecords).Error; err != nil {
+			return err
+		}
+		if err := dbtx.Read().Where("coin=?", w.CoinType.CurrencyCode()).Find(&txRecords).Error; err != nil {
+			return err
+		}
+		if err := dbtx.Read().Where("coin=?", w.CoinType.CurrencyCode()).Find(&watched).Error; err != nil {
+			return err
+		}
+		for _, record := range txRecords {
+			tx, err := record.Transaction()
+			if err != nil {
+				return err
+			}
+			txMap[tx.ID] = tx
+		}
+
+		for _, utxo := range utxoRecords {
+			amount := iwallet.NewAmount(utxo.Amount)
+			txid, err := outpointTxid(utxo.Outpoint)
+			if err != nil {
+				return err
+			}
+			switch {
+			case utxo.Frozen:
+				balance.Frozen = balance.Frozen.Add(amount)
+			case utxo.Height > 0 && isCoinbase(txMap[txid]) && bcInfo.Height+1 < utxo.Height+CoinbaseMaturity:
+				balance.Immature = balance.Immature.Add(amount)
+			case w.isSettled(utxo.Height):
+				balance.Confirmed = balance.Confirmed.Add(amount)
+			case utxo.Height == 0 && w.settlesUnconfirmedChange() && checkIfStxoIsConfirmed(iwallet.TransactionID(utxo.Outpoint[:64]), txMap):
+				balance.Confirmed = balance.Confirmed.Add(amount)
+			default:
+				balance.Unconfirmed = balance.Unconfirmed.Add(amount)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return balance, err
+	}
+
+	for _, rec := range watched {
+		unspent, err := w.watchOnlyBalance(iwallet.NewAddress(rec.Addr, w.CoinType))
+		if err != nil {
+			return balance, err
+		}
+		balance.WatchOnly = balance.WatchOnly.Add(unspent)
+	}
+	return balance, nil
+}
+
+// watchOnlyBalance returns the value of the unspent outputs paying addr.
+func (w *WalletBase) watchOnlyBalance(addr iwallet.Address) (iwallet.Amount, error) {
+	txs, err := w.ChainClient.GetAddressTransactions(addr, 0)
+	if err != nil {
+		return iwallet.NewAmount(0), err
+	}
+	var (
+		outputs = make(map[string]iwallet.Amount)
+		spent   = make(map[string]bool)
+	)
+	for _, tx := range txs {
+		for _, from := range tx.From {
+			spent[hex.EncodeToString(from.ID)] = true
+		}
+		for _, to := range tx.To {
+			if to.Address.String() == addr.String() {
+				outputs[hex.EncodeToString(to.ID)] = to.Amount
+			}
+		}
+	}
+	total := iwallet.NewAmount(0)
+	for op, amount := range outputs {
+		if !spent[op] {
+			total = total.Add(amount)
+		}
+	}
+	return total, nil
+}
+
+// isCoinbase returns whether the transaction is a coinbase transaction.
+func isCoinbase(tx iwallet.Transaction) bool {
+	return len(tx.From) == 1 && bytes.Equal(tx.From[0].ID, nullOutpoint)
+}
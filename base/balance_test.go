@@ -0,0 +1,106 @@
+package base
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	hd "github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"testing"
+	"time"
+)
+
+func TestWalletBase_Balances(t *testing.T) {
+	w, err := setupWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	xpriv, err := hd.NewKeyFromString("tprv8ZgxMBicQKsPeghT19pungdFLMJM2hMs3EEn5WtgobD7wuQSFQu4VNaEJXH9HS3RhhLT4wgZ3hj31m3kafuxhL9vfGTRtBVLSog4zjxW3L1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.CreateWallet(*xpriv, nil, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.OpenWallet(); err != nil {
+		t.Fatal(err)
+	}
+
+	addr, err := w.CurrentAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var coinbaseHash chainhash.Hash
+	rand.Read(coinbaseHash[:])
+	coinbase := iwallet.Transaction{
+		ID:     iwallet.TransactionID(coinbaseHash.String()),
+		Height: 1,
+		From:   []iwallet.SpendInfo{{ID: nullOutpoint, Amount: iwallet.NewAmount(0)}},
+		To:     []iwallet.SpendInfo{{ID: append(coinbaseHash.CloneBytes(), 0, 0, 0, 0), Address: addr, Amount: iwallet.NewAmount(5000)}},
+	}
+
+	watchAddr := mockAddress()
+	err = w.DB.Update(func(dbtx database.Tx) error {
+		rec, err := database.NewTransactionRecord(coinbase, iwallet.CtMock)
+		if err != nil {
+			return err
+		}
+		if err := dbtx.Save(rec); err != nil {
+			return err
+		}
+		utxos := []database.UtxoRecord{
+			{Outpoint: hex.EncodeToString(coinbase.To[0].ID), Height: 1, Amount: "5000"},
+			{Outpoint: hex.EncodeToString(mockOutpoint()), Height: 1, Amount: "1000"},
+			{Outpoint: hex.EncodeToString(mockOutpoint()), Amount: "700"},
+			{Outpoint: hex.EncodeToString(mockOutpoint()), Height: 1, Amount: "300", Frozen: true},
+		}
+		for _, utxo := range utxos {
+			utxo.Coin = iwallet.CtMock.CurrencyCode()
+			utxo.Address = addr.String()
+			if err := dbtx.Save(&utxo); err != nil {
+				return err
+			}
+		}
+		return dbtx.Save(&database.WatchedAddressRecord{Addr: watchAddr.String(), Coin: iwallet.CtMock.CurrencyCode()})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	escrowTx := NewMockTransaction(nil, &watchAddr)
+	escrowTx.To[0].Amount = iwallet.NewAmount(2000)
+	if err := w.ChainClient.(*MockChainClient).BroadcastInternal(escrowTx); err != nil {
+		t.Fatal(err)
+	}
+
+	balance, err := w.Balances()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][2]iwallet.Amount{
+		"confirmed":   {balance.Confirmed, iwallet.NewAmount(1000)},
+		"unconfirmed": {balance.Unconfirmed, iwallet.NewAmount(700)},
+		"immature":    {balance.Immature, iwallet.NewAmount(5000)},
+		"frozen":      {balance.Frozen, iwallet.NewAmount(300)},
+		"watch only":  {balance.WatchOnly, iwallet.NewAmount(2000)},
+		"total":       {balance.Total(), iwallet.NewAmount(7000)},
+	}
+	for name, amounts := range expected {
+		if amounts[0].Cmp(amounts[1]) != 0 {
+			t.Errorf("Expected %s balance %s, got %s", name, amounts[1], amounts[0])
+		}
+	}
+
+	fiat := balance.USDValue(iwallet.CtMock, iwallet.NewAmount(1000000))
+	if fiat.Immature != "50.00" {
+		t.Errorf("Expected immature value 50.00, got %s", fiat.Immature)
+	}
+	if sum := fiat.Add(fiat); sum.Immature != "100.00" {
+		t.Errorf("Expected summed immature value 100.00, got %s", sum.Immature)
+	}
+}
@@ -2,6 +2,7 @@ package base
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -9,9 +10,9 @@ import (
 	hd "github.com/btcsuite/btcutil/hdkeychain"
 	expbackoff "github.com/cenkalti/backoff"
 	"github.com/cpacia/multiwallet/database"
+	"github.com/cpacia/multiwallet/log"
 	iwallet "github.com/cpacia/wallet-interface"
 	"github.com/gcash/bchd/wire"
-	"github.com/op/go-logging"
 	"gorm.io/gorm"
 	"strings"
 	"sync"
@@ -20,30 +21,251 @@ import (
 
 var ErrInsufficientFunds = errors.New("insufficient funds")
 
+// ErrWalletClosed is returned by calls made after the wallet was stopped.
+var ErrWalletClosed = errors.New("wallet is closed")
+
+// Lifecycle is implemented by wallets which can be shut down gracefully.
+// Stop waits for the wallet's background work to finish, or for ctx to be
+// done, and leaves the database open.
+type Lifecycle interface {
+	Start() error
+	Stop(ctx context.Context) error
+}
+
+// AddressType selects the script type used for addresses generated by
+// wallets which support more than one.
+type AddressType int
+
+const (
+	// AddressTypeNativeSegwit is a P2WPKH bech32 address. This is the
+	// default for coins which support segwit.
+	AddressTypeNativeSegwit AddressType = iota
+
+	// AddressTypeNestedSegwit is a P2WPKH script nested inside a P2SH
+	// address for compatibility with wallets that can't send to bech32.
+	AddressTypeNestedSegwit
+
+	// AddressTypeLegacy is a P2PKH address.
+	AddressTypeLegacy
+
+	// AddressTypeTaproot is a single key P2TR bech32m address.
+	AddressTypeTaproot
+)
+
+// ChangePolicy selects where a UTXO wallet sends the change from a spend.
+type ChangePolicy int
+
+const (
+	// ChangeInternal sends change to the current address on the internal
+	// chain. This is the default.
+	ChangeInternal ChangePolicy = iota
+
+	// ChangeReuseSource sends change back to the address of the largest
+	// input being spent.
+	ChangeReuseSource
+
+	// ChangeFixedAddress sends change to WalletConfig.ChangeAddress.
+	ChangeFixedAddress
+
+	// ChangeAvoid selects inputs which pay the outputs without leaving
+	// change when such a set exists. The small excess is paid to the
+	// miner. If no such set is found change is sent to the internal chain.
+	ChangeAvoid
+)
+
 // WalletConfig is struct that can be used pass into the constructor
 // for each coin's wallet.
 type WalletConfig struct {
 	DB                   database.Database
-	Logger               *logging.Logger
+	Logger               log.Logger
 	Testnet              bool
 	ClientURL            string
 	FeeURL               string
 	ExchangeRateProvider ExchangeRateProvider
+
+	// Network selects the chain the wallet runs on. If it's
+	// NetworkMainnet, the zero value, and Testnet is set the wallet runs
+	// on testnet. See SelectedNetwork.
+	Network Network
+
+	// FallbackClientURLs are backends which are tried, in order, when
+	// the one at ClientURL can't be opened. See FailoverClient.
+	FallbackClientURLs []string
+
+	// VerifyClientURL is an optional second backend. If set, history
+	// queries are sent to both backends and any discrepancies are logged
+	// and emitted as DiscrepancyEvents by the VerifyingClient.
+	VerifyClientURL string
+
+	// AddressType is the type of address to generate. It is only used
+	// by coins which support more than one type. Since addresses are
+	// persisted this should not be changed after the wallet is created.
+	AddressType AddressType
+
+	// LookaheadWindow is the number of unused addresses the keychain
+	// keeps derived ahead of the last used one. If zero the keychain's
+	// default is used.
+	LookaheadWindow int
+
+	// FeeProvider replaces the coin's default fee provider if set.
+	FeeProvider FeeProvider
+
+	// GapLimit is the number of consecutive unused addresses used by
+	// RecoverWallet to decide when to stop scanning. If zero
+	// DefaultGapLimit is used.
+	GapLimit int
+
+	// ReplaceByFee marks outgoing transactions as replaceable (BIP 125)
+	// so their fee can be bumped later. It is ignored by coins which
+	// don't support replacement.
+	ReplaceByFee bool
+
+	// EscrowECDSA signs escrow spends with ECDSA rather than schnorr for
+	// counterparties which can't verify schnorr signatures. It's only
+	// used by Bitcoin Cash, which signs with schnorr by default.
+	EscrowECDSA bool
+
+	// EscrowCheckSig makes Bitcoin Cash escrow addresses check each key
+	// with its own OP_CHECKSIG instead of OP_CHECKMULTISIG. This lets
+	// every party sign with either schnorr or ECDSA at the cost of a
+	// larger redeem script. All parties must agree on this setting as it
+	// changes the escrow address. Escrows with a timeout are unaffected.
+	EscrowCheckSig bool
+
+	// EscrowP2SH makes Bitcoin escrow addresses legacy P2SH rather than
+	// P2WSH for counterparties which can't spend segwit outputs.
+	// Spending them costs more in fees.
+	EscrowP2SH bool
+
+	// EscrowMuSig2 makes Bitcoin escrow addresses taproot outputs signed
+	// with MuSig2, which takes two signing rounds. Like EscrowCheckSig
+	// all parties must agree on it.
+	EscrowMuSig2 bool
+
+	// EscrowSortedKeys sorts the keys in Bitcoin escrow redeem scripts as
+	// in BIP67 so every party derives the same address whatever order
+	// they pass the keys in. The escrow is flagged so counterparties know
+	// the keys were sorted, but all parties must agree on it as it
+	// changes the escrow address. MuSig2 escrows always sort their keys.
+	EscrowSortedKeys bool
+
+	// ChangePolicy selects where change is sent by UTXO coins.
+	// ChangeAddress is the address used by ChangeFixedAddress.
+	ChangePolicy  ChangePolicy
+	ChangeAddress string
+
+	// PreventAddressReuse stops UTXO coins from paying an address they
+	// have already paid and rotates their own addresses as soon as a
+	// transaction paying them is sent.
+	PreventAddressReuse bool
+
+	// DeterministicBuilds makes UTXO coins build the same transaction
+	// for a spend whenever the wallet is in the same state, so reviewers
+	// and cosigners can reproduce what they're asked to sign.
+	DeterministicBuilds bool
+
+	// SeparateUtxoSources makes UTXO coins pay each spend from the utxos
+	// of a single source, such as one customer's invoices, so a merchant's
+	// funds from different sources aren't linked on chain. See
+	// UtxoSource.
+	SeparateUtxoSources bool
+
+	// Prune configures pruning of old transaction history. Pruning is on
+	// by default; set Prune.Disabled to keep the full history.
+	Prune PruneConfig
+
+	// Confirmations sets how many confirmations the coin's transactions
+	// need before their funds are treated as settled. See
+	// ConfirmationPolicy.
+	Confirmations ConfirmationPolicy
+
+	// Vault enables vault mode for large Bitcoin spends. See VaultConfig.
+	Vault VaultConfig
+
+	// SpendPolicy limits how much UTXO coins spend per transaction and
+	// per day. See SpendPolicy.
+	SpendPolicy SpendPolicy
+
+	// PassphrasePolicy is the strength required of new passphrases. The
+	// zero policy accepts any passphrase.
+	PassphrasePolicy PassphrasePolicy
+
+	// CosignerKey is the account level extended public key of a second
+	// device. If set Bitcoin addresses are 2-of-2 multisigs of the
+	// wallet's key and the device's key at the same path, and spends
+	// wait for the device's approval as CosignRequests. It can't be
+	// changed after the wallet is created.
+	CosignerKey string
+
+	// Descriptor is an output script descriptor of the wallet's addresses,
+	// as an alternative to AddressType and CosignerKey. Its first key is
+	// the wallet's own and the wallet is created from it with
+	// CreateWalletFromDescriptor. Bitcoin accepts single key descriptors
+	// and wsh(sortedmulti(2,...)) of the wallet's key and a cosigner's.
+	Descriptor string
+
+	// Signer signs for wallets created with CreateWatchOnlyWallet, such
+	// as one whose key is split between a client and a server by the
+	// mpc package. It's used by Bitcoin.
+	Signer Signer
+
+	// Offline makes a Bitcoin wallet created with CreateWatchOnlyWallet
+	// export its spends as SigningRequests for an air-gapped wallet
+	// holding the private key, rather than signing them.
+	Offline bool
+}
+
+// KeychainOptions returns the keychain options selected by the config.
+func (cfg *WalletConfig) KeychainOptions() []KeychainOption {
+	var opts []KeychainOption
+	if cfg.LookaheadWindow > 0 {
+		opts = append(opts, LookaheadWindowSize(cfg.LookaheadWindow))
+	}
+	if cfg.PassphrasePolicy != (PassphrasePolicy{}) {
+		opts = append(opts, RequirePassphrase(cfg.PassphrasePolicy))
+	}
+	return opts
 }
 
 // DBTx satisfies the iwallet.Tx interface.
 type DBTx struct {
 	isClosed bool
 	mtx      *sync.Mutex
+	ctx      context.Context
 
 	OnCommit func() error
 }
 
+// NewDBTx returns a DBTx which unlocks mtx when it is committed or rolled
+// back. The caller must already hold the lock.
+func NewDBTx(mtx *sync.Mutex) *DBTx {
+	return &DBTx{mtx: mtx}
+}
+
+// Context returns the context the transaction was begun with by
+// BeginContext, or context.Background() if it was begun with Begin.
+func (tx *DBTx) Context() context.Context {
+	if tx.ctx == nil {
+		return context.Background()
+	}
+	return tx.ctx
+}
+
 // Commit will commit the transaction.
 func (tx *DBTx) Commit() error {
 	if tx.isClosed {
 		panic("dbtx is closed")
 	}
+	// The context is checked before OnCommit runs. Hooks bind their
+	// database writes to it with ContextTx and only broadcast once those
+	// are saved, so a cancelled commit is rolled back in full and one
+	// which has broadcast is never undone.
+	if tx.ctx != nil {
+		if err := tx.ctx.Err(); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
 	if tx.OnCommit != nil {
 		if err := tx.OnCommit(); err != nil {
 			tx.Rollback()
@@ -85,12 +307,44 @@ type WalletBase struct {
 	KeychainOpts []KeychainOption
 	DB           database.Database
 	CoinType     iwallet.CoinType
-	Logger       *logging.Logger
+	Logger       log.Logger
 	AddressFunc  AddrFunc
+	GapLimit     int
+
+	// MessageMagic is the prefix used when hashing messages for
+	// SignMessage and VerifyMessage. If empty DefaultMessageMagic is
+	// used.
+	MessageMagic string
+
+	// Prune configures history pruning. See PruneConfig.
+	Prune PruneConfig
+
+	// SpendPolicy limits how much the wallet spends. See SpendPolicy.
+	SpendPolicy SpendPolicy
+
+	// NormalizeAddress returns the canonical encoding of an address for
+	// the address policy. See AddressPolicyStore.Normalize.
+	NormalizeAddress func(addr iwallet.Address) (iwallet.Address, error)
+
+	// SyncPacer, if set, paces the wallet's chain sync with those of
+	// other wallets. See SetSyncPacer.
+	SyncPacer SyncPacer
+
+	// Confirmations sets how many confirmations transactions need to be
+	// settled. See ConfirmationPolicy.
+	Confirmations ConfirmationPolicy
 
 	rebroacaster     *Rebroadcaster
+	pruner           *Pruner
+	escrows          *EscrowManager
+	invoices         *InvoiceManager
 	subscriptionChan chan *subscription
 	txMtx            sync.Mutex
+	spendAuth        spendAuthorization
+
+	// wg tracks the goroutines started by OpenWallet.
+	wg      sync.WaitGroup
+	stopMtx sync.Mutex
 
 	Done chan struct{}
 }
@@ -99,9 +353,37 @@ type WalletBase struct {
 // once. After Commit() or Rollback() is called the transaction can be discarded.
 func (w *WalletBase) Begin() (iwallet.Tx, error) {
 	w.txMtx.Lock()
+	if w.isClosed() {
+		w.txMtx.Unlock()
+		return nil, ErrWalletClosed
+	}
 	return &DBTx{mtx: &w.txMtx}, nil
 }
 
+// BeginContext is like Begin but gives up waiting for the previous
+// transaction to finish when ctx is done. If ctx is done by the time the
+// transaction is committed, or while its commit hook is saving, it is
+// rolled back and ctx.Err() returned, so nothing is saved or broadcast.
+func (w *WalletBase) BeginContext(ctx context.Context) (iwallet.Tx, error) {
+	if err := LockContext(ctx, &w.txMtx); err != nil {
+		return nil, err
+	}
+	if w.isClosed() {
+		w.txMtx.Unlock()
+		return nil, ErrWalletClosed
+	}
+	return &DBTx{mtx: &w.txMtx, ctx: ctx}, nil
+}
+
+func (w *WalletBase) isClosed() bool {
+	select {
+	case <-w.Done:
+		return true
+	default:
+		return false
+	}
+}
+
 // WalletExists should return whether the wallet exits or has been
 // initialized.
 func (w *WalletBase) WalletExists() bool {
@@ -157,6 +439,39 @@ func (w *WalletBase) CreateWallet(xpriv hd.ExtendedKey, pw []byte, birthday time
 	})
 }
 
+// CreateWatchOnlyWallet initializes the wallet from an account level
+// extended public key. The wallet tracks the same addresses as one created
+// from the private key but can't sign. Coins which support a Signer spend
+// with it instead.
+func (w *WalletBase) CreateWatchOnlyWallet(xpub hd.ExtendedKey, birthday time.Time) error {
+	if xpub.IsPrivate() {
+		return errors.New("watch-only wallets must be created from a public key")
+	}
+	if w.WalletExists() {
+		return fmt.Errorf("wallet already exists for coin %s", w.CoinType.CurrencyCode())
+	}
+	return w.DB.Update(func(tx database.Tx) error {
+		return tx.Save(&database.CoinRecord{
+			MasterPub:       xpub.String(),
+			Coin:            w.CoinType.CurrencyCode(),
+			Birthday:        birthday,
+			BestBlockHeight: 0,
+			BestBlockID:     strings.Repeat("0", 64),
+		})
+	})
+}
+
+// OpenKeychain loads the wallet's keychain without connecting to the chain
+// so that an offline wallet can unlock and sign. OpenWallet replaces it.
+func (w *WalletBase) OpenKeychain() error {
+	keychain, err := NewKeychain(w.DB, w.CoinType, w.AddressFunc, w.KeychainOpts...)
+	if err != nil {
+		return err
+	}
+	w.Keychain = keychain
+	return nil
+}
+
 // Open wallet will be called each time on OpenBazaar start. It
 // will also be called after CreateWallet().
 func (w *WalletBase) OpenWallet() error {
@@ -177,6 +492,8 @@ func (w *WalletBase) OpenWallet() error {
 		CoinType:           w.CoinType,
 		Logger:             w.Logger,
 		TxSubscriptionChan: txSubChan,
+		SyncPacer:          w.SyncPacer,
+		Confirmations:      w.Confirmations.SettledConfirmations(),
 	}
 
 	w.ChainManager = NewChainManager(config)
@@ -184,7 +501,36 @@ func (w *WalletBase) OpenWallet() error {
 		return err
 	}
 
+	if !w.Prune.Disabled {
+		w.pruner = NewPruner(w.DB, w.Logger, w.CoinType, w.ChainManager, w.Prune)
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			w.pruner.Start()
+		}()
+	}
+
+	// The escrow manager receives every transaction sent to
+	// subscribers so it sees the ones for watched escrow addresses.
+	w.escrows = NewEscrowManager(w.DB, w.Logger, w.CoinType)
+	escrowTxs := make(chan iwallet.Transaction)
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		w.escrows.Start(escrowTxs)
+	}()
+
+	w.invoices = NewInvoiceManager(w.DB, w.Logger, w.CoinType)
+	invoiceTxs := make(chan iwallet.Transaction)
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		w.invoices.Start(invoiceTxs)
+	}()
+
+	w.wg.Add(1)
 	go func() {
+		defer w.wg.Done()
 		var (
 			blockSub1  *BlockSubscription
 			blockSub2  *BlockSubscription
@@ -205,12 +551,17 @@ func (w *WalletBase) OpenWallet() error {
 			break
 		}
 
-		w.rebroacaster = NewRebroadcaster(w.DB, w.Logger, w.CoinType, w.ChainClient.Broadcast, blockSub2)
-		go w.rebroacaster.Start()
+		w.rebroacaster = NewRebroadcaster(w.DB, w.Logger, w.CoinType, w.ChainClient, blockSub2)
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			w.rebroacaster.Start()
+		}()
+		defer w.rebroacaster.Stop()
 
 		var (
 			blockSubs []chan iwallet.BlockInfo
-			txSubs    []chan iwallet.Transaction
+			txSubs    = []chan iwallet.Transaction{escrowTxs, invoiceTxs}
 		)
 
 		for {
@@ -224,11 +575,19 @@ func (w *WalletBase) OpenWallet() error {
 				}
 			case blockInfo := <-blockSub1.Out:
 				for _, sub := range blockSubs {
-					sub <- blockInfo
+					select {
+					case sub <- blockInfo:
+					case <-w.Done:
+						return
+					}
 				}
 			case tx := <-txSubChan:
 				for _, sub := range txSubs {
-					sub <- tx
+					select {
+					case sub <- tx:
+					case <-w.Done:
+						return
+					}
 				}
 			case <-w.Done:
 				return
@@ -240,19 +599,112 @@ func (w *WalletBase) OpenWallet() error {
 
 // CloseWallet will be called when OpenBazaar shuts down.
 func (w *WalletBase) CloseWallet() error {
-	w.ChainManager.Stop()
-	if err := w.DB.Close(); err != nil {
-		return err
-	}
-	if err := w.ChainClient.Close(); err != nil {
-		return err
+	err := w.Stop(context.Background())
+	if cerr := w.DB.Close(); cerr != nil && err == nil {
+		err = cerr
 	}
-	if w.rebroacaster != nil {
-		w.rebroacaster.Stop()
+	return err
+}
+
+// Start opens the wallet. It's OpenWallet under the name used by
+// Lifecycle.
+func (w *WalletBase) Start() error {
+	return w.OpenWallet()
+}
+
+// Stop shuts the wallet down without closing the database. New database
+// transactions are refused once the open one, if any, is committed or
+// rolled back. The background loops are then stopped and waited on, queued
+// transactions which are due get a last broadcast attempt and the chain
+// client is closed. If ctx is done first Stop returns ctx.Err() after
+// closing the client; anything left unbroadcast stays queued.
+func (w *WalletBase) Stop(ctx context.Context) error {
+	w.stopMtx.Lock()
+	defer w.stopMtx.Unlock()
+
+	if w.isClosed() {
+		return nil
 	}
 
+	// Even if ctx is done before the open transaction finishes, Done is
+	// closed so no new ones start. The open one will still commit in full.
+	err := LockContext(ctx, &w.txMtx)
 	close(w.Done)
-	return nil
+	if err == nil {
+		w.txMtx.Unlock()
+	}
+
+	if w.ChainManager != nil {
+		w.ChainManager.Stop()
+	}
+	if w.pruner != nil {
+		w.pruner.Stop()
+	}
+	if w.escrows != nil {
+		w.escrows.Stop()
+	}
+	if w.invoices != nil {
+		w.invoices.Stop()
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		if w.ChainManager != nil {
+			w.ChainManager.Wait()
+		}
+		close(stopped)
+	}()
+	if err == nil {
+		select {
+		case <-stopped:
+			if w.rebroacaster != nil {
+				w.rebroacaster.Flush(ctx)
+			}
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+
+	if cerr := w.ChainClient.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// RecoverWallet restores the wallet's address and transaction history from
+// the account keys by scanning both chains until GapLimit consecutive unused
+// addresses are found. It is intended to be run after creating a wallet from
+// an existing seed.
+func (w *WalletBase) RecoverWallet(fromHeight uint64) (*RecoveryResult, error) {
+	tracker := w.ChainManager.newScanTracker(fromHeight)
+	scanner := NewRecoveryScanner(&RecoveryConfig{
+		Client:   w.ChainClient,
+		DB:       w.DB,
+		Keychain: w.Keychain,
+		CoinType: w.CoinType,
+		Logger:   w.Logger,
+		GapLimit: w.GapLimit,
+		SaveFunc: func(txs []iwallet.Transaction) error {
+			newTxs, err := w.ChainManager.saveTransactionsAndUtxos(txs)
+			tracker.Ingested(newTxs)
+			return err
+		},
+		Tracker: tracker,
+	})
+	return scanner.Scan(fromHeight)
+}
+
+// Rescan rebuilds the wallet's transaction history and utxos from the
+// given height. See ChainManager.Rescan.
+func (w *WalletBase) Rescan(fromHeight uint64) error {
+	return w.ChainManager.Rescan(fromHeight)
+}
+
+// RescanFromTime rebuilds the wallet's transaction history and utxos from
+// around the given time.
+func (w *WalletBase) RescanFromTime(t time.Time) error {
+	return w.ChainManager.RescanFromTime(t)
 }
 
 // BlockchainInfo returns the best hash and height of the chain.
@@ -293,9 +745,15 @@ func (w *WalletBase) HasKey(addr iwallet.Address) (bool, error) {
 
 // GetTransaction returns a transaction given it's ID.
 func (w *WalletBase) GetTransaction(id iwallet.TransactionID) (iwallet.Transaction, error) {
+	return w.GetTransactionContext(context.Background(), id)
+}
+
+// GetTransactionContext is like GetTransaction but stops querying the
+// backend when ctx is done.
+func (w *WalletBase) GetTransactionContext(ctx context.Context, id iwallet.TransactionID) (iwallet.Transaction, error) {
 	var record database.TransactionRecord
 	err := w.DB.View(func(tx database.Tx) error {
-		return tx.Read().Where("coin=?", w.CoinType.CurrencyCode()).Where("txid=?", id.String()).First(&record).Error
+		return readContext(ctx, tx).Where("coin=?", w.CoinType.CurrencyCode()).Where("txid=?", id.String()).First(&record).Error
 	})
 	if err == nil {
 		// We need to return the input metadata with this transaction. If it isn't stored with this
@@ -318,11 +776,15 @@ func (w *WalletBase) GetTransaction(id iwallet.TransactionID) (iwallet.Transacti
 	backoff := expbackoff.NewExponentialBackOff()
 	backoff.MaxElapsedTime = time.Second * 30
 
+	client := WithContext(w.ChainClient)
 	for {
-		tx, err := w.ChainClient.GetTransaction(id)
+		tx, err := client.GetTransactionContext(ctx, id)
 		if err == nil {
 			return tx, nil
 		}
+		if ctx.Err() != nil {
+			return tx, ctx.Err()
+		}
 		next := backoff.NextBackOff()
 		if next == expbackoff.Stop {
 			return tx, errors.New("timed out querying for address transactions")
@@ -330,25 +792,79 @@ func (w *WalletBase) GetTransaction(id iwallet.TransactionID) (iwallet.Transacti
 		select {
 		case <-time.After(next):
 			continue
+		case <-ctx.Done():
+			return tx, ctx.Err()
 		case <-w.Done:
-			return tx, errors.New("wallet is closed")
+			return tx, ErrWalletClosed
 		}
 	}
 }
 
+// GetRawTransaction returns the serialized transaction from the backend. It
+// returns ErrRawTransactionUnsupported if the ChainClient can't serve it.
+func (w *WalletBase) GetRawTransaction(id iwallet.TransactionID) ([]byte, error) {
+	rc, ok := optionalClient(w.ChainClient).(RawTransactionClient)
+	if !ok {
+		return nil, ErrRawTransactionUnsupported
+	}
+	return rc.GetRawTransaction(id)
+}
+
+// GetBlockScanTransactions returns the transactions in the block at height
+// with the scripts they spend. It returns ErrScanUnsupported if the
+// ChainClient can't serve them.
+func (w *WalletBase) GetBlockScanTransactions(height uint64) ([]ScanTransaction, error) {
+	sc, ok := optionalClient(w.ChainClient).(ScanClient)
+	if !ok {
+		return nil, ErrScanUnsupported
+	}
+	return sc.GetBlockScanTransactions(height)
+}
+
+// GetScanTransaction returns the transaction with the scripts it spends. It
+// returns ErrScanUnsupported if the ChainClient can't serve it.
+func (w *WalletBase) GetScanTransaction(id iwallet.TransactionID) (ScanTransaction, error) {
+	sc, ok := optionalClient(w.ChainClient).(ScanClient)
+	if !ok {
+		return ScanTransaction{}, ErrScanUnsupported
+	}
+	return sc.GetScanTransaction(id)
+}
+
+// SubscribeMempool subscribes to every transaction entering the backend's
+// mempool. It returns ErrScanUnsupported if the ChainClient can't stream
+// its mempool.
+func (w *WalletBase) SubscribeMempool() (*MempoolSubscription, error) {
+	mc, ok := optionalClient(w.ChainClient).(MempoolClient)
+	if !ok {
+		return nil, ErrScanUnsupported
+	}
+	return mc.SubscribeMempool()
+}
+
 // GetAddressTransactions returns the transactions sending to or spending from this address.
 // Note this will only ever be called for an order's payment address transaction so for the
 // purpose of this method the wallet only needs to be able to track transactions paid to a
 // wallet address and any watched addresses.
 func (w *WalletBase) GetAddressTransactions(addr iwallet.Address) ([]iwallet.Transaction, error) {
+	return w.GetAddressTransactionsContext(context.Background(), addr)
+}
+
+// GetAddressTransactionsContext is like GetAddressTransactions but stops
+// querying the backend when ctx is done.
+func (w *WalletBase) GetAddressTransactionsContext(ctx context.Context, addr iwallet.Address) ([]iwallet.Transaction, error) {
 	backoff := expbackoff.NewExponentialBackOff()
 	backoff.MaxElapsedTime = time.Second * 30
 
+	client := WithContext(w.ChainClient)
 	for {
-		txs, err := w.ChainClient.GetAddressTransactions(addr, 0)
+		txs, err := client.GetAddressTransactionsContext(ctx, addr, 0)
 		if err == nil {
 			return txs, nil
 		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		next := backoff.NextBackOff()
 		if next == expbackoff.Stop {
 			return nil, errors.New("timed out querying for address transactions")
@@ -356,8 +872,10 @@ func (w *WalletBase) GetAddressTransactions(addr iwallet.Address) ([]iwallet.Tra
 		select {
 		case <-time.After(next):
 			continue
+		case <-ctx.Done():
+			return nil, ctx.Err()
 		case <-w.Done:
-			return nil, errors.New("wallet is closed")
+			return nil, ErrWalletClosed
 		}
 	}
 }
@@ -392,7 +910,110 @@ func (w *WalletBase) Transactions(limit int, offsetID iwallet.TransactionID) ([]
 	return txs, nil
 }
 
+// LabeledTransaction is a wallet transaction along with the labels of any
+// wallet addresses it sends to or spends from and the metadata attached to
+// the transaction itself.
+type LabeledTransaction struct {
+	Transaction iwallet.Transaction
+	Labels      map[iwallet.Address]string
+	Metadata    TransactionMetadata
+}
+
+// TransactionHistory is the same as Transactions except each transaction
+// is returned with the labels attached to the wallet addresses it involves
+// and its metadata.
+func (w *WalletBase) TransactionHistory(limit int, offsetID iwallet.TransactionID) ([]LabeledTransaction, error) {
+	txs, err := w.Transactions(limit, offsetID)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		labels   map[iwallet.Address]string
+		metadata map[iwallet.TransactionID]TransactionMetadata
+	)
+	err = w.DB.View(func(dbtx database.Tx) error {
+		labels, err = w.Keychain.addressLabels(dbtx)
+		if err != nil {
+			return err
+		}
+		metadata, err = w.transactionMetadata(dbtx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	history := make([]LabeledTransaction, 0, len(txs))
+	for _, tx := range txs {
+		ltx := LabeledTransaction{
+			Transaction: tx,
+			Labels:      make(map[iwallet.Address]string),
+			Metadata:    metadata[tx.ID],
+		}
+		for _, from := range tx.From {
+			if label, ok := labels[from.Address]; ok {
+				ltx.Labels[from.Address] = label
+			}
+		}
+		for _, to := range tx.To {
+			if label, ok := labels[to.Address]; ok {
+				ltx.Labels[to.Address] = label
+			}
+		}
+		history = append(history, ltx)
+	}
+	return history, nil
+}
+
+// PendingTransaction is a transaction sent by the wallet which has not been
+// broadcast yet because its lock time is in the future.
+type PendingTransaction struct {
+	Txid      iwallet.TransactionID
+	Timestamp time.Time
+
+	// LockTime is a block height if it is below LockTimeThreshold and a
+	// unix timestamp otherwise.
+	LockTime uint32
+}
+
+// PendingTransactions returns the wallet's time locked transactions which
+// are waiting to be broadcast.
+func (w *WalletBase) PendingTransactions() ([]PendingTransaction, error) {
+	var records []database.UnconfirmedTransaction
+	err := w.DB.View(func(tx database.Tx) error {
+		return tx.Read().Where("coin=?", w.CoinType.CurrencyCode()).Where("lock_time > ?", 0).Order("timestamp desc").Find(&records).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	best, err := w.BlockchainInfo()
+	if err != nil {
+		return nil, err
+	}
+	var pending []PendingTransaction
+	for _, rec := range records {
+		if IsLockTimeFinal(rec.LockTime, best) {
+			continue
+		}
+		pending = append(pending, PendingTransaction{
+			Txid:      iwallet.TransactionID(rec.Txid),
+			Timestamp: rec.Timestamp,
+			LockTime:  rec.LockTime,
+		})
+	}
+	return pending, nil
+}
+
+// SetAddressLabel attaches a label and notes to one of the wallet's
+// addresses.
+func (w *WalletBase) SetAddressLabel(addr iwallet.Address, label, notes string) error {
+	return w.Keychain.SetAddressLabel(addr, label, notes)
+}
+
 // Balance should return the confirmed and unconfirmed balance for the wallet.
+// Frozen and immature funds are included. Confirmed funds are those settled
+// by the wallet's ConfirmationPolicy. Use Balances to tell spendable funds
+// apart from pending ones.
 func (w *WalletBase) Balance() (unconfirmed iwallet.Amount, confirmed iwallet.Amount, err error) {
 	err = w.DB.View(func(dbtx database.Tx) error {
 		var (
@@ -418,10 +1039,10 @@ func (w *WalletBase) Balance() (unconfirmed iwallet.Amount, confirmed iwallet.Am
 		}
 
 		for _, utxo := range utxoRecords {
-			if utxo.Height > 0 {
+			if w.isSettled(utxo.Height) {
 				confirmed = confirmed.Add(iwallet.NewAmount(utxo.Amount))
 			} else {
-				if checkIfStxoIsConfirmed(iwallet.TransactionID(utxo.Outpoint[:64]), txMap) {
+				if utxo.Height == 0 && w.settlesUnconfirmedChange() && checkIfStxoIsConfirmed(iwallet.TransactionID(utxo.Outpoint[:64]), txMap) {
 					confirmed = confirmed.Add(iwallet.NewAmount(utxo.Amount))
 				} else {
 					unconfirmed = unconfirmed.Add(iwallet.NewAmount(utxo.Amount))
@@ -516,8 +1137,9 @@ func (w *WalletBase) WatchAddress(tx iwallet.Tx, addrs ...iwallet.Address) error
 // sending to or spending from a watched address.
 func (w *WalletBase) SubscribeTransactions() <-chan iwallet.Transaction {
 	ch := make(chan iwallet.Transaction)
-	w.subscriptionChan <- &subscription{
-		txSub: ch,
+	select {
+	case w.subscriptionChan <- &subscription{txSub: ch}:
+	case <-w.Done:
 	}
 	return ch
 }
@@ -526,8 +1148,9 @@ func (w *WalletBase) SubscribeTransactions() <-chan iwallet.Transaction {
 // to push info about new blocks when they arrive.
 func (w *WalletBase) SubscribeBlocks() <-chan iwallet.BlockInfo {
 	ch := make(chan iwallet.BlockInfo)
-	w.subscriptionChan <- &subscription{
-		blockSub: ch,
+	select {
+	case w.subscriptionChan <- &subscription{blockSub: ch}:
+	case <-w.Done:
 	}
 	return ch
 }
@@ -536,6 +1159,11 @@ func (w *WalletBase) SubscribeBlocks() <-chan iwallet.BlockInfo {
 // return false if the wallet is encrypted or if there is insufficient coins in the wallet
 // to pay the transaction fee/gas. This method should not actually move any funds.
 func (w *WalletBase) CanReleaseFunds(txn iwallet.Transaction, signatures [][]iwallet.EscrowSignature, redeemScript []byte) (bool, error) {
+	if err := w.CheckEscrowRelease(redeemScript); errors.Is(err, ErrEscrowNotReleasable) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
 	return true, nil
 }
 
@@ -559,6 +1187,41 @@ func (w *WalletBase) RemovePassphrase(pw []byte) error {
 	return w.Keychain.RemovePassphrase(pw)
 }
 
+// HasPassphrase returns whether the wallet's keys are encrypted, whether
+// or not it's currently unlocked.
+func (w *WalletBase) HasPassphrase() (bool, error) {
+	return w.Keychain.HasPassphrase()
+}
+
+// IsWatchOnly returns whether the wallet was created without a private key.
+func (w *WalletBase) IsWatchOnly() bool {
+	return w.Keychain.IsWatchOnly()
+}
+
+// VerifyPassphrase returns an error if pw isn't the wallet's passphrase.
+// The wallet isn't unlocked.
+func (w *WalletBase) VerifyPassphrase(pw []byte) error {
+	return w.Keychain.VerifyPassphrase(pw)
+}
+
+// SetRecoveryHint saves a hint to help remember the passphrase. See
+// Keychain.SetRecoveryHint.
+func (w *WalletBase) SetRecoveryHint(pw []byte, hint string) error {
+	return w.Keychain.SetRecoveryHint(pw, hint)
+}
+
+// RecoveryHint returns the hint to the passphrase, or an empty string if
+// none was saved.
+func (w *WalletBase) RecoveryHint() (string, error) {
+	return w.Keychain.RecoveryHint()
+}
+
+// DecryptWithSeed removes the passphrase of a wallet whose passphrase is
+// lost using the seed it was created from. See Keychain.DecryptWithSeed.
+func (w *WalletBase) DecryptWithSeed(seed []byte, coinIndex uint32) error {
+	return w.Keychain.DecryptWithSeed(seed, coinIndex)
+}
+
 // Unlock is called just prior to calling Spend(). The wallet should
 // decrypt the private key and hold the decrypted key in memory for
 // the provided duration after which it should be purged from memory.
@@ -567,8 +1230,27 @@ func (w *WalletBase) Unlock(pw []byte, howLong time.Duration) error {
 	return w.Keychain.Unlock(pw, howLong)
 }
 
+// Lock immediately purges the decrypted private keys from memory
+// rather than waiting for the unlock period to expire.
+func (w *WalletBase) Lock() error {
+	return w.Keychain.Lock()
+}
+
+// IsLocked returns whether the private keys are currently unavailable
+// for signing.
+func (w *WalletBase) IsLocked() bool {
+	return w.Keychain.IsEncrypted()
+}
+
+// TimeUntilLock returns how long the wallet will remain unlocked. Zero
+// is returned if the wallet is locked.
+func (w *WalletBase) TimeUntilLock() time.Duration {
+	return w.Keychain.TimeUntilLock()
+}
+
 // GatherCoins returns the full list of spendable coins in the wallet along
-// with the key needed to spend. The wallet must be unlocked to use this
+// with the key needed to spend. Frozen coins and those spent by queued
+// transactions are not included. The wallet must be unlocked to use this
 // function.
 func (w *WalletBase) GatherCoins(dbtx database.Tx) (map[coinset.Coin]*hd.ExtendedKey, error) {
 	var utxoRecords []database.UtxoRecord
@@ -581,34 +1263,80 @@ func (w *WalletBase) GatherCoins(dbtx database.Tx) (map[coinset.Coin]*hd.Extende
 		return nil, err
 	}
 
+	graph, err := w.loadAncestorGraph(dbtx)
+	if err != nil {
+		return nil, err
+	}
+
+	queued, err := w.queuedInputs(dbtx)
+	if err != nil {
+		return nil, err
+	}
+
 	m := make(map[coinset.Coin]*hd.ExtendedKey)
 	for _, u := range utxoRecords {
-		var confirmations int64
-		if u.Height > 0 {
-			confirmations = int64(bcInfo.Height-u.Height) + 1
-		}
-
-		var op wire.OutPoint
-		ser, err := hex.DecodeString(u.Outpoint)
-		if err != nil {
-			return nil, err
+		if u.Frozen || queued[u.Outpoint] {
+			continue
 		}
-		if err := op.Deserialize(bytes.NewReader(ser)); err != nil {
-			return nil, err
+		if u.Height == 0 {
+			txid, err := outpointTxid(u.Outpoint)
+			if err != nil {
+				return nil, err
+			}
+			// Spending this would exceed the mempool's ancestor limit.
+			if graph.count(txid) >= MaxUnconfirmedAncestors {
+				continue
+			}
 		}
-
-		addr := iwallet.NewAddress(u.Address, w.CoinType)
-		c, err := NewCoin(iwallet.TransactionID(op.Hash.String()), op.Index, iwallet.NewAmount(u.Amount), confirmations, addr)
+		c, key, err := w.coinForUtxo(dbtx, u, bcInfo.Height)
 		if err != nil {
-			continue
+			return nil, err
 		}
-
-		key, err := w.Keychain.KeyForAddress(dbtx, addr, nil)
-		if err != nil {
+		if c == nil {
 			continue
 		}
-
 		m[c] = key
 	}
 	return m, nil
 }
+
+// coinForUtxo returns the coin and key for the utxo record. A nil coin is
+// returned if the record isn't spendable by the keychain.
+func (w *WalletBase) coinForUtxo(dbtx database.Tx, u database.UtxoRecord, bestHeight uint64) (coinset.Coin, *hd.ExtendedKey, error) {
+	var confirmations int64
+	if u.Height > 0 {
+		confirmations = int64(bestHeight-u.Height) + 1
+	}
+
+	var op wire.OutPoint
+	ser, err := hex.DecodeString(u.Outpoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := op.Deserialize(bytes.NewReader(ser)); err != nil {
+		return nil, nil, err
+	}
+
+	addr := iwallet.NewAddress(u.Address, w.CoinType)
+	c, err := NewCoin(iwallet.TransactionID(op.Hash.String()), op.Index, iwallet.NewAmount(u.Amount), confirmations, addr)
+	if err != nil {
+		return nil, nil, nil
+	}
+
+	c.(*Coin).Source = u.Source
+
+	key, err := w.Keychain.KeyForAddress(dbtx, addr, nil)
+	if err != nil {
+		return nil, nil, nil
+	}
+	return c, key, nil
+}
+
+// moduleLogger returns a logger for one of the wallet's modules which
+// adds the coin to every record. A nil logger is replaced with log.New.
+func moduleLogger(logger log.Logger, module string, coinType iwallet.CoinType) log.Logger {
+	if logger == nil {
+		logger = log.New(module)
+	}
+	return logger.Module(module).With(log.FieldCoin, coinType.CurrencyCode())
+}
@@ -1,28 +1,27 @@
 package base
 
 import (
+	"context"
 	"encoding/hex"
+	"errors"
 	hd "github.com/btcsuite/btcutil/hdkeychain"
 	"github.com/cpacia/multiwallet/database"
-	"github.com/cpacia/multiwallet/database/sqlitedb"
+	"github.com/cpacia/multiwallet/database/memorydb"
+	"github.com/cpacia/multiwallet/log"
 	iwallet "github.com/cpacia/wallet-interface"
-	"github.com/op/go-logging"
 	"testing"
 	"time"
 )
 
 func setupWallet() (*WalletBase, error) {
-	db, err := sqlitedb.NewMemoryDB()
+	db, err := memorydb.NewMemoryDB()
 	if err != nil {
 		return nil, err
 	}
 	if err := database.InitializeDatabase(db); err != nil {
 		return nil, err
 	}
-	logger, err := logging.GetLogger("test")
-	if err != nil {
-		return nil, err
-	}
+	logger := log.New("test")
 	w := &WalletBase{
 		ChainClient: NewMockChainClient(),
 		Done:        make(chan struct{}),
@@ -82,6 +81,49 @@ func TestWalletBase_OpenCloseWallet(t *testing.T) {
 	}
 }
 
+func TestWalletBase_Stop(t *testing.T) {
+	w, err := setupWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	xpriv, err := hd.NewKeyFromString("tprv8ZgxMBicQKsPeghT19pungdFLMJM2hMs3EEn5WtgobD7wuQSFQu4VNaEJXH9HS3RhhLT4wgZ3hj31m3kafuxhL9vfGTRtBVLSog4zjxW3L1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.CreateWallet(*xpriv, nil, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stop gives up waiting on the open transaction when ctx is done.
+	wtx, err := w.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if err := w.Stop(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+
+	// The open transaction can still commit but no new ones start.
+	if err := wtx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Begin(); err != ErrWalletClosed {
+		t.Errorf("Expected wallet closed, got %v", err)
+	}
+
+	if err := w.Stop(context.Background()); err != nil {
+		t.Errorf("Expected second stop to be a no-op, got %v", err)
+	}
+}
+
 func TestWalletBase_Subscriptions(t *testing.T) {
 	w, err := setupWallet()
 	if err != nil {
@@ -325,10 +367,19 @@ func TestWalletBase_EncryptDecrypt(t *testing.T) {
 		t.Errorf("Expected ErrEncryptedKeychain, got %s", err)
 	}
 
+	clock := newTestClock()
+	w.Keychain.lockManager.now = clock.Now
+
 	if err := w.Unlock([]byte("wrong password"), time.Second); err == nil {
 		t.Errorf("Expected decryption error got nil")
 	}
 
+	if err := w.Unlock(pw, time.Second); !errors.Is(err, ErrUnlockThrottled) {
+		t.Errorf("Expected ErrUnlockThrottled, got %v", err)
+	}
+
+	clock.Advance(defaultUnlockBackoff)
+
 	if err := w.Unlock(pw, time.Second); err != nil {
 		t.Fatal(err)
 	}
@@ -809,3 +860,54 @@ func TestWalletBase_GatherCoins(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func BenchmarkWalletBase_GatherCoins(b *testing.B) {
+	kc := setupLargeKeychain(b, 50000)
+	w := &WalletBase{
+		ChainManager: NewChainManager(&ChainConfig{DB: kc.db, Keychain: kc, CoinType: iwallet.CtMock}),
+		Keychain:     kc,
+		DB:           kc.db,
+		CoinType:     iwallet.CtMock,
+	}
+	w.ChainManager.best = iwallet.BlockInfo{Height: 1000}
+
+	// A utxo on every hundredth address.
+	err := kc.db.Update(func(dbtx database.Tx) error {
+		for i, addr := range kc.index.Addresses() {
+			if i%100 != 0 {
+				continue
+			}
+			tx := NewMockTransaction(nil, &addr)
+			id, err := hex.DecodeString(tx.ID.String())
+			if err != nil {
+				return err
+			}
+			err = dbtx.Save(&database.UtxoRecord{
+				Coin:     iwallet.CtMock,
+				Amount:   tx.To[0].Amount.String(),
+				Address:  addr.String(),
+				Height:   500,
+				Outpoint: hex.EncodeToString(append(id, []byte{0x00, 0x00, 0x00, 0x00}...)),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := kc.db.View(func(dbtx database.Tx) error {
+			coins, err := w.GatherCoins(dbtx)
+			ZeroCoinKeys(coins)
+			return err
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -5,8 +5,9 @@ import (
 	"errors"
 	expbackoff "github.com/cenkalti/backoff"
 	"github.com/cpacia/multiwallet/database"
+	"github.com/cpacia/multiwallet/headers"
+	"github.com/cpacia/multiwallet/log"
 	iwallet "github.com/cpacia/wallet-interface"
-	"github.com/op/go-logging"
 	"gorm.io/gorm"
 	"sync"
 	"time"
@@ -18,9 +19,16 @@ type ChainConfig struct {
 	DB                 database.Database
 	Keychain           *Keychain
 	CoinType           iwallet.CoinType
-	Logger             *logging.Logger
+	Logger             log.Logger
 	EventBus           Bus
 	TxSubscriptionChan chan iwallet.Transaction
+
+	// SyncPacer, if set, paces the sync with those of other wallets.
+	SyncPacer SyncPacer
+
+	// Confirmations is the number of confirmations a transaction needs
+	// to be settled. Defaults to DefaultConfirmations.
+	Confirmations uint64
 }
 
 // ChainManager manages the downloading of transactions for the wallet.
@@ -32,13 +40,51 @@ type ChainManager struct {
 	coinType         iwallet.CoinType
 	keychain         *Keychain
 	db               database.Database
-	logger           *logging.Logger
+	logger           log.Logger
 	unconfirmedTxs   map[iwallet.TransactionID]iwallet.Transaction
 	watchOnly        []iwallet.Address
 	subscriptionChan chan iwallet.Transaction
 	eventBus         Bus
 	msgChan          chan interface{}
 	done             chan struct{}
+
+	// wg tracks the goroutine which initializes the chain and the
+	// chainHandler so that Wait can block until they exit.
+	wg sync.WaitGroup
+
+	// headers is the verified header chain confirmations are checked
+	// against. It's nil if the client isn't a HeaderClient.
+	headers      *headers.Store
+	headerClient HeaderClient
+	headerMtx    sync.Mutex
+
+	// waiters are the pending WaitForConfirmation calls by txid.
+	waiters map[iwallet.TransactionID][]*confirmationWaiter
+	waitMtx sync.Mutex
+
+	// pacer, if set, paces the sync. status is reported by SyncStatus
+	// and scanFailed records whether a request failed during the scan in
+	// progress. scan tracks the last scan. These are guarded by
+	// statusMtx.
+	pacer      SyncPacer
+	status     SyncStatus
+	scanFailed bool
+	scan       *ScanTracker
+	statusMtx  sync.Mutex
+
+	// walletBus carries the events subscribed to through the WalletBase,
+	// such as scan progress and settlements.
+	walletBus Bus
+
+	// confirmations is the number of confirmations a transaction needs
+	// to be settled. settleMtx serializes notifySettled.
+	confirmations uint64
+	settleMtx     sync.Mutex
+
+	// streaming is set if the client is a StreamingClient. Confirmations
+	// of unconfirmed transactions are then pushed by the transaction
+	// subscription rather than polled for every block.
+	streaming bool
 }
 
 // NewChainManager builds a new ChainManager from the ChainConfig.
@@ -48,13 +94,17 @@ func NewChainManager(config *ChainConfig) *ChainManager {
 		keychain:         config.Keychain,
 		coinType:         config.CoinType,
 		bestMtx:          sync.RWMutex{},
-		logger:           config.Logger,
+		logger:           moduleLogger(config.Logger, "chain", config.CoinType),
 		db:               config.DB,
 		unconfirmedTxs:   make(map[iwallet.TransactionID]iwallet.Transaction),
 		subscriptionChan: config.TxSubscriptionChan,
 		eventBus:         config.EventBus,
 		msgChan:          make(chan interface{}),
 		done:             make(chan struct{}),
+		waiters:          make(map[iwallet.TransactionID][]*confirmationWaiter),
+		pacer:            config.SyncPacer,
+		walletBus:        NewBus(),
+		confirmations:    config.Confirmations,
 	}
 }
 
@@ -66,7 +116,13 @@ type scanJob struct {
 }
 
 type saveJob struct {
-	txs []iwallet.Transaction
+	txs     []iwallet.Transaction
+	errChan chan error
+}
+
+type ingestJob struct {
+	tx      iwallet.Transaction
+	errChan chan error
 }
 
 type addUnconfirmed struct {
@@ -118,11 +174,19 @@ func (cm *ChainManager) Start() error {
 	if err != nil {
 		return err
 	}
+	// Until the backend is reached the last block saved is the best one
+	// known, so spends can still be built and queued while it's down.
+	cm.bestMtx.Lock()
+	cm.best = currentBestBlock
+	cm.bestMtx.Unlock()
+
 	addrs, err := cm.keychain.GetAddresses()
 	if err != nil {
 		return err
 	}
+	cm.wg.Add(1)
 	go func() {
+		defer cm.wg.Done()
 		var (
 			transactionSub *TransactionSubscription
 			blocksSub      *BlockSubscription
@@ -132,12 +196,16 @@ func (cm *ChainManager) Start() error {
 
 		backoff.MaxElapsedTime = 0
 		backoff.InitialInterval = time.Second
+		if !cm.begin() {
+			return
+		}
 		for {
 			// Here we initialize the chain, including making a couple API calls
 			// to set the best height and hash. If any of that fails, we will
 			// recursively call this function again with an exponential backoff.
 			transactionSub, blocksSub, fromHeight, err = cm.initializeChain(currentBestBlock, unconfirmed, addrs, watchAddresses)
 			if err != nil {
+				cm.setSyncError(err)
 				backoffDuration := backoff.NextBackOff()
 				cm.logger.Errorf("[%s] Error initializing chain: %s. Retrying in %s", cm.coinType, err, backoffDuration)
 				select {
@@ -150,13 +218,55 @@ func (cm *ChainManager) Start() error {
 			break
 		}
 
+		if err := cm.initHeaders(); err != nil {
+			cm.logger.Warningf("[%s] Confirmations will not be verified: %s", cm.coinType, err)
+		} else if cm.headers != nil {
+			go func() {
+				if err := cm.syncHeaders(); err != nil {
+					cm.logger.Errorf("[%s] Error syncing headers: %s", cm.coinType, err)
+				}
+			}()
+		}
+
+		if mc, ok := optionalClient(cm.client).(MempoolClient); ok {
+			mempoolSub, err := mc.SubscribeMempool()
+			if err != nil {
+				cm.logger.Errorf("[%s] Error subscribing to mempool: %s", cm.coinType, err)
+			} else {
+				go cm.mempoolHandler(mempoolSub)
+			}
+		}
+
 		if cm.eventBus != nil {
 			cm.eventBus.Emit(&ChainStartedEvent{})
 		}
 
+		var reverted map[iwallet.TransactionID]iwallet.Transaction
+		if fromHeight == 0 && currentBestBlock.Height > 0 {
+			// Our best block was reorged out while we were offline.
+			var forkHeight uint64
+			reverted, forkHeight, err = cm.rollbackReorg()
+			if err != nil {
+				cm.logger.Errorf("[%s] Error rolling back reorged transactions: %s", cm.coinType, err)
+			} else {
+				fromHeight = forkHeight
+			}
+		}
+
 		cm.logger.Debugf("[%s] Chain initialized at height: %d", cm.coinType, fromHeight)
-		go cm.chainHandler(transactionSub, blocksSub)
-		go cm.ScanTransactions(fromHeight)
+		cm.wg.Add(1)
+		go func() {
+			defer cm.wg.Done()
+			cm.chainHandler(transactionSub, blocksSub)
+		}()
+
+		// The unconfirmed transactions were loaded before the
+		// rollback so the reverted ones are added once the
+		// chainHandler is running.
+		go func() {
+			cm.trackReverted(reverted)
+			cm.ScanTransactions(fromHeight)
+		}()
 	}()
 	return nil
 }
@@ -166,6 +276,12 @@ func (cm *ChainManager) Stop() {
 	close(cm.done)
 }
 
+// Wait blocks until the ChainManager has stopped processing blocks and
+// transactions after Stop is called.
+func (cm *ChainManager) Wait() {
+	cm.wg.Wait()
+}
+
 // chainHandler is the main loop for the ChainManager. It guards against concurrent
 // access to critical objects and processes blocks and transactions in the order
 // they come in.
@@ -175,7 +291,10 @@ func (cm *ChainManager) chainHandler(transactionSub *TransactionSubscription, bl
 	scanSem := make(chan struct{}, 1)
 	scanSem <- struct{}{}
 
-	var lastBlockNotifyTime time.Time
+	var (
+		lastBlockNotifyTime time.Time
+		polled              bool
+	)
 	for {
 		select {
 		case m := <-cm.msgChan:
@@ -185,24 +304,47 @@ func (cm *ChainManager) chainHandler(transactionSub *TransactionSubscription, bl
 				case <-scanSem:
 				default:
 					msg.errChan <- errScanInProgress
+					continue
 				}
 
 				addrs, err := cm.keychain.GetAddresses()
 				if err != nil {
+					scanSem <- struct{}{}
 					msg.errChan <- err
 					continue
 				}
 
-				scanSem <- struct{}{}
 				go func(addrs []iwallet.Address, job *scanJob) {
-					err := cm.scanTransactions(addrs, job.fromHeight)
-					msg.errChan <- err
+					tracker := cm.newScanTracker(job.fromHeight)
+					cm.updateStatus(func(status *SyncStatus) {
+						cm.scanFailed = false
+					})
+					err := cm.scanTransactions(addrs, job.fromHeight, tracker)
+					tracker.Finish(err)
+					cm.notifySettled()
+					cm.updateStatus(func(status *SyncStatus) {
+						if err != nil {
+							status.LastError = err
+							return
+						}
+						if !cm.scanFailed {
+							status.LastError = nil
+						}
+						status.Synced = true
+					})
+					scanSem <- struct{}{}
+					job.errChan <- err
 				}(append(addrs, cm.watchOnly...), msg)
 			case *saveJob:
 				newTxs, err := cm.saveTransactionsAndUtxos(msg.txs)
 				if err != nil {
 					cm.logger.Errorf("[%s] Error saving incoming transaction: %s", cm.coinType, err)
 				}
+				if msg.errChan != nil {
+					msg.errChan <- err
+				}
+				go cm.notifyWaiters()
+				go cm.notifySettled()
 				if newTxs > 0 {
 					addrs, err := cm.keychain.GetAddresses()
 					if err != nil {
@@ -213,6 +355,19 @@ func (cm *ChainManager) chainHandler(transactionSub *TransactionSubscription, bl
 					}()
 				}
 
+			case *ingestJob:
+				if !cm.isRelevant(msg.tx) {
+					msg.errChan <- ErrNotWalletTransaction
+					continue
+				}
+				if msg.tx.Height == 0 {
+					cm.unconfirmedTxs[msg.tx.ID] = msg.tx
+				}
+				go func(job *ingestJob) {
+					txs := cm.checkConfirmations([]iwallet.Transaction{job.tx})
+					cm.msgChan <- &saveJob{txs: txs, errChan: job.errChan}
+				}(msg)
+
 			case *addUnconfirmed:
 				cm.unconfirmedTxs[msg.tx.ID] = msg.tx
 
@@ -231,17 +386,27 @@ func (cm *ChainManager) chainHandler(transactionSub *TransactionSubscription, bl
 				if cm.eventBus != nil {
 					cm.eventBus.Emit(&AddAddressSubscriptionEvent{})
 				}
+
+			case *mempoolTx:
+				cm.checkConflicts(msg.tx)
 			}
 		case tx := <-transactionSub.Out:
+			cm.checkConflicts(tx)
 			if tx.Height == 0 {
 				cm.unconfirmedTxs[tx.ID] = tx
+			} else if prev, ok := cm.unconfirmedTxs[tx.ID]; ok && cm.streaming {
+				go cm.confirmUnconfirmed(map[iwallet.TransactionID]iwallet.Transaction{tx.ID: prev}, []iwallet.Transaction{tx})
 			}
 			go func() {
-				cm.msgChan <- &saveJob{txs: []iwallet.Transaction{tx}}
+				txs := cm.checkConfirmations([]iwallet.Transaction{tx})
+				cm.msgChan <- &saveJob{txs: txs}
 			}()
 
 		case blockInfo := <-blocksSub.Out:
-			if len(cm.unconfirmedTxs) > 0 {
+			// A streaming client pushes confirmations. The first
+			// block still polls for those which confirmed while
+			// the wallet was closed.
+			if len(cm.unconfirmedTxs) > 0 && (!cm.streaming || !polled) {
 				unconfirmed := make(map[iwallet.TransactionID]iwallet.Transaction)
 				for k, v := range cm.unconfirmedTxs {
 					unconfirmed[k] = v
@@ -249,6 +414,7 @@ func (cm *ChainManager) chainHandler(transactionSub *TransactionSubscription, bl
 
 				go cm.updateUnconfirmed(unconfirmed)
 			}
+			polled = true
 			cm.bestMtx.Lock()
 			previousBest := cm.best
 			cm.best = blockInfo
@@ -265,48 +431,18 @@ func (cm *ChainManager) chainHandler(transactionSub *TransactionSubscription, bl
 			if err != nil {
 				cm.logger.Errorf("[%s] Error updating database with new block height: %s", cm.coinType, err)
 			}
-			if previousBest.BlockID.String() != blockInfo.PrevBlock.String() {
-				// Possible reorg detected. Delete all transactions and trigger a
-				// rescan from genesis to make sure our state is up to date.
-				err := cm.db.Update(func(tx database.Tx) error {
-					var savedTxs []database.TransactionRecord
-					if err := tx.Read().Where("coin=?", cm.coinType.CurrencyCode()).Find(&savedTxs).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
-						return err
-					}
-					for _, rec := range savedTxs {
-						if err := tx.Delete("txid", rec.Txid, &database.TransactionRecord{}); err != nil {
-							return err
-						}
-					}
-					var savedUtxos []database.UtxoRecord
-					if err := tx.Read().Where("coin=?", cm.coinType.CurrencyCode()).Find(&savedUtxos).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
-						return err
-					}
-					for _, rec := range savedUtxos {
-						if err := tx.Delete("outpoint", rec.Outpoint, &database.UtxoRecord{}); err != nil {
-							return err
-						}
-					}
-					return nil
-				})
-				if err != nil {
-					cm.logger.Errorf("[%s] Error deleting transactions during reorg: %s", cm.coinType, err)
-				}
-
+			if cm.headers != nil {
 				go func() {
-					cm.logger.Debugf("[%s] Possible reorg. Re-scanning transactions", cm.coinType)
-					errChan := make(chan error)
-					cm.msgChan <- &scanJob{
-						fromHeight: 0,
-						errChan:    errChan,
-					}
-
-					err := <-errChan
-					if err != nil {
-						cm.logger.Errorf("[%s] Error scanning transactions after reorg detected: %s", cm.coinType, err)
+					if err := cm.syncHeaders(); err != nil {
+						cm.logger.Errorf("[%s] Error syncing headers: %s", cm.coinType, err)
 					}
 				}()
 			}
+			if previousBest.BlockID.String() != blockInfo.PrevBlock.String() {
+				go cm.handleReorg()
+			}
+			go cm.notifyWaiters()
+			go cm.notifySettled()
 			if cm.eventBus != nil {
 				cm.eventBus.Emit(&BlockReceivedEvent{})
 			}
@@ -359,6 +495,23 @@ func (cm *ChainManager) initializeChain(currentBestBlock iwallet.BlockInfo, unco
 		scanFrom = 0
 	}
 
+	if sc, ok := optionalClient(cm.client).(StreamingClient); ok {
+		// The scan from scanFrom covers the history before the tip so
+		// the streams only need to resume from it after a reconnect.
+		checkpoint := StreamCheckpoint{Height: blockchainInfo.Height, BlockID: blockchainInfo.BlockID}
+		transactionSub, err := sc.SubscribeAddresses(addrs, checkpoint)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		blocksSub, err := sc.SubscribeBlocksFrom(checkpoint)
+		if err != nil {
+			transactionSub.Close()
+			return nil, nil, 0, err
+		}
+		cm.streaming = true
+		return transactionSub, blocksSub, scanFrom, nil
+	}
+
 	transactionSub, err := cm.client.SubscribeTransactions(addrs)
 	if err != nil {
 		return nil, nil, 0, err
@@ -472,11 +625,85 @@ func (cm *ChainManager) ScanTransactions(fromHeight uint64) {
 	}
 }
 
+// Rescan deletes the transactions confirmed at or above fromHeight, along
+// with any unconfirmed transactions, and replays the wallet's history from
+// the ChainClient starting at that height. The keychain is extended as used
+// addresses are found and the utxo set is rebuilt. It blocks until the scan
+// completes. This is needed after restoring from an old backup or importing
+// keys.
+func (cm *ChainManager) Rescan(fromHeight uint64) error {
+	err := cm.db.Update(func(dbtx database.Tx) error {
+		var savedTxs []database.TransactionRecord
+		if err := dbtx.Read().Where("coin=?", cm.coinType.CurrencyCode()).Find(&savedTxs).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		for _, rec := range savedTxs {
+			if rec.BlockHeight == 0 || rec.BlockHeight >= fromHeight {
+				if err := dbtx.Delete("txid", rec.Txid, &database.TransactionRecord{}); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	cm.logger.Infof("[%s] Rescanning transactions from height %d", cm.coinType, fromHeight)
+	errChan := make(chan error)
+	cm.msgChan <- &scanJob{
+		fromHeight: fromHeight,
+		errChan:    errChan,
+	}
+	return <-errChan
+}
+
+// RescanFromTime is like Rescan but starts from an estimate of the height of
+// the chain at time t.
+func (cm *ChainManager) RescanFromTime(t time.Time) error {
+	return cm.Rescan(cm.heightAtTime(t))
+}
+
+// heightAtTime estimates the height of the chain at time t from the best
+// block. Blocks often arrive faster than the target interval so the
+// estimate assumes twice the rate, erring towards scanning more history.
+func (cm *ChainManager) heightAtTime(t time.Time) uint64 {
+	best := cm.BestBlock()
+	bestTime := best.BlockTime
+	if bestTime.IsZero() {
+		bestTime = time.Now()
+	}
+	elapsed := bestTime.Sub(t)
+	if elapsed <= 0 {
+		return best.Height
+	}
+	blocks := uint64(elapsed / (targetBlockInterval(cm.coinType) / 2))
+	if blocks >= best.Height {
+		return 0
+	}
+	return best.Height - blocks
+}
+
+// targetBlockInterval returns the expected time between blocks for the coin.
+func targetBlockInterval(coinType iwallet.CoinType) time.Duration {
+	switch coinType {
+	case iwallet.CtLitecoin:
+		return time.Second * 150
+	case iwallet.CtZCash:
+		return time.Second * 75
+	case iwallet.CtEthereum:
+		return time.Second * 13
+	}
+	return time.Minute * 10
+}
+
 // scanTransactions will query the ChainClient for the transactions for each address. It
-// tries to have no more than 20 parallel inflight requests at one time. If any returned
+// tries to have no more than 20 parallel inflight requests at one time and
+// each waits for the SyncPacer, if there is one. If any returned
 // transactions are new, it will extend the keychain and recursively call this method
 // again to redo the query with the newly generated addresses.
-func (cm *ChainManager) scanTransactions(addrs []iwallet.Address, fromHeight uint64) error {
+func (cm *ChainManager) scanTransactions(addrs []iwallet.Address, fromHeight uint64, tracker *ScanTracker) error {
 	var (
 		addrChan     = make(chan iwallet.Address, 20)
 		responseChan = make(chan []iwallet.Transaction, len(addrs))
@@ -488,16 +715,28 @@ func (cm *ChainManager) scanTransactions(addrs []iwallet.Address, fromHeight uin
 		}
 		close(addrChan)
 	}()
-	var wg sync.WaitGroup
+	var (
+		wg       sync.WaitGroup
+		errMtx   sync.Mutex
+		fetchErr error
+	)
+	tracker.AddAddresses(len(addrs))
 	wg.Add(len(addrs))
 	go func() {
 		for addr := range addrChan {
+			if !cm.pace() {
+				wg.Done()
+				continue
+			}
 			go func(address iwallet.Address) {
 				defer wg.Done()
 				txs, err := cm.client.GetAddressTransactions(address, fromHeight)
 				if err != nil {
 					cm.logger.Errorf("[%s] Error fetching transactions for address %s: %s", cm.coinType, address, err)
-					return
+					errMtx.Lock()
+					fetchErr = err
+					errMtx.Unlock()
+					txs = nil
 				}
 				responseChan <- txs
 			}(addr)
@@ -510,12 +749,20 @@ func (cm *ChainManager) scanTransactions(addrs []iwallet.Address, fromHeight uin
 	txs := make([]iwallet.Transaction, 0, len(addrs))
 	for resp := range responseChan {
 		txs = append(txs, resp...)
+		tracker.Scanned()
+	}
+	if fetchErr != nil {
+		cm.updateStatus(func(status *SyncStatus) {
+			status.LastError = fetchErr
+			cm.scanFailed = true
+		})
 	}
 
-	newTxs, err := cm.saveTransactionsAndUtxos(txs)
+	newTxs, err := cm.saveTransactionsAndUtxos(cm.checkConfirmations(txs))
 	if err != nil {
 		return err
 	}
+	tracker.Ingested(newTxs)
 	// If there were any new transaction we need to extend the keychain
 	// and rescan so as to detect any additional transactions for the new
 	// keys.
@@ -532,7 +779,7 @@ func (cm *ChainManager) scanTransactions(addrs []iwallet.Address, fromHeight uin
 				addrs: newAddrs,
 			}
 		}()
-		return cm.scanTransactions(newAddrs, fromHeight)
+		return cm.scanTransactions(newAddrs, fromHeight, tracker)
 	}
 	if cm.eventBus != nil {
 		cm.eventBus.Emit(&ScanCompleteEvent{})
@@ -579,6 +826,14 @@ func (cm *ChainManager) updateUnconfirmed(unconfirmed map[iwallet.TransactionID]
 	for resp := range responseChan {
 		responses = append(responses, resp)
 	}
+	cm.confirmUnconfirmed(unconfirmed, responses)
+}
+
+// confirmUnconfirmed records the confirmations of the unconfirmed
+// transactions among the responses, whether polled by updateUnconfirmed or
+// pushed by a StreamingClient.
+func (cm *ChainManager) confirmUnconfirmed(unconfirmed map[iwallet.TransactionID]iwallet.Transaction, responses []iwallet.Transaction) {
+	responses = cm.checkConfirmations(responses)
 
 	updated := make([]iwallet.Transaction, 0, len(unconfirmed))
 	err := cm.db.Update(func(tx database.Tx) error {
@@ -627,7 +882,7 @@ func (cm *ChainManager) updateUnconfirmed(unconfirmed map[iwallet.TransactionID]
 		return nil
 	})
 	if err != nil {
-		cm.logger.Error(err)
+		cm.logger.Errorf("[%s] Error updating unconfirmed transactions: %s", cm.coinType, err)
 	}
 
 	// Send updated transactions out to the subscriber.
@@ -637,6 +892,9 @@ func (cm *ChainManager) updateUnconfirmed(unconfirmed map[iwallet.TransactionID]
 		}
 	}
 
+	cm.notifyWaiters()
+	cm.notifySettled()
+
 	if cm.eventBus != nil {
 		cm.eventBus.Emit(&UpdateUnconfirmedCompleteEvent{})
 	}
@@ -651,16 +909,18 @@ func (cm *ChainManager) saveTransactionsAndUtxos(newTxs []iwallet.Transaction) (
 		addrMap      = make(map[iwallet.Address]bool)
 	)
 
-	addrs, err := cm.keychain.GetAddresses()
-	if err != nil {
-		return 0, err
-	}
-
-	for _, addr := range addrs {
-		addrMap[addr] = true
-	}
+	err := cm.db.Update(func(dbtx database.Tx) error {
+		// The address index is brought up to date with the keys
+		// derived since the last save rather than loading every
+		// address record again.
+		addrs, err := cm.keychain.allAddresses(dbtx)
+		if err != nil {
+			return err
+		}
+		for _, addr := range addrs {
+			addrMap[addr] = true
+		}
 
-	err = cm.db.Update(func(dbtx database.Tx) error {
 		// First load all the transactions from the db.
 		var savedTxs []database.TransactionRecord
 		if err := dbtx.Read().Where("coin=?", cm.coinType.CurrencyCode()).Find(&savedTxs).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
@@ -669,14 +929,29 @@ func (cm *ChainManager) saveTransactionsAndUtxos(newTxs []iwallet.Transaction) (
 
 		// Make a map out of them for easy querying.
 		txMap := make(map[iwallet.TransactionID]database.TransactionRecord)
+		var toSave []*database.TransactionRecord
 		for _, tx := range savedTxs {
 			txMap[tx.TransactionID()] = tx
 		}
 
+		// Pruned transactions are skipped if the client returns them
+		// again. Saving them would bring back the outputs they spent.
+		var summaries []database.TransactionSummary
+		if err := dbtx.Read().Where("coin=?", cm.coinType.CurrencyCode()).Find(&summaries).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		pruned := make(map[iwallet.TransactionID]bool, len(summaries))
+		for _, summary := range summaries {
+			pruned[iwallet.TransactionID(summary.Txid)] = true
+		}
+
 		// For each new transaction that we are trying to save, if it already exists in the
 		// database, just update the height and timestamp if necessary. If it doesn't already
 		// exist then save it.
 		for _, tx := range newTxs {
+			if pruned[tx.ID] {
+				continue
+			}
 			var (
 				relevant bool
 				total    = iwallet.NewAmount(0)
@@ -699,14 +974,24 @@ func (cm *ChainManager) saveTransactionsAndUtxos(newTxs []iwallet.Transaction) (
 
 			savedTx, ok := txMap[tx.ID]
 			if ok && savedTx.Height() != tx.Height {
-				savedTx.BlockHeight = tx.Height
+				// Keep the value we calculated when the transaction
+				// was first saved and update the confirmation.
+				saved, err := savedTx.Transaction()
+				if err != nil {
+					return err
+				}
+				saved.Height = tx.Height
+				saved.BlockInfo = tx.BlockInfo
 				if tx.BlockInfo != nil {
-					savedTx.Timestamp = tx.BlockInfo.BlockTime
+					saved.Timestamp = tx.BlockInfo.BlockTime
 				}
 
-				if err := dbtx.Save(&savedTx); err != nil {
+				txr, err := database.NewTransactionRecord(saved, cm.coinType)
+				if err != nil {
 					return err
 				}
+				toSave = append(toSave, txr)
+				txMap[tx.ID] = *txr
 
 				newOrUpdated = append(newOrUpdated, tx)
 			} else if !ok && relevant {
@@ -720,9 +1005,7 @@ func (cm *ChainManager) saveTransactionsAndUtxos(newTxs []iwallet.Transaction) (
 				if err != nil {
 					return err
 				}
-				if err := dbtx.Save(txr); err != nil {
-					return err
-				}
+				toSave = append(toSave, txr)
 				txMap[tx.ID] = *txr
 				numNew++
 				newOrUpdated = append(newOrUpdated, tx)
@@ -740,13 +1023,22 @@ func (cm *ChainManager) saveTransactionsAndUtxos(newTxs []iwallet.Transaction) (
 				cm.unconfirmedTxs[tx.ID] = tx
 			}
 		}
+		if err := dbtx.SaveAll(toSave); err != nil {
+			return err
+		}
 
 		// Next we will calculate our utxo set.
 		utxos := make(map[string]database.UtxoRecord)
+		creators := make(map[string]iwallet.Transaction)
 
 		// For each transaction, check to see if an output address matches one
-		// of our addresses. If so, add it to the utxo map.
+		// of our addresses. If so, add it to the utxo map. Replaced and
+		// abandoned transactions are skipped here and below so their
+		// inputs are unspent again.
 		for _, rec := range txMap {
+			if rec.Dropped() {
+				continue
+			}
 			tx, err := rec.Transaction()
 			if err != nil {
 				return err
@@ -768,6 +1060,7 @@ func (cm *ChainManager) saveTransactionsAndUtxos(newTxs []iwallet.Transaction) (
 						Address:   to.Address.String(),
 						Coin:      cm.coinType.CurrencyCode(),
 					}
+					creators[outpoint] = tx
 				}
 			}
 		}
@@ -777,6 +1070,9 @@ func (cm *ChainManager) saveTransactionsAndUtxos(newTxs []iwallet.Transaction) (
 		//
 		// After this loop the remaining set should contain all of our utxos.
 		for _, rec := range txMap {
+			if rec.Dropped() {
+				continue
+			}
 			tx, err := rec.Transaction()
 			if err != nil {
 				return err
@@ -795,9 +1091,9 @@ func (cm *ChainManager) saveTransactionsAndUtxos(newTxs []iwallet.Transaction) (
 			return err
 		}
 
-		savedUtxoMap := make(map[string]bool)
+		savedUtxoMap := make(map[string]database.UtxoRecord)
 		for _, utxo := range savedUtxos {
-			savedUtxoMap[utxo.Outpoint] = true
+			savedUtxoMap[utxo.Outpoint] = utxo
 		}
 
 		// Delete any utxos in the DB but not in our map.
@@ -809,14 +1105,25 @@ func (cm *ChainManager) saveTransactionsAndUtxos(newTxs []iwallet.Transaction) (
 			}
 		}
 
-		// Finally save each utxo to the database.
-		for _, utxo := range utxos {
-			if err := dbtx.Save(&utxo); err != nil {
-				return err
-			}
+		sources, err := newSourceResolver(dbtx, cm.keychain, cm.coinType, savedUtxoMap)
+		if err != nil {
+			return err
 		}
 
-		return nil
+		// Finally save the utxos to the database. The frozen state is
+		// set by the user so it's carried over from the saved record,
+		// as is the source unless it's yet to be worked out.
+		utxoRecords := make([]database.UtxoRecord, 0, len(utxos))
+		for outpoint, utxo := range utxos {
+			saved := savedUtxoMap[utxo.Outpoint]
+			utxo.Frozen = saved.Frozen
+			utxo.Source = saved.Source
+			if utxo.Source == "" {
+				utxo.Source = sources.source(utxo, creators[outpoint])
+			}
+			utxoRecords = append(utxoRecords, utxo)
+		}
+		return dbtx.SaveAll(utxoRecords)
 	})
 
 	// Send any new or updated transactions out to the subscriber.
@@ -7,16 +7,18 @@ import (
 	"github.com/btcsuite/btcd/chaincfg"
 	hd "github.com/btcsuite/btcutil/hdkeychain"
 	"github.com/cpacia/multiwallet/database"
-	"github.com/cpacia/multiwallet/database/sqlitedb"
+	"github.com/cpacia/multiwallet/database/memorydb"
+	"github.com/cpacia/multiwallet/log"
 	iwallet "github.com/cpacia/wallet-interface"
-	"github.com/op/go-logging"
+	"gorm.io/gorm"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 func newTestChain() (*ChainManager, *MockChainClient, error) {
-	db, err := sqlitedb.NewMemoryDB()
+	db, err := memorydb.NewMemoryDB()
 	if err != nil {
 		return nil, nil, err
 	}
@@ -57,7 +59,7 @@ func newTestChain() (*ChainManager, *MockChainClient, error) {
 		return nil, nil, err
 	}
 
-	log := logging.MustGetLogger("chain")
+	logger := log.New("chain")
 
 	client := NewMockChainClient()
 
@@ -66,7 +68,7 @@ func newTestChain() (*ChainManager, *MockChainClient, error) {
 		DB:                 db,
 		Keychain:           keychain,
 		CoinType:           iwallet.CtMock,
-		Logger:             log,
+		Logger:             logger,
 		TxSubscriptionChan: nil,
 		EventBus:           NewBus(),
 	}
@@ -504,3 +506,413 @@ func TestChainManager_WatchOnly(t *testing.T) {
 		t.Fatal("Timed out waiting for unconfirms to update")
 	}
 }
+
+func TestChainManager_rollbackReorg(t *testing.T) {
+	chain, client, err := newTestChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.db.Close()
+
+	addrs, err := chain.keychain.GetAddresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.GenerateBlock()
+	client.GenerateBlock()
+
+	var (
+		tx0 = NewMockTransaction(nil, &addrs[0])
+		tx1 = NewMockTransaction(nil, &addrs[1])
+		tx2 = NewMockTransaction(nil, &addrs[2])
+	)
+	tx0.Height, tx0.BlockInfo = 1, &client.blocks[1]
+	tx1.Height, tx1.BlockInfo = 2, &client.blocks[2]
+	tx2.Height, tx2.BlockInfo = 2, &client.blocks[2]
+
+	if _, err := chain.saveTransactionsAndUtxos([]iwallet.Transaction{tx0, tx1, tx2}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Hand tx2's utxo to another coin. Rolling back our transaction
+	// must not touch it.
+	err = chain.db.Update(func(dbtx database.Tx) error {
+		var utxo database.UtxoRecord
+		if err := dbtx.Read().Where("outpoint=?", hex.EncodeToString(tx2.To[0].ID)).First(&utxo).Error; err != nil {
+			return err
+		}
+		utxo.Coin = "BTC"
+		return dbtx.Save(&utxo)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.Reorg(1)
+
+	reverted, forkHeight, err := chain.rollbackReorg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reverted) != 2 {
+		t.Fatalf("Expected 2 reverted transactions, got %d", len(reverted))
+	}
+	if _, ok := reverted[tx1.ID]; !ok {
+		t.Error("Expected tx1 to be reverted")
+	}
+	if forkHeight != 1 {
+		t.Errorf("Expected fork height 1, got %d", forkHeight)
+	}
+
+	err = chain.db.View(func(dbtx database.Tx) error {
+		expected := map[iwallet.TransactionID]uint64{tx0.ID: 1, tx1.ID: 0}
+		for txid, height := range expected {
+			var rec database.TransactionRecord
+			if err := dbtx.Read().Where("txid=?", txid.String()).First(&rec).Error; err != nil {
+				return err
+			}
+			if rec.BlockHeight != height {
+				t.Errorf("Expected transaction %s at height %d, got %d", txid, height, rec.BlockHeight)
+			}
+			tx, err := rec.Transaction()
+			if err != nil {
+				return err
+			}
+			if tx.Height != height {
+				t.Errorf("Expected serialized transaction %s at height %d, got %d", txid, height, tx.Height)
+			}
+		}
+
+		expectedUtxos := map[string]uint64{
+			hex.EncodeToString(tx0.To[0].ID): 1,
+			hex.EncodeToString(tx1.To[0].ID): 0,
+			hex.EncodeToString(tx2.To[0].ID): 2,
+		}
+		for outpoint, height := range expectedUtxos {
+			var utxo database.UtxoRecord
+			if err := dbtx.Read().Where("outpoint=?", outpoint).First(&utxo).Error; err != nil {
+				return err
+			}
+			if utxo.Height != height {
+				t.Errorf("Expected utxo %s at height %d, got %d", outpoint, height, utxo.Height)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Transactions saved without a block ID force a full rescan.
+	err = chain.db.Update(func(dbtx database.Tx) error {
+		var rec database.TransactionRecord
+		if err := dbtx.Read().Where("txid=?", tx0.ID.String()).First(&rec).Error; err != nil {
+			return err
+		}
+		rec.BlockID = ""
+		return dbtx.Save(&rec)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reverted, forkHeight, err = chain.rollbackReorg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reverted) != 0 || forkHeight != 0 {
+		t.Errorf("Expected full rescan, got %d reverted from height %d", len(reverted), forkHeight)
+	}
+
+	var utxos []database.UtxoRecord
+	err = chain.db.View(func(dbtx database.Tx) error {
+		return dbtx.Read().Where("coin=?", iwallet.CtMock).Find(&utxos).Error
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(utxos) != 0 {
+		t.Errorf("Expected utxos to be deleted, got %d", len(utxos))
+	}
+}
+
+func TestChainManager_StartAfterOfflineReorg(t *testing.T) {
+	chain, client, err := newTestChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.db.Close()
+
+	addrs, err := chain.keychain.GetAddresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.GenerateBlock()
+	client.GenerateBlock()
+
+	// The transaction was confirmed in our best block, which is reorged
+	// out while the wallet is offline and isn't mined again.
+	tx := NewMockTransaction(nil, &addrs[0])
+	tx.Height, tx.BlockInfo = 2, &client.blocks[2]
+	if _, err := chain.saveTransactionsAndUtxos([]iwallet.Transaction{tx}); err != nil {
+		t.Fatal(err)
+	}
+	err = chain.db.Update(func(dbtx database.Tx) error {
+		var record database.CoinRecord
+		if err := dbtx.Read().Where("coin=?", iwallet.CtMock.CurrencyCode()).First(&record).Error; err != nil {
+			return err
+		}
+		record.BestBlockID = client.blocks[2].BlockID.String()
+		record.BestBlockHeight = client.blocks[2].Height
+		return dbtx.Save(&record)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.Reorg(1)
+
+	scanComplete, err := chain.eventBus.Subscribe(&ScanCompleteEvent{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain.Start()
+	select {
+	case <-scanComplete.Out():
+	case <-time.After(time.Second * 10):
+		t.Fatal("Timed out waiting for scan")
+	}
+	chain.Stop()
+	chain.Wait()
+
+	if _, ok := chain.unconfirmedTxs[tx.ID]; !ok {
+		t.Error("Expected the reverted transaction to be tracked as unconfirmed")
+	}
+}
+
+func TestChainManager_Rescan(t *testing.T) {
+	chain, client, err := newTestChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.db.Close()
+
+	scanComplete, err := chain.eventBus.Subscribe(&ScanCompleteEvent{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chain.Start()
+	defer chain.Stop()
+
+	select {
+	case <-scanComplete.Out():
+	case <-time.After(time.Second * 10):
+		t.Fatal("Timed out waiting for scan")
+	}
+
+	addrs, err := chain.keychain.GetAddresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A transaction below the rescan height which should be kept and
+	// one above it which the client doesn't know about.
+	var (
+		old   = NewMockTransaction(nil, &addrs[0])
+		stale = NewMockTransaction(nil, &addrs[1])
+		found = NewMockTransaction(nil, &addrs[2])
+	)
+	old.Height, stale.Height = 1, 5
+	err = chain.db.Update(func(dbtx database.Tx) error {
+		for _, tx := range []iwallet.Transaction{old, stale} {
+			rec, err := database.NewTransactionRecord(tx, iwallet.CtMock)
+			if err != nil {
+				return err
+			}
+			if err := dbtx.Save(rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.mtx.Lock()
+	client.addrIndex[addrs[2]] = append(client.addrIndex[addrs[2]], found)
+	client.mtx.Unlock()
+
+	if err := chain.Rescan(3); err != nil {
+		t.Fatal(err)
+	}
+
+	var savedTxs []database.TransactionRecord
+	err = chain.db.View(func(tx database.Tx) error {
+		return tx.Read().Where("coin=?", iwallet.CtMock).Find(&savedTxs).Error
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := make(map[iwallet.TransactionID]bool)
+	for _, rec := range savedTxs {
+		saved[rec.TransactionID()] = true
+	}
+	if len(saved) != 2 || !saved[old.ID] || !saved[found.ID] {
+		t.Errorf("Expected old and found transactions after rescan, got %v", saved)
+	}
+
+	var utxos []database.UtxoRecord
+	err = chain.db.View(func(tx database.Tx) error {
+		return tx.Read().Where("coin=?", iwallet.CtMock).Find(&utxos).Error
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(utxos) != 2 {
+		t.Errorf("Expected 2 utxos, got %d", len(utxos))
+	}
+}
+
+func TestChainManager_heightAtTime(t *testing.T) {
+	chain, _, err := newTestChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.db.Close()
+
+	now := time.Now()
+	chain.best = iwallet.BlockInfo{Height: 1000, BlockTime: now}
+
+	tests := []struct {
+		t        time.Time
+		expected uint64
+	}{
+		{now.Add(time.Hour), 1000},
+		{now.Add(-time.Hour), 988},
+		{now.Add(-time.Hour * 24 * 365), 0},
+	}
+	for _, test := range tests {
+		if height := chain.heightAtTime(test.t); height != test.expected {
+			t.Errorf("Expected height %d, got %d", test.expected, height)
+		}
+	}
+}
+
+// streamingMockClient is a MockChainClient implementing StreamingClient
+// which counts the transactions it's polled for.
+type streamingMockClient struct {
+	*MockChainClient
+	checkpoint StreamCheckpoint
+	polls      int32
+}
+
+func (c *streamingMockClient) SubscribeAddresses(addrs []iwallet.Address, from StreamCheckpoint) (*TransactionSubscription, error) {
+	c.checkpoint = from
+	return c.SubscribeTransactions(addrs)
+}
+
+func (c *streamingMockClient) SubscribeBlocksFrom(from StreamCheckpoint) (*BlockSubscription, error) {
+	return c.SubscribeBlocks()
+}
+
+func (c *streamingMockClient) GetTransaction(id iwallet.TransactionID) (iwallet.Transaction, error) {
+	atomic.AddInt32(&c.polls, 1)
+	return c.MockChainClient.GetTransaction(id)
+}
+
+func TestChainManager_Streaming(t *testing.T) {
+	chain, mock, err := newTestChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.db.Close()
+	client := &streamingMockClient{MockChainClient: mock}
+	chain.client = client
+
+	startSub, err := chain.eventBus.Subscribe(&ChainStartedEvent{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockSub, err := chain.eventBus.Subscribe(&BlockReceivedEvent{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ucSub, err := chain.eventBus.Subscribe(&UpdateUnconfirmedCompleteEvent{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chain.Start()
+	defer chain.Stop()
+
+	select {
+	case <-startSub.Out():
+	case <-time.After(time.Second * 10):
+		t.Fatal("Timed out waiting for start")
+	}
+	if client.checkpoint.BlockID != mock.blocks[0].BlockID {
+		t.Errorf("Expected the streams to resume from the tip, got %+v", client.checkpoint)
+	}
+
+	generateBlock := func() {
+		mock.GenerateBlock()
+		select {
+		case <-blockSub.Out():
+		case <-time.After(time.Second * 10):
+			t.Fatal("Timed out waiting to process block")
+		}
+	}
+	// The first block after starting polls the unconfirmed transactions.
+	generateBlock()
+
+	addrs, err := chain.keychain.GetAddresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := NewMockTransaction(nil, &addrs[0])
+	if err := mock.BroadcastInternal(tx); err != nil {
+		t.Fatal(err)
+	}
+	record := func() database.TransactionRecord {
+		var rec database.TransactionRecord
+		err := chain.db.View(func(dbtx database.Tx) error {
+			return dbtx.Read().Where("txid=?", tx.ID.String()).First(&rec).Error
+		})
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			t.Fatal(err)
+		}
+		return rec
+	}
+	for i := 0; record().Txid == ""; i++ {
+		if i == 100 {
+			t.Fatal("Timed out waiting for the transaction to be saved")
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	generateBlock()
+	if polls := atomic.LoadInt32(&client.polls); polls != 0 {
+		t.Errorf("Expected no transactions to be polled, got %d", polls)
+	}
+
+	// The confirmation is pushed by the address subscription.
+	confirmed := tx
+	confirmed.Height = mock.blocks[2].Height
+	confirmed.BlockInfo = &mock.blocks[2]
+	if err := mock.BroadcastInternal(confirmed); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ucSub.Out():
+	case <-time.After(time.Second * 10):
+		t.Fatal("Timed out waiting for the confirmation")
+	}
+	if height := record().BlockHeight; height != confirmed.Height {
+		t.Errorf("Expected the transaction to confirm at %d, got %d", confirmed.Height, height)
+	}
+}
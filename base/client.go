@@ -1,6 +1,11 @@
 package base
 
-import iwallet "github.com/cpacia/wallet-interface"
+import (
+	"errors"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	iwallet "github.com/cpacia/wallet-interface"
+)
 
 type BlockSubscription struct {
 	Out   chan iwallet.BlockInfo
@@ -14,6 +19,133 @@ type TransactionSubscription struct {
 	Close       func()
 }
 
+// MempoolBufferSize is the buffer size of MempoolSubscription.Out.
+const MempoolBufferSize = 256
+
+// MempoolSubscription delivers every transaction entering the backend's
+// mempool, not just those involving the wallet's addresses. Since that's
+// far more than the wallet's own traffic clients don't block on a full Out
+// channel and drop the transaction instead.
+type MempoolSubscription struct {
+	Out   chan iwallet.Transaction
+	Close func()
+}
+
+// MempoolClient is implemented by ChainClients which can stream their
+// mempool. The ChainManager uses it to detect double spends of unconfirmed
+// transactions. Transactions only need the IDs of their inputs to be set.
+type MempoolClient interface {
+	SubscribeMempool() (*MempoolSubscription, error)
+}
+
+// ErrMerkleProofUnsupported is returned by ChainClients whose backend
+// can't produce merkle proofs. Confirmations are then only checked against
+// the header chain.
+var ErrMerkleProofUnsupported = errors.New("merkle proofs not supported by backend")
+
+// MerkleProof links a transaction to the merkle root of the block it
+// confirmed in. Branch holds the sibling hashes from the leaf up and Index
+// is the transaction's position in the block.
+type MerkleProof struct {
+	BlockID iwallet.BlockID
+	Height  uint64
+	Index   uint32
+	Branch  []chainhash.Hash
+}
+
+// HeaderClient is implemented by ChainClients which can serve block
+// headers. The ChainManager uses it to maintain a verified header chain
+// which confirmations reported by the backend are checked against.
+type HeaderClient interface {
+	// GetBlockHeaders returns up to count headers in the best chain
+	// starting at fromHeight. Fewer are returned near the tip.
+	GetBlockHeaders(fromHeight uint64, count int) ([]wire.BlockHeader, error)
+}
+
+// ErrRawTransactionUnsupported is returned when the wallet's ChainClient
+// can't serve raw transactions.
+var ErrRawTransactionUnsupported = errors.New("raw transactions not supported by backend")
+
+// RawTransactionClient is implemented by ChainClients which can return the
+// serialized transaction, which iwallet.Transaction doesn't carry. It's
+// needed to read the scripts of transactions the wallet didn't build.
+type RawTransactionClient interface {
+	GetRawTransaction(id iwallet.TransactionID) ([]byte, error)
+}
+
+// ErrScanUnsupported is returned when the wallet's ChainClient can't serve
+// the transactions of a block with the scripts they spend.
+var ErrScanUnsupported = errors.New("transaction scanning not supported by backend")
+
+// ScanTransaction is a transaction along with the output script spent by
+// each of its inputs. PrevScripts is indexed like Tx.TxIn and the script of
+// a coinbase input is nil.
+type ScanTransaction struct {
+	Tx          *wire.MsgTx
+	PrevScripts [][]byte
+	Height      uint64
+}
+
+// ScanClient is implemented by ChainClients which can return transactions
+// with the scripts they spend. It's needed to find payments which can't be
+// subscribed to by address, such as silent payments, whose outputs can
+// only be recognized from the keys of the inputs spent.
+type ScanClient interface {
+	// GetBlockScanTransactions returns every transaction in the block at
+	// height in the best chain.
+	GetBlockScanTransactions(height uint64) ([]ScanTransaction, error)
+
+	// GetScanTransaction returns a confirmed or unconfirmed transaction.
+	GetScanTransaction(id iwallet.TransactionID) (ScanTransaction, error)
+}
+
+// StreamBufferSize is the buffer size of the Out channels of the
+// subscriptions returned by a StreamingClient.
+const StreamBufferSize = 64
+
+// StreamCheckpoint is the point a streaming subscription resumes from. It's
+// the last block the consumer has processed. The zero checkpoint starts the
+// subscription at the backend's current tip with nothing resumed.
+type StreamCheckpoint struct {
+	Height  uint64
+	BlockID iwallet.BlockID
+}
+
+// StreamingClient is implemented by ChainClients whose subscriptions are
+// pushed by the backend over streams which survive dropped connections.
+// The ChainManager relies on them instead of polling the backend for the
+// confirmations of its unconfirmed transactions every block.
+//
+// The subscriptions follow this contract:
+//
+//   - Reconnect: when a stream breaks the client reopens it with a
+//     backoff, resubscribing every address added so far, until the
+//     subscription is closed. Out stays open throughout and is closed
+//     once the subscription is.
+//   - Resume: on reconnect, and on subscribing with a non-zero
+//     checkpoint, the client first delivers what happened since the
+//     checkpoint. Blocks are delivered in order from the one after the
+//     checkpoint, or from the fork point if the checkpoint was reorged
+//     out. Address subscriptions deliver the confirmed and unconfirmed
+//     transactions of the addresses from the checkpoint's height. An
+//     update may be delivered more than once so the consumer must
+//     ignore repeats.
+//   - Backpressure: Out is buffered to StreamBufferSize. When it's full
+//     the client stops reading from the backend rather than dropping
+//     updates, leaving the backend's flow control to hold back the
+//     stream. If the backend gives up on the stream the client resumes
+//     it as above. The consumer must keep draining Out or call Close.
+type StreamingClient interface {
+	// SubscribeAddresses streams the transactions of addrs, and of any
+	// addresses later sent on the subscription's Subscribe channel,
+	// resuming from the checkpoint.
+	SubscribeAddresses(addrs []iwallet.Address, from StreamCheckpoint) (*TransactionSubscription, error)
+
+	// SubscribeBlocksFrom streams the blocks connected to the best
+	// chain, resuming from the checkpoint.
+	SubscribeBlocksFrom(from StreamCheckpoint) (*BlockSubscription, error)
+}
+
 type ChainClient interface {
 	GetBlockchainInfo() (iwallet.BlockInfo, error)
 
@@ -23,6 +155,10 @@ type ChainClient interface {
 
 	IsBlockInMainChain(block iwallet.BlockInfo) (bool, error)
 
+	// GetMerkleProof returns the proof that a confirmed transaction is
+	// committed to its block, or ErrMerkleProofUnsupported.
+	GetMerkleProof(id iwallet.TransactionID) (*MerkleProof, error)
+
 	SubscribeTransactions(addrs []iwallet.Address) (*TransactionSubscription, error)
 
 	SubscribeBlocks() (*BlockSubscription, error)
@@ -13,6 +13,10 @@ type Coin struct {
 	TxValue      btcutil.Amount
 	TxNumConfs   int64
 	ScriptPubKey []byte
+
+	// Source is the utxo's source, which coin selection may keep from
+	// being mixed with others. See UtxoSource.
+	Source string
 }
 
 func (c *Coin) Hash() *chainhash.Hash { return c.TxHash }
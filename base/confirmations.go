@@ -0,0 +1,199 @@
+package base
+
+import (
+	"errors"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/cpacia/multiwallet/headers"
+	iwallet "github.com/cpacia/wallet-interface"
+)
+
+// headerBatchSize is the number of headers requested from the HeaderClient
+// at a time.
+const headerBatchSize = 2000
+
+// checkpointDepth is how far below the backend's tip the header store
+// starts when it's first created. Confirmations below the checkpoint can't
+// be verified.
+const checkpointDepth = 2016
+
+// optionalClient returns the client whose optional interfaces, such as
+// MempoolClient and HeaderClient, the ChainManager should use.
+func optionalClient(client ChainClient) ChainClient {
+	switch c := client.(type) {
+	case *VerifyingClient:
+		return optionalClient(c.Primary)
+	case *FailoverClient:
+		return optionalClient(c.Active())
+	}
+	return client
+}
+
+// initHeaders opens the header store if the chain client can serve
+// headers for a supported coin. The network is picked by the backend's
+// genesis block. When the store is first created it's started from a
+// checkpoint below the backend's tip which is trusted on first use.
+func (cm *ChainManager) initHeaders() error {
+	hc, ok := optionalClient(cm.client).(HeaderClient)
+	if !ok {
+		return nil
+	}
+	genesis, err := hc.GetBlockHeaders(0, 1)
+	if err != nil {
+		return err
+	}
+	if len(genesis) == 0 {
+		return errors.New("backend returned no genesis header")
+	}
+	params, err := headers.ParamsForGenesis(cm.coinType, genesis[0].BlockHash())
+	if err != nil {
+		return err
+	}
+
+	checkpoint, ok, err := headers.LoadCheckpoint(cm.db, cm.coinType)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		best, err := cm.client.GetBlockchainInfo()
+		if err != nil {
+			return err
+		}
+		interval := uint64(params.TargetTimespan / params.TargetTimePerBlock)
+		var height uint64
+		if best.Height > checkpointDepth {
+			height = (best.Height - checkpointDepth) / interval * interval
+		}
+		hdrs, err := hc.GetBlockHeaders(height, 1)
+		if err != nil {
+			return err
+		}
+		if len(hdrs) == 0 {
+			return errors.New("backend returned no checkpoint header")
+		}
+		checkpoint = headers.Checkpoint{Height: height, Header: hdrs[0]}
+	}
+	params.Checkpoint = checkpoint
+
+	store, err := headers.NewStore(cm.db, params)
+	if err != nil {
+		return err
+	}
+	cm.headerClient = hc
+	cm.headers = store
+	return nil
+}
+
+// syncHeaders downloads headers from the HeaderClient until the store
+// reaches the backend's tip. If the backend has reorged below the store's
+// tip it steps back until the headers connect.
+func (cm *ChainManager) syncHeaders() error {
+	cm.headerMtx.Lock()
+	defer cm.headerMtx.Unlock()
+
+	var stepBack uint64
+	for {
+		_, height := cm.headers.Tip()
+		from := height + 1
+		if stepBack > 0 {
+			from = cm.headers.Params().Checkpoint.Height + 1
+			if height > stepBack {
+				if h := height + 1 - stepBack; h > from {
+					from = h
+				}
+			}
+		}
+		batch, err := cm.headerClient.GetBlockHeaders(from, headerBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+		hdrs := make([]*wire.BlockHeader, len(batch))
+		for i := range batch {
+			hdrs[i] = &batch[i]
+		}
+		changed, _, err := cm.headers.Connect(hdrs)
+		if errors.Is(err, headers.ErrHeadersDoNotConnect) {
+			if from <= cm.headers.Params().Checkpoint.Height+1 {
+				return err
+			}
+			if stepBack == 0 {
+				stepBack = 10
+			} else {
+				stepBack *= 2
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		stepBack = 0
+		if !changed || len(batch) < headerBatchSize {
+			return nil
+		}
+	}
+}
+
+// verifyConfirmation checks a confirmation reported by the chain client
+// against the header store and, if the backend supports them, a merkle
+// proof. It returns true if there is no header store.
+func (cm *ChainManager) verifyConfirmation(tx iwallet.Transaction) bool {
+	if cm.headers == nil || tx.Height == 0 || tx.BlockInfo == nil {
+		return true
+	}
+
+	err := cm.headers.VerifyConfirmation(tx.BlockInfo.BlockID, tx.Height)
+	if errors.Is(err, headers.ErrUnverifiedHeight) {
+		if err := cm.syncHeaders(); err != nil {
+			cm.logger.Errorf("[%s] Error syncing headers: %s", cm.coinType, err)
+			return false
+		}
+		err = cm.headers.VerifyConfirmation(tx.BlockInfo.BlockID, tx.Height)
+	}
+	if err != nil {
+		cm.logger.Warningf("[%s] Confirmation of %s in block %s failed verification: %s", cm.coinType, tx.ID, tx.BlockInfo.BlockID, err)
+		return false
+	}
+
+	proof, err := cm.client.GetMerkleProof(tx.ID)
+	if errors.Is(err, ErrMerkleProofUnsupported) {
+		return true
+	} else if err != nil {
+		cm.logger.Errorf("[%s] Error fetching merkle proof for %s: %s", cm.coinType, tx.ID, err)
+		return false
+	}
+	txid, err := chainhash.NewHashFromStr(tx.ID.String())
+	if err != nil {
+		return false
+	}
+	if proof.Height != tx.Height {
+		cm.logger.Warningf("[%s] Merkle proof for %s is for height %d not %d", cm.coinType, tx.ID, proof.Height, tx.Height)
+		return false
+	}
+	err = cm.headers.VerifyMerkleProof(*txid, proof.Height, proof.Index, proof.Branch)
+	if errors.Is(err, headers.ErrHeaderNotFound) {
+		// Below the checkpoint.
+		return true
+	} else if err != nil {
+		cm.logger.Warningf("[%s] Merkle proof for %s failed verification: %s", cm.coinType, tx.ID, err)
+		return false
+	}
+	return true
+}
+
+// checkConfirmations returns the transactions with any confirmations which
+// fail verification removed. They are treated as unconfirmed and checked
+// again when the next block arrives.
+func (cm *ChainManager) checkConfirmations(txs []iwallet.Transaction) []iwallet.Transaction {
+	if cm.headers == nil {
+		return txs
+	}
+	for i := range txs {
+		if !cm.verifyConfirmation(txs[i]) {
+			txs[i].Height = 0
+			txs[i].BlockInfo = nil
+		}
+	}
+	return txs
+}
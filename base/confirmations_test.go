@@ -0,0 +1,125 @@
+package base
+
+import (
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/cpacia/multiwallet/headers"
+	iwallet "github.com/cpacia/wallet-interface"
+	"testing"
+	"time"
+)
+
+type mockHeaderClient struct {
+	headers []wire.BlockHeader
+}
+
+func (m *mockHeaderClient) GetBlockHeaders(fromHeight uint64, count int) ([]wire.BlockHeader, error) {
+	var hdrs []wire.BlockHeader
+	for h := fromHeight; h < uint64(len(m.headers)) && len(hdrs) < count; h++ {
+		hdrs = append(hdrs, m.headers[h])
+	}
+	return hdrs, nil
+}
+
+// newTestHeaders mines a regtest block on top of genesis for each txid. The
+// merkle root of each block is the txid so it's the block's only
+// transaction.
+func newTestHeaders(params *headers.Params, txids []chainhash.Hash) []wire.BlockHeader {
+	prev := chaincfg.RegressionNetParams.GenesisBlock.Header
+	hdrs := []wire.BlockHeader{prev}
+	for _, txid := range txids {
+		header := wire.BlockHeader{
+			Version:    1,
+			PrevBlock:  prev.BlockHash(),
+			MerkleRoot: txid,
+			Timestamp:  prev.Timestamp.Add(time.Minute * 10),
+			Bits:       params.PowLimitBits,
+		}
+		target := blockchain.CompactToBig(header.Bits)
+		for {
+			hash := params.PowHash(&header)
+			if blockchain.HashToBig(&hash).Cmp(target) <= 0 {
+				break
+			}
+			header.Nonce++
+		}
+		hdrs = append(hdrs, header)
+		prev = header
+	}
+	return hdrs
+}
+
+func TestChainManager_verifyConfirmation(t *testing.T) {
+	cm, client, err := newTestChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.db.Close()
+
+	// Without a header store confirmations are trusted.
+	tx := iwallet.Transaction{
+		ID:     iwallet.TransactionID(chainhash.Hash{1}.String()),
+		Height: 2,
+	}
+	if !cm.verifyConfirmation(tx) {
+		t.Error("Expected confirmation to be trusted without a header store")
+	}
+
+	params := headers.BitcoinParams(&chaincfg.RegressionNetParams)
+	cm.headers, err = headers.NewStore(cm.db, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc := &mockHeaderClient{headers: newTestHeaders(params, []chainhash.Hash{{1}, {2}, {3}})}
+	cm.headerClient = hc
+
+	blockID := func(height int) iwallet.BlockID {
+		return iwallet.BlockID(hc.headers[height].BlockHash().String())
+	}
+	tx.BlockInfo = &iwallet.BlockInfo{BlockID: blockID(2), Height: 2}
+
+	// The store syncs up to the reported height and the backend doesn't
+	// support proofs.
+	if !cm.verifyConfirmation(tx) {
+		t.Error("Expected confirmation to verify")
+	}
+	if _, height := cm.headers.Tip(); height != 3 {
+		t.Errorf("Expected headers synced to height 3, got %d", height)
+	}
+
+	// The block isn't in the chain at that height.
+	tx.BlockInfo.BlockID = blockID(1)
+	if cm.verifyConfirmation(tx) {
+		t.Error("Expected confirmation in the wrong block to fail")
+	}
+	tx.BlockInfo.BlockID = blockID(2)
+
+	// The block is past the backend's headers.
+	tx.Height = 5
+	if cm.verifyConfirmation(tx) {
+		t.Error("Expected confirmation above the tip to fail")
+	}
+	tx.Height = 2
+
+	client.SetMerkleProof(tx.ID, &MerkleProof{BlockID: blockID(2), Height: 2})
+	if !cm.verifyConfirmation(tx) {
+		t.Error("Expected merkle proof to verify")
+	}
+
+	client.SetMerkleProof(tx.ID, &MerkleProof{BlockID: blockID(3), Height: 3})
+	if cm.verifyConfirmation(tx) {
+		t.Error("Expected merkle proof for another height to fail")
+	}
+
+	client.SetMerkleProof(tx.ID, &MerkleProof{BlockID: blockID(2), Height: 2, Branch: []chainhash.Hash{{4}}})
+	if cm.verifyConfirmation(tx) {
+		t.Error("Expected invalid merkle proof to fail")
+	}
+
+	txs := cm.checkConfirmations([]iwallet.Transaction{tx})
+	if txs[0].Height != 0 || txs[0].BlockInfo != nil {
+		t.Error("Expected failed confirmation to be removed")
+	}
+}
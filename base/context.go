@@ -0,0 +1,190 @@
+package base
+
+import (
+	"context"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"gorm.io/gorm"
+	"sync"
+)
+
+// ContextClient is implemented by ChainClients whose requests can be
+// cancelled. Each method returns ctx.Err() once ctx is done.
+type ContextClient interface {
+	GetBlockchainInfoContext(ctx context.Context) (iwallet.BlockInfo, error)
+
+	GetAddressTransactionsContext(ctx context.Context, addr iwallet.Address, fromHeight uint64) ([]iwallet.Transaction, error)
+
+	GetTransactionContext(ctx context.Context, id iwallet.TransactionID) (iwallet.Transaction, error)
+
+	BroadcastContext(ctx context.Context, serializedTx []byte) error
+}
+
+// WithContext returns the client as a ContextClient so ctx is passed into
+// the client's requests. Clients which can't take a context are wrapped so
+// each call runs in the background and is abandoned when ctx is done. An
+// abandoned broadcast may still reach the network.
+func WithContext(client ChainClient) ContextClient {
+	if cc, ok := client.(ContextClient); ok {
+		return cc
+	}
+	return &contextClient{client}
+}
+
+type contextClient struct {
+	client ChainClient
+}
+
+func (c *contextClient) GetBlockchainInfoContext(ctx context.Context) (iwallet.BlockInfo, error) {
+	var info iwallet.BlockInfo
+	err := runContext(ctx, func() (err error) {
+		info, err = c.client.GetBlockchainInfo()
+		return err
+	})
+	if err != nil {
+		return iwallet.BlockInfo{}, err
+	}
+	return info, nil
+}
+
+func (c *contextClient) GetAddressTransactionsContext(ctx context.Context, addr iwallet.Address, fromHeight uint64) ([]iwallet.Transaction, error) {
+	var txs []iwallet.Transaction
+	err := runContext(ctx, func() (err error) {
+		txs, err = c.client.GetAddressTransactions(addr, fromHeight)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return txs, nil
+}
+
+func (c *contextClient) GetTransactionContext(ctx context.Context, id iwallet.TransactionID) (iwallet.Transaction, error) {
+	var tx iwallet.Transaction
+	err := runContext(ctx, func() (err error) {
+		tx, err = c.client.GetTransaction(id)
+		return err
+	})
+	if err != nil {
+		return iwallet.Transaction{}, err
+	}
+	return tx, nil
+}
+
+func (c *contextClient) BroadcastContext(ctx context.Context, serializedTx []byte) error {
+	return runContext(ctx, func() error {
+		return c.client.Broadcast(serializedTx)
+	})
+}
+
+// runContext runs fn in a goroutine and returns its error, or ctx.Err() if
+// ctx is done first. It's only used for clients which don't implement
+// ContextClient. fn must not write to anything the caller reads unless
+// runContext returned its result.
+func runContext(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ContextTx returns dbtx with its queries bound to ctx. Reads are run with
+// gorm's WithContext, keeping the backend's context values, and writes fail with ctx.Err() once ctx is done, which
+// rolls back the database transaction they're in.
+func ContextTx(ctx context.Context, dbtx database.Tx) database.Tx {
+	return &contextTx{Tx: dbtx, ctx: ctx}
+}
+
+type contextTx struct {
+	database.Tx
+	ctx context.Context
+}
+
+func (tx *contextTx) Read() *gorm.DB {
+	return readContext(tx.ctx, tx.Tx)
+}
+
+// readContext returns dbtx's gorm database with its queries bound to ctx.
+// The values of the database's own context are kept as backends, such as
+// memorydb, use them to find the transaction a query belongs to.
+func readContext(ctx context.Context, dbtx database.Tx) *gorm.DB {
+	db := dbtx.Read()
+	if db.Statement == nil || db.Statement.Context == nil {
+		return db.WithContext(ctx)
+	}
+	return db.WithContext(valuesContext{Context: ctx, values: db.Statement.Context})
+}
+
+// valuesContext is a context which falls back to the values of another.
+type valuesContext struct {
+	context.Context
+	values context.Context
+}
+
+func (c valuesContext) Value(key interface{}) interface{} {
+	if v := c.Context.Value(key); v != nil {
+		return v
+	}
+	return c.values.Value(key)
+}
+
+func (tx *contextTx) Save(i interface{}) error {
+	if err := tx.ctx.Err(); err != nil {
+		return err
+	}
+	return tx.Tx.Save(i)
+}
+
+func (tx *contextTx) SaveAll(models interface{}) error {
+	if err := tx.ctx.Err(); err != nil {
+		return err
+	}
+	return tx.Tx.SaveAll(models)
+}
+
+func (tx *contextTx) Update(key string, value interface{}, where map[string]interface{}, model interface{}) error {
+	if err := tx.ctx.Err(); err != nil {
+		return err
+	}
+	return tx.Tx.Update(key, value, where, model)
+}
+
+func (tx *contextTx) Delete(key string, value interface{}, model interface{}) error {
+	if err := tx.ctx.Err(); err != nil {
+		return err
+	}
+	return tx.Tx.Delete(key, value, model)
+}
+
+// LockContext acquires mtx unless ctx is done first. If it gives up the
+// lock is released as soon as it's acquired.
+func LockContext(ctx context.Context, mtx *sync.Mutex) error {
+	locked := make(chan struct{})
+	go func() {
+		mtx.Lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		if err := ctx.Err(); err != nil {
+			mtx.Unlock()
+			return err
+		}
+		return nil
+	case <-ctx.Done():
+		go func() {
+			<-locked
+			mtx.Unlock()
+		}()
+		return ctx.Err()
+	}
+}
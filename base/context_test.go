@@ -0,0 +1,200 @@
+package base
+
+import (
+	"context"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"testing"
+	"time"
+)
+
+// blockingClient never answers GetTransaction until release is closed.
+type blockingClient struct {
+	*MockChainClient
+	release chan struct{}
+}
+
+func (c *blockingClient) GetTransaction(id iwallet.TransactionID) (iwallet.Transaction, error) {
+	<-c.release
+	return c.MockChainClient.GetTransaction(id)
+}
+
+// contextMockClient is a ContextClient which records the context its
+// requests were made with.
+type contextMockClient struct {
+	*MockChainClient
+	ctx context.Context
+}
+
+func (c *contextMockClient) GetBlockchainInfoContext(ctx context.Context) (iwallet.BlockInfo, error) {
+	c.ctx = ctx
+	return c.MockChainClient.GetBlockchainInfo()
+}
+
+func (c *contextMockClient) GetAddressTransactionsContext(ctx context.Context, addr iwallet.Address, fromHeight uint64) ([]iwallet.Transaction, error) {
+	c.ctx = ctx
+	return c.MockChainClient.GetAddressTransactions(addr, fromHeight)
+}
+
+func (c *contextMockClient) GetTransactionContext(ctx context.Context, id iwallet.TransactionID) (iwallet.Transaction, error) {
+	c.ctx = ctx
+	return c.MockChainClient.GetTransaction(id)
+}
+
+func (c *contextMockClient) BroadcastContext(ctx context.Context, serializedTx []byte) error {
+	c.ctx = ctx
+	return c.MockChainClient.Broadcast(serializedTx)
+}
+
+type testContextKey struct{}
+
+func TestWithContext_PassesContext(t *testing.T) {
+	ctx := context.WithValue(context.Background(), testContextKey{}, "request")
+	for _, name := range []string{"client", "failover", "verifying"} {
+		primary := &contextMockClient{MockChainClient: NewMockChainClient()}
+		var client ChainClient = primary
+		switch name {
+		case "failover":
+			client = NewFailoverClient([]ChainClient{primary}, iwallet.CtMock, nil)
+		case "verifying":
+			client = NewVerifyingClient(primary, &contextMockClient{MockChainClient: NewMockChainClient()}, iwallet.CtMock, nil)
+		}
+		if _, err := WithContext(client).GetBlockchainInfoContext(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if primary.ctx == nil || primary.ctx.Value(testContextKey{}) != "request" {
+			t.Errorf("%s: expected the context to be passed to the backend", name)
+		}
+	}
+}
+
+func TestWithContext(t *testing.T) {
+	client := &blockingClient{NewMockChainClient(), make(chan struct{})}
+	defer close(client.release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	_, err := WithContext(client).GetTransactionContext(ctx, iwallet.TransactionID("abc"))
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestWalletBase_GetTransactionContext(t *testing.T) {
+	w, err := setupWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &blockingClient{NewMockChainClient(), make(chan struct{})}
+	defer close(client.release)
+	w.ChainClient = client
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		cancel()
+	}()
+	if _, err := w.GetTransactionContext(ctx, iwallet.TransactionID("abc")); err != context.Canceled {
+		t.Errorf("Expected canceled, got %v", err)
+	}
+}
+
+func TestWalletBase_BeginContext(t *testing.T) {
+	w, err := setupWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wtx, err := w.BeginContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A second transaction can't start while the first is open.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if _, err := w.BeginContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+	if err := wtx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cancelling before commit rolls back without running the hook.
+	ctx, cancel = context.WithCancel(context.Background())
+	wtx, err = w.BeginContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	committed := false
+	wtx.(*DBTx).OnCommit = func() error {
+		committed = true
+		return nil
+	}
+	cancel()
+	if err := wtx.Commit(); err != context.Canceled {
+		t.Errorf("Expected canceled, got %v", err)
+	}
+	if committed {
+		t.Error("Expected commit hook not to run")
+	}
+
+	// The lock was released by the rollback.
+	wtx, err = w.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wtx.Rollback()
+}
+
+func TestContextTx(t *testing.T) {
+	w, err := setupWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err = w.DB.Update(func(dbtx database.Tx) error {
+		return ContextTx(ctx, dbtx).Save(&database.UnconfirmedTransaction{
+			Txid:      "abc",
+			Coin:      iwallet.CtMock.CurrencyCode(),
+			Timestamp: time.Now(),
+		})
+	})
+	if err != context.Canceled {
+		t.Errorf("Expected canceled, got %v", err)
+	}
+	var records []database.UnconfirmedTransaction
+	err = w.DB.View(func(dbtx database.Tx) error {
+		return dbtx.Read().Find(&records).Error
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 0 {
+		t.Error("Expected nothing to be saved")
+	}
+
+	// Reads bound to a live context still find the backend's
+	// transaction.
+	ctx = context.Background()
+	err = w.DB.Update(func(dbtx database.Tx) error {
+		ctxTx := ContextTx(ctx, dbtx)
+		if err := ctxTx.Save(&database.UnconfirmedTransaction{
+			Txid:      "abc",
+			Coin:      iwallet.CtMock.CurrencyCode(),
+			Timestamp: time.Now(),
+		}); err != nil {
+			return err
+		}
+		return ctxTx.Read().Where("txid=?", "abc").Find(&records).Error
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Errorf("Expected 1 record, got %d", len(records))
+	}
+}
@@ -0,0 +1,49 @@
+package base
+
+import (
+	"errors"
+	iwallet "github.com/cpacia/wallet-interface"
+	"time"
+)
+
+// ErrCosignClosed is returned when approving or rejecting a cosign request
+// which has already been approved or rejected.
+var ErrCosignClosed = errors.New("cosign request already approved or rejected")
+
+// CosignStatus is the state of a cosign request.
+type CosignStatus string
+
+const (
+	// CosignPending requests are waiting for the cosigner.
+	CosignPending CosignStatus = "pending"
+
+	// CosignApproved requests were signed by the cosigner and broadcast.
+	CosignApproved CosignStatus = "approved"
+
+	// CosignRejected requests were turned down and never broadcast.
+	CosignRejected CosignStatus = "rejected"
+)
+
+// CosignRequest is a spend from a 2-of-2 cosigned wallet waiting for the
+// second device's signatures. It's sent to the device as JSON.
+//
+// Tx is the transaction carrying the wallet's own signatures. The device
+// should show its outputs to the user before signing each input with the
+// key at the input's path and returning the signatures in input order.
+type CosignRequest struct {
+	ID        iwallet.TransactionID `json:"id"`
+	Coin      iwallet.CoinType      `json:"coin"`
+	Tx        []byte                `json:"tx"`
+	Inputs    []CosignInput         `json:"inputs"`
+	CreatedAt time.Time             `json:"createdAt"`
+}
+
+// CosignInput describes the input at Index. Change and KeyIndex are the
+// path of the keys below the account, which is the same for both devices.
+type CosignInput struct {
+	Index         int    `json:"index"`
+	Amount        int64  `json:"amount"`
+	Change        bool   `json:"change"`
+	KeyIndex      uint32 `json:"keyIndex"`
+	WitnessScript []byte `json:"witnessScript"`
+}
@@ -0,0 +1,448 @@
+package base
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	hd "github.com/btcsuite/btcutil/hdkeychain"
+	"strconv"
+	"strings"
+)
+
+// This file implements the subset of output script descriptors (BIPs 380
+// to 389) which describes a wallet's addresses: single key pkh, wpkh,
+// sh(wpkh) and key path only tr descriptors, and multi and sortedmulti
+// inside wsh, sh or sh(wsh). Keys must be extended keys so addresses can
+// be derived from them.
+
+var (
+	// ErrDescriptorChecksum is returned when parsing a descriptor whose
+	// checksum doesn't match.
+	ErrDescriptorChecksum = errors.New("descriptor checksum mismatch")
+
+	// ErrNoDescriptor is returned when creating a wallet from a
+	// descriptor if none was configured.
+	ErrNoDescriptor = errors.New("wallet has no descriptor")
+)
+
+// DescriptorType is the script a descriptor describes.
+type DescriptorType int
+
+const (
+	// DescriptorPKH is pkh(KEY), a P2PKH output.
+	DescriptorPKH DescriptorType = iota
+
+	// DescriptorWPKH is wpkh(KEY), a P2WPKH output.
+	DescriptorWPKH
+
+	// DescriptorShWPKH is sh(wpkh(KEY)), a P2WPKH output nested in P2SH.
+	DescriptorShWPKH
+
+	// DescriptorTR is tr(KEY), a P2TR output with no script tree.
+	DescriptorTR
+
+	// DescriptorWshMulti is wsh(multi(...)), a P2WSH multisig output.
+	DescriptorWshMulti
+
+	// DescriptorShMulti is sh(multi(...)), a P2SH multisig output.
+	DescriptorShMulti
+
+	// DescriptorShWshMulti is sh(wsh(multi(...))), a P2WSH multisig
+	// output nested in P2SH.
+	DescriptorShWshMulti
+)
+
+// maxMultisigKeys is the most keys a multisig descriptor may have.
+const maxMultisigKeys = 20
+
+// Descriptor is a parsed output script descriptor.
+type Descriptor struct {
+	Type DescriptorType
+
+	// Threshold and Sorted are only used by multisig descriptors. Sorted
+	// is set for sortedmulti.
+	Threshold int
+	Sorted    bool
+
+	Keys []DescriptorKey
+}
+
+// KeyOrigin is the fingerprint of the master key a descriptor key was
+// derived from and the path it was derived at.
+type KeyOrigin struct {
+	Fingerprint uint32
+	Path        []uint32
+}
+
+// DescriptorKey is an extended key in a descriptor along with the path
+// below it. Multipath holds the indexes of a /<a;b> step, which may only
+// come after Path and before the wildcard. Wildcard is set if the path
+// ends in /*.
+type DescriptorKey struct {
+	Origin    *KeyOrigin
+	Key       *hd.ExtendedKey
+	Path      []uint32
+	Multipath []uint32
+	Wildcard  bool
+}
+
+// ParseDescriptor parses a descriptor. The checksum is optional but is
+// checked if present.
+func ParseDescriptor(s string) (*Descriptor, error) {
+	s = strings.TrimSpace(s)
+	if i := strings.LastIndexByte(s, '#'); i >= 0 {
+		expected, err := DescriptorChecksum(s[:i])
+		if err != nil {
+			return nil, err
+		}
+		if s[i+1:] != expected {
+			return nil, ErrDescriptorChecksum
+		}
+		s = s[:i]
+	} else if _, err := DescriptorChecksum(s); err != nil {
+		return nil, err
+	}
+
+	if inner, ok := unwrapDescriptor(s, "sh"); ok {
+		if key, ok := unwrapDescriptor(inner, "wpkh"); ok {
+			return singleKeyDescriptor(DescriptorShWPKH, key)
+		}
+		if multi, ok := unwrapDescriptor(inner, "wsh"); ok {
+			return multiDescriptor(DescriptorShWshMulti, multi)
+		}
+		return multiDescriptor(DescriptorShMulti, inner)
+	}
+	if inner, ok := unwrapDescriptor(s, "wsh"); ok {
+		return multiDescriptor(DescriptorWshMulti, inner)
+	}
+	if key, ok := unwrapDescriptor(s, "wpkh"); ok {
+		return singleKeyDescriptor(DescriptorWPKH, key)
+	}
+	if key, ok := unwrapDescriptor(s, "pkh"); ok {
+		return singleKeyDescriptor(DescriptorPKH, key)
+	}
+	if key, ok := unwrapDescriptor(s, "tr"); ok {
+		if strings.Contains(key, ",") {
+			return nil, errors.New("taproot script trees aren't supported")
+		}
+		return singleKeyDescriptor(DescriptorTR, key)
+	}
+	return nil, fmt.Errorf("unsupported descriptor %s", s)
+}
+
+// unwrapDescriptor returns the argument of the script expression if it's
+// the named function.
+func unwrapDescriptor(s, name string) (string, bool) {
+	if !strings.HasPrefix(s, name+"(") || !strings.HasSuffix(s, ")") {
+		return "", false
+	}
+	return s[len(name)+1 : len(s)-1], true
+}
+
+func singleKeyDescriptor(typ DescriptorType, s string) (*Descriptor, error) {
+	key, err := parseDescriptorKey(s)
+	if err != nil {
+		return nil, err
+	}
+	return &Descriptor{Type: typ, Keys: []DescriptorKey{*key}}, nil
+}
+
+func multiDescriptor(typ DescriptorType, s string) (*Descriptor, error) {
+	d := &Descriptor{Type: typ}
+	args, ok := unwrapDescriptor(s, "multi")
+	if !ok {
+		args, ok = unwrapDescriptor(s, "sortedmulti")
+		if !ok {
+			return nil, fmt.Errorf("unsupported descriptor script %s", s)
+		}
+		d.Sorted = true
+	}
+	parts := strings.Split(args, ",")
+	threshold, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid multisig threshold %s", parts[0])
+	}
+	if len(parts) < 2 || len(parts)-1 > maxMultisigKeys {
+		return nil, fmt.Errorf("multisig descriptors must have between 1 and %d keys", maxMultisigKeys)
+	}
+	if threshold < 1 || threshold > len(parts)-1 {
+		return nil, fmt.Errorf("multisig threshold must be between 1 and %d", len(parts)-1)
+	}
+	d.Threshold = threshold
+	for _, part := range parts[1:] {
+		key, err := parseDescriptorKey(part)
+		if err != nil {
+			return nil, err
+		}
+		d.Keys = append(d.Keys, *key)
+	}
+	return d, nil
+}
+
+func parseDescriptorKey(s string) (*DescriptorKey, error) {
+	k := &DescriptorKey{}
+	if strings.HasPrefix(s, "[") {
+		end := strings.IndexByte(s, ']')
+		if end < 0 {
+			return nil, errors.New("unterminated key origin")
+		}
+		steps := strings.Split(s[1:end], "/")
+		fp, err := hex.DecodeString(steps[0])
+		if err != nil || len(fp) != 4 {
+			return nil, fmt.Errorf("invalid key origin fingerprint %s", steps[0])
+		}
+		path, err := parseDescriptorPath(steps[1:])
+		if err != nil {
+			return nil, err
+		}
+		k.Origin = &KeyOrigin{Fingerprint: binary.BigEndian.Uint32(fp), Path: path}
+		s = s[end+1:]
+	}
+
+	steps := strings.Split(s, "/")
+	key, err := hd.NewKeyFromString(steps[0])
+	if err != nil {
+		return nil, fmt.Errorf("descriptor keys must be extended keys: %s", err)
+	}
+	k.Key = key
+	steps = steps[1:]
+
+	if n := len(steps); n > 0 && steps[n-1] == "*" {
+		k.Wildcard = true
+		steps = steps[:n-1]
+	}
+	if n := len(steps); n > 0 && strings.HasPrefix(steps[n-1], "<") && strings.HasSuffix(steps[n-1], ">") {
+		multipath, err := parseDescriptorPath(strings.Split(steps[n-1][1:len(steps[n-1])-1], ";"))
+		if err != nil {
+			return nil, err
+		}
+		if len(multipath) < 2 {
+			return nil, errors.New("multipath steps need at least two indexes")
+		}
+		k.Multipath = multipath
+		steps = steps[:n-1]
+	}
+	k.Path, err = parseDescriptorPath(steps)
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// parseDescriptorPath parses path steps, which are hardened if they end
+// in ' or h.
+func parseDescriptorPath(steps []string) ([]uint32, error) {
+	var path []uint32
+	for _, step := range steps {
+		var hardened uint32
+		if strings.HasSuffix(step, "'") || strings.HasSuffix(step, "h") {
+			hardened = hd.HardenedKeyStart
+			step = step[:len(step)-1]
+		}
+		i, err := strconv.ParseUint(step, 10, 31)
+		if err != nil {
+			return nil, fmt.Errorf("invalid descriptor path step %s", step)
+		}
+		path = append(path, uint32(i)+hardened)
+	}
+	return path, nil
+}
+
+// String returns the descriptor with its checksum. Hardened steps are
+// written with h.
+func (d *Descriptor) String() string {
+	s := d.script()
+	checksum, _ := DescriptorChecksum(s)
+	return s + "#" + checksum
+}
+
+func (d *Descriptor) script() string {
+	keys := make([]string, len(d.Keys))
+	for i := range d.Keys {
+		keys[i] = d.Keys[i].String()
+	}
+	multi := "multi"
+	if d.Sorted {
+		multi = "sortedmulti"
+	}
+	multi = fmt.Sprintf("%s(%d,%s)", multi, d.Threshold, strings.Join(keys, ","))
+
+	switch d.Type {
+	case DescriptorPKH:
+		return "pkh(" + keys[0] + ")"
+	case DescriptorWPKH:
+		return "wpkh(" + keys[0] + ")"
+	case DescriptorShWPKH:
+		return "sh(wpkh(" + keys[0] + "))"
+	case DescriptorTR:
+		return "tr(" + keys[0] + ")"
+	case DescriptorShMulti:
+		return "sh(" + multi + ")"
+	case DescriptorShWshMulti:
+		return "sh(wsh(" + multi + "))"
+	}
+	return "wsh(" + multi + ")"
+}
+
+// String returns the key expression.
+func (k *DescriptorKey) String() string {
+	var b strings.Builder
+	if k.Origin != nil {
+		fmt.Fprintf(&b, "[%08x%s]", k.Origin.Fingerprint, formatDescriptorPath(k.Origin.Path, "/"))
+	}
+	b.WriteString(k.Key.String())
+	b.WriteString(formatDescriptorPath(k.Path, "/"))
+	if len(k.Multipath) > 0 {
+		b.WriteString("/<" + strings.TrimPrefix(formatDescriptorPath(k.Multipath, ";"), ";") + ">")
+	}
+	if k.Wildcard {
+		b.WriteString("/*")
+	}
+	return b.String()
+}
+
+// formatDescriptorPath writes each step of the path prefixed with sep.
+func formatDescriptorPath(path []uint32, sep string) string {
+	var b strings.Builder
+	for _, i := range path {
+		b.WriteString(sep)
+		if i >= hd.HardenedKeyStart {
+			fmt.Fprintf(&b, "%dh", i-hd.HardenedKeyStart)
+		} else {
+			fmt.Fprintf(&b, "%d", i)
+		}
+	}
+	return b.String()
+}
+
+// AddressType returns the address type of a single key descriptor. It
+// returns false for multisig descriptors.
+func (d *Descriptor) AddressType() (AddressType, bool) {
+	switch d.Type {
+	case DescriptorPKH:
+		return AddressTypeLegacy, true
+	case DescriptorWPKH:
+		return AddressTypeNativeSegwit, true
+	case DescriptorShWPKH:
+		return AddressTypeNestedSegwit, true
+	case DescriptorTR:
+		return AddressTypeTaproot, true
+	}
+	return 0, false
+}
+
+// AddressTypeDescriptor returns the single key descriptor type of the
+// address type.
+func AddressTypeDescriptor(addrType AddressType) DescriptorType {
+	switch addrType {
+	case AddressTypeNestedSegwit:
+		return DescriptorShWPKH
+	case AddressTypeLegacy:
+		return DescriptorPKH
+	case AddressTypeTaproot:
+		return DescriptorTR
+	}
+	return DescriptorWPKH
+}
+
+// AccountKey returns the key the wallet's addresses are derived from.
+// Wallets derive receive addresses at /0/* and change at /1/* below their
+// key so the key expression must end in /0/* or /<0;1>/*.
+func (k *DescriptorKey) AccountKey() (*hd.ExtendedKey, error) {
+	receiveOnly := len(k.Path) == 1 && k.Path[0] == 0 && len(k.Multipath) == 0
+	both := len(k.Path) == 0 && len(k.Multipath) == 2 && k.Multipath[0] == 0 && k.Multipath[1] == 1
+	if !k.Wildcard || (!receiveOnly && !both) {
+		return nil, errors.New("descriptor keys must end in /0/* or /<0;1>/*")
+	}
+	return k.Key, nil
+}
+
+// Neuter returns a copy of the descriptor with only public keys.
+func (d *Descriptor) Neuter() (*Descriptor, error) {
+	neutered := *d
+	neutered.Keys = make([]DescriptorKey, len(d.Keys))
+	for i, k := range d.Keys {
+		pub, err := k.Key.Neuter()
+		if err != nil {
+			return nil, err
+		}
+		k.Key = pub
+		neutered.Keys[i] = k
+	}
+	return &neutered, nil
+}
+
+// ChainDescriptors splits a wallet descriptor into the descriptors of its
+// receive and change addresses, which is how Bitcoin Core imports them.
+// Each key must be one AccountKey accepts.
+func (d *Descriptor) ChainDescriptors() (receive, change *Descriptor, err error) {
+	receive, change = &Descriptor{}, &Descriptor{}
+	*receive, *change = *d, *d
+	receive.Keys = make([]DescriptorKey, len(d.Keys))
+	change.Keys = make([]DescriptorKey, len(d.Keys))
+	for i, k := range d.Keys {
+		if _, err := k.AccountKey(); err != nil {
+			return nil, nil, err
+		}
+		k.Multipath = nil
+		k.Path = []uint32{0}
+		receive.Keys[i] = k
+		k.Path = []uint32{1}
+		change.Keys[i] = k
+	}
+	return receive, change, nil
+}
+
+const (
+	descriptorInputCharset    = "0123456789()[],'/*abcdefgh@:$%{}IJKLMNOPQRSTUVWXYZ&+-.;<=>?!^_|~ijklmnopqrstuvwxyzABCDEFGH`#\"\\ "
+	descriptorChecksumCharset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+)
+
+var descriptorGenerator = [5]uint64{0xf5dee51989, 0xa9fdca3312, 0x1bab10e32d, 0x3706b1677a, 0x644d626ffd}
+
+// DescriptorChecksum returns the BIP 380 checksum of a descriptor without
+// one.
+func DescriptorChecksum(s string) (string, error) {
+	var (
+		symbols []uint64
+		groups  []uint64
+	)
+	for _, c := range s {
+		v := strings.IndexRune(descriptorInputCharset, c)
+		if v < 0 {
+			return "", fmt.Errorf("invalid character %q in descriptor", c)
+		}
+		symbols = append(symbols, uint64(v&31))
+		groups = append(groups, uint64(v>>5))
+		if len(groups) == 3 {
+			symbols = append(symbols, groups[0]*9+groups[1]*3+groups[2])
+			groups = groups[:0]
+		}
+	}
+	switch len(groups) {
+	case 1:
+		symbols = append(symbols, groups[0])
+	case 2:
+		symbols = append(symbols, groups[0]*3+groups[1])
+	}
+	symbols = append(symbols, make([]uint64, 8)...)
+
+	chk := uint64(1)
+	for _, v := range symbols {
+		top := chk >> 35
+		chk = (chk&0x7ffffffff)<<5 ^ v
+		for i, g := range descriptorGenerator {
+			if (top>>uint(i))&1 == 1 {
+				chk ^= g
+			}
+		}
+	}
+	chk ^= 1
+
+	checksum := make([]byte, 8)
+	for i := range checksum {
+		checksum[i] = descriptorChecksumCharset[(chk>>(5*(7-uint(i))))&31]
+	}
+	return string(checksum), nil
+}
@@ -0,0 +1,140 @@
+package base
+
+import (
+	"errors"
+	"testing"
+)
+
+const (
+	testDescriptorXpub  = "xpub6BR5uPQQdPemcT96i4t8fd4Xo1Cuy7sLXfq2bjmoPexp79oBRUs9Q93CG7E9aQHsj8emsdSLbpXzFqLi5oyuJPFkH9YxFQSWMgdwmq9Yxkd"
+	testDescriptorTpub  = "tpubDBniRdE6LfcDw33DxZHePjQNjqGnocz5hFBVVGG8qemugynS8cEh2mmZpzYrApNPTDx8yLkgCq8MGuY15rKEvnDhzhHKgFDTC6ArvtsbcTE"
+	testDescriptorTpub2 = "tpubDACMoiKmUTz6QUchiA7cwsymLYeLxUdh4MRskB6C5vqrieqjuiKd2jcoy2HwTpvwW5PfrhX7pedsx5P9XjiHJa6eKsk8ofuX4BQmLnrsUSB"
+)
+
+func TestDescriptorChecksum(t *testing.T) {
+	// The valid descriptor from BIP 380's test vectors.
+	checksum, err := DescriptorChecksum("raw(deadbeef)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checksum != "89f8spxm" {
+		t.Errorf("Expected checksum 89f8spxm, got %s", checksum)
+	}
+	if _, err := DescriptorChecksum("wpkh(é)"); err == nil {
+		t.Error("Expected an error for a character outside the descriptor charset")
+	}
+}
+
+func TestParseDescriptor(t *testing.T) {
+	tests := []struct {
+		descriptor string
+		typ        DescriptorType
+		addrType   AddressType
+		multisig   bool
+	}{
+		{"wpkh(" + testDescriptorXpub + "/0/*)#zphchpdt", DescriptorWPKH, AddressTypeNativeSegwit, false},
+		{"sh(wpkh(" + testDescriptorXpub + "/0/*))#7qd0ah3m", DescriptorShWPKH, AddressTypeNestedSegwit, false},
+		{"pkh(" + testDescriptorXpub + "/0/*)#slw5up2v", DescriptorPKH, AddressTypeLegacy, false},
+		{"tr(" + testDescriptorXpub + "/0/*)#7ls74qxj", DescriptorTR, AddressTypeTaproot, false},
+		{"wpkh([3442193e/44h/0h]" + testDescriptorXpub + "/<0;1>/*)#w3jx5tjt", DescriptorWPKH, AddressTypeNativeSegwit, false},
+		{"wsh(sortedmulti(2," + testDescriptorTpub + "/0/*," + testDescriptorTpub2 + "/0/*))#tq3penhj", DescriptorWshMulti, 0, true},
+	}
+	for _, test := range tests {
+		desc, err := ParseDescriptor(test.descriptor)
+		if err != nil {
+			t.Fatalf("%s: %s", test.descriptor, err)
+		}
+		if desc.Type != test.typ {
+			t.Errorf("%s: expected type %d, got %d", test.descriptor, test.typ, desc.Type)
+		}
+		addrType, ok := desc.AddressType()
+		if ok == test.multisig || addrType != test.addrType {
+			t.Errorf("%s: expected address type %d, got %d", test.descriptor, test.addrType, addrType)
+		}
+		if desc.String() != test.descriptor {
+			t.Errorf("Expected %s, got %s", test.descriptor, desc)
+		}
+	}
+
+	// Hardened steps written with ' are written back with h and the
+	// checksum is optional.
+	desc, err := ParseDescriptor("wpkh([3442193e/44'/0']" + testDescriptorXpub + "/<0;1>/*)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.String() != tests[4].descriptor {
+		t.Errorf("Expected %s, got %s", tests[4].descriptor, desc)
+	}
+	if desc.Keys[0].Origin.Fingerprint != 0x3442193e {
+		t.Errorf("Expected fingerprint 3442193e, got %08x", desc.Keys[0].Origin.Fingerprint)
+	}
+}
+
+func TestParseDescriptor_Invalid(t *testing.T) {
+	tests := []string{
+		"wpkh(" + testDescriptorXpub + "/0/*)#zphchpdx",
+		"wpkh(" + testDescriptorXpub + "/0/*",
+		"addr(1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2)",
+		"wpkh(02e493dbf1c10d80f3581e4904930b1404cc6c13900ee0758474fa94abe8c4cd13)",
+		"tr(" + testDescriptorXpub + "/0/*,pk(" + testDescriptorXpub + "/1/*))",
+		"wsh(multi(3," + testDescriptorTpub + "/0/*," + testDescriptorTpub2 + "/0/*))",
+		"wsh(sortedmulti(0," + testDescriptorTpub + "/0/*))",
+		"wpkh([3442193/44h]" + testDescriptorXpub + "/0/*)",
+		"wpkh(" + testDescriptorXpub + "/x/*)",
+	}
+	for _, test := range tests {
+		if _, err := ParseDescriptor(test); err == nil {
+			t.Errorf("Expected an error parsing %s", test)
+		}
+	}
+	if _, err := ParseDescriptor(tests[0]); !errors.Is(err, ErrDescriptorChecksum) {
+		t.Errorf("Expected ErrDescriptorChecksum, got %v", err)
+	}
+}
+
+func TestDescriptor_ChainDescriptors(t *testing.T) {
+	desc, err := ParseDescriptor("wpkh([3442193e/44h/0h]" + testDescriptorXpub + "/<0;1>/*)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	receive, change, err := desc.ChainDescriptors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receive.String() != "wpkh([3442193e/44h/0h]"+testDescriptorXpub+"/0/*)#ltkkpg4h" {
+		t.Errorf("Unexpected receive descriptor %s", receive)
+	}
+	if change.String() != "wpkh([3442193e/44h/0h]"+testDescriptorXpub+"/1/*)#wlnhua90" {
+		t.Errorf("Unexpected change descriptor %s", change)
+	}
+
+	desc, err = ParseDescriptor("wpkh(" + testDescriptorXpub + "/0/*)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	receive, change, err = desc.ChainDescriptors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receive.String() != "wpkh("+testDescriptorXpub+"/0/*)#zphchpdt" {
+		t.Errorf("Unexpected receive descriptor %s", receive)
+	}
+	if change.String() != "wpkh("+testDescriptorXpub+"/1/*)#n4je25an" {
+		t.Errorf("Unexpected change descriptor %s", change)
+	}
+
+	for _, s := range []string{
+		"wpkh(" + testDescriptorXpub + "/1/*)",
+		"wpkh(" + testDescriptorXpub + "/0/0)",
+		"wpkh(" + testDescriptorXpub + "/0/0/*)",
+		"wpkh(" + testDescriptorXpub + "/<1;0>/*)",
+	} {
+		desc, err := ParseDescriptor(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := desc.ChainDescriptors(); err == nil {
+			t.Errorf("Expected %s not to be a wallet descriptor", s)
+		}
+	}
+}
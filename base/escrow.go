@@ -0,0 +1,261 @@
+package base
+
+import (
+	"encoding/hex"
+	"errors"
+	"github.com/cpacia/multiwallet/database"
+	"github.com/cpacia/multiwallet/log"
+	iwallet "github.com/cpacia/wallet-interface"
+	"gorm.io/gorm"
+	"strings"
+	"time"
+)
+
+// EscrowRole is the wallet's role in an escrow.
+type EscrowRole string
+
+const (
+	EscrowRoleBuyer     EscrowRole = "buyer"
+	EscrowRoleVendor    EscrowRole = "vendor"
+	EscrowRoleModerator EscrowRole = "moderator"
+)
+
+// EscrowInfo describes an escrow for TrackEscrow.
+type EscrowInfo struct {
+	Address      iwallet.Address
+	RedeemScript []byte
+	Role         EscrowRole
+	Threshold    int
+
+	// Counterparties are the serialized public keys of the other
+	// parties.
+	Counterparties [][]byte
+
+	// Timeout is zero if the escrow has no timeout.
+	Timeout time.Duration
+}
+
+// EscrowFundedEvent is emitted when a transaction paying into a tracked
+// escrow is first seen. Funded is the total paid into the escrow so far.
+type EscrowFundedEvent struct {
+	Address       iwallet.Address
+	TransactionID iwallet.TransactionID
+	Amount        iwallet.Amount
+	Funded        iwallet.Amount
+}
+
+// EscrowReleasedEvent is emitted when a transaction spending from a
+// tracked escrow is first seen.
+type EscrowReleasedEvent struct {
+	Address       iwallet.Address
+	TransactionID iwallet.TransactionID
+}
+
+// EscrowManager keeps the state of the escrows the wallet participates in
+// up to date from the transactions the wallet receives for the escrow
+// addresses.
+//
+// Funding and release events are emitted on Bus as *EscrowFundedEvent and
+// *EscrowReleasedEvent.
+type EscrowManager struct {
+	Bus Bus
+
+	db       database.Database
+	coinType iwallet.CoinType
+	logger   log.Logger
+	shutdown chan struct{}
+}
+
+// NewEscrowManager returns a new EscrowManager.
+func NewEscrowManager(db database.Database, logger log.Logger, coinType iwallet.CoinType) *EscrowManager {
+	return &EscrowManager{
+		Bus:      NewBus(),
+		db:       db,
+		coinType: coinType,
+		logger:   moduleLogger(logger, "escrow", coinType),
+		shutdown: make(chan struct{}),
+	}
+}
+
+// Start will process the transactions from txs until Stop is called.
+func (m *EscrowManager) Start(txs <-chan iwallet.Transaction) {
+	for {
+		select {
+		case tx := <-txs:
+			if err := m.HandleTransaction(tx); err != nil {
+				m.logger.Errorf("[%s] Error updating escrows for transaction %s: %s", m.coinType, tx.ID, err)
+			}
+		case <-m.shutdown:
+			return
+		}
+	}
+}
+
+// Stop will shutdown the EscrowManager.
+func (m *EscrowManager) Stop() {
+	close(m.shutdown)
+}
+
+// Track saves the escrow so transactions for its address are recorded.
+// It's a no-op if the escrow is already tracked.
+func (m *EscrowManager) Track(dbtx database.Tx, info EscrowInfo) error {
+	var record database.EscrowRecord
+	err := dbtx.Read().Where("coin=?", m.coinType.CurrencyCode()).Where("addr=?", info.Address.String()).First(&record).Error
+	if err == nil {
+		return nil
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	keys := make([]string, 0, len(info.Counterparties))
+	for _, key := range info.Counterparties {
+		keys = append(keys, hex.EncodeToString(key))
+	}
+	return dbtx.Save(&database.EscrowRecord{
+		Addr:           info.Address.String(),
+		Coin:           m.coinType.CurrencyCode(),
+		RedeemScript:   info.RedeemScript,
+		Role:           string(info.Role),
+		Threshold:      info.Threshold,
+		CreatedAt:      time.Now(),
+		Counterparties: strings.Join(keys, ";"),
+		Timeout:        info.Timeout,
+		FundedAmount:   iwallet.NewAmount(0).String(),
+	})
+}
+
+// HandleTransaction records tx against any tracked escrow it pays into or
+// spends from and emits an event for each escrow the first time tx is
+// seen.
+func (m *EscrowManager) HandleTransaction(tx iwallet.Transaction) error {
+	var events []interface{}
+	err := m.db.Update(func(dbtx database.Tx) error {
+		var records []database.EscrowRecord
+		if err := dbtx.Read().Where("coin=?", m.coinType.CurrencyCode()).Find(&records).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		if len(records) == 0 {
+			return nil
+		}
+
+		for i := range records {
+			var (
+				record   = &records[i]
+				addr     = iwallet.NewAddress(record.Addr, m.coinType)
+				paid     = iwallet.NewAmount(0)
+				funding  bool
+				spending bool
+			)
+			for _, to := range tx.To {
+				if to.Address.String() == record.Addr {
+					funding = true
+					paid = paid.Add(to.Amount)
+				}
+			}
+			for _, from := range tx.From {
+				if from.Address.String() == record.Addr {
+					spending = true
+				}
+			}
+
+			updated := false
+			if funding && !containsTxid(record.FundingTxids, tx.ID) {
+				funded := iwallet.NewAmount(record.FundedAmount).Add(paid)
+				record.FundedAmount = funded.String()
+				record.FundingTxids = appendTxid(record.FundingTxids, tx.ID)
+				events = append(events, &EscrowFundedEvent{
+					Address:       addr,
+					TransactionID: tx.ID,
+					Amount:        paid,
+					Funded:        funded,
+				})
+				updated = true
+			}
+			if spending && !containsTxid(record.ReleaseTxids, tx.ID) {
+				record.ReleaseTxids = appendTxid(record.ReleaseTxids, tx.ID)
+				events = append(events, &EscrowReleasedEvent{
+					Address:       addr,
+					TransactionID: tx.ID,
+				})
+				updated = true
+			}
+			if updated {
+				if err := dbtx.Save(record); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		m.Bus.Emit(event)
+	}
+	return nil
+}
+
+// Escrows returns the tracked escrows.
+func (m *EscrowManager) Escrows() ([]database.EscrowRecord, error) {
+	var records []database.EscrowRecord
+	err := m.db.View(func(dbtx database.Tx) error {
+		return dbtx.Read().Where("coin=?", m.coinType.CurrencyCode()).Find(&records).Error
+	})
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	return records, nil
+}
+
+func containsTxid(txids string, id iwallet.TransactionID) bool {
+	for _, txid := range strings.Split(txids, ";") {
+		if txid == id.String() {
+			return true
+		}
+	}
+	return false
+}
+
+func appendTxid(txids string, id iwallet.TransactionID) string {
+	if txids == "" {
+		return id.String()
+	}
+	return txids + ";" + id.String()
+}
+
+// TrackEscrow is used by the escrow system to record an escrow address the
+// wallet participates in. The address is watched as with WatchAddress and
+// the escrow's funding and release transactions are recorded. See
+// Escrows and SubscribeEscrowEvents.
+//
+// Note a database transaction is used here. Same rules of Commit() and
+// Rollback() apply.
+func (w *WalletBase) TrackEscrow(tx iwallet.Tx, info EscrowInfo) error {
+	if err := w.WatchAddress(tx, info.Address); err != nil {
+		return err
+	}
+	dbtx := tx.(*DBTx)
+	watch := dbtx.OnCommit
+	dbtx.OnCommit = func() error {
+		err := w.DB.Update(func(tx database.Tx) error {
+			return w.escrows.Track(tx, info)
+		})
+		if err != nil {
+			return err
+		}
+		return watch()
+	}
+	return nil
+}
+
+// Escrows returns the escrows recorded with TrackEscrow.
+func (w *WalletBase) Escrows() ([]database.EscrowRecord, error) {
+	return w.escrows.Escrows()
+}
+
+// SubscribeEscrowEvents returns a subscription to the *EscrowFundedEvents
+// and *EscrowReleasedEvents for the escrows recorded with TrackEscrow.
+func (w *WalletBase) SubscribeEscrowEvents() (Subscription, error) {
+	return w.escrows.Bus.Subscribe([]interface{}{&EscrowFundedEvent{}, &EscrowReleasedEvent{}})
+}
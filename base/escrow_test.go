@@ -0,0 +1,115 @@
+package base
+
+import (
+	"github.com/cpacia/multiwallet/database"
+	"github.com/cpacia/multiwallet/database/memorydb"
+	"github.com/cpacia/multiwallet/log"
+	iwallet "github.com/cpacia/wallet-interface"
+	"testing"
+	"time"
+)
+
+func TestEscrowManager(t *testing.T) {
+	db, err := memorydb.NewMemoryDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.InitializeDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+	m := NewEscrowManager(db, log.New("test"), iwallet.CtMock)
+
+	sub, err := m.Bus.Subscribe([]interface{}{&EscrowFundedEvent{}, &EscrowReleasedEvent{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	escrowAddr := mockAddress()
+	info := EscrowInfo{
+		Address:        escrowAddr,
+		RedeemScript:   []byte{0x52, 0x53, 0xae},
+		Role:           EscrowRoleBuyer,
+		Threshold:      2,
+		Counterparties: [][]byte{{0x02, 0x01}, {0x03, 0x02}},
+		Timeout:        time.Hour,
+	}
+	for i := 0; i < 2; i++ {
+		err := db.Update(func(dbtx database.Tx) error {
+			return m.Track(dbtx, info)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	funding := iwallet.Transaction{
+		ID:   iwallet.TransactionID("a"),
+		From: []iwallet.SpendInfo{{ID: mockOutpoint(), Address: mockAddress(), Amount: iwallet.NewAmount(20000)}},
+		To: []iwallet.SpendInfo{
+			{ID: mockOutpoint(), Address: escrowAddr, Amount: iwallet.NewAmount(15000)},
+			{ID: mockOutpoint(), Address: mockAddress(), Amount: iwallet.NewAmount(4000)},
+		},
+	}
+	release := iwallet.Transaction{
+		ID:   iwallet.TransactionID("b"),
+		From: []iwallet.SpendInfo{{ID: funding.To[0].ID, Address: escrowAddr, Amount: iwallet.NewAmount(15000)}},
+		To:   []iwallet.SpendInfo{{ID: mockOutpoint(), Address: mockAddress(), Amount: iwallet.NewAmount(14000)}},
+	}
+	unrelated := NewMockTransaction(nil, nil)
+
+	// The funding transaction is handled twice as it's sent again when
+	// it confirms.
+	for _, tx := range []iwallet.Transaction{funding, unrelated, funding, release} {
+		if err := m.HandleTransaction(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case e := <-sub.Out():
+			switch event := e.(type) {
+			case *EscrowFundedEvent:
+				if event.TransactionID != funding.ID || event.Address != escrowAddr {
+					t.Errorf("Unexpected funded event %v", event)
+				}
+				if event.Amount.Cmp(iwallet.NewAmount(15000)) != 0 || event.Funded.Cmp(iwallet.NewAmount(15000)) != 0 {
+					t.Errorf("Expected funded amount 15000, got %s", event.Funded)
+				}
+			case *EscrowReleasedEvent:
+				if event.TransactionID != release.ID || event.Address != escrowAddr {
+					t.Errorf("Unexpected released event %v", event)
+				}
+			}
+		case <-time.After(time.Second * 10):
+			t.Fatal("timed out waiting on event")
+		}
+	}
+	select {
+	case e := <-sub.Out():
+		t.Errorf("Unexpected event %v", e)
+	default:
+	}
+
+	records, err := m.Escrows()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("Expected 1 escrow, got %d", len(records))
+	}
+	record := records[0]
+	if record.Addr != escrowAddr.String() || record.Role != string(EscrowRoleBuyer) || record.Threshold != 2 || record.Timeout != time.Hour {
+		t.Errorf("Unexpected escrow record %v", record)
+	}
+	if record.Counterparties != "0201;0302" {
+		t.Errorf("Expected counterparties 0201;0302, got %s", record.Counterparties)
+	}
+	if record.FundedAmount != "15000" {
+		t.Errorf("Expected funded amount 15000, got %s", record.FundedAmount)
+	}
+	if record.FundingTxids != "a" || record.ReleaseTxids != "b" {
+		t.Errorf("Unexpected txids %s, %s", record.FundingTxids, record.ReleaseTxids)
+	}
+}
@@ -0,0 +1,262 @@
+package base
+
+import (
+	"errors"
+	"fmt"
+	iwallet "github.com/cpacia/wallet-interface"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// EscrowSignatureBundleVersion is the version of the bundles created by
+// NewEscrowSignatureBundle. It's only bumped for changes older versions
+// can't read; new fields get new field numbers, which older versions skip.
+const EscrowSignatureBundleVersion = 1
+
+// ErrInvalidEscrowSignature is returned when an escrow signature doesn't
+// verify or doesn't belong to a key in the escrow.
+var ErrInvalidEscrowSignature = errors.New("invalid escrow signature")
+
+// EscrowSignatureBundle is one party's signatures for an escrow release
+// in a form which can be sent to the other parties. It's serialized as the
+// protobuf message:
+//
+//	message EscrowSignatureBundle {
+//	    uint32 version = 1;
+//	    string coin = 2;
+//	    string txid = 3;
+//	    bytes pubkey = 4;
+//	    repeated Signature signatures = 5;
+//	}
+//
+//	message Signature {
+//	    uint32 index = 1;
+//	    uint32 sighash_type = 2;
+//	    bytes signature = 3;
+//	}
+//
+// Txid is the ID of the unsigned transaction so the other parties can
+// check they are signing the same one, and PubKey is the signer's key.
+type EscrowSignatureBundle struct {
+	Version    uint32
+	Coin       iwallet.CoinType
+	Txid       iwallet.TransactionID
+	PubKey     []byte
+	Signatures []BundleSignature
+}
+
+// BundleSignature is the signature for one input. The signature doesn't
+// include the sighash type.
+type BundleSignature struct {
+	Index       int
+	SigHashType uint32
+	Signature   []byte
+}
+
+const (
+	bundleFieldVersion    = 1
+	bundleFieldCoin       = 2
+	bundleFieldTxid       = 3
+	bundleFieldPubKey     = 4
+	bundleFieldSignatures = 5
+
+	signatureFieldIndex       = 1
+	signatureFieldSigHashType = 2
+	signatureFieldSignature   = 3
+)
+
+// NewEscrowSignatureBundle returns a bundle of the signatures returned by
+// SignMultisigTransaction.
+func NewEscrowSignatureBundle(coinType iwallet.CoinType, txid iwallet.TransactionID, pubkey []byte, sigHashType uint32, sigs []iwallet.EscrowSignature) *EscrowSignatureBundle {
+	bundle := &EscrowSignatureBundle{
+		Version: EscrowSignatureBundleVersion,
+		Coin:    coinType,
+		Txid:    txid,
+		PubKey:  pubkey,
+	}
+	for _, sig := range sigs {
+		bundle.Signatures = append(bundle.Signatures, BundleSignature{
+			Index:       sig.Index,
+			SigHashType: sigHashType,
+			Signature:   sig.Signature,
+		})
+	}
+	return bundle
+}
+
+// Serialize returns the protobuf encoding of the bundle.
+func (b *EscrowSignatureBundle) Serialize() []byte {
+	var out []byte
+	out = protowire.AppendTag(out, bundleFieldVersion, protowire.VarintType)
+	out = protowire.AppendVarint(out, uint64(b.Version))
+	out = protowire.AppendTag(out, bundleFieldCoin, protowire.BytesType)
+	out = protowire.AppendString(out, string(b.Coin))
+	out = protowire.AppendTag(out, bundleFieldTxid, protowire.BytesType)
+	out = protowire.AppendString(out, b.Txid.String())
+	out = protowire.AppendTag(out, bundleFieldPubKey, protowire.BytesType)
+	out = protowire.AppendBytes(out, b.PubKey)
+	for _, sig := range b.Signatures {
+		var s []byte
+		s = protowire.AppendTag(s, signatureFieldIndex, protowire.VarintType)
+		s = protowire.AppendVarint(s, uint64(sig.Index))
+		s = protowire.AppendTag(s, signatureFieldSigHashType, protowire.VarintType)
+		s = protowire.AppendVarint(s, uint64(sig.SigHashType))
+		s = protowire.AppendTag(s, signatureFieldSignature, protowire.BytesType)
+		s = protowire.AppendBytes(s, sig.Signature)
+
+		out = protowire.AppendTag(out, bundleFieldSignatures, protowire.BytesType)
+		out = protowire.AppendBytes(out, s)
+	}
+	return out
+}
+
+// ParseEscrowSignatureBundle parses a serialized bundle. Unknown fields are
+// skipped. Bundles with a newer version than EscrowSignatureBundleVersion
+// are rejected.
+func ParseEscrowSignatureBundle(data []byte) (*EscrowSignatureBundle, error) {
+	bundle := new(EscrowSignatureBundle)
+	err := consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == bundleFieldVersion && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 || v > 0xffffffff {
+				return n, errors.New("invalid version")
+			}
+			bundle.Version = uint32(v)
+			return n, nil
+		case num == bundleFieldCoin && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			bundle.Coin = iwallet.CoinType(v)
+			return n, nil
+		case num == bundleFieldTxid && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			bundle.Txid = iwallet.TransactionID(v)
+			return n, nil
+		case num == bundleFieldPubKey && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			bundle.PubKey = append([]byte(nil), v...)
+			return n, nil
+		case num == bundleFieldSignatures && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n, nil
+			}
+			sig, err := parseBundleSignature(v)
+			if err != nil {
+				return n, err
+			}
+			bundle.Signatures = append(bundle.Signatures, *sig)
+			return n, nil
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if bundle.Version == 0 {
+		return nil, errors.New("escrow signature bundle has no version")
+	}
+	if bundle.Version > EscrowSignatureBundleVersion {
+		return nil, fmt.Errorf("unsupported escrow signature bundle version %d", bundle.Version)
+	}
+	return bundle, nil
+}
+
+func parseBundleSignature(data []byte) (*BundleSignature, error) {
+	sig := new(BundleSignature)
+	err := consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == signatureFieldIndex && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 || v > 0xffffffff {
+				return n, errors.New("invalid input index")
+			}
+			sig.Index = int(v)
+			return n, nil
+		case num == signatureFieldSigHashType && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 || v > 0xffffffff {
+				return n, errors.New("invalid sighash type")
+			}
+			sig.SigHashType = uint32(v)
+			return n, nil
+		case num == signatureFieldSignature && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			sig.Signature = append([]byte(nil), v...)
+			return n, nil
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sig, nil
+}
+
+// consumeFields calls fn with the number, type and value of each field in
+// data. fn returns the length of the value it consumed.
+func consumeFields(data []byte, fn func(num protowire.Number, typ protowire.Type, b []byte) (int, error)) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		n, err := fn(num, typ, data)
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// Validate checks the bundle is for the coin and unsigned transaction and
+// has exactly one signature for each of the transaction's nInputs inputs.
+// It doesn't verify the signatures; that's done by the coin's wallet.
+func (b *EscrowSignatureBundle) Validate(coinType iwallet.CoinType, txid iwallet.TransactionID, nInputs int) error {
+	if b.Version == 0 || b.Version > EscrowSignatureBundleVersion {
+		return fmt.Errorf("unsupported escrow signature bundle version %d", b.Version)
+	}
+	if b.Coin != coinType {
+		return fmt.Errorf("escrow signature bundle is for %s not %s", b.Coin, coinType)
+	}
+	if b.Txid != txid {
+		return fmt.Errorf("escrow signature bundle is for transaction %s not %s", b.Txid, txid)
+	}
+	if len(b.PubKey) == 0 {
+		return errors.New("escrow signature bundle has no public key")
+	}
+	if len(b.Signatures) != nInputs {
+		return fmt.Errorf("escrow signature bundle has %d signatures for %d inputs", len(b.Signatures), nInputs)
+	}
+	seen := make(map[int]bool, len(b.Signatures))
+	for _, sig := range b.Signatures {
+		if sig.Index < 0 || sig.Index >= nInputs {
+			return fmt.Errorf("escrow signature for input %d out of range", sig.Index)
+		}
+		if seen[sig.Index] {
+			return fmt.Errorf("duplicate escrow signature for input %d", sig.Index)
+		}
+		if len(sig.Signature) == 0 {
+			return fmt.Errorf("empty escrow signature for input %d", sig.Index)
+		}
+		seen[sig.Index] = true
+	}
+	return nil
+}
+
+// EscrowSignatures returns the signatures in the form taken by
+// BuildAndSend.
+func (b *EscrowSignatureBundle) EscrowSignatures() []iwallet.EscrowSignature {
+	sigs := make([]iwallet.EscrowSignature, 0, len(b.Signatures))
+	for _, sig := range b.Signatures {
+		sigs = append(sigs, iwallet.EscrowSignature{
+			Index:     sig.Index,
+			Signature: sig.Signature,
+		})
+	}
+	return sigs
+}
@@ -0,0 +1,104 @@
+package base
+
+import (
+	"bytes"
+	iwallet "github.com/cpacia/wallet-interface"
+	"google.golang.org/protobuf/encoding/protowire"
+	"testing"
+)
+
+func TestEscrowSignatureBundle(t *testing.T) {
+	txid := iwallet.TransactionID("bdb237bf8c5de6b60ba1e2dcfe364fc24f583e568d1682f851a9d0f11a45c78d")
+	bundle := NewEscrowSignatureBundle(iwallet.CtBitcoin, txid, []byte{0x02, 0x01}, 1, []iwallet.EscrowSignature{
+		{Index: 0, Signature: []byte{0x30, 0x01}},
+		{Index: 1, Signature: []byte{0x30, 0x02}},
+	})
+
+	parsed, err := ParseEscrowSignatureBundle(bundle.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Version != EscrowSignatureBundleVersion || parsed.Coin != iwallet.CtBitcoin || parsed.Txid != txid || !bytes.Equal(parsed.PubKey, bundle.PubKey) {
+		t.Errorf("Unexpected bundle %v", parsed)
+	}
+	sigs := parsed.EscrowSignatures()
+	if len(sigs) != 2 {
+		t.Fatalf("Expected 2 signatures, got %d", len(sigs))
+	}
+	for i, sig := range sigs {
+		if sig.Index != i || !bytes.Equal(sig.Signature, bundle.Signatures[i].Signature) || parsed.Signatures[i].SigHashType != 1 {
+			t.Errorf("Unexpected signature %d: %v", i, parsed.Signatures[i])
+		}
+	}
+	if err := parsed.Validate(iwallet.CtBitcoin, txid, 2); err != nil {
+		t.Errorf("Validation failed: %s", err)
+	}
+
+	// Fields added by a later version are skipped.
+	extended := protowire.AppendTag(bundle.Serialize(), 100, protowire.BytesType)
+	extended = protowire.AppendBytes(extended, []byte("new field"))
+	if _, err := ParseEscrowSignatureBundle(extended); err != nil {
+		t.Errorf("Failed to parse bundle with unknown field: %s", err)
+	}
+
+	newer := *bundle
+	newer.Version = EscrowSignatureBundleVersion + 1
+	if _, err := ParseEscrowSignatureBundle(newer.Serialize()); err == nil {
+		t.Error("Expected newer version to be rejected")
+	}
+	if _, err := ParseEscrowSignatureBundle(bundle.Serialize()[:20]); err == nil {
+		t.Error("Expected truncated bundle to be rejected")
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(b *EscrowSignatureBundle)
+		nInputs int
+	}{
+		{
+			name:    "wrong coin",
+			modify:  func(b *EscrowSignatureBundle) { b.Coin = iwallet.CtLitecoin },
+			nInputs: 2,
+		},
+		{
+			name:    "wrong txid",
+			modify:  func(b *EscrowSignatureBundle) { b.Txid = "abc" },
+			nInputs: 2,
+		},
+		{
+			name:    "no public key",
+			modify:  func(b *EscrowSignatureBundle) { b.PubKey = nil },
+			nInputs: 2,
+		},
+		{
+			name:    "missing signature",
+			modify:  func(b *EscrowSignatureBundle) {},
+			nInputs: 3,
+		},
+		{
+			name:    "duplicate input",
+			modify:  func(b *EscrowSignatureBundle) { b.Signatures[1].Index = 0 },
+			nInputs: 2,
+		},
+		{
+			name:    "index out of range",
+			modify:  func(b *EscrowSignatureBundle) { b.Signatures[1].Index = 2 },
+			nInputs: 2,
+		},
+		{
+			name:    "empty signature",
+			modify:  func(b *EscrowSignatureBundle) { b.Signatures[0].Signature = nil },
+			nInputs: 2,
+		},
+	}
+	for _, test := range tests {
+		b, err := ParseEscrowSignatureBundle(bundle.Serialize())
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.modify(b)
+		if err := b.Validate(iwallet.CtBitcoin, txid, test.nInputs); err == nil {
+			t.Errorf("%s: expected validation to fail", test.name)
+		}
+	}
+}
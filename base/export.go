@@ -0,0 +1,300 @@
+package base
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"io"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ExportFormat is the encoding used by WriteHistory.
+type ExportFormat int
+
+const (
+	// ExportCSV writes one row per transaction with a header row.
+	ExportCSV ExportFormat = iota
+
+	// ExportJSON writes a JSON array of ExportedTransaction.
+	ExportJSON
+)
+
+// HistoricalExchangeRateProvider is an ExchangeRateProvider which can also
+// return the rate at a time in the past. Exports use it to value
+// transactions at the time they confirmed.
+type HistoricalExchangeRateProvider interface {
+	ExchangeRateProvider
+
+	// GetUSDRateAt returns the USD exchange rate for the given coin at
+	// time t, in the same units as GetUSDRate.
+	GetUSDRateAt(coinType iwallet.CoinType, t time.Time) (iwallet.Amount, error)
+}
+
+// ExportedTransaction is a transaction as written by WriteHistory.
+type ExportedTransaction struct {
+	Coin      string    `json:"coin"`
+	Txid      string    `json:"txid"`
+	Timestamp time.Time `json:"timestamp"`
+	Height    uint64    `json:"height"`
+
+	// Value is the net change to the wallet's balance in the coin's base
+	// unit. It is negative for sends. Fee is only set for transactions
+	// the wallet paid for.
+	Value string `json:"value"`
+	Fee   string `json:"fee,omitempty"`
+
+	From   []string `json:"from"`
+	To     []string `json:"to"`
+	Labels []string `json:"labels,omitempty"`
+
+	// Note, Category and OrderID are the transaction's metadata.
+	Note     string `json:"note,omitempty"`
+	Category string `json:"category,omitempty"`
+	OrderID  string `json:"orderID,omitempty"`
+
+	// USDRate is the rate returned by the exchange rate provider and
+	// USDValue is Value converted at that rate. If CurrentRate is set the
+	// provider couldn't return the rate at the time of the transaction
+	// so the current rate was used.
+	USDRate     string `json:"usdRate,omitempty"`
+	USDValue    string `json:"usdValue,omitempty"`
+	CurrentRate bool   `json:"currentRate,omitempty"`
+}
+
+// ExportHistory returns the wallet's full transaction history, oldest
+// first, valued using the exchange rate provider. If erp is nil the fiat
+// fields are left empty. Transactions removed by pruning are exported from
+// their summaries.
+func (w *WalletBase) ExportHistory(erp ExchangeRateProvider) ([]ExportedTransaction, error) {
+	history, err := w.TransactionHistory(-1, "")
+	if err != nil {
+		return nil, err
+	}
+	var (
+		own       map[iwallet.Address]bool
+		labels    map[iwallet.Address]string
+		metadata  map[iwallet.TransactionID]TransactionMetadata
+		summaries []database.TransactionSummary
+	)
+	err = w.DB.View(func(dbtx database.Tx) error {
+		var records []database.AddressRecord
+		if err := dbtx.Read().Where("coin=?", w.CoinType.CurrencyCode()).Find(&records).Error; err != nil {
+			return err
+		}
+		own = make(map[iwallet.Address]bool, len(records))
+		for _, rec := range records {
+			own[rec.Address()] = true
+		}
+		if err := dbtx.Read().Where("coin=?", w.CoinType.CurrencyCode()).Find(&summaries).Error; err != nil {
+			return err
+		}
+		labels, err = w.Keychain.addressLabels(dbtx)
+		if err != nil {
+			return err
+		}
+		metadata, err = w.transactionMetadata(dbtx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	exported := make([]ExportedTransaction, 0, len(history)+len(summaries))
+	for _, summary := range summaries {
+		etx := ExportedTransaction{
+			Coin:      w.CoinType.CurrencyCode(),
+			Txid:      summary.Txid,
+			Timestamp: summary.Timestamp,
+			Height:    summary.BlockHeight,
+			Value:     summary.Value,
+			Fee:       summary.Fee,
+			From:      splitAddresses(summary.From),
+			To:        splitAddresses(summary.To),
+		}
+		seen := make(map[string]bool)
+		for _, addr := range append(etx.From, etx.To...) {
+			label, ok := labels[iwallet.NewAddress(addr, w.CoinType)]
+			if ok && !seen[addr] {
+				etx.Labels = append(etx.Labels, label)
+				seen[addr] = true
+			}
+		}
+		sort.Strings(etx.Labels)
+		etx.setMetadata(metadata[iwallet.TransactionID(summary.Txid)])
+		exported = append(exported, etx)
+	}
+	for i := len(history) - 1; i >= 0; i-- {
+		tx := history[i].Transaction
+		etx := ExportedTransaction{
+			Coin:      w.CoinType.CurrencyCode(),
+			Txid:      tx.ID.String(),
+			Timestamp: tx.Timestamp,
+			Height:    tx.Height,
+			Value:     tx.Value.String(),
+		}
+
+		for _, from := range tx.From {
+			etx.From = append(etx.From, from.Address.String())
+		}
+		for _, to := range tx.To {
+			etx.To = append(etx.To, to.Address.String())
+		}
+		etx.Fee = transactionFee(tx, own)
+		for _, label := range history[i].Labels {
+			etx.Labels = append(etx.Labels, label)
+		}
+		sort.Strings(etx.Labels)
+		etx.setMetadata(history[i].Metadata)
+		exported = append(exported, etx)
+	}
+
+	// Summaries are usually older than the remaining history but a
+	// transaction which confirmed late can be pruned after newer ones.
+	sort.SliceStable(exported, func(i, j int) bool {
+		return exported[i].Timestamp.Before(exported[j].Timestamp)
+	})
+
+	if erp == nil {
+		return exported, nil
+	}
+	var currentRate *iwallet.Amount
+	for i := range exported {
+		etx := &exported[i]
+		var (
+			rate  iwallet.Amount
+			found bool
+		)
+		if historical, ok := erp.(HistoricalExchangeRateProvider); ok && etx.Height > 0 {
+			r, err := historical.GetUSDRateAt(w.CoinType, etx.Timestamp)
+			if err == nil {
+				rate, found = r, true
+			}
+		}
+		if !found {
+			if currentRate == nil {
+				r, err := erp.GetUSDRate(w.CoinType)
+				if err != nil {
+					return nil, err
+				}
+				currentRate = &r
+			}
+			rate = *currentRate
+			etx.CurrentRate = true
+		}
+		etx.USDRate = rate.String()
+		etx.USDValue = fiatValue(iwallet.NewAmount(etx.Value), rate, CoinDecimals(w.CoinType))
+	}
+	return exported, nil
+}
+
+func (etx *ExportedTransaction) setMetadata(metadata TransactionMetadata) {
+	etx.Note = metadata.Note
+	etx.Category = metadata.Category
+	etx.OrderID = metadata.OrderID
+}
+
+// transactionFee returns the fee paid by the wallet for the transaction,
+// or an empty string if none of its inputs belong to the wallet.
+func transactionFee(tx iwallet.Transaction, own map[iwallet.Address]bool) string {
+	var (
+		totalIn  = iwallet.NewAmount(0)
+		totalOut = iwallet.NewAmount(0)
+		sent     bool
+	)
+	for _, from := range tx.From {
+		totalIn = totalIn.Add(from.Amount)
+		if own[from.Address] {
+			sent = true
+		}
+	}
+	for _, to := range tx.To {
+		totalOut = totalOut.Add(to.Amount)
+	}
+	if sent && totalIn.Cmp(totalOut) >= 0 {
+		return totalIn.Sub(totalOut).String()
+	}
+	return ""
+}
+
+// splitAddresses splits the addresses joined by a TransactionSummary.
+func splitAddresses(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ";")
+}
+
+// WriteHistory encodes the exported transactions to out in the given
+// format.
+func WriteHistory(out io.Writer, txs []ExportedTransaction, format ExportFormat) error {
+	switch format {
+	case ExportJSON:
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "    ")
+		return enc.Encode(txs)
+	case ExportCSV:
+		w := csv.NewWriter(out)
+		header := []string{"coin", "txid", "timestamp", "height", "value", "fee", "from", "to", "labels", "usd_rate", "usd_value", "current_rate", "note", "category", "order_id"}
+		if err := w.Write(header); err != nil {
+			return err
+		}
+		for _, tx := range txs {
+			row := []string{
+				tx.Coin,
+				tx.Txid,
+				tx.Timestamp.UTC().Format(time.RFC3339),
+				strconv.FormatUint(tx.Height, 10),
+				tx.Value,
+				tx.Fee,
+				strings.Join(tx.From, ";"),
+				strings.Join(tx.To, ";"),
+				strings.Join(tx.Labels, ";"),
+				tx.USDRate,
+				tx.USDValue,
+				strconv.FormatBool(tx.CurrentRate),
+				tx.Note,
+				tx.Category,
+				tx.OrderID,
+			}
+			if err := w.Write(row); err != nil {
+				return err
+			}
+		}
+		w.Flush()
+		return w.Error()
+	}
+	return errors.New("unknown export format")
+}
+
+// fiatValue converts the amount, in the coin's base unit, at the rate and
+// returns it with two decimal places.
+func fiatValue(amount, rate iwallet.Amount, decimals int) string {
+	v, ok := new(big.Rat).SetString(amount.String())
+	if !ok {
+		return ""
+	}
+	r, ok := new(big.Rat).SetString(rate.String())
+	if !ok {
+		return ""
+	}
+	divisor := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimals)), nil)
+	v.Mul(v, r)
+	v.Quo(v, new(big.Rat).SetInt(divisor))
+	return v.FloatString(2)
+}
+
+// CoinDecimals returns the number of decimal places of the coin's base
+// unit.
+func CoinDecimals(coinType iwallet.CoinType) int {
+	switch coinType {
+	case iwallet.CtEthereum:
+		return 18
+	}
+	return 8
+}
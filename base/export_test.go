@@ -0,0 +1,138 @@
+package base
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	hd "github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"testing"
+	"time"
+)
+
+type testRateProvider struct {
+	current    iwallet.Amount
+	historical iwallet.Amount
+}
+
+func (p *testRateProvider) GetUSDRate(coinType iwallet.CoinType) (iwallet.Amount, error) {
+	return p.current, nil
+}
+
+func (p *testRateProvider) GetUSDRateAt(coinType iwallet.CoinType, t time.Time) (iwallet.Amount, error) {
+	return p.historical, nil
+}
+
+func TestWalletBase_ExportHistory(t *testing.T) {
+	w, err := setupWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	xpriv, err := hd.NewKeyFromString("tprv8ZgxMBicQKsPeghT19pungdFLMJM2hMs3EEn5WtgobD7wuQSFQu4VNaEJXH9HS3RhhLT4wgZ3hj31m3kafuxhL9vfGTRtBVLSog4zjxW3L1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.CreateWallet(*xpriv, nil, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.OpenWallet(); err != nil {
+		t.Fatal(err)
+	}
+
+	addr, err := w.CurrentAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SetAddressLabel(addr, "savings", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	received := iwallet.Transaction{
+		ID:        "aa",
+		Height:    600000,
+		Timestamp: time.Unix(1600000000, 0),
+		Value:     iwallet.NewAmount(900000),
+		From:      []iwallet.SpendInfo{{ID: mockOutpoint(), Address: mockAddress(), Amount: iwallet.NewAmount(1000000)}},
+		To:        []iwallet.SpendInfo{{ID: mockOutpoint(), Address: addr, Amount: iwallet.NewAmount(900000)}},
+	}
+	sent := iwallet.Transaction{
+		ID:        "bb",
+		Timestamp: time.Unix(1600001000, 0),
+		Value:     iwallet.NewAmount(-510000),
+		From:      []iwallet.SpendInfo{{ID: mockOutpoint(), Address: addr, Amount: iwallet.NewAmount(900000)}},
+		To: []iwallet.SpendInfo{
+			{ID: mockOutpoint(), Address: mockAddress(), Amount: iwallet.NewAmount(500000)},
+			{ID: mockOutpoint(), Address: mockAddress(), Amount: iwallet.NewAmount(390000)},
+		},
+	}
+	err = w.DB.Update(func(dbtx database.Tx) error {
+		for _, tx := range []iwallet.Transaction{received, sent} {
+			rec, err := database.NewTransactionRecord(tx, iwallet.CtMock)
+			if err != nil {
+				return err
+			}
+			if err := dbtx.Save(rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	erp := &testRateProvider{current: iwallet.NewAmount(1000000), historical: iwallet.NewAmount(900000)}
+	exported, err := w.ExportHistory(erp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exported) != 2 {
+		t.Fatalf("Expected 2 transactions, got %d", len(exported))
+	}
+
+	expected := []ExportedTransaction{
+		{Txid: "aa", Value: "900000", USDRate: "900000", USDValue: "8100.00"},
+		{Txid: "bb", Value: "-510000", Fee: "10000", USDRate: "1000000", USDValue: "-5100.00", CurrentRate: true},
+	}
+	for i, etx := range exported {
+		exp := expected[i]
+		if etx.Txid != exp.Txid || etx.Value != exp.Value || etx.Fee != exp.Fee || etx.USDRate != exp.USDRate ||
+			etx.USDValue != exp.USDValue || etx.CurrentRate != exp.CurrentRate {
+			t.Errorf("Expected %+v, got %+v", exp, etx)
+		}
+		if len(etx.Labels) != 1 || etx.Labels[0] != "savings" {
+			t.Errorf("Expected label savings, got %v", etx.Labels)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := WriteHistory(&buf, exported, ExportCSV); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("Expected 3 rows, got %d", len(rows))
+	}
+	if rows[1][1] != "aa" || rows[2][5] != "10000" || rows[2][10] != "-5100.00" {
+		t.Errorf("Unexpected csv rows %v", rows[1:])
+	}
+
+	buf.Reset()
+	if err := WriteHistory(&buf, exported, ExportJSON); err != nil {
+		t.Fatal(err)
+	}
+	var decoded []ExportedTransaction
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != 2 || decoded[1].USDValue != "-5100.00" {
+		t.Errorf("Unexpected json export %+v", decoded)
+	}
+}
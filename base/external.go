@@ -0,0 +1,127 @@
+package base
+
+import (
+	"errors"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"gorm.io/gorm"
+	"time"
+)
+
+// ErrNotWalletTransaction is returned when ingesting a transaction which
+// doesn't involve any of the wallet's addresses or watched addresses.
+var ErrNotWalletTransaction = errors.New("transaction does not involve the wallet")
+
+// BroadcastExternal pushes a transaction built outside the wallet, such as
+// one signed on another device, through the wallet's broadcast queue. The
+// coin decodes raw into its txid, the serialized outpoints it spends and
+// its lock time. Like the wallet's own spends it's left queued for the
+// rebroadcaster if the broadcast fails or the lock time isn't final, and
+// its inputs are kept out of coin selection until it's reported.
+//
+// Once a backend accepts it the transaction is ingested so it shows up in
+// the history right away if it involves the wallet.
+func (w *WalletBase) BroadcastExternal(txid iwallet.TransactionID, raw []byte, inputs [][]byte, lockTime uint32) error {
+	var final bool
+	err := w.DB.Update(func(dbtx database.Tx) error {
+		var record database.TransactionRecord
+		err := dbtx.Read().Where("coin=?", w.CoinType.CurrencyCode()).Where("txid=?", txid.String()).First(&record).Error
+		if err == nil && record.BlockHeight > 0 {
+			return ErrTransactionConfirmed
+		} else if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		best, err := w.BlockchainInfo()
+		if err != nil {
+			return err
+		}
+		final = IsLockTimeFinal(lockTime, best)
+
+		var queued []database.UnconfirmedTransaction
+		if err := dbtx.Read().Where("coin=?", w.CoinType.CurrencyCode()).Where("txid=?", txid.String()).Find(&queued).Error; err != nil {
+			return err
+		}
+		if len(queued) > 0 {
+			return nil
+		}
+		return dbtx.Save(&database.UnconfirmedTransaction{
+			Timestamp: time.Now(),
+			Coin:      w.CoinType.CurrencyCode(),
+			TxBytes:   raw,
+			Txid:      txid.String(),
+			LockTime:  lockTime,
+			Inputs:    JoinOutpoints(inputs),
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if !final {
+		return nil
+	}
+
+	w.BroadcastOrQueue(txid, raw)
+	status, err := w.BroadcastStatus(txid)
+	if err != nil || status.State != BroadcastSent {
+		return err
+	}
+	// The chain client reports the transaction in any case if it pays
+	// a subscribed address so failing to ingest it isn't an error.
+	if err := w.IngestExternalTransaction(txid); err != nil && err != ErrNotWalletTransaction {
+		w.Logger.Warningf("[%s] Error ingesting broadcast transaction %s: %s", w.CoinType, txid, err)
+	}
+	return nil
+}
+
+// IngestExternalTransaction fetches a transaction the wallet didn't build
+// from the backend and saves it to the history, updating the utxo set, if
+// it pays or spends from one of the wallet's addresses or watched
+// addresses. It returns ErrNotWalletTransaction otherwise. This is for
+// transactions broadcast elsewhere which the chain client wouldn't
+// otherwise report, or not yet.
+func (w *WalletBase) IngestExternalTransaction(txid iwallet.TransactionID) error {
+	tx, err := w.ChainClient.GetTransaction(txid)
+	if err != nil {
+		return err
+	}
+	return w.ChainManager.IngestTransaction(tx)
+}
+
+// IngestTransaction saves a transaction reported by a source other than
+// the chain client. It blocks until it's saved and returns
+// ErrNotWalletTransaction if it doesn't involve the wallet.
+func (cm *ChainManager) IngestTransaction(tx iwallet.Transaction) error {
+	errChan := make(chan error, 1)
+	cm.msgChan <- &ingestJob{
+		tx:      tx,
+		errChan: errChan,
+	}
+	return <-errChan
+}
+
+// isRelevant returns whether the transaction pays or spends from one of
+// the wallet's addresses or watched addresses. It must only be called from
+// the chainHandler.
+func (cm *ChainManager) isRelevant(tx iwallet.Transaction) bool {
+	addrs, err := cm.keychain.GetAddresses()
+	if err != nil {
+		cm.logger.Errorf("[%s] Error loading addresses: %s", cm.coinType, err)
+		return false
+	}
+	addrMap := make(map[string]bool, len(addrs)+len(cm.watchOnly))
+	for _, addr := range append(addrs, cm.watchOnly...) {
+		addrMap[addr.String()] = true
+	}
+	for _, from := range tx.From {
+		if addrMap[from.Address.String()] {
+			return true
+		}
+	}
+	for _, to := range tx.To {
+		if addrMap[to.Address.String()] {
+			return true
+		}
+	}
+	return false
+}
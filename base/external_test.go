@@ -0,0 +1,99 @@
+package base
+
+import (
+	"errors"
+	"github.com/cpacia/multiwallet/database"
+	"github.com/cpacia/multiwallet/log"
+	iwallet "github.com/cpacia/wallet-interface"
+	"gorm.io/gorm"
+	"testing"
+	"time"
+)
+
+func TestWalletBase_BroadcastExternal(t *testing.T) {
+	chain, mock, err := newTestChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.db.Close()
+	w := &WalletBase{
+		ChainClient:  mock,
+		ChainManager: chain,
+		DB:           chain.db,
+		Logger:       log.New("test"),
+		CoinType:     iwallet.CtMock,
+	}
+
+	startSub, err := chain.eventBus.Subscribe(&ChainStartedEvent{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain.Start()
+	defer chain.Stop()
+
+	select {
+	case <-startSub.Out():
+	case <-time.After(time.Second * 10):
+		t.Fatal("Timed out waiting for start")
+	}
+
+	addrs, err := chain.keychain.GetAddresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The backend knows the transactions but hasn't reported them on the
+	// subscription.
+	payment := NewMockTransaction(nil, &addrs[0])
+	unrelated := NewMockTransaction(nil, nil)
+	mock.mtx.Lock()
+	mock.txIndex[payment.ID] = payment
+	mock.txIndex[unrelated.ID] = unrelated
+	mock.mtx.Unlock()
+
+	recorded := func(txid iwallet.TransactionID) bool {
+		var rec database.TransactionRecord
+		err := chain.db.View(func(dbtx database.Tx) error {
+			return dbtx.Read().Where("txid=?", txid.String()).First(&rec).Error
+		})
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			t.Fatal(err)
+		}
+		return err == nil
+	}
+
+	if err := w.BroadcastExternal(payment.ID, []byte{0x01}, [][]byte{payment.From[0].ID}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !recorded(payment.ID) {
+		t.Error("Expected the payment to be ingested")
+	}
+	status, err := w.BroadcastStatus(payment.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != BroadcastSent {
+		t.Errorf("Expected the payment to be sent, got %s", status.State)
+	}
+
+	if err := w.IngestExternalTransaction(unrelated.ID); err != ErrNotWalletTransaction {
+		t.Errorf("Expected ErrNotWalletTransaction, got %v", err)
+	}
+	if recorded(unrelated.ID) {
+		t.Error("Expected the unrelated transaction not to be saved")
+	}
+
+	// While the backend is unreachable the transaction is queued.
+	offline := NewMockTransaction(nil, &addrs[1])
+	mock.SetErrorResponse(errors.New("connection refused"))
+	if err := w.BroadcastExternal(offline.ID, []byte{0x02}, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	mock.SetErrorResponse(nil)
+	spends, err := w.QueuedSpends()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spends) != 1 || spends[0].Txid != offline.ID {
+		t.Errorf("Expected the transaction to be queued, got %v", spends)
+	}
+}
@@ -0,0 +1,138 @@
+package base
+
+import (
+	"context"
+	"errors"
+	"github.com/cpacia/multiwallet/log"
+	iwallet "github.com/cpacia/wallet-interface"
+	"sync"
+)
+
+// FailoverClient is a ChainClient backed by an ordered list of backends.
+// Open connects to the first backend which can be opened and all calls go
+// to it. Each later Open, such as the ChainManager retrying after the
+// connection was lost, starts from the backend after the active one so a
+// dead backend is skipped.
+type FailoverClient struct {
+	clients []ChainClient
+	logger  log.Logger
+
+	mtx    sync.RWMutex
+	active int
+	opened bool
+}
+
+// NewFailoverClient returns a FailoverClient which tries the clients in
+// order.
+func NewFailoverClient(clients []ChainClient, coinType iwallet.CoinType, logger log.Logger) *FailoverClient {
+	return &FailoverClient{
+		clients: clients,
+		logger:  moduleLogger(logger, "failover", coinType),
+	}
+}
+
+// Active returns the backend calls are currently sent to.
+func (c *FailoverClient) Active() ChainClient {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.clients[c.active]
+}
+
+// Clients returns all of the backends in order.
+func (c *FailoverClient) Clients() []ChainClient {
+	return c.clients
+}
+
+func (c *FailoverClient) GetBlockchainInfo() (iwallet.BlockInfo, error) {
+	return c.Active().GetBlockchainInfo()
+}
+
+func (c *FailoverClient) GetBlockchainInfoContext(ctx context.Context) (iwallet.BlockInfo, error) {
+	return WithContext(c.Active()).GetBlockchainInfoContext(ctx)
+}
+
+func (c *FailoverClient) GetAddressTransactions(addr iwallet.Address, fromHeight uint64) ([]iwallet.Transaction, error) {
+	return c.Active().GetAddressTransactions(addr, fromHeight)
+}
+
+func (c *FailoverClient) GetAddressTransactionsContext(ctx context.Context, addr iwallet.Address, fromHeight uint64) ([]iwallet.Transaction, error) {
+	return WithContext(c.Active()).GetAddressTransactionsContext(ctx, addr, fromHeight)
+}
+
+func (c *FailoverClient) GetTransaction(id iwallet.TransactionID) (iwallet.Transaction, error) {
+	return c.Active().GetTransaction(id)
+}
+
+func (c *FailoverClient) GetTransactionContext(ctx context.Context, id iwallet.TransactionID) (iwallet.Transaction, error) {
+	return WithContext(c.Active()).GetTransactionContext(ctx, id)
+}
+
+func (c *FailoverClient) IsBlockInMainChain(block iwallet.BlockInfo) (bool, error) {
+	return c.Active().IsBlockInMainChain(block)
+}
+
+func (c *FailoverClient) GetMerkleProof(id iwallet.TransactionID) (*MerkleProof, error) {
+	return c.Active().GetMerkleProof(id)
+}
+
+func (c *FailoverClient) SubscribeTransactions(addrs []iwallet.Address) (*TransactionSubscription, error) {
+	return c.Active().SubscribeTransactions(addrs)
+}
+
+func (c *FailoverClient) SubscribeBlocks() (*BlockSubscription, error) {
+	return c.Active().SubscribeBlocks()
+}
+
+func (c *FailoverClient) Broadcast(serializedTx []byte) error {
+	return c.Active().Broadcast(serializedTx)
+}
+
+func (c *FailoverClient) BroadcastContext(ctx context.Context, serializedTx []byte) error {
+	return WithContext(c.Active()).BroadcastContext(ctx, serializedTx)
+}
+
+// Open opens the first backend which can be opened, starting after the
+// active one if it was opened before. The previously active backend is
+// closed when another one takes over.
+func (c *FailoverClient) Open() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if len(c.clients) == 0 {
+		return errors.New("no backends configured")
+	}
+	start := c.active
+	if c.opened {
+		start = (c.active + 1) % len(c.clients)
+	}
+	var firstErr error
+	for i := 0; i < len(c.clients); i++ {
+		n := (start + i) % len(c.clients)
+		if err := c.clients[n].Open(); err != nil {
+			c.logger.Warningf("Error opening backend %d: %s", n, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if c.opened && n != c.active {
+			c.clients[c.active].Close()
+			c.logger.Infof("Failed over to backend %d", n)
+		}
+		c.active = n
+		c.opened = true
+		return nil
+	}
+	return firstErr
+}
+
+func (c *FailoverClient) Close() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if !c.opened {
+		return nil
+	}
+	c.opened = false
+	return c.clients[c.active].Close()
+}
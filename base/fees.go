@@ -102,6 +102,10 @@ func (fp *APIFeeProvider) GetFee(level iwallet.FeeLevel) (iwallet.Amount, error)
 
 	resp, err := fp.client.Get(fp.aPIEndpoint)
 	if err != nil {
+		// Stale fees are better than none while offline.
+		if len(fp.cache) > 0 {
+			return fromCache()
+		}
 		return iwallet.NewAmount(0), err
 	}
 	var feeResponse apiResponse
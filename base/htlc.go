@@ -0,0 +1,260 @@
+package base
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	hd "github.com/btcsuite/btcutil/hdkeychain"
+	iwallet "github.com/cpacia/wallet-interface"
+)
+
+// HTLCSecretSize is the size of an HTLC secret.
+const HTLCSecretSize = 32
+
+// ErrNoHTLCSecret is returned by ExtractHTLCSecret when the transaction
+// doesn't redeem the contract.
+var ErrNoHTLCSecret = errors.New("transaction does not reveal the htlc secret")
+
+// HTLC is a hash time locked contract between two keys. The Recipient can
+// spend it by revealing the secret whose SHA256 is SecretHash. After
+// LockTime, a unix timestamp, the Refund key can spend it instead. Keys are
+// identified by the HASH160 of their compressed public key.
+//
+// The contract is used as a P2SH redeem script of the form:
+//
+//	OP_IF
+//	    OP_SIZE 32 OP_EQUALVERIFY OP_SHA256 <secret hash> OP_EQUALVERIFY
+//	    OP_DUP OP_HASH160 <recipient>
+//	OP_ELSE
+//	    <lock time> OP_CHECKLOCKTIMEVERIFY OP_DROP
+//	    OP_DUP OP_HASH160 <refund>
+//	OP_ENDIF
+//	OP_EQUALVERIFY OP_CHECKSIG
+//
+// Every UTXO coin supported by the wallet evaluates it the same way so the
+// two sides of an atomic swap use the same script.
+type HTLC struct {
+	SecretHash [32]byte
+	Recipient  [20]byte
+	Refund     [20]byte
+	LockTime   int64
+}
+
+// NewHTLC returns the contract paying recipient if they reveal the secret
+// hashing to secretHash and refundable to refund after lockTime.
+func NewHTLC(secretHash []byte, recipient, refund *btcec.PublicKey, lockTime int64) (HTLC, error) {
+	var h HTLC
+	if len(secretHash) != sha256.Size {
+		return h, errors.New("invalid secret hash")
+	}
+	if lockTime <= 0 || lockTime > 0xffffffff {
+		return h, errors.New("invalid lock time")
+	}
+	copy(h.SecretHash[:], secretHash)
+	copy(h.Recipient[:], btcutil.Hash160(recipient.SerializeCompressed()))
+	copy(h.Refund[:], btcutil.Hash160(refund.SerializeCompressed()))
+	h.LockTime = lockTime
+	return h, nil
+}
+
+// Script returns the redeem script of the contract.
+func (h HTLC) Script() ([]byte, error) {
+	return txscript.NewScriptBuilder().
+		AddOp(txscript.OP_IF).
+		AddOp(txscript.OP_SIZE).
+		AddInt64(HTLCSecretSize).
+		AddOp(txscript.OP_EQUALVERIFY).
+		AddOp(txscript.OP_SHA256).
+		AddData(h.SecretHash[:]).
+		AddOp(txscript.OP_EQUALVERIFY).
+		AddOp(txscript.OP_DUP).
+		AddOp(txscript.OP_HASH160).
+		AddData(h.Recipient[:]).
+		AddOp(txscript.OP_ELSE).
+		AddInt64(h.LockTime).
+		AddOp(txscript.OP_CHECKLOCKTIMEVERIFY).
+		AddOp(txscript.OP_DROP).
+		AddOp(txscript.OP_DUP).
+		AddOp(txscript.OP_HASH160).
+		AddData(h.Refund[:]).
+		AddOp(txscript.OP_ENDIF).
+		AddOp(txscript.OP_EQUALVERIFY).
+		AddOp(txscript.OP_CHECKSIG).
+		Script()
+}
+
+// ParseHTLCScript returns the contract of a redeem script built by
+// HTLC.Script. Any other script returns an error.
+func ParseHTLCScript(script []byte) (HTLC, error) {
+	var h HTLC
+	pushes, err := txscript.PushedData(script)
+	if err != nil {
+		return h, err
+	}
+	// The secret size, secret hash, recipient, lock time and refund.
+	if len(pushes) != 5 || len(pushes[1]) != 32 || len(pushes[2]) != 20 || len(pushes[4]) != 20 {
+		return h, errors.New("script is not an htlc")
+	}
+	lockTime, err := decodeScriptNum(pushes[3])
+	if err != nil {
+		return h, err
+	}
+	copy(h.SecretHash[:], pushes[1])
+	copy(h.Recipient[:], pushes[2])
+	copy(h.Refund[:], pushes[4])
+	h.LockTime = lockTime
+
+	// Rebuilding the script checks the opcodes between the pushes.
+	expected, err := h.Script()
+	if err != nil {
+		return h, err
+	}
+	if !bytes.Equal(script, expected) {
+		return h, errors.New("script is not an htlc")
+	}
+	return h, nil
+}
+
+// decodeScriptNum decodes a positive minimally encoded script number of up
+// to five bytes, the size CHECKLOCKTIMEVERIFY accepts.
+func decodeScriptNum(b []byte) (int64, error) {
+	if len(b) == 0 || len(b) > 5 || b[len(b)-1]&0x80 != 0 {
+		return 0, errors.New("invalid lock time")
+	}
+	var n int64
+	for i, v := range b {
+		n |= int64(v) << uint(8*i)
+	}
+	return n, nil
+}
+
+// CheckSecret returns an error if the secret doesn't redeem the contract.
+func (h HTLC) CheckSecret(secret []byte) error {
+	if len(secret) != HTLCSecretSize || sha256.Sum256(secret) != h.SecretHash {
+		return errors.New("secret does not match the htlc secret hash")
+	}
+	return nil
+}
+
+// HTLCRedeemSigScript returns the signature script spending the contract
+// with the secret. The signature has its sighash type appended.
+func HTLCRedeemSigScript(sig, pubKey, secret, script []byte) ([]byte, error) {
+	return txscript.NewScriptBuilder().
+		AddData(sig).
+		AddData(pubKey).
+		AddData(secret).
+		AddInt64(1).
+		AddData(script).
+		Script()
+}
+
+// HTLCRefundSigScript returns the signature script spending the contract
+// after its lock time. The signature has its sighash type appended.
+func HTLCRefundSigScript(sig, pubKey, script []byte) ([]byte, error) {
+	return txscript.NewScriptBuilder().
+		AddData(sig).
+		AddData(pubKey).
+		AddInt64(0).
+		AddData(script).
+		Script()
+}
+
+// HTLCSpendSize returns the serialized size of a transaction spending the
+// contract with one output paying outScriptSize bytes of script. The
+// largest ECDSA signature is assumed.
+func HTLCSpendSize(script []byte, redeem bool, outScriptSize int) int {
+	// A 72 byte signature with the sighash type, a compressed public key
+	// and the branch selector.
+	sigScriptSize := 1 + 73 + 1 + 33 + 1
+	if redeem {
+		sigScriptSize += 1 + HTLCSecretSize
+	}
+	sigScriptSize += 1 + len(script)
+	if len(script) >= txscript.OP_PUSHDATA1 {
+		sigScriptSize++
+	}
+
+	// version, input count, outpoint, script, sequence, output count,
+	// value, output script and lock time.
+	return 4 + 1 + 36 + wire.VarIntSerializeSize(uint64(sigScriptSize)) + sigScriptSize + 4 + 1 + 8 + 1 + outScriptSize + 4
+}
+
+// ExtractHTLCSecret returns the secret revealed by a serialized transaction
+// spending the contract with the given redeem script. ErrNoHTLCSecret is
+// returned if it doesn't redeem the contract.
+func ExtractHTLCSecret(rawTx []byte, script []byte) ([]byte, error) {
+	contract, err := ParseHTLCScript(script)
+	if err != nil {
+		return nil, err
+	}
+	var tx wire.MsgTx
+	if err := tx.Deserialize(bytes.NewReader(rawTx)); err != nil {
+		return nil, err
+	}
+	for _, in := range tx.TxIn {
+		pushes, err := txscript.PushedData(in.SignatureScript)
+		if err != nil || len(pushes) != 4 || !bytes.Equal(pushes[3], script) {
+			continue
+		}
+		if contract.CheckSecret(pushes[2]) == nil {
+			return pushes[2], nil
+		}
+	}
+	return nil, ErrNoHTLCSecret
+}
+
+// HTLCOutput returns the output of the transaction paying the contract
+// address.
+func HTLCOutput(txn iwallet.Transaction, addr iwallet.Address) (iwallet.SpendInfo, error) {
+	for _, out := range txn.To {
+		if out.Address.String() == addr.String() {
+			return out, nil
+		}
+	}
+	return iwallet.SpendInfo{}, errors.New("transaction does not pay the htlc")
+}
+
+// HTLCWallet is implemented by wallets which can fund and spend HTLCs.
+type HTLCWallet interface {
+	// HTLCAddress returns the P2SH address of the contract's redeem
+	// script. Funding an HTLC is a normal spend to this address.
+	HTLCAddress(script []byte) (iwallet.Address, error)
+
+	// SpendHTLC spends the contract output of contractTx to an internal
+	// address of the wallet, less the fee. If secret is set it redeems
+	// the contract and key must be the recipient's. Otherwise it refunds
+	// the contract, which only confirms after the lock time, and key
+	// must be the refund key. The transaction is broadcast when wtx is
+	// committed.
+	SpendHTLC(wtx iwallet.Tx, contractTx iwallet.Transaction, script, secret []byte, key btcec.PrivateKey, feeLevel iwallet.FeeLevel) (iwallet.TransactionID, error)
+
+	// SwapKey returns the wallet's HTLC key at index. See
+	// Keychain.SwapKey.
+	SwapKey(index uint32) (*btcec.PrivateKey, error)
+}
+
+// SwapKey returns the HTLC key at index. Swap keys are hardened children of
+// the internal chain so they're never used for addresses and can't be
+// derived from the account public key. ErrEncryptedKeychain is returned
+// while the keychain is locked. The caller must zero the key.
+func (kc *Keychain) SwapKey(index uint32) (*btcec.PrivateKey, error) {
+	kc.mtx.RLock()
+	defer kc.mtx.RUnlock()
+
+	if kc.watchOnly {
+		return nil, ErrWatchOnlyKeychain
+	}
+	if kc.internalPrivkey == nil {
+		return nil, ErrEncryptedKeychain
+	}
+	return childPrivKey(kc.internalPrivkey, hd.HardenedKeyStart+index)
+}
+
+// SwapKey returns the wallet's HTLC key at index. See Keychain.SwapKey.
+func (w *WalletBase) SwapKey(index uint32) (*btcec.PrivateKey, error) {
+	return w.Keychain.SwapKey(index)
+}
@@ -0,0 +1,133 @@
+package base
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/wire"
+	"testing"
+)
+
+func TestHTLC(t *testing.T) {
+	recipient, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	refund, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := bytes.Repeat([]byte{0x01}, HTLCSecretSize)
+	secretHash := sha256.Sum256(secret)
+
+	for _, lockTime := range []int64{1, 0x7f, 0x80, 1600000000, 0xffffffff} {
+		contract, err := NewHTLC(secretHash[:], recipient.PubKey(), refund.PubKey(), lockTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		script, err := contract.Script()
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := ParseHTLCScript(script)
+		if err != nil {
+			t.Fatalf("Lock time %d: %s", lockTime, err)
+		}
+		if parsed != contract {
+			t.Errorf("Lock time %d: expected %+v, got %+v", lockTime, contract, parsed)
+		}
+	}
+
+	contract, err := NewHTLC(secretHash[:], recipient.PubKey(), refund.PubKey(), 1600000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	script, err := contract.Script()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseHTLCScript(append(script, 0x00)); err == nil {
+		t.Error("Expected a modified script to fail to parse")
+	}
+	if err := contract.CheckSecret(secret); err != nil {
+		t.Error(err)
+	}
+	if err := contract.CheckSecret(make([]byte, HTLCSecretSize)); err == nil {
+		t.Error("Expected the wrong secret to fail")
+	}
+
+	spend := func(sigScript []byte) []byte {
+		tx := wire.NewMsgTx(1)
+		tx.AddTxIn(wire.NewTxIn(&wire.OutPoint{}, sigScript, nil))
+		tx.AddTxOut(wire.NewTxOut(1000, []byte{0x51}))
+		var buf bytes.Buffer
+		if err := tx.Serialize(&buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	sig := make([]byte, 72)
+	pub := recipient.PubKey().SerializeCompressed()
+
+	redeem, err := HTLCRedeemSigScript(sig, pub, secret, script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revealed, err := ExtractHTLCSecret(spend(redeem), script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(revealed, secret) {
+		t.Errorf("Expected secret %x, got %x", secret, revealed)
+	}
+
+	refundScript, err := HTLCRefundSigScript(sig, refund.PubKey().SerializeCompressed(), script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ExtractHTLCSecret(spend(refundScript), script); !errors.Is(err, ErrNoHTLCSecret) {
+		t.Errorf("Expected ErrNoHTLCSecret for a refund, got %v", err)
+	}
+
+	// The size estimate covers the signature script actually built.
+	if size := HTLCSpendSize(script, true, 1); size < len(spend(redeem)) {
+		t.Errorf("Redeem size %d underestimated, actual %d", size, len(spend(redeem)))
+	}
+	if size := HTLCSpendSize(script, false, 1); size < len(spend(refundScript)) {
+		t.Errorf("Refund size %d underestimated, actual %d", size, len(spend(refundScript)))
+	}
+}
+
+func TestKeychain_SwapKey(t *testing.T) {
+	keychain, err := setupKeychain()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key0, err := keychain.SwapKey(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := keychain.SwapKey(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key0.Serialize(), again.Serialize()) {
+		t.Error("Expected the same key for the same index")
+	}
+	key1, err := keychain.SwapKey(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(key0.Serialize(), key1.Serialize()) {
+		t.Error("Expected different keys for different indexes")
+	}
+
+	if err := keychain.SetPassphase([]byte("let me in")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keychain.SwapKey(0); !errors.Is(err, ErrEncryptedKeychain) {
+		t.Errorf("Expected ErrEncryptedKeychain, got %v", err)
+	}
+}
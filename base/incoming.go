@@ -0,0 +1,147 @@
+package base
+
+import (
+	"errors"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"gorm.io/gorm"
+	"time"
+)
+
+// ErrNotIncoming is returned by RebroadcastIncoming for a transaction which
+// spends coins of this wallet. The wallet's own transactions are handled by
+// the Rebroadcaster.
+var ErrNotIncoming = errors.New("transaction is not an incoming payment")
+
+// backends returns each of the backends behind client. Broadcasts sent to
+// all of them reach more of the network than the active one alone.
+func backends(client ChainClient) []ChainClient {
+	switch c := client.(type) {
+	case *VerifyingClient:
+		return append(backends(c.Primary), backends(c.Secondary)...)
+	case *FailoverClient:
+		var clients []ChainClient
+		for _, fc := range c.Clients() {
+			clients = append(clients, backends(fc)...)
+		}
+		return clients
+	}
+	return []ChainClient{client}
+}
+
+// LingeringIncoming returns the unconfirmed transactions paying the wallet,
+// which spend none of its coins, that were first seen more than age ago.
+func (w *WalletBase) LingeringIncoming(age time.Duration) ([]iwallet.TransactionID, error) {
+	var records []database.TransactionRecord
+	err := w.DB.View(func(dbtx database.Tx) error {
+		return dbtx.Read().Where("coin=?", w.CoinType.CurrencyCode()).
+			Where("block_height=?", 0).
+			Where("timestamp<?", time.Now().Add(-age)).
+			Find(&records).Error
+	})
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	var ids []iwallet.TransactionID
+	for i := range records {
+		if records[i].Dropped() || records[i].Status == database.TxStatusConflicted {
+			continue
+		}
+		tx, err := records[i].Transaction()
+		if err != nil {
+			return nil, err
+		}
+		incoming, err := w.isIncoming(tx)
+		if err != nil {
+			return nil, err
+		}
+		if incoming {
+			ids = append(ids, tx.ID)
+		}
+	}
+	return ids, nil
+}
+
+// isIncoming returns whether none of the transaction's inputs are from the
+// wallet.
+func (w *WalletBase) isIncoming(tx iwallet.Transaction) (bool, error) {
+	for _, from := range tx.From {
+		has, err := w.Keychain.HasKey(from.Address)
+		if err != nil {
+			return false, err
+		}
+		if has {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// RebroadcastIncoming fetches an unconfirmed payment to the wallet sent by
+// someone else and broadcasts it through every configured backend, in case
+// it has fallen out of the mempools of the nodes the sender reached. It
+// returns the number of backends which accepted it and an error only if
+// none did.
+func (w *WalletBase) RebroadcastIncoming(id iwallet.TransactionID) (int, error) {
+	var record database.TransactionRecord
+	err := w.DB.View(func(dbtx database.Tx) error {
+		return dbtx.Read().Where("coin=?", w.CoinType.CurrencyCode()).Where("txid=?", id.String()).First(&record).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, ErrTransactionNotFound
+	} else if err != nil {
+		return 0, err
+	}
+	if record.BlockHeight > 0 {
+		return 0, ErrTransactionConfirmed
+	}
+	tx, err := record.Transaction()
+	if err != nil {
+		return 0, err
+	}
+	incoming, err := w.isIncoming(tx)
+	if err != nil {
+		return 0, err
+	}
+	if !incoming {
+		return 0, ErrNotIncoming
+	}
+
+	clients := backends(w.ChainClient)
+	raw, err := w.GetRawTransaction(id)
+	if err == ErrRawTransactionUnsupported {
+		// The active backend may not serve raw transactions while
+		// another does.
+		for _, client := range clients {
+			if rc, ok := client.(RawTransactionClient); ok {
+				if raw, err = rc.GetRawTransaction(id); err == nil {
+					break
+				}
+			}
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		accepted int
+		firstErr error
+	)
+	for i, client := range clients {
+		if err := client.Broadcast(raw); err != nil {
+			w.Logger.Warningf("[%s] Backend %d rejected incoming tx %s: %s", w.CoinType, i, id, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		accepted++
+	}
+	if accepted == 0 {
+		return 0, firstErr
+	}
+	w.Logger.Infof("[%s] Rebroadcast incoming tx %s through %d of %d backends", w.CoinType, id, accepted, len(clients))
+	return accepted, nil
+}
@@ -0,0 +1,113 @@
+package base
+
+import (
+	"errors"
+	"github.com/cpacia/multiwallet/database"
+	"github.com/cpacia/multiwallet/log"
+	iwallet "github.com/cpacia/wallet-interface"
+	"testing"
+	"time"
+)
+
+// rawMockClient is a MockChainClient which serves raw transactions and
+// records what it's asked to broadcast.
+type rawMockClient struct {
+	*MockChainClient
+	raw       []byte
+	broadcast [][]byte
+	err       error
+}
+
+func (c *rawMockClient) GetRawTransaction(id iwallet.TransactionID) ([]byte, error) {
+	return c.raw, nil
+}
+
+func (c *rawMockClient) Broadcast(serializedTx []byte) error {
+	if c.err != nil {
+		return c.err
+	}
+	c.broadcast = append(c.broadcast, serializedTx)
+	return nil
+}
+
+func TestWalletBase_RebroadcastIncoming(t *testing.T) {
+	chain, _, err := newTestChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.db.Close()
+
+	raw := []byte{0x01, 0x02, 0x03}
+	primary := &rawMockClient{MockChainClient: NewMockChainClient(), raw: raw}
+	backup := &rawMockClient{MockChainClient: NewMockChainClient(), err: errors.New("rejected")}
+	w := &WalletBase{
+		ChainClient:  NewFailoverClient([]ChainClient{primary, backup}, iwallet.CtMock, nil),
+		ChainManager: chain,
+		Keychain:     chain.keychain,
+		DB:           chain.db,
+		Logger:       log.New("test"),
+		CoinType:     iwallet.CtMock,
+	}
+
+	addrs, err := chain.keychain.GetAddresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	incoming := NewMockTransaction(nil, &addrs[0])
+	incoming.Timestamp = time.Now().Add(-time.Hour)
+	recent := NewMockTransaction(nil, &addrs[1])
+	recent.Timestamp = time.Now()
+	outgoing := NewMockTransaction(&incoming.To[0], nil)
+	outgoing.Timestamp = time.Now().Add(-time.Hour)
+	confirmed := NewMockTransaction(nil, &addrs[2])
+	confirmed.Height = 1
+	err = chain.db.Update(func(dbtx database.Tx) error {
+		for _, tx := range []iwallet.Transaction{incoming, recent, outgoing, confirmed} {
+			rec, err := database.NewTransactionRecord(tx, iwallet.CtMock)
+			if err != nil {
+				return err
+			}
+			if err := dbtx.Save(rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lingering, err := w.LingeringIncoming(time.Minute * 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lingering) != 1 || lingering[0] != incoming.ID {
+		t.Errorf("Expected only the old incoming transaction to be lingering, got %v", lingering)
+	}
+
+	accepted, err := w.RebroadcastIncoming(incoming.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accepted != 1 {
+		t.Errorf("Expected one backend to accept the transaction, got %d", accepted)
+	}
+	if len(primary.broadcast) != 1 || string(primary.broadcast[0]) != string(raw) {
+		t.Error("Expected the raw transaction to be broadcast")
+	}
+
+	if _, err := w.RebroadcastIncoming(outgoing.ID); err != ErrNotIncoming {
+		t.Errorf("Expected ErrNotIncoming, got %v", err)
+	}
+	if _, err := w.RebroadcastIncoming(confirmed.ID); err != ErrTransactionConfirmed {
+		t.Errorf("Expected ErrTransactionConfirmed, got %v", err)
+	}
+	if _, err := w.RebroadcastIncoming(NewMockTransaction(nil, nil).ID); err != ErrTransactionNotFound {
+		t.Errorf("Expected ErrTransactionNotFound, got %v", err)
+	}
+
+	primary.err = errors.New("rejected")
+	if _, err := w.RebroadcastIncoming(incoming.ID); err == nil {
+		t.Error("Expected an error when every backend rejects the transaction")
+	}
+}
@@ -0,0 +1,368 @@
+package base
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/cpacia/multiwallet/database"
+	"github.com/cpacia/multiwallet/log"
+	iwallet "github.com/cpacia/wallet-interface"
+	"gorm.io/gorm"
+	"time"
+)
+
+// invoiceCheckInterval is how often the InvoiceManager looks for pending
+// invoices which have expired.
+const invoiceCheckInterval = time.Minute
+
+// ErrInvoiceNotFound is returned for an unknown invoice ID.
+var ErrInvoiceNotFound = errors.New("invoice not found")
+
+// InvoiceStatus is the state of an invoice.
+type InvoiceStatus string
+
+const (
+	// InvoicePending invoices haven't been paid in full and haven't
+	// expired.
+	InvoicePending InvoiceStatus = "pending"
+
+	// InvoicePaid invoices were paid exactly the amount requested before
+	// they expired.
+	InvoicePaid InvoiceStatus = "paid"
+
+	// InvoiceOverpaid invoices were paid more than the amount requested
+	// before they expired.
+	InvoiceOverpaid InvoiceStatus = "overpaid"
+
+	// InvoiceUnderpaid invoices expired after being paid less than the
+	// amount requested.
+	InvoiceUnderpaid InvoiceStatus = "underpaid"
+
+	// InvoiceExpired invoices expired without being paid.
+	InvoiceExpired InvoiceStatus = "expired"
+)
+
+// Invoice is a request for payment to a fresh wallet address.
+type Invoice struct {
+	ID         string
+	Address    iwallet.Address
+	Amount     iwallet.Amount
+	Memo       string
+	Status     InvoiceStatus
+	Paid       iwallet.Amount
+	Txids      []iwallet.TransactionID
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+	ResolvedAt time.Time
+}
+
+// InvoicePaymentEvent is emitted when a transaction paying an invoice is
+// first seen. Paid is the total paid so far. Late is set for payments
+// made after the invoice was resolved, which don't change its status and
+// may need to be refunded.
+type InvoicePaymentEvent struct {
+	ID            string
+	TransactionID iwallet.TransactionID
+	Amount        iwallet.Amount
+	Paid          iwallet.Amount
+	Late          bool
+}
+
+// InvoiceResolvedEvent is emitted when an invoice leaves the pending
+// status, or goes from paid to overpaid.
+type InvoiceResolvedEvent struct {
+	ID     string
+	Status InvoiceStatus
+	Paid   iwallet.Amount
+}
+
+// InvoiceManager tracks payments to the wallet's invoices. Invoices are
+// resolved as paid or overpaid as soon as enough is paid and as expired or
+// underpaid once their expiry passes. Payments are counted when they're
+// first seen, so callers which need confirmations should wait for them
+// with WaitForConfirmation.
+//
+// Events are emitted on Bus as *InvoicePaymentEvent and
+// *InvoiceResolvedEvent.
+type InvoiceManager struct {
+	Bus Bus
+
+	db       database.Database
+	coinType iwallet.CoinType
+	logger   log.Logger
+	shutdown chan struct{}
+}
+
+// NewInvoiceManager returns a new InvoiceManager.
+func NewInvoiceManager(db database.Database, logger log.Logger, coinType iwallet.CoinType) *InvoiceManager {
+	return &InvoiceManager{
+		Bus:      NewBus(),
+		db:       db,
+		coinType: coinType,
+		logger:   moduleLogger(logger, "invoice", coinType),
+		shutdown: make(chan struct{}),
+	}
+}
+
+// Start will process the transactions from txs and expire invoices until
+// Stop is called. Invoices which expired while the wallet was closed are
+// resolved straight away.
+func (m *InvoiceManager) Start(txs <-chan iwallet.Transaction) {
+	ticker := time.NewTicker(invoiceCheckInterval)
+	defer ticker.Stop()
+
+	if err := m.ExpireInvoices(time.Now()); err != nil {
+		m.logger.Errorf("[%s] Error expiring invoices: %s", m.coinType, err)
+	}
+	for {
+		select {
+		case tx := <-txs:
+			if err := m.HandleTransaction(tx); err != nil {
+				m.logger.Errorf("[%s] Error updating invoices for transaction %s: %s", m.coinType, tx.ID, err)
+			}
+		case now := <-ticker.C:
+			if err := m.ExpireInvoices(now); err != nil {
+				m.logger.Errorf("[%s] Error expiring invoices: %s", m.coinType, err)
+			}
+		case <-m.shutdown:
+			return
+		}
+	}
+}
+
+// Stop will shutdown the InvoiceManager.
+func (m *InvoiceManager) Stop() {
+	close(m.shutdown)
+}
+
+// Create saves a new pending invoice for amount paid to addr which expires
+// after expiry.
+func (m *InvoiceManager) Create(dbtx database.Tx, addr iwallet.Address, amount iwallet.Amount, expiry time.Duration, memo string) (Invoice, error) {
+	if amount.Cmp(iwallet.NewAmount(0)) <= 0 {
+		return Invoice{}, errors.New("invoice amount must be positive")
+	}
+	if expiry <= 0 {
+		return Invoice{}, errors.New("invoice expiry must be positive")
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return Invoice{}, err
+	}
+	now := time.Now()
+	record := database.InvoiceRecord{
+		ID:        hex.EncodeToString(id),
+		Coin:      m.coinType.CurrencyCode(),
+		Addr:      addr.String(),
+		Amount:    amount.String(),
+		Memo:      memo,
+		Status:    string(InvoicePending),
+		CreatedAt: now,
+		ExpiresAt: now.Add(expiry),
+		Paid:      iwallet.NewAmount(0).String(),
+	}
+	if err := dbtx.Save(&record); err != nil {
+		return Invoice{}, err
+	}
+	return m.invoice(&record), nil
+}
+
+// HandleTransaction records tx against any invoice it pays and resolves
+// the invoices which are now paid in full.
+func (m *InvoiceManager) HandleTransaction(tx iwallet.Transaction) error {
+	var events []interface{}
+	err := m.db.Update(func(dbtx database.Tx) error {
+		for _, to := range tx.To {
+			var records []database.InvoiceRecord
+			err := dbtx.Read().Where("coin=?", m.coinType.CurrencyCode()).Where("addr=?", to.Address.String()).Find(&records).Error
+			if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+				return err
+			}
+			for i := range records {
+				record := &records[i]
+				if containsTxid(record.Txids, tx.ID) {
+					continue
+				}
+				paid := iwallet.NewAmount(0)
+				for _, out := range tx.To {
+					if out.Address.String() == record.Addr {
+						paid = paid.Add(out.Amount)
+					}
+				}
+				total := iwallet.NewAmount(record.Paid).Add(paid)
+				record.Paid = total.String()
+				record.Txids = appendTxid(record.Txids, tx.ID)
+
+				status := InvoiceStatus(record.Status)
+				late := status == InvoiceExpired || status == InvoiceUnderpaid
+				events = append(events, &InvoicePaymentEvent{
+					ID:            record.ID,
+					TransactionID: tx.ID,
+					Amount:        paid,
+					Paid:          total,
+					Late:          late,
+				})
+				if !late {
+					if resolved := paymentStatus(total, iwallet.NewAmount(record.Amount)); resolved != status {
+						record.Status = string(resolved)
+						record.ResolvedAt = time.Now()
+						events = append(events, &InvoiceResolvedEvent{
+							ID:     record.ID,
+							Status: resolved,
+							Paid:   total,
+						})
+					}
+				}
+				if err := dbtx.Save(record); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		m.Bus.Emit(event)
+	}
+	return nil
+}
+
+// ExpireInvoices resolves the pending invoices which expired before now
+// as underpaid or expired.
+func (m *InvoiceManager) ExpireInvoices(now time.Time) error {
+	var events []interface{}
+	err := m.db.Update(func(dbtx database.Tx) error {
+		var records []database.InvoiceRecord
+		err := dbtx.Read().Where("coin=?", m.coinType.CurrencyCode()).Where("status=?", string(InvoicePending)).Find(&records).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		for i := range records {
+			record := &records[i]
+			if now.Before(record.ExpiresAt) {
+				continue
+			}
+			status := InvoiceExpired
+			if iwallet.NewAmount(record.Paid).Cmp(iwallet.NewAmount(0)) > 0 {
+				status = InvoiceUnderpaid
+			}
+			record.Status = string(status)
+			record.ResolvedAt = now
+			if err := dbtx.Save(record); err != nil {
+				return err
+			}
+			events = append(events, &InvoiceResolvedEvent{
+				ID:     record.ID,
+				Status: status,
+				Paid:   iwallet.NewAmount(record.Paid),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		m.Bus.Emit(event)
+	}
+	return nil
+}
+
+// Invoice returns the invoice with the given ID.
+func (m *InvoiceManager) Invoice(id string) (Invoice, error) {
+	var record database.InvoiceRecord
+	err := m.db.View(func(dbtx database.Tx) error {
+		return dbtx.Read().Where("coin=?", m.coinType.CurrencyCode()).Where("id=?", id).First(&record).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return Invoice{}, ErrInvoiceNotFound
+	} else if err != nil {
+		return Invoice{}, err
+	}
+	return m.invoice(&record), nil
+}
+
+// Invoices returns every invoice, newest first.
+func (m *InvoiceManager) Invoices() ([]Invoice, error) {
+	var records []database.InvoiceRecord
+	err := m.db.View(func(dbtx database.Tx) error {
+		return dbtx.Read().Where("coin=?", m.coinType.CurrencyCode()).Order("created_at desc").Find(&records).Error
+	})
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	invoices := make([]Invoice, 0, len(records))
+	for i := range records {
+		invoices = append(invoices, m.invoice(&records[i]))
+	}
+	return invoices, nil
+}
+
+func (m *InvoiceManager) invoice(record *database.InvoiceRecord) Invoice {
+	inv := Invoice{
+		ID:         record.ID,
+		Address:    iwallet.NewAddress(record.Addr, m.coinType),
+		Amount:     iwallet.NewAmount(record.Amount),
+		Memo:       record.Memo,
+		Status:     InvoiceStatus(record.Status),
+		Paid:       iwallet.NewAmount(record.Paid),
+		CreatedAt:  record.CreatedAt,
+		ExpiresAt:  record.ExpiresAt,
+		ResolvedAt: record.ResolvedAt,
+	}
+	for _, txid := range splitAddresses(record.Txids) {
+		inv.Txids = append(inv.Txids, iwallet.TransactionID(txid))
+	}
+	return inv
+}
+
+// paymentStatus returns the status of an unexpired invoice for amount
+// which has been paid total.
+func paymentStatus(total, amount iwallet.Amount) InvoiceStatus {
+	switch total.Cmp(amount) {
+	case 0:
+		return InvoicePaid
+	case 1:
+		return InvoiceOverpaid
+	}
+	return InvoicePending
+}
+
+// CreateInvoice requests a payment of amount to a new address which
+// expires after expiry. The address is never reused so every payment to it
+// is credited to the invoice. See SubscribeInvoiceEvents for payments and
+// resolution.
+func (w *WalletBase) CreateInvoice(amount iwallet.Amount, expiry time.Duration, memo string) (Invoice, error) {
+	addr, err := w.Keychain.NewAddress(false)
+	if err != nil {
+		return Invoice{}, err
+	}
+	var inv Invoice
+	err = w.DB.Update(func(dbtx database.Tx) error {
+		inv, err = w.invoices.Create(dbtx, addr, amount, expiry, memo)
+		return err
+	})
+	if err != nil {
+		return Invoice{}, err
+	}
+	w.ChainManager.AddAddressSubscription(addr)
+	return inv, nil
+}
+
+// Invoice returns the invoice with the given ID.
+func (w *WalletBase) Invoice(id string) (Invoice, error) {
+	return w.invoices.Invoice(id)
+}
+
+// Invoices returns every invoice created with CreateInvoice, newest first.
+func (w *WalletBase) Invoices() ([]Invoice, error) {
+	return w.invoices.Invoices()
+}
+
+// SubscribeInvoiceEvents returns a subscription to the
+// *InvoicePaymentEvents and *InvoiceResolvedEvents for the wallet's
+// invoices.
+func (w *WalletBase) SubscribeInvoiceEvents() (Subscription, error) {
+	return w.invoices.Bus.Subscribe([]interface{}{&InvoicePaymentEvent{}, &InvoiceResolvedEvent{}})
+}
@@ -0,0 +1,142 @@
+package base
+
+import (
+	"github.com/cpacia/multiwallet/database"
+	"github.com/cpacia/multiwallet/database/memorydb"
+	"github.com/cpacia/multiwallet/log"
+	iwallet "github.com/cpacia/wallet-interface"
+	"testing"
+	"time"
+)
+
+func TestInvoiceManager(t *testing.T) {
+	db, err := memorydb.NewMemoryDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.InitializeDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+	m := NewInvoiceManager(db, log.New("test"), iwallet.CtMock)
+
+	sub, err := m.Bus.Subscribe([]interface{}{&InvoicePaymentEvent{}, &InvoiceResolvedEvent{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	create := func(amount int64) Invoice {
+		var inv Invoice
+		err := db.Update(func(dbtx database.Tx) error {
+			inv, err = m.Create(dbtx, mockAddress(), iwallet.NewAmount(amount), time.Hour, "order")
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return inv
+	}
+	pay := func(inv Invoice, id string, amount int64) {
+		tx := iwallet.Transaction{
+			ID:   iwallet.TransactionID(id),
+			From: []iwallet.SpendInfo{{ID: mockOutpoint(), Address: mockAddress(), Amount: iwallet.NewAmount(amount + 1000)}},
+			To:   []iwallet.SpendInfo{{ID: mockOutpoint(), Address: inv.Address, Amount: iwallet.NewAmount(amount)}},
+		}
+		if err := m.HandleTransaction(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	nextEvent := func() interface{} {
+		select {
+		case e := <-sub.Out():
+			return e
+		case <-time.After(time.Second * 10):
+			t.Fatal("Timed out waiting for event")
+		}
+		return nil
+	}
+	status := func(inv Invoice) InvoiceStatus {
+		got, err := m.Invoice(inv.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got.Status
+	}
+
+	if err := db.Update(func(dbtx database.Tx) error {
+		_, err := m.Create(dbtx, mockAddress(), iwallet.NewAmount(0), time.Hour, "")
+		return err
+	}); err == nil {
+		t.Error("Expected error for a zero amount")
+	}
+
+	// Paid in two parts.
+	paid := create(10000)
+	pay(paid, "a", 4000)
+	if e := nextEvent().(*InvoicePaymentEvent); e.ID != paid.ID || e.Paid.Cmp(iwallet.NewAmount(4000)) != 0 || e.Late {
+		t.Errorf("Unexpected payment event %+v", e)
+	}
+	if s := status(paid); s != InvoicePending {
+		t.Errorf("Expected pending, got %s", s)
+	}
+	pay(paid, "b", 6000)
+	nextEvent()
+	if e := nextEvent().(*InvoiceResolvedEvent); e.ID != paid.ID || e.Status != InvoicePaid {
+		t.Errorf("Unexpected resolved event %+v", e)
+	}
+
+	// The same transaction isn't counted twice.
+	pay(paid, "b", 6000)
+	got, err := m.Invoice(paid.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Paid.Cmp(iwallet.NewAmount(10000)) != 0 || len(got.Txids) != 2 {
+		t.Errorf("Expected 10000 paid by 2 transactions, got %s by %v", got.Paid, got.Txids)
+	}
+
+	// Overpaid in one payment.
+	overpaid := create(10000)
+	pay(overpaid, "c", 12000)
+	nextEvent()
+	if e := nextEvent().(*InvoiceResolvedEvent); e.Status != InvoiceOverpaid {
+		t.Errorf("Expected overpaid, got %s", e.Status)
+	}
+
+	// Expiry resolves the rest.
+	underpaid := create(10000)
+	pay(underpaid, "d", 5000)
+	nextEvent()
+	expired := create(10000)
+	if err := m.ExpireInvoices(time.Now().Add(time.Hour * 2)); err != nil {
+		t.Fatal(err)
+	}
+	resolved := map[string]InvoiceStatus{}
+	for i := 0; i < 2; i++ {
+		e := nextEvent().(*InvoiceResolvedEvent)
+		resolved[e.ID] = e.Status
+	}
+	if resolved[underpaid.ID] != InvoiceUnderpaid || resolved[expired.ID] != InvoiceExpired {
+		t.Errorf("Unexpected resolutions %v", resolved)
+	}
+
+	// Late payments are reported but don't change the status.
+	pay(expired, "e", 10000)
+	if e := nextEvent().(*InvoicePaymentEvent); !e.Late {
+		t.Error("Expected a late payment")
+	}
+	if s := status(expired); s != InvoiceExpired {
+		t.Errorf("Expected expired, got %s", s)
+	}
+
+	invoices, err := m.Invoices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(invoices) != 4 {
+		t.Errorf("Expected 4 invoices, got %d", len(invoices))
+	}
+	if _, err := m.Invoice("unknown"); err != ErrInvoiceNotFound {
+		t.Errorf("Expected ErrInvoiceNotFound, got %v", err)
+	}
+}
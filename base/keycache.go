@@ -0,0 +1,148 @@
+package base
+
+import (
+	"container/list"
+	"fmt"
+	hd "github.com/btcsuite/btcutil/hdkeychain"
+	"reflect"
+	"sync"
+)
+
+// defaultKeyCacheSize is the number of derived keys the keychain keeps in
+// memory so spending from an address doesn't derive its key again.
+const defaultKeyCacheSize = 1000
+
+// keyPath is the position of a key in the keychain, the chain it's on and
+// its index.
+type keyPath struct {
+	change bool
+	index  uint32
+}
+
+type cachedKey struct {
+	path keyPath
+	key  *hd.ExtendedKey
+}
+
+// keyCache is a least recently used cache of keys derived by the keychain.
+// Callers zero the keys they're given so the cache only hands out copies
+// and zeroes its own keys as they're evicted or purged.
+type keyCache struct {
+	size  int
+	order *list.List
+	keys  map[keyPath]*list.Element
+	mtx   sync.Mutex
+}
+
+func newKeyCache(size int) *keyCache {
+	return &keyCache{
+		size:  size,
+		order: list.New(),
+		keys:  make(map[keyPath]*list.Element),
+	}
+}
+
+// get returns a copy of the key at the path or nil if it isn't cached.
+func (c *keyCache) get(path keyPath) *hd.ExtendedKey {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	elem, ok := c.keys[path]
+	if !ok {
+		return nil
+	}
+	c.order.MoveToFront(elem)
+	key, err := copyKey(elem.Value.(*cachedKey).key)
+	if err != nil {
+		return nil
+	}
+	return key
+}
+
+// add caches a copy of the key at the path, evicting the least recently
+// used key if the cache is full.
+func (c *keyCache) add(path keyPath, key *hd.ExtendedKey) {
+	if c.size <= 0 {
+		return
+	}
+	cp, err := copyKey(key)
+	if err != nil {
+		return
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if elem, ok := c.keys[path]; ok {
+		ZeroKey(cp)
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.keys[path] = c.order.PushFront(&cachedKey{path: path, key: cp})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		entry := c.order.Remove(oldest).(*cachedKey)
+		delete(c.keys, entry.path)
+		ZeroKey(entry.key)
+	}
+}
+
+// purge zeroes and removes every cached key.
+func (c *keyCache) purge() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for _, elem := range c.keys {
+		ZeroKey(elem.Value.(*cachedKey).key)
+	}
+	c.order.Init()
+	c.keys = make(map[keyPath]*list.Element)
+}
+
+// len returns the number of cached keys.
+func (c *keyCache) len() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.order.Len()
+}
+
+// copyKey returns a copy of the key which can be zeroed without affecting
+// the original. The bytes are copied directly rather than through the
+// key's string encoding, which would leave the private key in memory that
+// can't be zeroed. This version of hdkeychain has no accessors for the
+// version, key or chain code so they're read with reflection.
+func copyKey(key *hd.ExtendedKey) (*hd.ExtendedKey, error) {
+	v := reflect.ValueOf(key).Elem()
+	field := func(name string) ([]byte, error) {
+		f := v.FieldByName(name)
+		if !f.IsValid() || f.Kind() != reflect.Slice {
+			return nil, fmt.Errorf("extended key has no %s field", name)
+		}
+		return append([]byte(nil), f.Bytes()...), nil
+	}
+	version, err := field("version")
+	if err != nil {
+		return nil, err
+	}
+	keyBytes, err := field("key")
+	if err != nil {
+		return nil, err
+	}
+	chainCode, err := field("chainCode")
+	if err != nil {
+		ZeroBytes(keyBytes)
+		return nil, err
+	}
+	parentFP, err := field("parentFP")
+	if err != nil {
+		ZeroBytes(keyBytes)
+		return nil, err
+	}
+	childNum := v.FieldByName("childNum")
+	if !childNum.IsValid() || childNum.Kind() != reflect.Uint32 {
+		ZeroBytes(keyBytes)
+		return nil, fmt.Errorf("extended key has no childNum field")
+	}
+	return hd.NewExtendedKey(version, keyBytes, chainCode, parentFP, key.Depth(), uint32(childNum.Uint()), key.IsPrivate()), nil
+}
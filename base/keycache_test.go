@@ -0,0 +1,157 @@
+package base
+
+import (
+	hd "github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/cpacia/multiwallet/database"
+	"testing"
+)
+
+func TestKeyCache(t *testing.T) {
+	master, err := hd.NewKeyFromString("tprv8ZgxMBicQKsPeghT19pungdFLMJM2hMs3EEn5WtgobD7wuQSFQu4VNaEJXH9HS3RhhLT4wgZ3hj31m3kafuxhL9vfGTRtBVLSog4zjxW3L1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]*hd.ExtendedKey, 3)
+	for i := range keys {
+		keys[i], err = master.Child(uint32(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cache := newKeyCache(2)
+	cache.add(keyPath{index: 0}, keys[0])
+	cache.add(keyPath{index: 1}, keys[1])
+
+	key := cache.get(keyPath{index: 0})
+	if key == nil || key.String() != keys[0].String() {
+		t.Fatal("Expected the cached key")
+	}
+	ZeroKey(key)
+	if key := cache.get(keyPath{index: 0}); key == nil || key.String() != keys[0].String() {
+		t.Error("Zeroing a returned key changed the cached key")
+	}
+
+	// Key 1 is now the least recently used.
+	evicted := cache.keys[keyPath{index: 1}].Value.(*cachedKey).key
+	cache.add(keyPath{index: 2}, keys[2])
+	if cache.len() != 2 {
+		t.Errorf("Expected 2 keys, got %d", cache.len())
+	}
+	if cache.get(keyPath{index: 1}) != nil {
+		t.Error("Expected key 1 to be evicted")
+	}
+	if _, err := evicted.ECPrivKey(); err == nil {
+		t.Error("Expected the evicted key to be zeroed")
+	}
+	if _, err := keys[1].ECPrivKey(); err != nil {
+		t.Error("Evicting a key zeroed the caller's key")
+	}
+	if cache.get(keyPath{change: true, index: 0}) != nil {
+		t.Error("Expected a key on the other chain to be missing")
+	}
+
+	purged := cache.keys[keyPath{index: 2}].Value.(*cachedKey).key
+	cache.purge()
+	if _, err := purged.ECPrivKey(); err == nil {
+		t.Error("Expected the purged key to be zeroed")
+	}
+	if cache.len() != 0 || cache.get(keyPath{index: 2}) != nil {
+		t.Error("Expected the cache to be empty")
+	}
+
+	disabled := newKeyCache(0)
+	disabled.add(keyPath{index: 0}, keys[0])
+	if disabled.len() != 0 {
+		t.Error("Expected a cache of size zero to hold nothing")
+	}
+}
+
+func TestKeychain_KeyForAddressCache(t *testing.T) {
+	kc, err := setupKeychain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := kc.CurrentAddress(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var first, second *hd.ExtendedKey
+	err = kc.db.View(func(tx database.Tx) error {
+		first, err = kc.KeyForAddress(tx, addr, nil)
+		if err != nil {
+			return err
+		}
+		second, err = kc.KeyForAddress(tx, addr, nil)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kc.keys.len() != 1 {
+		t.Errorf("Expected 1 cached key, got %d", kc.keys.len())
+	}
+	if first.String() != second.String() {
+		t.Error("Expected the cached key to match the derived key")
+	}
+	ZeroKey(first)
+	ZeroKey(second)
+
+	// Locking purges the cache and the key can't be derived again.
+	kc.purgePrivateKeys()
+	if kc.keys.len() != 0 {
+		t.Error("Expected the cache to be purged")
+	}
+	err = kc.db.View(func(tx database.Tx) error {
+		_, err := kc.KeyForAddress(tx, addr, nil)
+		return err
+	})
+	if err != ErrEncryptedKeychain {
+		t.Errorf("Expected ErrEncryptedKeychain, got %v", err)
+	}
+}
+
+// setupLargeKeychain returns a keychain holding n addresses, most of them
+// on the external chain.
+func setupLargeKeychain(b *testing.B, n int) *Keychain {
+	kc, err := setupKeychain()
+	if err != nil {
+		b.Fatal(err)
+	}
+	err = kc.db.Update(func(tx database.Tx) error {
+		return kc.createNewKeys(tx, false, n-kc.index.Len())
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	return kc
+}
+
+func BenchmarkKeychain_KeyForAddress(b *testing.B) {
+	kc := setupLargeKeychain(b, 50000)
+	addrs := kc.index.Addresses()
+
+	for _, bench := range []struct {
+		name      string
+		cacheSize int
+	}{
+		{"uncached", 0},
+		{"cached", defaultKeyCacheSize},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			kc.keys = newKeyCache(bench.cacheSize)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				err := kc.db.View(func(tx database.Tx) error {
+					key, err := kc.KeyForAddress(tx, addrs[i%100], nil)
+					ZeroKey(key)
+					return err
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
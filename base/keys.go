@@ -1,6 +1,7 @@
 package base
 
 import (
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
@@ -8,6 +9,7 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"github.com/btcsuite/btcd/btcec"
 	hd "github.com/btcsuite/btcutil/hdkeychain"
 	"github.com/cpacia/multiwallet/database"
 	iwallet "github.com/cpacia/wallet-interface"
@@ -36,12 +38,20 @@ const (
 // ErrEncryptedKeychain means the keychain is encrypted.
 var ErrEncryptedKeychain = errors.New("keychain is encrypted")
 
+// ErrWatchOnlyKeychain means the keychain has no private key.
+var ErrWatchOnlyKeychain = errors.New("keychain is watch-only")
+
 // KeychainConfig holds some optional configuration options for
 // the keychain.
 type KeychainConfig struct {
 	LookaheadWindowSize int
 	ExternalOnly        bool
 	DisableMarkAsUsed   bool
+	PaymentCodeAddrFunc PubKeyAddrFunc
+	SilentPayments      bool
+	PassphrasePolicy    PassphrasePolicy
+	KeyCacheSize        int
+	ScriptFunc          ScriptFunc
 }
 
 // Apply applies the given options to this Option
@@ -57,6 +67,52 @@ func (cfg *KeychainConfig) Apply(opts ...KeychainOption) error {
 // KeychainOption is a keychain option type.
 type KeychainOption func(*KeychainConfig) error
 
+// LookaheadWindowSize sets the number of unused addresses the keychain
+// keeps derived ahead of the last used one.
+func LookaheadWindowSize(n int) KeychainOption {
+	return func(cfg *KeychainConfig) error {
+		if n <= 0 {
+			return errors.New("lookahead window must be positive")
+		}
+		cfg.LookaheadWindowSize = n
+		return nil
+	}
+}
+
+// RequirePassphrase makes the keychain refuse new passphrases which don't
+// meet the policy.
+func RequirePassphrase(policy PassphrasePolicy) KeychainOption {
+	return func(cfg *KeychainConfig) error {
+		if policy.MinScore < 0 || policy.MinScore > 4 {
+			return errors.New("passphrase score must be between 0 and 4")
+		}
+		cfg.PassphrasePolicy = policy
+		return nil
+	}
+}
+
+// KeyCacheSize sets how many derived keys the keychain keeps in memory.
+// Zero disables the cache. Cached private keys are purged when the keychain
+// locks.
+func KeyCacheSize(n int) KeychainOption {
+	return func(cfg *KeychainConfig) error {
+		if n < 0 {
+			return errors.New("key cache size can't be negative")
+		}
+		cfg.KeyCacheSize = n
+		return nil
+	}
+}
+
+// IndexScripts makes the keychain's AddressIndex look up addresses by the
+// output scripts the function returns for them.
+func IndexScripts(f ScriptFunc) KeychainOption {
+	return func(cfg *KeychainConfig) error {
+		cfg.ScriptFunc = f
+		return nil
+	}
+}
+
 // Keychain manages a Bip44 keychain for each coin.
 type Keychain struct {
 	db              database.Database
@@ -70,8 +126,31 @@ type Keychain struct {
 	externalOnly        bool
 	disableMarkAsUsed   bool
 
+	// watchOnly is set for wallets created without a private key.
+	watchOnly bool
+
+	// paymentCodePrivkey is the BIP 47 payment code key. Like the
+	// external and internal keys it's purged when the keychain locks.
+	paymentCodePrivkey *hd.ExtendedKey
+	pcAddrFunc         PubKeyAddrFunc
+
+	// silentPaymentSpendKey is the BIP 352 spend key, also purged when
+	// the keychain locks.
+	silentPaymentSpendKey *btcec.PrivateKey
+	silentPayments        bool
+
+	// passphrasePolicy is checked by SetPassphase and ChangePassphrase.
+	passphrasePolicy PassphrasePolicy
+
+	// keys caches the keys KeyForAddress derives and index maps the
+	// keychain's addresses to their key paths and scripts.
+	keys  *keyCache
+	index *AddressIndex
+
 	coinType iwallet.CoinType
 
+	lockManager *LockManager
+
 	mtx sync.RWMutex
 
 	addrFunc func(key *hd.ExtendedKey) (iwallet.Address, error)
@@ -89,7 +168,7 @@ type Keychain struct {
 // public key keys so we do not need the master private key to generate new addresses.
 // This allows us to encrypt the master private key if the user desires.
 func NewKeychain(db database.Database, coinType iwallet.CoinType, addressFunc AddrFunc, opts ...KeychainOption) (*Keychain, error) {
-	cfg := KeychainConfig{LookaheadWindowSize: defaultLookaheadWindow}
+	cfg := KeychainConfig{LookaheadWindowSize: defaultLookaheadWindow, KeyCacheSize: defaultKeyCacheSize}
 	if err := cfg.Apply(opts...); err != nil {
 		return nil, err
 	}
@@ -112,11 +191,14 @@ func NewKeychain(db database.Database, coinType iwallet.CoinType, addressFunc Ad
 		return nil, err
 	}
 
-	if !coinRecord.EncryptedMasterKey {
-		accountPrivKey, err := hd.NewKeyFromString(coinRecord.MasterPriv)
+	watchOnly := coinRecord.MasterPriv == "" && !coinRecord.EncryptedMasterKey
+	var accountPrivKey *hd.ExtendedKey
+	if !coinRecord.EncryptedMasterKey && !watchOnly {
+		accountPrivKey, err = hd.NewKeyFromString(coinRecord.MasterPriv)
 		if err != nil {
 			return nil, err
 		}
+		defer ZeroKey(accountPrivKey)
 		externalPrivkey, internalPrivkey, err = generateAccountPrivKeys(accountPrivKey)
 		if err != nil {
 			return nil, err
@@ -132,22 +214,51 @@ func NewKeychain(db database.Database, coinType iwallet.CoinType, addressFunc Ad
 		lookaheadWindowSize: cfg.LookaheadWindowSize,
 		externalOnly:        cfg.ExternalOnly,
 		disableMarkAsUsed:   cfg.DisableMarkAsUsed,
+		watchOnly:           watchOnly,
 		coinType:            coinType,
 		addrFunc:            addressFunc,
+		pcAddrFunc:          cfg.PaymentCodeAddrFunc,
+		silentPayments:      cfg.SilentPayments,
+		passphrasePolicy:    cfg.PassphrasePolicy,
+		keys:                newKeyCache(cfg.KeyCacheSize),
+		index:               newAddressIndex(coinType, cfg.ScriptFunc),
 		mtx:                 sync.RWMutex{},
 	}
+	kc.lockManager = NewLockManager(kc.purgePrivateKeys)
+	if accountPrivKey != nil {
+		err := db.Update(func(tx database.Tx) error {
+			if err := kc.setPaymentCodeKey(tx, accountPrivKey); err != nil {
+				return err
+			}
+			return kc.setSilentPaymentKeys(tx, accountPrivKey)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
 	if err := kc.ExtendKeychain(); err != nil {
 		return nil, err
 	}
+	if err := db.View(kc.SyncAddressIndex); err != nil {
+		return nil, err
+	}
 	return kc, nil
 }
 
 // SetPassphase encrypts the master private key in the database and
-// deletes the internal and external private keys from memory.
+// deletes the internal and external private keys from memory. The
+// passphrase must meet the keychain's PassphrasePolicy.
 func (kc *Keychain) SetPassphase(pw []byte) error {
 	kc.mtx.Lock()
 	defer kc.mtx.Unlock()
 
+	if kc.watchOnly {
+		return ErrWatchOnlyKeychain
+	}
+	if err := kc.passphrasePolicy.Check(pw); err != nil {
+		return err
+	}
+
 	var (
 		salt       = make([]byte, 32)
 		rounds     = defaultKdfRounds
@@ -166,6 +277,7 @@ func (kc *Keychain) SetPassphase(pw []byte) error {
 		}
 
 		plaintext := []byte(coinRecord.MasterPriv)
+		defer ZeroBytes(plaintext)
 
 		_, err = rand.Read(salt)
 		if err != nil {
@@ -195,23 +307,41 @@ func (kc *Keychain) SetPassphase(pw []byte) error {
 		coinRecord.KdfKeyLen = keyLen
 		coinRecord.Salt = salt
 
+		ZeroKey(kc.externalPrivkey)
+		ZeroKey(kc.internalPrivkey)
+		ZeroKey(kc.paymentCodePrivkey)
+		ZeroPrivKey(kc.silentPaymentSpendKey)
+		kc.keys.purge()
 		kc.externalPrivkey = nil
 		kc.internalPrivkey = nil
+		kc.paymentCodePrivkey = nil
+		kc.silentPaymentSpendKey = nil
 
 		return tx.Save(&coinRecord)
 	})
 }
 
 // ChangePassphrase will change the passphrase used to encrypt the
-// master private key.
+// master private key. The new passphrase must meet the keychain's
+// PassphrasePolicy.
 func (kc *Keychain) ChangePassphrase(old, new []byte) error {
 	kc.mtx.Lock()
 	defer kc.mtx.Unlock()
 
+	if kc.watchOnly {
+		return ErrWatchOnlyKeychain
+	}
+	if err := kc.passphrasePolicy.Check(new); err != nil {
+		return err
+	}
 	if kc.internalPrivkey != nil || kc.externalPrivkey != nil {
 		return errors.New("wallet is not encrypted")
 	}
 
+	if err := kc.lockManager.CheckAttempt(); err != nil {
+		return err
+	}
+
 	var (
 		salt       = make([]byte, 32)
 		rounds     = defaultKdfRounds
@@ -243,19 +373,24 @@ func (kc *Keychain) ChangePassphrase(old, new []byte) error {
 			return errors.New("ciphertext too short")
 		}
 		iv := ciphertext[:aes.BlockSize]
-		ciphertext = ciphertext[aes.BlockSize:]
+
+		// Decrypt into locked memory so the plaintext key is never
+		// paged out and is zeroed when we're done with it.
+		secureBuf := NewSecureBytes(ciphertext[aes.BlockSize:])
+		defer secureBuf.Destroy()
 
 		stream := cipher.NewCFBDecrypter(block, iv)
 
 		// XORKeyStream can work in-place if the two arguments are the same.
-		stream.XORKeyStream(ciphertext, ciphertext)
-
-		plaintext := ciphertext
+		plaintext := secureBuf.Bytes()
+		stream.XORKeyStream(plaintext, plaintext)
 
-		_, err = hd.NewKeyFromString(string(plaintext))
+		key, err := newKeyFromBytes(plaintext)
 		if err != nil {
+			kc.lockManager.AttemptFailed()
 			return errors.New("invalid passphrase")
 		}
+		ZeroKey(key)
 
 		_, err = rand.Read(salt)
 		if err != nil {
@@ -296,10 +431,17 @@ func (kc *Keychain) RemovePassphrase(pw []byte) error {
 	kc.mtx.Lock()
 	defer kc.mtx.Unlock()
 
+	if kc.watchOnly {
+		return ErrWatchOnlyKeychain
+	}
 	if kc.internalPrivkey != nil || kc.externalPrivkey != nil {
 		return errors.New("wallet is not encrypted")
 	}
 
+	if err := kc.lockManager.CheckAttempt(); err != nil {
+		return err
+	}
+
 	return kc.db.Update(func(tx database.Tx) error {
 		var coinRecord database.CoinRecord
 		err := tx.Read().Where("coin=?", kc.coinType.CurrencyCode()).Find(&coinRecord).Error
@@ -325,40 +467,65 @@ func (kc *Keychain) RemovePassphrase(pw []byte) error {
 			return errors.New("ciphertext too short")
 		}
 		iv := ciphertext[:aes.BlockSize]
-		ciphertext = ciphertext[aes.BlockSize:]
+
+		secureBuf := NewSecureBytes(ciphertext[aes.BlockSize:])
+		defer secureBuf.Destroy()
 
 		stream := cipher.NewCFBDecrypter(block, iv)
 
 		// XORKeyStream can work in-place if the two arguments are the same.
-		stream.XORKeyStream(ciphertext, ciphertext)
+		plaintext := secureBuf.Bytes()
+		stream.XORKeyStream(plaintext, plaintext)
 
-		key, err := hd.NewKeyFromString(string(ciphertext))
+		key, err := newKeyFromBytes(plaintext)
 		if err != nil {
+			kc.lockManager.AttemptFailed()
 			return errors.New("invalid passphrase")
 		}
 
 		kc.externalPrivkey, kc.internalPrivkey, err = generateAccountPrivKeys(key)
+		if err != nil {
+			ZeroKey(key)
+			return err
+		}
+		err = kc.setPaymentCodeKey(tx, key)
+		if err == nil {
+			err = kc.setSilentPaymentKeys(tx, key)
+		}
+		ZeroKey(key)
 		if err != nil {
 			return err
 		}
 
-		coinRecord.MasterPriv = string(ciphertext)
+		coinRecord.MasterPriv = string(plaintext)
 		coinRecord.EncryptedMasterKey = false
 
-		return tx.Save(&coinRecord)
+		if err := tx.Save(&coinRecord); err != nil {
+			return err
+		}
+		return kc.extendPaymentCodes(tx)
 	})
 }
 
 // Unlock will dcrypt the master key and store the external and internal
-// private keys in memory for howLong.
+// private keys in memory for howLong. Failed attempts are throttled by
+// the LockManager so repeated calls with a wrong passphrase will return
+// ErrUnlockThrottled until the backoff expires.
 func (kc *Keychain) Unlock(pw []byte, howLong time.Duration) error {
 	kc.mtx.Lock()
 	defer kc.mtx.Unlock()
 
+	if kc.watchOnly {
+		return ErrWatchOnlyKeychain
+	}
 	if kc.internalPrivkey != nil || kc.externalPrivkey != nil {
 		return errors.New("wallet is not encrypted")
 	}
 
+	if err := kc.lockManager.CheckAttempt(); err != nil {
+		return err
+	}
+
 	var coinRecord database.CoinRecord
 	err := kc.db.View(func(tx database.Tx) error {
 		return tx.Read().Where("coin=?", kc.coinType.CurrencyCode()).Find(&coinRecord).Error
@@ -385,55 +552,210 @@ func (kc *Keychain) Unlock(pw []byte, howLong time.Duration) error {
 		return errors.New("ciphertext too short")
 	}
 	iv := ciphertext[:aes.BlockSize]
-	ciphertext = ciphertext[aes.BlockSize:]
+
+	// Decrypt into locked memory so the plaintext key is never
+	// paged out and is zeroed when we're done with it.
+	secureBuf := NewSecureBytes(ciphertext[aes.BlockSize:])
+	defer secureBuf.Destroy()
 
 	stream := cipher.NewCFBDecrypter(block, iv)
 
 	// XORKeyStream can work in-place if the two arguments are the same.
-	stream.XORKeyStream(ciphertext, ciphertext)
+	plaintext := secureBuf.Bytes()
+	stream.XORKeyStream(plaintext, plaintext)
 
-	key, err := hd.NewKeyFromString(string(ciphertext))
+	key, err := newKeyFromBytes(plaintext)
 	if err != nil {
+		kc.lockManager.AttemptFailed()
 		return err
 	}
 
 	kc.externalPrivkey, kc.internalPrivkey, err = generateAccountPrivKeys(key)
+	if err != nil {
+		ZeroKey(key)
+		return err
+	}
+	// Addresses of incoming payment codes can only be derived with the
+	// private key so any which were used while locked are topped up now.
+	err = kc.db.Update(func(tx database.Tx) error {
+		if err := kc.setPaymentCodeKey(tx, key); err != nil {
+			return err
+		}
+		if err := kc.setSilentPaymentKeys(tx, key); err != nil {
+			return err
+		}
+		return kc.extendPaymentCodes(tx)
+	})
+	ZeroKey(key)
 	if err != nil {
 		return err
 	}
 
-	time.AfterFunc(howLong, func() {
-		kc.mtx.Lock()
-		defer kc.mtx.Unlock()
+	kc.lockManager.Unlocked(howLong)
+	return nil
+}
 
-		kc.externalPrivkey = nil
-		kc.internalPrivkey = nil
+// VerifyPassphrase returns an error if pw isn't the passphrase the master
+// key is encrypted with. It doesn't unlock the keychain and works whether or
+// not it's unlocked. Like Unlock failed attempts are throttled.
+func (kc *Keychain) VerifyPassphrase(pw []byte) error {
+	if kc.IsWatchOnly() {
+		return ErrWatchOnlyKeychain
+	}
+	if err := kc.lockManager.CheckAttempt(); err != nil {
+		return err
+	}
+
+	var coinRecord database.CoinRecord
+	err := kc.db.View(func(tx database.Tx) error {
+		return tx.Read().Where("coin=?", kc.coinType.CurrencyCode()).Find(&coinRecord).Error
 	})
+	if err != nil {
+		return err
+	}
+	if !coinRecord.EncryptedMasterKey {
+		return errors.New("wallet is not encrypted")
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(coinRecord.MasterPriv)
+	if err != nil {
+		return err
+	}
+	if len(ciphertext) < aes.BlockSize {
+		return errors.New("ciphertext too short")
+	}
+
+	dk := pbkdf2.Key(pw, coinRecord.Salt, coinRecord.KdfRounds, coinRecord.KdfKeyLen, sha512.New)
+	block, err := aes.NewCipher(dk)
+	if err != nil {
+		return err
+	}
+
+	secureBuf := NewSecureBytes(ciphertext[aes.BlockSize:])
+	defer secureBuf.Destroy()
+
+	plaintext := secureBuf.Bytes()
+	cipher.NewCFBDecrypter(block, ciphertext[:aes.BlockSize]).XORKeyStream(plaintext, plaintext)
+
+	key, err := newKeyFromBytes(plaintext)
+	if err != nil {
+		kc.lockManager.AttemptFailed()
+		return err
+	}
+	ZeroKey(key)
 	return nil
 }
 
+// Lock immediately purges the external and internal private keys from
+// memory. The keychain must be encrypted for this to have any effect.
+func (kc *Keychain) Lock() error {
+	var coinRecord database.CoinRecord
+	err := kc.db.View(func(tx database.Tx) error {
+		return tx.Read().Where("coin=?", kc.coinType.CurrencyCode()).Find(&coinRecord).Error
+	})
+	if err != nil {
+		return err
+	}
+	if !coinRecord.EncryptedMasterKey {
+		return errors.New("wallet is not encrypted")
+	}
+	kc.lockManager.Lock()
+	return nil
+}
+
+// TimeUntilLock returns the amount of time remaining before an unlocked
+// keychain is locked again. Zero is returned if the keychain is locked.
+func (kc *Keychain) TimeUntilLock() time.Duration {
+	return kc.lockManager.TimeUntilLock()
+}
+
+// purgePrivateKeys zeroes the external and internal private keys before
+// dropping them so the key material doesn't linger on the heap.
+func (kc *Keychain) purgePrivateKeys() {
+	kc.mtx.Lock()
+	defer kc.mtx.Unlock()
+
+	ZeroKey(kc.externalPrivkey)
+	ZeroKey(kc.internalPrivkey)
+	ZeroKey(kc.paymentCodePrivkey)
+	ZeroPrivKey(kc.silentPaymentSpendKey)
+	kc.keys.purge()
+	kc.externalPrivkey = nil
+	kc.internalPrivkey = nil
+	kc.paymentCodePrivkey = nil
+	kc.silentPaymentSpendKey = nil
+}
+
 // IsEncrypted returns whether or not this keychain is encrypted.
 func (kc *Keychain) IsEncrypted() bool {
 	kc.mtx.RLock()
 	defer kc.mtx.RUnlock()
 
+	if kc.watchOnly {
+		return false
+	}
 	return kc.internalPrivkey == nil || kc.externalPrivkey == nil
 }
 
-// GetAddresses returns all addresses in the wallet.
+// IsWatchOnly returns whether the keychain was created without a private
+// key.
+func (kc *Keychain) IsWatchOnly() bool {
+	return kc.watchOnly
+}
+
+// HasPassphrase returns whether the master key is encrypted. Unlike
+// IsEncrypted it's true while the keychain is unlocked.
+func (kc *Keychain) HasPassphrase() (bool, error) {
+	var coinRecord database.CoinRecord
+	err := kc.db.View(func(tx database.Tx) error {
+		return tx.Read().Where("coin=?", kc.coinType.CurrencyCode()).Find(&coinRecord).Error
+	})
+	if err != nil {
+		return false, err
+	}
+	return coinRecord.EncryptedMasterKey, nil
+}
+
+// GetAddresses returns all addresses in the wallet, including those derived
+// for incoming payment codes and those paid by silent payments.
 func (kc *Keychain) GetAddresses() ([]iwallet.Address, error) {
-	var records []database.AddressRecord
+	var addrs []iwallet.Address
 	err := kc.db.Update(func(tx database.Tx) error {
-		return tx.Read().Where("coin=?", kc.coinType.CurrencyCode()).Find(&records).Error
+		var err error
+		addrs, err = kc.allAddresses(tx)
+		return err
 	})
-	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+	return addrs, err
+}
+
+// allAddresses syncs the address index and returns its addresses along
+// with those of payment codes and silent payments.
+func (kc *Keychain) allAddresses(dbtx database.Tx) ([]iwallet.Address, error) {
+	if err := kc.SyncAddressIndex(dbtx); err != nil {
 		return nil, err
 	}
-	var addrs []iwallet.Address
-	for _, rec := range records {
-		addrs = append(addrs, rec.Address())
+	pcAddrs, err := kc.paymentCodeAddresses(dbtx)
+	if err != nil {
+		return nil, err
 	}
-	return addrs, nil
+	spAddrs, err := kc.silentPaymentAddresses(dbtx)
+	if err != nil {
+		return nil, err
+	}
+	addrs := append(kc.index.Addresses(), pcAddrs...)
+	return append(addrs, spAddrs...), nil
+}
+
+// AddressIndex returns the keychain's index of its addresses. It's only
+// as current as the last sync, see SyncAddressIndex.
+func (kc *Keychain) AddressIndex() *AddressIndex {
+	return kc.index
+}
+
+// SyncAddressIndex adds the address records saved since the index was last
+// synced to it.
+func (kc *Keychain) SyncAddressIndex(dbtx database.Tx) error {
+	return kc.index.sync(dbtx)
 }
 
 // CurrentAddress returns the first unused address.
@@ -489,11 +811,12 @@ func (kc *Keychain) NewAddress(change bool) (iwallet.Address, error) {
 		}
 
 		newRecord := &database.AddressRecord{
-			Addr:     address.String(),
-			KeyIndex: index,
-			Change:   false,
-			Used:     false,
-			Coin:     kc.coinType.CurrencyCode(),
+			Addr:      address.String(),
+			KeyIndex:  index,
+			Change:    false,
+			Used:      false,
+			Coin:      kc.coinType.CurrencyCode(),
+			CreatedAt: time.Now(),
 		}
 		if err := kc.extendKeychain(tx); err != nil {
 			return err
@@ -514,27 +837,221 @@ func (kc *Keychain) HasKey(addr iwallet.Address) (bool, error) {
 			return err
 		} else if err == nil {
 			has = true
+			return nil
 		}
+		var pcRecord database.PaymentCodeAddressRecord
+		err = tx.Read().Where("coin=?", kc.coinType.CurrencyCode()).Where("addr=?", addr.String()).First(&pcRecord).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		} else if err == nil {
+			has = true
+			return nil
+		}
+		var spRecord database.SilentPaymentOutputRecord
+		err = tx.Read().Where("coin=?", kc.coinType.CurrencyCode()).Where("addr=?", addr.String()).First(&spRecord).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		has = err == nil
 		return nil
 	})
 	return has, err
 }
 
+// GetAddressesContext is like GetAddresses but reads through the
+// database's Store so the query is abandoned when ctx is done.
+func (kc *Keychain) GetAddressesContext(ctx context.Context) ([]iwallet.Address, error) {
+	records, err := kc.db.Store().ListAddresses(ctx, kc.coinType)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []iwallet.Address
+	for _, rec := range records {
+		addrs = append(addrs, rec.Address())
+	}
+	return addrs, nil
+}
+
+// HasKeyContext is like HasKey but reads through the database's Store so
+// the query is abandoned when ctx is done.
+func (kc *Keychain) HasKeyContext(ctx context.Context, addr iwallet.Address) (bool, error) {
+	_, err := kc.db.Store().GetAddress(ctx, iwallet.NewAddress(addr.String(), kc.coinType))
+	if errors.Is(err, database.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// AddressMetadata is an address in the keychain along with any user
+// supplied metadata.
+type AddressMetadata struct {
+	Address   iwallet.Address
+	KeyIndex  int
+	Change    bool
+	Used      bool
+	Label     string
+	Notes     string
+	CreatedAt time.Time
+}
+
+// SetAddressLabel attaches a label and notes to the given address. This
+// is typically used by merchants to tag a receive address with an order ID.
+func (kc *Keychain) SetAddressLabel(addr iwallet.Address, label, notes string) error {
+	return kc.db.Update(func(tx database.Tx) error {
+		var record database.AddressRecord
+		err := tx.Read().Where("coin=?", kc.coinType.CurrencyCode()).Where("addr=?", addr.String()).First(&record).Error
+		if err != nil {
+			return err
+		}
+		record.Label = label
+		record.Notes = notes
+		return tx.Save(&record)
+	})
+}
+
+// GetAddressesWithMetadata returns all addresses in the wallet along with
+// their labels and notes.
+func (kc *Keychain) GetAddressesWithMetadata() ([]AddressMetadata, error) {
+	var records []database.AddressRecord
+	err := kc.db.View(func(tx database.Tx) error {
+		return tx.Read().Where("coin=?", kc.coinType.CurrencyCode()).Order("change asc").Order("key_index asc").Find(&records).Error
+	})
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	metadata := make([]AddressMetadata, 0, len(records))
+	for _, rec := range records {
+		metadata = append(metadata, AddressMetadata{
+			Address:   rec.Address(),
+			KeyIndex:  rec.KeyIndex,
+			Change:    rec.Change,
+			Used:      rec.Used,
+			Label:     rec.Label,
+			Notes:     rec.Notes,
+			CreatedAt: rec.CreatedAt,
+		})
+	}
+	return metadata, nil
+}
+
+// addressLabels returns a map of address to label for all labeled
+// addresses in the wallet.
+func (kc *Keychain) addressLabels(dbtx database.Tx) (map[iwallet.Address]string, error) {
+	var records []database.AddressRecord
+	err := dbtx.Read().Where("coin=?", kc.coinType.CurrencyCode()).Where("label <> ?", "").Find(&records).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	labels := make(map[iwallet.Address]string, len(records))
+	for _, rec := range records {
+		labels[rec.Address()] = rec.Label
+	}
+	return labels, nil
+}
+
+// DerivationMismatch describes a stored address which does not match the
+// address derived from the account public key at the same index.
+type DerivationMismatch struct {
+	KeyIndex int
+	Change   bool
+	Expected iwallet.Address
+	Stored   iwallet.Address
+	Err      error
+}
+
+// VerifyDerivation re-derives every stored address from the account public
+// key and returns any that do not match. A non-empty result indicates either
+// database corruption or that the address function has changed between
+// releases. In either case the affected addresses should not be handed out
+// as we may not be able to derive the keys to spend from them.
+func (kc *Keychain) VerifyDerivation() ([]DerivationMismatch, error) {
+	var records []database.AddressRecord
+	err := kc.db.View(func(tx database.Tx) error {
+		return tx.Read().Where("coin=?", kc.coinType.CurrencyCode()).Order("change asc").Order("key_index asc").Find(&records).Error
+	})
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	var mismatches []DerivationMismatch
+	for _, rec := range records {
+		var key *hd.ExtendedKey
+		if rec.Change {
+			key, err = kc.internalPubkey.Child(uint32(rec.KeyIndex))
+		} else {
+			key, err = kc.externalPubkey.Child(uint32(rec.KeyIndex))
+		}
+		if err != nil {
+			mismatches = append(mismatches, DerivationMismatch{
+				KeyIndex: rec.KeyIndex,
+				Change:   rec.Change,
+				Stored:   rec.Address(),
+				Err:      err,
+			})
+			continue
+		}
+		expected, err := kc.addrFunc(key)
+		if err != nil {
+			mismatches = append(mismatches, DerivationMismatch{
+				KeyIndex: rec.KeyIndex,
+				Change:   rec.Change,
+				Stored:   rec.Address(),
+				Err:      err,
+			})
+			continue
+		}
+		if expected.String() != rec.Addr {
+			mismatches = append(mismatches, DerivationMismatch{
+				KeyIndex: rec.KeyIndex,
+				Change:   rec.Change,
+				Expected: expected,
+				Stored:   rec.Address(),
+			})
+		}
+	}
+	return mismatches, nil
+}
+
 // KeyForAddress returns the private key for the given address. If this wallet is not
 // encrypted then accountPrivKey may be nil and it will generate and return the key.
 // However, if the wallet is encrypted a unencrypted accountPrivKey must be passed in
-// so we can derive the correct child key.
+// so we can derive the correct child key. Watch-only keychains return the
+// public key instead. Addresses of incoming payment codes and silent
+// payments have keys without a chain code.
 func (kc *Keychain) KeyForAddress(dbtx database.Tx, addr iwallet.Address, accountPrivKey *hd.ExtendedKey) (*hd.ExtendedKey, error) {
 	kc.mtx.Lock()
 	defer kc.mtx.Unlock()
 
-	var record database.AddressRecord
-	err := dbtx.Read().Where("coin=?", kc.coinType.CurrencyCode()).Where("addr=?", addr.String()).First(&record).Error
-	if err != nil {
-		return nil, err
+	path, ok := kc.index.path(addr.String())
+	if !ok {
+		var record database.AddressRecord
+		err := dbtx.Read().Where("coin=?", kc.coinType.CurrencyCode()).Where("addr=?", addr.String()).First(&record).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) && kc.silentPayments {
+			key, spErr := kc.silentPaymentKeyForAddress(dbtx, addr, accountPrivKey)
+			if !errors.Is(spErr, gorm.ErrRecordNotFound) {
+				return key, spErr
+			}
+		}
+		if errors.Is(err, gorm.ErrRecordNotFound) && kc.pcAddrFunc != nil {
+			return kc.paymentCodeKeyForAddress(dbtx, addr, accountPrivKey)
+		} else if err != nil {
+			return nil, err
+		}
+		path = keyPath{change: record.Change, index: uint32(record.KeyIndex)}
 	}
+
+	// Only keys derived from the keychain's own keys are cached. Those
+	// from an accountPrivKey passed in to a locked keychain aren't kept.
+	cacheable := kc.watchOnly || (kc.externalPrivkey != nil && kc.internalPrivkey != nil)
+	if cacheable {
+		if key := kc.keys.get(path); key != nil {
+			return key, nil
+		}
+	}
+
 	var (
 		key             *hd.ExtendedKey
+		err             error
 		externalPrivkey = kc.externalPrivkey
 		internalPrivkey = kc.internalPrivkey
 	)
@@ -544,20 +1061,33 @@ func (kc *Keychain) KeyForAddress(dbtx database.Tx, addr iwallet.Address, accoun
 		if err != nil {
 			return nil, err
 		}
+		// These were derived just for this call so make sure they
+		// don't outlive it.
+		defer ZeroKey(externalPrivkey)
+		defer ZeroKey(internalPrivkey)
+	}
+	if kc.watchOnly {
+		externalPrivkey, internalPrivkey = kc.externalPubkey, kc.internalPubkey
 	}
 
-	if record.Change {
+	if path.change {
 		if internalPrivkey == nil {
 			return nil, ErrEncryptedKeychain
 		}
-		key, err = internalPrivkey.Child(uint32(record.KeyIndex))
+		key, err = internalPrivkey.Child(path.index)
 	} else {
 		if externalPrivkey == nil {
 			return nil, ErrEncryptedKeychain
 		}
-		key, err = externalPrivkey.Child(uint32(record.KeyIndex))
+		key, err = externalPrivkey.Child(path.index)
 	}
-	return key, err
+	if err != nil {
+		return nil, err
+	}
+	if cacheable {
+		kc.keys.add(path, key)
+	}
+	return key, nil
 }
 
 // MarkAddressAsUsed marks the given address as used and extends the keychain.
@@ -567,7 +1097,15 @@ func (kc *Keychain) MarkAddressAsUsed(dbtx database.Tx, addr iwallet.Address) er
 	}
 	var record database.AddressRecord
 	err := dbtx.Read().Where("coin=?", kc.coinType.CurrencyCode()).Where("addr=?", addr.String()).First(&record).Error
-	if err != nil {
+	if errors.Is(err, gorm.ErrRecordNotFound) && kc.silentPayments {
+		spErr := kc.markSilentPaymentAddressUsed(dbtx, addr)
+		if !errors.Is(spErr, gorm.ErrRecordNotFound) {
+			return spErr
+		}
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) && kc.pcAddrFunc != nil {
+		return kc.markPaymentCodeAddressUsed(dbtx, addr)
+	} else if err != nil {
 		return err
 	}
 	record.Used = true
@@ -617,8 +1155,8 @@ func (kc *Keychain) extendKeychain(tx database.Tx) error {
 
 func (kc *Keychain) createNewKeys(dbtx database.Tx, change bool, numKeys int) error {
 	var (
-		record        database.AddressRecord
-		generatedKeys = 0
+		record     database.AddressRecord
+		newRecords = make([]database.AddressRecord, 0, numKeys)
 	)
 	err := dbtx.Read().Order("key_index desc").Where("coin=?", kc.coinType.CurrencyCode()).Where("change=?", change).First(&record).Error
 	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
@@ -628,7 +1166,7 @@ func (kc *Keychain) createNewKeys(dbtx database.Tx, change bool, numKeys int) er
 	if errors.Is(err, gorm.ErrRecordNotFound) {
 		nextIndex = 0
 	}
-	for generatedKeys < numKeys {
+	for len(newRecords) < numKeys {
 		// There is a small possibility bip32 keys can be invalid. The procedure in such cases
 		// is to discard the key and derive the next one. This loop will continue until a valid key
 		// is derived.
@@ -648,21 +1186,41 @@ func (kc *Keychain) createNewKeys(dbtx database.Tx, change bool, numKeys int) er
 			return err
 		}
 
-		newRecord := &database.AddressRecord{
-			Addr:     addr.String(),
-			KeyIndex: nextIndex,
-			Change:   change,
-			Used:     false,
-			Coin:     kc.coinType.CurrencyCode(),
-		}
+		newRecords = append(newRecords, database.AddressRecord{
+			Addr:      addr.String(),
+			KeyIndex:  nextIndex,
+			Change:    change,
+			Used:      false,
+			Coin:      kc.coinType.CurrencyCode(),
+			CreatedAt: time.Now(),
+		})
+		nextIndex++
+	}
+	if err := dbtx.SaveAll(newRecords); err != nil {
+		return err
+	}
+	return kc.index.sync(dbtx)
+}
 
-		if err := dbtx.Save(&newRecord); err != nil {
+// chainAddresses returns the address records for either the internal or
+// external chain ordered by key index. If fewer than n records exist new
+// keys will be generated so that at least n are returned.
+func (kc *Keychain) chainAddresses(change bool, n int) ([]database.AddressRecord, error) {
+	var records []database.AddressRecord
+	err := kc.db.Update(func(tx database.Tx) error {
+		err := tx.Read().Order("key_index asc").Where("coin=?", kc.coinType.CurrencyCode()).Where("change=?", change).Find(&records).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
 			return err
 		}
-		generatedKeys++
-		nextIndex++
-	}
-	return nil
+		if len(records) >= n {
+			return nil
+		}
+		if err := kc.createNewKeys(tx, change, n-len(records)); err != nil {
+			return err
+		}
+		return tx.Read().Order("key_index asc").Where("coin=?", kc.coinType.CurrencyCode()).Where("change=?", change).Find(&records).Error
+	})
+	return records, err
 }
 
 func (kc *Keychain) getLookaheadWindows(dbtx database.Tx) (internalUnused, externalUnused int, err error) {
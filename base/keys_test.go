@@ -3,17 +3,18 @@ package base
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	hd "github.com/btcsuite/btcutil/hdkeychain"
 	"github.com/cpacia/multiwallet/database"
-	"github.com/cpacia/multiwallet/database/sqlitedb"
+	"github.com/cpacia/multiwallet/database/memorydb"
 	iwallet "github.com/cpacia/wallet-interface"
 	"strings"
 	"testing"
 	"time"
 )
 
-func setupKeychain() (*Keychain, error) {
-	db, err := sqlitedb.NewMemoryDB()
+func setupKeychain(opts ...KeychainOption) (*Keychain, error) {
+	db, err := memorydb.NewMemoryDB()
 	if err != nil {
 		return nil, err
 	}
@@ -47,7 +48,7 @@ func setupKeychain() (*Keychain, error) {
 		return nil, err
 	}
 
-	return NewKeychain(db, iwallet.CtMock, newTestAddress)
+	return NewKeychain(db, iwallet.CtMock, newTestAddress, opts...)
 }
 
 func newTestAddress(key *hd.ExtendedKey) (iwallet.Address, error) {
@@ -109,10 +110,19 @@ func TestKeychain_EncryptDecrypt(t *testing.T) {
 		t.Errorf("Expected ErrEncryptedKeychain, got %s", err)
 	}
 
+	clock := newTestClock()
+	keychain.lockManager.now = clock.Now
+
 	if err := keychain.Unlock([]byte("wrong password"), time.Second); err == nil {
 		t.Errorf("Expected decryption error got nil")
 	}
 
+	if err := keychain.Unlock(pw, time.Second); !errors.Is(err, ErrUnlockThrottled) {
+		t.Errorf("Expected ErrUnlockThrottled, got %v", err)
+	}
+
+	clock.Advance(defaultUnlockBackoff)
+
 	if err := keychain.Unlock(pw, time.Millisecond); err != nil {
 		t.Fatal(err)
 	}
@@ -343,3 +353,109 @@ func TestKeychain_MarkAddressAsUsed(t *testing.T) {
 		t.Errorf("Expected 1 used got %d", numUsed)
 	}
 }
+
+func TestKeychain_SetAddressLabel(t *testing.T) {
+	keychain, err := setupKeychain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs, err := keychain.GetAddresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := keychain.SetAddressLabel(addrs[0], "order-1234", "first order"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := keychain.SetAddressLabel(iwallet.NewAddress("abc", iwallet.CtMock), "label", ""); err == nil {
+		t.Error("Expected error labeling unknown address")
+	}
+
+	metadata, err := keychain.GetAddressesWithMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metadata) != len(addrs) {
+		t.Fatalf("Expected %d addresses got %d", len(addrs), len(metadata))
+	}
+
+	found := false
+	for _, m := range metadata {
+		if m.CreatedAt.IsZero() {
+			t.Errorf("Address %s missing created at", m.Address)
+		}
+		if m.Address == addrs[0] {
+			found = true
+			if m.Label != "order-1234" {
+				t.Errorf("Expected label order-1234 got %s", m.Label)
+			}
+			if m.Notes != "first order" {
+				t.Errorf("Expected notes 'first order' got %s", m.Notes)
+			}
+		} else if m.Label != "" {
+			t.Errorf("Expected empty label for %s got %s", m.Address, m.Label)
+		}
+	}
+	if !found {
+		t.Error("Labeled address not found")
+	}
+}
+
+func TestKeychain_VerifyDerivation(t *testing.T) {
+	kc, err := setupKeychain()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mismatches, err := kc.VerifyDerivation()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatches) != 0 {
+		t.Fatalf("Expected no mismatches got %d", len(mismatches))
+	}
+
+	addr, err := kc.CurrentAddress(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = kc.db.Update(func(tx database.Tx) error {
+		return tx.Update("addr", "corrupted", map[string]interface{}{"addr = ?": addr.String()}, &database.AddressRecord{})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mismatches, err = kc.VerifyDerivation()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatches) != 1 {
+		t.Fatalf("Expected 1 mismatch got %d", len(mismatches))
+	}
+	if mismatches[0].Expected != addr {
+		t.Errorf("Expected address %s got %s", addr, mismatches[0].Expected)
+	}
+	if mismatches[0].Stored.String() != "corrupted" {
+		t.Errorf("Expected stored address corrupted got %s", mismatches[0].Stored)
+	}
+}
+
+func BenchmarkKeychain_createNewKeys(b *testing.B) {
+	kc, err := setupKeychain()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := kc.db.Update(func(tx database.Tx) error {
+			return kc.createNewKeys(tx, false, 1000)
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
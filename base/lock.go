@@ -0,0 +1,136 @@
+package base
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultUnlockBackoff is the amount of time a caller must wait
+	// after the first failed passphrase attempt. Each subsequent failure
+	// doubles the wait.
+	defaultUnlockBackoff = time.Second
+
+	// maxUnlockBackoff caps the amount of time a caller must wait between
+	// passphrase attempts.
+	maxUnlockBackoff = time.Minute * 10
+)
+
+// ErrUnlockThrottled means a passphrase attempt was made before the backoff
+// from a previous failed attempt expired.
+var ErrUnlockThrottled = errors.New("too many failed passphrase attempts")
+
+// LockManager tracks how long the private keys should remain unlocked and
+// throttles repeated passphrase attempts with an exponential backoff so that
+// the passphrase cannot be brute forced through the Unlock API.
+type LockManager struct {
+	lockFunc func()
+
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+
+	// now returns the time used to enforce the attempt backoff. Tests
+	// replace it so they don't have to wait for the backoff to expire.
+	now func() time.Time
+
+	failedAttempts int
+	nextAttempt    time.Time
+	lockAt         time.Time
+	timer          *time.Timer
+
+	mtx sync.Mutex
+}
+
+// NewLockManager returns a new LockManager. The lockFunc will be called
+// whenever the unlock period expires or Lock is called and should purge
+// the private keys from memory.
+func NewLockManager(lockFunc func()) *LockManager {
+	return &LockManager{
+		lockFunc:       lockFunc,
+		initialBackoff: defaultUnlockBackoff,
+		maxBackoff:     maxUnlockBackoff,
+		now:            time.Now,
+		mtx:            sync.Mutex{},
+	}
+}
+
+// CheckAttempt returns ErrUnlockThrottled if a passphrase attempt is not
+// permitted yet.
+func (lm *LockManager) CheckAttempt() error {
+	lm.mtx.Lock()
+	defer lm.mtx.Unlock()
+
+	if wait := lm.nextAttempt.Sub(lm.now()); wait > 0 {
+		return fmt.Errorf("%w: retry in %s", ErrUnlockThrottled, wait.Round(time.Millisecond))
+	}
+	return nil
+}
+
+// AttemptFailed records a failed passphrase attempt and extends the backoff.
+func (lm *LockManager) AttemptFailed() {
+	lm.mtx.Lock()
+	defer lm.mtx.Unlock()
+
+	backoff := lm.initialBackoff
+	for i := 0; i < lm.failedAttempts && backoff < lm.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > lm.maxBackoff {
+		backoff = lm.maxBackoff
+	}
+	lm.failedAttempts++
+	lm.nextAttempt = lm.now().Add(backoff)
+}
+
+// Unlocked resets the backoff and schedules the keys to be locked again
+// after howLong.
+func (lm *LockManager) Unlocked(howLong time.Duration) {
+	lm.mtx.Lock()
+	defer lm.mtx.Unlock()
+
+	lm.failedAttempts = 0
+	lm.nextAttempt = time.Time{}
+
+	if lm.timer != nil {
+		lm.timer.Stop()
+	}
+	lm.lockAt = time.Now().Add(howLong)
+	lm.timer = time.AfterFunc(howLong, lm.Lock)
+}
+
+// Lock immediately purges the keys from memory and cancels any pending
+// timer.
+func (lm *LockManager) Lock() {
+	lm.mtx.Lock()
+	if lm.timer != nil {
+		lm.timer.Stop()
+		lm.timer = nil
+	}
+	lm.lockAt = time.Time{}
+	lm.mtx.Unlock()
+
+	// The lockFunc is called without holding our lock as it will
+	// most likely need to acquire the keychain lock. Holding both
+	// could deadlock with a concurrent Unlock.
+	lm.lockFunc()
+}
+
+// IsLocked returns whether the unlock period has expired.
+func (lm *LockManager) IsLocked() bool {
+	return lm.TimeUntilLock() == 0
+}
+
+// TimeUntilLock returns the amount of time remaining before the keys are
+// locked again. Zero is returned if the keys are already locked.
+func (lm *LockManager) TimeUntilLock() time.Duration {
+	lm.mtx.Lock()
+	defer lm.mtx.Unlock()
+
+	remaining := time.Until(lm.lockAt)
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
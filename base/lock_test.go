@@ -0,0 +1,154 @@
+package base
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testClock is a manually advanced clock for the attempt backoff.
+type testClock struct {
+	now time.Time
+	mtx sync.Mutex
+}
+
+func newTestClock() *testClock {
+	return &testClock{now: time.Now()}
+}
+
+func (c *testClock) Now() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestLockManager_Backoff(t *testing.T) {
+	clock := newTestClock()
+	lm := NewLockManager(func() {})
+	lm.now = clock.Now
+
+	if err := lm.CheckAttempt(); err != nil {
+		t.Fatalf("Expected nil, got %s", err)
+	}
+
+	lm.AttemptFailed()
+	if err := lm.CheckAttempt(); !errors.Is(err, ErrUnlockThrottled) {
+		t.Fatalf("Expected ErrUnlockThrottled, got %v", err)
+	}
+
+	clock.Advance(defaultUnlockBackoff)
+	if err := lm.CheckAttempt(); err != nil {
+		t.Fatalf("Expected nil, got %s", err)
+	}
+
+	// The second failure should double the backoff.
+	lm.AttemptFailed()
+	clock.Advance(defaultUnlockBackoff)
+	if err := lm.CheckAttempt(); !errors.Is(err, ErrUnlockThrottled) {
+		t.Fatalf("Expected ErrUnlockThrottled, got %v", err)
+	}
+	clock.Advance(defaultUnlockBackoff)
+	if err := lm.CheckAttempt(); err != nil {
+		t.Fatalf("Expected nil, got %s", err)
+	}
+
+	// Further failures should be capped at the max backoff.
+	for i := 0; i < 20; i++ {
+		lm.AttemptFailed()
+	}
+	if wait := lm.nextAttempt.Sub(clock.Now()); wait != maxUnlockBackoff {
+		t.Errorf("Expected backoff capped at %s, got %s", maxUnlockBackoff, wait)
+	}
+
+	// A successful unlock resets the backoff.
+	lm.Unlocked(time.Hour)
+	defer lm.Lock()
+	if err := lm.CheckAttempt(); err != nil {
+		t.Fatalf("Expected nil, got %s", err)
+	}
+}
+
+func TestLockManager_Lock(t *testing.T) {
+	locked := make(chan struct{}, 2)
+	lm := NewLockManager(func() {
+		locked <- struct{}{}
+	})
+
+	if !lm.IsLocked() {
+		t.Error("Expected locked")
+	}
+
+	lm.Unlocked(time.Millisecond * 50)
+	if lm.TimeUntilLock() <= 0 {
+		t.Error("Expected positive time until lock")
+	}
+
+	select {
+	case <-locked:
+	case <-time.After(time.Second * 10):
+		t.Fatal("Timed out waiting for the unlock period to expire")
+	}
+	if !lm.IsLocked() {
+		t.Error("Expected locked")
+	}
+
+	lm.Unlocked(time.Hour)
+	if lm.IsLocked() {
+		t.Error("Expected unlocked")
+	}
+	lm.Lock()
+	if !lm.IsLocked() {
+		t.Error("Expected locked")
+	}
+	if lm.TimeUntilLock() != 0 {
+		t.Errorf("Expected zero time until lock, got %s", lm.TimeUntilLock())
+	}
+	select {
+	case <-locked:
+	default:
+		t.Error("Expected lockFunc to be called by Lock")
+	}
+}
+
+func TestKeychain_Lock(t *testing.T) {
+	keychain, err := setupKeychain()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := keychain.Lock(); err == nil {
+		t.Error("Expected error locking an unencrypted keychain")
+	}
+
+	pw := []byte("let me in")
+	if err := keychain.SetPassphase(pw); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := keychain.Unlock(pw, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if keychain.IsEncrypted() {
+		t.Fatal("Keychain is encrypted")
+	}
+	if keychain.TimeUntilLock() <= 0 {
+		t.Error("Expected positive time until lock")
+	}
+
+	if err := keychain.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	if !keychain.IsEncrypted() {
+		t.Fatal("Keychain is not encrypted")
+	}
+	if keychain.TimeUntilLock() != 0 {
+		t.Errorf("Expected zero time until lock, got %s", keychain.TimeUntilLock())
+	}
+}
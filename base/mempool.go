@@ -0,0 +1,126 @@
+package base
+
+import (
+	"errors"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"gorm.io/gorm"
+)
+
+// DoubleSpendEvent is emitted when a transaction spending the same inputs
+// as an unconfirmed wallet transaction is seen. The wallet transaction is
+// flagged as conflicted and will never confirm if the conflicting
+// transaction does.
+type DoubleSpendEvent struct {
+	TransactionID iwallet.TransactionID
+	ConflictingID iwallet.TransactionID
+}
+
+type mempoolTx struct {
+	tx iwallet.Transaction
+}
+
+// mempoolHandler forwards transactions from the mempool subscription to
+// the chainHandler until the ChainManager is stopped.
+func (cm *ChainManager) mempoolHandler(sub *MempoolSubscription) {
+	defer sub.Close()
+	for {
+		select {
+		case tx, ok := <-sub.Out:
+			if !ok {
+				return
+			}
+			select {
+			case cm.msgChan <- &mempoolTx{tx: tx}:
+			case <-cm.done:
+				return
+			}
+		case <-cm.done:
+			return
+		}
+	}
+}
+
+// checkConflicts flags any unconfirmed wallet transaction which spends an
+// input tx also spends. It must only be called from the chainHandler.
+func (cm *ChainManager) checkConflicts(tx iwallet.Transaction) {
+	if len(cm.unconfirmedTxs) == 0 {
+		return
+	}
+	spent := make(map[string]bool, len(tx.From))
+	for _, in := range tx.From {
+		if len(in.ID) > 0 {
+			spent[string(in.ID)] = true
+		}
+	}
+
+	for txid, unconfirmed := range cm.unconfirmedTxs {
+		if txid == tx.ID || isCoinbase(unconfirmed) {
+			continue
+		}
+		for _, in := range unconfirmed.From {
+			if spent[string(in.ID)] {
+				cm.flagConflict(txid, tx.ID)
+				break
+			}
+		}
+	}
+}
+
+// flagConflict records that txid is conflicted by conflictingID and emits
+// a DoubleSpendEvent the first time the conflict is seen.
+func (cm *ChainManager) flagConflict(txid, conflictingID iwallet.TransactionID) {
+	var isNew bool
+	err := cm.db.Update(func(dbtx database.Tx) error {
+		var record database.TransactionRecord
+		err := dbtx.Read().Where("coin=?", cm.coinType.CurrencyCode()).Where("txid=?", txid.String()).First(&record).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// Watch only transactions aren't saved but the
+			// conflict is still reported.
+			isNew = true
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if record.ConflictedBy == conflictingID.String() {
+			return nil
+		}
+		isNew = true
+		record.ConflictedBy = conflictingID.String()
+		if record.BlockHeight == 0 && !record.Dropped() {
+			record.Status = database.TxStatusConflicted
+		}
+		return dbtx.Save(&record)
+	})
+	if err != nil {
+		cm.logger.Errorf("[%s] Error flagging conflicted transaction %s: %s", cm.coinType, txid, err)
+		return
+	}
+	if !isNew {
+		return
+	}
+	cm.logger.Warningf("[%s] Unconfirmed transaction %s double spent by %s", cm.coinType, txid, conflictingID)
+	go cm.notifyWaiters()
+	if cm.eventBus != nil {
+		cm.eventBus.Emit(&DoubleSpendEvent{
+			TransactionID: txid,
+			ConflictingID: conflictingID,
+		})
+	}
+}
+
+// ConflictingTransaction returns the ID of the transaction which double
+// spends the wallet transaction, if one has been seen.
+func (w *WalletBase) ConflictingTransaction(id iwallet.TransactionID) (iwallet.TransactionID, bool, error) {
+	var record database.TransactionRecord
+	err := w.DB.View(func(dbtx database.Tx) error {
+		return dbtx.Read().Where("coin=?", w.CoinType.CurrencyCode()).Where("txid=?", id.String()).First(&record).Error
+	})
+	if err != nil {
+		return "", false, err
+	}
+	if record.ConflictedBy == "" {
+		return "", false, nil
+	}
+	return iwallet.TransactionID(record.ConflictedBy), true, nil
+}
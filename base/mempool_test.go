@@ -0,0 +1,95 @@
+package base
+
+import (
+	"github.com/cpacia/multiwallet/database"
+	"testing"
+	"time"
+)
+
+func TestChainManager_DoubleSpend(t *testing.T) {
+	chain, client, err := newTestChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.db.Close()
+
+	addrs, err := chain.keychain.GetAddresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scanSub, err := chain.eventBus.Subscribe(&ScanCompleteEvent{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dsSub, err := chain.eventBus.Subscribe(&DoubleSpendEvent{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chain.Start()
+	defer chain.Stop()
+
+	select {
+	case <-scanSub.Out():
+	case <-time.After(time.Second * 10):
+		t.Fatal("Timed out waiting for scan")
+	}
+
+	incoming := NewMockTransaction(nil, &addrs[0])
+	if err := client.BroadcastInternal(incoming); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for the incoming transaction to be saved.
+	for i := 0; ; i++ {
+		var record database.TransactionRecord
+		err := chain.db.View(func(tx database.Tx) error {
+			return tx.Read().Where("txid=?", incoming.ID.String()).First(&record).Error
+		})
+		if err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatal("Timed out waiting for transaction to be saved")
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	// The payer double spends the input to themselves.
+	replacement := NewMockTransaction(&incoming.From[0], nil)
+	if err := client.BroadcastInternal(replacement); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case e := <-dsSub.Out():
+		event := e.(*DoubleSpendEvent)
+		if event.TransactionID != incoming.ID || event.ConflictingID != replacement.ID {
+			t.Errorf("Expected %s conflicted by %s, got %s conflicted by %s", incoming.ID, replacement.ID, event.TransactionID, event.ConflictingID)
+		}
+	case <-time.After(time.Second * 10):
+		t.Fatal("Timed out waiting for double spend")
+	}
+
+	var record database.TransactionRecord
+	err = chain.db.View(func(tx database.Tx) error {
+		return tx.Read().Where("txid=?", incoming.ID.String()).First(&record).Error
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.ConflictedBy != replacement.ID.String() {
+		t.Errorf("Expected transaction to be conflicted by %s, got %q", replacement.ID, record.ConflictedBy)
+	}
+
+	// Seeing the replacement again doesn't emit another event.
+	if err := client.BroadcastInternal(replacement); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-dsSub.Out():
+		t.Error("Expected a single double spend event")
+	case <-time.After(time.Millisecond * 500):
+	}
+}
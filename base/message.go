@@ -0,0 +1,97 @@
+package base
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	hd "github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+)
+
+// DefaultMessageMagic is the prefix used by the Bitcoin signed message
+// format. Coins which use a different prefix should set MessageMagic on
+// the WalletBase.
+const DefaultMessageMagic = "Bitcoin Signed Message:\n"
+
+// ErrInvalidSignature means the signature could not be parsed.
+var ErrInvalidSignature = errors.New("invalid message signature")
+
+// SignMessage signs the message with the private key for the given address
+// using the Bitcoin signed message format. The returned signature is a base64
+// encoded compact signature from which the public key can be recovered.
+// The wallet must be unlocked to use this function.
+func (w *WalletBase) SignMessage(addr iwallet.Address, message string) (string, error) {
+	var sig []byte
+	err := w.DB.View(func(dbtx database.Tx) error {
+		key, err := w.Keychain.KeyForAddress(dbtx, addr, nil)
+		if err != nil {
+			return err
+		}
+		defer ZeroKey(key)
+
+		privKey, err := key.ECPrivKey()
+		if err != nil {
+			return err
+		}
+		defer ZeroPrivKey(privKey)
+
+		sig, err = btcec.SignCompact(btcec.S256(), privKey, w.messageHash(message), true)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// VerifyMessage returns whether the signature over the message was created
+// by the key for the given address. The address does not need to belong
+// to this wallet.
+func (w *WalletBase) VerifyMessage(addr iwallet.Address, sig string, message string) (bool, error) {
+	sigBytes, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return false, ErrInvalidSignature
+	}
+
+	pubKey, compressed, err := btcec.RecoverCompact(btcec.S256(), sigBytes, w.messageHash(message))
+	if err != nil {
+		return false, ErrInvalidSignature
+	}
+
+	// Our address functions only support compressed keys.
+	if !compressed {
+		return false, nil
+	}
+
+	// The address function operates on extended keys so wrap the recovered
+	// key in one. Only the public key bytes are used to build the address.
+	key := hd.NewExtendedKey(chaincfg.MainNetParams.HDPublicKeyID[:], pubKey.SerializeCompressed(), make([]byte, 32), []byte{0x00, 0x00, 0x00, 0x00}, 0, 0, false)
+
+	recovered, err := w.AddressFunc(key)
+	if err != nil {
+		return false, err
+	}
+	return recovered.String() == addr.String(), nil
+}
+
+func (w *WalletBase) messageHash(message string) []byte {
+	magic := w.MessageMagic
+	if magic == "" {
+		magic = DefaultMessageMagic
+	}
+	return MessageHash(magic, message)
+}
+
+// MessageHash returns the hash signed by the signed message format for the
+// given magic prefix.
+func MessageHash(magic, message string) []byte {
+	var buf bytes.Buffer
+	wire.WriteVarString(&buf, 0, magic)
+	wire.WriteVarString(&buf, 0, message)
+	return chainhash.DoubleHashB(buf.Bytes())
+}
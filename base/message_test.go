@@ -0,0 +1,70 @@
+package base
+
+import (
+	hd "github.com/btcsuite/btcutil/hdkeychain"
+	"testing"
+	"time"
+)
+
+func TestWalletBase_SignVerifyMessage(t *testing.T) {
+	w, err := setupWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	xpriv, err := hd.NewKeyFromString("tprv8ZgxMBicQKsPeghT19pungdFLMJM2hMs3EEn5WtgobD7wuQSFQu4VNaEJXH9HS3RhhLT4wgZ3hj31m3kafuxhL9vfGTRtBVLSog4zjxW3L1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.CreateWallet(*xpriv, nil, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.OpenWallet(); err != nil {
+		t.Fatal(err)
+	}
+	defer w.CloseWallet()
+
+	addr, err := w.CurrentAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sig, err := w.SignMessage(addr, "hello world")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid, err := w.VerifyMessage(addr, sig, "hello world")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !valid {
+		t.Error("Expected signature to be valid")
+	}
+
+	valid, err = w.VerifyMessage(addr, sig, "goodbye world")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if valid {
+		t.Error("Expected signature over different message to be invalid")
+	}
+
+	other, err := w.NewAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid, err = w.VerifyMessage(other, sig, "hello world")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if valid {
+		t.Error("Expected signature for different address to be invalid")
+	}
+
+	if _, err := w.VerifyMessage(addr, "not a signature", "hello world"); err != ErrInvalidSignature {
+		t.Errorf("Expected ErrInvalidSignature got %v", err)
+	}
+}
@@ -12,12 +12,14 @@ import (
 )
 
 type MockChainClient struct {
-	mtx       sync.RWMutex
-	blocks    []iwallet.BlockInfo
-	addrIndex map[iwallet.Address][]iwallet.Transaction
-	txIndex   map[iwallet.TransactionID]iwallet.Transaction
-	txSubs    map[iwallet.Address]*TransactionSubscription
-	blockSubs map[int32]*BlockSubscription
+	mtx         sync.RWMutex
+	blocks      []iwallet.BlockInfo
+	addrIndex   map[iwallet.Address][]iwallet.Transaction
+	txIndex     map[iwallet.TransactionID]iwallet.Transaction
+	txSubs      map[iwallet.Address]*TransactionSubscription
+	blockSubs   map[int32]*BlockSubscription
+	mempoolSubs map[int32]*MempoolSubscription
+	proofs      map[iwallet.TransactionID]*MerkleProof
 
 	returnErr error
 }
@@ -33,10 +35,12 @@ func NewMockChainClient() *MockChainClient {
 				BlockTime: time.Now(),
 			},
 		},
-		addrIndex: make(map[iwallet.Address][]iwallet.Transaction),
-		txIndex:   make(map[iwallet.TransactionID]iwallet.Transaction),
-		txSubs:    make(map[iwallet.Address]*TransactionSubscription),
-		blockSubs: make(map[int32]*BlockSubscription),
+		addrIndex:   make(map[iwallet.Address][]iwallet.Transaction),
+		txIndex:     make(map[iwallet.TransactionID]iwallet.Transaction),
+		txSubs:      make(map[iwallet.Address]*TransactionSubscription),
+		blockSubs:   make(map[int32]*BlockSubscription),
+		mempoolSubs: make(map[int32]*MempoolSubscription),
+		proofs:      make(map[iwallet.TransactionID]*MerkleProof),
 	}
 }
 
@@ -76,6 +80,44 @@ func (m *MockChainClient) GenerateBlock() {
 	}
 }
 
+// Reorg replaces the top depth blocks with new ones. Transactions in the
+// replaced blocks go back to being unconfirmed.
+func (m *MockChainClient) Reorg(depth int) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	forkHeight := m.blocks[len(m.blocks)-depth].Height
+	m.blocks = m.blocks[:len(m.blocks)-depth]
+
+	for _, txs := range m.addrIndex {
+		for i := range txs {
+			if txs[i].Height >= forkHeight {
+				txs[i].Height = 0
+				txs[i].BlockInfo = nil
+			}
+		}
+	}
+	for txid, tx := range m.txIndex {
+		if tx.Height >= forkHeight {
+			tx.Height = 0
+			tx.BlockInfo = nil
+			m.txIndex[txid] = tx
+		}
+	}
+
+	for i := 0; i < depth; i++ {
+		r := make([]byte, 32)
+		rand.Read(r)
+
+		m.blocks = append(m.blocks, iwallet.BlockInfo{
+			BlockID:   iwallet.BlockID(hex.EncodeToString(r)),
+			PrevBlock: m.blocks[len(m.blocks)-1].BlockID,
+			Height:    m.blocks[len(m.blocks)-1].Height + 1,
+			BlockTime: time.Now(),
+		})
+	}
+}
+
 func (m *MockChainClient) SetErrorResponse(err error) {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
@@ -137,6 +179,30 @@ func (m *MockChainClient) IsBlockInMainChain(blk iwallet.BlockInfo) (bool, error
 	return false, nil
 }
 
+// SetMerkleProof sets the proof returned for the transaction. Without one
+// GetMerkleProof returns ErrMerkleProofUnsupported.
+func (m *MockChainClient) SetMerkleProof(id iwallet.TransactionID, proof *MerkleProof) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.proofs[id] = proof
+}
+
+func (m *MockChainClient) GetMerkleProof(id iwallet.TransactionID) (*MerkleProof, error) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	if m.returnErr != nil {
+		return nil, m.returnErr
+	}
+
+	proof, ok := m.proofs[id]
+	if !ok {
+		return nil, ErrMerkleProofUnsupported
+	}
+	return proof, nil
+}
+
 func (m *MockChainClient) SubscribeTransactions(addrs []iwallet.Address) (*TransactionSubscription, error) {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
@@ -258,7 +324,15 @@ func (m *MockChainClient) BroadcastInternal(tx iwallet.Transaction) error {
 		}
 	}
 
+	mempoolSubs := make([]*MempoolSubscription, 0, len(m.mempoolSubs))
+	for _, sub := range m.mempoolSubs {
+		mempoolSubs = append(mempoolSubs, sub)
+	}
+
 	go func() {
+		for _, sub := range mempoolSubs {
+			sub.Out <- tx
+		}
 		for _, sub := range subs {
 			sub.Out <- tx
 		}
@@ -267,6 +341,25 @@ func (m *MockChainClient) BroadcastInternal(tx iwallet.Transaction) error {
 	return nil
 }
 
+func (m *MockChainClient) SubscribeMempool() (*MempoolSubscription, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	sub := &MempoolSubscription{
+		Out: make(chan iwallet.Transaction),
+	}
+
+	id := rand.Int31()
+	m.mempoolSubs[id] = sub
+
+	sub.Close = func() {
+		m.mtx.Lock()
+		defer m.mtx.Unlock()
+		delete(m.mempoolSubs, id)
+	}
+	return sub, nil
+}
+
 func (m *MockChainClient) Open() error {
 	return nil
 }
@@ -0,0 +1,98 @@
+package base
+
+import (
+	"errors"
+	"fmt"
+	iwallet "github.com/cpacia/wallet-interface"
+)
+
+// ErrUnsupportedNetwork is returned when creating a wallet for a network
+// the coin doesn't have.
+var ErrUnsupportedNetwork = errors.New("network is not supported by this coin")
+
+// Network selects which of a coin's chains a wallet runs on.
+type Network int
+
+const (
+	// NetworkMainnet is the coin's main chain. This is the default.
+	NetworkMainnet Network = iota
+
+	// NetworkTestnet is the coin's public test chain.
+	NetworkTestnet
+
+	// NetworkSignet is a test chain whose blocks are signed by a known
+	// key rather than mined competitively so it's more reliable than
+	// testnet. Only Bitcoin has one.
+	NetworkSignet
+
+	// NetworkRegtest is a private chain whose blocks are mined on demand,
+	// such as by a node started for end-to-end tests.
+	NetworkRegtest
+)
+
+// localNetworkFee is the fee per byte used on networks with no fee market
+// to estimate fees from.
+const localNetworkFee = 1
+
+// String returns the name of the network as accepted by ParseNetwork.
+func (n Network) String() string {
+	switch n {
+	case NetworkMainnet:
+		return "mainnet"
+	case NetworkTestnet:
+		return "testnet"
+	case NetworkSignet:
+		return "signet"
+	case NetworkRegtest:
+		return "regtest"
+	}
+	return fmt.Sprintf("network(%d)", int(n))
+}
+
+// ParseNetwork returns the network with the given name. An empty name is
+// mainnet.
+func ParseNetwork(s string) (Network, error) {
+	switch s {
+	case "", "mainnet":
+		return NetworkMainnet, nil
+	case "testnet":
+		return NetworkTestnet, nil
+	case "signet":
+		return NetworkSignet, nil
+	case "regtest":
+		return NetworkRegtest, nil
+	}
+	return NetworkMainnet, fmt.Errorf("unknown network %s", s)
+}
+
+// IsTest returns whether the network's coins are worthless. Wallets on
+// test networks derive their keys with the testnet BIP44 coin type.
+func (n Network) IsTest() bool {
+	return n != NetworkMainnet
+}
+
+// DefaultFeeProvider returns the fee provider used on the network when the
+// config doesn't set one, or nil to use the coin's own. Signet and regtest
+// have no fee market so they pay the minimum relay fee.
+func (n Network) DefaultFeeProvider() FeeProvider {
+	if n != NetworkSignet && n != NetworkRegtest {
+		return nil
+	}
+	fee := iwallet.NewAmount(localNetworkFee)
+	return NewHardCodedFeeProvider(fee, fee, fee, fee)
+}
+
+// SelectedNetwork returns the network selected by the config. Configs
+// which only set Testnet select testnet.
+func (cfg *WalletConfig) SelectedNetwork() Network {
+	if cfg.Network == NetworkMainnet && cfg.Testnet {
+		return NetworkTestnet
+	}
+	return cfg.Network
+}
+
+// UnsupportedNetwork returns an error wrapping ErrUnsupportedNetwork for a
+// coin which doesn't have the network.
+func UnsupportedNetwork(coinType iwallet.CoinType, n Network) error {
+	return fmt.Errorf("%w: %s has no %s", ErrUnsupportedNetwork, coinType.CurrencyCode(), n)
+}
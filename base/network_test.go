@@ -0,0 +1,54 @@
+package base
+
+import (
+	iwallet "github.com/cpacia/wallet-interface"
+	"testing"
+)
+
+func TestParseNetwork(t *testing.T) {
+	for _, n := range []Network{NetworkMainnet, NetworkTestnet, NetworkSignet, NetworkRegtest} {
+		parsed, err := ParseNetwork(n.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed != n {
+			t.Errorf("Expected %s, got %s", n, parsed)
+		}
+	}
+	if n, err := ParseNetwork(""); err != nil || n != NetworkMainnet {
+		t.Errorf("Expected an empty name to be mainnet, got %s %v", n, err)
+	}
+	if _, err := ParseNetwork("simnet"); err == nil {
+		t.Error("Expected an error for an unknown network")
+	}
+}
+
+func TestWalletConfig_SelectedNetwork(t *testing.T) {
+	tests := []struct {
+		cfg      WalletConfig
+		expected Network
+	}{
+		{WalletConfig{}, NetworkMainnet},
+		{WalletConfig{Testnet: true}, NetworkTestnet},
+		{WalletConfig{Network: NetworkRegtest}, NetworkRegtest},
+		{WalletConfig{Testnet: true, Network: NetworkSignet}, NetworkSignet},
+	}
+	for i, test := range tests {
+		if n := test.cfg.SelectedNetwork(); n != test.expected {
+			t.Errorf("Test %d: expected %s, got %s", i, test.expected, n)
+		}
+	}
+}
+
+func TestNetwork_DefaultFeeProvider(t *testing.T) {
+	if NetworkMainnet.DefaultFeeProvider() != nil || NetworkTestnet.DefaultFeeProvider() != nil {
+		t.Error("Expected mainnet and testnet to use the coin's fee provider")
+	}
+	fee, err := NetworkRegtest.DefaultFeeProvider().GetFee(iwallet.FlPriority)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fee.Cmp(iwallet.NewAmount(localNetworkFee)) != 0 {
+		t.Errorf("Expected the regtest fee to be %d, got %s", localNetworkFee, fee)
+	}
+}
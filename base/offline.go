@@ -0,0 +1,58 @@
+package base
+
+import (
+	"errors"
+	iwallet "github.com/cpacia/wallet-interface"
+	"time"
+)
+
+// ErrSigningClosed is returned when completing or canceling a signing
+// request which has already been completed or canceled.
+var ErrSigningClosed = errors.New("signing request already completed or canceled")
+
+// SigningStatus is the state of an offline signing request.
+type SigningStatus string
+
+const (
+	// SigningPending requests are waiting for the offline wallet's
+	// signatures.
+	SigningPending SigningStatus = "pending"
+
+	// SigningComplete requests were signed and broadcast.
+	SigningComplete SigningStatus = "complete"
+
+	// SigningCanceled requests were dropped and never broadcast.
+	SigningCanceled SigningStatus = "canceled"
+)
+
+// SigningRequest is an unsigned spend from a watch-only wallet in offline
+// mode. It's carried to the air-gapped wallet holding the private key as
+// JSON, usually split into QR codes with EncodeQRChunks.
+//
+// The offline wallet should show the outputs of Tx to the user before
+// signing each input and returning a SigningResponse. ID is the hash of
+// the unsigned transaction, which is also its final txid unless it spends
+// legacy P2PKH inputs.
+type SigningRequest struct {
+	ID        iwallet.TransactionID `json:"id"`
+	Coin      iwallet.CoinType      `json:"coin"`
+	Tx        []byte                `json:"tx"`
+	Inputs    []SigningInput        `json:"inputs"`
+	CreatedAt time.Time             `json:"createdAt"`
+}
+
+// SigningInput describes the input at Index. PrevScript is the output
+// script being spent and Path the path of its key below the account.
+type SigningInput struct {
+	Index      int     `json:"index"`
+	Amount     int64   `json:"amount"`
+	PrevScript []byte  `json:"prevScript"`
+	Path       KeyPath `json:"path"`
+}
+
+// SigningResponse carries the offline wallet's signatures back to the
+// watch-only wallet, one per request input with the sighash type appended.
+type SigningResponse struct {
+	ID         iwallet.TransactionID `json:"id"`
+	Signatures [][]byte              `json:"signatures"`
+}
@@ -0,0 +1,106 @@
+package base
+
+import (
+	"encoding/hex"
+	"errors"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"gorm.io/gorm"
+	"strings"
+)
+
+// ErrAlreadyBroadcast is returned by CancelQueuedSpend for a transaction a
+// backend has accepted. It may be mined so it can't be cancelled.
+var ErrAlreadyBroadcast = errors.New("transaction has already been broadcast")
+
+// JoinOutpoints encodes the serialized outpoints spent by a transaction for
+// UnconfirmedTransaction.Inputs.
+func JoinOutpoints(outpoints [][]byte) string {
+	encoded := make([]string, 0, len(outpoints))
+	for _, op := range outpoints {
+		encoded = append(encoded, hex.EncodeToString(op))
+	}
+	return strings.Join(encoded, ";")
+}
+
+// queuedInputs returns the outpoints spent by the transactions in the
+// broadcast queue. Spends made while the backend is unreachable stay queued
+// and their inputs aren't removed from the utxo set until the chain client
+// reports them, so coin selection must skip them.
+func (w *WalletBase) queuedInputs(dbtx database.Tx) (map[string]bool, error) {
+	var queued []database.UnconfirmedTransaction
+	err := dbtx.Read().Where("coin=?", w.CoinType.CurrencyCode()).Find(&queued).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	inputs := make(map[string]bool)
+	for _, utx := range queued {
+		if utx.Inputs == "" {
+			continue
+		}
+		for _, op := range strings.Split(utx.Inputs, ";") {
+			inputs[op] = true
+		}
+	}
+	return inputs, nil
+}
+
+// QueuedSpends returns the outbox: the wallet's spends which are awaiting
+// broadcast, either because the backend couldn't be reached when they were
+// made or because their lock time isn't final. They're broadcast by the
+// rebroadcaster as soon as it's possible. Spends a backend has accepted
+// aren't included.
+func (w *WalletBase) QueuedSpends() ([]BroadcastStatus, error) {
+	var queued []database.UnconfirmedTransaction
+	err := w.DB.View(func(dbtx database.Tx) error {
+		return dbtx.Read().Where("coin=?", w.CoinType.CurrencyCode()).Order("timestamp asc").Find(&queued).Error
+	})
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	best, err := w.BlockchainInfo()
+	if err != nil {
+		return nil, err
+	}
+	var spends []BroadcastStatus
+	for i := range queued {
+		status := queuedStatus(&queued[i], best)
+		if status.State == BroadcastQueued || status.State == BroadcastPending {
+			spends = append(spends, status)
+		}
+	}
+	return spends, nil
+}
+
+// CancelQueuedSpend removes a spend awaiting broadcast from the outbox so
+// its coins can be spent again. It fails with ErrAlreadyBroadcast once a
+// backend has accepted the transaction. A broadcast which failed may still
+// have reached the network, such as when the connection dropped before the
+// backend replied, in which case the transaction is recorded as usual if
+// the chain client reports it.
+func (w *WalletBase) CancelQueuedSpend(txid iwallet.TransactionID) error {
+	var utx database.UnconfirmedTransaction
+	err := w.DB.View(func(dbtx database.Tx) error {
+		return dbtx.Read().Where("coin=?", w.CoinType.CurrencyCode()).Where("txid=?", txid.String()).First(&utx).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrTransactionNotFound
+	} else if err != nil {
+		return err
+	}
+	best, err := w.BlockchainInfo()
+	if err != nil {
+		return err
+	}
+	if state := queuedStatus(&utx, best).State; state != BroadcastQueued && state != BroadcastPending {
+		return ErrAlreadyBroadcast
+	}
+
+	if err := w.ChainManager.AbandonTransaction(txid); err != nil {
+		return err
+	}
+	// The spend no longer counts towards the SpendPolicy's daily limit.
+	return w.DB.Update(func(dbtx database.Tx) error {
+		return dbtx.Delete("txid", txid.String(), &database.SpendRecord{})
+	})
+}
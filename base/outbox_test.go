@@ -0,0 +1,104 @@
+package base
+
+import (
+	"encoding/hex"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"testing"
+	"time"
+)
+
+func TestWalletBase_QueuedSpends(t *testing.T) {
+	chain, _, err := newTestChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.db.Close()
+	w := &WalletBase{
+		ChainManager: chain,
+		DB:           chain.db,
+		CoinType:     iwallet.CtMock,
+	}
+
+	addrs, err := chain.keychain.GetAddresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	funding := NewMockTransaction(nil, &addrs[0])
+	funding.Height = 1
+	if _, err := chain.saveTransactionsAndUtxos([]iwallet.Transaction{funding}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A spend made while the backend was unreachable and one a backend
+	// has accepted.
+	queued := NewMockTransaction(&funding.To[0], nil)
+	sent := NewMockTransaction(nil, nil)
+	err = chain.db.Update(func(dbtx database.Tx) error {
+		err := dbtx.Save(&database.UnconfirmedTransaction{
+			Txid:      queued.ID.String(),
+			Coin:      iwallet.CtMock.CurrencyCode(),
+			Timestamp: time.Now(),
+			Attempts:  1,
+			LastError: "connection refused",
+			Inputs:    JoinOutpoints([][]byte{funding.To[0].ID}),
+		})
+		if err != nil {
+			return err
+		}
+		return dbtx.Save(&database.UnconfirmedTransaction{
+			Txid:      sent.ID.String(),
+			Coin:      iwallet.CtMock.CurrencyCode(),
+			Timestamp: time.Now(),
+			Attempts:  1,
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inputs := func() map[string]bool {
+		var inputs map[string]bool
+		err := chain.db.View(func(dbtx database.Tx) error {
+			var err error
+			inputs, err = w.queuedInputs(dbtx)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return inputs
+	}
+	if in := inputs(); len(in) != 1 || !in[hex.EncodeToString(funding.To[0].ID)] {
+		t.Errorf("Expected the funding output to be spent by the queue, got %v", in)
+	}
+
+	spends, err := w.QueuedSpends()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spends) != 1 || spends[0].Txid != queued.ID || spends[0].State != BroadcastQueued {
+		t.Fatalf("Expected only the queued spend, got %v", spends)
+	}
+
+	if err := w.CancelQueuedSpend(sent.ID); err != ErrAlreadyBroadcast {
+		t.Errorf("Expected ErrAlreadyBroadcast, got %v", err)
+	}
+	if err := w.CancelQueuedSpend(NewMockTransaction(nil, nil).ID); err != ErrTransactionNotFound {
+		t.Errorf("Expected ErrTransactionNotFound, got %v", err)
+	}
+
+	if err := w.CancelQueuedSpend(queued.ID); err != nil {
+		t.Fatal(err)
+	}
+	if in := inputs(); len(in) != 0 {
+		t.Errorf("Expected the funding output to be released, got %v", in)
+	}
+	spends, err = w.QueuedSpends()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spends) != 0 {
+		t.Errorf("Expected no queued spends, got %v", spends)
+	}
+}
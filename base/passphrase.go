@@ -0,0 +1,336 @@
+package base
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/chaincfg"
+	hd "github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/cpacia/multiwallet/database"
+	"golang.org/x/crypto/pbkdf2"
+	"io"
+	"math"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ErrWeakPassphrase is returned when a new passphrase doesn't meet the
+// keychain's PassphrasePolicy.
+var ErrWeakPassphrase = errors.New("passphrase is too weak")
+
+// ErrSeedMismatch is returned by DecryptWithSeed when the seed isn't the
+// one the wallet was created from.
+var ErrSeedMismatch = errors.New("seed does not match the wallet")
+
+// PassphrasePolicy is the strength required of new passphrases. The zero
+// policy accepts any passphrase.
+type PassphrasePolicy struct {
+	// MinLength is the fewest characters a passphrase may have.
+	MinLength int
+
+	// MinScore is the lowest ScorePassphrase score accepted, from 0 to 4.
+	MinScore int
+}
+
+// Check returns ErrWeakPassphrase if pw doesn't meet the policy.
+func (p PassphrasePolicy) Check(pw []byte) error {
+	if n := utf8.RuneCount(pw); n < p.MinLength {
+		return fmt.Errorf("%w: it must have at least %d characters", ErrWeakPassphrase, p.MinLength)
+	}
+	if score := ScorePassphrase(pw); score < p.MinScore {
+		return fmt.Errorf("%w: it scores %d of 4, at least %d is required", ErrWeakPassphrase, score, p.MinScore)
+	}
+	return nil
+}
+
+// commonPassphrases are some of the most used passwords, most used first.
+// A passphrase which is one, or contains one, is guessed early.
+var commonPassphrases = []string{
+	"123456", "password", "12345678", "qwerty", "123456789", "12345",
+	"1234", "111111", "1234567", "dragon", "123123", "baseball", "abc123",
+	"football", "monkey", "letmein", "shadow", "master", "696969",
+	"mustang", "666666", "qwertyuiop", "123321", "1234567890", "michael",
+	"superman", "iloveyou", "trustno1", "sunshine", "princess", "welcome",
+	"admin", "login", "passw0rd", "starwars", "whatever", "bitcoin",
+	"satoshi", "wallet", "asdfgh", "zxcvbn",
+}
+
+// ScorePassphrase estimates how hard a passphrase is to guess on zxcvbn's
+// scale: 0 is guessed in under a thousand guesses, 1 under a million, 2
+// under a hundred million, 3 under ten billion and 4 takes more. Repeated
+// characters, runs like "abc" or "321" and common passwords add little.
+func ScorePassphrase(pw []byte) int {
+	bits := passphraseEntropy(pw)
+	switch {
+	case bits < math.Log2(1e3):
+		return 0
+	case bits < math.Log2(1e6):
+		return 1
+	case bits < math.Log2(1e8):
+		return 2
+	case bits < math.Log2(1e10):
+		return 3
+	default:
+		return 4
+	}
+}
+
+// passphraseEntropy returns the estimated bits of entropy in pw. Each
+// character costs the bits needed to pick it from the classes of characters
+// used. A run of three or more of the same character, or stepping by one
+// like "abc" or "321", costs its first character and its length. A common
+// password anywhere in pw costs no more than picking it from the list.
+func passphraseEntropy(pw []byte) float64 {
+	var hasLower, hasUpper, hasDigit, hasSymbol, hasOther bool
+	for _, r := range string(pw) {
+		switch {
+		case r >= 'a' && r <= 'z':
+			hasLower = true
+		case r >= 'A' && r <= 'Z':
+			hasUpper = true
+		case r >= '0' && r <= '9':
+			hasDigit = true
+		case r < utf8.RuneSelf && unicode.IsPrint(r):
+			hasSymbol = true
+		default:
+			hasOther = true
+		}
+	}
+	pool := 0
+	for _, class := range []struct {
+		present bool
+		size    int
+	}{{hasLower, 26}, {hasUpper, 26}, {hasDigit, 10}, {hasSymbol, 33}, {hasOther, 100}} {
+		if class.present {
+			pool += class.size
+		}
+	}
+	if pool == 0 {
+		return 0
+	}
+	perChar := math.Log2(float64(pool))
+
+	lower := strings.ToLower(string(pw))
+	runes := []rune(lower)
+	costs := make([]float64, len(runes))
+	for i := 0; i < len(runes); {
+		j := i + 1
+		if j < len(runes) {
+			step := runes[j] - runes[i]
+			for step >= -1 && step <= 1 && j < len(runes) && runes[j]-runes[j-1] == step {
+				j++
+			}
+		}
+		costs[i] = perChar
+		if j-i < 3 {
+			j = i + 1
+		} else {
+			costs[i] += math.Log2(float64(j - i))
+		}
+		i = j
+	}
+
+	for rank, common := range commonPassphrases {
+		guess := math.Log2(float64(rank + 2))
+		for offset := 0; ; {
+			idx := strings.Index(lower[offset:], common)
+			if idx < 0 {
+				break
+			}
+			start := utf8.RuneCountInString(lower[:offset+idx])
+			end := start + len(common)
+			var span float64
+			for _, c := range costs[start:end] {
+				span += c
+			}
+			if span > guess {
+				costs[start] = guess
+				for k := start + 1; k < end; k++ {
+					costs[k] = 0
+				}
+			}
+			offset += idx + len(common)
+		}
+	}
+
+	var bits float64
+	for _, c := range costs {
+		bits += c
+	}
+	return bits
+}
+
+// MnemonicSeed returns the BIP 39 seed of a mnemonic and its optional
+// passphrase. The words aren't checked against a wordlist. Only ASCII
+// mnemonics, such as those from the English wordlist, are accepted as
+// others would need Unicode normalization.
+func MnemonicSeed(mnemonic, passphrase string) ([]byte, error) {
+	for _, s := range []string{mnemonic, passphrase} {
+		for i := 0; i < len(s); i++ {
+			if s[i] >= utf8.RuneSelf {
+				return nil, errors.New("only ASCII mnemonics are supported")
+			}
+		}
+	}
+	words := strings.Fields(mnemonic)
+	if len(words) < 12 || len(words)%3 != 0 {
+		return nil, errors.New("a mnemonic has 12, 15, 18, 21 or 24 words")
+	}
+	return pbkdf2.Key([]byte(strings.Join(words, " ")), []byte("mnemonic"+passphrase), 2048, 64, sha512.New), nil
+}
+
+// SetRecoveryHint saves a hint to help remember the passphrase, replacing
+// any saved before. pw must be the passphrase and the hint can't contain
+// it. The hint is encrypted with a key derived from the account public key,
+// which keeps it out of plain sight in the database and its exports but
+// doesn't hide it from anyone who has the wallet. An empty hint removes it.
+func (kc *Keychain) SetRecoveryHint(pw []byte, hint string) error {
+	if err := kc.VerifyPassphrase(pw); err != nil {
+		return err
+	}
+	if hint != "" && strings.Contains(strings.ToLower(hint), strings.ToLower(string(pw))) {
+		return errors.New("recovery hint contains the passphrase")
+	}
+	return kc.db.Update(func(tx database.Tx) error {
+		var coinRecord database.CoinRecord
+		if err := tx.Read().Where("coin=?", kc.coinType.CurrencyCode()).Find(&coinRecord).Error; err != nil {
+			return err
+		}
+		coinRecord.RecoveryHint = ""
+		if hint != "" {
+			block, err := aes.NewCipher(recoveryHintKey(coinRecord.MasterPub))
+			if err != nil {
+				return err
+			}
+			ciphertext := make([]byte, aes.BlockSize+len(hint))
+			iv := ciphertext[:aes.BlockSize]
+			if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+				return err
+			}
+			cipher.NewCFBEncrypter(block, iv).XORKeyStream(ciphertext[aes.BlockSize:], []byte(hint))
+			coinRecord.RecoveryHint = base64.StdEncoding.EncodeToString(ciphertext)
+		}
+		return tx.Save(&coinRecord)
+	})
+}
+
+// RecoveryHint returns the hint saved by SetRecoveryHint or an empty string
+// if there's none.
+func (kc *Keychain) RecoveryHint() (string, error) {
+	var coinRecord database.CoinRecord
+	err := kc.db.View(func(tx database.Tx) error {
+		return tx.Read().Where("coin=?", kc.coinType.CurrencyCode()).Find(&coinRecord).Error
+	})
+	if err != nil || coinRecord.RecoveryHint == "" {
+		return "", err
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(coinRecord.RecoveryHint)
+	if err != nil {
+		return "", err
+	}
+	if len(ciphertext) < aes.BlockSize {
+		return "", errors.New("ciphertext too short")
+	}
+	block, err := aes.NewCipher(recoveryHintKey(coinRecord.MasterPub))
+	if err != nil {
+		return "", err
+	}
+	plaintext := ciphertext[aes.BlockSize:]
+	cipher.NewCFBDecrypter(block, ciphertext[:aes.BlockSize]).XORKeyStream(plaintext, plaintext)
+	return string(plaintext), nil
+}
+
+// recoveryHintKey returns the key recovery hints are encrypted with.
+func recoveryHintKey(masterPub string) []byte {
+	key := sha256.Sum256([]byte("multiwallet recovery hint" + masterPub))
+	return key[:]
+}
+
+// DecryptWithSeed is the way back into an encrypted wallet whose passphrase
+// is lost. The coin level key, m/44'/coinIndex', is derived again from the
+// seed the wallet was created from and must match the wallet's public key.
+// The master key is then saved unencrypted, as by RemovePassphrase, and the
+// recovery hint is removed. A new passphrase should be set straight away.
+func (kc *Keychain) DecryptWithSeed(seed []byte, coinIndex uint32) error {
+	kc.mtx.Lock()
+	defer kc.mtx.Unlock()
+
+	if kc.watchOnly {
+		return ErrWatchOnlyKeychain
+	}
+
+	return kc.db.Update(func(tx database.Tx) error {
+		var coinRecord database.CoinRecord
+		if err := tx.Read().Where("coin=?", kc.coinType.CurrencyCode()).Find(&coinRecord).Error; err != nil {
+			return err
+		}
+		if !coinRecord.EncryptedMasterKey {
+			return errors.New("wallet is not encrypted")
+		}
+
+		key, err := coinKeyFromSeed(seed, coinIndex, coinRecord.MasterPub)
+		if err != nil {
+			return err
+		}
+		defer ZeroKey(key)
+
+		externalPrivkey, internalPrivkey, err := generateAccountPrivKeys(key)
+		if err != nil {
+			return err
+		}
+		ZeroKey(kc.externalPrivkey)
+		ZeroKey(kc.internalPrivkey)
+		kc.externalPrivkey, kc.internalPrivkey = externalPrivkey, internalPrivkey
+		if err := kc.setPaymentCodeKey(tx, key); err != nil {
+			return err
+		}
+		if err := kc.setSilentPaymentKeys(tx, key); err != nil {
+			return err
+		}
+
+		coinRecord.MasterPriv = key.String()
+		coinRecord.EncryptedMasterKey = false
+		coinRecord.RecoveryHint = ""
+		if err := tx.Save(&coinRecord); err != nil {
+			return err
+		}
+		return kc.extendPaymentCodes(tx)
+	})
+}
+
+// coinKeyFromSeed derives m/44'/coinIndex' from the seed and checks its
+// public key is masterPub. The wallet may have been created on any network
+// so each is tried.
+func coinKeyFromSeed(seed []byte, coinIndex uint32, masterPub string) (*hd.ExtendedKey, error) {
+	for _, params := range []*chaincfg.Params{&chaincfg.MainNetParams, &chaincfg.TestNet3Params, &chaincfg.RegressionNetParams, &chaincfg.SimNetParams} {
+		master, err := hd.NewMaster(seed, params)
+		if err != nil {
+			return nil, err
+		}
+		purpose, err := master.Child(hd.HardenedKeyStart + 44)
+		ZeroKey(master)
+		if err != nil {
+			return nil, err
+		}
+		key, err := purpose.Child(hd.HardenedKeyStart + coinIndex)
+		ZeroKey(purpose)
+		if err != nil {
+			return nil, err
+		}
+		pub, err := key.Neuter()
+		if err == nil && pub.String() == masterPub {
+			return key, nil
+		}
+		ZeroKey(key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, ErrSeedMismatch
+}
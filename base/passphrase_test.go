@@ -0,0 +1,192 @@
+package base
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"github.com/btcsuite/btcd/chaincfg"
+	hd "github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/cpacia/multiwallet/database"
+	"github.com/cpacia/multiwallet/database/memorydb"
+	iwallet "github.com/cpacia/wallet-interface"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScorePassphrase(t *testing.T) {
+	tests := []struct {
+		pw    string
+		score int
+	}{
+		{"password", 0},
+		{"aaaaaaaaaaaa", 0},
+		{"abcdefghijkl", 0},
+		{"Password1", 0},
+		{"qwertyuiop123", 1},
+		{"monkey77", 1},
+		{"correct horse battery staple", 4},
+		{"9#kQ!v2Lp@x7", 4},
+	}
+	for _, test := range tests {
+		if score := ScorePassphrase([]byte(test.pw)); score != test.score {
+			t.Errorf("Expected %q to score %d, got %d", test.pw, test.score, score)
+		}
+	}
+}
+
+func TestPassphrasePolicy(t *testing.T) {
+	policy := PassphrasePolicy{MinLength: 10, MinScore: 3}
+	for _, pw := range []string{"9#kQ!v2", "password123456"} {
+		if err := policy.Check([]byte(pw)); !errors.Is(err, ErrWeakPassphrase) {
+			t.Errorf("Expected %q to be rejected, got %v", pw, err)
+		}
+	}
+	if err := policy.Check([]byte("correct horse battery staple")); err != nil {
+		t.Error(err)
+	}
+	if err := (PassphrasePolicy{}).Check([]byte("a")); err != nil {
+		t.Errorf("Expected the zero policy to accept anything, got %v", err)
+	}
+
+	keychain, err := setupKeychain(RequirePassphrase(policy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keychain.SetPassphase([]byte("letmein")); !errors.Is(err, ErrWeakPassphrase) {
+		t.Errorf("Expected ErrWeakPassphrase, got %v", err)
+	}
+	if keychain.IsEncrypted() {
+		t.Error("Expected the keychain to stay unencrypted")
+	}
+	pw := []byte("correct horse battery staple")
+	if err := keychain.SetPassphase(pw); err != nil {
+		t.Fatal(err)
+	}
+	if err := keychain.ChangePassphrase(pw, []byte("letmein")); !errors.Is(err, ErrWeakPassphrase) {
+		t.Errorf("Expected ErrWeakPassphrase, got %v", err)
+	}
+}
+
+func TestMnemonicSeed(t *testing.T) {
+	// BIP 39 test vector.
+	mnemonic := "abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about"
+	expected, _ := hex.DecodeString("c55257c360c07c72029aebc1b53c05ed0362ada38ead3e3e9efa3708e53495531f09a6987599d18264c1e1c92f2cf141630c7a3c4ab7c81b2f001698e7463b04")
+	seed, err := MnemonicSeed(mnemonic, "TREZOR")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(seed, expected) {
+		t.Errorf("Expected seed %x, got %x", expected, seed)
+	}
+	if _, err := MnemonicSeed("abandon about", ""); err == nil {
+		t.Error("Expected a short mnemonic to be rejected")
+	}
+}
+
+func TestKeychain_RecoveryHint(t *testing.T) {
+	keychain, err := setupKeychain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pw := []byte("let me in")
+	if err := keychain.SetPassphase(pw); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := keychain.SetRecoveryHint(pw, "it's LET ME IN"); err == nil {
+		t.Error("Expected a hint containing the passphrase to be rejected")
+	}
+	if err := keychain.SetRecoveryHint(pw, "what you say at the door"); err != nil {
+		t.Fatal(err)
+	}
+	var record database.CoinRecord
+	err = keychain.db.View(func(tx database.Tx) error {
+		return tx.Read().Where("coin=?", iwallet.CtMock.CurrencyCode()).Find(&record).Error
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.RecoveryHint == "" || strings.Contains(record.RecoveryHint, "door") {
+		t.Error("Expected the hint to be saved encrypted")
+	}
+	hint, err := keychain.RecoveryHint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hint != "what you say at the door" {
+		t.Errorf("Unexpected hint %q", hint)
+	}
+}
+
+func TestKeychain_DecryptWithSeed(t *testing.T) {
+	db, err := memorydb.NewMemoryDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.InitializeDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+	seed := bytes.Repeat([]byte{0x01}, hd.RecommendedSeedLen)
+	master, err := hd.NewMaster(seed, &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	purpose, err := master.Child(hd.HardenedKeyStart + 44)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xpriv, err := purpose.Child(hd.HardenedKeyStart + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xpub, err := xpriv.Neuter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx database.Tx) error {
+		return tx.Save(&database.CoinRecord{
+			MasterPriv: xpriv.String(),
+			MasterPub:  xpub.String(),
+			Coin:       iwallet.CtMock,
+			Birthday:   time.Now(),
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keychain, err := NewKeychain(db, iwallet.CtMock, newTestAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pw := []byte("forgotten")
+	if err := keychain.SetPassphase(pw); err != nil {
+		t.Fatal(err)
+	}
+	if err := keychain.SetRecoveryHint(pw, "no idea"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := keychain.DecryptWithSeed(bytes.Repeat([]byte{0x02}, hd.RecommendedSeedLen), 1); !errors.Is(err, ErrSeedMismatch) {
+		t.Errorf("Expected ErrSeedMismatch for another seed, got %v", err)
+	}
+	if err := keychain.DecryptWithSeed(seed, 0); !errors.Is(err, ErrSeedMismatch) {
+		t.Errorf("Expected ErrSeedMismatch for another coin, got %v", err)
+	}
+	if err := keychain.DecryptWithSeed(seed, 1); err != nil {
+		t.Fatal(err)
+	}
+	if keychain.IsEncrypted() {
+		t.Error("Expected the keychain to be decrypted")
+	}
+	if has, err := keychain.HasPassphrase(); err != nil || has {
+		t.Errorf("Expected the master key to be saved unencrypted, got %t, %v", has, err)
+	}
+	if hint, err := keychain.RecoveryHint(); err != nil || hint != "" {
+		t.Errorf("Expected the hint to be removed, got %q, %v", hint, err)
+	}
+	if err := keychain.SetPassphase([]byte("remembered")); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,549 @@
+package base
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil/base58"
+	hd "github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"gorm.io/gorm"
+	"math/big"
+	"time"
+)
+
+const (
+	// paymentCodeVersion is the base58check version byte of a BIP 47
+	// payment code. It makes encoded codes start with "PM8T".
+	paymentCodeVersion = 0x47
+
+	// PaymentCodeLen is the length of a serialized payment code, which
+	// is also the length of the OP_RETURN payload of a notification.
+	PaymentCodeLen = 80
+
+	// paymentCodePurpose is the hardened index below the account key of
+	// the payment code key.
+	paymentCodePurpose = 47
+)
+
+var (
+	// ErrInvalidPaymentCode means a payment code couldn't be decoded.
+	ErrInvalidPaymentCode = errors.New("invalid payment code")
+
+	// ErrPaymentCodesDisabled is returned by the payment code methods of
+	// a keychain created without the PaymentCodes option.
+	ErrPaymentCodesDisabled = errors.New("payment codes are not enabled")
+)
+
+// PubKeyAddrFunc returns the address of a public key.
+type PubKeyAddrFunc func(pubKey *btcec.PublicKey) (iwallet.Address, error)
+
+// PaymentCodes enables BIP 47 reusable payment codes. addrFunc must return
+// the P2PKH address of a key as version 1 codes only pay to P2PKH.
+func PaymentCodes(addrFunc PubKeyAddrFunc) KeychainOption {
+	return func(cfg *KeychainConfig) error {
+		if addrFunc == nil {
+			return errors.New("payment code address function is nil")
+		}
+		cfg.PaymentCodeAddrFunc = addrFunc
+		return nil
+	}
+}
+
+// PaymentCode is a version 1 BIP 47 payment code. It's the public key and
+// chain code of an extended key whose children are the keys payments to the
+// code's owner are derived from.
+type PaymentCode struct {
+	PubKey    *btcec.PublicKey
+	ChainCode []byte
+}
+
+// NewPaymentCode returns the payment code of an extended key.
+func NewPaymentCode(key *hd.ExtendedKey) (PaymentCode, error) {
+	pubKey, err := key.ECPubKey()
+	if err != nil {
+		return PaymentCode{}, err
+	}
+	// The hdkeychain version we use doesn't export the chain code so it's
+	// read from the serialized key.
+	ser := base58.Decode(key.String())
+	if len(ser) != 82 {
+		return PaymentCode{}, errors.New("invalid extended key")
+	}
+	return PaymentCode{
+		PubKey:    pubKey,
+		ChainCode: append([]byte(nil), ser[13:45]...),
+	}, nil
+}
+
+// ParsePaymentCode decodes a base58check encoded payment code.
+func ParsePaymentCode(s string) (PaymentCode, error) {
+	payload, version, err := base58.CheckDecode(s)
+	if err != nil || version != paymentCodeVersion {
+		return PaymentCode{}, ErrInvalidPaymentCode
+	}
+	return paymentCodeFromBytes(payload)
+}
+
+// paymentCodeFromBytes decodes the 80 byte serialization of a payment code.
+func paymentCodeFromBytes(b []byte) (PaymentCode, error) {
+	if len(b) != PaymentCodeLen || b[0] != 1 {
+		return PaymentCode{}, ErrInvalidPaymentCode
+	}
+	pubKey, err := btcec.ParsePubKey(b[2:35], btcec.S256())
+	if err != nil {
+		return PaymentCode{}, ErrInvalidPaymentCode
+	}
+	return PaymentCode{
+		PubKey:    pubKey,
+		ChainCode: append([]byte(nil), b[35:67]...),
+	}, nil
+}
+
+// Bytes returns the 80 byte serialization of the payment code: the version,
+// an empty features byte, the compressed public key and the chain code
+// followed by reserved zero bytes.
+func (pc PaymentCode) Bytes() []byte {
+	b := make([]byte, PaymentCodeLen)
+	b[0] = 1
+	copy(b[2:35], pc.PubKey.SerializeCompressed())
+	copy(b[35:67], pc.ChainCode)
+	return b
+}
+
+// String returns the base58check encoding of the payment code.
+func (pc PaymentCode) String() string {
+	return base58.CheckEncode(pc.Bytes(), paymentCodeVersion)
+}
+
+// Key returns the public key at index i below the payment code.
+func (pc PaymentCode) Key(i uint32) (*btcec.PublicKey, error) {
+	key := hd.NewExtendedKey(chaincfg.MainNetParams.HDPublicKeyID[:], pc.PubKey.SerializeCompressed(), pc.ChainCode, []byte{0, 0, 0, 0}, 3, 0, false)
+	child, err := key.Child(i)
+	if err != nil {
+		return nil, err
+	}
+	return child.ECPubKey()
+}
+
+// NotificationKey returns the key at index zero. Notifications are paid to
+// its address.
+func (pc PaymentCode) NotificationKey() (*btcec.PublicKey, error) {
+	return pc.Key(0)
+}
+
+// BlindPaymentCode returns the payload of a notification transaction from
+// the payment code pc to the owner of notificationKey. The key's point and
+// chain code are masked with a secret shared between the private key of the
+// transaction's first input and notificationKey, salted with the input's
+// serialized outpoint.
+func BlindPaymentCode(pc PaymentCode, inputKey *btcec.PrivateKey, outpoint []byte, notificationKey *btcec.PublicKey) []byte {
+	b := pc.Bytes()
+	maskPaymentCode(b, sharedX(inputKey, notificationKey), outpoint)
+	return b
+}
+
+// UnblindPaymentCode returns the payment code in a notification payload. The
+// notification key is the private key of the receiver's notification
+// address and inputKey is the public key of the transaction's first input.
+func UnblindPaymentCode(payload []byte, notificationKey *btcec.PrivateKey, outpoint []byte, inputKey *btcec.PublicKey) (PaymentCode, error) {
+	if len(payload) != PaymentCodeLen {
+		return PaymentCode{}, ErrInvalidPaymentCode
+	}
+	b := append([]byte(nil), payload...)
+	maskPaymentCode(b, sharedX(notificationKey, inputKey), outpoint)
+	return paymentCodeFromBytes(b)
+}
+
+// maskPaymentCode XORs the point and chain code of a serialized payment
+// code with the HMAC-SHA512 of the shared secret.
+func maskPaymentCode(b []byte, secret []byte, outpoint []byte) {
+	mac := hmac.New(sha512.New, outpoint)
+	mac.Write(secret)
+	mask := mac.Sum(nil)
+	for i := 0; i < 64; i++ {
+		b[3+i] ^= mask[i]
+	}
+}
+
+// sharedX returns the x coordinate of the ECDH point of the keys.
+func sharedX(priv *btcec.PrivateKey, pub *btcec.PublicKey) []byte {
+	x, _ := btcec.S256().ScalarMult(pub.X, pub.Y, priv.D.Bytes())
+	return padded32(x)
+}
+
+// padded32 returns the 32 byte big endian encoding of n.
+func padded32(n *big.Int) []byte {
+	b := make([]byte, 32)
+	xb := n.Bytes()
+	copy(b[32-len(xb):], xb)
+	return b
+}
+
+// sharedSecret returns the scalar added to the payee's key at the index to
+// make the key of a payment. An error is returned for the rare indexes
+// whose secret isn't a valid scalar, which BIP 47 says to skip.
+func sharedSecret(priv *btcec.PrivateKey, pub *btcec.PublicKey) (*big.Int, error) {
+	h := sha256.Sum256(sharedX(priv, pub))
+	s := new(big.Int).SetBytes(h[:])
+	if s.Sign() == 0 || s.Cmp(btcec.S256().N) >= 0 {
+		return nil, errors.New("invalid shared secret")
+	}
+	return s, nil
+}
+
+// PaymentCodeSendKey returns the public key of the payment at index i from
+// the owner of the notification key to the payment code. The key is the
+// payee's key at the index tweaked by their shared secret.
+func PaymentCodeSendKey(notificationKey *btcec.PrivateKey, to PaymentCode, i uint32) (*btcec.PublicKey, error) {
+	b, err := to.Key(i)
+	if err != nil {
+		return nil, err
+	}
+	s, err := sharedSecret(notificationKey, b)
+	if err != nil {
+		return nil, err
+	}
+	curve := btcec.S256()
+	sx, sy := curve.ScalarBaseMult(padded32(s))
+	x, y := curve.Add(b.X, b.Y, sx, sy)
+	return &btcec.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+// PaymentCodeReceiveKey returns the private key of the payment at index i
+// from the payment code. b is the receiver's key at the index.
+func PaymentCodeReceiveKey(b *btcec.PrivateKey, from PaymentCode) (*btcec.PrivateKey, error) {
+	a, err := from.NotificationKey()
+	if err != nil {
+		return nil, err
+	}
+	s, err := sharedSecret(b, a)
+	if err != nil {
+		return nil, err
+	}
+	d := new(big.Int).Add(b.D, s)
+	d.Mod(d, btcec.S256().N)
+	priv, _ := btcec.PrivKeyFromBytes(btcec.S256(), padded32(d))
+	return priv, nil
+}
+
+// paymentCodeKey derives the payment code key from the account private key.
+// BIP 47 puts it at m / 47' / coin_type' / account' but the keychain only
+// stores the account level so it's derived at account' / 47' instead.
+func paymentCodeKey(accountPrivKey *hd.ExtendedKey) (*hd.ExtendedKey, error) {
+	return accountPrivKey.Child(hd.HardenedKeyStart + paymentCodePurpose)
+}
+
+// setPaymentCodeKey derives the payment code key from the account private
+// key and saves the public code so it can be read while the keychain is
+// locked.
+func (kc *Keychain) setPaymentCodeKey(dbtx database.Tx, accountPrivKey *hd.ExtendedKey) error {
+	if kc.pcAddrFunc == nil {
+		return nil
+	}
+	key, err := paymentCodeKey(accountPrivKey)
+	if err != nil {
+		return err
+	}
+	pc, err := NewPaymentCode(key)
+	if err != nil {
+		ZeroKey(key)
+		return err
+	}
+	kc.paymentCodePrivkey = key
+
+	var coinRecord database.CoinRecord
+	if err := dbtx.Read().Where("coin=?", kc.coinType.CurrencyCode()).Find(&coinRecord).Error; err != nil {
+		return err
+	}
+	if coinRecord.PaymentCode == pc.String() {
+		return nil
+	}
+	coinRecord.PaymentCode = pc.String()
+	return dbtx.Save(&coinRecord)
+}
+
+// PaymentCode returns the wallet's payment code. An encrypted keychain must
+// have been unlocked once for the code to be known.
+func (kc *Keychain) PaymentCode() (PaymentCode, error) {
+	if kc.pcAddrFunc == nil {
+		return PaymentCode{}, ErrPaymentCodesDisabled
+	}
+	if kc.watchOnly {
+		return PaymentCode{}, ErrWatchOnlyKeychain
+	}
+	var coinRecord database.CoinRecord
+	err := kc.db.View(func(tx database.Tx) error {
+		return tx.Read().Where("coin=?", kc.coinType.CurrencyCode()).Find(&coinRecord).Error
+	})
+	if err != nil {
+		return PaymentCode{}, err
+	}
+	if coinRecord.PaymentCode == "" {
+		return PaymentCode{}, ErrEncryptedKeychain
+	}
+	return ParsePaymentCode(coinRecord.PaymentCode)
+}
+
+// PaymentCodeAddress returns the P2PKH address of a key.
+func (kc *Keychain) PaymentCodeAddress(pubKey *btcec.PublicKey) (iwallet.Address, error) {
+	if kc.pcAddrFunc == nil {
+		return iwallet.Address{}, ErrPaymentCodesDisabled
+	}
+	return kc.pcAddrFunc(pubKey)
+}
+
+// NotificationKey returns the private key of the wallet's notification
+// address. It's used to sign and blind notifications to other codes and
+// derive the addresses paid to them. The caller must zero the key.
+func (kc *Keychain) NotificationKey() (*btcec.PrivateKey, error) {
+	kc.mtx.RLock()
+	defer kc.mtx.RUnlock()
+
+	if kc.pcAddrFunc == nil {
+		return nil, ErrPaymentCodesDisabled
+	}
+	if kc.paymentCodePrivkey == nil {
+		return nil, ErrEncryptedKeychain
+	}
+	return childPrivKey(kc.paymentCodePrivkey, 0)
+}
+
+// childPrivKey returns the private key at index i below the key.
+func childPrivKey(key *hd.ExtendedKey, i uint32) (*btcec.PrivateKey, error) {
+	child, err := key.Child(i)
+	if err != nil {
+		return nil, err
+	}
+	defer ZeroKey(child)
+	return child.ECPrivKey()
+}
+
+// AddIncomingPaymentCode records a payment code which has notified the
+// wallet and derives the first addresses it will pay. More are derived as
+// they're used. The keychain must be unlocked.
+func (kc *Keychain) AddIncomingPaymentCode(dbtx database.Tx, from PaymentCode, notificationTxid iwallet.TransactionID) ([]iwallet.Address, error) {
+	kc.mtx.RLock()
+	defer kc.mtx.RUnlock()
+
+	if kc.pcAddrFunc == nil {
+		return nil, ErrPaymentCodesDisabled
+	}
+	if kc.paymentCodePrivkey == nil {
+		return nil, ErrEncryptedKeychain
+	}
+	var record database.PaymentCodeRecord
+	err := dbtx.Read().Where("coin=?", kc.coinType.CurrencyCode()).Where("code=?", from.String()).Where("outgoing=?", false).First(&record).Error
+	if err == nil {
+		return nil, nil
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	err = dbtx.Save(&database.PaymentCodeRecord{
+		Coin:             kc.coinType.CurrencyCode(),
+		Code:             from.String(),
+		Outgoing:         false,
+		NotificationTxid: notificationTxid.String(),
+		CreatedAt:        time.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return kc.extendPaymentCode(dbtx, from)
+}
+
+// IncomingPaymentCodes returns the payment codes which have notified the
+// wallet.
+func (kc *Keychain) IncomingPaymentCodes() ([]PaymentCode, error) {
+	var records []database.PaymentCodeRecord
+	err := kc.db.View(func(tx database.Tx) error {
+		return tx.Read().Where("coin=?", kc.coinType.CurrencyCode()).Where("outgoing=?", false).Find(&records).Error
+	})
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	codes := make([]PaymentCode, 0, len(records))
+	for _, rec := range records {
+		pc, err := ParsePaymentCode(rec.Code)
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, pc)
+	}
+	return codes, nil
+}
+
+// extendPaymentCode derives addresses for the incoming payment code until
+// there are lookaheadWindowSize unused ones after the last used address.
+// The caller must hold the mutex and the payment code key.
+func (kc *Keychain) extendPaymentCode(dbtx database.Tx, from PaymentCode) ([]iwallet.Address, error) {
+	var records []database.PaymentCodeAddressRecord
+	err := dbtx.Read().Where("coin=?", kc.coinType.CurrencyCode()).Where("code=?", from.String()).Find(&records).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	lastUsed, next := -1, 0
+	for _, rec := range records {
+		if rec.Used && rec.KeyIndex > lastUsed {
+			lastUsed = rec.KeyIndex
+		}
+		if rec.KeyIndex >= next {
+			next = rec.KeyIndex + 1
+		}
+	}
+	unused := 0
+	for _, rec := range records {
+		if !rec.Used && rec.KeyIndex > lastUsed {
+			unused++
+		}
+	}
+	var (
+		newRecords []database.PaymentCodeAddressRecord
+		addrs      []iwallet.Address
+	)
+	for ; unused < kc.lookaheadWindowSize; next++ {
+		addr, err := kc.paymentCodeReceiveAddress(kc.paymentCodePrivkey, from, uint32(next))
+		if err != nil {
+			// Indexes whose keys or shared secrets are invalid are
+			// skipped by both sides.
+			continue
+		}
+		newRecords = append(newRecords, database.PaymentCodeAddressRecord{
+			Addr:      addr.String(),
+			Coin:      kc.coinType.CurrencyCode(),
+			Code:      from.String(),
+			KeyIndex:  next,
+			CreatedAt: time.Now(),
+		})
+		addrs = append(addrs, addr)
+		unused++
+	}
+	if len(newRecords) == 0 {
+		return nil, nil
+	}
+	return addrs, dbtx.SaveAll(newRecords)
+}
+
+// paymentCodeReceiveKey returns the private key of the address at index i
+// of the incoming payment code.
+func paymentCodeReceiveKey(codeKey *hd.ExtendedKey, from PaymentCode, i uint32) (*btcec.PrivateKey, error) {
+	b, err := childPrivKey(codeKey, i)
+	if err != nil {
+		return nil, err
+	}
+	defer ZeroPrivKey(b)
+	return PaymentCodeReceiveKey(b, from)
+}
+
+func (kc *Keychain) paymentCodeReceiveAddress(codeKey *hd.ExtendedKey, from PaymentCode, i uint32) (iwallet.Address, error) {
+	priv, err := paymentCodeReceiveKey(codeKey, from, i)
+	if err != nil {
+		return iwallet.Address{}, err
+	}
+	defer ZeroPrivKey(priv)
+	return kc.pcAddrFunc(priv.PubKey())
+}
+
+// paymentCodeAddresses returns the addresses derived for incoming payment
+// codes.
+func (kc *Keychain) paymentCodeAddresses(dbtx database.Tx) ([]iwallet.Address, error) {
+	var records []database.PaymentCodeAddressRecord
+	err := dbtx.Read().Where("coin=?", kc.coinType.CurrencyCode()).Find(&records).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	addrs := make([]iwallet.Address, 0, len(records))
+	for _, rec := range records {
+		addrs = append(addrs, iwallet.NewAddress(rec.Addr, kc.coinType))
+	}
+	return addrs, nil
+}
+
+// paymentCodeKeyForAddress returns the key of an address derived for an
+// incoming payment code. If the keychain is locked the payment code key is
+// derived from accountPrivKey. The caller must hold the mutex.
+func (kc *Keychain) paymentCodeKeyForAddress(dbtx database.Tx, addr iwallet.Address, accountPrivKey *hd.ExtendedKey) (*hd.ExtendedKey, error) {
+	var record database.PaymentCodeAddressRecord
+	err := dbtx.Read().Where("coin=?", kc.coinType.CurrencyCode()).Where("addr=?", addr.String()).First(&record).Error
+	if err != nil {
+		return nil, err
+	}
+	from, err := ParsePaymentCode(record.Code)
+	if err != nil {
+		return nil, err
+	}
+	codeKey := kc.paymentCodePrivkey
+	if codeKey == nil && accountPrivKey != nil {
+		codeKey, err = paymentCodeKey(accountPrivKey)
+		if err != nil {
+			return nil, err
+		}
+		defer ZeroKey(codeKey)
+	}
+	if codeKey == nil {
+		return nil, ErrEncryptedKeychain
+	}
+	priv, err := paymentCodeReceiveKey(codeKey, from, uint32(record.KeyIndex))
+	if err != nil {
+		return nil, err
+	}
+	defer ZeroPrivKey(priv)
+
+	// The key has no chain code as nothing is derived below it.
+	return hd.NewExtendedKey(chaincfg.MainNetParams.HDPrivateKeyID[:], padded32(priv.D), make([]byte, 32), []byte{0, 0, 0, 0}, 0, uint32(record.KeyIndex), true), nil
+}
+
+// markPaymentCodeAddressUsed marks an address of an incoming payment code
+// as used. If the keychain is unlocked more addresses are derived for the
+// code, otherwise that waits until it's next unlocked.
+func (kc *Keychain) markPaymentCodeAddressUsed(dbtx database.Tx, addr iwallet.Address) error {
+	var record database.PaymentCodeAddressRecord
+	err := dbtx.Read().Where("coin=?", kc.coinType.CurrencyCode()).Where("addr=?", addr.String()).First(&record).Error
+	if err != nil {
+		return err
+	}
+	record.Used = true
+	if err := dbtx.Save(&record); err != nil {
+		return err
+	}
+
+	kc.mtx.RLock()
+	defer kc.mtx.RUnlock()
+	if kc.paymentCodePrivkey == nil {
+		return nil
+	}
+	from, err := ParsePaymentCode(record.Code)
+	if err != nil {
+		return err
+	}
+	_, err = kc.extendPaymentCode(dbtx, from)
+	return err
+}
+
+// extendPaymentCodes tops up the addresses of every incoming payment code.
+// It's run when the keychain is unlocked. The caller must hold the mutex.
+func (kc *Keychain) extendPaymentCodes(dbtx database.Tx) error {
+	if kc.pcAddrFunc == nil || kc.paymentCodePrivkey == nil {
+		return nil
+	}
+	var records []database.PaymentCodeRecord
+	err := dbtx.Read().Where("coin=?", kc.coinType.CurrencyCode()).Where("outgoing=?", false).Find(&records).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+	for _, rec := range records {
+		from, err := ParsePaymentCode(rec.Code)
+		if err != nil {
+			return fmt.Errorf("payment code %s: %w", rec.Code, err)
+		}
+		if _, err := kc.extendPaymentCode(dbtx, from); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,299 @@
+package base
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil"
+	hd "github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"testing"
+)
+
+// The BIP 47 test vectors.
+const (
+	aliceSeed        = "64dca76abc9c6f0cf3d212d248c380c4622c8f93b2c425ec6a5567fd5db57e10d3e6f94a2f6af4ac2edb8998072aad92098db73558c323777abf5bd1082d970a"
+	alicePaymentCode = "PM8TJTLJbPRGxSbc8EJi42Wrr6QbNSaSSVJ5Y3E4pbCYiTHUskHg13935Ubb7q8tx9GVbh2UuRnBc3WSyJHhUrw8KhprKnn9eDznYGieTzFcwQRya4GA"
+	bobPaymentCode   = "PM8TJS2JxQ5ztXUpBBRnpTbcUXbUHy2T1abfrb3KkAAtMEGNbey4oumH7Hc578WgQJhPjBxteQ5GHHToTYHE3A1w6p7tU6KSoFmWBVbFGjKPisZDbP97"
+)
+
+func testP2PKHAddress(pubKey *btcec.PublicKey) (iwallet.Address, error) {
+	addr, err := btcutil.NewAddressPubKeyHash(btcutil.Hash160(pubKey.SerializeCompressed()), &chaincfg.MainNetParams)
+	if err != nil {
+		return iwallet.Address{}, err
+	}
+	return iwallet.NewAddress(addr.String(), iwallet.CtMock), nil
+}
+
+// alicePaymentCodeKey derives Alice's payment code key at m/47'/0'/0'.
+func alicePaymentCodeKey(t *testing.T) *hd.ExtendedKey {
+	seed, err := hex.DecodeString(aliceSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := hd.NewMaster(seed, &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []uint32{47, 0, 0} {
+		key, err = key.Child(hd.HardenedKeyStart + i)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return key
+}
+
+func TestPaymentCode_Vectors(t *testing.T) {
+	key := alicePaymentCodeKey(t)
+	alice, err := NewPaymentCode(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alice.String() != alicePaymentCode {
+		t.Errorf("Expected payment code %s, got %s", alicePaymentCode, alice.String())
+	}
+
+	notificationKey, err := alice.NotificationKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := testP2PKHAddress(notificationKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.String() != "1JDdmqFLhpzcUwPeinhJbUPw4Co3aWLyzW" {
+		t.Errorf("Incorrect notification address %s", addr)
+	}
+
+	bob, err := ParsePaymentCode(bobPaymentCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bob.String() != bobPaymentCode {
+		t.Errorf("Payment code did not round trip")
+	}
+
+	a, err := childPrivKey(key, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"141fi7TY3h936vRUKh1qfUZr8rSBuYbVBK",
+		"12u3Uued2fuko2nY4SoSFGCoGLCBUGPkk6",
+		"1FsBVhT5dQutGwaPePTYMe5qvYqqjxyftc",
+	}
+	for i, exp := range expected {
+		pubKey, err := PaymentCodeSendKey(a, bob, uint32(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr, err := testP2PKHAddress(pubKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr.String() != exp {
+			t.Errorf("Payment %d: expected address %s, got %s", i, exp, addr)
+		}
+	}
+}
+
+func TestParsePaymentCode_Invalid(t *testing.T) {
+	tests := []string{
+		"",
+		"PM8TJTLJbPRGxSbc8EJi42Wrr6QbNSaSSVJ5Y3E4pbCYiTHUskHg13935Ubb7q8tx9GVbh2UuRnBc3WSyJHhUrw8KhprKnn9eDznYGieTzFcwQRya4GB",
+		"1JDdmqFLhpzcUwPeinhJbUPw4Co3aWLyzW",
+	}
+	for _, test := range tests {
+		if _, err := ParsePaymentCode(test); err != ErrInvalidPaymentCode {
+			t.Errorf("Expected ErrInvalidPaymentCode for %q, got %v", test, err)
+		}
+	}
+}
+
+func TestPaymentCode_Notification(t *testing.T) {
+	alice, err := ParsePaymentCode(alicePaymentCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobKey, err := hd.NewMaster(bytes.Repeat([]byte{0x01}, 32), &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobNotification, err := childPrivKey(bobKey, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	outpoint := bytes.Repeat([]byte{0x02}, 36)
+
+	payload := BlindPaymentCode(alice, inputKey, outpoint, bobNotification.PubKey())
+	if bytes.Equal(payload, alice.Bytes()) {
+		t.Fatal("Payment code was not blinded")
+	}
+	unblinded, err := UnblindPaymentCode(payload, bobNotification, outpoint, inputKey.PubKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unblinded.String() != alicePaymentCode {
+		t.Errorf("Expected %s, got %s", alicePaymentCode, unblinded)
+	}
+
+	// Anyone else unblinds garbage.
+	other, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	unblinded, err = UnblindPaymentCode(payload, other, outpoint, inputKey.PubKey())
+	if err == nil && unblinded.String() == alicePaymentCode {
+		t.Error("Payment code unblinded with the wrong key")
+	}
+}
+
+func TestPaymentCode_SendReceive(t *testing.T) {
+	aliceKey := alicePaymentCodeKey(t)
+	alice, err := NewPaymentCode(aliceKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := childPrivKey(aliceKey, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobKey, err := hd.NewMaster(bytes.Repeat([]byte{0x01}, 32), &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := NewPaymentCode(bobKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := uint32(0); i < 5; i++ {
+		sendKey, err := PaymentCodeSendKey(a, bob, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		receiveKey, err := paymentCodeReceiveKey(bobKey, alice, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !receiveKey.PubKey().IsEqual(sendKey) {
+			t.Errorf("Payment %d: receive key does not match send key", i)
+		}
+	}
+}
+
+func TestKeychain_PaymentCodes(t *testing.T) {
+	kc, err := setupKeychain(PaymentCodes(testP2PKHAddress))
+	if err != nil {
+		t.Fatal(err)
+	}
+	own, err := kc.PaymentCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParsePaymentCode(own.String()); err != nil {
+		t.Fatal(err)
+	}
+
+	aliceKey := alicePaymentCodeKey(t)
+	alice, err := NewPaymentCode(aliceKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var addrs []iwallet.Address
+	err = kc.db.Update(func(tx database.Tx) error {
+		addrs, err = kc.AddIncomingPaymentCode(tx, alice, "abc")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != defaultLookaheadWindow {
+		t.Fatalf("Expected %d addresses, got %d", defaultLookaheadWindow, len(addrs))
+	}
+
+	// The addresses match the ones Alice pays.
+	a, err := childPrivKey(aliceKey, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendKey, err := PaymentCodeSendKey(a, own, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := testP2PKHAddress(sendKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.String() != addrs[0].String() {
+		t.Errorf("Expected first address %s, got %s", first, addrs[0])
+	}
+
+	all, err := kc.GetAddresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, addr := range all {
+		if addr.String() == first.String() {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("Payment code address not returned by GetAddresses")
+	}
+
+	has, err := kc.HasKey(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !has {
+		t.Error("Expected HasKey to return true")
+	}
+
+	err = kc.db.Update(func(tx database.Tx) error {
+		key, err := kc.KeyForAddress(tx, first, nil)
+		if err != nil {
+			return err
+		}
+		priv, err := key.ECPrivKey()
+		if err != nil {
+			return err
+		}
+		if !priv.PubKey().IsEqual(sendKey) {
+			t.Error("KeyForAddress returned the wrong key")
+		}
+		return kc.MarkAddressAsUsed(tx, first)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var records []database.PaymentCodeAddressRecord
+	err = kc.db.View(func(tx database.Tx) error {
+		return tx.Read().Where("code=?", alice.String()).Find(&records).Error
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != defaultLookaheadWindow+1 {
+		t.Errorf("Expected %d addresses after use, got %d", defaultLookaheadWindow+1, len(records))
+	}
+}
+
+func TestKeychain_PaymentCodesDisabled(t *testing.T) {
+	kc, err := setupKeychain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kc.PaymentCode(); err != ErrPaymentCodesDisabled {
+		t.Errorf("Expected ErrPaymentCodesDisabled, got %v", err)
+	}
+}
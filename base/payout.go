@@ -0,0 +1,127 @@
+package base
+
+import (
+	"errors"
+	iwallet "github.com/cpacia/wallet-interface"
+	"math/big"
+)
+
+// PayoutShareTotal is the sum of the shares in a PayoutSplit. Shares are in
+// basis points.
+const PayoutShareTotal = 10000
+
+// PayoutSplit describes how the funds in an escrow are paid out when a
+// dispute is resolved. The moderator's fee is paid first and the rest is
+// split between the buyer and vendor by their shares, which must add up to
+// PayoutShareTotal. The transaction fee is taken from the escrow before
+// anything is paid out.
+type PayoutSplit struct {
+	Buyer       iwallet.Address
+	BuyerShare  int
+	Vendor      iwallet.Address
+	VendorShare int
+
+	Moderator    iwallet.Address
+	ModeratorFee iwallet.Amount
+}
+
+// DisputePayout is an unsigned dispute payout transaction.
+type DisputePayout struct {
+	// Transaction is passed to SignMultisigTransaction by each party and
+	// then to BuildAndSend.
+	Transaction iwallet.Transaction
+
+	// UnsignedTx is the serialized unsigned transaction and Txid its ID.
+	UnsignedTx []byte
+	Txid       iwallet.TransactionID
+
+	// SigHashes are the hashes signed for each input. They are the same
+	// for every party.
+	SigHashes [][]byte
+
+	Fee iwallet.Amount
+}
+
+// PayoutOutputs returns the outputs paying total out according to the
+// split, in the order buyer, vendor, moderator. Parties due nothing get no
+// output. Outputs isDust reports as dust are dropped and their value is
+// redistributed to the remaining outputs in proportion to their amounts.
+func PayoutOutputs(total iwallet.Amount, split PayoutSplit, isDust func(iwallet.Amount) bool) ([]iwallet.SpendInfo, error) {
+	if split.BuyerShare < 0 || split.VendorShare < 0 || split.BuyerShare+split.VendorShare != PayoutShareTotal {
+		return nil, errors.New("payout shares must add up to 100%")
+	}
+	remaining, ok := new(big.Int).SetString(total.String(), 10)
+	if !ok || remaining.Sign() <= 0 {
+		return nil, errors.New("nothing to pay out")
+	}
+	moderatorFee := big.NewInt(0)
+	if split.ModeratorFee.String() != "" {
+		moderatorFee, ok = new(big.Int).SetString(split.ModeratorFee.String(), 10)
+		if !ok || moderatorFee.Sign() < 0 {
+			return nil, errors.New("invalid moderator fee")
+		}
+	}
+	if moderatorFee.Cmp(remaining) > 0 {
+		return nil, errors.New("moderator fee exceeds escrow value")
+	}
+	remaining.Sub(remaining, moderatorFee)
+
+	buyer := new(big.Int).Mul(remaining, big.NewInt(int64(split.BuyerShare)))
+	buyer.Quo(buyer, big.NewInt(PayoutShareTotal))
+	vendor := new(big.Int).Sub(remaining, buyer)
+
+	type payout struct {
+		addr   iwallet.Address
+		amount *big.Int
+	}
+	var payouts []payout
+	for _, p := range []payout{{split.Buyer, buyer}, {split.Vendor, vendor}, {split.Moderator, moderatorFee}} {
+		if p.amount.Sign() > 0 {
+			payouts = append(payouts, p)
+		}
+	}
+
+	var (
+		kept      []payout
+		keptTotal = big.NewInt(0)
+		dust      = big.NewInt(0)
+	)
+	for _, p := range payouts {
+		if isDust(iwallet.NewAmount(p.amount.String())) {
+			dust.Add(dust, p.amount)
+			continue
+		}
+		kept = append(kept, p)
+		keptTotal.Add(keptTotal, p.amount)
+	}
+	if len(kept) == 0 {
+		return nil, errors.New("every payout is dust")
+	}
+
+	// Any remainder from rounding goes to the largest output.
+	if dust.Sign() > 0 {
+		largest := 0
+		for i, p := range kept {
+			if p.amount.Cmp(kept[largest].amount) > 0 {
+				largest = i
+			}
+		}
+		distributed := big.NewInt(0)
+		for i, p := range kept {
+			share := new(big.Int).Mul(dust, p.amount)
+			share.Quo(share, keptTotal)
+			distributed.Add(distributed, share)
+			kept[i].amount = new(big.Int).Add(p.amount, share)
+		}
+		kept[largest].amount.Add(kept[largest].amount, dust.Sub(dust, distributed))
+	}
+
+	outputs := make([]iwallet.SpendInfo, 0, len(kept))
+	for _, p := range kept {
+		outputs = append(outputs, iwallet.SpendInfo{
+			Address: p.addr,
+			Amount:  iwallet.NewAmount(p.amount.String()),
+		})
+	}
+	return outputs, nil
+}
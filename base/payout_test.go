@@ -0,0 +1,119 @@
+package base
+
+import (
+	iwallet "github.com/cpacia/wallet-interface"
+	"testing"
+)
+
+func TestPayoutOutputs(t *testing.T) {
+	var (
+		buyer     = iwallet.NewAddress("buyer", iwallet.CtMock)
+		vendor    = iwallet.NewAddress("vendor", iwallet.CtMock)
+		moderator = iwallet.NewAddress("moderator", iwallet.CtMock)
+	)
+	isDust := func(amount iwallet.Amount) bool {
+		return amount.Cmp(iwallet.NewAmount(546)) < 0
+	}
+
+	tests := []struct {
+		name        string
+		total       int64
+		buyerShare  int
+		moderator   int64
+		expected    map[iwallet.Address]int64
+		expectedErr bool
+	}{
+		{
+			name:       "even split",
+			total:      100000,
+			buyerShare: 5000,
+			moderator:  10000,
+			expected:   map[iwallet.Address]int64{buyer: 45000, vendor: 45000, moderator: 10000},
+		},
+		{
+			name:       "all to the buyer",
+			total:      100000,
+			buyerShare: 10000,
+			moderator:  5000,
+			expected:   map[iwallet.Address]int64{buyer: 95000, moderator: 5000},
+		},
+		{
+			name:       "rounding",
+			total:      10001,
+			buyerShare: 3333,
+			expected:   map[iwallet.Address]int64{buyer: 3333, vendor: 6668},
+		},
+		{
+			// The vendor's 271 is split between the buyer and
+			// moderator with the remainder going to the buyer.
+			name:       "dust vendor output",
+			total:      100300,
+			buyerShare: 9970,
+			moderator:  10000,
+			expected:   map[iwallet.Address]int64{buyer: 90273, moderator: 10027},
+		},
+		{
+			// The moderator's 500 is split between the buyer and
+			// vendor with the remainder going to the vendor.
+			name:       "dust moderator fee with remainder",
+			total:      90500,
+			buyerShare: 3333,
+			moderator:  500,
+			expected:   map[iwallet.Address]int64{buyer: 30163, vendor: 60337},
+		},
+		{
+			name:        "all dust",
+			total:       800,
+			buyerShare:  5000,
+			expectedErr: true,
+		},
+		{
+			name:        "moderator fee too large",
+			total:       1000,
+			buyerShare:  5000,
+			moderator:   1001,
+			expectedErr: true,
+		},
+		{
+			name:        "bad shares",
+			total:       100000,
+			buyerShare:  10001,
+			expectedErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		split := PayoutSplit{
+			Buyer:        buyer,
+			BuyerShare:   test.buyerShare,
+			Vendor:       vendor,
+			VendorShare:  PayoutShareTotal - test.buyerShare,
+			Moderator:    moderator,
+			ModeratorFee: iwallet.NewAmount(test.moderator),
+		}
+		outputs, err := PayoutOutputs(iwallet.NewAmount(test.total), split, isDust)
+		if test.expectedErr {
+			if err == nil {
+				t.Errorf("%s: expected error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if len(outputs) != len(test.expected) {
+			t.Errorf("%s: expected %d outputs, got %d", test.name, len(test.expected), len(outputs))
+		}
+		sum := iwallet.NewAmount(0)
+		for _, out := range outputs {
+			if out.Amount.Cmp(iwallet.NewAmount(test.expected[out.Address])) != 0 {
+				t.Errorf("%s: expected %d for %s, got %s", test.name, test.expected[out.Address], out.Address, out.Amount)
+			}
+			sum = sum.Add(out.Amount)
+		}
+		if sum.Cmp(iwallet.NewAmount(test.total)) != 0 {
+			t.Errorf("%s: expected outputs to add up to %d, got %s", test.name, test.total, sum)
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package base
+
+import (
+	"errors"
+	"fmt"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"gorm.io/gorm"
+	"math"
+	"sort"
+)
+
+// The kinds of PrivacySuggestion.
+const (
+	// SuggestionAddressReuse flags an address which received more than
+	// one payment. Every payment to it is linked to the others.
+	SuggestionAddressReuse = "address-reuse"
+
+	// SuggestionConsolidation warns that the utxos belong to separate
+	// clusters which spending them together, such as when consolidating,
+	// would link.
+	SuggestionConsolidation = "consolidation"
+
+	// SuggestionMergedInputs flags spends which merged inputs from
+	// several addresses, linking them to one owner.
+	SuggestionMergedInputs = "merged-inputs"
+)
+
+// PrivacySuggestion is an action which would improve, or avoid harming,
+// the wallet's privacy. Addresses are those the suggestion is about.
+type PrivacySuggestion struct {
+	Kind      string   `json:"kind"`
+	Message   string   `json:"message"`
+	Addresses []string `json:"addresses,omitempty"`
+}
+
+// ReusedAddress is a wallet address which received more than one payment.
+type ReusedAddress struct {
+	Address  string `json:"address"`
+	Payments int    `json:"payments"`
+}
+
+// PrivacyReport describes how linkable the wallet's addresses and utxos are
+// to an observer of the chain using the common heuristics:
+//
+//   - Address reuse links every payment to the address.
+//   - Merged inputs, spending from several addresses in one transaction,
+//     links the addresses to one owner.
+//   - Change linkage: change is linked to the addresses it was spent from.
+//
+// Addresses linked by these are grouped into clusters. Score runs from 0,
+// every utxo linked, to 100 with nothing linked.
+type PrivacyReport struct {
+	Score int `json:"score"`
+
+	// Utxos is the number of utxos and LinkedUtxos those whose address
+	// is reused or in a cluster with other addresses.
+	Utxos       int `json:"utxos"`
+	LinkedUtxos int `json:"linkedUtxos"`
+
+	// ReusedAddresses are ordered by the number of payments, most first.
+	ReusedAddresses []ReusedAddress `json:"reusedAddresses"`
+
+	// Spends is the number of transactions spending from the wallet,
+	// MergedInputs those which spent from more than one address and
+	// LinkedChange the change outputs of the spends.
+	Spends       int `json:"spends"`
+	MergedInputs int `json:"mergedInputs"`
+	LinkedChange int `json:"linkedChange"`
+
+	// Clusters are the groups of more than one address known to belong
+	// to the wallet, largest first.
+	Clusters [][]string `json:"clusters"`
+
+	Suggestions []PrivacySuggestion `json:"suggestions"`
+}
+
+// The weights of the reuse, merged input and linked utxo ratios in the
+// privacy score.
+const (
+	reuseWeight  = 40
+	mergeWeight  = 30
+	linkedWeight = 30
+)
+
+// PrivacyReport analyses the wallet's history and utxos for how linkable
+// they are and suggests what to do about it.
+func (w *WalletBase) PrivacyReport() (PrivacyReport, error) {
+	var (
+		addrRecords []database.AddressRecord
+		txRecords   []database.TransactionRecord
+		utxoRecords []database.UtxoRecord
+	)
+	err := w.DB.View(func(dbtx database.Tx) error {
+		if err := dbtx.Read().Where("coin=?", w.CoinType.CurrencyCode()).Find(&addrRecords).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		if err := dbtx.Read().Where("coin=?", w.CoinType.CurrencyCode()).Find(&txRecords).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		if err := dbtx.Read().Where("coin=?", w.CoinType.CurrencyCode()).Find(&utxoRecords).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return PrivacyReport{}, err
+	}
+
+	change := make(map[string]bool, len(addrRecords))
+	for _, rec := range addrRecords {
+		change[rec.Addr] = rec.Change
+	}
+	txs := make([]iwallet.Transaction, 0, len(txRecords))
+	for _, rec := range txRecords {
+		if rec.Dropped() {
+			continue
+		}
+		tx, err := rec.Transaction()
+		if err != nil {
+			return PrivacyReport{}, err
+		}
+		txs = append(txs, tx)
+	}
+	return analyzePrivacy(change, txs, utxoRecords), nil
+}
+
+// analyzePrivacy builds the report from the wallet's transactions and utxos.
+// owned maps each wallet address to whether it's a change address.
+func analyzePrivacy(owned map[string]bool, txs []iwallet.Transaction, utxos []database.UtxoRecord) PrivacyReport {
+	report := PrivacyReport{
+		Utxos:           len(utxos),
+		ReusedAddresses: []ReusedAddress{},
+		Clusters:        [][]string{},
+		Suggestions:     []PrivacySuggestion{},
+	}
+	clusters := newAddressClusters()
+	payments := make(map[string]int)
+	var merged []string
+
+	for _, tx := range txs {
+		var inputs []string
+		seen := make(map[string]bool)
+		for _, from := range tx.From {
+			addr := from.Address.String()
+			if _, ok := owned[addr]; ok && !seen[addr] {
+				seen[addr] = true
+				inputs = append(inputs, addr)
+			}
+		}
+		for _, to := range tx.To {
+			addr := to.Address.String()
+			isChange, ok := owned[addr]
+			if !ok {
+				continue
+			}
+			if len(inputs) > 0 && isChange {
+				report.LinkedChange++
+				clusters.union(inputs[0], addr)
+				continue
+			}
+			payments[addr]++
+		}
+		if len(inputs) == 0 {
+			continue
+		}
+		report.Spends++
+		if len(inputs) > 1 {
+			report.MergedInputs++
+			merged = append(merged, inputs[0])
+		}
+		for _, addr := range inputs[1:] {
+			clusters.union(inputs[0], addr)
+		}
+	}
+
+	usedAddrs := 0
+	for addr, n := range payments {
+		usedAddrs++
+		if n > 1 {
+			report.ReusedAddresses = append(report.ReusedAddresses, ReusedAddress{
+				Address:  addr,
+				Payments: n,
+			})
+		}
+	}
+	sort.Slice(report.ReusedAddresses, func(i, j int) bool {
+		a, b := report.ReusedAddresses[i], report.ReusedAddresses[j]
+		if a.Payments != b.Payments {
+			return a.Payments > b.Payments
+		}
+		return a.Address < b.Address
+	})
+
+	report.Clusters = append(report.Clusters, clusters.groups()...)
+
+	// A utxo is linked if its address is reused or clustered. The
+	// clusters the utxos are in, counting each lone address as its own,
+	// are what spending them all together would link.
+	utxoClusters := make(map[string]bool)
+	for _, u := range utxos {
+		if payments[u.Address] > 1 || clusters.size(u.Address) > 1 {
+			report.LinkedUtxos++
+		}
+		utxoClusters[clusters.find(u.Address)] = true
+	}
+
+	for _, reused := range report.ReusedAddresses {
+		report.Suggestions = append(report.Suggestions, PrivacySuggestion{
+			Kind:      SuggestionAddressReuse,
+			Message:   fmt.Sprintf("Address %s received %d payments. Give each payer a new address.", reused.Address, reused.Payments),
+			Addresses: []string{reused.Address},
+		})
+	}
+	if report.MergedInputs > 0 {
+		report.Suggestions = append(report.Suggestions, PrivacySuggestion{
+			Kind:      SuggestionMergedInputs,
+			Message:   fmt.Sprintf("%d of %d spends merged inputs from several addresses. Use coin control to spend from one source where possible.", report.MergedInputs, report.Spends),
+			Addresses: merged,
+		})
+	}
+	if len(utxoClusters) > 1 {
+		report.Suggestions = append(report.Suggestions, PrivacySuggestion{
+			Kind:    SuggestionConsolidation,
+			Message: fmt.Sprintf("The %d utxos belong to %d unlinked clusters. Consolidating them, or spending them together, would link the clusters.", len(utxos), len(utxoClusters)),
+		})
+	}
+
+	var reuse, merge, linked float64
+	if usedAddrs > 0 {
+		reuse = float64(len(report.ReusedAddresses)) / float64(usedAddrs)
+	}
+	if report.Spends > 0 {
+		merge = float64(report.MergedInputs) / float64(report.Spends)
+	}
+	if report.Utxos > 0 {
+		linked = float64(report.LinkedUtxos) / float64(report.Utxos)
+	}
+	report.Score = 100 - int(math.Round(reuseWeight*reuse+mergeWeight*merge+linkedWeight*linked))
+	return report
+}
+
+// addressClusters is a union-find over addresses. Only addresses which
+// have been joined to another are in parent. Roots aren't.
+type addressClusters struct {
+	parent map[string]string
+	sizes  map[string]int
+}
+
+func newAddressClusters() *addressClusters {
+	return &addressClusters{
+		parent: make(map[string]string),
+		sizes:  make(map[string]int),
+	}
+}
+
+func (c *addressClusters) find(addr string) string {
+	root := addr
+	for {
+		p, ok := c.parent[root]
+		if !ok || p == root {
+			break
+		}
+		root = p
+	}
+	// Compress the path so later finds are quick.
+	for addr != root {
+		next := c.parent[addr]
+		c.parent[addr] = root
+		addr = next
+	}
+	return root
+}
+
+func (c *addressClusters) union(a, b string) {
+	ra, rb := c.find(a), c.find(b)
+	if ra == rb {
+		return
+	}
+	sa, sb := c.size(ra), c.size(rb)
+	if sa < sb {
+		ra, rb = rb, ra
+	}
+	c.parent[rb] = ra
+	c.sizes[ra] = sa + sb
+	delete(c.sizes, rb)
+}
+
+// size returns the number of addresses in the address's cluster.
+func (c *addressClusters) size(addr string) int {
+	if n, ok := c.sizes[c.find(addr)]; ok {
+		return n
+	}
+	return 1
+}
+
+// groups returns the clusters of more than one address, largest first.
+// The addresses in each are sorted.
+func (c *addressClusters) groups() [][]string {
+	members := make(map[string][]string)
+	for addr := range c.parent {
+		root := c.find(addr)
+		members[root] = append(members[root], addr)
+	}
+	var groups [][]string
+	for root, addrs := range members {
+		addrs = append(addrs, root)
+		sort.Strings(addrs)
+		groups = append(groups, addrs)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if len(groups[i]) != len(groups[j]) {
+			return len(groups[i]) > len(groups[j])
+		}
+		return groups[i][0] < groups[j][0]
+	})
+	return groups
+}
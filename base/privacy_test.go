@@ -0,0 +1,78 @@
+package base
+
+import (
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"reflect"
+	"testing"
+)
+
+func TestAnalyzePrivacy(t *testing.T) {
+	owned := map[string]bool{
+		"r1": false,
+		"r2": false,
+		"r3": false,
+		"c1": true,
+	}
+	spendInfo := func(addr string) iwallet.SpendInfo {
+		return iwallet.SpendInfo{
+			ID:      mockOutpoint(),
+			Address: iwallet.NewAddress(addr, iwallet.CtMock),
+			Amount:  iwallet.NewAmount(1000),
+		}
+	}
+	tx := func(from []string, to []string) iwallet.Transaction {
+		tx := NewMockTransaction(nil, nil)
+		tx.From, tx.To = nil, nil
+		for _, addr := range from {
+			tx.From = append(tx.From, spendInfo(addr))
+		}
+		for _, addr := range to {
+			tx.To = append(tx.To, spendInfo(addr))
+		}
+		return tx
+	}
+	txs := []iwallet.Transaction{
+		tx([]string{"ext"}, []string{"r1"}),
+		tx([]string{"ext"}, []string{"r1"}),
+		tx([]string{"ext"}, []string{"r2"}),
+		// Merges r1 and r2 and pays change to c1.
+		tx([]string{"r1", "r1", "r2"}, []string{"ext", "c1"}),
+		tx([]string{"ext"}, []string{"r3"}),
+	}
+	utxos := []database.UtxoRecord{
+		{Address: "c1"},
+		{Address: "r3"},
+	}
+
+	report := analyzePrivacy(owned, txs, utxos)
+
+	if !reflect.DeepEqual(report.ReusedAddresses, []ReusedAddress{{Address: "r1", Payments: 2}}) {
+		t.Errorf("Unexpected reused addresses %v", report.ReusedAddresses)
+	}
+	if report.Spends != 1 || report.MergedInputs != 1 || report.LinkedChange != 1 {
+		t.Errorf("Expected one spend merging inputs with linked change, got %d %d %d", report.Spends, report.MergedInputs, report.LinkedChange)
+	}
+	if !reflect.DeepEqual(report.Clusters, [][]string{{"c1", "r1", "r2"}}) {
+		t.Errorf("Unexpected clusters %v", report.Clusters)
+	}
+	if report.Utxos != 2 || report.LinkedUtxos != 1 {
+		t.Errorf("Expected one of two utxos to be linked, got %d of %d", report.LinkedUtxos, report.Utxos)
+	}
+	var kinds []string
+	for _, s := range report.Suggestions {
+		kinds = append(kinds, s.Kind)
+	}
+	if !reflect.DeepEqual(kinds, []string{SuggestionAddressReuse, SuggestionMergedInputs, SuggestionConsolidation}) {
+		t.Errorf("Unexpected suggestions %v", kinds)
+	}
+	// 40 * 1/3 reused + 30 * 1/1 merged + 30 * 1/2 linked.
+	if report.Score != 42 {
+		t.Errorf("Expected score 42, got %d", report.Score)
+	}
+
+	empty := analyzePrivacy(owned, nil, nil)
+	if empty.Score != 100 || len(empty.Suggestions) != 0 {
+		t.Errorf("Expected a perfect score with no suggestions, got %d %v", empty.Score, empty.Suggestions)
+	}
+}
@@ -0,0 +1,182 @@
+package base
+
+import (
+	"errors"
+	iwallet "github.com/cpacia/wallet-interface"
+	"sync"
+	"time"
+)
+
+// progressInterval is the most often a ScanTracker emits ScanProgressEvents.
+const progressInterval = time.Millisecond * 250
+
+// ScanProgress is the progress of a scan of the wallet's address history,
+// such as a restore or a rescan.
+type ScanProgress struct {
+	CoinType   iwallet.CoinType
+	FromHeight uint64
+	StartedAt  time.Time
+
+	// AddressesScanned is the number of addresses whose history has
+	// been fetched.
+	AddressesScanned int
+
+	// AddressesTotal is the number of addresses the scan has queued so
+	// far. It grows as used addresses are found and more are derived.
+	AddressesTotal int
+
+	// Transactions is the number of new transactions ingested into the
+	// wallet.
+	Transactions int
+
+	// Remaining is the estimated time left, from the rate addresses have
+	// been scanned at. It's zero until an address has been scanned.
+	Remaining time.Duration
+
+	// Done is set once the scan has finished. Err is the error it failed
+	// with, if any.
+	Done bool
+	Err  error
+}
+
+// Percent returns the percentage of the queued addresses which have been
+// scanned. It's 100 once the scan is done.
+func (p ScanProgress) Percent() float64 {
+	if p.Done {
+		return 100
+	}
+	if p.AddressesTotal == 0 {
+		return 0
+	}
+	return float64(p.AddressesScanned) * 100 / float64(p.AddressesTotal)
+}
+
+// ScanProgressEvent is emitted as a scan progresses, at most every
+// quarter of a second, and when it finishes.
+type ScanProgressEvent struct {
+	ScanProgress
+}
+
+// ScanTracker tracks the progress of one scan and emits it on a Bus.
+type ScanTracker struct {
+	progress ScanProgress
+	bus      Bus
+	lastEmit time.Time
+	mtx      sync.Mutex
+}
+
+// NewScanTracker returns a tracker for a scan starting now. bus may be nil.
+func NewScanTracker(coinType iwallet.CoinType, fromHeight uint64, bus Bus) *ScanTracker {
+	return &ScanTracker{
+		progress: ScanProgress{
+			CoinType:   coinType,
+			FromHeight: fromHeight,
+			StartedAt:  time.Now(),
+		},
+		bus: bus,
+	}
+}
+
+// AddAddresses adds n addresses to those queued.
+func (t *ScanTracker) AddAddresses(n int) {
+	t.update(false, func(p *ScanProgress) {
+		p.AddressesTotal += n
+	})
+}
+
+// Scanned records that the history of an address has been fetched.
+func (t *ScanTracker) Scanned() {
+	t.update(false, func(p *ScanProgress) {
+		p.AddressesScanned++
+	})
+}
+
+// Ingested adds n new transactions to those ingested.
+func (t *ScanTracker) Ingested(n int) {
+	t.update(false, func(p *ScanProgress) {
+		p.Transactions += n
+	})
+}
+
+// Finish marks the scan as done.
+func (t *ScanTracker) Finish(err error) {
+	t.update(true, func(p *ScanProgress) {
+		p.Done = true
+		p.Err = err
+		p.Remaining = 0
+	})
+}
+
+// Progress returns the progress of the scan.
+func (t *ScanTracker) Progress() ScanProgress {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	return t.progress
+}
+
+// update changes the progress and emits it if it's been long enough since
+// it was last emitted or force is set. The event is emitted after the lock
+// is released as the Bus blocks until subscribers receive it.
+func (t *ScanTracker) update(force bool, f func(p *ScanProgress)) {
+	t.mtx.Lock()
+	f(&t.progress)
+	p := &t.progress
+	if !p.Done && p.AddressesScanned > 0 {
+		perAddress := time.Since(p.StartedAt) / time.Duration(p.AddressesScanned)
+		p.Remaining = perAddress * time.Duration(p.AddressesTotal-p.AddressesScanned)
+	}
+	emit := t.bus != nil && (force || time.Since(t.lastEmit) >= progressInterval)
+	if emit {
+		t.lastEmit = time.Now()
+	}
+	progress := t.progress
+	t.mtx.Unlock()
+
+	if emit {
+		t.bus.Emit(&ScanProgressEvent{progress})
+	}
+}
+
+// newScanTracker starts tracking a new scan. It replaces the scan reported
+// by ScanProgress.
+func (cm *ChainManager) newScanTracker(fromHeight uint64) *ScanTracker {
+	tracker := NewScanTracker(cm.coinType, fromHeight, cm.walletBus)
+	cm.statusMtx.Lock()
+	cm.scan = tracker
+	cm.statusMtx.Unlock()
+	return tracker
+}
+
+// ScanProgress returns the progress of the last scan, or false if there
+// hasn't been one.
+func (cm *ChainManager) ScanProgress() (ScanProgress, bool) {
+	cm.statusMtx.Lock()
+	tracker := cm.scan
+	cm.statusMtx.Unlock()
+
+	if tracker == nil {
+		return ScanProgress{}, false
+	}
+	return tracker.Progress(), true
+}
+
+// ScanProgress returns the progress of the wallet's last restore or rescan,
+// or false if there hasn't been one since it was opened.
+func (w *WalletBase) ScanProgress() (ScanProgress, bool) {
+	if w.ChainManager == nil {
+		return ScanProgress{}, false
+	}
+	return w.ChainManager.ScanProgress()
+}
+
+// SubscribeScanProgress returns a subscription to the *ScanProgressEvents of
+// the wallet's restores and rescans. The wallet must be open. The scan
+// blocks until the events are received so the subscription must be drained
+// or closed.
+func (w *WalletBase) SubscribeScanProgress() (Subscription, error) {
+	if w.ChainManager == nil {
+		return nil, errors.New("wallet is not open")
+	}
+	return w.ChainManager.walletBus.Subscribe(&ScanProgressEvent{})
+}
@@ -0,0 +1,111 @@
+package base
+
+import (
+	iwallet "github.com/cpacia/wallet-interface"
+	"testing"
+	"time"
+)
+
+func TestScanTracker(t *testing.T) {
+	bus := NewBus()
+	sub, err := bus.Subscribe(&ScanProgressEvent{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	tracker := NewScanTracker(iwallet.CtMock, 100, bus)
+	events := make(chan *ScanProgressEvent, 10)
+	go func() {
+		for event := range sub.Out() {
+			events <- event.(*ScanProgressEvent)
+		}
+	}()
+
+	tracker.AddAddresses(4)
+	select {
+	case event := <-events:
+		if event.AddressesTotal != 4 || event.FromHeight != 100 {
+			t.Errorf("Unexpected progress %+v", event.ScanProgress)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting on progress event")
+	}
+
+	// Updates within the interval aren't emitted.
+	time.Sleep(time.Millisecond * 10)
+	tracker.Scanned()
+	tracker.Ingested(3)
+	select {
+	case event := <-events:
+		t.Errorf("Unexpected progress event %+v", event.ScanProgress)
+	default:
+	}
+
+	p := tracker.Progress()
+	if p.AddressesScanned != 1 || p.Transactions != 3 {
+		t.Errorf("Unexpected progress %+v", p)
+	}
+	if p.Percent() != 25 {
+		t.Errorf("Expected 25 percent, got %f", p.Percent())
+	}
+	if p.Remaining < time.Millisecond*30 {
+		t.Errorf("Expected three addresses' worth of time remaining, got %s", p.Remaining)
+	}
+
+	// Finishing is always emitted.
+	tracker.Finish(nil)
+	select {
+	case event := <-events:
+		if !event.Done || event.Remaining != 0 || event.Percent() != 100 {
+			t.Errorf("Unexpected progress %+v", event.ScanProgress)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting on progress event")
+	}
+}
+
+func TestChainManager_ScanProgress(t *testing.T) {
+	chain, _, err := newTestChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.db.Close()
+
+	if _, ok := chain.ScanProgress(); ok {
+		t.Error("Expected no progress before a scan")
+	}
+
+	sub, err := chain.walletBus.Subscribe(&ScanProgressEvent{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	chain.Start()
+	defer chain.Stop()
+
+	timeout := time.After(time.Second * 10)
+	for done := false; !done; {
+		select {
+		case event := <-sub.Out():
+			done = event.(*ScanProgressEvent).Done
+		case <-timeout:
+			t.Fatal("Timed out waiting for scan")
+		}
+	}
+
+	p, ok := chain.ScanProgress()
+	if !ok {
+		t.Fatal("Expected scan progress")
+	}
+	if !p.Done || p.Err != nil {
+		t.Errorf("Expected the scan to be done, got %+v", p)
+	}
+	if p.AddressesTotal == 0 || p.AddressesScanned != p.AddressesTotal {
+		t.Errorf("Expected every address to be scanned, got %+v", p)
+	}
+	if status := chain.SyncStatus(); status.Progress != 100 {
+		t.Errorf("Expected sync progress of 100, got %f", status.Progress)
+	}
+}
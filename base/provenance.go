@@ -0,0 +1,119 @@
+package base
+
+import (
+	"encoding/hex"
+	"errors"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"gorm.io/gorm"
+)
+
+// The kinds of utxo source. A source is recorded as the kind and an ID
+// joined by a colon, see UtxoSource.
+const (
+	// SourceInvoice is a utxo paying an invoice's address. The ID is
+	// the invoice's ID.
+	SourceInvoice = "invoice"
+
+	// SourceEscrow is a utxo released to the wallet from a tracked
+	// escrow. The ID is the escrow's address.
+	SourceEscrow = "escrow"
+
+	// SourceLabel is a utxo paying an address with a label. The ID is
+	// the label.
+	SourceLabel = "label"
+)
+
+// UtxoSource returns the source recorded for utxos of the given kind and ID.
+func UtxoSource(kind, id string) string {
+	return kind + ":" + id
+}
+
+// sourceResolver works out the source of the utxos found while saving
+// transactions. The invoices, escrows and labels are loaded once for the
+// whole utxo set.
+type sourceResolver struct {
+	invoices map[string]string
+	escrows  map[string]bool
+	labels   map[iwallet.Address]string
+
+	// previous is the utxo set before the transactions were saved. It
+	// holds the wallet's utxos spent by a new transaction.
+	previous map[string]database.UtxoRecord
+}
+
+func newSourceResolver(dbtx database.Tx, keychain *Keychain, coinType iwallet.CoinType, previous map[string]database.UtxoRecord) (*sourceResolver, error) {
+	r := &sourceResolver{
+		invoices: make(map[string]string),
+		escrows:  make(map[string]bool),
+		previous: previous,
+	}
+	var invoices []database.InvoiceRecord
+	if err := dbtx.Read().Where("coin=?", coinType.CurrencyCode()).Find(&invoices).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	for _, invoice := range invoices {
+		r.invoices[invoice.Addr] = invoice.ID
+	}
+	var escrows []database.EscrowRecord
+	if err := dbtx.Read().Where("coin=?", coinType.CurrencyCode()).Find(&escrows).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	for _, escrow := range escrows {
+		r.escrows[escrow.Addr] = true
+	}
+	labels, err := keychain.addressLabels(dbtx)
+	if err != nil {
+		return nil, err
+	}
+	r.labels = labels
+	return r, nil
+}
+
+// source returns the source of a utxo created by tx. An invoice's address
+// takes precedence, then the address's label, then an escrow tx spends
+// from. Otherwise change carries the source of the utxos it was spent from
+// if they all have the same one. An empty source is returned for utxos
+// from anywhere else.
+func (r *sourceResolver) source(utxo database.UtxoRecord, tx iwallet.Transaction) string {
+	if id, ok := r.invoices[utxo.Address]; ok {
+		return UtxoSource(SourceInvoice, id)
+	}
+	if label, ok := r.labels[iwallet.NewAddress(utxo.Address, iwallet.CoinType(utxo.Coin))]; ok {
+		return UtxoSource(SourceLabel, label)
+	}
+	for _, from := range tx.From {
+		if r.escrows[from.Address.String()] {
+			return UtxoSource(SourceEscrow, from.Address.String())
+		}
+	}
+	inherited := ""
+	for _, from := range tx.From {
+		spent, ok := r.previous[hex.EncodeToString(from.ID)]
+		if !ok {
+			continue
+		}
+		if spent.Source == "" || (inherited != "" && spent.Source != inherited) {
+			return ""
+		}
+		inherited = spent.Source
+	}
+	return inherited
+}
+
+// SetUtxoSource sets the source of a utxo, replacing the one worked out
+// when it was found. An empty source makes it unlabeled until the wallet
+// next saves its utxo set, when the source is worked out again.
+func (w *WalletBase) SetUtxoSource(outpoint []byte, source string) error {
+	return w.DB.Update(func(dbtx database.Tx) error {
+		var record database.UtxoRecord
+		err := dbtx.Read().Where("coin = ?", w.CoinType.CurrencyCode()).Where("outpoint = ?", hex.EncodeToString(outpoint)).First(&record).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrUtxoNotFound
+		} else if err != nil {
+			return err
+		}
+		record.Source = source
+		return dbtx.Save(&record)
+	})
+}
@@ -0,0 +1,97 @@
+package base
+
+import (
+	"encoding/hex"
+	hd "github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"testing"
+	"time"
+)
+
+func TestSourceResolver_Source(t *testing.T) {
+	spent := []byte{0x01}
+	r := &sourceResolver{
+		invoices: map[string]string{"invoiceaddr": "inv1"},
+		escrows:  map[string]bool{"escrowaddr": true},
+		labels:   map[iwallet.Address]string{iwallet.NewAddress("labeledaddr", iwallet.CtMock): "donations"},
+		previous: map[string]database.UtxoRecord{
+			hex.EncodeToString(spent): {Source: UtxoSource(SourceLabel, "donations")},
+		},
+	}
+	fromEscrow := iwallet.Transaction{From: []iwallet.SpendInfo{{Address: iwallet.NewAddress("escrowaddr", iwallet.CtMock)}}}
+	fromWallet := iwallet.Transaction{From: []iwallet.SpendInfo{{ID: spent}}}
+
+	tests := []struct {
+		addr     string
+		tx       iwallet.Transaction
+		expected string
+	}{
+		{"invoiceaddr", fromEscrow, "invoice:inv1"},
+		{"labeledaddr", fromEscrow, "label:donations"},
+		{"changeaddr", fromEscrow, "escrow:escrowaddr"},
+		{"changeaddr", fromWallet, "label:donations"},
+		{"changeaddr", iwallet.Transaction{}, ""},
+	}
+	for i, test := range tests {
+		utxo := database.UtxoRecord{Address: test.addr, Coin: iwallet.CtMock}
+		if source := r.source(utxo, test.tx); source != test.expected {
+			t.Errorf("Test %d: expected source %q, got %q", i, test.expected, source)
+		}
+	}
+
+	// Change from utxos of different sources has none.
+	other := []byte{0x02}
+	r.previous[hex.EncodeToString(other)] = database.UtxoRecord{Source: UtxoSource(SourceInvoice, "inv2")}
+	mixed := iwallet.Transaction{From: []iwallet.SpendInfo{{ID: spent}, {ID: other}}}
+	if source := r.source(database.UtxoRecord{Address: "changeaddr", Coin: iwallet.CtMock}, mixed); source != "" {
+		t.Errorf("Expected mixed change to have no source, got %q", source)
+	}
+}
+
+func TestWalletBase_SetUtxoSource(t *testing.T) {
+	w, err := setupWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	xpriv, err := hd.NewKeyFromString("tprv8ZgxMBicQKsPeghT19pungdFLMJM2hMs3EEn5WtgobD7wuQSFQu4VNaEJXH9HS3RhhLT4wgZ3hj31m3kafuxhL9vfGTRtBVLSog4zjxW3L1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.CreateWallet(*xpriv, nil, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.OpenWallet(); err != nil {
+		t.Fatal(err)
+	}
+
+	tx := NewMockTransaction(nil, nil)
+	err = w.DB.Update(func(dbtx database.Tx) error {
+		return dbtx.Save(&database.UtxoRecord{
+			Coin:     iwallet.CtMock,
+			Amount:   tx.To[0].Amount.String(),
+			Address:  tx.To[0].Address.String(),
+			Outpoint: hex.EncodeToString(tx.To[0].ID),
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := UtxoSource(SourceLabel, "savings")
+	if err := w.SetUtxoSource(tx.To[0].ID, source); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SetUtxoSource(make([]byte, 36), source); err != ErrUtxoNotFound {
+		t.Errorf("Expected ErrUtxoNotFound, got %v", err)
+	}
+
+	utxos, err := w.ListUnspent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(utxos) != 1 || utxos[0].Source != source {
+		t.Errorf("Expected the utxo's source to be %s", source)
+	}
+}
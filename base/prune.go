@@ -0,0 +1,247 @@
+package base
+
+import (
+	"encoding/hex"
+	"errors"
+	"github.com/cpacia/multiwallet/database"
+	"github.com/cpacia/multiwallet/log"
+	iwallet "github.com/cpacia/wallet-interface"
+	"gorm.io/gorm"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultPruneAge is the age a transaction must reach before it can
+	// be pruned if the PruneConfig doesn't set one.
+	DefaultPruneAge = time.Hour * 24 * 90
+
+	// DefaultPruneConfirmations is the number of confirmations a
+	// transaction needs before it can be pruned if the PruneConfig
+	// doesn't set one.
+	DefaultPruneConfirmations = 1000
+
+	// PruneInterval is how often the pruner runs.
+	PruneInterval = time.Hour * 24
+
+	// pruneStartDelay is the delay before the first run so pruning
+	// doesn't compete with the initial sync.
+	pruneStartDelay = time.Minute * 10
+)
+
+// PruneConfig configures history pruning. Pruning replaces the records of
+// old, deeply confirmed transactions whose outputs have all been spent
+// with TransactionSummary records. Balances are computed from utxos so
+// they are unaffected and exports include the summaries, but the pruned
+// transactions are no longer returned by Transactions or GetTransaction
+// without asking the chain client.
+//
+// The zero value prunes using the defaults.
+type PruneConfig struct {
+	// Disabled keeps every transaction record forever. Deployments which
+	// need the full transactions for audits should set it.
+	Disabled bool
+
+	// Age is how old a transaction must be before it's pruned.
+	Age time.Duration
+
+	// Confirmations is the number of confirmations a transaction, and
+	// every wallet transaction spending from it, needs before it's
+	// pruned.
+	Confirmations uint64
+}
+
+// Pruner periodically prunes the wallet's transaction history.
+type Pruner struct {
+	db       database.Database
+	coinType iwallet.CoinType
+	logger   log.Logger
+	chain    *ChainManager
+	cfg      PruneConfig
+	now      func() time.Time
+	shutdown chan struct{}
+}
+
+// NewPruner returns a new Pruner. Zero values in the config are replaced
+// with the defaults.
+func NewPruner(db database.Database, logger log.Logger, coinType iwallet.CoinType, chain *ChainManager, cfg PruneConfig) *Pruner {
+	if cfg.Age <= 0 {
+		cfg.Age = DefaultPruneAge
+	}
+	if cfg.Confirmations == 0 {
+		cfg.Confirmations = DefaultPruneConfirmations
+	}
+	return &Pruner{
+		db:       db,
+		coinType: coinType,
+		logger:   moduleLogger(logger, "pruner", coinType),
+		chain:    chain,
+		cfg:      cfg,
+		now:      time.Now,
+		shutdown: make(chan struct{}),
+	}
+}
+
+// Start will run the pruner until Stop is called.
+func (p *Pruner) Start() {
+	timer := time.NewTimer(pruneStartDelay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			n, err := p.Prune()
+			if err != nil {
+				p.logger.Errorf("[%s] Error pruning transactions: %s", p.coinType, err)
+			} else if n > 0 {
+				p.logger.Infof("[%s] Pruned %d transactions", p.coinType, n)
+			}
+			timer.Reset(PruneInterval)
+		case <-p.shutdown:
+			return
+		}
+	}
+}
+
+// Stop will shutdown the pruner.
+func (p *Pruner) Stop() {
+	close(p.shutdown)
+}
+
+// Prune replaces the records of the transactions which can be pruned with
+// summaries and returns the number pruned.
+//
+// A transaction can be pruned once it's older than the configured age and
+// has the configured number of confirmations, and every output paying the
+// wallet has been spent by a transaction with as many confirmations.
+// Transactions spending from a wallet transaction which can't be pruned
+// are kept too, otherwise the output they spend would return to the utxo
+// set the next time it's rebuilt.
+func (p *Pruner) Prune() (int, error) {
+	best := p.chain.BestBlock().Height
+	if best+1 < p.cfg.Confirmations {
+		return 0, nil
+	}
+	maxHeight := best + 1 - p.cfg.Confirmations
+	cutoff := p.now().Add(-p.cfg.Age)
+
+	var n int
+	err := p.db.Update(func(dbtx database.Tx) error {
+		var (
+			records   []database.TransactionRecord
+			summaries []database.TransactionSummary
+			addrs     []database.AddressRecord
+		)
+		if err := dbtx.Read().Where("coin=?", p.coinType.CurrencyCode()).Find(&records).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		if err := dbtx.Read().Where("coin=?", p.coinType.CurrencyCode()).Find(&summaries).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		if err := dbtx.Read().Where("coin=?", p.coinType.CurrencyCode()).Find(&addrs).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		own := make(map[iwallet.Address]bool, len(addrs))
+		for _, rec := range addrs {
+			own[rec.Address()] = true
+		}
+
+		var (
+			txs      = make([]iwallet.Transaction, 0, len(records))
+			known    = make(map[iwallet.TransactionID]bool, len(records))
+			spenders = make(map[string]iwallet.Transaction)
+			pruned   = make(map[iwallet.TransactionID]bool, len(summaries))
+		)
+		for _, rec := range records {
+			tx, err := rec.Transaction()
+			if err != nil {
+				return err
+			}
+			txs = append(txs, tx)
+			known[tx.ID] = true
+			for _, from := range tx.From {
+				spenders[hex.EncodeToString(from.ID)] = tx
+			}
+		}
+		for _, summary := range summaries {
+			pruned[iwallet.TransactionID(summary.Txid)] = true
+		}
+
+		// Parents are always lower in the chain so sorting by height
+		// lets each transaction check whether its parents were pruned.
+		sort.Slice(txs, func(i, j int) bool {
+			return txs[i].Height < txs[j].Height
+		})
+
+		deep := func(tx iwallet.Transaction) bool {
+			return tx.Height > 0 && tx.Height <= maxHeight
+		}
+
+		var newSummaries []database.TransactionSummary
+	txLoop:
+		for _, tx := range txs {
+			if !deep(tx) || tx.Timestamp.After(cutoff) {
+				continue
+			}
+			for _, to := range tx.To {
+				if !own[to.Address] {
+					continue
+				}
+				spender, ok := spenders[hex.EncodeToString(to.ID)]
+				if !ok || !deep(spender) {
+					continue txLoop
+				}
+			}
+			for _, from := range tx.From {
+				parent, err := outpointTxid(hex.EncodeToString(from.ID))
+				if err != nil {
+					return err
+				}
+				if known[parent] && !pruned[parent] {
+					continue txLoop
+				}
+			}
+
+			var from, to []string
+			for _, in := range tx.From {
+				from = append(from, in.Address.String())
+			}
+			for _, out := range tx.To {
+				to = append(to, out.Address.String())
+			}
+			newSummaries = append(newSummaries, database.TransactionSummary{
+				Txid:        tx.ID.String(),
+				BlockHeight: tx.Height,
+				Timestamp:   tx.Timestamp,
+				Coin:        p.coinType.CurrencyCode(),
+				Value:       tx.Value.String(),
+				Fee:         transactionFee(tx, own),
+				From:        strings.Join(from, ";"),
+				To:          strings.Join(to, ";"),
+			})
+			pruned[tx.ID] = true
+		}
+
+		if err := dbtx.SaveAll(newSummaries); err != nil {
+			return err
+		}
+		for _, summary := range newSummaries {
+			if err := dbtx.Delete("txid", summary.Txid, &database.TransactionRecord{}); err != nil {
+				return err
+			}
+		}
+		n = len(newSummaries)
+		return nil
+	})
+	return n, err
+}
+
+// PruneHistory prunes the wallet's transaction history now using the
+// wallet's PruneConfig and returns the number of transactions pruned.
+func (w *WalletBase) PruneHistory() (int, error) {
+	if w.Prune.Disabled {
+		return 0, errors.New("pruning is disabled")
+	}
+	return NewPruner(w.DB, w.Logger, w.CoinType, w.ChainManager, w.Prune).Prune()
+}
@@ -0,0 +1,204 @@
+package base
+
+import (
+	"crypto/rand"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	hd "github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPruner_Prune(t *testing.T) {
+	w, err := setupWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	xpriv, err := hd.NewKeyFromString("tprv8ZgxMBicQKsPeghT19pungdFLMJM2hMs3EEn5WtgobD7wuQSFQu4VNaEJXH9HS3RhhLT4wgZ3hj31m3kafuxhL9vfGTRtBVLSog4zjxW3L1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.CreateWallet(*xpriv, nil, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.OpenWallet(); err != nil {
+		t.Fatal(err)
+	}
+
+	addr, err := w.CurrentAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SetAddressLabel(addr, "savings", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	newTx := func(height uint64, value int64) iwallet.Transaction {
+		var h chainhash.Hash
+		rand.Read(h[:])
+		return iwallet.Transaction{
+			ID:        iwallet.TransactionID(h.String()),
+			Height:    height,
+			Timestamp: time.Unix(1600000000, 0).Add(time.Minute * time.Duration(height-600000)),
+			Value:     iwallet.NewAmount(value),
+		}
+	}
+	output := func(tx iwallet.Transaction, index byte, to iwallet.Address, amount int64) iwallet.SpendInfo {
+		h, _ := chainhash.NewHashFromStr(tx.ID.String())
+		return iwallet.SpendInfo{ID: append(h.CloneBytes(), index, 0, 0, 0), Address: to, Amount: iwallet.NewAmount(amount)}
+	}
+
+	// received is spent by sent so it can be pruned.
+	received := newTx(600000, 1000)
+	received.From = []iwallet.SpendInfo{{ID: mockOutpoint(), Address: mockAddress(), Amount: iwallet.NewAmount(1100)}}
+	received.To = []iwallet.SpendInfo{output(received, 0, addr, 1000)}
+
+	// sent still has an unspent output.
+	sent := newTx(600010, -600)
+	sent.From = []iwallet.SpendInfo{received.To[0]}
+	sent.To = []iwallet.SpendInfo{
+		output(sent, 0, mockAddress(), 500),
+		output(sent, 1, addr, 300),
+		output(sent, 2, addr, 100),
+	}
+
+	// sweep spends from sent which is kept.
+	sweep := newTx(600020, -300)
+	sweep.From = []iwallet.SpendInfo{sent.To[1]}
+	sweep.To = []iwallet.SpendInfo{output(sweep, 0, mockAddress(), 290)}
+
+	// spentUnconfirmed's output is spent by an unconfirmed transaction.
+	spentUnconfirmed := newTx(600030, 2000)
+	spentUnconfirmed.From = []iwallet.SpendInfo{{ID: mockOutpoint(), Address: mockAddress(), Amount: iwallet.NewAmount(2100)}}
+	spentUnconfirmed.To = []iwallet.SpendInfo{output(spentUnconfirmed, 0, addr, 2000)}
+
+	unconfirmed := newTx(600040, -2000)
+	unconfirmed.Height = 0
+	unconfirmed.From = []iwallet.SpendInfo{spentUnconfirmed.To[0]}
+	unconfirmed.To = []iwallet.SpendInfo{output(unconfirmed, 0, mockAddress(), 1900)}
+
+	// recent doesn't have enough confirmations.
+	recent := newTx(699500, 700)
+	recent.From = []iwallet.SpendInfo{{ID: mockOutpoint(), Address: mockAddress(), Amount: iwallet.NewAmount(800)}}
+	recent.To = []iwallet.SpendInfo{output(recent, 0, mockAddress(), 700)}
+
+	all := []iwallet.Transaction{received, sent, sweep, spentUnconfirmed, unconfirmed, recent}
+	err = w.DB.Update(func(dbtx database.Tx) error {
+		for _, tx := range all {
+			rec, err := database.NewTransactionRecord(tx, iwallet.CtMock)
+			if err != nil {
+				return err
+			}
+			if err := dbtx.Save(rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	utxos := func() string {
+		if _, err := w.ChainManager.saveTransactionsAndUtxos(nil); err != nil {
+			t.Fatal(err)
+		}
+		var records []database.UtxoRecord
+		err := w.DB.View(func(dbtx database.Tx) error {
+			return dbtx.Read().Where("coin=?", iwallet.CtMock.CurrencyCode()).Find(&records).Error
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var outpoints []string
+		for _, rec := range records {
+			outpoints = append(outpoints, rec.Outpoint+":"+rec.Amount)
+		}
+		sort.Strings(outpoints)
+		return strings.Join(outpoints, ",")
+	}
+	before := utxos()
+
+	pruner := NewPruner(w.DB, w.Logger, w.CoinType, &ChainManager{best: iwallet.BlockInfo{Height: 700000}}, PruneConfig{})
+	n, err := pruner.Prune()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("Expected 1 transaction pruned, got %d", n)
+	}
+
+	var (
+		records   []database.TransactionRecord
+		summaries []database.TransactionSummary
+	)
+	err = w.DB.View(func(dbtx database.Tx) error {
+		if err := dbtx.Read().Where("coin=?", iwallet.CtMock.CurrencyCode()).Find(&records).Error; err != nil {
+			return err
+		}
+		return dbtx.Read().Where("coin=?", iwallet.CtMock.CurrencyCode()).Find(&summaries).Error
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != len(all)-1 {
+		t.Errorf("Expected %d transaction records, got %d", len(all)-1, len(records))
+	}
+	for _, rec := range records {
+		if rec.Txid == received.ID.String() {
+			t.Error("Pruned transaction record was not deleted")
+		}
+	}
+	if len(summaries) != 1 || summaries[0].Txid != received.ID.String() || summaries[0].Value != "1000" || summaries[0].To != addr.String() {
+		t.Errorf("Unexpected summaries %+v", summaries)
+	}
+
+	// Pruning and saving the pruned transaction again leave the utxos
+	// untouched.
+	if _, err := w.ChainManager.saveTransactionsAndUtxos([]iwallet.Transaction{received}); err != nil {
+		t.Fatal(err)
+	}
+	if after := utxos(); after != before {
+		t.Errorf("Utxos changed by pruning. Before %s, after %s", before, after)
+	}
+
+	// Running again prunes nothing new.
+	if n, err := pruner.Prune(); err != nil || n != 0 {
+		t.Errorf("Expected nothing pruned, got %d, %v", n, err)
+	}
+
+	exported, err := w.ExportHistory(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exported) != len(all) {
+		t.Fatalf("Expected %d exported transactions, got %d", len(all), len(exported))
+	}
+	etx := exported[0]
+	if etx.Txid != received.ID.String() || etx.Value != "1000" || etx.Height != 600000 || len(etx.To) != 1 || etx.To[0] != addr.String() {
+		t.Errorf("Unexpected export of pruned transaction %+v", etx)
+	}
+	if len(etx.Labels) != 1 || etx.Labels[0] != "savings" {
+		t.Errorf("Expected label savings, got %v", etx.Labels)
+	}
+	if exported[1].Txid != sent.ID.String() || exported[1].Fee != "100" {
+		t.Errorf("Unexpected export %+v", exported[1])
+	}
+}
+
+func TestWalletBase_PruneHistoryDisabled(t *testing.T) {
+	w, err := setupWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Prune.Disabled = true
+	if _, err := w.PruneHistory(); err == nil {
+		t.Error("Expected error when pruning is disabled")
+	}
+}
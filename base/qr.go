@@ -0,0 +1,139 @@
+package base
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// qrPrefix starts every QR chunk. Chunks are
+//
+//	MW:<index>/<total>:<checksum>:<data>
+//
+// where index counts from 1, checksum is the first four bytes of the
+// SHA256 of the whole payload in hex and data is the chunk's part of the
+// payload in unpadded base32. Every character is in the QR alphanumeric
+// set, which packs more data into a code than byte mode.
+const qrPrefix = "MW:"
+
+// qrHeaderLen is the longest header, allowing up to 9999 chunks.
+const qrHeaderLen = len(qrPrefix) + len("9999/9999:") + 8 + 1
+
+// ErrInvalidQRChunk is returned when a scanned QR code isn't a chunk or
+// doesn't belong with the chunks already scanned.
+var ErrInvalidQRChunk = errors.New("invalid QR chunk")
+
+var qrEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// EncodeQRChunks splits the payload into strings of at most maxLen
+// characters, each of which is shown as one QR code. The chunks can be
+// scanned in any order by a QRDecoder.
+func EncodeQRChunks(payload []byte, maxLen int) ([]string, error) {
+	// Base32 encodes 5 bytes in 8 characters.
+	dataLen := (maxLen - qrHeaderLen) / 8 * 5
+	if dataLen <= 0 {
+		return nil, errors.New("QR chunk length too small")
+	}
+	total := (len(payload) + dataLen - 1) / dataLen
+	if total == 0 {
+		total = 1
+	}
+	if total > 9999 {
+		return nil, errors.New("payload too large for QR chunks")
+	}
+
+	checksum := qrChecksum(payload)
+	chunks := make([]string, 0, total)
+	for i := 0; i < total; i++ {
+		end := (i + 1) * dataLen
+		if end > len(payload) {
+			end = len(payload)
+		}
+		data := qrEncoding.EncodeToString(payload[i*dataLen : end])
+		chunks = append(chunks, fmt.Sprintf("%s%d/%d:%s:%s", qrPrefix, i+1, total, checksum, data))
+	}
+	return chunks, nil
+}
+
+// QRDecoder reassembles a payload from its QR chunks.
+type QRDecoder struct {
+	checksum string
+	parts    [][]byte
+	have     int
+}
+
+// Add adds a scanned chunk. Chunks which were already added are ignored
+// so the codes can be scanned in a loop until Complete returns true.
+func (d *QRDecoder) Add(chunk string) error {
+	if !strings.HasPrefix(chunk, qrPrefix) {
+		return ErrInvalidQRChunk
+	}
+	fields := strings.SplitN(strings.TrimPrefix(chunk, qrPrefix), ":", 3)
+	if len(fields) != 3 {
+		return ErrInvalidQRChunk
+	}
+	position := strings.SplitN(fields[0], "/", 2)
+	if len(position) != 2 {
+		return ErrInvalidQRChunk
+	}
+	index, err := strconv.Atoi(position[0])
+	if err != nil {
+		return ErrInvalidQRChunk
+	}
+	total, err := strconv.Atoi(position[1])
+	if err != nil || total < 1 || total > 9999 || index < 1 || index > total {
+		return ErrInvalidQRChunk
+	}
+	data, err := qrEncoding.DecodeString(fields[2])
+	if err != nil {
+		return ErrInvalidQRChunk
+	}
+
+	if d.parts == nil {
+		d.checksum = fields[1]
+		d.parts = make([][]byte, total)
+	} else if fields[1] != d.checksum || total != len(d.parts) {
+		return ErrInvalidQRChunk
+	}
+	if d.parts[index-1] == nil {
+		d.parts[index-1] = data
+		d.have++
+	}
+	return nil
+}
+
+// Progress returns the number of chunks added and the total. The total is
+// zero until the first chunk is added.
+func (d *QRDecoder) Progress() (have, total int) {
+	return d.have, len(d.parts)
+}
+
+// Complete returns whether every chunk has been added.
+func (d *QRDecoder) Complete() bool {
+	return d.parts != nil && d.have == len(d.parts)
+}
+
+// Payload returns the reassembled payload once every chunk has been added.
+// The payload is checked against the chunks' checksum.
+func (d *QRDecoder) Payload() ([]byte, error) {
+	if !d.Complete() {
+		return nil, errors.New("QR chunks incomplete")
+	}
+	var payload []byte
+	for _, part := range d.parts {
+		payload = append(payload, part...)
+	}
+	if qrChecksum(payload) != d.checksum {
+		return nil, errors.New("QR payload checksum mismatch")
+	}
+	return payload, nil
+}
+
+func qrChecksum(payload []byte) string {
+	h := sha256.Sum256(payload)
+	return strings.ToUpper(hex.EncodeToString(h[:4]))
+}
@@ -0,0 +1,61 @@
+package base
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestQRChunks(t *testing.T) {
+	payload := make([]byte, 1000)
+	rand.Read(payload)
+
+	chunks, err := EncodeQRChunks(payload, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) < 2 {
+		t.Fatalf("Expected several chunks, got %d", len(chunks))
+	}
+	for _, chunk := range chunks {
+		if len(chunk) > 300 {
+			t.Errorf("Chunk length %d exceeds the maximum", len(chunk))
+		}
+	}
+
+	// Scan out of order and with repeats.
+	var d QRDecoder
+	for i := len(chunks) - 1; i >= 0; i-- {
+		if err := d.Add(chunks[i]); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Add(chunks[i]); err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 && d.Complete() {
+			t.Fatal("Decoder complete before every chunk was added")
+		}
+	}
+	if have, total := d.Progress(); have != len(chunks) || total != len(chunks) {
+		t.Errorf("Expected progress %d/%d, got %d/%d", len(chunks), len(chunks), have, total)
+	}
+	decoded, err := d.Payload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded, payload) {
+		t.Error("Decoded payload doesn't match")
+	}
+
+	// Chunks from another payload are rejected.
+	other, err := EncodeQRChunks([]byte("other"), 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Add(other[0]); err != ErrInvalidQRChunk {
+		t.Errorf("Expected ErrInvalidQRChunk, got %v", err)
+	}
+	if err := d.Add("not a chunk"); err != ErrInvalidQRChunk {
+		t.Errorf("Expected ErrInvalidQRChunk, got %v", err)
+	}
+}
@@ -1,35 +1,87 @@
 package base
 
 import (
+	"context"
 	"errors"
 	"github.com/cpacia/multiwallet/database"
+	"github.com/cpacia/multiwallet/log"
 	iwallet "github.com/cpacia/wallet-interface"
-	"github.com/op/go-logging"
 	"gorm.io/gorm"
+	"time"
 )
 
-// Rebroadcaster handles rebroadcasting unconfirmed transactions.
+const (
+	// RebroadcastInterval is how often the rebroadcaster checks for
+	// queued transactions which are due for another attempt. It is also
+	// the delay before the first retry of a failed broadcast.
+	RebroadcastInterval = time.Minute
+
+	// MaxRebroadcastInterval caps the exponential backoff between
+	// attempts to broadcast a single transaction.
+	MaxRebroadcastInterval = time.Hour
+)
+
+// Rebroadcaster handles rebroadcasting unconfirmed transactions. Every
+// transaction the wallet sends is queued in the database before it is
+// broadcast and stays queued, with its broadcast attempts recorded, until
+// the chain client reports it. A backend outage at the time of the spend
+// therefore only delays the broadcast.
 type Rebroadcaster struct {
-	db            database.Database
-	coinType      iwallet.CoinType
-	logger        *logging.Logger
-	sub           *BlockSubscription
-	broadcastFunc func(serializedTx []byte) error
-	shutdown      chan struct{}
+	db       database.Database
+	coinType iwallet.CoinType
+	logger   log.Logger
+	sub      *BlockSubscription
+	client   ChainClient
+	shutdown chan struct{}
+
+	// best is the last block seen by Start. Flush uses it once Start
+	// has returned.
+	best iwallet.BlockInfo
 }
 
 // NewRebroadcaster returns a new Rebroadcaster.
-func NewRebroadcaster(db database.Database, logger *logging.Logger, coinType iwallet.CoinType, broadcastFunc func(serializedTx []byte) error, sub *BlockSubscription) *Rebroadcaster {
-	return &Rebroadcaster{db: db, sub: sub, coinType: coinType, logger: logger, broadcastFunc: broadcastFunc, shutdown: make(chan struct{})}
+func NewRebroadcaster(db database.Database, logger log.Logger, coinType iwallet.CoinType, client ChainClient, sub *BlockSubscription) *Rebroadcaster {
+	return &Rebroadcaster{db: db, sub: sub, coinType: coinType, logger: moduleLogger(logger, "rebroadcaster", coinType), client: client, shutdown: make(chan struct{})}
 }
 
-// Start will run the rebroadcaster. Ever new block it will try
-// to rebroadcast unconfirmed txs.
+// Start will run the rebroadcaster. The queue is flushed on startup, every
+// new block and when the backend becomes reachable again, and transactions
+// whose backoff has expired are retried every RebroadcastInterval. Time
+// locked txs are held back until their lock time is final.
 func (r *Rebroadcaster) Start() {
+	// offline is set while the backend can't be reached. The queue is
+	// flushed as soon as it can be again so spends made while offline
+	// go out without waiting for their backoff or a block.
+	offline := false
+	best, err := r.client.GetBlockchainInfo()
+	if err != nil {
+		r.logger.Errorf("[%s] Error loading best block for rebroadcast: %s", r.coinType, err)
+		offline = true
+	} else {
+		r.best = best
+		r.rebroadcast(context.Background(), best, true)
+	}
+
+	ticker := time.NewTicker(RebroadcastInterval)
+	defer ticker.Stop()
 	for {
 		select {
-		case <-r.sub.Out:
-			r.rebroadcast()
+		case info := <-r.sub.Out:
+			r.best = info
+			offline = false
+			r.rebroadcast(context.Background(), info, true)
+		case <-ticker.C:
+			best, err := r.client.GetBlockchainInfo()
+			if err != nil {
+				offline = true
+				continue
+			}
+			if offline {
+				r.logger.Infof("[%s] Backend reachable again, broadcasting queued transactions", r.coinType)
+			}
+			r.best = best
+			r.rebroadcast(context.Background(), best, offline)
+			offline = false
 		case <-r.shutdown:
 			return
 		}
@@ -41,26 +93,249 @@ func (r *Rebroadcaster) Stop() {
 	close(r.shutdown)
 }
 
-func (r *Rebroadcaster) rebroadcast() {
+// Flush makes a last attempt at broadcasting the queued transactions whose
+// backoff has expired. It's called on shutdown after Start has returned and
+// gives up on the remaining transactions when ctx is done. They stay queued
+// for the next time the wallet is opened.
+func (r *Rebroadcaster) Flush(ctx context.Context) {
+	if r.best.Height == 0 {
+		return
+	}
+	r.rebroadcast(ctx, r.best, false)
+}
+
+// rebroadcast attempts every queued transaction which hasn't been seen by
+// the chain client. Unless force is set transactions are skipped until
+// their backoff expires.
+func (r *Rebroadcaster) rebroadcast(ctx context.Context, info iwallet.BlockInfo, force bool) {
 	var unconf []database.UnconfirmedTransaction
 	err := r.db.View(func(tx database.Tx) error {
-		return tx.Read().Where("coin=?", r.coinType.CurrencyCode()).Find(&unconf).Error
+		return tx.Read().Where("coin=?", r.coinType.CurrencyCode()).Where("seen=?", false).Find(&unconf).Error
 	})
 	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
 		r.logger.Errorf("Error loading unconfirmed txs for rebroadcast: %s", err)
 		return
 	}
 
+	client := WithContext(r.client)
+	now := time.Now()
 	for _, utx := range unconf {
-		if err := r.broadcastFunc(utx.TxBytes); err != nil {
-			r.logger.Errorf("Error rebroadcasting tx %s: %s", utx.Txid, err)
+		if ctx.Err() != nil {
+			return
+		}
+		if !IsLockTimeFinal(utx.LockTime, info) {
+			continue
+		}
+		if utx.Attempts > 0 {
+			if _, err := client.GetTransactionContext(ctx, iwallet.TransactionID(utx.Txid)); err == nil {
+				if err := markBroadcastSeen(r.db, r.coinType, iwallet.TransactionID(utx.Txid)); err != nil {
+					r.logger.Errorf("Error updating unconfirmed tx %s: %s", utx.Txid, err)
+				}
+				continue
+			}
+		}
+		if !force && now.Before(utx.NextAttempt) {
 			continue
 		}
-		err := r.db.Update(func(tx database.Tx) error {
-			return tx.Delete("txid", utx.Txid, &utx)
-		})
+		err := client.BroadcastContext(ctx, utx.TxBytes)
+		if err == context.Canceled || err == context.DeadlineExceeded {
+			return
+		}
 		if err != nil {
-			r.logger.Errorf("Error deleting unconfirmed tx: %s", err)
+			r.logger.Errorf("Error rebroadcasting tx %s: %s", utx.Txid, err)
+		}
+		if err := recordBroadcastAttempt(r.db, r.coinType, iwallet.TransactionID(utx.Txid), err); err != nil {
+			r.logger.Errorf("Error updating unconfirmed tx %s: %s", utx.Txid, err)
+		}
+	}
+}
+
+// recordBroadcastAttempt saves the outcome of a broadcast attempt on the
+// queued transaction and schedules the next attempt.
+func recordBroadcastAttempt(db database.Database, coinType iwallet.CoinType, txid iwallet.TransactionID, broadcastErr error) error {
+	return db.Update(func(dbtx database.Tx) error {
+		var utx database.UnconfirmedTransaction
+		if err := dbtx.Read().Where("coin=?", coinType.CurrencyCode()).Where("txid=?", txid.String()).First(&utx).Error; err != nil {
+			return err
+		}
+		utx.Attempts++
+		utx.LastAttempt = time.Now()
+		utx.NextAttempt = utx.LastAttempt.Add(rebroadcastBackoff(utx.Attempts))
+		utx.LastError = ""
+		if broadcastErr != nil {
+			utx.LastError = broadcastErr.Error()
+		}
+		return dbtx.Save(&utx)
+	})
+}
+
+// markBroadcastSeen flags the queued transaction as seen by the chain
+// client so that it is no longer rebroadcast.
+func markBroadcastSeen(db database.Database, coinType iwallet.CoinType, txid iwallet.TransactionID) error {
+	return db.Update(func(dbtx database.Tx) error {
+		var utx database.UnconfirmedTransaction
+		err := dbtx.Read().Where("coin=?", coinType.CurrencyCode()).Where("txid=?", txid.String()).First(&utx).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if utx.Seen {
+			return nil
+		}
+		utx.Seen = true
+		utx.LastError = ""
+		return dbtx.Save(&utx)
+	})
+}
+
+// rebroadcastBackoff returns the delay after the given number of attempts,
+// doubling from RebroadcastInterval up to MaxRebroadcastInterval.
+func rebroadcastBackoff(attempts int) time.Duration {
+	delay := RebroadcastInterval
+	for i := 1; i < attempts && delay < MaxRebroadcastInterval; i++ {
+		delay *= 2
+	}
+	if delay > MaxRebroadcastInterval {
+		delay = MaxRebroadcastInterval
+	}
+	return delay
+}
+
+// BroadcastOrQueue makes the first broadcast attempt for a transaction which
+// has already been saved as unconfirmed. A failure is recorded on the
+// queued transaction and left for the rebroadcaster to retry rather than
+// returned, as the spend has already been committed.
+func (w *WalletBase) BroadcastOrQueue(txid iwallet.TransactionID, serializedTx []byte) {
+	err := w.ChainClient.Broadcast(serializedTx)
+	if err != nil {
+		w.Logger.Warningf("[%s] Broadcast of %s failed, queued for retry: %s", w.CoinType, txid, err)
+	}
+	if err := recordBroadcastAttempt(w.DB, w.CoinType, txid, err); err != nil {
+		w.Logger.Errorf("[%s] Error updating unconfirmed tx %s: %s", w.CoinType, txid, err)
+	}
+}
+
+// BroadcastState describes where a transaction sent by the wallet is in
+// the broadcast queue.
+type BroadcastState int
+
+const (
+	// BroadcastPending is a time locked transaction which won't be
+	// broadcast until its lock time is final.
+	BroadcastPending BroadcastState = iota
+	// BroadcastQueued is a transaction awaiting broadcast because its
+	// last broadcast attempt failed, such as while the backend was
+	// unreachable, or it hasn't been attempted yet.
+	BroadcastQueued
+	// BroadcastSent is a transaction which was accepted by the chain
+	// client but hasn't been reported back yet.
+	BroadcastSent
+	// BroadcastSeen is a transaction the chain client has reported in
+	// the mempool.
+	BroadcastSeen
+	// BroadcastConfirmed is a transaction which has been mined and
+	// removed from the queue.
+	BroadcastConfirmed
+)
+
+// String returns a readable name for the state.
+func (s BroadcastState) String() string {
+	switch s {
+	case BroadcastPending:
+		return "pending"
+	case BroadcastQueued:
+		return "queued"
+	case BroadcastSent:
+		return "sent"
+	case BroadcastSeen:
+		return "seen"
+	case BroadcastConfirmed:
+		return "confirmed"
+	}
+	return "unknown"
+}
+
+// BroadcastStatus is the broadcast state of a transaction sent by the
+// wallet.
+type BroadcastStatus struct {
+	Txid        iwallet.TransactionID
+	State       BroadcastState
+	Attempts    int
+	LastAttempt time.Time
+	NextAttempt time.Time
+	LastError   string
+}
+
+// BroadcastStatus returns the broadcast state of a transaction sent by the
+// wallet. gorm.ErrRecordNotFound is returned if the wallet has no record
+// of the transaction.
+func (w *WalletBase) BroadcastStatus(txid iwallet.TransactionID) (BroadcastStatus, error) {
+	var (
+		utx    database.UnconfirmedTransaction
+		record database.TransactionRecord
+		queued = true
+	)
+	err := w.DB.View(func(dbtx database.Tx) error {
+		err := dbtx.Read().Where("coin=?", w.CoinType.CurrencyCode()).Where("txid=?", txid.String()).First(&utx).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			queued = false
+			return dbtx.Read().Where("coin=?", w.CoinType.CurrencyCode()).Where("txid=?", txid.String()).First(&record).Error
+		}
+		return err
+	})
+	if err != nil {
+		return BroadcastStatus{}, err
+	}
+	if !queued {
+		state := BroadcastSeen
+		if record.BlockHeight > 0 {
+			state = BroadcastConfirmed
 		}
+		return BroadcastStatus{Txid: txid, State: state}, nil
+	}
+
+	best, err := w.BlockchainInfo()
+	if err != nil {
+		return BroadcastStatus{}, err
+	}
+	return queuedStatus(&utx, best), nil
+}
+
+// queuedStatus returns the broadcast status of the queued transaction.
+func queuedStatus(utx *database.UnconfirmedTransaction, best iwallet.BlockInfo) BroadcastStatus {
+	status := BroadcastStatus{
+		Txid:        iwallet.TransactionID(utx.Txid),
+		Attempts:    utx.Attempts,
+		LastAttempt: utx.LastAttempt,
+		NextAttempt: utx.NextAttempt,
+		LastError:   utx.LastError,
+	}
+	switch {
+	case utx.Seen:
+		status.State = BroadcastSeen
+	case utx.Attempts > 0 && utx.LastError == "":
+		status.State = BroadcastSent
+	case !IsLockTimeFinal(utx.LockTime, best):
+		status.State = BroadcastPending
+	default:
+		status.State = BroadcastQueued
+	}
+	return status
+}
+
+// LockTimeThreshold is the value below which a lock time is a block height
+// and above which it is a unix timestamp.
+const LockTimeThreshold = 500000000
+
+// IsLockTimeFinal returns whether a transaction with the lock time can be
+// included in the block after the given best block.
+func IsLockTimeFinal(lockTime uint32, best iwallet.BlockInfo) bool {
+	if lockTime == 0 {
+		return true
+	}
+	if lockTime < LockTimeThreshold {
+		return uint64(lockTime) <= best.Height
 	}
+	return int64(lockTime) < best.BlockTime.Unix()
 }
@@ -2,25 +2,22 @@ package base
 
 import (
 	"github.com/cpacia/multiwallet/database"
-	"github.com/cpacia/multiwallet/database/sqlitedb"
+	"github.com/cpacia/multiwallet/database/memorydb"
+	"github.com/cpacia/multiwallet/log"
 	iwallet "github.com/cpacia/wallet-interface"
-	"github.com/op/go-logging"
 	"testing"
 	"time"
 )
 
 func TestRebroadcaster(t *testing.T) {
-	db, err := sqlitedb.NewMemoryDB()
+	db, err := memorydb.NewMemoryDB()
 	if err != nil {
 		t.Fatal(err)
 	}
 	if err := database.InitializeDatabase(db); err != nil {
 		t.Fatal(err)
 	}
-	logger, err := logging.GetLogger("test")
-	if err != nil {
-		t.Fatal(err)
-	}
+	logger := log.New("test")
 
 	client := NewMockChainClient()
 	sub, err := client.SubscribeBlocks()
@@ -28,9 +25,10 @@ func TestRebroadcaster(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	rebroadcaster := NewRebroadcaster(db, logger, iwallet.CtMock, client.Broadcast, sub)
+	rebroadcaster := NewRebroadcaster(db, logger, iwallet.CtMock, client, sub)
 
 	go rebroadcaster.Start()
+	defer rebroadcaster.Stop()
 
 	<-time.After(time.Second)
 
@@ -49,14 +47,194 @@ func TestRebroadcaster(t *testing.T) {
 
 	<-time.After(time.Second)
 
+	// The transaction stays queued until the chain client reports it.
 	var unconf []database.UnconfirmedTransaction
+	err = db.View(func(tx database.Tx) error {
+		return tx.Read().Find(&unconf).Error
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unconf) != 1 {
+		t.Fatalf("Expected 1 tx got %d", len(unconf))
+	}
+	if unconf[0].Attempts != 1 || unconf[0].LastError != "" || unconf[0].Seen {
+		t.Errorf("Expected one successful attempt, got %d attempts with error %q", unconf[0].Attempts, unconf[0].LastError)
+	}
+
+	if err := client.BroadcastInternal(iwallet.Transaction{ID: "abc"}); err != nil {
+		t.Fatal(err)
+	}
+	client.GenerateBlock()
+
+	<-time.After(time.Second)
+
+	err = db.View(func(tx database.Tx) error {
+		return tx.Read().Find(&unconf).Error
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unconf) != 1 {
+		t.Fatalf("Expected 1 tx got %d", len(unconf))
+	}
+	if !unconf[0].Seen || unconf[0].Attempts != 1 {
+		t.Errorf("Expected tx to be seen without another attempt, got %d attempts", unconf[0].Attempts)
+	}
+}
+
+func TestRebroadcaster_Retry(t *testing.T) {
+	db, err := memorydb.NewMemoryDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.InitializeDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+	logger := log.New("test")
+
+	// A transaction queued while the backend was down is broadcast on
+	// startup.
+	err = db.Update(func(tx database.Tx) error {
+		return tx.Save(&database.UnconfirmedTransaction{
+			Txid:        "abc",
+			TxBytes:     []byte{0xff},
+			Coin:        iwallet.CtMock,
+			Attempts:    1,
+			LastError:   "connection refused",
+			NextAttempt: time.Now().Add(time.Hour),
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewMockChainClient()
+	sub, err := client.SubscribeBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rebroadcaster := NewRebroadcaster(db, logger, iwallet.CtMock, client, sub)
+
+	go rebroadcaster.Start()
+	defer rebroadcaster.Stop()
+
+	<-time.After(time.Second)
+
+	var utx database.UnconfirmedTransaction
+	err = db.View(func(tx database.Tx) error {
+		return tx.Read().Where("txid=?", "abc").First(&utx).Error
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if utx.Attempts != 2 || utx.LastError != "" {
+		t.Errorf("Expected a successful second attempt, got %d attempts with error %q", utx.Attempts, utx.LastError)
+	}
+	if !utx.NextAttempt.After(utx.LastAttempt.Add(RebroadcastInterval)) {
+		t.Error("Expected the next attempt to back off")
+	}
+}
+
+func TestRebroadcastBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		delay    time.Duration
+	}{
+		{1, RebroadcastInterval},
+		{2, RebroadcastInterval * 2},
+		{4, RebroadcastInterval * 8},
+		{100, MaxRebroadcastInterval},
+	}
+	for _, test := range tests {
+		if delay := rebroadcastBackoff(test.attempts); delay != test.delay {
+			t.Errorf("Attempt %d: expected %s, got %s", test.attempts, test.delay, delay)
+		}
+	}
+}
+
+func TestRebroadcaster_LockTime(t *testing.T) {
+	db, err := memorydb.NewMemoryDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.InitializeDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+	logger := log.New("test")
+
+	client := NewMockChainClient()
+	sub, err := client.SubscribeBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rebroadcaster := NewRebroadcaster(db, logger, iwallet.CtMock, client, sub)
+
+	go rebroadcaster.Start()
+	defer rebroadcaster.Stop()
+
+	<-time.After(time.Second)
+
 	err = db.Update(func(tx database.Tx) error {
+		for _, utx := range []database.UnconfirmedTransaction{
+			{Txid: "abc", TxBytes: []byte{0xff}, Coin: iwallet.CtMock, LockTime: 1000000},
+			{Txid: "def", TxBytes: []byte{0xff}, Coin: iwallet.CtMock, LockTime: 1},
+		} {
+			if err := tx.Save(&utx); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.GenerateBlock()
+
+	<-time.After(time.Second)
+
+	var unconf []database.UnconfirmedTransaction
+	err = db.View(func(tx database.Tx) error {
 		return tx.Read().Find(&unconf).Error
 	})
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(unconf) != 0 {
-		t.Errorf("Expected 0 txs got %d", len(unconf))
+	if len(unconf) != 2 {
+		t.Fatalf("Expected 2 txs got %d", len(unconf))
+	}
+	for _, utx := range unconf {
+		if utx.Txid == "abc" && utx.Attempts != 0 {
+			t.Error("Expected time locked tx to be held back")
+		}
+		if utx.Txid == "def" && utx.Attempts != 1 {
+			t.Errorf("Expected final tx to be broadcast, got %d attempts", utx.Attempts)
+		}
+	}
+}
+
+func TestIsLockTimeFinal(t *testing.T) {
+	best := iwallet.BlockInfo{
+		Height:    600000,
+		BlockTime: time.Unix(1600000000, 0),
+	}
+	tests := []struct {
+		lockTime uint32
+		final    bool
+	}{
+		{0, true},
+		{599999, true},
+		{600000, true},
+		{600001, false},
+		{1599999999, true},
+		{1600000000, false},
+	}
+	for _, test := range tests {
+		if final := IsLockTimeFinal(test.lockTime, best); final != test.final {
+			t.Errorf("Lock time %d: expected final %t, got %t", test.lockTime, test.final, final)
+		}
 	}
 }
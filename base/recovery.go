@@ -0,0 +1,208 @@
+package base
+
+import (
+	"errors"
+	"github.com/cpacia/multiwallet/database"
+	"github.com/cpacia/multiwallet/log"
+	iwallet "github.com/cpacia/wallet-interface"
+	"sync"
+)
+
+// DefaultGapLimit is the number of consecutive unused addresses the
+// RecoveryScanner must find before it considers a chain fully scanned.
+// This matches the gap limit recommended by BIP44.
+const DefaultGapLimit = 20
+
+// RecoveryConfig holds everything needed to build a RecoveryScanner.
+type RecoveryConfig struct {
+	Client   ChainClient
+	DB       database.Database
+	Keychain *Keychain
+	CoinType iwallet.CoinType
+	Logger   log.Logger
+
+	// GapLimit is the number of consecutive unused addresses after
+	// which the scan of a chain stops. Defaults to DefaultGapLimit.
+	GapLimit int
+
+	// SaveFunc is called with the discovered transactions so that they
+	// can be ingested into the wallet.
+	SaveFunc func(txs []iwallet.Transaction) error
+
+	// Tracker, if set, tracks the addresses scanned. It's finished when
+	// the scan returns.
+	Tracker *ScanTracker
+}
+
+// RecoveryResult summarizes what a recovery scan found.
+type RecoveryResult struct {
+	UsedAddresses []iwallet.Address
+	Transactions  []iwallet.Transaction
+}
+
+// RecoveryScanner restores wallet state from the account xpub stored in
+// the keychain. It walks both the external and internal chains querying the
+// ChainClient for the history of each address, extending the keychain as it
+// goes, until GapLimit consecutive unused addresses are found on each chain.
+type RecoveryScanner struct {
+	client   ChainClient
+	db       database.Database
+	keychain *Keychain
+	coinType iwallet.CoinType
+	logger   log.Logger
+	gapLimit int
+	saveFunc func(txs []iwallet.Transaction) error
+	tracker  *ScanTracker
+}
+
+// NewRecoveryScanner returns a new RecoveryScanner.
+func NewRecoveryScanner(cfg *RecoveryConfig) *RecoveryScanner {
+	gapLimit := cfg.GapLimit
+	if gapLimit <= 0 {
+		gapLimit = DefaultGapLimit
+	}
+	return &RecoveryScanner{
+		client:   cfg.Client,
+		db:       cfg.DB,
+		keychain: cfg.Keychain,
+		coinType: cfg.CoinType,
+		logger:   moduleLogger(cfg.Logger, "recovery", cfg.CoinType),
+		gapLimit: gapLimit,
+		saveFunc: cfg.SaveFunc,
+		tracker:  cfg.Tracker,
+	}
+}
+
+// Scan runs the recovery scan from the given height. Any addresses found
+// with history are marked as used and the discovered transactions are
+// passed to the SaveFunc.
+func (rs *RecoveryScanner) Scan(fromHeight uint64) (*RecoveryResult, error) {
+	result, err := rs.scan(fromHeight)
+	if rs.tracker != nil {
+		rs.tracker.Finish(err)
+	}
+	return result, err
+}
+
+func (rs *RecoveryScanner) scan(fromHeight uint64) (*RecoveryResult, error) {
+	var (
+		result = &RecoveryResult{}
+		seen   = make(map[iwallet.TransactionID]bool)
+		chains = []bool{false}
+	)
+	if !rs.keychain.externalOnly {
+		chains = append(chains, true)
+	}
+
+	for _, change := range chains {
+		used, txs, err := rs.scanChain(change, fromHeight)
+		if err != nil {
+			return nil, err
+		}
+		result.UsedAddresses = append(result.UsedAddresses, used...)
+		for _, tx := range txs {
+			if !seen[tx.ID] {
+				seen[tx.ID] = true
+				result.Transactions = append(result.Transactions, tx)
+			}
+		}
+	}
+
+	err := rs.db.Update(func(dbtx database.Tx) error {
+		for _, addr := range result.UsedAddresses {
+			if err := rs.keychain.MarkAddressAsUsed(dbtx, addr); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if rs.saveFunc != nil && len(result.Transactions) > 0 {
+		if err := rs.saveFunc(result.Transactions); err != nil {
+			return nil, err
+		}
+	}
+
+	if rs.logger != nil {
+		rs.logger.Infof("[%s] Recovery scan found %d used addresses and %d transactions", rs.coinType, len(result.UsedAddresses), len(result.Transactions))
+	}
+	return result, nil
+}
+
+// scanChain queries the address history of one chain in batches of gapLimit
+// addresses until gapLimit consecutive addresses have no history.
+func (rs *RecoveryScanner) scanChain(change bool, fromHeight uint64) ([]iwallet.Address, []iwallet.Transaction, error) {
+	var (
+		used  []iwallet.Address
+		txs   []iwallet.Transaction
+		index = 0
+		gap   = 0
+	)
+	for gap < rs.gapLimit {
+		records, err := rs.keychain.chainAddresses(change, index+rs.gapLimit)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(records) <= index {
+			return nil, nil, errors.New("keychain failed to generate new addresses")
+		}
+		batch := records[index:]
+		if len(batch) > rs.gapLimit {
+			batch = batch[:rs.gapLimit]
+		}
+		if rs.tracker != nil {
+			rs.tracker.AddAddresses(len(batch))
+		}
+
+		results, err := rs.queryBatch(batch, fromHeight)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for i, rec := range batch {
+			if len(results[i]) > 0 {
+				used = append(used, rec.Address())
+				txs = append(txs, results[i]...)
+				gap = 0
+			} else {
+				gap++
+			}
+			index++
+			if gap >= rs.gapLimit {
+				break
+			}
+		}
+	}
+	return used, txs, nil
+}
+
+// queryBatch fetches the history of each address in parallel. The returned
+// slice is in the same order as the records.
+func (rs *RecoveryScanner) queryBatch(records []database.AddressRecord, fromHeight uint64) ([][]iwallet.Transaction, error) {
+	var (
+		results = make([][]iwallet.Transaction, len(records))
+		errs    = make([]error, len(records))
+		wg      sync.WaitGroup
+	)
+	wg.Add(len(records))
+	for i, rec := range records {
+		go func(i int, addr iwallet.Address) {
+			defer wg.Done()
+			results[i], errs[i] = rs.client.GetAddressTransactions(addr, fromHeight)
+			if errs[i] == nil && rs.tracker != nil {
+				rs.tracker.Scanned()
+			}
+		}(i, rec.Address())
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,90 @@
+package base
+
+import (
+	"encoding/hex"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"math/rand"
+	"testing"
+)
+
+func TestRecoveryScanner_Scan(t *testing.T) {
+	kc, err := setupKeychain()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := kc.chainAddresses(false, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewMockChainClient()
+
+	// Index 22 is only discoverable if the gap counter is reset
+	// after finding history on index 5. Index 45 is beyond the gap
+	// limit and should not be found.
+	for _, i := range []int{5, 22, 45} {
+		r := make([]byte, 32)
+		rand.Read(r)
+		err := client.BroadcastInternal(iwallet.Transaction{
+			ID: iwallet.TransactionID(hex.EncodeToString(r)),
+			To: []iwallet.SpendInfo{
+				{
+					Address: records[i].Address(),
+					Amount:  iwallet.NewAmount(100000),
+				},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var saved []iwallet.Transaction
+	tracker := NewScanTracker(iwallet.CtMock, 0, nil)
+	scanner := NewRecoveryScanner(&RecoveryConfig{
+		Client:   client,
+		DB:       kc.db,
+		Keychain: kc,
+		CoinType: iwallet.CtMock,
+		GapLimit: 20,
+		SaveFunc: func(txs []iwallet.Transaction) error {
+			saved = append(saved, txs...)
+			return nil
+		},
+		Tracker: tracker,
+	})
+
+	result, err := scanner.Scan(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.UsedAddresses) != 2 {
+		t.Fatalf("Expected 2 used addresses, got %d", len(result.UsedAddresses))
+	}
+	if result.UsedAddresses[0] != records[5].Address() || result.UsedAddresses[1] != records[22].Address() {
+		t.Error("Returned incorrect used addresses")
+	}
+	if len(saved) != 2 {
+		t.Errorf("Expected 2 saved transactions, got %d", len(saved))
+	}
+	if p := tracker.Progress(); !p.Done || p.AddressesScanned == 0 || p.AddressesScanned != p.AddressesTotal {
+		t.Errorf("Unexpected scan progress %+v", p)
+	}
+
+	err = kc.db.View(func(tx database.Tx) error {
+		var rec database.AddressRecord
+		if err := tx.Read().Where("addr=?", records[22].Address().String()).First(&rec).Error; err != nil {
+			return err
+		}
+		if !rec.Used {
+			t.Error("Expected address to be marked used")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,175 @@
+package base
+
+import (
+	"encoding/hex"
+	"errors"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"gorm.io/gorm"
+	"sort"
+)
+
+// handleReorg is called when a new block doesn't build on our best block.
+// Transactions confirmed in blocks which are no longer in the main chain
+// are reverted to unconfirmed and checked against the new chain, then the
+// wallet is rescanned from the fork point.
+func (cm *ChainManager) handleReorg() {
+	cm.logger.Debugf("[%s] Possible reorg. Re-scanning transactions", cm.coinType)
+
+	reverted, forkHeight, err := cm.rollbackReorg()
+	if err != nil {
+		cm.logger.Errorf("[%s] Error rolling back reorged transactions: %s", cm.coinType, err)
+		forkHeight = 0
+	}
+	cm.trackReverted(reverted)
+
+	errChan := make(chan error)
+	cm.msgChan <- &scanJob{
+		fromHeight: forkHeight,
+		errChan:    errChan,
+	}
+	if err := <-errChan; err != nil {
+		cm.logger.Errorf("[%s] Error scanning transactions after reorg detected: %s", cm.coinType, err)
+	}
+}
+
+// trackReverted adds the transactions reverted by rollbackReorg to the
+// unconfirmed set and checks them against the new chain so those which
+// aren't mined again are still tracked. The chainHandler must be running.
+func (cm *ChainManager) trackReverted(reverted map[iwallet.TransactionID]iwallet.Transaction) {
+	if len(reverted) == 0 {
+		return
+	}
+	cm.logger.Infof("[%s] Reverted %d transactions reorged out of the main chain", cm.coinType, len(reverted))
+	for _, tx := range reverted {
+		cm.msgChan <- &addUnconfirmed{tx: tx}
+	}
+	cm.updateUnconfirmed(reverted)
+}
+
+// rollbackReorg finds the confirmed transactions whose block is no longer in
+// the main chain and marks them and their utxos as unconfirmed. It returns
+// the reverted transactions and the height to rescan from.
+//
+// Transactions saved before block IDs were recorded can't be checked. If
+// there are any, all transactions and utxos are deleted and the height
+// returned is zero so the wallet is rebuilt from a full rescan.
+func (cm *ChainManager) rollbackReorg() (map[iwallet.TransactionID]iwallet.Transaction, uint64, error) {
+	var confirmed []database.TransactionRecord
+	err := cm.db.View(func(dbtx database.Tx) error {
+		err := dbtx.Read().Where("coin=?", cm.coinType.CurrencyCode()).Where("block_height>?", 0).Find(&confirmed).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	blocks := make(map[iwallet.BlockID]uint64)
+	for _, rec := range confirmed {
+		if rec.BlockID == "" {
+			return nil, 0, cm.deleteTransactionsAndUtxos()
+		}
+		blocks[iwallet.BlockID(rec.BlockID)] = rec.BlockHeight
+	}
+
+	sorted := make([]iwallet.BlockInfo, 0, len(blocks))
+	for id, height := range blocks {
+		sorted = append(sorted, iwallet.BlockInfo{BlockID: id, Height: height})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Height > sorted[j].Height
+	})
+
+	// Check blocks from the tip down. Once we find one which is still in
+	// the main chain, everything below it must be as well.
+	var (
+		orphaned   = make(map[iwallet.BlockID]bool)
+		forkHeight uint64
+	)
+	for _, blk := range sorted {
+		inMainChain, err := cm.client.IsBlockInMainChain(blk)
+		if err != nil {
+			return nil, 0, err
+		}
+		forkHeight = blk.Height
+		if inMainChain {
+			break
+		}
+		orphaned[blk.BlockID] = true
+	}
+	if len(orphaned) == 0 {
+		return nil, forkHeight, nil
+	}
+
+	reverted := make(map[iwallet.TransactionID]iwallet.Transaction)
+	err = cm.db.Update(func(dbtx database.Tx) error {
+		for _, rec := range confirmed {
+			if !orphaned[iwallet.BlockID(rec.BlockID)] {
+				continue
+			}
+			tx, err := rec.Transaction()
+			if err != nil {
+				return err
+			}
+			tx.Height = 0
+			tx.BlockInfo = nil
+
+			txr, err := database.NewTransactionRecord(tx, cm.coinType)
+			if err != nil {
+				return err
+			}
+			if err := dbtx.Save(txr); err != nil {
+				return err
+			}
+
+			for _, to := range tx.To {
+				var utxo database.UtxoRecord
+				err := dbtx.Read().Where("coin=?", cm.coinType.CurrencyCode()).Where("outpoint=?", hex.EncodeToString(to.ID)).First(&utxo).Error
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					continue
+				} else if err != nil {
+					return err
+				}
+				utxo.Height = 0
+				if err := dbtx.Save(&utxo); err != nil {
+					return err
+				}
+			}
+			reverted[tx.ID] = tx
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return reverted, forkHeight, nil
+}
+
+// deleteTransactionsAndUtxos deletes all of the coin's transactions and utxos
+// from the database.
+func (cm *ChainManager) deleteTransactionsAndUtxos() error {
+	return cm.db.Update(func(tx database.Tx) error {
+		var savedTxs []database.TransactionRecord
+		if err := tx.Read().Where("coin=?", cm.coinType.CurrencyCode()).Find(&savedTxs).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		for _, rec := range savedTxs {
+			if err := tx.Delete("txid", rec.Txid, &database.TransactionRecord{}); err != nil {
+				return err
+			}
+		}
+		var savedUtxos []database.UtxoRecord
+		if err := tx.Read().Where("coin=?", cm.coinType.CurrencyCode()).Find(&savedUtxos).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		for _, rec := range savedUtxos {
+			if err := tx.Delete("outpoint", rec.Outpoint, &database.UtxoRecord{}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
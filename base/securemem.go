@@ -0,0 +1,190 @@
+package base
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcutil/coinset"
+	hd "github.com/btcsuite/btcutil/hdkeychain"
+	"sync"
+)
+
+// serializedKeyLen is the length of a serialized extended key without its
+// checksum: version, depth, parent fingerprint, child number, chain code
+// and key data.
+const serializedKeyLen = 4 + 1 + 4 + 4 + 32 + 33
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// base58Digits maps each base58 character to its value or -1.
+var base58Digits = func() [256]int {
+	var digits [256]int
+	for i := range digits {
+		digits[i] = -1
+	}
+	for i := 0; i < len(base58Alphabet); i++ {
+		digits[base58Alphabet[i]] = i
+	}
+	return digits
+}()
+
+// SecureBytes holds sensitive key material such as a decrypted master
+// private key. Where the platform supports it the underlying memory is
+// locked so that it will not be paged out to swap. Destroy must be called
+// when the bytes are no longer needed to zero and unlock the memory.
+type SecureBytes struct {
+	buf    []byte
+	locked bool
+	mtx    sync.Mutex
+}
+
+// NewSecureBytes copies b into a new locked buffer. The caller is
+// responsible for zeroing b if it is no longer needed.
+func NewSecureBytes(b []byte) *SecureBytes {
+	buf := make([]byte, len(b))
+	copy(buf, b)
+	return &SecureBytes{
+		buf:    buf,
+		locked: mlock(buf) == nil,
+	}
+}
+
+// Bytes returns the underlying buffer. The returned slice must not be
+// used after Destroy is called.
+func (s *SecureBytes) Bytes() []byte {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.buf
+}
+
+// Destroy zeroes the buffer and releases the memory lock.
+func (s *SecureBytes) Destroy() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	ZeroBytes(s.buf)
+	if s.locked {
+		munlock(s.buf)
+		s.locked = false
+	}
+	s.buf = nil
+}
+
+// ZeroBytes overwrites b with zeros.
+func ZeroBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// ZeroKey zeroes the private key material held by the extended key.
+// It is safe to call with a nil key.
+func ZeroKey(key *hd.ExtendedKey) {
+	if key != nil {
+		key.Zero()
+	}
+}
+
+// ZeroPrivKey zeroes the scalar of the private key. It is safe to call
+// with a nil key. SetInt64 alone only shortens the slice of words so each
+// word is overwritten first.
+func ZeroPrivKey(key *btcec.PrivateKey) {
+	if key != nil && key.D != nil {
+		words := key.D.Bits()
+		for i := range words {
+			words[i] = 0
+		}
+		key.D.SetInt64(0)
+	}
+}
+
+// newKeyFromBytes parses a base58 encoded extended private key held in b.
+// It does the same as hd.NewKeyFromString but without copying the key into
+// an immutable string, so the caller can zero b when it's done. The
+// intermediate buffers are zeroed before returning.
+func newKeyFromBytes(b []byte) (*hd.ExtendedKey, error) {
+	decoded, err := base58DecodeBytes(b)
+	if err != nil {
+		return nil, err
+	}
+	defer ZeroBytes(decoded)
+
+	if len(decoded) != serializedKeyLen+4 {
+		return nil, hd.ErrInvalidKeyLen
+	}
+	payload := decoded[:serializedKeyLen]
+	checksum := decoded[serializedKeyLen:]
+	if !bytes.Equal(checksum, chainhash.DoubleHashB(payload)[:4]) {
+		return nil, hd.ErrBadChecksum
+	}
+
+	keyData := payload[45:78]
+	if keyData[0] != 0x00 {
+		return nil, errors.New("not an extended private key")
+	}
+	keyData = keyData[1:]
+	if isZero(keyData) || bytes.Compare(keyData, btcec.S256().N.Bytes()) >= 0 {
+		return nil, hd.ErrUnusableSeed
+	}
+
+	// The extended key keeps these slices so they're copied out of the
+	// buffer we zero.
+	version := append([]byte(nil), payload[:4]...)
+	parentFP := append([]byte(nil), payload[5:9]...)
+	chainCode := append([]byte(nil), payload[13:45]...)
+	key := append([]byte(nil), keyData...)
+	return hd.NewExtendedKey(version, key, chainCode, parentFP, payload[4], binary.BigEndian.Uint32(payload[9:13]), true), nil
+}
+
+// base58DecodeBytes decodes base58 without converting b to a string or a
+// big.Int, either of which would leave a copy we can't zero.
+func base58DecodeBytes(b []byte) ([]byte, error) {
+	zeros := 0
+	for zeros < len(b) && b[zeros] == base58Alphabet[0] {
+		zeros++
+	}
+
+	// Each base58 digit holds log(58)/log(256) < 0.733 bytes.
+	buf := make([]byte, len(b)*733/1000+1)
+	for _, c := range b {
+		carry := base58Digits[c]
+		if carry < 0 {
+			ZeroBytes(buf)
+			return nil, hd.ErrInvalidKeyLen
+		}
+		for j := len(buf) - 1; j >= 0; j-- {
+			carry += 58 * int(buf[j])
+			buf[j] = byte(carry)
+			carry >>= 8
+		}
+	}
+
+	start := 0
+	for start < len(buf) && buf[start] == 0 {
+		start++
+	}
+	decoded := make([]byte, zeros+len(buf)-start)
+	copy(decoded[zeros:], buf[start:])
+	ZeroBytes(buf)
+	return decoded, nil
+}
+
+// isZero returns whether every byte of b is zero.
+func isZero(b []byte) bool {
+	var acc byte
+	for _, v := range b {
+		acc |= v
+	}
+	return acc == 0
+}
+
+// ZeroCoinKeys zeroes each of the keys returned by GatherCoins. Signing
+// paths should call this once the transaction has been signed.
+func ZeroCoinKeys(m map[coinset.Coin]*hd.ExtendedKey) {
+	for _, key := range m {
+		ZeroKey(key)
+	}
+}
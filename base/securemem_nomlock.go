@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package base
+
+import "errors"
+
+func mlock(b []byte) error {
+	return errors.New("mlock not supported on this platform")
+}
+
+func munlock(b []byte) error {
+	return nil
+}
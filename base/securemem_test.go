@@ -0,0 +1,100 @@
+package base
+
+import (
+	"bytes"
+	"github.com/btcsuite/btcd/btcec"
+	hd "github.com/btcsuite/btcutil/hdkeychain"
+	"testing"
+)
+
+func TestSecureBytes(t *testing.T) {
+	secret := []byte("super secret key material")
+	sb := NewSecureBytes(secret)
+
+	if !bytes.Equal(sb.Bytes(), secret) {
+		t.Fatal("Secure bytes do not match input")
+	}
+
+	buf := sb.Bytes()
+	sb.Destroy()
+
+	if !bytes.Equal(buf, make([]byte, len(secret))) {
+		t.Error("Buffer was not zeroed")
+	}
+	if sb.Bytes() != nil {
+		t.Error("Expected nil buffer after destroy")
+	}
+}
+
+func TestZeroKey(t *testing.T) {
+	key, err := hd.NewKeyFromString("tprv8ZgxMBicQKsPeghT19pungdFLMJM2hMs3EEn5WtgobD7wuQSFQu4VNaEJXH9HS3RhhLT4wgZ3hj31m3kafuxhL9vfGTRtBVLSog4zjxW3L1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ZeroKey(key)
+
+	if _, err := key.ECPrivKey(); err == nil {
+		t.Error("Expected error deriving private key from zeroed key")
+	}
+
+	// Should not panic.
+	ZeroKey(nil)
+}
+
+func TestZeroPrivKey(t *testing.T) {
+	key, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	words := key.D.Bits()
+
+	ZeroPrivKey(key)
+
+	for i, w := range words {
+		if w != 0 {
+			t.Errorf("Word %d was not zeroed", i)
+		}
+	}
+	if key.D.Sign() != 0 {
+		t.Error("Expected zero scalar")
+	}
+
+	// Should not panic.
+	ZeroPrivKey(nil)
+}
+
+func TestNewKeyFromBytes(t *testing.T) {
+	const xprv = "tprv8ZgxMBicQKsPeghT19pungdFLMJM2hMs3EEn5WtgobD7wuQSFQu4VNaEJXH9HS3RhhLT4wgZ3hj31m3kafuxhL9vfGTRtBVLSog4zjxW3L1"
+	buf := []byte(xprv)
+	key, err := newKeyFromBytes(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.String() != xprv {
+		t.Errorf("Expected %s, got %s", xprv, key.String())
+	}
+
+	// Zeroing the buffer must not affect the parsed key.
+	ZeroBytes(buf)
+	if key.String() != xprv {
+		t.Error("Parsed key shares memory with the buffer")
+	}
+
+	bad := []byte(xprv)
+	bad[len(bad)-1] = '2'
+	if _, err := newKeyFromBytes(bad); err != hd.ErrBadChecksum {
+		t.Errorf("Expected ErrBadChecksum, got %v", err)
+	}
+	if _, err := newKeyFromBytes([]byte("0OIl")); err != hd.ErrInvalidKeyLen {
+		t.Errorf("Expected ErrInvalidKeyLen for invalid characters, got %v", err)
+	}
+
+	pub, err := key.Neuter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newKeyFromBytes([]byte(pub.String())); err == nil {
+		t.Error("Expected extended public key to be rejected")
+	}
+}
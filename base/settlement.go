@@ -0,0 +1,220 @@
+package base
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"gorm.io/gorm"
+	"strings"
+)
+
+// ErrEscrowNotReleasable is returned when signing or releasing the funds
+// of a tracked escrow which EscrowReleasable says isn't eligible for
+// release.
+var ErrEscrowNotReleasable = errors.New("escrow is not releasable")
+
+// DefaultConfirmations is the number of confirmations a transaction needs
+// before its funds are treated as settled if the ConfirmationPolicy doesn't
+// say otherwise.
+const DefaultConfirmations = 1
+
+// ConfirmationPolicy sets how many confirmations a coin's transactions need
+// before their funds are treated as settled. Coins differ: a merchant taking
+// Bitcoin Cash may settle on the first confirmation while Bitcoin escrows
+// may want six.
+type ConfirmationPolicy struct {
+	// Settled is the number of confirmations a transaction needs for the
+	// funds it pays the wallet to count as confirmed in Balances and for
+	// a TransactionSettledEvent to be emitted. Defaults to
+	// DefaultConfirmations.
+	Settled uint64
+
+	// Escrow is the number of confirmations the transactions funding an
+	// escrow need before it's eligible for release. Defaults to Settled.
+	Escrow uint64
+}
+
+// SettledConfirmations returns the confirmations needed to settle a
+// transaction.
+func (p ConfirmationPolicy) SettledConfirmations() uint64 {
+	if p.Settled == 0 {
+		return DefaultConfirmations
+	}
+	return p.Settled
+}
+
+// EscrowConfirmations returns the confirmations an escrow's funding needs
+// before it can be released.
+func (p ConfirmationPolicy) EscrowConfirmations() uint64 {
+	if p.Escrow == 0 {
+		return p.SettledConfirmations()
+	}
+	return p.Escrow
+}
+
+// TransactionSettledEvent is emitted when a wallet transaction reaches the
+// confirmations needed to settle it. It's emitted again if the transaction
+// is reorged into another block and settles there.
+type TransactionSettledEvent struct {
+	TransactionID iwallet.TransactionID
+	Height        uint64
+	Confirmations uint64
+}
+
+// confirmations returns the confirmations of a transaction at height when
+// the best block is at best. A transaction in a block past best has one.
+func confirmations(height, best uint64) uint64 {
+	switch {
+	case height == 0:
+		return 0
+	case best < height:
+		return 1
+	}
+	return best - height + 1
+}
+
+// isSettled returns whether a transaction or utxo at height has the
+// confirmations needed to settle it.
+func (w *WalletBase) isSettled(height uint64) bool {
+	var best uint64
+	if w.ChainManager != nil {
+		best = w.ChainManager.BestBlock().Height
+	}
+	return confirmations(height, best) >= w.Confirmations.SettledConfirmations()
+}
+
+// settlesUnconfirmedChange returns whether unconfirmed change from
+// transactions with confirmed inputs is treated as settled, which it is
+// when a single confirmation settles.
+func (w *WalletBase) settlesUnconfirmedChange() bool {
+	return w.Confirmations.SettledConfirmations() <= 1
+}
+
+// notifySettled marks the confirmed wallet transactions which have reached
+// the confirmations needed to settle them and emits a
+// TransactionSettledEvent for each. Like notifyWaiters it's run whenever a
+// block arrives or transactions are saved.
+func (cm *ChainManager) notifySettled() {
+	cm.settleMtx.Lock()
+	defer cm.settleMtx.Unlock()
+
+	needed := cm.confirmations
+	if needed == 0 {
+		needed = DefaultConfirmations
+	}
+	best := cm.BestBlock()
+	if best.Height+1 < needed {
+		return
+	}
+
+	var events []*TransactionSettledEvent
+	err := cm.db.Update(func(dbtx database.Tx) error {
+		var records []database.TransactionRecord
+		err := dbtx.Read().Where("coin=?", cm.coinType.CurrencyCode()).
+			Where("settled=?", false).
+			Where("block_height>?", 0).
+			Where("block_height<=?", best.Height+1-needed).
+			Find(&records).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		for i := range records {
+			records[i].Settled = true
+			if err := dbtx.Save(&records[i]); err != nil {
+				return err
+			}
+			events = append(events, &TransactionSettledEvent{
+				TransactionID: iwallet.TransactionID(records[i].Txid),
+				Height:        records[i].BlockHeight,
+				Confirmations: confirmations(records[i].BlockHeight, best.Height),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		cm.logger.Errorf("[%s] Error checking settled transactions: %s", cm.coinType, err)
+		return
+	}
+	for _, event := range events {
+		cm.walletBus.Emit(event)
+	}
+}
+
+// SubscribeSettledEvents returns a subscription to the
+// *TransactionSettledEvents of the wallet's transactions. The wallet must be
+// open.
+func (w *WalletBase) SubscribeSettledEvents() (Subscription, error) {
+	if w.ChainManager == nil {
+		return nil, errors.New("wallet is not open")
+	}
+	return w.ChainManager.walletBus.Subscribe(&TransactionSettledEvent{})
+}
+
+// EscrowReleasable returns whether the escrow at addr, recorded with
+// TrackEscrow, is eligible for release. It must have been funded and not
+// released, and each transaction funding it must have the Escrow
+// confirmations of the wallet's ConfirmationPolicy. The wallets enforce
+// it with CheckEscrowRelease.
+func (w *WalletBase) EscrowReleasable(addr iwallet.Address) (bool, error) {
+	var record database.EscrowRecord
+	err := w.DB.View(func(dbtx database.Tx) error {
+		return dbtx.Read().Where("coin=?", w.CoinType.CurrencyCode()).Where("addr=?", addr.String()).First(&record).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, errors.New("escrow not found")
+	} else if err != nil {
+		return false, err
+	}
+	if record.FundingTxids == "" || record.ReleaseTxids != "" {
+		return false, nil
+	}
+
+	bcInfo, err := w.BlockchainInfo()
+	if err != nil {
+		return false, err
+	}
+	needed := w.Confirmations.EscrowConfirmations()
+	for _, txid := range strings.Split(record.FundingTxids, ";") {
+		// Funding transactions paid by the other parties are only known
+		// to the chain client.
+		tx, err := w.GetTransaction(iwallet.TransactionID(txid))
+		if err != nil {
+			return false, err
+		}
+		if confirmations(tx.Height, bcInfo.Height) < needed {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// CheckEscrowRelease returns ErrEscrowNotReleasable if the escrow with the
+// redeem script was recorded with TrackEscrow and isn't releasable. Escrows
+// which aren't tracked aren't checked. The wallets call it before signing
+// an escrow spend, building one from the signatures or releasing the funds
+// after the timeout.
+func (w *WalletBase) CheckEscrowRelease(redeemScript []byte) error {
+	var records []database.EscrowRecord
+	err := w.DB.View(func(dbtx database.Tx) error {
+		return dbtx.Read().Where("coin=?", w.CoinType.CurrencyCode()).Find(&records).Error
+	})
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+	for _, record := range records {
+		if !bytes.Equal(record.RedeemScript, redeemScript) {
+			continue
+		}
+		releasable, err := w.EscrowReleasable(iwallet.NewAddress(record.Addr, w.CoinType))
+		if err != nil {
+			return err
+		}
+		if !releasable {
+			return fmt.Errorf("%w: %s", ErrEscrowNotReleasable, record.Addr)
+		}
+		return nil
+	}
+	return nil
+}
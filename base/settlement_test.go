@@ -0,0 +1,173 @@
+package base
+
+import (
+	"encoding/hex"
+	"errors"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"testing"
+	"time"
+)
+
+func TestChainManager_notifySettled(t *testing.T) {
+	chain, _, err := newTestChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.db.Close()
+	chain.confirmations = 3
+
+	sub, err := chain.walletBus.Subscribe(&TransactionSettledEvent{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	setHeight := func(height uint64) {
+		chain.bestMtx.Lock()
+		chain.best = iwallet.BlockInfo{Height: height}
+		chain.bestMtx.Unlock()
+	}
+	expectNone := func() {
+		select {
+		case event := <-sub.Out():
+			t.Errorf("Unexpected event %+v", event)
+		case <-time.After(time.Millisecond * 100):
+		}
+	}
+
+	tx := NewMockTransaction(nil, nil)
+	tx.Height = 101
+	err = chain.db.Update(func(dbtx database.Tx) error {
+		rec, err := database.NewTransactionRecord(tx, iwallet.CtMock)
+		if err != nil {
+			return err
+		}
+		return dbtx.Save(rec)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setHeight(102)
+	go chain.notifySettled()
+	expectNone()
+
+	setHeight(104)
+	go chain.notifySettled()
+	select {
+	case event := <-sub.Out():
+		settled := event.(*TransactionSettledEvent)
+		if settled.TransactionID != tx.ID || settled.Height != 101 || settled.Confirmations != 4 {
+			t.Errorf("Unexpected event %+v", settled)
+		}
+	case <-time.After(time.Second * 10):
+		t.Fatal("Timed out waiting for settlement")
+	}
+
+	// Each transaction only settles once.
+	go chain.notifySettled()
+	expectNone()
+}
+
+func TestWalletBase_ConfirmationPolicy(t *testing.T) {
+	w, err := setupWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.ChainManager = NewChainManager(&ChainConfig{
+		DB:       w.DB,
+		CoinType: iwallet.CtMock,
+		Logger:   w.Logger,
+	})
+	w.Confirmations = ConfirmationPolicy{Settled: 2, Escrow: 3}
+	setHeight := func(height uint64) {
+		w.ChainManager.bestMtx.Lock()
+		w.ChainManager.best = iwallet.BlockInfo{Height: height}
+		w.ChainManager.bestMtx.Unlock()
+	}
+
+	escrowAddr := mockAddress()
+	redeemScript := []byte{0x52, 0xae}
+	funding := NewMockTransaction(nil, &escrowAddr)
+	funding.Height = 10
+	err = w.DB.Update(func(dbtx database.Tx) error {
+		rec, err := database.NewTransactionRecord(funding, iwallet.CtMock)
+		if err != nil {
+			return err
+		}
+		if err := dbtx.Save(rec); err != nil {
+			return err
+		}
+		if err := dbtx.Save(&database.EscrowRecord{
+			Addr:         escrowAddr.String(),
+			Coin:         iwallet.CtMock.CurrencyCode(),
+			RedeemScript: redeemScript,
+			FundedAmount: funding.To[0].Amount.String(),
+			FundingTxids: funding.ID.String(),
+		}); err != nil {
+			return err
+		}
+		return dbtx.Save(&database.UtxoRecord{
+			Outpoint: hex.EncodeToString(mockOutpoint()),
+			Coin:     iwallet.CtMock.CurrencyCode(),
+			Height:   10,
+			Amount:   "1000",
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		height      uint64
+		confirmed   int64
+		releasable  bool
+		description string
+	}{
+		{10, 0, false, "one confirmation"},
+		{11, 1000, false, "two confirmations"},
+		{12, 1000, true, "three confirmations"},
+	} {
+		setHeight(test.height)
+		balance, err := w.Balances()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if balance.Confirmed.Cmp(iwallet.NewAmount(test.confirmed)) != 0 {
+			t.Errorf("%s: expected confirmed balance %d, got %s", test.description, test.confirmed, balance.Confirmed)
+		}
+		releasable, err := w.EscrowReleasable(escrowAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if releasable != test.releasable {
+			t.Errorf("%s: expected releasable %t, got %t", test.description, test.releasable, releasable)
+		}
+
+		// Signing and releasing are refused until the escrow is
+		// releasable.
+		err = w.CheckEscrowRelease(redeemScript)
+		if test.releasable && err != nil {
+			t.Errorf("%s: expected release to be allowed, got %v", test.description, err)
+		} else if !test.releasable && !errors.Is(err, ErrEscrowNotReleasable) {
+			t.Errorf("%s: expected ErrEscrowNotReleasable, got %v", test.description, err)
+		}
+		canRelease, err := w.CanReleaseFunds(iwallet.Transaction{}, nil, redeemScript)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if canRelease != test.releasable {
+			t.Errorf("%s: expected CanReleaseFunds %t, got %t", test.description, test.releasable, canRelease)
+		}
+	}
+
+	// Escrows which aren't tracked aren't checked.
+	if err := w.CheckEscrowRelease([]byte{0x51}); err != nil {
+		t.Errorf("Expected untracked escrow to be allowed, got %v", err)
+	}
+
+	if _, err := w.EscrowReleasable(mockAddress()); err == nil {
+		t.Error("Expected an error for an untracked escrow")
+	}
+}
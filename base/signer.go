@@ -0,0 +1,21 @@
+package base
+
+import (
+	"github.com/btcsuite/btcd/btcec"
+)
+
+// KeyPath is the path of a wallet key below the account key.
+type KeyPath struct {
+	Change bool   `json:"change"`
+	Index  uint32 `json:"index"`
+}
+
+// Signer signs with keys the Keychain doesn't hold, such as keys split
+// between devices. A wallet created with CreateWatchOnlyWallet spends
+// using its Signer, which must sign for the keys below the account key the
+// wallet was created with.
+type Signer interface {
+	// Sign returns an ECDSA signature of the digest by the key at the
+	// path.
+	Sign(path KeyPath, digest []byte) (*btcec.Signature, error)
+}
@@ -0,0 +1,238 @@
+package base
+
+import (
+	"encoding/hex"
+	"errors"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	hd "github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"gorm.io/gorm"
+	"math/big"
+	"time"
+)
+
+// silentPaymentPurpose is the hardened index below the account key of the
+// silent payment keys.
+const silentPaymentPurpose = 352
+
+// ErrSilentPaymentsDisabled is returned by the silent payment methods of a
+// keychain created without the SilentPayments option.
+var ErrSilentPaymentsDisabled = errors.New("silent payments are not enabled")
+
+// SilentPayments enables BIP 352 silent payments. The wallet publishes a
+// static scan and spend key and finds the outputs paid to it by scanning
+// the chain. Each output found is added with AddSilentPaymentOutput.
+func SilentPayments() KeychainOption {
+	return func(cfg *KeychainConfig) error {
+		cfg.SilentPayments = true
+		return nil
+	}
+}
+
+// silentPaymentKeys derives the scan and spend keys from the account
+// private key. BIP 352 puts them at m / 352' / coin_type' / account' / 1' / 0
+// and 0' / 0 but like payment codes the keychain only stores the account
+// level so they're derived at account' / 352' / 1' / 0 and 0' / 0.
+func silentPaymentKeys(accountPrivKey *hd.ExtendedKey) (scan, spend *btcec.PrivateKey, err error) {
+	purposeKey, err := accountPrivKey.Child(hd.HardenedKeyStart + silentPaymentPurpose)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer ZeroKey(purposeKey)
+
+	derive := func(branch uint32) (*btcec.PrivateKey, error) {
+		branchKey, err := purposeKey.Child(hd.HardenedKeyStart + branch)
+		if err != nil {
+			return nil, err
+		}
+		defer ZeroKey(branchKey)
+		return childPrivKey(branchKey, 0)
+	}
+	scan, err = derive(1)
+	if err != nil {
+		return nil, nil, err
+	}
+	spend, err = derive(0)
+	if err != nil {
+		ZeroPrivKey(scan)
+		return nil, nil, err
+	}
+	return scan, spend, nil
+}
+
+// setSilentPaymentKeys derives the silent payment keys from the account
+// private key. The spend private key is held until the keychain locks. The
+// scan private key and spend public key are saved so the wallet can keep
+// scanning while it's locked.
+func (kc *Keychain) setSilentPaymentKeys(dbtx database.Tx, accountPrivKey *hd.ExtendedKey) error {
+	if !kc.silentPayments {
+		return nil
+	}
+	scan, spend, err := silentPaymentKeys(accountPrivKey)
+	if err != nil {
+		return err
+	}
+	defer ZeroPrivKey(scan)
+	kc.silentPaymentSpendKey = spend
+
+	var coinRecord database.CoinRecord
+	if err := dbtx.Read().Where("coin=?", kc.coinType.CurrencyCode()).Find(&coinRecord).Error; err != nil {
+		return err
+	}
+	scanHex := hex.EncodeToString(padded32(scan.D))
+	spendHex := hex.EncodeToString(spend.PubKey().SerializeCompressed())
+	if coinRecord.SilentPaymentScanKey == scanHex && coinRecord.SilentPaymentSpendKey == spendHex {
+		return nil
+	}
+	coinRecord.SilentPaymentScanKey = scanHex
+	coinRecord.SilentPaymentSpendKey = spendHex
+	return dbtx.Save(&coinRecord)
+}
+
+// SilentPaymentKeys returns the scan private key and spend public key of
+// the wallet's silent payment address. An encrypted keychain must have been
+// unlocked once for the keys to be known. The caller must zero the scan key.
+func (kc *Keychain) SilentPaymentKeys() (*btcec.PrivateKey, *btcec.PublicKey, error) {
+	if !kc.silentPayments {
+		return nil, nil, ErrSilentPaymentsDisabled
+	}
+	if kc.watchOnly {
+		return nil, nil, ErrWatchOnlyKeychain
+	}
+	var coinRecord database.CoinRecord
+	err := kc.db.View(func(tx database.Tx) error {
+		return tx.Read().Where("coin=?", kc.coinType.CurrencyCode()).Find(&coinRecord).Error
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if coinRecord.SilentPaymentScanKey == "" {
+		return nil, nil, ErrEncryptedKeychain
+	}
+	scanBytes, err := hex.DecodeString(coinRecord.SilentPaymentScanKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer ZeroBytes(scanBytes)
+	spendBytes, err := hex.DecodeString(coinRecord.SilentPaymentSpendKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	spend, err := btcec.ParsePubKey(spendBytes, btcec.S256())
+	if err != nil {
+		return nil, nil, err
+	}
+	scan, _ := btcec.PrivKeyFromBytes(btcec.S256(), scanBytes)
+	return scan, spend, nil
+}
+
+// SilentPaymentHeight returns the height of the next block to scan for
+// silent payments, or zero if none have been scanned.
+func (kc *Keychain) SilentPaymentHeight() (uint64, error) {
+	var coinRecord database.CoinRecord
+	err := kc.db.View(func(tx database.Tx) error {
+		return tx.Read().Where("coin=?", kc.coinType.CurrencyCode()).Find(&coinRecord).Error
+	})
+	return coinRecord.SilentPaymentHeight, err
+}
+
+// SetSilentPaymentHeight saves the height of the next block to scan for
+// silent payments.
+func (kc *Keychain) SetSilentPaymentHeight(dbtx database.Tx, height uint64) error {
+	var coinRecord database.CoinRecord
+	if err := dbtx.Read().Where("coin=?", kc.coinType.CurrencyCode()).Find(&coinRecord).Error; err != nil {
+		return err
+	}
+	coinRecord.SilentPaymentHeight = height
+	return dbtx.Save(&coinRecord)
+}
+
+// AddSilentPaymentOutput records an address paid by a silent payment.
+// tweak is the scalar added to the spend key to get the address's key. It
+// returns false if the address was already known.
+func (kc *Keychain) AddSilentPaymentOutput(dbtx database.Tx, addr iwallet.Address, tweak []byte, txid iwallet.TransactionID) (bool, error) {
+	if !kc.silentPayments {
+		return false, ErrSilentPaymentsDisabled
+	}
+	if len(tweak) != 32 {
+		return false, errors.New("silent payment tweak must be 32 bytes")
+	}
+	var record database.SilentPaymentOutputRecord
+	err := dbtx.Read().Where("coin=?", kc.coinType.CurrencyCode()).Where("addr=?", addr.String()).First(&record).Error
+	if err == nil {
+		return false, nil
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, err
+	}
+	return true, dbtx.Save(&database.SilentPaymentOutputRecord{
+		Addr:      addr.String(),
+		Coin:      kc.coinType.CurrencyCode(),
+		Tweak:     hex.EncodeToString(tweak),
+		Txid:      txid.String(),
+		CreatedAt: time.Now(),
+	})
+}
+
+// silentPaymentAddresses returns the addresses paid by silent payments.
+func (kc *Keychain) silentPaymentAddresses(dbtx database.Tx) ([]iwallet.Address, error) {
+	var records []database.SilentPaymentOutputRecord
+	err := dbtx.Read().Where("coin=?", kc.coinType.CurrencyCode()).Find(&records).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	addrs := make([]iwallet.Address, 0, len(records))
+	for _, rec := range records {
+		addrs = append(addrs, iwallet.NewAddress(rec.Addr, kc.coinType))
+	}
+	return addrs, nil
+}
+
+// silentPaymentKeyForAddress returns the key of an address paid by a silent
+// payment, the spend key plus the output's tweak. If the keychain is locked
+// the spend key is derived from accountPrivKey. gorm.ErrRecordNotFound is
+// returned for other addresses. The caller must hold the mutex.
+func (kc *Keychain) silentPaymentKeyForAddress(dbtx database.Tx, addr iwallet.Address, accountPrivKey *hd.ExtendedKey) (*hd.ExtendedKey, error) {
+	var record database.SilentPaymentOutputRecord
+	err := dbtx.Read().Where("coin=?", kc.coinType.CurrencyCode()).Where("addr=?", addr.String()).First(&record).Error
+	if err != nil {
+		return nil, err
+	}
+	tweak, err := hex.DecodeString(record.Tweak)
+	if err != nil {
+		return nil, err
+	}
+	spend := kc.silentPaymentSpendKey
+	if spend == nil && accountPrivKey != nil {
+		var scan *btcec.PrivateKey
+		scan, spend, err = silentPaymentKeys(accountPrivKey)
+		if err != nil {
+			return nil, err
+		}
+		ZeroPrivKey(scan)
+		defer ZeroPrivKey(spend)
+	}
+	if spend == nil {
+		return nil, ErrEncryptedKeychain
+	}
+	d := new(big.Int).SetBytes(tweak)
+	d.Add(d, spend.D)
+	d.Mod(d, btcec.S256().N)
+	defer d.SetInt64(0)
+
+	// The key has no chain code as nothing is derived below it.
+	return hd.NewExtendedKey(chaincfg.MainNetParams.HDPrivateKeyID[:], padded32(d), make([]byte, 32), []byte{0, 0, 0, 0}, 0, 0, true), nil
+}
+
+// markSilentPaymentAddressUsed marks an address paid by a silent payment as
+// used. gorm.ErrRecordNotFound is returned for other addresses.
+func (kc *Keychain) markSilentPaymentAddressUsed(dbtx database.Tx, addr iwallet.Address) error {
+	var record database.SilentPaymentOutputRecord
+	err := dbtx.Read().Where("coin=?", kc.coinType.CurrencyCode()).Where("addr=?", addr.String()).First(&record).Error
+	if err != nil {
+		return err
+	}
+	record.Used = true
+	return dbtx.Save(&record)
+}
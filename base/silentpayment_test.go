@@ -0,0 +1,129 @@
+package base
+
+import (
+	"bytes"
+	"errors"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"testing"
+)
+
+func TestKeychain_SilentPayments(t *testing.T) {
+	kc, err := setupKeychain(SilentPayments())
+	if err != nil {
+		t.Fatal(err)
+	}
+	scan, spend, err := kc.SilentPaymentKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scan.PubKey().IsEqual(spend) {
+		t.Fatal("Expected different scan and spend keys")
+	}
+
+	tweak := bytes.Repeat([]byte{0x07}, 32)
+	addr := iwallet.NewAddress("silentpaymentaddress", iwallet.CtMock)
+	err = kc.db.Update(func(tx database.Tx) error {
+		added, err := kc.AddSilentPaymentOutput(tx, addr, tweak, "abc")
+		if err != nil {
+			return err
+		}
+		if !added {
+			t.Error("Expected the output to be added")
+		}
+		added, err = kc.AddSilentPaymentOutput(tx, addr, tweak, "abc")
+		if err != nil {
+			return err
+		}
+		if added {
+			t.Error("Expected a known output not to be added again")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	has, err := kc.HasKey(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !has {
+		t.Error("Expected HasKey to return true")
+	}
+	all, err := kc.GetAddresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, a := range all {
+		if a.String() == addr.String() {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("Silent payment address not returned by GetAddresses")
+	}
+
+	// The output's key is the spend key plus the tweak.
+	curve := btcec.S256()
+	tweakX, tweakY := curve.ScalarBaseMult(tweak)
+	ex, ey := curve.Add(spend.X, spend.Y, tweakX, tweakY)
+	err = kc.db.Update(func(tx database.Tx) error {
+		key, err := kc.KeyForAddress(tx, addr, nil)
+		if err != nil {
+			return err
+		}
+		priv, err := key.ECPrivKey()
+		if err != nil {
+			return err
+		}
+		if priv.PubKey().X.Cmp(ex) != 0 || priv.PubKey().Y.Cmp(ey) != 0 {
+			t.Error("KeyForAddress returned the wrong key")
+		}
+		return kc.MarkAddressAsUsed(tx, addr)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var record database.SilentPaymentOutputRecord
+	err = kc.db.View(func(tx database.Tx) error {
+		return tx.Read().Where("addr=?", addr.String()).First(&record).Error
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !record.Used {
+		t.Error("Expected the address to be marked used")
+	}
+
+	// The scan key is still available once locked but the spend key isn't.
+	if err := kc.SetPassphase([]byte("letmein")); err != nil {
+		t.Fatal(err)
+	}
+	lockedScan, _, err := kc.SilentPaymentKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lockedScan.D.Cmp(scan.D) != 0 {
+		t.Error("Expected the same scan key while locked")
+	}
+	err = kc.db.View(func(tx database.Tx) error {
+		_, err := kc.KeyForAddress(tx, addr, nil)
+		return err
+	})
+	if !errors.Is(err, ErrEncryptedKeychain) {
+		t.Errorf("Expected ErrEncryptedKeychain, got %v", err)
+	}
+}
+
+func TestKeychain_SilentPaymentsDisabled(t *testing.T) {
+	kc, err := setupKeychain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := kc.SilentPaymentKeys(); err != ErrSilentPaymentsDisabled {
+		t.Errorf("Expected ErrSilentPaymentsDisabled, got %v", err)
+	}
+}
@@ -0,0 +1,150 @@
+package base
+
+import (
+	"errors"
+	"fmt"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"gorm.io/gorm"
+	"sync"
+	"time"
+)
+
+const (
+	// spendLimitWindow is the rolling window MaxPerDay applies to.
+	spendLimitWindow = time.Hour * 24
+
+	// spendAuthorizationTTL is how long an AuthorizeSpend lasts if no
+	// spend over the limit uses it.
+	spendAuthorizationTTL = time.Minute * 5
+)
+
+// ErrSpendLimitExceeded is returned for a spend over the wallet's
+// SpendPolicy which wasn't authorized with AuthorizeSpend.
+var ErrSpendLimitExceeded = errors.New("spend exceeds the wallet's spend limit")
+
+// SpendPolicy caps how much a wallet spends so that stolen API credentials
+// can't be used to empty it. A spend of more than MaxPerTransaction, or
+// which would take the amount spent in the last 24 hours over MaxPerDay, is
+// refused with ErrSpendLimitExceeded unless the passphrase is re-entered
+// with AuthorizeSpend first. Spends held for another party's signature,
+// such as a cosigner's, are authorized by that party but still count
+// towards MaxPerDay.
+//
+// Amounts include the fee. A zero limit is unlimited and the zero value
+// disables the policy.
+type SpendPolicy struct {
+	MaxPerTransaction iwallet.Amount
+	MaxPerDay         iwallet.Amount
+}
+
+// Enabled returns whether either limit is set.
+func (p SpendPolicy) Enabled() bool {
+	zero := iwallet.NewAmount(0)
+	return p.MaxPerTransaction.Cmp(zero) > 0 || p.MaxPerDay.Cmp(zero) > 0
+}
+
+// spendAuthorization is a pending AuthorizeSpend.
+type spendAuthorization struct {
+	mtx     sync.Mutex
+	expires time.Time
+}
+
+// AuthorizeSpend checks the passphrase and allows the next spend over the
+// wallet's SpendPolicy. The authorization is used up by that spend or
+// expires after five minutes.
+func (w *WalletBase) AuthorizeSpend(pw []byte) error {
+	if err := w.Keychain.VerifyPassphrase(pw); err != nil {
+		return err
+	}
+	w.spendAuth.mtx.Lock()
+	defer w.spendAuth.mtx.Unlock()
+
+	w.spendAuth.expires = time.Now().Add(spendAuthorizationTTL)
+	return nil
+}
+
+// CheckSpendPolicy returns ErrSpendLimitExceeded if a spend of amount would
+// break the wallet's SpendPolicy and it hasn't been authorized. An
+// authorization is used up by the spend it allows.
+func (w *WalletBase) CheckSpendPolicy(dbtx database.Tx, amount iwallet.Amount) error {
+	if !w.SpendPolicy.Enabled() {
+		return nil
+	}
+	var reason string
+	if max := w.SpendPolicy.MaxPerTransaction; max.Cmp(iwallet.NewAmount(0)) > 0 && amount.Cmp(max) > 0 {
+		reason = fmt.Sprintf("%s is more than the per transaction limit of %s", amount, max)
+	}
+	if max := w.SpendPolicy.MaxPerDay; reason == "" && max.Cmp(iwallet.NewAmount(0)) > 0 {
+		spent, err := w.spentSince(dbtx, time.Now().Add(-spendLimitWindow))
+		if err != nil {
+			return err
+		}
+		if total := spent.Add(amount); total.Cmp(max) > 0 {
+			reason = fmt.Sprintf("%s spent in the last 24 hours is more than the daily limit of %s", total, max)
+		}
+	}
+	if reason == "" {
+		return nil
+	}
+
+	w.spendAuth.mtx.Lock()
+	defer w.spendAuth.mtx.Unlock()
+
+	if time.Now().Before(w.spendAuth.expires) {
+		w.spendAuth.expires = time.Time{}
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrSpendLimitExceeded, reason)
+}
+
+// RecordSpend saves amount as spent by the transaction now so it counts
+// towards the daily limit. Spends which have left the window are deleted.
+// Nothing is saved if the wallet has no SpendPolicy.
+func (w *WalletBase) RecordSpend(dbtx database.Tx, txid iwallet.TransactionID, amount iwallet.Amount) error {
+	if !w.SpendPolicy.Enabled() {
+		return nil
+	}
+	now := time.Now()
+	var expired []database.SpendRecord
+	err := dbtx.Read().Where("coin=?", w.CoinType.CurrencyCode()).Where("timestamp < ?", now.Add(-spendLimitWindow)).Find(&expired).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+	for _, rec := range expired {
+		if err := dbtx.Delete("txid", rec.Txid, &database.SpendRecord{}); err != nil {
+			return err
+		}
+	}
+	return dbtx.Save(&database.SpendRecord{
+		Txid:      txid.String(),
+		Coin:      w.CoinType.CurrencyCode(),
+		Amount:    amount.String(),
+		Timestamp: now,
+	})
+}
+
+// SpentInLastDay returns the amount counted towards the SpendPolicy's
+// daily limit.
+func (w *WalletBase) SpentInLastDay() (iwallet.Amount, error) {
+	var spent iwallet.Amount
+	err := w.DB.View(func(dbtx database.Tx) error {
+		var err error
+		spent, err = w.spentSince(dbtx, time.Now().Add(-spendLimitWindow))
+		return err
+	})
+	return spent, err
+}
+
+func (w *WalletBase) spentSince(dbtx database.Tx, since time.Time) (iwallet.Amount, error) {
+	var records []database.SpendRecord
+	err := dbtx.Read().Where("coin=?", w.CoinType.CurrencyCode()).Where("timestamp >= ?", since).Find(&records).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return iwallet.Amount{}, err
+	}
+	spent := iwallet.NewAmount(0)
+	for _, rec := range records {
+		spent = spent.Add(iwallet.NewAmount(rec.Amount))
+	}
+	return spent, nil
+}
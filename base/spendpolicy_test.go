@@ -0,0 +1,99 @@
+package base
+
+import (
+	"errors"
+	hd "github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"testing"
+	"time"
+)
+
+func TestWalletBase_SpendPolicy(t *testing.T) {
+	w, err := setupWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	xpriv, err := hd.NewKeyFromString("tprv8ZgxMBicQKsPeghT19pungdFLMJM2hMs3EEn5WtgobD7wuQSFQu4VNaEJXH9HS3RhhLT4wgZ3hj31m3kafuxhL9vfGTRtBVLSog4zjxW3L1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pw := []byte("letmein")
+	if err := w.CreateWallet(*xpriv, nil, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.OpenWallet(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SetPassphase(pw); err != nil {
+		t.Fatal(err)
+	}
+
+	spend := func(txid string, amount int64) error {
+		return w.DB.Update(func(dbtx database.Tx) error {
+			if err := w.CheckSpendPolicy(dbtx, iwallet.NewAmount(amount)); err != nil {
+				return err
+			}
+			return w.RecordSpend(dbtx, iwallet.TransactionID(txid), iwallet.NewAmount(amount))
+		})
+	}
+
+	// Nothing is limited or recorded without a policy.
+	if err := spend("a", 1000000); err != nil {
+		t.Fatal(err)
+	}
+	if spent, err := w.SpentInLastDay(); err != nil || spent.Cmp(iwallet.NewAmount(0)) != 0 {
+		t.Errorf("Expected nothing recorded, got %s, %v", spent, err)
+	}
+
+	w.SpendPolicy = SpendPolicy{
+		MaxPerTransaction: iwallet.NewAmount(50000),
+		MaxPerDay:         iwallet.NewAmount(100000),
+	}
+	if err := spend("b", 60000); !errors.Is(err, ErrSpendLimitExceeded) {
+		t.Errorf("Expected per transaction limit, got %v", err)
+	}
+	if err := spend("c", 40000); err != nil {
+		t.Fatal(err)
+	}
+	if err := spend("d", 40000); err != nil {
+		t.Fatal(err)
+	}
+	if err := spend("e", 30000); !errors.Is(err, ErrSpendLimitExceeded) {
+		t.Errorf("Expected daily limit, got %v", err)
+	}
+	if spent, err := w.SpentInLastDay(); err != nil || spent.Cmp(iwallet.NewAmount(80000)) != 0 {
+		t.Errorf("Expected 80000 spent, got %s, %v", spent, err)
+	}
+
+	// An authorization allows one spend over the limit.
+	if err := w.AuthorizeSpend(pw); err != nil {
+		t.Fatal(err)
+	}
+	if err := spend("e", 30000); err != nil {
+		t.Errorf("Expected authorized spend to succeed, got %v", err)
+	}
+	if err := spend("f", 30000); !errors.Is(err, ErrSpendLimitExceeded) {
+		t.Errorf("Expected authorization to be used up, got %v", err)
+	}
+
+	// Spends which have left the window don't count.
+	err = w.DB.Update(func(dbtx database.Tx) error {
+		return dbtx.Save(&database.SpendRecord{
+			Txid:      "old",
+			Coin:      iwallet.CtMock.CurrencyCode(),
+			Amount:    "1000000",
+			Timestamp: time.Now().Add(-time.Hour * 25),
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spent, err := w.SpentInLastDay(); err != nil || spent.Cmp(iwallet.NewAmount(110000)) != 0 {
+		t.Errorf("Expected 110000 spent, got %s, %v", spent, err)
+	}
+
+	if err := w.AuthorizeSpend([]byte("wrong")); err == nil {
+		t.Error("Expected wrong passphrase to fail")
+	}
+}
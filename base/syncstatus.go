@@ -0,0 +1,109 @@
+package base
+
+import (
+	iwallet "github.com/cpacia/wallet-interface"
+)
+
+// SyncStatus is the state of a wallet's chain sync.
+type SyncStatus struct {
+	// Started is set once the wallet's SyncPacer, if it has one, has let
+	// the sync start.
+	Started bool
+
+	// Synced is set once the wallet's addresses have been scanned.
+	Synced bool
+
+	// Height is the height of the best block the wallet has seen.
+	Height uint64
+
+	// Progress is the percentage of addresses checked by the last scan.
+	// See ScanProgress for the details.
+	Progress float64
+
+	// LastError is the most recent error syncing. It's cleared by the
+	// next scan which finishes without one.
+	LastError error
+}
+
+// SyncPacer paces the chain syncs of the wallets sharing it so that, for
+// example, they don't all start at once or overload a shared API. Both
+// methods return false if done is closed before they unblock.
+type SyncPacer interface {
+	// Begin blocks until the coin's sync may start.
+	Begin(coinType iwallet.CoinType, done <-chan struct{}) bool
+
+	// Request blocks until the coin may make its next request to its
+	// chain client while syncing.
+	Request(coinType iwallet.CoinType, done <-chan struct{}) bool
+}
+
+// Syncer is implemented by wallets which report the state of their chain
+// sync and can have it paced.
+type Syncer interface {
+	SyncStatus() SyncStatus
+	SetSyncPacer(pacer SyncPacer)
+}
+
+// SyncStatus returns the state of the chain sync.
+func (cm *ChainManager) SyncStatus() SyncStatus {
+	cm.statusMtx.Lock()
+	status := cm.status
+	cm.statusMtx.Unlock()
+
+	status.Height = cm.BestBlock().Height
+	if progress, ok := cm.ScanProgress(); ok {
+		status.Progress = progress.Percent()
+	}
+	return status
+}
+
+// updateStatus calls f with the sync status to change.
+func (cm *ChainManager) updateStatus(f func(status *SyncStatus)) {
+	cm.statusMtx.Lock()
+	defer cm.statusMtx.Unlock()
+
+	f(&cm.status)
+}
+
+// setSyncError records an error syncing.
+func (cm *ChainManager) setSyncError(err error) {
+	cm.updateStatus(func(status *SyncStatus) {
+		status.LastError = err
+	})
+}
+
+// begin waits for the SyncPacer to let the sync start. It returns false if
+// the ChainManager is stopped first.
+func (cm *ChainManager) begin() bool {
+	if cm.pacer != nil && !cm.pacer.Begin(cm.coinType, cm.done) {
+		return false
+	}
+	cm.updateStatus(func(status *SyncStatus) {
+		status.Started = true
+	})
+	return true
+}
+
+// pace waits for the SyncPacer to allow the next chain client request. It
+// returns false if the ChainManager is stopped first.
+func (cm *ChainManager) pace() bool {
+	if cm.pacer == nil {
+		return true
+	}
+	return cm.pacer.Request(cm.coinType, cm.done)
+}
+
+// SyncStatus returns the state of the wallet's chain sync. It's the zero
+// status until the wallet is opened.
+func (w *WalletBase) SyncStatus() SyncStatus {
+	if w.ChainManager == nil {
+		return SyncStatus{}
+	}
+	return w.ChainManager.SyncStatus()
+}
+
+// SetSyncPacer sets the SyncPacer used by the wallet's chain sync. It must
+// be called before the wallet is opened.
+func (w *WalletBase) SetSyncPacer(pacer SyncPacer) {
+	w.SyncPacer = pacer
+}
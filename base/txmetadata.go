@@ -0,0 +1,132 @@
+package base
+
+import (
+	"errors"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"gorm.io/gorm"
+	"time"
+)
+
+// TransactionMetadata is user supplied bookkeeping information about a
+// transaction. Unlike address labels it describes the payment itself, for
+// example the order a spend paid for.
+type TransactionMetadata struct {
+	Note     string
+	Category string
+	OrderID  string
+}
+
+// IsEmpty returns true if none of the fields are set.
+func (m TransactionMetadata) IsEmpty() bool {
+	return m.Note == "" && m.Category == "" && m.OrderID == ""
+}
+
+// SetTransactionMetadata attaches the metadata to the transaction,
+// replacing any already set. The transaction doesn't need to be in the
+// wallet yet so it can be tagged as soon as a spend returns its ID. Empty
+// metadata removes it.
+func (w *WalletBase) SetTransactionMetadata(txid iwallet.TransactionID, metadata TransactionMetadata) error {
+	return w.DB.Update(func(dbtx database.Tx) error {
+		return w.setTransactionMetadata(dbtx, txid, metadata)
+	})
+}
+
+// SetSpendMetadata attaches the metadata to a spend made with wtx when wtx
+// is committed. If the spend is rolled back nothing is saved.
+func (w *WalletBase) SetSpendMetadata(wtx iwallet.Tx, txid iwallet.TransactionID, metadata TransactionMetadata) error {
+	wbtx, ok := wtx.(*DBTx)
+	if !ok {
+		return errors.New("tx is not expected type")
+	}
+	commit := wbtx.OnCommit
+	wbtx.OnCommit = func() error {
+		if err := w.SetTransactionMetadata(txid, metadata); err != nil {
+			return err
+		}
+		if commit != nil {
+			return commit()
+		}
+		return nil
+	}
+	return nil
+}
+
+// GetTransactionMetadata returns the metadata attached to the
+// transaction. It's empty if none was set.
+func (w *WalletBase) GetTransactionMetadata(txid iwallet.TransactionID) (TransactionMetadata, error) {
+	var metadata TransactionMetadata
+	err := w.DB.View(func(dbtx database.Tx) error {
+		var record database.TransactionMetadataRecord
+		err := dbtx.Read().Where("coin=?", w.CoinType.CurrencyCode()).Where("txid=?", txid.String()).First(&record).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		metadata = recordMetadata(&record)
+		return nil
+	})
+	return metadata, err
+}
+
+// TransactionsByMetadata returns the IDs of the transactions tagged with
+// the category or order ID. Empty arguments match anything.
+func (w *WalletBase) TransactionsByMetadata(category, orderID string) ([]iwallet.TransactionID, error) {
+	var records []database.TransactionMetadataRecord
+	err := w.DB.View(func(dbtx database.Tx) error {
+		query := dbtx.Read().Where("coin=?", w.CoinType.CurrencyCode())
+		if category != "" {
+			query = query.Where("category=?", category)
+		}
+		if orderID != "" {
+			query = query.Where("order_id=?", orderID)
+		}
+		return query.Order("updated_at asc").Find(&records).Error
+	})
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	txids := make([]iwallet.TransactionID, 0, len(records))
+	for _, rec := range records {
+		txids = append(txids, iwallet.TransactionID(rec.Txid))
+	}
+	return txids, nil
+}
+
+func (w *WalletBase) setTransactionMetadata(dbtx database.Tx, txid iwallet.TransactionID, metadata TransactionMetadata) error {
+	if metadata.IsEmpty() {
+		return dbtx.Delete("txid", txid.String(), &database.TransactionMetadataRecord{})
+	}
+	return dbtx.Save(&database.TransactionMetadataRecord{
+		Txid:      txid.String(),
+		Coin:      w.CoinType.CurrencyCode(),
+		Note:      metadata.Note,
+		Category:  metadata.Category,
+		OrderID:   metadata.OrderID,
+		UpdatedAt: time.Now(),
+	})
+}
+
+// transactionMetadata returns a map of txid to metadata for all tagged
+// transactions in the wallet.
+func (w *WalletBase) transactionMetadata(dbtx database.Tx) (map[iwallet.TransactionID]TransactionMetadata, error) {
+	var records []database.TransactionMetadataRecord
+	err := dbtx.Read().Where("coin=?", w.CoinType.CurrencyCode()).Find(&records).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	metadata := make(map[iwallet.TransactionID]TransactionMetadata, len(records))
+	for i := range records {
+		metadata[iwallet.TransactionID(records[i].Txid)] = recordMetadata(&records[i])
+	}
+	return metadata, nil
+}
+
+func recordMetadata(record *database.TransactionMetadataRecord) TransactionMetadata {
+	return TransactionMetadata{
+		Note:     record.Note,
+		Category: record.Category,
+		OrderID:  record.OrderID,
+	}
+}
@@ -0,0 +1,143 @@
+package base
+
+import (
+	hd "github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"testing"
+	"time"
+)
+
+func TestWalletBase_TransactionMetadata(t *testing.T) {
+	w, err := setupWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	xpriv, err := hd.NewKeyFromString("tprv8ZgxMBicQKsPeghT19pungdFLMJM2hMs3EEn5WtgobD7wuQSFQu4VNaEJXH9HS3RhhLT4wgZ3hj31m3kafuxhL9vfGTRtBVLSog4zjxW3L1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.CreateWallet(*xpriv, nil, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.OpenWallet(); err != nil {
+		t.Fatal(err)
+	}
+
+	tx := iwallet.Transaction{
+		ID:        "aa",
+		Timestamp: time.Unix(1600000000, 0),
+		Value:     iwallet.NewAmount(-100000),
+		From:      []iwallet.SpendInfo{{ID: mockOutpoint(), Address: mockAddress(), Amount: iwallet.NewAmount(100000)}},
+	}
+	err = w.DB.Update(func(dbtx database.Tx) error {
+		rec, err := database.NewTransactionRecord(tx, iwallet.CtMock)
+		if err != nil {
+			return err
+		}
+		return dbtx.Save(rec)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metadata := TransactionMetadata{Note: "office chairs", Category: "expenses", OrderID: "1234"}
+	if err := w.SetTransactionMetadata(tx.ID, metadata); err != nil {
+		t.Fatal(err)
+	}
+	got, err := w.GetTransactionMetadata(tx.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != metadata {
+		t.Errorf("Expected %+v, got %+v", metadata, got)
+	}
+
+	history, err := w.TransactionHistory(-1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || history[0].Metadata != metadata {
+		t.Errorf("Expected metadata in history, got %+v", history)
+	}
+
+	exported, err := w.ExportHistory(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exported) != 1 || exported[0].Note != metadata.Note || exported[0].Category != metadata.Category || exported[0].OrderID != metadata.OrderID {
+		t.Errorf("Expected metadata in export, got %+v", exported)
+	}
+
+	txids, err := w.TransactionsByMetadata("expenses", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txids) != 1 || txids[0] != tx.ID {
+		t.Errorf("Expected [aa], got %v", txids)
+	}
+	txids, err = w.TransactionsByMetadata("", "5678")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txids) != 0 {
+		t.Errorf("Expected no transactions, got %v", txids)
+	}
+
+	// Empty metadata removes it.
+	if err := w.SetTransactionMetadata(tx.ID, TransactionMetadata{}); err != nil {
+		t.Fatal(err)
+	}
+	got, err = w.GetTransactionMetadata(tx.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.IsEmpty() {
+		t.Errorf("Expected empty metadata, got %+v", got)
+	}
+}
+
+func TestWalletBase_SetSpendMetadata(t *testing.T) {
+	w, err := setupWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata := TransactionMetadata{Category: "payroll"}
+
+	// Nothing is saved if the spend is rolled back.
+	wtx, err := w.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SetSpendMetadata(wtx, "aa", metadata); err != nil {
+		t.Fatal(err)
+	}
+	if err := wtx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := w.GetTransactionMetadata("aa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.IsEmpty() {
+		t.Errorf("Expected no metadata after rollback, got %+v", got)
+	}
+
+	wtx, err = w.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SetSpendMetadata(wtx, "aa", metadata); err != nil {
+		t.Fatal(err)
+	}
+	if err := wtx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	got, err = w.GetTransactionMetadata("aa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != metadata {
+		t.Errorf("Expected %+v, got %+v", metadata, got)
+	}
+}
@@ -0,0 +1,183 @@
+package base
+
+import (
+	"errors"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"gorm.io/gorm"
+)
+
+// TransactionStatus is the state of a wallet transaction.
+type TransactionStatus string
+
+const (
+	// TxPending transactions are unconfirmed.
+	TxPending TransactionStatus = database.TxStatusPending
+
+	// TxConfirmed transactions are in a block.
+	TxConfirmed TransactionStatus = database.TxStatusConfirmed
+
+	// TxReplaced transactions were replaced by the wallet with another
+	// spending the same inputs, such as by BumpFee.
+	TxReplaced TransactionStatus = database.TxStatusReplaced
+
+	// TxConflicted transactions are unconfirmed and double spent by
+	// another transaction. They'll never confirm if it does.
+	TxConflicted TransactionStatus = database.TxStatusConflicted
+
+	// TxAbandoned transactions were dropped with AbandonTransaction.
+	TxAbandoned TransactionStatus = database.TxStatusAbandoned
+)
+
+var (
+	// ErrTransactionNotFound is returned for a transaction the wallet
+	// doesn't have.
+	ErrTransactionNotFound = errors.New("transaction not found")
+
+	// ErrTransactionConfirmed is returned by AbandonTransaction for a
+	// transaction which is already in a block.
+	ErrTransactionConfirmed = errors.New("transaction is confirmed")
+)
+
+// recordStatus returns the status of the transaction record. Records saved
+// before statuses were recorded have none.
+func recordStatus(record *database.TransactionRecord) TransactionStatus {
+	switch {
+	case record.BlockHeight > 0:
+		return TxConfirmed
+	case record.Status == "":
+		return TxPending
+	}
+	return TransactionStatus(record.Status)
+}
+
+// TransactionStatus returns the status of the wallet transaction. For a
+// replaced or conflicted transaction the ID of the transaction which
+// replaced or double spent it is also returned.
+func (w *WalletBase) TransactionStatus(id iwallet.TransactionID) (TransactionStatus, iwallet.TransactionID, error) {
+	var record database.TransactionRecord
+	err := w.DB.View(func(dbtx database.Tx) error {
+		return dbtx.Read().Where("coin=?", w.CoinType.CurrencyCode()).Where("txid=?", id.String()).First(&record).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", "", ErrTransactionNotFound
+	} else if err != nil {
+		return "", "", err
+	}
+	status := recordStatus(&record)
+	switch status {
+	case TxReplaced:
+		return status, iwallet.TransactionID(record.ReplacedBy), nil
+	case TxConflicted:
+		return status, iwallet.TransactionID(record.ConflictedBy), nil
+	}
+	return status, "", nil
+}
+
+// AbandonTransaction drops a stuck unconfirmed transaction sent by the
+// wallet so its inputs can be spent again. It's removed from the broadcast
+// queue and marked as abandoned, as are any unconfirmed wallet transactions
+// spending its outputs, and the utxos it spent are restored.
+//
+// The transaction may still confirm if it has already reached the network's
+// mempools, in which case it's recorded as confirmed as usual.
+func (w *WalletBase) AbandonTransaction(id iwallet.TransactionID) error {
+	return w.ChainManager.AbandonTransaction(id)
+}
+
+// AbandonTransaction drops the unconfirmed transaction and its unconfirmed
+// descendants. See WalletBase.AbandonTransaction.
+func (cm *ChainManager) AbandonTransaction(id iwallet.TransactionID) error {
+	err := cm.db.Update(func(dbtx database.Tx) error {
+		var queued []database.UnconfirmedTransaction
+		if err := dbtx.Read().Where("coin=?", cm.coinType.CurrencyCode()).Where("txid=?", id.String()).Find(&queued).Error; err != nil {
+			return err
+		}
+
+		var pending []database.TransactionRecord
+		if err := dbtx.Read().Where("coin=?", cm.coinType.CurrencyCode()).Where("block_height=?", 0).Find(&pending).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		records := make(map[iwallet.TransactionID]*database.TransactionRecord, len(pending))
+		for i := range pending {
+			records[pending[i].TransactionID()] = &pending[i]
+		}
+
+		if _, ok := records[id]; !ok {
+			var record database.TransactionRecord
+			err := dbtx.Read().Where("coin=?", cm.coinType.CurrencyCode()).Where("txid=?", id.String()).First(&record).Error
+			if err == nil {
+				return ErrTransactionConfirmed
+			} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+				return err
+			}
+			// A transaction the chain client hasn't reported yet is
+			// only in the broadcast queue.
+			if len(queued) == 0 {
+				return ErrTransactionNotFound
+			}
+		}
+
+		abandon := []iwallet.TransactionID{id}
+		for len(abandon) > 0 {
+			txid := abandon[0]
+			abandon = abandon[1:]
+
+			if err := dbtx.Delete("txid", txid.String(), &database.UnconfirmedTransaction{}); err != nil {
+				return err
+			}
+			record, ok := records[txid]
+			if !ok || record.Status == database.TxStatusAbandoned {
+				continue
+			}
+			record.Status = database.TxStatusAbandoned
+			if err := dbtx.Save(record); err != nil {
+				return err
+			}
+			abandon = append(abandon, spenders(records, txid)...)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Rebuild the utxos without the abandoned transactions.
+	if _, err := cm.saveTransactionsAndUtxos(nil); err != nil {
+		return err
+	}
+	cm.logger.Infof("[%s] Abandoned transaction %s", cm.coinType, id)
+	return nil
+}
+
+// spenders returns the transactions among records which spend an output of
+// txid.
+func spenders(records map[iwallet.TransactionID]*database.TransactionRecord, txid iwallet.TransactionID) []iwallet.TransactionID {
+	parent, ok := records[txid]
+	if !ok {
+		return nil
+	}
+	ptx, err := parent.Transaction()
+	if err != nil {
+		return nil
+	}
+	outputs := make(map[string]bool, len(ptx.To))
+	for _, to := range ptx.To {
+		outputs[string(to.ID)] = true
+	}
+
+	var ids []iwallet.TransactionID
+	for id, record := range records {
+		tx, err := record.Transaction()
+		if err != nil {
+			continue
+		}
+		for _, from := range tx.From {
+			if outputs[string(from.ID)] {
+				ids = append(ids, id)
+				break
+			}
+		}
+	}
+	return ids
+}
@@ -0,0 +1,146 @@
+package base
+
+import (
+	"encoding/hex"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"testing"
+	"time"
+)
+
+func TestWalletBase_AbandonTransaction(t *testing.T) {
+	chain, _, err := newTestChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.db.Close()
+	w := &WalletBase{
+		ChainManager: chain,
+		DB:           chain.db,
+		CoinType:     iwallet.CtMock,
+	}
+
+	addrs, err := chain.keychain.GetAddresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A confirmed transaction funding the wallet, an unconfirmed spend
+	// of it and an unconfirmed spend of the spend's output.
+	funding := NewMockTransaction(nil, &addrs[0])
+	funding.Height = 1
+	spend := NewMockTransaction(&funding.To[0], &addrs[1])
+	child := NewMockTransaction(&spend.To[0], &addrs[2])
+	if _, err := chain.saveTransactionsAndUtxos([]iwallet.Transaction{funding, spend, child}); err != nil {
+		t.Fatal(err)
+	}
+	err = chain.db.Update(func(dbtx database.Tx) error {
+		return dbtx.Save(&database.UnconfirmedTransaction{
+			Txid:      spend.ID.String(),
+			Coin:      iwallet.CtMock.CurrencyCode(),
+			Timestamp: time.Now(),
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	utxos := func() []string {
+		var records []database.UtxoRecord
+		err := chain.db.View(func(dbtx database.Tx) error {
+			return dbtx.Read().Where("coin=?", iwallet.CtMock.CurrencyCode()).Find(&records).Error
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var outpoints []string
+		for _, rec := range records {
+			outpoints = append(outpoints, rec.Outpoint)
+		}
+		return outpoints
+	}
+	if ops := utxos(); len(ops) != 1 || ops[0] != hex.EncodeToString(child.To[0].ID) {
+		t.Fatalf("Expected the child's output to be the only utxo, got %v", ops)
+	}
+
+	if err := w.AbandonTransaction(funding.ID); err != ErrTransactionConfirmed {
+		t.Errorf("Expected ErrTransactionConfirmed, got %v", err)
+	}
+	if err := w.AbandonTransaction(NewMockTransaction(nil, nil).ID); err != ErrTransactionNotFound {
+		t.Errorf("Expected ErrTransactionNotFound, got %v", err)
+	}
+
+	if err := w.AbandonTransaction(spend.ID); err != nil {
+		t.Fatal(err)
+	}
+	if ops := utxos(); len(ops) != 1 || ops[0] != hex.EncodeToString(funding.To[0].ID) {
+		t.Errorf("Expected the funding output to be unspent again, got %v", ops)
+	}
+	for _, txid := range []iwallet.TransactionID{spend.ID, child.ID} {
+		status, _, err := w.TransactionStatus(txid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != TxAbandoned {
+			t.Errorf("Expected %s to be abandoned, got %s", txid, status)
+		}
+	}
+	var queued []database.UnconfirmedTransaction
+	err = chain.db.View(func(dbtx database.Tx) error {
+		return dbtx.Read().Find(&queued).Error
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queued) != 0 {
+		t.Error("Expected the abandoned transaction to be removed from the broadcast queue")
+	}
+
+	// The abandoned transaction confirming anyway is recorded as usual.
+	spend.Height = 2
+	if _, err := chain.saveTransactionsAndUtxos([]iwallet.Transaction{spend}); err != nil {
+		t.Fatal(err)
+	}
+	if status, _, err := w.TransactionStatus(spend.ID); err != nil || status != TxConfirmed {
+		t.Errorf("Expected the spend to be confirmed, got %s %v", status, err)
+	}
+}
+
+func TestWalletBase_TransactionStatus(t *testing.T) {
+	chain, _, err := newTestChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.db.Close()
+	w := &WalletBase{
+		ChainManager: chain,
+		DB:           chain.db,
+		CoinType:     iwallet.CtMock,
+	}
+
+	addrs, err := chain.keychain.GetAddresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := NewMockTransaction(nil, &addrs[0])
+	if _, err := chain.saveTransactionsAndUtxos([]iwallet.Transaction{tx}); err != nil {
+		t.Fatal(err)
+	}
+	if status, _, err := w.TransactionStatus(tx.ID); err != nil || status != TxPending {
+		t.Errorf("Expected the transaction to be pending, got %s %v", status, err)
+	}
+
+	conflicting := NewMockTransaction(nil, nil)
+	chain.flagConflict(tx.ID, conflicting.ID)
+	status, related, err := w.TransactionStatus(tx.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != TxConflicted || related != conflicting.ID {
+		t.Errorf("Expected the transaction to be conflicted by %s, got %s %s", conflicting.ID, status, related)
+	}
+
+	if _, _, err := w.TransactionStatus(conflicting.ID); err != ErrTransactionNotFound {
+		t.Errorf("Expected ErrTransactionNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,179 @@
+package base
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcutil/coinset"
+	hd "github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"gorm.io/gorm"
+	"time"
+)
+
+// ErrUtxoNotFound is returned when an outpoint is not in the wallet's utxo
+// set.
+var ErrUtxoNotFound = errors.New("utxo not found")
+
+// Utxo is an unspent output held by the wallet.
+type Utxo struct {
+	// Outpoint is the serialized outpoint in the same format used by
+	// iwallet.SpendInfo.ID.
+	Outpoint      []byte
+	Address       iwallet.Address
+	Amount        iwallet.Amount
+	Height        uint64
+	Confirmations uint64
+	Timestamp     time.Time
+	Frozen        bool
+
+	// Source is where the utxo came from. See UtxoSource.
+	Source string
+
+	// Ancestors is the number of unconfirmed transactions in the utxo's
+	// ancestry, including the one which created it. It is zero once
+	// confirmed.
+	Ancestors int
+}
+
+// ListUnspent returns the wallet's utxos, including frozen ones.
+func (w *WalletBase) ListUnspent() ([]Utxo, error) {
+	bcInfo, err := w.BlockchainInfo()
+	if err != nil {
+		return nil, err
+	}
+	var utxos []Utxo
+	err = w.DB.View(func(dbtx database.Tx) error {
+		var records []database.UtxoRecord
+		if err := dbtx.Read().Where("coin = ?", w.CoinType.CurrencyCode()).Find(&records).Error; err != nil {
+			return err
+		}
+		graph, err := w.loadAncestorGraph(dbtx)
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			ser, err := hex.DecodeString(record.Outpoint)
+			if err != nil {
+				return err
+			}
+			utxo := Utxo{
+				Outpoint:  ser,
+				Address:   iwallet.NewAddress(record.Address, w.CoinType),
+				Amount:    iwallet.NewAmount(record.Amount),
+				Height:    record.Height,
+				Timestamp: record.Timestamp,
+				Frozen:    record.Frozen,
+				Source:    record.Source,
+			}
+			if record.Height > 0 && bcInfo.Height >= record.Height {
+				utxo.Confirmations = bcInfo.Height - record.Height + 1
+			}
+			if record.Height == 0 {
+				txid, err := outpointTxid(record.Outpoint)
+				if err != nil {
+					return err
+				}
+				utxo.Ancestors = graph.count(txid)
+			}
+			utxos = append(utxos, utxo)
+		}
+		return nil
+	})
+	return utxos, err
+}
+
+// FreezeUtxo excludes the utxo from coin selection until it is unfrozen.
+// The frozen state is persisted.
+func (w *WalletBase) FreezeUtxo(outpoint []byte) error {
+	return w.setUtxoFrozen(outpoint, true)
+}
+
+// UnfreezeUtxo makes a frozen utxo available for coin selection again.
+func (w *WalletBase) UnfreezeUtxo(outpoint []byte) error {
+	return w.setUtxoFrozen(outpoint, false)
+}
+
+func (w *WalletBase) setUtxoFrozen(outpoint []byte, frozen bool) error {
+	return w.DB.Update(func(dbtx database.Tx) error {
+		var record database.UtxoRecord
+		err := dbtx.Read().Where("coin = ?", w.CoinType.CurrencyCode()).Where("outpoint = ?", hex.EncodeToString(outpoint)).First(&record).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrUtxoNotFound
+		} else if err != nil {
+			return err
+		}
+		record.Frozen = frozen
+		return dbtx.Save(&record)
+	})
+}
+
+// GatherSelectedCoins returns the coins for the given outpoints along with
+// the keys needed to spend them. It fails if any of the outpoints is not in
+// the utxo set, is frozen or is spent by a queued transaction. The wallet
+// must be unlocked to use this function.
+func (w *WalletBase) GatherSelectedCoins(dbtx database.Tx, outpoints [][]byte) (_ map[coinset.Coin]*hd.ExtendedKey, err error) {
+	bcInfo, err := w.BlockchainInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[coinset.Coin]*hd.ExtendedKey)
+	defer func() {
+		if err != nil {
+			ZeroCoinKeys(m)
+		}
+	}()
+
+	queued, err := w.queuedInputs(dbtx)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	for _, outpoint := range outpoints {
+		ser := hex.EncodeToString(outpoint)
+		if seen[ser] {
+			return nil, fmt.Errorf("utxo %s selected more than once", ser)
+		}
+		seen[ser] = true
+
+		var record database.UtxoRecord
+		err = dbtx.Read().Where("coin = ?", w.CoinType.CurrencyCode()).Where("outpoint = ?", ser).First(&record).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrUtxoNotFound
+		} else if err != nil {
+			return nil, err
+		}
+		if record.Frozen {
+			return nil, fmt.Errorf("utxo %s is frozen", ser)
+		}
+		if queued[ser] {
+			return nil, fmt.Errorf("utxo %s is spent by a queued transaction", ser)
+		}
+		if record.Height == 0 {
+			var n int
+			n, err = w.unconfirmedAncestorsOf(dbtx, record.Outpoint)
+			if err != nil {
+				return nil, err
+			}
+			if n >= MaxUnconfirmedAncestors {
+				return nil, ErrTooManyUnconfirmedAncestors
+			}
+		}
+		var (
+			c   coinset.Coin
+			key *hd.ExtendedKey
+		)
+		c, key, err = w.coinForUtxo(dbtx, record, bcInfo.Height)
+		if err != nil {
+			return nil, err
+		}
+		if c == nil {
+			return nil, fmt.Errorf("no key for utxo %s", ser)
+		}
+		m[c] = key
+	}
+	return m, nil
+}
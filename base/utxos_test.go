@@ -0,0 +1,234 @@
+package base
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	hd "github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"testing"
+	"time"
+)
+
+func TestWalletBase_FreezeUtxo(t *testing.T) {
+	w, err := setupWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	xpriv, err := hd.NewKeyFromString("tprv8ZgxMBicQKsPeghT19pungdFLMJM2hMs3EEn5WtgobD7wuQSFQu4VNaEJXH9HS3RhhLT4wgZ3hj31m3kafuxhL9vfGTRtBVLSog4zjxW3L1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.CreateWallet(*xpriv, nil, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.OpenWallet(); err != nil {
+		t.Fatal(err)
+	}
+
+	addr, err := w.CurrentAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var outpoints [][]byte
+	err = w.DB.Update(func(dbtx database.Tx) error {
+		for _, amount := range []int64{500, 700} {
+			tx := NewMockTransaction(nil, &addr)
+			tx.To[0].Amount = iwallet.NewAmount(amount)
+			utxo := database.UtxoRecord{
+				Coin:     iwallet.CtMock,
+				Amount:   tx.To[0].Amount.String(),
+				Address:  tx.To[0].Address.String(),
+				Outpoint: hex.EncodeToString(tx.To[0].ID),
+			}
+			if err := dbtx.Save(&utxo); err != nil {
+				return err
+			}
+			outpoints = append(outpoints, tx.To[0].ID)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.FreezeUtxo(outpoints[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.FreezeUtxo(make([]byte, 36)); err != ErrUtxoNotFound {
+		t.Errorf("Expected ErrUtxoNotFound, got %v", err)
+	}
+
+	utxos, err := w.ListUnspent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(utxos) != 2 {
+		t.Fatalf("Expected 2 utxos, got %d", len(utxos))
+	}
+	for _, utxo := range utxos {
+		if frozen := bytes.Equal(utxo.Outpoint, outpoints[0]); utxo.Frozen != frozen {
+			t.Errorf("Expected utxo %x frozen to be %t", utxo.Outpoint, frozen)
+		}
+	}
+
+	err = w.DB.View(func(dbtx database.Tx) error {
+		coinMap, err := w.GatherCoins(dbtx)
+		if err != nil {
+			return err
+		}
+		if len(coinMap) != 1 {
+			t.Errorf("Expected %d coins, got %d", 1, len(coinMap))
+		}
+		for coin := range coinMap {
+			if coin.Value() != 700 {
+				t.Errorf("Expected frozen coin to be excluded")
+			}
+		}
+
+		if _, err := w.GatherSelectedCoins(dbtx, outpoints[:1]); err == nil {
+			t.Error("Expected selecting a frozen utxo to fail")
+		}
+		if _, err := w.GatherSelectedCoins(dbtx, [][]byte{outpoints[1], outpoints[1]}); err == nil {
+			t.Error("Expected selecting a utxo twice to fail")
+		}
+		coinMap, err = w.GatherSelectedCoins(dbtx, outpoints[1:])
+		if err != nil {
+			return err
+		}
+		if len(coinMap) != 1 {
+			t.Errorf("Expected %d coins, got %d", 1, len(coinMap))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.UnfreezeUtxo(outpoints[0]); err != nil {
+		t.Fatal(err)
+	}
+	err = w.DB.View(func(dbtx database.Tx) error {
+		coinMap, err := w.GatherCoins(dbtx)
+		if err != nil {
+			return err
+		}
+		if len(coinMap) != 2 {
+			t.Errorf("Expected %d coins, got %d", 2, len(coinMap))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWalletBase_UnconfirmedAncestors(t *testing.T) {
+	w, err := setupWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	xpriv, err := hd.NewKeyFromString("tprv8ZgxMBicQKsPeghT19pungdFLMJM2hMs3EEn5WtgobD7wuQSFQu4VNaEJXH9HS3RhhLT4wgZ3hj31m3kafuxhL9vfGTRtBVLSog4zjxW3L1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.CreateWallet(*xpriv, nil, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.OpenWallet(); err != nil {
+		t.Fatal(err)
+	}
+
+	addr, err := w.CurrentAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Build a chain of unconfirmed transactions each spending the
+	// previous one.
+	var outpoints [][]byte
+	err = w.DB.Update(func(dbtx database.Tx) error {
+		prev := mockOutpoint()
+		for i := 0; i < MaxUnconfirmedAncestors; i++ {
+			var h chainhash.Hash
+			rand.Read(h[:])
+			outpoint := append(h.CloneBytes(), 0, 0, 0, 0)
+			tx := iwallet.Transaction{
+				ID:   iwallet.TransactionID(h.String()),
+				From: []iwallet.SpendInfo{{ID: prev, Address: addr, Amount: iwallet.NewAmount(1000)}},
+				To:   []iwallet.SpendInfo{{ID: outpoint, Address: addr, Amount: iwallet.NewAmount(1000)}},
+			}
+			rec, err := database.NewTransactionRecord(tx, iwallet.CtMock)
+			if err != nil {
+				return err
+			}
+			if err := dbtx.Save(rec); err != nil {
+				return err
+			}
+			prev = outpoint
+			outpoints = append(outpoints, outpoint)
+		}
+		for _, outpoint := range outpoints[len(outpoints)-2:] {
+			err := dbtx.Save(&database.UtxoRecord{
+				Coin:     iwallet.CtMock,
+				Amount:   "1000",
+				Address:  addr.String(),
+				Outpoint: hex.EncodeToString(outpoint),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	utxos, err := w.ListUnspent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, utxo := range utxos {
+		expected := MaxUnconfirmedAncestors - 1
+		if bytes.Equal(utxo.Outpoint, outpoints[len(outpoints)-1]) {
+			expected = MaxUnconfirmedAncestors
+		}
+		if utxo.Ancestors != expected {
+			t.Errorf("Expected %d ancestors, got %d", expected, utxo.Ancestors)
+		}
+	}
+
+	err = w.DB.View(func(dbtx database.Tx) error {
+		coinMap, err := w.GatherCoins(dbtx)
+		if err != nil {
+			return err
+		}
+		if len(coinMap) != 1 {
+			t.Errorf("Expected %d coins, got %d", 1, len(coinMap))
+		}
+		limited, err := w.HasAncestorLimitedCoins(dbtx)
+		if err != nil {
+			return err
+		}
+		if !limited {
+			t.Error("Expected ancestor limited coins")
+		}
+		if _, err := w.GatherSelectedCoins(dbtx, outpoints[len(outpoints)-1:]); err != ErrTooManyUnconfirmedAncestors {
+			t.Errorf("Expected ErrTooManyUnconfirmedAncestors, got %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
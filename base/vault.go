@@ -0,0 +1,39 @@
+package base
+
+import (
+	"github.com/btcsuite/btcd/btcec"
+	iwallet "github.com/cpacia/wallet-interface"
+)
+
+// VaultStatus is the state of a vaulted spend.
+type VaultStatus string
+
+const (
+	// VaultPending spends are waiting out the delay in the vault.
+	VaultPending VaultStatus = "pending"
+
+	// VaultReleased spends were paid from the vault to the recipient.
+	VaultReleased VaultStatus = "released"
+
+	// VaultCancelled spends were clawed back with the cancel key.
+	VaultCancelled VaultStatus = "cancelled"
+)
+
+// VaultConfig configures vault mode. In vault mode spends of more than
+// Threshold are first paid to a vault address the wallet controls. The
+// wallet can only pay the funds on to the recipient once the vault
+// transaction has Delay confirmations. Until then the holder of CancelKey,
+// which should be kept offline, can claw them back. This limits what can be
+// stolen with a compromised hot wallet to spends nobody notices in time.
+//
+// The zero value disables vault mode.
+type VaultConfig struct {
+	Threshold iwallet.Amount
+	Delay     uint32
+	CancelKey *btcec.PublicKey
+}
+
+// Enabled returns whether vault mode is on.
+func (cfg VaultConfig) Enabled() bool {
+	return cfg.Threshold.Cmp(iwallet.NewAmount(0)) > 0
+}
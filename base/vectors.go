@@ -0,0 +1,196 @@
+package base
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/chaincfg"
+	hd "github.com/btcsuite/btcutil/hdkeychain"
+	iwallet "github.com/cpacia/wallet-interface"
+)
+
+// ErrNoAddressVectors is returned when verifying a wallet for which no
+// address vectors are published, such as a coin on an unsupported network.
+var ErrNoAddressVectors = errors.New("no address vectors for wallet")
+
+// AddressVector is a published address derived from a seed. The key is at
+// m/44'/CoinIndex'/change/index, the path the wallets are created at, and
+// the master key is derived with the mainnet or testnet3 parameters.
+// AddressType only applies to coins with more than one. The vectors are
+// also published as JSON in testdata/address_vectors.json so other
+// implementations can check against them.
+type AddressVector struct {
+	Coin        iwallet.CoinType `json:"coin"`
+	Testnet     bool             `json:"testnet"`
+	AddressType AddressType      `json:"addressType"`
+	Seed        string           `json:"seed"`
+	CoinIndex   uint32           `json:"coinIndex"`
+	Path        KeyPath          `json:"path"`
+	Address     string           `json:"address"`
+}
+
+// The seeds the vectors are derived from. vectorSeedBIP32 is the seed of
+// BIP 32's first test vector and vectorSeedBIP39 the BIP 39 seed of the
+// mnemonic "abandon abandon abandon abandon abandon abandon abandon
+// abandon abandon abandon abandon about" with no passphrase.
+const (
+	vectorSeedBIP32 = "000102030405060708090a0b0c0d0e0f"
+	vectorSeedBIP39 = "5eb00bbddcf069084889a8ab9155568165f5c453ccb85e70811aaed6f6da5fc19a5ac40b389cd370d086206dec8aa6c43daea6690f20ad3d8d48b2d2ce9e38e4"
+)
+
+// AddressVectors are the published vectors for every coin. They must never
+// change: a build which derives different addresses loses track of funds
+// sent to wallets created by other builds.
+var AddressVectors = []AddressVector{
+	{Coin: iwallet.CtBitcoin, Seed: vectorSeedBIP32, CoinIndex: 0, Path: KeyPath{}, Address: "bc1qdeya3k6n5fdzgt452u2ylscw0y502pylg7ytck"},
+	{Coin: iwallet.CtBitcoin, Seed: vectorSeedBIP32, CoinIndex: 0, Path: KeyPath{Index: 1}, Address: "bc1qzjzy3wu7a502hqscj7wletdgxwcgcq8r6g60sc"},
+	{Coin: iwallet.CtBitcoin, Seed: vectorSeedBIP32, CoinIndex: 0, Path: KeyPath{Change: true}, Address: "bc1qkatk47csjms7nex4hwjzzy5t0v25dk6lpeaaal"},
+	{Coin: iwallet.CtBitcoin, Seed: vectorSeedBIP39, CoinIndex: 0, Path: KeyPath{}, Address: "bc1q0y524ap88sytv03n7p5pf50dn68hqzrhr7slf9"},
+	{Coin: iwallet.CtBitcoin, Seed: vectorSeedBIP39, CoinIndex: 0, Path: KeyPath{Index: 1}, Address: "bc1qmd0cdncrqfn9mfdq5glepqee9h8vjxyzrdw82d"},
+	{Coin: iwallet.CtBitcoin, Seed: vectorSeedBIP39, CoinIndex: 0, Path: KeyPath{Change: true}, Address: "bc1qw4jdzad3e5dtjkde3ua5vns87qh53fvu3wjluw"},
+
+	{Coin: iwallet.CtBitcoin, AddressType: AddressTypeNestedSegwit, Seed: vectorSeedBIP32, CoinIndex: 0, Path: KeyPath{}, Address: "3GeFYikn91qPZAVWNU1LQJjJZhU28JJtcw"},
+	{Coin: iwallet.CtBitcoin, AddressType: AddressTypeNestedSegwit, Seed: vectorSeedBIP32, CoinIndex: 0, Path: KeyPath{Index: 1}, Address: "3Q3RX9vBtoZGp8eGmd1Qkm6Kok6HZPKWF1"},
+	{Coin: iwallet.CtBitcoin, AddressType: AddressTypeNestedSegwit, Seed: vectorSeedBIP32, CoinIndex: 0, Path: KeyPath{Change: true}, Address: "3Q8dWnpaZByH5MSWWrSHNeSPBxX7QvED1c"},
+	{Coin: iwallet.CtBitcoin, AddressType: AddressTypeNestedSegwit, Seed: vectorSeedBIP39, CoinIndex: 0, Path: KeyPath{}, Address: "37yLEAsGoj42ddpHiNJBF4dBDLc93mL3RX"},
+	{Coin: iwallet.CtBitcoin, AddressType: AddressTypeNestedSegwit, Seed: vectorSeedBIP39, CoinIndex: 0, Path: KeyPath{Index: 1}, Address: "3A7eFhf3ABe7VPRKTE87CieyVHzjrB2V7E"},
+	{Coin: iwallet.CtBitcoin, AddressType: AddressTypeNestedSegwit, Seed: vectorSeedBIP39, CoinIndex: 0, Path: KeyPath{Change: true}, Address: "38M6AuzSK5YxVnXGBZrkWQBfK3HXWTF2a4"},
+
+	{Coin: iwallet.CtBitcoin, AddressType: AddressTypeLegacy, Seed: vectorSeedBIP32, CoinIndex: 0, Path: KeyPath{}, Address: "1B49o65boNBFErpb565zVL1WCNx2AwWWGc"},
+	{Coin: iwallet.CtBitcoin, AddressType: AddressTypeLegacy, Seed: vectorSeedBIP32, CoinIndex: 0, Path: KeyPath{Index: 1}, Address: "12sUz6gMEyGQiT5CbdqECHtm6wpLAyvcmh"},
+	{Coin: iwallet.CtBitcoin, AddressType: AddressTypeLegacy, Seed: vectorSeedBIP32, CoinIndex: 0, Path: KeyPath{Change: true}, Address: "1HiRP1PVX1BogRJa1W616AzK2iMe8HYU6U"},
+	{Coin: iwallet.CtBitcoin, AddressType: AddressTypeLegacy, Seed: vectorSeedBIP39, CoinIndex: 0, Path: KeyPath{}, Address: "1C3dUrpRvLcmSBc14JCpceUxeuR1yEj4fY"},
+	{Coin: iwallet.CtBitcoin, AddressType: AddressTypeLegacy, Seed: vectorSeedBIP39, CoinIndex: 0, Path: KeyPath{Index: 1}, Address: "1LzwRKH6TJVCfQgxQ5wx1ibd3Ka8giPJ8t"},
+	{Coin: iwallet.CtBitcoin, AddressType: AddressTypeLegacy, Seed: vectorSeedBIP39, CoinIndex: 0, Path: KeyPath{Change: true}, Address: "1BhiqR7ExQ4utyTCgYR4ypkxwdHWyw7phx"},
+
+	{Coin: iwallet.CtBitcoin, AddressType: AddressTypeTaproot, Seed: vectorSeedBIP32, CoinIndex: 0, Path: KeyPath{}, Address: "bc1pkmagstqj90529nz3qf5jq3znx2fw3fyvu5s7sydyaafw5aql7j6s35a8dr"},
+	{Coin: iwallet.CtBitcoin, AddressType: AddressTypeTaproot, Seed: vectorSeedBIP32, CoinIndex: 0, Path: KeyPath{Index: 1}, Address: "bc1pk9d3ch0zysft02fhudj3xj5f24z89truj5899j64ls7f7ffzmhpqxhkruq"},
+	{Coin: iwallet.CtBitcoin, AddressType: AddressTypeTaproot, Seed: vectorSeedBIP32, CoinIndex: 0, Path: KeyPath{Change: true}, Address: "bc1p364ujf9svj6y3yjvglfjchh0pvp5tsd93hyh089afszdaunckm7s7s8lhn"},
+	{Coin: iwallet.CtBitcoin, AddressType: AddressTypeTaproot, Seed: vectorSeedBIP39, CoinIndex: 0, Path: KeyPath{}, Address: "bc1pwsxg8au92qxndvd0s9c09qpxmux8hxmgkgxmp8ltv43z0psu4qrs72ratr"},
+	{Coin: iwallet.CtBitcoin, AddressType: AddressTypeTaproot, Seed: vectorSeedBIP39, CoinIndex: 0, Path: KeyPath{Index: 1}, Address: "bc1pw4zgdmmayat2tgn2q2jyfhguh5ljcwyxqw8mlchurrj24zs06xjqlnyx64"},
+	{Coin: iwallet.CtBitcoin, AddressType: AddressTypeTaproot, Seed: vectorSeedBIP39, CoinIndex: 0, Path: KeyPath{Change: true}, Address: "bc1ptwupakddk70nqfeevvp76vvlh3n3ju9j6tfaca3ecfz0sxc7uu4s6rmdx2"},
+
+	{Coin: iwallet.CtBitcoin, Testnet: true, Seed: vectorSeedBIP32, CoinIndex: 1, Path: KeyPath{}, Address: "tb1qcq03tfyesyxgv3a7tj88v9ehwmhpp22quwdzmp"},
+	{Coin: iwallet.CtBitcoin, Testnet: true, Seed: vectorSeedBIP32, CoinIndex: 1, Path: KeyPath{Index: 1}, Address: "tb1qg3rke572qtsvwt3dn0z6ffh7fcqtx2s20sy5xe"},
+	{Coin: iwallet.CtBitcoin, Testnet: true, Seed: vectorSeedBIP32, CoinIndex: 1, Path: KeyPath{Change: true}, Address: "tb1qymfhl5yv3as5tqqsflyejhhzwn6f5wcyzvhqlq"},
+	{Coin: iwallet.CtBitcoin, Testnet: true, Seed: vectorSeedBIP39, CoinIndex: 1, Path: KeyPath{}, Address: "tb1qk2xtupzg7c4ytrgypu0kav9ayfafwwdq30xm9s"},
+	{Coin: iwallet.CtBitcoin, Testnet: true, Seed: vectorSeedBIP39, CoinIndex: 1, Path: KeyPath{Index: 1}, Address: "tb1qv5nlqkldw8cx7680whc5xrpsw6t03zwq6tps7n"},
+	{Coin: iwallet.CtBitcoin, Testnet: true, Seed: vectorSeedBIP39, CoinIndex: 1, Path: KeyPath{Change: true}, Address: "tb1qmtzfjlrdxquzn3vkzcvnm3df4ajqj02gqzxfwn"},
+
+	{Coin: iwallet.CtBitcoinCash, Seed: vectorSeedBIP32, CoinIndex: 145, Path: KeyPath{}, Address: "qp2uxmzgm47n9t2yj4679e02553x0rp5ky3swp9e77"},
+	{Coin: iwallet.CtBitcoinCash, Seed: vectorSeedBIP32, CoinIndex: 145, Path: KeyPath{Index: 1}, Address: "qq34w6lyy3wl7gtnq70vfzepraxmgz4ujgjapeqe9t"},
+	{Coin: iwallet.CtBitcoinCash, Seed: vectorSeedBIP32, CoinIndex: 145, Path: KeyPath{Change: true}, Address: "qrh7pn9n598ya0cedllvxe5fegz9ug4fksv8gvweuw"},
+	{Coin: iwallet.CtBitcoinCash, Seed: vectorSeedBIP39, CoinIndex: 145, Path: KeyPath{}, Address: "qz8e6wuu04aaw7qhrnnp6ml6m8ztr8yxwyhd800q42"},
+	{Coin: iwallet.CtBitcoinCash, Seed: vectorSeedBIP39, CoinIndex: 145, Path: KeyPath{Index: 1}, Address: "qzdcjv67cfja4l3e7wqugxvcja3dx9r0evhr7m9qdd"},
+	{Coin: iwallet.CtBitcoinCash, Seed: vectorSeedBIP39, CoinIndex: 145, Path: KeyPath{Change: true}, Address: "qqxu87nx260qaqqmfft67svtxw37v63l4cdskrz6aj"},
+
+	{Coin: iwallet.CtBitcoinCash, Testnet: true, Seed: vectorSeedBIP32, CoinIndex: 1, Path: KeyPath{}, Address: "qrqp79dynxqsepj8hewguashxamwuy9fgqy94sf2nc"},
+	{Coin: iwallet.CtBitcoinCash, Testnet: true, Seed: vectorSeedBIP32, CoinIndex: 1, Path: KeyPath{Index: 1}, Address: "qpzywmxnegpwp3ew9kdutf9xle8qpve2pg5a8vwad3"},
+	{Coin: iwallet.CtBitcoinCash, Testnet: true, Seed: vectorSeedBIP32, CoinIndex: 1, Path: KeyPath{Change: true}, Address: "qqndxl7s3j8kz3vqzp8unx27uf60fx3mqsjmxwx97r"},
+	{Coin: iwallet.CtBitcoinCash, Testnet: true, Seed: vectorSeedBIP39, CoinIndex: 1, Path: KeyPath{}, Address: "qzege0syfrmz53vdqs837m4sh53849ee5q7ln92xvr"},
+	{Coin: iwallet.CtBitcoinCash, Testnet: true, Seed: vectorSeedBIP39, CoinIndex: 1, Path: KeyPath{Index: 1}, Address: "qpjj0uzma4clqmmgaa6lzscvxpmfd7yfcqdyuwp936"},
+	{Coin: iwallet.CtBitcoinCash, Testnet: true, Seed: vectorSeedBIP39, CoinIndex: 1, Path: KeyPath{Change: true}, Address: "qrdvfxtud5crs2w9jctpj0w94xhkgzfafqzjvl5jzf"},
+
+	{Coin: iwallet.CtLitecoin, Seed: vectorSeedBIP32, CoinIndex: 2, Path: KeyPath{}, Address: "ltc1q7mj2sk6h4p59c747urrjk6sf6k6m0tk0j38y6r"},
+	{Coin: iwallet.CtLitecoin, Seed: vectorSeedBIP32, CoinIndex: 2, Path: KeyPath{Index: 1}, Address: "ltc1qqrkju64zja8fpmjqa9jc4s8v3xqaj7zxgy2jj0"},
+	{Coin: iwallet.CtLitecoin, Seed: vectorSeedBIP32, CoinIndex: 2, Path: KeyPath{Change: true}, Address: "ltc1qgh6f3j9jhgzavc4t06n4m5p3fggxly6xz2j6ns"},
+	{Coin: iwallet.CtLitecoin, Seed: vectorSeedBIP39, CoinIndex: 2, Path: KeyPath{}, Address: "ltc1q6sr2nx2dmaj3c2zt8p9703wdrka30s49ktwgda"},
+	{Coin: iwallet.CtLitecoin, Seed: vectorSeedBIP39, CoinIndex: 2, Path: KeyPath{Index: 1}, Address: "ltc1qcctpd7s6jh4q67vhkj3j502pl8vy2r5cm9gerd"},
+	{Coin: iwallet.CtLitecoin, Seed: vectorSeedBIP39, CoinIndex: 2, Path: KeyPath{Change: true}, Address: "ltc1qdayn24j45qe2xftq5hkdm9np3mnq5swpyg6vhj"},
+
+	{Coin: iwallet.CtLitecoin, Testnet: true, Seed: vectorSeedBIP32, CoinIndex: 1, Path: KeyPath{}, Address: "tltc1qcq03tfyesyxgv3a7tj88v9ehwmhpp22q9x0utg"},
+	{Coin: iwallet.CtLitecoin, Testnet: true, Seed: vectorSeedBIP32, CoinIndex: 1, Path: KeyPath{Index: 1}, Address: "tltc1qg3rke572qtsvwt3dn0z6ffh7fcqtx2s2kcx2ks"},
+	{Coin: iwallet.CtLitecoin, Testnet: true, Seed: vectorSeedBIP32, CoinIndex: 1, Path: KeyPath{Change: true}, Address: "tltc1qymfhl5yv3as5tqqsflyejhhzwn6f5wcymy470f"},
+	{Coin: iwallet.CtLitecoin, Testnet: true, Seed: vectorSeedBIP39, CoinIndex: 1, Path: KeyPath{}, Address: "tltc1qk2xtupzg7c4ytrgypu0kav9ayfafwwdqg8y94e"},
+	{Coin: iwallet.CtLitecoin, Testnet: true, Seed: vectorSeedBIP39, CoinIndex: 1, Path: KeyPath{Index: 1}, Address: "tltc1qv5nlqkldw8cx7680whc5xrpsw6t03zwqrrrww6"},
+	{Coin: iwallet.CtLitecoin, Testnet: true, Seed: vectorSeedBIP39, CoinIndex: 1, Path: KeyPath{Change: true}, Address: "tltc1qmtzfjlrdxquzn3vkzcvnm3df4ajqj02ge2yh76"},
+
+	{Coin: iwallet.CtZCash, Seed: vectorSeedBIP32, CoinIndex: 133, Path: KeyPath{}, Address: "t1bPimUe6UTYS2Cz9F46CMrwscbYkfqQ5nt"},
+	{Coin: iwallet.CtZCash, Seed: vectorSeedBIP32, CoinIndex: 133, Path: KeyPath{Index: 1}, Address: "t1dgTYkM7D88fe6E78UyXkG8im7GWwRrs5U"},
+	{Coin: iwallet.CtZCash, Seed: vectorSeedBIP32, CoinIndex: 133, Path: KeyPath{Change: true}, Address: "t1VzWd986GRAUtj3NDLF8LFzRkXX5LjDJSK"},
+	{Coin: iwallet.CtZCash, Seed: vectorSeedBIP39, CoinIndex: 133, Path: KeyPath{}, Address: "t1Sx5L6i1jmxygH6zswC2vEMtTiCdgcfm3Z"},
+	{Coin: iwallet.CtZCash, Seed: vectorSeedBIP39, CoinIndex: 133, Path: KeyPath{Index: 1}, Address: "t1apJBjzH8GtDXmK8wEZs3n5zGVAvPvhTNF"},
+	{Coin: iwallet.CtZCash, Seed: vectorSeedBIP39, CoinIndex: 133, Path: KeyPath{Change: true}, Address: "t1Jc1vuhezDhoxC3K6vxXi6sERjLtBrUKQM"},
+
+	{Coin: iwallet.CtZCash, Testnet: true, Seed: vectorSeedBIP32, CoinIndex: 1, Path: KeyPath{}, Address: "tmTECJo4TeHgMMyaeySjtp4hov1at8KDdaC"},
+	{Coin: iwallet.CtZCash, Testnet: true, Seed: vectorSeedBIP32, CoinIndex: 1, Path: KeyPath{Index: 1}, Address: "tmFwNqvHQnFX8qpCsAiuX167h3M5Uu8BD5R"},
+	{Coin: iwallet.CtZCash, Testnet: true, Seed: vectorSeedBIP32, CoinIndex: 1, Path: KeyPath{Change: true}, Address: "tmDFeNgtJgmuM5df5A1bkVkvFm9H8J8rSko"},
+	{Coin: iwallet.CtZCash, Testnet: true, Seed: vectorSeedBIP39, CoinIndex: 1, Path: KeyPath{}, Address: "tmRzSDG4siPUchUQwojCSyqn2QdnnZkFW3f"},
+	{Coin: iwallet.CtZCash, Testnet: true, Seed: vectorSeedBIP39, CoinIndex: 1, Path: KeyPath{Index: 1}, Address: "tmJwDRYrkbTyu7xnHsfG1RdpL8AtoUhpE8k"},
+	{Coin: iwallet.CtZCash, Testnet: true, Seed: vectorSeedBIP39, CoinIndex: 1, Path: KeyPath{Change: true}, Address: "tmVf69y3s8uSre7onGKS1vqseG9CxrGQYt5"},
+}
+
+// AddressVectorsFor returns the vectors of the coin on the network with the
+// address type.
+func AddressVectorsFor(coinType iwallet.CoinType, testnet bool, addressType AddressType) []AddressVector {
+	var vectors []AddressVector
+	for _, v := range AddressVectors {
+		if v.Coin == coinType && v.Testnet == testnet && v.AddressType == addressType {
+			vectors = append(vectors, v)
+		}
+	}
+	return vectors
+}
+
+// VerifyAddressVectors derives the key of each vector and checks
+// addressFunc encodes it as the vector's address. addressFunc is passed the
+// public key, as it is by the Keychain. It returns ErrNoAddressVectors if
+// vectors is empty so a wallet can't pass without being checked.
+func VerifyAddressVectors(vectors []AddressVector, addressFunc AddrFunc) error {
+	if len(vectors) == 0 {
+		return ErrNoAddressVectors
+	}
+	for _, v := range vectors {
+		key, err := v.deriveKey()
+		if err != nil {
+			return err
+		}
+		addr, err := addressFunc(key)
+		if err != nil {
+			return err
+		}
+		if addr.String() != v.Address {
+			return fmt.Errorf("%s key %s derived address %s, expected %s", v.Coin.CurrencyCode(), v.pathString(), addr, v.Address)
+		}
+	}
+	return nil
+}
+
+// deriveKey returns the public key at the vector's path.
+func (v AddressVector) deriveKey() (*hd.ExtendedKey, error) {
+	seed, err := hex.DecodeString(v.Seed)
+	if err != nil {
+		return nil, err
+	}
+	params := &chaincfg.MainNetParams
+	if v.Testnet {
+		params = &chaincfg.TestNet3Params
+	}
+	key, err := hd.NewMaster(seed, params)
+	if err != nil {
+		return nil, err
+	}
+	change := uint32(0)
+	if v.Path.Change {
+		change = 1
+	}
+	for _, i := range []uint32{hd.HardenedKeyStart + 44, hd.HardenedKeyStart + v.CoinIndex, change, v.Path.Index} {
+		child, err := key.Child(i)
+		ZeroKey(key)
+		if err != nil {
+			return nil, err
+		}
+		key = child
+	}
+	pub, err := key.Neuter()
+	ZeroKey(key)
+	return pub, err
+}
+
+func (v AddressVector) pathString() string {
+	change := 0
+	if v.Path.Change {
+		change = 1
+	}
+	return fmt.Sprintf("m/44'/%d'/%d/%d", v.CoinIndex, change, v.Path.Index)
+}
@@ -0,0 +1,37 @@
+package base
+
+import (
+	"bytes"
+	"encoding/json"
+	iwallet "github.com/cpacia/wallet-interface"
+	"io/ioutil"
+	"testing"
+)
+
+func TestAddressVectors_Golden(t *testing.T) {
+	golden, err := ioutil.ReadFile("testdata/address_vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := json.MarshalIndent(AddressVectors, "", "\t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bytes.TrimSpace(golden), encoded) {
+		t.Error("AddressVectors don't match the published vectors in testdata/address_vectors.json")
+	}
+}
+
+func TestVerifyAddressVectors(t *testing.T) {
+	// The mock address is the hash of the public key so no vector matches.
+	vectors := AddressVectorsFor(iwallet.CtBitcoin, false, AddressTypeNativeSegwit)
+	if len(vectors) == 0 {
+		t.Fatal("Expected bitcoin vectors")
+	}
+	if err := VerifyAddressVectors(vectors, newTestAddress); err == nil {
+		t.Error("Expected mismatch error")
+	}
+	if err := VerifyAddressVectors(nil, newTestAddress); err != ErrNoAddressVectors {
+		t.Errorf("Expected ErrNoAddressVectors, got %v", err)
+	}
+}
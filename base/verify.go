@@ -0,0 +1,288 @@
+package base
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/cpacia/multiwallet/log"
+	iwallet "github.com/cpacia/wallet-interface"
+)
+
+// DiscrepancyKind describes how the responses from two backends differ.
+type DiscrepancyKind int
+
+const (
+	// DiscrepancyMissingTransaction means a transaction was returned by
+	// one backend but not the other.
+	DiscrepancyMissingTransaction DiscrepancyKind = iota
+
+	// DiscrepancyHeight means both backends returned the transaction but
+	// at different heights, so they report different confirmations.
+	DiscrepancyHeight
+
+	// DiscrepancyTransaction means both backends returned the transaction
+	// but with different inputs or outputs.
+	DiscrepancyTransaction
+
+	// DiscrepancyBackendError means the verifying backend failed to
+	// answer so the primary's response could not be checked.
+	DiscrepancyBackendError
+)
+
+func (k DiscrepancyKind) String() string {
+	switch k {
+	case DiscrepancyMissingTransaction:
+		return "missing transaction"
+	case DiscrepancyHeight:
+		return "height mismatch"
+	case DiscrepancyTransaction:
+		return "transaction mismatch"
+	case DiscrepancyBackendError:
+		return "backend error"
+	}
+	return "unknown"
+}
+
+// DiscrepancyEvent is emitted by the VerifyingClient when the two backends
+// disagree. Address is empty if the query wasn't for an address.
+type DiscrepancyEvent struct {
+	Kind          DiscrepancyKind
+	CoinType      iwallet.CoinType
+	Address       iwallet.Address
+	TransactionID iwallet.TransactionID
+	Detail        string
+}
+
+// VerifyingClient is a ChainClient which sends history queries to two
+// independent backends and reports any differences between their responses
+// instead of trusting a single indexer. The primary backend's response is
+// always the one returned. Subscriptions only use the primary backend.
+//
+// Discrepancies are logged and emitted on Bus as *DiscrepancyEvent.
+type VerifyingClient struct {
+	Primary   ChainClient
+	Secondary ChainClient
+	Bus       Bus
+
+	coinType iwallet.CoinType
+	logger   log.Logger
+}
+
+// NewVerifyingClient returns a VerifyingClient which checks the responses
+// of primary against secondary.
+func NewVerifyingClient(primary, secondary ChainClient, coinType iwallet.CoinType, logger log.Logger) *VerifyingClient {
+	return &VerifyingClient{
+		Primary:   primary,
+		Secondary: secondary,
+		Bus:       NewBus(),
+		coinType:  coinType,
+		logger:    moduleLogger(logger, "verify", coinType),
+	}
+}
+
+func (c *VerifyingClient) GetBlockchainInfo() (iwallet.BlockInfo, error) {
+	return c.Primary.GetBlockchainInfo()
+}
+
+func (c *VerifyingClient) GetBlockchainInfoContext(ctx context.Context) (iwallet.BlockInfo, error) {
+	return WithContext(c.Primary).GetBlockchainInfoContext(ctx)
+}
+
+func (c *VerifyingClient) GetAddressTransactions(addr iwallet.Address, fromHeight uint64) ([]iwallet.Transaction, error) {
+	return c.GetAddressTransactionsContext(context.Background(), addr, fromHeight)
+}
+
+func (c *VerifyingClient) GetAddressTransactionsContext(ctx context.Context, addr iwallet.Address, fromHeight uint64) ([]iwallet.Transaction, error) {
+	type result struct {
+		txs []iwallet.Transaction
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		txs, err := WithContext(c.Secondary).GetAddressTransactionsContext(ctx, addr, fromHeight)
+		ch <- result{txs, err}
+	}()
+
+	txs, err := WithContext(c.Primary).GetAddressTransactionsContext(ctx, addr, fromHeight)
+	if err != nil {
+		return nil, err
+	}
+
+	secondary := <-ch
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if secondary.err != nil {
+		c.report(&DiscrepancyEvent{
+			Kind:    DiscrepancyBackendError,
+			Address: addr,
+			Detail:  secondary.err.Error(),
+		})
+		return txs, nil
+	}
+
+	secondaryTxs := make(map[iwallet.TransactionID]iwallet.Transaction, len(secondary.txs))
+	for _, tx := range secondary.txs {
+		secondaryTxs[tx.ID] = tx
+	}
+	for _, tx := range txs {
+		other, ok := secondaryTxs[tx.ID]
+		if !ok {
+			c.report(&DiscrepancyEvent{
+				Kind:          DiscrepancyMissingTransaction,
+				Address:       addr,
+				TransactionID: tx.ID,
+				Detail:        "not returned by verifying backend",
+			})
+			continue
+		}
+		delete(secondaryTxs, tx.ID)
+		c.compare(addr, tx, other)
+	}
+	for id := range secondaryTxs {
+		c.report(&DiscrepancyEvent{
+			Kind:          DiscrepancyMissingTransaction,
+			Address:       addr,
+			TransactionID: id,
+			Detail:        "not returned by primary backend",
+		})
+	}
+	return txs, nil
+}
+
+func (c *VerifyingClient) GetTransaction(id iwallet.TransactionID) (iwallet.Transaction, error) {
+	return c.GetTransactionContext(context.Background(), id)
+}
+
+func (c *VerifyingClient) GetTransactionContext(ctx context.Context, id iwallet.TransactionID) (iwallet.Transaction, error) {
+	type result struct {
+		tx  iwallet.Transaction
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		tx, err := WithContext(c.Secondary).GetTransactionContext(ctx, id)
+		ch <- result{tx, err}
+	}()
+
+	tx, err := WithContext(c.Primary).GetTransactionContext(ctx, id)
+	if err != nil {
+		return tx, err
+	}
+
+	secondary := <-ch
+	if err := ctx.Err(); err != nil {
+		return iwallet.Transaction{}, err
+	}
+	if secondary.err != nil {
+		c.report(&DiscrepancyEvent{
+			Kind:          DiscrepancyBackendError,
+			TransactionID: id,
+			Detail:        secondary.err.Error(),
+		})
+		return tx, nil
+	}
+	c.compare(iwallet.Address{}, tx, secondary.tx)
+	return tx, nil
+}
+
+func (c *VerifyingClient) IsBlockInMainChain(block iwallet.BlockInfo) (bool, error) {
+	return c.Primary.IsBlockInMainChain(block)
+}
+
+func (c *VerifyingClient) GetMerkleProof(id iwallet.TransactionID) (*MerkleProof, error) {
+	return c.Primary.GetMerkleProof(id)
+}
+
+func (c *VerifyingClient) SubscribeTransactions(addrs []iwallet.Address) (*TransactionSubscription, error) {
+	return c.Primary.SubscribeTransactions(addrs)
+}
+
+func (c *VerifyingClient) SubscribeBlocks() (*BlockSubscription, error) {
+	return c.Primary.SubscribeBlocks()
+}
+
+// Broadcast sends the transaction to both backends. Only an error from the
+// primary is returned.
+func (c *VerifyingClient) Broadcast(serializedTx []byte) error {
+	return c.BroadcastContext(context.Background(), serializedTx)
+}
+
+func (c *VerifyingClient) BroadcastContext(ctx context.Context, serializedTx []byte) error {
+	if err := WithContext(c.Primary).BroadcastContext(ctx, serializedTx); err != nil {
+		return err
+	}
+	if err := WithContext(c.Secondary).BroadcastContext(ctx, serializedTx); err != nil && c.logger != nil {
+		c.logger.Debugf("Verifying backend failed to broadcast transaction: %s", err)
+	}
+	return nil
+}
+
+func (c *VerifyingClient) Open() error {
+	if err := c.Primary.Open(); err != nil {
+		return err
+	}
+	if err := c.Secondary.Open(); err != nil {
+		c.Primary.Close()
+		return err
+	}
+	return nil
+}
+
+func (c *VerifyingClient) Close() error {
+	err := c.Primary.Close()
+	if err2 := c.Secondary.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// compare reports any difference between the two versions of a transaction.
+func (c *VerifyingClient) compare(addr iwallet.Address, tx, other iwallet.Transaction) {
+	if tx.Height != other.Height {
+		c.report(&DiscrepancyEvent{
+			Kind:          DiscrepancyHeight,
+			Address:       addr,
+			TransactionID: tx.ID,
+			Detail:        fmt.Sprintf("primary height %d, verifying height %d", tx.Height, other.Height),
+		})
+	}
+	if !spendInfosEqual(tx.From, other.From) || !spendInfosEqual(tx.To, other.To) {
+		c.report(&DiscrepancyEvent{
+			Kind:          DiscrepancyTransaction,
+			Address:       addr,
+			TransactionID: tx.ID,
+			Detail:        "inputs or outputs differ",
+		})
+	}
+}
+
+func (c *VerifyingClient) report(event *DiscrepancyEvent) {
+	event.CoinType = c.coinType
+	if c.logger != nil {
+		c.logger.Warningf("Backend discrepancy (%s) for %s transaction %s: %s", event.Kind, c.coinType.CurrencyCode(), event.TransactionID, event.Detail)
+	}
+	c.Bus.Emit(event)
+}
+
+func spendInfosEqual(a, b []iwallet.SpendInfo) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Address.String() != b[i].Address.String() || a[i].Amount.String() != b[i].Amount.String() {
+			return false
+		}
+	}
+	return true
+}
+
+// SubscribeDiscrepancies returns a subscription to the *DiscrepancyEvents
+// emitted when the wallet was configured with a VerifyClientURL.
+func (w *WalletBase) SubscribeDiscrepancies() (Subscription, error) {
+	vc, ok := w.ChainClient.(*VerifyingClient)
+	if !ok {
+		return nil, errors.New("backend verification is not enabled")
+	}
+	return vc.Bus.Subscribe(&DiscrepancyEvent{})
+}
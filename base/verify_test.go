@@ -0,0 +1,107 @@
+package base
+
+import (
+	"errors"
+	iwallet "github.com/cpacia/wallet-interface"
+	"testing"
+	"time"
+)
+
+func TestVerifyingClient_GetAddressTransactions(t *testing.T) {
+	var (
+		primary   = NewMockChainClient()
+		secondary = NewMockChainClient()
+		client    = NewVerifyingClient(primary, secondary, iwallet.CtMock, nil)
+		addr      = mockAddress()
+		tx1       = NewMockTransaction(nil, &addr)
+		tx2       = NewMockTransaction(nil, &addr)
+		tx3       = NewMockTransaction(nil, &addr)
+	)
+
+	sub, err := client.Bus.Subscribe(&DiscrepancyEvent{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	for _, tx := range []iwallet.Transaction{tx1, tx2} {
+		if err := primary.BroadcastInternal(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tx := range []iwallet.Transaction{tx1, tx3} {
+		if err := secondary.BroadcastInternal(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	primary.GenerateBlock()
+
+	txs, err := client.GetAddressTransactions(addr, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txs) != 2 {
+		t.Fatalf("Expected primary's 2 transactions, got %d", len(txs))
+	}
+
+	expected := map[iwallet.TransactionID]DiscrepancyKind{
+		tx1.ID: DiscrepancyHeight,
+		tx2.ID: DiscrepancyMissingTransaction,
+		tx3.ID: DiscrepancyMissingTransaction,
+	}
+	for range expected {
+		select {
+		case e := <-sub.Out():
+			event := e.(*DiscrepancyEvent)
+			kind, ok := expected[event.TransactionID]
+			if !ok {
+				t.Fatalf("Unexpected discrepancy for %s", event.TransactionID)
+			}
+			if event.Kind != kind {
+				t.Errorf("Expected %s for %s, got %s", kind, event.TransactionID, event.Kind)
+			}
+			delete(expected, event.TransactionID)
+		case <-time.After(time.Second * 10):
+			t.Fatal("Timed out waiting for discrepancy")
+		}
+	}
+
+	select {
+	case e := <-sub.Out():
+		t.Errorf("Unexpected discrepancy %v", e)
+	default:
+	}
+}
+
+func TestVerifyingClient_SecondaryError(t *testing.T) {
+	var (
+		primary   = NewMockChainClient()
+		secondary = NewMockChainClient()
+		client    = NewVerifyingClient(primary, secondary, iwallet.CtMock, nil)
+		tx        = NewMockTransaction(nil, nil)
+	)
+
+	sub, err := client.Bus.Subscribe(&DiscrepancyEvent{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	if err := primary.BroadcastInternal(tx); err != nil {
+		t.Fatal(err)
+	}
+	secondary.SetErrorResponse(errors.New("unavailable"))
+
+	if _, err := client.GetTransaction(tx.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case e := <-sub.Out():
+		if kind := e.(*DiscrepancyEvent).Kind; kind != DiscrepancyBackendError {
+			t.Errorf("Expected backend error, got %s", kind)
+		}
+	case <-time.After(time.Second * 10):
+		t.Fatal("Timed out waiting for discrepancy")
+	}
+}
@@ -0,0 +1,124 @@
+package base
+
+import (
+	"errors"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"gorm.io/gorm"
+)
+
+// ConfirmationEvent is sent by WaitForConfirmation when a transaction
+// reaches the requested number of confirmations or is double spent. If
+// ConflictingID is set the transaction was double spent and may never
+// confirm.
+type ConfirmationEvent struct {
+	TransactionID iwallet.TransactionID
+	Confirmations uint64
+	Height        uint64
+	ConflictingID iwallet.TransactionID
+}
+
+// confirmationWaiter is a pending WaitForConfirmation call.
+type confirmationWaiter struct {
+	txid          iwallet.TransactionID
+	confirmations uint64
+	ch            chan ConfirmationEvent
+}
+
+// WaitForConfirmation returns a channel which receives one event when the
+// wallet transaction reaches n confirmations or is flagged as conflicted.
+// The channel is closed after the event. The transaction doesn't need to
+// be in the wallet yet. The CancelFunc stops waiting and closes the channel
+// if it hasn't fired.
+func (cm *ChainManager) WaitForConfirmation(txid iwallet.TransactionID, n uint64) (<-chan ConfirmationEvent, CancelFunc) {
+	if n == 0 {
+		n = 1
+	}
+	waiter := &confirmationWaiter{
+		txid:          txid,
+		confirmations: n,
+		ch:            make(chan ConfirmationEvent, 1),
+	}
+	cm.waitMtx.Lock()
+	cm.waiters[txid] = append(cm.waiters[txid], waiter)
+	cm.waitMtx.Unlock()
+
+	// The transaction may already be confirmed.
+	go cm.notifyWaiters()
+
+	cancel := func() {
+		cm.waitMtx.Lock()
+		defer cm.waitMtx.Unlock()
+		waiters := cm.waiters[txid]
+		for i, w := range waiters {
+			if w == waiter {
+				cm.waiters[txid] = append(waiters[:i], waiters[i+1:]...)
+				if len(cm.waiters[txid]) == 0 {
+					delete(cm.waiters, txid)
+				}
+				close(waiter.ch)
+				return
+			}
+		}
+	}
+	return waiter.ch, cancel
+}
+
+// notifyWaiters fires the waiters whose transactions have enough
+// confirmations or are conflicted. It's run whenever a block arrives or
+// transactions are saved or updated.
+func (cm *ChainManager) notifyWaiters() {
+	cm.waitMtx.Lock()
+	defer cm.waitMtx.Unlock()
+	if len(cm.waiters) == 0 {
+		return
+	}
+
+	best := cm.BestBlock()
+	err := cm.db.View(func(dbtx database.Tx) error {
+		for txid, waiters := range cm.waiters {
+			var record database.TransactionRecord
+			err := dbtx.Read().Where("coin=?", cm.coinType.CurrencyCode()).Where("txid=?", txid.String()).First(&record).Error
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				continue
+			} else if err != nil {
+				return err
+			}
+
+			event := ConfirmationEvent{
+				TransactionID: txid,
+				Height:        record.BlockHeight,
+				ConflictingID: iwallet.TransactionID(record.ConflictedBy),
+			}
+			if record.BlockHeight > 0 && best.Height >= record.BlockHeight {
+				event.Confirmations = best.Height - record.BlockHeight + 1
+			}
+
+			var remaining []*confirmationWaiter
+			for _, w := range waiters {
+				if event.ConflictingID != "" || event.Confirmations >= w.confirmations {
+					w.ch <- event
+					close(w.ch)
+					continue
+				}
+				remaining = append(remaining, w)
+			}
+			if len(remaining) == 0 {
+				delete(cm.waiters, txid)
+			} else {
+				cm.waiters[txid] = remaining
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		cm.logger.Errorf("[%s] Error checking confirmations: %s", cm.coinType, err)
+	}
+}
+
+// WaitForConfirmation returns a channel which receives one event when the
+// wallet transaction reaches n confirmations or is double spent, so callers
+// don't have to poll. See ChainManager.WaitForConfirmation.
+func (w *WalletBase) WaitForConfirmation(txid iwallet.TransactionID, n uint64) (<-chan ConfirmationEvent, CancelFunc) {
+	return w.ChainManager.WaitForConfirmation(txid, n)
+}
@@ -0,0 +1,94 @@
+package base
+
+import (
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"testing"
+	"time"
+)
+
+func TestChainManager_WaitForConfirmation(t *testing.T) {
+	chain, _, err := newTestChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.db.Close()
+
+	saveTx := func(tx iwallet.Transaction, conflictedBy string) {
+		err := chain.db.Update(func(dbtx database.Tx) error {
+			rec, err := database.NewTransactionRecord(tx, iwallet.CtMock)
+			if err != nil {
+				return err
+			}
+			rec.ConflictedBy = conflictedBy
+			return dbtx.Save(rec)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	setHeight := func(height uint64) {
+		chain.bestMtx.Lock()
+		chain.best = iwallet.BlockInfo{Height: height}
+		chain.bestMtx.Unlock()
+	}
+
+	setHeight(100)
+	tx := NewMockTransaction(nil, nil)
+	saveTx(tx, "")
+
+	ch, cancel := chain.WaitForConfirmation(tx.ID, 3)
+	defer cancel()
+
+	// Not confirmed yet.
+	chain.notifyWaiters()
+	select {
+	case <-ch:
+		t.Fatal("Fired before the transaction confirmed")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	tx.Height = 101
+	saveTx(tx, "")
+	chain.notifyWaiters()
+	select {
+	case <-ch:
+		t.Fatal("Fired with one confirmation")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	setHeight(103)
+	chain.notifyWaiters()
+	select {
+	case event := <-ch:
+		if event.TransactionID != tx.ID || event.Confirmations != 3 || event.Height != 101 || event.ConflictingID != "" {
+			t.Errorf("Unexpected event %+v", event)
+		}
+	case <-time.After(time.Second * 10):
+		t.Fatal("Timed out waiting for confirmation")
+	}
+	if _, ok := <-ch; ok {
+		t.Error("Expected channel to be closed")
+	}
+
+	// A conflicted transaction fires straight away.
+	conflicted := NewMockTransaction(nil, nil)
+	saveTx(conflicted, "abc")
+	ch2, cancel2 := chain.WaitForConfirmation(conflicted.ID, 1)
+	defer cancel2()
+	select {
+	case event := <-ch2:
+		if event.ConflictingID != "abc" {
+			t.Errorf("Expected conflicting ID abc, got %s", event.ConflictingID)
+		}
+	case <-time.After(time.Second * 10):
+		t.Fatal("Timed out waiting for conflict")
+	}
+
+	// Canceling closes the channel without an event.
+	ch3, cancel3 := chain.WaitForConfirmation("unknown", 1)
+	cancel3()
+	if _, ok := <-ch3; ok {
+		t.Error("Expected channel to be closed without an event")
+	}
+}
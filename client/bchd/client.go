@@ -14,7 +14,6 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/status"
-	"math/rand"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -158,164 +157,22 @@ func (c *BchdClient) IsBlockInMainChain(block iwallet.BlockInfo) (bool, error) {
 	return blockInfo.Info.Confirmations > 0, nil
 }
 
-func (c *BchdClient) SubscribeTransactions(addrs []iwallet.Address) (*base.TransactionSubscription, error) {
-	if atomic.LoadUint32(&c.started) == 0 {
-		return nil, errors.New("bchd client not connected")
-	}
-	c.subMtx.Lock()
-	defer c.subMtx.Unlock()
-
-	sub := &base.TransactionSubscription{
-		Out:         make(chan iwallet.Transaction),
-		Subscribe:   make(chan []iwallet.Address),
-		Unsubscribe: make(chan []iwallet.Address),
-	}
-
-	addrStrs := make([]string, 0, len(addrs))
-	for _, addr := range addrs {
-		addrStrs = append(addrStrs, addr.String())
-	}
-	stream, err := c.client.SubscribeTransactionStream(context.Background())
-	if err != nil {
-		return nil, err
-	}
-
-	err = stream.Send(&pb.SubscribeTransactionsRequest{
-		Subscribe: &pb.TransactionFilter{
-			Addresses: addrStrs,
-		},
-		IncludeMempool: true,
-		IncludeInBlock: true,
-	})
-	if err != nil {
-		return nil, err
-	}
-
-	id := rand.Int31()
-	c.txSubs[id] = sub
-
-	subClose := make(chan struct{})
-
-	sub.Close = func() {
-		stream.CloseSend()
-		close(sub.Out)
-		close(subClose)
-		c.subMtx.Lock()
-		delete(c.txSubs, id)
-		c.subMtx.Unlock()
-	}
+// GetMerkleProof is not supported. bchd's merkle proofs are partial
+// merkle trees which don't include the block's transaction count.
+func (c *BchdClient) GetMerkleProof(id iwallet.TransactionID) (*base.MerkleProof, error) {
+	return nil, base.ErrMerkleProofUnsupported
+}
 
-	go func() {
-		for {
-			select {
-			case <-subClose:
-				return
-			case addrs := <-sub.Subscribe:
-				addrStrs := make([]string, 0, len(addrs))
-				for _, addr := range addrs {
-					addrStrs = append(addrStrs, addr.String())
-				}
-
-				stream.Send(&pb.SubscribeTransactionsRequest{
-					Subscribe: &pb.TransactionFilter{
-						Addresses: addrStrs,
-					},
-					IncludeMempool: true,
-					IncludeInBlock: true,
-				})
-			case addrs := <-sub.Unsubscribe:
-				addrStrs := make([]string, 0, len(addrs))
-				for _, addr := range addrs {
-					addrStrs = append(addrStrs, addr.String())
-				}
-				stream.Send(&pb.SubscribeTransactionsRequest{
-					Unsubscribe: &pb.TransactionFilter{
-						Addresses: addrStrs,
-					},
-				})
-			}
-		}
-	}()
-
-	go func() {
-		for {
-			txNtf, err := stream.Recv()
-			if err != nil {
-				return
-			}
-			if txNtf.Type == pb.TransactionNotification_CONFIRMED {
-				tx, err := buildTransaction(txNtf.GetConfirmedTransaction())
-				if err != nil {
-					continue
-				}
-				sub.Out <- tx
-			} else if txNtf.Type == pb.TransactionNotification_UNCONFIRMED {
-				tx, err := buildTransaction(txNtf.GetUnconfirmedTransaction().Transaction)
-				if err != nil {
-					continue
-				}
-				sub.Out <- tx
-			}
-		}
-	}()
-	return sub, nil
+// SubscribeTransactions streams the transactions of the addresses. It's
+// SubscribeAddresses starting at the current tip.
+func (c *BchdClient) SubscribeTransactions(addrs []iwallet.Address) (*base.TransactionSubscription, error) {
+	return c.SubscribeAddresses(addrs, base.StreamCheckpoint{})
 }
 
+// SubscribeBlocks streams new blocks. It's SubscribeBlocksFrom starting at
+// the current tip.
 func (c *BchdClient) SubscribeBlocks() (*base.BlockSubscription, error) {
-	if atomic.LoadUint32(&c.started) == 0 {
-		return nil, errors.New("bchd client not connected")
-	}
-	c.subMtx.Lock()
-	defer c.subMtx.Unlock()
-
-	sub := &base.BlockSubscription{
-		Out: make(chan iwallet.BlockInfo),
-	}
-
-	stream, err := c.client.SubscribeBlocks(context.Background(), &pb.SubscribeBlocksRequest{})
-	if err != nil {
-		return nil, err
-	}
-
-	id := rand.Int31()
-	c.blockSubs[id] = sub
-
-	sub.Close = func() {
-		stream.CloseSend()
-		c.subMtx.Lock()
-		delete(c.blockSubs, id)
-		c.subMtx.Unlock()
-		close(sub.Out)
-	}
-	go func() {
-		for {
-			blockNotf, err := stream.Recv()
-			if err != nil {
-				return
-			}
-			if blockNotf.Type != pb.BlockNotification_CONNECTED {
-				continue
-			}
-			info := blockNotf.GetBlockInfo()
-
-			blockHash, err := chainhash.NewHash(info.Hash)
-			if err != nil {
-				continue
-			}
-			prevHash, err := chainhash.NewHash(info.PreviousBlock)
-			if err != nil {
-				continue
-			}
-
-			sub.Out <- iwallet.BlockInfo{
-				BlockID:   iwallet.BlockID(blockHash.String()),
-				PrevBlock: iwallet.BlockID(prevHash.String()),
-				BlockTime: time.Unix(info.Timestamp, 0),
-				Height:    uint64(info.Height),
-			}
-		}
-	}()
-	return sub, nil
+	return c.SubscribeBlocksFrom(base.StreamCheckpoint{})
 }
 
 func (c *BchdClient) Broadcast(serializedTx []byte) error {
@@ -0,0 +1,565 @@
+package bchd
+
+import (
+	"context"
+	"errors"
+	"github.com/cpacia/multiwallet/base"
+	iwallet "github.com/cpacia/wallet-interface"
+	"github.com/gcash/bchd/bchrpc/pb"
+	"github.com/gcash/bchd/chaincfg/chainhash"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// streamRetryInterval is the delay before the first attempt to
+	// reopen a broken stream. It doubles up to maxStreamRetryInterval.
+	streamRetryInterval    = time.Second
+	maxStreamRetryInterval = time.Minute
+
+	// recentBlocks is the number of delivered blocks a block stream
+	// remembers to find the fork point when resuming after a reorg.
+	recentBlocks = 100
+)
+
+var _ = base.StreamingClient(&BchdClient{})
+
+// errStreamClosed is returned within a stream when its subscription has
+// been closed.
+var errStreamClosed = errors.New("subscription closed")
+
+// SubscribeAddresses streams the transactions of the addresses following
+// the base.StreamingClient contract. The gRPC stream is reopened whenever
+// it breaks and the addresses' transactions from the tip at the time the
+// broken stream was opened are delivered again.
+func (c *BchdClient) SubscribeAddresses(addrs []iwallet.Address, from base.StreamCheckpoint) (*base.TransactionSubscription, error) {
+	if atomic.LoadUint32(&c.started) == 0 {
+		return nil, errors.New("bchd client not connected")
+	}
+	s := &addressStream{
+		client: c,
+		sub: &base.TransactionSubscription{
+			Out:         make(chan iwallet.Transaction, base.StreamBufferSize),
+			Subscribe:   make(chan []iwallet.Address),
+			Unsubscribe: make(chan []iwallet.Address),
+		},
+		done:  make(chan struct{}),
+		addrs: make(map[string]iwallet.Address),
+	}
+	for _, addr := range addrs {
+		s.addrs[addr.String()] = addr
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+
+	c.subMtx.Lock()
+	id := rand.Int31()
+	c.txSubs[id] = s.sub
+	c.subMtx.Unlock()
+
+	var closeOnce sync.Once
+	s.sub.Close = func() {
+		closeOnce.Do(func() {
+			close(s.done)
+			s.mtx.Lock()
+			s.cancel()
+			s.mtx.Unlock()
+			c.subMtx.Lock()
+			delete(c.txSubs, id)
+			c.subMtx.Unlock()
+		})
+	}
+
+	go s.handleFilters()
+	go s.run(from)
+	return s.sub, nil
+}
+
+// SubscribeBlocksFrom streams the blocks connected to the best chain
+// following the base.StreamingClient contract. The gRPC stream is reopened
+// whenever it breaks and the blocks since the last one delivered are
+// fetched by height.
+func (c *BchdClient) SubscribeBlocksFrom(from base.StreamCheckpoint) (*base.BlockSubscription, error) {
+	if atomic.LoadUint32(&c.started) == 0 {
+		return nil, errors.New("bchd client not connected")
+	}
+	s := &blockStream{
+		client: c,
+		sub: &base.BlockSubscription{
+			Out: make(chan iwallet.BlockInfo, base.StreamBufferSize),
+		},
+		done:   make(chan struct{}),
+		recent: make(map[uint64]iwallet.BlockID),
+	}
+	if from != (base.StreamCheckpoint{}) {
+		s.last = iwallet.BlockInfo{Height: from.Height, BlockID: from.BlockID}
+		s.recent[from.Height] = from.BlockID
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+
+	c.subMtx.Lock()
+	id := rand.Int31()
+	c.blockSubs[id] = s.sub
+	c.subMtx.Unlock()
+
+	var closeOnce sync.Once
+	s.sub.Close = func() {
+		closeOnce.Do(func() {
+			close(s.done)
+			s.mtx.Lock()
+			s.cancel()
+			s.mtx.Unlock()
+			c.subMtx.Lock()
+			delete(c.blockSubs, id)
+			c.subMtx.Unlock()
+		})
+	}
+
+	go s.run(from != (base.StreamCheckpoint{}))
+	return s.sub, nil
+}
+
+// reconnect calls open with an exponential backoff until it succeeds. It
+// returns false if done or the client is closed first.
+func (c *BchdClient) reconnect(done chan struct{}, open func() error) bool {
+	delay := streamRetryInterval
+	for {
+		select {
+		case <-time.After(delay):
+		case <-done:
+			return false
+		case <-c.shutdown:
+			return false
+		}
+		err := open()
+		if err == nil {
+			return true
+		} else if err == errStreamClosed {
+			return false
+		}
+		delay *= 2
+		if delay > maxStreamRetryInterval {
+			delay = maxStreamRetryInterval
+		}
+	}
+}
+
+// addressStream is the state of one address subscription. It outlives the
+// gRPC streams it's delivered over.
+type addressStream struct {
+	client *BchdClient
+	sub    *base.TransactionSubscription
+	done   chan struct{}
+
+	// addrs are the subscribed addresses. stream is the current gRPC
+	// stream, cancel closes it and connectedAt is the height of the tip
+	// when it was opened. These are guarded by mtx, which also
+	// serializes sends on the stream.
+	mtx         sync.Mutex
+	addrs       map[string]iwallet.Address
+	stream      pb.Bchrpc_SubscribeTransactionStreamClient
+	cancel      context.CancelFunc
+	connectedAt uint64
+}
+
+// open opens a new gRPC stream subscribed to all of the addresses.
+func (s *addressStream) open() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := s.client.client.SubscribeTransactionStream(ctx)
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	select {
+	case <-s.done:
+		cancel()
+		return errStreamClosed
+	default:
+	}
+	addrs := make([]iwallet.Address, 0, len(s.addrs))
+	for _, addr := range s.addrs {
+		addrs = append(addrs, addr)
+	}
+	err = stream.Send(&pb.SubscribeTransactionsRequest{
+		Subscribe:      &pb.TransactionFilter{Addresses: addrStrings(addrs)},
+		IncludeMempool: true,
+		IncludeInBlock: true,
+	})
+	if err != nil {
+		cancel()
+		return err
+	}
+	// The tip is read after subscribing so nothing between the two is
+	// missed when resuming from it.
+	info, err := s.client.client.GetBlockchainInfo(ctx, &pb.GetBlockchainInfoRequest{})
+	if err != nil {
+		cancel()
+		return err
+	}
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.stream, s.cancel, s.connectedAt = stream, cancel, uint64(info.BestHeight)
+	return nil
+}
+
+// handleFilters applies the addresses sent on the subscription's Subscribe
+// and Unsubscribe channels. They're remembered so that a reopened stream
+// is subscribed to them. A failed send is left to run, which reopens the
+// broken stream.
+func (s *addressStream) handleFilters() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case addrs := <-s.sub.Subscribe:
+			s.mtx.Lock()
+			for _, addr := range addrs {
+				s.addrs[addr.String()] = addr
+			}
+			s.stream.Send(&pb.SubscribeTransactionsRequest{
+				Subscribe:      &pb.TransactionFilter{Addresses: addrStrings(addrs)},
+				IncludeMempool: true,
+				IncludeInBlock: true,
+			})
+			s.mtx.Unlock()
+		case addrs := <-s.sub.Unsubscribe:
+			s.mtx.Lock()
+			for _, addr := range addrs {
+				delete(s.addrs, addr.String())
+			}
+			s.stream.Send(&pb.SubscribeTransactionsRequest{
+				Unsubscribe: &pb.TransactionFilter{Addresses: addrStrings(addrs)},
+			})
+			s.mtx.Unlock()
+		}
+	}
+}
+
+// run delivers the stream's transactions until the subscription or client
+// is closed, reopening the stream whenever it breaks. Out is closed once
+// the subscription is.
+func (s *addressStream) run(from base.StreamCheckpoint) {
+	defer func() {
+		select {
+		case <-s.done:
+			close(s.sub.Out)
+		default:
+		}
+	}()
+
+	resume, resumeFrom := from != (base.StreamCheckpoint{}), from.Height
+	for {
+		if resume {
+			if err := s.backfill(resumeFrom); err == errStreamClosed {
+				return
+			} else if err != nil {
+				// Try again from the same height on a new
+				// stream.
+				if !s.client.reconnect(s.done, s.open) {
+					return
+				}
+				continue
+			}
+		}
+
+		s.mtx.Lock()
+		stream, connectedAt := s.stream, s.connectedAt
+		s.mtx.Unlock()
+		if !s.receive(stream) {
+			return
+		}
+		resume, resumeFrom = true, connectedAt
+		if !s.client.reconnect(s.done, s.open) {
+			return
+		}
+	}
+}
+
+// receive delivers the transactions from the stream until it breaks, when
+// it returns true, or the subscription is closed.
+func (s *addressStream) receive(stream pb.Bchrpc_SubscribeTransactionStreamClient) bool {
+	for {
+		txNtf, err := stream.Recv()
+		if err != nil {
+			select {
+			case <-s.done:
+				return false
+			default:
+				return true
+			}
+		}
+		var tx iwallet.Transaction
+		switch txNtf.Type {
+		case pb.TransactionNotification_CONFIRMED:
+			tx, err = buildTransaction(txNtf.GetConfirmedTransaction())
+		case pb.TransactionNotification_UNCONFIRMED:
+			tx, err = buildTransaction(txNtf.GetUnconfirmedTransaction().Transaction)
+		default:
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if !s.deliver(tx) {
+			return false
+		}
+	}
+}
+
+// backfill delivers the transactions of every address from height, which
+// covers anything missed while the stream was down.
+func (s *addressStream) backfill(height uint64) error {
+	s.mtx.Lock()
+	addrs := make([]iwallet.Address, 0, len(s.addrs))
+	for _, addr := range s.addrs {
+		addrs = append(addrs, addr)
+	}
+	s.mtx.Unlock()
+
+	seen := make(map[iwallet.TransactionID]bool)
+	for _, addr := range addrs {
+		txs, err := s.client.GetAddressTransactions(addr, height)
+		if err != nil {
+			return err
+		}
+		for _, tx := range txs {
+			if seen[tx.ID] {
+				continue
+			}
+			seen[tx.ID] = true
+			if !s.deliver(tx) {
+				return errStreamClosed
+			}
+		}
+	}
+	return nil
+}
+
+// deliver sends tx on Out, blocking while it's full. It returns false if
+// the subscription was closed first.
+func (s *addressStream) deliver(tx iwallet.Transaction) bool {
+	select {
+	case s.sub.Out <- tx:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// blockStream is the state of one block subscription. It outlives the gRPC
+// streams it's delivered over.
+type blockStream struct {
+	client *BchdClient
+	sub    *base.BlockSubscription
+	done   chan struct{}
+
+	// stream is the current gRPC stream and cancel closes it. These are
+	// guarded by mtx.
+	mtx    sync.Mutex
+	stream pb.Bchrpc_SubscribeBlocksClient
+	cancel context.CancelFunc
+
+	// last is the last block delivered and recent holds the IDs of the
+	// last recentBlocks delivered by height. They're only used by run.
+	last   iwallet.BlockInfo
+	recent map[uint64]iwallet.BlockID
+}
+
+// open opens a new gRPC block stream.
+func (s *blockStream) open() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := s.client.client.SubscribeBlocks(ctx, &pb.SubscribeBlocksRequest{})
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	select {
+	case <-s.done:
+		cancel()
+		return errStreamClosed
+	default:
+	}
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.stream, s.cancel = stream, cancel
+	return nil
+}
+
+// run delivers the stream's blocks until the subscription or client is
+// closed, reopening the stream whenever it breaks. Out is closed once the
+// subscription is.
+func (s *blockStream) run(resume bool) {
+	defer func() {
+		select {
+		case <-s.done:
+			close(s.sub.Out)
+		default:
+		}
+	}()
+
+	for {
+		if resume {
+			if err := s.catchUp(); err == errStreamClosed {
+				return
+			} else if err != nil {
+				if !s.client.reconnect(s.done, s.open) {
+					return
+				}
+				continue
+			}
+		}
+
+		s.mtx.Lock()
+		stream := s.stream
+		s.mtx.Unlock()
+		if !s.receive(stream) {
+			return
+		}
+		resume = true
+		if !s.client.reconnect(s.done, s.open) {
+			return
+		}
+	}
+}
+
+// receive delivers the blocks from the stream until it breaks, when it
+// returns true, or the subscription is closed.
+func (s *blockStream) receive(stream pb.Bchrpc_SubscribeBlocksClient) bool {
+	for {
+		blockNtf, err := stream.Recv()
+		if err != nil {
+			select {
+			case <-s.done:
+				return false
+			default:
+				return true
+			}
+		}
+		if blockNtf.Type != pb.BlockNotification_CONNECTED {
+			continue
+		}
+		info, err := buildBlockInfo(blockNtf.GetBlockInfo())
+		if err != nil {
+			continue
+		}
+		if !s.deliver(info) {
+			return false
+		}
+	}
+}
+
+// catchUp delivers the blocks connected since the last one delivered. If
+// that block was reorged out they're delivered from the most recent
+// delivered block which is still in the best chain.
+func (s *blockStream) catchUp() error {
+	if s.last.BlockID == "" {
+		return nil
+	}
+	bcInfo, err := s.client.client.GetBlockchainInfo(context.Background(), &pb.GetBlockchainInfoRequest{})
+	if err != nil {
+		return err
+	}
+
+	height := s.last.Height
+	for height > 0 {
+		id, ok := s.recent[height]
+		if !ok {
+			break
+		}
+		info, err := s.client.blockAt(height)
+		if err != nil {
+			return err
+		}
+		if info.BlockID == id {
+			break
+		}
+		height--
+	}
+
+	for h := height + 1; h <= uint64(bcInfo.BestHeight); h++ {
+		info, err := s.client.blockAt(h)
+		if err != nil {
+			return err
+		}
+		if !s.deliver(info) {
+			return errStreamClosed
+		}
+	}
+	return nil
+}
+
+// deliver sends the block on Out, blocking while it's full, unless it was
+// already delivered. It returns false if the subscription was closed
+// first.
+func (s *blockStream) deliver(info iwallet.BlockInfo) bool {
+	if s.recent[info.Height] == info.BlockID {
+		return true
+	}
+	select {
+	case s.sub.Out <- info:
+	case <-s.done:
+		return false
+	}
+	s.last = info
+	for height := range s.recent {
+		// Blocks above this one were reorged out.
+		if height > info.Height || height+recentBlocks <= info.Height {
+			delete(s.recent, height)
+		}
+	}
+	s.recent[info.Height] = info.BlockID
+	return true
+}
+
+// blockAt returns the block at height in the best chain.
+func (c *BchdClient) blockAt(height uint64) (iwallet.BlockInfo, error) {
+	resp, err := c.client.GetBlockInfo(context.Background(), &pb.GetBlockInfoRequest{
+		HashOrHeight: &pb.GetBlockInfoRequest_Height{
+			Height: int32(height),
+		},
+	})
+	if err != nil {
+		return iwallet.BlockInfo{}, err
+	}
+	return buildBlockInfo(resp.Info)
+}
+
+func buildBlockInfo(info *pb.BlockInfo) (iwallet.BlockInfo, error) {
+	blockHash, err := chainhash.NewHash(info.Hash)
+	if err != nil {
+		return iwallet.BlockInfo{}, err
+	}
+	prevHash, err := chainhash.NewHash(info.PreviousBlock)
+	if err != nil {
+		return iwallet.BlockInfo{}, err
+	}
+	return iwallet.BlockInfo{
+		BlockID:   iwallet.BlockID(blockHash.String()),
+		PrevBlock: iwallet.BlockID(prevHash.String()),
+		BlockTime: time.Unix(info.Timestamp, 0),
+		Height:    uint64(info.Height),
+	}, nil
+}
+
+func addrStrings(addrs []iwallet.Address) []string {
+	strs := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		strs = append(strs, addr.String())
+	}
+	return strs
+}
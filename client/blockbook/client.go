@@ -2,6 +2,7 @@ package blockbook
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
@@ -71,7 +72,20 @@ type socketioReq struct {
 	Params []interface{} `json:"params"`
 }
 
+// get makes a GET request bound to ctx.
+func (c *BlockbookClient) get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.client.Do(req.WithContext(ctx))
+}
+
 func (c *BlockbookClient) GetBlockchainInfo() (iwallet.BlockInfo, error) {
+	return c.GetBlockchainInfoContext(context.Background())
+}
+
+func (c *BlockbookClient) GetBlockchainInfoContext(ctx context.Context) (iwallet.BlockInfo, error) {
 	type Info struct {
 		Blockbook struct {
 			LastBlockTime time.Time `json:"lastBlockTime"`
@@ -82,7 +96,7 @@ func (c *BlockbookClient) GetBlockchainInfo() (iwallet.BlockInfo, error) {
 		} `json:"backend"`
 	}
 
-	resp, err := c.client.Get(c.clientURL)
+	resp, err := c.get(ctx, c.clientURL)
 	if err != nil {
 		return iwallet.BlockInfo{}, err
 	}
@@ -102,7 +116,7 @@ func (c *BlockbookClient) GetBlockchainInfo() (iwallet.BlockInfo, error) {
 		Hash string `json:"blockHash"`
 	}
 
-	resp, err = c.client.Get(c.clientURL + "/block-index/" + strconv.Itoa(info.Backend.BestHeight-1))
+	resp, err = c.get(ctx, c.clientURL+"/block-index/"+strconv.Itoa(info.Backend.BestHeight-1))
 	if err != nil {
 		return iwallet.BlockInfo{}, err
 	}
@@ -131,6 +145,13 @@ type resultAddressTxids struct {
 }
 
 func (c *BlockbookClient) GetAddressTransactions(addr iwallet.Address, fromHeight uint64) ([]iwallet.Transaction, error) {
+	return c.GetAddressTransactionsContext(context.Background(), addr, fromHeight)
+}
+
+// GetAddressTransactionsContext is GetAddressTransactions with the
+// transaction lookups bound to ctx. The socket.io query for the txids
+// can't be cancelled so ctx is checked once it returns.
+func (c *BlockbookClient) GetAddressTransactionsContext(ctx context.Context, addr iwallet.Address, fromHeight uint64) ([]iwallet.Transaction, error) {
 	if atomic.LoadUint32(&c.started) == 0 {
 		return nil, errors.New("blockbook client not connected")
 	}
@@ -145,6 +166,9 @@ func (c *BlockbookClient) GetAddressTransactions(addr iwallet.Address, fromHeigh
 	if err != nil {
 		return nil, err
 	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
 	type txOrError struct {
 		tx  iwallet.Transaction
@@ -165,7 +189,7 @@ func (c *BlockbookClient) GetAddressTransactions(addr iwallet.Address, fromHeigh
 
 	for _, id := range ids.Result {
 		go func(strID string) {
-			tx, err := c.GetTransaction(iwallet.TransactionID(strID))
+			tx, err := c.GetTransactionContext(ctx, iwallet.TransactionID(strID))
 			ch <- txOrError{tx, err}
 			wg.Done()
 		}(id)
@@ -186,7 +210,11 @@ func (c *BlockbookClient) GetAddressTransactions(addr iwallet.Address, fromHeigh
 }
 
 func (c *BlockbookClient) GetTransaction(id iwallet.TransactionID) (iwallet.Transaction, error) {
-	resp, err := c.client.Get(c.clientURL + "/tx/" + id.String())
+	return c.GetTransactionContext(context.Background(), id)
+}
+
+func (c *BlockbookClient) GetTransactionContext(ctx context.Context, id iwallet.TransactionID) (iwallet.Transaction, error) {
+	resp, err := c.get(ctx, c.clientURL+"/tx/"+id.String())
 	if err != nil {
 		return iwallet.Transaction{}, err
 	}
@@ -229,6 +257,11 @@ func (c *BlockbookClient) IsBlockInMainChain(block iwallet.BlockInfo) (bool, err
 	return block.BlockID.String() == hash.Hash, nil
 }
 
+// GetMerkleProof is not supported as Blockbook doesn't serve merkle proofs.
+func (c *BlockbookClient) GetMerkleProof(id iwallet.TransactionID) (*base.MerkleProof, error) {
+	return nil, base.ErrMerkleProofUnsupported
+}
+
 func (c *BlockbookClient) SubscribeTransactions(addrs []iwallet.Address) (*base.TransactionSubscription, error) {
 	if atomic.LoadUint32(&c.started) == 0 {
 		return nil, errors.New("blockbook client not connected")
@@ -329,7 +362,16 @@ func (c *BlockbookClient) SubscribeBlocks() (*base.BlockSubscription, error) {
 }
 
 func (c *BlockbookClient) Broadcast(serializedTx []byte) error {
-	resp, err := c.client.Post(c.clientURL+"/sendtx/", "text/plain", bytes.NewReader([]byte(hex.EncodeToString(serializedTx))))
+	return c.BroadcastContext(context.Background(), serializedTx)
+}
+
+func (c *BlockbookClient) BroadcastContext(ctx context.Context, serializedTx []byte) error {
+	req, err := http.NewRequest(http.MethodPost, c.clientURL+"/sendtx/", bytes.NewReader([]byte(hex.EncodeToString(serializedTx))))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	resp, err := c.client.Do(req.WithContext(ctx))
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,658 @@
+package blockbook
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/cenkalti/backoff"
+	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/proxyclient"
+	iwallet "github.com/cpacia/wallet-interface"
+	"github.com/gcash/bchd/chaincfg/chainhash"
+	"github.com/gorilla/websocket"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WSSchemePrefix is prepended to a Blockbook server URL to select the
+// WebsocketClient, for example blockbook+wss://btc1.trezor.io.
+const WSSchemePrefix = "blockbook+"
+
+// wsPageSize is the number of transactions requested per page of address
+// history.
+const wsPageSize = 1000
+
+// IsWebsocketURL returns whether the ClientURL selects the WebsocketClient.
+func IsWebsocketURL(clientURL string) bool {
+	return strings.HasPrefix(clientURL, WSSchemePrefix)
+}
+
+// WebsocketClient is a ChainClient which uses the websocket interface of
+// Blockbook's v2 API. Unlike the socket.io interface used by BlockbookClient
+// it's served by Blockbook for every coin it supports, including Bitcoin
+// Cash, Dogecoin, Dash and Ethereum, so any coin module can use it and
+// operators only need to host a single indexer.
+type WebsocketClient struct {
+	client    *http.Client
+	wsURL     string
+	restURL   string
+	coinType  iwallet.CoinType
+	conn      *websocket.Conn
+	connMtx   sync.Mutex
+	writeMtx  sync.Mutex
+	requestID uint64
+	pending   map[string]chan wsResponse
+	pendMtx   sync.Mutex
+	subMtx    sync.Mutex
+	started   uint32
+	stopped   uint32
+	shutdown  chan struct{}
+	txSubs    map[int32]*transactionSub
+	blockSubs map[int32]*base.BlockSubscription
+
+	// blockSubID and addrSubID are the request IDs of the server side
+	// subscriptions. Notifications are sent with the same ID.
+	blockSubID string
+	addrSubID  string
+}
+
+// NewWebsocketClient returns a new WebsocketClient for the Blockbook server
+// at url, such as wss://btc1.trezor.io. The url may include the
+// WSSchemePrefix.
+func NewWebsocketClient(url string, coinType iwallet.CoinType) (*WebsocketClient, error) {
+	url = strings.TrimSuffix(strings.TrimPrefix(url, WSSchemePrefix), "/")
+	url = strings.TrimSuffix(url, "/websocket")
+
+	var restURL string
+	switch {
+	case strings.HasPrefix(url, "wss://"):
+		restURL = "https://" + strings.TrimPrefix(url, "wss://")
+	case strings.HasPrefix(url, "ws://"):
+		restURL = "http://" + strings.TrimPrefix(url, "ws://")
+	default:
+		return nil, errors.New("blockbook websocket url must use ws or wss")
+	}
+
+	httpClient := proxyclient.NewHttpClient()
+	httpClient.Timeout = RequestTimeout
+
+	return &WebsocketClient{
+		client:    httpClient,
+		wsURL:     url + "/websocket",
+		restURL:   restURL + "/api",
+		coinType:  coinType,
+		pending:   make(map[string]chan wsResponse),
+		shutdown:  make(chan struct{}),
+		txSubs:    make(map[int32]*transactionSub),
+		blockSubs: make(map[int32]*base.BlockSubscription),
+	}, nil
+}
+
+type wsRequest struct {
+	ID     string      `json:"id"`
+	Method string      `json:"method"`
+	Params interface{} `json:"params"`
+}
+
+type wsResponse struct {
+	ID   string          `json:"id"`
+	Data json.RawMessage `json:"data"`
+}
+
+// nextID returns a new request ID.
+func (c *WebsocketClient) nextID() string {
+	return strconv.FormatUint(atomic.AddUint64(&c.requestID, 1), 10)
+}
+
+// send writes a request without waiting for a response. If respChan is not
+// nil the response is delivered to it.
+func (c *WebsocketClient) send(id, method string, params interface{}, respChan chan wsResponse) error {
+	c.connMtx.Lock()
+	conn := c.conn
+	c.connMtx.Unlock()
+	if conn == nil {
+		return errors.New("blockbook client not connected")
+	}
+
+	if respChan != nil {
+		c.pendMtx.Lock()
+		c.pending[id] = respChan
+		c.pendMtx.Unlock()
+	}
+
+	c.writeMtx.Lock()
+	defer c.writeMtx.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(WsDefaultSendTimeout))
+	if err := conn.WriteJSON(&wsRequest{ID: id, Method: method, Params: params}); err != nil {
+		c.pendMtx.Lock()
+		delete(c.pending, id)
+		c.pendMtx.Unlock()
+		return err
+	}
+	return nil
+}
+
+// call makes a request and decodes the response data into result.
+func (c *WebsocketClient) call(method string, params interface{}, result interface{}) error {
+	respChan := make(chan wsResponse, 1)
+	id := c.nextID()
+	if err := c.send(id, method, params, respChan); err != nil {
+		return err
+	}
+	defer func() {
+		c.pendMtx.Lock()
+		delete(c.pending, id)
+		c.pendMtx.Unlock()
+	}()
+
+	select {
+	case resp := <-respChan:
+		var wsErr struct {
+			Error *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if json.Unmarshal(resp.Data, &wsErr) == nil && wsErr.Error != nil {
+			return errors.New(wsErr.Error.Message)
+		}
+		if result == nil {
+			return nil
+		}
+		return json.Unmarshal(resp.Data, result)
+	case <-time.After(RequestTimeout):
+		return errors.New("blockbook request timed out")
+	case <-c.shutdown:
+		return errors.New("blockbook client closed")
+	}
+}
+
+func (c *WebsocketClient) GetBlockchainInfo() (iwallet.BlockInfo, error) {
+	type Info struct {
+		Blockbook struct {
+			LastBlockTime time.Time `json:"lastBlockTime"`
+		} `json:"blockbook"`
+		Backend struct {
+			BestHeight uint64 `json:"blocks"`
+			BestHash   string `json:"bestBlockHash"`
+		} `json:"backend"`
+	}
+
+	// The block time isn't available over the websocket so the status
+	// is fetched from the REST interface.
+	resp, err := c.client.Get(c.restURL)
+	if err != nil {
+		return iwallet.BlockInfo{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return iwallet.BlockInfo{}, errors.New("incorrect status code")
+	}
+
+	var info Info
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return iwallet.BlockInfo{}, err
+	}
+
+	var prevHash struct {
+		Hash string `json:"hash"`
+	}
+	if info.Backend.BestHeight > 0 {
+		if err := c.call("getBlockHash", map[string]interface{}{"height": info.Backend.BestHeight - 1}, &prevHash); err != nil {
+			return iwallet.BlockInfo{}, err
+		}
+	}
+
+	return iwallet.BlockInfo{
+		Height:    info.Backend.BestHeight,
+		BlockID:   iwallet.BlockID(info.Backend.BestHash),
+		BlockTime: info.Blockbook.LastBlockTime,
+		PrevBlock: iwallet.BlockID(prevHash.Hash),
+	}, nil
+}
+
+func (c *WebsocketClient) GetAddressTransactions(addr iwallet.Address, fromHeight uint64) ([]iwallet.Transaction, error) {
+	var txs []iwallet.Transaction
+	for page := 1; ; page++ {
+		var account struct {
+			TotalPages   int             `json:"totalPages"`
+			Transactions []wsTransaction `json:"transactions"`
+		}
+		params := map[string]interface{}{
+			"descriptor": addr.String(),
+			"details":    "txs",
+			"page":       page,
+			"pageSize":   wsPageSize,
+			"from":       fromHeight,
+		}
+		if err := c.call("getAccountInfo", params, &account); err != nil {
+			return nil, err
+		}
+		for i := range account.Transactions {
+			tx, err := buildWSTransaction(&account.Transactions[i], c.coinType)
+			if err != nil {
+				return nil, err
+			}
+			txs = append(txs, tx)
+		}
+		if page >= account.TotalPages {
+			return txs, nil
+		}
+	}
+}
+
+func (c *WebsocketClient) GetTransaction(id iwallet.TransactionID) (iwallet.Transaction, error) {
+	var tx wsTransaction
+	if err := c.call("getTransaction", map[string]interface{}{"txid": id.String()}, &tx); err != nil {
+		return iwallet.Transaction{}, err
+	}
+	return buildWSTransaction(&tx, c.coinType)
+}
+
+func (c *WebsocketClient) IsBlockInMainChain(block iwallet.BlockInfo) (bool, error) {
+	var hash struct {
+		Hash string `json:"hash"`
+	}
+	if err := c.call("getBlockHash", map[string]interface{}{"height": block.Height}, &hash); err != nil {
+		return false, err
+	}
+	return block.BlockID.String() == hash.Hash, nil
+}
+
+// GetMerkleProof is not supported as Blockbook doesn't serve merkle proofs.
+func (c *WebsocketClient) GetMerkleProof(id iwallet.TransactionID) (*base.MerkleProof, error) {
+	return nil, base.ErrMerkleProofUnsupported
+}
+
+func (c *WebsocketClient) SubscribeTransactions(addrs []iwallet.Address) (*base.TransactionSubscription, error) {
+	if atomic.LoadUint32(&c.started) == 0 {
+		return nil, errors.New("blockbook client not connected")
+	}
+
+	sub := &base.TransactionSubscription{
+		Out:         make(chan iwallet.Transaction),
+		Subscribe:   make(chan []iwallet.Address),
+		Unsubscribe: make(chan []iwallet.Address),
+	}
+
+	addrMap := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		addrMap[addr.String()] = true
+	}
+
+	c.subMtx.Lock()
+	id := rand.Int31()
+	c.txSubs[id] = &transactionSub{
+		sub:   sub,
+		addrs: addrMap,
+	}
+	c.subMtx.Unlock()
+
+	if err := c.subscribeAddresses(); err != nil {
+		c.subMtx.Lock()
+		delete(c.txSubs, id)
+		c.subMtx.Unlock()
+		return nil, err
+	}
+
+	subClose := make(chan struct{})
+
+	sub.Close = func() {
+		close(subClose)
+		c.subMtx.Lock()
+		delete(c.txSubs, id)
+		c.subMtx.Unlock()
+		close(sub.Out)
+	}
+
+	go func() {
+		for {
+			select {
+			case <-subClose:
+				return
+			case <-c.shutdown:
+				return
+			case addrs := <-sub.Subscribe:
+				c.subMtx.Lock()
+				for _, addr := range addrs {
+					addrMap[addr.String()] = true
+				}
+				c.subMtx.Unlock()
+				c.subscribeAddresses()
+			case addrs := <-sub.Unsubscribe:
+				c.subMtx.Lock()
+				for _, addr := range addrs {
+					delete(addrMap, addr.String())
+				}
+				c.subMtx.Unlock()
+				c.subscribeAddresses()
+			}
+		}
+	}()
+
+	return sub, nil
+}
+
+// subscribeAddresses replaces the server side address subscription with the
+// addresses of all subscriptions.
+func (c *WebsocketClient) subscribeAddresses() error {
+	c.subMtx.Lock()
+	var addrs []string
+	for _, sub := range c.txSubs {
+		for addr := range sub.addrs {
+			addrs = append(addrs, addr)
+		}
+	}
+	id := c.nextID()
+	c.addrSubID = id
+	c.subMtx.Unlock()
+
+	return c.send(id, "subscribeAddresses", map[string]interface{}{"addresses": addrs}, nil)
+}
+
+func (c *WebsocketClient) SubscribeBlocks() (*base.BlockSubscription, error) {
+	if atomic.LoadUint32(&c.started) == 0 {
+		return nil, errors.New("blockbook client not connected")
+	}
+
+	c.subMtx.Lock()
+	defer c.subMtx.Unlock()
+
+	sub := &base.BlockSubscription{
+		Out: make(chan iwallet.BlockInfo),
+	}
+
+	id := rand.Int31()
+	c.blockSubs[id] = sub
+
+	sub.Close = func() {
+		c.subMtx.Lock()
+		delete(c.blockSubs, id)
+		c.subMtx.Unlock()
+		close(sub.Out)
+	}
+	return sub, nil
+}
+
+func (c *WebsocketClient) Broadcast(serializedTx []byte) error {
+	return c.call("sendTransaction", map[string]interface{}{"hex": fmt.Sprintf("%x", serializedTx)}, nil)
+}
+
+// Open connects to the server and subscribes to new blocks and to the
+// addresses of any existing subscriptions.
+func (c *WebsocketClient) Open() error {
+	dialer := websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: RequestTimeout,
+		ReadBufferSize:   WsDefaultBufferSize,
+		WriteBufferSize:  WsDefaultBufferSize,
+	}
+	conn, _, err := dialer.Dial(c.wsURL, nil)
+	if err != nil {
+		return err
+	}
+
+	c.connMtx.Lock()
+	c.conn = conn
+	c.connMtx.Unlock()
+	go c.readHandler(conn)
+
+	// The subscription IDs are set before the requests are sent so that
+	// the read handler recognizes the first notification.
+	c.subMtx.Lock()
+	id := c.nextID()
+	c.blockSubID = id
+	resubscribe := len(c.txSubs) > 0
+	c.subMtx.Unlock()
+
+	if err := c.send(id, "subscribeNewBlock", map[string]interface{}{}, nil); err != nil {
+		conn.Close()
+		return err
+	}
+
+	if resubscribe {
+		if err := c.subscribeAddresses(); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+
+	atomic.StoreUint32(&c.started, 1)
+	return nil
+}
+
+func (c *WebsocketClient) Close() error {
+	c.subMtx.Lock()
+	defer c.subMtx.Unlock()
+
+	close(c.shutdown)
+	atomic.AddUint32(&c.stopped, 1)
+	c.connMtx.Lock()
+	defer c.connMtx.Unlock()
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	return nil
+}
+
+// readHandler routes responses to their callers and notifications to the
+// subscriptions. If the connection drops it reconnects unless the client
+// was closed.
+func (c *WebsocketClient) readHandler(conn *websocket.Conn) {
+	for {
+		var resp wsResponse
+		if err := conn.ReadJSON(&resp); err != nil {
+			conn.Close()
+			if atomic.LoadUint32(&c.started) == 1 && atomic.LoadUint32(&c.stopped) == 0 {
+				backoff.Retry(func() error {
+					if atomic.LoadUint32(&c.stopped) > 0 {
+						return nil
+					}
+					return c.Open()
+				}, backoff.NewExponentialBackOff())
+			}
+			return
+		}
+
+		c.subMtx.Lock()
+		blockSubID, addrSubID := c.blockSubID, c.addrSubID
+		c.subMtx.Unlock()
+
+		switch resp.ID {
+		case blockSubID:
+			c.notifyBlock()
+		case addrSubID:
+			var notification struct {
+				Tx *wsTransaction `json:"tx"`
+			}
+			if err := json.Unmarshal(resp.Data, &notification); err != nil || notification.Tx == nil {
+				continue
+			}
+			tx, err := buildWSTransaction(notification.Tx, c.coinType)
+			if err != nil {
+				continue
+			}
+			go c.notifyTransaction(tx)
+		default:
+			c.pendMtx.Lock()
+			ch, ok := c.pending[resp.ID]
+			c.pendMtx.Unlock()
+			if ok {
+				ch <- resp
+			}
+		}
+	}
+}
+
+func (c *WebsocketClient) notifyBlock() {
+	go func() {
+		info, err := c.GetBlockchainInfo()
+		if err != nil {
+			return
+		}
+		c.subMtx.Lock()
+		for _, sub := range c.blockSubs {
+			sub.Out <- info
+		}
+		c.subMtx.Unlock()
+	}()
+}
+
+func (c *WebsocketClient) notifyTransaction(tx iwallet.Transaction) {
+	c.subMtx.Lock()
+	defer c.subMtx.Unlock()
+	for _, sub := range c.txSubs {
+		matches := false
+		for _, from := range tx.From {
+			if sub.addrs[from.Address.String()] {
+				matches = true
+				break
+			}
+		}
+		for _, to := range tx.To {
+			if sub.addrs[to.Address.String()] {
+				matches = true
+				break
+			}
+		}
+		if matches {
+			sub.sub.Out <- tx
+		}
+	}
+}
+
+// wsTransaction is a transaction in the v2 API format. Values are strings
+// in the coin's base unit so they can hold Ethereum amounts.
+type wsTransaction struct {
+	Txid string `json:"txid"`
+	Vin  []struct {
+		Txid      string   `json:"txid"`
+		Vout      uint32   `json:"vout"`
+		Coinbase  string   `json:"coinbase"`
+		Addresses []string `json:"addresses"`
+		Value     string   `json:"value"`
+	} `json:"vin"`
+	Vout []struct {
+		N         uint32   `json:"n"`
+		Value     string   `json:"value"`
+		Addresses []string `json:"addresses"`
+	} `json:"vout"`
+	BlockHash   string `json:"blockHash"`
+	BlockHeight int64  `json:"blockHeight"`
+	BlockTime   int64  `json:"blockTime"`
+	Value       string `json:"value"`
+
+	// EthereumSpecific is only set for Ethereum transactions.
+	EthereumSpecific *struct {
+		Status int `json:"status"`
+	} `json:"ethereumSpecific"`
+}
+
+func buildWSTransaction(transaction *wsTransaction, ct iwallet.CoinType) (iwallet.Transaction, error) {
+	tx := iwallet.Transaction{
+		ID:        iwallet.TransactionID(transaction.Txid),
+		Timestamp: time.Unix(transaction.BlockTime, 0),
+	}
+	if transaction.BlockHeight > 0 && transaction.BlockHash != "" {
+		tx.Height = uint64(transaction.BlockHeight)
+		tx.BlockInfo = &iwallet.BlockInfo{
+			Height:    uint64(transaction.BlockHeight),
+			BlockID:   iwallet.BlockID(transaction.BlockHash),
+			BlockTime: time.Unix(transaction.BlockTime, 0),
+		}
+	}
+
+	// Ethereum transactions are account based. Blockbook reports the
+	// sender as the only input and the recipient as the only output.
+	if transaction.EthereumSpecific != nil {
+		amount := iwallet.NewAmount(transaction.Value)
+		for _, in := range transaction.Vin {
+			if len(in.Addresses) > 0 {
+				tx.From = append(tx.From, iwallet.SpendInfo{
+					Address: iwallet.NewAddress(in.Addresses[0], ct),
+					Amount:  amount,
+				})
+			}
+		}
+		for _, out := range transaction.Vout {
+			if len(out.Addresses) > 0 {
+				tx.To = append(tx.To, iwallet.SpendInfo{
+					Address: iwallet.NewAddress(out.Addresses[0], ct),
+					Amount:  amount,
+				})
+			}
+		}
+		return tx, nil
+	}
+
+	for _, in := range transaction.Vin {
+		if in.Coinbase != "" {
+			tx.From = append(tx.From, iwallet.SpendInfo{
+				ID:     append(make([]byte, 32), 0xff, 0xff, 0xff, 0xff),
+				Amount: iwallet.NewAmount(0),
+			})
+			continue
+		}
+		prevHash, err := chainhash.NewHashFromStr(in.Txid)
+		if err != nil {
+			return tx, err
+		}
+		id := make([]byte, 36)
+		copy(id[:32], prevHash[:])
+		binary.LittleEndian.PutUint32(id[32:], in.Vout)
+
+		from := iwallet.SpendInfo{
+			ID:     id,
+			Amount: iwallet.NewAmount(valueOrZero(in.Value)),
+		}
+		if len(in.Addresses) > 0 {
+			from.Address = iwallet.NewAddress(normalizeAddress(in.Addresses[0], ct), ct)
+		}
+		tx.From = append(tx.From, from)
+	}
+
+	txidHash, err := chainhash.NewHashFromStr(transaction.Txid)
+	if err != nil {
+		return tx, err
+	}
+	for _, out := range transaction.Vout {
+		id := make([]byte, 36)
+		copy(id[:32], txidHash[:])
+		binary.LittleEndian.PutUint32(id[32:], out.N)
+
+		to := iwallet.SpendInfo{
+			ID:     id,
+			Amount: iwallet.NewAmount(valueOrZero(out.Value)),
+		}
+		if len(out.Addresses) > 0 {
+			to.Address = iwallet.NewAddress(normalizeAddress(out.Addresses[0], ct), ct)
+		}
+		tx.To = append(tx.To, to)
+	}
+	return tx, nil
+}
+
+func valueOrZero(value string) string {
+	if value == "" {
+		return "0"
+	}
+	return value
+}
+
+// normalizeAddress converts an address returned by Blockbook to the format
+// used by the coin module. Bitcoin Cash modules use cashaddr without the
+// prefix.
+func normalizeAddress(addr string, ct iwallet.CoinType) string {
+	if ct == iwallet.CtBitcoinCash {
+		if i := strings.Index(addr, ":"); i >= 0 {
+			return addr[i+1:]
+		}
+	}
+	return addr
+}
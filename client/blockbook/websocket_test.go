@@ -0,0 +1,218 @@
+package blockbook
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	iwallet "github.com/cpacia/wallet-interface"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type wsHandler func(params map[string]interface{}) interface{}
+
+// newTestWSServer returns a Blockbook server which answers websocket
+// requests with the handlers. Requests to methods without a handler are
+// answered after a new block notification is sent.
+func newTestWSServer(t *testing.T, handlers map[string]wsHandler) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api" {
+			w.Write([]byte(`{"blockbook": {"lastBlockTime": "2019-12-27T03:48:06.17252601Z"}, "backend": {"blocks": 100000, "bestBlockHash": "000000000000000000059db7d02e5a408dea5a55a44276fa89551749103590fa"}}`))
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		for {
+			var req struct {
+				ID     string                 `json:"id"`
+				Method string                 `json:"method"`
+				Params map[string]interface{} `json:"params"`
+			}
+			if err := conn.ReadJSON(&req); err != nil {
+				return
+			}
+			var data interface{} = map[string]interface{}{"subscribed": true}
+			if handler, ok := handlers[req.Method]; ok {
+				data = handler(req.Params)
+			}
+			if err := conn.WriteJSON(map[string]interface{}{"id": req.ID, "data": data}); err != nil {
+				return
+			}
+			if req.Method == "subscribeNewBlock" && handlers["notifyBlock"] != nil {
+				conn.WriteJSON(map[string]interface{}{"id": req.ID, "data": map[string]interface{}{"height": 100000}})
+			}
+		}
+	}))
+}
+
+func newTestWSClient(t *testing.T, server *httptest.Server, ct iwallet.CoinType) *WebsocketClient {
+	client, err := NewWebsocketClient(WSSchemePrefix+strings.Replace(server.URL, "http://", "ws://", 1), ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Open(); err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestWebsocketClient_GetBlockchainInfo(t *testing.T) {
+	server := newTestWSServer(t, map[string]wsHandler{
+		"getBlockHash": func(params map[string]interface{}) interface{} {
+			if params["height"].(float64) != 99999 {
+				t.Errorf("Expected height 99999, got %v", params["height"])
+			}
+			return map[string]interface{}{"hash": "00000000000000000003657bf1583f9f9ef196cb80bb3c72aeecbb22f3c581c4"}
+		},
+	})
+	defer server.Close()
+
+	client := newTestWSClient(t, server, iwallet.CtBitcoin)
+	defer client.Close()
+
+	info, err := client.GetBlockchainInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Height != 100000 {
+		t.Errorf("Expected height 100000, got %d", info.Height)
+	}
+	if info.BlockID.String() != "000000000000000000059db7d02e5a408dea5a55a44276fa89551749103590fa" {
+		t.Errorf("Incorrect block ID %s", info.BlockID)
+	}
+	if info.PrevBlock.String() != "00000000000000000003657bf1583f9f9ef196cb80bb3c72aeecbb22f3c581c4" {
+		t.Errorf("Incorrect prev block ID %s", info.PrevBlock)
+	}
+	if info.BlockTime.Unix() != 1577418486 {
+		t.Errorf("Expected time 1577418486, got %d", info.BlockTime.Unix())
+	}
+}
+
+func TestWebsocketClient_GetTransaction(t *testing.T) {
+	server := newTestWSServer(t, map[string]wsHandler{
+		"getTransaction": func(params map[string]interface{}) interface{} {
+			var tx interface{}
+			json.Unmarshal([]byte(`{"txid":"2a4cfac4cb8a322a31ac683bf6f2f05b6a5a1788af4e23a6a91a25fc7d891ce0","vin":[{"txid":"88e9d70258ddcec90be40aa90990aadf6829f00cbd94643e084790ed6c57531a","vout":32,"addresses":["bitcoincash:qpm2qsznhks23z7629mms6s4cwef74vcwvy22gdx6a"],"value":"281414000"}],"vout":[{"value":"87253600","n":0,"addresses":["bitcoincash:qr95sy3j9xwd2ap32xkykttr4cvcu7as4y0qverfuy"]},{"value":"194110000","n":1,"addresses":["bitcoincash:qqq3728yw0y47sqn6l2na30mcw6zm78dzqre909m2r"]}],"blockHash":"00000000000000000003657bf1583f9f9ef196cb80bb3c72aeecbb22f3c581c4","blockHeight":609951,"blockTime":1577417904,"value":"281363600"}`), &tx)
+			return tx
+		},
+	})
+	defer server.Close()
+
+	client := newTestWSClient(t, server, iwallet.CtBitcoinCash)
+	defer client.Close()
+
+	tx, err := client.GetTransaction(iwallet.TransactionID("2a4cfac4cb8a322a31ac683bf6f2f05b6a5a1788af4e23a6a91a25fc7d891ce0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tx.Height != 609951 || tx.BlockInfo == nil {
+		t.Fatalf("Expected height 609951, got %d", tx.Height)
+	}
+	if len(tx.From) != 1 {
+		t.Fatalf("Expected 1 input got %d", len(tx.From))
+	}
+	if tx.From[0].Address.String() != "qpm2qsznhks23z7629mms6s4cwef74vcwvy22gdx6a" {
+		t.Errorf("Expected from address without prefix, got %s", tx.From[0].Address)
+	}
+	if tx.From[0].Amount.String() != "281414000" {
+		t.Errorf("Expected from amount 281414000, got %s", tx.From[0].Amount)
+	}
+	expectedFromID := "1a53576ced9047083e6494bd0cf02968dfaa9009a90ae40bc9cedd5802d7e98820000000"
+	if hex.EncodeToString(tx.From[0].ID) != expectedFromID {
+		t.Errorf("Expected from ID %s, got %s", expectedFromID, hex.EncodeToString(tx.From[0].ID))
+	}
+	if len(tx.To) != 2 {
+		t.Fatalf("Expected 2 outputs got %d", len(tx.To))
+	}
+	if tx.To[1].Amount.String() != "194110000" {
+		t.Errorf("Expected to amount 194110000, got %s", tx.To[1].Amount)
+	}
+	expectedToID := "e01c897dfc251aa9a6234eaf88175a6a5bf0f2f63b68ac312a328acbc4fa4c2a01000000"
+	if hex.EncodeToString(tx.To[1].ID) != expectedToID {
+		t.Errorf("Expected to ID %s, got %s", expectedToID, hex.EncodeToString(tx.To[1].ID))
+	}
+}
+
+func TestWebsocketClient_GetAddressTransactions(t *testing.T) {
+	server := newTestWSServer(t, map[string]wsHandler{
+		"getAccountInfo": func(params map[string]interface{}) interface{} {
+			page := int(params["page"].(float64))
+			return map[string]interface{}{
+				"totalPages": 2,
+				"transactions": []interface{}{
+					map[string]interface{}{
+						"txid":             strings.Repeat("0", 63) + string(rune('0'+page)),
+						"vin":              []interface{}{map[string]interface{}{"addresses": []string{"0xabc"}}},
+						"vout":             []interface{}{map[string]interface{}{"addresses": []string{"0xdef"}}},
+						"blockHeight":      -1,
+						"value":            "1000000000000000000",
+						"ethereumSpecific": map[string]interface{}{"status": -1},
+					},
+				},
+			}
+		},
+	})
+	defer server.Close()
+
+	client := newTestWSClient(t, server, iwallet.CtEthereum)
+	defer client.Close()
+
+	txs, err := client.GetAddressTransactions(iwallet.NewAddress("0xabc", iwallet.CtEthereum), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txs) != 2 {
+		t.Fatalf("Expected 2 transactions, got %d", len(txs))
+	}
+	for _, tx := range txs {
+		if tx.Height != 0 || tx.BlockInfo != nil {
+			t.Errorf("Expected unconfirmed transaction, got height %d", tx.Height)
+		}
+		if len(tx.To) != 1 || tx.To[0].Address.String() != "0xdef" || tx.To[0].Amount.String() != "1000000000000000000" {
+			t.Errorf("Incorrect outputs %v", tx.To)
+		}
+	}
+}
+
+func TestWebsocketClient_SubscribeBlocks(t *testing.T) {
+	server := newTestWSServer(t, map[string]wsHandler{
+		"notifyBlock": func(params map[string]interface{}) interface{} { return nil },
+		"getBlockHash": func(params map[string]interface{}) interface{} {
+			return map[string]interface{}{"hash": "00000000000000000003657bf1583f9f9ef196cb80bb3c72aeecbb22f3c581c4"}
+		},
+	})
+	defer server.Close()
+
+	client, err := NewWebsocketClient(WSSchemePrefix+strings.Replace(server.URL, "http://", "ws://", 1), iwallet.CtBitcoin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Subscribe before the notification is processed.
+	client.started = 1
+	sub, err := client.SubscribeBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	select {
+	case info := <-sub.Out:
+		if info.Height != 100000 {
+			t.Errorf("Expected height 100000, got %d", info.Height)
+		}
+	case <-time.After(time.Second * 10):
+		t.Fatal("Timed out waiting for block")
+	}
+}
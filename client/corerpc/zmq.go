@@ -0,0 +1,165 @@
+package corerpc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+)
+
+const (
+	zmtpFlagMore    = 0x01
+	zmtpFlagLong    = 0x02
+	zmtpFlagCommand = 0x04
+)
+
+// zmqSubscriber is a minimal ZMTP 3.0 SUB socket. It only implements what is
+// needed to read bitcoind's notifications: a single TCP peer using the NULL
+// security mechanism.
+type zmqSubscriber struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// dialZMQ connects to a ZMQ PUB socket at an address such as
+// tcp://127.0.0.1:28332 and subscribes to the topics.
+func dialZMQ(addr string, topics ...string) (*zmqSubscriber, error) {
+	conn, err := net.DialTimeout("tcp", strings.TrimPrefix(addr, "tcp://"), RequestTimeout)
+	if err != nil {
+		return nil, err
+	}
+	s := &zmqSubscriber{conn: conn, r: bufio.NewReader(conn)}
+	if err := s.handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	for _, topic := range topics {
+		// ZMTP 3.0 sends subscriptions as messages starting with 0x01.
+		if err := s.writeFrame(0, append([]byte{0x01}, topic...)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// handshake exchanges greetings and READY commands with the publisher.
+func (s *zmqSubscriber) handshake() error {
+	greeting := make([]byte, 64)
+	greeting[0] = 0xff
+	greeting[9] = 0x7f
+	greeting[10] = 3
+	copy(greeting[12:32], "NULL")
+	if _, err := s.conn.Write(greeting); err != nil {
+		return err
+	}
+
+	peer := make([]byte, 64)
+	if _, err := io.ReadFull(s.r, peer); err != nil {
+		return err
+	}
+	if peer[0] != 0xff || peer[9]&0x01 == 0 || peer[10] < 3 {
+		return errors.New("zmq peer does not support ZMTP 3")
+	}
+	if string(bytes.TrimRight(peer[12:32], "\x00")) != "NULL" {
+		return errors.New("zmq peer requires an unsupported security mechanism")
+	}
+
+	ready := []byte{5}
+	ready = append(ready, "READY"...)
+	ready = append(ready, zmtpProperty("Socket-Type", "SUB")...)
+	if err := s.writeFrame(zmtpFlagCommand, ready); err != nil {
+		return err
+	}
+
+	flags, body, err := s.readFrame()
+	if err != nil {
+		return err
+	}
+	if flags&zmtpFlagCommand == 0 || len(body) < 6 || string(body[1:6]) != "READY" {
+		return errors.New("zmq peer did not send READY")
+	}
+	return nil
+}
+
+// readMessage returns the frames of the next message. Commands received
+// between messages are ignored.
+func (s *zmqSubscriber) readMessage() ([][]byte, error) {
+	var frames [][]byte
+	for {
+		flags, body, err := s.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		if flags&zmtpFlagCommand != 0 {
+			continue
+		}
+		frames = append(frames, body)
+		if flags&zmtpFlagMore == 0 {
+			return frames, nil
+		}
+	}
+}
+
+func (s *zmqSubscriber) readFrame() (byte, []byte, error) {
+	flags, err := s.r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	var size uint64
+	if flags&zmtpFlagLong != 0 {
+		b := make([]byte, 8)
+		if _, err := io.ReadFull(s.r, b); err != nil {
+			return 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(b)
+	} else {
+		b, err := s.r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		size = uint64(b)
+	}
+	if size > maxZMQFrameSize {
+		return 0, nil, errors.New("zmq frame too large")
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(s.r, body); err != nil {
+		return 0, nil, err
+	}
+	return flags, body, nil
+}
+
+func (s *zmqSubscriber) writeFrame(flags byte, body []byte) error {
+	var header []byte
+	if len(body) > 255 {
+		header = make([]byte, 9)
+		header[0] = flags | zmtpFlagLong
+		binary.BigEndian.PutUint64(header[1:], uint64(len(body)))
+	} else {
+		header = []byte{flags, byte(len(body))}
+	}
+	_, err := s.conn.Write(append(header, body...))
+	return err
+}
+
+func (s *zmqSubscriber) Close() error {
+	return s.conn.Close()
+}
+
+// maxZMQFrameSize bounds the memory used by a single frame. It's larger than
+// the biggest transaction or block hash bitcoind will publish.
+const maxZMQFrameSize = 4000000
+
+// zmtpProperty encodes a metadata property for a READY command.
+func zmtpProperty(name, value string) []byte {
+	b := []byte{byte(len(name))}
+	b = append(b, name...)
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(len(value)))
+	b = append(b, size...)
+	return append(b, value...)
+}
@@ -0,0 +1,841 @@
+package esplora
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/proxyclient"
+	iwallet "github.com/cpacia/wallet-interface"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const RequestTimeout = time.Second * 30
+
+// SchemePrefix is prepended to an Esplora API URL to select this client,
+// for example esplora+https://blockstream.info/api.
+const SchemePrefix = "esplora+"
+
+// DefaultPollInterval is how often the client checks for new blocks and
+// transactions. Esplora has no push interface so subscriptions are
+// implemented by polling.
+const DefaultPollInterval = time.Second * 30
+
+// confirmedPageSize is the number of confirmed transactions Esplora returns
+// per page of address history.
+const confirmedPageSize = 25
+
+// blockTxsPageSize is the number of transactions Esplora returns per page
+// of a block's transactions.
+const blockTxsPageSize = 25
+
+// feeTargets maps fee levels to the confirmation target, in blocks, used to
+// look up the fee estimate.
+var feeTargets = map[iwallet.FeeLevel]string{
+	iwallet.FlPriority:      "1",
+	iwallet.FlNormal:        "6",
+	iwallet.FlEconomic:      "24",
+	iwallet.FLSuperEconomic: "144",
+}
+
+// IsEsploraURL returns whether the ClientURL selects this client.
+func IsEsploraURL(clientURL string) bool {
+	return strings.HasPrefix(clientURL, SchemePrefix)
+}
+
+type transactionSub struct {
+	sub   *base.TransactionSubscription
+	addrs map[string]bool
+}
+
+// EsploraClient is a ChainClient which uses the Esplora REST API run by
+// Blockstream. It works with any Esplora instance, including Bitcoin
+// testnet and Liquid.
+type EsploraClient struct { // nolint
+	client       *http.Client
+	clientURL    string
+	coinType     iwallet.CoinType
+	pollInterval time.Duration
+	subMtx       sync.Mutex
+	started      uint32
+	shutdown     chan struct{}
+	txSubs       map[int32]*transactionSub
+	blockSubs    map[int32]*base.BlockSubscription
+
+	// txCounts holds the last seen transaction count of each subscribed
+	// address so only addresses with new activity are fetched.
+	txCounts map[string]int
+	seenTxs  map[string]bool
+}
+
+// NewEsploraClient returns a new EsploraClient for the API at url. The url
+// may include the SchemePrefix.
+func NewEsploraClient(url string, coinType iwallet.CoinType) (*EsploraClient, error) {
+	url = strings.TrimSuffix(strings.TrimPrefix(url, SchemePrefix), "/")
+	if !strings.HasPrefix(url, "http") {
+		return nil, errors.New("esplora url must use http or https")
+	}
+
+	httpClient := proxyclient.NewHttpClient()
+	httpClient.Timeout = RequestTimeout
+
+	return &EsploraClient{
+		client:       httpClient,
+		clientURL:    url,
+		coinType:     coinType,
+		pollInterval: DefaultPollInterval,
+		shutdown:     make(chan struct{}),
+		txSubs:       make(map[int32]*transactionSub),
+		blockSubs:    make(map[int32]*base.BlockSubscription),
+		txCounts:     make(map[string]int),
+		seenTxs:      make(map[string]bool),
+	}, nil
+}
+
+// get makes a GET request to the API and decodes the JSON response into
+// result.
+func (c *EsploraClient) get(path string, result interface{}) error {
+	return c.getContext(context.Background(), path, result)
+}
+
+// getContext is get with a request bound to ctx.
+func (c *EsploraClient) getContext(ctx context.Context, path string, result interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, c.clientURL+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("incorrect status code %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// getText makes a GET request to the API and returns the plain text
+// response.
+func (c *EsploraClient) getText(path string) (string, error) {
+	return c.getTextContext(context.Background(), path)
+}
+
+// getTextContext is getText with a request bound to ctx.
+func (c *EsploraClient) getTextContext(ctx context.Context, path string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, c.clientURL+path, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("incorrect status code %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+type block struct {
+	ID                string `json:"id"`
+	Height            uint64 `json:"height"`
+	Timestamp         int64  `json:"timestamp"`
+	PreviousBlockHash string `json:"previousblockhash"`
+}
+
+func (c *EsploraClient) GetBlockchainInfo() (iwallet.BlockInfo, error) {
+	return c.GetBlockchainInfoContext(context.Background())
+}
+
+func (c *EsploraClient) GetBlockchainInfoContext(ctx context.Context) (iwallet.BlockInfo, error) {
+	hash, err := c.getTextContext(ctx, "/blocks/tip/hash")
+	if err != nil {
+		return iwallet.BlockInfo{}, err
+	}
+	var blk block
+	if err := c.getContext(ctx, "/block/"+hash, &blk); err != nil {
+		return iwallet.BlockInfo{}, err
+	}
+	return iwallet.BlockInfo{
+		Height:    blk.Height,
+		BlockID:   iwallet.BlockID(blk.ID),
+		BlockTime: time.Unix(blk.Timestamp, 0),
+		PrevBlock: iwallet.BlockID(blk.PreviousBlockHash),
+	}, nil
+}
+
+func (c *EsploraClient) GetAddressTransactions(addr iwallet.Address, fromHeight uint64) ([]iwallet.Transaction, error) {
+	return c.GetAddressTransactionsContext(context.Background(), addr, fromHeight)
+}
+
+func (c *EsploraClient) GetAddressTransactionsContext(ctx context.Context, addr iwallet.Address, fromHeight uint64) ([]iwallet.Transaction, error) {
+	// The first page holds up to 50 mempool transactions followed by
+	// the newest confirmed transactions. Later pages are confirmed
+	// transactions only, newest first.
+	var page []transaction
+	if err := c.getContext(ctx, "/address/"+addr.String()+"/txs", &page); err != nil {
+		return nil, err
+	}
+
+	var txs []iwallet.Transaction
+	for {
+		confirmed := 0
+		for i := range page {
+			if page[i].Status.Confirmed {
+				confirmed++
+				if page[i].Status.BlockHeight < fromHeight {
+					return txs, nil
+				}
+			}
+			tx, err := buildTransaction(&page[i], c.coinType)
+			if err != nil {
+				return nil, err
+			}
+			txs = append(txs, tx)
+		}
+		if confirmed < confirmedPageSize {
+			return txs, nil
+		}
+		lastSeen := page[len(page)-1].Txid
+		page = nil
+		if err := c.getContext(ctx, "/address/"+addr.String()+"/txs/chain/"+lastSeen, &page); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (c *EsploraClient) GetTransaction(id iwallet.TransactionID) (iwallet.Transaction, error) {
+	return c.GetTransactionContext(context.Background(), id)
+}
+
+func (c *EsploraClient) GetTransactionContext(ctx context.Context, id iwallet.TransactionID) (iwallet.Transaction, error) {
+	var tx transaction
+	if err := c.getContext(ctx, "/tx/"+id.String(), &tx); err != nil {
+		return iwallet.Transaction{}, err
+	}
+	return buildTransaction(&tx, c.coinType)
+}
+
+// GetRawTransaction returns the serialized transaction.
+func (c *EsploraClient) GetRawTransaction(id iwallet.TransactionID) ([]byte, error) {
+	h, err := c.getText("/tx/" + id.String() + "/hex")
+	if err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(strings.TrimSpace(h))
+}
+
+func (c *EsploraClient) IsBlockInMainChain(block iwallet.BlockInfo) (bool, error) {
+	var status struct {
+		InBestChain bool `json:"in_best_chain"`
+	}
+	resp, err := c.client.Get(c.clientURL + "/block/" + block.BlockID.String() + "/status")
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	} else if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("incorrect status code %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return false, err
+	}
+	return status.InBestChain, nil
+}
+
+func (c *EsploraClient) GetMerkleProof(id iwallet.TransactionID) (*base.MerkleProof, error) {
+	var resp struct {
+		BlockHeight uint64   `json:"block_height"`
+		Merkle      []string `json:"merkle"`
+		Pos         uint32   `json:"pos"`
+	}
+	if err := c.get("/tx/"+id.String()+"/merkle-proof", &resp); err != nil {
+		return nil, err
+	}
+	proof := &base.MerkleProof{
+		Height: resp.BlockHeight,
+		Index:  resp.Pos,
+		Branch: make([]chainhash.Hash, 0, len(resp.Merkle)),
+	}
+	for _, h := range resp.Merkle {
+		hash, err := chainhash.NewHashFromStr(h)
+		if err != nil {
+			return nil, err
+		}
+		proof.Branch = append(proof.Branch, *hash)
+	}
+	return proof, nil
+}
+
+// headerBlock is a block as returned by the /blocks endpoint which has
+// all the fields of its header.
+type headerBlock struct {
+	ID                string `json:"id"`
+	Height            uint64 `json:"height"`
+	Version           int32  `json:"version"`
+	Timestamp         int64  `json:"timestamp"`
+	Bits              uint32 `json:"bits"`
+	Nonce             uint32 `json:"nonce"`
+	MerkleRoot        string `json:"merkle_root"`
+	PreviousBlockHash string `json:"previousblockhash"`
+}
+
+// GetBlockHeaders builds the headers from the /blocks endpoint, which
+// returns ten blocks at a time counting down from a height.
+func (c *EsploraClient) GetBlockHeaders(fromHeight uint64, count int) ([]wire.BlockHeader, error) {
+	tip, err := c.getText("/blocks/tip/height")
+	if err != nil {
+		return nil, err
+	}
+	tipHeight, err := strconv.ParseUint(tip, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	if fromHeight > tipHeight {
+		return nil, nil
+	}
+	last := fromHeight + uint64(count) - 1
+	if last > tipHeight {
+		last = tipHeight
+	}
+
+	headers := make([]wire.BlockHeader, last-fromHeight+1)
+	for height := last; ; {
+		var blocks []headerBlock
+		if err := c.get("/blocks/"+strconv.FormatUint(height, 10), &blocks); err != nil {
+			return nil, err
+		}
+		if len(blocks) == 0 {
+			return nil, errors.New("no blocks returned")
+		}
+		for _, blk := range blocks {
+			if blk.Height < fromHeight || blk.Height > last {
+				continue
+			}
+			header := wire.BlockHeader{
+				Version:   blk.Version,
+				Timestamp: time.Unix(blk.Timestamp, 0),
+				Bits:      blk.Bits,
+				Nonce:     blk.Nonce,
+			}
+			merkleRoot, err := chainhash.NewHashFromStr(blk.MerkleRoot)
+			if err != nil {
+				return nil, err
+			}
+			header.MerkleRoot = *merkleRoot
+			if blk.PreviousBlockHash != "" {
+				prev, err := chainhash.NewHashFromStr(blk.PreviousBlockHash)
+				if err != nil {
+					return nil, err
+				}
+				header.PrevBlock = *prev
+			}
+			if header.BlockHash().String() != blk.ID {
+				return nil, fmt.Errorf("header for block %s does not hash to its id", blk.ID)
+			}
+			headers[blk.Height-fromHeight] = header
+		}
+		lowest := blocks[len(blocks)-1].Height
+		if lowest <= fromHeight {
+			return headers, nil
+		}
+		height = lowest - 1
+	}
+}
+
+// GetBlockScanTransactions returns the transactions of the block at height
+// with the scripts they spend. Esplora serves a block's transactions
+// blockTxsPageSize at a time.
+func (c *EsploraClient) GetBlockScanTransactions(height uint64) ([]base.ScanTransaction, error) {
+	hash, err := c.getText("/block-height/" + strconv.FormatUint(height, 10))
+	if err != nil {
+		return nil, err
+	}
+	var info struct {
+		TxCount int `json:"tx_count"`
+	}
+	if err := c.get("/block/"+hash, &info); err != nil {
+		return nil, err
+	}
+	txs := make([]base.ScanTransaction, 0, info.TxCount)
+	for start := 0; start < info.TxCount; start += blockTxsPageSize {
+		var page []transaction
+		if err := c.get("/block/"+hash+"/txs/"+strconv.Itoa(start), &page); err != nil {
+			return nil, err
+		}
+		if len(page) == 0 {
+			return nil, errors.New("no transactions returned")
+		}
+		for i := range page {
+			stx, err := buildScanTransaction(&page[i])
+			if err != nil {
+				return nil, err
+			}
+			txs = append(txs, stx)
+		}
+	}
+	return txs, nil
+}
+
+// GetScanTransaction returns the transaction with the scripts it spends.
+func (c *EsploraClient) GetScanTransaction(id iwallet.TransactionID) (base.ScanTransaction, error) {
+	var tx transaction
+	if err := c.get("/tx/"+id.String(), &tx); err != nil {
+		return base.ScanTransaction{}, err
+	}
+	return buildScanTransaction(&tx)
+}
+
+// Utxo is an unspent output returned by GetUtxos.
+type Utxo struct {
+	Txid   string `json:"txid"`
+	Vout   uint32 `json:"vout"`
+	Value  uint64 `json:"value"`
+	Status struct {
+		Confirmed   bool   `json:"confirmed"`
+		BlockHeight uint64 `json:"block_height"`
+	} `json:"status"`
+}
+
+// GetUtxos returns the unspent outputs paying the address.
+func (c *EsploraClient) GetUtxos(addr iwallet.Address) ([]Utxo, error) {
+	var utxos []Utxo
+	if err := c.get("/address/"+addr.String()+"/utxo", &utxos); err != nil {
+		return nil, err
+	}
+	return utxos, nil
+}
+
+// GetFee returns the server's fee estimate, in satoshis per virtual byte,
+// for the confirmation target of the fee level. It satisfies
+// base.FeeProvider.
+func (c *EsploraClient) GetFee(level iwallet.FeeLevel) (iwallet.Amount, error) {
+	target, ok := feeTargets[level]
+	if !ok {
+		return iwallet.NewAmount(0), errors.New("unknown fee level")
+	}
+	var estimates map[string]float64
+	if err := c.get("/fee-estimates", &estimates); err != nil {
+		return iwallet.NewAmount(0), err
+	}
+	fee, ok := estimates[target]
+	if !ok {
+		return iwallet.NewAmount(0), errors.New("no fee estimate for target")
+	}
+	return iwallet.NewAmount(uint64(math.Ceil(fee))), nil
+}
+
+func (c *EsploraClient) SubscribeTransactions(addrs []iwallet.Address) (*base.TransactionSubscription, error) {
+	if atomic.LoadUint32(&c.started) == 0 {
+		return nil, errors.New("esplora client not connected")
+	}
+
+	c.subMtx.Lock()
+	defer c.subMtx.Unlock()
+
+	sub := &base.TransactionSubscription{
+		Out:         make(chan iwallet.Transaction),
+		Subscribe:   make(chan []iwallet.Address),
+		Unsubscribe: make(chan []iwallet.Address),
+	}
+
+	addrMap := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		addrMap[addr.String()] = true
+	}
+
+	id := rand.Int31()
+	c.txSubs[id] = &transactionSub{
+		sub:   sub,
+		addrs: addrMap,
+	}
+
+	subClose := make(chan struct{})
+
+	sub.Close = func() {
+		close(subClose)
+		c.subMtx.Lock()
+		delete(c.txSubs, id)
+		c.subMtx.Unlock()
+		close(sub.Out)
+	}
+
+	go func() {
+		for {
+			select {
+			case <-subClose:
+				return
+			case <-c.shutdown:
+				return
+			case addrs := <-sub.Subscribe:
+				c.subMtx.Lock()
+				for _, addr := range addrs {
+					addrMap[addr.String()] = true
+				}
+				c.subMtx.Unlock()
+			case addrs := <-sub.Unsubscribe:
+				c.subMtx.Lock()
+				for _, addr := range addrs {
+					delete(addrMap, addr.String())
+				}
+				c.subMtx.Unlock()
+			}
+		}
+	}()
+
+	return sub, nil
+}
+
+func (c *EsploraClient) SubscribeBlocks() (*base.BlockSubscription, error) {
+	if atomic.LoadUint32(&c.started) == 0 {
+		return nil, errors.New("esplora client not connected")
+	}
+
+	c.subMtx.Lock()
+	defer c.subMtx.Unlock()
+
+	sub := &base.BlockSubscription{
+		Out: make(chan iwallet.BlockInfo),
+	}
+
+	id := rand.Int31()
+	c.blockSubs[id] = sub
+
+	sub.Close = func() {
+		c.subMtx.Lock()
+		delete(c.blockSubs, id)
+		c.subMtx.Unlock()
+		close(sub.Out)
+	}
+	return sub, nil
+}
+
+func (c *EsploraClient) Broadcast(serializedTx []byte) error {
+	return c.BroadcastContext(context.Background(), serializedTx)
+}
+
+func (c *EsploraClient) BroadcastContext(ctx context.Context, serializedTx []byte) error {
+	req, err := http.NewRequest(http.MethodPost, c.clientURL+"/tx", bytes.NewReader([]byte(hex.EncodeToString(serializedTx))))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err == nil {
+			return fmt.Errorf("transaction broadcast failed: %s", string(body))
+		}
+		return fmt.Errorf("transaction broadcast failed. status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Open checks the server is reachable and starts polling for new blocks and
+// transactions.
+func (c *EsploraClient) Open() error {
+	tip, err := c.getText("/blocks/tip/hash")
+	if err != nil {
+		return err
+	}
+	if atomic.SwapUint32(&c.started, 1) == 0 {
+		go c.poll(tip)
+	}
+	return nil
+}
+
+func (c *EsploraClient) Close() error {
+	c.subMtx.Lock()
+	defer c.subMtx.Unlock()
+
+	close(c.shutdown)
+	return nil
+}
+
+// poll checks for a new tip and for new transactions paying subscribed
+// addresses every poll interval.
+func (c *EsploraClient) poll(tip string) {
+	ticker := time.NewTicker(c.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.shutdown:
+			return
+		case <-ticker.C:
+		}
+
+		hash, err := c.getText("/blocks/tip/hash")
+		if err == nil && hash != tip {
+			tip = hash
+			info, err := c.GetBlockchainInfo()
+			if err == nil {
+				c.subMtx.Lock()
+				for _, sub := range c.blockSubs {
+					sub.Out <- info
+				}
+				c.subMtx.Unlock()
+			}
+		}
+		c.pollTransactions()
+	}
+}
+
+// pollTransactions fetches the recent history of subscribed addresses whose
+// transaction count changed and sends unseen transactions to the
+// subscriptions watching them.
+func (c *EsploraClient) pollTransactions() {
+	c.subMtx.Lock()
+	addrs := make(map[string]bool)
+	for _, sub := range c.txSubs {
+		for addr := range sub.addrs {
+			addrs[addr] = true
+		}
+	}
+	c.subMtx.Unlock()
+
+	for addr := range addrs {
+		var stats struct {
+			ChainStats struct {
+				TxCount int `json:"tx_count"`
+			} `json:"chain_stats"`
+			MempoolStats struct {
+				TxCount int `json:"tx_count"`
+			} `json:"mempool_stats"`
+		}
+		if err := c.get("/address/"+addr, &stats); err != nil {
+			continue
+		}
+		count := stats.ChainStats.TxCount + stats.MempoolStats.TxCount
+		last, ok := c.txCounts[addr]
+		c.txCounts[addr] = count
+		if !ok || count == last {
+			continue
+		}
+
+		var page []transaction
+		if err := c.get("/address/"+addr+"/txs", &page); err != nil {
+			continue
+		}
+		for i := range page {
+			if c.seenTxs[page[i].Txid] {
+				continue
+			}
+			tx, err := buildTransaction(&page[i], c.coinType)
+			if err != nil {
+				continue
+			}
+			c.seenTxs[page[i].Txid] = true
+			c.notifyTransaction(tx)
+		}
+	}
+}
+
+func (c *EsploraClient) notifyTransaction(tx iwallet.Transaction) {
+	c.subMtx.Lock()
+	defer c.subMtx.Unlock()
+	for _, sub := range c.txSubs {
+		matches := false
+		for _, from := range tx.From {
+			if sub.addrs[from.Address.String()] {
+				matches = true
+				break
+			}
+		}
+		for _, to := range tx.To {
+			if sub.addrs[to.Address.String()] {
+				matches = true
+				break
+			}
+		}
+		if matches {
+			sub.sub.Out <- tx
+		}
+	}
+}
+
+type transaction struct {
+	Txid     string `json:"txid"`
+	Version  int32  `json:"version"`
+	LockTime uint32 `json:"locktime"`
+	Vin      []struct {
+		Txid       string   `json:"txid"`
+		Vout       uint32   `json:"vout"`
+		IsCoinbase bool     `json:"is_coinbase"`
+		ScriptSig  string   `json:"scriptsig"`
+		Witness    []string `json:"witness"`
+		Sequence   uint32   `json:"sequence"`
+		Prevout    *struct {
+			Script  string `json:"scriptpubkey"`
+			Address string `json:"scriptpubkey_address"`
+			Value   uint64 `json:"value"`
+		} `json:"prevout"`
+	} `json:"vin"`
+	Vout []struct {
+		Script  string `json:"scriptpubkey"`
+		Address string `json:"scriptpubkey_address"`
+		Value   uint64 `json:"value"`
+	} `json:"vout"`
+	Status struct {
+		Confirmed   bool   `json:"confirmed"`
+		BlockHeight uint64 `json:"block_height"`
+		BlockHash   string `json:"block_hash"`
+		BlockTime   int64  `json:"block_time"`
+	} `json:"status"`
+}
+
+func buildTransaction(transaction *transaction, ct iwallet.CoinType) (iwallet.Transaction, error) {
+	tx := iwallet.Transaction{
+		ID:        iwallet.TransactionID(transaction.Txid),
+		Timestamp: time.Now(),
+	}
+	if transaction.Status.Confirmed {
+		tx.Height = transaction.Status.BlockHeight
+		tx.Timestamp = time.Unix(transaction.Status.BlockTime, 0)
+		tx.BlockInfo = &iwallet.BlockInfo{
+			Height:    transaction.Status.BlockHeight,
+			BlockID:   iwallet.BlockID(transaction.Status.BlockHash),
+			BlockTime: time.Unix(transaction.Status.BlockTime, 0),
+		}
+	}
+
+	for _, in := range transaction.Vin {
+		if in.IsCoinbase {
+			tx.From = append(tx.From, iwallet.SpendInfo{
+				ID:     append(make([]byte, 32), 0xff, 0xff, 0xff, 0xff),
+				Amount: iwallet.NewAmount(0),
+			})
+			continue
+		}
+		id, err := outpointID(in.Txid, in.Vout)
+		if err != nil {
+			return tx, err
+		}
+		from := iwallet.SpendInfo{
+			ID:     id,
+			Amount: iwallet.NewAmount(0),
+		}
+		if in.Prevout != nil {
+			from.Amount = iwallet.NewAmount(in.Prevout.Value)
+			if in.Prevout.Address != "" {
+				from.Address = iwallet.NewAddress(in.Prevout.Address, ct)
+			}
+		}
+		tx.From = append(tx.From, from)
+	}
+
+	for i, out := range transaction.Vout {
+		id, err := outpointID(transaction.Txid, uint32(i))
+		if err != nil {
+			return tx, err
+		}
+		to := iwallet.SpendInfo{
+			ID:     id,
+			Amount: iwallet.NewAmount(out.Value),
+		}
+		if out.Address != "" {
+			to.Address = iwallet.NewAddress(out.Address, ct)
+		}
+		tx.To = append(tx.To, to)
+	}
+	return tx, nil
+}
+
+// buildScanTransaction rebuilds the wire transaction from the decoded
+// fields since Esplora only returns the raw transaction from a separate
+// endpoint. The result is checked against the txid.
+func buildScanTransaction(transaction *transaction) (base.ScanTransaction, error) {
+	tx := &wire.MsgTx{
+		Version:  transaction.Version,
+		LockTime: transaction.LockTime,
+	}
+	prevScripts := make([][]byte, 0, len(transaction.Vin))
+	for _, in := range transaction.Vin {
+		hash, err := chainhash.NewHashFromStr(in.Txid)
+		if err != nil {
+			return base.ScanTransaction{}, err
+		}
+		sigScript, err := hex.DecodeString(in.ScriptSig)
+		if err != nil {
+			return base.ScanTransaction{}, err
+		}
+		txIn := wire.NewTxIn(wire.NewOutPoint(hash, in.Vout), sigScript, nil)
+		txIn.Sequence = in.Sequence
+		for _, item := range in.Witness {
+			b, err := hex.DecodeString(item)
+			if err != nil {
+				return base.ScanTransaction{}, err
+			}
+			txIn.Witness = append(txIn.Witness, b)
+		}
+		tx.AddTxIn(txIn)
+
+		var prevScript []byte
+		if in.Prevout != nil && !in.IsCoinbase {
+			prevScript, err = hex.DecodeString(in.Prevout.Script)
+			if err != nil {
+				return base.ScanTransaction{}, err
+			}
+		}
+		prevScripts = append(prevScripts, prevScript)
+	}
+	for _, out := range transaction.Vout {
+		script, err := hex.DecodeString(out.Script)
+		if err != nil {
+			return base.ScanTransaction{}, err
+		}
+		tx.AddTxOut(wire.NewTxOut(int64(out.Value), script))
+	}
+	if tx.TxHash().String() != transaction.Txid {
+		return base.ScanTransaction{}, fmt.Errorf("transaction %s does not hash to its id", transaction.Txid)
+	}
+	stx := base.ScanTransaction{
+		Tx:          tx,
+		PrevScripts: prevScripts,
+	}
+	if transaction.Status.Confirmed {
+		stx.Height = transaction.Status.BlockHeight
+	}
+	return stx, nil
+}
+
+// outpointID serializes the outpoint in the format used for SpendInfo IDs.
+func outpointID(txid string, index uint32) ([]byte, error) {
+	hash, err := chainhash.NewHashFromStr(txid)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 36)
+	copy(id[:32], hash[:])
+	binary.LittleEndian.PutUint32(id[32:], index)
+	return id, nil
+}
@@ -0,0 +1,228 @@
+package esplora
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	iwallet "github.com/cpacia/wallet-interface"
+	"github.com/jarcoal/httpmock"
+	"strings"
+	"testing"
+)
+
+func TestEsploraClient_GetBlockchainInfo(t *testing.T) {
+	client, err := NewEsploraClient("esplora+https://example.com/api/", iwallet.CtBitcoin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	httpmock.RegisterResponder("GET", "https://example.com/api/blocks/tip/hash",
+		httpmock.NewStringResponder(200, "000000000000000000059db7d02e5a408dea5a55a44276fa89551749103590fa\n"))
+	httpmock.RegisterResponder("GET", "https://example.com/api/block/000000000000000000059db7d02e5a408dea5a55a44276fa89551749103590fa",
+		httpmock.NewStringResponder(200, `{"id":"000000000000000000059db7d02e5a408dea5a55a44276fa89551749103590fa","height":100000,"timestamp":1577418486,"previousblockhash":"00000000000000000003657bf1583f9f9ef196cb80bb3c72aeecbb22f3c581c4"}`))
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	info, err := client.GetBlockchainInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Height != 100000 {
+		t.Errorf("Expected height 100000, got %d", info.Height)
+	}
+	expectedBlockID := "000000000000000000059db7d02e5a408dea5a55a44276fa89551749103590fa"
+	if info.BlockID.String() != expectedBlockID {
+		t.Errorf("Expected block ID %s, got %s", expectedBlockID, info.BlockID)
+	}
+	expectedPrevID := "00000000000000000003657bf1583f9f9ef196cb80bb3c72aeecbb22f3c581c4"
+	if info.PrevBlock.String() != expectedPrevID {
+		t.Errorf("Expected prev ID %s, got %s", expectedPrevID, info.PrevBlock)
+	}
+	if info.BlockTime.Unix() != 1577418486 {
+		t.Errorf("Expected time 1577418486, got %d", info.BlockTime.Unix())
+	}
+}
+
+func TestEsploraClient_GetTransaction(t *testing.T) {
+	client, err := NewEsploraClient("esplora+https://example.com/api", iwallet.CtBitcoin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	httpmock.RegisterResponder("GET", "https://example.com/api/tx/2a4cfac4cb8a322a31ac683bf6f2f05b6a5a1788af4e23a6a91a25fc7d891ce0",
+		httpmock.NewStringResponder(200, `{"txid":"2a4cfac4cb8a322a31ac683bf6f2f05b6a5a1788af4e23a6a91a25fc7d891ce0","vin":[{"txid":"88e9d70258ddcec90be40aa90990aadf6829f00cbd94643e084790ed6c57531a","vout":32,"prevout":{"scriptpubkey_address":"3Fxe7hfikmEM4ATc2h5enZFLdKDpw8eZc7","value":281414000},"is_coinbase":false}],"vout":[{"scriptpubkey_address":"3KowsLAQ2ZZ3FmwnBR8kiEzwnC2LqDNcmK","value":87253600},{"scriptpubkey_address":"17MrLXcJWnCbyJUXkvUeYeQEyQwYY5gMAU","value":194110000}],"status":{"confirmed":true,"block_height":609951,"block_hash":"00000000000000000003657bf1583f9f9ef196cb80bb3c72aeecbb22f3c581c4","block_time":1577417904}}`))
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	tx, err := client.GetTransaction(iwallet.TransactionID("2a4cfac4cb8a322a31ac683bf6f2f05b6a5a1788af4e23a6a91a25fc7d891ce0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tx.Height != 609951 || tx.BlockInfo == nil {
+		t.Fatalf("Expected height 609951, got %d", tx.Height)
+	}
+	if len(tx.From) != 1 {
+		t.Fatalf("Expected 1 input got %d", len(tx.From))
+	}
+	if tx.From[0].Address.String() != "3Fxe7hfikmEM4ATc2h5enZFLdKDpw8eZc7" {
+		t.Errorf("Expected from address 3Fxe7hfikmEM4ATc2h5enZFLdKDpw8eZc7, got %s", tx.From[0].Address)
+	}
+	if tx.From[0].Amount.String() != "281414000" {
+		t.Errorf("Expected from amount 281414000, got %s", tx.From[0].Amount)
+	}
+	expectedFromID := "1a53576ced9047083e6494bd0cf02968dfaa9009a90ae40bc9cedd5802d7e98820000000"
+	if hex.EncodeToString(tx.From[0].ID) != expectedFromID {
+		t.Errorf("Expected from ID %s, got %s", expectedFromID, hex.EncodeToString(tx.From[0].ID))
+	}
+	if len(tx.To) != 2 {
+		t.Fatalf("Expected 2 outputs got %d", len(tx.To))
+	}
+	if tx.To[1].Amount.String() != "194110000" {
+		t.Errorf("Expected to amount 194110000, got %s", tx.To[1].Amount)
+	}
+	expectedToID := "e01c897dfc251aa9a6234eaf88175a6a5bf0f2f63b68ac312a328acbc4fa4c2a01000000"
+	if hex.EncodeToString(tx.To[1].ID) != expectedToID {
+		t.Errorf("Expected to ID %s, got %s", expectedToID, hex.EncodeToString(tx.To[1].ID))
+	}
+}
+
+func TestEsploraClient_IsBlockInMainChain(t *testing.T) {
+	client, err := NewEsploraClient("esplora+https://example.com/api", iwallet.CtBitcoin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	httpmock.RegisterResponder("GET", "https://example.com/api/block/aa/status",
+		httpmock.NewStringResponder(200, `{"in_best_chain":true,"height":10}`))
+	httpmock.RegisterResponder("GET", "https://example.com/api/block/bb/status",
+		httpmock.NewStringResponder(200, `{"in_best_chain":false}`))
+	httpmock.RegisterResponder("GET", "https://example.com/api/block/cc/status",
+		httpmock.NewStringResponder(404, `Block not found`))
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	expected := map[string]bool{"aa": true, "bb": false, "cc": false}
+	for id, inMainChain := range expected {
+		res, err := client.IsBlockInMainChain(iwallet.BlockInfo{BlockID: iwallet.BlockID(id)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != inMainChain {
+			t.Errorf("Expected %s in main chain %t, got %t", id, inMainChain, res)
+		}
+	}
+}
+
+func TestEsploraClient_GetFee(t *testing.T) {
+	client, err := NewEsploraClient("esplora+https://example.com/api", iwallet.CtBitcoin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	httpmock.RegisterResponder("GET", "https://example.com/api/fee-estimates",
+		httpmock.NewStringResponder(200, `{"1":87.882,"6":40.1,"24":12,"144":1.027}`))
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	expected := map[iwallet.FeeLevel]string{
+		iwallet.FlPriority:      "88",
+		iwallet.FlNormal:        "41",
+		iwallet.FlEconomic:      "12",
+		iwallet.FLSuperEconomic: "2",
+	}
+	for level, fee := range expected {
+		res, err := client.GetFee(level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.String() != fee {
+			t.Errorf("Expected fee %s, got %s", fee, res)
+		}
+	}
+}
+
+func TestEsploraClient_GetMerkleProof(t *testing.T) {
+	client, err := NewEsploraClient("esplora+https://example.com/api", iwallet.CtBitcoin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	httpmock.RegisterResponder("GET", "https://example.com/api/tx/2a4cfac4cb8a322a31ac683bf6f2f05b6a5a1788af4e23a6a91a25fc7d891ce0/merkle-proof",
+		httpmock.NewStringResponder(200, `{"block_height":609951,"merkle":["88e9d70258ddcec90be40aa90990aadf6829f00cbd94643e084790ed6c57531a","00000000000000000003657bf1583f9f9ef196cb80bb3c72aeecbb22f3c581c4"],"pos":3}`))
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	proof, err := client.GetMerkleProof(iwallet.TransactionID("2a4cfac4cb8a322a31ac683bf6f2f05b6a5a1788af4e23a6a91a25fc7d891ce0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proof.Height != 609951 || proof.Index != 3 {
+		t.Errorf("Expected height 609951 and index 3, got %d and %d", proof.Height, proof.Index)
+	}
+	if len(proof.Branch) != 2 || proof.Branch[0].String() != "88e9d70258ddcec90be40aa90990aadf6829f00cbd94643e084790ed6c57531a" {
+		t.Errorf("Incorrect branch %v", proof.Branch)
+	}
+}
+
+func TestEsploraClient_GetBlockScanTransactions(t *testing.T) {
+	client, err := NewEsploraClient("esplora+https://example.com/api", iwallet.CtBitcoin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prevHash, err := chainhash.NewHashFromStr("88e9d70258ddcec90be40aa90990aadf6829f00cbd94643e084790ed6c57531a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevScript, _ := hex.DecodeString("0014751e76e8199196d454941c45d1b3a323f1433bd6")
+	tx := wire.NewMsgTx(2)
+	in := wire.NewTxIn(wire.NewOutPoint(prevHash, 1), nil, wire.TxWitness{bytes.Repeat([]byte{0x01}, 71), bytes.Repeat([]byte{0x02}, 33)})
+	in.Sequence = 0xfffffffd
+	tx.AddTxIn(in)
+	tx.AddTxOut(wire.NewTxOut(5000, append([]byte{0x51, 0x20}, bytes.Repeat([]byte{0x03}, 32)...)))
+	tx.LockTime = 609950
+
+	txJSON := fmt.Sprintf(`{"txid":"%s","version":2,"locktime":609950,"vin":[{"txid":"%s","vout":1,"scriptsig":"","witness":["%x","%x"],"sequence":4294967293,"is_coinbase":false,"prevout":{"scriptpubkey":"%x","value":6000}}],"vout":[{"scriptpubkey":"%x","value":5000}],"status":{"confirmed":true,"block_height":609951}}`,
+		tx.TxHash(), prevHash, in.Witness[0], in.Witness[1], prevScript, tx.TxOut[0].PkScript)
+
+	blockHash := "00000000000000000003657bf1583f9f9ef196cb80bb3c72aeecbb22f3c581c4"
+	httpmock.RegisterResponder("GET", "https://example.com/api/block-height/609951",
+		httpmock.NewStringResponder(200, blockHash+"\n"))
+	httpmock.RegisterResponder("GET", "https://example.com/api/block/"+blockHash,
+		httpmock.NewStringResponder(200, `{"id":"`+blockHash+`","height":609951,"tx_count":1}`))
+	httpmock.RegisterResponder("GET", "https://example.com/api/block/"+blockHash+"/txs/0",
+		httpmock.NewStringResponder(200, "["+txJSON+"]"))
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	txs, err := client.GetBlockScanTransactions(609951)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txs) != 1 {
+		t.Fatalf("Expected 1 transaction, got %d", len(txs))
+	}
+	if txs[0].Tx.TxHash() != tx.TxHash() || txs[0].Height != 609951 {
+		t.Errorf("Expected transaction %s at height 609951, got %s at %d", tx.TxHash(), txs[0].Tx.TxHash(), txs[0].Height)
+	}
+	if len(txs[0].PrevScripts) != 1 || !bytes.Equal(txs[0].PrevScripts[0], prevScript) {
+		t.Errorf("Incorrect previous scripts %x", txs[0].PrevScripts)
+	}
+
+	// A transaction which doesn't match its txid is rejected.
+	httpmock.RegisterResponder("GET", "https://example.com/api/tx/"+tx.TxHash().String(),
+		httpmock.NewStringResponder(200, strings.Replace(txJSON, `"locktime":609950`, `"locktime":0`, 1)))
+	if _, err := client.GetScanTransaction(iwallet.TransactionID(tx.TxHash().String())); err == nil {
+		t.Error("Expected an error for a transaction not matching its id")
+	}
+}
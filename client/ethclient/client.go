@@ -223,6 +223,11 @@ func (c *EthClient) IsBlockInMainChain(block iwallet.BlockInfo) (bool, error) {
 	return header.Hash().String() == block.BlockID.String(), nil
 }
 
+// GetMerkleProof is not supported for account based chains.
+func (c *EthClient) GetMerkleProof(id iwallet.TransactionID) (*base.MerkleProof, error) {
+	return nil, base.ErrMerkleProofUnsupported
+}
+
 func (c *EthClient) SubscribeTransactions(addrs []iwallet.Address) (*base.TransactionSubscription, error) {
 	if atomic.LoadUint32(&c.started) == 0 {
 		return nil, errors.New("blockbook client not connected")
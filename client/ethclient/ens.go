@@ -0,0 +1,228 @@
+package ethclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"math/big"
+	"strings"
+	"sync/atomic"
+)
+
+// ENSRegistry is the address of the ENS registry on mainnet and the
+// public testnets.
+var ENSRegistry = common.HexToAddress("0x00000000000C2E074eC69A0dFb2997BA6C7d2e1e")
+
+var (
+	// ErrNameNotFound is returned when an ENS name or reverse record
+	// isn't set.
+	ErrNameNotFound = errors.New("ens name not found")
+
+	// ErrNameMismatch is returned when an address's reverse record names
+	// an ENS name which doesn't resolve back to the address.
+	ErrNameMismatch = errors.New("ens name doesn't resolve to the address")
+
+	// ErrNameUnverified is returned by ResolveAddress when the address an
+	// ENS name resolves to has no reverse record naming it back.
+	ErrNameUnverified = errors.New("ens name isn't verified by the address's reverse record")
+)
+
+var (
+	ensResolverMethod = crypto.Keccak256([]byte("resolver(bytes32)"))[:4]
+	ensAddrMethod     = crypto.Keccak256([]byte("addr(bytes32)"))[:4]
+	ensNameMethod     = crypto.Keccak256([]byte("name(bytes32)"))[:4]
+)
+
+// IsENSName returns whether s has the form of an ENS name.
+func IsENSName(s string) bool {
+	if common.IsHexAddress(s) || !strings.Contains(s, ".") {
+		return false
+	}
+	for _, label := range strings.Split(s, ".") {
+		if label == "" || strings.ContainsAny(label, " /?@:#") {
+			return false
+		}
+	}
+	return true
+}
+
+// Namehash returns the EIP-137 node of the ENS name.
+func Namehash(name string) common.Hash {
+	var node common.Hash
+	if name == "" {
+		return node
+	}
+	labels := strings.Split(strings.ToLower(name), ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		node = crypto.Keccak256Hash(node.Bytes(), crypto.Keccak256([]byte(labels[i])))
+	}
+	return node
+}
+
+// ResolveName returns the address the ENS name resolves to. It's verified
+// if the address's reverse record names it back.
+func (c *EthClient) ResolveName(name string) (addr common.Address, verified bool, err error) {
+	if atomic.LoadUint32(&c.started) == 0 {
+		return common.Address{}, false, errors.New("rpc client not connected")
+	}
+	addr, err = c.resolveName(name)
+	if err != nil {
+		return common.Address{}, false, err
+	}
+	reverse, err := c.reverseName(addr)
+	if errors.Is(err, ErrNameNotFound) {
+		return addr, false, nil
+	} else if err != nil {
+		return common.Address{}, false, err
+	}
+	return addr, strings.EqualFold(reverse, name), nil
+}
+
+// LookupAddress returns the ENS name in the address's reverse record. It
+// returns ErrNameMismatch if the name doesn't resolve back to the address
+// as anyone can set a reverse record to any name.
+func (c *EthClient) LookupAddress(addr common.Address) (string, error) {
+	if atomic.LoadUint32(&c.started) == 0 {
+		return "", errors.New("rpc client not connected")
+	}
+	name, err := c.reverseName(addr)
+	if err != nil {
+		return "", err
+	}
+	forward, err := c.resolveName(name)
+	if errors.Is(err, ErrNameNotFound) || (err == nil && forward != addr) {
+		return "", fmt.Errorf("%w: %s", ErrNameMismatch, name)
+	} else if err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// ResolveAddress returns the address to pay for a hex address, ENS name
+// or ethereum: payment URI. Mixed case hex addresses must have a valid
+// EIP-55 checksum. ENS names must be verified, see ResolveName, or
+// ErrNameUnverified is returned.
+func (c *EthClient) ResolveAddress(s string) (common.Address, error) {
+	target := strings.TrimSpace(s)
+	if strings.HasPrefix(strings.ToLower(target), paymentURIScheme) {
+		u, err := ParsePaymentURI(target)
+		if err != nil {
+			return common.Address{}, err
+		}
+		target = u.Recipient()
+	}
+	if common.IsHexAddress(target) {
+		addr := common.HexToAddress(target)
+		hex := strings.TrimPrefix(strings.TrimPrefix(target, "0x"), "0X")
+		if hex != strings.ToLower(hex) && hex != strings.ToUpper(hex) && addr.Hex()[2:] != hex {
+			return common.Address{}, fmt.Errorf("invalid address checksum %s", target)
+		}
+		return addr, nil
+	}
+	if !IsENSName(target) {
+		return common.Address{}, fmt.Errorf("invalid address %s", s)
+	}
+	addr, verified, err := c.ResolveName(target)
+	if err != nil {
+		return common.Address{}, err
+	}
+	if !verified {
+		return common.Address{}, fmt.Errorf("%w: %s", ErrNameUnverified, target)
+	}
+	return addr, nil
+}
+
+// resolveName looks up the name's resolver in the registry and the address
+// in the resolver.
+func (c *EthClient) resolveName(name string) (common.Address, error) {
+	node := Namehash(name)
+	resolver, err := c.ensResolver(node)
+	if err != nil {
+		return common.Address{}, err
+	}
+	out, err := c.ensCall(resolver, ensAddrMethod, node)
+	if err != nil {
+		return common.Address{}, err
+	}
+	addr, err := unpackENSAddress(out)
+	if err != nil {
+		return common.Address{}, err
+	}
+	if addr == (common.Address{}) {
+		return common.Address{}, fmt.Errorf("%w: %s", ErrNameNotFound, name)
+	}
+	return addr, nil
+}
+
+// reverseName returns the name in the address's reverse record.
+func (c *EthClient) reverseName(addr common.Address) (string, error) {
+	node := Namehash(strings.ToLower(addr.Hex()[2:]) + ".addr.reverse")
+	resolver, err := c.ensResolver(node)
+	if err != nil {
+		return "", err
+	}
+	out, err := c.ensCall(resolver, ensNameMethod, node)
+	if err != nil {
+		return "", err
+	}
+	name, err := unpackABIString(out)
+	if err != nil {
+		return "", err
+	}
+	if name == "" {
+		return "", fmt.Errorf("%w: %s", ErrNameNotFound, addr.Hex())
+	}
+	return name, nil
+}
+
+// ensResolver returns the resolver set for the node in the registry.
+func (c *EthClient) ensResolver(node common.Hash) (common.Address, error) {
+	out, err := c.ensCall(ENSRegistry, ensResolverMethod, node)
+	if err != nil {
+		return common.Address{}, err
+	}
+	resolver, err := unpackENSAddress(out)
+	if err != nil {
+		return common.Address{}, err
+	}
+	if resolver == (common.Address{}) {
+		return common.Address{}, ErrNameNotFound
+	}
+	return resolver, nil
+}
+
+func (c *EthClient) ensCall(contract common.Address, method []byte, node common.Hash) ([]byte, error) {
+	data := append(append([]byte{}, method...), node.Bytes()...)
+
+	ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+	defer cancel()
+
+	return c.RPC.CallContract(ctx, ethereum.CallMsg{To: &contract, Data: data}, nil)
+}
+
+func unpackENSAddress(out []byte) (common.Address, error) {
+	if len(out) < 32 {
+		return common.Address{}, errors.New("invalid response from ens contract")
+	}
+	return common.BytesToAddress(out[12:32]), nil
+}
+
+// unpackABIString decodes a string returned by a contract call.
+func unpackABIString(out []byte) (string, error) {
+	if len(out) < 64 {
+		return "", errors.New("invalid abi encoded string")
+	}
+	offset := new(big.Int).SetBytes(out[:32])
+	if !offset.IsUint64() || offset.Uint64() > uint64(len(out)-32) {
+		return "", errors.New("invalid abi encoded string")
+	}
+	start := offset.Uint64() + 32
+	length := new(big.Int).SetBytes(out[start-32 : start])
+	if !length.IsUint64() || length.Uint64() > uint64(len(out))-start {
+		return "", errors.New("invalid abi encoded string")
+	}
+	return string(out[start : start+length.Uint64()]), nil
+}
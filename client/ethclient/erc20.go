@@ -0,0 +1,197 @@
+package ethclient
+
+import (
+	"context"
+	"errors"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"math/big"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// ERC20ABI is the subset of the ERC20 interface used by the client.
+const ERC20ABI = `[{"constant":true,"inputs":[{"name":"_owner","type":"address"}],"name":"balanceOf","outputs":[{"name":"balance","type":"uint256"}],"payable":false,"stateMutability":"view","type":"function"},{"constant":false,"inputs":[{"name":"_to","type":"address"},{"name":"_value","type":"uint256"}],"name":"transfer","outputs":[{"name":"success","type":"bool"}],"payable":false,"stateMutability":"nonpayable","type":"function"},{"constant":true,"inputs":[],"name":"decimals","outputs":[{"name":"","type":"uint8"}],"payable":false,"stateMutability":"view","type":"function"},{"anonymous":false,"inputs":[{"indexed":true,"name":"from","type":"address"},{"indexed":true,"name":"to","type":"address"},{"indexed":false,"name":"value","type":"uint256"}],"name":"Transfer","type":"event"}]`
+
+// transferEventTopic is the keccak256 hash of the ERC20 Transfer event
+// signature. It is the first topic of every Transfer log.
+var transferEventTopic = crypto.Keccak256Hash([]byte("Transfer(address,address,uint256)"))
+
+var erc20ABI abi.ABI
+
+func init() {
+	var err error
+	erc20ABI, err = abi.JSON(strings.NewReader(ERC20ABI))
+	if err != nil {
+		panic(err)
+	}
+}
+
+// ERC20Token describes a token contract.
+type ERC20Token struct {
+	Contract common.Address
+	Symbol   string
+	Decimals uint8
+}
+
+// TokenTransfer is a single Transfer event emitted by a token contract.
+type TokenTransfer struct {
+	TxHash      common.Hash
+	BlockNumber uint64
+	BlockHash   common.Hash
+	LogIndex    uint
+	From        common.Address
+	To          common.Address
+	Value       *big.Int
+}
+
+// PackTokenTransfer returns the call data for transfer(to, amount).
+func PackTokenTransfer(to common.Address, amount *big.Int) ([]byte, error) {
+	return erc20ABI.Pack("transfer", to, amount)
+}
+
+// TokenBalance returns the token balance for the owner.
+func (c *EthClient) TokenBalance(token, owner common.Address) (*big.Int, error) {
+	if atomic.LoadUint32(&c.started) == 0 {
+		return nil, errors.New("rpc client not connected")
+	}
+	data, err := erc20ABI.Pack("balanceOf", owner)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+	defer cancel()
+
+	out, err := c.RPC.CallContract(ctx, ethereum.CallMsg{To: &token, Data: data}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(out) == 0 {
+		return nil, errors.New("empty response from token contract")
+	}
+	return new(big.Int).SetBytes(out), nil
+}
+
+// TokenDecimals queries the token contract for its number of decimals.
+func (c *EthClient) TokenDecimals(token common.Address) (uint8, error) {
+	if atomic.LoadUint32(&c.started) == 0 {
+		return 0, errors.New("rpc client not connected")
+	}
+	data, err := erc20ABI.Pack("decimals")
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+	defer cancel()
+
+	out, err := c.RPC.CallContract(ctx, ethereum.CallMsg{To: &token, Data: data}, nil)
+	if err != nil {
+		return 0, err
+	}
+	if len(out) == 0 {
+		return 0, errors.New("empty response from token contract")
+	}
+	return uint8(new(big.Int).SetBytes(out).Uint64()), nil
+}
+
+// TransferFilterer is the part of the RPC client used to query Transfer
+// logs. It's implemented by *ethclient.Client.
+type TransferFilterer interface {
+	FilterLogs(ctx context.Context, q ethereum.FilterQuery) ([]types.Log, error)
+}
+
+// GetTokenTransfers returns all Transfer events for the token where addr is
+// either the sender or recipient, starting at fromBlock.
+func (c *EthClient) GetTokenTransfers(token, addr common.Address, fromBlock uint64) ([]TokenTransfer, error) {
+	if atomic.LoadUint32(&c.started) == 0 {
+		return nil, errors.New("rpc client not connected")
+	}
+	return FilterTokenTransfers(context.Background(), c.RPC, token, addr, fromBlock, nil)
+}
+
+// FilterTokenTransfers returns the Transfer events for the token where addr
+// is either the sender or recipient from fromBlock to toBlock inclusive. If
+// toBlock is nil the query runs to the latest block. The transfers are
+// ordered by block and log index.
+func FilterTokenTransfers(ctx context.Context, backend TransferFilterer, token, addr common.Address, fromBlock uint64, toBlock *big.Int) ([]TokenTransfer, error) {
+	addrTopic := common.BytesToHash(addr.Bytes())
+
+	// Topics are ANDed together so sent and received transfers must be
+	// queried separately.
+	queries := []ethereum.FilterQuery{
+		{
+			FromBlock: new(big.Int).SetUint64(fromBlock),
+			ToBlock:   toBlock,
+			Addresses: []common.Address{token},
+			Topics:    [][]common.Hash{{transferEventTopic}, {addrTopic}},
+		},
+		{
+			FromBlock: new(big.Int).SetUint64(fromBlock),
+			ToBlock:   toBlock,
+			Addresses: []common.Address{token},
+			Topics:    [][]common.Hash{{transferEventTopic}, nil, {addrTopic}},
+		},
+	}
+
+	var (
+		transfers []TokenTransfer
+		seen      = make(map[common.Hash]map[uint]bool)
+	)
+	for _, query := range queries {
+		reqCtx, cancel := context.WithTimeout(ctx, RequestTimeout)
+		logs, err := backend.FilterLogs(reqCtx, query)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range logs {
+			if len(l.Topics) != 3 || l.Topics[0] != transferEventTopic || l.Removed {
+				continue
+			}
+			if seen[l.TxHash][l.Index] {
+				continue
+			}
+			if seen[l.TxHash] == nil {
+				seen[l.TxHash] = make(map[uint]bool)
+			}
+			seen[l.TxHash][l.Index] = true
+
+			transfers = append(transfers, TokenTransfer{
+				TxHash:      l.TxHash,
+				BlockNumber: l.BlockNumber,
+				BlockHash:   l.BlockHash,
+				LogIndex:    l.Index,
+				From:        common.BytesToAddress(l.Topics[1].Bytes()),
+				To:          common.BytesToAddress(l.Topics[2].Bytes()),
+				Value:       new(big.Int).SetBytes(l.Data),
+			})
+		}
+	}
+	sort.Slice(transfers, func(i, j int) bool {
+		if transfers[i].BlockNumber != transfers[j].BlockNumber {
+			return transfers[i].BlockNumber < transfers[j].BlockNumber
+		}
+		return transfers[i].LogIndex < transfers[j].LogIndex
+	})
+	return transfers, nil
+}
+
+// EstimateTokenTransferGas returns the estimated gas limit for a token
+// transfer.
+func (c *EthClient) EstimateTokenTransferGas(token, from, to common.Address, amount *big.Int) (uint64, error) {
+	if atomic.LoadUint32(&c.started) == 0 {
+		return 0, errors.New("rpc client not connected")
+	}
+	data, err := PackTokenTransfer(to, amount)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+	defer cancel()
+
+	return c.RPC.EstimateGas(ctx, ethereum.CallMsg{From: from, To: &token, Data: data})
+}
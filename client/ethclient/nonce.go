@@ -0,0 +1,434 @@
+package ethclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/cpacia/multiwallet/database"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// replacementBumpPercent is how much higher than the original's a
+	// replacement's gas price must be for nodes to accept it.
+	replacementBumpPercent = 10
+
+	// transferGas is the gas used by a plain ether transfer, which is
+	// what a cancellation sends.
+	transferGas = 21000
+)
+
+var (
+	// ErrNonceNotPending is returned when replacing the transaction at a
+	// nonce the manager has no pending transaction at.
+	ErrNonceNotPending = errors.New("no pending transaction at nonce")
+
+	// ErrReplacementUnderpriced is returned when a replacement's gas
+	// price isn't enough higher than the original's for nodes to accept
+	// it.
+	ErrReplacementUnderpriced = errors.New("replacement gas price too low")
+
+	// ErrNonceUsed is returned when sending a signed transaction whose
+	// nonce another transaction has been sent at.
+	ErrNonceUsed = errors.New("nonce already used")
+)
+
+// NonceBackend is the part of the RPC client used by the NonceManager.
+// It's implemented by *ethclient.Client.
+type NonceBackend interface {
+	PendingNonceAt(ctx context.Context, account common.Address) (uint64, error)
+	NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error)
+	SendTransaction(ctx context.Context, tx *types.Transaction) error
+}
+
+// SignFunc signs a transaction with the account's key.
+type SignFunc func(tx *types.Transaction) (*types.Transaction, error)
+
+// NonceManager assigns nonces to an account's transactions. The
+// transactions it sends are saved until they confirm so nonces aren't
+// reused after a restart even if the node has dropped them, and a stuck
+// transaction can be replaced at its nonce with SpeedUp or Cancel.
+type NonceManager struct {
+	db      database.Database
+	backend NonceBackend
+	account common.Address
+	sign    SignFunc
+	mtx     sync.Mutex
+}
+
+// PendingTransaction is a transaction the manager sent which isn't
+// confirmed. Replaced are the transactions it replaced at the same nonce.
+type PendingTransaction struct {
+	Nonce     uint64
+	Txid      common.Hash
+	GasPrice  *big.Int
+	Replaced  []common.Hash
+	Cancelled bool
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// NonceStatus is the state of the account's nonces returned by Sync.
+type NonceStatus struct {
+	// Confirmed is the account's nonce in the latest block. Every lower
+	// nonce is mined.
+	Confirmed uint64
+
+	// Gaps are unconfirmed nonces below the highest pending one which
+	// the manager has no transaction at. Nothing after a gap can be mined
+	// until it's filled, which Cancel does.
+	Gaps []uint64
+
+	// Stuck are pending transactions at the confirmed nonce which haven't
+	// been mined in time. They hold up every later transaction.
+	Stuck []PendingTransaction
+}
+
+// NewNonceManager returns a NonceManager for the account.
+func NewNonceManager(db database.Database, backend NonceBackend, account common.Address, sign SignFunc) *NonceManager {
+	return &NonceManager{
+		db:      db,
+		backend: backend,
+		account: account,
+		sign:    sign,
+		mtx:     sync.Mutex{},
+	}
+}
+
+// NonceManager returns a NonceManager for the account which uses the
+// client's RPC connection.
+func (c *EthClient) NonceManager(db database.Database, account common.Address, sign SignFunc) (*NonceManager, error) {
+	if atomic.LoadUint32(&c.started) == 0 {
+		return nil, errors.New("rpc client not connected")
+	}
+	return NewNonceManager(db, c.RPC, account, sign), nil
+}
+
+// NextNonce returns the nonce the next transaction will be sent at.
+func (m *NonceManager) NextNonce(ctx context.Context) (uint64, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	return m.nextNonce(ctx)
+}
+
+// nextNonce returns the higher of the node's pending nonce and the nonce
+// after the last saved transaction.
+func (m *NonceManager) nextNonce(ctx context.Context) (uint64, error) {
+	nonce, err := m.backend.PendingNonceAt(ctx, m.account)
+	if err != nil {
+		return 0, err
+	}
+	records, err := m.records()
+	if err != nil {
+		return 0, err
+	}
+	if n := len(records); n > 0 && records[n-1].Nonce >= nonce {
+		nonce = records[n-1].Nonce + 1
+	}
+	return nonce, nil
+}
+
+// Send signs and broadcasts a transaction at the next nonce and saves it
+// as pending.
+func (m *NonceManager) Send(ctx context.Context, to common.Address, value *big.Int, gasLimit uint64, gasPrice *big.Int, data []byte) (*types.Transaction, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	nonce, err := m.nextNonce(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tx := types.NewTransaction(nonce, to, value, gasLimit, gasPrice, data)
+	return m.send(ctx, tx, nil, false)
+}
+
+// Sign signs a transaction at the next nonce without sending it. It's
+// for callers which must know the txid before the transaction is sent,
+// such as a wallet which sends when its database transaction commits.
+// The transaction is sent with SendSigned.
+func (m *NonceManager) Sign(ctx context.Context, to common.Address, value *big.Int, gasLimit uint64, gasPrice *big.Int, data []byte) (*types.Transaction, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	nonce, err := m.nextNonce(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return m.sign(types.NewTransaction(nonce, to, value, gasLimit, gasPrice, data))
+}
+
+// SendSigned broadcasts a transaction returned by Sign and saves it as
+// pending. It returns ErrNonceUsed if another transaction has been sent at
+// its nonce since it was signed.
+func (m *NonceManager) SendSigned(ctx context.Context, signed *types.Transaction) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	nonce, err := m.nextNonce(ctx)
+	if err != nil {
+		return err
+	}
+	if signed.Nonce() != nonce {
+		return fmt.Errorf("%w %d", ErrNonceUsed, signed.Nonce())
+	}
+	return m.broadcast(ctx, signed, nil, false)
+}
+
+// SpeedUp replaces the pending transaction at the nonce with the same
+// transaction at a higher gas price. If gasPrice is nil the lowest price
+// nodes accept as a replacement is used.
+func (m *NonceManager) SpeedUp(ctx context.Context, nonce uint64, gasPrice *big.Int) (*types.Transaction, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	record, err := m.record(nonce)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return nil, fmt.Errorf("%w %d", ErrNonceNotPending, nonce)
+	}
+	var old types.Transaction
+	if err := rlp.DecodeBytes(record.Tx, &old); err != nil {
+		return nil, err
+	}
+	gasPrice, err = replacementGasPrice(old.GasPrice(), gasPrice)
+	if err != nil {
+		return nil, err
+	}
+
+	var tx *types.Transaction
+	if old.To() == nil {
+		tx = types.NewContractCreation(nonce, old.Value(), old.Gas(), gasPrice, old.Data())
+	} else {
+		tx = types.NewTransaction(nonce, *old.To(), old.Value(), old.Gas(), gasPrice, old.Data())
+	}
+	return m.send(ctx, tx, record, record.Cancelled)
+}
+
+// Cancel replaces the pending transaction at the nonce with an empty
+// transfer to the account itself at a higher gas price, so the original
+// can't be mined. If gasPrice is nil the lowest price nodes accept as a
+// replacement is used. Cancel also fills a gap, in which case the gas
+// price is required.
+func (m *NonceManager) Cancel(ctx context.Context, nonce uint64, gasPrice *big.Int) (*types.Transaction, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	record, err := m.record(nonce)
+	if err != nil {
+		return nil, err
+	}
+	if record != nil {
+		var old types.Transaction
+		if err := rlp.DecodeBytes(record.Tx, &old); err != nil {
+			return nil, err
+		}
+		gasPrice, err = replacementGasPrice(old.GasPrice(), gasPrice)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		confirmed, err := m.backend.NonceAt(ctx, m.account, nil)
+		if err != nil {
+			return nil, err
+		}
+		next, err := m.nextNonce(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if nonce < confirmed || nonce >= next {
+			return nil, fmt.Errorf("%w %d", ErrNonceNotPending, nonce)
+		}
+		if gasPrice == nil {
+			return nil, errors.New("a gas price is required to fill a nonce gap")
+		}
+	}
+
+	tx := types.NewTransaction(nonce, m.account, big.NewInt(0), transferGas, gasPrice, nil)
+	return m.send(ctx, tx, record, true)
+}
+
+// send signs and broadcasts the transaction and saves it as pending. If
+// it replaces record the old txid is added to the record's replacements.
+func (m *NonceManager) send(ctx context.Context, tx *types.Transaction, record *database.NonceRecord, cancelled bool) (*types.Transaction, error) {
+	signed, err := m.sign(tx)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.broadcast(ctx, signed, record, cancelled); err != nil {
+		return nil, err
+	}
+	return signed, nil
+}
+
+// broadcast sends the signed transaction and saves it as pending.
+func (m *NonceManager) broadcast(ctx context.Context, signed *types.Transaction, record *database.NonceRecord, cancelled bool) error {
+	ser, err := rlp.EncodeToBytes(signed)
+	if err != nil {
+		return err
+	}
+	if err := m.backend.SendTransaction(ctx, signed); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if record == nil {
+		record = &database.NonceRecord{
+			Account:   m.account.Hex(),
+			Nonce:     signed.Nonce(),
+			CreatedAt: now,
+		}
+	} else {
+		replaced := record.Txid
+		if record.Replaced != "" {
+			replaced = record.Replaced + "," + replaced
+		}
+		record.Replaced = replaced
+	}
+	record.Txid = signed.Hash().Hex()
+	record.Tx = ser
+	record.GasPrice = signed.GasPrice().String()
+	record.Cancelled = cancelled
+	record.UpdatedAt = now
+
+	return m.db.Update(func(dbtx database.Tx) error {
+		return dbtx.Save(record)
+	})
+}
+
+// Pending returns the manager's unconfirmed transactions ordered by
+// nonce. Call Sync first to remove ones which have confirmed.
+func (m *NonceManager) Pending() ([]PendingTransaction, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	records, err := m.records()
+	if err != nil {
+		return nil, err
+	}
+	pending := make([]PendingTransaction, 0, len(records))
+	for _, record := range records {
+		pending = append(pending, pendingTransaction(record))
+	}
+	return pending, nil
+}
+
+// Sync removes the transactions at nonces which have confirmed and
+// returns the account's gaps and the transactions which have been pending
+// at the confirmed nonce for longer than stuckAfter.
+func (m *NonceManager) Sync(ctx context.Context, stuckAfter time.Duration) (*NonceStatus, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	confirmed, err := m.backend.NonceAt(ctx, m.account, nil)
+	if err != nil {
+		return nil, err
+	}
+	records, err := m.records()
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []database.NonceRecord
+	err = m.db.Update(func(dbtx database.Tx) error {
+		for _, record := range records {
+			if record.Nonce >= confirmed {
+				pending = append(pending, record)
+				continue
+			}
+			if err := dbtx.Delete("txid", record.Txid, &database.NonceRecord{}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	status := &NonceStatus{Confirmed: confirmed}
+	next := confirmed
+	for _, record := range pending {
+		for ; next < record.Nonce; next++ {
+			status.Gaps = append(status.Gaps, next)
+		}
+		next = record.Nonce + 1
+		if record.Nonce == confirmed && time.Since(record.UpdatedAt) >= stuckAfter {
+			status.Stuck = append(status.Stuck, pendingTransaction(record))
+		}
+	}
+	return status, nil
+}
+
+// records returns the account's saved transactions ordered by nonce.
+func (m *NonceManager) records() ([]database.NonceRecord, error) {
+	var records []database.NonceRecord
+	err := m.db.View(func(dbtx database.Tx) error {
+		return dbtx.Read().Where("account = ?", m.account.Hex()).Find(&records).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Nonce < records[j].Nonce
+	})
+	return records, nil
+}
+
+// record returns the saved transaction at the nonce or nil if there isn't
+// one.
+func (m *NonceManager) record(nonce uint64) (*database.NonceRecord, error) {
+	records, err := m.records()
+	if err != nil {
+		return nil, err
+	}
+	for i := range records {
+		if records[i].Nonce == nonce {
+			return &records[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// replacementGasPrice returns the gas price to replace a transaction with.
+// If requested is nil it's the lowest price nodes accept.
+func replacementGasPrice(old, requested *big.Int) (*big.Int, error) {
+	min := new(big.Int).Mul(old, big.NewInt(100+replacementBumpPercent))
+	min.Add(min, big.NewInt(99))
+	min.Div(min, big.NewInt(100))
+	if requested == nil {
+		return min, nil
+	}
+	if requested.Cmp(min) < 0 {
+		return nil, fmt.Errorf("%w: at least %s is required", ErrReplacementUnderpriced, min)
+	}
+	return requested, nil
+}
+
+func pendingTransaction(record database.NonceRecord) PendingTransaction {
+	gasPrice, _ := new(big.Int).SetString(record.GasPrice, 10)
+	pending := PendingTransaction{
+		Nonce:     record.Nonce,
+		Txid:      common.HexToHash(record.Txid),
+		GasPrice:  gasPrice,
+		Cancelled: record.Cancelled,
+		CreatedAt: record.CreatedAt,
+		UpdatedAt: record.UpdatedAt,
+	}
+	if record.Replaced != "" {
+		for _, txid := range strings.Split(record.Replaced, ",") {
+			pending.Replaced = append(pending.Replaced, common.HexToHash(txid))
+		}
+	}
+	return pending
+}
@@ -0,0 +1,268 @@
+package ethclient
+
+import (
+	"context"
+	"errors"
+	"github.com/cpacia/multiwallet/database"
+	"github.com/cpacia/multiwallet/database/sqlitedb"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"math/big"
+	"testing"
+	"time"
+)
+
+type mockNonceBackend struct {
+	pending   uint64
+	confirmed uint64
+	sent      []*types.Transaction
+}
+
+func (b *mockNonceBackend) PendingNonceAt(ctx context.Context, account common.Address) (uint64, error) {
+	return b.pending, nil
+}
+
+func (b *mockNonceBackend) NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error) {
+	return b.confirmed, nil
+}
+
+func (b *mockNonceBackend) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	b.sent = append(b.sent, tx)
+	if tx.Nonce() >= b.pending {
+		b.pending = tx.Nonce() + 1
+	}
+	return nil
+}
+
+func newTestNonceManager(t *testing.T) (*NonceManager, *mockNonceBackend, database.Database) {
+	db, err := sqlitedb.NewMemoryDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.InitializeDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(tx *types.Transaction) (*types.Transaction, error) {
+		return types.SignTx(tx, types.HomesteadSigner{}, key)
+	}
+	backend := &mockNonceBackend{pending: 5, confirmed: 5}
+	return NewNonceManager(db, backend, crypto.PubkeyToAddress(key.PublicKey), sign), backend, db
+}
+
+func TestNonceManager_Send(t *testing.T) {
+	m, backend, db := newTestNonceManager(t)
+	ctx := context.Background()
+	to := common.HexToAddress("0x52908400098527886E0F7030069857D2E4169EE7")
+
+	for i := uint64(5); i < 7; i++ {
+		tx, err := m.Send(ctx, to, big.NewInt(1000), transferGas, big.NewInt(1e9), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tx.Nonce() != i {
+			t.Errorf("Expected nonce %d, got %d", i, tx.Nonce())
+		}
+	}
+
+	// A restarted manager doesn't reuse nonces the node dropped.
+	backend.pending = 5
+	m = NewNonceManager(db, backend, m.account, m.sign)
+	nonce, err := m.NextNonce(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nonce != 7 {
+		t.Errorf("Expected nonce 7, got %d", nonce)
+	}
+
+	// Nonces used outside the manager are skipped.
+	backend.pending = 9
+	nonce, err = m.NextNonce(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nonce != 9 {
+		t.Errorf("Expected nonce 9, got %d", nonce)
+	}
+
+	pending, err := m.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 2 {
+		t.Fatalf("Expected 2 pending transactions, got %d", len(pending))
+	}
+	for i, p := range pending {
+		if p.Nonce != uint64(5+i) || p.Txid != backend.sent[i].Hash() {
+			t.Errorf("Unexpected pending transaction %d at nonce %d", i, p.Nonce)
+		}
+	}
+}
+
+func TestNonceManager_SpeedUpCancel(t *testing.T) {
+	m, backend, _ := newTestNonceManager(t)
+	ctx := context.Background()
+	to := common.HexToAddress("0x52908400098527886E0F7030069857D2E4169EE7")
+
+	orig, err := m.Send(ctx, to, big.NewInt(1000), 50000, big.NewInt(1e9), []byte{0x01})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.SpeedUp(ctx, 5, big.NewInt(1.05e9)); !errors.Is(err, ErrReplacementUnderpriced) {
+		t.Errorf("Expected ErrReplacementUnderpriced, got %v", err)
+	}
+	if _, err := m.SpeedUp(ctx, 6, nil); !errors.Is(err, ErrNonceNotPending) {
+		t.Errorf("Expected ErrNonceNotPending, got %v", err)
+	}
+
+	spedUp, err := m.SpeedUp(ctx, 5, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spedUp.Nonce() != 5 || spedUp.GasPrice().Cmp(big.NewInt(1.1e9)) != 0 {
+		t.Errorf("Expected nonce 5 at 1.1 gwei, got nonce %d at %s", spedUp.Nonce(), spedUp.GasPrice())
+	}
+	if *spedUp.To() != to || spedUp.Value().Cmp(orig.Value()) != 0 || spedUp.Gas() != orig.Gas() || string(spedUp.Data()) != string(orig.Data()) {
+		t.Error("Expected the replacement to be the original transaction")
+	}
+
+	cancel, err := m.Cancel(ctx, 5, big.NewInt(2e9))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cancel.Nonce() != 5 || *cancel.To() != m.account || cancel.Value().Sign() != 0 || cancel.Gas() != transferGas {
+		t.Error("Expected an empty transfer to the account at nonce 5")
+	}
+	if len(backend.sent) != 3 {
+		t.Errorf("Expected 3 broadcast transactions, got %d", len(backend.sent))
+	}
+
+	pending, err := m.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 {
+		t.Fatalf("Expected 1 pending transaction, got %d", len(pending))
+	}
+	p := pending[0]
+	if p.Txid != cancel.Hash() || !p.Cancelled || p.GasPrice.Cmp(big.NewInt(2e9)) != 0 {
+		t.Errorf("Expected the cancellation to be pending, got %s", p.Txid.Hex())
+	}
+	if len(p.Replaced) != 2 || p.Replaced[0] != orig.Hash() || p.Replaced[1] != spedUp.Hash() {
+		t.Errorf("Expected the original and sped up transactions to be replaced, got %v", p.Replaced)
+	}
+}
+
+func TestNonceManager_Sync(t *testing.T) {
+	m, backend, _ := newTestNonceManager(t)
+	ctx := context.Background()
+	to := common.HexToAddress("0x52908400098527886E0F7030069857D2E4169EE7")
+
+	for i := 0; i < 2; i++ {
+		if _, err := m.Send(ctx, to, big.NewInt(1000), transferGas, big.NewInt(1e9), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Nonces 7 and 8 were used elsewhere and dropped.
+	backend.pending = 9
+	if _, err := m.Send(ctx, to, big.NewInt(1000), transferGas, big.NewInt(1e9), nil); err != nil {
+		t.Fatal(err)
+	}
+	backend.confirmed = 6
+
+	status, err := m.Sync(ctx, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Confirmed != 6 {
+		t.Errorf("Expected confirmed nonce 6, got %d", status.Confirmed)
+	}
+	if len(status.Gaps) != 2 || status.Gaps[0] != 7 || status.Gaps[1] != 8 {
+		t.Errorf("Expected gaps at 7 and 8, got %v", status.Gaps)
+	}
+	if len(status.Stuck) != 0 {
+		t.Errorf("Expected no stuck transactions, got %d", len(status.Stuck))
+	}
+
+	status, err = m.Sync(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Stuck) != 1 || status.Stuck[0].Nonce != 6 {
+		t.Errorf("Expected the transaction at nonce 6 to be stuck, got %v", status.Stuck)
+	}
+
+	pending, err := m.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 2 || pending[0].Nonce != 6 || pending[1].Nonce != 9 {
+		t.Errorf("Expected transactions at 6 and 9 to be pending, got %v", pending)
+	}
+
+	// Gaps are filled by cancelling them.
+	if _, err := m.Cancel(ctx, 7, nil); err == nil {
+		t.Error("Expected an error filling a gap without a gas price")
+	}
+	if _, err := m.Cancel(ctx, 5, big.NewInt(1e9)); !errors.Is(err, ErrNonceNotPending) {
+		t.Errorf("Expected ErrNonceNotPending for a confirmed nonce, got %v", err)
+	}
+	for _, nonce := range []uint64{7, 8} {
+		if _, err := m.Cancel(ctx, nonce, big.NewInt(1e9)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	status, err = m.Sync(ctx, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Gaps) != 0 {
+		t.Errorf("Expected the gaps to be filled, got %v", status.Gaps)
+	}
+}
+
+func TestNonceManager_SignSendSigned(t *testing.T) {
+	m, backend, _ := newTestNonceManager(t)
+	ctx := context.Background()
+	to := common.HexToAddress("0x52908400098527886E0F7030069857D2E4169EE7")
+
+	signed, err := m.Sign(ctx, to, big.NewInt(1000), transferGas, big.NewInt(1e9), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signed.Nonce() != 5 {
+		t.Errorf("Expected nonce 5, got %d", signed.Nonce())
+	}
+	if len(backend.sent) != 0 {
+		t.Fatal("Expected Sign not to broadcast")
+	}
+
+	// Another transaction takes the nonce before the signed one is sent.
+	stale, err := m.Sign(ctx, to, big.NewInt(2000), transferGas, big.NewInt(1e9), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SendSigned(ctx, signed); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SendSigned(ctx, stale); !errors.Is(err, ErrNonceUsed) {
+		t.Errorf("Expected ErrNonceUsed, got %v", err)
+	}
+	if len(backend.sent) != 1 || backend.sent[0].Hash() != signed.Hash() {
+		t.Fatal("Expected only the first signed transaction to be broadcast")
+	}
+
+	pending, err := m.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].Nonce != 5 || pending[0].Txid != signed.Hash() {
+		t.Error("Expected the signed transaction to be pending at nonce 5")
+	}
+}
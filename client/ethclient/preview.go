@@ -0,0 +1,180 @@
+package ethclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/rpc"
+	"math/big"
+	"sync/atomic"
+)
+
+var (
+	// revertErrorSelector prefixes the reason of a require or revert
+	// with a message, encoded as Error(string).
+	revertErrorSelector = []byte{0x08, 0xc3, 0x79, 0xa0}
+
+	// revertPanicSelector prefixes the code of a failed assert or other
+	// panic, encoded as Panic(uint256).
+	revertPanicSelector = []byte{0x4e, 0x48, 0x7b, 0x71}
+)
+
+// SpendPreview is the result of simulating a spend before it's signed.
+type SpendPreview struct {
+	GasLimit uint64
+	GasPrice *big.Int
+
+	// MaxFee is the most the transaction can pay in fees, its gas limit
+	// times its gas price.
+	MaxFee *big.Int
+
+	// Failure is why the transaction would fail if it were sent, such as
+	// a revert reason or insufficient funds. It's empty if the simulation
+	// succeeded.
+	Failure string
+}
+
+// PreviewBackend is the part of the RPC client used to preview a spend.
+// It's implemented by *ethclient.Client.
+type PreviewBackend interface {
+	PendingCallContract(ctx context.Context, msg ethereum.CallMsg) ([]byte, error)
+	EstimateGas(ctx context.Context, msg ethereum.CallMsg) (uint64, error)
+	PendingBalanceAt(ctx context.Context, account common.Address) (*big.Int, error)
+}
+
+// WillFail returns whether the simulated transaction failed.
+func (p *SpendPreview) WillFail() bool {
+	return p.Failure != ""
+}
+
+// PreviewSpend simulates sending value from one address to another and
+// estimates its gas. If gasPrice is nil the node's suggested price is used.
+func (c *EthClient) PreviewSpend(from, to common.Address, value, gasPrice *big.Int) (*SpendPreview, error) {
+	if atomic.LoadUint32(&c.started) == 0 {
+		return nil, errors.New("rpc client not connected")
+	}
+	return c.previewCall(ethereum.CallMsg{From: from, To: &to, Value: value}, gasPrice)
+}
+
+// PreviewTokenSpend simulates a token transfer and estimates its gas. If
+// gasPrice is nil the node's suggested price is used.
+func (c *EthClient) PreviewTokenSpend(token, from, to common.Address, amount, gasPrice *big.Int) (*SpendPreview, error) {
+	if atomic.LoadUint32(&c.started) == 0 {
+		return nil, errors.New("rpc client not connected")
+	}
+	data, err := PackTokenTransfer(to, amount)
+	if err != nil {
+		return nil, err
+	}
+	return c.previewCall(ethereum.CallMsg{From: from, To: &token, Data: data}, gasPrice)
+}
+
+// previewCall previews the call at the gas price or, if it's nil, at the
+// node's suggested price.
+func (c *EthClient) previewCall(msg ethereum.CallMsg, gasPrice *big.Int) (*SpendPreview, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+	defer cancel()
+
+	if gasPrice == nil {
+		var err error
+		gasPrice, err = c.RPC.SuggestGasPrice(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return PreviewCall(ctx, c.RPC, msg, gasPrice, 0)
+}
+
+// PreviewCall runs the call with eth_call to find any revert, estimates its
+// gas and checks the sender can pay for it at the gas price. The gas
+// estimate is raised by gasMarginPercent for callers which send with a
+// margin over the estimate.
+func PreviewCall(ctx context.Context, backend PreviewBackend, msg ethereum.CallMsg, gasPrice *big.Int, gasMarginPercent uint64) (*SpendPreview, error) {
+	preview := &SpendPreview{
+		GasPrice: gasPrice,
+		MaxFee:   big.NewInt(0),
+	}
+
+	out, err := backend.PendingCallContract(ctx, msg)
+	if err != nil {
+		reason, ok := revertReason(err)
+		if !ok {
+			return nil, err
+		}
+		preview.Failure = reason
+		return preview, nil
+	}
+	// Token transfers which fail without reverting return false.
+	if len(msg.Data) > 0 && len(out) == 32 && new(big.Int).SetBytes(out).Sign() == 0 {
+		preview.Failure = "token transfer returned false"
+		return preview, nil
+	}
+
+	gas, err := backend.EstimateGas(ctx, msg)
+	if err != nil {
+		reason, ok := revertReason(err)
+		if !ok {
+			return nil, err
+		}
+		preview.Failure = reason
+		return preview, nil
+	}
+	preview.GasLimit = gas + gas*gasMarginPercent/100
+	preview.MaxFee = new(big.Int).Mul(gasPrice, new(big.Int).SetUint64(preview.GasLimit))
+
+	balance, err := backend.PendingBalanceAt(ctx, msg.From)
+	if err != nil {
+		return nil, err
+	}
+	cost := new(big.Int).Set(preview.MaxFee)
+	if msg.Value != nil {
+		cost.Add(cost, msg.Value)
+	}
+	if balance.Cmp(cost) < 0 {
+		preview.Failure = fmt.Sprintf("insufficient funds: balance %s, need %s", balance, cost)
+	}
+	return preview, nil
+}
+
+// revertReason returns why an eth_call or eth_estimateGas failed if the
+// error is from executing the transaction rather than from the
+// connection.
+func revertReason(err error) (string, bool) {
+	var rpcErr rpc.Error
+	if !errors.As(err, &rpcErr) {
+		return "", false
+	}
+	if dataErr, ok := rpcErr.(rpc.DataError); ok {
+		if s, ok := dataErr.ErrorData().(string); ok {
+			if data, err := hexutil.Decode(s); err == nil {
+				if reason, ok := decodeRevert(data); ok {
+					return reason, true
+				}
+			}
+		}
+	}
+	return err.Error(), true
+}
+
+// decodeRevert decodes the Error(string) or Panic(uint256) data returned by
+// a reverted call.
+func decodeRevert(data []byte) (string, bool) {
+	if len(data) < 4 {
+		return "", false
+	}
+	switch {
+	case bytes.Equal(data[:4], revertErrorSelector):
+		reason, err := unpackABIString(data[4:])
+		if err != nil {
+			return "", false
+		}
+		return "execution reverted: " + reason, true
+	case bytes.Equal(data[:4], revertPanicSelector) && len(data) == 36:
+		return fmt.Sprintf("execution reverted: panic code 0x%x", new(big.Int).SetBytes(data[4:])), true
+	}
+	return "", false
+}
@@ -0,0 +1,49 @@
+package ethclient
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"testing"
+)
+
+type mockRPCError struct {
+	data interface{}
+}
+
+func (e *mockRPCError) Error() string          { return "execution reverted" }
+func (e *mockRPCError) ErrorCode() int         { return 3 }
+func (e *mockRPCError) ErrorData() interface{} { return e.data }
+
+func TestRevertReason(t *testing.T) {
+	data := append([]byte{}, revertErrorSelector...)
+	word := make([]byte, 96)
+	word[31] = 0x20
+	word[63] = 18
+	copy(word[64:], "insufficient funds")
+	data = append(data, word...)
+
+	panicData := append(append([]byte{}, revertPanicSelector...), make([]byte, 32)...)
+	panicData[35] = 0x11
+
+	tests := []struct {
+		err    error
+		reason string
+		ok     bool
+	}{
+		{&mockRPCError{hexutil.Encode(data)}, "execution reverted: insufficient funds", true},
+		{fmt.Errorf("call: %w", &mockRPCError{hexutil.Encode(panicData)}), "execution reverted: panic code 0x11", true},
+		{&mockRPCError{nil}, "execution reverted", true},
+		{&mockRPCError{"0x1234"}, "execution reverted", true},
+		{errors.New("connection refused"), "", false},
+	}
+	for i, test := range tests {
+		reason, ok := revertReason(test.err)
+		if ok != test.ok {
+			t.Errorf("Test %d: expected ok %t, got %t", i, test.ok, ok)
+		}
+		if ok && reason != test.reason {
+			t.Errorf("Test %d: expected reason %q, got %q", i, test.reason, reason)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package ethclient
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
+	"math/big"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const paymentURIScheme = "ethereum:"
+
+// PaymentURI is an EIP-681 payment request. For a plain payment Target
+// is the recipient and Value the amount in wei. For a token payment
+// Function is transfer, Target is the token contract and the recipient
+// and amount are the address and uint256 parameters.
+type PaymentURI struct {
+	// Target is a hex address or an ENS name.
+	Target   string
+	ChainID  *big.Int
+	Function string
+	Value    *big.Int
+	GasLimit uint64
+	GasPrice *big.Int
+
+	// Params are the function parameters.
+	Params map[string]string
+}
+
+// ParsePaymentURI parses an ethereum: payment URI.
+func ParsePaymentURI(s string) (*PaymentURI, error) {
+	if len(s) < len(paymentURIScheme) || !strings.EqualFold(s[:len(paymentURIScheme)], paymentURIScheme) {
+		return nil, errors.New("not an ethereum: uri")
+	}
+	rest := strings.TrimPrefix(s[len(paymentURIScheme):], "pay-")
+
+	u := &PaymentURI{Params: make(map[string]string)}
+	var query string
+	if i := strings.IndexByte(rest, '?'); i >= 0 {
+		rest, query = rest[:i], rest[i+1:]
+	}
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		rest, u.Function = rest[:i], rest[i+1:]
+		if u.Function == "" {
+			return nil, errors.New("empty function name in uri")
+		}
+	}
+	if i := strings.IndexByte(rest, '@'); i >= 0 {
+		chainID, ok := new(big.Int).SetString(rest[i+1:], 10)
+		if !ok || chainID.Sign() <= 0 {
+			return nil, fmt.Errorf("invalid chain id %q in uri", rest[i+1:])
+		}
+		rest, u.ChainID = rest[:i], chainID
+	}
+	if !common.IsHexAddress(rest) && !IsENSName(rest) {
+		return nil, fmt.Errorf("invalid target %q in uri", rest)
+	}
+	u.Target = rest
+
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	for key, vals := range values {
+		if len(vals) != 1 {
+			return nil, fmt.Errorf("uri parameter %s is repeated", key)
+		}
+		v := vals[0]
+		switch key {
+		case "value":
+			if u.Value, err = parseURINumber(v); err != nil {
+				return nil, err
+			}
+		case "gas", "gasLimit":
+			n, err := parseURINumber(v)
+			if err != nil {
+				return nil, err
+			}
+			if !n.IsUint64() {
+				return nil, fmt.Errorf("gas limit %s is too large", v)
+			}
+			u.GasLimit = n.Uint64()
+		case "gasPrice":
+			if u.GasPrice, err = parseURINumber(v); err != nil {
+				return nil, err
+			}
+		default:
+			u.Params[key] = v
+		}
+	}
+
+	if u.Function == "transfer" {
+		to := u.Params["address"]
+		if !common.IsHexAddress(to) && !IsENSName(to) {
+			return nil, fmt.Errorf("invalid transfer address %q in uri", to)
+		}
+		if _, err := parseURINumber(u.Params["uint256"]); err != nil {
+			return nil, err
+		}
+	}
+	return u, nil
+}
+
+// Recipient returns the address or ENS name being paid.
+func (u *PaymentURI) Recipient() string {
+	if u.Function == "transfer" {
+		return u.Params["address"]
+	}
+	return u.Target
+}
+
+// Amount returns the amount being paid in wei or, for a token transfer,
+// in the token's base units. It's zero if the URI doesn't set one.
+func (u *PaymentURI) Amount() *big.Int {
+	if u.Function == "transfer" {
+		amount, _ := parseURINumber(u.Params["uint256"])
+		return amount
+	}
+	if u.Value == nil {
+		return big.NewInt(0)
+	}
+	return new(big.Int).Set(u.Value)
+}
+
+// String returns the URI.
+func (u *PaymentURI) String() string {
+	s := paymentURIScheme + u.Target
+	if u.ChainID != nil {
+		s += "@" + u.ChainID.String()
+	}
+	if u.Function != "" {
+		s += "/" + u.Function
+	}
+
+	values := make(url.Values)
+	for key, v := range u.Params {
+		values.Set(key, v)
+	}
+	if u.Value != nil {
+		values.Set("value", u.Value.String())
+	}
+	if u.GasLimit != 0 {
+		values.Set("gas", strconv.FormatUint(u.GasLimit, 10))
+	}
+	if u.GasPrice != nil {
+		values.Set("gasPrice", u.GasPrice.String())
+	}
+	if len(values) > 0 {
+		s += "?" + values.Encode()
+	}
+	return s
+}
+
+// parseURINumber parses a non-negative integer in EIP-681's number format,
+// which allows a decimal point and exponent such as 2.014e18.
+func parseURINumber(s string) (*big.Int, error) {
+	if s == "" || strings.Trim(s, "0123456789.eE+") != "" {
+		return nil, fmt.Errorf("invalid number %q in uri", s)
+	}
+	r, ok := new(big.Rat).SetString(s)
+	if !ok || !r.IsInt() {
+		return nil, fmt.Errorf("invalid number %q in uri", s)
+	}
+	return new(big.Int).Set(r.Num()), nil
+}
@@ -0,0 +1,119 @@
+package ethclient
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"math/big"
+	"testing"
+)
+
+func TestParsePaymentURI(t *testing.T) {
+	u, err := ParsePaymentURI("ethereum:0xfb6916095ca1df60bb79Ce92ce3ea74c37c5d359?value=2.014e18")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Recipient() != "0xfb6916095ca1df60bb79Ce92ce3ea74c37c5d359" {
+		t.Errorf("Unexpected recipient %s", u.Recipient())
+	}
+	if u.Amount().String() != "2014000000000000000" {
+		t.Errorf("Expected amount 2014000000000000000, got %s", u.Amount())
+	}
+
+	u, err = ParsePaymentURI("ethereum:pay-0x89205a3a3b2a69de6dbf7f01ed13b2108b2c43e7@1/transfer?address=alice.eth&uint256=1e6&gas=60000&gasPrice=2e9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Target != "0x89205a3a3b2a69de6dbf7f01ed13b2108b2c43e7" || u.ChainID.Int64() != 1 || u.Function != "transfer" {
+		t.Errorf("Unexpected token transfer %s", u)
+	}
+	if u.Recipient() != "alice.eth" || u.Amount().Int64() != 1000000 {
+		t.Errorf("Expected 1000000 to alice.eth, got %s to %s", u.Amount(), u.Recipient())
+	}
+	if u.GasLimit != 60000 || u.GasPrice.Cmp(big.NewInt(2e9)) != 0 {
+		t.Errorf("Expected gas 60000 at 2e9, got %d at %s", u.GasLimit, u.GasPrice)
+	}
+
+	u, err = ParsePaymentURI("ETHEREUM:vitalik.eth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Recipient() != "vitalik.eth" || u.Amount().Sign() != 0 {
+		t.Errorf("Unexpected payment %s", u)
+	}
+	if u.String() != "ethereum:vitalik.eth" {
+		t.Errorf("Expected ethereum:vitalik.eth, got %s", u)
+	}
+
+	for _, s := range []string{
+		"bitcoin:0xfb6916095ca1df60bb79Ce92ce3ea74c37c5d359",
+		"ethereum:0xfb6916095ca1df60bb79",
+		"ethereum:0xfb6916095ca1df60bb79Ce92ce3ea74c37c5d359?value=1.5",
+		"ethereum:0xfb6916095ca1df60bb79Ce92ce3ea74c37c5d359?value=-1",
+		"ethereum:0xfb6916095ca1df60bb79Ce92ce3ea74c37c5d359@x",
+		"ethereum:0xfb6916095ca1df60bb79Ce92ce3ea74c37c5d359?value=1&value=2",
+		"ethereum:0x89205a3a3b2a69de6dbf7f01ed13b2108b2c43e7/transfer?address=bob&uint256=1",
+		"ethereum:0x89205a3a3b2a69de6dbf7f01ed13b2108b2c43e7/transfer?address=alice.eth",
+	} {
+		if _, err := ParsePaymentURI(s); err == nil {
+			t.Errorf("Expected an error parsing %s", s)
+		}
+	}
+}
+
+func TestNamehash(t *testing.T) {
+	// Test vectors from EIP-137.
+	tests := map[string]string{
+		"":        "0x0000000000000000000000000000000000000000000000000000000000000000",
+		"eth":     "0x93cdeb708b7545dc668eb9280176169d1c33cfd8ed6f04690a0bcc88a93fc4ae",
+		"foo.eth": "0xde9b09fd7c5f901e23a3f19fecc54828e9c848539801e86591bd9801b019f84f",
+		"Foo.ETH": "0xde9b09fd7c5f901e23a3f19fecc54828e9c848539801e86591bd9801b019f84f",
+	}
+	for name, expected := range tests {
+		if node := Namehash(name); node.Hex() != expected {
+			t.Errorf("%q: expected %s, got %s", name, expected, node.Hex())
+		}
+	}
+}
+
+func TestEthClient_ResolveAddress(t *testing.T) {
+	c := &EthClient{}
+	for _, s := range []string{
+		"0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed",
+		"0x5aaeb6053f3e94c9b9a09f33669435e7ef1beaed",
+		"ethereum:0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed?value=1e18",
+	} {
+		addr, err := c.ResolveAddress(s)
+		if err != nil {
+			t.Fatalf("%s: %s", s, err)
+		}
+		if addr != common.HexToAddress("0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed") {
+			t.Errorf("%s: unexpected address %s", s, addr.Hex())
+		}
+	}
+	for _, s := range []string{
+		"0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAeD",
+		"alice",
+		"vitalik.eth",
+	} {
+		if _, err := c.ResolveAddress(s); err == nil {
+			t.Errorf("Expected an error resolving %s", s)
+		}
+	}
+}
+
+func TestUnpackABIString(t *testing.T) {
+	out := make([]byte, 96)
+	out[31] = 0x20
+	out[63] = 9
+	copy(out[64:], "alice.eth")
+	name, err := unpackABIString(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "alice.eth" {
+		t.Errorf("Expected alice.eth, got %s", name)
+	}
+	out[63] = 40
+	if _, err := unpackABIString(out); err == nil {
+		t.Error("Expected an error for a string longer than the response")
+	}
+}
@@ -0,0 +1,193 @@
+package spv
+
+import (
+	"errors"
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// maxLocatorHashes bounds the size of the block locator sent with
+// getheaders.
+const maxLocatorHashes = 64
+
+// errHeadersDoNotConnect is returned when a batch of headers doesn't build
+// on any header in the chain.
+var errHeadersDoNotConnect = errors.New("headers do not connect to chain")
+
+// headerChain is the in-memory chain of block headers, starting at the
+// genesis block. Headers are checked to link to their parent and to meet
+// the proof of work their bits commit to. Difficulty retargeting is not
+// checked, so the chain trusts that the peer isn't feeding us a low
+// difficulty fork; the heaviest chain is still always preferred.
+type headerChain struct {
+	mtx     sync.RWMutex
+	params  *chaincfg.Params
+	headers []wire.BlockHeader
+	hashes  []chainhash.Hash
+	heights map[chainhash.Hash]uint64
+}
+
+func newHeaderChain(params *chaincfg.Params) *headerChain {
+	genesis := params.GenesisBlock.Header
+	return &headerChain{
+		params:  params,
+		headers: []wire.BlockHeader{genesis},
+		hashes:  []chainhash.Hash{*params.GenesisHash},
+		heights: map[chainhash.Hash]uint64{*params.GenesisHash: 0},
+	}
+}
+
+// tip returns the best header and its height.
+func (hc *headerChain) tip() (wire.BlockHeader, uint64) {
+	hc.mtx.RLock()
+	defer hc.mtx.RUnlock()
+	height := uint64(len(hc.headers) - 1)
+	return hc.headers[height], height
+}
+
+// hashAt returns the hash of the block at height in the best chain.
+func (hc *headerChain) hashAt(height uint64) (chainhash.Hash, bool) {
+	hc.mtx.RLock()
+	defer hc.mtx.RUnlock()
+	if height >= uint64(len(hc.hashes)) {
+		return chainhash.Hash{}, false
+	}
+	return hc.hashes[height], true
+}
+
+// headerAt returns the header at height in the best chain.
+func (hc *headerChain) headerAt(height uint64) (wire.BlockHeader, bool) {
+	hc.mtx.RLock()
+	defer hc.mtx.RUnlock()
+	if height >= uint64(len(hc.headers)) {
+		return wire.BlockHeader{}, false
+	}
+	return hc.headers[height], true
+}
+
+// heightOf returns the height of the block if it's in the best chain.
+func (hc *headerChain) heightOf(hash chainhash.Hash) (uint64, bool) {
+	hc.mtx.RLock()
+	defer hc.mtx.RUnlock()
+	height, ok := hc.heights[hash]
+	return height, ok
+}
+
+// heightAtTime returns the height of the last block with a timestamp
+// before t, or zero if there is none.
+func (hc *headerChain) heightAtTime(t time.Time) uint64 {
+	hc.mtx.RLock()
+	defer hc.mtx.RUnlock()
+	var height uint64
+	for i, header := range hc.headers {
+		if !header.Timestamp.Before(t) {
+			break
+		}
+		height = uint64(i)
+	}
+	return height
+}
+
+// locator returns a block locator for the best chain. It contains the ten
+// most recent hashes followed by hashes exponentially further back and
+// ends with the genesis hash.
+func (hc *headerChain) locator() []*chainhash.Hash {
+	hc.mtx.RLock()
+	defer hc.mtx.RUnlock()
+
+	var (
+		locator []*chainhash.Hash
+		step    = 1
+		height  = len(hc.hashes) - 1
+	)
+	for height > 0 && len(locator) < maxLocatorHashes-1 {
+		hash := hc.hashes[height]
+		locator = append(locator, &hash)
+		if len(locator) >= 10 {
+			step *= 2
+		}
+		height -= step
+	}
+	genesis := hc.hashes[0]
+	return append(locator, &genesis)
+}
+
+// connect adds the headers to the chain. If they fork from the best chain
+// they replace it only if they have more work. It returns whether the best
+// chain changed and the height of the last block the old and new chains
+// have in common.
+func (hc *headerChain) connect(headers []*wire.BlockHeader) (bool, uint64, error) {
+	hc.mtx.Lock()
+	defer hc.mtx.Unlock()
+
+	if len(headers) == 0 {
+		return false, 0, nil
+	}
+	forkHeight, ok := hc.heights[headers[0].PrevBlock]
+	if !ok {
+		return false, 0, errHeadersDoNotConnect
+	}
+
+	prevHash := headers[0].PrevBlock
+	for _, header := range headers {
+		if header.PrevBlock != prevHash {
+			return false, 0, errors.New("headers are not continuous")
+		}
+		if err := hc.checkProofOfWork(header); err != nil {
+			return false, 0, err
+		}
+		prevHash = header.BlockHash()
+	}
+
+	// Skip any headers we already have.
+	for len(headers) > 0 && forkHeight+1 < uint64(len(hc.hashes)) && hc.hashes[forkHeight+1] == headers[0].BlockHash() {
+		forkHeight++
+		headers = headers[1:]
+	}
+	if len(headers) == 0 {
+		return false, forkHeight, nil
+	}
+
+	if forkHeight+1 < uint64(len(hc.headers)) {
+		oldWork, newWork := new(big.Int), new(big.Int)
+		for _, header := range hc.headers[forkHeight+1:] {
+			oldWork.Add(oldWork, blockchain.CalcWork(header.Bits))
+		}
+		for _, header := range headers {
+			newWork.Add(newWork, blockchain.CalcWork(header.Bits))
+		}
+		if newWork.Cmp(oldWork) <= 0 {
+			return false, forkHeight, nil
+		}
+		for _, hash := range hc.hashes[forkHeight+1:] {
+			delete(hc.heights, hash)
+		}
+		hc.headers = hc.headers[:forkHeight+1]
+		hc.hashes = hc.hashes[:forkHeight+1]
+	}
+
+	for _, header := range headers {
+		hash := header.BlockHash()
+		hc.headers = append(hc.headers, *header)
+		hc.hashes = append(hc.hashes, hash)
+		hc.heights[hash] = uint64(len(hc.hashes) - 1)
+	}
+	return true, forkHeight, nil
+}
+
+func (hc *headerChain) checkProofOfWork(header *wire.BlockHeader) error {
+	target := blockchain.CompactToBig(header.Bits)
+	if target.Sign() <= 0 || target.Cmp(hc.params.PowLimit) > 0 {
+		return errors.New("header target is out of range")
+	}
+	hash := header.BlockHash()
+	if blockchain.HashToBig(&hash).Cmp(target) > 0 {
+		return errors.New("header hash is above target")
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package spv
+
+import (
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"testing"
+	"time"
+)
+
+// mineHeaders returns n regtest headers building on prev.
+func mineHeaders(hc *headerChain, prev chainhash.Hash, n int, salt uint32) []*wire.BlockHeader {
+	headers := make([]*wire.BlockHeader, 0, n)
+	for i := 0; i < n; i++ {
+		header := &wire.BlockHeader{
+			Version:   1,
+			PrevBlock: prev,
+			Timestamp: time.Unix(1577836800+int64(i)*600, 0),
+			Bits:      chaincfg.RegressionNetParams.PowLimitBits,
+			Nonce:     salt << 16,
+		}
+		for hc.checkProofOfWork(header) != nil {
+			header.Nonce++
+		}
+		headers = append(headers, header)
+		prev = header.BlockHash()
+	}
+	return headers
+}
+
+func TestHeaderChain_Connect(t *testing.T) {
+	hc := newHeaderChain(&chaincfg.RegressionNetParams)
+
+	headers := mineHeaders(hc, *chaincfg.RegressionNetParams.GenesisHash, 10, 0)
+	changed, _, err := hc.connect(headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Error("Expected chain to change")
+	}
+	tip, height := hc.tip()
+	if height != 10 || tip.BlockHash() != headers[9].BlockHash() {
+		t.Errorf("Expected tip at height 10, got %d", height)
+	}
+
+	// Connecting the same headers again is a no-op.
+	changed, _, err = hc.connect(headers[5:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed {
+		t.Error("Expected chain not to change")
+	}
+
+	// A shorter fork is ignored.
+	fork := mineHeaders(hc, headers[6].BlockHash(), 2, 1)
+	changed, _, err = hc.connect(fork)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed {
+		t.Error("Expected shorter fork to be ignored")
+	}
+
+	// A longer fork replaces the best chain.
+	fork = mineHeaders(hc, headers[6].BlockHash(), 5, 2)
+	changed, forkHeight, err := hc.connect(fork)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed || forkHeight != 7 {
+		t.Errorf("Expected reorg at height 7, got %d", forkHeight)
+	}
+	_, height = hc.tip()
+	if height != 12 {
+		t.Errorf("Expected tip at height 12, got %d", height)
+	}
+	if _, ok := hc.heightOf(headers[9].BlockHash()); ok {
+		t.Error("Expected orphaned header to be removed")
+	}
+
+	// Headers which don't connect or don't meet their target are rejected.
+	if _, _, err := hc.connect(mineHeaders(hc, chainhash.Hash{1}, 1, 3)); err != errHeadersDoNotConnect {
+		t.Errorf("Expected errHeadersDoNotConnect, got %v", err)
+	}
+	bad := mineHeaders(hc, fork[4].BlockHash(), 1, 4)
+	for hc.checkProofOfWork(bad[0]) == nil {
+		bad[0].Nonce++
+	}
+	if _, _, err := hc.connect(bad); err == nil {
+		t.Error("Expected error for invalid proof of work")
+	}
+}
+
+func TestHeaderChain_Locator(t *testing.T) {
+	hc := newHeaderChain(&chaincfg.RegressionNetParams)
+	if _, _, err := hc.connect(mineHeaders(hc, *chaincfg.RegressionNetParams.GenesisHash, 100, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	locator := hc.locator()
+	tip, _ := hc.tip()
+	if *locator[0] != tip.BlockHash() {
+		t.Error("Expected locator to start at the tip")
+	}
+	if *locator[len(locator)-1] != *chaincfg.RegressionNetParams.GenesisHash {
+		t.Error("Expected locator to end at genesis")
+	}
+	if len(locator) > 20 {
+		t.Errorf("Expected sparse locator, got %d hashes", len(locator))
+	}
+}
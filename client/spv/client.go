@@ -0,0 +1,1069 @@
+// Package spv implements a Bitcoin ChainClient which uses BIP157/158
+// compact block filters in the style of Neutrino instead of a trusted
+// indexer. Headers are downloaded from full node peers, each block's filter
+// is matched against the wallet's scripts locally and only the matching
+// blocks are downloaded.
+package spv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/peer"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/gcs"
+	"github.com/btcsuite/btcutil/gcs/builder"
+	"github.com/cenkalti/backoff"
+	"github.com/cpacia/multiwallet/base"
+	iwallet "github.com/cpacia/wallet-interface"
+	"math/rand"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Scheme is the ClientURL scheme which selects the SPV client. For example:
+//
+//	spv://127.0.0.1:8333,node.example.com:8333?birthday=1577836800
+//
+// The network query parameter selects testnet3 or regtest.
+const Scheme = "spv"
+
+const (
+	// queryTimeout is how long to wait for a peer to answer a request.
+	queryTimeout = time.Second * 30
+
+	// dialTimeout is how long to wait to connect to a peer.
+	dialTimeout = time.Second * 10
+
+	// birthdaySlack is subtracted from the birthday before it's converted
+	// to a height to allow for inaccurate block timestamps.
+	birthdaySlack = time.Hour * 24
+)
+
+// Config holds the peers and network for an SPVClient.
+type Config struct {
+	// Peers are the host:port addresses of full nodes which serve
+	// compact block filters. They are tried in order. Since a peer can
+	// hide transactions by omitting them from its filters they should
+	// be nodes the operator trusts, such as their own.
+	Peers []string
+
+	Params *chaincfg.Params
+
+	// Birthday is the creation time of the wallet. Blocks before it are
+	// not scanned.
+	Birthday time.Time
+}
+
+// IsSPVURL returns whether the ClientURL selects the SPV client.
+func IsSPVURL(clientURL string) bool {
+	return strings.HasPrefix(clientURL, Scheme+"://")
+}
+
+// ParseURL returns the Config for a ClientURL using the Scheme.
+func ParseURL(clientURL string) (*Config, error) {
+	u, err := url.Parse(clientURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != Scheme {
+		return nil, fmt.Errorf("invalid spv url scheme %s", u.Scheme)
+	}
+	cfg := &Config{
+		Params: &chaincfg.MainNetParams,
+	}
+	for _, addr := range strings.Split(u.Host, ",") {
+		if addr != "" {
+			cfg.Peers = append(cfg.Peers, addr)
+		}
+	}
+	if len(cfg.Peers) == 0 {
+		return nil, errors.New("spv url must include at least one peer")
+	}
+
+	query := u.Query()
+	switch query.Get("network") {
+	case "", "mainnet":
+	case "testnet3":
+		cfg.Params = &chaincfg.TestNet3Params
+	case "regtest":
+		cfg.Params = &chaincfg.RegressionNetParams
+	default:
+		return nil, fmt.Errorf("unknown network %s", query.Get("network"))
+	}
+	if birthday := query.Get("birthday"); birthday != "" {
+		ts, err := strconv.ParseInt(birthday, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid birthday: %s", err)
+		}
+		cfg.Birthday = time.Unix(ts, 0)
+	}
+	return cfg, nil
+}
+
+type transactionSub struct {
+	sub   *base.TransactionSubscription
+	addrs map[string]bool
+}
+
+// watchedScript is an output script the client matches filters against.
+// scanned is false until the blocks before nextHeight have been checked
+// for it.
+type watchedScript struct {
+	script  []byte
+	scanned bool
+}
+
+// SPVClient is a ChainClient which finds the wallet's transactions using
+// compact block filters. Transactions are only known once the block or
+// mempool announcement containing them has been processed, so
+// GetTransaction can't look up arbitrary transactions and inputs spending
+// outputs which aren't the wallet's have no address or amount.
+type SPVClient struct {
+	cfg      *Config
+	coinType iwallet.CoinType
+	chain    *headerChain
+	synced   uint32
+
+	peerMtx     sync.RWMutex
+	peer        *peer.Peer
+	queryMtx    sync.Mutex
+	syncMtx     sync.Mutex
+	headersChan chan *wire.MsgHeaders
+	filterChan  chan *wire.MsgCFilter
+	blockChan   chan *wire.MsgBlock
+
+	// walletMtx guards the state below. It's held for the duration of a
+	// scan.
+	walletMtx   sync.Mutex
+	watched     map[string]*watchedScript
+	startHeight uint64
+	nextHeight  uint64
+	addrIndex   map[string]map[iwallet.TransactionID]bool
+	txIndex     map[iwallet.TransactionID]iwallet.Transaction
+	outpoints   map[wire.OutPoint]iwallet.SpendInfo
+	proofs      map[iwallet.TransactionID]*base.MerkleProof
+
+	subMtx    sync.Mutex
+	started   uint32
+	stopped   uint32
+	shutdown  chan struct{}
+	txSubs    map[int32]*transactionSub
+	blockSubs map[int32]*base.BlockSubscription
+
+	mempoolSubs map[int32]*base.MempoolSubscription
+}
+
+// NewSPVClient returns a new SPVClient. It doesn't connect to a peer until
+// Open is called.
+func NewSPVClient(cfg *Config, coinType iwallet.CoinType) (*SPVClient, error) {
+	if len(cfg.Peers) == 0 {
+		return nil, errors.New("no peers configured")
+	}
+	if cfg.Params == nil {
+		cfg.Params = &chaincfg.MainNetParams
+	}
+	return &SPVClient{
+		cfg:         cfg,
+		coinType:    coinType,
+		chain:       newHeaderChain(cfg.Params),
+		headersChan: make(chan *wire.MsgHeaders, 1),
+		filterChan:  make(chan *wire.MsgCFilter, wire.MaxGetCFiltersReqRange),
+		blockChan:   make(chan *wire.MsgBlock, 1),
+		watched:     make(map[string]*watchedScript),
+		addrIndex:   make(map[string]map[iwallet.TransactionID]bool),
+		txIndex:     make(map[iwallet.TransactionID]iwallet.Transaction),
+		outpoints:   make(map[wire.OutPoint]iwallet.SpendInfo),
+		proofs:      make(map[iwallet.TransactionID]*base.MerkleProof),
+		shutdown:    make(chan struct{}),
+		txSubs:      make(map[int32]*transactionSub),
+		blockSubs:   make(map[int32]*base.BlockSubscription),
+		mempoolSubs: make(map[int32]*base.MempoolSubscription),
+	}, nil
+}
+
+func (c *SPVClient) GetBlockchainInfo() (iwallet.BlockInfo, error) {
+	if atomic.LoadUint32(&c.synced) == 0 {
+		return iwallet.BlockInfo{}, errors.New("headers are not synced")
+	}
+	header, height := c.chain.tip()
+	return iwallet.BlockInfo{
+		BlockID:   iwallet.BlockID(header.BlockHash().String()),
+		PrevBlock: iwallet.BlockID(header.PrevBlock.String()),
+		Height:    height,
+		BlockTime: header.Timestamp,
+	}, nil
+}
+
+func (c *SPVClient) GetAddressTransactions(addr iwallet.Address, fromHeight uint64) ([]iwallet.Transaction, error) {
+	if atomic.LoadUint32(&c.synced) == 0 {
+		return nil, errors.New("headers are not synced")
+	}
+
+	c.walletMtx.Lock()
+	defer c.walletMtx.Unlock()
+
+	if err := c.watch(addr); err != nil {
+		return nil, err
+	}
+	if _, err := c.catchUp(); err != nil {
+		return nil, err
+	}
+
+	var txs []iwallet.Transaction
+	for txid := range c.addrIndex[addr.String()] {
+		tx := c.txIndex[txid]
+		if tx.Height == 0 || tx.Height >= fromHeight {
+			txs = append(txs, tx)
+		}
+	}
+	sort.Slice(txs, func(i, j int) bool {
+		return txs[i].Height < txs[j].Height
+	})
+	return txs, nil
+}
+
+func (c *SPVClient) GetTransaction(id iwallet.TransactionID) (iwallet.Transaction, error) {
+	c.walletMtx.Lock()
+	defer c.walletMtx.Unlock()
+
+	tx, ok := c.txIndex[id]
+	if !ok {
+		return iwallet.Transaction{}, errors.New("transaction not found")
+	}
+	return tx, nil
+}
+
+// GetMerkleProof returns the proof recorded when the transaction's block
+// was downloaded.
+func (c *SPVClient) GetMerkleProof(id iwallet.TransactionID) (*base.MerkleProof, error) {
+	c.walletMtx.Lock()
+	defer c.walletMtx.Unlock()
+
+	proof, ok := c.proofs[id]
+	if !ok {
+		return nil, errors.New("merkle proof not found")
+	}
+	return proof, nil
+}
+
+// GetBlockHeaders returns headers from the synced header chain.
+func (c *SPVClient) GetBlockHeaders(fromHeight uint64, count int) ([]wire.BlockHeader, error) {
+	headers := make([]wire.BlockHeader, 0, count)
+	for height := fromHeight; len(headers) < count; height++ {
+		header, ok := c.chain.headerAt(height)
+		if !ok {
+			break
+		}
+		headers = append(headers, header)
+	}
+	return headers, nil
+}
+
+func (c *SPVClient) IsBlockInMainChain(block iwallet.BlockInfo) (bool, error) {
+	hash, err := chainhash.NewHashFromStr(block.BlockID.String())
+	if err != nil {
+		return false, err
+	}
+	_, ok := c.chain.heightOf(*hash)
+	return ok, nil
+}
+
+func (c *SPVClient) SubscribeTransactions(addrs []iwallet.Address) (*base.TransactionSubscription, error) {
+	if atomic.LoadUint32(&c.started) == 0 {
+		return nil, errors.New("spv client not connected")
+	}
+
+	// Watching the addresses here means the first scan covers all of
+	// them instead of scanning the chain once per address.
+	c.walletMtx.Lock()
+	for _, addr := range addrs {
+		if err := c.watch(addr); err != nil {
+			c.walletMtx.Unlock()
+			return nil, err
+		}
+	}
+	c.walletMtx.Unlock()
+
+	sub := &base.TransactionSubscription{
+		Out:         make(chan iwallet.Transaction),
+		Subscribe:   make(chan []iwallet.Address),
+		Unsubscribe: make(chan []iwallet.Address),
+	}
+
+	addrMap := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		addrMap[addr.String()] = true
+	}
+
+	c.subMtx.Lock()
+	id := rand.Int31()
+	c.txSubs[id] = &transactionSub{
+		sub:   sub,
+		addrs: addrMap,
+	}
+	c.subMtx.Unlock()
+
+	subClose := make(chan struct{})
+
+	sub.Close = func() {
+		close(subClose)
+		c.subMtx.Lock()
+		delete(c.txSubs, id)
+		c.subMtx.Unlock()
+		close(sub.Out)
+	}
+
+	go func() {
+		for {
+			select {
+			case <-subClose:
+				return
+			case <-c.shutdown:
+				return
+			case addrs := <-sub.Subscribe:
+				c.walletMtx.Lock()
+				for _, addr := range addrs {
+					c.watch(addr)
+				}
+				c.walletMtx.Unlock()
+				c.subMtx.Lock()
+				for _, addr := range addrs {
+					addrMap[addr.String()] = true
+				}
+				c.subMtx.Unlock()
+			case addrs := <-sub.Unsubscribe:
+				c.subMtx.Lock()
+				for _, addr := range addrs {
+					delete(addrMap, addr.String())
+				}
+				c.subMtx.Unlock()
+			}
+		}
+	}()
+
+	return sub, nil
+}
+
+func (c *SPVClient) SubscribeBlocks() (*base.BlockSubscription, error) {
+	if atomic.LoadUint32(&c.started) == 0 {
+		return nil, errors.New("spv client not connected")
+	}
+
+	c.subMtx.Lock()
+	defer c.subMtx.Unlock()
+
+	sub := &base.BlockSubscription{
+		Out: make(chan iwallet.BlockInfo),
+	}
+
+	id := rand.Int31()
+	c.blockSubs[id] = sub
+
+	sub.Close = func() {
+		c.subMtx.Lock()
+		delete(c.blockSubs, id)
+		c.subMtx.Unlock()
+		close(sub.Out)
+	}
+	return sub, nil
+}
+
+// SubscribeMempool returns a subscription to the transactions relayed by
+// the peer.
+func (c *SPVClient) SubscribeMempool() (*base.MempoolSubscription, error) {
+	if atomic.LoadUint32(&c.started) == 0 {
+		return nil, errors.New("spv client not connected")
+	}
+
+	c.subMtx.Lock()
+	defer c.subMtx.Unlock()
+
+	sub := &base.MempoolSubscription{
+		Out: make(chan iwallet.Transaction, base.MempoolBufferSize),
+	}
+
+	id := rand.Int31()
+	c.mempoolSubs[id] = sub
+
+	sub.Close = func() {
+		c.subMtx.Lock()
+		delete(c.mempoolSubs, id)
+		c.subMtx.Unlock()
+		close(sub.Out)
+	}
+	return sub, nil
+}
+
+// Broadcast relays the transaction to the connected peer.
+func (c *SPVClient) Broadcast(serializedTx []byte) error {
+	var msgTx wire.MsgTx
+	if err := msgTx.Deserialize(bytes.NewReader(serializedTx)); err != nil {
+		return err
+	}
+	p := c.currentPeer()
+	if p == nil {
+		return errors.New("spv client not connected")
+	}
+	done := make(chan struct{}, 1)
+	p.QueueMessage(&msgTx, done)
+	select {
+	case <-done:
+	case <-time.After(queryTimeout):
+		return errors.New("timed out sending transaction")
+	}
+
+	c.walletMtx.Lock()
+	c.processTransaction(&msgTx, nil)
+	c.walletMtx.Unlock()
+	return nil
+}
+
+// Open connects to a peer and starts syncing headers in the background.
+// Until the headers are synced GetBlockchainInfo and
+// GetAddressTransactions return an error.
+func (c *SPVClient) Open() error {
+	p, err := c.connect()
+	if err != nil {
+		return err
+	}
+	atomic.StoreUint32(&c.started, 1)
+	go c.peerHandler(p)
+	return nil
+}
+
+func (c *SPVClient) Close() error {
+	c.subMtx.Lock()
+	defer c.subMtx.Unlock()
+
+	close(c.shutdown)
+	atomic.AddUint32(&c.stopped, 1)
+	if p := c.currentPeer(); p != nil {
+		p.Disconnect()
+	}
+	return nil
+}
+
+// connect tries each configured peer in turn and returns the first which
+// serves compact block filters.
+func (c *SPVClient) connect() (*peer.Peer, error) {
+	var lastErr error
+	for _, addr := range c.cfg.Peers {
+		p, err := c.connectPeer(addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		c.peerMtx.Lock()
+		c.peer = p
+		c.peerMtx.Unlock()
+		return p, nil
+	}
+	return nil, fmt.Errorf("unable to connect to a peer: %s", lastErr)
+}
+
+func (c *SPVClient) connectPeer(addr string) (*peer.Peer, error) {
+	verack := make(chan struct{})
+	cfg := &peer.Config{
+		UserAgentName:    "multiwallet",
+		UserAgentVersion: "0.1.0",
+		ChainParams:      c.cfg.Params,
+		TrickleInterval:  time.Second * 10,
+		Listeners: peer.MessageListeners{
+			OnVerAck: func(p *peer.Peer, msg *wire.MsgVerAck) {
+				close(verack)
+			},
+			OnHeaders: func(p *peer.Peer, msg *wire.MsgHeaders) {
+				select {
+				case c.headersChan <- msg:
+				default:
+				}
+			},
+			OnCFilter: func(p *peer.Peer, msg *wire.MsgCFilter) {
+				select {
+				case c.filterChan <- msg:
+				default:
+				}
+			},
+			OnBlock: func(p *peer.Peer, msg *wire.MsgBlock, buf []byte) {
+				select {
+				case c.blockChan <- msg:
+				default:
+				}
+			},
+			OnInv: c.handleInv,
+			OnTx: func(p *peer.Peer, msg *wire.MsgTx) {
+				go c.handleTransaction(msg)
+			},
+		},
+	}
+
+	p, err := peer.NewOutboundPeer(cfg, addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout("tcp", p.Addr(), dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	p.AssociateConnection(conn)
+
+	select {
+	case <-verack:
+	case <-time.After(queryTimeout):
+		p.Disconnect()
+		return nil, fmt.Errorf("peer %s did not complete handshake", addr)
+	}
+	if p.Services()&wire.SFNodeCF != wire.SFNodeCF {
+		p.Disconnect()
+		return nil, fmt.Errorf("peer %s does not serve compact filters", addr)
+	}
+	return p, nil
+}
+
+// peerHandler syncs headers from the peer and reconnects if it
+// disconnects, unless the client was closed.
+func (c *SPVClient) peerHandler(p *peer.Peer) {
+	for {
+		go c.syncHeaders()
+		p.WaitForDisconnect()
+		if atomic.LoadUint32(&c.stopped) > 0 {
+			return
+		}
+
+		var err error
+		backoff.Retry(func() error {
+			if atomic.LoadUint32(&c.stopped) > 0 {
+				return nil
+			}
+			p, err = c.connect()
+			return err
+		}, backoff.NewExponentialBackOff())
+		if p == nil || atomic.LoadUint32(&c.stopped) > 0 {
+			return
+		}
+	}
+}
+
+func (c *SPVClient) currentPeer() *peer.Peer {
+	c.peerMtx.RLock()
+	defer c.peerMtx.RUnlock()
+	return c.peer
+}
+
+func (c *SPVClient) handleInv(p *peer.Peer, msg *wire.MsgInv) {
+	getData := wire.NewMsgGetData()
+	for _, inv := range msg.InvList {
+		switch inv.Type {
+		case wire.InvTypeBlock, wire.InvTypeWitnessBlock:
+			go c.syncHeaders()
+		case wire.InvTypeTx, wire.InvTypeWitnessTx:
+			getData.AddInvVect(wire.NewInvVect(wire.InvTypeTx, &inv.Hash))
+		}
+	}
+	if len(getData.InvList) > 0 {
+		p.QueueMessage(getData, nil)
+	}
+}
+
+// handleTransaction processes a transaction relayed from the mempool and
+// notifies the subscriptions if it's relevant.
+func (c *SPVClient) handleTransaction(msgTx *wire.MsgTx) {
+	c.walletMtx.Lock()
+	tx, relevant := c.processTransaction(msgTx, nil)
+	c.walletMtx.Unlock()
+
+	c.subMtx.Lock()
+	for _, sub := range c.mempoolSubs {
+		select {
+		case sub.Out <- tx:
+		default:
+		}
+	}
+	c.subMtx.Unlock()
+
+	if relevant {
+		c.notifyTransaction(tx)
+	}
+}
+
+// syncHeaders downloads headers until the peer has no more, scans any new
+// blocks and notifies the subscriptions.
+func (c *SPVClient) syncHeaders() {
+	c.syncMtx.Lock()
+	defer c.syncMtx.Unlock()
+
+	_, oldHeight := c.chain.tip()
+	for {
+		msg := wire.NewMsgGetHeaders()
+		for _, hash := range c.chain.locator() {
+			msg.AddBlockLocatorHash(hash)
+		}
+
+		resp, err := c.queryHeaders(msg)
+		if err != nil {
+			return
+		}
+		if len(resp.Headers) == 0 {
+			break
+		}
+		changed, forkHeight, err := c.chain.connect(resp.Headers)
+		if err != nil {
+			if p := c.currentPeer(); p != nil {
+				p.Disconnect()
+			}
+			return
+		}
+		if changed && forkHeight < oldHeight {
+			c.rollback(forkHeight)
+			oldHeight = forkHeight
+		}
+		if len(resp.Headers) < wire.MaxBlockHeadersPerMsg {
+			break
+		}
+	}
+
+	_, newHeight := c.chain.tip()
+	if atomic.LoadUint32(&c.synced) == 0 {
+		c.walletMtx.Lock()
+		if !c.cfg.Birthday.IsZero() {
+			c.startHeight = c.chain.heightAtTime(c.cfg.Birthday.Add(-birthdaySlack))
+		}
+		c.nextHeight = c.startHeight
+		c.walletMtx.Unlock()
+		atomic.StoreUint32(&c.synced, 1)
+		return
+	}
+	if newHeight == oldHeight {
+		return
+	}
+
+	c.walletMtx.Lock()
+	txs, err := c.catchUp()
+	c.walletMtx.Unlock()
+	if err != nil {
+		return
+	}
+	for _, tx := range txs {
+		c.notifyTransaction(tx)
+	}
+
+	info, err := c.GetBlockchainInfo()
+	if err != nil {
+		return
+	}
+	c.subMtx.Lock()
+	for _, sub := range c.blockSubs {
+		sub.Out <- info
+	}
+	c.subMtx.Unlock()
+}
+
+// rollback marks transactions in blocks above forkHeight as unconfirmed
+// so they're confirmed again when the new chain is scanned.
+func (c *SPVClient) rollback(forkHeight uint64) {
+	c.walletMtx.Lock()
+	defer c.walletMtx.Unlock()
+
+	for txid, tx := range c.txIndex {
+		if tx.Height > forkHeight {
+			tx.Height = 0
+			tx.BlockInfo = nil
+			c.txIndex[txid] = tx
+			delete(c.proofs, txid)
+		}
+	}
+	if c.nextHeight > forkHeight+1 {
+		c.nextHeight = forkHeight + 1
+	}
+}
+
+// watch adds the address to the watched scripts. The caller must hold the
+// walletMtx.
+func (c *SPVClient) watch(addr iwallet.Address) error {
+	if _, ok := c.watched[addr.String()]; ok {
+		return nil
+	}
+	decoded, err := btcutil.DecodeAddress(addr.String(), c.cfg.Params)
+	if err != nil {
+		return err
+	}
+	script, err := txscript.PayToAddrScript(decoded)
+	if err != nil {
+		return err
+	}
+	c.watched[addr.String()] = &watchedScript{
+		script: script,
+	}
+	return nil
+}
+
+// catchUp scans the blocks before nextHeight for any newly watched scripts
+// and then scans the new blocks up to the tip for all of them. It returns
+// the relevant transactions found in the new blocks. The caller must hold
+// the walletMtx.
+func (c *SPVClient) catchUp() ([]iwallet.Transaction, error) {
+	var pending [][]byte
+	for _, w := range c.watched {
+		if !w.scanned {
+			pending = append(pending, w.script)
+		}
+	}
+	if len(pending) > 0 && c.nextHeight > c.startHeight {
+		if _, err := c.scan(pending, c.startHeight, c.nextHeight-1); err != nil {
+			return nil, err
+		}
+	}
+	for _, w := range c.watched {
+		w.scanned = true
+	}
+
+	_, tip := c.chain.tip()
+	if c.nextHeight > tip {
+		return nil, nil
+	}
+	scripts := make([][]byte, 0, len(c.watched))
+	for _, w := range c.watched {
+		scripts = append(scripts, w.script)
+	}
+	txs, err := c.scan(scripts, c.nextHeight, tip)
+	if err != nil {
+		return nil, err
+	}
+	c.nextHeight = tip + 1
+	return txs, nil
+}
+
+// scan matches the filters of the blocks between from and to against the
+// scripts and processes the blocks which match. The caller must hold the
+// walletMtx.
+func (c *SPVClient) scan(scripts [][]byte, from, to uint64) ([]iwallet.Transaction, error) {
+	if len(scripts) == 0 {
+		return nil, nil
+	}
+
+	var txs []iwallet.Transaction
+	for start := from; start <= to; start += wire.MaxGetCFiltersReqRange {
+		stop := start + wire.MaxGetCFiltersReqRange - 1
+		if stop > to {
+			stop = to
+		}
+		filters, err := c.queryFilters(start, stop)
+		if err != nil {
+			return nil, err
+		}
+		for i, msg := range filters {
+			height := start + uint64(i)
+			match, err := matchFilter(msg, scripts)
+			if err != nil {
+				return nil, err
+			}
+			if !match {
+				continue
+			}
+			block, err := c.queryBlock(msg.BlockHash)
+			if err != nil {
+				return nil, err
+			}
+			txs = append(txs, c.processBlock(block, height)...)
+		}
+	}
+	return txs, nil
+}
+
+// matchFilter returns whether the block's filter matches any of the
+// scripts. The filter includes the scripts of the block's outputs and of
+// the outputs its inputs spend, so spends from the wallet also match.
+func matchFilter(msg *wire.MsgCFilter, scripts [][]byte) (bool, error) {
+	if len(msg.Data) == 0 {
+		return false, nil
+	}
+	filter, err := gcs.FromNBytes(builder.DefaultP, builder.DefaultM, msg.Data)
+	if err != nil {
+		return false, err
+	}
+	if filter.N() == 0 {
+		return false, nil
+	}
+	key := builder.DeriveKey(&msg.BlockHash)
+	return filter.MatchAny(key, scripts)
+}
+
+// processBlock indexes the block's relevant transactions and returns them.
+func (c *SPVClient) processBlock(block *wire.MsgBlock, height uint64) []iwallet.Transaction {
+	info := &iwallet.BlockInfo{
+		BlockID:   iwallet.BlockID(block.BlockHash().String()),
+		PrevBlock: iwallet.BlockID(block.Header.PrevBlock.String()),
+		Height:    height,
+		BlockTime: block.Header.Timestamp,
+	}
+	var (
+		txs    []iwallet.Transaction
+		hashes = make([]chainhash.Hash, len(block.Transactions))
+	)
+	for i, msgTx := range block.Transactions {
+		hashes[i] = msgTx.TxHash()
+	}
+	for i, msgTx := range block.Transactions {
+		if tx, relevant := c.processTransaction(msgTx, info); relevant {
+			txs = append(txs, tx)
+			c.proofs[tx.ID] = &base.MerkleProof{
+				BlockID: info.BlockID,
+				Height:  height,
+				Index:   uint32(i),
+				Branch:  merkleBranch(hashes, i),
+			}
+		}
+	}
+	return txs
+}
+
+// merkleBranch returns the sibling hashes linking the transaction at index
+// to the merkle root, from the leaves up.
+func merkleBranch(hashes []chainhash.Hash, index int) []chainhash.Hash {
+	var branch []chainhash.Hash
+	level := hashes
+	for len(level) > 1 {
+		if len(level)%2 == 1 {
+			level = append(level[:len(level):len(level)], level[len(level)-1])
+		}
+		branch = append(branch, level[index^1])
+		next := make([]chainhash.Hash, len(level)/2)
+		for i := range next {
+			var buf [chainhash.HashSize * 2]byte
+			copy(buf[:chainhash.HashSize], level[i*2][:])
+			copy(buf[chainhash.HashSize:], level[i*2+1][:])
+			next[i] = chainhash.DoubleHashH(buf[:])
+		}
+		level = next
+		index >>= 1
+	}
+	return branch
+}
+
+// processTransaction converts the transaction and indexes it if it pays
+// a watched script or spends one of the wallet's outputs. Blocks must be
+// processed in order so the outputs are known before they're spent.
+func (c *SPVClient) processTransaction(msgTx *wire.MsgTx, block *iwallet.BlockInfo) (iwallet.Transaction, bool) {
+	txHash := msgTx.TxHash()
+	tx := iwallet.Transaction{
+		ID:        iwallet.TransactionID(txHash.String()),
+		Timestamp: time.Now(),
+	}
+	if existing, ok := c.txIndex[tx.ID]; ok {
+		tx.Timestamp = existing.Timestamp
+	}
+	if block != nil {
+		tx.Height = block.Height
+		tx.BlockInfo = block
+		tx.Timestamp = block.BlockTime
+	}
+
+	var addrs []string
+	for _, in := range msgTx.TxIn {
+		from, ok := c.outpoints[in.PreviousOutPoint]
+		if ok {
+			addrs = append(addrs, from.Address.String())
+		} else {
+			from = iwallet.SpendInfo{
+				ID:     outpointID(&in.PreviousOutPoint.Hash, in.PreviousOutPoint.Index),
+				Amount: iwallet.NewAmount(0),
+			}
+		}
+		tx.From = append(tx.From, from)
+	}
+
+	for i, out := range msgTx.TxOut {
+		to := iwallet.SpendInfo{
+			ID:     outpointID(&txHash, uint32(i)),
+			Amount: iwallet.NewAmount(out.Value),
+		}
+		_, outAddrs, _, err := txscript.ExtractPkScriptAddrs(out.PkScript, c.cfg.Params)
+		if err == nil && len(outAddrs) > 0 {
+			to.Address = iwallet.NewAddress(outAddrs[0].String(), c.coinType)
+		}
+		if _, ok := c.watched[to.Address.String()]; ok && to.Address.String() != "" {
+			c.outpoints[*wire.NewOutPoint(&txHash, uint32(i))] = to
+			addrs = append(addrs, to.Address.String())
+		}
+		tx.To = append(tx.To, to)
+	}
+
+	if len(addrs) == 0 {
+		return tx, false
+	}
+	c.txIndex[tx.ID] = tx
+	for _, addr := range addrs {
+		if c.addrIndex[addr] == nil {
+			c.addrIndex[addr] = make(map[iwallet.TransactionID]bool)
+		}
+		c.addrIndex[addr][tx.ID] = true
+	}
+	return tx, true
+}
+
+func (c *SPVClient) notifyTransaction(tx iwallet.Transaction) {
+	c.subMtx.Lock()
+	defer c.subMtx.Unlock()
+	for _, sub := range c.txSubs {
+		matches := false
+		for _, from := range tx.From {
+			if sub.addrs[from.Address.String()] {
+				matches = true
+				break
+			}
+		}
+		for _, to := range tx.To {
+			if sub.addrs[to.Address.String()] {
+				matches = true
+				break
+			}
+		}
+		if matches {
+			sub.sub.Out <- tx
+		}
+	}
+}
+
+// queryHeaders sends getheaders and waits for the response.
+func (c *SPVClient) queryHeaders(msg *wire.MsgGetHeaders) (*wire.MsgHeaders, error) {
+	c.queryMtx.Lock()
+	defer c.queryMtx.Unlock()
+
+	p := c.currentPeer()
+	if p == nil {
+		return nil, errors.New("spv client not connected")
+	}
+	select {
+	case <-c.headersChan:
+	default:
+	}
+	p.QueueMessage(msg, nil)
+
+	select {
+	case resp := <-c.headersChan:
+		return resp, nil
+	case <-time.After(queryTimeout):
+		return nil, errors.New("timed out waiting for headers")
+	case <-c.shutdown:
+		return nil, errors.New("spv client closed")
+	}
+}
+
+// queryFilters requests the basic filters for the blocks between start and
+// stop, which must not be more than wire.MaxGetCFiltersReqRange apart.
+func (c *SPVClient) queryFilters(start, stop uint64) ([]*wire.MsgCFilter, error) {
+	stopHash, ok := c.chain.hashAt(stop)
+	if !ok {
+		return nil, errors.New("filter range is above the tip")
+	}
+
+	c.queryMtx.Lock()
+	defer c.queryMtx.Unlock()
+
+	p := c.currentPeer()
+	if p == nil {
+		return nil, errors.New("spv client not connected")
+	}
+	for len(c.filterChan) > 0 {
+		<-c.filterChan
+	}
+	p.QueueMessage(wire.NewMsgGetCFilters(wire.GCSFilterRegular, uint32(start), &stopHash), nil)
+
+	filters := make([]*wire.MsgCFilter, 0, stop-start+1)
+	for uint64(len(filters)) < stop-start+1 {
+		select {
+		case msg := <-c.filterChan:
+			expected, _ := c.chain.hashAt(start + uint64(len(filters)))
+			if msg.BlockHash != expected || msg.FilterType != wire.GCSFilterRegular {
+				return nil, errors.New("peer sent an unexpected filter")
+			}
+			filters = append(filters, msg)
+		case <-time.After(queryTimeout):
+			return nil, errors.New("timed out waiting for filters")
+		case <-c.shutdown:
+			return nil, errors.New("spv client closed")
+		}
+	}
+	return filters, nil
+}
+
+// queryBlock downloads the block and checks it matches its header.
+func (c *SPVClient) queryBlock(hash chainhash.Hash) (*wire.MsgBlock, error) {
+	c.queryMtx.Lock()
+	defer c.queryMtx.Unlock()
+
+	p := c.currentPeer()
+	if p == nil {
+		return nil, errors.New("spv client not connected")
+	}
+	select {
+	case <-c.blockChan:
+	default:
+	}
+	getData := wire.NewMsgGetData()
+	getData.AddInvVect(wire.NewInvVect(wire.InvTypeWitnessBlock, &hash))
+	p.QueueMessage(getData, nil)
+
+	select {
+	case block := <-c.blockChan:
+		if block.BlockHash() != hash {
+			return nil, errors.New("peer sent an unexpected block")
+		}
+		if err := checkMerkleRoot(block); err != nil {
+			return nil, err
+		}
+		return block, nil
+	case <-time.After(queryTimeout):
+		return nil, errors.New("timed out waiting for block")
+	case <-c.shutdown:
+		return nil, errors.New("spv client closed")
+	}
+}
+
+// checkMerkleRoot makes sure the block's transactions are the ones its
+// header commits to.
+func checkMerkleRoot(block *wire.MsgBlock) error {
+	if len(block.Transactions) == 0 {
+		return errors.New("block has no transactions")
+	}
+	hashes := make([]chainhash.Hash, len(block.Transactions))
+	for i, tx := range block.Transactions {
+		hashes[i] = tx.TxHash()
+	}
+	for len(hashes) > 1 {
+		if len(hashes)%2 == 1 {
+			hashes = append(hashes, hashes[len(hashes)-1])
+		}
+		next := make([]chainhash.Hash, len(hashes)/2)
+		for i := range next {
+			var buf [chainhash.HashSize * 2]byte
+			copy(buf[:chainhash.HashSize], hashes[i*2][:])
+			copy(buf[chainhash.HashSize:], hashes[i*2+1][:])
+			next[i] = chainhash.DoubleHashH(buf[:])
+		}
+		hashes = next
+	}
+	if hashes[0] != block.Header.MerkleRoot {
+		return errors.New("block merkle root does not match transactions")
+	}
+	return nil
+}
+
+func outpointID(hash *chainhash.Hash, index uint32) []byte {
+	id := make([]byte, 36)
+	copy(id[:32], hash[:])
+	binary.LittleEndian.PutUint32(id[32:], index)
+	return id
+}
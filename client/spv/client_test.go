@@ -0,0 +1,150 @@
+package spv
+
+import (
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/gcs/builder"
+	"github.com/cpacia/multiwallet/headers"
+	iwallet "github.com/cpacia/wallet-interface"
+	"testing"
+	"time"
+)
+
+func TestParseURL(t *testing.T) {
+	cfg, err := ParseURL("spv://127.0.0.1:18444,10.0.0.1:18444?network=regtest&birthday=1577836800")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Peers) != 2 || cfg.Peers[1] != "10.0.0.1:18444" {
+		t.Errorf("Incorrect peers %v", cfg.Peers)
+	}
+	if cfg.Params.Name != chaincfg.RegressionNetParams.Name {
+		t.Errorf("Expected regtest params, got %s", cfg.Params.Name)
+	}
+	if cfg.Birthday.Unix() != 1577836800 {
+		t.Errorf("Expected birthday 1577836800, got %d", cfg.Birthday.Unix())
+	}
+
+	if _, err := ParseURL("spv://?network=regtest"); err == nil {
+		t.Error("Expected error without peers")
+	}
+	if _, err := ParseURL("spv://127.0.0.1:8333?network=bogus"); err == nil {
+		t.Error("Expected error for unknown network")
+	}
+	if IsSPVURL("https://btc.blockbook.api.openbazaar.org/api") {
+		t.Error("Expected blockbook url not to select the client")
+	}
+}
+
+func TestSPVClient_ProcessBlock(t *testing.T) {
+	params := &chaincfg.RegressionNetParams
+	client, err := NewSPVClient(&Config{Peers: []string{"127.0.0.1:18444"}, Params: params}, iwallet.CtBitcoin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	walletAddr, err := btcutil.NewAddressPubKeyHash(make([]byte, 20), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherAddr, err := btcutil.NewAddressPubKeyHash(append(make([]byte, 19), 1), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	walletScript, _ := txscript.PayToAddrScript(walletAddr)
+	otherScript, _ := txscript.PayToAddrScript(otherAddr)
+
+	client.walletMtx.Lock()
+	defer client.walletMtx.Unlock()
+	if err := client.watch(iwallet.NewAddress(walletAddr.String(), iwallet.CtBitcoin)); err != nil {
+		t.Fatal(err)
+	}
+
+	coinbase := wire.NewMsgTx(1)
+	coinbase.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{}, wire.MaxPrevOutIndex), []byte{0x51}, nil))
+	coinbase.AddTxOut(wire.NewTxOut(5000000000, walletScript))
+	coinbaseHash := coinbase.TxHash()
+
+	spend := wire.NewMsgTx(1)
+	spend.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&coinbaseHash, 0), nil, nil))
+	spend.AddTxOut(wire.NewTxOut(4999990000, otherScript))
+
+	unrelated := wire.NewMsgTx(1)
+	unrelated.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{2}, 0), nil, nil))
+	unrelated.AddTxOut(wire.NewTxOut(1000, otherScript))
+
+	block := &wire.MsgBlock{
+		Header: wire.BlockHeader{
+			Version:   1,
+			PrevBlock: *params.GenesisHash,
+			Timestamp: time.Unix(1577836800, 0),
+			Bits:      params.PowLimitBits,
+		},
+		Transactions: []*wire.MsgTx{coinbase, spend, unrelated},
+	}
+	hashes := []chainhash.Hash{coinbaseHash, spend.TxHash(), unrelated.TxHash()}
+	left := chainhash.DoubleHashH(append(hashes[0][:], hashes[1][:]...))
+	right := chainhash.DoubleHashH(append(hashes[2][:], hashes[2][:]...))
+	block.Header.MerkleRoot = chainhash.DoubleHashH(append(left[:], right[:]...))
+	if err := checkMerkleRoot(block); err != nil {
+		t.Fatal(err)
+	}
+
+	filter, err := builder.BuildBasicFilter(block, [][]byte{walletScript})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := filter.NBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockHash := block.BlockHash()
+	msg := wire.NewMsgCFilter(wire.GCSFilterRegular, &blockHash, data)
+	match, err := matchFilter(msg, [][]byte{walletScript})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !match {
+		t.Error("Expected filter to match wallet script")
+	}
+
+	txs := client.processBlock(block, 1)
+	if len(txs) != 2 {
+		t.Fatalf("Expected 2 relevant transactions, got %d", len(txs))
+	}
+	if txs[1].From[0].Address.String() != walletAddr.String() || txs[1].From[0].Amount.String() != "5000000000" {
+		t.Errorf("Expected spend to include input metadata, got %v", txs[1].From[0])
+	}
+	if txs[1].Height != 1 || txs[1].BlockInfo == nil {
+		t.Errorf("Expected height 1, got %d", txs[1].Height)
+	}
+	if len(client.addrIndex[walletAddr.String()]) != 2 {
+		t.Errorf("Expected 2 indexed transactions, got %d", len(client.addrIndex[walletAddr.String()]))
+	}
+	if _, ok := client.txIndex[iwallet.TransactionID(unrelated.TxHash().String())]; ok {
+		t.Error("Expected unrelated transaction not to be indexed")
+	}
+
+	for _, tx := range txs {
+		proof, err := client.GetMerkleProof(tx.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		txid, _ := chainhash.NewHashFromStr(tx.ID.String())
+		if headers.MerkleRoot(*txid, proof.Index, proof.Branch) != block.Header.MerkleRoot {
+			t.Errorf("Expected merkle proof for %s to match the block", tx.ID)
+		}
+	}
+	client.rollback(0)
+	if _, err := client.GetMerkleProof(txs[0].ID); err == nil {
+		t.Error("Expected rollback to remove merkle proof")
+	}
+
+	block.Transactions[2] = spend
+	if err := checkMerkleRoot(block); err == nil {
+		t.Error("Expected merkle root mismatch")
+	}
+}
@@ -0,0 +1,708 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/cpacia/multiwallet"
+	"github.com/cpacia/multiwallet/base"
+	iwallet "github.com/cpacia/wallet-interface"
+	"io/ioutil"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// bip44CoinTypes are the registered BIP44 coin types. Every test network uses
+// coin type 1.
+var bip44CoinTypes = map[iwallet.CoinType]uint32{
+	iwallet.CtBitcoin:     0,
+	iwallet.CtLitecoin:    2,
+	iwallet.CtZCash:       133,
+	iwallet.CtBitcoinCash: 145,
+}
+
+// recoverer is implemented by wallets which can restore their history
+// from the chain.
+type recoverer interface {
+	RecoverWallet(fromHeight uint64) (*base.RecoveryResult, error)
+}
+
+// descriptorWallet is implemented by wallets which can be created from a
+// configured descriptor rather than the seed.
+type descriptorWallet interface {
+	CreateWalletFromDescriptor(birthday time.Time) error
+}
+
+// sweeper is implemented by wallets which can sweep their balance.
+type sweeper interface {
+	SweepWallet(wtx iwallet.Tx, to iwallet.Address, level iwallet.FeeLevel) (iwallet.TransactionID, error)
+}
+
+// psbtSigner is implemented by wallets which can sign PSBTs offline.
+type psbtSigner interface {
+	OpenKeychain() error
+	IsLocked() bool
+	Unlock(pw []byte, howLong time.Duration) error
+	SignPSBT(psbt string) (string, int, error)
+	FinalizePSBT(psbt string) (*wire.MsgTx, error)
+}
+
+// rescanner is implemented by wallets which can rebuild their history.
+type rescanner interface {
+	Rescan(fromHeight uint64) error
+}
+
+// progressReporter is implemented by wallets which report the progress of
+// their rescans.
+type progressReporter interface {
+	SubscribeScanProgress() (base.Subscription, error)
+}
+
+func runInit(c *cli, args []string) error {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	restore := fs.Bool("restore", false, "restore the wallets from an existing seed")
+	encrypt := fs.Bool("encrypt", false, "encrypt the wallets with a passphrase")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return errUsage
+	}
+
+	var (
+		seed     []byte
+		birthday = time.Now()
+		err      error
+	)
+	if *restore {
+		seed, err = readSeed()
+		if err != nil {
+			return err
+		}
+		birthday = time.Time{}
+	} else {
+		seed = make([]byte, hdkeychain.RecommendedSeedLen)
+		if _, err := rand.Read(seed); err != nil {
+			return err
+		}
+	}
+	defer base.ZeroBytes(seed)
+
+	params := &chaincfg.MainNetParams
+	if c.network.IsTest() {
+		params = &chaincfg.TestNet3Params
+	}
+	master, err := hdkeychain.NewMaster(seed, params)
+	if err != nil {
+		return err
+	}
+	defer base.ZeroKey(master)
+	purpose, err := master.Child(hdkeychain.HardenedKeyStart + 44)
+	if err != nil {
+		return err
+	}
+	defer base.ZeroKey(purpose)
+
+	mw, err := c.newMultiwallet()
+	if err != nil {
+		return err
+	}
+	defer mw.Close()
+
+	var created []iwallet.CoinType
+	for _, ct := range mw.CoinTypes() {
+		wl, err := mw.Wallet(ct)
+		if err != nil {
+			return err
+		}
+		if wl.WalletExists() {
+			fmt.Printf("%s wallet already exists\n", ct.CurrencyCode())
+			continue
+		}
+		if dw, ok := wl.(descriptorWallet); ok {
+			err := dw.CreateWalletFromDescriptor(birthday)
+			if err == nil {
+				created = append(created, ct)
+				fmt.Printf("Created %s wallet from its descriptor\n", ct.CurrencyCode())
+				continue
+			}
+			if !errors.Is(err, base.ErrNoDescriptor) {
+				return err
+			}
+		}
+		index, ok := bip44CoinTypes[ct]
+		if !ok {
+			return fmt.Errorf("no BIP44 coin type for %s", ct.CurrencyCode())
+		}
+		if c.network.IsTest() {
+			index = 1
+		}
+		xpriv, err := purpose.Child(hdkeychain.HardenedKeyStart + index)
+		if err != nil {
+			return err
+		}
+		err = wl.CreateWallet(*xpriv, nil, birthday)
+		base.ZeroKey(xpriv)
+		if err != nil {
+			return err
+		}
+		created = append(created, ct)
+		fmt.Printf("Created %s wallet\n", ct.CurrencyCode())
+	}
+	if len(created) == 0 {
+		return nil
+	}
+
+	if *encrypt || *restore {
+		if err := mw.Start(); err != nil {
+			return err
+		}
+	}
+	if *restore {
+		for _, ct := range created {
+			wl, _ := mw.Wallet(ct)
+			r, ok := wl.(recoverer)
+			if !ok {
+				continue
+			}
+			result, err := r.RecoverWallet(0)
+			if err != nil {
+				return fmt.Errorf("error recovering %s wallet: %s", ct.CurrencyCode(), err)
+			}
+			fmt.Printf("Recovered %d %s transactions\n", len(result.Transactions), ct.CurrencyCode())
+		}
+	}
+	if *encrypt {
+		pw, err := c.readPassphrase("New passphrase: ")
+		if err != nil {
+			return err
+		}
+		defer base.ZeroBytes(pw)
+		if err := mw.Crypter().SetPassphrase(pw); err != nil {
+			return err
+		}
+	}
+	if !*restore {
+		fmt.Printf("\nWrite down the seed below. It's the only way to restore the wallets.\n\n%s\n", hex.EncodeToString(seed))
+	}
+	return nil
+}
+
+func runAddress(c *cli, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	mw, err := c.open()
+	if err != nil {
+		return err
+	}
+	defer mw.Close()
+
+	_, wl, err := coinArg(mw, args[0])
+	if err != nil {
+		return err
+	}
+	addr, err := wl.CurrentAddress()
+	if err != nil {
+		return err
+	}
+	fmt.Println(addr.String())
+	return nil
+}
+
+func runBalance(c *cli, args []string) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+	mw, err := c.open()
+	if err != nil {
+		return err
+	}
+	defer mw.Close()
+
+	coins := mw.CoinTypes()
+	if len(args) == 1 {
+		ct, _, err := coinArg(mw, args[0])
+		if err != nil {
+			return err
+		}
+		coins = []iwallet.CoinType{ct}
+	}
+	balances, _, err := mw.Balances(nil)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "COIN\tCONFIRMED\tUNCONFIRMED")
+	for _, ct := range coins {
+		b := balances[ct]
+		fmt.Fprintf(w, "%s\t%s\t%s\n", ct.CurrencyCode(), b.Confirmed, b.Unconfirmed)
+	}
+	return w.Flush()
+}
+
+func runSend(c *cli, args []string) error {
+	fs := flag.NewFlagSet("send", flag.ExitOnError)
+	fee := fs.String("fee", "normal", "fee level: priority, normal or economic")
+	fs.Parse(args)
+	if fs.NArg() != 3 {
+		return errUsage
+	}
+	feeLevel, err := parseFeeLevel(*fee)
+	if err != nil {
+		return err
+	}
+	amount, err := parseAmount(fs.Arg(2))
+	if err != nil {
+		return err
+	}
+
+	mw, err := c.open()
+	if err != nil {
+		return err
+	}
+	defer mw.Close()
+
+	ct, wl, err := coinArg(mw, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	to := iwallet.NewAddress(fs.Arg(1), ct)
+	if err := wl.ValidateAddress(to); err != nil {
+		return err
+	}
+	if err := c.unlock(mw, wl); err != nil {
+		return err
+	}
+	return commit(wl, func(wtx iwallet.Tx) (iwallet.TransactionID, error) {
+		return wl.Spend(wtx, to, amount, feeLevel)
+	})
+}
+
+func runSweep(c *cli, args []string) error {
+	fs := flag.NewFlagSet("sweep", flag.ExitOnError)
+	fee := fs.String("fee", "normal", "fee level: priority, normal or economic")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		return errUsage
+	}
+	feeLevel, err := parseFeeLevel(*fee)
+	if err != nil {
+		return err
+	}
+
+	mw, err := c.open()
+	if err != nil {
+		return err
+	}
+	defer mw.Close()
+
+	ct, wl, err := coinArg(mw, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	sw, ok := wl.(sweeper)
+	if !ok {
+		return fmt.Errorf("%s wallet does not support sweeping", ct.CurrencyCode())
+	}
+	to := iwallet.NewAddress(fs.Arg(1), ct)
+	if err := wl.ValidateAddress(to); err != nil {
+		return err
+	}
+	if err := c.unlock(mw, wl); err != nil {
+		return err
+	}
+	return commit(wl, func(wtx iwallet.Tx) (iwallet.TransactionID, error) {
+		return sw.SweepWallet(wtx, to, feeLevel)
+	})
+}
+
+// unlock unlocks every wallet if the wallet being spent from is locked.
+func (c *cli) unlock(mw *multiwallet.Multiwallet, wl iwallet.Wallet) error {
+	status, ok := wl.(interface{ IsLocked() bool })
+	if !ok || !status.IsLocked() {
+		return nil
+	}
+	pw, err := c.readPassphrase("Passphrase: ")
+	if err != nil {
+		return err
+	}
+	defer base.ZeroBytes(pw)
+	return mw.UnlockAll(pw, time.Minute)
+}
+
+// commit runs spend in a wallet transaction, commits it so the transaction
+// is broadcast and prints the txid.
+func commit(wl iwallet.Wallet, spend func(wtx iwallet.Tx) (iwallet.TransactionID, error)) error {
+	wtx, err := wl.Begin()
+	if err != nil {
+		return err
+	}
+	txid, err := spend(wtx)
+	if err != nil {
+		wtx.Rollback()
+		return err
+	}
+	if err := wtx.Commit(); err != nil {
+		return err
+	}
+	fmt.Println(txid.String())
+	return nil
+}
+
+func runHistory(c *cli, args []string) error {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	limit := fs.Int("limit", 20, "number of transactions")
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		return errUsage
+	}
+
+	mw, err := c.open()
+	if err != nil {
+		return err
+	}
+	defer mw.Close()
+
+	var txs []historyRow
+	if fs.NArg() == 1 {
+		ct, wl, err := coinArg(mw, fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		coinTxs, err := wl.Transactions(*limit, "")
+		if err != nil {
+			return err
+		}
+		for _, tx := range coinTxs {
+			txs = append(txs, historyRow{ct.CurrencyCode(), tx})
+		}
+	} else {
+		coinTxs, err := mw.Transactions(*limit)
+		if err != nil {
+			return err
+		}
+		for _, tx := range coinTxs {
+			txs = append(txs, historyRow{tx.CoinType.CurrencyCode(), tx.Transaction})
+		}
+	}
+	return printHistory(txs)
+}
+
+type historyRow struct {
+	coin string
+	tx   iwallet.Transaction
+}
+
+func printHistory(rows []historyRow) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tCOIN\tTXID\tHEIGHT\tVALUE")
+	for _, row := range rows {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", row.tx.Timestamp.Format(time.RFC3339), row.coin, row.tx.ID, row.tx.Height, row.tx.Value)
+	}
+	return w.Flush()
+}
+
+func runUnlock(c *cli, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	mw, err := c.open()
+	if err != nil {
+		return err
+	}
+	defer mw.Close()
+
+	pw, err := c.readPassphrase("Passphrase: ")
+	if err != nil {
+		return err
+	}
+	defer base.ZeroBytes(pw)
+	if err := mw.UnlockAll(pw, time.Minute); err != nil {
+		return err
+	}
+	fmt.Println("Passphrase is correct")
+	return mw.LockAll()
+}
+
+func runMigrate(c *cli, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	mw, err := c.open()
+	if err != nil {
+		return err
+	}
+	defer mw.Close()
+
+	pw, err := c.readPassphrase("Wallet-wide passphrase: ")
+	if err != nil {
+		return err
+	}
+	defer base.ZeroBytes(pw)
+	unencrypted, differ, err := mw.Crypter().Check(pw)
+	if err != nil {
+		return err
+	}
+	if len(unencrypted) == 0 && len(differ) == 0 {
+		fmt.Println("Every wallet already uses the passphrase")
+		return nil
+	}
+	passphrases := make(map[iwallet.CoinType][]byte)
+	for _, ct := range differ {
+		old, err := promptPassphrase(fmt.Sprintf("Current %s passphrase: ", ct.CurrencyCode()))
+		if err != nil {
+			return err
+		}
+		defer base.ZeroBytes(old)
+		passphrases[ct] = old
+	}
+	if err := mw.Crypter().Migrate(passphrases, pw); err != nil {
+		return err
+	}
+	fmt.Printf("Moved %d wallets to the passphrase\n", len(unencrypted)+len(differ))
+	return nil
+}
+
+func runHint(c *cli, args []string) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+	mw, err := c.open()
+	if err != nil {
+		return err
+	}
+	defer mw.Close()
+
+	if len(args) == 0 {
+		hint, err := mw.Crypter().RecoveryHint()
+		if err != nil {
+			return err
+		}
+		if hint == "" {
+			fmt.Println("No hint saved")
+			return nil
+		}
+		fmt.Println(hint)
+		return nil
+	}
+	pw, err := c.readPassphrase("Passphrase: ")
+	if err != nil {
+		return err
+	}
+	defer base.ZeroBytes(pw)
+	return mw.Crypter().SetRecoveryHint(pw, args[0])
+}
+
+func runForgot(c *cli, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	seed, err := readSeed()
+	if err != nil {
+		return err
+	}
+	defer base.ZeroBytes(seed)
+
+	mw, err := c.open()
+	if err != nil {
+		return err
+	}
+	defer mw.Close()
+
+	indexes := make(map[iwallet.CoinType]uint32)
+	for ct, index := range bip44CoinTypes {
+		if c.network.IsTest() {
+			index = 1
+		}
+		indexes[ct] = index
+	}
+	if err := mw.Crypter().DecryptWithSeed(seed, indexes); err != nil {
+		return err
+	}
+	pw, err := promptPassphrase("New passphrase: ")
+	if err != nil {
+		return err
+	}
+	defer base.ZeroBytes(pw)
+	return mw.Crypter().SetPassphrase(pw)
+}
+
+// readSeed reads the seed the wallets were created from, either hex
+// encoded or as a BIP39 mnemonic.
+func readSeed() ([]byte, error) {
+	input, err := readSecret("Seed or mnemonic: ")
+	if err != nil {
+		return nil, err
+	}
+	defer base.ZeroBytes(input)
+
+	var seed []byte
+	if bytes.ContainsRune(input, ' ') {
+		seed, err = base.MnemonicSeed(string(input), "")
+	} else {
+		seed = make([]byte, hex.DecodedLen(len(input)))
+		var n int
+		n, err = hex.Decode(seed, input)
+		seed = seed[:n]
+	}
+	if err != nil {
+		base.ZeroBytes(seed)
+		return nil, fmt.Errorf("invalid seed: %s", err)
+	}
+	return seed, nil
+}
+
+func runPSBT(c *cli, args []string) error {
+	if len(args) < 2 || len(args) > 3 {
+		return errUsage
+	}
+	action := args[0]
+	if action != "sign" && action != "finalize" {
+		return errUsage
+	}
+	var (
+		psbt []byte
+		err  error
+	)
+	if len(args) == 3 {
+		psbt, err = ioutil.ReadFile(args[2])
+	} else {
+		psbt, err = ioutil.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		return err
+	}
+
+	// The wallets are built but not opened so no chain client is
+	// started.
+	mw, err := c.newMultiwallet()
+	if err != nil {
+		return err
+	}
+	defer mw.Close()
+
+	ct, wl, err := coinArg(mw, args[1])
+	if err != nil {
+		return err
+	}
+	ps, ok := wl.(psbtSigner)
+	if !ok {
+		return fmt.Errorf("%s wallet does not support PSBTs", ct.CurrencyCode())
+	}
+
+	if action == "finalize" {
+		tx, err := ps.FinalizePSBT(string(bytes.TrimSpace(psbt)))
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if err := tx.BtcEncode(&buf, wire.ProtocolVersion, wire.WitnessEncoding); err != nil {
+			return err
+		}
+		fmt.Println(hex.EncodeToString(buf.Bytes()))
+		return nil
+	}
+
+	if !wl.WalletExists() {
+		return fmt.Errorf("%s wallet has not been created, run multiwallet init first", ct.CurrencyCode())
+	}
+	if err := ps.OpenKeychain(); err != nil {
+		return err
+	}
+	// Only this wallet's keychain is open so it's unlocked on its own
+	// rather than with UnlockAll.
+	if ps.IsLocked() {
+		pw, err := c.readPassphrase("Passphrase: ")
+		if err != nil {
+			return err
+		}
+		err = ps.Unlock(pw, time.Minute)
+		base.ZeroBytes(pw)
+		if err != nil {
+			return err
+		}
+	}
+	signed, n, err := ps.SignPSBT(string(bytes.TrimSpace(psbt)))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Signed %d inputs\n", n)
+	fmt.Println(signed)
+	return nil
+}
+
+func runBackup(c *cli, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	if _, err := os.Stat(args[0]); err == nil {
+		return fmt.Errorf("%s already exists", args[0])
+	}
+	mw, err := c.newMultiwallet()
+	if err != nil {
+		return err
+	}
+	defer mw.Close()
+
+	pw, err := c.readPassphrase("Backup passphrase: ")
+	if err != nil {
+		return err
+	}
+	defer base.ZeroBytes(pw)
+	blob, err := mw.Backup(pw)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(args[0], blob, 0600)
+}
+
+func runRescan(c *cli, args []string) error {
+	fs := flag.NewFlagSet("rescan", flag.ExitOnError)
+	height := fs.Uint64("height", 0, "block height to rescan from")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+
+	mw, err := c.open()
+	if err != nil {
+		return err
+	}
+	defer mw.Close()
+
+	ct, wl, err := coinArg(mw, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	r, ok := wl.(rescanner)
+	if !ok {
+		return fmt.Errorf("%s wallet does not support rescanning", ct.CurrencyCode())
+	}
+	if p, ok := wl.(progressReporter); ok {
+		sub, err := p.SubscribeScanProgress()
+		if err != nil {
+			return err
+		}
+		defer sub.Close()
+		go printScanProgress(sub)
+	}
+	return r.Rescan(*height)
+}
+
+// printScanProgress prints the progress events of a scan until the
+// subscription is closed.
+func printScanProgress(sub base.Subscription) {
+	for event := range sub.Out() {
+		p := event.(*base.ScanProgressEvent)
+		if p.Done {
+			continue
+		}
+		fmt.Printf("%d/%d addresses scanned, %d transactions, %s remaining\n", p.AddressesScanned, p.AddressesTotal, p.Transactions, p.Remaining.Round(time.Second))
+	}
+}
@@ -0,0 +1,321 @@
+// Command multiwallet is a command line client for the multiwallet. It
+// works against the local database in the data directory or, with -api,
+// against a running api.Server.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/cpacia/multiwallet"
+	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/multiwallet/log"
+	iwallet "github.com/cpacia/wallet-interface"
+	"golang.org/x/crypto/ssh/terminal"
+	"io"
+	"math/big"
+	"os"
+	"strings"
+)
+
+// errUsage is returned by a command when its arguments are wrong.
+var errUsage = errors.New("invalid arguments")
+
+type command struct {
+	name  string
+	usage string
+	help  string
+
+	// local runs the command against the local database and remote
+	// against the API. Either is nil if the command isn't supported in
+	// that mode.
+	local  func(c *cli, args []string) error
+	remote func(c *cli, args []string) error
+}
+
+var commands = []command{
+	{
+		name:  "init",
+		usage: "init [-restore] [-encrypt]",
+		help:  "create the wallets from a new seed or restore them from an existing one",
+		local: runInit,
+	},
+	{
+		name:   "address",
+		usage:  "address <coin>",
+		help:   "print the current receiving address",
+		local:  runAddress,
+		remote: remoteAddress,
+	},
+	{
+		name:   "balance",
+		usage:  "balance [coin]",
+		help:   "print the balance of one or all wallets",
+		local:  runBalance,
+		remote: remoteBalance,
+	},
+	{
+		name:   "send",
+		usage:  "send [-fee level] <coin> <address> <amount>",
+		help:   "send an amount, in the coin's base unit, to an address",
+		local:  runSend,
+		remote: remoteSend,
+	},
+	{
+		name:  "sweep",
+		usage: "sweep [-fee level] <coin> <address>",
+		help:  "send the wallet's entire balance to an address",
+		local: runSweep,
+	},
+	{
+		name:   "history",
+		usage:  "history [-limit n] [coin]",
+		help:   "print the most recent transactions of one or all wallets",
+		local:  runHistory,
+		remote: remoteHistory,
+	},
+	{
+		name:  "unlock",
+		usage: "unlock",
+		help:  "check the passphrase unlocks every encrypted wallet",
+		local: runUnlock,
+	},
+	{
+		name:  "migrate",
+		usage: "migrate",
+		help:  "move wallets encrypted with their own passphrases to the wallet-wide one",
+		local: runMigrate,
+	},
+	{
+		name:  "hint",
+		usage: "hint [text]",
+		help:  "print the passphrase hint, or save a new one",
+		local: runHint,
+	},
+	{
+		name:  "forgot",
+		usage: "forgot",
+		help:  "decrypt the wallets with their seed and set a new passphrase",
+		local: runForgot,
+	},
+	{
+		name:  "psbt",
+		usage: "psbt sign|finalize <coin> [file]",
+		help:  "sign a PSBT with the wallet's keys, or print its final transaction, without a chain client",
+		local: runPSBT,
+	},
+	{
+		name:  "backup",
+		usage: "backup <file>",
+		help:  "write an encrypted backup of the database to file",
+		local: runBackup,
+	},
+	{
+		name:  "rescan",
+		usage: "rescan [-height n] <coin>",
+		help:  "rebuild the wallet's history from a block height",
+		local: runRescan,
+	},
+}
+
+// cli holds the global options.
+type cli struct {
+	dataDir    string
+	testnet    bool
+	network    base.Network
+	apiURL     string
+	logLevel   string
+	passphrase string
+}
+
+func main() {
+	var c cli
+	flag.StringVar(&c.dataDir, "datadir", multiwallet.DefaultHomeDir, "data directory")
+	flag.BoolVar(&c.testnet, "testnet", false, "use testnet")
+	networkName := flag.String("network", "", "network to use: mainnet, testnet, signet or regtest")
+	flag.StringVar(&c.apiURL, "api", "", "URL of a multiwallet API server to use instead of the local database")
+	flag.StringVar(&c.logLevel, "loglevel", "warning", "log level")
+	flag.Usage = usage
+	flag.Parse()
+
+	network, err := base.ParseNetwork(*networkName)
+	if err != nil {
+		fatalf("%s", err)
+	}
+	if network == base.NetworkMainnet && c.testnet {
+		network = base.NetworkTestnet
+	}
+	c.network = network
+
+	c.passphrase = os.Getenv("MULTIWALLET_PASSPHRASE")
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	name, args := flag.Arg(0), flag.Args()[1:]
+	for _, cmd := range commands {
+		if cmd.name != name {
+			continue
+		}
+		run := cmd.local
+		if c.apiURL != "" {
+			run = cmd.remote
+		}
+		if run == nil {
+			fatalf("%s is not supported with -api", name)
+		}
+		if err := run(&c, args); err != nil {
+			if err == errUsage {
+				fatalf("usage: multiwallet %s", cmd.usage)
+			}
+			fatalf("%s", err)
+		}
+		return
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n", name)
+	usage()
+	os.Exit(2)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: multiwallet [flags] <command> [args]\n\ncommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-45s %s\n", cmd.usage, cmd.help)
+	}
+	fmt.Fprintf(os.Stderr, "\nflags:\n")
+	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\nThe passphrase is read from MULTIWALLET_PASSPHRASE or prompted for. Seeds and\n")
+	fmt.Fprintf(os.Stderr, "mnemonics are prompted for, or read from stdin if it isn't a terminal. To sign\n")
+	fmt.Fprintf(os.Stderr, "a PSBT piped to stdin with an encrypted wallet set MULTIWALLET_PASSPHRASE.\n")
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "multiwallet: "+format+"\n", args...)
+	os.Exit(1)
+}
+
+// newMultiwallet builds the multiwallet for the data directory without
+// opening the wallets.
+func (c *cli) newMultiwallet() (*multiwallet.Multiwallet, error) {
+	level, err := log.ParseLevel(c.logLevel)
+	if err != nil {
+		return nil, err
+	}
+	return multiwallet.NewMultiwallet(
+		multiwallet.DataDir(c.dataDir),
+		multiwallet.LogDir(""),
+		multiwallet.LogLevel(level),
+		multiwallet.Network(c.network),
+	)
+}
+
+// open builds the multiwallet and opens the wallets. The caller must
+// close it.
+func (c *cli) open() (*multiwallet.Multiwallet, error) {
+	mw, err := c.newMultiwallet()
+	if err != nil {
+		return nil, err
+	}
+	if err := mw.Start(); err != nil {
+		mw.Close()
+		if strings.Contains(err.Error(), "has not been created") {
+			return nil, fmt.Errorf("%s, run multiwallet init first", err)
+		}
+		return nil, err
+	}
+	return mw, nil
+}
+
+// readPassphrase returns the passphrase from the environment or prompts
+// for it.
+func (c *cli) readPassphrase(prompt string) ([]byte, error) {
+	if c.passphrase != "" {
+		return []byte(c.passphrase), nil
+	}
+	return promptPassphrase(prompt)
+}
+
+// promptPassphrase prompts for a passphrase without echoing it.
+func promptPassphrase(prompt string) ([]byte, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	pw, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if len(pw) == 0 {
+		return nil, errors.New("passphrase is required")
+	}
+	return pw, nil
+}
+
+// readSecret prompts for a secret, such as a seed, without echoing it. If
+// stdin isn't a terminal the first line of stdin is read instead. Secrets
+// are never taken as arguments so they don't end up in the shell history
+// or the process list.
+func readSecret(prompt string) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	var (
+		secret []byte
+		err    error
+	)
+	if terminal.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, prompt)
+		secret, err = terminal.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+	} else {
+		secret, err = bufio.NewReader(os.Stdin).ReadBytes('\n')
+		if err == io.EOF {
+			err = nil
+		}
+	}
+	if err != nil {
+		base.ZeroBytes(secret)
+		return nil, err
+	}
+	secret = bytes.TrimSpace(secret)
+	if len(secret) == 0 {
+		return nil, errors.New("no input")
+	}
+	return secret, nil
+}
+
+// coinArg returns the coin type for a currency code given on the command
+// line.
+func coinArg(mw *multiwallet.Multiwallet, code string) (iwallet.CoinType, iwallet.Wallet, error) {
+	for _, ct := range mw.CoinTypes() {
+		if cc := strings.ToUpper(ct.CurrencyCode()); cc == strings.ToUpper(code) || cc == "T"+strings.ToUpper(code) {
+			wl, err := mw.Wallet(ct)
+			return ct, wl, err
+		}
+	}
+	var codes []string
+	for _, ct := range mw.CoinTypes() {
+		codes = append(codes, ct.CurrencyCode())
+	}
+	return "", nil, fmt.Errorf("unknown coin %s, expected one of %s", code, strings.Join(codes, ", "))
+}
+
+// parseAmount parses an amount in the coin's base unit.
+func parseAmount(s string) (iwallet.Amount, error) {
+	if amount, ok := new(big.Int).SetString(s, 10); !ok || amount.Sign() <= 0 {
+		return iwallet.Amount{}, errors.New("amount must be a positive integer in the coin's base unit")
+	}
+	return iwallet.NewAmount(s), nil
+}
+
+func parseFeeLevel(level string) (iwallet.FeeLevel, error) {
+	switch strings.ToLower(level) {
+	case "priority":
+		return iwallet.FlPriority, nil
+	case "normal":
+		return iwallet.FlNormal, nil
+	case "economic":
+		return iwallet.FlEconomic, nil
+	default:
+		return 0, errors.New("fee level must be priority, normal or economic")
+	}
+}
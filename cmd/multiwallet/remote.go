@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/cpacia/multiwallet/api"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var apiClient = &http.Client{Timeout: time.Minute}
+
+// call makes a request to the API and decodes the response into resp.
+func (c *cli) call(method, path string, body, resp interface{}) error {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.apiURL, "/")+path, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	r, err := apiClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&apiErr); err != nil || apiErr.Error == "" {
+			return fmt.Errorf("api returned %s", r.Status)
+		}
+		return errors.New(apiErr.Error)
+	}
+	return json.NewDecoder(r.Body).Decode(resp)
+}
+
+func coinPath(coin, endpoint string) string {
+	return "/v1/" + url.PathEscape(strings.ToLower(coin)) + "/" + endpoint
+}
+
+func remoteAddress(c *cli, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	var resp struct {
+		Address string `json:"address"`
+	}
+	if err := c.call(http.MethodGet, coinPath(args[0], "address"), nil, &resp); err != nil {
+		return err
+	}
+	fmt.Println(resp.Address)
+	return nil
+}
+
+func remoteBalance(c *cli, args []string) error {
+	if len(args) != 1 {
+		return errors.New("a coin is required with -api")
+	}
+	var resp struct {
+		Unconfirmed string `json:"unconfirmed"`
+		Confirmed   string `json:"confirmed"`
+	}
+	if err := c.call(http.MethodGet, coinPath(args[0], "balance"), nil, &resp); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "COIN\tCONFIRMED\tUNCONFIRMED")
+	fmt.Fprintf(w, "%s\t%s\t%s\n", strings.ToUpper(args[0]), resp.Confirmed, resp.Unconfirmed)
+	return w.Flush()
+}
+
+func remoteSend(c *cli, args []string) error {
+	fs := flag.NewFlagSet("send", flag.ExitOnError)
+	fee := fs.String("fee", "normal", "fee level: priority, normal or economic")
+	fs.Parse(args)
+	if fs.NArg() != 3 {
+		return errUsage
+	}
+	if _, err := parseFeeLevel(*fee); err != nil {
+		return err
+	}
+	if _, err := parseAmount(fs.Arg(2)); err != nil {
+		return err
+	}
+	req := struct {
+		Address  string `json:"address"`
+		Amount   string `json:"amount"`
+		FeeLevel string `json:"feeLevel"`
+	}{fs.Arg(1), fs.Arg(2), *fee}
+	var resp struct {
+		Txid string `json:"txid"`
+	}
+	if err := c.call(http.MethodPost, coinPath(fs.Arg(0), "spend"), req, &resp); err != nil {
+		return err
+	}
+	fmt.Println(resp.Txid)
+	return nil
+}
+
+func remoteHistory(c *cli, args []string) error {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	limit := fs.Int("limit", 20, "number of transactions")
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		return errUsage
+	}
+
+	path := "/v1/transactions"
+	if fs.NArg() == 1 {
+		path = coinPath(fs.Arg(0), "transactions")
+	}
+	var resp struct {
+		Transactions []api.Transaction `json:"transactions"`
+	}
+	if err := c.call(http.MethodGet, path+"?limit="+strconv.Itoa(*limit), nil, &resp); err != nil {
+		return err
+	}
+	rows := make([]historyRow, 0, len(resp.Transactions))
+	for _, tx := range resp.Transactions {
+		rows = append(rows, historyRow{tx.Coin, tx.Transaction})
+	}
+	return printHistory(rows)
+}
@@ -0,0 +1,256 @@
+package bitcoin
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+)
+
+// BIP 322 proves control of an address by signing a virtual transaction
+// which spends a virtual output paying to the address. The output commits
+// to the message so the signature can't be reused for a different one.
+// Unlike the legacy signed message format, which only works for P2PKH
+// addresses, proofs can be made for any script.
+//
+// Other UTXO coins use the legacy format through WalletBase.SignMessage.
+
+// bip322Tag is the tag of the BIP 322 message hash.
+const bip322Tag = "BIP0322-signed-message"
+
+// bip322MessageHash returns the tagged hash of the message committed to by
+// the virtual output.
+func bip322MessageHash(message string) []byte {
+	return taggedHash(bip322Tag, []byte(message))
+}
+
+// bip322ToSpend returns the virtual transaction which pays to the address
+// with the given script.
+func bip322ToSpend(challenge []byte, message string) (*wire.MsgTx, error) {
+	sigScript, err := txscript.NewScriptBuilder().AddOp(txscript.OP_0).AddData(bip322MessageHash(message)).Script()
+	if err != nil {
+		return nil, err
+	}
+	tx := wire.NewMsgTx(0)
+	tx.AddTxIn(&wire.TxIn{
+		PreviousOutPoint: wire.OutPoint{Hash: chainhash.Hash{}, Index: 0xffffffff},
+		SignatureScript:  sigScript,
+		Sequence:         0,
+	})
+	tx.AddTxOut(wire.NewTxOut(0, challenge))
+	return tx, nil
+}
+
+// bip322ToSign returns the unsigned virtual transaction which spends the
+// output of toSpend.
+func bip322ToSign(toSpend *wire.MsgTx) *wire.MsgTx {
+	tx := wire.NewMsgTx(0)
+	tx.AddTxIn(&wire.TxIn{
+		PreviousOutPoint: wire.OutPoint{Hash: toSpend.TxHash(), Index: 0},
+		Sequence:         0,
+	})
+	tx.AddTxOut(wire.NewTxOut(0, []byte{txscript.OP_RETURN}))
+	return tx
+}
+
+// SignMessageBIP322 signs the message with the key for one of the wallet's
+// addresses using the BIP 322 generic signed message format. Native segwit
+// and taproot addresses produce the simple format, which is the witness of
+// the signed virtual transaction. Other addresses produce the full format,
+// which is the whole transaction. Cosigned and vault addresses can't be
+// signed for. The wallet must be unlocked to use this function.
+func (w *BitcoinWallet) SignMessageBIP322(addr iwallet.Address, message string) (string, error) {
+	challenge, err := w.addressToScript(addr.String())
+	if err != nil {
+		return "", err
+	}
+	simple := isPayToTaproot(challenge) || txscript.IsPayToWitnessPubKeyHash(challenge)
+	if !simple && !txscript.IsPayToScriptHash(challenge) && txscript.GetScriptClass(challenge) != txscript.PubKeyHashTy {
+		return "", errors.New("message signing is not supported for this address type")
+	}
+
+	toSpend, err := bip322ToSpend(challenge, message)
+	if err != nil {
+		return "", err
+	}
+	toSign := bip322ToSign(toSpend)
+	op := toSign.TxIn[0].PreviousOutPoint
+
+	err = w.DB.View(func(dbtx database.Tx) error {
+		key, err := w.Keychain.KeyForAddress(dbtx, addr, nil)
+		if err != nil {
+			return err
+		}
+		defer base.ZeroKey(key)
+
+		privKey, err := key.ECPrivKey()
+		if err != nil {
+			return err
+		}
+		defer base.ZeroPrivKey(privKey)
+
+		prevScripts := map[wire.OutPoint][]byte{op: challenge}
+		values := map[wire.OutPoint]int64{op: 0}
+		return signInput(toSign, txscript.NewTxSigHashes(toSign), 0, values, prevScripts, privKey, w.params())
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if simple {
+		if err := serializeWitness(&buf, toSign.TxIn[0].Witness); err != nil {
+			return "", err
+		}
+	} else if err := toSign.Serialize(&buf); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// VerifyMessageBIP322 returns whether the signature proves control of the
+// address. The signature may be in the simple or full BIP 322 format or,
+// for P2PKH addresses, the legacy signed message format. The address does
+// not need to belong to this wallet and may be for any script, though
+// taproot script path spends and proofs of funds aren't supported.
+func (w *BitcoinWallet) VerifyMessageBIP322(addr iwallet.Address, sig string, message string) (bool, error) {
+	challenge, err := w.addressToScript(addr.String())
+	if err != nil {
+		return false, err
+	}
+	sigBytes, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return false, base.ErrInvalidSignature
+	}
+
+	if len(sigBytes) == 65 && txscript.GetScriptClass(challenge) == txscript.PubKeyHashTy {
+		return verifyLegacyMessage(challenge, sigBytes, message, w.params()), nil
+	}
+
+	toSpend, err := bip322ToSpend(challenge, message)
+	if err != nil {
+		return false, err
+	}
+	toSign, err := decodeBIP322Signature(sigBytes, toSpend)
+	if err != nil {
+		return false, err
+	}
+	// A full signature for a different message or address spends a
+	// different virtual output.
+	if toSign.TxIn[0].PreviousOutPoint != (wire.OutPoint{Hash: toSpend.TxHash(), Index: 0}) {
+		return false, nil
+	}
+
+	if isPayToTaproot(challenge) {
+		witness := toSign.TxIn[0].Witness
+		if len(witness) != 1 || len(witness[0]) != 64 {
+			return false, errors.New("only taproot key path signatures with the default sighash are supported")
+		}
+		op := toSign.TxIn[0].PreviousOutPoint
+		sigHash, err := taprootSigHash(toSign, 0, map[wire.OutPoint][]byte{op: challenge}, map[wire.OutPoint]int64{op: 0})
+		if err != nil {
+			return false, err
+		}
+		return schnorrVerify(challenge[2:], sigHash, witness[0]), nil
+	}
+
+	vm, err := txscript.NewEngine(challenge, toSign, 0, txscript.StandardVerifyFlags, nil, txscript.NewTxSigHashes(toSign), 0)
+	if err != nil {
+		return false, err
+	}
+	return vm.Execute() == nil, nil
+}
+
+// decodeBIP322Signature returns the signed virtual transaction from a
+// signature in the full format, or builds it from the witness in the simple
+// format.
+func decodeBIP322Signature(sig []byte, toSpend *wire.MsgTx) (*wire.MsgTx, error) {
+	var full wire.MsgTx
+	r := bytes.NewReader(sig)
+	if err := full.Deserialize(r); err == nil && r.Len() == 0 && len(full.TxIn) > 0 {
+		if len(full.TxIn) > 1 {
+			return nil, errors.New("proofs of funds are not supported")
+		}
+		if len(full.TxOut) != 1 || full.TxOut[0].Value != 0 || !bytes.Equal(full.TxOut[0].PkScript, []byte{txscript.OP_RETURN}) {
+			return nil, base.ErrInvalidSignature
+		}
+		return &full, nil
+	}
+
+	witness, err := deserializeWitness(sig)
+	if err != nil {
+		return nil, base.ErrInvalidSignature
+	}
+	toSign := bip322ToSign(toSpend)
+	toSign.TxIn[0].Witness = witness
+	return toSign, nil
+}
+
+// verifyLegacyMessage returns whether the compact signature over the
+// message in the legacy signed message format is from the key of the P2PKH
+// script.
+func verifyLegacyMessage(challenge, sig []byte, message string, params *chaincfg.Params) bool {
+	pubKey, compressed, err := btcec.RecoverCompact(btcec.S256(), sig, base.MessageHash(base.DefaultMessageMagic, message))
+	if err != nil {
+		return false
+	}
+	serialized := pubKey.SerializeUncompressed()
+	if compressed {
+		serialized = pubKey.SerializeCompressed()
+	}
+	addr, err := btcutil.NewAddressPubKeyHash(btcutil.Hash160(serialized), params)
+	if err != nil {
+		return false
+	}
+	script, err := txscript.PayToAddrScript(addr)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(script, challenge)
+}
+
+// serializeWitness writes the witness stack in the encoding used by the
+// simple format.
+func serializeWitness(buf *bytes.Buffer, witness wire.TxWitness) error {
+	if err := wire.WriteVarInt(buf, 0, uint64(len(witness))); err != nil {
+		return err
+	}
+	for _, item := range witness {
+		if err := wire.WriteVarBytes(buf, 0, item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deserializeWitness reads a witness stack in the encoding used by the
+// simple format.
+func deserializeWitness(b []byte) (wire.TxWitness, error) {
+	r := bytes.NewReader(b)
+	n, err := wire.ReadVarInt(r, 0)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 || n > uint64(len(b)) {
+		return nil, errors.New("invalid witness")
+	}
+	witness := make(wire.TxWitness, n)
+	for i := range witness {
+		witness[i], err = wire.ReadVarBytes(r, 0, txscript.MaxScriptSize, "witness item")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if r.Len() != 0 {
+		return nil, errors.New("invalid witness")
+	}
+	return witness, nil
+}
@@ -0,0 +1,142 @@
+package bitcoin
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil"
+	"github.com/cpacia/multiwallet/base"
+	iwallet "github.com/cpacia/wallet-interface"
+	"github.com/jarcoal/httpmock"
+	"testing"
+)
+
+func TestBIP322MessageHash(t *testing.T) {
+	tests := []struct {
+		message  string
+		expected string
+	}{
+		{"", "c90c269c4f8fcbe6880f72a721ddfbf1914268a794cbb21cfafee13770ae19f1"},
+		{"Hello World", "f0eb03b1a75ac6d9847f55c624a99169b5dccba2a31f5b23bea77ba270de0a7a"},
+	}
+	for _, test := range tests {
+		if h := hex.EncodeToString(bip322MessageHash(test.message)); h != test.expected {
+			t.Errorf("Message %q: expected hash %s, got %s", test.message, test.expected, h)
+		}
+	}
+}
+
+func TestBitcoinWallet_SignVerifyMessageBIP322(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	for _, addrType := range []base.AddressType{base.AddressTypeNativeSegwit, base.AddressTypeNestedSegwit, base.AddressTypeLegacy, base.AddressTypeTaproot} {
+		w, err := newTestWalletWithAddressType(addrType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr, err := w.Keychain.CurrentAddress(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, err := w.Keychain.NewAddress(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sig, err := w.SignMessageBIP322(addr, "Hello World")
+		if err != nil {
+			t.Fatalf("Address type %d: %s", addrType, err)
+		}
+		valid, err := w.VerifyMessageBIP322(addr, sig, "Hello World")
+		if err != nil {
+			t.Fatalf("Address type %d: %s", addrType, err)
+		}
+		if !valid {
+			t.Errorf("Address type %d: signature did not verify", addrType)
+		}
+
+		valid, err = w.VerifyMessageBIP322(addr, sig, "Goodbye World")
+		if err != nil {
+			t.Fatalf("Address type %d: %s", addrType, err)
+		}
+		if valid {
+			t.Errorf("Address type %d: signature verified for the wrong message", addrType)
+		}
+
+		valid, err = w.VerifyMessageBIP322(other, sig, "Hello World")
+		if err != nil {
+			t.Fatalf("Address type %d: %s", addrType, err)
+		}
+		if valid {
+			t.Errorf("Address type %d: signature verified for the wrong address", addrType)
+		}
+	}
+}
+
+func TestBitcoinWallet_VerifyMessageBIP322Legacy(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	w, err := newTestWalletWithAddressType(base.AddressTypeLegacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := w.Keychain.CurrentAddress(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := w.SignMessage(addr, "Hello World")
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid, err := w.VerifyMessageBIP322(addr, sig, "Hello World")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !valid {
+		t.Error("Legacy signature did not verify")
+	}
+
+	// Legacy signatures from uncompressed keys are accepted for their
+	// addresses.
+	key, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	uncompressed, err := btcutil.NewAddressPubKeyHash(btcutil.Hash160(key.PubKey().SerializeUncompressed()), &chaincfg.TestNet3Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compact, err := btcec.SignCompact(btcec.S256(), key, base.MessageHash(base.DefaultMessageMagic, "Hello World"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid, err = w.VerifyMessageBIP322(iwallet.NewAddress(uncompressed.String(), iwallet.CtBitcoin), base64.StdEncoding.EncodeToString(compact), "Hello World")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !valid {
+		t.Error("Uncompressed legacy signature did not verify")
+	}
+}
+
+func TestBitcoinWallet_VerifyMessageBIP322Invalid(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	w, err := newTestWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := w.Keychain.CurrentAddress(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sig := range []string{"not a signature", "AA==", base64.StdEncoding.EncodeToString([]byte{0x01, 0x05, 0x01})} {
+		if _, err := w.VerifyMessageBIP322(addr, sig, "Hello World"); err != base.ErrInvalidSignature {
+			t.Errorf("Signature %q: expected ErrInvalidSignature, got %v", sig, err)
+		}
+	}
+}
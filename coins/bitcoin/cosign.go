@@ -0,0 +1,548 @@
+package bitcoin
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/base58"
+	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"gorm.io/gorm"
+	"sync"
+	"time"
+)
+
+// ErrInvalidCosignature is returned by ApproveCosign when a signature
+// from the cosigner doesn't verify.
+var ErrInvalidCosignature = errors.New("invalid cosigner signature")
+
+// cosigner holds the second device's keys in a 2-of-2 cosigned wallet.
+type cosigner struct {
+	account  *hdkeychain.ExtendedKey
+	external *hdkeychain.ExtendedKey
+	internal *hdkeychain.ExtendedKey
+
+	// externalFP is the fingerprint of the wallet's own external chain
+	// key. It tells cosignAddress which chain a key was derived from.
+	externalFP uint32
+
+	// scripts are the witness scripts of the wallet's addresses indexed
+	// by output script.
+	mtx     sync.Mutex
+	scripts map[string]cosignScript
+}
+
+// cosignScript is the witness script of a cosigned address and the path
+// of its keys.
+type cosignScript struct {
+	script []byte
+	change bool
+	index  uint32
+}
+
+// setCosigner puts the wallet in cosign mode with the device's account
+// level extended public key.
+func (w *BitcoinWallet) setCosigner(xpub string) error {
+	key, err := hdkeychain.NewKeyFromString(xpub)
+	if err != nil {
+		return err
+	}
+	if key.IsPrivate() {
+		return errors.New("cosigner key must be a public key")
+	}
+	if !key.IsForNet(w.params()) {
+		return errors.New("cosigner key is for the wrong network")
+	}
+	external, internal, err := accountChainKeys(key)
+	if err != nil {
+		return err
+	}
+	w.cosigner = &cosigner{
+		account:  key,
+		external: external,
+		internal: internal,
+		scripts:  make(map[string]cosignScript),
+	}
+	w.Hold = w.requestCosign
+	return nil
+}
+
+// OpenWallet opens the wallet. Wallets with a descriptor first check it
+// has the wallet's key. Cosigned wallets and wallets with a Signer
+// first load the fingerprint used to tell which chain their keys are on.
+// Once open every address is derived again, which checks they all match
+// the wallet's keys and indexes their scripts for signing. Other wallets
+// start scanning for silent payments.
+func (w *BitcoinWallet) OpenWallet() error {
+	if w.descriptor != nil {
+		if err := w.checkDescriptorKey(); err != nil {
+			return err
+		}
+	}
+	if w.cosigner == nil && w.signer == nil {
+		if err := w.Wallet.OpenWallet(); err != nil {
+			return err
+		}
+		if w.silentPayments {
+			go w.silentPaymentLoop()
+		}
+		return nil
+	}
+
+	var record database.CoinRecord
+	err := w.DB.View(func(dbtx database.Tx) error {
+		return dbtx.Read().Where("coin=?", iwallet.CtBitcoin.CurrencyCode()).First(&record).Error
+	})
+	if err != nil {
+		return err
+	}
+	accountKey, err := record.MasterPublicKey()
+	if err != nil {
+		return err
+	}
+	external, _, err := accountChainKeys(accountKey)
+	if err != nil {
+		return err
+	}
+	externalFP, err := fingerprint(external)
+	if err != nil {
+		return err
+	}
+	if w.cosigner != nil {
+		w.cosigner.externalFP = externalFP
+	} else {
+		w.signer.externalFP = externalFP
+	}
+
+	if err := w.Wallet.OpenWallet(); err != nil {
+		return err
+	}
+	mismatches, err := w.Keychain.VerifyDerivation()
+	if err != nil {
+		return err
+	}
+	if len(mismatches) > 0 {
+		if w.cosigner != nil {
+			return fmt.Errorf("%d wallet addresses don't match the cosigner key", len(mismatches))
+		}
+		return fmt.Errorf("%d wallet addresses don't match the account key", len(mismatches))
+	}
+	return nil
+}
+
+// Start opens the wallet. It's OpenWallet under the name used by
+// base.Lifecycle.
+func (w *BitcoinWallet) Start() error {
+	return w.OpenWallet()
+}
+
+// cosignAddress returns the 2-of-2 P2WSH address of the wallet's key and
+// the cosigner's key at the same path.
+func (w *BitcoinWallet) cosignAddress(key *hdkeychain.ExtendedKey) (iwallet.Address, error) {
+	index, err := childIndex(key)
+	if err != nil {
+		return iwallet.Address{}, err
+	}
+	change := key.ParentFingerprint() != w.cosigner.externalFP
+	chainKey := w.cosigner.external
+	if change {
+		chainKey = w.cosigner.internal
+	}
+	theirKey, err := chainKey.Child(index)
+	if err != nil {
+		return iwallet.Address{}, err
+	}
+	theirPub, err := theirKey.ECPubKey()
+	if err != nil {
+		return iwallet.Address{}, err
+	}
+	ourPub, err := key.ECPubKey()
+	if err != nil {
+		return iwallet.Address{}, err
+	}
+
+	script, err := cosignWitnessScript(ourPub, theirPub)
+	if err != nil {
+		return iwallet.Address{}, err
+	}
+	witnessProgram := sha256.Sum256(script)
+	addr, err := btcutil.NewAddressWitnessScriptHash(witnessProgram[:], w.params())
+	if err != nil {
+		return iwallet.Address{}, err
+	}
+	pkScript, err := txscript.PayToAddrScript(addr)
+	if err != nil {
+		return iwallet.Address{}, err
+	}
+
+	w.cosigner.mtx.Lock()
+	w.cosigner.scripts[string(pkScript)] = cosignScript{script: script, change: change, index: index}
+	w.cosigner.mtx.Unlock()
+
+	return iwallet.NewAddress(addr.String(), iwallet.CtBitcoin), nil
+}
+
+// script returns the witness script of the wallet address with the given
+// output script.
+func (c *cosigner) script(pkScript []byte) (cosignScript, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	s, ok := c.scripts[string(pkScript)]
+	return s, ok
+}
+
+// signInput adds the wallet's signature to the input at the given index.
+// The witness holds the signature and the witness script until the
+// cosigner's signature is added by ApproveCosign.
+func (c *cosigner) signInput(tx *wire.MsgTx, sigHashes *txscript.TxSigHashes, idx int, inVals map[wire.OutPoint]int64, prevScripts map[wire.OutPoint][]byte, key *btcec.PrivateKey) error {
+	op := tx.TxIn[idx].PreviousOutPoint
+	s, ok := c.script(prevScripts[op])
+	if !ok {
+		return errors.New("input is not from a cosigned address")
+	}
+	sig, err := txscript.RawTxInWitnessSignature(tx, sigHashes, idx, inVals[op], s.script, txscript.SigHashAll, key)
+	if err != nil {
+		return err
+	}
+	tx.TxIn[idx].Witness = wire.TxWitness{sig, s.script}
+	return nil
+}
+
+// requestCosign is the wallet's Hold function in cosign mode. Instead of
+// broadcasting the transaction it's saved as a cosign request when wtx is
+// committed.
+func (w *BitcoinWallet) requestCosign(wtx iwallet.Tx, tx *wire.MsgTx) (iwallet.TransactionID, error) {
+	txid := iwallet.TransactionID(tx.TxHash().String())
+	req := base.CosignRequest{
+		ID:        txid,
+		Coin:      iwallet.CtBitcoin,
+		CreatedAt: time.Now(),
+	}
+	err := w.DB.View(func(dbtx database.Tx) error {
+		for i, in := range tx.TxIn {
+			if len(in.Witness) != 2 {
+				return errors.New("input is not from a cosigned address")
+			}
+			pkScript, err := p2wshScript(in.Witness[1])
+			if err != nil {
+				return err
+			}
+			s, ok := w.cosigner.script(pkScript)
+			if !ok {
+				return errors.New("input is not from a cosigned address")
+			}
+			var utxo database.UtxoRecord
+			err = dbtx.Read().Where("coin=?", iwallet.CtBitcoin.CurrencyCode()).Where("outpoint=?", hex.EncodeToString(serializeOutpoint(&in.PreviousOutPoint))).First(&utxo).Error
+			if err != nil {
+				return err
+			}
+			req.Inputs = append(req.Inputs, base.CosignInput{
+				Index:         i,
+				Amount:        iwallet.NewAmount(utxo.Amount).Int64(),
+				Change:        s.change,
+				KeyIndex:      s.index,
+				WitnessScript: s.script,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return txid, err
+	}
+
+	var buf bytes.Buffer
+	if err := tx.BtcEncode(&buf, wire.ProtocolVersion, wire.WitnessEncoding); err != nil {
+		return txid, err
+	}
+	req.Tx = buf.Bytes()
+	ser, err := json.Marshal(&req)
+	if err != nil {
+		return txid, err
+	}
+
+	wbtx, ok := wtx.(*base.DBTx)
+	if !ok {
+		return txid, errors.New("tx is not expected type")
+	}
+	wbtx.OnCommit = func() error {
+		return w.DB.Update(func(dbtx database.Tx) error {
+			return dbtx.Save(&database.CosignRecord{
+				Txid:      txid.String(),
+				Coin:      iwallet.CtBitcoin.CurrencyCode(),
+				Status:    string(base.CosignPending),
+				CreatedAt: req.CreatedAt,
+				Request:   ser,
+			})
+		})
+	}
+	return txid, nil
+}
+
+// CosignRequests returns the spends waiting for the cosigner's approval.
+func (w *BitcoinWallet) CosignRequests() ([]base.CosignRequest, error) {
+	var records []database.CosignRecord
+	err := w.DB.View(func(dbtx database.Tx) error {
+		err := dbtx.Read().Where("coin=?", iwallet.CtBitcoin.CurrencyCode()).Where("status=?", string(base.CosignPending)).Find(&records).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	reqs := make([]base.CosignRequest, 0, len(records))
+	for _, record := range records {
+		var req base.CosignRequest
+		if err := json.Unmarshal(record.Request, &req); err != nil {
+			return nil, err
+		}
+		reqs = append(reqs, req)
+	}
+	return reqs, nil
+}
+
+// ApproveCosign completes the cosign request with the given ID using the
+// cosigner's signatures, one per request input with the sighash type
+// appended. The signatures are checked before the transaction is
+// broadcast when wtx is committed.
+func (w *BitcoinWallet) ApproveCosign(wtx iwallet.Tx, id iwallet.TransactionID, sigs [][]byte) (iwallet.TransactionID, error) {
+	if w.cosigner == nil {
+		return "", errors.New("wallet has no cosigner")
+	}
+	var tx wire.MsgTx
+	err := w.DB.View(func(dbtx database.Tx) error {
+		req, err := pendingCosign(dbtx, id)
+		if err != nil {
+			return err
+		}
+		if err := tx.BtcDecode(bytes.NewReader(req.Tx), wire.ProtocolVersion, wire.WitnessEncoding); err != nil {
+			return err
+		}
+		if len(sigs) != len(req.Inputs) {
+			return errors.New("incorrect number of signatures")
+		}
+
+		sigHashes := txscript.NewTxSigHashes(&tx)
+		for j, in := range req.Inputs {
+			if in.Index < 0 || in.Index >= len(tx.TxIn) || len(tx.TxIn[in.Index].Witness) != 2 {
+				return errors.New("invalid cosign request")
+			}
+			chainKey := w.cosigner.external
+			if in.Change {
+				chainKey = w.cosigner.internal
+			}
+			theirKey, err := chainKey.Child(in.KeyIndex)
+			if err != nil {
+				return err
+			}
+			theirPub, err := theirKey.ECPubKey()
+			if err != nil {
+				return err
+			}
+
+			theirSig := sigs[j]
+			if len(theirSig) == 0 || theirSig[len(theirSig)-1] != byte(txscript.SigHashAll) {
+				return ErrInvalidCosignature
+			}
+			sig, err := btcec.ParseDERSignature(theirSig[:len(theirSig)-1], btcec.S256())
+			if err != nil {
+				return ErrInvalidCosignature
+			}
+			hash, err := txscript.CalcWitnessSigHash(in.WitnessScript, sigHashes, txscript.SigHashAll, &tx, in.Index, in.Amount)
+			if err != nil {
+				return err
+			}
+			if !sig.Verify(hash, theirPub) {
+				return ErrInvalidCosignature
+			}
+
+			// The signatures must be in the order of the keys in
+			// the script.
+			ourSig := tx.TxIn[in.Index].Witness[0]
+			witness := wire.TxWitness{{}, ourSig, theirSig, in.WitnessScript}
+			if bytes.Equal(in.WitnessScript[2:35], theirPub.SerializeCompressed()) {
+				witness = wire.TxWitness{{}, theirSig, ourSig, in.WitnessScript}
+			}
+			tx.TxIn[in.Index].Witness = witness
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	txid, err := w.CommitTx(wtx, &tx)
+	if err != nil {
+		return txid, err
+	}
+	wbtx := wtx.(*base.DBTx)
+	broadcast := wbtx.OnCommit
+	wbtx.OnCommit = func() error {
+		if err := w.closeCosign(id, base.CosignApproved); err != nil {
+			return err
+		}
+		return broadcast()
+	}
+	return txid, nil
+}
+
+// RejectCosign turns down the cosign request with the given ID. Its
+// transaction is never broadcast.
+func (w *BitcoinWallet) RejectCosign(id iwallet.TransactionID) error {
+	return w.closeCosign(id, base.CosignRejected)
+}
+
+// closeCosign sets the status of a pending cosign request.
+func (w *BitcoinWallet) closeCosign(id iwallet.TransactionID, status base.CosignStatus) error {
+	return w.DB.Update(func(dbtx database.Tx) error {
+		var record database.CosignRecord
+		err := dbtx.Read().Where("coin=?", iwallet.CtBitcoin.CurrencyCode()).Where("txid=?", id.String()).First(&record).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("cosign request %s not found", id)
+		} else if err != nil {
+			return err
+		}
+		if record.Status != string(base.CosignPending) {
+			return base.ErrCosignClosed
+		}
+		record.Status = string(status)
+		return dbtx.Save(&record)
+	})
+}
+
+// pendingCosign returns the cosign request with the given ID if it hasn't
+// been approved or rejected.
+func pendingCosign(dbtx database.Tx, id iwallet.TransactionID) (*base.CosignRequest, error) {
+	var record database.CosignRecord
+	err := dbtx.Read().Where("coin=?", iwallet.CtBitcoin.CurrencyCode()).Where("txid=?", id.String()).First(&record).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("cosign request %s not found", id)
+	} else if err != nil {
+		return nil, err
+	}
+	if record.Status != string(base.CosignPending) {
+		return nil, base.ErrCosignClosed
+	}
+	var req base.CosignRequest
+	if err := json.Unmarshal(record.Request, &req); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+// SignCosignRequest signs every input of the cosign request with the
+// cosigning device's account level private key. It's run on the device,
+// which should first show the user the request's outputs. The signatures
+// are passed back to ApproveCosign.
+func SignCosignRequest(req *base.CosignRequest, accountKey *hdkeychain.ExtendedKey) ([][]byte, error) {
+	var tx wire.MsgTx
+	if err := tx.BtcDecode(bytes.NewReader(req.Tx), wire.ProtocolVersion, wire.WitnessEncoding); err != nil {
+		return nil, err
+	}
+	external, internal, err := accountChainKeys(accountKey)
+	if err != nil {
+		return nil, err
+	}
+	defer base.ZeroKey(external)
+	defer base.ZeroKey(internal)
+
+	sigHashes := txscript.NewTxSigHashes(&tx)
+	sigs := make([][]byte, 0, len(req.Inputs))
+	for _, in := range req.Inputs {
+		if in.Index < 0 || in.Index >= len(tx.TxIn) {
+			return nil, errors.New("invalid cosign request")
+		}
+		chainKey := external
+		if in.Change {
+			chainKey = internal
+		}
+		hdKey, err := chainKey.Child(in.KeyIndex)
+		if err != nil {
+			return nil, err
+		}
+		priv, err := hdKey.ECPrivKey()
+		base.ZeroKey(hdKey)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Contains(in.WitnessScript, priv.PubKey().SerializeCompressed()) {
+			base.ZeroPrivKey(priv)
+			return nil, fmt.Errorf("input %d is not for this key", in.Index)
+		}
+		sig, err := txscript.RawTxInWitnessSignature(&tx, sigHashes, in.Index, in.Amount, in.WitnessScript, txscript.SigHashAll, priv)
+		base.ZeroPrivKey(priv)
+		if err != nil {
+			return nil, err
+		}
+		sigs = append(sigs, sig)
+	}
+	return sigs, nil
+}
+
+// cosignWitnessScript returns the 2-of-2 multisig script of the keys. The
+// keys are sorted so both devices build the same script.
+func cosignWitnessScript(a, b *btcec.PublicKey) ([]byte, error) {
+	keys := [][]byte{a.SerializeCompressed(), b.SerializeCompressed()}
+	if bytes.Compare(keys[0], keys[1]) > 0 {
+		keys[0], keys[1] = keys[1], keys[0]
+	}
+	return txscript.NewScriptBuilder().
+		AddOp(txscript.OP_2).
+		AddData(keys[0]).
+		AddData(keys[1]).
+		AddOp(txscript.OP_2).
+		AddOp(txscript.OP_CHECKMULTISIG).
+		Script()
+}
+
+// p2wshScript returns the P2WSH output script of the witness script.
+func p2wshScript(script []byte) ([]byte, error) {
+	witnessProgram := sha256.Sum256(script)
+	return txscript.NewScriptBuilder().AddOp(txscript.OP_0).AddData(witnessProgram[:]).Script()
+}
+
+// accountChainKeys returns the external and internal chain keys below an
+// account key.
+func accountChainKeys(accountKey *hdkeychain.ExtendedKey) (external, internal *hdkeychain.ExtendedKey, err error) {
+	external, err = accountKey.Child(0)
+	if err != nil {
+		return nil, nil, err
+	}
+	internal, err = accountKey.Child(1)
+	if err != nil {
+		return nil, nil, err
+	}
+	return external, internal, nil
+}
+
+// fingerprint returns the BIP 32 fingerprint of the key, which is the
+// parent fingerprint of its children.
+func fingerprint(key *hdkeychain.ExtendedKey) (uint32, error) {
+	pub, err := key.ECPubKey()
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(btcutil.Hash160(pub.SerializeCompressed())[:4]), nil
+}
+
+// childIndex returns the index of the key below its parent. The hdkeychain
+// version we use doesn't export it so it's read from the serialized key.
+func childIndex(key *hdkeychain.ExtendedKey) (uint32, error) {
+	ser := base58.Decode(key.String())
+	if len(ser) != 82 {
+		return 0, errors.New("invalid extended key")
+	}
+	return binary.BigEndian.Uint32(ser[9:13]), nil
+}
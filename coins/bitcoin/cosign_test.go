@@ -0,0 +1,144 @@
+package bitcoin
+
+import (
+	"bytes"
+	"errors"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/cpacia/multiwallet/base"
+	iwallet "github.com/cpacia/wallet-interface"
+	"github.com/jarcoal/httpmock"
+	"testing"
+)
+
+func TestBitcoinWallet_Cosign(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	cosignerKey, err := hdkeychain.NewMaster(bytes.Repeat([]byte{0x01}, 32), &chaincfg.TestNet3Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cosignerPub, err := cosignerKey.Neuter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := hdkeychain.NewMaster(bytes.Repeat([]byte{0x02}, 32), &chaincfg.TestNet3Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := newTestWalletWithSetup(base.AddressTypeNativeSegwit, func(w *BitcoinWallet) error {
+		return w.setCosigner(cosignerPub.String())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr, err := w.CurrentAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addr.String()) != 62 {
+		t.Errorf("Expected a P2WSH address, got %s", addr)
+	}
+
+	fromScript := fundTestWallet(t, w)
+
+	wtx, err := w.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	txid, err := w.Spend(wtx, iwallet.NewAddress("tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", iwallet.CtBitcoin), iwallet.NewAmount(500000), iwallet.FlNormal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wtx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if txs := loadUnconfirmed(t, w); len(txs) != 0 {
+		t.Fatalf("Expected no broadcast before approval, found %d txs", len(txs))
+	}
+	reqs, err := w.CosignRequests()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 1 {
+		t.Fatalf("Expected 1 cosign request found %d", len(reqs))
+	}
+	if reqs[0].ID != txid {
+		t.Errorf("Expected request %s, got %s", txid, reqs[0].ID)
+	}
+	if len(reqs[0].Inputs) != 1 || reqs[0].Inputs[0].Amount != 1000000 {
+		t.Fatalf("Unexpected request inputs %v", reqs[0].Inputs)
+	}
+
+	// Signatures from another key are rejected.
+	if _, err := SignCosignRequest(&reqs[0], otherKey); err == nil {
+		t.Error("Expected error signing with the wrong key")
+	}
+	badSigs, err := SignCosignRequest(&reqs[0], cosignerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	badSigs[0][10] ^= 0xff
+	wtx, err = w.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.ApproveCosign(wtx, txid, badSigs); !errors.Is(err, ErrInvalidCosignature) {
+		t.Errorf("Expected ErrInvalidCosignature, got %v", err)
+	}
+	if err := wtx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	sigs, err := SignCosignRequest(&reqs[0], cosignerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wtx, err = w.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	approved, err := w.ApproveCosign(wtx, txid, sigs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wtx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if approved != txid {
+		t.Errorf("Expected txid %s, got %s", txid, approved)
+	}
+
+	txs := loadUnconfirmed(t, w)
+	if len(txs) != 1 {
+		t.Fatalf("Expected 1 tx found %d", len(txs))
+	}
+	var tx wire.MsgTx
+	if err := tx.BtcDecode(bytes.NewReader(txs[0].TxBytes), wire.ProtocolVersion, wire.WitnessEncoding); err != nil {
+		t.Fatal(err)
+	}
+	vm, err := txscript.NewEngine(fromScript, &tx, 0, txscript.StandardVerifyFlags, nil, nil, 1000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Execute(); err != nil {
+		t.Errorf("Script verification failed: %s", err)
+	}
+
+	reqs, err = w.CosignRequests()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 0 {
+		t.Errorf("Expected no pending requests found %d", len(reqs))
+	}
+	if err := w.RejectCosign(txid); !errors.Is(err, base.ErrCosignClosed) {
+		t.Errorf("Expected ErrCosignClosed, got %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+package bitcoin
+
+import (
+	"errors"
+	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"time"
+)
+
+// setDescriptor derives the wallet's addresses per the descriptor. Single
+// key descriptors select the address type and a wsh(sortedmulti(2,...))
+// of the wallet's key and another key puts the wallet in cosign mode with
+// the other key.
+func (w *BitcoinWallet) setDescriptor(s string) error {
+	desc, err := base.ParseDescriptor(s)
+	if err != nil {
+		return err
+	}
+	for _, k := range desc.Keys {
+		if !k.Key.IsForNet(w.params()) {
+			return errors.New("descriptor key is for the wrong network")
+		}
+		if _, err := k.AccountKey(); err != nil {
+			return err
+		}
+	}
+
+	if addrType, ok := desc.AddressType(); ok {
+		w.addressType = addrType
+	} else {
+		if desc.Type != base.DescriptorWshMulti || !desc.Sorted || desc.Threshold != 2 || len(desc.Keys) != 2 {
+			return errors.New("multisig descriptors must be wsh(sortedmulti(2,...)) of the wallet's key and a cosigner's")
+		}
+		cosignerKey, err := desc.Keys[1].Key.Neuter()
+		if err != nil {
+			return err
+		}
+		if err := w.setCosigner(cosignerKey.String()); err != nil {
+			return err
+		}
+	}
+	w.descriptor = desc
+	return nil
+}
+
+// CreateWalletFromDescriptor creates the wallet from the first key of its
+// descriptor. If it's a private key the wallet can sign, otherwise it's
+// watch-only. It returns base.ErrNoDescriptor if the wallet wasn't
+// configured with a descriptor.
+func (w *BitcoinWallet) CreateWalletFromDescriptor(birthday time.Time) error {
+	if w.descriptor == nil {
+		return base.ErrNoDescriptor
+	}
+	key := w.descriptor.Keys[0].Key
+	if key.IsPrivate() {
+		return w.CreateWallet(*key, nil, birthday)
+	}
+	return w.CreateWatchOnlyWallet(*key, birthday)
+}
+
+// checkDescriptorKey returns an error if the wallet was created from a
+// different key than the first in its descriptor.
+func (w *BitcoinWallet) checkDescriptorKey() error {
+	accountKey, err := w.accountKey()
+	if err != nil {
+		return err
+	}
+	descriptorKey, err := w.descriptor.Keys[0].Key.Neuter()
+	if err != nil {
+		return err
+	}
+	if accountKey.String() != descriptorKey.String() {
+		return errors.New("wallet key doesn't match the descriptor")
+	}
+	return nil
+}
+
+// Descriptors returns the descriptors of the wallet's receive and change
+// addresses with checksums, for importing the wallet as watch-only into
+// Bitcoin Core or other tools. The wallet's own descriptor is used if it
+// has one so key origins are kept. Private keys are never included.
+func (w *BitcoinWallet) Descriptors() (receive, change string, err error) {
+	accountKey, err := w.accountKey()
+	if err != nil {
+		return "", "", err
+	}
+
+	var desc *base.Descriptor
+	if w.descriptor != nil {
+		desc, err = w.descriptor.Neuter()
+		if err != nil {
+			return "", "", err
+		}
+	} else {
+		wallet := base.DescriptorKey{Key: accountKey, Multipath: []uint32{0, 1}, Wildcard: true}
+		desc = &base.Descriptor{
+			Type: base.AddressTypeDescriptor(w.addressType),
+			Keys: []base.DescriptorKey{wallet},
+		}
+		if w.cosigner != nil {
+			cosigner := base.DescriptorKey{Key: w.cosigner.account, Multipath: []uint32{0, 1}, Wildcard: true}
+			desc = &base.Descriptor{
+				Type:      base.DescriptorWshMulti,
+				Threshold: 2,
+				Sorted:    true,
+				Keys:      []base.DescriptorKey{wallet, cosigner},
+			}
+		}
+	}
+
+	receiveDesc, changeDesc, err := desc.ChainDescriptors()
+	if err != nil {
+		return "", "", err
+	}
+	return receiveDesc.String(), changeDesc.String(), nil
+}
+
+// accountKey returns the public key the wallet was created from.
+func (w *BitcoinWallet) accountKey() (*hdkeychain.ExtendedKey, error) {
+	var record database.CoinRecord
+	err := w.DB.View(func(dbtx database.Tx) error {
+		return dbtx.Read().Where("coin=?", iwallet.CtBitcoin.CurrencyCode()).First(&record).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return record.MasterPublicKey()
+}
@@ -0,0 +1,142 @@
+package bitcoin
+
+import (
+	"github.com/cpacia/multiwallet/base"
+	"github.com/jarcoal/httpmock"
+	"testing"
+	"time"
+)
+
+// The keys are m/44'/1' of BIP 32's first test vector seed and of the
+// reversed seed.
+const (
+	testDescriptorTpub  = "tpubDBniRdE6LfcDw33DxZHePjQNjqGnocz5hFBVVGG8qemugynS8cEh2mmZpzYrApNPTDx8yLkgCq8MGuY15rKEvnDhzhHKgFDTC6ArvtsbcTE"
+	testDescriptorTpub2 = "tpubDACMoiKmUTz6QUchiA7cwsymLYeLxUdh4MRskB6C5vqrieqjuiKd2jcoy2HwTpvwW5PfrhX7pedsx5P9XjiHJa6eKsk8ofuX4BQmLnrsUSB"
+)
+
+func TestBitcoinWallet_CreateWalletFromDescriptor(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	tests := []struct {
+		descriptor string
+		address    string
+		receive    string
+		change     string
+	}{
+		{
+			descriptor: "wpkh(" + testDescriptorTpub + "/0/*)",
+			address:    "tb1qcq03tfyesyxgv3a7tj88v9ehwmhpp22quwdzmp",
+			receive:    "wpkh(" + testDescriptorTpub + "/0/*)#cyjynyha",
+			change:     "wpkh(" + testDescriptorTpub + "/1/*)#fsh9w389",
+		},
+		{
+			descriptor: "sh(wpkh(" + testDescriptorTpub + "/<0;1>/*))",
+			address:    "2NFaDAtmGreeB11z8JHmeMdGWeVLUiAERLC",
+			receive:    "sh(wpkh(" + testDescriptorTpub + "/0/*))#y0222rmw",
+			change:     "sh(wpkh(" + testDescriptorTpub + "/1/*))#zvz03ws6",
+		},
+		{
+			descriptor: "pkh(" + testDescriptorTpub + "/0/*)#j32fwy9y",
+			address:    "my2oGgEu6KpWQCow5rbQeW9TvMugnskC31",
+			receive:    "pkh(" + testDescriptorTpub + "/0/*)#j32fwy9y",
+			change:     "pkh(" + testDescriptorTpub + "/1/*)#r90gn34u",
+		},
+		{
+			descriptor: "tr(" + testDescriptorTpub + "/0/*)",
+			address:    "tb1p96nhvqftmqjft465ujxqat64chtuml4lx5gqmg4j6zqk5nak86lswtqpru",
+			receive:    "tr(" + testDescriptorTpub + "/0/*)#vg6qf5l4",
+			change:     "tr(" + testDescriptorTpub + "/1/*)#aulp5p0d",
+		},
+		{
+			descriptor: "wsh(sortedmulti(2," + testDescriptorTpub + "/<0;1>/*," + testDescriptorTpub2 + "/<0;1>/*))",
+			address:    "tb1q3kmg4ysdwth44z3hmv6hu670saenkwrftq0l7ll8f3h9wmaxf63s4zej46",
+			receive:    "wsh(sortedmulti(2," + testDescriptorTpub + "/0/*," + testDescriptorTpub2 + "/0/*))#tq3penhj",
+			change:     "wsh(sortedmulti(2," + testDescriptorTpub + "/1/*," + testDescriptorTpub2 + "/1/*))#gqp5uhrp",
+		},
+		{
+			descriptor: "wpkh([3442193e/44'/1']" + testDescriptorTpub + "/0/*)",
+			address:    "tb1qcq03tfyesyxgv3a7tj88v9ehwmhpp22quwdzmp",
+			receive:    "wpkh([3442193e/44h/1h]" + testDescriptorTpub + "/0/*)#msglphav",
+			change:     "wpkh([3442193e/44h/1h]" + testDescriptorTpub + "/1/*)#2yd7uzd5",
+		},
+	}
+	for _, test := range tests {
+		w, err := newTestWalletWithSetup(base.AddressTypeNativeSegwit, func(w *BitcoinWallet) error {
+			if err := w.setDescriptor(test.descriptor); err != nil {
+				return err
+			}
+			return w.CreateWalletFromDescriptor(time.Now())
+		})
+		if err != nil {
+			t.Fatalf("%s: %s", test.descriptor, err)
+		}
+		if !w.IsWatchOnly() {
+			t.Errorf("%s: expected a watch-only wallet", test.descriptor)
+		}
+
+		addr, err := w.CurrentAddress()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr.String() != test.address {
+			t.Errorf("%s: expected address %s, got %s", test.descriptor, test.address, addr)
+		}
+
+		receive, change, err := w.Descriptors()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if receive != test.receive {
+			t.Errorf("Expected receive descriptor %s, got %s", test.receive, receive)
+		}
+		if change != test.change {
+			t.Errorf("Expected change descriptor %s, got %s", test.change, change)
+		}
+	}
+}
+
+func TestBitcoinWallet_DescriptorErrors(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	for _, desc := range []string{
+		"wpkh(xpub6BR5uPQQdPemcT96i4t8fd4Xo1Cuy7sLXfq2bjmoPexp79oBRUs9Q93CG7E9aQHsj8emsdSLbpXzFqLi5oyuJPFkH9YxFQSWMgdwmq9Yxkd/0/*)",
+		"wpkh(" + testDescriptorTpub + "/0/0)",
+		"wsh(multi(2," + testDescriptorTpub + "/0/*," + testDescriptorTpub2 + "/0/*))",
+		"sh(sortedmulti(2," + testDescriptorTpub + "/0/*," + testDescriptorTpub2 + "/0/*))",
+	} {
+		w := &BitcoinWallet{network: base.NetworkTestnet}
+		if err := w.setDescriptor(desc); err == nil {
+			t.Errorf("Expected an error setting descriptor %s", desc)
+		}
+	}
+
+	// A wallet created from another key doesn't open.
+	_, err := newTestWalletWithSetup(base.AddressTypeNativeSegwit, func(w *BitcoinWallet) error {
+		return w.setDescriptor("wpkh(" + testDescriptorTpub + "/0/*)")
+	})
+	if err == nil {
+		t.Error("Expected an error opening a wallet whose key doesn't match its descriptor")
+	}
+
+	// Wallets without a descriptor export one for their address type.
+	w, err := newTestWalletWithAddressType(base.AddressTypeTaproot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.CreateWalletFromDescriptor(time.Now()); err != base.ErrNoDescriptor {
+		t.Errorf("Expected ErrNoDescriptor, got %v", err)
+	}
+	receive, _, err := w.Descriptors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc, err := base.ParseDescriptor(receive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.Type != base.DescriptorTR || desc.Keys[0].Key.IsPrivate() {
+		t.Errorf("Expected a public tr descriptor, got %s", receive)
+	}
+}
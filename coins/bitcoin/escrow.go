@@ -0,0 +1,340 @@
+package bitcoin
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/txsort"
+	"github.com/btcsuite/btcwallet/wallet/txsizes"
+	"github.com/cpacia/multiwallet/base"
+	iwallet "github.com/cpacia/wallet-interface"
+	"sort"
+)
+
+// The byte slice returned with an escrow address is one of:
+//
+//   - the redeem script of a P2WSH escrow
+//   - a serialized MuSig2 escrow, see musig_escrow.go
+//   - the redeem script of a P2SH escrow prefixed with p2shEscrowVersion
+//
+// Either redeem script may be further prefixed with sortedEscrowVersion
+// if the keys in it were sorted as in BIP67.
+//
+// Redeem scripts start with a small integer or OP_IF so a version byte
+// can't be mistaken for the start of one. P2WSH escrows have no version
+// byte so they're compatible with older versions of the wallet.
+
+// p2shEscrowVersion marks the redeem script of a legacy P2SH escrow.
+const p2shEscrowVersion = 0x02
+
+// sortedEscrowVersion marks a redeem script whose keys were sorted so
+// every party derives the same address whatever order they list the keys.
+const sortedEscrowVersion = 0x03
+
+// orderEscrowKeys returns keys in the order they're used in the redeem
+// script. If the wallet was configured with EscrowSortedKeys they're
+// sorted by their compressed encoding as in BIP67, otherwise the caller's
+// order is kept.
+func (w *BitcoinWallet) orderEscrowKeys(keys []btcec.PublicKey) []btcec.PublicKey {
+	if !w.escrowSortedKeys {
+		return keys
+	}
+	pubkeys := make([]*btcec.PublicKey, 0, len(keys))
+	for i := range keys {
+		pubkeys = append(pubkeys, &keys[i])
+	}
+	sorted := make([]btcec.PublicKey, 0, len(keys))
+	for _, key := range sortKeys(pubkeys) {
+		sorted = append(sorted, *key)
+	}
+	return sorted
+}
+
+// escrowAddress returns the address for the redeem script along with the
+// byte slice describing the escrow.
+func (w *BitcoinWallet) escrowAddress(redeemScript []byte) (iwallet.Address, []byte, error) {
+	var (
+		address iwallet.Address
+		escrow  []byte
+	)
+	if w.escrowP2SH {
+		addr, err := btcutil.NewAddressScriptHash(redeemScript, w.params())
+		if err != nil {
+			return iwallet.Address{}, nil, err
+		}
+		address = iwallet.NewAddress(addr.String(), iwallet.CtBitcoin)
+		escrow = append([]byte{p2shEscrowVersion}, redeemScript...)
+	} else {
+		witnessProgram := sha256.Sum256(redeemScript)
+		addr, err := btcutil.NewAddressWitnessScriptHash(witnessProgram[:], w.params())
+		if err != nil {
+			return iwallet.Address{}, nil, err
+		}
+		address = iwallet.NewAddress(addr.String(), iwallet.CtBitcoin)
+		escrow = redeemScript
+	}
+	if w.escrowSortedKeys {
+		escrow = append([]byte{sortedEscrowVersion}, escrow...)
+	}
+	return address, escrow, nil
+}
+
+// splitEscrowScript returns the redeem script from the byte slice and
+// whether it is a P2SH escrow.
+func splitEscrowScript(b []byte) ([]byte, bool) {
+	if isSortedEscrow(b) {
+		b = b[1:]
+	}
+	if len(b) > 0 && b[0] == p2shEscrowVersion {
+		return b[1:], true
+	}
+	return b, false
+}
+
+// isSortedEscrow returns whether the escrow's redeem script was built with
+// sorted keys. Counterparties can use it to check they've derived the
+// address the same way.
+func isSortedEscrow(b []byte) bool {
+	return len(b) > 0 && b[0] == sortedEscrowVersion
+}
+
+// escrowSize returns the virtual size of a transaction spending nIns
+// inputs from an m of n multisig escrow to nOuts outputs. Signatures are
+// assumed to be the largest DER encoding.
+func escrowSize(m, n, nIns, nOuts int, p2sh bool) int {
+	const sigSize = 1 + 72 + 1
+
+	redeemScriptSize := 1 + n*(1+33) + 1 + 1
+
+	// 8 bytes are for version and locktime
+	size := 8 + wire.VarIntSerializeSize(uint64(nIns)) + wire.VarIntSerializeSize(uint64(nOuts)) +
+		txsizes.P2PKHOutputSize*nOuts
+
+	if p2sh {
+		// The CHECKMULTISIG dummy, signatures and the redeem script push.
+		scriptSigSize := 1 + m*sigSize + redeemScriptSize + 1
+		if redeemScriptSize > txscript.OP_DATA_75 {
+			scriptSigSize++
+		}
+		if redeemScriptSize > 0xff {
+			scriptSigSize++
+		}
+		return size + nIns*(36+wire.VarIntSerializeSize(uint64(scriptSigSize))+scriptSigSize+4)
+	}
+
+	// The segwit marker and flag then, for each input, the item count,
+	// CHECKMULTISIG dummy, signatures and redeem script are all witness
+	// data.
+	witness := 2 + nIns*(1+1+m*sigSize+wire.VarIntSerializeSize(uint64(redeemScriptSize))+redeemScriptSize)
+	return size + nIns*41 + (witness+3)/4
+}
+
+// pushesToScript returns a script pushing each item, used to turn a
+// witness stack into the equivalent P2SH signature script.
+func pushesToScript(items [][]byte) ([]byte, error) {
+	builder := txscript.NewScriptBuilder()
+	for _, item := range items {
+		builder.AddData(item)
+	}
+	return builder.Script()
+}
+
+// escrowTx returns the unsigned, BIP69 sorted transaction spending from an
+// escrow along with the amount of each input.
+func (w *BitcoinWallet) escrowTx(txn iwallet.Transaction) (*wire.MsgTx, map[wire.OutPoint]int64, error) {
+	tx := wire.NewMsgTx(1)
+	amounts := make(map[wire.OutPoint]int64)
+	for _, from := range txn.From {
+		op, err := deserializeOutpoint(from.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		amounts[*op] = from.Amount.Int64()
+
+		input := wire.NewTxIn(op, nil, nil)
+		tx.TxIn = append(tx.TxIn, input)
+	}
+	for _, to := range txn.To {
+		scriptPubkey, err := w.addressToScript(to.Address.String())
+		if err != nil {
+			return nil, nil, err
+		}
+		output := wire.NewTxOut(to.Amount.Int64(), scriptPubkey)
+		tx.TxOut = append(tx.TxOut, output)
+	}
+
+	// BIP 69 sorting
+	txsort.InPlaceSort(tx)
+	return tx, amounts, nil
+}
+
+// escrowSigHash returns the SigHashAll signature hash for input idx.
+func escrowSigHash(tx *wire.MsgTx, sigHashes *txscript.TxSigHashes, idx int, amount int64, redeemScript []byte, p2sh bool) ([]byte, error) {
+	if p2sh {
+		return txscript.CalcSignatureHash(redeemScript, txscript.SigHashAll, tx, idx)
+	}
+	return txscript.CalcWitnessSigHash(redeemScript, sigHashes, txscript.SigHashAll, tx, idx, amount)
+}
+
+// escrowKeys returns the public keys in the redeem script in the order
+// they appear.
+func escrowKeys(redeemScript []byte) ([]*btcec.PublicKey, error) {
+	pushes, err := txscript.PushedData(redeemScript)
+	if err != nil {
+		return nil, err
+	}
+	var keys []*btcec.PublicKey
+	for _, push := range pushes {
+		if len(push) != 33 {
+			continue
+		}
+		key, err := btcec.ParsePubKey(push, btcec.S256())
+		if err != nil {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// verifyEscrowSignature returns the index of the key in keys which made
+// sig or an error if it wasn't made by any of them.
+func verifyEscrowSignature(sig, sigHash []byte, keys []*btcec.PublicKey) (int, error) {
+	signature, err := btcec.ParseDERSignature(sig, btcec.S256())
+	if err != nil {
+		return 0, base.ErrInvalidEscrowSignature
+	}
+	for i, key := range keys {
+		if signature.Verify(sigHash, key) {
+			return i, nil
+		}
+	}
+	return 0, base.ErrInvalidEscrowSignature
+}
+
+// orderEscrowSignatures verifies the signatures for each input against the
+// keys in the redeem script and returns them in the order of the keys,
+// which is the order OP_CHECKMULTISIG requires.
+func orderEscrowSignatures(tx *wire.MsgTx, amounts map[wire.OutPoint]int64, redeemScript []byte, p2sh bool, signatures [][]iwallet.EscrowSignature) ([][][]byte, error) {
+	keys, err := escrowKeys(redeemScript)
+	if err != nil {
+		return nil, err
+	}
+	type keySig struct {
+		key int
+		sig []byte
+	}
+
+	sigHashes := txscript.NewTxSigHashes(tx)
+	ordered := make([][][]byte, len(tx.TxIn))
+	for i, in := range tx.TxIn {
+		sigHash, err := escrowSigHash(tx, sigHashes, i, amounts[in.PreviousOutPoint], redeemScript, p2sh)
+		if err != nil {
+			return nil, err
+		}
+
+		var sigs []keySig
+		for _, escrowSigs := range signatures {
+			var sig []byte
+			for _, s := range escrowSigs {
+				if s.Index == i {
+					sig = s.Signature
+					break
+				}
+			}
+			if sig == nil {
+				return nil, fmt.Errorf("missing signature for input %d", i)
+			}
+			k, err := verifyEscrowSignature(sig, sigHash, keys)
+			if err != nil {
+				return nil, fmt.Errorf("%w for input %d", err, i)
+			}
+			for _, s := range sigs {
+				if s.key == k {
+					return nil, fmt.Errorf("duplicate signature for input %d", i)
+				}
+			}
+			sigs = append(sigs, keySig{key: k, sig: sig})
+		}
+		sort.Slice(sigs, func(a, b int) bool { return sigs[a].key < sigs[b].key })
+		for _, s := range sigs {
+			ordered[i] = append(ordered[i], s.sig)
+		}
+	}
+	return ordered, nil
+}
+
+// SignEscrowBundle is SignMultisigTransaction returning the signatures as
+// an EscrowSignatureBundle which can be sent to the other parties. It's
+// not supported for MuSig2 escrows, which exchange nonces first.
+func (w *BitcoinWallet) SignEscrowBundle(txn iwallet.Transaction, key btcec.PrivateKey, redeemScript []byte) (*base.EscrowSignatureBundle, error) {
+	if isMuSigEscrow(redeemScript) {
+		return nil, errors.New("signature bundles are not supported for musig escrows")
+	}
+	tx, _, err := w.escrowTx(txn)
+	if err != nil {
+		return nil, err
+	}
+	sigs, err := w.SignMultisigTransaction(txn, key, redeemScript)
+	if err != nil {
+		return nil, err
+	}
+	txid := iwallet.TransactionID(tx.TxHash().String())
+	return base.NewEscrowSignatureBundle(iwallet.CtBitcoin, txid, key.PubKey().SerializeCompressed(), uint32(txscript.SigHashAll), sigs), nil
+}
+
+// VerifyEscrowBundle checks the bundle is for txn and that its signatures
+// were made by a key in the escrow.
+func (w *BitcoinWallet) VerifyEscrowBundle(txn iwallet.Transaction, bundle *base.EscrowSignatureBundle, redeemScript []byte) error {
+	if isMuSigEscrow(redeemScript) {
+		return errors.New("signature bundles are not supported for musig escrows")
+	}
+	redeemScript, p2sh := splitEscrowScript(redeemScript)
+
+	tx, amounts, err := w.escrowTx(txn)
+	if err != nil {
+		return err
+	}
+	if err := bundle.Validate(iwallet.CtBitcoin, iwallet.TransactionID(tx.TxHash().String()), len(tx.TxIn)); err != nil {
+		return err
+	}
+
+	pubkey, err := btcec.ParsePubKey(bundle.PubKey, btcec.S256())
+	if err != nil {
+		return err
+	}
+	keys, err := escrowKeys(redeemScript)
+	if err != nil {
+		return err
+	}
+	var inEscrow bool
+	for _, key := range keys {
+		if key.IsEqual(pubkey) {
+			inEscrow = true
+			break
+		}
+	}
+	if !inEscrow {
+		return errors.New("signer is not a party to the escrow")
+	}
+
+	sigHashes := txscript.NewTxSigHashes(tx)
+	for _, sig := range bundle.Signatures {
+		if txscript.SigHashType(sig.SigHashType) != txscript.SigHashAll {
+			return fmt.Errorf("unsupported sighash type %d for input %d", sig.SigHashType, sig.Index)
+		}
+		in := tx.TxIn[sig.Index]
+		sigHash, err := escrowSigHash(tx, sigHashes, sig.Index, amounts[in.PreviousOutPoint], redeemScript, p2sh)
+		if err != nil {
+			return err
+		}
+		if _, err := verifyEscrowSignature(sig.Signature, sigHash, []*btcec.PublicKey{pubkey}); err != nil {
+			return fmt.Errorf("%w for input %d", err, sig.Index)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,553 @@
+package bitcoin
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBitcoinWallet_EscrowAddressTypes(t *testing.T) {
+	var (
+		keys    []*btcec.PrivateKey
+		pubkeys []btcec.PublicKey
+	)
+	for _, s := range []string{
+		"84c8a01a81bf562aafafd4a9fccda533b33d6382b984c081a8cb7817bf909c18",
+		"c68ab7796c52952a062b4c875c758ae3831448240fb58c152cc58a224d6ad3b8",
+		"0404e6967fc6c638564d4c381e299636fd01fdbcaaaa28e540647c928b44d39b",
+	} {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, _ := btcec.PrivKeyFromBytes(btcec.S256(), b)
+		keys = append(keys, key)
+		pubkeys = append(pubkeys, *key.PubKey())
+	}
+
+	h, err := chainhash.NewHashFromStr("bdb237bf8c5de6b60ba1e2dcfe364fc24f583e568d1682f851a9d0f11a45c78d")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The inputs are listed out of BIP69 order with different amounts so
+	// the segwit signatures fail if an amount is matched to the wrong input.
+	amounts := map[wire.OutPoint]int64{
+		*wire.NewOutPoint(h, 1): 500000,
+		*wire.NewOutPoint(h, 0): 1000000,
+	}
+	txn := iwallet.Transaction{
+		To: []iwallet.SpendInfo{
+			{
+				Amount:  iwallet.NewAmount(1400000),
+				Address: iwallet.NewAddress("bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4", iwallet.CtBitcoin),
+			},
+		},
+	}
+	for _, idx := range []uint32{1, 0} {
+		op := wire.NewOutPoint(h, idx)
+		txn.From = append(txn.From, iwallet.SpendInfo{
+			ID:     serializeOutpoint(op),
+			Amount: iwallet.NewAmount(amounts[*op]),
+		})
+	}
+
+	tests := []struct {
+		name   string
+		p2sh   bool
+		sorted bool
+		prefix string
+	}{
+		{
+			name:   "P2WSH",
+			prefix: "tb1q",
+		},
+		{
+			name:   "P2SH",
+			p2sh:   true,
+			prefix: "2",
+		},
+		{
+			name:   "P2WSH sorted",
+			sorted: true,
+			prefix: "tb1q",
+		},
+		{
+			name:   "P2SH sorted",
+			p2sh:   true,
+			sorted: true,
+			prefix: "2",
+		},
+	}
+
+	for _, test := range tests {
+		w1, err := newTestWallet()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w2, err := newTestWallet()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w1.escrowP2SH, w2.escrowP2SH = test.p2sh, test.p2sh
+		w1.escrowSortedKeys, w2.escrowSortedKeys = test.sorted, test.sorted
+
+		address, redeemScript, err := w1.CreateMultisigAddress(pubkeys, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(address.String(), test.prefix) {
+			t.Errorf("%s: unexpected address %s", test.name, address)
+		}
+		script, p2sh := splitEscrowScript(redeemScript)
+		if p2sh != test.p2sh {
+			t.Errorf("%s: expected p2sh %t, got %t", test.name, test.p2sh, p2sh)
+		}
+		if isSortedEscrow(redeemScript) != test.sorted {
+			t.Errorf("%s: expected sorted %t", test.name, test.sorted)
+		}
+
+		sig1, err := w1.SignMultisigTransaction(txn, *keys[0], redeemScript)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig2, err := w2.SignMultisigTransaction(txn, *keys[1], redeemScript)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wtx, err := w1.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		txid, err := w1.BuildAndSend(wtx, txn, [][]iwallet.EscrowSignature{sig1, sig2}, redeemScript)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if err := wtx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		var txBytes []byte
+		err = w1.DB.View(func(tx database.Tx) error {
+			var txs []database.UnconfirmedTransaction
+			if err := tx.Read().Where("txid=?", txid.String()).Find(&txs).Error; err != nil {
+				return err
+			}
+			if len(txs) != 1 {
+				t.Fatalf("%s: expected 1 tx found %d", test.name, len(txs))
+			}
+			txBytes = txs[0].TxBytes
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var scriptAddr btcutil.Address
+		if test.p2sh {
+			scriptAddr, err = btcutil.NewAddressScriptHash(script, w1.params())
+		} else {
+			scriptAddr, err = btcutil.DecodeAddress(address.String(), w1.params())
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if scriptAddr.String() != address.String() {
+			t.Errorf("%s: expected address %s, got %s", test.name, scriptAddr, address)
+		}
+		fromScript, err := txscript.PayToAddrScript(scriptAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var msgTx wire.MsgTx
+		if err := msgTx.BtcDecode(bytes.NewReader(txBytes), wire.ProtocolVersion, wire.WitnessEncoding); err != nil {
+			t.Fatal(err)
+		}
+		if test.p2sh && msgTx.HasWitness() {
+			t.Errorf("%s: expected no witness data", test.name)
+		}
+
+		for i, in := range msgTx.TxIn {
+			vm, err := txscript.NewEngine(fromScript, &msgTx, i, txscript.StandardVerifyFlags, nil, nil, amounts[in.PreviousOutPoint])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := vm.Execute(); err != nil {
+				t.Errorf("%s: script verification failed for input %d: %s", test.name, i, err)
+			}
+		}
+	}
+}
+
+func TestBitcoinWallet_EscrowSortedKeys(t *testing.T) {
+	var keys []btcec.PublicKey
+	for i := 0; i < 3; i++ {
+		key, err := btcec.NewPrivateKey(btcec.S256())
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, *key.PubKey())
+	}
+	reversed := []btcec.PublicKey{keys[2], keys[1], keys[0]}
+
+	for _, p2sh := range []bool{false, true} {
+		w1, err := newTestWallet()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w2, err := newTestWallet()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w1.escrowP2SH, w2.escrowP2SH = p2sh, p2sh
+
+		// Without sorting the key order changes the address.
+		addr1, _, err := w1.CreateMultisigAddress(keys, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr2, _, err := w2.CreateMultisigAddress(reversed, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr1.String() == addr2.String() {
+			t.Errorf("p2sh %t: expected different addresses for unsorted keys", p2sh)
+		}
+
+		// With sorting both parties derive the same address and script.
+		w1.escrowSortedKeys, w2.escrowSortedKeys = true, true
+		for _, timeout := range []bool{false, true} {
+			create := func(w *BitcoinWallet, keys []btcec.PublicKey) (iwallet.Address, []byte) {
+				var (
+					addr   iwallet.Address
+					script []byte
+					err    error
+				)
+				if timeout {
+					addr, script, err = w.CreateMultisigWithTimeout(keys, 2, time.Hour*24, keys[0])
+				} else {
+					addr, script, err = w.CreateMultisigAddress(keys, 2)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				return addr, script
+			}
+			// The timeout key is passed separately so keep it fixed.
+			addr1, script1 := create(w1, keys)
+			if timeout {
+				addr2, script2 := create(w2, []btcec.PublicKey{keys[0], keys[2], keys[1]})
+				if addr1.String() != addr2.String() || !bytes.Equal(script1, script2) {
+					t.Errorf("p2sh %t timeout: expected identical escrows, got %s and %s", p2sh, addr1, addr2)
+				}
+				continue
+			}
+			addr2, script2 := create(w2, reversed)
+			if addr1.String() != addr2.String() || !bytes.Equal(script1, script2) {
+				t.Errorf("p2sh %t: expected identical escrows, got %s and %s", p2sh, addr1, addr2)
+			}
+			if !isSortedEscrow(script1) {
+				t.Errorf("p2sh %t: expected escrow to be flagged as sorted", p2sh)
+			}
+
+			script, _ := splitEscrowScript(script1)
+			scriptKeys, err := escrowKeys(script)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 1; i < len(scriptKeys); i++ {
+				if bytes.Compare(scriptKeys[i-1].SerializeCompressed(), scriptKeys[i].SerializeCompressed()) >= 0 {
+					t.Errorf("p2sh %t: keys not sorted in redeem script", p2sh)
+				}
+			}
+		}
+	}
+}
+
+func TestEscrowSize(t *testing.T) {
+	// Spending an escrow from P2WSH must be cheaper than from P2SH.
+	for _, m := range []int{1, 2} {
+		p2wsh := escrowSize(m, m+1, 1, 2, false)
+		p2sh := escrowSize(m, m+1, 1, 2, true)
+		if p2wsh >= p2sh {
+			t.Errorf("%d of %d: expected P2WSH size %d to be less than P2SH size %d", m, m+1, p2wsh, p2sh)
+		}
+	}
+}
+
+func TestBitcoinWallet_EscrowSignatureBundle(t *testing.T) {
+	var (
+		keys    []*btcec.PrivateKey
+		pubkeys []btcec.PublicKey
+	)
+	for i := 0; i < 4; i++ {
+		key, err := btcec.NewPrivateKey(btcec.S256())
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+		pubkeys = append(pubkeys, *key.PubKey())
+	}
+
+	h, err := chainhash.NewHashFromStr("bdb237bf8c5de6b60ba1e2dcfe364fc24f583e568d1682f851a9d0f11a45c78d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn := iwallet.Transaction{
+		From: []iwallet.SpendInfo{
+			{
+				ID:     serializeOutpoint(wire.NewOutPoint(h, 0)),
+				Amount: iwallet.NewAmount(1000000),
+			},
+			{
+				ID:     serializeOutpoint(wire.NewOutPoint(h, 1)),
+				Amount: iwallet.NewAmount(500000),
+			},
+		},
+		To: []iwallet.SpendInfo{
+			{
+				Amount:  iwallet.NewAmount(1400000),
+				Address: iwallet.NewAddress("bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4", iwallet.CtBitcoin),
+			},
+		},
+	}
+
+	w, err := newTestWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, redeemScript, err := w.CreateMultisigAddress(pubkeys[:3], 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each party signs and sends the others a serialized bundle.
+	var bundles []*base.EscrowSignatureBundle
+	for _, key := range []*btcec.PrivateKey{keys[2], keys[0]} {
+		bundle, err := w.SignEscrowBundle(txn, *key, redeemScript)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := base.ParseEscrowSignatureBundle(bundle.Serialize())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.VerifyEscrowBundle(txn, parsed, redeemScript); err != nil {
+			t.Errorf("Failed to verify bundle: %s", err)
+		}
+		bundles = append(bundles, parsed)
+	}
+
+	outsider, err := w.SignEscrowBundle(txn, *keys[3], redeemScript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.VerifyEscrowBundle(txn, outsider, redeemScript); err == nil {
+		t.Error("Expected bundle from a key outside the escrow to fail")
+	}
+
+	otherTxn := txn
+	otherTxn.To = []iwallet.SpendInfo{{Amount: iwallet.NewAmount(1300000), Address: txn.To[0].Address}}
+	if err := w.VerifyEscrowBundle(otherTxn, bundles[0], redeemScript); err == nil {
+		t.Error("Expected bundle for another transaction to fail")
+	}
+
+	forged := *bundles[0]
+	forged.PubKey = pubkeys[1].SerializeCompressed()
+	if err := w.VerifyEscrowBundle(txn, &forged, redeemScript); !errors.Is(err, base.ErrInvalidEscrowSignature) {
+		t.Errorf("Expected ErrInvalidEscrowSignature, got %v", err)
+	}
+
+	// A bad signature is caught before the transaction is assembled.
+	bad := bundles[1].EscrowSignatures()
+	bad[0].Signature = append([]byte{}, bad[0].Signature...)
+	bad[0].Signature[len(bad[0].Signature)-1] ^= 0x01
+	wtx, err := w.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.BuildAndSend(wtx, txn, [][]iwallet.EscrowSignature{bundles[0].EscrowSignatures(), bad}, redeemScript); err == nil {
+		t.Error("Expected BuildAndSend with a bad signature to fail")
+	}
+	if err := wtx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The signatures are passed out of key order and must be reordered
+	// for OP_CHECKMULTISIG.
+	wtx, err = w.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	txid, err := w.BuildAndSend(wtx, txn, [][]iwallet.EscrowSignature{bundles[0].EscrowSignatures(), bundles[1].EscrowSignatures()}, redeemScript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wtx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if txid != bundles[0].Txid {
+		t.Errorf("Expected txid %s, got %s", bundles[0].Txid, txid)
+	}
+
+	var txBytes []byte
+	err = w.DB.View(func(tx database.Tx) error {
+		var utx database.UnconfirmedTransaction
+		if err := tx.Read().Where("txid=?", txid.String()).First(&utx).Error; err != nil {
+			return err
+		}
+		txBytes = utx.TxBytes
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msgTx wire.MsgTx
+	if err := msgTx.BtcDecode(bytes.NewReader(txBytes), wire.ProtocolVersion, wire.WitnessEncoding); err != nil {
+		t.Fatal(err)
+	}
+
+	scriptAddr, err := btcutil.DecodeAddress(addr.String(), w.params())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromScript, err := txscript.PayToAddrScript(scriptAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	amounts := map[uint32]int64{0: 1000000, 1: 500000}
+	for i, in := range msgTx.TxIn {
+		vm, err := txscript.NewEngine(fromScript, &msgTx, i, txscript.StandardVerifyFlags, nil, nil, amounts[in.PreviousOutPoint.Index])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := vm.Execute(); err != nil {
+			t.Errorf("Script verification failed for input %d: %s", i, err)
+		}
+	}
+}
+
+func TestBitcoinWallet_BuildDisputePayout(t *testing.T) {
+	var (
+		keys    []*btcec.PrivateKey
+		pubkeys []btcec.PublicKey
+	)
+	for i := 0; i < 3; i++ {
+		key, err := btcec.NewPrivateKey(btcec.S256())
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+		pubkeys = append(pubkeys, *key.PubKey())
+	}
+
+	w, err := newTestWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, redeemScript, err := w.CreateMultisigAddress(pubkeys, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := chainhash.NewHashFromStr("bdb237bf8c5de6b60ba1e2dcfe364fc24f583e568d1682f851a9d0f11a45c78d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	utxos := []iwallet.SpendInfo{
+		{
+			ID:     serializeOutpoint(wire.NewOutPoint(h, 0)),
+			Amount: iwallet.NewAmount(1000000),
+		},
+		{
+			ID:     serializeOutpoint(wire.NewOutPoint(h, 1)),
+			Amount: iwallet.NewAmount(500000),
+		},
+	}
+	split := base.PayoutSplit{
+		Buyer:        iwallet.NewAddress("tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", iwallet.CtBitcoin),
+		BuyerShare:   9999,
+		Vendor:       iwallet.NewAddress("tb1qrp33g0q5c5txsp9arysrx4k6zdkfs4nce4xj0gdcccefvpysxf3q0sl5k7", iwallet.CtBitcoin),
+		VendorShare:  1,
+		Moderator:    iwallet.NewAddress("2N3oefVeg6stiTb5Kh3ozCSkaqmx91FDbsm", iwallet.CtBitcoin),
+		ModeratorFee: iwallet.NewAmount(50000),
+	}
+
+	payout, err := w.BuildDisputePayout(utxos, split, redeemScript, iwallet.FlNormal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The vendor's share is dust so only the buyer and moderator are
+	// paid.
+	if len(payout.Transaction.To) != 2 {
+		t.Fatalf("Expected 2 outputs, got %d", len(payout.Transaction.To))
+	}
+	sum := payout.Fee
+	for _, out := range payout.Transaction.To {
+		if out.Address == split.Vendor {
+			t.Error("Expected the vendor's dust output to be dropped")
+		}
+		sum = sum.Add(out.Amount)
+	}
+	if sum.Cmp(iwallet.NewAmount(1500000)) != 0 {
+		t.Errorf("Expected outputs and fee to add up to 1500000, got %s", sum)
+	}
+	if len(payout.SigHashes) != len(utxos) {
+		t.Fatalf("Expected %d sighashes, got %d", len(utxos), len(payout.SigHashes))
+	}
+
+	var sigs [][]iwallet.EscrowSignature
+	for _, key := range keys[:2] {
+		s, err := w.SignMultisigTransaction(payout.Transaction, *key, redeemScript)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, sig := range s {
+			signature, err := btcec.ParseDERSignature(sig.Signature, btcec.S256())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !signature.Verify(payout.SigHashes[sig.Index], key.PubKey()) {
+				t.Errorf("Signature for input %d doesn't match the payout's sighash", sig.Index)
+			}
+		}
+		sigs = append(sigs, s)
+	}
+
+	wtx, err := w.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	txid, err := w.BuildAndSend(wtx, payout.Transaction, sigs, redeemScript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wtx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if txid != payout.Txid {
+		t.Errorf("Expected txid %s, got %s", payout.Txid, txid)
+	}
+
+	var unsigned wire.MsgTx
+	if err := unsigned.Deserialize(bytes.NewReader(payout.UnsignedTx)); err != nil {
+		t.Fatal(err)
+	}
+	if unsigned.TxHash().String() != payout.Txid.String() {
+		t.Errorf("Unsigned transaction doesn't match txid %s", payout.Txid)
+	}
+}
@@ -0,0 +1,23 @@
+package bitcoin
+
+import (
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+)
+
+// scriptHashAddress returns the legacy P2SH address of the redeem script.
+// HTLCs use P2SH so the same script and spend work on every UTXO coin.
+func (w *BitcoinWallet) scriptHashAddress(script []byte) (string, error) {
+	addr, err := btcutil.NewAddressScriptHash(script, w.params())
+	if err != nil {
+		return "", err
+	}
+	return addr.String(), nil
+}
+
+// signScriptInput signs a P2SH input with the legacy signature hash.
+func (w *BitcoinWallet) signScriptInput(tx *wire.MsgTx, idx int, script []byte, amount int64, key *btcec.PrivateKey) ([]byte, error) {
+	return txscript.RawTxInSignature(tx, idx, script, txscript.SigHashAll, key)
+}
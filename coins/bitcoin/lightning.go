@@ -0,0 +1,136 @@
+package bitcoin
+
+import (
+	"errors"
+	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/multiwallet/coins/bitcoin/lightning"
+	iwallet "github.com/cpacia/wallet-interface"
+	"time"
+)
+
+// ErrLightningDisabled is returned by the lightning methods if no
+// lightning client has been configured.
+var ErrLightningDisabled = errors.New("lightning is not enabled")
+
+// fundingTxSize is the approximate virtual size of the transaction the
+// lightning node uses to open a channel: one P2WPKH input, the P2WSH
+// funding output and a P2WPKH change output.
+const fundingTxSize = 154
+
+// LayeredBalance is the wallet balance broken down by layer.
+type LayeredBalance struct {
+	OnChainConfirmed   iwallet.Amount
+	OnChainUnconfirmed iwallet.Amount
+
+	// LightningLocal is the amount which can be sent over open channels.
+	LightningLocal iwallet.Amount
+
+	// LightningPending is the local balance of channels which are waiting
+	// for the funding transaction to confirm.
+	LightningPending iwallet.Amount
+}
+
+// EnableLightning enables the lightning methods using the client.
+func (w *BitcoinWallet) EnableLightning(client lightning.Client) {
+	w.lightning = client
+}
+
+// LayeredBalance returns the on-chain balance and, if lightning is enabled,
+// the balance held in channels.
+func (w *BitcoinWallet) LayeredBalance() (LayeredBalance, error) {
+	unconfirmed, confirmed, err := w.Balance()
+	if err != nil {
+		return LayeredBalance{}, err
+	}
+	bal := LayeredBalance{
+		OnChainConfirmed:   confirmed,
+		OnChainUnconfirmed: unconfirmed,
+		LightningLocal:     iwallet.NewAmount(0),
+		LightningPending:   iwallet.NewAmount(0),
+	}
+	if w.lightning == nil {
+		return bal, nil
+	}
+	chanBal, err := w.lightning.ChannelBalance()
+	if err != nil {
+		return LayeredBalance{}, err
+	}
+	bal.LightningLocal = chanBal.Local
+	bal.LightningPending = chanBal.PendingOpen
+	return bal, nil
+}
+
+// OpenChannel funds the lightning node from the wallet and opens a channel
+// to the peer with the given local amount. The wallet sends the amount plus
+// the node's estimated on-chain fee to the node. Once wtx is committed and
+// the funding transaction is broadcast, the channel is opened using the
+// unconfirmed funds. If the node fails to open the channel the commit
+// returns the error and the funds remain in the node's wallet.
+func (w *BitcoinWallet) OpenChannel(wtx iwallet.Tx, nodePubKey, host string, amount iwallet.Amount, feeLevel iwallet.FeeLevel) (iwallet.TransactionID, error) {
+	if w.lightning == nil {
+		return "", ErrLightningDisabled
+	}
+	addr, err := w.lightning.NewAddress()
+	if err != nil {
+		return "", err
+	}
+	fpb, err := w.FeeProvider.GetFee(feeLevel)
+	if err != nil {
+		return "", err
+	}
+	fundingFee := fpb.Mul(iwallet.NewAmount(fundingTxSize))
+
+	txid, err := w.Spend(wtx, iwallet.NewAddress(addr, iwallet.CtBitcoin), amount.Add(fundingFee), feeLevel)
+	if err != nil {
+		return txid, err
+	}
+
+	wbtx := wtx.(*base.DBTx)
+	broadcast := wbtx.OnCommit
+	wbtx.OnCommit = func() error {
+		if err := broadcast(); err != nil {
+			return err
+		}
+		chanPoint, err := w.lightning.OpenChannel(nodePubKey, host, amount)
+		if err != nil {
+			w.Logger.Errorf("Error opening lightning channel to %s: %s", nodePubKey, err)
+			return err
+		}
+		w.Logger.Infof("Opened lightning channel %s to %s", chanPoint, nodePubKey)
+		return nil
+	}
+	return txid, nil
+}
+
+// CloseChannel closes the channel. The funds are returned to the lightning
+// node's on-chain wallet.
+func (w *BitcoinWallet) CloseChannel(chanPoint lightning.ChannelPoint, force bool) error {
+	if w.lightning == nil {
+		return ErrLightningDisabled
+	}
+	return w.lightning.CloseChannel(chanPoint, force)
+}
+
+// PayInvoice pays the BOLT11 invoice over lightning and returns the
+// payment preimage.
+func (w *BitcoinWallet) PayInvoice(paymentRequest string) ([]byte, error) {
+	if w.lightning == nil {
+		return nil, ErrLightningDisabled
+	}
+	invoice, err := w.lightning.DecodeInvoice(paymentRequest)
+	if err != nil {
+		return nil, err
+	}
+	if invoice.Expiry > 0 && !invoice.Timestamp.Add(invoice.Expiry).After(time.Now()) {
+		return nil, errors.New("invoice has expired")
+	}
+	return w.lightning.PayInvoice(paymentRequest)
+}
+
+// CreateInvoice returns a new BOLT11 invoice for the amount.
+func (w *BitcoinWallet) CreateInvoice(amount iwallet.Amount, memo string, expiry time.Duration) (*lightning.Invoice, error) {
+	if w.lightning == nil {
+		return nil, ErrLightningDisabled
+	}
+	return w.lightning.AddInvoice(amount, memo, expiry)
+}
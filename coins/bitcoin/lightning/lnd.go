@@ -0,0 +1,324 @@
+// Package lightning provides a lightning network client for the bitcoin
+// wallet. The client talks to an LND node through the REST gateway which
+// exposes the same RPCs as the gRPC interface.
+package lightning
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/cpacia/proxyclient"
+	iwallet "github.com/cpacia/wallet-interface"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrPaymentFailed is returned when the node could not route a payment.
+var ErrPaymentFailed = errors.New("lightning payment failed")
+
+// ChannelPoint identifies a channel by its funding outpoint.
+type ChannelPoint struct {
+	FundingTxid iwallet.TransactionID
+	OutputIndex uint32
+}
+
+// String returns the channel point as txid:index.
+func (c ChannelPoint) String() string {
+	return fmt.Sprintf("%s:%d", c.FundingTxid, c.OutputIndex)
+}
+
+// ChannelBalance is the sum of the node's channel balances.
+type ChannelBalance struct {
+	// Local is the amount we can send over open channels.
+	Local iwallet.Amount
+
+	// Remote is the amount we can receive over open channels.
+	Remote iwallet.Amount
+
+	// PendingOpen is the local balance of channels that are not yet
+	// confirmed.
+	PendingOpen iwallet.Amount
+}
+
+// Invoice is a BOLT11 payment request.
+type Invoice struct {
+	PaymentRequest string
+	PaymentHash    []byte
+	Amount         iwallet.Amount
+	Description    string
+	Destination    string
+	Timestamp      time.Time
+	Expiry         time.Duration
+}
+
+// Client is the interface to a lightning node used by the wallet.
+type Client interface {
+	// NewAddress returns an on-chain address belonging to the node which
+	// is used to fund channels from the wallet.
+	NewAddress() (string, error)
+
+	// OpenChannel connects to the peer, if necessary, and opens a channel
+	// with the given local funding amount. Unconfirmed funds may be used so
+	// that a channel can be opened immediately after the wallet funds the
+	// node.
+	OpenChannel(nodePubKey, host string, amount iwallet.Amount) (ChannelPoint, error)
+
+	// CloseChannel closes the channel. If force is true the channel is
+	// closed unilaterally.
+	CloseChannel(chanPoint ChannelPoint, force bool) error
+
+	// ChannelBalance returns the balance held in channels.
+	ChannelBalance() (ChannelBalance, error)
+
+	// PayInvoice pays the BOLT11 invoice and returns the preimage.
+	PayInvoice(paymentRequest string) ([]byte, error)
+
+	// AddInvoice creates a new invoice for the amount.
+	AddInvoice(amount iwallet.Amount, memo string, expiry time.Duration) (*Invoice, error)
+
+	// DecodeInvoice decodes the BOLT11 payment request.
+	DecodeInvoice(paymentRequest string) (*Invoice, error)
+}
+
+// LNDClient is a Client for LND's REST interface.
+type LNDClient struct {
+	url        string
+	macaroon   string
+	httpClient *http.Client
+}
+
+// NewLNDClient returns a client for the LND node listening on url. The
+// macaroon is the raw admin macaroon. If tlsCert is not empty it is used as
+// the only trusted root when connecting to the node.
+func NewLNDClient(url string, macaroon []byte, tlsCert []byte) (*LNDClient, error) {
+	httpClient := proxyclient.NewHttpClient()
+	if len(tlsCert) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(tlsCert) {
+			return nil, errors.New("invalid tls certificate")
+		}
+		httpClient = &http.Client{
+			Timeout: time.Minute,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		}
+	}
+	return &LNDClient{
+		url:        strings.TrimSuffix(url, "/"),
+		macaroon:   hex.EncodeToString(macaroon),
+		httpClient: httpClient,
+	}, nil
+}
+
+func (c *LNDClient) do(method, path string, req, resp interface{}) error {
+	var body bytes.Buffer
+	if req != nil {
+		if err := json.NewEncoder(&body).Encode(req); err != nil {
+			return err
+		}
+	}
+	r, err := http.NewRequest(method, c.url+path, &body)
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Grpc-Metadata-macaroon", c.macaroon)
+	r.Header.Set("Content-Type", "application/json")
+
+	res, err := c.httpClient.Do(r)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		var lndErr struct {
+			Error   string `json:"error"`
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(data, &lndErr) == nil && (lndErr.Message != "" || lndErr.Error != "") {
+			if lndErr.Message == "" {
+				lndErr.Message = lndErr.Error
+			}
+			return fmt.Errorf("lnd error: %s", lndErr.Message)
+		}
+		return fmt.Errorf("lnd returned status %d", res.StatusCode)
+	}
+	if resp == nil {
+		return nil
+	}
+	return json.Unmarshal(data, resp)
+}
+
+// NewAddress returns a new native segwit address from the node's wallet.
+func (c *LNDClient) NewAddress() (string, error) {
+	var resp struct {
+		Address string `json:"address"`
+	}
+	if err := c.do(http.MethodGet, "/v1/newaddress?type=0", nil, &resp); err != nil {
+		return "", err
+	}
+	return resp.Address, nil
+}
+
+// OpenChannel connects to the peer and opens a channel.
+func (c *LNDClient) OpenChannel(nodePubKey, host string, amount iwallet.Amount) (ChannelPoint, error) {
+	if host != "" {
+		connect := map[string]interface{}{
+			"addr": map[string]string{"pubkey": nodePubKey, "host": host},
+			"perm": true,
+		}
+		if err := c.do(http.MethodPost, "/v1/peers", connect, nil); err != nil && !strings.Contains(err.Error(), "already connected") {
+			return ChannelPoint{}, err
+		}
+	}
+
+	req := map[string]interface{}{
+		"node_pubkey_string":   nodePubKey,
+		"local_funding_amount": amount.String(),
+		"spend_unconfirmed":    true,
+	}
+	var resp struct {
+		FundingTxidBytes string `json:"funding_txid_bytes"`
+		FundingTxidStr   string `json:"funding_txid_str"`
+		OutputIndex      uint32 `json:"output_index"`
+	}
+	if err := c.do(http.MethodPost, "/v1/channels", req, &resp); err != nil {
+		return ChannelPoint{}, err
+	}
+	txid := resp.FundingTxidStr
+	if txid == "" {
+		// The funding txid bytes are in internal byte order.
+		b, err := base64.StdEncoding.DecodeString(resp.FundingTxidBytes)
+		if err != nil {
+			return ChannelPoint{}, err
+		}
+		h, err := chainhash.NewHash(b)
+		if err != nil {
+			return ChannelPoint{}, err
+		}
+		txid = h.String()
+	}
+	return ChannelPoint{FundingTxid: iwallet.TransactionID(txid), OutputIndex: resp.OutputIndex}, nil
+}
+
+// CloseChannel closes the channel.
+func (c *LNDClient) CloseChannel(chanPoint ChannelPoint, force bool) error {
+	path := fmt.Sprintf("/v1/channels/%s/%d?force=%t", chanPoint.FundingTxid, chanPoint.OutputIndex, force)
+	return c.do(http.MethodDelete, path, nil, nil)
+}
+
+// ChannelBalance returns the balance held in channels.
+func (c *LNDClient) ChannelBalance() (ChannelBalance, error) {
+	type amount struct {
+		Sat string `json:"sat"`
+	}
+	var resp struct {
+		LocalBalance            amount `json:"local_balance"`
+		RemoteBalance           amount `json:"remote_balance"`
+		PendingOpenLocalBalance amount `json:"pending_open_local_balance"`
+	}
+	if err := c.do(http.MethodGet, "/v1/balance/channels", nil, &resp); err != nil {
+		return ChannelBalance{}, err
+	}
+	return ChannelBalance{
+		Local:       parseSat(resp.LocalBalance.Sat),
+		Remote:      parseSat(resp.RemoteBalance.Sat),
+		PendingOpen: parseSat(resp.PendingOpenLocalBalance.Sat),
+	}, nil
+}
+
+// PayInvoice pays the invoice and returns the preimage.
+func (c *LNDClient) PayInvoice(paymentRequest string) ([]byte, error) {
+	var resp struct {
+		PaymentError    string `json:"payment_error"`
+		PaymentPreimage string `json:"payment_preimage"`
+	}
+	req := map[string]string{"payment_request": paymentRequest}
+	if err := c.do(http.MethodPost, "/v1/channels/transactions", req, &resp); err != nil {
+		return nil, err
+	}
+	if resp.PaymentError != "" {
+		return nil, fmt.Errorf("%w: %s", ErrPaymentFailed, resp.PaymentError)
+	}
+	return base64.StdEncoding.DecodeString(resp.PaymentPreimage)
+}
+
+// AddInvoice creates a new invoice.
+func (c *LNDClient) AddInvoice(amount iwallet.Amount, memo string, expiry time.Duration) (*Invoice, error) {
+	req := map[string]string{
+		"value":  amount.String(),
+		"memo":   memo,
+		"expiry": strconv.FormatInt(int64(expiry.Seconds()), 10),
+	}
+	var resp struct {
+		RHash          string `json:"r_hash"`
+		PaymentRequest string `json:"payment_request"`
+	}
+	if err := c.do(http.MethodPost, "/v1/invoices", req, &resp); err != nil {
+		return nil, err
+	}
+	hash, err := base64.StdEncoding.DecodeString(resp.RHash)
+	if err != nil {
+		return nil, err
+	}
+	return &Invoice{
+		PaymentRequest: resp.PaymentRequest,
+		PaymentHash:    hash,
+		Amount:         amount,
+		Description:    memo,
+		Timestamp:      time.Now(),
+		Expiry:         expiry,
+	}, nil
+}
+
+// DecodeInvoice decodes the payment request.
+func (c *LNDClient) DecodeInvoice(paymentRequest string) (*Invoice, error) {
+	var resp struct {
+		Destination string `json:"destination"`
+		PaymentHash string `json:"payment_hash"`
+		NumSatoshis string `json:"num_satoshis"`
+		Timestamp   string `json:"timestamp"`
+		Expiry      string `json:"expiry"`
+		Description string `json:"description"`
+	}
+	if err := c.do(http.MethodGet, "/v1/payreq/"+paymentRequest, nil, &resp); err != nil {
+		return nil, err
+	}
+	hash, err := hex.DecodeString(resp.PaymentHash)
+	if err != nil {
+		return nil, err
+	}
+	ts, _ := strconv.ParseInt(resp.Timestamp, 10, 64)
+	expiry, _ := strconv.ParseInt(resp.Expiry, 10, 64)
+	return &Invoice{
+		PaymentRequest: paymentRequest,
+		PaymentHash:    hash,
+		Amount:         parseSat(resp.NumSatoshis),
+		Description:    resp.Description,
+		Destination:    resp.Destination,
+		Timestamp:      time.Unix(ts, 0),
+		Expiry:         time.Duration(expiry) * time.Second,
+	}, nil
+}
+
+// parseSat parses an amount from LND. Zero values are omitted from the
+// JSON responses.
+func parseSat(s string) iwallet.Amount {
+	if s == "" {
+		return iwallet.NewAmount(0)
+	}
+	return iwallet.NewAmount(s)
+}
@@ -0,0 +1,116 @@
+package lightning
+
+import (
+	"bytes"
+	"encoding/json"
+	iwallet "github.com/cpacia/wallet-interface"
+	"github.com/jarcoal/httpmock"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+const testLNDURL = "https://localhost:8080"
+
+func TestLNDClient_ChannelBalance(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder(http.MethodGet, testLNDURL+"/v1/balance/channels",
+		func(req *http.Request) (*http.Response, error) {
+			if req.Header.Get("Grpc-Metadata-macaroon") != "0102" {
+				return httpmock.NewStringResponse(http.StatusUnauthorized, `{"message":"bad macaroon"}`), nil
+			}
+			return httpmock.NewStringResponse(http.StatusOK, `{"local_balance":{"sat":"150000"},"remote_balance":{"sat":"50000"}}`), nil
+		})
+
+	client, err := NewLNDClient(testLNDURL, []byte{0x01, 0x02}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bal, err := client.ChannelBalance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bal.Local.Cmp(iwallet.NewAmount(150000)) != 0 {
+		t.Errorf("Expected local balance of 150000, got %s", bal.Local)
+	}
+	if bal.Remote.Cmp(iwallet.NewAmount(50000)) != 0 {
+		t.Errorf("Expected remote balance of 50000, got %s", bal.Remote)
+	}
+	if bal.PendingOpen.Cmp(iwallet.NewAmount(0)) != 0 {
+		t.Errorf("Expected pending balance of 0, got %s", bal.PendingOpen)
+	}
+}
+
+func TestLNDClient_OpenChannel(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder(http.MethodPost, testLNDURL+"/v1/peers",
+		httpmock.NewStringResponder(http.StatusInternalServerError, `{"message":"already connected to peer"}`))
+
+	var req map[string]interface{}
+	httpmock.RegisterResponder(http.MethodPost, testLNDURL+"/v1/channels",
+		func(r *http.Request) (*http.Response, error) {
+			body, _ := ioutil.ReadAll(r.Body)
+			if err := json.NewDecoder(bytes.NewReader(body)).Decode(&req); err != nil {
+				return nil, err
+			}
+			// Internal byte order of txid 0100...00.
+			return httpmock.NewStringResponse(http.StatusOK, `{"funding_txid_bytes":"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAE=","output_index":1}`), nil
+		})
+
+	client, err := NewLNDClient(testLNDURL, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chanPoint, err := client.OpenChannel("02abcd", "127.0.0.1:9735", iwallet.NewAmount(100000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "0100000000000000000000000000000000000000000000000000000000000000:1"
+	if chanPoint.String() != expected {
+		t.Errorf("Expected channel point %s, got %s", expected, chanPoint)
+	}
+	if req["local_funding_amount"] != "100000" || req["spend_unconfirmed"] != true {
+		t.Errorf("Unexpected request %v", req)
+	}
+}
+
+func TestLNDClient_Invoices(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder(http.MethodPost, testLNDURL+"/v1/invoices",
+		httpmock.NewStringResponder(http.StatusOK, `{"r_hash":"AQID","payment_request":"lntb1abc"}`))
+	httpmock.RegisterResponder(http.MethodGet, testLNDURL+"/v1/payreq/lntb1abc",
+		httpmock.NewStringResponder(http.StatusOK, `{"destination":"02abcd","payment_hash":"010203","num_satoshis":"1000","timestamp":"1600000000","expiry":"3600","description":"test"}`))
+	httpmock.RegisterResponder(http.MethodPost, testLNDURL+"/v1/channels/transactions",
+		httpmock.NewStringResponder(http.StatusOK, `{"payment_error":"no route"}`))
+
+	client, err := NewLNDClient(testLNDURL, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invoice, err := client.AddInvoice(iwallet.NewAmount(1000), "test", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if invoice.PaymentRequest != "lntb1abc" || !bytes.Equal(invoice.PaymentHash, []byte{1, 2, 3}) {
+		t.Errorf("Unexpected invoice %v", invoice)
+	}
+
+	decoded, err := client.DecodeInvoice("lntb1abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Amount.Cmp(iwallet.NewAmount(1000)) != 0 || decoded.Expiry != time.Hour || decoded.Destination != "02abcd" {
+		t.Errorf("Unexpected decoded invoice %v", decoded)
+	}
+
+	if _, err := client.PayInvoice("lntb1abc"); err == nil {
+		t.Error("Expected payment error")
+	}
+}
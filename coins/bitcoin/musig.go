@@ -0,0 +1,442 @@
+package bitcoin
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/wire"
+	"math/big"
+	"sort"
+)
+
+// This file contains MuSig2 (BIP327) and the parts of BIP341 and BIP342
+// needed to spend a taproot output through a script path. As with the rest
+// of taproot the version of btcd we depend on predates them so they are
+// implemented here.
+//
+// Only x-only tweaks of the aggregate key are supported since that's all
+// taproot needs.
+
+const (
+	// tapLeafVersion is the leaf version of BIP342 tapscript.
+	tapLeafVersion = 0xc0
+
+	// musigPubNonceSize is the size of a serialized public nonce.
+	musigPubNonceSize = 66
+
+	// musigPartialSigSize is the size of a serialized partial signature.
+	musigPartialSigSize = 32
+)
+
+var errInvalidPartialSig = errors.New("invalid partial signature")
+
+// keyAggContext holds the aggregate key of a set of signers along with the
+// accumulated tweak state from BIP327.
+type keyAggContext struct {
+	qx, qy     *big.Int
+	gacc, tacc *big.Int
+
+	// keys are the compressed public keys in aggregation order, l is the
+	// hash of the list and second the second distinct key in it.
+	keys   [][]byte
+	l      []byte
+	second []byte
+}
+
+// musigSecNonce is a signer's secret nonce. It must only ever be used to
+// create one partial signature.
+type musigSecNonce struct {
+	k1, k2 *big.Int
+	pk     []byte
+}
+
+// isInfinity returns whether the affine coordinates are the point at
+// infinity as represented by btcec.
+func isInfinity(x, y *big.Int) bool {
+	return x.Sign() == 0 && y.Sign() == 0
+}
+
+func hasEvenY(y *big.Int) bool {
+	return y.Bit(0) == 0
+}
+
+// negatePoint returns -P. The point at infinity is returned unchanged.
+func negatePoint(x, y *big.Int) (*big.Int, *big.Int) {
+	if isInfinity(x, y) {
+		return x, y
+	}
+	return x, new(big.Int).Sub(btcec.S256().P, y)
+}
+
+func serializePoint(x, y *big.Int) []byte {
+	return (&btcec.PublicKey{Curve: btcec.S256(), X: x, Y: y}).SerializeCompressed()
+}
+
+// serializePointExt serializes the point at infinity as 33 zero bytes.
+func serializePointExt(x, y *big.Int) []byte {
+	if isInfinity(x, y) {
+		return make([]byte, 33)
+	}
+	return serializePoint(x, y)
+}
+
+func parsePoint(b []byte) (*big.Int, *big.Int, error) {
+	pub, err := btcec.ParsePubKey(b, btcec.S256())
+	if err != nil {
+		return nil, nil, err
+	}
+	return pub.X, pub.Y, nil
+}
+
+func parsePointExt(b []byte) (*big.Int, *big.Int, error) {
+	if bytes.Equal(b, make([]byte, 33)) {
+		return new(big.Int), new(big.Int), nil
+	}
+	return parsePoint(b)
+}
+
+// sortKeys returns the compressed keys sorted as in the BIP327 KeySort
+// algorithm so that every signer aggregates them in the same order.
+func sortKeys(keys []*btcec.PublicKey) []*btcec.PublicKey {
+	sorted := append([]*btcec.PublicKey{}, keys...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].SerializeCompressed(), sorted[j].SerializeCompressed()) < 0
+	})
+	return sorted
+}
+
+// keyAgg aggregates the keys in the given order.
+func keyAgg(keys []*btcec.PublicKey) (*keyAggContext, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no keys to aggregate")
+	}
+	ctx := &keyAggContext{
+		gacc: big.NewInt(1),
+		tacc: new(big.Int),
+	}
+	for _, key := range keys {
+		ctx.keys = append(ctx.keys, key.SerializeCompressed())
+	}
+	ctx.l = taggedHash("KeyAgg list", ctx.keys...)
+	for _, pk := range ctx.keys[1:] {
+		if !bytes.Equal(pk, ctx.keys[0]) {
+			ctx.second = pk
+			break
+		}
+	}
+
+	curve := btcec.S256()
+	qx, qy := new(big.Int), new(big.Int)
+	for i, key := range keys {
+		a := ctx.coefficient(ctx.keys[i])
+		ax, ay := curve.ScalarMult(key.X, key.Y, pad32(a))
+		qx, qy = curve.Add(qx, qy, ax, ay)
+	}
+	if isInfinity(qx, qy) {
+		return nil, errors.New("aggregate key is infinity")
+	}
+	ctx.qx, ctx.qy = qx, qy
+	return ctx, nil
+}
+
+// coefficient returns the key aggregation coefficient of the key.
+func (ctx *keyAggContext) coefficient(pk []byte) *big.Int {
+	if bytes.Equal(pk, ctx.second) {
+		return big.NewInt(1)
+	}
+	a := new(big.Int).SetBytes(taggedHash("KeyAgg coefficient", ctx.l, pk))
+	return a.Mod(a, btcec.S256().N)
+}
+
+// hasKey returns whether pk is one of the aggregated keys.
+func (ctx *keyAggContext) hasKey(pk []byte) bool {
+	for _, k := range ctx.keys {
+		if bytes.Equal(k, pk) {
+			return true
+		}
+	}
+	return false
+}
+
+// xOnly returns the x-only serialization of the aggregate key.
+func (ctx *keyAggContext) xOnly() []byte {
+	return pad32(ctx.qx)
+}
+
+// applyXOnlyTweak returns a copy of the context with the aggregate key
+// tweaked by t as an x-only key, as done by a taproot output key.
+func (ctx *keyAggContext) applyXOnlyTweak(t *big.Int) (*keyAggContext, error) {
+	curve := btcec.S256()
+	if t.Cmp(curve.N) >= 0 {
+		return nil, errors.New("tweak out of range")
+	}
+	g := big.NewInt(1)
+	qx, qy := ctx.qx, ctx.qy
+	if !hasEvenY(qy) {
+		g.Sub(curve.N, g)
+		qx, qy = negatePoint(qx, qy)
+	}
+	tx, ty := curve.ScalarBaseMult(pad32(t))
+	qx, qy = curve.Add(qx, qy, tx, ty)
+	if isInfinity(qx, qy) {
+		return nil, errors.New("tweaked key is infinity")
+	}
+
+	tweaked := *ctx
+	tweaked.qx, tweaked.qy = qx, qy
+	tweaked.gacc = new(big.Int).Mul(g, ctx.gacc)
+	tweaked.gacc.Mod(tweaked.gacc, curve.N)
+	tweaked.tacc = new(big.Int).Mul(g, ctx.tacc)
+	tweaked.tacc.Add(tweaked.tacc, t)
+	tweaked.tacc.Mod(tweaked.tacc, curve.N)
+	return &tweaked, nil
+}
+
+// musigNonceGen creates a fresh nonce for the signer. The message isn't
+// known when nonces are exchanged so none is committed to.
+func musigNonceGen(priv *btcec.PrivateKey) (*musigSecNonce, []byte, error) {
+	randBytes := make([]byte, 32)
+	if _, err := rand.Read(randBytes); err != nil {
+		return nil, nil, err
+	}
+	seed := taggedHash("MuSig/aux", randBytes)
+	for i, b := range pad32(priv.D) {
+		seed[i] ^= b
+	}
+
+	curve := btcec.S256()
+	pk := priv.PubKey().SerializeCompressed()
+	sec := &musigSecNonce{pk: pk}
+	var pubNonce []byte
+	for i := 0; i < 2; i++ {
+		var buf bytes.Buffer
+		buf.Write(seed)
+		buf.WriteByte(byte(len(pk)))
+		buf.Write(pk)
+		buf.WriteByte(0) // No aggregate key
+		buf.WriteByte(0) // No message
+		binary.Write(&buf, binary.BigEndian, uint32(0))
+		buf.WriteByte(byte(i))
+
+		k := new(big.Int).SetBytes(taggedHash("MuSig/nonce", buf.Bytes()))
+		k.Mod(k, curve.N)
+		if k.Sign() == 0 {
+			return nil, nil, errors.New("musig nonce is zero")
+		}
+		if i == 0 {
+			sec.k1 = k
+		} else {
+			sec.k2 = k
+		}
+		rx, ry := curve.ScalarBaseMult(pad32(k))
+		pubNonce = append(pubNonce, serializePoint(rx, ry)...)
+	}
+	return sec, pubNonce, nil
+}
+
+// musigNonceAgg sums the signers' public nonces.
+func musigNonceAgg(pubNonces [][]byte) ([]byte, error) {
+	curve := btcec.S256()
+	var aggNonce []byte
+	for j := 0; j < 2; j++ {
+		rx, ry := new(big.Int), new(big.Int)
+		for _, pubNonce := range pubNonces {
+			if len(pubNonce) != musigPubNonceSize {
+				return nil, errors.New("invalid public nonce")
+			}
+			x, y, err := parsePoint(pubNonce[j*33 : (j+1)*33])
+			if err != nil {
+				return nil, err
+			}
+			rx, ry = curve.Add(rx, ry, x, y)
+		}
+		aggNonce = append(aggNonce, serializePointExt(rx, ry)...)
+	}
+	return aggNonce, nil
+}
+
+// musigSession holds the values shared by every signer when signing msg
+// with the aggregate nonce.
+type musigSession struct {
+	ctx    *keyAggContext
+	rx, ry *big.Int
+	b, e   *big.Int
+}
+
+func newMuSigSession(ctx *keyAggContext, aggNonce, msg []byte) (*musigSession, error) {
+	if len(aggNonce) != musigPubNonceSize {
+		return nil, errors.New("invalid aggregate nonce")
+	}
+	curve := btcec.S256()
+	r1x, r1y, err := parsePointExt(aggNonce[:33])
+	if err != nil {
+		return nil, err
+	}
+	r2x, r2y, err := parsePointExt(aggNonce[33:])
+	if err != nil {
+		return nil, err
+	}
+
+	b := new(big.Int).SetBytes(taggedHash("MuSig/noncecoef", aggNonce, ctx.xOnly(), msg))
+	b.Mod(b, curve.N)
+
+	bx, by := curve.ScalarMult(r2x, r2y, pad32(b))
+	rx, ry := curve.Add(r1x, r1y, bx, by)
+	if isInfinity(rx, ry) {
+		rx, ry = curve.Gx, curve.Gy
+	}
+
+	e := new(big.Int).SetBytes(taggedHash("BIP0340/challenge", pad32(rx), ctx.xOnly(), msg))
+	e.Mod(e, curve.N)
+
+	return &musigSession{ctx: ctx, rx: rx, ry: ry, b: b, e: e}, nil
+}
+
+// g returns the negation factor applied to secret keys because of the
+// parity of the aggregate key, combined with the accumulated tweak one.
+func (s *musigSession) g() *big.Int {
+	n := btcec.S256().N
+	g := big.NewInt(1)
+	if !hasEvenY(s.ctx.qy) {
+		g.Sub(n, g)
+	}
+	g.Mul(g, s.ctx.gacc)
+	return g.Mod(g, n)
+}
+
+// sign creates the signer's partial signature. The secret nonce is
+// cleared so it can't be reused.
+func (s *musigSession) sign(sec *musigSecNonce, priv *btcec.PrivateKey) ([]byte, error) {
+	curve := btcec.S256()
+	if sec.k1 == nil || sec.k1.Sign() == 0 {
+		return nil, errors.New("nonce has already been used")
+	}
+	pk := priv.PubKey().SerializeCompressed()
+	if !bytes.Equal(pk, sec.pk) {
+		return nil, errors.New("nonce was created for a different key")
+	}
+	if !s.ctx.hasKey(pk) {
+		return nil, errors.New("key is not one of the signers")
+	}
+
+	k1 := new(big.Int).Set(sec.k1)
+	k2 := new(big.Int).Set(sec.k2)
+	sec.k1.SetInt64(0)
+	sec.k2.SetInt64(0)
+	defer k1.SetInt64(0)
+	defer k2.SetInt64(0)
+	if !hasEvenY(s.ry) {
+		k1.Sub(curve.N, k1)
+		k2.Sub(curve.N, k2)
+	}
+
+	d := new(big.Int).Mul(s.g(), priv.D)
+	d.Mod(d, curve.N)
+	defer d.SetInt64(0)
+
+	// s = k1 + b*k2 + e*a*d
+	sig := new(big.Int).Mul(s.e, s.ctx.coefficient(pk))
+	sig.Mul(sig, d)
+	sig.Add(sig, k1)
+	sig.Add(sig, new(big.Int).Mul(s.b, k2))
+	sig.Mod(sig, curve.N)
+	return pad32(sig), nil
+}
+
+// verify checks the partial signature made by pk with its public nonce.
+func (s *musigSession) verify(psig, pubNonce, pk []byte) bool {
+	curve := btcec.S256()
+	if len(psig) != musigPartialSigSize || len(pubNonce) != musigPubNonceSize || !s.ctx.hasKey(pk) {
+		return false
+	}
+	sig := new(big.Int).SetBytes(psig)
+	if sig.Cmp(curve.N) >= 0 {
+		return false
+	}
+	r1x, r1y, err := parsePoint(pubNonce[:33])
+	if err != nil {
+		return false
+	}
+	r2x, r2y, err := parsePoint(pubNonce[33:])
+	if err != nil {
+		return false
+	}
+	px, py, err := parsePoint(pk)
+	if err != nil {
+		return false
+	}
+
+	bx, by := curve.ScalarMult(r2x, r2y, pad32(s.b))
+	rx, ry := curve.Add(r1x, r1y, bx, by)
+	if !hasEvenY(s.ry) {
+		rx, ry = negatePoint(rx, ry)
+	}
+
+	// s*G == R + e*a*g*P
+	m := new(big.Int).Mul(s.e, s.ctx.coefficient(pk))
+	m.Mul(m, s.g())
+	m.Mod(m, curve.N)
+	ex, ey := curve.ScalarMult(px, py, pad32(m))
+	ex, ey = curve.Add(rx, ry, ex, ey)
+
+	sx, sy := curve.ScalarBaseMult(pad32(sig))
+	return sx.Cmp(ex) == 0 && sy.Cmp(ey) == 0
+}
+
+// aggregate combines the partial signatures into a BIP340 signature for
+// the aggregate key.
+func (s *musigSession) aggregate(psigs [][]byte) ([]byte, error) {
+	curve := btcec.S256()
+	sig := new(big.Int)
+	for _, psig := range psigs {
+		v := new(big.Int).SetBytes(psig)
+		if len(psig) != musigPartialSigSize || v.Cmp(curve.N) >= 0 {
+			return nil, errInvalidPartialSig
+		}
+		sig.Add(sig, v)
+	}
+	g := big.NewInt(1)
+	if !hasEvenY(s.ctx.qy) {
+		g.Sub(curve.N, g)
+	}
+	t := new(big.Int).Mul(s.e, g)
+	t.Mul(t, s.ctx.tacc)
+	sig.Add(sig, t)
+	sig.Mod(sig, curve.N)
+	return append(pad32(s.rx), pad32(sig)...), nil
+}
+
+// tapLeafHash returns the BIP341 leaf hash of a tapscript.
+func tapLeafHash(script []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(tapLeafVersion)
+	wire.WriteVarBytes(&buf, 0, script)
+	return taggedHash("TapLeaf", buf.Bytes())
+}
+
+func tapBranchHash(a, b []byte) []byte {
+	if bytes.Compare(a, b) > 0 {
+		a, b = b, a
+	}
+	return taggedHash("TapBranch", a, b)
+}
+
+// tapTree builds a balanced script tree from the leaf hashes. It returns
+// the merkle root and the merkle path of each leaf.
+func tapTree(leaves [][]byte) ([]byte, [][][]byte) {
+	if len(leaves) == 1 {
+		return leaves[0], [][][]byte{nil}
+	}
+	mid := (len(leaves) + 1) / 2
+	left, leftPaths := tapTree(leaves[:mid])
+	right, rightPaths := tapTree(leaves[mid:])
+	for i := range leftPaths {
+		leftPaths[i] = append(leftPaths[i], right)
+	}
+	for i := range rightPaths {
+		rightPaths[i] = append(rightPaths[i], left)
+	}
+	return tapBranchHash(left, right), append(leftPaths, rightPaths...)
+}
@@ -0,0 +1,540 @@
+package bitcoin
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil/txsort"
+	"github.com/btcsuite/btcwallet/wallet/txsizes"
+	iwallet "github.com/cpacia/wallet-interface"
+	"sort"
+)
+
+// MuSig2 escrows are taproot outputs which any threshold of the keys can
+// spend with a single BIP340 signature made with MuSig2. The aggregate of
+// the first threshold keys, normally the buyer and vendor, is the internal
+// key so a cooperative release is a key path spend that looks like any
+// other single key taproot spend. Every other combination of keys is a
+// script path fallback with a leaf of the form:
+//
+//   <aggregate key> OP_CHECKSIG
+//
+// Only the leaf that is used is revealed when spending through it.
+//
+// Signing takes two rounds. The first call to SignMultisigTransaction
+// returns the signer's public nonces. Once the co-signers' nonces have been
+// passed to AddEscrowNonces the second call returns partial signatures which
+// BuildAndSend aggregates. Secret nonces are only held in memory so a
+// restart between the rounds means starting again from the first.
+
+const (
+	// musigEscrowVersion is the first byte of a serialized MuSig2 escrow.
+	// It can't start a multisig redeem script.
+	musigEscrowVersion = 0x01
+
+	// musigNonceSize is the size of a first round escrow signature: the
+	// signer's key followed by its public nonce.
+	musigNonceSize = 33 + musigPubNonceSize
+
+	// musigSigSize is the size of a second round escrow signature: the
+	// signer's key, its public nonce and the partial signature.
+	musigSigSize = musigNonceSize + musigPartialSigSize
+)
+
+// musigEscrow is an m of n escrow spent with MuSig2. Its serialization is
+// used in place of a redeem script.
+type musigEscrow struct {
+	threshold int
+	keys      []*btcec.PublicKey
+
+	// combinations are the sets of key indexes able to spend. The first
+	// spends through the key path and the rest through the leaves.
+	combinations [][]int
+	internal     *keyAggContext
+	output       *keyAggContext
+	leaves       []musigLeaf
+}
+
+type musigLeaf struct {
+	ctx          *keyAggContext
+	script       []byte
+	hash         []byte
+	controlBlock []byte
+}
+
+// musigSessionID identifies the signing session of one of our keys for a
+// transaction spending an escrow.
+type musigSessionID struct {
+	escrow [32]byte
+	txid   chainhash.Hash
+	signer [33]byte
+}
+
+// musigSigner is our side of a signing session between the two rounds.
+type musigSigner struct {
+	index     int
+	nonces    []*musigSecNonce
+	pubNonces [][]byte
+
+	// peers are the co-signers' public nonces for each input keyed by
+	// their index in the escrow.
+	peers map[int][][]byte
+}
+
+func isMuSigEscrow(redeemScript []byte) bool {
+	return len(redeemScript) > 0 && redeemScript[0] == musigEscrowVersion
+}
+
+func newMuSigEscrow(keys []*btcec.PublicKey, threshold int) (*musigEscrow, error) {
+	if threshold < 1 || len(keys) < threshold {
+		return nil, fmt.Errorf("unable to generate multisig script with "+
+			"%d required signatures when there are only %d public "+
+			"keys available", threshold, len(keys))
+	}
+	if len(keys) > 8 {
+		return nil, errors.New("unable to generate multisig script with " +
+			"more than 8 public keys")
+	}
+
+	e := &musigEscrow{
+		threshold:    threshold,
+		keys:         keys,
+		combinations: combinations(len(keys), threshold),
+	}
+	var leafHashes [][]byte
+	for i, combination := range e.combinations {
+		var signers []*btcec.PublicKey
+		for _, idx := range combination {
+			signers = append(signers, keys[idx])
+		}
+		ctx, err := keyAgg(sortKeys(signers))
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			e.internal = ctx
+			continue
+		}
+		script, err := txscript.NewScriptBuilder().AddData(ctx.xOnly()).AddOp(txscript.OP_CHECKSIG).Script()
+		if err != nil {
+			return nil, err
+		}
+		leaf := musigLeaf{ctx: ctx, script: script, hash: tapLeafHash(script)}
+		e.leaves = append(e.leaves, leaf)
+		leafHashes = append(leafHashes, leaf.hash)
+	}
+
+	var (
+		merkleRoot []byte
+		paths      [][][]byte
+	)
+	if len(leafHashes) > 0 {
+		merkleRoot, paths = tapTree(leafHashes)
+	}
+	t, err := taprootTweakWithRoot(e.internal.xOnly(), merkleRoot)
+	if err != nil {
+		return nil, err
+	}
+	e.output, err = e.internal.applyXOnlyTweak(t)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range e.leaves {
+		cb := append([]byte{tapLeafVersion | byte(e.output.qy.Bit(0))}, e.internal.xOnly()...)
+		for _, h := range paths[i] {
+			cb = append(cb, h...)
+		}
+		e.leaves[i].controlBlock = cb
+	}
+	return e, nil
+}
+
+// parseMuSigEscrow parses a serialized escrow.
+func parseMuSigEscrow(b []byte) (*musigEscrow, error) {
+	if len(b) < 3 || b[0] != musigEscrowVersion || len(b) != 3+int(b[2])*33 {
+		return nil, errors.New("invalid musig escrow")
+	}
+	var keys []*btcec.PublicKey
+	for i := 0; i < int(b[2]); i++ {
+		key, err := btcec.ParsePubKey(b[3+i*33:3+(i+1)*33], btcec.S256())
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return newMuSigEscrow(keys, int(b[1]))
+}
+
+// serialize returns the version, threshold, number of keys and the keys.
+func (e *musigEscrow) serialize() []byte {
+	b := []byte{musigEscrowVersion, byte(e.threshold), byte(len(e.keys))}
+	for _, key := range e.keys {
+		b = append(b, key.SerializeCompressed()...)
+	}
+	return b
+}
+
+// script returns the escrow's output script.
+func (e *musigEscrow) script() ([]byte, error) {
+	return taprootScript(e.output.xOnly())
+}
+
+func (e *musigEscrow) keyIndex(pk []byte) int {
+	for i, key := range e.keys {
+		if bytes.Equal(key.SerializeCompressed(), pk) {
+			return i
+		}
+	}
+	return -1
+}
+
+// spendPath returns the context to sign with for the set of signers and
+// the leaf to spend through, which is nil for the key path.
+func (e *musigEscrow) spendPath(signers []int) (*keyAggContext, *musigLeaf, error) {
+	sorted := append([]int{}, signers...)
+	sort.Ints(sorted)
+	for i, combination := range e.combinations {
+		if !equalInts(sorted, combination) {
+			continue
+		}
+		if i == 0 {
+			return e.output, nil, nil
+		}
+		return e.leaves[i-1].ctx, &e.leaves[i-1], nil
+	}
+	return nil, nil, fmt.Errorf("escrow needs signatures from %d distinct keys", e.threshold)
+}
+
+// combinations returns every set of k of the indexes 0 to n-1 in
+// lexicographic order.
+func combinations(n, k int) [][]int {
+	if k == 0 {
+		return [][]int{nil}
+	}
+	var out [][]int
+	for first := 0; first <= n-k; first++ {
+		for _, rest := range combinations(n-first-1, k-1) {
+			combination := []int{first}
+			for _, idx := range rest {
+				combination = append(combination, first+1+idx)
+			}
+			out = append(out, combination)
+		}
+	}
+	return out
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// musigEscrowSize returns the virtual size of a transaction spending one
+// input from an m of n escrow through its deepest leaf, which is the worst
+// case, to nOuts outputs.
+func musigEscrowSize(m, n, nOuts int) int {
+	leaves := len(combinations(n, m)) - 1
+	depth := 0
+	for 1<<uint(depth) < leaves {
+		depth++
+	}
+	// Item count and signature, plus the leaf and control block for a
+	// script path spend.
+	witness := 1 + 1 + 64
+	if leaves > 0 {
+		witness += 1 + 34 + 1 + 33 + 32*depth
+	}
+	// 8 bytes are for version and locktime, the segwit marker and flag
+	// are counted with the witness.
+	size := 8 + wire.VarIntSerializeSize(1) + wire.VarIntSerializeSize(uint64(nOuts)) +
+		41 + txsizes.P2PKHOutputSize*nOuts
+	return size + (witness+2+3)/4
+}
+
+// musigEscrowTx builds the unsigned transaction spending txn from the
+// escrow along with the previous output scripts and values needed for the
+// taproot signature hash.
+func (w *BitcoinWallet) musigEscrowTx(txn iwallet.Transaction, e *musigEscrow) (*wire.MsgTx, map[wire.OutPoint][]byte, map[wire.OutPoint]int64, error) {
+	script, err := e.script()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var (
+		tx          = wire.NewMsgTx(1)
+		prevScripts = make(map[wire.OutPoint][]byte)
+		inVals      = make(map[wire.OutPoint]int64)
+	)
+	for _, from := range txn.From {
+		op, err := deserializeOutpoint(from.ID)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if _, ok := inVals[*op]; ok {
+			return nil, nil, nil, errors.New("duplicate input")
+		}
+		prevScripts[*op] = script
+		inVals[*op] = from.Amount.Int64()
+		tx.TxIn = append(tx.TxIn, wire.NewTxIn(op, nil, nil))
+	}
+	for _, to := range txn.To {
+		scriptPubkey, err := w.addressToScript(to.Address.String())
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		tx.TxOut = append(tx.TxOut, wire.NewTxOut(to.Amount.Int64(), scriptPubkey))
+	}
+
+	// BIP 69 sorting
+	txsort.InPlaceSort(tx)
+	return tx, prevScripts, inVals, nil
+}
+
+// signMuSigEscrow runs our side of the two signing rounds for key.
+func (w *BitcoinWallet) signMuSigEscrow(txn iwallet.Transaction, key btcec.PrivateKey, redeemScript []byte) ([]iwallet.EscrowSignature, error) {
+	e, err := parseMuSigEscrow(redeemScript)
+	if err != nil {
+		return nil, err
+	}
+	pk := key.PubKey().SerializeCompressed()
+	index := e.keyIndex(pk)
+	if index < 0 {
+		return nil, errors.New("key is not part of the escrow")
+	}
+	tx, prevScripts, inVals, err := w.musigEscrowTx(txn, e)
+	if err != nil {
+		return nil, err
+	}
+
+	id := musigSessionID{escrow: sha256.Sum256(redeemScript), txid: tx.TxHash()}
+	copy(id.signer[:], pk)
+
+	w.musigMtx.Lock()
+	defer w.musigMtx.Unlock()
+
+	if w.musigSigners == nil {
+		w.musigSigners = make(map[musigSessionID]*musigSigner)
+	}
+	s, ok := w.musigSigners[id]
+	if !ok {
+		s = &musigSigner{index: index, peers: make(map[int][][]byte)}
+		for range tx.TxIn {
+			sec, pubNonce, err := musigNonceGen(&key)
+			if err != nil {
+				return nil, err
+			}
+			s.nonces = append(s.nonces, sec)
+			s.pubNonces = append(s.pubNonces, pubNonce)
+		}
+		w.musigSigners[id] = s
+	}
+
+	// Until the co-signers' nonces arrive the first round is repeated.
+	var sigs []iwallet.EscrowSignature
+	if len(s.peers) < e.threshold-1 {
+		for i, pubNonce := range s.pubNonces {
+			sigs = append(sigs, iwallet.EscrowSignature{Index: i, Signature: append(append([]byte{}, pk...), pubNonce...)})
+		}
+		return sigs, nil
+	}
+
+	signers := []int{s.index}
+	for idx := range s.peers {
+		signers = append(signers, idx)
+	}
+	ctx, leaf, err := e.spendPath(signers)
+	if err != nil {
+		return nil, err
+	}
+
+	// The nonces are consumed even if signing fails part way through.
+	delete(w.musigSigners, id)
+
+	for i := range tx.TxIn {
+		session, err := w.musigSession(tx, i, prevScripts, inVals, ctx, leaf, s.pubNonces[i], s.peers)
+		if err != nil {
+			return nil, err
+		}
+		psig, err := session.sign(s.nonces[i], &key)
+		if err != nil {
+			return nil, err
+		}
+		sig := append(append(append([]byte{}, pk...), s.pubNonces[i]...), psig...)
+		sigs = append(sigs, iwallet.EscrowSignature{Index: i, Signature: sig})
+	}
+	return sigs, nil
+}
+
+// musigSession returns the signing session for input i with the given
+// public nonces.
+func (w *BitcoinWallet) musigSession(tx *wire.MsgTx, i int, prevScripts map[wire.OutPoint][]byte, inVals map[wire.OutPoint]int64, ctx *keyAggContext, leaf *musigLeaf, pubNonce []byte, peers map[int][][]byte) (*musigSession, error) {
+	var leafHash []byte
+	if leaf != nil {
+		leafHash = leaf.hash
+	}
+	sigHash, err := taprootScriptSigHash(tx, i, prevScripts, inVals, leafHash)
+	if err != nil {
+		return nil, err
+	}
+	pubNonces := [][]byte{pubNonce}
+	for _, nonces := range peers {
+		pubNonces = append(pubNonces, nonces[i])
+	}
+	aggNonce, err := musigNonceAgg(pubNonces)
+	if err != nil {
+		return nil, err
+	}
+	return newMuSigSession(ctx, aggNonce, sigHash)
+}
+
+// AddEscrowNonces passes the public nonces returned by the co-signers'
+// first call to SignMultisigTransaction for a MuSig2 escrow to our signing
+// sessions for the transaction. Exactly threshold-1 co-signers must be
+// added before SignMultisigTransaction returns partial signatures.
+func (w *BitcoinWallet) AddEscrowNonces(txn iwallet.Transaction, redeemScript []byte, nonces [][]iwallet.EscrowSignature) error {
+	e, err := parseMuSigEscrow(redeemScript)
+	if err != nil {
+		return err
+	}
+	tx, _, _, err := w.musigEscrowTx(txn, e)
+	if err != nil {
+		return err
+	}
+
+	peers := make(map[int][][]byte)
+	for _, signerNonces := range nonces {
+		if len(signerNonces) != len(tx.TxIn) {
+			return errors.New("incorrect number of nonces")
+		}
+		index := -1
+		pubNonces := make([][]byte, len(tx.TxIn))
+		for _, nonce := range signerNonces {
+			if len(nonce.Signature) != musigNonceSize || nonce.Index < 0 || nonce.Index >= len(tx.TxIn) {
+				return errors.New("invalid nonce")
+			}
+			idx := e.keyIndex(nonce.Signature[:33])
+			if idx < 0 || (index >= 0 && idx != index) {
+				return errors.New("nonce from unknown key")
+			}
+			index = idx
+			pubNonces[nonce.Index] = nonce.Signature[33:]
+		}
+		for _, pubNonce := range pubNonces {
+			if pubNonce == nil {
+				return errors.New("missing nonce")
+			}
+		}
+		peers[index] = pubNonces
+	}
+
+	w.musigMtx.Lock()
+	defer w.musigMtx.Unlock()
+
+	found := false
+	escrowID := sha256.Sum256(redeemScript)
+	for id, s := range w.musigSigners {
+		if id.escrow != escrowID || id.txid != tx.TxHash() {
+			continue
+		}
+		found = true
+		for idx, pubNonces := range peers {
+			if idx != s.index {
+				s.peers[idx] = pubNonces
+			}
+		}
+		if len(s.peers) > e.threshold-1 {
+			return errors.New("more co-signers than the escrow threshold")
+		}
+	}
+	if !found {
+		return errors.New("no signing session for transaction")
+	}
+	return nil
+}
+
+// buildMuSigEscrowTx aggregates the partial signatures from the second
+// signing round into the signed transaction.
+func (w *BitcoinWallet) buildMuSigEscrowTx(txn iwallet.Transaction, signatures [][]iwallet.EscrowSignature, redeemScript []byte) (*wire.MsgTx, error) {
+	e, err := parseMuSigEscrow(redeemScript)
+	if err != nil {
+		return nil, err
+	}
+	tx, prevScripts, inVals, err := w.musigEscrowTx(txn, e)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range tx.TxIn {
+		var (
+			signers   []int
+			pubNonces = make(map[int][]byte)
+			psigs     = make(map[int][]byte)
+		)
+		for _, escrowSigs := range signatures {
+			for _, sig := range escrowSigs {
+				if sig.Index != i {
+					continue
+				}
+				if len(sig.Signature) != musigSigSize {
+					return nil, errors.New("invalid musig signature")
+				}
+				idx := e.keyIndex(sig.Signature[:33])
+				if idx < 0 {
+					return nil, errors.New("signature from unknown key")
+				}
+				if _, ok := psigs[idx]; !ok {
+					signers = append(signers, idx)
+				}
+				pubNonces[idx] = sig.Signature[33:musigNonceSize]
+				psigs[idx] = sig.Signature[musigNonceSize:]
+				break
+			}
+		}
+
+		ctx, leaf, err := e.spendPath(signers)
+		if err != nil {
+			return nil, err
+		}
+		first, peers := signers[0], make(map[int][][]byte)
+		for _, idx := range signers[1:] {
+			nonces := make([][]byte, len(tx.TxIn))
+			nonces[i] = pubNonces[idx]
+			peers[idx] = nonces
+		}
+		session, err := w.musigSession(tx, i, prevScripts, inVals, ctx, leaf, pubNonces[first], peers)
+		if err != nil {
+			return nil, err
+		}
+
+		var parts [][]byte
+		for _, idx := range signers {
+			if !session.verify(psigs[idx], pubNonces[idx], e.keys[idx].SerializeCompressed()) {
+				return nil, errInvalidPartialSig
+			}
+			parts = append(parts, psigs[idx])
+		}
+		sig, err := session.aggregate(parts)
+		if err != nil {
+			return nil, err
+		}
+
+		if leaf == nil {
+			tx.TxIn[i].Witness = wire.TxWitness{sig}
+		} else {
+			tx.TxIn[i].Witness = wire.TxWitness{sig, leaf.script, leaf.controlBlock}
+		}
+	}
+	return tx, nil
+}
@@ -0,0 +1,378 @@
+package bitcoin
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	iwallet "github.com/cpacia/wallet-interface"
+	"strings"
+	"testing"
+)
+
+func TestKeyAgg(t *testing.T) {
+	// Test vectors from BIP327.
+	var keys []*btcec.PublicKey
+	for _, s := range []string{
+		"02F9308A019258C31049344F85F89D5229B531C845836F99B08601F113BCE036F9",
+		"03DFF1D77F2A671C5F36183726DB2341BE58FEAE1DA2DECED843240F7B502BA659",
+		"023590A94E768F8E1815C2F24B4D80A8E3149316C3518CE7B7AD338368D038CA66",
+	} {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := btcec.ParsePubKey(b, btcec.S256())
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+
+	tests := []struct {
+		indexes  []int
+		expected string
+	}{
+		{[]int{0, 1, 2}, "90539EEDE565F5D054F32CC0C220126889ED1E5D193BAF15AEF344FE59D4610C"},
+		{[]int{2, 1, 0}, "6204DE8B083426DC6EAF9502D27024D53FC826BF7D2012148A0575435DF54B2B"},
+		{[]int{0, 0, 0}, "B436E3BAD62B8CD409969A224731C193D051162D8C5AE8B109306127DA3AA935"},
+		{[]int{0, 0, 1, 1}, "69BC22BFA5D106306E48A20679DE1D7389386124D07571D0D872686028C26A3E"},
+	}
+	for i, test := range tests {
+		var ks []*btcec.PublicKey
+		for _, idx := range test.indexes {
+			ks = append(ks, keys[idx])
+		}
+		ctx, err := keyAgg(ks)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if agg := strings.ToUpper(hex.EncodeToString(ctx.xOnly())); agg != test.expected {
+			t.Errorf("Test %d: expected %s, got %s", i, test.expected, agg)
+		}
+	}
+}
+
+func TestMuSig2Sign(t *testing.T) {
+	var (
+		privs []*btcec.PrivateKey
+		pubs  []*btcec.PublicKey
+	)
+	for i := 0; i < 3; i++ {
+		priv, err := btcec.NewPrivateKey(btcec.S256())
+		if err != nil {
+			t.Fatal(err)
+		}
+		privs = append(privs, priv)
+		pubs = append(pubs, priv.PubKey())
+	}
+	ctx, err := keyAgg(sortKeys(pubs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := make([]byte, 32)
+	rand.Read(root)
+	tweak, err := taprootTweakWithRoot(ctx.xOnly(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tweaked, err := ctx.applyXOnlyTweak(tweak)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []*keyAggContext{ctx, tweaked} {
+		msg := make([]byte, 32)
+		rand.Read(msg)
+
+		var (
+			secNonces []*musigSecNonce
+			pubNonces [][]byte
+		)
+		for _, priv := range privs {
+			sec, pub, err := musigNonceGen(priv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			secNonces = append(secNonces, sec)
+			pubNonces = append(pubNonces, pub)
+		}
+		aggNonce, err := musigNonceAgg(pubNonces)
+		if err != nil {
+			t.Fatal(err)
+		}
+		session, err := newMuSigSession(c, aggNonce, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var psigs [][]byte
+		for i, priv := range privs {
+			psig, err := session.sign(secNonces[i], priv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !session.verify(psig, pubNonces[i], priv.PubKey().SerializeCompressed()) {
+				t.Errorf("Failed to verify partial signature %d", i)
+			}
+			if session.verify(psig, pubNonces[(i+1)%3], priv.PubKey().SerializeCompressed()) {
+				t.Errorf("Verified partial signature %d with the wrong nonce", i)
+			}
+			psigs = append(psigs, psig)
+		}
+		if _, err := session.sign(secNonces[0], privs[0]); err == nil {
+			t.Error("Expected nonce reuse to fail")
+		}
+
+		sig, err := session.aggregate(psigs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !schnorrVerify(c.xOnly(), msg, sig) {
+			t.Error("Failed to verify aggregate signature")
+		}
+	}
+}
+
+func TestTapTree(t *testing.T) {
+	for n := 1; n <= 6; n++ {
+		var leaves [][]byte
+		for i := 0; i < n; i++ {
+			leaves = append(leaves, tapLeafHash([]byte{byte(i)}))
+		}
+		root, paths := tapTree(leaves)
+		for i, leaf := range leaves {
+			h := leaf
+			for _, node := range paths[i] {
+				h = tapBranchHash(h, node)
+			}
+			if !bytes.Equal(h, root) {
+				t.Errorf("%d leaves: path for leaf %d doesn't lead to the root", n, i)
+			}
+		}
+	}
+}
+
+func TestBitcoinWallet_MuSig2Escrow(t *testing.T) {
+	var (
+		keys    []*btcec.PrivateKey
+		pubkeys []btcec.PublicKey
+	)
+	for i := 0; i < 3; i++ {
+		key, err := btcec.NewPrivateKey(btcec.S256())
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+		pubkeys = append(pubkeys, *key.PubKey())
+	}
+
+	h, err := chainhash.NewHashFromStr("bdb237bf8c5de6b60ba1e2dcfe364fc24f583e568d1682f851a9d0f11a45c78d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn := iwallet.Transaction{
+		From: []iwallet.SpendInfo{
+			{
+				ID:     serializeOutpoint(wire.NewOutPoint(h, 0)),
+				Amount: iwallet.NewAmount(1000000),
+			},
+			{
+				ID:     serializeOutpoint(wire.NewOutPoint(h, 1)),
+				Amount: iwallet.NewAmount(500000),
+			},
+		},
+		To: []iwallet.SpendInfo{
+			{
+				Amount:  iwallet.NewAmount(1400000),
+				Address: iwallet.NewAddress("tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", iwallet.CtBitcoin),
+			},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		threshold int
+		nKeys     int
+		signers   []int
+		keyPath   bool
+	}{
+		{
+			name:      "2 of 3 key path",
+			threshold: 2,
+			nKeys:     3,
+			signers:   []int{1, 0},
+			keyPath:   true,
+		},
+		{
+			name:      "2 of 3 script path",
+			threshold: 2,
+			nKeys:     3,
+			signers:   []int{2, 0},
+		},
+		{
+			name:      "2 of 3 last leaf",
+			threshold: 2,
+			nKeys:     3,
+			signers:   []int{1, 2},
+		},
+		{
+			name:      "1 of 2 script path",
+			threshold: 1,
+			nKeys:     2,
+			signers:   []int{1},
+		},
+	}
+
+	for _, test := range tests {
+		var wallets []*BitcoinWallet
+		for i := 0; i < 3; i++ {
+			w, err := newTestWallet()
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.escrowMuSig2 = true
+			wallets = append(wallets, w)
+		}
+		w := wallets[test.signers[0]]
+		addr, redeemScript, err := w.CreateMultisigAddress(pubkeys[:test.nKeys], test.threshold)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputKey, err := decodeTaprootAddress(addr.String(), w.params())
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		// First round.
+		var nonces [][]iwallet.EscrowSignature
+		if test.threshold > 1 {
+			for _, s := range test.signers {
+				n, err := wallets[s].SignMultisigTransaction(txn, *keys[s], redeemScript)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(n) != 2 || len(n[0].Signature) != musigNonceSize {
+					t.Fatalf("%s: expected nonces", test.name)
+				}
+				nonces = append(nonces, n)
+			}
+			for i, s := range test.signers {
+				var others [][]iwallet.EscrowSignature
+				for j := range test.signers {
+					if j != i {
+						others = append(others, nonces[j])
+					}
+				}
+				if err := wallets[s].AddEscrowNonces(txn, redeemScript, others); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		// Second round.
+		var sigs [][]iwallet.EscrowSignature
+		for _, s := range test.signers {
+			sig, err := wallets[s].SignMultisigTransaction(txn, *keys[s], redeemScript)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sig) != 2 || len(sig[0].Signature) != musigSigSize {
+				t.Fatalf("%s: expected partial signatures", test.name)
+			}
+			sigs = append(sigs, sig)
+		}
+
+		// A bad partial signature is caught before aggregating.
+		bad := make([]iwallet.EscrowSignature, len(sigs[0]))
+		copy(bad, sigs[0])
+		bad[0].Signature = append([]byte{}, bad[0].Signature...)
+		bad[0].Signature[musigSigSize-1] ^= 0x01
+		if _, err := w.buildMuSigEscrowTx(txn, append([][]iwallet.EscrowSignature{bad}, sigs[1:]...), redeemScript); err == nil {
+			t.Errorf("%s: expected invalid partial signature to fail", test.name)
+		}
+
+		wtx, err := w.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		txid, err := w.BuildAndSend(wtx, txn, sigs, redeemScript)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if err := wtx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		txs, err := w.DB.Store().ListUnconfirmed(context.Background(), iwallet.CtBitcoin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msgTx *wire.MsgTx
+		for _, utx := range txs {
+			if utx.Txid == txid.String() {
+				msgTx = new(wire.MsgTx)
+				if err := msgTx.Deserialize(bytes.NewReader(utx.TxBytes)); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if msgTx == nil {
+			t.Fatalf("%s: transaction not saved", test.name)
+		}
+
+		e, err := parseMuSigEscrow(redeemScript)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, prevScripts, inVals, err := w.musigEscrowTx(txn, e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, in := range msgTx.TxIn {
+			signingKey := outputKey
+			var leafHash []byte
+			if test.keyPath {
+				if len(in.Witness) != 1 {
+					t.Fatalf("%s: expected key path spend", test.name)
+				}
+			} else {
+				if len(in.Witness) != 3 {
+					t.Fatalf("%s: expected script path spend", test.name)
+				}
+				script, cb := in.Witness[1], in.Witness[2]
+				signingKey = script[1:33]
+				leafHash = tapLeafHash(script)
+
+				// The control block must commit to the output key.
+				node := leafHash
+				for j := 33; j < len(cb); j += 32 {
+					node = tapBranchHash(node, cb[j:j+32])
+				}
+				tweak, err := taprootTweakWithRoot(cb[1:33], node)
+				if err != nil {
+					t.Fatal(err)
+				}
+				internal, err := liftX(cb[1:33])
+				if err != nil {
+					t.Fatal(err)
+				}
+				tx, ty := btcec.S256().ScalarBaseMult(pad32(tweak))
+				qx, qy := btcec.S256().Add(internal.X, internal.Y, tx, ty)
+				if !bytes.Equal(pad32(qx), outputKey) || byte(qy.Bit(0)) != cb[0]&1 {
+					t.Errorf("%s: control block doesn't match the output key", test.name)
+				}
+			}
+			sigHash, err := taprootScriptSigHash(msgTx, i, prevScripts, inVals, leafHash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !schnorrVerify(signingKey, sigHash, in.Witness[0]) {
+				t.Errorf("%s: invalid signature for input %d", test.name, i)
+			}
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package bitcoin
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"gorm.io/gorm"
+	"time"
+)
+
+// ErrInvalidOfflineSignature is returned by CompleteSigningRequest when a
+// signature from the offline wallet doesn't verify.
+var ErrInvalidOfflineSignature = errors.New("invalid offline signature")
+
+// setOffline puts a watch-only wallet in offline mode. Spends are built
+// unsigned and saved as SigningRequests for the air-gapped wallet.
+func (w *BitcoinWallet) setOffline() error {
+	if err := w.setSigner(nil); err != nil {
+		return err
+	}
+	w.Hold = w.requestSignatures
+	return nil
+}
+
+// requestSignatures is the wallet's Hold function in offline mode. Instead
+// of broadcasting the transaction it's saved as a signing request when wtx
+// is committed.
+func (w *BitcoinWallet) requestSignatures(wtx iwallet.Tx, tx *wire.MsgTx) (iwallet.TransactionID, error) {
+	txid := iwallet.TransactionID(tx.TxHash().String())
+	req := base.SigningRequest{
+		ID:        txid,
+		Coin:      iwallet.CtBitcoin,
+		CreatedAt: time.Now(),
+	}
+	err := w.DB.View(func(dbtx database.Tx) error {
+		for i, in := range tx.TxIn {
+			var utxo database.UtxoRecord
+			err := dbtx.Read().Where("coin=?", iwallet.CtBitcoin.CurrencyCode()).Where("outpoint=?", hex.EncodeToString(serializeOutpoint(&in.PreviousOutPoint))).First(&utxo).Error
+			if err != nil {
+				return err
+			}
+			prevScript, err := w.addressToScript(utxo.Address)
+			if err != nil {
+				return err
+			}
+			k, ok := w.signer.key(prevScript)
+			if !ok {
+				return errors.New("input is not from a wallet address")
+			}
+			req.Inputs = append(req.Inputs, base.SigningInput{
+				Index:      i,
+				Amount:     iwallet.NewAmount(utxo.Amount).Int64(),
+				PrevScript: prevScript,
+				Path:       k.path,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return txid, err
+	}
+
+	var buf bytes.Buffer
+	if err := tx.BtcEncode(&buf, wire.ProtocolVersion, wire.WitnessEncoding); err != nil {
+		return txid, err
+	}
+	req.Tx = buf.Bytes()
+	ser, err := json.Marshal(&req)
+	if err != nil {
+		return txid, err
+	}
+
+	wbtx, ok := wtx.(*base.DBTx)
+	if !ok {
+		return txid, errors.New("tx is not expected type")
+	}
+	wbtx.OnCommit = func() error {
+		return w.DB.Update(func(dbtx database.Tx) error {
+			return dbtx.Save(&database.SigningRecord{
+				Txid:      txid.String(),
+				Coin:      iwallet.CtBitcoin.CurrencyCode(),
+				Status:    string(base.SigningPending),
+				CreatedAt: req.CreatedAt,
+				Request:   ser,
+			})
+		})
+	}
+	return txid, nil
+}
+
+// SigningRequests returns the spends waiting for the offline wallet's
+// signatures.
+func (w *BitcoinWallet) SigningRequests() ([]base.SigningRequest, error) {
+	var records []database.SigningRecord
+	err := w.DB.View(func(dbtx database.Tx) error {
+		err := dbtx.Read().Where("coin=?", iwallet.CtBitcoin.CurrencyCode()).Where("status=?", string(base.SigningPending)).Find(&records).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	reqs := make([]base.SigningRequest, 0, len(records))
+	for _, record := range records {
+		var req base.SigningRequest
+		if err := json.Unmarshal(record.Request, &req); err != nil {
+			return nil, err
+		}
+		reqs = append(reqs, req)
+	}
+	return reqs, nil
+}
+
+// SignOffline signs every input of the request with the wallet's keys. It's
+// run by the air-gapped wallet, which should first show the user the
+// request's outputs. Inputs which aren't from the wallet's addresses are
+// an error. The response is carried back to CompleteSigningRequest.
+func (w *BitcoinWallet) SignOffline(req *base.SigningRequest) (*base.SigningResponse, error) {
+	if req.Coin != iwallet.CtBitcoin {
+		return nil, fmt.Errorf("signing request is for %s", req.Coin.CurrencyCode())
+	}
+	var tx wire.MsgTx
+	if err := tx.BtcDecode(bytes.NewReader(req.Tx), wire.ProtocolVersion, wire.WitnessEncoding); err != nil {
+		return nil, err
+	}
+
+	resp := &base.SigningResponse{ID: req.ID}
+	sigHashes := txscript.NewTxSigHashes(&tx)
+	err := w.DB.View(func(dbtx database.Tx) error {
+		for _, in := range req.Inputs {
+			if in.Index < 0 || in.Index >= len(tx.TxIn) {
+				return errors.New("invalid signing request")
+			}
+			_, addrs, _, err := txscript.ExtractPkScriptAddrs(in.PrevScript, w.params())
+			if err != nil {
+				return err
+			}
+			if len(addrs) != 1 {
+				return fmt.Errorf("input %d is not from a wallet address", in.Index)
+			}
+			hdKey, err := w.Keychain.KeyForAddress(dbtx, iwallet.NewAddress(addrs[0].String(), iwallet.CtBitcoin), nil)
+			if err != nil {
+				return fmt.Errorf("input %d: %w", in.Index, err)
+			}
+			priv, err := hdKey.ECPrivKey()
+			base.ZeroKey(hdKey)
+			if err != nil {
+				return err
+			}
+			hash, err := inputSigHash(&tx, sigHashes, in.Index, in.PrevScript, in.Amount, priv.PubKey().SerializeCompressed())
+			if err != nil {
+				base.ZeroPrivKey(priv)
+				return err
+			}
+			sig, err := priv.Sign(hash)
+			base.ZeroPrivKey(priv)
+			if err != nil {
+				return err
+			}
+			resp.Signatures = append(resp.Signatures, append(sig.Serialize(), byte(txscript.SigHashAll)))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// CompleteSigningRequest adds the offline wallet's signatures to the
+// request they answer. The signatures are checked before the transaction
+// is broadcast when wtx is committed.
+func (w *BitcoinWallet) CompleteSigningRequest(wtx iwallet.Tx, resp *base.SigningResponse) (iwallet.TransactionID, error) {
+	if w.signer == nil || w.signer.signer != nil {
+		return "", errors.New("wallet is not in offline mode")
+	}
+	var tx wire.MsgTx
+	err := w.DB.View(func(dbtx database.Tx) error {
+		req, err := pendingSigning(dbtx, resp.ID)
+		if err != nil {
+			return err
+		}
+		if err := tx.BtcDecode(bytes.NewReader(req.Tx), wire.ProtocolVersion, wire.WitnessEncoding); err != nil {
+			return err
+		}
+		if len(resp.Signatures) != len(req.Inputs) {
+			return errors.New("incorrect number of signatures")
+		}
+
+		sigHashes := txscript.NewTxSigHashes(&tx)
+		for j, in := range req.Inputs {
+			if in.Index < 0 || in.Index >= len(tx.TxIn) {
+				return errors.New("invalid signing request")
+			}
+			k, ok := w.signer.key(in.PrevScript)
+			if !ok {
+				return errors.New("input is not from a wallet address")
+			}
+			pubKey := k.pubKey.SerializeCompressed()
+
+			sig := resp.Signatures[j]
+			if len(sig) == 0 || sig[len(sig)-1] != byte(txscript.SigHashAll) {
+				return ErrInvalidOfflineSignature
+			}
+			parsed, err := btcec.ParseDERSignature(sig[:len(sig)-1], btcec.S256())
+			if err != nil {
+				return ErrInvalidOfflineSignature
+			}
+			hash, err := inputSigHash(&tx, sigHashes, in.Index, in.PrevScript, in.Amount, pubKey)
+			if err != nil {
+				return err
+			}
+			if !parsed.Verify(hash, k.pubKey) {
+				return ErrInvalidOfflineSignature
+			}
+			if err := setInputSignature(&tx, in.Index, in.PrevScript, pubKey, sig); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	txid, err := w.CommitTx(wtx, &tx)
+	if err != nil {
+		return txid, err
+	}
+	wbtx := wtx.(*base.DBTx)
+	broadcast := wbtx.OnCommit
+	wbtx.OnCommit = func() error {
+		if err := w.closeSigning(resp.ID, base.SigningComplete); err != nil {
+			return err
+		}
+		return broadcast()
+	}
+	return txid, nil
+}
+
+// CancelSigningRequest drops the signing request with the given ID. Its
+// transaction is never broadcast.
+func (w *BitcoinWallet) CancelSigningRequest(id iwallet.TransactionID) error {
+	return w.closeSigning(id, base.SigningCanceled)
+}
+
+// closeSigning sets the status of a pending signing request.
+func (w *BitcoinWallet) closeSigning(id iwallet.TransactionID, status base.SigningStatus) error {
+	return w.DB.Update(func(dbtx database.Tx) error {
+		var record database.SigningRecord
+		err := dbtx.Read().Where("coin=?", iwallet.CtBitcoin.CurrencyCode()).Where("txid=?", id.String()).First(&record).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("signing request %s not found", id)
+		} else if err != nil {
+			return err
+		}
+		if record.Status != string(base.SigningPending) {
+			return base.ErrSigningClosed
+		}
+		record.Status = string(status)
+		return dbtx.Save(&record)
+	})
+}
+
+// pendingSigning returns the signing request with the given ID if it
+// hasn't been completed or canceled.
+func pendingSigning(dbtx database.Tx, id iwallet.TransactionID) (*base.SigningRequest, error) {
+	var record database.SigningRecord
+	err := dbtx.Read().Where("coin=?", iwallet.CtBitcoin.CurrencyCode()).Where("txid=?", id.String()).First(&record).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("signing request %s not found", id)
+	} else if err != nil {
+		return nil, err
+	}
+	if record.Status != string(base.SigningPending) {
+		return nil, base.ErrSigningClosed
+	}
+	var req base.SigningRequest
+	if err := json.Unmarshal(record.Request, &req); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
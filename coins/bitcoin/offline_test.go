@@ -0,0 +1,144 @@
+package bitcoin
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/cpacia/multiwallet/base"
+	iwallet "github.com/cpacia/wallet-interface"
+	"github.com/jarcoal/httpmock"
+	"testing"
+	"time"
+)
+
+func TestBitcoinWallet_Offline(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	for _, addrType := range []base.AddressType{base.AddressTypeNativeSegwit, base.AddressTypeLegacy} {
+		// The air-gapped wallet holds the private key.
+		signer, err := newTestWalletWithAddressType(addrType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := hdkeychain.NewKeyFromString("tprv8ZgxMBicQKsPeghT19pungdFLMJM2hMs3EEn5WtgobD7wuQSFQu4VNaEJXH9HS3RhhLT4wgZ3hj31m3kafuxhL9vfGTRtBVLSog4zjxW3L1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		xpub, err := key.Neuter()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := newTestWalletWithSetup(addrType, func(w *BitcoinWallet) error {
+			if err := w.setOffline(); err != nil {
+				return err
+			}
+			return w.CreateWatchOnlyWallet(*xpub, time.Now())
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fromScript := fundTestWallet(t, w)
+
+		wtx, err := w.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := w.Spend(wtx, iwallet.NewAddress("tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", iwallet.CtBitcoin), iwallet.NewAmount(500000), iwallet.FlNormal)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := wtx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if txs := loadUnconfirmed(t, w); len(txs) != 0 {
+			t.Fatalf("Expected no broadcast before signing, found %d txs", len(txs))
+		}
+
+		reqs, err := w.SigningRequests()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(reqs) != 1 || reqs[0].ID != id {
+			t.Fatalf("Expected signing request %s, got %v", id, reqs)
+		}
+
+		// Carry the request across as QR codes.
+		ser, err := json.Marshal(&reqs[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks, err := base.EncodeQRChunks(ser, 500)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var d base.QRDecoder
+		for _, chunk := range chunks {
+			if err := d.Add(chunk); err != nil {
+				t.Fatal(err)
+			}
+		}
+		payload, err := d.Payload()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var req base.SigningRequest
+		if err := json.Unmarshal(payload, &req); err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := signer.SignOffline(&req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		bad := *resp
+		bad.Signatures = [][]byte{append([]byte{}, resp.Signatures[0]...)}
+		bad.Signatures[0][10] ^= 0xff
+		wtx, err = w.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.CompleteSigningRequest(wtx, &bad); !errors.Is(err, ErrInvalidOfflineSignature) {
+			t.Errorf("Expected ErrInvalidOfflineSignature, got %v", err)
+		}
+		if err := wtx.Rollback(); err != nil {
+			t.Fatal(err)
+		}
+
+		wtx, err = w.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.CompleteSigningRequest(wtx, resp); err != nil {
+			t.Fatal(err)
+		}
+		if err := wtx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		txs := loadUnconfirmed(t, w)
+		if len(txs) != 1 {
+			t.Fatalf("Expected 1 tx found %d", len(txs))
+		}
+		var tx wire.MsgTx
+		if err := tx.BtcDecode(bytes.NewReader(txs[0].TxBytes), wire.ProtocolVersion, wire.WitnessEncoding); err != nil {
+			t.Fatal(err)
+		}
+		vm, err := txscript.NewEngine(fromScript, &tx, 0, txscript.StandardVerifyFlags, nil, nil, 1000000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := vm.Execute(); err != nil {
+			t.Errorf("Script verification failed for address type %d: %s", addrType, err)
+		}
+
+		if err := w.CancelSigningRequest(id); !errors.Is(err, base.ErrSigningClosed) {
+			t.Errorf("Expected ErrSigningClosed, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package bitcoin
+
+import (
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+	"math/big"
+	"time"
+)
+
+// signetGenesisBlock is the genesis block of the default signet. It's the
+// mainnet genesis block with signet's timestamp and difficulty.
+var signetGenesisBlock = func() wire.MsgBlock {
+	block := *chaincfg.MainNetParams.GenesisBlock
+	block.Header.Timestamp = time.Unix(1598918400, 0)
+	block.Header.Bits = 0x1e0377ae
+	block.Header.Nonce = 52613770
+	return block
+}()
+
+// signetGenesisHash is 00000008819873e925422c1ff0f99f7cc9bbb232af63a077a480a3633bee1ef6.
+var signetGenesisHash = signetGenesisBlock.BlockHash()
+
+// signetPowLimit is the highest proof of work value a signet block can
+// have, 0x00000377ae << 216.
+var signetPowLimit = new(big.Int).Lsh(big.NewInt(0x0377ae), 216)
+
+// SigNetParams are the parameters for the default signet. Signet encodes
+// addresses and keys like testnet so only the network and genesis block
+// differ. They aren't registered with chaincfg as that would clash with
+// testnet's address prefixes, which are already registered.
+var SigNetParams = func() chaincfg.Params {
+	params := chaincfg.TestNet3Params
+	params.Name = "signet"
+	params.Net = wire.BitcoinNet(0x40cf030a)
+	params.DefaultPort = "38333"
+	params.DNSSeeds = []chaincfg.DNSSeed{
+		{Host: "seed.signet.bitcoin.sprovoost.nl", HasFiltering: false},
+	}
+	params.GenesisBlock = &signetGenesisBlock
+	params.GenesisHash = &signetGenesisHash
+	params.PowLimit = signetPowLimit
+	params.PowLimitBits = 0x1e0377ae
+	params.ReduceMinDifficulty = false
+	params.MinDiffReductionTime = 0
+	params.Checkpoints = nil
+	return params
+}()
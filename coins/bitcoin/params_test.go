@@ -0,0 +1,50 @@
+package bitcoin
+
+import (
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcutil"
+	"github.com/cpacia/multiwallet/base"
+	"strings"
+	"testing"
+)
+
+func TestSigNetParams(t *testing.T) {
+	expected := "00000008819873e925422c1ff0f99f7cc9bbb232af63a077a480a3633bee1ef6"
+	if SigNetParams.GenesisHash.String() != expected {
+		t.Errorf("Expected genesis hash %s, got %s", expected, SigNetParams.GenesisHash)
+	}
+	if SigNetParams.Bech32HRPSegwit != "tb" {
+		t.Errorf("Expected signet addresses to use the testnet prefix, got %s", SigNetParams.Bech32HRPSegwit)
+	}
+}
+
+func TestBitcoinWallet_Networks(t *testing.T) {
+	key, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkh := btcutil.Hash160(key.PubKey().SerializeCompressed())
+
+	tests := []struct {
+		network base.Network
+		prefix  string
+	}{
+		{base.NetworkMainnet, "bc1"},
+		{base.NetworkTestnet, "tb1"},
+		{base.NetworkSignet, "tb1"},
+		{base.NetworkRegtest, "bcrt1"},
+	}
+	for _, test := range tests {
+		w := &BitcoinWallet{network: test.network}
+		addr, err := btcutil.NewAddressWitnessPubKeyHash(pkh, w.params())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(addr.String(), test.prefix) {
+			t.Errorf("Expected %s address to start with %s, got %s", test.network, test.prefix, addr)
+		}
+		if _, err := w.addressToScript(addr.String()); err != nil {
+			t.Errorf("%s address %s did not decode: %s", test.network, addr, err)
+		}
+	}
+}
@@ -0,0 +1,486 @@
+package bitcoin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/multiwallet/database"
+	"github.com/cpacia/proxyclient"
+	iwallet "github.com/cpacia/wallet-interface"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// payjoinTimeout is how long the receiver has to answer a payjoin request
+// before the original transaction is sent.
+const payjoinTimeout = time.Minute
+
+// maxPayjoinResponse is the largest payjoin response read.
+const maxPayjoinResponse = 1 << 20
+
+// ErrInvalidPaymentURI is returned by ParsePaymentURI for a malformed URI.
+var ErrInvalidPaymentURI = errors.New("invalid payment URI")
+
+// PaymentURI is a BIP 21 payment request.
+type PaymentURI struct {
+	Address iwallet.Address
+
+	// Amount is zero if the request doesn't set one.
+	Amount iwallet.Amount
+
+	Label   string
+	Message string
+
+	// PayjoinEndpoint is the receiver's BIP 78 endpoint. It's empty if
+	// the receiver doesn't accept payjoins.
+	PayjoinEndpoint string
+}
+
+// ParsePaymentURI decodes a BIP 21 bitcoin: URI. Payjoin endpoints must be
+// https or onion URLs.
+func (w *BitcoinWallet) ParsePaymentURI(uri string) (*PaymentURI, error) {
+	const scheme = "bitcoin:"
+	if len(uri) < len(scheme) || !strings.EqualFold(uri[:len(scheme)], scheme) {
+		return nil, ErrInvalidPaymentURI
+	}
+	addr, query := uri[len(scheme):], ""
+	if i := strings.Index(addr, "?"); i >= 0 {
+		addr, query = addr[:i], addr[i+1:]
+	}
+	// Bech32 addresses are upper case in QR codes.
+	if strings.HasPrefix(strings.ToLower(addr), w.params().Bech32HRPSegwit+"1") {
+		addr = strings.ToLower(addr)
+	}
+	req := &PaymentURI{
+		Address: iwallet.NewAddress(addr, iwallet.CtBitcoin),
+		Amount:  iwallet.NewAmount(0),
+	}
+	if err := w.ValidateAddress(req.Address); err != nil {
+		return nil, ErrInvalidPaymentURI
+	}
+
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, ErrInvalidPaymentURI
+	}
+	for key, values := range params {
+		value := values[0]
+		switch key {
+		case "amount":
+			req.Amount, err = parseBitcoinAmount(value)
+			if err != nil {
+				return nil, ErrInvalidPaymentURI
+			}
+		case "label":
+			req.Label = value
+		case "message":
+			req.Message = value
+		case "pj":
+			u, err := url.Parse(value)
+			if err != nil || !(u.Scheme == "https" || (u.Scheme == "http" && strings.HasSuffix(u.Hostname(), ".onion"))) {
+				return nil, ErrInvalidPaymentURI
+			}
+			req.PayjoinEndpoint = value
+		default:
+			// Required parameters we don't understand mean the
+			// request can't be paid.
+			if strings.HasPrefix(key, "req-") {
+				return nil, fmt.Errorf("%w: unsupported parameter %s", ErrInvalidPaymentURI, key)
+			}
+		}
+	}
+	return req, nil
+}
+
+// parseBitcoinAmount returns the satoshis of a decimal amount of bitcoin.
+func parseBitcoinAmount(s string) (iwallet.Amount, error) {
+	whole, frac := s, ""
+	if i := strings.Index(s, "."); i >= 0 {
+		whole, frac = s[:i], s[i+1:]
+	}
+	if whole+frac == "" || len(frac) > 8 {
+		return iwallet.Amount{}, errors.New("invalid amount")
+	}
+	digits := whole + frac + strings.Repeat("0", 8-len(frac))
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return iwallet.Amount{}, errors.New("invalid amount")
+		}
+	}
+	digits = strings.TrimLeft(digits, "0")
+	if digits == "" {
+		digits = "0"
+	}
+	return iwallet.NewAmount(digits), nil
+}
+
+// SpendPaymentURI pays a BIP 21 URI. The URI's amount is sent if it has one,
+// otherwise amt is. If the URI has a payjoin endpoint the signed transaction
+// is offered to the receiver, who may add one of their own inputs and so
+// break the assumption that every input of a transaction belongs to the
+// sender. The receiver's proposal is sent in place of the original if it
+// passes the BIP 78 sender checks. If the receiver can't be reached or its
+// proposal is rejected the original transaction is sent.
+//
+// Wallets which don't sign their own transactions alone, with a cosigner,
+// signer or vault, pay the URI without a payjoin. The transaction is saved
+// and broadcast when wtx is committed.
+func (w *BitcoinWallet) SpendPaymentURI(wtx iwallet.Tx, uri string, amt iwallet.Amount, feeLevel iwallet.FeeLevel) (iwallet.TransactionID, error) {
+	req, err := w.ParsePaymentURI(uri)
+	if err != nil {
+		return "", err
+	}
+	if req.Amount.Cmp(iwallet.NewAmount(0)) > 0 {
+		amt = req.Amount
+	}
+	if req.PayjoinEndpoint == "" || w.cosigner != nil || w.signer != nil || w.vault.Enabled() || w.Hold != nil {
+		return w.Spend(wtx, req.Address, amt, feeLevel)
+	}
+
+	if err := w.CheckDestinations(req.Address); err != nil {
+		return "", err
+	}
+	var original *wire.MsgTx
+	err = w.DB.View(func(dbtx database.Tx) error {
+		original, err = w.BuildTx(dbtx, amt.Int64(), req.Address, feeLevel)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := w.payjoin(req, original)
+	if err != nil {
+		w.Logger.Warningf("[%s] Payjoin with %s failed, sending the original transaction: %s", iwallet.CtBitcoin, req.PayjoinEndpoint, err)
+		tx = original
+	}
+	return w.SendSigned(wtx, tx)
+}
+
+// payjoinSender holds what the sender knows about its original transaction
+// while negotiating a payjoin.
+type payjoinSender struct {
+	original      *wire.MsgTx
+	paymentScript []byte
+	params        *chaincfg.Params
+
+	// changeIdx is the index of the change output the receiver may take
+	// fees from, or -1 if there's none.
+	changeIdx int
+
+	// fee is the original's fee and feeRate its fee per vbyte.
+	fee     int64
+	feeRate int64
+
+	// inputVSize is the virtual size of one of the sender's inputs. The
+	// receiver's inputs must be of the same type.
+	inputVSize int64
+
+	// maxContribution is the most the receiver may take from the
+	// change output to pay for its inputs.
+	maxContribution int64
+
+	keys        map[wire.OutPoint]*btcec.PrivateKey
+	prevScripts map[wire.OutPoint][]byte
+	inVals      map[wire.OutPoint]int64
+}
+
+// payjoin offers the original transaction to the receiver and returns the
+// signed payjoin transaction.
+func (w *BitcoinWallet) payjoin(req *PaymentURI, original *wire.MsgTx) (*wire.MsgTx, error) {
+	s, psbt, err := w.newPayjoinSender(req.Address, original)
+	if err != nil {
+		return nil, err
+	}
+	defer s.zeroKeys()
+
+	proposal, err := requestPayjoin(req.PayjoinEndpoint, psbt, s.changeIdx, s.maxContribution)
+	if err != nil {
+		return nil, err
+	}
+	return s.finish(proposal)
+}
+
+// newPayjoinSender gathers the outputs spent by the original transaction
+// paying addr and the keys to sign for them. It returns the sender along
+// with the original PSBT.
+func (w *BitcoinWallet) newPayjoinSender(addr iwallet.Address, original *wire.MsgTx) (*payjoinSender, string, error) {
+	paymentScript, err := w.addressToScript(addr.String())
+	if err != nil {
+		return nil, "", err
+	}
+	s := &payjoinSender{
+		original:      original,
+		paymentScript: paymentScript,
+		params:        w.params(),
+		changeIdx:     -1,
+		keys:          make(map[wire.OutPoint]*btcec.PrivateKey),
+		prevScripts:   make(map[wire.OutPoint][]byte),
+		inVals:        make(map[wire.OutPoint]int64),
+	}
+
+	utxos := make([]*wire.TxOut, 0, len(original.TxIn))
+	err = w.DB.View(func(dbtx database.Tx) error {
+		prevOuts, err := w.spentOutputs(dbtx, iwallet.TransactionID(original.TxHash().String()))
+		if err != nil {
+			return err
+		}
+		for _, in := range original.TxIn {
+			prev, ok := prevOuts[in.PreviousOutPoint]
+			if !ok {
+				return errors.New("input is not from this wallet")
+			}
+			script, err := w.Chain.AddressToScript(prev.Address.String())
+			if err != nil {
+				return err
+			}
+			if !isPayToTaproot(script) && !txscript.IsPayToWitnessPubKeyHash(script) && !txscript.IsPayToScriptHash(script) {
+				return errors.New("payjoin requires segwit inputs")
+			}
+			hdKey, err := w.Keychain.KeyForAddress(dbtx, prev.Address, nil)
+			if err != nil {
+				return err
+			}
+			priv, err := hdKey.ECPrivKey()
+			base.ZeroKey(hdKey)
+			if err != nil {
+				return err
+			}
+			s.keys[in.PreviousOutPoint] = priv
+			s.prevScripts[in.PreviousOutPoint] = script
+			s.inVals[in.PreviousOutPoint] = prev.Amount.Int64()
+			s.fee += prev.Amount.Int64()
+			utxos = append(utxos, wire.NewTxOut(prev.Amount.Int64(), script))
+		}
+		changeIdx, err := w.changeOutputIndex(dbtx, original.TxOut)
+		if err == nil {
+			s.changeIdx = changeIdx
+		} else if !errors.Is(err, ErrNoChangeOutput) {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		s.zeroKeys()
+		return nil, "", err
+	}
+
+	for _, out := range original.TxOut {
+		s.fee -= out.Value
+	}
+	weight := blockchain.GetTransactionWeight(btcutil.NewTx(original))
+	s.feeRate = s.fee / ((weight + blockchain.WitnessScaleFactor - 1) / blockchain.WitnessScaleFactor)
+	size, witnessWeight := w.inputSize(utxos[0].PkScript)
+	s.inputVSize = int64(size + (witnessWeight+3)/4)
+	s.maxContribution = s.feeRate * s.inputVSize
+
+	psbt, err := encodePSBT(original, utxos)
+	if err != nil {
+		s.zeroKeys()
+		return nil, "", err
+	}
+	return s, psbt, nil
+}
+
+// zeroKeys zeroes the sender's private keys.
+func (s *payjoinSender) zeroKeys() {
+	for _, key := range s.keys {
+		base.ZeroPrivKey(key)
+	}
+}
+
+// requestPayjoin posts the original PSBT to the receiver's endpoint and
+// returns its proposal. Output substitution is always disabled so the
+// receiver can't change the address paid.
+func requestPayjoin(endpoint, psbt string, changeIdx int, maxContribution int64) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("v", "1")
+	q.Set("disableoutputsubstitution", "true")
+	if changeIdx >= 0 {
+		q.Set("additionalfeeoutputindex", strconv.Itoa(changeIdx))
+		q.Set("maxadditionalfeecontribution", strconv.FormatInt(maxContribution, 10))
+	}
+	u.RawQuery = q.Encode()
+
+	ctx, cancel := context.WithTimeout(context.Background(), payjoinTimeout)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), strings.NewReader(psbt))
+	if err != nil {
+		return "", err
+	}
+	httpReq.Header.Set("Content-Type", "text/plain")
+	resp, err := proxyclient.NewHttpClient().Do(httpReq)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: maxPayjoinResponse})
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var payjoinErr struct {
+			ErrorCode string `json:"errorCode"`
+			Message   string `json:"message"`
+		}
+		if err := json.Unmarshal(body, &payjoinErr); err == nil && payjoinErr.ErrorCode != "" {
+			return "", fmt.Errorf("receiver returned %s: %s", payjoinErr.ErrorCode, payjoinErr.Message)
+		}
+		return "", fmt.Errorf("receiver returned status %d", resp.StatusCode)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// finish checks the receiver's proposal and signs the sender's inputs.
+func (s *payjoinSender) finish(proposalPSBT string) (*wire.MsgTx, error) {
+	proposal, utxos, err := decodePSBT(proposalPSBT)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkProposal(proposal, utxos); err != nil {
+		return nil, err
+	}
+
+	prevScripts := make(map[wire.OutPoint][]byte)
+	inVals := make(map[wire.OutPoint]int64)
+	for i, in := range proposal.TxIn {
+		if _, ok := s.keys[in.PreviousOutPoint]; ok {
+			prevScripts[in.PreviousOutPoint] = s.prevScripts[in.PreviousOutPoint]
+			inVals[in.PreviousOutPoint] = s.inVals[in.PreviousOutPoint]
+			continue
+		}
+		prevScripts[in.PreviousOutPoint] = utxos[i].PkScript
+		inVals[in.PreviousOutPoint] = utxos[i].Value
+	}
+	sigHashes := txscript.NewTxSigHashes(proposal)
+	for i, in := range proposal.TxIn {
+		key, ok := s.keys[in.PreviousOutPoint]
+		if !ok {
+			continue
+		}
+		if err := signInput(proposal, sigHashes, i, inVals, prevScripts, key, s.params); err != nil {
+			return nil, err
+		}
+	}
+	return proposal, nil
+}
+
+// checkProposal makes the BIP 78 sender checks of the receiver's proposal.
+// The sender's inputs must be unchanged and unsigned and the receiver's
+// inputs signed and of the same type. The original outputs must all be
+// kept. Only the payment may increase and only the change may decrease, by
+// no more than the fee for the receiver's inputs.
+func (s *payjoinSender) checkProposal(proposal *wire.MsgTx, utxos []*wire.TxOut) error {
+	if proposal.Version != s.original.Version || proposal.LockTime != s.original.LockTime {
+		return errors.New("proposal changed the version or lock time")
+	}
+
+	sequence := s.original.TxIn[0].Sequence
+	inputType := payjoinInputType(s.prevScripts[s.original.TxIn[0].PreviousOutPoint])
+	ours := make(map[wire.OutPoint]*wire.TxIn)
+	for _, in := range s.original.TxIn {
+		ours[in.PreviousOutPoint] = in
+	}
+	var (
+		senderInputs   int
+		receiverInputs int64
+		totalIn        int64
+	)
+	for i, in := range proposal.TxIn {
+		if orig, ok := ours[in.PreviousOutPoint]; ok {
+			if in.Sequence != orig.Sequence {
+				return errors.New("proposal changed the sequence of an input")
+			}
+			if len(in.SignatureScript) > 0 || len(in.Witness) > 0 {
+				return errors.New("proposal didn't clear the sender's signatures")
+			}
+			delete(ours, in.PreviousOutPoint)
+			senderInputs++
+			totalIn += s.inVals[in.PreviousOutPoint]
+			continue
+		}
+		if utxos[i] == nil {
+			return errors.New("proposal is missing the receiver's utxo")
+		}
+		if len(in.SignatureScript) == 0 && len(in.Witness) == 0 {
+			return errors.New("proposal has an unsigned receiver input")
+		}
+		if payjoinInputType(utxos[i].PkScript) != inputType {
+			return errors.New("proposal mixes input types")
+		}
+		if in.Sequence != sequence {
+			return errors.New("proposal mixes input sequences")
+		}
+		receiverInputs++
+		totalIn += utxos[i].Value
+	}
+	if senderInputs != len(s.original.TxIn) {
+		return errors.New("proposal dropped an input")
+	}
+
+	used := make([]bool, len(proposal.TxOut))
+	var contribution int64
+	for i, out := range s.original.TxOut {
+		j := -1
+		for k, propOut := range proposal.TxOut {
+			if !used[k] && bytes.Equal(propOut.PkScript, out.PkScript) {
+				j = k
+				break
+			}
+		}
+		if j < 0 {
+			return errors.New("proposal dropped an output")
+		}
+		used[j] = true
+		value := proposal.TxOut[j].Value
+		switch {
+		case i == s.changeIdx:
+			contribution = out.Value - value
+		case bytes.Equal(out.PkScript, s.paymentScript):
+			if value < out.Value {
+				return errors.New("proposal decreased the payment")
+			}
+		case value != out.Value:
+			return errors.New("proposal changed an output")
+		}
+	}
+	if contribution > s.maxContribution || contribution > receiverInputs*s.inputVSize*s.feeRate {
+		return errors.New("proposal takes too much fee from the sender")
+	}
+
+	fee := totalIn
+	for _, out := range proposal.TxOut {
+		fee -= out.Value
+	}
+	if fee < s.fee {
+		return errors.New("proposal lowered the fee")
+	}
+	return nil
+}
+
+// payjoinInputType returns the type of the script an input spends.
+func payjoinInputType(script []byte) string {
+	if isPayToTaproot(script) {
+		return "taproot"
+	}
+	return txscript.GetScriptClass(script).String()
+}
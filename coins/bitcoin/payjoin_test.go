@@ -0,0 +1,334 @@
+package bitcoin
+
+import (
+	"bytes"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"github.com/jarcoal/httpmock"
+	"reflect"
+	"testing"
+)
+
+func TestBitcoinWallet_ParsePaymentURI(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	w, err := newTestWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := w.ParsePaymentURI("bitcoin:tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx?amount=0.0005&label=Shop&pj=https://example.com/pj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Address.String() != "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx" {
+		t.Errorf("Wrong address %s", req.Address)
+	}
+	if req.Amount.Cmp(iwallet.NewAmount(50000)) != 0 {
+		t.Errorf("Expected 50000 sats, got %s", req.Amount)
+	}
+	if req.Label != "Shop" || req.PayjoinEndpoint != "https://example.com/pj" {
+		t.Errorf("Unexpected request %+v", req)
+	}
+
+	req, err = w.ParsePaymentURI("BITCOIN:TB1QW508D6QEJXTDG4Y5R3ZARVARY0C5XW7KXPJZSX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Address.String() != "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx" || req.Amount.Cmp(iwallet.NewAmount(0)) != 0 || req.PayjoinEndpoint != "" {
+		t.Errorf("Unexpected request %+v", req)
+	}
+
+	for _, uri := range []string{
+		"tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+		"bitcoin:notanaddress",
+		"bitcoin:bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4",
+		"bitcoin:tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx?amount=0.123456789",
+		"bitcoin:tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx?amount=1e3",
+		"bitcoin:tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx?pj=http://example.com/pj",
+		"bitcoin:tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx?req-somethingnew=1",
+	} {
+		if _, err := w.ParsePaymentURI(uri); err == nil {
+			t.Errorf("Expected %s to be rejected", uri)
+		}
+	}
+}
+
+func TestPSBT(t *testing.T) {
+	tx := wire.NewMsgTx(2)
+	tx.AddTxIn(wire.NewTxIn(&wire.OutPoint{Hash: chainhash.Hash{0x01}, Index: 1}, nil, wire.TxWitness{{0x01, 0x02}, {0x03}}))
+	tx.AddTxIn(wire.NewTxIn(&wire.OutPoint{Hash: chainhash.Hash{0x02}}, []byte{0x04, 0x05}, nil))
+	tx.AddTxIn(wire.NewTxIn(&wire.OutPoint{Hash: chainhash.Hash{0x03}}, nil, nil))
+	tx.AddTxOut(wire.NewTxOut(1000, []byte{txscript.OP_TRUE}))
+	tx.LockTime = 100
+	utxos := []*wire.TxOut{wire.NewTxOut(2000, []byte{0x00, 0x14}), nil, wire.NewTxOut(3000, []byte{0x51})}
+
+	psbt, err := encodePSBT(tx, utxos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, decodedUtxos, err := decodePSBT(psbt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.TxHash() != tx.TxHash() || decoded.WitnessHash() != tx.WitnessHash() {
+		t.Error("Decoded the wrong transaction")
+	}
+	if !reflect.DeepEqual(decodedUtxos, utxos) {
+		t.Error("Decoded the wrong utxos")
+	}
+
+	if _, _, err := decodePSBT("cHNidP8="); err == nil {
+		t.Error("Expected an empty PSBT to be rejected")
+	}
+}
+
+// payjoinReceiver returns the proposal of a receiver adding an input worth
+// 200000 sats to the payment and taking contribution from the change.
+func payjoinReceiver(t *testing.T, psbt string, paymentIdx, changeIdx int, contribution int64, sign bool) string {
+	tx, utxos, err := decodePSBT(psbt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, in := range tx.TxIn {
+		in.SignatureScript = nil
+		in.Witness = nil
+	}
+	for i := range utxos {
+		utxos[i] = nil
+	}
+
+	key, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	script, err := txscript.NewScriptBuilder().AddOp(txscript.OP_0).AddData(btcutil.Hash160(key.PubKey().SerializeCompressed())).Script()
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := wire.NewTxIn(&wire.OutPoint{Hash: chainhash.Hash{0x05}}, nil, nil)
+	in.Sequence = tx.TxIn[0].Sequence
+	tx.AddTxIn(in)
+	utxos = append(utxos, wire.NewTxOut(200000, script))
+	tx.TxOut[paymentIdx].Value += 200000
+	tx.TxOut[changeIdx].Value -= contribution
+
+	if sign {
+		idx := len(tx.TxIn) - 1
+		witness, err := txscript.WitnessSignature(tx, txscript.NewTxSigHashes(tx), idx, 200000, script, txscript.SigHashAll, key, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx.TxIn[idx].Witness = witness
+	}
+	proposal, err := encodePSBT(tx, utxos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return proposal
+}
+
+func TestBitcoinWallet_Payjoin(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	w, err := newTestWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fundTestWallet(t, w)
+
+	addr := iwallet.NewAddress("tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", iwallet.CtBitcoin)
+	var original *wire.MsgTx
+	err = w.DB.View(func(dbtx database.Tx) error {
+		original, err = w.BuildTx(dbtx, 500000, addr, iwallet.FlNormal)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, psbt, err := w.newPayjoinSender(addr, original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.zeroKeys()
+	if s.changeIdx < 0 || s.feeRate <= 0 || s.maxContribution <= 0 {
+		t.Fatalf("Unexpected sender %+v", s)
+	}
+	paymentIdx := 1 - s.changeIdx
+	if !bytes.Equal(original.TxOut[paymentIdx].PkScript, s.paymentScript) {
+		t.Fatal("Expected the other output to be the payment")
+	}
+
+	tx, err := s.finish(payjoinReceiver(t, psbt, paymentIdx, s.changeIdx, s.maxContribution, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tx.TxIn) != 2 {
+		t.Fatalf("Expected 2 inputs, got %d", len(tx.TxIn))
+	}
+	op := original.TxIn[0].PreviousOutPoint
+	if tx.TxIn[0].PreviousOutPoint != op {
+		t.Fatal("Expected the sender's input first")
+	}
+	vm, err := txscript.NewEngine(s.prevScripts[op], tx, 0, txscript.StandardVerifyFlags, nil, txscript.NewTxSigHashes(tx), s.inVals[op])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Execute(); err != nil {
+		t.Errorf("Sender's input doesn't verify: %s", err)
+	}
+
+	if _, err := s.finish(payjoinReceiver(t, psbt, paymentIdx, s.changeIdx, s.maxContribution+1, true)); err == nil {
+		t.Error("Expected a proposal taking too much fee to be rejected")
+	}
+	if _, err := s.finish(payjoinReceiver(t, psbt, paymentIdx, s.changeIdx, 0, false)); err == nil {
+		t.Error("Expected a proposal with an unsigned receiver input to be rejected")
+	}
+	if _, err := s.finish(payjoinReceiver(t, psbt, paymentIdx, paymentIdx, 200001, true)); err == nil {
+		t.Error("Expected a proposal decreasing the payment to be rejected")
+	}
+	if _, err := s.finish(psbt); err == nil {
+		t.Error("Expected the signed original to be rejected as a proposal")
+	}
+}
+
+func TestBitcoinWallet_SignPSBT(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	w, err := newTestWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fundTestWallet(t, w)
+
+	addr := iwallet.NewAddress("tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", iwallet.CtBitcoin)
+	var original *wire.MsgTx
+	err = w.DB.View(func(dbtx database.Tx) error {
+		original, err = w.BuildTx(dbtx, 500000, addr, iwallet.FlNormal)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, psbt, err := w.newPayjoinSender(addr, original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.zeroKeys()
+
+	// Clear the wallet's signature and add an input from another
+	// wallet.
+	tx, utxos, err := decodePSBT(psbt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.TxIn[0].SignatureScript = nil
+	tx.TxIn[0].Witness = nil
+	tx.AddTxIn(wire.NewTxIn(&wire.OutPoint{Hash: chainhash.Hash{0x01}}, nil, nil))
+	foreign := wire.NewTxOut(10000, append([]byte{txscript.OP_0, txscript.OP_DATA_20}, make([]byte, 20)...))
+	unsigned, err := encodePSBT(tx, append(utxos, foreign))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed, n, err := w.SignPSBT(unsigned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("Expected 1 input signed, got %d", n)
+	}
+	if _, err := w.FinalizePSBT(signed); err == nil {
+		t.Error("Expected a PSBT with an unsigned input not to finalize")
+	}
+	tx, _, err = decodePSBT(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm, err := txscript.NewEngine(utxos[0].PkScript, tx, 0, txscript.StandardVerifyFlags, nil, txscript.NewTxSigHashes(tx), utxos[0].Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Execute(); err != nil {
+		t.Errorf("Signed input doesn't verify: %s", err)
+	}
+
+	// Signing again leaves the final input alone.
+	if _, n, err := w.SignPSBT(signed); err != nil || n != 0 {
+		t.Errorf("Expected nothing signed, got %d, %v", n, err)
+	}
+
+	tx.TxIn[1].Witness = wire.TxWitness{{0x01}}
+	complete, err := encodePSBT(tx, append(utxos, foreign))
+	if err != nil {
+		t.Fatal(err)
+	}
+	final, err := w.FinalizePSBT(complete)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if final.WitnessHash() != tx.WitnessHash() {
+		t.Error("Finalized the wrong transaction")
+	}
+
+	missing, err := encodePSBT(tx, append(utxos, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := w.SignPSBT(missing); err == nil {
+		t.Error("Expected a PSBT without an input's utxo to be rejected")
+	}
+}
+
+func TestBitcoinWallet_SpendPaymentURIFallback(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	w, err := newTestWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fundTestWallet(t, w)
+
+	wtx, err := w.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	txid, err := w.SpendPaymentURI(wtx, "bitcoin:tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx?amount=0.005&pj=https://127.0.0.1:1/pj", iwallet.NewAmount(0), iwallet.FlNormal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wtx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	txs := loadUnconfirmed(t, w)
+	if len(txs) != 1 || txs[0].Txid != txid.String() {
+		t.Fatalf("Expected the original transaction to be sent, got %d", len(txs))
+	}
+	var tx wire.MsgTx
+	if err := tx.BtcDecode(bytes.NewReader(txs[0].TxBytes), wire.ProtocolVersion, wire.WitnessEncoding); err != nil {
+		t.Fatal(err)
+	}
+	if len(tx.TxIn) != 1 {
+		t.Errorf("Expected only the wallet's input, got %d", len(tx.TxIn))
+	}
+	found := false
+	for _, out := range tx.TxOut {
+		if out.Value == 500000 {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("Expected the URI's amount to be paid")
+	}
+}
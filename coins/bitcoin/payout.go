@@ -0,0 +1,106 @@
+package bitcoin
+
+import (
+	"bytes"
+	"errors"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/cpacia/multiwallet/base"
+	iwallet "github.com/cpacia/wallet-interface"
+)
+
+// BuildDisputePayout builds the unsigned transaction paying the escrow's
+// utxos out according to the split. The fee for the fee level is taken
+// from the escrow before it's split. It's estimated for every party being
+// paid, so it's slightly more than needed if a dust output is dropped.
+//
+// Each party signs the returned Transaction with SignMultisigTransaction.
+// MuSig2 escrows are not supported.
+func (w *BitcoinWallet) BuildDisputePayout(utxos []iwallet.SpendInfo, split base.PayoutSplit, redeemScript []byte, level iwallet.FeeLevel) (*base.DisputePayout, error) {
+	if isMuSigEscrow(redeemScript) {
+		return nil, errors.New("dispute payouts are not supported for musig escrows")
+	}
+	if len(utxos) == 0 {
+		return nil, errors.New("no escrow utxos")
+	}
+	script, p2sh := splitEscrowScript(redeemScript)
+	m, n, err := multisigParams(script)
+	if err != nil {
+		return nil, err
+	}
+
+	total := iwallet.NewAmount(0)
+	for _, utxo := range utxos {
+		total = total.Add(utxo.Amount)
+	}
+
+	outputs, err := base.PayoutOutputs(total, split, w.IsDust)
+	if err != nil {
+		return nil, err
+	}
+	fpb, err := w.FeeProvider.GetFee(level)
+	if err != nil {
+		return nil, err
+	}
+	fee := fpb.Mul(iwallet.NewAmount(escrowSize(m, n, len(utxos), len(outputs), p2sh)))
+	if fee.Cmp(total) >= 0 {
+		return nil, errors.New("escrow value is less than the fee")
+	}
+	outputs, err = base.PayoutOutputs(total.Sub(fee), split, w.IsDust)
+	if err != nil {
+		return nil, err
+	}
+
+	txn := iwallet.Transaction{
+		From: utxos,
+		To:   outputs,
+	}
+	tx, amounts, err := w.escrowTx(txn)
+	if err != nil {
+		return nil, err
+	}
+
+	sigHashes := txscript.NewTxSigHashes(tx)
+	payout := &base.DisputePayout{
+		Transaction: txn,
+		Txid:        iwallet.TransactionID(tx.TxHash().String()),
+		Fee:         fee,
+	}
+	for i, in := range tx.TxIn {
+		sigHash, err := escrowSigHash(tx, sigHashes, i, amounts[in.PreviousOutPoint], script, p2sh)
+		if err != nil {
+			return nil, err
+		}
+		payout.SigHashes = append(payout.SigHashes, sigHash)
+	}
+
+	var buf bytes.Buffer
+	if err := tx.Serialize(&buf); err != nil {
+		return nil, err
+	}
+	payout.UnsignedTx = buf.Bytes()
+	return payout, nil
+}
+
+// multisigParams returns the threshold and number of keys of a multisig
+// escrow's redeem script. Escrows with a timeout are supported.
+func multisigParams(redeemScript []byte) (int, int, error) {
+	script := redeemScript
+	if len(script) > 0 && script[0] == txscript.OP_IF {
+		script = script[1:]
+	}
+	if len(script) == 0 || script[0] < txscript.OP_1 || script[0] > txscript.OP_16 {
+		return 0, 0, errors.New("not a multisig redeem script")
+	}
+	m := int(script[0]-txscript.OP_1) + 1
+
+	var n int
+	i := 1
+	for i+34 <= len(script) && script[i] == txscript.OP_DATA_33 {
+		n++
+		i += 34
+	}
+	if n == 0 || m > n || i+1 >= len(script) || script[i] != txscript.OP_1+byte(n-1) || script[i+1] != txscript.OP_CHECKMULTISIG {
+		return 0, 0, errors.New("not a multisig redeem script")
+	}
+	return m, n, nil
+}
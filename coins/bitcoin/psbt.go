@@ -0,0 +1,315 @@
+package bitcoin
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/multiwallet/coins/utxobase"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"gorm.io/gorm"
+	"io"
+)
+
+// The BIP 174 partially signed transaction encoding. Only the fields used by
+// payjoin and offline signing are understood: the unsigned transaction, each
+// input's spent output and its final scripts. Other fields are skipped when
+// decoding.
+const (
+	psbtGlobalUnsignedTx = 0x00
+
+	psbtInNonWitnessUtxo     = 0x00
+	psbtInWitnessUtxo        = 0x01
+	psbtInFinalScriptSig     = 0x07
+	psbtInFinalScriptWitness = 0x08
+)
+
+var psbtMagic = []byte{0x70, 0x73, 0x62, 0x74, 0xff}
+
+var errInvalidPSBT = errors.New("invalid PSBT")
+
+// encodePSBT returns the base64 PSBT of the transaction. utxos holds the
+// output spent by each input, which may be nil if it's unknown. Input scripts
+// and witnesses are encoded as the input's final scripts.
+func encodePSBT(tx *wire.MsgTx, utxos []*wire.TxOut) (string, error) {
+	if len(utxos) != len(tx.TxIn) {
+		return "", errors.New("a utxo is needed for each input")
+	}
+	var buf bytes.Buffer
+	buf.Write(psbtMagic)
+
+	var unsigned bytes.Buffer
+	if err := utxobase.StripSignatures(tx).BtcEncode(&unsigned, wire.ProtocolVersion, wire.BaseEncoding); err != nil {
+		return "", err
+	}
+	if err := writePSBTPair(&buf, psbtGlobalUnsignedTx, unsigned.Bytes()); err != nil {
+		return "", err
+	}
+	buf.WriteByte(0)
+
+	for i, in := range tx.TxIn {
+		if utxos[i] != nil {
+			var out bytes.Buffer
+			if err := wire.WriteTxOut(&out, 0, 0, utxos[i]); err != nil {
+				return "", err
+			}
+			if err := writePSBTPair(&buf, psbtInWitnessUtxo, out.Bytes()); err != nil {
+				return "", err
+			}
+		}
+		if len(in.SignatureScript) > 0 {
+			if err := writePSBTPair(&buf, psbtInFinalScriptSig, in.SignatureScript); err != nil {
+				return "", err
+			}
+		}
+		if len(in.Witness) > 0 {
+			var witness bytes.Buffer
+			if err := wire.WriteVarInt(&witness, 0, uint64(len(in.Witness))); err != nil {
+				return "", err
+			}
+			for _, item := range in.Witness {
+				if err := wire.WriteVarBytes(&witness, 0, item); err != nil {
+					return "", err
+				}
+			}
+			if err := writePSBTPair(&buf, psbtInFinalScriptWitness, witness.Bytes()); err != nil {
+				return "", err
+			}
+		}
+		buf.WriteByte(0)
+	}
+	for range tx.TxOut {
+		buf.WriteByte(0)
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// decodePSBT decodes a base64 PSBT. The final scripts of each input are set
+// on the returned transaction and the spent outputs are returned by input,
+// nil where the PSBT doesn't include them.
+func decodePSBT(s string) (*wire.MsgTx, []*wire.TxOut, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, nil, errInvalidPSBT
+	}
+	if !bytes.HasPrefix(b, psbtMagic) {
+		return nil, nil, errInvalidPSBT
+	}
+	r := bytes.NewReader(b[len(psbtMagic):])
+
+	var tx *wire.MsgTx
+	err = readPSBTMap(r, func(keyType byte, key, value []byte) error {
+		if keyType != psbtGlobalUnsignedTx {
+			return nil
+		}
+		if len(key) != 0 || tx != nil {
+			return errInvalidPSBT
+		}
+		tx = new(wire.MsgTx)
+		return tx.BtcDecode(bytes.NewReader(value), wire.ProtocolVersion, wire.BaseEncoding)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if tx == nil {
+		return nil, nil, errInvalidPSBT
+	}
+
+	utxos := make([]*wire.TxOut, len(tx.TxIn))
+	for i, in := range tx.TxIn {
+		if len(in.SignatureScript) > 0 || len(in.Witness) > 0 {
+			return nil, nil, errInvalidPSBT
+		}
+		err := readPSBTMap(r, func(keyType byte, key, value []byte) error {
+			if len(key) != 0 {
+				return nil
+			}
+			vr := bytes.NewReader(value)
+			switch keyType {
+			case psbtInNonWitnessUtxo:
+				var prev wire.MsgTx
+				if err := prev.BtcDecode(vr, wire.ProtocolVersion, wire.WitnessEncoding); err != nil {
+					return err
+				}
+				if prev.TxHash() != in.PreviousOutPoint.Hash || int(in.PreviousOutPoint.Index) >= len(prev.TxOut) {
+					return errInvalidPSBT
+				}
+				utxos[i] = prev.TxOut[in.PreviousOutPoint.Index]
+			case psbtInWitnessUtxo:
+				var amount [8]byte
+				if _, err := io.ReadFull(vr, amount[:]); err != nil {
+					return errInvalidPSBT
+				}
+				script, err := wire.ReadVarBytes(vr, 0, uint32(vr.Len()), "script")
+				if err != nil {
+					return errInvalidPSBT
+				}
+				utxos[i] = wire.NewTxOut(int64(binary.LittleEndian.Uint64(amount[:])), script)
+			case psbtInFinalScriptSig:
+				in.SignatureScript = value
+			case psbtInFinalScriptWitness:
+				count, err := wire.ReadVarInt(vr, 0)
+				if err != nil {
+					return err
+				}
+				if count > uint64(len(value)) {
+					return errInvalidPSBT
+				}
+				in.Witness = make(wire.TxWitness, count)
+				for j := range in.Witness {
+					in.Witness[j], err = wire.ReadVarBytes(vr, 0, uint32(len(value)), "witness")
+					if err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	for range tx.TxOut {
+		if err := readPSBTMap(r, func(byte, []byte, []byte) error { return nil }); err != nil {
+			return nil, nil, err
+		}
+	}
+	return tx, utxos, nil
+}
+
+// SignPSBT signs the inputs of the base64 PSBT which spend the wallet's
+// addresses and returns the PSBT with their final scripts along with the
+// number of inputs signed. Inputs which are already final or aren't the
+// wallet's are left as they are. The PSBT must include the output spent by
+// every input. Only the wallet's keys are used, not the chain, so it can be
+// run offline once the keychain is open.
+func (w *BitcoinWallet) SignPSBT(psbt string) (string, int, error) {
+	tx, utxos, err := decodePSBT(psbt)
+	if err != nil {
+		return "", 0, err
+	}
+	prevScripts := make(map[wire.OutPoint][]byte)
+	inVals := make(map[wire.OutPoint]int64)
+	for i, in := range tx.TxIn {
+		if utxos[i] == nil {
+			return "", 0, fmt.Errorf("PSBT is missing the output spent by input %d", i)
+		}
+		prevScripts[in.PreviousOutPoint] = utxos[i].PkScript
+		inVals[in.PreviousOutPoint] = utxos[i].Value
+	}
+
+	keys := make(map[int]*btcec.PrivateKey)
+	defer func() {
+		for _, key := range keys {
+			base.ZeroPrivKey(key)
+		}
+	}()
+	err = w.DB.View(func(dbtx database.Tx) error {
+		for i, in := range tx.TxIn {
+			if len(in.SignatureScript) > 0 || len(in.Witness) > 0 {
+				continue
+			}
+			addr, err := w.scriptAddress(utxos[i].PkScript)
+			if err != nil {
+				continue
+			}
+			hdKey, err := w.Keychain.KeyForAddress(dbtx, addr, nil)
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				continue
+			} else if err != nil {
+				return err
+			}
+			priv, err := hdKey.ECPrivKey()
+			base.ZeroKey(hdKey)
+			if err != nil {
+				return err
+			}
+			keys[i] = priv
+		}
+		return nil
+	})
+	if err != nil {
+		return "", 0, err
+	}
+
+	sigHashes := txscript.NewTxSigHashes(tx)
+	for i, key := range keys {
+		if err := signInput(tx, sigHashes, i, inVals, prevScripts, key, w.params()); err != nil {
+			return "", 0, err
+		}
+	}
+	signed, err := encodePSBT(tx, utxos)
+	if err != nil {
+		return "", 0, err
+	}
+	return signed, len(keys), nil
+}
+
+// FinalizePSBT returns the transaction of the base64 PSBT once every input
+// has its final scripts, ready to be broadcast.
+func (w *BitcoinWallet) FinalizePSBT(psbt string) (*wire.MsgTx, error) {
+	tx, _, err := decodePSBT(psbt)
+	if err != nil {
+		return nil, err
+	}
+	for i, in := range tx.TxIn {
+		if len(in.SignatureScript) == 0 && len(in.Witness) == 0 {
+			return nil, fmt.Errorf("input %d is not signed", i)
+		}
+	}
+	return tx, nil
+}
+
+// scriptAddress returns the address paid by a single key output script.
+func (w *BitcoinWallet) scriptAddress(script []byte) (iwallet.Address, error) {
+	if isPayToTaproot(script) {
+		addr, err := encodeTaprootAddress(script[2:], w.params())
+		if err != nil {
+			return iwallet.Address{}, err
+		}
+		return iwallet.NewAddress(addr, iwallet.CtBitcoin), nil
+	}
+	_, addrs, _, err := txscript.ExtractPkScriptAddrs(script, w.params())
+	if err != nil {
+		return iwallet.Address{}, err
+	}
+	if len(addrs) != 1 {
+		return iwallet.Address{}, errors.New("script does not pay a single address")
+	}
+	return iwallet.NewAddress(addrs[0].String(), iwallet.CtBitcoin), nil
+}
+
+// writePSBTPair writes a key-value pair whose key is only its type.
+func writePSBTPair(w io.Writer, keyType byte, value []byte) error {
+	if err := wire.WriteVarBytes(w, 0, []byte{keyType}); err != nil {
+		return err
+	}
+	return wire.WriteVarBytes(w, 0, value)
+}
+
+// readPSBTMap reads key-value pairs up to the map's separator and passes
+// each to fn with the key split into its type and data.
+func readPSBTMap(r *bytes.Reader, fn func(keyType byte, key, value []byte) error) error {
+	for {
+		key, err := wire.ReadVarBytes(r, 0, uint32(r.Len()), "key")
+		if err != nil {
+			return errInvalidPSBT
+		}
+		if len(key) == 0 {
+			return nil
+		}
+		value, err := wire.ReadVarBytes(r, 0, uint32(r.Len()), "value")
+		if err != nil {
+			return errInvalidPSBT
+		}
+		if err := fn(key[0], key[1:], value); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package bitcoin
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/txsort"
+	"github.com/btcsuite/btcwallet/wallet/txrules"
+	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/multiwallet/coins/utxobase"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"gorm.io/gorm"
+	"time"
+)
+
+var (
+	// ErrNotReplaceable is returned by BumpFee if the transaction does
+	// not signal BIP 125 replaceability.
+	ErrNotReplaceable = errors.New("transaction is not replaceable")
+
+	// ErrNoChangeOutput is returned by BumpFee if the transaction has no
+	// change output to pay the higher fee from.
+	ErrNoChangeOutput = errors.New("transaction has no change output")
+)
+
+// BumpFee replaces an unconfirmed transaction sent by this wallet with one
+// paying the fee for the new fee level. The additional fee is taken from the
+// change output, which is dropped if what remains would be dust. The new fee
+// is at least the old fee plus the minimum relay fee for the transaction's
+// size, as required by BIP 125.
+//
+// Only transactions sent with ReplaceByFee enabled can be bumped. When wtx
+// is committed the pending record for the original transaction is replaced
+// and the new transaction is broadcast.
+func (w *BitcoinWallet) BumpFee(wtx iwallet.Tx, txid iwallet.TransactionID, feeLevel iwallet.FeeLevel) (iwallet.TransactionID, error) {
+	if w.cosigner != nil {
+		return "", errors.New("fee bumping is not supported by cosigned wallets")
+	}
+	var tx wire.MsgTx
+	err := w.DB.View(func(dbtx database.Tx) error {
+		var unconfirmed database.UnconfirmedTransaction
+		err := dbtx.Read().Where("coin = ?", iwallet.CtBitcoin.CurrencyCode()).Where("txid = ?", txid.String()).First(&unconfirmed).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errors.New("transaction not found or already confirmed")
+		} else if err != nil {
+			return err
+		}
+		if err := tx.BtcDecode(bytes.NewReader(unconfirmed.TxBytes), wire.ProtocolVersion, wire.WitnessEncoding); err != nil {
+			return err
+		}
+		if !signalsReplacement(&tx) {
+			return ErrNotReplaceable
+		}
+
+		var (
+			keys        = make(map[wire.OutPoint]*btcec.PrivateKey)
+			prevScripts = make(map[wire.OutPoint][]byte)
+			inVals      = make(map[wire.OutPoint]int64)
+			scripts     [][]byte
+			totalIn     int64
+		)
+		defer func() {
+			for _, key := range keys {
+				base.ZeroPrivKey(key)
+			}
+		}()
+
+		prevOuts, err := w.spentOutputs(dbtx, txid)
+		if err != nil {
+			return err
+		}
+		for _, in := range tx.TxIn {
+			prev, ok := prevOuts[in.PreviousOutPoint]
+			if !ok {
+				return errors.New("input is not from this wallet")
+			}
+			script, err := w.Chain.AddressToScript(prev.Address.String())
+			if err != nil {
+				return err
+			}
+			hdKey, err := w.Keychain.KeyForAddress(dbtx, prev.Address, nil)
+			if err != nil {
+				return err
+			}
+			priv, err := hdKey.ECPrivKey()
+			base.ZeroKey(hdKey)
+			if err != nil {
+				return err
+			}
+			keys[in.PreviousOutPoint] = priv
+			prevScripts[in.PreviousOutPoint] = script
+			inVals[in.PreviousOutPoint] = prev.Amount.Int64()
+			scripts = append(scripts, script)
+			totalIn += prev.Amount.Int64()
+
+			in.SignatureScript = nil
+			in.Witness = nil
+		}
+
+		var totalOut int64
+		for _, out := range tx.TxOut {
+			totalOut += out.Value
+		}
+		oldFee := totalIn - totalOut
+
+		changeIdx, err := w.changeOutputIndex(dbtx, tx.TxOut)
+		if err != nil {
+			return err
+		}
+
+		fpb, err := w.FeeProvider.GetFee(feeLevel)
+		if err != nil {
+			return err
+		}
+		size := w.Chain.EstimateSize(scripts, tx.TxOut, false)
+		newFee := fpb.Mul(iwallet.NewAmount(size)).Int64()
+		minFee := oldFee + int64(txrules.FeeForSerializeSize(txrules.DefaultRelayFeePerKb, size))
+		if newFee < minFee {
+			newFee = minFee
+		}
+
+		change := tx.TxOut[changeIdx]
+		remaining := change.Value - (newFee - oldFee)
+		if remaining < 0 || txrules.IsDustAmount(btcutil.Amount(remaining), len(change.PkScript), txrules.DefaultRelayFeePerKb) {
+			// Dropping the change pays all of it to the fee. There
+			// must be another output left to send.
+			if len(tx.TxOut) == 1 || oldFee+change.Value < minFee {
+				return base.ErrInsufficientFunds
+			}
+			tx.TxOut = append(tx.TxOut[:changeIdx], tx.TxOut[changeIdx+1:]...)
+		} else {
+			change.Value = remaining
+		}
+
+		// BIP 69 sorting
+		txsort.InPlaceSort(&tx)
+
+		return w.Chain.SignTx(&tx, prevScripts, inVals, keys)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	newTxid := iwallet.TransactionID(tx.TxHash().String())
+	ser, err := w.Chain.Serialize(&tx)
+	if err != nil {
+		return newTxid, err
+	}
+
+	wbtx, ok := wtx.(*base.DBTx)
+	if !ok {
+		return newTxid, errors.New("tx is not expected type")
+	}
+
+	inputs := make([][]byte, 0, len(tx.TxIn))
+	for _, in := range tx.TxIn {
+		inputs = append(inputs, utxobase.SerializeOutpoint(&in.PreviousOutPoint))
+	}
+
+	wbtx.OnCommit = func() error {
+		err := w.DB.Update(func(dbtx database.Tx) error {
+			if err := dbtx.Delete("txid", txid.String(), &database.UnconfirmedTransaction{}); err != nil {
+				return err
+			}
+			// The original is kept as replaced so its relationship to
+			// the new transaction isn't lost.
+			var record database.TransactionRecord
+			err := dbtx.Read().Where("txid = ?", txid.String()).First(&record).Error
+			if err == nil && record.BlockHeight == 0 {
+				record.Status = database.TxStatusReplaced
+				record.ReplacedBy = newTxid.String()
+				if err := dbtx.Save(&record); err != nil {
+					return err
+				}
+			} else if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+				return err
+			}
+			err = dbtx.Save(&database.UnconfirmedTransaction{
+				Timestamp: time.Now(),
+				Coin:      iwallet.CtBitcoin,
+				TxBytes:   ser,
+				Txid:      newTxid.String(),
+				LockTime:  tx.LockTime,
+				Inputs:    base.JoinOutpoints(inputs),
+			})
+			if err != nil {
+				return err
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		w.BroadcastOrQueue(newTxid, ser)
+		return nil
+	}
+	return newTxid, nil
+}
+
+// spentOutputs returns the outputs spent by the transaction, indexed by
+// outpoint. If the transaction has already been seen by the chain client its
+// inputs are taken from the transaction record, otherwise the spent coins are
+// still in the utxo set.
+func (w *BitcoinWallet) spentOutputs(dbtx database.Tx, txid iwallet.TransactionID) (map[wire.OutPoint]iwallet.SpendInfo, error) {
+	prevOuts := make(map[wire.OutPoint]iwallet.SpendInfo)
+
+	var record database.TransactionRecord
+	err := dbtx.Read().Where("txid = ?", txid.String()).First(&record).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	} else if err == nil {
+		itx, err := record.Transaction()
+		if err != nil {
+			return nil, err
+		}
+		for _, from := range itx.From {
+			op, err := utxobase.DeserializeOutpoint(from.ID)
+			if err != nil {
+				return nil, err
+			}
+			prevOuts[*op] = from
+		}
+	}
+
+	var utxos []database.UtxoRecord
+	if err := dbtx.Read().Where("coin = ?", iwallet.CtBitcoin.CurrencyCode()).Find(&utxos).Error; err != nil {
+		return nil, err
+	}
+	for _, utxo := range utxos {
+		ser, err := hex.DecodeString(utxo.Outpoint)
+		if err != nil {
+			return nil, err
+		}
+		op, err := utxobase.DeserializeOutpoint(ser)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := prevOuts[*op]; ok {
+			continue
+		}
+		prevOuts[*op] = iwallet.SpendInfo{
+			ID:      ser,
+			Address: iwallet.NewAddress(utxo.Address, iwallet.CtBitcoin),
+			Amount:  iwallet.NewAmount(utxo.Amount),
+		}
+	}
+	return prevOuts, nil
+}
+
+// changeOutputIndex returns the index of the output paying to one of the
+// wallet's change addresses.
+func (w *BitcoinWallet) changeOutputIndex(dbtx database.Tx, outputs []*wire.TxOut) (int, error) {
+	var records []database.AddressRecord
+	err := dbtx.Read().Where("coin = ?", iwallet.CtBitcoin.CurrencyCode()).Where("change=?", true).Find(&records).Error
+	if err != nil {
+		return 0, err
+	}
+	for _, record := range records {
+		script, err := w.Chain.AddressToScript(record.Addr)
+		if err != nil {
+			continue
+		}
+		for i, out := range outputs {
+			if bytes.Equal(out.PkScript, script) {
+				return i, nil
+			}
+		}
+	}
+	return 0, ErrNoChangeOutput
+}
+
+// signalsReplacement returns whether any input of the transaction opts in
+// to BIP 125 replacement.
+func signalsReplacement(tx *wire.MsgTx) bool {
+	for _, in := range tx.TxIn {
+		if in.Sequence <= utxobase.MaxRBFSequence {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,185 @@
+package bitcoin
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/cpacia/multiwallet/coins/utxobase"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"github.com/jarcoal/httpmock"
+	"testing"
+	"time"
+)
+
+func fundTestWallet(t *testing.T, w *BitcoinWallet) []byte {
+	addr, err := w.Keychain.CurrentAddress(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fromAddr, err := btcutil.DecodeAddress(addr.String(), &chaincfg.TestNet3Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fromScript, err := txscript.PayToAddrScript(fromAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := chainhash.NewHashFromStr("bdb237bf8c5de6b60ba1e2dcfe364fc24f583e568d1682f851a9d0f11a45c78d")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = w.DB.Update(func(tx database.Tx) error {
+		return tx.Save(&database.UtxoRecord{
+			Timestamp: time.Now(),
+			Amount:    "1000000",
+			Height:    600000,
+			Coin:      iwallet.CtBitcoin,
+			Address:   addr.String(),
+			Outpoint:  hex.EncodeToString(serializeOutpoint(wire.NewOutPoint(h, 0))),
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fromScript
+}
+
+func loadUnconfirmed(t *testing.T, w *BitcoinWallet) []database.UnconfirmedTransaction {
+	var txs []database.UnconfirmedTransaction
+	err := w.DB.View(func(tx database.Tx) error {
+		return tx.Read().Where("coin=?", iwallet.CtBitcoin).Find(&txs).Error
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return txs
+}
+
+func TestBitcoinWallet_BumpFee(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	w, err := newTestWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.rbf = true
+	w.Chain = w.chain()
+
+	fromScript := fundTestWallet(t, w)
+
+	wtx, err := w.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	txid, err := w.Spend(wtx, iwallet.NewAddress("tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", iwallet.CtBitcoin), iwallet.NewAmount(500000), iwallet.FlEconomic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wtx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	txs := loadUnconfirmed(t, w)
+	if len(txs) != 1 {
+		t.Fatalf("Expected 1 tx found %d", len(txs))
+	}
+	var orig wire.MsgTx
+	if err := orig.BtcDecode(bytes.NewReader(txs[0].TxBytes), wire.ProtocolVersion, wire.WitnessEncoding); err != nil {
+		t.Fatal(err)
+	}
+	if !signalsReplacement(&orig) {
+		t.Fatal("Expected transaction to signal replacement")
+	}
+
+	wtx, err = w.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newTxid, err := w.BumpFee(wtx, txid, iwallet.FlPriority)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newTxid == txid {
+		t.Error("Expected a new txid")
+	}
+	if err := wtx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	txs = loadUnconfirmed(t, w)
+	if len(txs) != 1 {
+		t.Fatalf("Expected 1 tx found %d", len(txs))
+	}
+	if txs[0].Txid != newTxid.String() {
+		t.Errorf("Expected txid %s, got %s", newTxid, txs[0].Txid)
+	}
+
+	var replacement wire.MsgTx
+	if err := replacement.BtcDecode(bytes.NewReader(txs[0].TxBytes), wire.ProtocolVersion, wire.WitnessEncoding); err != nil {
+		t.Fatal(err)
+	}
+	if replacement.TxIn[0].Sequence != utxobase.MaxRBFSequence {
+		t.Errorf("Expected sequence %d, got %d", utxobase.MaxRBFSequence, replacement.TxIn[0].Sequence)
+	}
+
+	outVal := func(tx *wire.MsgTx) int64 {
+		var total int64
+		for _, out := range tx.TxOut {
+			total += out.Value
+		}
+		return total
+	}
+	if 1000000-outVal(&replacement) <= 1000000-outVal(&orig) {
+		t.Error("Expected replacement to pay a higher fee")
+	}
+
+	vm, err := txscript.NewEngine(fromScript, &replacement, 0, txscript.StandardVerifyFlags, nil, nil, 1000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Execute(); err != nil {
+		t.Errorf("Script verification failed: %s", err)
+	}
+}
+
+func TestBitcoinWallet_BumpFeeNotReplaceable(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	w, err := newTestWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fundTestWallet(t, w)
+
+	wtx, err := w.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	txid, err := w.Spend(wtx, iwallet.NewAddress("tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", iwallet.CtBitcoin), iwallet.NewAmount(500000), iwallet.FlEconomic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wtx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	wtx, err = w.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wtx.Rollback()
+	if _, err := w.BumpFee(wtx, txid, iwallet.FlPriority); err != ErrNotReplaceable {
+		t.Errorf("Expected ErrNotReplaceable, got %v", err)
+	}
+}
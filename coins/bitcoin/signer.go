@@ -0,0 +1,165 @@
+package bitcoin
+
+import (
+	"errors"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/cpacia/multiwallet/base"
+	iwallet "github.com/cpacia/wallet-interface"
+	"sync"
+)
+
+// keySigner signs the inputs of a watch-only wallet with a base.Signer. The
+// Signer is given the path of each key so the wallet's output scripts are
+// indexed by path as their addresses are derived.
+type keySigner struct {
+	signer base.Signer
+
+	// externalFP is the fingerprint of the wallet's external chain key.
+	// It tells signerAddress which chain a key was derived from.
+	externalFP uint32
+
+	mtx  sync.Mutex
+	keys map[string]signerKey
+}
+
+// signerKey is the path and public key of a wallet address.
+type signerKey struct {
+	path   base.KeyPath
+	pubKey *btcec.PublicKey
+}
+
+// setSigner makes the wallet sign with the Signer rather than its
+// keychain.
+func (w *BitcoinWallet) setSigner(signer base.Signer) error {
+	if w.addressType == base.AddressTypeTaproot {
+		return errors.New("taproot addresses can't be used with a signer")
+	}
+	w.signer = &keySigner{
+		signer: signer,
+		keys:   make(map[string]signerKey),
+	}
+	return nil
+}
+
+// signerAddress returns the address of the key and indexes its output
+// script for signing.
+func (w *BitcoinWallet) signerAddress(key *hdkeychain.ExtendedKey) (iwallet.Address, error) {
+	addr, err := w.singleKeyAddress(key)
+	if err != nil {
+		return iwallet.Address{}, err
+	}
+	index, err := childIndex(key)
+	if err != nil {
+		return iwallet.Address{}, err
+	}
+	pubKey, err := key.ECPubKey()
+	if err != nil {
+		return iwallet.Address{}, err
+	}
+	pkScript, err := w.addressToScript(addr.String())
+	if err != nil {
+		return iwallet.Address{}, err
+	}
+
+	w.signer.mtx.Lock()
+	w.signer.keys[string(pkScript)] = signerKey{
+		path: base.KeyPath{
+			Change: key.ParentFingerprint() != w.signer.externalFP,
+			Index:  index,
+		},
+		pubKey: pubKey,
+	}
+	w.signer.mtx.Unlock()
+
+	return addr, nil
+}
+
+// key returns the path and public key of the wallet address with the
+// given output script.
+func (s *keySigner) key(pkScript []byte) (signerKey, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	k, ok := s.keys[string(pkScript)]
+	return k, ok
+}
+
+// signInput signs the input at the given index with the Signer. Offline
+// wallets have no Signer so the input is left for the air-gapped wallet.
+func (s *keySigner) signInput(tx *wire.MsgTx, sigHashes *txscript.TxSigHashes, idx int, inVals map[wire.OutPoint]int64, prevScripts map[wire.OutPoint][]byte) error {
+	if s.signer == nil {
+		return nil
+	}
+	op := tx.TxIn[idx].PreviousOutPoint
+	prevOutScript := prevScripts[op]
+	k, ok := s.key(prevOutScript)
+	if !ok {
+		return errors.New("input is not from a wallet address")
+	}
+
+	pubKey := k.pubKey.SerializeCompressed()
+	hash, err := inputSigHash(tx, sigHashes, idx, prevOutScript, inVals[op], pubKey)
+	if err != nil {
+		return err
+	}
+	sig, err := s.signer.Sign(k.path, hash)
+	if err != nil {
+		return err
+	}
+	// The Signer may be remote so its signature is checked.
+	if !sig.Verify(hash, k.pubKey) {
+		return errors.New("signer returned an invalid signature")
+	}
+	return setInputSignature(tx, idx, prevOutScript, pubKey, append(sig.Serialize(), byte(txscript.SigHashAll)))
+}
+
+// inputSigHash returns the SigHashAll hash signed by the key for the input
+// at the given index. The previous output script must pay to the key with
+// P2WPKH, nested P2WPKH or P2PKH.
+func inputSigHash(tx *wire.MsgTx, sigHashes *txscript.TxSigHashes, idx int, prevOutScript []byte, amount int64, pubKey []byte) ([]byte, error) {
+	switch {
+	case txscript.IsPayToWitnessPubKeyHash(prevOutScript), txscript.IsPayToScriptHash(prevOutScript):
+		p2pkhScript, err := txscript.NewScriptBuilder().AddOp(txscript.OP_DUP).AddOp(txscript.OP_HASH160).
+			AddData(btcutil.Hash160(pubKey)).AddOp(txscript.OP_EQUALVERIFY).AddOp(txscript.OP_CHECKSIG).Script()
+		if err != nil {
+			return nil, err
+		}
+		return txscript.CalcWitnessSigHash(p2pkhScript, sigHashes, txscript.SigHashAll, tx, idx, amount)
+	case txscript.GetScriptClass(prevOutScript) == txscript.PubKeyHashTy:
+		return txscript.CalcSignatureHash(prevOutScript, txscript.SigHashAll, tx, idx)
+	default:
+		return nil, errors.New("input script can't be signed without the private key")
+	}
+}
+
+// setInputSignature sets the witness and signature script of the input at
+// the given index from the key's signature, which has the sighash type
+// appended.
+func setInputSignature(tx *wire.MsgTx, idx int, prevOutScript []byte, pubKey []byte, sig []byte) error {
+	switch {
+	case txscript.IsPayToWitnessPubKeyHash(prevOutScript):
+		tx.TxIn[idx].Witness = wire.TxWitness{sig, pubKey}
+	case txscript.IsPayToScriptHash(prevOutScript):
+		witnessProgram, err := txscript.NewScriptBuilder().AddOp(txscript.OP_0).AddData(btcutil.Hash160(pubKey)).Script()
+		if err != nil {
+			return err
+		}
+		sigScript, err := txscript.NewScriptBuilder().AddData(witnessProgram).Script()
+		if err != nil {
+			return err
+		}
+		tx.TxIn[idx].Witness = wire.TxWitness{sig, pubKey}
+		tx.TxIn[idx].SignatureScript = sigScript
+	default:
+		sigScript, err := txscript.NewScriptBuilder().AddData(sig).AddData(pubKey).Script()
+		if err != nil {
+			return err
+		}
+		tx.TxIn[idx].SignatureScript = sigScript
+	}
+	return nil
+}
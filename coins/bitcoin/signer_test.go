@@ -0,0 +1,97 @@
+package bitcoin
+
+import (
+	"bytes"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/multiwallet/mpc"
+	iwallet "github.com/cpacia/wallet-interface"
+	"github.com/jarcoal/httpmock"
+	"testing"
+	"time"
+)
+
+func TestBitcoinWallet_Signer(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	kg, req, err := mpc.NewClientKeyGen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	skg, resp, err := mpc.NewServerKeyGen(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec, err := kg.Decommit(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, err := skg.Challenge(dec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shareResp, err := kg.Respond(ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev, err := skg.Reveal(shareResp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, opening, err := kg.Finish(rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := skg.Finish(opening)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := mpc.NewSigner(client, mpc.NewLocalServer(server))
+
+	for _, addrType := range []base.AddressType{base.AddressTypeNativeSegwit, base.AddressTypeNestedSegwit, base.AddressTypeLegacy} {
+		w, err := newTestWalletWithSetup(addrType, func(w *BitcoinWallet) error {
+			if err := w.setSigner(signer); err != nil {
+				return err
+			}
+			return w.CreateWatchOnlyWallet(*client.AccountKey(&chaincfg.TestNet3Params), time.Now())
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.IsLocked() {
+			t.Error("Expected watch-only wallet to be unlocked")
+		}
+
+		fromScript := fundTestWallet(t, w)
+
+		wtx, err := w.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Spend(wtx, iwallet.NewAddress("tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", iwallet.CtBitcoin), iwallet.NewAmount(500000), iwallet.FlNormal); err != nil {
+			t.Fatal(err)
+		}
+		if err := wtx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		txs := loadUnconfirmed(t, w)
+		if len(txs) != 1 {
+			t.Fatalf("Expected 1 tx found %d", len(txs))
+		}
+		var tx wire.MsgTx
+		if err := tx.BtcDecode(bytes.NewReader(txs[0].TxBytes), wire.ProtocolVersion, wire.WitnessEncoding); err != nil {
+			t.Fatal(err)
+		}
+		vm, err := txscript.NewEngine(fromScript, &tx, 0, txscript.StandardVerifyFlags, nil, nil, 1000000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := vm.Execute(); err != nil {
+			t.Errorf("Script verification failed for address type %d: %s", addrType, err)
+		}
+	}
+}
@@ -0,0 +1,424 @@
+package bitcoin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/bech32"
+	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"math/big"
+)
+
+// This file implements receiving BIP352 silent payments. The wallet
+// publishes a static address made of a scan and a spend key. A sender
+// derives a fresh taproot output for each payment from the keys of the
+// inputs they spend so nothing links the payment to the address on chain.
+// To find them the wallet checks every transaction in each new block, and
+// the mempool if the backend streams it, using the scan key. Each output
+// found is added to the keychain like any other address.
+//
+// Labels aren't supported so only the unlabeled address is scanned for.
+
+// silentPaymentVersion is the version of the silent payment address format.
+const silentPaymentVersion = 0
+
+// silentPaymentMaxLen is the longest silent payment address decoded. BIP352
+// raises the bech32 limit of 90 characters to 1023 for future versions.
+const silentPaymentMaxLen = 1023
+
+// silentPaymentNUMS is the x coordinate of the BIP341 NUMS point. Taproot
+// inputs spent by script path with it as the internal key have no key
+// usable for silent payments.
+var silentPaymentNUMS, _ = hex.DecodeString("50929b74c1a04954b78b4b6035e97a5e078a5a0f28ec96d547bfee9ace803ac0")
+
+var errInvalidSilentPaymentAddress = errors.New("invalid silent payment address")
+
+// silentPaymentHRP returns the human readable part of silent payment
+// addresses on the network.
+func silentPaymentHRP(params *chaincfg.Params) string {
+	if params.Net == chaincfg.MainNetParams.Net {
+		return "sp"
+	}
+	return "tsp"
+}
+
+// encodeSilentPaymentAddress returns the silent payment address of the scan
+// and spend public keys.
+func encodeSilentPaymentAddress(scan, spend *btcec.PublicKey, params *chaincfg.Params) (string, error) {
+	payload := append(scan.SerializeCompressed(), spend.SerializeCompressed()...)
+	converted, err := bech32.ConvertBits(payload, 8, 5, true)
+	if err != nil {
+		return "", err
+	}
+	return bech32mEncode(silentPaymentHRP(params), append([]byte{silentPaymentVersion}, converted...)), nil
+}
+
+// decodeSilentPaymentAddress returns the scan and spend public keys of a
+// silent payment address.
+func decodeSilentPaymentAddress(addr string, params *chaincfg.Params) (scan, spend *btcec.PublicKey, err error) {
+	hrp, data, err := bech32mDecode(addr, silentPaymentMaxLen)
+	if err != nil || hrp != silentPaymentHRP(params) || len(data) < 1 || data[0] != silentPaymentVersion {
+		return nil, nil, errInvalidSilentPaymentAddress
+	}
+	payload, err := bech32.ConvertBits(data[1:], 5, 8, false)
+	if err != nil || len(payload) != 66 {
+		return nil, nil, errInvalidSilentPaymentAddress
+	}
+	scan, err = btcec.ParsePubKey(payload[:33], btcec.S256())
+	if err != nil {
+		return nil, nil, errInvalidSilentPaymentAddress
+	}
+	spend, err = btcec.ParsePubKey(payload[33:], btcec.S256())
+	if err != nil {
+		return nil, nil, errInvalidSilentPaymentAddress
+	}
+	return scan, spend, nil
+}
+
+// silentPaymentInputKey returns the public key an input contributes to a
+// silent payment, or nil if the input isn't eligible. Eligible inputs are
+// P2TR, P2WPKH, P2SH-P2WPKH and P2PKH spends with compressed keys.
+func silentPaymentInputKey(in *wire.TxIn, prevScript []byte) *btcec.PublicKey {
+	parseCompressed := func(b []byte) *btcec.PublicKey {
+		if len(b) != 33 {
+			return nil
+		}
+		key, err := btcec.ParsePubKey(b, btcec.S256())
+		if err != nil {
+			return nil
+		}
+		return key
+	}
+
+	switch {
+	case isPayToTaproot(prevScript):
+		witness := in.Witness
+		if len(witness) > 1 && len(witness[len(witness)-1]) > 0 && witness[len(witness)-1][0] == 0x50 {
+			// Drop the annex.
+			witness = witness[:len(witness)-1]
+		}
+		if len(witness) > 1 {
+			// A script path spend. The internal key is in the control
+			// block after the leaf version byte.
+			control := witness[len(witness)-1]
+			if len(control) >= 33 && bytes.Equal(control[1:33], silentPaymentNUMS) {
+				return nil
+			}
+		}
+		key, err := liftX(prevScript[2:])
+		if err != nil {
+			return nil
+		}
+		return key
+	case txscript.IsPayToWitnessPubKeyHash(prevScript):
+		if len(in.Witness) != 2 {
+			return nil
+		}
+		return parseCompressed(in.Witness[1])
+	case txscript.IsPayToScriptHash(prevScript):
+		pushes, err := txscript.PushedData(in.SignatureScript)
+		if err != nil || len(pushes) != 1 || !txscript.IsPayToWitnessPubKeyHash(pushes[0]) || len(in.Witness) != 2 {
+			return nil
+		}
+		return parseCompressed(in.Witness[1])
+	case txscript.IsPayToPubKeyHash(prevScript):
+		// The key is the last push hashing to the script's key hash.
+		pushes, err := txscript.PushedData(in.SignatureScript)
+		if err != nil {
+			return nil
+		}
+		for i := len(pushes) - 1; i >= 0; i-- {
+			if len(pushes[i]) == 33 && bytes.Equal(btcutil.Hash160(pushes[i]), prevScript[3:23]) {
+				return parseCompressed(pushes[i])
+			}
+		}
+	}
+	return nil
+}
+
+// isSegwitAbove1 returns whether the script is a witness program of a
+// version greater than one, which BIP352 reserves for future upgrades.
+func isSegwitAbove1(script []byte) bool {
+	if len(script) < 4 || len(script) > 42 || script[0] < txscript.OP_2 || script[0] > txscript.OP_16 {
+		return false
+	}
+	return int(script[1]) == len(script)-2
+}
+
+// silentPaymentMatch is an output of a transaction paying a silent payment
+// address.
+type silentPaymentMatch struct {
+	Index     uint32
+	OutputKey []byte
+	Tweak     []byte
+}
+
+// silentPaymentOutputs returns the outputs of the transaction paid to the
+// scan and spend keys. prevScripts holds the script spent by each input.
+func silentPaymentOutputs(tx *wire.MsgTx, prevScripts [][]byte, scan *btcec.PrivateKey, spend *btcec.PublicKey) ([]silentPaymentMatch, error) {
+	if len(prevScripts) != len(tx.TxIn) {
+		return nil, errors.New("missing previous output scripts")
+	}
+	taprootOutputs := make(map[string]uint32)
+	for i, out := range tx.TxOut {
+		if isPayToTaproot(out.PkScript) {
+			taprootOutputs[string(out.PkScript[2:])] = uint32(i)
+		}
+	}
+	if len(taprootOutputs) == 0 {
+		return nil, nil
+	}
+
+	curve := btcec.S256()
+	var (
+		sumX, sumY *big.Int
+		lowest     []byte
+	)
+	for i, in := range tx.TxIn {
+		if isSegwitAbove1(prevScripts[i]) {
+			return nil, nil
+		}
+		var op bytes.Buffer
+		op.Write(in.PreviousOutPoint.Hash[:])
+		binary.Write(&op, binary.LittleEndian, in.PreviousOutPoint.Index)
+		if lowest == nil || bytes.Compare(op.Bytes(), lowest) < 0 {
+			lowest = op.Bytes()
+		}
+
+		key := silentPaymentInputKey(in, prevScripts[i])
+		if key == nil {
+			continue
+		}
+		if sumX == nil {
+			sumX, sumY = key.X, key.Y
+		} else {
+			sumX, sumY = curve.Add(sumX, sumY, key.X, key.Y)
+		}
+	}
+	if sumX == nil || (sumX.Sign() == 0 && sumY.Sign() == 0) {
+		return nil, nil
+	}
+	inputSum := &btcec.PublicKey{Curve: curve, X: sumX, Y: sumY}
+
+	inputHash := new(big.Int).SetBytes(taggedHash("BIP0352/Inputs", lowest, inputSum.SerializeCompressed()))
+	if inputHash.Sign() == 0 || inputHash.Cmp(curve.N) >= 0 {
+		return nil, nil
+	}
+	scalar := new(big.Int).Mul(inputHash, scan.D)
+	scalar.Mod(scalar, curve.N)
+	defer scalar.SetInt64(0)
+	ex, ey := curve.ScalarMult(sumX, sumY, pad32(scalar))
+	sharedSecret := (&btcec.PublicKey{Curve: curve, X: ex, Y: ey}).SerializeCompressed()
+
+	var matches []silentPaymentMatch
+	for k := uint32(0); ; k++ {
+		var ser [4]byte
+		binary.BigEndian.PutUint32(ser[:], k)
+		tweak := taggedHash("BIP0352/SharedSecret", sharedSecret, ser[:])
+		t := new(big.Int).SetBytes(tweak)
+		if t.Sign() == 0 || t.Cmp(curve.N) >= 0 {
+			return matches, nil
+		}
+		tweakX, tweakY := curve.ScalarBaseMult(tweak)
+		px, py := curve.Add(spend.X, spend.Y, tweakX, tweakY)
+		outputKey := xOnly(&btcec.PublicKey{Curve: curve, X: px, Y: py})
+		idx, ok := taprootOutputs[string(outputKey)]
+		if !ok {
+			return matches, nil
+		}
+		matches = append(matches, silentPaymentMatch{
+			Index:     idx,
+			OutputKey: outputKey,
+			Tweak:     tweak,
+		})
+	}
+}
+
+// SilentPaymentAddress returns the wallet's BIP352 silent payment address.
+// It can be published and paid any number of times without the payments
+// being linked. An encrypted wallet must have been unlocked once for the
+// address to be known.
+func (w *BitcoinWallet) SilentPaymentAddress() (string, error) {
+	scan, spend, err := w.Keychain.SilentPaymentKeys()
+	if err != nil {
+		return "", err
+	}
+	defer base.ZeroPrivKey(scan)
+	return encodeSilentPaymentAddress(scan.PubKey(), spend, w.params())
+}
+
+// ProcessSilentPayment checks the transaction for outputs paid to the
+// wallet's silent payment address. Any found are added to the keychain and
+// watched and the wallet is rescanned from the transaction's height so
+// they're credited. The new addresses are returned.
+func (w *BitcoinWallet) ProcessSilentPayment(stx base.ScanTransaction) ([]iwallet.Address, error) {
+	scan, spend, err := w.Keychain.SilentPaymentKeys()
+	if err != nil {
+		return nil, err
+	}
+	matches, err := silentPaymentOutputs(stx.Tx, stx.PrevScripts, scan, spend)
+	base.ZeroPrivKey(scan)
+	if err != nil || len(matches) == 0 {
+		return nil, err
+	}
+
+	txid := iwallet.TransactionID(stx.Tx.TxHash().String())
+	var addrs []iwallet.Address
+	err = w.DB.Update(func(dbtx database.Tx) error {
+		for _, match := range matches {
+			encoded, err := encodeTaprootAddress(match.OutputKey, w.params())
+			if err != nil {
+				return err
+			}
+			addr := iwallet.NewAddress(encoded, iwallet.CtBitcoin)
+			added, err := w.Keychain.AddSilentPaymentOutput(dbtx, addr, match.Tweak, txid)
+			if err != nil {
+				return err
+			}
+			if added {
+				addrs = append(addrs, addr)
+			}
+		}
+		return nil
+	})
+	if err != nil || len(addrs) == 0 {
+		return nil, err
+	}
+
+	for _, addr := range addrs {
+		w.ChainManager.AddAddressSubscription(addr)
+	}
+	height := stx.Height
+	if height == 0 {
+		if info, err := w.BlockchainInfo(); err == nil {
+			height = info.Height
+		}
+	}
+	go w.ChainManager.ScanTransactions(height)
+	return addrs, nil
+}
+
+// RescanSilentPayments moves the silent payment scan back to fromHeight.
+// Scanning starts at the tip when the wallet is first opened so a restored
+// wallet must be rescanned from its birthday to find older payments.
+func (w *BitcoinWallet) RescanSilentPayments(fromHeight uint64) error {
+	if fromHeight == 0 {
+		// The genesis block can't be spent from.
+		fromHeight = 1
+	}
+	err := w.DB.Update(func(dbtx database.Tx) error {
+		return w.Keychain.SetSilentPaymentHeight(dbtx, fromHeight)
+	})
+	if err != nil {
+		return err
+	}
+	w.triggerSilentPaymentScan()
+	return nil
+}
+
+// triggerSilentPaymentScan wakes the block scanner without waiting for it.
+func (w *BitcoinWallet) triggerSilentPaymentScan() {
+	select {
+	case w.silentPaymentScan <- struct{}{}:
+	default:
+	}
+}
+
+// scanSilentPaymentBlocks scans the blocks from the next one to scan up to
+// the tip. If it's never scanned it starts after the tip.
+func (w *BitcoinWallet) scanSilentPaymentBlocks() error {
+	info, err := w.BlockchainInfo()
+	if err != nil {
+		return err
+	}
+	next, err := w.Keychain.SilentPaymentHeight()
+	if err != nil {
+		return err
+	}
+	if next == 0 {
+		return w.DB.Update(func(dbtx database.Tx) error {
+			return w.Keychain.SetSilentPaymentHeight(dbtx, info.Height+1)
+		})
+	}
+	for height := next; height <= info.Height; height++ {
+		txs, err := w.GetBlockScanTransactions(height)
+		if err != nil {
+			return err
+		}
+		for _, stx := range txs {
+			if _, err := w.ProcessSilentPayment(stx); err != nil {
+				return err
+			}
+		}
+		err = w.DB.Update(func(dbtx database.Tx) error {
+			return w.Keychain.SetSilentPaymentHeight(dbtx, height+1)
+		})
+		if err != nil {
+			return err
+		}
+		select {
+		case <-w.Done:
+			return nil
+		default:
+		}
+	}
+	return nil
+}
+
+// silentPaymentLoop scans each new block, and each mempool transaction if
+// the backend streams them, for silent payments until the wallet closes.
+// Blocks are scanned on a separate goroutine so the wallet's block
+// notifications are never held up.
+func (w *BitcoinWallet) silentPaymentLoop() {
+	go func() {
+		for {
+			select {
+			case <-w.silentPaymentScan:
+				if err := w.scanSilentPaymentBlocks(); errors.Is(err, base.ErrScanUnsupported) {
+					w.Logger.Warningf("[%s] Silent payments will not be found: %s", iwallet.CtBitcoin, err)
+					return
+				} else if err != nil {
+					w.Logger.Errorf("[%s] Error scanning for silent payments: %s", iwallet.CtBitcoin, err)
+				}
+			case <-w.Done:
+				return
+			}
+		}
+	}()
+	w.triggerSilentPaymentScan()
+
+	var mempool <-chan iwallet.Transaction
+	if sub, err := w.SubscribeMempool(); err == nil {
+		defer sub.Close()
+		mempool = sub.Out
+	}
+	blocks := w.SubscribeBlocks()
+	for {
+		select {
+		case <-blocks:
+			w.triggerSilentPaymentScan()
+		case txn, ok := <-mempool:
+			if !ok {
+				mempool = nil
+				continue
+			}
+			stx, err := w.GetScanTransaction(txn.ID)
+			if err != nil {
+				continue
+			}
+			if _, err := w.ProcessSilentPayment(stx); err != nil {
+				w.Logger.Errorf("[%s] Error checking %s for silent payments: %s", iwallet.CtBitcoin, txn.ID, err)
+			}
+		case <-w.Done:
+			return
+		}
+	}
+}
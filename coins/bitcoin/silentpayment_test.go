@@ -0,0 +1,186 @@
+package bitcoin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"math/big"
+	"testing"
+)
+
+func TestSilentPaymentAddress(t *testing.T) {
+	// Keys and address from the BIP352 test vectors.
+	scanBytes, _ := hex.DecodeString("0f694e068028a717f8af6b9411f9a133dd3565258714cc226594b34db90c1f2c")
+	spendBytes, _ := hex.DecodeString("9d6ad855ce3417ef84e836892e5a56392bfba05fa5d97ccea30e266f540e08b3")
+	scan, _ := btcec.PrivKeyFromBytes(btcec.S256(), scanBytes)
+	spend, _ := btcec.PrivKeyFromBytes(btcec.S256(), spendBytes)
+
+	expected := "sp1qqgste7k9hx0qftg6qmwlkqtwuy6cycyavzmzj85c6qdfhjdpdjtdgqjuexzk6murw56suy3e0rd2cgqvycxttddwsvgxe2usfpxumr70xc9pkqwv"
+	addr, err := encodeSilentPaymentAddress(scan.PubKey(), spend.PubKey(), &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != expected {
+		t.Errorf("Expected address %s, got %s", expected, addr)
+	}
+
+	scanPub, spendPub, err := decodeSilentPaymentAddress(expected, &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !scanPub.IsEqual(scan.PubKey()) || !spendPub.IsEqual(spend.PubKey()) {
+		t.Error("Decoded the wrong keys")
+	}
+	if _, _, err := decodeSilentPaymentAddress(expected, &chaincfg.TestNet3Params); err == nil {
+		t.Error("Expected a mainnet address to fail on testnet")
+	}
+	if _, err := decodeTaprootAddress(expected, &chaincfg.MainNetParams); err == nil {
+		t.Error("Expected a silent payment address not to decode as taproot")
+	}
+}
+
+// sendSilentPayment returns the taproot output keys a sender spending the
+// input keys to the address derives, computed from the sender's side.
+func sendSilentPayment(inputKeys []*btcec.PrivateKey, outpoints []wire.OutPoint, taproot []bool, scan, spend *btcec.PublicKey, count int) [][]byte {
+	curve := btcec.S256()
+	a := new(big.Int)
+	for i, key := range inputKeys {
+		d := new(big.Int).Set(key.D)
+		if taproot[i] && key.PubKey().Y.Bit(0) == 1 {
+			d.Sub(curve.N, d)
+		}
+		a.Add(a, d)
+	}
+	a.Mod(a, curve.N)
+
+	var lowest []byte
+	for _, op := range outpoints {
+		ser := append(append([]byte{}, op.Hash[:]...), 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(ser[32:], op.Index)
+		if lowest == nil || bytes.Compare(ser, lowest) < 0 {
+			lowest = ser
+		}
+	}
+	ax, ay := curve.ScalarBaseMult(pad32(a))
+	inputSum := &btcec.PublicKey{Curve: curve, X: ax, Y: ay}
+	inputHash := new(big.Int).SetBytes(taggedHash("BIP0352/Inputs", lowest, inputSum.SerializeCompressed()))
+
+	s := new(big.Int).Mul(inputHash, a)
+	s.Mod(s, curve.N)
+	sx, sy := curve.ScalarMult(scan.X, scan.Y, pad32(s))
+	shared := (&btcec.PublicKey{Curve: curve, X: sx, Y: sy}).SerializeCompressed()
+
+	var keys [][]byte
+	for k := 0; k < count; k++ {
+		ser := make([]byte, 4)
+		binary.BigEndian.PutUint32(ser, uint32(k))
+		tweakX, tweakY := curve.ScalarBaseMult(taggedHash("BIP0352/SharedSecret", shared, ser))
+		px, py := curve.Add(spend.X, spend.Y, tweakX, tweakY)
+		keys = append(keys, xOnly(&btcec.PublicKey{Curve: curve, X: px, Y: py}))
+	}
+	return keys
+}
+
+func TestSilentPaymentOutputs(t *testing.T) {
+	scan, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	spend, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	wpkhKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	trKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outpoints := []wire.OutPoint{
+		{Hash: chainhash.Hash{0x02}, Index: 1},
+		{Hash: chainhash.Hash{0x01}, Index: 7},
+	}
+	wpkhScript, err := txscript.NewScriptBuilder().AddOp(txscript.OP_0).AddData(btcutil.Hash160(wpkhKey.PubKey().SerializeCompressed())).Script()
+	if err != nil {
+		t.Fatal(err)
+	}
+	trScript, err := taprootScript(xOnly(trKey.PubKey()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevScripts := [][]byte{wpkhScript, trScript}
+
+	outputKeys := sendSilentPayment([]*btcec.PrivateKey{wpkhKey, trKey}, outpoints, []bool{false, true}, scan.PubKey(), spend.PubKey(), 2)
+	tx := wire.NewMsgTx(2)
+	tx.AddTxIn(wire.NewTxIn(&outpoints[0], nil, wire.TxWitness{make([]byte, 72), wpkhKey.PubKey().SerializeCompressed()}))
+	tx.AddTxIn(wire.NewTxIn(&outpoints[1], nil, wire.TxWitness{make([]byte, 64)}))
+	for i, key := range [][]byte{outputKeys[0], nil, outputKeys[1]} {
+		script := wpkhScript
+		if key != nil {
+			script, err = taprootScript(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		tx.AddTxOut(wire.NewTxOut(int64(1000*(i+1)), script))
+	}
+
+	matches, err := silentPaymentOutputs(tx, prevScripts, scan, spend.PubKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 2 {
+		t.Fatalf("Expected 2 matches, got %d", len(matches))
+	}
+	if matches[0].Index != 0 || matches[1].Index != 2 {
+		t.Errorf("Expected outputs 0 and 2, got %d and %d", matches[0].Index, matches[1].Index)
+	}
+
+	// Another scan key finds nothing.
+	other, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matches, err := silentPaymentOutputs(tx, prevScripts, other, spend.PubKey()); err != nil || len(matches) != 0 {
+		t.Errorf("Expected no matches for another scan key, got %d, %v", len(matches), err)
+	}
+
+	// Spending a future segwit version makes the transaction ineligible.
+	future := append([]byte{txscript.OP_2, 0x20}, make([]byte, 32)...)
+	if matches, err := silentPaymentOutputs(tx, [][]byte{wpkhScript, future}, scan, spend.PubKey()); err != nil || len(matches) != 0 {
+		t.Errorf("Expected no matches spending segwit v2, got %d, %v", len(matches), err)
+	}
+
+	// The output is spent with the spend key plus the tweak, untweaked
+	// by BIP86.
+	d := new(big.Int).SetBytes(matches[0].Tweak)
+	d.Add(d, spend.D)
+	d.Mod(d, btcec.S256().N)
+	outputPriv, _ := btcec.PrivKeyFromBytes(btcec.S256(), pad32(d))
+
+	spendTx := wire.NewMsgTx(2)
+	prevOut := wire.OutPoint{Hash: tx.TxHash(), Index: matches[0].Index}
+	spendTx.AddTxIn(wire.NewTxIn(&prevOut, nil, nil))
+	spendTx.AddTxOut(wire.NewTxOut(500, wpkhScript))
+	spendPrevScripts := map[wire.OutPoint][]byte{prevOut: tx.TxOut[0].PkScript}
+	inVals := map[wire.OutPoint]int64{prevOut: tx.TxOut[0].Value}
+	if err := signInput(spendTx, txscript.NewTxSigHashes(spendTx), 0, inVals, spendPrevScripts, outputPriv, &chaincfg.MainNetParams); err != nil {
+		t.Fatal(err)
+	}
+	sigHash, err := taprootSigHash(spendTx, 0, spendPrevScripts, inVals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !schnorrVerify(outputKeys[0], sigHash, spendTx.TxIn[0].Witness[0]) {
+		t.Error("Failed to verify the silent payment spend")
+	}
+}
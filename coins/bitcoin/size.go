@@ -0,0 +1,122 @@
+package bitcoin
+
+import (
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcwallet/wallet/txsizes"
+	"github.com/cpacia/multiwallet/base"
+)
+
+// The sizes of the inputs the wallet spends. Each input has a part which
+// is serialized in the transaction, counted in full, and a witness which
+// is discounted to a quarter of its size.
+const (
+	// p2trInputWitnessWeight is the witness of a taproot key path spend:
+	// the item count, length prefix and a 64 byte schnorr signature
+	// using the default sighash.
+	p2trInputWitnessWeight = 1 + 1 + 64
+
+	// cosignInputWitnessWeight is the witness of a 2-of-2 P2WSH spend:
+	// the item count, the empty item OP_CHECKMULTISIG consumes, two
+	// signatures and the witness script.
+	cosignInputWitnessWeight = 1 + 1 + 2*(1+73) + 1 + 71
+
+	// p2trPkScriptSize and p2wshPkScriptSize are the sizes of a taproot
+	// and P2WSH output script.
+	p2trPkScriptSize  = 1 + 1 + 32
+	p2wshPkScriptSize = 1 + 1 + 32
+)
+
+// inputSize returns the serialized size of an input spending script,
+// excluding its witness, and the weight of its witness. A nil script is an
+// input that hasn't been selected yet and is sized as one of the wallet's
+// own addresses.
+func (w *BitcoinWallet) inputSize(script []byte) (size, witnessWeight int) {
+	switch {
+	case script == nil:
+		return w.inputSize(w.sampleScript())
+	case txscript.IsPayToWitnessPubKeyHash(script):
+		return txsizes.RedeemP2WPKHInputSize, txsizes.RedeemP2WPKHInputWitnessWeight
+	case isPayToTaproot(script):
+		return txsizes.RedeemP2WPKHInputSize, p2trInputWitnessWeight
+	case txscript.IsPayToWitnessScriptHash(script):
+		return txsizes.RedeemP2WPKHInputSize, cosignInputWitnessWeight
+	case txscript.IsPayToScriptHash(script):
+		return txsizes.RedeemNestedP2WPKHInputSize, txsizes.RedeemP2WPKHInputWitnessWeight
+	default:
+		return txsizes.RedeemP2PKHInputSize, 0
+	}
+}
+
+// sampleScript returns an output script of the same type as the wallet's
+// addresses. Only its type matters.
+func (w *BitcoinWallet) sampleScript() []byte {
+	hash20, hash32 := make([]byte, 20), make([]byte, 32)
+	switch {
+	case w.cosigner != nil:
+		return append([]byte{txscript.OP_0, txscript.OP_DATA_32}, hash32...)
+	case w.addressType == base.AddressTypeTaproot:
+		return append([]byte{txscript.OP_1, txscript.OP_DATA_32}, hash32...)
+	case w.addressType == base.AddressTypeNestedSegwit:
+		script := append([]byte{txscript.OP_HASH160, txscript.OP_DATA_20}, hash20...)
+		return append(script, txscript.OP_EQUAL)
+	case w.addressType == base.AddressTypeLegacy:
+		script := append([]byte{txscript.OP_DUP, txscript.OP_HASH160, txscript.OP_DATA_20}, hash20...)
+		return append(script, txscript.OP_EQUALVERIFY, txscript.OP_CHECKSIG)
+	}
+	return append([]byte{txscript.OP_0, txscript.OP_DATA_20}, hash20...)
+}
+
+// changeScriptSize returns the size of the output script of the wallet's
+// change addresses.
+func (w *BitcoinWallet) changeScriptSize() int {
+	switch {
+	case w.cosigner != nil:
+		return p2wshPkScriptSize
+	case w.addressType == base.AddressTypeTaproot:
+		return p2trPkScriptSize
+	case w.addressType == base.AddressTypeNestedSegwit:
+		return txsizes.NestedP2WPKHPkScriptSize
+	case w.addressType == base.AddressTypeLegacy:
+		return txsizes.P2PKHPkScriptSize
+	}
+	return txsizes.P2WPKHPkScriptSize
+}
+
+// estimateSize returns the virtual size of a signed transaction spending
+// outputs with the given scripts. Each input is sized by the type of the
+// script it spends so a transaction mixing legacy, segwit and taproot
+// inputs isn't under or over estimated. It otherwise follows
+// txsizes.EstimateVirtualSize, with the change output sized for the
+// wallet's change addresses.
+func (w *BitcoinWallet) estimateSize(prevScripts [][]byte, outputs []*wire.TxOut, addChange bool) int {
+	changeSize := 0
+	if addChange {
+		changeScriptSize := w.changeScriptSize()
+		changeSize = 8 + wire.VarIntSerializeSize(uint64(changeScriptSize)) + changeScriptSize
+	}
+
+	var (
+		inputsSize     int
+		witnessWeight  int
+		witnessScripts int
+	)
+	for _, script := range prevScripts {
+		size, witness := w.inputSize(script)
+		inputsSize += size
+		if witness > 0 {
+			witnessWeight += witness
+			witnessScripts++
+		}
+	}
+
+	baseSize := 8 + wire.VarIntSerializeSize(uint64(len(prevScripts))) +
+		wire.VarIntSerializeSize(uint64(len(outputs))) +
+		inputsSize + txsizes.SumOutputSerializeSizes(outputs) + changeSize
+
+	if witnessScripts > 0 {
+		// The segwit marker and flag and the witness count.
+		witnessWeight += 2 + wire.VarIntSerializeSize(uint64(witnessScripts))
+	}
+	return baseSize + (witnessWeight+3)/4
+}
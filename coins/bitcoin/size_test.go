@@ -0,0 +1,99 @@
+package bitcoin
+
+import (
+	"encoding/hex"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcwallet/wallet/txsizes"
+	"github.com/cpacia/multiwallet/base"
+	"testing"
+)
+
+func TestBitcoinWallet_EstimateSize(t *testing.T) {
+	mustDecode := func(s string) []byte {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	var (
+		p2pkh  = mustDecode("76a914000000000000000000000000000000000000000088ac")
+		p2wpkh = mustDecode("00140000000000000000000000000000000000000000")
+		nested = mustDecode("a914000000000000000000000000000000000000000087")
+		p2tr   = mustDecode("51200000000000000000000000000000000000000000000000000000000000000000")
+		p2wsh  = mustDecode("00200000000000000000000000000000000000000000000000000000000000000000")
+	)
+	outputs := []*wire.TxOut{wire.NewTxOut(10000, p2wpkh)}
+
+	w := &BitcoinWallet{addressType: base.AddressTypeNativeSegwit}
+
+	// Single input types match txsizes.
+	for _, test := range []struct {
+		scripts                [][]byte
+		p2pkhs, p2wpkhs, nests int
+	}{
+		{[][]byte{p2pkh}, 1, 0, 0},
+		{[][]byte{p2wpkh, p2wpkh, p2wpkh}, 0, 3, 0},
+		{[][]byte{nested}, 0, 0, 1},
+		{[][]byte{p2pkh, p2wpkh, nested}, 1, 1, 1},
+	} {
+		for _, addChange := range []bool{false, true} {
+			expected := txsizes.EstimateVirtualSize(test.p2pkhs, test.p2wpkhs, test.nests, outputs, addChange)
+			if size := w.estimateSize(test.scripts, outputs, addChange); size != expected {
+				t.Errorf("%d p2pkh, %d p2wpkh, %d nested: expected %d, got %d", test.p2pkhs, test.p2wpkhs, test.nests, expected, size)
+			}
+		}
+	}
+
+	tests := []struct {
+		name     string
+		scripts  [][]byte
+		expected int
+	}{
+		{
+			// 82 bytes plus 69 weight units of witness.
+			name:     "taproot",
+			scripts:  [][]byte{p2tr},
+			expected: 100,
+		},
+		{
+			// 82 bytes plus 225 weight units of witness.
+			name:     "cosign",
+			scripts:  [][]byte{p2wsh},
+			expected: 139,
+		},
+		{
+			// 271 bytes plus 178 weight units of witness.
+			name:     "mixed",
+			scripts:  [][]byte{p2pkh, p2wpkh, p2tr},
+			expected: 316,
+		},
+	}
+	for _, test := range tests {
+		if size := w.estimateSize(test.scripts, outputs, false); size != test.expected {
+			t.Errorf("%s: expected %d, got %d", test.name, test.expected, size)
+		}
+	}
+
+	// Inputs that haven't been selected and the change output are sized
+	// for the wallet's address type.
+	for _, test := range []struct {
+		addrType base.AddressType
+		script   []byte
+	}{
+		{base.AddressTypeNativeSegwit, p2wpkh},
+		{base.AddressTypeNestedSegwit, nested},
+		{base.AddressTypeLegacy, p2pkh},
+		{base.AddressTypeTaproot, p2tr},
+	} {
+		w := &BitcoinWallet{addressType: test.addrType}
+		if w.estimateSize([][]byte{nil}, outputs, false) != w.estimateSize([][]byte{test.script}, outputs, false) {
+			t.Errorf("Address type %d: unselected input sized as the wrong type", test.addrType)
+		}
+		change := wire.NewTxOut(0, test.script)
+		withChange := []*wire.TxOut{outputs[0], change}
+		if w.estimateSize([][]byte{nil}, outputs, true) != w.estimateSize([][]byte{nil}, withChange, false) {
+			t.Errorf("Address type %d: change output sized as the wrong type", test.addrType)
+		}
+	}
+}
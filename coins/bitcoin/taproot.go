@@ -0,0 +1,371 @@
+package bitcoin
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil/bech32"
+	"math/big"
+	"strings"
+)
+
+// This file contains the pieces of BIP340 (schnorr signatures), BIP341
+// (taproot) and BIP350 (bech32m) needed to receive to and spend from
+// single key P2TR outputs. The version of btcd we depend on predates
+// taproot so these are implemented here rather than in the library.
+//
+// Only key path spends are supported. Following BIP86 the internal key is
+// tweaked with an empty script tree.
+
+const (
+	// bech32mConst is the checksum constant for bech32m (BIP350).
+	bech32mConst = 0x2bc830a3
+
+	bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+	// taprootWitnessVersion is the segwit version used by P2TR outputs.
+	taprootWitnessVersion = 1
+)
+
+var errInvalidTaprootAddress = errors.New("invalid taproot address")
+
+// taggedHash implements the BIP340 tagged hash function.
+func taggedHash(tag string, msgs ...[]byte) []byte {
+	tagHash := sha256.Sum256([]byte(tag))
+	h := sha256.New()
+	h.Write(tagHash[:])
+	h.Write(tagHash[:])
+	for _, msg := range msgs {
+		h.Write(msg)
+	}
+	return h.Sum(nil)
+}
+
+// pad32 returns the big endian encoding of n left padded to 32 bytes.
+func pad32(n *big.Int) []byte {
+	b := n.Bytes()
+	if len(b) >= 32 {
+		return b[len(b)-32:]
+	}
+	out := make([]byte, 32)
+	copy(out[32-len(b):], b)
+	return out
+}
+
+// liftX returns the point with the given x coordinate and an even y.
+func liftX(x []byte) (*btcec.PublicKey, error) {
+	if len(x) != 32 {
+		return nil, errors.New("x-only key must be 32 bytes")
+	}
+	return btcec.ParsePubKey(append([]byte{0x02}, x...), btcec.S256())
+}
+
+// xOnly returns the 32 byte x-only serialization of the public key.
+func xOnly(pub *btcec.PublicKey) []byte {
+	return pad32(pub.X)
+}
+
+// taprootTweak returns the BIP86 tweak for the internal key.
+func taprootTweak(internalKey *btcec.PublicKey) (*big.Int, error) {
+	return taprootTweakWithRoot(xOnly(internalKey), nil)
+}
+
+// taprootTweakWithRoot returns the BIP341 tweak for the x-only internal key
+// committing to the script tree with the given merkle root.
+func taprootTweakWithRoot(internalKey, merkleRoot []byte) (*big.Int, error) {
+	t := new(big.Int).SetBytes(taggedHash("TapTweak", internalKey, merkleRoot))
+	if t.Cmp(btcec.S256().N) >= 0 {
+		return nil, errors.New("taproot tweak out of range")
+	}
+	return t, nil
+}
+
+// taprootOutputKey computes the output key for a key path only taproot
+// output with the given internal key.
+func taprootOutputKey(internalKey *btcec.PublicKey) (*btcec.PublicKey, error) {
+	t, err := taprootTweak(internalKey)
+	if err != nil {
+		return nil, err
+	}
+	p, err := liftX(xOnly(internalKey))
+	if err != nil {
+		return nil, err
+	}
+	curve := btcec.S256()
+	tx, ty := curve.ScalarBaseMult(pad32(t))
+	qx, qy := curve.Add(p.X, p.Y, tx, ty)
+	if qx.Sign() == 0 && qy.Sign() == 0 {
+		return nil, errors.New("taproot output key is infinity")
+	}
+	return &btcec.PublicKey{Curve: curve, X: qx, Y: qy}, nil
+}
+
+// taprootTweakPrivKey returns the private key for the output key
+// derived from the given internal private key.
+func taprootTweakPrivKey(priv *btcec.PrivateKey) (*btcec.PrivateKey, error) {
+	curve := btcec.S256()
+	t, err := taprootTweak(priv.PubKey())
+	if err != nil {
+		return nil, err
+	}
+	d := new(big.Int).Set(priv.D)
+	if priv.PubKey().Y.Bit(0) == 1 {
+		d.Sub(curve.N, d)
+	}
+	d.Add(d, t)
+	d.Mod(d, curve.N)
+	if d.Sign() == 0 {
+		return nil, errors.New("tweaked private key is zero")
+	}
+	tweaked, _ := btcec.PrivKeyFromBytes(curve, pad32(d))
+	d.SetInt64(0)
+	return tweaked, nil
+}
+
+// taprootScript returns the P2TR output script for the output key.
+func taprootScript(outputKey []byte) ([]byte, error) {
+	return txscript.NewScriptBuilder().AddOp(txscript.OP_1).AddData(outputKey).Script()
+}
+
+// isPayToTaproot returns whether the script is a segwit v1 output with a
+// 32 byte program.
+func isPayToTaproot(script []byte) bool {
+	return len(script) == 34 && script[0] == txscript.OP_1 && script[1] == txscript.OP_DATA_32
+}
+
+// schnorrSign creates a BIP340 signature over the 32 byte message.
+func schnorrSign(priv *btcec.PrivateKey, msg []byte) ([]byte, error) {
+	aux := make([]byte, 32)
+	if _, err := rand.Read(aux); err != nil {
+		return nil, err
+	}
+	return schnorrSignWithAux(priv, msg, aux)
+}
+
+func schnorrSignWithAux(priv *btcec.PrivateKey, msg, aux []byte) ([]byte, error) {
+	if len(msg) != 32 {
+		return nil, errors.New("message must be 32 bytes")
+	}
+	curve := btcec.S256()
+
+	pub := priv.PubKey()
+	d := new(big.Int).Set(priv.D)
+	if pub.Y.Bit(0) == 1 {
+		d.Sub(curve.N, d)
+	}
+	defer d.SetInt64(0)
+
+	t := new(big.Int).Xor(d, new(big.Int).SetBytes(taggedHash("BIP0340/aux", aux)))
+	k := new(big.Int).SetBytes(taggedHash("BIP0340/nonce", pad32(t), xOnly(pub), msg))
+	k.Mod(k, curve.N)
+	if k.Sign() == 0 {
+		return nil, errors.New("schnorr nonce is zero")
+	}
+	defer k.SetInt64(0)
+
+	rx, ry := curve.ScalarBaseMult(pad32(k))
+	if ry.Bit(0) == 1 {
+		k.Sub(curve.N, k)
+	}
+
+	e := new(big.Int).SetBytes(taggedHash("BIP0340/challenge", pad32(rx), xOnly(pub), msg))
+	e.Mod(e, curve.N)
+
+	s := new(big.Int).Mul(e, d)
+	s.Add(s, k)
+	s.Mod(s, curve.N)
+
+	return append(pad32(rx), pad32(s)...), nil
+}
+
+// schnorrVerify verifies a BIP340 signature against an x-only public key.
+func schnorrVerify(pubKey, msg, sig []byte) bool {
+	if len(sig) != 64 || len(msg) != 32 {
+		return false
+	}
+	curve := btcec.S256()
+	p, err := liftX(pubKey)
+	if err != nil {
+		return false
+	}
+	r := new(big.Int).SetBytes(sig[:32])
+	s := new(big.Int).SetBytes(sig[32:])
+	if r.Cmp(curve.P) >= 0 || s.Cmp(curve.N) >= 0 {
+		return false
+	}
+	e := new(big.Int).SetBytes(taggedHash("BIP0340/challenge", sig[:32], pubKey, msg))
+	e.Mod(e, curve.N)
+
+	// R = s*G - e*P
+	sx, sy := curve.ScalarBaseMult(pad32(s))
+	ex, ey := curve.ScalarMult(p.X, p.Y, pad32(e))
+	ey.Sub(curve.P, ey)
+	rx, ry := curve.Add(sx, sy, ex, ey)
+	if rx.Sign() == 0 && ry.Sign() == 0 {
+		return false
+	}
+	return ry.Bit(0) == 0 && rx.Cmp(r) == 0
+}
+
+// taprootSigHash computes the BIP341 signature hash for a key path spend of
+// the input at idx using SIGHASH_DEFAULT. Unlike segwit v0 the hash commits
+// to the amounts and scripts of all inputs so they must all be provided.
+func taprootSigHash(tx *wire.MsgTx, idx int, prevScripts map[wire.OutPoint][]byte, inVals map[wire.OutPoint]int64) ([]byte, error) {
+	return taprootScriptSigHash(tx, idx, prevScripts, inVals, nil)
+}
+
+// taprootScriptSigHash is taprootSigHash for a script path spend of the
+// leaf with the given hash. A nil leaf hash is a key path spend.
+func taprootScriptSigHash(tx *wire.MsgTx, idx int, prevScripts map[wire.OutPoint][]byte, inVals map[wire.OutPoint]int64, leafHash []byte) ([]byte, error) {
+	var prevouts, amounts, scripts, sequences, outputs bytes.Buffer
+	for _, in := range tx.TxIn {
+		script, ok := prevScripts[in.PreviousOutPoint]
+		if !ok {
+			return nil, fmt.Errorf("missing previous output script for %s", in.PreviousOutPoint)
+		}
+		amount, ok := inVals[in.PreviousOutPoint]
+		if !ok {
+			return nil, fmt.Errorf("missing previous output value for %s", in.PreviousOutPoint)
+		}
+		prevouts.Write(in.PreviousOutPoint.Hash[:])
+		binary.Write(&prevouts, binary.LittleEndian, in.PreviousOutPoint.Index)
+		binary.Write(&amounts, binary.LittleEndian, amount)
+		wire.WriteVarBytes(&scripts, 0, script)
+		binary.Write(&sequences, binary.LittleEndian, in.Sequence)
+	}
+	for _, out := range tx.TxOut {
+		binary.Write(&outputs, binary.LittleEndian, out.Value)
+		wire.WriteVarBytes(&outputs, 0, out.PkScript)
+	}
+
+	var msg bytes.Buffer
+	msg.WriteByte(0x00) // Epoch
+	msg.WriteByte(0x00) // SIGHASH_DEFAULT
+	binary.Write(&msg, binary.LittleEndian, tx.Version)
+	binary.Write(&msg, binary.LittleEndian, tx.LockTime)
+	for _, b := range []*bytes.Buffer{&prevouts, &amounts, &scripts, &sequences, &outputs} {
+		h := sha256.Sum256(b.Bytes())
+		msg.Write(h[:])
+	}
+	if leafHash == nil {
+		msg.WriteByte(0x00) // Key path spend with no annex
+	} else {
+		msg.WriteByte(0x02) // Script path spend with no annex
+	}
+	binary.Write(&msg, binary.LittleEndian, uint32(idx))
+	if leafHash != nil {
+		// BIP342 extension: the leaf, key version 0 and no
+		// OP_CODESEPARATOR executed.
+		msg.Write(leafHash)
+		msg.WriteByte(0x00)
+		binary.Write(&msg, binary.LittleEndian, uint32(0xffffffff))
+	}
+
+	return taggedHash("TapSighash", msg.Bytes()), nil
+}
+
+// encodeTaprootAddress returns the bech32m encoding of the output key.
+func encodeTaprootAddress(outputKey []byte, params *chaincfg.Params) (string, error) {
+	if len(outputKey) != 32 {
+		return "", errors.New("output key must be 32 bytes")
+	}
+	converted, err := bech32.ConvertBits(outputKey, 8, 5, true)
+	if err != nil {
+		return "", err
+	}
+	return bech32mEncode(params.Bech32HRPSegwit, append([]byte{taprootWitnessVersion}, converted...)), nil
+}
+
+// decodeTaprootAddress returns the output key encoded in the address.
+func decodeTaprootAddress(addr string, params *chaincfg.Params) ([]byte, error) {
+	hrp, data, err := bech32mDecode(addr, 90)
+	if err != nil || hrp != params.Bech32HRPSegwit {
+		return nil, errInvalidTaprootAddress
+	}
+	if len(data) < 1 || data[0] != taprootWitnessVersion {
+		return nil, errInvalidTaprootAddress
+	}
+	program, err := bech32.ConvertBits(data[1:], 5, 8, false)
+	if err != nil || len(program) != 32 {
+		return nil, errInvalidTaprootAddress
+	}
+	return program, nil
+}
+
+// bech32mEncode returns the bech32m string of the 5 bit data values.
+func bech32mEncode(hrp string, data []byte) string {
+	values := append(bech32HrpExpand(hrp), data...)
+	values = append(values, 0, 0, 0, 0, 0, 0)
+	mod := bech32Polymod(values) ^ bech32mConst
+
+	var sb strings.Builder
+	sb.WriteString(hrp)
+	sb.WriteByte('1')
+	for _, b := range data {
+		sb.WriteByte(bech32Charset[b])
+	}
+	for i := 0; i < 6; i++ {
+		sb.WriteByte(bech32Charset[(mod>>uint(5*(5-i)))&31])
+	}
+	return sb.String()
+}
+
+// bech32mDecode returns the human readable part and 5 bit data values of a
+// bech32m string of up to maxLen characters, without the checksum.
+func bech32mDecode(s string, maxLen int) (string, []byte, error) {
+	if strings.ToLower(s) != s && strings.ToUpper(s) != s {
+		return "", nil, errors.New("mixed case bech32m string")
+	}
+	s = strings.ToLower(s)
+	pos := strings.LastIndexByte(s, '1')
+	if pos < 1 || pos+7 > len(s) || len(s) > maxLen {
+		return "", nil, errors.New("invalid bech32m length")
+	}
+	hrp := s[:pos]
+	data := make([]byte, 0, len(s)-pos-1)
+	for _, c := range s[pos+1:] {
+		i := strings.IndexRune(bech32Charset, c)
+		if i < 0 {
+			return "", nil, errors.New("invalid bech32m character")
+		}
+		data = append(data, byte(i))
+	}
+	if bech32Polymod(append(bech32HrpExpand(hrp), data...)) != bech32mConst {
+		return "", nil, errors.New("invalid bech32m checksum")
+	}
+	return hrp, data[:len(data)-6], nil
+}
+
+func bech32HrpExpand(hrp string) []byte {
+	out := make([]byte, 0, len(hrp)*2+1)
+	for i := 0; i < len(hrp); i++ {
+		out = append(out, hrp[i]>>5)
+	}
+	out = append(out, 0)
+	for i := 0; i < len(hrp); i++ {
+		out = append(out, hrp[i]&31)
+	}
+	return out
+}
+
+func bech32Polymod(values []byte) uint32 {
+	gen := []uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		b := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (b>>uint(i))&1 == 1 {
+				chk ^= gen[i]
+			}
+		}
+	}
+	return chk
+}
@@ -0,0 +1,155 @@
+package bitcoin
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"github.com/jarcoal/httpmock"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSchnorrSign(t *testing.T) {
+	// Test vector 0 from BIP340.
+	priv, _ := btcec.PrivKeyFromBytes(btcec.S256(), append(make([]byte, 31), 0x03))
+	sig, err := schnorrSignWithAux(priv, make([]byte, 32), make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "e907831f80848d1069a5371b402410364bdf1c5f8307b0084c55f1ce2dca821525f66a4a85ea8b71e482a74f382d2ce5ebeee8fdb2172f477df4900d310536c0"
+	if hex.EncodeToString(sig) != expected {
+		t.Errorf("Expected signature %s, got %s", expected, hex.EncodeToString(sig))
+	}
+
+	pubkey, err := hex.DecodeString("f9308a019258c31049344f85f89d5229b531c845836f99b08601f113bce036f9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !schnorrVerify(pubkey, make([]byte, 32), sig) {
+		t.Error("Failed to verify signature")
+	}
+	sig[63] ^= 0x01
+	if schnorrVerify(pubkey, make([]byte, 32), sig) {
+		t.Error("Verified invalid signature")
+	}
+}
+
+func TestTaprootAddress(t *testing.T) {
+	// Test vector from BIP86 for m/86'/0'/0'/0/0.
+	internalKey, err := hex.DecodeString("cc8a4bc64d897bddc5fbc2f670f7a8ba0b386779106cf1223c6fc5d7cd6fc115")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, err := liftX(internalKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputKey, err := taprootOutputKey(pubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(xOnly(outputKey)) != "a60869f0dbcf1dc659c9cecbaf8050135ea9e8cdc487053f1dc6880949dc684c" {
+		t.Errorf("Incorrect output key %s", hex.EncodeToString(xOnly(outputKey)))
+	}
+
+	addr, err := encodeTaprootAddress(xOnly(outputKey), &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "bc1p5cyxnuxmeuwuvkwfem96lqzszd02n6xdcjrs20cac6yqjjwudpxqkedrcr"
+	if addr != expected {
+		t.Errorf("Expected address %s, got %s", expected, addr)
+	}
+
+	program, err := decodeTaprootAddress(expected, &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(program, xOnly(outputKey)) {
+		t.Error("Decoded incorrect program")
+	}
+
+	if _, err := decodeTaprootAddress(expected, &chaincfg.TestNet3Params); err == nil {
+		t.Error("Decoded address for wrong network")
+	}
+	// Segwit v0 addresses use the bech32 checksum and must be rejected.
+	if _, err := decodeTaprootAddress("bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4", &chaincfg.MainNetParams); err == nil {
+		t.Error("Decoded bech32 address as taproot")
+	}
+}
+
+func TestBitcoinWallet_TaprootSpend(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	w, err := newTestWalletWithAddressType(base.AddressTypeTaproot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr, err := w.Keychain.CurrentAddress(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(addr.String(), "tb1p") {
+		t.Fatalf("Expected taproot address got %s", addr)
+	}
+
+	fromScript, err := w.addressToScript(addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, 32)
+	rand.Read(b)
+
+	h, err := chainhash.NewHash(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	op := wire.NewOutPoint(h, 0)
+
+	err = w.DB.Update(func(tx database.Tx) error {
+		return tx.Save(&database.UtxoRecord{
+			Timestamp: time.Now(),
+			Amount:    "1000000",
+			Height:    600000,
+			Coin:      iwallet.CtBitcoin,
+			Address:   addr.String(),
+			Outpoint:  hex.EncodeToString(serializeOutpoint(op)),
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tx *wire.MsgTx
+	err = w.DB.View(func(dbtx database.Tx) error {
+		tx, err = w.BuildTx(dbtx, 500000, addr, iwallet.FlNormal)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tx.TxIn[0].Witness) != 1 || len(tx.TxIn[0].Witness[0]) != 64 {
+		t.Fatal("Expected single 64 byte schnorr signature in witness")
+	}
+
+	sigHash, err := taprootSigHash(tx, 0, map[wire.OutPoint][]byte{*op: fromScript}, map[wire.OutPoint]int64{*op: 1000000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !schnorrVerify(fromScript[2:], sigHash, tx.TxIn[0].Witness[0]) {
+		t.Error("Failed to verify taproot signature")
+	}
+}
@@ -0,0 +1,391 @@
+package bitcoin
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/multiwallet/coins/utxobase"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"gorm.io/gorm"
+	"time"
+)
+
+var (
+	// ErrVaultLocked is returned by ReleaseVault if the vault transaction
+	// doesn't have the vault delay's confirmations yet.
+	ErrVaultLocked = errors.New("vault delay has not passed")
+
+	// ErrVaultClosed is returned when releasing or cancelling a vault
+	// which has already been released or cancelled.
+	ErrVaultClosed = errors.New("vault already released or cancelled")
+)
+
+// maxVaultDelay is the largest relative lock time in blocks CSV supports.
+const maxVaultDelay = 0xffff
+
+// Spend sends amt to the address. In vault mode spends of more than the
+// vault threshold are paid into a vault instead and must be released with
+// ReleaseVault once the delay has passed. The returned ID is then that of
+// the transaction paying the vault.
+func (w *BitcoinWallet) Spend(wtx iwallet.Tx, to iwallet.Address, amt iwallet.Amount, feeLevel iwallet.FeeLevel) (iwallet.TransactionID, error) {
+	return w.SpendContext(context.Background(), wtx, to, amt, feeLevel)
+}
+
+// SpendContext is like Spend but stops building the transaction when ctx is
+// done. Begin wtx with BeginContext for the commit to be bound to ctx too.
+func (w *BitcoinWallet) SpendContext(ctx context.Context, wtx iwallet.Tx, to iwallet.Address, amt iwallet.Amount, feeLevel iwallet.FeeLevel) (iwallet.TransactionID, error) {
+	if !w.vault.Enabled() || amt.Cmp(w.vault.Threshold) <= 0 {
+		return w.Wallet.SpendContext(ctx, wtx, to, amt, feeLevel)
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return w.spendToVault(wtx, to, amt, feeLevel)
+}
+
+// spendToVault pays amt plus the fee to release it into a new vault. The
+// vault is recorded and its address watched when wtx is committed.
+func (w *BitcoinWallet) spendToVault(wtx iwallet.Tx, to iwallet.Address, amt iwallet.Amount, feeLevel iwallet.FeeLevel) (iwallet.TransactionID, error) {
+	if err := w.CheckDestinations(to); err != nil {
+		return "", err
+	}
+	destScript, err := w.addressToScript(to.String())
+	if err != nil {
+		return "", err
+	}
+
+	hotAddr, err := w.Keychain.NewAddress(false)
+	if err != nil {
+		return "", err
+	}
+	var hotKey *btcec.PublicKey
+	err = w.DB.View(func(dbtx database.Tx) error {
+		hdKey, err := w.Keychain.KeyForAddress(dbtx, hotAddr, nil)
+		if err != nil {
+			return err
+		}
+		defer base.ZeroKey(hdKey)
+		hotKey, err = hdKey.ECPubKey()
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	script, err := vaultScript(w.vault.CancelKey, hotKey, w.vault.Delay)
+	if err != nil {
+		return "", err
+	}
+	vaultAddr, vaultPkScript, err := w.vaultAddress(script)
+	if err != nil {
+		return "", err
+	}
+
+	fpb, err := w.FeeProvider.GetFee(feeLevel)
+	if err != nil {
+		return "", err
+	}
+	fee := fpb.Mul(iwallet.NewAmount(vaultSpendSize(script, destScript, false)))
+	vaultAmt := amt.Add(fee)
+
+	if err := w.WatchAddress(wtx, vaultAddr); err != nil {
+		return "", err
+	}
+	dbtx := wtx.(*base.DBTx)
+	watch := dbtx.OnCommit
+
+	txid, err := w.Wallet.SpendMulti(wtx, []utxobase.Output{{Address: vaultAddr, Amount: vaultAmt}}, feeLevel)
+	if err != nil {
+		return "", err
+	}
+	broadcast := dbtx.OnCommit
+
+	dbtx.OnCommit = func() error {
+		if err := broadcast(); err != nil {
+			return err
+		}
+		err := w.DB.Update(func(tx database.Tx) error {
+			var unconfirmed database.UnconfirmedTransaction
+			err := tx.Read().Where("coin=?", iwallet.CtBitcoin.CurrencyCode()).Where("txid=?", txid.String()).First(&unconfirmed).Error
+			if err != nil {
+				return err
+			}
+			var msgTx wire.MsgTx
+			if err := msgTx.BtcDecode(bytes.NewReader(unconfirmed.TxBytes), wire.ProtocolVersion, wire.WitnessEncoding); err != nil {
+				return err
+			}
+			idx := -1
+			for i, out := range msgTx.TxOut {
+				if bytes.Equal(out.PkScript, vaultPkScript) {
+					idx = i
+					break
+				}
+			}
+			if idx < 0 {
+				return errors.New("vault output not found")
+			}
+			return tx.Save(&database.VaultRecord{
+				Txid:        txid.String(),
+				Coin:        iwallet.CtBitcoin.CurrencyCode(),
+				Status:      string(base.VaultPending),
+				CreatedAt:   time.Now(),
+				Outpoint:    serializeOutpoint(wire.NewOutPoint(&msgTx.TxHash, uint32(idx))),
+				Amount:      vaultAmt.String(),
+				Script:      script,
+				HotAddr:     hotAddr.String(),
+				Destination: to.String(),
+				DestAmount:  amt.String(),
+				Delay:       w.vault.Delay,
+			})
+		})
+		if err != nil {
+			return err
+		}
+		return watch()
+	}
+	return txid, nil
+}
+
+// ReleaseVault pays the funds in the vault created by the transaction with
+// the given ID on to the original recipient. The vault transaction must
+// have the vault delay's confirmations. The release transaction is
+// broadcast when wtx is committed.
+func (w *BitcoinWallet) ReleaseVault(wtx iwallet.Tx, id iwallet.TransactionID) (iwallet.TransactionID, error) {
+	var tx *wire.MsgTx
+	err := w.DB.View(func(dbtx database.Tx) error {
+		record, err := pendingVault(dbtx, id)
+		if err != nil {
+			return err
+		}
+
+		var txRecord database.TransactionRecord
+		err = dbtx.Read().Where("coin=?", iwallet.CtBitcoin.CurrencyCode()).Where("txid=?", id.String()).First(&txRecord).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrVaultLocked
+		} else if err != nil {
+			return err
+		}
+		best := w.ChainManager.BestBlock().Height
+		if txRecord.BlockHeight == 0 || best+1 < txRecord.BlockHeight+uint64(record.Delay) {
+			return ErrVaultLocked
+		}
+
+		hdKey, err := w.Keychain.KeyForAddress(dbtx, iwallet.NewAddress(record.HotAddr, iwallet.CtBitcoin), nil)
+		if err != nil {
+			return err
+		}
+		defer base.ZeroKey(hdKey)
+		priv, err := hdKey.ECPrivKey()
+		if err != nil {
+			return err
+		}
+		defer base.ZeroPrivKey(priv)
+
+		tx, err = w.vaultSpendTx(record, record.Destination, iwallet.NewAmount(record.DestAmount).Int64(), blockchain.LockTimeToSequence(false, record.Delay))
+		if err != nil {
+			return err
+		}
+		return signVaultInput(tx, record, priv, false)
+	})
+	if err != nil {
+		return "", err
+	}
+	return w.closeVaultOnCommit(wtx, id, tx, base.VaultReleased)
+}
+
+// CancelVault claws back the funds in the vault created by the transaction
+// with the given ID, sending them to the address less the fee for the fee
+// level. It's signed with the private key for the vault's cancel key and
+// can be done at any time before the vault is released. The cancel
+// transaction is broadcast when wtx is committed.
+func (w *BitcoinWallet) CancelVault(wtx iwallet.Tx, id iwallet.TransactionID, cancelKey btcec.PrivateKey, to iwallet.Address, feeLevel iwallet.FeeLevel) (iwallet.TransactionID, error) {
+	var tx *wire.MsgTx
+	err := w.DB.View(func(dbtx database.Tx) error {
+		record, err := pendingVault(dbtx, id)
+		if err != nil {
+			return err
+		}
+		priv, _ := btcec.PrivKeyFromBytes(btcec.S256(), cancelKey.Serialize())
+		defer base.ZeroPrivKey(priv)
+		if len(record.Script) < 35 || !bytes.Equal(record.Script[2:35], priv.PubKey().SerializeCompressed()) {
+			return errors.New("key is not the vault's cancel key")
+		}
+
+		destScript, err := w.addressToScript(to.String())
+		if err != nil {
+			return err
+		}
+		fpb, err := w.FeeProvider.GetFee(feeLevel)
+		if err != nil {
+			return err
+		}
+		fee := fpb.Mul(iwallet.NewAmount(vaultSpendSize(record.Script, destScript, true)))
+		amount := iwallet.NewAmount(record.Amount).Sub(fee)
+		if w.IsDust(amount) {
+			return errors.New("vault value is too small to pay the fee")
+		}
+
+		tx, err = w.vaultSpendTx(record, to.String(), amount.Int64(), wire.MaxTxInSequenceNum)
+		if err != nil {
+			return err
+		}
+		return signVaultInput(tx, record, priv, true)
+	})
+	if err != nil {
+		return "", err
+	}
+	return w.closeVaultOnCommit(wtx, id, tx, base.VaultCancelled)
+}
+
+// VaultSpends returns the spends paid into vaults.
+func (w *BitcoinWallet) VaultSpends() ([]database.VaultRecord, error) {
+	var records []database.VaultRecord
+	err := w.DB.View(func(dbtx database.Tx) error {
+		err := dbtx.Read().Where("coin=?", iwallet.CtBitcoin.CurrencyCode()).Find(&records).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	})
+	return records, err
+}
+
+// pendingVault returns the record of the vault created by the transaction
+// with the given ID if it hasn't been released or cancelled.
+func pendingVault(dbtx database.Tx, id iwallet.TransactionID) (*database.VaultRecord, error) {
+	var record database.VaultRecord
+	err := dbtx.Read().Where("coin=?", iwallet.CtBitcoin.CurrencyCode()).Where("txid=?", id.String()).First(&record).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("vault %s not found", id)
+	} else if err != nil {
+		return nil, err
+	}
+	if record.Status != string(base.VaultPending) {
+		return nil, ErrVaultClosed
+	}
+	return &record, nil
+}
+
+// vaultSpendTx returns the unsigned version 2 transaction spending the
+// vault to the address.
+func (w *BitcoinWallet) vaultSpendTx(record *database.VaultRecord, addr string, amount int64, sequence uint32) (*wire.MsgTx, error) {
+	op, err := deserializeOutpoint(record.Outpoint)
+	if err != nil {
+		return nil, err
+	}
+	script, err := w.addressToScript(addr)
+	if err != nil {
+		return nil, err
+	}
+	tx := wire.NewMsgTx(2)
+	in := wire.NewTxIn(op, nil, nil)
+	in.Sequence = sequence
+	tx.AddTxIn(in)
+	tx.AddTxOut(wire.NewTxOut(amount, script))
+	return tx, nil
+}
+
+// closeVaultOnCommit sets the commit hook on wtx to broadcast the
+// transaction spending the vault and mark the vault as closed.
+func (w *BitcoinWallet) closeVaultOnCommit(wtx iwallet.Tx, id iwallet.TransactionID, tx *wire.MsgTx, status base.VaultStatus) (iwallet.TransactionID, error) {
+	txid, err := w.broadcastEscrowTx(context.Background(), wtx, tx)
+	if err != nil {
+		return txid, err
+	}
+	dbtx := wtx.(*base.DBTx)
+	broadcast := dbtx.OnCommit
+	dbtx.OnCommit = func() error {
+		err := w.DB.Update(func(dbtx database.Tx) error {
+			record, err := pendingVault(dbtx, id)
+			if err != nil {
+				return err
+			}
+			record.Status = string(status)
+			record.SpendTxid = txid.String()
+			return dbtx.Save(record)
+		})
+		if err != nil {
+			return err
+		}
+		return broadcast()
+	}
+	return txid, nil
+}
+
+// signVaultInput signs the transaction's only input, which spends the
+// vault, with the cancel key if cancel is set and the hot key otherwise.
+func signVaultInput(tx *wire.MsgTx, record *database.VaultRecord, key *btcec.PrivateKey, cancel bool) error {
+	amount := iwallet.NewAmount(record.Amount).Int64()
+	sig, err := txscript.RawTxInWitnessSignature(tx, txscript.NewTxSigHashes(tx), 0, amount, record.Script, txscript.SigHashAll, key)
+	if err != nil {
+		return err
+	}
+	branch := []byte{}
+	if cancel {
+		branch = []byte{0x01}
+	}
+	tx.TxIn[0].Witness = wire.TxWitness{sig, branch, record.Script}
+	return nil
+}
+
+// vaultScript returns the witness script of a vault. It can be spent with
+// the cancel key at any time or with the hot key once the vault output has
+// delay confirmations:
+//
+//	OP_IF <cancelKey> OP_CHECKSIG
+//	OP_ELSE <delay> OP_CHECKSEQUENCEVERIFY OP_DROP <hotKey> OP_CHECKSIG
+//	OP_ENDIF
+func vaultScript(cancelKey, hotKey *btcec.PublicKey, delay uint32) ([]byte, error) {
+	return txscript.NewScriptBuilder().
+		AddOp(txscript.OP_IF).
+		AddData(cancelKey.SerializeCompressed()).
+		AddOp(txscript.OP_CHECKSIG).
+		AddOp(txscript.OP_ELSE).
+		AddInt64(int64(blockchain.LockTimeToSequence(false, delay))).
+		AddOp(txscript.OP_CHECKSEQUENCEVERIFY).
+		AddOp(txscript.OP_DROP).
+		AddData(hotKey.SerializeCompressed()).
+		AddOp(txscript.OP_CHECKSIG).
+		AddOp(txscript.OP_ENDIF).
+		Script()
+}
+
+// vaultAddress returns the P2WSH address and output script for the vault
+// script.
+func (w *BitcoinWallet) vaultAddress(script []byte) (iwallet.Address, []byte, error) {
+	witnessProgram := sha256.Sum256(script)
+	addr, err := btcutil.NewAddressWitnessScriptHash(witnessProgram[:], w.params())
+	if err != nil {
+		return iwallet.Address{}, nil, err
+	}
+	pkScript, err := txscript.PayToAddrScript(addr)
+	if err != nil {
+		return iwallet.Address{}, nil, err
+	}
+	return iwallet.NewAddress(addr.String(), iwallet.CtBitcoin), pkScript, nil
+}
+
+// vaultSpendSize returns the virtual size of a transaction spending a vault
+// to a single output with the given script.
+func vaultSpendSize(script, pkScript []byte, cancel bool) int {
+	// Version, input and output counts and lock time, the outpoint,
+	// empty script sig and sequence, and the output.
+	baseSize := 4 + 1 + 1 + 4 + 36 + 1 + 4 + 8 + wire.VarIntSerializeSize(uint64(len(pkScript))) + len(pkScript)
+
+	// Marker and flag, the item count, the signature, the branch
+	// selector and the script.
+	witnessSize := 2 + 1 + 1 + 73 + 1 + wire.VarIntSerializeSize(uint64(len(script))) + len(script)
+	if cancel {
+		witnessSize++
+	}
+	return baseSize + (witnessSize+3)/4
+}
@@ -0,0 +1,190 @@
+package bitcoin
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"github.com/jarcoal/httpmock"
+	"testing"
+)
+
+func TestBitcoinWallet_Vault(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	w, err := newTestWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := hex.DecodeString("84c8a01a81bf562aafafd4a9fccda533b33d6382b984c081a8cb7817bf909c18")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancelKey, _ := btcec.PrivKeyFromBytes(btcec.S256(), b)
+	w.vault = base.VaultConfig{
+		Threshold: iwallet.NewAmount(100000),
+		Delay:     144,
+		CancelKey: cancelKey.PubKey(),
+	}
+
+	fundTestWallet(t, w)
+
+	to := iwallet.NewAddress("tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", iwallet.CtBitcoin)
+
+	// Spends at or below the threshold are paid directly.
+	wtx, err := w.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Spend(wtx, to, iwallet.NewAmount(100000), iwallet.FlNormal); err != nil {
+		t.Fatal(err)
+	}
+	if err := wtx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	wtx, err = w.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	txid, err := w.Spend(wtx, to, iwallet.NewAmount(500000), iwallet.FlNormal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wtx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := w.VaultSpends()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("Expected 1 vault found %d", len(records))
+	}
+	record := records[0]
+	if record.Txid != txid.String() {
+		t.Errorf("Expected txid %s, got %s", txid, record.Txid)
+	}
+	if record.Status != string(base.VaultPending) {
+		t.Errorf("Expected status %s, got %s", base.VaultPending, record.Status)
+	}
+	if record.Destination != to.String() || record.DestAmount != "500000" {
+		t.Errorf("Unexpected destination %s %s", record.Destination, record.DestAmount)
+	}
+
+	vaultAmount := iwallet.NewAmount(record.Amount).Int64()
+	if vaultAmount <= 500000 {
+		t.Errorf("Expected vault amount to cover the release fee, got %d", vaultAmount)
+	}
+	_, vaultPkScript, err := w.vaultAddress(record.Script)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The vault can't be released before the delay has passed.
+	wtx, err = w.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.ReleaseVault(wtx, txid); !errors.Is(err, ErrVaultLocked) {
+		t.Errorf("Expected ErrVaultLocked, got %v", err)
+	}
+	if err := wtx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The release transaction is valid once the delay has passed.
+	err = w.DB.View(func(dbtx database.Tx) error {
+		hdKey, err := w.Keychain.KeyForAddress(dbtx, iwallet.NewAddress(record.HotAddr, iwallet.CtBitcoin), nil)
+		if err != nil {
+			return err
+		}
+		priv, err := hdKey.ECPrivKey()
+		if err != nil {
+			return err
+		}
+		tx, err := w.vaultSpendTx(&record, record.Destination, 500000, blockchain.LockTimeToSequence(false, record.Delay))
+		if err != nil {
+			return err
+		}
+		if err := signVaultInput(tx, &record, priv, false); err != nil {
+			return err
+		}
+		vm, err := txscript.NewEngine(vaultPkScript, tx, 0, txscript.StandardVerifyFlags, nil, nil, vaultAmount)
+		if err != nil {
+			return err
+		}
+		return vm.Execute()
+	})
+	if err != nil {
+		t.Errorf("Release script verification failed: %s", err)
+	}
+
+	// Only the cancel key can cancel the vault.
+	wtx, err = w.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.CancelVault(wtx, txid, *otherKey, to, iwallet.FlNormal); err == nil {
+		t.Error("Expected error cancelling with the wrong key")
+	}
+
+	cancelTxid, err := w.CancelVault(wtx, txid, *cancelKey, to, iwallet.FlNormal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wtx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	var cancelTx wire.MsgTx
+	for _, unconfirmed := range loadUnconfirmed(t, w) {
+		if unconfirmed.Txid == cancelTxid.String() {
+			if err := cancelTx.BtcDecode(bytes.NewReader(unconfirmed.TxBytes), wire.ProtocolVersion, wire.WitnessEncoding); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if len(cancelTx.TxIn) != 1 {
+		t.Fatal("Cancel transaction not found")
+	}
+	vm, err := txscript.NewEngine(vaultPkScript, &cancelTx, 0, txscript.StandardVerifyFlags, nil, nil, vaultAmount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Execute(); err != nil {
+		t.Errorf("Cancel script verification failed: %s", err)
+	}
+
+	records, err = w.VaultSpends()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records[0].Status != string(base.VaultCancelled) || records[0].SpendTxid != cancelTxid.String() {
+		t.Errorf("Expected vault cancelled by %s, got %s %s", cancelTxid, records[0].Status, records[0].SpendTxid)
+	}
+
+	wtx, err = w.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.ReleaseVault(wtx, txid); !errors.Is(err, ErrVaultClosed) {
+		t.Errorf("Expected ErrVaultClosed, got %v", err)
+	}
+	if err := wtx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+}
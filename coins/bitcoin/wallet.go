@@ -2,9 +2,8 @@ package bitcoin
 
 import (
 	"bytes"
-	"crypto/sha256"
+	"context"
 	"encoding/binary"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/btcsuite/btcd/blockchain"
@@ -14,16 +13,15 @@ import (
 	"github.com/btcsuite/btcd/txscript"
 	"github.com/btcsuite/btcd/wire"
 	"github.com/btcsuite/btcutil"
-	"github.com/btcsuite/btcutil/coinset"
 	"github.com/btcsuite/btcutil/hdkeychain"
 	"github.com/btcsuite/btcutil/txsort"
-	"github.com/btcsuite/btcwallet/wallet/txauthor"
-	"github.com/btcsuite/btcwallet/wallet/txrules"
-	"github.com/btcsuite/btcwallet/wallet/txsizes"
 	"github.com/cpacia/multiwallet/base"
-	"github.com/cpacia/multiwallet/client/blockbook"
+	"github.com/cpacia/multiwallet/client"
+	"github.com/cpacia/multiwallet/coins/bitcoin/lightning"
+	"github.com/cpacia/multiwallet/coins/utxobase"
 	"github.com/cpacia/multiwallet/database"
 	iwallet "github.com/cpacia/wallet-interface"
+	"sync"
 	"time"
 )
 
@@ -38,274 +36,145 @@ const maxFeePerByte = 200
 // BitcoinWallet extends wallet base and implements the
 // remaining functions for each interface.
 type BitcoinWallet struct { // nolint
-	base.WalletBase
-	testnet     bool
+	utxobase.Wallet
+	network     base.Network
 	feeURL      string
-	feeProvider base.FeeProvider
+	addressType base.AddressType
+	rbf         bool
+	lightning   lightning.Client
+
+	escrowP2SH       bool
+	escrowMuSig2     bool
+	escrowSortedKeys bool
+	vault            base.VaultConfig
+	cosigner         *cosigner
+	descriptor       *base.Descriptor
+	signer           *keySigner
+	musigMtx         sync.Mutex
+	musigSigners     map[musigSessionID]*musigSigner
+
+	silentPayments    bool
+	silentPaymentScan chan struct{}
 }
 
 // NewBitcoinWallet returns a new BitcoinWallet. This constructor
 // attempts to connect to the API. If it fails, it will not build.
 func NewBitcoinWallet(cfg *base.WalletConfig) (*BitcoinWallet, error) {
 	w := &BitcoinWallet{
-		testnet: cfg.Testnet,
-		feeURL:  cfg.FeeURL,
+		network:          cfg.SelectedNetwork(),
+		feeURL:           cfg.FeeURL,
+		addressType:      cfg.AddressType,
+		rbf:              cfg.ReplaceByFee,
+		escrowP2SH:       cfg.EscrowP2SH,
+		escrowMuSig2:     cfg.EscrowMuSig2,
+		escrowSortedKeys: cfg.EscrowSortedKeys,
+		vault:            cfg.Vault,
 	}
-
-	chainClient, err := blockbook.NewBlockbookClient(cfg.ClientURL, iwallet.CtBitcoin)
-	if err != nil {
-		return nil, err
-	}
-
-	fp := base.NewAPIFeeProvider(cfg.FeeURL, iwallet.NewAmount(maxFeePerByte))
-
-	w.ChainClient = chainClient
-	w.DB = cfg.DB
-	w.Logger = cfg.Logger
-	w.CoinType = iwallet.CtBitcoin
-	w.Done = make(chan struct{})
-	w.AddressFunc = w.keyToAddress
-	w.feeProvider = fp
-	return w, nil
-}
-
-// ValidateAddress validates that the serialization of the address is correct
-// for this coin and network. It returns an error if it isn't.
-func (w *BitcoinWallet) ValidateAddress(addr iwallet.Address) error {
-	_, err := btcutil.DecodeAddress(addr.String(), w.params())
-	return err
-}
-
-// IsDust returns whether the amount passed in is considered dust by network. This
-// method is called when building payout transactions from the multisig to the various
-// participants. If the amount that is supposed to be sent to a given party is below
-// the dust threshold, openbazaar-go will not pay that party to avoid building a transaction
-// that never confirms.
-func (w *BitcoinWallet) IsDust(amount iwallet.Amount) bool {
-	return txrules.IsDustAmount(btcutil.Amount(amount.Int64()), 25, txrules.DefaultRelayFeePerKb)
-}
-
-// EstimateSpendFee should return the anticipated fee to transfer a given amount of coins
-// out of the wallet at the provided fee level. Typically this involves building a
-// transaction with enough inputs to cover the request amount and calculating the size
-// of the transaction. It is OK, if a transaction comes in after this function is called
-// that changes the estimated fee as it's only intended to be an estimate.
-//
-// All amounts should be in the coin's base unit (for example: satoshis).
-func (w *BitcoinWallet) EstimateSpendFee(amount iwallet.Amount, feeLevel iwallet.FeeLevel) (iwallet.Amount, error) {
-	amt := iwallet.NewAmount(0)
-	err := w.DB.Update(func(dbtx database.Tx) error {
-		// Since this is an estimate we can use a dummy output address. Let's use a long one so we don't under estimate.
-		addrStr := "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4"
-		if w.testnet {
-			addrStr = "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx"
-		}
-		tx, err := w.buildTx(dbtx, amount.Int64(), iwallet.NewAddress(addrStr, iwallet.CtBitcoin), feeLevel)
-		if err != nil {
-			return err
+	if w.vault.Enabled() {
+		if w.vault.CancelKey == nil {
+			return nil, errors.New("vault mode requires a cancel key")
 		}
-		var outval int64
-		for _, output := range tx.TxOut {
-			outval += output.Value
+		if w.vault.Delay == 0 || w.vault.Delay > maxVaultDelay {
+			return nil, fmt.Errorf("vault delay must be between 1 and %d blocks", maxVaultDelay)
 		}
-		var utxoRecords []database.UtxoRecord
-		err = dbtx.Read().Where("coin = ?", w.CoinType.CurrencyCode()).Find(&utxoRecords).Error
-		if err != nil {
-			return err
-		}
-
-		var inval int64
-		for _, input := range tx.TxIn {
-			for _, utxo := range utxoRecords {
-				ser, err := hex.DecodeString(utxo.Outpoint)
-				if err != nil {
-					return err
-				}
-				op, err := deserializeOutpoint(ser)
-				if err != nil {
-					return err
-				}
-
-				if op.Hash.IsEqual(&input.PreviousOutPoint.Hash) && op.Index == input.PreviousOutPoint.Index {
-					inval += iwallet.NewAmount(utxo.Amount).Int64()
-					break
-				}
-			}
-		}
-		if inval < outval {
-			return errors.New("error building transaction: inputs less than outputs")
+	}
+	if cfg.Descriptor != "" {
+		if cfg.CosignerKey != "" {
+			return nil, errors.New("a descriptor can't be used with a cosigner key")
 		}
-		amt = iwallet.NewAmount(inval - outval)
-		return nil
-	})
-	return amt, err
-}
-
-// Spend is a request to send requested amount to the requested address. The
-// fee level is provided by the user. It's up to the implementation to decide
-// how best to use the fee level.
-//
-// The database Tx MUST be respected. When this function is called the wallet
-// state changes should be prepped and held in memory. If Rollback() is called
-// the state changes should be discarded. Only when Commit() is called should
-// the state changes be applied and the transaction broadcasted to the network.
-func (w *BitcoinWallet) Spend(wtx iwallet.Tx, to iwallet.Address, amt iwallet.Amount, feeLevel iwallet.FeeLevel) (iwallet.TransactionID, error) {
-	var (
-		txid iwallet.TransactionID
-		buf  bytes.Buffer
-	)
-	err := w.DB.View(func(dbtx database.Tx) error {
-		tx, err := w.buildTx(dbtx, amt.Int64(), to, feeLevel)
-		if err != nil {
-			return err
+		if err := w.setDescriptor(cfg.Descriptor); err != nil {
+			return nil, err
 		}
-		txid = iwallet.TransactionID(tx.TxHash().String())
-		if err := tx.BtcEncode(&buf, wire.ProtocolVersion, wire.WitnessEncoding); err != nil {
-			return err
+		if w.vault.Enabled() && w.cosigner != nil {
+			return nil, errors.New("vault mode can't be used with a cosigner")
 		}
-		return nil
-	})
-
-	wbtx, ok := wtx.(*base.DBTx)
-	if !ok {
-		return txid, errors.New("tx is not expected type")
 	}
-
-	wbtx.OnCommit = func() error {
-		return w.DB.Update(func(dbtx database.Tx) error {
-			err := dbtx.Save(&database.UnconfirmedTransaction{
-				Timestamp: time.Now(),
-				Coin:      iwallet.CtBitcoin,
-				TxBytes:   buf.Bytes(),
-				Txid:      txid.String(),
-			})
-			if err != nil {
-				return err
-			}
-			return w.ChainClient.Broadcast(buf.Bytes())
-		})
-	}
-	return txid, err
-}
-
-// SweepWallet should sweep the full balance of the wallet to the requested
-// address. It is expected for most coins that the fee will be subtracted
-// from the amount sent rather than added to it.
-func (w *BitcoinWallet) SweepWallet(wtx iwallet.Tx, to iwallet.Address, level iwallet.FeeLevel) (iwallet.TransactionID, error) {
-	var (
-		txid iwallet.TransactionID
-		buf  bytes.Buffer
-	)
-	err := w.DB.Update(func(dbtx database.Tx) error {
-		var (
-			totalIn               btcutil.Amount
-			tx                    = wire.NewMsgTx(1)
-			keyMap                = make(map[wire.OutPoint]*btcec.PrivateKey)
-			additionalPrevScripts = make(map[wire.OutPoint][]byte)
-			inVals                = make(map[wire.OutPoint]int64)
-		)
-
-		coinMap, err := w.GatherCoins(dbtx)
-		if err != nil {
-			return err
+	if cfg.CosignerKey != "" {
+		if w.vault.Enabled() {
+			return nil, errors.New("vault mode can't be used with a cosigner")
 		}
-
-		for coin, key := range coinMap {
-			h, err := chainhash.NewHashFromStr(coin.Hash().String())
-			if err != nil {
-				return err
-			}
-			op := wire.NewOutPoint(h, coin.Index())
-			tx.AddTxIn(wire.NewTxIn(op, nil, nil))
-			totalIn += btcutil.Amount(coin.Value().ToUnit(btcutil.AmountSatoshi))
-
-			inVals[*op] = int64(coin.Value())
-
-			priv, err := key.ECPrivKey()
-			if err != nil {
-				return err
-			}
-			keyMap[*op] = priv
-
-			address, err := btcutil.DecodeAddress(string(coin.PkScript()), w.params())
-			if err != nil {
-				return err
-			}
-
-			script, err := txscript.PayToAddrScript(address)
-			if err != nil {
-				return err
-			}
-
-			additionalPrevScripts[*op] = script
-		}
-		addr, err := btcutil.DecodeAddress(to.String(), w.params())
-		if err != nil {
-			return err
+		if err := w.setCosigner(cfg.CosignerKey); err != nil {
+			return nil, err
 		}
-
-		script, err := txscript.PayToAddrScript(addr)
-		if err != nil {
-			return err
+	}
+	if cfg.Signer != nil {
+		if w.vault.Enabled() || w.cosigner != nil {
+			return nil, errors.New("a signer can't be used with vault mode or a cosigner")
 		}
-
-		tx.AddTxOut(wire.NewTxOut(0, script))
-
-		size := txsizes.EstimateSerializeSize(len(tx.TxIn), tx.TxOut, false)
-		fpb, err := w.feeProvider.GetFee(level)
-		if err != nil {
-			return err
+		if err := w.setSigner(cfg.Signer); err != nil {
+			return nil, err
 		}
-		fee := fpb.Mul(iwallet.NewAmount(size)).Int64()
-
-		tx.TxOut[0].Value = int64(totalIn) - fee
-
-		// BIP 69 sorting
-		txsort.InPlaceSort(tx)
-
-		// Sign tx
-		for i, txIn := range tx.TxIn {
-			prevOutScript := additionalPrevScripts[txIn.PreviousOutPoint]
-			key := keyMap[txIn.PreviousOutPoint]
-
-			script, err := txscript.WitnessSignature(tx, txscript.NewTxSigHashes(tx), i,
-				inVals[txIn.PreviousOutPoint], prevOutScript,
-				txscript.SigHashAll, key, true)
-			if err != nil {
-				return errors.New("failed to sign transaction")
-			}
-			txIn.Witness = script
+	}
+	if cfg.Offline {
+		if w.vault.Enabled() || w.cosigner != nil || w.signer != nil {
+			return nil, errors.New("offline mode can't be used with vault mode, a cosigner or a signer")
 		}
-
-		txid = iwallet.TransactionID(tx.TxHash().String())
-		if err := tx.BtcEncode(&buf, wire.ProtocolVersion, wire.WitnessEncoding); err != nil {
-			return err
+		if err := w.setOffline(); err != nil {
+			return nil, err
 		}
+	}
 
-		return nil
-	})
+	chainClient, err := client.NewChainClient(cfg.ClientURL, iwallet.CtBitcoin)
+	if err != nil {
+		return nil, err
+	}
 
-	wbtx, ok := wtx.(*base.DBTx)
+	// Esplora serves its own fee estimates so there's no need to use a
+	// separate fee API.
+	fp, ok := chainClient.(base.FeeProvider)
 	if !ok {
-		return txid, errors.New("tx is not expected type")
+		fp = base.NewAPIFeeProvider(cfg.FeeURL, iwallet.NewAmount(maxFeePerByte))
+	}
+	if netFP := w.network.DefaultFeeProvider(); netFP != nil {
+		fp = netFP
+	}
+	if cfg.FeeProvider != nil {
+		fp = cfg.FeeProvider
 	}
 
-	wbtx.OnCommit = func() error {
-		return w.DB.Update(func(dbtx database.Tx) error {
-			err := dbtx.Save(&database.UnconfirmedTransaction{
-				Timestamp: time.Now(),
-				Coin:      iwallet.CtBitcoin,
-				TxBytes:   buf.Bytes(),
-				Txid:      txid.String(),
-			})
-			if err != nil {
-				return err
-			}
-			return w.ChainClient.Broadcast(buf.Bytes())
-		})
+	chainClient, err = client.WithFailover(chainClient, cfg.FallbackClientURLs, iwallet.CtBitcoin, cfg.Logger)
+	if err != nil {
+		return nil, err
+	}
+
+	chainClient, err = client.WithVerification(chainClient, cfg.VerifyClientURL, iwallet.CtBitcoin, cfg.Logger)
+	if err != nil {
+		return nil, err
 	}
 
-	return txid, err
+	w.ChainClient = chainClient
+	w.DB = cfg.DB
+	w.Logger = cfg.Logger
+	w.CoinType = iwallet.CtBitcoin
+	w.Done = make(chan struct{})
+	w.AddressFunc = w.keyToAddress
+	w.NormalizeAddress = w.normalizeAddress
+	w.GapLimit = cfg.GapLimit
+	w.KeychainOpts = cfg.KeychainOptions()
+	// Payment code addresses are single key P2PKH so they're only used by
+	// wallets whose own addresses are too.
+	if !w.vault.Enabled() && w.cosigner == nil && w.signer == nil && w.addressType != base.AddressTypeTaproot {
+		w.KeychainOpts = append(w.KeychainOpts, base.PaymentCodes(w.paymentCodeAddress))
+	}
+	// Silent payment outputs are single key P2TR which any wallet signing
+	// with its own keys can spend.
+	if !w.vault.Enabled() && w.cosigner == nil && w.signer == nil {
+		w.silentPayments = true
+		w.silentPaymentScan = make(chan struct{}, 1)
+		w.KeychainOpts = append(w.KeychainOpts, base.SilentPayments())
+	}
+	w.Prune = cfg.Prune
+	w.Confirmations = cfg.Confirmations
+	w.SpendPolicy = cfg.SpendPolicy
+	w.FeeProvider = fp
+	w.Chain = w.chain()
+	w.KeychainOpts = append(w.KeychainOpts, base.IndexScripts(w.Chain.AddressToScript))
+	w.ChangePolicy = cfg.ChangePolicy
+	w.ChangeAddress = cfg.ChangeAddress
+	w.PreventAddressReuse = cfg.PreventAddressReuse
+	w.DeterministicBuilds = cfg.DeterministicBuilds
+	w.SeparateSources = cfg.SeparateUtxoSources
+	return w, nil
 }
 
 // EstimateEscrowFee estimates the fee to release the funds from escrow.
@@ -313,20 +182,20 @@ func (w *BitcoinWallet) SweepWallet(wtx iwallet.Tx, to iwallet.Address, level iw
 // will add 50% of the returned fee for each additional input. This is a
 // crude fee calculating but it simplifies things quite a bit.
 func (w *BitcoinWallet) EstimateEscrowFee(threshold int, level iwallet.FeeLevel) (iwallet.Amount, error) {
-	var (
-		nOuts            = 2
-		redeemScriptSize = 4 + (threshold+1)*34
-	)
+	nOuts := 2
 	if threshold == 1 {
 		nOuts = 1
 	}
 
-	// 8 additional bytes are for version and locktime
-	size := 8 + wire.VarIntSerializeSize(1) +
-		wire.VarIntSerializeSize(uint64(nOuts)) + 1 +
-		threshold*66 + txsizes.P2PKHOutputSize*nOuts + redeemScriptSize
+	// The number of keys in the escrow isn't known here so threshold+1
+	// is assumed, which covers the 1 of 2 and 2 of 3 escrows OpenBazaar
+	// creates.
+	size := escrowSize(threshold, threshold+1, 1, nOuts, w.escrowP2SH)
+	if w.escrowMuSig2 {
+		size = musigEscrowSize(threshold, threshold+1, nOuts)
+	}
 
-	fpb, err := w.feeProvider.GetFee(level)
+	fpb, err := w.FeeProvider.GetFee(level)
 	if err != nil {
 		return iwallet.NewAmount(0), err
 	}
@@ -349,7 +218,34 @@ func (w *BitcoinWallet) EstimateEscrowFee(threshold int, level iwallet.FeeLevel)
 // also uses 1 of 2 multisigs as a form of a "cancelable" address when sending to
 // a node that is offline. This allows the sender to cancel the payment if the vendor
 // never comes back online.
+//
+// Escrow addresses are P2WSH unless the wallet was configured with
+// EscrowP2SH for counterparties which can't use segwit, in which case the
+// returned slice is the redeem script prefixed with a version byte.
+//
+// If the wallet was configured with EscrowMuSig2 the address is a taproot
+// output spent with MuSig2 and the returned slice describes the escrow
+// rather than being a redeem script.
+//
+// If the wallet was configured with EscrowSortedKeys the keys are sorted
+// as in BIP67 and the returned slice is flagged with sortedEscrowVersion.
 func (w *BitcoinWallet) CreateMultisigAddress(keys []btcec.PublicKey, threshold int) (iwallet.Address, []byte, error) {
+	if w.escrowMuSig2 {
+		var pubkeys []*btcec.PublicKey
+		for i := range keys {
+			pubkeys = append(pubkeys, &keys[i])
+		}
+		e, err := newMuSigEscrow(pubkeys, threshold)
+		if err != nil {
+			return iwallet.Address{}, nil, err
+		}
+		addr, err := encodeTaprootAddress(e.output.xOnly(), w.params())
+		if err != nil {
+			return iwallet.Address{}, nil, err
+		}
+		return iwallet.NewAddress(addr, iwallet.CtBitcoin), e.serialize(), nil
+	}
+
 	if len(keys) < threshold {
 		return iwallet.Address{}, nil, fmt.Errorf("unable to generate multisig script with "+
 			"%d required signatures when there are only %d public "+
@@ -363,7 +259,7 @@ func (w *BitcoinWallet) CreateMultisigAddress(keys []btcec.PublicKey, threshold
 
 	builder := txscript.NewScriptBuilder()
 	builder.AddInt64(int64(threshold))
-	for _, key := range keys {
+	for _, key := range w.orderEscrowKeys(keys) {
 		builder.AddData(key.SerializeCompressed())
 	}
 	builder.AddInt64(int64(len(keys)))
@@ -373,12 +269,7 @@ func (w *BitcoinWallet) CreateMultisigAddress(keys []btcec.PublicKey, threshold
 	if err != nil {
 		return iwallet.Address{}, nil, err
 	}
-	witnessProgram := sha256.Sum256(redeemScript)
-	addr, err := btcutil.NewAddressWitnessScriptHash(witnessProgram[:], w.params())
-	if err != nil {
-		return iwallet.Address{}, nil, err
-	}
-	return iwallet.NewAddress(addr.String(), iwallet.CtBitcoin), redeemScript, nil
+	return w.escrowAddress(redeemScript)
 }
 
 // SignMultisigTransaction should use the provided key to create a signature for
@@ -389,37 +280,32 @@ func (w *BitcoinWallet) CreateMultisigAddress(keys []btcec.PublicKey, threshold
 //
 // For coins like bitcoin you may need to return one signature *per input* which is
 // why a slice of signatures is returned.
+//
+// MuSig2 escrows are signed in two rounds. See AddEscrowNonces.
 func (w *BitcoinWallet) SignMultisigTransaction(txn iwallet.Transaction, key btcec.PrivateKey, redeemScript []byte) ([]iwallet.EscrowSignature, error) {
-	var sigs []iwallet.EscrowSignature
-	tx := wire.NewMsgTx(1)
-	for _, from := range txn.From {
-		op, err := deserializeOutpoint(from.ID)
-		if err != nil {
-			return nil, err
-		}
-
-		input := wire.NewTxIn(op, nil, nil)
-		tx.TxIn = append(tx.TxIn, input)
+	if err := w.CheckEscrowRelease(redeemScript); err != nil {
+		return nil, err
 	}
-	for _, to := range txn.To {
-		addr, err := btcutil.DecodeAddress(to.Address.String(), w.params())
-		if err != nil {
-			return nil, err
-		}
-
-		scriptPubkey, err := txscript.PayToAddrScript(addr)
-		if err != nil {
-			return nil, err
-		}
-		output := wire.NewTxOut(to.Amount.Int64(), scriptPubkey)
-		tx.TxOut = append(tx.TxOut, output)
+	if isMuSigEscrow(redeemScript) {
+		return w.signMuSigEscrow(txn, key, redeemScript)
 	}
 
-	// BIP 69 sorting
-	txsort.InPlaceSort(tx)
+	redeemScript, p2sh := splitEscrowScript(redeemScript)
 
-	for i := range tx.TxIn {
-		sig, err := txscript.RawTxInWitnessSignature(tx, txscript.NewTxSigHashes(tx), i, txn.From[i].Amount.Int64(), redeemScript, txscript.SigHashAll, &key)
+	tx, amounts, err := w.escrowTx(txn)
+	if err != nil {
+		return nil, err
+	}
+
+	var sigs []iwallet.EscrowSignature
+	sigHashes := txscript.NewTxSigHashes(tx)
+	for i, in := range tx.TxIn {
+		var sig []byte
+		if p2sh {
+			sig, err = txscript.RawTxInSignature(tx, i, redeemScript, txscript.SigHashAll, &key)
+		} else {
+			sig, err = txscript.RawTxInWitnessSignature(tx, sigHashes, i, amounts[in.PreviousOutPoint], redeemScript, txscript.SigHashAll, &key)
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -438,27 +324,31 @@ func (w *BitcoinWallet) SignMultisigTransaction(txn iwallet.Transaction, key btc
 // Note a database transaction is used here. Same rules of Commit() and
 // Rollback() apply.
 func (w *BitcoinWallet) BuildAndSend(wtx iwallet.Tx, txn iwallet.Transaction, signatures [][]iwallet.EscrowSignature, redeemScript []byte) (iwallet.TransactionID, error) {
-	tx := wire.NewMsgTx(1)
-	for _, from := range txn.From {
-		op, err := deserializeOutpoint(from.ID)
-		if err != nil {
-			return iwallet.TransactionID(""), err
-		}
-		input := wire.NewTxIn(op, nil, nil)
-		tx.TxIn = append(tx.TxIn, input)
+	return w.BuildAndSendContext(context.Background(), wtx, txn, signatures, redeemScript)
+}
+
+// BuildAndSendContext is like BuildAndSend but returns ctx.Err(), without
+// setting the commit hook, if ctx is done by the time the transaction is
+// built. Begin wtx with BeginContext for the commit to be bound to ctx too.
+func (w *BitcoinWallet) BuildAndSendContext(ctx context.Context, wtx iwallet.Tx, txn iwallet.Transaction, signatures [][]iwallet.EscrowSignature, redeemScript []byte) (iwallet.TransactionID, error) {
+	if err := w.CheckEscrowRelease(redeemScript); err != nil {
+		return "", err
 	}
-	for _, to := range txn.To {
-		addr, err := btcutil.DecodeAddress(to.Address.String(), w.params())
+	if err := w.CheckDestinations(base.PaidAddresses(txn)...); err != nil {
+		return "", err
+	}
+	if isMuSigEscrow(redeemScript) {
+		tx, err := w.buildMuSigEscrowTx(txn, signatures, redeemScript)
 		if err != nil {
 			return iwallet.TransactionID(""), err
 		}
+		return w.broadcastEscrowTx(ctx, wtx, tx)
+	}
+	redeemScript, p2sh := splitEscrowScript(redeemScript)
 
-		scriptPubkey, err := txscript.PayToAddrScript(addr)
-		if err != nil {
-			return iwallet.TransactionID(""), err
-		}
-		output := wire.NewTxOut(to.Amount.Int64(), scriptPubkey)
-		tx.TxOut = append(tx.TxOut, output)
+	tx, amounts, err := w.escrowTx(txn)
+	if err != nil {
+		return iwallet.TransactionID(""), err
 	}
 
 	for _, sig := range signatures {
@@ -467,8 +357,13 @@ func (w *BitcoinWallet) BuildAndSend(wtx iwallet.Tx, txn iwallet.Transaction, si
 		}
 	}
 
-	// BIP 69 sorting
-	txsort.InPlaceSort(tx)
+	// The signatures are checked before assembling the transaction so a
+	// bad one from a counterparty is reported instead of being rejected
+	// by the network.
+	ordered, err := orderEscrowSignatures(tx, amounts, redeemScript, p2sh, signatures)
+	if err != nil {
+		return iwallet.TransactionID(""), err
+	}
 
 	// Check if time locked
 	var timeLocked bool
@@ -478,13 +373,8 @@ func (w *BitcoinWallet) BuildAndSend(wtx iwallet.Tx, txn iwallet.Transaction, si
 
 	for i := range tx.TxIn {
 		witness := [][]byte{{}}
-		for _, escrowSigs := range signatures {
-			for _, sig := range escrowSigs {
-				if sig.Index == i {
-					witness = append(witness, append(sig.Signature, byte(txscript.SigHashAll)))
-					break
-				}
-			}
+		for _, sig := range ordered[i] {
+			witness = append(witness, append(sig, byte(txscript.SigHashAll)))
 		}
 
 		if timeLocked {
@@ -492,37 +382,18 @@ func (w *BitcoinWallet) BuildAndSend(wtx iwallet.Tx, txn iwallet.Transaction, si
 		}
 
 		witness = append(witness, redeemScript)
-		tx.TxIn[i].Witness = witness
-	}
-
-	txid := iwallet.TransactionID(tx.TxHash().String())
-
-	var buf bytes.Buffer
-	if err := tx.BtcEncode(&buf, wire.ProtocolVersion, wire.WitnessEncoding); err != nil {
-		return txid, err
-	}
-
-	wbtx, ok := wtx.(*base.DBTx)
-	if !ok {
-		return txid, errors.New("tx is not expected type")
-	}
-
-	wbtx.OnCommit = func() error {
-		return w.DB.Update(func(dbtx database.Tx) error {
-			err := dbtx.Save(&database.UnconfirmedTransaction{
-				Timestamp: time.Now(),
-				Coin:      iwallet.CtBitcoin,
-				TxBytes:   buf.Bytes(),
-				Txid:      tx.TxHash().String(),
-			})
+		if p2sh {
+			scriptSig, err := pushesToScript(witness)
 			if err != nil {
-				return err
+				return iwallet.TransactionID(""), err
 			}
-			return w.ChainClient.Broadcast(buf.Bytes())
-		})
+			tx.TxIn[i].SignatureScript = scriptSig
+			continue
+		}
+		tx.TxIn[i].Witness = witness
 	}
 
-	return txid, nil
+	return w.broadcastEscrowTx(ctx, wtx, tx)
 }
 
 // CreateMultisigWithTimeout is the same as CreateMultisigAddress but it adds
@@ -545,7 +416,7 @@ func (w *BitcoinWallet) CreateMultisigWithTimeout(keys []btcec.PublicKey, thresh
 	sequenceLock := blockchain.LockTimeToSequence(false, uint32(timeout.Hours()*6))
 	builder.AddOp(txscript.OP_IF)
 	builder.AddInt64(int64(threshold))
-	for _, key := range keys {
+	for _, key := range w.orderEscrowKeys(keys) {
 		builder.AddData(key.SerializeCompressed())
 	}
 	builder.AddInt64(int64(len(keys)))
@@ -562,33 +433,37 @@ func (w *BitcoinWallet) CreateMultisigWithTimeout(keys []btcec.PublicKey, thresh
 	if err != nil {
 		return iwallet.Address{}, nil, err
 	}
-	witnessProgram := sha256.Sum256(redeemScript)
-	addr, err := btcutil.NewAddressWitnessScriptHash(witnessProgram[:], w.params())
-	if err != nil {
-		return iwallet.Address{}, nil, err
-	}
-	return iwallet.NewAddress(addr.String(), iwallet.CtBitcoin), redeemScript, nil
+	return w.escrowAddress(redeemScript)
 }
 
 // ReleaseFundsAfterTimeout will release funds from the escrow. The signature will
 // be created using the timeoutKey.
 func (w *BitcoinWallet) ReleaseFundsAfterTimeout(wtx iwallet.Tx, txn iwallet.Transaction, timeoutKey btcec.PrivateKey, redeemScript []byte) (iwallet.TransactionID, error) {
+	return w.ReleaseFundsAfterTimeoutContext(context.Background(), wtx, txn, timeoutKey, redeemScript)
+}
+
+// ReleaseFundsAfterTimeoutContext is like ReleaseFundsAfterTimeout but
+// returns ctx.Err(), without setting the commit hook, if ctx is done by the
+// time the transaction is signed.
+func (w *BitcoinWallet) ReleaseFundsAfterTimeoutContext(ctx context.Context, wtx iwallet.Tx, txn iwallet.Transaction, timeoutKey btcec.PrivateKey, redeemScript []byte) (iwallet.TransactionID, error) {
+	if err := w.CheckEscrowRelease(redeemScript); err != nil {
+		return "", err
+	}
+	redeemScript, p2sh := splitEscrowScript(redeemScript)
+
 	tx := wire.NewMsgTx(2)
+	amounts := make(map[wire.OutPoint]int64)
 	for _, from := range txn.From {
 		op, err := deserializeOutpoint(from.ID)
 		if err != nil {
 			return iwallet.TransactionID(""), err
 		}
+		amounts[*op] = from.Amount.Int64()
 		input := wire.NewTxIn(op, nil, nil)
 		tx.TxIn = append(tx.TxIn, input)
 	}
 	for _, to := range txn.To {
-		addr, err := btcutil.DecodeAddress(to.Address.String(), w.params())
-		if err != nil {
-			return iwallet.TransactionID(""), err
-		}
-
-		scriptPubkey, err := txscript.PayToAddrScript(addr)
+		scriptPubkey, err := w.addressToScript(to.Address.String())
 		if err != nil {
 			return iwallet.TransactionID(""), err
 		}
@@ -609,8 +484,21 @@ func (w *BitcoinWallet) ReleaseFundsAfterTimeout(wtx iwallet.Tx, txn iwallet.Tra
 		tx.TxIn[i].Sequence = locktime
 	}
 
-	for i := range tx.TxIn {
-		sig, err := txscript.RawTxInWitnessSignature(tx, txscript.NewTxSigHashes(tx), i, txn.From[i].Amount.Int64(), redeemScript, txscript.SigHashAll, privKey)
+	sigHashes := txscript.NewTxSigHashes(tx)
+	for i, in := range tx.TxIn {
+		if p2sh {
+			sig, err := txscript.RawTxInSignature(tx, i, redeemScript, txscript.SigHashAll, privKey)
+			if err != nil {
+				return iwallet.TransactionID(""), err
+			}
+			scriptSig, err := pushesToScript([][]byte{sig, {}, redeemScript})
+			if err != nil {
+				return iwallet.TransactionID(""), err
+			}
+			tx.TxIn[i].SignatureScript = scriptSig
+			continue
+		}
+		sig, err := txscript.RawTxInWitnessSignature(tx, sigHashes, i, amounts[in.PreviousOutPoint], redeemScript, txscript.SigHashAll, privKey)
 		if err != nil {
 			return iwallet.TransactionID(""), err
 		}
@@ -618,7 +506,17 @@ func (w *BitcoinWallet) ReleaseFundsAfterTimeout(wtx iwallet.Tx, txn iwallet.Tra
 		tx.TxIn[i].Witness = witness
 	}
 
+	return w.broadcastEscrowTx(ctx, wtx, tx)
+}
+
+// broadcastEscrowTx sets the commit hook on wtx to save the signed escrow
+// transaction as unconfirmed and broadcast it. The save is bound to wtx's
+// context and the transaction is only broadcast once saved.
+func (w *BitcoinWallet) broadcastEscrowTx(ctx context.Context, wtx iwallet.Tx, tx *wire.MsgTx) (iwallet.TransactionID, error) {
 	txid := iwallet.TransactionID(tx.TxHash().String())
+	if err := ctx.Err(); err != nil {
+		return txid, err
+	}
 
 	var buf bytes.Buffer
 	if err := tx.BtcEncode(&buf, wire.ProtocolVersion, wire.WitnessEncoding); err != nil {
@@ -631,7 +529,8 @@ func (w *BitcoinWallet) ReleaseFundsAfterTimeout(wtx iwallet.Tx, txn iwallet.Tra
 	}
 
 	wbtx.OnCommit = func() error {
-		return w.DB.Update(func(dbtx database.Tx) error {
+		err := w.DB.Update(func(dbtx database.Tx) error {
+			dbtx = base.ContextTx(wbtx.Context(), dbtx)
 			err := dbtx.Save(&database.UnconfirmedTransaction{
 				Timestamp: time.Now(),
 				Coin:      iwallet.CtBitcoin,
@@ -641,179 +540,245 @@ func (w *BitcoinWallet) ReleaseFundsAfterTimeout(wtx iwallet.Tx, txn iwallet.Tra
 			if err != nil {
 				return err
 			}
-			return w.ChainClient.Broadcast(buf.Bytes())
+			return nil
 		})
+		if err != nil {
+			return err
+		}
+		w.BroadcastOrQueue(txid, buf.Bytes())
+		return nil
 	}
 
 	return txid, nil
 }
 
 func (w *BitcoinWallet) params() *chaincfg.Params {
-	if w.testnet {
+	switch w.network {
+	case base.NetworkTestnet:
 		return &chaincfg.TestNet3Params
+	case base.NetworkSignet:
+		return &SigNetParams
+	case base.NetworkRegtest:
+		return &chaincfg.RegressionNetParams
 	}
 	return &chaincfg.MainNetParams
 }
 
-func (w *BitcoinWallet) buildTx(dbtx database.Tx, amount int64, iaddr iwallet.Address, feeLevel iwallet.FeeLevel) (*wire.MsgTx, error) {
-	// Check for dust
-	addr, err := btcutil.DecodeAddress(iaddr.String(), w.params())
-	if err != nil {
-		return nil, err
+// chain returns the bitcoin specific functions used by the utxobase wallet.
+func (w *BitcoinWallet) chain() *utxobase.Chain {
+	// Since this is an estimate we can use a dummy output address. Let's use a long one so we don't under estimate.
+	estimationAddr := "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4"
+	switch w.network {
+	case base.NetworkTestnet, base.NetworkSignet:
+		estimationAddr = "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx"
+	case base.NetworkRegtest:
+		estimationAddr = "bcrt1qw508d6qejxtdg4y5r3zarvary0c5xw7kygt080"
+	}
+	return &utxobase.Chain{
+		AddressToScript: w.addressToScript,
+		SignTx: func(tx *wire.MsgTx, prevScripts map[wire.OutPoint][]byte, values map[wire.OutPoint]int64, keys map[wire.OutPoint]*btcec.PrivateKey) error {
+			sigHashes := txscript.NewTxSigHashes(tx)
+			for i, txIn := range tx.TxIn {
+				if w.cosigner != nil && txscript.IsPayToWitnessScriptHash(prevScripts[txIn.PreviousOutPoint]) {
+					if err := w.cosigner.signInput(tx, sigHashes, i, values, prevScripts, keys[txIn.PreviousOutPoint]); err != nil {
+						return err
+					}
+					continue
+				}
+				if w.signer != nil && keys[txIn.PreviousOutPoint] == nil {
+					if err := w.signer.signInput(tx, sigHashes, i, values, prevScripts); err != nil {
+						return err
+					}
+					continue
+				}
+				if err := signInput(tx, sigHashes, i, values, prevScripts, keys[txIn.PreviousOutPoint], w.params()); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Serialize:         utxobase.SerializeWitness,
+		EstimateSize:      w.estimateSize,
+		ChangeScriptSize:  w.changeScriptSize(),
+		EstimationAddress: estimationAddr,
+		Replaceable:       w.rbf,
+		ScriptHashAddress: w.scriptHashAddress,
+		SignScriptInput:   w.signScriptInput,
 	}
-	script, err := txscript.PayToAddrScript(addr)
-	if err != nil {
-		return nil, err
+}
+
+func (w *BitcoinWallet) keyToAddress(key *hdkeychain.ExtendedKey) (iwallet.Address, error) {
+	if w.cosigner != nil {
+		return w.cosignAddress(key)
 	}
-	if txrules.IsDustAmount(btcutil.Amount(amount), len(script), txrules.DefaultRelayFeePerKb) {
-		return nil, errors.New("dust output amount")
+	if w.signer != nil {
+		return w.signerAddress(key)
 	}
+	return w.singleKeyAddress(key)
+}
 
-	var (
-		additionalKeysByScript = make(map[wire.OutPoint]*btcutil.WIF)
-		additionalPrevScripts  = make(map[wire.OutPoint][]byte)
-		inVals                 = make(map[wire.OutPoint]int64)
-	)
+// VerifyVectors checks the wallet derives the published address vectors
+// for its network and address type. Single key addresses are checked even
+// if the wallet's addresses are cosigned or signed externally. Signet
+// addresses are the same as testnet's. There are no regtest vectors.
+func (w *BitcoinWallet) VerifyVectors() error {
+	if w.network == base.NetworkRegtest {
+		return base.ErrNoAddressVectors
+	}
+	return base.VerifyAddressVectors(base.AddressVectorsFor(iwallet.CtBitcoin, w.network.IsTest(), w.addressType), w.singleKeyAddress)
+}
 
-	// Create input source
-	coinKeyMap, err := w.GatherCoins(dbtx)
+// paymentCodeAddress returns the P2PKH address of a payment code key.
+func (w *BitcoinWallet) paymentCodeAddress(pubKey *btcec.PublicKey) (iwallet.Address, error) {
+	addr, err := btcutil.NewAddressPubKeyHash(btcutil.Hash160(pubKey.SerializeCompressed()), w.params())
 	if err != nil {
-		return nil, err
+		return iwallet.Address{}, err
 	}
+	return iwallet.NewAddress(addr.String(), iwallet.CtBitcoin), nil
+}
 
-	allCoins := make([]coinset.Coin, 0, len(coinKeyMap))
-	for coin := range coinKeyMap {
-		allCoins = append(allCoins, coin)
+// singleKeyAddress returns the address of the key for the wallet's address
+// type.
+func (w *BitcoinWallet) singleKeyAddress(key *hdkeychain.ExtendedKey) (iwallet.Address, error) {
+	newKey, err := hdkeychain.NewKeyFromString(key.String())
+	if err != nil {
+		return iwallet.Address{}, err
 	}
-	inputSource := func(target btcutil.Amount) (total btcutil.Amount, inputs []*wire.TxIn, inputValues []btcutil.Amount, scripts [][]byte, err error) {
-		coinSelector := coinset.MaxValueAgeCoinSelector{MaxInputs: 10000, MinChangeAmount: txrules.DefaultRelayFeePerKb}
-		coins, err := coinSelector.CoinSelect(btcutil.Amount(target.ToUnit(btcutil.AmountSatoshi)), allCoins)
+	addr, err := newKey.Address(w.params())
+	if err != nil {
+		return iwallet.Address{}, err
+	}
+	switch w.addressType {
+	case base.AddressTypeTaproot:
+		pubKey, err := newKey.ECPubKey()
 		if err != nil {
-			err = base.ErrInsufficientFunds
-			return
+			return iwallet.Address{}, err
 		}
-		for _, c := range coins.Coins() {
-			total += btcutil.Amount(c.Value().ToUnit(btcutil.AmountSatoshi))
-
-			h, herr := chainhash.NewHashFromStr(c.Hash().String())
-			if herr != nil {
-				err = herr
-				return
-			}
-
-			outpoint := wire.NewOutPoint(h, c.Index())
-
-			in := wire.NewTxIn(outpoint, nil, nil)
-			inputs = append(inputs, in)
-
-			key := coinKeyMap[c]
-			hdKey, kerr := hdkeychain.NewKeyFromString(key.String())
-			if kerr != nil {
-				err = kerr
-				return
-			}
-			privKey, perr := hdKey.ECPrivKey()
-			if perr != nil {
-				err = perr
-				return
-			}
-			wif, werr := btcutil.NewWIF(privKey, w.params(), true)
-			if werr != nil {
-				err = werr
-				return
-			}
-
-			additionalKeysByScript[*outpoint] = wif
-
-			address, derr := btcutil.DecodeAddress(string(c.PkScript()), w.params())
-			if derr != nil {
-				err = derr
-				return
-			}
-
-			script, perr := txscript.PayToAddrScript(address)
-			if perr != nil {
-				err = perr
-				return
-			}
-
-			additionalPrevScripts[*outpoint] = script
-
-			sat := c.Value().ToUnit(btcutil.AmountSatoshi)
-			inVals[*outpoint] = int64(sat)
+		outputKey, err := taprootOutputKey(pubKey)
+		if err != nil {
+			return iwallet.Address{}, err
 		}
-		return total, inputs, inputValues, scripts, nil
-	}
-
-	// Get the fee per kilobyte
-	fpb, err := w.feeProvider.GetFee(feeLevel)
-	if err != nil {
-		return nil, err
-	}
-	feePerKB := fpb.Int64() * 1000
-
-	// outputs
-	out := wire.NewTxOut(amount, script)
-
-	// Create change source
-	changeSource := func() ([]byte, error) {
-		iaddr, err := w.Keychain.CurrentAddressWithTx(dbtx, true)
+		taprootAddr, err := encodeTaprootAddress(xOnly(outputKey), w.params())
 		if err != nil {
-			return nil, err
+			return iwallet.Address{}, err
 		}
-
-		addr, err := btcutil.DecodeAddress(iaddr.String(), w.params())
+		return iwallet.NewAddress(taprootAddr, iwallet.CtBitcoin), nil
+	case base.AddressTypeLegacy:
+		return iwallet.NewAddress(addr.String(), iwallet.CtBitcoin), nil
+	case base.AddressTypeNestedSegwit:
+		witnessProgram, err := txscript.NewScriptBuilder().AddOp(txscript.OP_0).AddData(addr.ScriptAddress()).Script()
 		if err != nil {
-			return nil, err
+			return iwallet.Address{}, err
 		}
-
-		script, err := txscript.PayToAddrScript(addr)
+		nestedAddr, err := btcutil.NewAddressScriptHash(witnessProgram, w.params())
 		if err != nil {
-			return nil, err
+			return iwallet.Address{}, err
 		}
-		return script, nil
-	}
-
-	// Build transaction
-	authoredTx, err := txauthor.NewUnsignedTransaction([]*wire.TxOut{out}, btcutil.Amount(feePerKB), inputSource, changeSource)
-	if err != nil {
-		return nil, err
+		return iwallet.NewAddress(nestedAddr.String(), iwallet.CtBitcoin), nil
+	default:
+		witnessAddr, err := btcutil.NewAddressWitnessPubKeyHash(addr.ScriptAddress(), w.params())
+		if err != nil {
+			return iwallet.Address{}, err
+		}
+		return iwallet.NewAddress(witnessAddr.String(), iwallet.CtBitcoin), nil
 	}
+}
 
-	// BIP 69 sorting
-	txsort.InPlaceSort(authoredTx.Tx)
-
-	// Sign tx
-	tx := authoredTx.Tx
-	for i, txIn := range tx.TxIn {
-		prevOutScript := additionalPrevScripts[txIn.PreviousOutPoint]
-		wif := additionalKeysByScript[txIn.PreviousOutPoint]
-
-		script, err := txscript.WitnessSignature(tx, txscript.NewTxSigHashes(tx), i,
-			inVals[txIn.PreviousOutPoint], prevOutScript,
-			txscript.SigHashAll, wif.PrivKey, true)
+// signInput signs the input at the given index. The signature type is selected
+// from the previous output script so that the wallet can spend from any of
+// the address types it supports, regardless of which it currently generates.
+// Taproot signature hashes commit to every input so the previous scripts and
+// values for all inputs are required.
+func signInput(tx *wire.MsgTx, sigHashes *txscript.TxSigHashes, idx int, inVals map[wire.OutPoint]int64, prevScripts map[wire.OutPoint][]byte, key *btcec.PrivateKey, params *chaincfg.Params) error {
+	prevOutScript := prevScripts[tx.TxIn[idx].PreviousOutPoint]
+	amount := inVals[tx.TxIn[idx].PreviousOutPoint]
+
+	switch {
+	case isPayToTaproot(prevOutScript):
+		sigHash, err := taprootSigHash(tx, idx, prevScripts, inVals)
 		if err != nil {
-			return nil, fmt.Errorf("failed to sign transaction: %s", err)
+			return err
+		}
+		// Silent payment outputs pay the key itself rather than its
+		// BIP86 tweak.
+		signingKey := key
+		if !bytes.Equal(xOnly(key.PubKey()), prevOutScript[2:]) {
+			tweaked, err := taprootTweakPrivKey(key)
+			if err != nil {
+				return err
+			}
+			defer base.ZeroPrivKey(tweaked)
+			signingKey = tweaked
 		}
-		tx.TxIn[i].Witness = script
+		sig, err := schnorrSign(signingKey, sigHash)
+		if err != nil {
+			return err
+		}
+		tx.TxIn[idx].Witness = wire.TxWitness{sig}
+	case txscript.IsPayToWitnessPubKeyHash(prevOutScript):
+		witness, err := txscript.WitnessSignature(tx, sigHashes, idx, amount, prevOutScript, txscript.SigHashAll, key, true)
+		if err != nil {
+			return err
+		}
+		tx.TxIn[idx].Witness = witness
+	case txscript.IsPayToScriptHash(prevOutScript):
+		pkh, err := btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(key.PubKey().SerializeCompressed()), params)
+		if err != nil {
+			return err
+		}
+		witnessProgram, err := txscript.PayToAddrScript(pkh)
+		if err != nil {
+			return err
+		}
+		witness, err := txscript.WitnessSignature(tx, sigHashes, idx, amount, witnessProgram, txscript.SigHashAll, key, true)
+		if err != nil {
+			return err
+		}
+		sigScript, err := txscript.NewScriptBuilder().AddData(witnessProgram).Script()
+		if err != nil {
+			return err
+		}
+		tx.TxIn[idx].Witness = witness
+		tx.TxIn[idx].SignatureScript = sigScript
+	default:
+		sigScript, err := txscript.SignatureScript(tx, idx, prevOutScript, txscript.SigHashAll, key, true)
+		if err != nil {
+			return err
+		}
+		tx.TxIn[idx].SignatureScript = sigScript
 	}
-	return tx, nil
+	return nil
 }
 
-func (w *BitcoinWallet) keyToAddress(key *hdkeychain.ExtendedKey) (iwallet.Address, error) {
-	newKey, err := hdkeychain.NewKeyFromString(key.String())
-	if err != nil {
-		return iwallet.Address{}, err
+// normalizeAddress decodes and re-encodes the address so every encoding
+// of it, such as upper case bech32, has the same string.
+func (w *BitcoinWallet) normalizeAddress(addr iwallet.Address) (iwallet.Address, error) {
+	if outputKey, err := decodeTaprootAddress(addr.String(), w.params()); err == nil {
+		encoded, err := encodeTaprootAddress(outputKey, w.params())
+		if err != nil {
+			return iwallet.Address{}, err
+		}
+		return iwallet.NewAddress(encoded, iwallet.CtBitcoin), nil
 	}
-	addr, err := newKey.Address(w.params())
+	address, err := btcutil.DecodeAddress(addr.String(), w.params())
 	if err != nil {
 		return iwallet.Address{}, err
 	}
-	witnessAddr, err := btcutil.NewAddressWitnessPubKeyHash(addr.ScriptAddress(), w.params())
+	return iwallet.NewAddress(address.EncodeAddress(), iwallet.CtBitcoin), nil
+}
+
+// addressToScript returns the output script for the address. The btcutil
+// version we use does not understand bech32m so taproot addresses are
+// decoded separately.
+func (w *BitcoinWallet) addressToScript(addr string) ([]byte, error) {
+	if outputKey, err := decodeTaprootAddress(addr, w.params()); err == nil {
+		return taprootScript(outputKey)
+	}
+	address, err := btcutil.DecodeAddress(addr, w.params())
 	if err != nil {
-		return iwallet.Address{}, err
+		return nil, err
 	}
-	return iwallet.NewAddress(witnessAddr.String(), iwallet.CtBitcoin), nil
+	return txscript.PayToAddrScript(address)
 }
 
 func lockTimeFromRedeemScript(redeemScript []byte) (uint32, error) {
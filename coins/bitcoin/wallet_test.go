@@ -5,6 +5,7 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"github.com/btcsuite/btcd/btcec"
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
@@ -13,21 +14,35 @@ import (
 	"github.com/btcsuite/btcutil"
 	"github.com/btcsuite/btcutil/hdkeychain"
 	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/multiwallet/coins/utxobase"
 	"github.com/cpacia/multiwallet/database"
 	"github.com/cpacia/multiwallet/database/sqlitedb"
+	"github.com/cpacia/multiwallet/log"
 	iwallet "github.com/cpacia/wallet-interface"
 	"github.com/jarcoal/httpmock"
-	"github.com/op/go-logging"
+	"strings"
 	"testing"
 	"time"
 )
 
 func newTestWallet() (*BitcoinWallet, error) {
+	return newTestWalletWithAddressType(base.AddressTypeNativeSegwit)
+}
+
+func newTestWalletWithAddressType(addrType base.AddressType) (*BitcoinWallet, error) {
+	return newTestWalletWithSetup(addrType, nil)
+}
+
+// newTestWalletWithSetup is newTestWalletWithAddressType with a function
+// which configures the wallet before it's created.
+func newTestWalletWithSetup(addrType base.AddressType, setup func(w *BitcoinWallet) error) (*BitcoinWallet, error) {
 	w := &BitcoinWallet{
-		testnet:     true,
+		network:     base.NetworkTestnet,
 		feeURL:      "https://btc.fees.openbazaar.org/",
-		feeProvider: base.NewHardCodedFeeProvider(iwallet.NewAmount(50), iwallet.NewAmount(40), iwallet.NewAmount(30), iwallet.NewAmount(20)),
+		addressType: addrType,
 	}
+	w.FeeProvider = base.NewHardCodedFeeProvider(iwallet.NewAmount(50), iwallet.NewAmount(40), iwallet.NewAmount(30), iwallet.NewAmount(20))
+	w.Chain = w.chain()
 
 	httpmock.RegisterResponder("GET", w.feeURL,
 		httpmock.NewStringResponder(200, `{"priority": 50, "normal": 25, "economic": 12}`))
@@ -44,18 +59,27 @@ func newTestWallet() (*BitcoinWallet, error) {
 
 	w.ChainClient = chainClient
 	w.DB = db
-	w.Logger = logging.MustGetLogger("bchtest")
+	w.Logger = log.New("bchtest")
 	w.CoinType = iwallet.CtBitcoin
 	w.Done = make(chan struct{})
 	w.AddressFunc = w.keyToAddress
 
-	key, err := hdkeychain.NewKeyFromString("tprv8ZgxMBicQKsPeghT19pungdFLMJM2hMs3EEn5WtgobD7wuQSFQu4VNaEJXH9HS3RhhLT4wgZ3hj31m3kafuxhL9vfGTRtBVLSog4zjxW3L1")
-	if err != nil {
-		return nil, err
+	if setup != nil {
+		if err := setup(w); err != nil {
+			return nil, err
+		}
 	}
 
-	if err := w.CreateWallet(*key, nil, time.Now()); err != nil {
-		return nil, err
+	// The setup may have created the wallet itself.
+	if !w.WalletExists() {
+		key, err := hdkeychain.NewKeyFromString("tprv8ZgxMBicQKsPeghT19pungdFLMJM2hMs3EEn5WtgobD7wuQSFQu4VNaEJXH9HS3RhhLT4wgZ3hj31m3kafuxhL9vfGTRtBVLSog4zjxW3L1")
+		if err != nil {
+			return nil, err
+		}
+
+		if err := w.CreateWallet(*key, nil, time.Now()); err != nil {
+			return nil, err
+		}
 	}
 
 	if err := w.OpenWallet(); err != nil {
@@ -136,17 +160,17 @@ func TestBitcoinWallet_EstimateSpendFee(t *testing.T) {
 		{
 			amount:   iwallet.NewAmount(500000),
 			feeLevel: iwallet.FlEconomic,
-			expected: iwallet.NewAmount(2160),
+			expected: iwallet.NewAmount(4230),
 		},
 		{
 			amount:   iwallet.NewAmount(500000),
 			feeLevel: iwallet.FlNormal,
-			expected: iwallet.NewAmount(2880),
+			expected: iwallet.NewAmount(5640),
 		},
 		{
 			amount:   iwallet.NewAmount(500000),
 			feeLevel: iwallet.FlPriority,
-			expected: iwallet.NewAmount(3600),
+			expected: iwallet.NewAmount(7050),
 		},
 		{
 			amount:        iwallet.NewAmount(1000000),
@@ -257,7 +281,7 @@ func TestBitcoinWallet_Spend(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	expected := "5ff7259943524c1f9f91ba5a0497ef84fb1d2a463e5d6ac40a517a82a6dba2d3"
+	expected := "97ab789ec7030bea7a303e056020dec57204610dd7c0e78fc89277040b31b277"
 	if txid.String() != expected {
 		t.Errorf("Expected txid %s, got %s", expected, txid)
 	}
@@ -354,7 +378,7 @@ func TestBitcoinWallet_SweepWallet(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	expected := "8d403b9c2ed2b38cad9949263577b6f9a06c20fbc969d40dea90dffb2fb6a221"
+	expected := "3bdeb3fb2a527c7578272c1dd947de80f35192ab1a3031997888f1177797e874"
 	if txid.String() != expected {
 		t.Errorf("Expected txid %s, got %s", expected, txid)
 	}
@@ -408,32 +432,32 @@ func TestBitcoinWallet_EstimateEscrowFee(t *testing.T) {
 		{
 			threshold: 1,
 			level:     iwallet.FlEconomic,
-			expected:  iwallet.NewAmount(5490),
+			expected:  iwallet.NewAmount(3690),
 		},
 		{
 			threshold: 1,
 			level:     iwallet.FlNormal,
-			expected:  iwallet.NewAmount(7320),
+			expected:  iwallet.NewAmount(4920),
 		},
 		{
 			threshold: 1,
 			level:     iwallet.FlPriority,
-			expected:  iwallet.NewAmount(9150),
+			expected:  iwallet.NewAmount(6150),
 		},
 		{
 			threshold: 2,
 			level:     iwallet.FlEconomic,
-			expected:  iwallet.NewAmount(9510),
+			expected:  iwallet.NewAmount(5520),
 		},
 		{
 			threshold: 2,
 			level:     iwallet.FlNormal,
-			expected:  iwallet.NewAmount(12680),
+			expected:  iwallet.NewAmount(7360),
 		},
 		{
 			threshold: 2,
 			level:     iwallet.FlPriority,
-			expected:  iwallet.NewAmount(15850),
+			expected:  iwallet.NewAmount(9200),
 		},
 	}
 
@@ -1032,7 +1056,7 @@ func TestBitcoinWallet_buildTx(t *testing.T) {
 		outVal = int64(500000)
 	)
 	err = w.DB.View(func(dbtx database.Tx) error {
-		tx, err = w.buildTx(dbtx, outVal, iwallet.NewAddress(payTo.String(), iwallet.CtBitcoin), iwallet.FlNormal)
+		tx, err = w.BuildTx(dbtx, outVal, iwallet.NewAddress(payTo.String(), iwallet.CtBitcoin), iwallet.FlNormal)
 		return err
 	})
 	if err != nil {
@@ -1065,8 +1089,8 @@ func TestBitcoinWallet_buildTx(t *testing.T) {
 	if !paysTo {
 		t.Error("Pay to address not found in transaction")
 	}
-	if totalOut != 997000 {
-		t.Errorf("Expected totalOut of %d, got %d", 997000, totalOut)
+	if totalOut != 994240 {
+		t.Errorf("Expected totalOut of %d, got %d", 994240, totalOut)
 	}
 
 	vm, err := txscript.NewEngine(fromScript, tx, 0, txscript.StandardVerifyFlags, nil, nil, 1000000)
@@ -1077,3 +1101,720 @@ func TestBitcoinWallet_buildTx(t *testing.T) {
 		t.Errorf("Script verificationf failed: %s", err)
 	}
 }
+
+func TestBitcoinWallet_AddressTypes(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	tests := []struct {
+		addrType    base.AddressType
+		prefix      string
+		expectedFee int64
+	}{
+		{
+			addrType:    base.AddressTypeNativeSegwit,
+			prefix:      "tb1q",
+			expectedFee: 5640,
+		},
+		{
+			addrType:    base.AddressTypeNestedSegwit,
+			prefix:      "2",
+			expectedFee: 6560,
+		},
+		{
+			addrType:    base.AddressTypeLegacy,
+			prefix:      "m",
+			expectedFee: 8840,
+		},
+	}
+
+	for i, test := range tests {
+		w, err := newTestWalletWithAddressType(test.addrType)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		addr, err := w.Keychain.CurrentAddress(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if test.prefix == "m" {
+			if addr.String()[0] != 'm' && addr.String()[0] != 'n' {
+				t.Errorf("Test %d: unexpected address %s", i, addr)
+			}
+		} else if !strings.HasPrefix(addr.String(), test.prefix) {
+			t.Errorf("Test %d: unexpected address %s", i, addr)
+		}
+
+		fromAddr, err := btcutil.DecodeAddress(addr.String(), &chaincfg.TestNet3Params)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fromScript, err := txscript.PayToAddrScript(fromAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b := make([]byte, 32)
+		rand.Read(b)
+
+		h, err := chainhash.NewHash(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		op := wire.NewOutPoint(h, 0)
+
+		err = w.DB.Update(func(tx database.Tx) error {
+			return tx.Save(&database.UtxoRecord{
+				Timestamp: time.Now(),
+				Amount:    "1000000",
+				Height:    600000,
+				Coin:      iwallet.CtBitcoin,
+				Address:   addr.String(),
+				Outpoint:  hex.EncodeToString(serializeOutpoint(op)),
+			})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var tx *wire.MsgTx
+		err = w.DB.View(func(dbtx database.Tx) error {
+			tx, err = w.BuildTx(dbtx, 500000, iwallet.NewAddress("tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", iwallet.CtBitcoin), iwallet.FlNormal)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var totalOut int64
+		for _, out := range tx.TxOut {
+			totalOut += out.Value
+		}
+		if fee := 1000000 - totalOut; fee != test.expectedFee {
+			t.Errorf("Test %d: expected fee %d, got %d", i, test.expectedFee, fee)
+		}
+
+		vm, err := txscript.NewEngine(fromScript, tx, 0, txscript.StandardVerifyFlags, nil, nil, 1000000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := vm.Execute(); err != nil {
+			t.Errorf("Test %d: script verification failed: %s", i, err)
+		}
+	}
+}
+
+func TestBitcoinWallet_SpendFrom(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	w, err := newTestWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fundTestWallet(t, w)
+
+	addr, err := w.Keychain.CurrentAddress(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := chainhash.NewHashFromStr("a8c685478265f4c14dada651969c45a65e1aeb8cd6791f2f5bb6a1d9952104d9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	selected := serializeOutpoint(wire.NewOutPoint(h, 1))
+	payTo := iwallet.NewAddress("tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", iwallet.CtBitcoin)
+	err = w.DB.Update(func(tx database.Tx) error {
+		return tx.Save(&database.UtxoRecord{
+			Timestamp: time.Now(),
+			Amount:    "2000000",
+			Height:    600000,
+			Coin:      iwallet.CtBitcoin,
+			Address:   addr.String(),
+			Outpoint:  hex.EncodeToString(selected),
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wtx, err := w.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.SpendFrom(wtx, [][]byte{selected}, []utxobase.Output{{Address: payTo, Amount: iwallet.NewAmount(2500000)}}, iwallet.FlNormal); err != base.ErrInsufficientFunds {
+		t.Errorf("Expected ErrInsufficientFunds, got %v", err)
+	}
+	if _, err := w.SpendFrom(wtx, [][]byte{selected}, []utxobase.Output{{Address: payTo, Amount: iwallet.NewAmount(500000)}}, iwallet.FlNormal); err != nil {
+		t.Fatal(err)
+	}
+	if err := wtx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	txs := loadUnconfirmed(t, w)
+	if len(txs) != 1 {
+		t.Fatalf("Expected 1 tx found %d", len(txs))
+	}
+	var tx wire.MsgTx
+	if err := tx.BtcDecode(bytes.NewReader(txs[0].TxBytes), wire.ProtocolVersion, wire.WitnessEncoding); err != nil {
+		t.Fatal(err)
+	}
+	if len(tx.TxIn) != 1 || !bytes.Equal(serializeOutpoint(&tx.TxIn[0].PreviousOutPoint), selected) {
+		t.Error("Expected only the selected utxo to be spent")
+	}
+
+	if err := w.FreezeUtxo(selected); err != nil {
+		t.Fatal(err)
+	}
+	wtx, err = w.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wtx.Rollback()
+	if _, err := w.SpendFrom(wtx, [][]byte{selected}, []utxobase.Output{{Address: payTo, Amount: iwallet.NewAmount(500000)}}, iwallet.FlNormal); err == nil {
+		t.Error("Expected spending a frozen utxo to fail")
+	}
+}
+
+func TestBitcoinWallet_SpendMulti(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	w, err := newTestWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromScript := fundTestWallet(t, w)
+
+	outputs := []utxobase.Output{
+		{
+			Address: iwallet.NewAddress("tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", iwallet.CtBitcoin),
+			Amount:  iwallet.NewAmount(300000),
+		},
+		{
+			Address: iwallet.NewAddress("mipcBbFg9gMiCh81Kj8tqqdgoZub1ZJRfn", iwallet.CtBitcoin),
+			Amount:  iwallet.NewAmount(200000),
+		},
+	}
+
+	wtx, err := w.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.SpendMulti(wtx, outputs, iwallet.FlNormal); err != nil {
+		t.Fatal(err)
+	}
+	if err := wtx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	txs := loadUnconfirmed(t, w)
+	if len(txs) != 1 {
+		t.Fatalf("Expected 1 tx found %d", len(txs))
+	}
+	var tx wire.MsgTx
+	if err := tx.BtcDecode(bytes.NewReader(txs[0].TxBytes), wire.ProtocolVersion, wire.WitnessEncoding); err != nil {
+		t.Fatal(err)
+	}
+	if len(tx.TxIn) != 1 {
+		t.Errorf("Expected 1 input, got %d", len(tx.TxIn))
+	}
+	// Both payments plus change.
+	if len(tx.TxOut) != 3 {
+		t.Fatalf("Expected 3 outputs, got %d", len(tx.TxOut))
+	}
+	for _, out := range outputs {
+		script, err := w.addressToScript(out.Address.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var found bool
+		for _, txOut := range tx.TxOut {
+			if bytes.Equal(txOut.PkScript, script) && txOut.Value == out.Amount.Int64() {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Output to %s not found", out.Address)
+		}
+	}
+
+	vm, err := txscript.NewEngine(fromScript, &tx, 0, txscript.StandardVerifyFlags, nil, nil, 1000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Execute(); err != nil {
+		t.Errorf("Script verification failed: %s", err)
+	}
+}
+
+func TestBitcoinWallet_SpendWithLockTime(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	w, err := newTestWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fundTestWallet(t, w)
+
+	best, err := w.BlockchainInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lockTime := uint32(best.Height + 100)
+
+	// The transaction must not be broadcast before its lock time.
+	w.ChainClient.(*base.MockChainClient).SetErrorResponse(errors.New("broadcast"))
+
+	wtx, err := w.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputs := []utxobase.Output{{Address: iwallet.NewAddress("tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", iwallet.CtBitcoin), Amount: iwallet.NewAmount(500000)}}
+	txid, err := w.SpendWithLockTime(wtx, outputs, lockTime, iwallet.FlNormal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wtx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	txs := loadUnconfirmed(t, w)
+	if len(txs) != 1 {
+		t.Fatalf("Expected 1 tx found %d", len(txs))
+	}
+	if txs[0].LockTime != lockTime {
+		t.Errorf("Expected saved lock time %d, got %d", lockTime, txs[0].LockTime)
+	}
+	if txs[0].Attempts != 0 {
+		t.Errorf("Expected no broadcast attempts, got %d", txs[0].Attempts)
+	}
+
+	var tx wire.MsgTx
+	if err := tx.BtcDecode(bytes.NewReader(txs[0].TxBytes), wire.ProtocolVersion, wire.WitnessEncoding); err != nil {
+		t.Fatal(err)
+	}
+	if tx.LockTime != lockTime {
+		t.Errorf("Expected lock time %d, got %d", lockTime, tx.LockTime)
+	}
+	for _, in := range tx.TxIn {
+		if in.Sequence == wire.MaxTxInSequenceNum {
+			t.Error("Expected inputs to enable the lock time")
+		}
+	}
+
+	pending, err := w.PendingTransactions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 {
+		t.Fatalf("Expected 1 pending tx, got %d", len(pending))
+	}
+	if pending[0].Txid != txid || pending[0].LockTime != lockTime {
+		t.Errorf("Unexpected pending tx %s with lock time %d", pending[0].Txid, pending[0].LockTime)
+	}
+}
+
+func TestBitcoinWallet_SpendBroadcastError(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	w, err := newTestWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fundTestWallet(t, w)
+
+	// A broadcast failure leaves the spend queued for the rebroadcaster.
+	w.ChainClient.(*base.MockChainClient).SetErrorResponse(errors.New("connection refused"))
+
+	wtx, err := w.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	txid, err := w.Spend(wtx, iwallet.NewAddress("tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", iwallet.CtBitcoin), iwallet.NewAmount(500000), iwallet.FlNormal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wtx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := w.BroadcastStatus(txid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != base.BroadcastQueued {
+		t.Errorf("Expected state queued, got %s", status.State)
+	}
+	if status.Attempts != 1 || status.LastError != "connection refused" {
+		t.Errorf("Expected one failed attempt, got %d attempts with error %q", status.Attempts, status.LastError)
+	}
+	if !status.NextAttempt.After(status.LastAttempt) {
+		t.Error("Expected a retry to be scheduled")
+	}
+}
+
+func TestBitcoinWallet_ChangePolicy(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	w, err := newTestWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sourceScript := fundTestWallet(t, w)
+
+	addr, err := w.Keychain.CurrentAddress(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := chainhash.NewHashFromStr("a8c685478265f4c14dada651969c45a65e1aeb8cd6791f2f5bb6a1d9952104d9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.DB.Update(func(tx database.Tx) error {
+		return tx.Save(&database.UtxoRecord{
+			Timestamp: time.Now(),
+			Amount:    "60000",
+			Height:    600000,
+			Coin:      iwallet.CtBitcoin,
+			Address:   addr.String(),
+			Outpoint:  hex.EncodeToString(serializeOutpoint(wire.NewOutPoint(h, 1))),
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fixedAddr := "mkWqVHGbfpznuu3JpPoXfCnHrhoekJLUGu"
+	fixedScript, err := w.Chain.AddressToScript(fixedAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payTo := iwallet.NewAddress("tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", iwallet.CtBitcoin)
+	payToScript, err := w.Chain.AddressToScript(payTo.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		policy       base.ChangePolicy
+		amount       int64
+		inputs       int
+		changeScript []byte
+	}{
+		{
+			name:         "reuse source",
+			policy:       base.ChangeReuseSource,
+			amount:       500000,
+			inputs:       1,
+			changeScript: sourceScript,
+		},
+		{
+			name:         "fixed address",
+			policy:       base.ChangeFixedAddress,
+			amount:       500000,
+			inputs:       1,
+			changeScript: fixedScript,
+		},
+		{
+			name:   "avoid change",
+			policy: base.ChangeAvoid,
+			amount: 55500,
+			inputs: 1,
+		},
+		{
+			name:   "avoid change not possible",
+			policy: base.ChangeAvoid,
+			amount: 500000,
+			inputs: 1,
+		},
+	}
+	for _, test := range tests {
+		w.ChangePolicy = test.policy
+		w.ChangeAddress = fixedAddr
+		err := w.DB.View(func(dbtx database.Tx) error {
+			tx, err := w.BuildTx(dbtx, test.amount, payTo, iwallet.FlNormal)
+			if err != nil {
+				return err
+			}
+			if len(tx.TxIn) != test.inputs {
+				t.Errorf("%s: expected %d inputs, got %d", test.name, test.inputs, len(tx.TxIn))
+			}
+			var change *wire.TxOut
+			for _, out := range tx.TxOut {
+				if !bytes.Equal(out.PkScript, payToScript) {
+					change = out
+				}
+			}
+			if test.policy == base.ChangeAvoid && test.amount < 60000 {
+				if change != nil {
+					t.Errorf("%s: expected no change output", test.name)
+				}
+				return nil
+			}
+			if change == nil {
+				t.Errorf("%s: expected a change output", test.name)
+				return nil
+			}
+			if test.changeScript != nil && !bytes.Equal(change.PkScript, test.changeScript) {
+				t.Errorf("%s: change paid to the wrong script", test.name)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+	}
+
+	// A P2PKH change output is three bytes larger than P2WPKH.
+	w.ChangePolicy = base.ChangeInternal
+	internalFee, err := w.EstimateSpendFee(iwallet.NewAmount(500000), iwallet.FlNormal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.ChangePolicy = base.ChangeFixedAddress
+	fixedFee, err := w.EstimateSpendFee(iwallet.NewAmount(500000), iwallet.FlNormal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fixedFee.Int64()-internalFee.Int64() != 120 {
+		t.Errorf("Expected fixed address fee to be 120 higher, got %s and %s", fixedFee, internalFee)
+	}
+}
+
+func TestBitcoinWallet_PreventAddressReuse(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	w, err := newTestWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.PreventAddressReuse = true
+	fundTestWallet(t, w)
+
+	changeAddr, err := w.Keychain.CurrentAddress(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payTo := iwallet.NewAddress("tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", iwallet.CtBitcoin)
+	wtx, err := w.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Spend(wtx, payTo, iwallet.NewAmount(500000), iwallet.FlNormal); err != nil {
+		t.Fatal(err)
+	}
+	if err := wtx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	newChangeAddr, err := w.Keychain.CurrentAddress(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newChangeAddr == changeAddr {
+		t.Error("Expected change address to rotate after sending")
+	}
+
+	wtx, err = w.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Spend(wtx, payTo, iwallet.NewAmount(100000), iwallet.FlNormal); err != utxobase.ErrAddressReused {
+		t.Errorf("Expected ErrAddressReused, got %v", err)
+	}
+	if _, err := w.SpendMulti(wtx, []utxobase.Output{{Address: payTo, Amount: iwallet.NewAmount(100000), AllowReuse: true}}, iwallet.FlNormal); err != nil {
+		t.Errorf("Expected override to allow reuse, got %v", err)
+	}
+	wtx.Rollback()
+}
+
+func TestBitcoinWallet_SpendSubtractFee(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	w, err := newTestWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromScript := fundTestWallet(t, w)
+
+	h, err := chainhash.NewHashFromStr("bdb237bf8c5de6b60ba1e2dcfe364fc24f583e568d1682f851a9d0f11a45c78d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payTo := iwallet.NewAddress("tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", iwallet.CtBitcoin)
+
+	wtx, err := w.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputs := []utxobase.Output{{Address: payTo, Amount: iwallet.NewAmount(1000000), SubtractFee: true}}
+	if _, err := w.SpendFrom(wtx, [][]byte{serializeOutpoint(wire.NewOutPoint(h, 0))}, outputs, iwallet.FlNormal); err != nil {
+		t.Fatal(err)
+	}
+	if err := wtx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	txs := loadUnconfirmed(t, w)
+	if len(txs) != 1 {
+		t.Fatalf("Expected 1 tx found %d", len(txs))
+	}
+	var tx wire.MsgTx
+	if err := tx.BtcDecode(bytes.NewReader(txs[0].TxBytes), wire.ProtocolVersion, wire.WitnessEncoding); err != nil {
+		t.Fatal(err)
+	}
+	if len(tx.TxOut) != 1 {
+		t.Fatalf("Expected 1 output, got %d", len(tx.TxOut))
+	}
+	// One p2wpkh input and output at 40 sat/vbyte.
+	expectedFee := int64(110 * 40)
+	if tx.TxOut[0].Value != 1000000-expectedFee {
+		t.Errorf("Expected output of %d, got %d", 1000000-expectedFee, tx.TxOut[0].Value)
+	}
+
+	vm, err := txscript.NewEngine(fromScript, &tx, 0, txscript.StandardVerifyFlags, nil, nil, 1000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Execute(); err != nil {
+		t.Errorf("Script verification failed: %s", err)
+	}
+
+	wtx, err = w.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wtx.Rollback()
+	outputs[0].Amount = iwallet.NewAmount(1000)
+	if _, err := w.SpendMulti(wtx, outputs, iwallet.FlNormal); err == nil {
+		t.Error("Expected output too small for the fee to fail")
+	}
+}
+
+func TestBitcoinWallet_Consolidate(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	w, err := newTestWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fundTestWallet(t, w)
+
+	addr, err := w.Keychain.CurrentAddress(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := chainhash.NewHashFromStr("a8c685478265f4c14dada651969c45a65e1aeb8cd6791f2f5bb6a1d9952104d9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.DB.Update(func(tx database.Tx) error {
+		for i := uint32(0); i < 3; i++ {
+			err := tx.Save(&database.UtxoRecord{
+				Timestamp: time.Now(),
+				Amount:    "10000",
+				Height:    600000,
+				Coin:      iwallet.CtBitcoin,
+				Address:   addr.String(),
+				Outpoint:  hex.EncodeToString(serializeOutpoint(wire.NewOutPoint(h, i))),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := w.PlanConsolidation(iwallet.NewAmount(50000), iwallet.FlEconomic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Outpoints) != 3 {
+		t.Errorf("Expected 3 outpoints, got %d", len(plan.Outpoints))
+	}
+	if plan.Total.Cmp(iwallet.NewAmount(30000)) != 0 {
+		t.Errorf("Expected total of 30000, got %s", plan.Total)
+	}
+	// Three p2wpkh inputs and one output at 30 sat/vbyte.
+	if plan.Fee.Cmp(iwallet.NewAmount(247*30)) != 0 {
+		t.Errorf("Expected fee of %d, got %s", 247*30, plan.Fee)
+	}
+	// Two fewer inputs in a future spend at 40 sat/vbyte, less the fee.
+	if plan.Savings.Cmp(iwallet.NewAmount(137*40-247*30)) != 0 {
+		t.Errorf("Expected savings of %d, got %s", 137*40-247*30, plan.Savings)
+	}
+
+	wtx, err := w.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Consolidate(wtx, iwallet.NewAmount(50000), iwallet.FlEconomic); err != nil {
+		t.Fatal(err)
+	}
+	if err := wtx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	txs := loadUnconfirmed(t, w)
+	if len(txs) != 1 {
+		t.Fatalf("Expected 1 tx found %d", len(txs))
+	}
+	var tx wire.MsgTx
+	if err := tx.BtcDecode(bytes.NewReader(txs[0].TxBytes), wire.ProtocolVersion, wire.WitnessEncoding); err != nil {
+		t.Fatal(err)
+	}
+	if len(tx.TxIn) != 3 || len(tx.TxOut) != 1 {
+		t.Fatalf("Expected 3 inputs and 1 output, got %d and %d", len(tx.TxIn), len(tx.TxOut))
+	}
+	if tx.TxOut[0].Value != 30000-247*30 {
+		t.Errorf("Expected output of %d, got %d", 30000-247*30, tx.TxOut[0].Value)
+	}
+	err = w.DB.View(func(dbtx database.Tx) error {
+		_, err := w.changeOutputIndex(dbtx, tx.TxOut)
+		return err
+	})
+	if err != nil {
+		t.Error("Expected consolidation to pay a change address")
+	}
+
+	if _, err := w.PlanConsolidation(iwallet.NewAmount(10000), iwallet.FlEconomic); err != utxobase.ErrNothingToConsolidate {
+		t.Errorf("Expected ErrNothingToConsolidate, got %v", err)
+	}
+}
+
+func TestBitcoinWallet_VerifyVectors(t *testing.T) {
+	tests := []struct {
+		network  base.Network
+		addrType base.AddressType
+	}{
+		{base.NetworkMainnet, base.AddressTypeNativeSegwit},
+		{base.NetworkMainnet, base.AddressTypeNestedSegwit},
+		{base.NetworkMainnet, base.AddressTypeLegacy},
+		{base.NetworkMainnet, base.AddressTypeTaproot},
+		{base.NetworkTestnet, base.AddressTypeNativeSegwit},
+		{base.NetworkSignet, base.AddressTypeNativeSegwit},
+	}
+	for _, test := range tests {
+		w := &BitcoinWallet{network: test.network, addressType: test.addrType}
+		if err := w.VerifyVectors(); err != nil {
+			t.Errorf("Network %s address type %d: %s", test.network, test.addrType, err)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package bitcoincash
+
+import (
+	"context"
+	"errors"
+	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/multiwallet/coins/utxobase"
+	iwallet "github.com/cpacia/wallet-interface"
+	"github.com/gcash/bchd/chaincfg"
+	"github.com/gcash/bchutil"
+)
+
+// The wallet stores addresses in cashaddr format without the network prefix,
+// which is how its own addresses are derived and how chain clients report
+// them. Addresses given to the wallet may also be in legacy base58 format or
+// carry the prefix so they're converted before being saved or compared.
+
+// CashAddress converts a legacy or cashaddr address, with or without the
+// prefix, to the cashaddr format used by the wallet.
+func CashAddress(addr string, params *chaincfg.Params) (string, error) {
+	decoded, err := bchutil.DecodeAddress(addr, params)
+	if err != nil {
+		return "", err
+	}
+	if !decoded.IsForNet(params) {
+		return "", errors.New("address is for the wrong network")
+	}
+	switch a := decoded.(type) {
+	case *bchutil.LegacyAddressPubKeyHash:
+		decoded, err = bchutil.NewAddressPubKeyHash(a.Hash160()[:], params)
+	case *bchutil.LegacyAddressScriptHash:
+		decoded, err = bchutil.NewAddressScriptHashFromHash(a.Hash160()[:], params)
+	case *bchutil.AddressPubKeyHash, *bchutil.AddressScriptHash:
+	default:
+		return "", errors.New("unsupported address type")
+	}
+	if err != nil {
+		return "", err
+	}
+	return decoded.String(), nil
+}
+
+// LegacyAddress converts a legacy or cashaddr address to legacy base58
+// format for services which don't accept cashaddr.
+func LegacyAddress(addr string, params *chaincfg.Params) (string, error) {
+	decoded, err := bchutil.DecodeAddress(addr, params)
+	if err != nil {
+		return "", err
+	}
+	if !decoded.IsForNet(params) {
+		return "", errors.New("address is for the wrong network")
+	}
+	switch a := decoded.(type) {
+	case *bchutil.AddressPubKeyHash:
+		decoded, err = bchutil.NewLegacyAddressPubKeyHash(a.Hash160()[:], params)
+	case *bchutil.AddressScriptHash:
+		decoded, err = bchutil.NewLegacyAddressScriptHashFromHash(a.Hash160()[:], params)
+	case *bchutil.LegacyAddressPubKeyHash, *bchutil.LegacyAddressScriptHash:
+	default:
+		return "", errors.New("unsupported address type")
+	}
+	if err != nil {
+		return "", err
+	}
+	return decoded.String(), nil
+}
+
+// CashAddress converts the address to the cashaddr format used by the
+// wallet.
+func (w *BitcoinCashWallet) CashAddress(addr iwallet.Address) (iwallet.Address, error) {
+	s, err := CashAddress(addr.String(), w.params())
+	if err != nil {
+		return iwallet.Address{}, err
+	}
+	return iwallet.NewAddress(s, iwallet.CtBitcoinCash), nil
+}
+
+// LegacyAddress converts the address to legacy base58 format.
+func (w *BitcoinCashWallet) LegacyAddress(addr iwallet.Address) (iwallet.Address, error) {
+	s, err := LegacyAddress(addr.String(), w.params())
+	if err != nil {
+		return iwallet.Address{}, err
+	}
+	return iwallet.NewAddress(s, iwallet.CtBitcoinCash), nil
+}
+
+// ValidateAddress returns an error if the address isn't a valid cashaddr or
+// legacy address for the wallet's network.
+func (w *BitcoinCashWallet) ValidateAddress(addr iwallet.Address) error {
+	_, err := w.CashAddress(addr)
+	return err
+}
+
+// HasKey returns true if the wallet can spend from the address, which may
+// be in either format.
+func (w *BitcoinCashWallet) HasKey(addr iwallet.Address) (bool, error) {
+	canonical, err := w.CashAddress(addr)
+	if err != nil {
+		return false, nil
+	}
+	return w.Wallet.HasKey(canonical)
+}
+
+// WatchAddress watches the addresses in cashaddr format.
+func (w *BitcoinCashWallet) WatchAddress(tx iwallet.Tx, addrs ...iwallet.Address) error {
+	canonical, err := w.cashAddresses(addrs)
+	if err != nil {
+		return err
+	}
+	return w.Wallet.WatchAddress(tx, canonical...)
+}
+
+// GetAddressTransactions returns the transactions sending to or spending
+// from the address, which may be in either format.
+func (w *BitcoinCashWallet) GetAddressTransactions(addr iwallet.Address) ([]iwallet.Transaction, error) {
+	canonical, err := w.CashAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	return w.Wallet.GetAddressTransactions(canonical)
+}
+
+// SetAddressLabel labels one of the wallet's addresses, which may be in
+// either format.
+func (w *BitcoinCashWallet) SetAddressLabel(addr iwallet.Address, label, notes string) error {
+	canonical, err := w.CashAddress(addr)
+	if err != nil {
+		return err
+	}
+	return w.Wallet.SetAddressLabel(canonical, label, notes)
+}
+
+// Spend sends amt to the address, which may be in either format.
+func (w *BitcoinCashWallet) Spend(wtx iwallet.Tx, to iwallet.Address, amt iwallet.Amount, feeLevel iwallet.FeeLevel) (iwallet.TransactionID, error) {
+	return w.SpendMultiContext(context.Background(), wtx, []utxobase.Output{{Address: to, Amount: amt}}, feeLevel)
+}
+
+// SpendContext is Spend with the transaction built under ctx.
+func (w *BitcoinCashWallet) SpendContext(ctx context.Context, wtx iwallet.Tx, to iwallet.Address, amt iwallet.Amount, feeLevel iwallet.FeeLevel) (iwallet.TransactionID, error) {
+	return w.SpendMultiContext(ctx, wtx, []utxobase.Output{{Address: to, Amount: amt}}, feeLevel)
+}
+
+// SpendMulti pays each of the outputs, whose addresses may be in either
+// format, in a single transaction.
+func (w *BitcoinCashWallet) SpendMulti(wtx iwallet.Tx, outputs []utxobase.Output, feeLevel iwallet.FeeLevel) (iwallet.TransactionID, error) {
+	return w.SpendMultiContext(context.Background(), wtx, outputs, feeLevel)
+}
+
+// SpendMultiContext is SpendMulti with the transaction built under ctx.
+func (w *BitcoinCashWallet) SpendMultiContext(ctx context.Context, wtx iwallet.Tx, outputs []utxobase.Output, feeLevel iwallet.FeeLevel) (iwallet.TransactionID, error) {
+	canonical := make([]utxobase.Output, len(outputs))
+	for i, out := range outputs {
+		canonical[i] = out
+		if out.Data != nil {
+			continue
+		}
+		addr, err := w.CashAddress(out.Address)
+		if err != nil {
+			return "", err
+		}
+		canonical[i].Address = addr
+	}
+	return w.Wallet.SpendMultiContext(ctx, wtx, canonical, feeLevel)
+}
+
+// cashAddresses converts each of the addresses to cashaddr format.
+func (w *BitcoinCashWallet) cashAddresses(addrs []iwallet.Address) ([]iwallet.Address, error) {
+	canonical := make([]iwallet.Address, 0, len(addrs))
+	for _, addr := range addrs {
+		c, err := w.CashAddress(addr)
+		if err != nil {
+			return nil, err
+		}
+		canonical = append(canonical, c)
+	}
+	return canonical, nil
+}
+
+// SweepWallet sweeps the balance to the address, which may be in either
+// format.
+func (w *BitcoinCashWallet) SweepWallet(wtx iwallet.Tx, to iwallet.Address, level iwallet.FeeLevel) (iwallet.TransactionID, error) {
+	return w.SweepWalletContext(context.Background(), wtx, to, level)
+}
+
+// SweepWalletContext is SweepWallet with the transaction built under ctx.
+func (w *BitcoinCashWallet) SweepWalletContext(ctx context.Context, wtx iwallet.Tx, to iwallet.Address, level iwallet.FeeLevel) (iwallet.TransactionID, error) {
+	canonical, err := w.CashAddress(to)
+	if err != nil {
+		return "", err
+	}
+	return w.Wallet.SweepWalletContext(ctx, wtx, canonical, level)
+}
+
+// SetAddressPolicy adds the addresses, which may be in either format, to
+// the allow or deny list in cashaddr format.
+func (w *BitcoinCashWallet) SetAddressPolicy(policy base.AddressPolicy, reason string, addrs ...iwallet.Address) error {
+	canonical, err := w.cashAddresses(addrs)
+	if err != nil {
+		return err
+	}
+	return w.Wallet.SetAddressPolicy(policy, reason, canonical...)
+}
+
+// RemoveAddressPolicy removes the addresses, which may be in either
+// format, from the allow or deny list.
+func (w *BitcoinCashWallet) RemoveAddressPolicy(addrs ...iwallet.Address) error {
+	canonical, err := w.cashAddresses(addrs)
+	if err != nil {
+		return err
+	}
+	return w.Wallet.RemoveAddressPolicy(canonical...)
+}
+
+// CheckDestinations checks the addresses, which may be in either format,
+// against the address policy.
+func (w *BitcoinCashWallet) CheckDestinations(addrs ...iwallet.Address) error {
+	canonical, err := w.cashAddresses(addrs)
+	if err != nil {
+		return err
+	}
+	return w.Wallet.CheckDestinations(canonical...)
+}
@@ -0,0 +1,236 @@
+package bitcoincash
+
+import (
+	"errors"
+	"github.com/btcsuite/btcd/btcec"
+	iwallet "github.com/cpacia/wallet-interface"
+	"github.com/gcash/bchd/bchec"
+	"github.com/gcash/bchd/txscript"
+	"github.com/gcash/bchd/wire"
+	"sort"
+)
+
+// This file contains the parts of the escrow implementation which depend on
+// the signature scheme. Bitcoin Cash accepts both schnorr and ECDSA
+// signatures. OP_CHECKSIG takes either but OP_CHECKMULTISIG requires every
+// signature in a spend to use the same scheme: ECDSA with a null dummy
+// element, or schnorr with the dummy set to a bitfield of the signing keys.
+//
+// Escrows created with the EscrowCheckSig option avoid that restriction by
+// checking each key with its own OP_CHECKSIG and counting the results:
+//
+//   <key 1> OP_CHECKSIG
+//   OP_SWAP <key 2> OP_CHECKSIG OP_ADD
+//   ...
+//   OP_SWAP <key n> OP_CHECKSIG OP_ADD
+//   <threshold> OP_NUMEQUAL
+//
+// Keys which didn't sign are given an empty signature, which makes
+// OP_CHECKSIG push false without failing the script.
+
+const (
+	// schnorrSigSize is the size of a schnorr signature without the
+	// sighash type.
+	schnorrSigSize = 64
+
+	// maxECDSASigSize is the size of the largest DER encoded ECDSA
+	// signature without the sighash type.
+	maxECDSASigSize = 72
+
+	escrowSigHashType = txscript.SigHashAll | txscript.SigHashForkID
+)
+
+var errMixedSignatures = errors.New("OP_CHECKMULTISIG escrows can't mix schnorr and ECDSA signatures")
+
+// escrowSig is an escrow signature matched with the key which made it.
+type escrowSig struct {
+	keyIndex  int
+	signature []byte
+	schnorr   bool
+}
+
+// signEscrowInput signs input idx of an escrow spend with the wallet's
+// escrow signature scheme. The sighash type is left off the signature and
+// added by BuildAndSend.
+func (w *BitcoinCashWallet) signEscrowInput(tx *wire.MsgTx, idx int, redeemScript []byte, key *bchec.PrivateKey, amt int64) ([]byte, error) {
+	var (
+		sig []byte
+		err error
+	)
+	if w.escrowECDSA {
+		sig, err = txscript.RawTxInECDSASignature(tx, idx, redeemScript, txscript.SigHashAll, key, amt)
+	} else {
+		sig, err = txscript.RawTxInSchnorrSignature(tx, idx, redeemScript, txscript.SigHashAll, key, amt)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sig[:len(sig)-1], nil
+}
+
+// escrowInputSize returns the serialized size of an input spending an m of n
+// escrow created and signed with the wallet's escrow options. ECDSA
+// signatures vary in size so the largest is assumed.
+func (w *BitcoinCashWallet) escrowInputSize(m, n int) int {
+	sigSize := 1 + schnorrSigSize + 1
+	if w.escrowECDSA {
+		sigSize = 1 + maxECDSASigSize + 1
+	}
+
+	var redeemScriptSize, scriptSigSize int
+	if w.escrowCheckSig {
+		// The first key check, n-1 further checks, the threshold and
+		// OP_NUMEQUAL. Keys which didn't sign cost one byte.
+		redeemScriptSize = 35 + (n-1)*37 + 2
+		scriptSigSize = m*sigSize + (n - m)
+	} else {
+		// The ECDSA dummy is OP_0, the schnorr dummy a one byte push.
+		redeemScriptSize = 1 + n*(1+33) + 1 + 1
+		scriptSigSize = 2 + m*sigSize
+		if w.escrowECDSA {
+			scriptSigSize = 1 + m*sigSize
+		}
+	}
+	scriptSigSize += pushSize(redeemScriptSize) + redeemScriptSize
+
+	// outpoint, script length, script and sequence
+	return 36 + wire.VarIntSerializeSize(uint64(scriptSigSize)) + scriptSigSize + 4
+}
+
+// checkSigEscrowScript returns the redeem script for a threshold of keys
+// checked with one OP_CHECKSIG each.
+func checkSigEscrowScript(keys []btcec.PublicKey, threshold int) ([]byte, error) {
+	builder := txscript.NewScriptBuilder()
+	for i, key := range keys {
+		if i > 0 {
+			builder.AddOp(txscript.OP_SWAP)
+		}
+		builder.AddData(key.SerializeCompressed())
+		builder.AddOp(txscript.OP_CHECKSIG)
+		if i > 0 {
+			builder.AddOp(txscript.OP_ADD)
+		}
+	}
+	builder.AddInt64(int64(threshold))
+	builder.AddOp(txscript.OP_NUMEQUAL)
+	return builder.Script()
+}
+
+// isCheckSigEscrow returns whether the redeem script was built by
+// checkSigEscrowScript.
+func isCheckSigEscrow(redeemScript []byte) bool {
+	n := len(redeemScript)
+	return n > 2 && redeemScript[n-1] == txscript.OP_NUMEQUAL
+}
+
+// checkSigThreshold returns the number of signatures required by a
+// checkSigEscrowScript.
+func checkSigThreshold(redeemScript []byte) (int, error) {
+	op := redeemScript[len(redeemScript)-2]
+	if op < txscript.OP_1 || op > txscript.OP_16 {
+		return 0, errors.New("invalid escrow threshold")
+	}
+	return int(op-txscript.OP_1) + 1, nil
+}
+
+// parseEscrowSignature parses a signature without its sighash type. As in
+// the consensus rules, 64 byte signatures are schnorr and anything else
+// is DER encoded ECDSA.
+func parseEscrowSignature(sig []byte) (*bchec.Signature, bool, error) {
+	if len(sig) == schnorrSigSize {
+		parsed, err := bchec.ParseSchnorrSignature(sig)
+		return parsed, true, err
+	}
+	parsed, err := bchec.ParseDERSignature(sig, bchec.S256())
+	return parsed, false, err
+}
+
+// matchEscrowSignatures returns the signatures for input idx sorted by the
+// index of the key in the redeem script which made them. The signatures
+// don't say which key they belong to so each is verified against the keys
+// to find out.
+func matchEscrowSignatures(signatures [][]iwallet.EscrowSignature, idx int, sigHash []byte, pubkeys []*bchec.PublicKey) ([]escrowSig, error) {
+	var (
+		matched []escrowSig
+		used    = make(map[int]bool)
+	)
+	for _, indexSig := range signatures {
+		for _, sig := range indexSig {
+			if sig.Index != idx {
+				continue
+			}
+			parsed, schnorr, err := parseEscrowSignature(sig.Signature)
+			if err != nil {
+				return nil, err
+			}
+			keyIndex := -1
+			for i, key := range pubkeys {
+				if !used[i] && parsed.Verify(sigHash, key) {
+					keyIndex = i
+					break
+				}
+			}
+			if keyIndex < 0 {
+				return nil, errors.New("signatures do not match public keys")
+			}
+			used[keyIndex] = true
+			matched = append(matched, escrowSig{keyIndex: keyIndex, signature: sig.Signature, schnorr: schnorr})
+			break
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].keyIndex < matched[j].keyIndex
+	})
+	return matched, nil
+}
+
+// addMultisigSignatures adds the dummy element and signatures needed by
+// OP_CHECKMULTISIG to the builder.
+func addMultisigSignatures(builder *txscript.ScriptBuilder, sigs []escrowSig) error {
+	schnorr := len(sigs) == 0 || sigs[0].schnorr
+	for _, sig := range sigs {
+		if sig.schnorr != schnorr {
+			return errMixedSignatures
+		}
+	}
+
+	if schnorr {
+		var checkBits byte
+		for _, sig := range sigs {
+			checkBits |= 1 << uint(sig.keyIndex)
+		}
+		builder.AddData([]byte{checkBits})
+	} else {
+		builder.AddOp(txscript.OP_0)
+	}
+	for _, sig := range sigs {
+		builder.AddData(withSigHashType(sig.signature))
+	}
+	return nil
+}
+
+// addCheckSigSignatures adds one signature per key of a checkSigEscrowScript
+// to the builder. They're pushed in reverse so the first key's signature is
+// on top of the stack.
+func addCheckSigSignatures(builder *txscript.ScriptBuilder, sigs []escrowSig, nKeys, threshold int) error {
+	if len(sigs) < threshold {
+		return errors.New("not enough signatures")
+	}
+	// Any more than the threshold would make OP_NUMEQUAL fail.
+	byKey := make(map[int][]byte)
+	for _, sig := range sigs[:threshold] {
+		byKey[sig.keyIndex] = sig.signature
+	}
+	for i := nKeys - 1; i >= 0; i-- {
+		if sig, ok := byKey[i]; ok {
+			builder.AddData(withSigHashType(sig))
+		} else {
+			builder.AddOp(txscript.OP_0)
+		}
+	}
+	return nil
+}
+
+func withSigHashType(sig []byte) []byte {
+	return append(append([]byte{}, sig...), byte(escrowSigHashType))
+}
@@ -0,0 +1,203 @@
+package bitcoincash
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"github.com/btcsuite/btcd/btcec"
+	iwallet "github.com/cpacia/wallet-interface"
+	"github.com/gcash/bchd/chaincfg/chainhash"
+	"github.com/gcash/bchd/txscript"
+	"github.com/gcash/bchd/wire"
+	"github.com/gcash/bchutil"
+	"testing"
+)
+
+func TestBitcoinCashWallet_EscrowSignatureTypes(t *testing.T) {
+	var keys []*btcec.PrivateKey
+	for _, k := range []string{
+		"84c8a01a81bf562aafafd4a9fccda533b33d6382b984c081a8cb7817bf909c18",
+		"c68ab7796c52952a062b4c875c758ae3831448240fb58c152cc58a224d6ad3b8",
+		"0404e6967fc6c638564d4c381e299636fd01fdbcaaaa28e540647c928b44d39b",
+	} {
+		b, err := hex.DecodeString(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, _ := btcec.PrivKeyFromBytes(btcec.S256(), b)
+		keys = append(keys, key)
+	}
+
+	h, err := chainhash.NewHashFromStr("bdb237bf8c5de6b60ba1e2dcfe364fc24f583e568d1682f851a9d0f11a45c78d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := wire.NewOutPoint(h, 0).Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	tx := iwallet.Transaction{
+		From: []iwallet.SpendInfo{
+			{
+				ID:     buf.Bytes(),
+				Amount: iwallet.NewAmount(1000000),
+			},
+		},
+		To: []iwallet.SpendInfo{
+			{
+				Amount:  iwallet.NewAmount(900000),
+				Address: iwallet.NewAddress("qrk0e04s67l9mf20jvae6fznht04rej57sf8jz2nua", iwallet.CtBitcoinCash),
+			},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		checkSig  bool
+		nKeys     int
+		threshold int
+		// ecdsa selects the signature type of each signer. Signer i
+		// uses key i and the signatures are passed in reverse order.
+		ecdsa      []bool
+		expectFail bool
+	}{
+		{
+			name:      "multisig ECDSA",
+			nKeys:     3,
+			threshold: 2,
+			ecdsa:     []bool{true, true},
+		},
+		{
+			name:       "multisig mixed",
+			nKeys:      3,
+			threshold:  2,
+			ecdsa:      []bool{false, true},
+			expectFail: true,
+		},
+		{
+			name:      "checksig schnorr",
+			checkSig:  true,
+			nKeys:     3,
+			threshold: 2,
+			ecdsa:     []bool{false, false},
+		},
+		{
+			name:      "checksig mixed",
+			checkSig:  true,
+			nKeys:     3,
+			threshold: 2,
+			ecdsa:     []bool{false, true},
+		},
+		{
+			name:      "checksig extra signature",
+			checkSig:  true,
+			nKeys:     3,
+			threshold: 2,
+			ecdsa:     []bool{true, false, true},
+		},
+		{
+			name:      "checksig 1 of 2 ECDSA",
+			checkSig:  true,
+			nKeys:     2,
+			threshold: 1,
+			ecdsa:     []bool{true},
+		},
+		{
+			name:       "checksig not enough signatures",
+			checkSig:   true,
+			nKeys:      3,
+			threshold:  2,
+			ecdsa:      []bool{true},
+			expectFail: true,
+		},
+	}
+
+	for _, test := range tests {
+		w, err := newTestWallet()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.escrowCheckSig = test.checkSig
+
+		var pubkeys []btcec.PublicKey
+		for _, key := range keys[:test.nKeys] {
+			pubkeys = append(pubkeys, *key.PubKey())
+		}
+		_, redeemScript, err := w.CreateMultisigAddress(pubkeys, test.threshold)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isCheckSigEscrow(redeemScript) != test.checkSig {
+			t.Errorf("%s: unexpected redeem script %x", test.name, redeemScript)
+		}
+
+		var sigs [][]iwallet.EscrowSignature
+		for i, ecdsa := range test.ecdsa {
+			w.escrowECDSA = ecdsa
+			sig, err := w.SignMultisigTransaction(tx, *keys[i], redeemScript)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (len(sig[0].Signature) == schnorrSigSize) == ecdsa {
+				t.Errorf("%s: signer %d made the wrong signature type", test.name, i)
+			}
+			sigs = append([][]iwallet.EscrowSignature{sig}, sigs...)
+		}
+
+		wtx, err := w.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = w.BuildAndSend(wtx, tx, sigs, redeemScript)
+		if test.expectFail {
+			if err == nil {
+				t.Errorf("%s: expected error", test.name)
+			}
+			wtx.Rollback()
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if err := wtx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		txs, err := w.DB.Store().ListUnconfirmed(context.Background(), iwallet.CtBitcoinCash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(txs) != 1 {
+			t.Fatalf("%s: expected 1 tx found %d", test.name, len(txs))
+		}
+		var msgTx wire.MsgTx
+		if err := msgTx.BchDecode(bytes.NewReader(txs[0].TxBytes), wire.ProtocolVersion, wire.BaseEncoding); err != nil {
+			t.Fatal(err)
+		}
+
+		scriptAddr, err := bchutil.NewAddressScriptHash(redeemScript, w.params())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fromScript, err := txscript.PayToAddrScript(scriptAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vm, err := txscript.NewEngine(fromScript, &msgTx, 0, txscript.StandardVerifyFlags, nil, nil, 1000000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := vm.Execute(); err != nil {
+			t.Errorf("%s: script verification failed: %s", test.name, err)
+		}
+
+		// The fee estimate must cover the largest ECDSA signatures.
+		w.escrowECDSA = false
+		for _, ecdsa := range test.ecdsa {
+			w.escrowECDSA = w.escrowECDSA || ecdsa
+		}
+		if size := msgTx.TxIn[0].SerializeSize(); size > w.escrowInputSize(test.threshold, test.nKeys) {
+			t.Errorf("%s: input size %d larger than estimate %d", test.name, size, w.escrowInputSize(test.threshold, test.nKeys))
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package bitcoincash
+
+import (
+	"bytes"
+	"github.com/btcsuite/btcd/btcec"
+	btcwire "github.com/btcsuite/btcd/wire"
+	"github.com/cpacia/multiwallet/coins/utxobase"
+	"github.com/gcash/bchd/bchec"
+	"github.com/gcash/bchd/txscript"
+	"github.com/gcash/bchd/wire"
+	"github.com/gcash/bchutil"
+)
+
+// scriptHashAddress returns the cashaddr P2SH address of the redeem script.
+func (w *BitcoinCashWallet) scriptHashAddress(script []byte) (string, error) {
+	addr, err := bchutil.NewAddressScriptHash(script, w.params())
+	if err != nil {
+		return "", err
+	}
+	return addr.String(), nil
+}
+
+// signScriptInput signs a P2SH input with an ECDSA signature using the
+// bitcoin cash signature hash algorithm.
+func (w *BitcoinCashWallet) signScriptInput(tx *btcwire.MsgTx, idx int, script []byte, amount int64, key *btcec.PrivateKey) ([]byte, error) {
+	ser, err := utxobase.SerializeBase(tx)
+	if err != nil {
+		return nil, err
+	}
+	bchTx := wire.NewMsgTx(wire.TxVersion)
+	if err := bchTx.Deserialize(bytes.NewReader(ser)); err != nil {
+		return nil, err
+	}
+	priv, _ := bchec.PrivKeyFromBytes(bchec.S256(), key.Serialize())
+	sig, err := txscript.RawTxInECDSASignature(bchTx, idx, script, txscript.SigHashAll, priv, amount)
+	priv.D.SetInt64(0)
+	if err != nil {
+		return nil, err
+	}
+	return append(sig[:len(sig)-1], byte(escrowSigHashType)), nil
+}
@@ -2,28 +2,27 @@ package bitcoincash
 
 import (
 	"bytes"
-	"encoding/hex"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/btcsuite/btcd/btcec"
-	"github.com/btcsuite/btcutil"
-	"github.com/btcsuite/btcutil/coinset"
+	btcwire "github.com/btcsuite/btcd/wire"
 	btchd "github.com/btcsuite/btcutil/hdkeychain"
 	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/multiwallet/client"
 	"github.com/cpacia/multiwallet/client/bchd"
+	"github.com/cpacia/multiwallet/client/blockbook"
+	"github.com/cpacia/multiwallet/coins/utxobase"
 	"github.com/cpacia/multiwallet/database"
 	iwallet "github.com/cpacia/wallet-interface"
 	"github.com/gcash/bchd/bchec"
 	"github.com/gcash/bchd/blockchain"
 	"github.com/gcash/bchd/chaincfg"
-	"github.com/gcash/bchd/chaincfg/chainhash"
 	"github.com/gcash/bchd/txscript"
 	"github.com/gcash/bchd/wire"
 	"github.com/gcash/bchutil"
 	"github.com/gcash/bchutil/hdkeychain"
 	"github.com/gcash/bchutil/txsort"
-	"github.com/gcash/bchwallet/wallet/txauthor"
-	"github.com/gcash/bchwallet/wallet/txrules"
 	"github.com/gcash/bchwallet/wallet/txsizes"
 	"time"
 )
@@ -47,25 +46,53 @@ const (
 // BitcoinCashWallet extends wallet base and implements the
 // remaining functions for each interface.
 type BitcoinCashWallet struct { // nolint
-	base.WalletBase
-	testnet     bool
-	feeProvider base.FeeProvider
+	utxobase.Wallet
+	network        base.Network
+	escrowECDSA    bool
+	escrowCheckSig bool
 }
 
 // NewBitcoinCashWallet returns a new BitcoinCashWallet. This constructor
 // attempts to connect to the API. If it fails, it will not build.
 func NewBitcoinCashWallet(cfg *base.WalletConfig) (*BitcoinCashWallet, error) {
 	w := &BitcoinCashWallet{
-		testnet: cfg.Testnet,
+		network:        cfg.SelectedNetwork(),
+		escrowECDSA:    cfg.EscrowECDSA,
+		escrowCheckSig: cfg.EscrowCheckSig,
+	}
+	if w.network == base.NetworkSignet {
+		return nil, base.UnsupportedNetwork(iwallet.CtBitcoinCash, w.network)
+	}
+
+	chainClient, err := newChainClient(cfg.ClientURL)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.FallbackClientURLs) > 0 {
+		clients := []base.ChainClient{chainClient}
+		for _, u := range cfg.FallbackClientURLs {
+			c, err := newChainClient(u)
+			if err != nil {
+				return nil, err
+			}
+			clients = append(clients, c)
+		}
+		chainClient = base.NewFailoverClient(clients, iwallet.CtBitcoinCash, cfg.Logger)
 	}
 
-	chainClient, err := bchd.NewBchdClient(cfg.ClientURL)
+	chainClient, err = client.WithVerification(chainClient, cfg.VerifyClientURL, iwallet.CtBitcoinCash, cfg.Logger)
 	if err != nil {
 		return nil, err
 	}
 
-	fp := base.NewExchangeRateFeeProvider(iwallet.CtBitcoinCash, divisibility, cfg.ExchangeRateProvider, averageTransactionSize,
+	var fp base.FeeProvider = base.NewExchangeRateFeeProvider(iwallet.CtBitcoinCash, divisibility, cfg.ExchangeRateProvider, averageTransactionSize,
 		iwallet.NewAmount(maxFeePerByte), priorityTarget, normalTarget, economicTarget, superEconomicTarget)
+	if netFP := w.network.DefaultFeeProvider(); netFP != nil {
+		fp = netFP
+	}
+	if cfg.FeeProvider != nil {
+		fp = cfg.FeeProvider
+	}
 
 	w.ChainClient = chainClient
 	w.DB = cfg.DB
@@ -73,287 +100,72 @@ func NewBitcoinCashWallet(cfg *base.WalletConfig) (*BitcoinCashWallet, error) {
 	w.CoinType = iwallet.CtBitcoinCash
 	w.Done = make(chan struct{})
 	w.AddressFunc = w.keyToAddress
-	w.feeProvider = fp
+	w.GapLimit = cfg.GapLimit
+	w.KeychainOpts = append(cfg.KeychainOptions(), base.PaymentCodes(w.paymentCodeAddress))
+	w.Prune = cfg.Prune
+	w.Confirmations = cfg.Confirmations
+	w.SpendPolicy = cfg.SpendPolicy
+	w.FeeProvider = fp
+	w.Chain = w.chain()
+	w.KeychainOpts = append(w.KeychainOpts, base.IndexScripts(w.Chain.AddressToScript))
+	w.ChangePolicy = cfg.ChangePolicy
+	w.ChangeAddress = cfg.ChangeAddress
+	w.PreventAddressReuse = cfg.PreventAddressReuse
+	w.DeterministicBuilds = cfg.DeterministicBuilds
+	w.SeparateSources = cfg.SeparateUtxoSources
 	return w, nil
 }
 
-// ValidateAddress validates that the serialization of the address is correct
-// for this coin and network. It returns an error if it isn't.
-func (w *BitcoinCashWallet) ValidateAddress(addr iwallet.Address) error {
-	_, err := bchutil.DecodeAddress(addr.String(), w.params())
-	return err
-}
-
-// IsDust returns whether the amount passed in is considered dust by network. This
-// method is called when building payout transactions from the multisig to the various
-// participants. If the amount that is supposed to be sent to a given party is below
-// the dust threshold, openbazaar-go will not pay that party to avoid building a transaction
-// that never confirms.
-func (w *BitcoinCashWallet) IsDust(amount iwallet.Amount) bool {
-	return txrules.IsDustAmount(bchutil.Amount(amount.Int64()), 25, txrules.DefaultRelayFeePerKb)
-}
-
-// EstimateSpendFee should return the anticipated fee to transfer a given amount of coins
-// out of the wallet at the provided fee level. Typically this involves building a
-// transaction with enough inputs to cover the request amount and calculating the size
-// of the transaction. It is OK, if a transaction comes in after this function is called
-// that changes the estimated fee as it's only intended to be an estimate.
-//
-// All amounts should be in the coin's base unit (for example: satoshis).
-func (w *BitcoinCashWallet) EstimateSpendFee(amount iwallet.Amount, feeLevel iwallet.FeeLevel) (iwallet.Amount, error) {
-	amt := iwallet.NewAmount(0)
-	err := w.DB.Update(func(dbtx database.Tx) error {
-		// Since this is an estimate we can use a dummy output address. Let's use a long one so we don't under estimate.
-		addrStr := "qzc3v2xhklaa7wzfjha9lut4e0ytj6z6rypk6fce4m"
-		if w.testnet {
-			addrStr = "mkWqVHGbfpznuu3JpPoXfCnHrhoekJLUGu"
-		}
-		tx, err := w.buildTx(dbtx, amount.Int64(), iwallet.NewAddress(addrStr, iwallet.CtBitcoinCash), feeLevel)
-		if err != nil {
-			return err
-		}
-		var outval int64
-		for _, output := range tx.TxOut {
-			outval += output.Value
-		}
-		var utxoRecords []database.UtxoRecord
-		err = dbtx.Read().Where("coin = ?", w.CoinType.CurrencyCode()).Find(&utxoRecords).Error
-		if err != nil {
-			return err
-		}
-
-		var inval int64
-		for _, input := range tx.TxIn {
-			for _, utxo := range utxoRecords {
-				var op wire.OutPoint
-				ser, err := hex.DecodeString(utxo.Outpoint)
-				if err != nil {
-					return err
-				}
-				if err := op.Deserialize(bytes.NewReader(ser)); err != nil {
-					return err
-				}
-
-				if op.Hash.IsEqual(&input.PreviousOutPoint.Hash) && op.Index == input.PreviousOutPoint.Index {
-					inval += iwallet.NewAmount(utxo.Amount).Int64()
-					break
-				}
-			}
-		}
-		if inval < outval {
-			return errors.New("error building transaction: inputs less than outputs")
-		}
-		amt = iwallet.NewAmount(inval - outval)
-		return nil
-	})
-	return amt, err
-}
-
-// Spend is a request to send requested amount to the requested address. The
-// fee level is provided by the user. It's up to the implementation to decide
-// how best to use the fee level.
-//
-// The database Tx MUST be respected. When this function is called the wallet
-// state changes should be prepped and held in memory. If Rollback() is called
-// the state changes should be discarded. Only when Commit() is called should
-// the state changes be applied and the transaction broadcasted to the network.
-func (w *BitcoinCashWallet) Spend(wtx iwallet.Tx, to iwallet.Address, amt iwallet.Amount, feeLevel iwallet.FeeLevel) (iwallet.TransactionID, error) {
-	var (
-		txid iwallet.TransactionID
-		buf  bytes.Buffer
-	)
-	err := w.DB.View(func(dbtx database.Tx) error {
-		tx, err := w.buildTx(dbtx, amt.Int64(), to, feeLevel)
-		if err != nil {
-			return err
-		}
-		txid = iwallet.TransactionID(tx.TxHash().String())
-		if err := tx.BchEncode(&buf, wire.ProtocolVersion, wire.BaseEncoding); err != nil {
-			return err
-		}
-		return nil
-	})
-
-	wbtx, ok := wtx.(*base.DBTx)
-	if !ok {
-		return txid, errors.New("tx is not expected type")
-	}
-
-	wbtx.OnCommit = func() error {
-		return w.DB.Update(func(dbtx database.Tx) error {
-			err := dbtx.Save(&database.UnconfirmedTransaction{
-				Timestamp: time.Now(),
-				Coin:      iwallet.CtBitcoinCash,
-				TxBytes:   buf.Bytes(),
-				Txid:      txid.String(),
-			})
-			if err != nil {
-				return err
-			}
-			return w.ChainClient.Broadcast(buf.Bytes())
-		})
-	}
-	return txid, err
-}
-
-// SweepWallet should sweep the full balance of the wallet to the requested
-// address. It is expected for most coins that the fee will be subtracted
-// from the amount sent rather than added to it.
-func (w *BitcoinCashWallet) SweepWallet(wtx iwallet.Tx, to iwallet.Address, level iwallet.FeeLevel) (iwallet.TransactionID, error) {
-	var (
-		txid iwallet.TransactionID
-		buf  bytes.Buffer
-	)
-	err := w.DB.Update(func(dbtx database.Tx) error {
-		var (
-			totalIn               bchutil.Amount
-			tx                    = wire.NewMsgTx(1)
-			keyMap                = make(map[string]*btcec.PrivateKey)
-			additionalPrevScripts = make(map[wire.OutPoint][]byte)
-			inVals                = make(map[wire.OutPoint]int64)
-		)
-
-		coinMap, err := w.GatherCoins(dbtx)
-		if err != nil {
-			return err
-		}
-
-		for coin, key := range coinMap {
-			h, err := chainhash.NewHashFromStr(coin.Hash().String())
-			if err != nil {
-				return err
-			}
-			op := wire.NewOutPoint(h, coin.Index())
-			tx.AddTxIn(wire.NewTxIn(op, nil))
-			totalIn += bchutil.Amount(coin.Value().ToUnit(btcutil.AmountSatoshi))
-
-			inVals[*op] = int64(coin.Value())
-
-			priv, err := key.ECPrivKey()
-			if err != nil {
-				return err
-			}
-			keyMap[string(coin.PkScript())] = priv
-
-			address, err := bchutil.DecodeAddress(string(coin.PkScript()), w.params())
-			if err != nil {
-				return err
-			}
-
-			script, err := txscript.PayToAddrScript(address)
-			if err != nil {
-				return err
-			}
-
-			additionalPrevScripts[*op] = script
-		}
-		addr, err := bchutil.DecodeAddress(to.String(), w.params())
-		if err != nil {
-			return err
-		}
-
-		script, err := txscript.PayToAddrScript(addr)
-		if err != nil {
-			return err
-		}
-
-		tx.AddTxOut(wire.NewTxOut(0, script))
-
-		size := txsizes.EstimateSerializeSize(len(tx.TxIn), tx.TxOut, false)
-		fpb, err := w.feeProvider.GetFee(level)
-		if err != nil {
-			return err
-		}
-		fee := fpb.Mul(iwallet.NewAmount(size)).Int64()
-
-		tx.TxOut[0].Value = int64(totalIn) - fee
-
-		// BIP 69 sorting
-		txsort.InPlaceSort(tx)
-
-		// Sign tx
-		getKey := txscript.KeyClosure(func(addr bchutil.Address) (*bchec.PrivateKey, bool, error) {
-			addrStr := addr.EncodeAddress()
-			key := keyMap[addrStr]
-
-			priv, _ := bchec.PrivKeyFromBytes(bchec.S256(), key.Serialize())
-
-			return priv, true, nil
-		})
-
-		getScript := txscript.ScriptClosure(func(
-			addr bchutil.Address) ([]byte, error) {
-			return nil, nil
-		})
-
-		for i, txIn := range tx.TxIn {
-			prevOutScript := additionalPrevScripts[txIn.PreviousOutPoint]
-
-			script, err := txscript.SignTxOutput(w.params(),
-				tx, i, inVals[txIn.PreviousOutPoint], prevOutScript,
-				txscript.SigHashAll, getKey, getScript, txIn.SignatureScript)
-			if err != nil {
-				return errors.New("failed to sign transaction")
-			}
-			txIn.SignatureScript = script
-		}
-
-		txid = iwallet.TransactionID(tx.TxHash().String())
-		if err := tx.BchEncode(&buf, wire.ProtocolVersion, wire.BaseEncoding); err != nil {
-			return err
-		}
-
-		return nil
-	})
-
-	wbtx, ok := wtx.(*base.DBTx)
-	if !ok {
-		return txid, errors.New("tx is not expected type")
+// newChainClient returns the client for the URL. bchd remains the default
+// backend. A Blockbook websocket URL selects the shared Blockbook client
+// instead.
+func newChainClient(clientURL string) (base.ChainClient, error) {
+	if blockbook.IsWebsocketURL(clientURL) {
+		return client.NewChainClient(clientURL, iwallet.CtBitcoinCash)
 	}
-
-	wbtx.OnCommit = func() error {
-		return w.DB.Update(func(dbtx database.Tx) error {
-			err := dbtx.Save(&database.UnconfirmedTransaction{
-				Timestamp: time.Now(),
-				Coin:      iwallet.CtBitcoinCash,
-				TxBytes:   buf.Bytes(),
-				Txid:      txid.String(),
-			})
-			if err != nil {
-				return err
-			}
-			return w.ChainClient.Broadcast(buf.Bytes())
-		})
-	}
-
-	return txid, err
+	return bchd.NewBchdClient(clientURL)
 }
 
 // EstimateEscrowFee estimates the fee to release the funds from escrow.
 // this assumes only one input. If there are more inputs OpenBazaar will
 // will add 50% of the returned fee for each additional input. This is a
 // crude fee calculating but it simplifies things quite a bit.
+//
+// The number of keys in the escrow isn't known here so threshold+1 is
+// assumed, which covers the 1 of 2 and 2 of 3 escrows OpenBazaar creates.
 func (w *BitcoinCashWallet) EstimateEscrowFee(threshold int, level iwallet.FeeLevel) (iwallet.Amount, error) {
-	var (
-		nOuts            = 2
-		redeemScriptSize = 4 + (threshold+1)*34
-	)
+	if threshold < 1 || threshold > 7 {
+		return iwallet.NewAmount(0), errors.New("invalid escrow threshold")
+	}
+	nOuts := 2
 	if threshold == 1 {
 		nOuts = 1
 	}
 
 	// 8 additional bytes are for version and locktime
 	size := 8 + wire.VarIntSerializeSize(1) +
-		wire.VarIntSerializeSize(uint64(nOuts)) + 1 +
-		threshold*66 + txsizes.P2PKHOutputSize*nOuts + redeemScriptSize
+		wire.VarIntSerializeSize(uint64(nOuts)) +
+		w.escrowInputSize(threshold, threshold+1) + txsizes.P2PKHOutputSize*nOuts
 
-	fpb, err := w.feeProvider.GetFee(level)
+	fpb, err := w.FeeProvider.GetFee(level)
 	if err != nil {
 		return iwallet.NewAmount(0), err
 	}
 	return fpb.Mul(iwallet.NewAmount(size)), nil
 }
 
+// pushSize returns the size of the opcode(s) needed to push n bytes.
+func pushSize(n int) int {
+	switch {
+	case n <= txscript.OP_DATA_75:
+		return 1
+	case n <= 0xff:
+		return 2
+	default:
+		return 3
+	}
+}
+
 // CreateMultisigAddress creates a new threshold multisig address using the
 // provided pubkeys and the threshold. The multisig address is returned along
 // with a byte slice. The byte slice will typically be the redeem script for
@@ -370,6 +182,9 @@ func (w *BitcoinCashWallet) EstimateEscrowFee(threshold int, level iwallet.FeeLe
 // also uses 1 of 2 multisigs as a form of a "cancelable" address when sending to
 // a node that is offline. This allows the sender to cancel the payment if the vendor
 // never comes back online.
+//
+// If the wallet was configured with EscrowCheckSig the keys are checked with
+// one OP_CHECKSIG each so the parties may sign with schnorr or ECDSA.
 func (w *BitcoinCashWallet) CreateMultisigAddress(keys []btcec.PublicKey, threshold int) (iwallet.Address, []byte, error) {
 	if len(keys) < threshold {
 		return iwallet.Address{}, nil, fmt.Errorf("unable to generate multisig script with "+
@@ -382,15 +197,22 @@ func (w *BitcoinCashWallet) CreateMultisigAddress(keys []btcec.PublicKey, thresh
 			"more than 8 public keys")
 	}
 
-	builder := txscript.NewScriptBuilder()
-	builder.AddInt64(int64(threshold))
-	for _, key := range keys {
-		builder.AddData(key.SerializeCompressed())
+	var (
+		redeemScript []byte
+		err          error
+	)
+	if w.escrowCheckSig {
+		redeemScript, err = checkSigEscrowScript(keys, threshold)
+	} else {
+		builder := txscript.NewScriptBuilder()
+		builder.AddInt64(int64(threshold))
+		for _, key := range keys {
+			builder.AddData(key.SerializeCompressed())
+		}
+		builder.AddInt64(int64(len(keys)))
+		builder.AddOp(txscript.OP_CHECKMULTISIG)
+		redeemScript, err = builder.Script()
 	}
-	builder.AddInt64(int64(len(keys)))
-	builder.AddOp(txscript.OP_CHECKMULTISIG)
-
-	redeemScript, err := builder.Script()
 	if err != nil {
 		return iwallet.Address{}, nil, err
 	}
@@ -409,43 +231,27 @@ func (w *BitcoinCashWallet) CreateMultisigAddress(keys []btcec.PublicKey, thresh
 //
 // For coins like bitcoin you may need to return one signature *per input* which is
 // why a slice of signatures is returned.
+//
+// The signatures are schnorr unless the wallet was configured with
+// EscrowECDSA.
 func (w *BitcoinCashWallet) SignMultisigTransaction(txn iwallet.Transaction, key btcec.PrivateKey, redeemScript []byte) ([]iwallet.EscrowSignature, error) {
-	var sigs []iwallet.EscrowSignature
-	tx := wire.NewMsgTx(1)
-	for _, from := range txn.From {
-		op := wire.OutPoint{}
-		if err := op.Deserialize(bytes.NewReader(from.ID)); err != nil {
-			return nil, err
-		}
-
-		input := wire.NewTxIn(&op, nil)
-		tx.TxIn = append(tx.TxIn, input)
+	if err := w.CheckEscrowRelease(redeemScript); err != nil {
+		return nil, err
 	}
-	for _, to := range txn.To {
-		addr, err := bchutil.DecodeAddress(to.Address.String(), w.params())
-		if err != nil {
-			return nil, err
-		}
-
-		scriptPubkey, err := txscript.PayToAddrScript(addr)
-		if err != nil {
-			return nil, err
-		}
-		output := wire.NewTxOut(to.Amount.Int64(), scriptPubkey)
-		tx.TxOut = append(tx.TxOut, output)
+	var sigs []iwallet.EscrowSignature
+	tx, values, err := w.buildEscrowTx(txn, 1)
+	if err != nil {
+		return nil, err
 	}
 
-	// BIP 69 sorting
-	txsort.InPlaceSort(tx)
-
 	privKey, _ := bchec.PrivKeyFromBytes(bchec.S256(), key.Serialize())
 
 	for i := range tx.TxIn {
-		sig, err := txscript.RawTxInSchnorrSignature(tx, i, redeemScript, txscript.SigHashAll, privKey, txn.From[i].Amount.Int64())
+		sig, err := w.signEscrowInput(tx, i, redeemScript, privKey, values[i])
 		if err != nil {
 			return nil, err
 		}
-		bs := iwallet.EscrowSignature{Index: i, Signature: sig[:64]}
+		bs := iwallet.EscrowSignature{Index: i, Signature: sig}
 		sigs = append(sigs, bs)
 	}
 	return sigs, nil
@@ -459,32 +265,27 @@ func (w *BitcoinCashWallet) SignMultisigTransaction(txn iwallet.Transaction, key
 //
 // Note a database transaction is used here. Same rules of Commit() and
 // Rollback() apply.
+//
+// Signatures may be schnorr or ECDSA. OP_CHECKMULTISIG escrows need all
+// signatures for an input to use the same scheme.
 func (w *BitcoinCashWallet) BuildAndSend(wtx iwallet.Tx, txn iwallet.Transaction, signatures [][]iwallet.EscrowSignature, redeemScript []byte) (iwallet.TransactionID, error) {
-	tx := wire.NewMsgTx(1)
-	for _, from := range txn.From {
-		op := wire.OutPoint{}
-		if err := op.Deserialize(bytes.NewReader(from.ID)); err != nil {
-			return iwallet.TransactionID(""), err
-		}
-		input := wire.NewTxIn(&op, nil)
-		tx.TxIn = append(tx.TxIn, input)
-	}
-	for _, to := range txn.To {
-		addr, err := bchutil.DecodeAddress(to.Address.String(), w.params())
-		if err != nil {
-			return iwallet.TransactionID(""), err
-		}
+	return w.BuildAndSendContext(context.Background(), wtx, txn, signatures, redeemScript)
+}
 
-		scriptPubkey, err := txscript.PayToAddrScript(addr)
-		if err != nil {
-			return iwallet.TransactionID(""), err
-		}
-		output := wire.NewTxOut(to.Amount.Int64(), scriptPubkey)
-		tx.TxOut = append(tx.TxOut, output)
+// BuildAndSendContext is like BuildAndSend but returns ctx.Err(), without
+// setting the commit hook, if ctx is done by the time the transaction is
+// built. Begin wtx with BeginContext for the commit to be bound to ctx too.
+func (w *BitcoinCashWallet) BuildAndSendContext(ctx context.Context, wtx iwallet.Tx, txn iwallet.Transaction, signatures [][]iwallet.EscrowSignature, redeemScript []byte) (iwallet.TransactionID, error) {
+	if err := w.CheckEscrowRelease(redeemScript); err != nil {
+		return "", err
+	}
+	if err := w.CheckDestinations(base.PaidAddresses(txn)...); err != nil {
+		return "", err
+	}
+	tx, values, err := w.buildEscrowTx(txn, 1)
+	if err != nil {
+		return iwallet.TransactionID(""), err
 	}
-
-	// BIP 69 sorting
-	txsort.InPlaceSort(tx)
 
 	// Check if time locked
 	var timeLocked bool
@@ -509,66 +310,33 @@ func (w *BitcoinCashWallet) BuildAndSend(wtx iwallet.Tx, txn iwallet.Transaction
 		return iwallet.TransactionID(""), errors.New("too many pubkeys in redeem script")
 	}
 
-	for i := range tx.TxIn {
-		// The primary challenge for us here is matching signatures with public keys from
-		// the redeem script. The Bitcoin Cash schnorr signature specification requires
-		// that we enumerate the indexes of the public keys for which we are providing a
-		// signature. To do this we will validate the signature against the public keys
-		// to figure out the key index.
-		var (
-			parsedSigs []*bchec.Signature
-			escrowSigs []iwallet.EscrowSignature
-		)
-
-		for _, indexSig := range signatures {
-			for _, sig := range indexSig {
-				if sig.Index == i {
-					escrowSigs = append(escrowSigs, sig)
-					break
-				}
-			}
-		}
-
-		for _, sig := range escrowSigs {
-			parsedSig, err := bchec.ParseSchnorrSignature(sig.Signature)
-			if err != nil {
-				return iwallet.TransactionID(""), err
-			}
-			parsedSigs = append(parsedSigs, parsedSig)
-		}
-
-		pubkeyIndexes := make([]int, 0, len(parsedSigs))
-
-		sigHash, err := txscript.CalcSignatureHash(redeemScript, txscript.NewTxSigHashes(tx), txscript.SigHashAll|txscript.SigHashForkID, tx, i, txn.From[i].Amount.Int64(), true)
+	threshold := 0
+	if isCheckSigEscrow(redeemScript) {
+		threshold, err = checkSigThreshold(redeemScript)
 		if err != nil {
 			return iwallet.TransactionID(""), err
 		}
+	}
 
-		for _, parsedSig := range parsedSigs {
-			for i, key := range pubkeys {
-				if parsedSig.Verify(sigHash, key) {
-					pubkeyIndexes = append(pubkeyIndexes, i)
-					break
-				}
-			}
-		}
-
-		if len(pubkeyIndexes) != len(parsedSigs) {
-			return iwallet.TransactionID(""), errors.New("signatures do not match public keys")
+	for i := range tx.TxIn {
+		sigHash, err := txscript.CalcSignatureHash(redeemScript, txscript.NewTxSigHashes(tx), escrowSigHashType, tx, i, values[i], true)
+		if err != nil {
+			return iwallet.TransactionID(""), err
 		}
 
-		var (
-			dummy = make([]byte, 1)
-			mask  = 0x80
-		)
-		for _, idx := range pubkeyIndexes {
-			dummy[0] |= byte(mask >> uint(8-(idx+1)))
+		sigs, err := matchEscrowSignatures(signatures, i, sigHash, pubkeys)
+		if err != nil {
+			return iwallet.TransactionID(""), err
 		}
 
 		builder := txscript.NewScriptBuilder()
-		builder.AddData(dummy)
-		for _, sig := range escrowSigs {
-			builder.AddData(append(sig.Signature, byte(txscript.SigHashAll|txscript.SigHashForkID)))
+		if threshold > 0 {
+			err = addCheckSigSignatures(builder, sigs, len(pubkeys), threshold)
+		} else {
+			err = addMultisigSignatures(builder, sigs)
+		}
+		if err != nil {
+			return iwallet.TransactionID(""), err
 		}
 
 		if timeLocked {
@@ -583,34 +351,7 @@ func (w *BitcoinCashWallet) BuildAndSend(wtx iwallet.Tx, txn iwallet.Transaction
 		tx.TxIn[i].SignatureScript = scriptSig
 	}
 
-	txid := iwallet.TransactionID(tx.TxHash().String())
-
-	var buf bytes.Buffer
-	if err := tx.BchEncode(&buf, wire.ProtocolVersion, wire.BaseEncoding); err != nil {
-		return txid, err
-	}
-
-	wbtx, ok := wtx.(*base.DBTx)
-	if !ok {
-		return txid, errors.New("tx is not expected type")
-	}
-
-	wbtx.OnCommit = func() error {
-		return w.DB.Update(func(dbtx database.Tx) error {
-			err := dbtx.Save(&database.UnconfirmedTransaction{
-				Timestamp: time.Now(),
-				Coin:      iwallet.CtBitcoinCash,
-				TxBytes:   buf.Bytes(),
-				Txid:      tx.TxHash().String(),
-			})
-			if err != nil {
-				return err
-			}
-			return w.ChainClient.Broadcast(buf.Bytes())
-		})
-	}
-
-	return txid, nil
+	return w.broadcastEscrowTx(ctx, wtx, tx)
 }
 
 // CreateMultisigWithTimeout is the same as CreateMultisigAddress but it adds
@@ -660,31 +401,32 @@ func (w *BitcoinCashWallet) CreateMultisigWithTimeout(keys []btcec.PublicKey, th
 // ReleaseFundsAfterTimeout will release funds from the escrow. The signature will
 // be created using the timeoutKey.
 func (w *BitcoinCashWallet) ReleaseFundsAfterTimeout(wtx iwallet.Tx, txn iwallet.Transaction, timeoutKey btcec.PrivateKey, redeemScript []byte) (iwallet.TransactionID, error) {
-	tx := wire.NewMsgTx(2)
-	for _, from := range txn.From {
-		op := wire.OutPoint{}
-		if err := op.Deserialize(bytes.NewReader(from.ID)); err != nil {
-			return iwallet.TransactionID(""), err
-		}
-		input := wire.NewTxIn(&op, nil)
-		tx.TxIn = append(tx.TxIn, input)
-	}
-	for _, to := range txn.To {
-		addr, err := bchutil.DecodeAddress(to.Address.String(), w.params())
-		if err != nil {
-			return iwallet.TransactionID(""), err
-		}
+	return w.ReleaseFundsAfterTimeoutContext(context.Background(), wtx, txn, timeoutKey, redeemScript)
+}
 
-		scriptPubkey, err := txscript.PayToAddrScript(addr)
-		if err != nil {
-			return iwallet.TransactionID(""), err
-		}
-		output := wire.NewTxOut(to.Amount.Int64(), scriptPubkey)
-		tx.TxOut = append(tx.TxOut, output)
+// ReleaseFundsAfterTimeoutContext is like ReleaseFundsAfterTimeout but
+// returns ctx.Err(), without setting the commit hook, if ctx is done by the
+// time the transaction is signed.
+func (w *BitcoinCashWallet) ReleaseFundsAfterTimeoutContext(ctx context.Context, wtx iwallet.Tx, txn iwallet.Transaction, timeoutKey btcec.PrivateKey, redeemScript []byte) (iwallet.TransactionID, error) {
+	if err := w.CheckEscrowRelease(redeemScript); err != nil {
+		return "", err
+	}
+	if len(redeemScript) == 0 || redeemScript[0] != txscript.OP_IF {
+		return iwallet.TransactionID(""), errors.New("redeem script does not have a timeout")
+	}
+	elems, err := txscript.ExtractDataElements(redeemScript)
+	if err != nil {
+		return iwallet.TransactionID(""), err
+	}
+	if len(elems) == 0 || !bytes.Equal(elems[len(elems)-1], timeoutKey.PubKey().SerializeCompressed()) {
+		return iwallet.TransactionID(""), errors.New("timeout key does not match redeem script")
 	}
 
-	// BIP 69 sorting
-	txsort.InPlaceSort(tx)
+	// CSV requires version 2 transactions.
+	tx, values, err := w.buildEscrowTx(txn, 2)
+	if err != nil {
+		return iwallet.TransactionID(""), err
+	}
 
 	privKey, _ := bchec.PrivKeyFromBytes(bchec.S256(), timeoutKey.Serialize())
 
@@ -696,8 +438,10 @@ func (w *BitcoinCashWallet) ReleaseFundsAfterTimeout(wtx iwallet.Tx, txn iwallet
 		tx.TxIn[i].Sequence = locktime
 	}
 
+	// The sequence numbers are committed to by the signature so they
+	// must all be set before any input is signed.
 	for i := range tx.TxIn {
-		sig, err := txscript.RawTxInSchnorrSignature(tx, i, redeemScript, txscript.SigHashAll, privKey, txn.From[i].Amount.Int64())
+		sig, err := txscript.RawTxInSchnorrSignature(tx, i, redeemScript, txscript.SigHashAll, privKey, values[i])
 		if err != nil {
 			return iwallet.TransactionID(""), err
 		}
@@ -712,7 +456,63 @@ func (w *BitcoinCashWallet) ReleaseFundsAfterTimeout(wtx iwallet.Tx, txn iwallet
 		tx.TxIn[i].SignatureScript = scriptSig
 	}
 
+	return w.broadcastEscrowTx(ctx, wtx, tx)
+}
+
+// buildEscrowTx builds the unsigned transaction spending txn from an escrow
+// address. The inputs and outputs are BIP 69 sorted so that every party
+// signs the same transaction regardless of the order they were given in.
+// The input values are returned in the sorted order.
+func (w *BitcoinCashWallet) buildEscrowTx(txn iwallet.Transaction, version int32) (*wire.MsgTx, []int64, error) {
+	tx := wire.NewMsgTx(version)
+	amounts := make(map[wire.OutPoint]int64)
+	for _, from := range txn.From {
+		op := wire.OutPoint{}
+		if err := op.Deserialize(bytes.NewReader(from.ID)); err != nil {
+			return nil, nil, err
+		}
+		if _, ok := amounts[op]; ok {
+			return nil, nil, errors.New("duplicate input")
+		}
+		amounts[op] = from.Amount.Int64()
+
+		input := wire.NewTxIn(&op, nil)
+		tx.TxIn = append(tx.TxIn, input)
+	}
+	for _, to := range txn.To {
+		addr, err := bchutil.DecodeAddress(to.Address.String(), w.params())
+		if err != nil {
+			return nil, nil, err
+		}
+
+		scriptPubkey, err := txscript.PayToAddrScript(addr)
+		if err != nil {
+			return nil, nil, err
+		}
+		output := wire.NewTxOut(to.Amount.Int64(), scriptPubkey)
+		tx.TxOut = append(tx.TxOut, output)
+	}
+
+	// BIP 69 sorting
+	txsort.InPlaceSort(tx)
+
+	values := make([]int64, len(tx.TxIn))
+	for i, in := range tx.TxIn {
+		values[i] = amounts[in.PreviousOutPoint]
+	}
+	return tx, values, nil
+}
+
+// broadcastEscrowTx sets the commit hook on wtx to save the signed escrow
+// transaction as unconfirmed and broadcast it. The wallet history picks the
+// transaction up from the chain client if it pays to one of our addresses.
+// The save is bound to wtx's context and the transaction is only broadcast
+// once saved.
+func (w *BitcoinCashWallet) broadcastEscrowTx(ctx context.Context, wtx iwallet.Tx, tx *wire.MsgTx) (iwallet.TransactionID, error) {
 	txid := iwallet.TransactionID(tx.TxHash().String())
+	if err := ctx.Err(); err != nil {
+		return txid, err
+	}
 
 	var buf bytes.Buffer
 	if err := tx.BchEncode(&buf, wire.ProtocolVersion, wire.BaseEncoding); err != nil {
@@ -725,181 +525,110 @@ func (w *BitcoinCashWallet) ReleaseFundsAfterTimeout(wtx iwallet.Tx, txn iwallet
 	}
 
 	wbtx.OnCommit = func() error {
-		return w.DB.Update(func(dbtx database.Tx) error {
-			err := dbtx.Save(&database.UnconfirmedTransaction{
-				Timestamp: time.Now(),
-				Coin:      iwallet.CtBitcoinCash,
-				TxBytes:   buf.Bytes(),
-				Txid:      tx.TxHash().String(),
-			})
-			if err != nil {
-				return err
-			}
-			return w.ChainClient.Broadcast(buf.Bytes())
+		err := w.DB.Store().SaveUnconfirmed(wbtx.Context(), &database.UnconfirmedTransaction{
+			Timestamp: time.Now(),
+			Coin:      iwallet.CtBitcoinCash,
+			TxBytes:   buf.Bytes(),
+			Txid:      tx.TxHash().String(),
 		})
+		if err != nil {
+			return err
+		}
+		w.BroadcastOrQueue(txid, buf.Bytes())
+		return nil
 	}
 
 	return txid, nil
 }
 
 func (w *BitcoinCashWallet) params() *chaincfg.Params {
-	if w.testnet {
+	switch w.network {
+	case base.NetworkTestnet:
 		return &chaincfg.TestNet3Params
+	case base.NetworkRegtest:
+		return &chaincfg.RegressionNetParams
 	}
 	return &chaincfg.MainNetParams
 }
 
-func (w *BitcoinCashWallet) buildTx(dbtx database.Tx, amount int64, iaddr iwallet.Address, feeLevel iwallet.FeeLevel) (*wire.MsgTx, error) {
-	// Check for dust
-	addr, err := bchutil.DecodeAddress(iaddr.String(), w.params())
-	if err != nil {
-		return nil, err
-	}
-	script, err := txscript.PayToAddrScript(addr)
-	if err != nil {
-		return nil, err
-	}
-	if txrules.IsDustAmount(bchutil.Amount(amount), len(script), txrules.DefaultRelayFeePerKb) {
-		return nil, errors.New("dust output amount")
-	}
-
-	var (
-		additionalKeysByAddress = make(map[string]*bchutil.WIF)
-		additionalPrevScripts   = make(map[wire.OutPoint][]byte)
-		inVals                  = make(map[wire.OutPoint]int64)
-	)
-
-	// Create input source
-	coinKeyMap, err := w.GatherCoins(dbtx)
-	if err != nil {
-		return nil, err
-	}
-
-	allCoins := make([]coinset.Coin, 0, len(coinKeyMap))
-	for coin := range coinKeyMap {
-		allCoins = append(allCoins, coin)
-	}
-	inputSource := func(target bchutil.Amount) (total bchutil.Amount, inputs []*wire.TxIn, inputValues []bchutil.Amount, scripts [][]byte, err error) {
-		coinSelector := coinset.MaxValueAgeCoinSelector{MaxInputs: 10000, MinChangeAmount: btcutil.Amount(txrules.DefaultRelayFeePerKb)}
-		coins, err := coinSelector.CoinSelect(btcutil.Amount(target.ToUnit(bchutil.AmountSatoshi)), allCoins)
-		if err != nil {
-			err = base.ErrInsufficientFunds
-			return
-		}
-		for _, c := range coins.Coins() {
-			total += bchutil.Amount(c.Value().ToUnit(btcutil.AmountSatoshi))
-
-			h, herr := chainhash.NewHashFromStr(c.Hash().String())
-			if herr != nil {
-				err = herr
-				return
+// chain returns the bitcoin cash specific functions used by the utxobase
+// wallet. The utxobase wallet builds transactions using the btcd types. The
+// serialization is the same for bitcoin cash so transactions are converted
+// to the bchd types when signing.
+func (w *BitcoinCashWallet) chain() *utxobase.Chain {
+	// Since this is an estimate we can use a dummy output address. Let's use a long one so we don't under estimate.
+	estimationAddr := "qzc3v2xhklaa7wzfjha9lut4e0ytj6z6rypk6fce4m"
+	if w.network.IsTest() {
+		estimationAddr = "mkWqVHGbfpznuu3JpPoXfCnHrhoekJLUGu"
+	}
+	return &utxobase.Chain{
+		AddressToScript: w.addressToScript,
+		SignTx:          w.signTx,
+		Serialize:       utxobase.SerializeBase,
+		EstimateSize: func(prevScripts [][]byte, outputs []*btcwire.TxOut, addChange bool) int {
+			outs := make([]*wire.TxOut, 0, len(outputs))
+			for _, out := range outputs {
+				outs = append(outs, wire.NewTxOut(out.Value, out.PkScript))
 			}
-
-			outpoint := wire.NewOutPoint(h, c.Index())
-
-			in := wire.NewTxIn(outpoint, nil)
-			inputs = append(inputs, in)
-
-			key := coinKeyMap[c]
-			hdKey, kerr := hdkeychain.NewKeyFromString(key.String())
-			if kerr != nil {
-				err = kerr
-				return
-			}
-			privKey, perr := hdKey.ECPrivKey()
-			if perr != nil {
-				err = perr
-				return
-			}
-			wif, werr := bchutil.NewWIF(privKey, w.params(), true)
-			if werr != nil {
-				err = werr
-				return
-			}
-
-			additionalKeysByAddress[string(c.PkScript())] = wif
-
-			address, derr := bchutil.DecodeAddress(string(c.PkScript()), w.params())
-			if derr != nil {
-				err = derr
-				return
-			}
-
-			script, perr := txscript.PayToAddrScript(address)
-			if perr != nil {
-				err = perr
-				return
-			}
-
-			additionalPrevScripts[*outpoint] = script
-
-			sat := c.Value().ToUnit(btcutil.AmountSatoshi)
-			inVals[*outpoint] = int64(sat)
-		}
-		return total, inputs, inputValues, scripts, nil
+			return txsizes.EstimateSerializeSize(len(prevScripts), outs, addChange)
+		},
+		ChangeScriptSize:  txsizes.P2PKHPkScriptSize,
+		EstimationAddress: estimationAddr,
+		ScriptHashAddress: w.scriptHashAddress,
+		SignScriptInput:   w.signScriptInput,
 	}
+}
 
-	// Get the fee per kilobyte
-	fpb, err := w.feeProvider.GetFee(feeLevel)
+func (w *BitcoinCashWallet) addressToScript(addr string) ([]byte, error) {
+	address, err := bchutil.DecodeAddress(addr, w.params())
 	if err != nil {
 		return nil, err
 	}
-	feePerKB := fpb.Int64() * 1000
-
-	// outputs
-	out := wire.NewTxOut(amount, script)
-
-	// Create change source
-	changeSource := func() ([]byte, error) {
-		iaddr, err := w.Keychain.CurrentAddressWithTx(dbtx, true)
-		if err != nil {
-			return nil, err
-		}
-
-		addr, err := bchutil.DecodeAddress(iaddr.String(), w.params())
-		if err != nil {
-			return nil, err
-		}
-
-		script, err := txscript.PayToAddrScript(addr)
-		if err != nil {
-			return nil, err
-		}
-		return script, nil
-	}
+	return txscript.PayToAddrScript(address)
+}
 
-	// Build transaction
-	authoredTx, err := txauthor.NewUnsignedTransaction([]*wire.TxOut{out}, bchutil.Amount(feePerKB), inputSource, changeSource)
+// signTx signs each input using the bitcoin cash signature hash algorithm.
+func (w *BitcoinCashWallet) signTx(tx *btcwire.MsgTx, prevScripts map[btcwire.OutPoint][]byte, values map[btcwire.OutPoint]int64, keys map[btcwire.OutPoint]*btcec.PrivateKey) error {
+	ser, err := utxobase.SerializeBase(tx)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	bchTx := wire.NewMsgTx(wire.TxVersion)
+	if err := bchTx.Deserialize(bytes.NewReader(ser)); err != nil {
+		return err
 	}
-
-	// BIP 69 sorting
-	txsort.InPlaceSort(authoredTx.Tx)
-
-	// Sign tx
-	getKey := txscript.KeyClosure(func(addr bchutil.Address) (*bchec.PrivateKey, bool, error) {
-		addrStr := addr.EncodeAddress()
-		wif := additionalKeysByAddress[addrStr]
-		return wif.PrivKey, wif.CompressPubKey, nil
-	})
 
 	getScript := txscript.ScriptClosure(func(addr bchutil.Address) ([]byte, error) {
 		return nil, nil
 	})
 
-	for i, txIn := range authoredTx.Tx.TxIn {
-		prevOutScript := additionalPrevScripts[txIn.PreviousOutPoint]
+	for i, txIn := range tx.TxIn {
+		op := txIn.PreviousOutPoint
+		priv, _ := bchec.PrivKeyFromBytes(bchec.S256(), keys[op].Serialize())
+		getKey := txscript.KeyClosure(func(addr bchutil.Address) (*bchec.PrivateKey, bool, error) {
+			return priv, true, nil
+		})
 
 		script, err := txscript.SignTxOutput(w.params(),
-			authoredTx.Tx, i, inVals[txIn.PreviousOutPoint], prevOutScript,
-			txscript.SigHashAll, getKey, getScript, txIn.SignatureScript)
+			bchTx, i, values[op], prevScripts[op],
+			txscript.SigHashAll, getKey, getScript, nil)
+		priv.D.SetInt64(0)
 		if err != nil {
-			return nil, fmt.Errorf("failed to sign transaction: %s", err)
+			return err
 		}
+		bchTx.TxIn[i].SignatureScript = script
 		txIn.SignatureScript = script
 	}
-	return authoredTx.Tx, nil
+	return nil
+}
+
+// paymentCodeAddress returns the P2PKH address of a payment code key.
+func (w *BitcoinCashWallet) paymentCodeAddress(pubKey *btcec.PublicKey) (iwallet.Address, error) {
+	addr, err := bchutil.NewAddressPubKeyHash(bchutil.Hash160(pubKey.SerializeCompressed()), w.params())
+	if err != nil {
+		return iwallet.Address{}, err
+	}
+	return iwallet.NewAddress(addr.String(), iwallet.CtBitcoinCash), nil
 }
 
 func (w *BitcoinCashWallet) keyToAddress(key *btchd.ExtendedKey) (iwallet.Address, error) {
@@ -914,6 +643,13 @@ func (w *BitcoinCashWallet) keyToAddress(key *btchd.ExtendedKey) (iwallet.Addres
 	return iwallet.NewAddress(addr.String(), iwallet.CtBitcoinCash), nil
 }
 
+// VerifyVectors checks the wallet derives the published address vectors
+// for its network. Addresses are encoded without the cashaddr prefix so
+// regtest addresses are the same as testnet's.
+func (w *BitcoinCashWallet) VerifyVectors() error {
+	return base.VerifyAddressVectors(base.AddressVectorsFor(iwallet.CtBitcoinCash, w.network.IsTest(), base.AddressTypeNativeSegwit), w.keyToAddress)
+}
+
 func lockTimeFromRedeemScript(redeemScript []byte) (uint32, error) {
 	if len(redeemScript) < 113 {
 		return 0, errors.New("redeem script invalid length")
@@ -2,29 +2,32 @@ package bitcoincash
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"github.com/btcsuite/btcd/btcec"
 	"github.com/btcsuite/btcutil/hdkeychain"
 	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/multiwallet/coins/utxobase"
 	"github.com/cpacia/multiwallet/database"
 	"github.com/cpacia/multiwallet/database/sqlitedb"
+	"github.com/cpacia/multiwallet/log"
 	iwallet "github.com/cpacia/wallet-interface"
 	"github.com/gcash/bchd/chaincfg"
 	"github.com/gcash/bchd/chaincfg/chainhash"
 	"github.com/gcash/bchd/txscript"
 	"github.com/gcash/bchd/wire"
 	"github.com/gcash/bchutil"
-	"github.com/op/go-logging"
 	"testing"
 	"time"
 )
 
 func newTestWallet() (*BitcoinCashWallet, error) {
 	w := &BitcoinCashWallet{
-		testnet:     true,
-		feeProvider: base.NewHardCodedFeeProvider(iwallet.NewAmount(50), iwallet.NewAmount(40), iwallet.NewAmount(30), iwallet.NewAmount(20)),
+		network: base.NetworkTestnet,
 	}
+	w.FeeProvider = base.NewHardCodedFeeProvider(iwallet.NewAmount(50), iwallet.NewAmount(40), iwallet.NewAmount(30), iwallet.NewAmount(20))
+	w.Chain = w.chain()
 
 	chainClient := base.NewMockChainClient()
 
@@ -38,7 +41,7 @@ func newTestWallet() (*BitcoinCashWallet, error) {
 
 	w.ChainClient = chainClient
 	w.DB = db
-	w.Logger = logging.MustGetLogger("bchtest")
+	w.Logger = log.New("bchtest")
 	w.CoinType = iwallet.CtBitcoinCash
 	w.Done = make(chan struct{})
 	w.AddressFunc = w.keyToAddress
@@ -71,6 +74,18 @@ func TestBitcoinCashWallet_ValidateAddress(t *testing.T) {
 			address: iwallet.NewAddress("qrk0e04s67l9mf20jvae6fznht04rej57sf8jz2nua", iwallet.CtBitcoinCash),
 			valid:   true,
 		},
+		{
+			address: iwallet.NewAddress("bchtest:qqmd9unmhkpx4pkmr6fkrr8rm6y77vckjvqe8aey35", iwallet.CtBitcoinCash),
+			valid:   true,
+		},
+		{
+			address: iwallet.NewAddress("mkWqVHGbfpznuu3JpPoXfCnHrhoekJLUGu", iwallet.CtBitcoinCash),
+			valid:   true,
+		},
+		{
+			address: iwallet.NewAddress("1BpEi6DfDAUFd7GtittLSdBeYJvcoaVggu", iwallet.CtBitcoinCash),
+			valid:   false,
+		},
 	}
 	w, err := newTestWallet()
 	if err != nil {
@@ -87,6 +102,50 @@ func TestBitcoinCashWallet_ValidateAddress(t *testing.T) {
 	}
 }
 
+func TestBitcoinCashWallet_AddressConversion(t *testing.T) {
+	w, err := newTestWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const (
+		cashAddr   = "qqmd9unmhkpx4pkmr6fkrr8rm6y77vckjvqe8aey35"
+		legacyAddr = "mkWqVHGbfpznuu3JpPoXfCnHrhoekJLUGu"
+	)
+	for _, addr := range []string{cashAddr, "bchtest:" + cashAddr, legacyAddr} {
+		converted, err := w.CashAddress(iwallet.NewAddress(addr, iwallet.CtBitcoinCash))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if converted.String() != cashAddr {
+			t.Errorf("Expected %s for %s, got %s", cashAddr, addr, converted)
+		}
+		converted, err = w.LegacyAddress(iwallet.NewAddress(addr, iwallet.CtBitcoinCash))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if converted.String() != legacyAddr {
+			t.Errorf("Expected %s for %s, got %s", legacyAddr, addr, converted)
+		}
+	}
+
+	// The wallet's own addresses are found in either format.
+	addr, err := w.CurrentAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy, err := w.LegacyAddress(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	has, err := w.HasKey(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !has {
+		t.Error("Expected HasKey to find the legacy address")
+	}
+}
+
 func TestBitcoinCashWallet_IsDust(t *testing.T) {
 	tests := []struct {
 		amount iwallet.Amount
@@ -172,15 +231,13 @@ func TestBitcoinCashWallet_EstimateSpendFee(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err = w.DB.Update(func(tx database.Tx) error {
-		return tx.Save(&database.UtxoRecord{
-			Timestamp: time.Now(),
-			Amount:    "1000000",
-			Height:    600000,
-			Coin:      iwallet.CtBitcoinCash,
-			Address:   addr.String(),
-			Outpoint:  hex.EncodeToString(buf.Bytes()),
-		})
+	err = w.DB.Store().SaveUtxo(context.Background(), &database.UtxoRecord{
+		Timestamp: time.Now(),
+		Amount:    "1000000",
+		Height:    600000,
+		Coin:      iwallet.CtBitcoinCash,
+		Address:   addr.String(),
+		Outpoint:  hex.EncodeToString(buf.Bytes()),
 	})
 	if err != nil {
 		t.Fatal(err)
@@ -231,15 +288,13 @@ func TestBitcoinCashWallet_Spend(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err = w.DB.Update(func(tx database.Tx) error {
-		return tx.Save(&database.UtxoRecord{
-			Timestamp: time.Now(),
-			Amount:    "1000000",
-			Height:    600000,
-			Coin:      iwallet.CtBitcoinCash,
-			Address:   addr.String(),
-			Outpoint:  hex.EncodeToString(buf.Bytes()),
-		})
+	err = w.DB.Store().SaveUtxo(context.Background(), &database.UtxoRecord{
+		Timestamp: time.Now(),
+		Amount:    "1000000",
+		Height:    600000,
+		Coin:      iwallet.CtBitcoinCash,
+		Address:   addr.String(),
+		Outpoint:  hex.EncodeToString(buf.Bytes()),
 	})
 	if err != nil {
 		t.Fatal(err)
@@ -264,24 +319,17 @@ func TestBitcoinCashWallet_Spend(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	var txBytes []byte
-	err = w.DB.View(func(tx database.Tx) error {
-		var txs []database.UnconfirmedTransaction
-		if err := tx.Read().Where("coin=?", iwallet.CtBitcoinCash).Find(&txs).Error; err != nil {
-			return err
-		}
-		if len(txs) != 1 {
-			t.Errorf("Expected 1 tx found %d", len(txs))
-		}
-		if txs[0].Txid != txid.String() {
-			t.Errorf("Expected txid %s, got %s", txid, txs[0].Txid)
-		}
-		txBytes = txs[0].TxBytes
-		return nil
-	})
+	txs, err := w.DB.Store().ListUnconfirmed(context.Background(), iwallet.CtBitcoinCash)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if len(txs) != 1 {
+		t.Fatalf("Expected 1 tx found %d", len(txs))
+	}
+	if txs[0].Txid != txid.String() {
+		t.Errorf("Expected txid %s, got %s", txid, txs[0].Txid)
+	}
+	txBytes := txs[0].TxBytes
 
 	var tx wire.MsgTx
 	if err := tx.BchDecode(bytes.NewReader(txBytes), wire.ProtocolVersion, wire.BaseEncoding); err != nil {
@@ -330,15 +378,13 @@ func TestBitcoinCashWallet_SweepWallet(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err = w.DB.Update(func(tx database.Tx) error {
-		return tx.Save(&database.UtxoRecord{
-			Timestamp: time.Now(),
-			Amount:    "1000000",
-			Height:    600000,
-			Coin:      iwallet.CtBitcoinCash,
-			Address:   addr.String(),
-			Outpoint:  hex.EncodeToString(buf.Bytes()),
-		})
+	err = w.DB.Store().SaveUtxo(context.Background(), &database.UtxoRecord{
+		Timestamp: time.Now(),
+		Amount:    "1000000",
+		Height:    600000,
+		Coin:      iwallet.CtBitcoinCash,
+		Address:   addr.String(),
+		Outpoint:  hex.EncodeToString(buf.Bytes()),
 	})
 	if err != nil {
 		t.Fatal(err)
@@ -363,24 +409,17 @@ func TestBitcoinCashWallet_SweepWallet(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	var txBytes []byte
-	err = w.DB.View(func(tx database.Tx) error {
-		var txs []database.UnconfirmedTransaction
-		if err := tx.Read().Where("coin=?", iwallet.CtBitcoinCash).Find(&txs).Error; err != nil {
-			return err
-		}
-		if len(txs) != 1 {
-			t.Errorf("Expected 1 tx found %d", len(txs))
-		}
-		if txs[0].Txid != txid.String() {
-			t.Errorf("Expected txid %s, got %s", txid, txs[0].Txid)
-		}
-		txBytes = txs[0].TxBytes
-		return nil
-	})
+	txs, err := w.DB.Store().ListUnconfirmed(context.Background(), iwallet.CtBitcoinCash)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if len(txs) != 1 {
+		t.Fatalf("Expected 1 tx found %d", len(txs))
+	}
+	if txs[0].Txid != txid.String() {
+		t.Errorf("Expected txid %s, got %s", txid, txs[0].Txid)
+	}
+	txBytes := txs[0].TxBytes
 
 	var tx wire.MsgTx
 	if err := tx.BchDecode(bytes.NewReader(txBytes), wire.ProtocolVersion, wire.BaseEncoding); err != nil {
@@ -405,32 +444,32 @@ func TestBitcoinCashWallet_EstimateEscrowFee(t *testing.T) {
 		{
 			threshold: 1,
 			level:     iwallet.FlEconomic,
-			expected:  iwallet.NewAmount(5490),
+			expected:  iwallet.NewAmount(6750),
 		},
 		{
 			threshold: 1,
 			level:     iwallet.FlNormal,
-			expected:  iwallet.NewAmount(7320),
+			expected:  iwallet.NewAmount(9000),
 		},
 		{
 			threshold: 1,
 			level:     iwallet.FlPriority,
-			expected:  iwallet.NewAmount(9150),
+			expected:  iwallet.NewAmount(11250),
 		},
 		{
 			threshold: 2,
 			level:     iwallet.FlEconomic,
-			expected:  iwallet.NewAmount(9510),
+			expected:  iwallet.NewAmount(10800),
 		},
 		{
 			threshold: 2,
 			level:     iwallet.FlNormal,
-			expected:  iwallet.NewAmount(12680),
+			expected:  iwallet.NewAmount(14400),
 		},
 		{
 			threshold: 2,
 			level:     iwallet.FlPriority,
-			expected:  iwallet.NewAmount(15850),
+			expected:  iwallet.NewAmount(18000),
 		},
 	}
 
@@ -531,24 +570,17 @@ func TestBitcoinCashWallet_Multisig1of2(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	var txBytes []byte
-	err = w.DB.View(func(tx database.Tx) error {
-		var txs []database.UnconfirmedTransaction
-		if err := tx.Read().Where("coin=?", iwallet.CtBitcoinCash).Find(&txs).Error; err != nil {
-			return err
-		}
-		if len(txs) != 1 {
-			t.Errorf("Expected 1 tx found %d", len(txs))
-		}
-		if txs[0].Txid != txid.String() {
-			t.Errorf("Expected txid %s, got %s", txid, txs[0].Txid)
-		}
-		txBytes = txs[0].TxBytes
-		return nil
-	})
+	txs, err := w.DB.Store().ListUnconfirmed(context.Background(), iwallet.CtBitcoinCash)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if len(txs) != 1 {
+		t.Fatalf("Expected 1 tx found %d", len(txs))
+	}
+	if txs[0].Txid != txid.String() {
+		t.Errorf("Expected txid %s, got %s", txid, txs[0].Txid)
+	}
+	txBytes := txs[0].TxBytes
 
 	scriptAddr, err := bchutil.NewAddressScriptHash(redeemScript, w.params())
 	if err != nil {
@@ -572,6 +604,126 @@ func TestBitcoinCashWallet_Multisig1of2(t *testing.T) {
 	if err := vm.Execute(); err != nil {
 		t.Errorf("Script verificationf failed: %s", err)
 	}
+
+	if size := msgTx.TxIn[0].SerializeSize(); size != w.escrowInputSize(1, 2) {
+		t.Errorf("Expected input size %d, got %d", w.escrowInputSize(1, 2), size)
+	}
+}
+
+func TestBitcoinCashWallet_MultisigUnsortedInputs(t *testing.T) {
+	w, err := newTestWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key1, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	key2, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, redeemScript, err := w.CreateMultisigAddress([]btcec.PublicKey{*key1.PubKey(), *key2.PubKey()}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The inputs are passed in the reverse of BIP 69 order and with
+	// different values so the signatures only verify if each value is
+	// matched to the right outpoint after sorting.
+	var (
+		from   []iwallet.SpendInfo
+		hashes = []string{
+			"ff00000000000000000000000000000000000000000000000000000000000000",
+			"0100000000000000000000000000000000000000000000000000000000000000",
+		}
+		values = make(map[wire.OutPoint]int64)
+	)
+	for i, hash := range hashes {
+		h, err := chainhash.NewHashFromStr(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		op := wire.NewOutPoint(h, 0)
+		var buf bytes.Buffer
+		if err := op.Serialize(&buf); err != nil {
+			t.Fatal(err)
+		}
+		amount := int64(1000000 * (i + 1))
+		values[*op] = amount
+		from = append(from, iwallet.SpendInfo{
+			ID:     buf.Bytes(),
+			Amount: iwallet.NewAmount(amount),
+		})
+	}
+
+	tx := iwallet.Transaction{
+		From: from,
+		To: []iwallet.SpendInfo{
+			{
+				Amount:  iwallet.NewAmount(2900000),
+				Address: iwallet.NewAddress("qrk0e04s67l9mf20jvae6fznht04rej57sf8jz2nua", iwallet.CtBitcoinCash),
+			},
+		},
+	}
+
+	sig, err := w.SignMultisigTransaction(tx, *key2, redeemScript)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wtx, err := w.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	txid, err := w.BuildAndSend(wtx, tx, [][]iwallet.EscrowSignature{sig}, redeemScript)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := wtx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	txs, err := w.DB.Store().ListUnconfirmed(context.Background(), iwallet.CtBitcoinCash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txs) != 1 {
+		t.Fatalf("Expected 1 tx found %d", len(txs))
+	}
+	if txs[0].Txid != txid.String() {
+		t.Errorf("Expected txid %s, got %s", txid, txs[0].Txid)
+	}
+	txBytes := txs[0].TxBytes
+
+	scriptAddr, err := bchutil.NewAddressScriptHash(redeemScript, w.params())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fromScript, err := txscript.PayToAddrScript(scriptAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var msgTx wire.MsgTx
+	if err := msgTx.BchDecode(bytes.NewReader(txBytes), wire.ProtocolVersion, wire.BaseEncoding); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, in := range msgTx.TxIn {
+		vm, err := txscript.NewEngine(fromScript, &msgTx, i, txscript.StandardVerifyFlags, nil, nil, values[in.PreviousOutPoint])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := vm.Execute(); err != nil {
+			t.Errorf("Input %d: script verification failed: %s", i, err)
+		}
+	}
 }
 
 func TestBitcoinCashWallet_Multisig2of3(t *testing.T) {
@@ -671,24 +823,17 @@ func TestBitcoinCashWallet_Multisig2of3(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	var txBytes []byte
-	err = w1.DB.View(func(tx database.Tx) error {
-		var txs []database.UnconfirmedTransaction
-		if err := tx.Read().Where("coin=?", iwallet.CtBitcoinCash).Find(&txs).Error; err != nil {
-			return err
-		}
-		if len(txs) != 1 {
-			t.Errorf("Expected 1 tx found %d", len(txs))
-		}
-		if txs[0].Txid != txid.String() {
-			t.Errorf("Expected txid %s, got %s", txid, txs[0].Txid)
-		}
-		txBytes = txs[0].TxBytes
-		return nil
-	})
+	txs, err := w1.DB.Store().ListUnconfirmed(context.Background(), iwallet.CtBitcoinCash)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if len(txs) != 1 {
+		t.Fatalf("Expected 1 tx found %d", len(txs))
+	}
+	if txs[0].Txid != txid.String() {
+		t.Errorf("Expected txid %s, got %s", txid, txs[0].Txid)
+	}
+	txBytes := txs[0].TxBytes
 
 	scriptAddr, err := bchutil.NewAddressScriptHash(redeemScript, w1.params())
 	if err != nil {
@@ -712,6 +857,10 @@ func TestBitcoinCashWallet_Multisig2of3(t *testing.T) {
 	if err := vm.Execute(); err != nil {
 		t.Errorf("Script verificationf failed: %s", err)
 	}
+
+	if size := msgTx.TxIn[0].SerializeSize(); size != w1.escrowInputSize(2, 3) {
+		t.Errorf("Expected input size %d, got %d", w1.escrowInputSize(2, 3), size)
+	}
 }
 
 func TestBitcoinCashWallet_Multisig2of3Timlocked(t *testing.T) {
@@ -811,24 +960,17 @@ func TestBitcoinCashWallet_Multisig2of3Timlocked(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	var txBytes []byte
-	err = w1.DB.View(func(tx database.Tx) error {
-		var txs []database.UnconfirmedTransaction
-		if err := tx.Read().Where("coin=?", iwallet.CtBitcoinCash).Find(&txs).Error; err != nil {
-			return err
-		}
-		if len(txs) != 1 {
-			t.Errorf("Expected 1 tx found %d", len(txs))
-		}
-		if txs[0].Txid != txid.String() {
-			t.Errorf("Expected txid %s, got %s", txid, txs[0].Txid)
-		}
-		txBytes = txs[0].TxBytes
-		return nil
-	})
+	txs, err := w1.DB.Store().ListUnconfirmed(context.Background(), iwallet.CtBitcoinCash)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if len(txs) != 1 {
+		t.Fatalf("Expected 1 tx found %d", len(txs))
+	}
+	if txs[0].Txid != txid.String() {
+		t.Errorf("Expected txid %s, got %s", txid, txs[0].Txid)
+	}
+	txBytes := txs[0].TxBytes
 
 	scriptAddr, err := bchutil.NewAddressScriptHash(redeemScript, w1.params())
 	if err != nil {
@@ -937,24 +1079,17 @@ func TestBitcoinCashWallet_ReleaseFundsAfterTimeout(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	var txBytes []byte
-	err = w.DB.View(func(tx database.Tx) error {
-		var txs []database.UnconfirmedTransaction
-		if err := tx.Read().Where("coin=?", iwallet.CtBitcoinCash).Find(&txs).Error; err != nil {
-			return err
-		}
-		if len(txs) != 1 {
-			t.Errorf("Expected 1 tx found %d", len(txs))
-		}
-		if txs[0].Txid != txid.String() {
-			t.Errorf("Expected txid %s, got %s", txid, txs[0].Txid)
-		}
-		txBytes = txs[0].TxBytes
-		return nil
-	})
+	txs, err := w.DB.Store().ListUnconfirmed(context.Background(), iwallet.CtBitcoinCash)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if len(txs) != 1 {
+		t.Fatalf("Expected 1 tx found %d", len(txs))
+	}
+	if txs[0].Txid != txid.String() {
+		t.Errorf("Expected txid %s, got %s", txid, txs[0].Txid)
+	}
+	txBytes := txs[0].TxBytes
 
 	scriptAddr, err := bchutil.NewAddressScriptHash(redeemScript, w.params())
 	if err != nil {
@@ -978,6 +1113,22 @@ func TestBitcoinCashWallet_ReleaseFundsAfterTimeout(t *testing.T) {
 	if err := vm.Execute(); err != nil {
 		t.Errorf("Script verificationf failed: %s", err)
 	}
+
+	if msgTx.Version != 2 {
+		t.Errorf("Expected version 2, got %d", msgTx.Version)
+	}
+	if msgTx.TxIn[0].Sequence != 144 {
+		t.Errorf("Expected sequence 144, got %d", msgTx.TxIn[0].Sequence)
+	}
+
+	wtx, err = w.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wtx.Rollback()
+	if _, err := w.ReleaseFundsAfterTimeout(wtx, tx, *key1, redeemScript); err == nil {
+		t.Error("Expected release with the wrong timeout key to fail")
+	}
 }
 
 func TestBitcoinCashWallet_buildTx(t *testing.T) {
@@ -1016,15 +1167,13 @@ func TestBitcoinCashWallet_buildTx(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err = w.DB.Update(func(tx database.Tx) error {
-		return tx.Save(&database.UtxoRecord{
-			Timestamp: time.Now(),
-			Amount:    "1000000",
-			Height:    600000,
-			Coin:      iwallet.CtBitcoinCash,
-			Address:   addr.String(),
-			Outpoint:  hex.EncodeToString(buf.Bytes()),
-		})
+	err = w.DB.Store().SaveUtxo(context.Background(), &database.UtxoRecord{
+		Timestamp: time.Now(),
+		Amount:    "1000000",
+		Height:    600000,
+		Coin:      iwallet.CtBitcoinCash,
+		Address:   addr.String(),
+		Outpoint:  hex.EncodeToString(buf.Bytes()),
 	})
 	if err != nil {
 		t.Fatal(err)
@@ -1039,12 +1188,19 @@ func TestBitcoinCashWallet_buildTx(t *testing.T) {
 	}
 
 	var (
-		tx     *wire.MsgTx
+		tx     wire.MsgTx
 		outVal = int64(500000)
 	)
 	err = w.DB.View(func(dbtx database.Tx) error {
-		tx, err = w.buildTx(dbtx, outVal, iwallet.NewAddress(payTo.String(), iwallet.CtBitcoinCash), iwallet.FlNormal)
-		return err
+		btcTx, err := w.BuildTx(dbtx, outVal, iwallet.NewAddress(payTo.String(), iwallet.CtBitcoinCash), iwallet.FlNormal)
+		if err != nil {
+			return err
+		}
+		ser, err := utxobase.SerializeBase(btcTx)
+		if err != nil {
+			return err
+		}
+		return tx.BchDecode(bytes.NewReader(ser), wire.ProtocolVersion, wire.BaseEncoding)
 	})
 	if err != nil {
 		t.Fatal(err)
@@ -1080,7 +1236,7 @@ func TestBitcoinCashWallet_buildTx(t *testing.T) {
 		t.Errorf("Expected totalOut of %d, got %d", 990920, totalOut)
 	}
 
-	vm, err := txscript.NewEngine(fromScript, tx, 0, txscript.StandardVerifyFlags, nil, nil, 1000000)
+	vm, err := txscript.NewEngine(fromScript, &tx, 0, txscript.StandardVerifyFlags, nil, nil, 1000000)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1088,3 +1244,12 @@ func TestBitcoinCashWallet_buildTx(t *testing.T) {
 		t.Errorf("Script verificationf failed: %s", err)
 	}
 }
+
+func TestBitcoinCashWallet_VerifyVectors(t *testing.T) {
+	for _, network := range []base.Network{base.NetworkMainnet, base.NetworkTestnet, base.NetworkRegtest} {
+		w := &BitcoinCashWallet{network: network}
+		if err := w.VerifyVectors(); err != nil {
+			t.Errorf("Network %s: %s", network, err)
+		}
+	}
+}
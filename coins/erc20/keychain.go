@@ -0,0 +1,157 @@
+package erc20
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	hd "github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/multiwallet/client/ethclient"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"gorm.io/gorm"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Keychain is the Ethereum account's key, saved in the ETH coin record.
+// The token wallets all spend from this one account so they share a
+// Keychain, and a NonceManager made from it, with each other and with the
+// ETH wallet.
+type Keychain struct {
+	db      database.Database
+	chainID *big.Int
+
+	addr    *common.Address
+	addrMtx sync.Mutex
+}
+
+// NewKeychain returns the Keychain saved in the database. Transactions are
+// signed for the chain ID.
+func NewKeychain(db database.Database, chainID *big.Int) *Keychain {
+	return &Keychain{db: db, chainID: chainID}
+}
+
+// Exists returns whether the ETH coin record has been created.
+func (k *Keychain) Exists() bool {
+	_, err := k.record()
+	return !errors.Is(err, gorm.ErrRecordNotFound)
+}
+
+// Create saves the coin level key, m/44'/60', in the ETH coin record.
+func (k *Keychain) Create(xpriv hd.ExtendedKey, birthday time.Time) error {
+	if k.Exists() {
+		return fmt.Errorf("wallet already exists for coin %s", iwallet.CtEthereum.CurrencyCode())
+	}
+	xpub, err := xpriv.Neuter()
+	if err != nil {
+		return err
+	}
+	return k.db.Update(func(tx database.Tx) error {
+		return tx.Save(&database.CoinRecord{
+			MasterPriv:  xpriv.String(),
+			MasterPub:   xpub.String(),
+			Coin:        iwallet.CtEthereum.CurrencyCode(),
+			Birthday:    birthday,
+			BestBlockID: strings.Repeat("0", 64),
+		})
+	})
+}
+
+// Address returns the account's address. The private key is needed the
+// first time as the account is below a hardened step of the path.
+func (k *Keychain) Address() (common.Address, error) {
+	k.addrMtx.Lock()
+	defer k.addrMtx.Unlock()
+
+	if k.addr != nil {
+		return *k.addr, nil
+	}
+	key, err := k.accountKey()
+	if err != nil {
+		return common.Address{}, err
+	}
+	addr := crypto.PubkeyToAddress(key.PublicKey)
+	zeroKey(key)
+	k.addr = &addr
+	return addr, nil
+}
+
+// Sign signs the transaction with the account's key. It's the SignFunc of
+// the account's NonceManager.
+func (k *Keychain) Sign(tx *types.Transaction) (*types.Transaction, error) {
+	key, err := k.accountKey()
+	if err != nil {
+		return nil, err
+	}
+	defer zeroKey(key)
+	return types.SignTx(tx, types.NewEIP155Signer(k.chainID), key)
+}
+
+// NonceManager returns a NonceManager for the account. Every wallet which
+// spends from the account should use the same one.
+func (k *Keychain) NonceManager(backend ethclient.NonceBackend) (*ethclient.NonceManager, error) {
+	addr, err := k.Address()
+	if err != nil {
+		return nil, err
+	}
+	return ethclient.NewNonceManager(k.db, backend, addr, k.Sign), nil
+}
+
+func (k *Keychain) record() (*database.CoinRecord, error) {
+	var rec database.CoinRecord
+	err := k.db.View(func(tx database.Tx) error {
+		return tx.Read().Where("coin = ?", iwallet.CtEthereum.CurrencyCode()).First(&rec).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// accountKey derives the key at m/44'/60'/0'/0/0. The caller must zero it
+// when finished.
+func (k *Keychain) accountKey() (*ecdsa.PrivateKey, error) {
+	rec, err := k.record()
+	if err != nil {
+		return nil, err
+	}
+	if rec.EncryptedMasterKey {
+		return nil, base.ErrEncryptedKeychain
+	}
+	xpriv, err := rec.MasterPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	defer base.ZeroKey(xpriv)
+
+	key := xpriv
+	for _, idx := range []uint32{hd.HardenedKeyStart, 0, 0} {
+		child, err := key.Child(idx)
+		if key != xpriv {
+			base.ZeroKey(key)
+		}
+		if err != nil {
+			return nil, err
+		}
+		key = child
+	}
+	defer base.ZeroKey(key)
+
+	priv, err := key.ECPrivKey()
+	if err != nil {
+		return nil, err
+	}
+	return priv.ToECDSA(), nil
+}
+
+func zeroKey(key *ecdsa.PrivateKey) {
+	if key != nil && key.D != nil {
+		key.D.SetInt64(0)
+	}
+}
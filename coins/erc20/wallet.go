@@ -0,0 +1,905 @@
+// Package erc20 implements wallets for ERC20 tokens. A token wallet has no
+// keys of its own. It spends from the Ethereum account in the shared
+// Keychain and finds its balance from the token's Transfer logs.
+package erc20
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	hd "github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/multiwallet/client/ethclient"
+	"github.com/cpacia/multiwallet/database"
+	"github.com/cpacia/multiwallet/log"
+	iwallet "github.com/cpacia/wallet-interface"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"gorm.io/gorm"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var _ = iwallet.Wallet(&ERC20Wallet{})
+
+const (
+	// syncInterval is how often the wallet checks for new transfers.
+	syncInterval = time.Second * 15
+
+	// reorgDepth is how many of the latest synced blocks are scanned
+	// again on each sync so transfers in reorged blocks are replaced.
+	reorgDepth = 12
+
+	// gasMarginPercent is added to the estimated gas of a transfer as
+	// the estimate is only exact for the current state.
+	gasMarginPercent = 20
+)
+
+// Backend is the part of the RPC client used by the wallet. It's
+// implemented by *ethclient.Client from go-ethereum.
+type Backend interface {
+	ethclient.TransferFilterer
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+	SuggestGasPrice(ctx context.Context) (*big.Int, error)
+	EstimateGas(ctx context.Context, msg ethereum.CallMsg) (uint64, error)
+	PendingCallContract(ctx context.Context, msg ethereum.CallMsg) ([]byte, error)
+	PendingBalanceAt(ctx context.Context, account common.Address) (*big.Int, error)
+}
+
+// AddressResolver resolves ENS names and ethereum: payment URIs to the
+// address to pay. It's implemented by *ethclient.EthClient.
+type AddressResolver interface {
+	ResolveAddress(s string) (common.Address, error)
+}
+
+// ERC20Wallet is a wallet for a single token. Its transactions are sent
+// through the account's NonceManager so they're ordered with the
+// account's ether transactions and those of its other tokens. Amounts are
+// in the token's smallest unit; fees are paid in wei.
+type ERC20Wallet struct {
+	DB       database.Database
+	Logger   log.Logger
+	Done     chan struct{}
+	CoinType iwallet.CoinType
+	Token    ethclient.ERC20Token
+
+	// StartBlock is the first block scanned for transfers. It should be
+	// no later than the block the token's contract was created in.
+	StartBlock uint64
+
+	// Resolver, if set, resolves ENS names and EIP-681 ethereum: payment
+	// URIs given as addresses. Without it only hex addresses are
+	// accepted.
+	Resolver AddressResolver
+
+	// Confirmations is the number of blocks a transfer must be buried
+	// under, including its own, before it counts toward the confirmed
+	// balance.
+	Confirmations uint64
+
+	// AddressPolicyStore holds the allow and deny lists checked by
+	// Spend and SweepWallet.
+	base.AddressPolicyStore
+
+	keychain *Keychain
+	nonces   *ethclient.NonceManager
+	backend  Backend
+
+	tip       *types.Header
+	txSubs    []chan iwallet.Transaction
+	blockSubs []chan iwallet.BlockInfo
+	subMtx    sync.Mutex
+	syncMtx   sync.Mutex
+	txMtx     sync.Mutex
+	stopMtx   sync.Mutex
+	wg        sync.WaitGroup
+}
+
+// NewERC20Wallet returns a wallet for the token. The keychain and nonce
+// manager must be the ones shared by every wallet spending from the
+// account.
+func NewERC20Wallet(cfg *base.WalletConfig, coinType iwallet.CoinType, token ethclient.ERC20Token, keychain *Keychain, nonces *ethclient.NonceManager, backend Backend) *ERC20Wallet {
+	w := &ERC20Wallet{
+		DB:            cfg.DB,
+		Logger:        cfg.Logger,
+		Done:          make(chan struct{}),
+		CoinType:      coinType,
+		Token:         token,
+		Confirmations: cfg.Confirmations.SettledConfirmations(),
+		AddressPolicyStore: base.AddressPolicyStore{
+			DB:       cfg.DB,
+			CoinType: coinType,
+			Logger:   cfg.Logger,
+		},
+		keychain: keychain,
+		nonces:   nonces,
+		backend:  backend,
+	}
+	w.Normalize = w.resolveAddress
+	return w
+}
+
+// Begin returns a new database transaction. A spend is only sent when the
+// transaction is committed.
+func (w *ERC20Wallet) Begin() (iwallet.Tx, error) {
+	w.txMtx.Lock()
+	select {
+	case <-w.Done:
+		w.txMtx.Unlock()
+		return nil, base.ErrWalletClosed
+	default:
+	}
+	return base.NewDBTx(&w.txMtx), nil
+}
+
+// WalletExists returns whether the account's keychain has been created.
+func (w *ERC20Wallet) WalletExists() bool {
+	return w.keychain.Exists()
+}
+
+// CreateWallet creates the account's keychain. The key must be the ETH coin
+// level key as the token wallets share the ETH wallet's account. It's only
+// needed if the ETH wallet hasn't been created.
+func (w *ERC20Wallet) CreateWallet(xpriv hd.ExtendedKey, pw []byte, birthday time.Time) error {
+	return w.keychain.Create(xpriv, birthday)
+}
+
+// OpenWallet starts syncing the token's transfers.
+func (w *ERC20Wallet) OpenWallet() error {
+	w.wg.Add(1)
+	go w.syncLoop()
+	return nil
+}
+
+// CloseWallet shuts down the wallet.
+func (w *ERC20Wallet) CloseWallet() error {
+	return w.Stop(context.Background())
+}
+
+// Start is OpenWallet under the name used by base.Lifecycle.
+func (w *ERC20Wallet) Start() error {
+	return w.OpenWallet()
+}
+
+// Stop refuses new transactions once the open one, if any, is committed or
+// rolled back and waits for the sync loop to exit.
+func (w *ERC20Wallet) Stop(ctx context.Context) error {
+	w.stopMtx.Lock()
+	defer w.stopMtx.Unlock()
+
+	select {
+	case <-w.Done:
+		return nil
+	default:
+	}
+	err := base.LockContext(ctx, &w.txMtx)
+	close(w.Done)
+	if err == nil {
+		w.txMtx.Unlock()
+	}
+	w.wg.Wait()
+	return err
+}
+
+// BlockchainInfo returns the latest block.
+func (w *ERC20Wallet) BlockchainInfo() (iwallet.BlockInfo, error) {
+	header, err := w.header(context.Background(), nil)
+	if err != nil {
+		return iwallet.BlockInfo{}, err
+	}
+	return blockInfo(header), nil
+}
+
+// CurrentAddress returns the account's address.
+func (w *ERC20Wallet) CurrentAddress() (iwallet.Address, error) {
+	addr, err := w.keychain.Address()
+	if err != nil {
+		return iwallet.Address{}, err
+	}
+	return iwallet.NewAddress(addr.Hex(), w.CoinType), nil
+}
+
+// NewAddress returns the account's address. The account is the wallet's
+// only address.
+func (w *ERC20Wallet) NewAddress() (iwallet.Address, error) {
+	return w.CurrentAddress()
+}
+
+// ValidateAddress returns an error if the address isn't a hex encoded
+// Ethereum address or, with a Resolver, an ENS name or ethereum: payment
+// URI which resolves to one.
+func (w *ERC20Wallet) ValidateAddress(addr iwallet.Address) error {
+	_, err := w.resolveAddress(addr)
+	return err
+}
+
+// resolveAddress returns the checksummed hex address to pay for the
+// address, so every casing of a hex address has the same string. ENS names
+// and payment URIs are resolved by the Resolver. A payment URI for a
+// transfer of another token is rejected.
+func (w *ERC20Wallet) resolveAddress(addr iwallet.Address) (iwallet.Address, error) {
+	s := strings.TrimSpace(addr.String())
+	if w.Resolver == nil {
+		if !common.IsHexAddress(s) {
+			return iwallet.Address{}, errors.New("invalid address")
+		}
+		return iwallet.NewAddress(common.HexToAddress(s).Hex(), w.CoinType), nil
+	}
+	if u, err := ethclient.ParsePaymentURI(s); err == nil && u.Function == "transfer" {
+		if !common.IsHexAddress(u.Target) || common.HexToAddress(u.Target) != w.Token.Contract {
+			return iwallet.Address{}, fmt.Errorf("payment uri is for token %s not %s", u.Target, w.Token.Contract.Hex())
+		}
+	}
+	resolved, err := w.Resolver.ResolveAddress(s)
+	if err != nil {
+		return iwallet.Address{}, err
+	}
+	return iwallet.NewAddress(resolved.Hex(), w.CoinType), nil
+}
+
+// HasKey returns whether the address is the account's.
+func (w *ERC20Wallet) HasKey(addr iwallet.Address) (bool, error) {
+	ours, err := w.keychain.Address()
+	if err != nil {
+		return false, err
+	}
+	return common.IsHexAddress(addr.String()) && common.HexToAddress(addr.String()) == ours, nil
+}
+
+// IsDust returns whether the amount is below the token's smallest unit.
+func (w *ERC20Wallet) IsDust(amount iwallet.Amount) bool {
+	return amount.Cmp(iwallet.NewAmount(1)) < 0
+}
+
+// Balance returns the account's token balance from the saved transfers.
+// Transfers with fewer than Confirmations blocks, and sent transfers which
+// aren't in a block yet, count toward the unconfirmed balance.
+func (w *ERC20Wallet) Balance() (unconfirmed iwallet.Amount, confirmed iwallet.Amount, err error) {
+	addr, err := w.keychain.Address()
+	if err != nil {
+		return iwallet.NewAmount(0), iwallet.NewAmount(0), err
+	}
+	var (
+		records []database.TokenTransferRecord
+		syncRec database.TokenSyncRecord
+	)
+	err = w.DB.View(func(tx database.Tx) error {
+		err := tx.Read().Where("token=?", w.Token.Contract.Hex()).Where("account=?", addr.Hex()).First(&syncRec).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		return tx.Read().Where("token=?", w.Token.Contract.Hex()).Where("account=?", addr.Hex()).Find(&records).Error
+	})
+	if err != nil {
+		return iwallet.NewAmount(0), iwallet.NewAmount(0), err
+	}
+
+	unconf, conf := new(big.Int), new(big.Int)
+	for _, rec := range records {
+		if rec.To == rec.From {
+			continue
+		}
+		value, ok := new(big.Int).SetString(rec.Value, 10)
+		if !ok {
+			return iwallet.NewAmount(0), iwallet.NewAmount(0), fmt.Errorf("invalid transfer value %q", rec.Value)
+		}
+		if rec.From == addr.Hex() {
+			value.Neg(value)
+		}
+		if rec.BlockNumber == 0 || rec.BlockNumber+w.Confirmations > syncRec.BlockNumber+1 {
+			unconf.Add(unconf, value)
+		} else {
+			conf.Add(conf, value)
+		}
+	}
+	return iwallet.NewAmount(unconf.String()), iwallet.NewAmount(conf.String()), nil
+}
+
+// Transactions returns the account's token transactions, newest first.
+func (w *ERC20Wallet) Transactions(limit int, offsetID iwallet.TransactionID) ([]iwallet.Transaction, error) {
+	addr, err := w.keychain.Address()
+	if err != nil {
+		return nil, err
+	}
+	var records []database.TokenTransferRecord
+	err = w.DB.View(func(tx database.Tx) error {
+		return tx.Read().Where("token=?", w.Token.Contract.Hex()).Where("account=?", addr.Hex()).Find(&records).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	txs := w.transactions(records, addr)
+
+	var (
+		ret       []iwallet.Transaction
+		skipUntil = offsetID != ""
+	)
+	for _, tx := range txs {
+		if skipUntil {
+			if tx.ID == offsetID {
+				skipUntil = false
+			}
+			continue
+		}
+		ret = append(ret, tx)
+		if limit > 0 && len(ret) == limit {
+			break
+		}
+	}
+	return ret, nil
+}
+
+// GetTransaction returns the account's token transaction with the ID.
+func (w *ERC20Wallet) GetTransaction(id iwallet.TransactionID) (iwallet.Transaction, error) {
+	addr, err := w.keychain.Address()
+	if err != nil {
+		return iwallet.Transaction{}, err
+	}
+	var records []database.TokenTransferRecord
+	err = w.DB.View(func(tx database.Tx) error {
+		return tx.Read().Where("token=?", w.Token.Contract.Hex()).Where("account=?", addr.Hex()).Where("txid=?", id.String()).Find(&records).Error
+	})
+	if err != nil {
+		return iwallet.Transaction{}, err
+	}
+	if len(records) == 0 {
+		return iwallet.Transaction{}, gorm.ErrRecordNotFound
+	}
+	return w.transactions(records, addr)[0], nil
+}
+
+// EstimateSpendFee returns the fee in wei of a transfer of the amount. The
+// fee is paid from the account's ether balance.
+func (w *ERC20Wallet) EstimateSpendFee(amount iwallet.Amount, feeLevel iwallet.FeeLevel) (iwallet.Amount, error) {
+	addr, err := w.keychain.Address()
+	if err != nil {
+		return iwallet.NewAmount(0), err
+	}
+	ctx := context.Background()
+	value, err := toBig(amount)
+	if err != nil {
+		return iwallet.NewAmount(0), err
+	}
+	data, err := ethclient.PackTokenTransfer(addr, value)
+	if err != nil {
+		return iwallet.NewAmount(0), err
+	}
+	gas, err := w.estimateGas(ctx, addr, data)
+	if err != nil {
+		return iwallet.NewAmount(0), err
+	}
+	gasPrice, err := w.gasPrice(ctx, feeLevel)
+	if err != nil {
+		return iwallet.NewAmount(0), err
+	}
+	return iwallet.NewAmount(new(big.Int).Mul(gasPrice, new(big.Int).SetUint64(gas)).String()), nil
+}
+
+// PreviewSpend simulates a Spend of the amount to the address without
+// signing it. The gas limit and price are the ones Spend would use for the
+// fee level. The preview's Failure says why the transfer would fail, such
+// as a revert or too little ether for the fee.
+func (w *ERC20Wallet) PreviewSpend(to iwallet.Address, amt iwallet.Amount, feeLevel iwallet.FeeLevel) (*ethclient.SpendPreview, error) {
+	to, err := w.resolveAddress(to)
+	if err != nil {
+		return nil, err
+	}
+	value, err := toBig(amt)
+	if err != nil {
+		return nil, err
+	}
+	if value.Sign() <= 0 {
+		return nil, errors.New("amount must be positive")
+	}
+	unconfirmed, confirmed, err := w.Balance()
+	if err != nil {
+		return nil, err
+	}
+	if unconfirmed.Add(confirmed).Cmp(amt) < 0 {
+		return nil, base.ErrInsufficientFunds
+	}
+	from, err := w.keychain.Address()
+	if err != nil {
+		return nil, err
+	}
+	data, err := ethclient.PackTokenTransfer(common.HexToAddress(to.String()), value)
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	gasPrice, err := w.gasPrice(ctx, feeLevel)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ethclient.RequestTimeout)
+	defer cancel()
+
+	return ethclient.PreviewCall(ctx, w.backend, ethereum.CallMsg{From: from, To: &w.Token.Contract, Data: data}, gasPrice, gasMarginPercent)
+}
+
+// Spend sends the amount of the token to the address, which is resolved
+// as in ValidateAddress. The transaction is signed at the account's next
+// nonce and sent when wtx is committed.
+func (w *ERC20Wallet) Spend(wtx iwallet.Tx, to iwallet.Address, amt iwallet.Amount, feeLevel iwallet.FeeLevel) (iwallet.TransactionID, error) {
+	to, err := w.resolveAddress(to)
+	if err != nil {
+		return "", err
+	}
+	if err := w.CheckDestinations(to); err != nil {
+		return "", err
+	}
+	value, err := toBig(amt)
+	if err != nil {
+		return "", err
+	}
+	if value.Sign() <= 0 {
+		return "", errors.New("amount must be positive")
+	}
+	unconfirmed, confirmed, err := w.Balance()
+	if err != nil {
+		return "", err
+	}
+	if unconfirmed.Add(confirmed).Cmp(amt) < 0 {
+		return "", base.ErrInsufficientFunds
+	}
+	return w.transfer(wtx, to, value, feeLevel)
+}
+
+// SweepWallet sends the account's whole token balance to the address. The
+// fee is paid in ether so none of the tokens are kept back for it.
+func (w *ERC20Wallet) SweepWallet(wtx iwallet.Tx, to iwallet.Address, level iwallet.FeeLevel) (iwallet.TransactionID, error) {
+	to, err := w.resolveAddress(to)
+	if err != nil {
+		return "", err
+	}
+	if err := w.CheckDestinations(to); err != nil {
+		return "", err
+	}
+	unconfirmed, confirmed, err := w.Balance()
+	if err != nil {
+		return "", err
+	}
+	value, err := toBig(unconfirmed.Add(confirmed))
+	if err != nil {
+		return "", err
+	}
+	if value.Sign() <= 0 {
+		return "", base.ErrInsufficientFunds
+	}
+	return w.transfer(wtx, to, value, level)
+}
+
+// WatchAddress saves the addresses so their transfers of the token are
+// pushed to the transaction subscribers.
+func (w *ERC20Wallet) WatchAddress(wtx iwallet.Tx, addrs ...iwallet.Address) error {
+	wbtx, ok := wtx.(*base.DBTx)
+	if !ok {
+		return errors.New("tx is not expected type")
+	}
+	accounts := make([]common.Address, 0, len(addrs))
+	for _, addr := range addrs {
+		resolved, err := w.resolveAddress(addr)
+		if err != nil {
+			return err
+		}
+		accounts = append(accounts, common.HexToAddress(resolved.String()))
+	}
+	ours, err := w.keychain.Address()
+	if err != nil {
+		return err
+	}
+	wbtx.OnCommit = func() error {
+		return w.DB.Update(func(tx database.Tx) error {
+			for _, account := range accounts {
+				if account == ours {
+					continue
+				}
+				var rec database.TokenSyncRecord
+				err := tx.Read().Where("token=?", w.Token.Contract.Hex()).Where("account=?", account.Hex()).First(&rec).Error
+				if err == nil {
+					continue
+				} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+					return err
+				}
+				err = tx.Save(&database.TokenSyncRecord{
+					Token:   w.Token.Contract.Hex(),
+					Account: account.Hex(),
+				})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	return nil
+}
+
+// SubscribeTransactions returns a chan over which the wallet pushes new
+// transfers of the token to or from the account and watched addresses.
+func (w *ERC20Wallet) SubscribeTransactions() <-chan iwallet.Transaction {
+	ch := make(chan iwallet.Transaction)
+	w.subMtx.Lock()
+	w.txSubs = append(w.txSubs, ch)
+	w.subMtx.Unlock()
+	return ch
+}
+
+// SubscribeBlocks returns a chan over which the wallet pushes each new
+// chain tip it syncs to.
+func (w *ERC20Wallet) SubscribeBlocks() <-chan iwallet.BlockInfo {
+	ch := make(chan iwallet.BlockInfo)
+	w.subMtx.Lock()
+	w.blockSubs = append(w.blockSubs, ch)
+	w.subMtx.Unlock()
+	return ch
+}
+
+// transfer signs a transfer of the token and sends it when wtx commits.
+func (w *ERC20Wallet) transfer(wtx iwallet.Tx, to iwallet.Address, value *big.Int, feeLevel iwallet.FeeLevel) (iwallet.TransactionID, error) {
+	wbtx, ok := wtx.(*base.DBTx)
+	if !ok {
+		return "", errors.New("tx is not expected type")
+	}
+	if err := w.ValidateAddress(to); err != nil {
+		return "", err
+	}
+	from, err := w.keychain.Address()
+	if err != nil {
+		return "", err
+	}
+	dest := common.HexToAddress(to.String())
+	data, err := ethclient.PackTokenTransfer(dest, value)
+	if err != nil {
+		return "", err
+	}
+
+	ctx := context.Background()
+	gas, err := w.estimateGas(ctx, from, data)
+	if err != nil {
+		return "", err
+	}
+	gasPrice, err := w.gasPrice(ctx, feeLevel)
+	if err != nil {
+		return "", err
+	}
+	signed, err := w.nonces.Sign(ctx, w.Token.Contract, big.NewInt(0), gas, gasPrice, data)
+	if err != nil {
+		return "", err
+	}
+	txid := signed.Hash().Hex()
+
+	wbtx.OnCommit = func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), ethclient.RequestTimeout)
+		defer cancel()
+		if err := w.nonces.SendSigned(ctx, signed); err != nil {
+			return err
+		}
+		// The transfer counts against the balance until its log is
+		// found, which replaces this record.
+		return w.DB.Update(func(tx database.Tx) error {
+			return tx.Save(&database.TokenTransferRecord{
+				ID:        transferID(w.Token.Contract, from, txid, "pending"),
+				Token:     w.Token.Contract.Hex(),
+				Account:   from.Hex(),
+				Txid:      txid,
+				From:      from.Hex(),
+				To:        dest.Hex(),
+				Value:     value.String(),
+				Timestamp: time.Now(),
+			})
+		})
+	}
+	return iwallet.TransactionID(txid), nil
+}
+
+func (w *ERC20Wallet) estimateGas(ctx context.Context, from common.Address, data []byte) (uint64, error) {
+	ctx, cancel := context.WithTimeout(ctx, ethclient.RequestTimeout)
+	defer cancel()
+
+	gas, err := w.backend.EstimateGas(ctx, ethereum.CallMsg{From: from, To: &w.Token.Contract, Data: data})
+	if err != nil {
+		return 0, err
+	}
+	return gas + gas*gasMarginPercent/100, nil
+}
+
+// gasPrice returns the node's suggested gas price raised by half for
+// priority spends.
+func (w *ERC20Wallet) gasPrice(ctx context.Context, feeLevel iwallet.FeeLevel) (*big.Int, error) {
+	ctx, cancel := context.WithTimeout(ctx, ethclient.RequestTimeout)
+	defer cancel()
+
+	price, err := w.backend.SuggestGasPrice(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if feeLevel == iwallet.FlPriority {
+		price = new(big.Int).Div(new(big.Int).Mul(price, big.NewInt(3)), big.NewInt(2))
+	}
+	return price, nil
+}
+
+func (w *ERC20Wallet) syncLoop() {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+	for {
+		if err := w.syncTransfers(context.Background()); err != nil {
+			w.Logger.Warningf("[%s] Error syncing transfers: %s", w.CoinType, err)
+		}
+		select {
+		case <-ticker.C:
+		case <-w.Done:
+			return
+		}
+	}
+}
+
+// syncTransfers saves the token's transfers to or from the account and
+// the watched addresses up to the chain tip and pushes new ones to the
+// subscribers.
+func (w *ERC20Wallet) syncTransfers(ctx context.Context) error {
+	w.syncMtx.Lock()
+	defer w.syncMtx.Unlock()
+
+	tip, err := w.header(ctx, nil)
+	if err != nil {
+		return err
+	}
+	addr, err := w.keychain.Address()
+	if err != nil {
+		return err
+	}
+	var syncRecs []database.TokenSyncRecord
+	err = w.DB.View(func(tx database.Tx) error {
+		return tx.Read().Where("token=?", w.Token.Contract.Hex()).Find(&syncRecs).Error
+	})
+	if err != nil {
+		return err
+	}
+	accounts := []common.Address{addr}
+	for _, rec := range syncRecs {
+		if rec.Account != addr.Hex() {
+			accounts = append(accounts, common.HexToAddress(rec.Account))
+		}
+	}
+
+	headers := map[uint64]*types.Header{tip.Number.Uint64(): tip}
+	var notify []iwallet.Transaction
+	for _, account := range accounts {
+		txs, err := w.syncAccount(ctx, account, tip.Number.Uint64(), headers)
+		if err != nil {
+			return err
+		}
+		notify = append(notify, txs...)
+	}
+
+	newTip := w.tip == nil || w.tip.Hash() != tip.Hash()
+	w.tip = tip
+
+	w.subMtx.Lock()
+	txSubs, blockSubs := w.txSubs, w.blockSubs
+	w.subMtx.Unlock()
+	for _, tx := range notify {
+		for _, sub := range txSubs {
+			select {
+			case sub <- tx:
+			case <-w.Done:
+				return nil
+			}
+		}
+	}
+	if newTip {
+		for _, sub := range blockSubs {
+			select {
+			case sub <- blockInfo(tip):
+			case <-w.Done:
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// syncAccount saves the account's transfers from its last synced block,
+// less reorgDepth, to height. Saved transfers in that range which are no
+// longer found are deleted. It returns the transactions with transfers
+// which weren't saved before.
+func (w *ERC20Wallet) syncAccount(ctx context.Context, account common.Address, height uint64, headers map[uint64]*types.Header) ([]iwallet.Transaction, error) {
+	token := w.Token.Contract.Hex()
+
+	from := w.StartBlock
+	var syncRec database.TokenSyncRecord
+	err := w.DB.View(func(tx database.Tx) error {
+		return tx.Read().Where("token=?", token).Where("account=?", account.Hex()).First(&syncRec).Error
+	})
+	if err == nil {
+		if syncRec.BlockNumber >= from+reorgDepth {
+			from = syncRec.BlockNumber + 1 - reorgDepth
+		}
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	if from > height {
+		from = height
+	}
+
+	transfers, err := ethclient.FilterTokenTransfers(ctx, w.backend, w.Token.Contract, account, from, new(big.Int).SetUint64(height))
+	if err != nil {
+		return nil, err
+	}
+
+	var existing, pending []database.TokenTransferRecord
+	err = w.DB.View(func(tx database.Tx) error {
+		err := tx.Read().Where("token=?", token).Where("account=?", account.Hex()).Where("block_number>=?", from).Find(&existing).Error
+		if err != nil {
+			return err
+		}
+		return tx.Read().Where("token=?", token).Where("account=?", account.Hex()).Where("block_number=?", 0).Find(&pending).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	if from > 0 {
+		existing = append(existing, pending...)
+	}
+	known := make(map[string]database.TokenTransferRecord)
+	for _, rec := range existing {
+		known[rec.ID] = rec
+	}
+
+	var (
+		records []database.TokenTransferRecord
+		found   = make(map[string]bool)
+		changed = make(map[string]bool)
+	)
+	for _, t := range transfers {
+		header, ok := headers[t.BlockNumber]
+		if !ok {
+			header, err = w.header(ctx, new(big.Int).SetUint64(t.BlockNumber))
+			if err != nil {
+				return nil, err
+			}
+			headers[t.BlockNumber] = header
+		}
+		txid := t.TxHash.Hex()
+		rec := database.TokenTransferRecord{
+			ID:          transferID(w.Token.Contract, account, txid, fmt.Sprint(t.LogIndex)),
+			Token:       token,
+			Account:     account.Hex(),
+			Txid:        txid,
+			LogIndex:    t.LogIndex,
+			From:        t.From.Hex(),
+			To:          t.To.Hex(),
+			Value:       t.Value.String(),
+			BlockNumber: t.BlockNumber,
+			BlockHash:   t.BlockHash.Hex(),
+			Timestamp:   time.Unix(int64(header.Time), 0),
+		}
+		records = append(records, rec)
+		found[rec.ID] = true
+		if old, ok := known[rec.ID]; !ok || old.BlockHash != rec.BlockHash {
+			changed[txid] = true
+		}
+	}
+	foundTxids := make(map[string]bool)
+	for _, rec := range records {
+		foundTxids[rec.Txid] = true
+	}
+
+	err = w.DB.Update(func(tx database.Tx) error {
+		for _, rec := range existing {
+			if found[rec.ID] {
+				continue
+			}
+			// Sent transfers stay pending until their log is found.
+			if rec.BlockNumber == 0 && !foundTxids[rec.Txid] {
+				continue
+			}
+			if err := tx.Delete("id", rec.ID, &database.TokenTransferRecord{}); err != nil {
+				return err
+			}
+		}
+		for _, rec := range records {
+			if err := tx.Save(&rec); err != nil {
+				return err
+			}
+		}
+		return tx.Save(&database.TokenSyncRecord{
+			Token:       token,
+			Account:     account.Hex(),
+			BlockNumber: height,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var changedRecords []database.TokenTransferRecord
+	for _, rec := range records {
+		if changed[rec.Txid] {
+			changedRecords = append(changedRecords, rec)
+		}
+	}
+	return w.transactions(changedRecords, account), nil
+}
+
+// transactions groups the transfers by transaction, newest first, with
+// the value of each to the account.
+func (w *ERC20Wallet) transactions(records []database.TokenTransferRecord, account common.Address) []iwallet.Transaction {
+	sort.Slice(records, func(i, j int) bool {
+		// Pending transfers have no block so they sort first.
+		bi, bj := records[i].BlockNumber, records[j].BlockNumber
+		switch {
+		case (bi == 0) != (bj == 0):
+			return bi == 0
+		case bi == 0:
+			return records[i].Timestamp.After(records[j].Timestamp)
+		case bi != bj:
+			return bi > bj
+		}
+		return records[i].LogIndex > records[j].LogIndex
+	})
+
+	var (
+		txs   []iwallet.Transaction
+		index = make(map[string]int)
+	)
+	for _, rec := range records {
+		i, ok := index[rec.Txid]
+		if !ok {
+			i = len(txs)
+			index[rec.Txid] = i
+			txs = append(txs, iwallet.Transaction{
+				ID:        iwallet.TransactionID(rec.Txid),
+				Height:    rec.BlockNumber,
+				Timestamp: rec.Timestamp,
+				Value:     iwallet.NewAmount(0),
+			})
+		}
+		amount := iwallet.NewAmount(rec.Value)
+		txs[i].From = append(txs[i].From, iwallet.SpendInfo{Address: iwallet.NewAddress(rec.From, w.CoinType), Amount: amount})
+		txs[i].To = append(txs[i].To, iwallet.SpendInfo{Address: iwallet.NewAddress(rec.To, w.CoinType), Amount: amount})
+		if rec.To == account.Hex() {
+			txs[i].Value = txs[i].Value.Add(amount)
+		}
+		if rec.From == account.Hex() {
+			txs[i].Value = txs[i].Value.Sub(amount)
+		}
+	}
+	return txs
+}
+
+func (w *ERC20Wallet) header(ctx context.Context, number *big.Int) (*types.Header, error) {
+	ctx, cancel := context.WithTimeout(ctx, ethclient.RequestTimeout)
+	defer cancel()
+	return w.backend.HeaderByNumber(ctx, number)
+}
+
+func blockInfo(header *types.Header) iwallet.BlockInfo {
+	return iwallet.BlockInfo{
+		BlockID:   iwallet.BlockID(header.Hash().Hex()),
+		PrevBlock: iwallet.BlockID(header.ParentHash.Hex()),
+		Height:    header.Number.Uint64(),
+		BlockTime: time.Unix(int64(header.Time), 0),
+	}
+}
+
+func transferID(token, account common.Address, txid, logIndex string) string {
+	return strings.Join([]string{token.Hex(), account.Hex(), txid, logIndex}, ":")
+}
+
+func toBig(amt iwallet.Amount) (*big.Int, error) {
+	value, ok := new(big.Int).SetString(amt.String(), 10)
+	if !ok {
+		return nil, fmt.Errorf("invalid amount %q", amt.String())
+	}
+	return value, nil
+}
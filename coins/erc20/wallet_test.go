@@ -0,0 +1,547 @@
+package erc20
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/chaincfg"
+	hd "github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/multiwallet/client/ethclient"
+	"github.com/cpacia/multiwallet/database"
+	"github.com/cpacia/multiwallet/database/memorydb"
+	"github.com/cpacia/multiwallet/database/sqlitedb"
+	"github.com/cpacia/multiwallet/log"
+	iwallet "github.com/cpacia/wallet-interface"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	testToken     = common.HexToAddress("0x6B175474E89094C44Da98b954EedeAC495271d0F")
+	otherToken    = common.HexToAddress("0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48")
+	testRecipient = common.HexToAddress("0x52908400098527886E0F7030069857D2E4169EE7")
+	testSender    = common.HexToAddress("0xde0B295669a9FD93d5F28D9Ec85E40f4cb697BAe")
+
+	transferTopic = crypto.Keccak256Hash([]byte("Transfer(address,address,uint256)"))
+)
+
+type mockBackend struct {
+	tip    uint64
+	fork   byte
+	logs   []types.Log
+	nonce  uint64
+	sent   []*types.Transaction
+	ether  int64
+	revert error
+}
+
+func (b *mockBackend) headerAt(n uint64) *types.Header {
+	return &types.Header{
+		Number: new(big.Int).SetUint64(n),
+		Time:   1600000000 + n,
+		Extra:  []byte{b.fork},
+	}
+}
+
+func (b *mockBackend) blockHash(n uint64) common.Hash {
+	return b.headerAt(n).Hash()
+}
+
+func (b *mockBackend) addTransfer(token, from, to common.Address, value int64, block uint64, txid common.Hash) {
+	b.logs = append(b.logs, types.Log{
+		Address:     token,
+		Topics:      []common.Hash{transferTopic, common.BytesToHash(from.Bytes()), common.BytesToHash(to.Bytes())},
+		Data:        common.LeftPadBytes(big.NewInt(value).Bytes(), 32),
+		BlockNumber: block,
+		BlockHash:   b.blockHash(block),
+		TxHash:      txid,
+	})
+}
+
+func (b *mockBackend) FilterLogs(ctx context.Context, q ethereum.FilterQuery) ([]types.Log, error) {
+	var logs []types.Log
+	for _, l := range b.logs {
+		if len(q.Addresses) > 0 && l.Address != q.Addresses[0] {
+			continue
+		}
+		if l.BlockNumber < q.FromBlock.Uint64() || (q.ToBlock != nil && l.BlockNumber > q.ToBlock.Uint64()) {
+			continue
+		}
+		match := true
+		for i, topics := range q.Topics {
+			if len(topics) > 0 && (i >= len(l.Topics) || l.Topics[i] != topics[0]) {
+				match = false
+			}
+		}
+		if match {
+			logs = append(logs, l)
+		}
+	}
+	return logs, nil
+}
+
+func (b *mockBackend) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	if number == nil {
+		return b.headerAt(b.tip), nil
+	}
+	return b.headerAt(number.Uint64()), nil
+}
+
+func (b *mockBackend) SuggestGasPrice(ctx context.Context) (*big.Int, error) {
+	return big.NewInt(1e9), nil
+}
+
+func (b *mockBackend) EstimateGas(ctx context.Context, msg ethereum.CallMsg) (uint64, error) {
+	return 50000, nil
+}
+
+func (b *mockBackend) PendingCallContract(ctx context.Context, msg ethereum.CallMsg) ([]byte, error) {
+	if b.revert != nil {
+		return nil, b.revert
+	}
+	return common.LeftPadBytes([]byte{1}, 32), nil
+}
+
+func (b *mockBackend) PendingBalanceAt(ctx context.Context, account common.Address) (*big.Int, error) {
+	return big.NewInt(b.ether), nil
+}
+
+func (b *mockBackend) PendingNonceAt(ctx context.Context, account common.Address) (uint64, error) {
+	return b.nonce, nil
+}
+
+func (b *mockBackend) NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error) {
+	return b.nonce, nil
+}
+
+func (b *mockBackend) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	b.sent = append(b.sent, tx)
+	b.nonce = tx.Nonce() + 1
+	return nil
+}
+
+// mockResolver resolves hex addresses, payment URIs and the ENS names in
+// the map. Other names are unverified.
+type mockResolver map[string]common.Address
+
+func (r mockResolver) ResolveAddress(s string) (common.Address, error) {
+	if u, err := ethclient.ParsePaymentURI(s); err == nil {
+		s = u.Recipient()
+	}
+	if common.IsHexAddress(s) {
+		return common.HexToAddress(s), nil
+	}
+	if addr, ok := r[s]; ok {
+		return addr, nil
+	}
+	return common.Address{}, ethclient.ErrNameUnverified
+}
+
+func newTestWallet(t *testing.T) (*ERC20Wallet, *mockBackend, common.Address) {
+	return newTestWalletWithDB(t, sqlitedb.NewMemoryDB)
+}
+
+// newTestWalletWithDB returns a test wallet using a database from newDB so
+// tests can be run against each backend.
+func newTestWalletWithDB(t *testing.T, newDB func() (database.Database, error)) (*ERC20Wallet, *mockBackend, common.Address) {
+	db, err := newDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.InitializeDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+	keychain := NewKeychain(db, big.NewInt(1))
+	xpriv, err := hd.NewMaster(bytes.Repeat([]byte{0x01}, 32), &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keychain.Create(*xpriv, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	addr, err := keychain.Address()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := &mockBackend{nonce: 5}
+	nonces, err := keychain.NonceManager(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &base.WalletConfig{
+		DB:            db,
+		Logger:        log.New("erc20test"),
+		Confirmations: base.ConfirmationPolicy{Settled: 3},
+	}
+	token := ethclient.ERC20Token{Contract: testToken, Symbol: "DAI", Decimals: 18}
+	return NewERC20Wallet(cfg, iwallet.CoinType("DAI"), token, keychain, nonces, backend), backend, addr
+}
+
+func checkBalance(t *testing.T, w *ERC20Wallet, unconfirmed, confirmed string) {
+	t.Helper()
+	unconf, conf, err := w.Balance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unconf.String() != unconfirmed || conf.String() != confirmed {
+		t.Errorf("Expected balance %s/%s, got %s/%s", unconfirmed, confirmed, unconf, conf)
+	}
+}
+
+func TestERC20Wallet_SyncTransfers(t *testing.T) {
+	testSyncTransfers(t, sqlitedb.NewMemoryDB)
+}
+
+// The key-value backends only support one condition per Where.
+func TestERC20Wallet_SyncTransfersMemoryDB(t *testing.T) {
+	testSyncTransfers(t, memorydb.NewMemoryDB)
+}
+
+func testSyncTransfers(t *testing.T, newDB func() (database.Database, error)) {
+	w, backend, addr := newTestWalletWithDB(t, newDB)
+
+	received := common.HexToHash("0x01")
+	sent := common.HexToHash("0x02")
+	backend.addTransfer(testToken, testSender, addr, 100, 10, received)
+	backend.addTransfer(testToken, addr, testRecipient, 30, 12, sent)
+	backend.addTransfer(otherToken, testSender, addr, 500, 11, common.HexToHash("0x03"))
+	backend.addTransfer(testToken, testSender, testRecipient, 700, 11, common.HexToHash("0x04"))
+	backend.tip = 12
+
+	sub := w.SubscribeTransactions()
+	errCh := make(chan error)
+	go func() {
+		errCh <- w.syncTransfers(context.Background())
+	}()
+	var notified []iwallet.Transaction
+	for i := 0; i < 2; i++ {
+		select {
+		case tx := <-sub:
+			notified = append(notified, tx)
+		case <-time.After(time.Second * 5):
+			t.Fatal("Timed out waiting for transaction")
+		}
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	if notified[0].ID.String() != sent.Hex() || notified[1].ID.String() != received.Hex() {
+		t.Errorf("Expected the sent and received transactions, got %s and %s", notified[0].ID, notified[1].ID)
+	}
+
+	// The receive has three confirmations and the send one.
+	checkBalance(t, w, "-30", "100")
+
+	txs, err := w.Transactions(-1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txs) != 2 {
+		t.Fatalf("Expected 2 transactions, got %d", len(txs))
+	}
+	if txs[0].ID.String() != sent.Hex() || txs[0].Value.String() != "-30" || txs[0].Height != 12 {
+		t.Errorf("Expected the send of 30 at height 12, got %s of %s at %d", txs[0].ID, txs[0].Value, txs[0].Height)
+	}
+	if txs[1].ID.String() != received.Hex() || txs[1].Value.String() != "100" || txs[1].Height != 10 {
+		t.Errorf("Expected the receive of 100 at height 10, got %s of %s at %d", txs[1].ID, txs[1].Value, txs[1].Height)
+	}
+	if !txs[1].Timestamp.Equal(time.Unix(1600000010, 0)) {
+		t.Errorf("Expected the block's timestamp, got %s", txs[1].Timestamp)
+	}
+
+	// The chain is reorged from block 10. The receive is mined again in
+	// a new block 10, the send is dropped and a different one is mined
+	// in block 13.
+	backend.fork = 1
+	backend.logs = nil
+	backend.addTransfer(testToken, testSender, addr, 100, 10, received)
+	resent := common.HexToHash("0x05")
+	backend.addTransfer(testToken, addr, testRecipient, 20, 13, resent)
+	backend.tip = 13
+
+	go func() {
+		errCh <- w.syncTransfers(context.Background())
+	}()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-sub:
+		case <-time.After(time.Second * 5):
+			t.Fatal("Timed out waiting for transaction")
+		}
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := w.GetTransaction(iwallet.TransactionID(sent.Hex())); err == nil {
+		t.Error("Expected the reorged transfer to be removed")
+	}
+	tx, err := w.GetTransaction(iwallet.TransactionID(resent.Hex()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.Height != 13 || tx.Value.String() != "-20" {
+		t.Errorf("Expected the send of 20 at height 13, got %s at %d", tx.Value, tx.Height)
+	}
+	checkBalance(t, w, "-20", "100")
+}
+
+func TestERC20Wallet_Spend(t *testing.T) {
+	w, backend, addr := newTestWallet(t)
+
+	backend.addTransfer(testToken, testSender, addr, 100, 10, common.HexToHash("0x01"))
+	backend.tip = 12
+	if err := w.syncTransfers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	wtx, err := w.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	txid, err := w.Spend(wtx, iwallet.NewAddress(testRecipient.Hex(), w.CoinType), iwallet.NewAmount(40), iwallet.FlNormal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backend.sent) != 0 {
+		t.Fatal("Expected nothing to be sent before commit")
+	}
+	if err := wtx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(backend.sent) != 1 {
+		t.Fatalf("Expected 1 sent transaction, got %d", len(backend.sent))
+	}
+	signed := backend.sent[0]
+	data, err := ethclient.PackTokenTransfer(testRecipient, big.NewInt(40))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *signed.To() != testToken || !bytes.Equal(signed.Data(), data) || signed.Value().Sign() != 0 {
+		t.Error("Expected a call to the token's transfer method")
+	}
+	if signed.Nonce() != 5 || signed.Gas() != 60000 || signed.Hash().Hex() != txid.String() {
+		t.Errorf("Expected txid %s at nonce 5 with 60000 gas, got %s at nonce %d with %d gas", txid, signed.Hash().Hex(), signed.Nonce(), signed.Gas())
+	}
+	from, err := types.Sender(types.NewEIP155Signer(big.NewInt(1)), signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != addr {
+		t.Errorf("Expected the transaction to be signed by %s, got %s", addr.Hex(), from.Hex())
+	}
+
+	// The pending send counts against the balance.
+	checkBalance(t, w, "-40", "100")
+	tx, err := w.GetTransaction(txid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.Height != 0 || tx.Value.String() != "-40" {
+		t.Errorf("Expected a pending send of 40, got %s at %d", tx.Value, tx.Height)
+	}
+
+	wtx, err = w.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Spend(wtx, iwallet.NewAddress(testRecipient.Hex(), w.CoinType), iwallet.NewAmount(100), iwallet.FlNormal); !errors.Is(err, base.ErrInsufficientFunds) {
+		t.Errorf("Expected ErrInsufficientFunds, got %v", err)
+	}
+	if _, err := w.Spend(wtx, iwallet.NewAddress(testRecipient.Hex(), w.CoinType), iwallet.NewAmount(10), iwallet.FlNormal); err != nil {
+		t.Fatal(err)
+	}
+	if err := wtx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if len(backend.sent) != 1 {
+		t.Error("Expected nothing to be sent after rollback")
+	}
+
+	// The transfer's log replaces the pending record once it's mined.
+	backend.addTransfer(testToken, addr, testRecipient, 40, 13, signed.Hash())
+	backend.tip = 13
+	if err := w.syncTransfers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	txs, err := w.Transactions(-1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txs) != 2 {
+		t.Fatalf("Expected 2 transactions, got %d", len(txs))
+	}
+	if txs[0].ID != txid || txs[0].Height != 13 || txs[0].Value.String() != "-40" {
+		t.Errorf("Expected the send of 40 at height 13, got %s of %s at %d", txs[0].ID, txs[0].Value, txs[0].Height)
+	}
+	checkBalance(t, w, "-40", "100")
+}
+
+func TestERC20Wallet_AddressPolicy(t *testing.T) {
+	w, backend, addr := newTestWallet(t)
+
+	backend.addTransfer(testToken, testSender, addr, 100, 10, common.HexToHash("0x01"))
+	backend.tip = 12
+	if err := w.syncTransfers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The deny entry is lower case but the spend uses the checksummed
+	// address.
+	to := iwallet.NewAddress(testRecipient.Hex(), w.CoinType)
+	if err := w.SetAddressPolicy(base.AddressDenied, "scam list", iwallet.NewAddress(strings.ToLower(testRecipient.Hex()), w.CoinType)); err != nil {
+		t.Fatal(err)
+	}
+
+	wtx, err := w.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wtx.Rollback()
+	if _, err := w.Spend(wtx, to, iwallet.NewAmount(40), iwallet.FlNormal); !errors.Is(err, base.ErrDestinationRejected) {
+		t.Errorf("Expected ErrDestinationRejected from Spend, got %v", err)
+	}
+	if _, err := w.SweepWallet(wtx, to, iwallet.FlNormal); !errors.Is(err, base.ErrDestinationRejected) {
+		t.Errorf("Expected ErrDestinationRejected from SweepWallet, got %v", err)
+	}
+
+	rejected, err := w.RejectedSpends()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rejected) != 2 {
+		t.Errorf("Expected 2 rejected spends, got %d", len(rejected))
+	}
+}
+
+func TestERC20Wallet_ResolveAddress(t *testing.T) {
+	w, backend, addr := newTestWallet(t)
+
+	backend.addTransfer(testToken, testSender, addr, 100, 10, common.HexToHash("0x01"))
+	backend.tip = 12
+	if err := w.syncTransfers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	name := iwallet.NewAddress("alice.eth", w.CoinType)
+	if err := w.ValidateAddress(name); err == nil {
+		t.Error("Expected ENS name to be invalid without a resolver")
+	}
+
+	w.Resolver = mockResolver{"alice.eth": testRecipient}
+	if err := w.ValidateAddress(name); err != nil {
+		t.Errorf("Expected ENS name to be valid, got %v", err)
+	}
+	if err := w.ValidateAddress(iwallet.NewAddress("bob.eth", w.CoinType)); !errors.Is(err, ethclient.ErrNameUnverified) {
+		t.Errorf("Expected ErrNameUnverified, got %v", err)
+	}
+	uri := fmt.Sprintf("ethereum:%s/transfer?address=alice.eth&uint256=40", testToken.Hex())
+	if err := w.ValidateAddress(iwallet.NewAddress(uri, w.CoinType)); err != nil {
+		t.Errorf("Expected payment uri to be valid, got %v", err)
+	}
+	otherURI := fmt.Sprintf("ethereum:%s/transfer?address=alice.eth&uint256=40", otherToken.Hex())
+	if err := w.ValidateAddress(iwallet.NewAddress(otherURI, w.CoinType)); err == nil {
+		t.Error("Expected payment uri for another token to be rejected")
+	}
+
+	wtx, err := w.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Spend(wtx, iwallet.NewAddress(uri, w.CoinType), iwallet.NewAmount(40), iwallet.FlNormal); err != nil {
+		t.Fatal(err)
+	}
+	if err := wtx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if len(backend.sent) != 1 {
+		t.Fatalf("Expected 1 sent transaction, got %d", len(backend.sent))
+	}
+	data, err := ethclient.PackTokenTransfer(testRecipient, big.NewInt(40))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(backend.sent[0].Data(), data) {
+		t.Error("Expected a transfer to the resolved address")
+	}
+
+	// A name on the deny list is matched by the address it resolves to.
+	if err := w.SetAddressPolicy(base.AddressDenied, "scam list", name); err != nil {
+		t.Fatal(err)
+	}
+	wtx, err = w.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wtx.Rollback()
+	if _, err := w.Spend(wtx, iwallet.NewAddress(strings.ToLower(testRecipient.Hex()), w.CoinType), iwallet.NewAmount(10), iwallet.FlNormal); !errors.Is(err, base.ErrDestinationRejected) {
+		t.Errorf("Expected ErrDestinationRejected, got %v", err)
+	}
+}
+
+// revertError is the rpc.Error returned for a reverted call.
+type revertError struct{}
+
+func (revertError) Error() string  { return "execution reverted" }
+func (revertError) ErrorCode() int { return 3 }
+
+func TestERC20Wallet_PreviewSpend(t *testing.T) {
+	w, backend, addr := newTestWallet(t)
+
+	backend.addTransfer(testToken, testSender, addr, 100, 10, common.HexToHash("0x01"))
+	backend.tip = 12
+	if err := w.syncTransfers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	to := iwallet.NewAddress(testRecipient.Hex(), w.CoinType)
+
+	// The gas limit has the wallet's margin and the price is raised by
+	// half for priority spends.
+	backend.ether = 1e18
+	preview, err := w.PreviewSpend(to, iwallet.NewAmount(40), iwallet.FlPriority)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preview.WillFail() {
+		t.Errorf("Expected the preview to succeed, got %s", preview.Failure)
+	}
+	if preview.GasLimit != 60000 || preview.GasPrice.Int64() != 1500000000 || preview.MaxFee.Int64() != 90000000000000 {
+		t.Errorf("Expected 60000 gas at 1500000000 wei, got %d at %s with max fee %s", preview.GasLimit, preview.GasPrice, preview.MaxFee)
+	}
+	if len(backend.sent) != 0 {
+		t.Error("Expected nothing to be sent by a preview")
+	}
+
+	backend.ether = 1000
+	preview, err = w.PreviewSpend(to, iwallet.NewAmount(40), iwallet.FlNormal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(preview.Failure, "insufficient funds") {
+		t.Errorf("Expected too little ether for the fee, got %q", preview.Failure)
+	}
+
+	backend.ether = 1e18
+	backend.revert = revertError{}
+	preview, err = w.PreviewSpend(to, iwallet.NewAmount(40), iwallet.FlNormal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preview.Failure != "execution reverted" {
+		t.Errorf("Expected a revert, got %q", preview.Failure)
+	}
+
+	if _, err := w.PreviewSpend(to, iwallet.NewAmount(200), iwallet.FlNormal); !errors.Is(err, base.ErrInsufficientFunds) {
+		t.Errorf("Expected ErrInsufficientFunds, got %v", err)
+	}
+}
@@ -0,0 +1,177 @@
+// Package fork implements a wallet for bitcoin forks which aren't built in.
+// The fork is described by Params which are registered before the wallet
+// is built. The wallet is the generic utxobase wallet paying to P2PKH, or
+// P2WPKH addresses if the fork has segwit, and signing like bitcoin. Forks
+// which changed the signature hash, such as with a fork id, aren't
+// supported.
+package fork
+
+import (
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/cpacia/multiwallet/base"
+	iwallet "github.com/cpacia/wallet-interface"
+	"sync"
+)
+
+var (
+	// ErrNotRegistered is returned when building a wallet for a coin
+	// with no parameters registered for the network.
+	ErrNotRegistered = errors.New("fork parameters are not registered")
+
+	// ErrAlreadyRegistered is returned when registering parameters for a
+	// coin and network which already has them.
+	ErrAlreadyRegistered = errors.New("fork parameters are already registered")
+)
+
+// builtinCoins are the coins with their own wallets. They can't be
+// registered as forks.
+var builtinCoins = map[iwallet.CoinType]bool{
+	iwallet.CtBitcoin:     true,
+	iwallet.CtBitcoinCash: true,
+	iwallet.CtLitecoin:    true,
+	iwallet.CtZCash:       true,
+}
+
+// Params describe a fork on one network.
+type Params struct {
+	// CoinType is the fork's currency code, such as DOGE.
+	CoinType iwallet.CoinType
+
+	// Network is the network the parameters are for. A fork may be
+	// registered once for each network.
+	Network base.Network
+
+	// Name identifies the network, such as dogecoin-mainnet.
+	Name string
+
+	// Net is the fork's magic bytes and DefaultPort its peer to peer
+	// port.
+	Net         wire.BitcoinNet
+	DefaultPort string
+
+	// PubKeyHashAddrID, ScriptHashAddrID and PrivateKeyID are the
+	// base58 version bytes of P2PKH and P2SH addresses and WIF keys.
+	PubKeyHashAddrID byte
+	ScriptHashAddrID byte
+	PrivateKeyID     byte
+
+	// Bech32HRPSegwit is the human readable part of segwit addresses. If
+	// it's set the wallet uses P2WPKH addresses. Forks without segwit
+	// leave it empty and use P2PKH.
+	Bech32HRPSegwit string
+
+	// HDPrivateKeyID and HDPublicKeyID are the version bytes of extended
+	// keys.
+	HDPrivateKeyID [4]byte
+	HDPublicKeyID  [4]byte
+
+	// HDCoinType is the fork's BIP44 coin type. Wallets on test networks
+	// usually use 1.
+	HDCoinType uint32
+
+	// FeePerByte is the fee rate paid at every fee level unless the
+	// wallet config sets a FeeProvider. If zero one is used.
+	FeePerByte uint64
+
+	// MessageMagic prefixes signed messages. If empty
+	// base.DefaultMessageMagic is used.
+	MessageMagic string
+}
+
+// Segwit returns whether the fork pays to segwit addresses.
+func (p *Params) Segwit() bool {
+	return p.Bech32HRPSegwit != ""
+}
+
+// chainParams returns the chaincfg parameters used to encode the fork's
+// addresses and keys. Only the fields the wallet needs are set.
+func (p *Params) chainParams() *chaincfg.Params {
+	return &chaincfg.Params{
+		Name:             p.Name,
+		Net:              p.Net,
+		DefaultPort:      p.DefaultPort,
+		PubKeyHashAddrID: p.PubKeyHashAddrID,
+		ScriptHashAddrID: p.ScriptHashAddrID,
+		PrivateKeyID:     p.PrivateKeyID,
+		Bech32HRPSegwit:  p.Bech32HRPSegwit,
+		HDPrivateKeyID:   p.HDPrivateKeyID,
+		HDPublicKeyID:    p.HDPublicKeyID,
+		HDCoinType:       p.HDCoinType,
+	}
+}
+
+type registryKey struct {
+	coinType iwallet.CoinType
+	network  base.Network
+}
+
+type registered struct {
+	params      Params
+	chainParams *chaincfg.Params
+}
+
+var (
+	registryMtx sync.RWMutex
+	registry    = make(map[registryKey]*registered)
+)
+
+// Register adds the parameters of a fork so wallets can be built for it
+// with NewForkWallet. The parameters are also registered with chaincfg so
+// the fork's segwit addresses can be decoded. Registering the same magic
+// bytes as another network fails.
+func Register(params Params) error {
+	if params.CoinType == "" || params.Name == "" {
+		return errors.New("fork parameters need a coin type and name")
+	}
+	if builtinCoins[params.CoinType] {
+		return fmt.Errorf("%s has its own wallet", params.CoinType.CurrencyCode())
+	}
+	if params.HDPrivateKeyID == params.HDPublicKeyID {
+		return errors.New("extended private and public key ids must differ")
+	}
+
+	registryMtx.Lock()
+	defer registryMtx.Unlock()
+
+	key := registryKey{params.CoinType, params.Network}
+	if _, ok := registry[key]; ok {
+		return fmt.Errorf("%w: %s %s", ErrAlreadyRegistered, params.CoinType.CurrencyCode(), params.Network)
+	}
+	chainParams := params.chainParams()
+	if err := chaincfg.Register(chainParams); err != nil {
+		return fmt.Errorf("registering %s: %s", params.Name, err)
+	}
+	registry[key] = &registered{
+		params:      params,
+		chainParams: chainParams,
+	}
+	return nil
+}
+
+// Lookup returns the parameters registered for the coin on the network.
+func Lookup(coinType iwallet.CoinType, network base.Network) (Params, bool) {
+	registryMtx.RLock()
+	defer registryMtx.RUnlock()
+
+	reg, ok := registry[registryKey{coinType, network}]
+	if !ok {
+		return Params{}, false
+	}
+	return reg.params, true
+}
+
+// lookup returns the registered parameters along with their chaincfg
+// parameters.
+func lookup(coinType iwallet.CoinType, network base.Network) (*registered, error) {
+	registryMtx.RLock()
+	defer registryMtx.RUnlock()
+
+	reg, ok := registry[registryKey{coinType, network}]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s %s", ErrNotRegistered, coinType.CurrencyCode(), network)
+	}
+	return reg, nil
+}
@@ -0,0 +1,224 @@
+package fork
+
+import (
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/btcsuite/btcwallet/wallet/txsizes"
+	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/multiwallet/client"
+	"github.com/cpacia/multiwallet/coins/utxobase"
+	iwallet "github.com/cpacia/wallet-interface"
+)
+
+// Assert interfaces
+var _ = iwallet.Wallet(&ForkWallet{})
+var _ = iwallet.WalletCrypter(&ForkWallet{})
+
+const defaultFeePerByte = 1
+
+// ForkWallet is a utxobase wallet for a registered fork.
+type ForkWallet struct { // nolint
+	utxobase.Wallet
+	params      Params
+	chainParams *chaincfg.Params
+}
+
+// NewForkWallet returns a new ForkWallet for the coin using the parameters
+// registered for the config's network. This constructor attempts to
+// connect to the API. If it fails, it will not build.
+func NewForkWallet(cfg *base.WalletConfig, coinType iwallet.CoinType) (*ForkWallet, error) {
+	reg, err := lookup(coinType, cfg.SelectedNetwork())
+	if err != nil {
+		return nil, err
+	}
+	w := &ForkWallet{
+		params:      reg.params,
+		chainParams: reg.chainParams,
+	}
+
+	chainClient, err := client.NewChainClient(cfg.ClientURL, coinType)
+	if err != nil {
+		return nil, err
+	}
+
+	chainClient, err = client.WithFailover(chainClient, cfg.FallbackClientURLs, coinType, cfg.Logger)
+	if err != nil {
+		return nil, err
+	}
+
+	chainClient, err = client.WithVerification(chainClient, cfg.VerifyClientURL, coinType, cfg.Logger)
+	if err != nil {
+		return nil, err
+	}
+
+	feePerByte := w.params.FeePerByte
+	if feePerByte == 0 {
+		feePerByte = defaultFeePerByte
+	}
+	fee := iwallet.NewAmount(feePerByte)
+	fp := base.NewHardCodedFeeProvider(fee, fee, fee, fee)
+	if cfg.FeeProvider != nil {
+		fp = cfg.FeeProvider
+	}
+
+	w.ChainClient = chainClient
+	w.DB = cfg.DB
+	w.Logger = cfg.Logger
+	w.CoinType = coinType
+	w.Done = make(chan struct{})
+	w.AddressFunc = w.keyToAddress
+	w.NormalizeAddress = w.normalizeAddress
+	w.GapLimit = cfg.GapLimit
+	w.KeychainOpts = cfg.KeychainOptions()
+	w.Prune = cfg.Prune
+	w.Confirmations = cfg.Confirmations
+	w.SpendPolicy = cfg.SpendPolicy
+	w.MessageMagic = w.params.MessageMagic
+	w.FeeProvider = fp
+	w.Chain = w.chain()
+	w.KeychainOpts = append(w.KeychainOpts, base.IndexScripts(w.Chain.AddressToScript))
+	w.ChangePolicy = cfg.ChangePolicy
+	w.ChangeAddress = cfg.ChangeAddress
+	w.PreventAddressReuse = cfg.PreventAddressReuse
+	w.DeterministicBuilds = cfg.DeterministicBuilds
+	w.SeparateSources = cfg.SeparateUtxoSources
+	return w, nil
+}
+
+// Params returns the fork's parameters.
+func (w *ForkWallet) Params() Params {
+	return w.params
+}
+
+// chain returns the functions used by the utxobase wallet.
+func (w *ForkWallet) chain() *utxobase.Chain {
+	changeScriptSize := txsizes.P2PKHPkScriptSize
+	serialize := utxobase.SerializeBase
+	if w.params.Segwit() {
+		changeScriptSize = txsizes.P2WPKHPkScriptSize
+		serialize = utxobase.SerializeWitness
+	}
+	return &utxobase.Chain{
+		AddressToScript:   w.addressToScript,
+		SignTx:            w.signTx,
+		Serialize:         serialize,
+		EstimateSize:      w.estimateSize,
+		ChangeScriptSize:  changeScriptSize,
+		EstimationAddress: w.estimationAddress(),
+		ScriptHashAddress: w.scriptHashAddress,
+		SignScriptInput:   w.signScriptInput,
+	}
+}
+
+// estimationAddress returns an address of the type the wallet pays to for
+// estimating fees.
+func (w *ForkWallet) estimationAddress() string {
+	var (
+		addr btcutil.Address
+		err  error
+	)
+	if w.params.Segwit() {
+		addr, err = btcutil.NewAddressWitnessPubKeyHash(make([]byte, 20), w.chainParams)
+	} else {
+		addr, err = btcutil.NewAddressPubKeyHash(make([]byte, 20), w.chainParams)
+	}
+	if err != nil {
+		return ""
+	}
+	return addr.String()
+}
+
+// estimateSize returns the size of a transaction spending outputs of the
+// wallet's address type.
+func (w *ForkWallet) estimateSize(prevScripts [][]byte, outputs []*wire.TxOut, addChange bool) int {
+	if w.params.Segwit() {
+		return txsizes.EstimateVirtualSize(0, len(prevScripts), 0, outputs, addChange)
+	}
+	return txsizes.EstimateSerializeSize(len(prevScripts), outputs, addChange)
+}
+
+func (w *ForkWallet) addressToScript(addr string) ([]byte, error) {
+	address, err := btcutil.DecodeAddress(addr, w.chainParams)
+	if err != nil {
+		return nil, err
+	}
+	if !address.IsForNet(w.chainParams) {
+		return nil, fmt.Errorf("address %s is not for %s", addr, w.params.Name)
+	}
+	return txscript.PayToAddrScript(address)
+}
+
+// normalizeAddress decodes and re-encodes the address so every encoding
+// of it, such as upper case bech32, has the same string.
+func (w *ForkWallet) normalizeAddress(addr iwallet.Address) (iwallet.Address, error) {
+	address, err := btcutil.DecodeAddress(addr.String(), w.chainParams)
+	if err != nil {
+		return iwallet.Address{}, err
+	}
+	return iwallet.NewAddress(address.EncodeAddress(), w.CoinType), nil
+}
+
+// signTx signs each P2PKH or P2WPKH input with the bitcoin signature hash.
+func (w *ForkWallet) signTx(tx *wire.MsgTx, prevScripts map[wire.OutPoint][]byte, values map[wire.OutPoint]int64, keys map[wire.OutPoint]*btcec.PrivateKey) error {
+	sigHashes := txscript.NewTxSigHashes(tx)
+	for i, txIn := range tx.TxIn {
+		prevScript := prevScripts[txIn.PreviousOutPoint]
+		key := keys[txIn.PreviousOutPoint]
+		if key == nil {
+			return errors.New("missing key for input")
+		}
+		switch {
+		case txscript.IsPayToWitnessPubKeyHash(prevScript):
+			witness, err := txscript.WitnessSignature(tx, sigHashes, i, values[txIn.PreviousOutPoint], prevScript, txscript.SigHashAll, key, true)
+			if err != nil {
+				return err
+			}
+			txIn.Witness = witness
+		default:
+			sigScript, err := txscript.SignatureScript(tx, i, prevScript, txscript.SigHashAll, key, true)
+			if err != nil {
+				return err
+			}
+			txIn.SignatureScript = sigScript
+		}
+	}
+	return nil
+}
+
+func (w *ForkWallet) scriptHashAddress(script []byte) (string, error) {
+	addr, err := btcutil.NewAddressScriptHash(script, w.chainParams)
+	if err != nil {
+		return "", err
+	}
+	return addr.String(), nil
+}
+
+// signScriptInput signs a P2SH input with the legacy signature hash.
+func (w *ForkWallet) signScriptInput(tx *wire.MsgTx, idx int, script []byte, amount int64, key *btcec.PrivateKey) ([]byte, error) {
+	return txscript.RawTxInSignature(tx, idx, script, txscript.SigHashAll, key)
+}
+
+func (w *ForkWallet) keyToAddress(key *hdkeychain.ExtendedKey) (iwallet.Address, error) {
+	pubKey, err := key.ECPubKey()
+	if err != nil {
+		return iwallet.Address{}, err
+	}
+	pkh := btcutil.Hash160(pubKey.SerializeCompressed())
+
+	var addr btcutil.Address
+	if w.params.Segwit() {
+		addr, err = btcutil.NewAddressWitnessPubKeyHash(pkh, w.chainParams)
+	} else {
+		addr, err = btcutil.NewAddressPubKeyHash(pkh, w.chainParams)
+	}
+	if err != nil {
+		return iwallet.Address{}, err
+	}
+	return iwallet.NewAddress(addr.String(), w.CoinType), nil
+}
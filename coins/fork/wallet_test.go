@@ -0,0 +1,241 @@
+package fork
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/multiwallet/coins/utxobase"
+	"github.com/cpacia/multiwallet/database"
+	"github.com/cpacia/multiwallet/database/sqlitedb"
+	"github.com/cpacia/multiwallet/log"
+	iwallet "github.com/cpacia/wallet-interface"
+	"testing"
+	"time"
+)
+
+const (
+	ctDogecoin = iwallet.CoinType("DOGE")
+	ctTestFork = iwallet.CoinType("FORK")
+)
+
+var (
+	dogecoinParams = Params{
+		CoinType:         ctDogecoin,
+		Name:             "dogecoin-mainnet",
+		Net:              0xc0c0c0c0,
+		DefaultPort:      "22556",
+		PubKeyHashAddrID: 0x1e,
+		ScriptHashAddrID: 0x16,
+		PrivateKeyID:     0x9e,
+		HDPrivateKeyID:   [4]byte{0x02, 0xfa, 0xc3, 0x98},
+		HDPublicKeyID:    [4]byte{0x02, 0xfa, 0xca, 0xfd},
+		HDCoinType:       3,
+		MessageMagic:     "Dogecoin Signed Message:\n",
+	}
+
+	segwitForkParams = Params{
+		CoinType:         ctTestFork,
+		Network:          base.NetworkRegtest,
+		Name:             "fork-regtest",
+		Net:              0x0b0f0b0f,
+		PubKeyHashAddrID: 0x41,
+		ScriptHashAddrID: 0x42,
+		PrivateKeyID:     0xc1,
+		Bech32HRPSegwit:  "fork",
+		HDPrivateKeyID:   [4]byte{0x04, 0x35, 0x83, 0x94},
+		HDPublicKeyID:    [4]byte{0x04, 0x35, 0x87, 0xcf},
+		HDCoinType:       9999,
+		FeePerByte:       2,
+	}
+)
+
+// registerTestParams registers the test forks. They're registered once
+// for the whole package as chaincfg can't unregister them.
+func registerTestParams(t *testing.T) {
+	for _, params := range []Params{dogecoinParams, segwitForkParams} {
+		if err := Register(params); err != nil && !errors.Is(err, ErrAlreadyRegistered) {
+			t.Fatal(err)
+		}
+	}
+}
+
+func newTestWallet(t *testing.T, params Params) *ForkWallet {
+	registerTestParams(t)
+	reg, err := lookup(params.CoinType, params.Network)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &ForkWallet{
+		params:      reg.params,
+		chainParams: reg.chainParams,
+	}
+	w.FeeProvider = base.NewHardCodedFeeProvider(iwallet.NewAmount(50), iwallet.NewAmount(40), iwallet.NewAmount(30), iwallet.NewAmount(20))
+	w.Chain = w.chain()
+
+	db, err := sqlitedb.NewMemoryDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.InitializeDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+
+	w.ChainClient = base.NewMockChainClient()
+	w.DB = db
+	w.Logger = log.New("forktest")
+	w.CoinType = params.CoinType
+	w.Done = make(chan struct{})
+	w.AddressFunc = w.keyToAddress
+
+	key, err := testKey(reg.chainParams, params.HDCoinType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.CreateWallet(*key, nil, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.OpenWallet(); err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+// testKey derives m/44'/coinType' from the BIP32 test vector seed.
+func testKey(params *chaincfg.Params, coinType uint32) (*hdkeychain.ExtendedKey, error) {
+	seed, err := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+	if err != nil {
+		return nil, err
+	}
+	master, err := hdkeychain.NewMaster(seed, params)
+	if err != nil {
+		return nil, err
+	}
+	purpose, err := master.Child(hdkeychain.HardenedKeyStart + 44)
+	if err != nil {
+		return nil, err
+	}
+	return purpose.Child(hdkeychain.HardenedKeyStart + coinType)
+}
+
+func TestRegister(t *testing.T) {
+	registerTestParams(t)
+
+	if err := Register(dogecoinParams); !errors.Is(err, ErrAlreadyRegistered) {
+		t.Errorf("Expected ErrAlreadyRegistered, got %v", err)
+	}
+	btc := dogecoinParams
+	btc.CoinType = iwallet.CtBitcoin
+	if err := Register(btc); err == nil {
+		t.Error("Expected registering a built in coin to fail")
+	}
+
+	params, ok := Lookup(ctDogecoin, base.NetworkMainnet)
+	if !ok || params.HDCoinType != 3 {
+		t.Errorf("Expected the dogecoin params, got %v", params)
+	}
+	if _, ok := Lookup(ctDogecoin, base.NetworkTestnet); ok {
+		t.Error("Expected no dogecoin testnet params")
+	}
+	if _, err := NewForkWallet(&base.WalletConfig{Testnet: true}, ctDogecoin); !errors.Is(err, ErrNotRegistered) {
+		t.Errorf("Expected ErrNotRegistered, got %v", err)
+	}
+}
+
+func TestForkWallet_keyToAddress(t *testing.T) {
+	tests := []struct {
+		params   Params
+		expected string
+	}{
+		{dogecoinParams, "DDALtZ8SF7br219bVYEkBuf2SpaUFP2djY"},
+		{segwitForkParams, "fork1q03kwjpsqgcd57007pkj3t67su7ge8hl93uwpjr"},
+	}
+	for _, test := range tests {
+		w := newTestWallet(t, test.params)
+
+		// The wallet's first address is m/44'/coinType'/0/0.
+		addr, err := w.Keychain.CurrentAddress(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr.String() != test.expected {
+			t.Errorf("%s: expected address %s, got %s", test.params.Name, test.expected, addr)
+		}
+		if err := w.ValidateAddress(addr); err != nil {
+			t.Errorf("%s: expected own address to validate: %s", test.params.Name, err)
+		}
+		if err := w.ValidateAddress(iwallet.NewAddress("1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2", test.params.CoinType)); err == nil {
+			t.Errorf("%s: expected a bitcoin address to be rejected", test.params.Name)
+		}
+	}
+}
+
+func TestForkWallet_Spend(t *testing.T) {
+	for _, params := range []Params{dogecoinParams, segwitForkParams} {
+		w := newTestWallet(t, params)
+
+		addr, err := w.Keychain.CurrentAddress(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fromScript, err := w.addressToScript(addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		h, err := chainhash.NewHashFromStr("bdb237bf8c5de6b60ba1e2dcfe364fc24f583e568d1682f851a9d0f11a45c78d")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.DB.Store().SaveUtxo(context.Background(), &database.UtxoRecord{
+			Timestamp: time.Now(),
+			Amount:    "1000000",
+			Height:    600000,
+			Coin:      params.CoinType,
+			Address:   addr.String(),
+			Outpoint:  hex.EncodeToString(utxobase.SerializeOutpoint(wire.NewOutPoint(h, 0))),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wtx, err := w.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Spend(wtx, iwallet.NewAddress(w.estimationAddress(), params.CoinType), iwallet.NewAmount(500000), iwallet.FlNormal); err != nil {
+			t.Fatal(err)
+		}
+		if err := wtx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		txs, err := w.DB.Store().ListUnconfirmed(context.Background(), params.CoinType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(txs) != 1 {
+			t.Fatalf("%s: expected 1 tx found %d", params.Name, len(txs))
+		}
+		var tx wire.MsgTx
+		if err := tx.Deserialize(bytes.NewReader(txs[0].TxBytes)); err != nil {
+			t.Fatal(err)
+		}
+		if params.Segwit() != tx.HasWitness() {
+			t.Errorf("%s: expected witness %t", params.Name, params.Segwit())
+		}
+		vm, err := txscript.NewEngine(fromScript, &tx, 0, txscript.StandardVerifyFlags, nil, nil, 1000000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := vm.Execute(); err != nil {
+			t.Errorf("%s: script verification failed: %s", params.Name, err)
+		}
+	}
+}
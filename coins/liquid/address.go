@@ -0,0 +1,225 @@
+package liquid
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/bech32"
+	hd "github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/cpacia/multiwallet/base"
+	"strings"
+)
+
+// ErrInvalidAddress is returned when an address can't be decoded.
+var ErrInvalidAddress = errors.New("invalid liquid address")
+
+// MasterBlindingKey derives the SLIP-0077 master blinding key.
+//
+// SLIP-0077 derives the key from the BIP39 seed. The wallet is only ever
+// given the coin level extended key so its private key is used in place of
+// the seed.
+func MasterBlindingKey(xpriv *hd.ExtendedKey) ([]byte, error) {
+	priv, err := xpriv.ECPrivKey()
+	if err != nil {
+		return nil, err
+	}
+	defer base.ZeroPrivKey(priv)
+	seed := priv.Serialize()
+	defer base.ZeroBytes(seed)
+
+	// SLIP-0021 master node then the child for the SLIP-0077 label.
+	mac := hmac.New(sha512.New, []byte("Symmetric key seed"))
+	mac.Write(seed)
+	node := mac.Sum(nil)
+	defer base.ZeroBytes(node)
+
+	mac = hmac.New(sha512.New, node[:32])
+	mac.Write(append([]byte{0x00}, []byte("SLIP-0077")...))
+	child := mac.Sum(nil)
+	key := make([]byte, 32)
+	copy(key, child[32:])
+	base.ZeroBytes(child)
+	return key, nil
+}
+
+// BlindingKey returns the blinding key pair for the output script.
+func BlindingKey(masterBlindingKey, script []byte) (*btcec.PrivateKey, *btcec.PublicKey) {
+	mac := hmac.New(sha256.New, masterBlindingKey)
+	mac.Write(script)
+	return btcec.PrivKeyFromBytes(btcec.S256(), mac.Sum(nil))
+}
+
+// ConfidentialAddress is a segwit address with the public blinding key used
+// to blind outputs sent to it.
+type ConfidentialAddress struct {
+	BlindingKey    *btcec.PublicKey
+	WitnessVersion byte
+	WitnessProgram []byte
+}
+
+// NewConfidentialAddress returns the confidential P2WPKH address for the
+// wallet key. The blinding key is derived from the address's script.
+func NewConfidentialAddress(key *hd.ExtendedKey, masterBlindingKey []byte) (*ConfidentialAddress, error) {
+	pubkey, err := key.ECPubKey()
+	if err != nil {
+		return nil, err
+	}
+	program := btcutil.Hash160(pubkey.SerializeCompressed())
+	addr := &ConfidentialAddress{
+		WitnessVersion: 0,
+		WitnessProgram: program,
+	}
+	_, addr.BlindingKey = BlindingKey(masterBlindingKey, addr.Script())
+	return addr, nil
+}
+
+// Script returns the output script for the address.
+func (a *ConfidentialAddress) Script() []byte {
+	version := byte(txscript.OP_0)
+	if a.WitnessVersion > 0 {
+		version = txscript.OP_1 + a.WitnessVersion - 1
+	}
+	return append([]byte{version, byte(len(a.WitnessProgram))}, a.WitnessProgram...)
+}
+
+// Encode returns the blech32 encoding of the address.
+func (a *ConfidentialAddress) Encode(params *Params) (string, error) {
+	payload := append(a.BlindingKey.SerializeCompressed(), a.WitnessProgram...)
+	conv, err := bech32.ConvertBits(payload, 8, 5, true)
+	if err != nil {
+		return "", err
+	}
+	return blech32Encode(params.ConfidentialHRP, append([]byte{a.WitnessVersion}, conv...), a.WitnessVersion > 0)
+}
+
+// Unconfidential returns the bech32 encoding of the address without the
+// blinding key. Outputs sent to it are not blinded.
+func (a *ConfidentialAddress) Unconfidential(params *Params) (string, error) {
+	conv, err := bech32.ConvertBits(a.WitnessProgram, 8, 5, true)
+	if err != nil {
+		return "", err
+	}
+	return bech32.Encode(params.UnconfidentialHRP, append([]byte{a.WitnessVersion}, conv...))
+}
+
+// DecodeConfidentialAddress decodes a blech32 confidential address.
+func DecodeConfidentialAddress(addr string, params *Params) (*ConfidentialAddress, error) {
+	hrp, data, err := blech32Decode(addr)
+	if err != nil {
+		return nil, err
+	}
+	if hrp != params.ConfidentialHRP || len(data) < 1 {
+		return nil, ErrInvalidAddress
+	}
+	payload, err := bech32.ConvertBits(data[1:], 5, 8, false)
+	if err != nil {
+		return nil, ErrInvalidAddress
+	}
+	if len(payload) != 33+20 && len(payload) != 33+32 {
+		return nil, ErrInvalidAddress
+	}
+	blindingKey, err := btcec.ParsePubKey(payload[:33], btcec.S256())
+	if err != nil {
+		return nil, ErrInvalidAddress
+	}
+	return &ConfidentialAddress{
+		BlindingKey:    blindingKey,
+		WitnessVersion: data[0],
+		WitnessProgram: payload[33:],
+	}, nil
+}
+
+// The blech32 format used by confidential addresses is bech32 with a 60 bit
+// checksum to accommodate the longer payload.
+
+const blech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+const (
+	blech32Const  = 1
+	blech32mConst = 0x455972a3350f7a1
+)
+
+var blech32Gen = [5]uint64{0x7d52fba40bd886, 0x5e8dbf1a03950c, 0x1c3a3c74072a18, 0x385d72fa0e5139, 0x7093e5a608865b}
+
+func blech32Polymod(values []byte) uint64 {
+	chk := uint64(1)
+	for _, v := range values {
+		top := chk >> 55
+		chk = (chk&0x7fffffffffffff)<<5 ^ uint64(v)
+		for i := 0; i < 5; i++ {
+			if (top>>uint(i))&1 == 1 {
+				chk ^= blech32Gen[i]
+			}
+		}
+	}
+	return chk
+}
+
+func hrpExpand(hrp string) []byte {
+	ret := make([]byte, 0, len(hrp)*2+1)
+	for _, c := range hrp {
+		ret = append(ret, byte(c)>>5)
+	}
+	ret = append(ret, 0)
+	for _, c := range hrp {
+		ret = append(ret, byte(c)&31)
+	}
+	return ret
+}
+
+func blech32Encode(hrp string, data []byte, m bool) (string, error) {
+	c := uint64(blech32Const)
+	if m {
+		c = blech32mConst
+	}
+	values := append(hrpExpand(hrp), data...)
+	polymod := blech32Polymod(append(values, make([]byte, 12)...)) ^ c
+
+	var sb strings.Builder
+	sb.WriteString(hrp)
+	sb.WriteByte('1')
+	for _, d := range data {
+		if d > 31 {
+			return "", fmt.Errorf("invalid data byte %d", d)
+		}
+		sb.WriteByte(blech32Charset[d])
+	}
+	for i := 0; i < 12; i++ {
+		sb.WriteByte(blech32Charset[(polymod>>uint(5*(11-i)))&31])
+	}
+	return sb.String(), nil
+}
+
+func blech32Decode(s string) (string, []byte, error) {
+	if strings.ToLower(s) != s && strings.ToUpper(s) != s {
+		return "", nil, ErrInvalidAddress
+	}
+	s = strings.ToLower(s)
+	pos := strings.LastIndexByte(s, '1')
+	if pos < 1 || pos+13 > len(s) {
+		return "", nil, ErrInvalidAddress
+	}
+	hrp := s[:pos]
+	var data []byte
+	for _, c := range []byte(s[pos+1:]) {
+		idx := bytes.IndexByte([]byte(blech32Charset), c)
+		if idx < 0 {
+			return "", nil, ErrInvalidAddress
+		}
+		data = append(data, byte(idx))
+	}
+	c := uint64(blech32Const)
+	if data[0] > 0 {
+		c = blech32mConst
+	}
+	if blech32Polymod(append(hrpExpand(hrp), data...)) != c {
+		return "", nil, ErrInvalidAddress
+	}
+	return hrp, data[:len(data)-12], nil
+}
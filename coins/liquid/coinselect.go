@@ -0,0 +1,114 @@
+package liquid
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/cpacia/multiwallet/base"
+	"sort"
+)
+
+// ErrBlindedOutput is returned for outputs whose asset or value is a
+// commitment rather than explicit. Unblinding them needs the secp256k1-zkp
+// rangeproofs, which this package doesn't implement.
+var ErrBlindedOutput = errors.New("blinded outputs are not supported")
+
+// The prefixes of the confidential fields of Elements transaction outputs.
+// Explicit fields are prefixed with 1 and commitments with their parity.
+const (
+	explicitPrefix = 0x01
+
+	assetCommitmentEven = 0x0a
+	assetCommitmentOdd  = 0x0b
+	valueCommitmentEven = 0x08
+	valueCommitmentOdd  = 0x09
+)
+
+// ExplicitAsset decodes the serialized asset of a transaction output. It
+// returns ErrBlindedOutput if the asset is a commitment.
+func ExplicitAsset(b []byte) (Asset, error) {
+	var a Asset
+	if len(b) != 33 {
+		return a, errors.New("invalid asset length")
+	}
+	switch b[0] {
+	case explicitPrefix:
+		copy(a[:], b[1:])
+		return a, nil
+	case assetCommitmentEven, assetCommitmentOdd:
+		return a, ErrBlindedOutput
+	}
+	return a, fmt.Errorf("invalid asset prefix %d", b[0])
+}
+
+// ExplicitValue decodes the serialized value of a transaction output. It
+// returns ErrBlindedOutput if the value is a commitment.
+func ExplicitValue(b []byte) (uint64, error) {
+	if len(b) == 0 {
+		return 0, errors.New("invalid value length")
+	}
+	switch b[0] {
+	case explicitPrefix:
+		if len(b) != 9 {
+			return 0, errors.New("invalid value length")
+		}
+		return binary.BigEndian.Uint64(b[1:]), nil
+	case valueCommitmentEven, valueCommitmentOdd:
+		return 0, ErrBlindedOutput
+	}
+	return 0, fmt.Errorf("invalid value prefix %d", b[0])
+}
+
+// Utxo is an unspent output with an explicit asset and value.
+type Utxo struct {
+	Outpoint wire.OutPoint
+	Asset    Asset
+	Value    uint64
+	Script   []byte
+}
+
+// SelectCoins picks the utxos to pay amount of asset along with a fee in
+// the network's policy asset. Each asset is selected separately, largest
+// utxos first, as an output can only fund its own asset. The change owed
+// in each asset is returned with the selection. base.ErrInsufficientFunds
+// is returned if the utxos can't cover an asset.
+func SelectCoins(utxos []Utxo, asset Asset, amount, fee uint64, params *Params) ([]Utxo, map[Asset]uint64, error) {
+	targets := []Asset{asset}
+	needed := map[Asset]uint64{asset: amount}
+	if fee > 0 {
+		if asset != params.PolicyAsset {
+			targets = append(targets, params.PolicyAsset)
+		}
+		needed[params.PolicyAsset] += fee
+	}
+
+	byValue := make([]Utxo, len(utxos))
+	copy(byValue, utxos)
+	sort.SliceStable(byValue, func(i, j int) bool {
+		return byValue[i].Value > byValue[j].Value
+	})
+
+	var selected []Utxo
+	change := make(map[Asset]uint64)
+	for _, a := range targets {
+		var total uint64
+		for _, u := range byValue {
+			if total >= needed[a] {
+				break
+			}
+			if u.Asset != a {
+				continue
+			}
+			selected = append(selected, u)
+			total += u.Value
+		}
+		if total < needed[a] {
+			return nil, nil, base.ErrInsufficientFunds
+		}
+		if total > needed[a] {
+			change[a] = total - needed[a]
+		}
+	}
+	return selected, change, nil
+}
@@ -0,0 +1,254 @@
+package liquid
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/cpacia/multiwallet/base"
+	"math/big"
+	"testing"
+)
+
+func testKey(t *testing.T) *hdkeychain.ExtendedKey {
+	key, err := hdkeychain.NewKeyFromString("tprv8ZgxMBicQKsPeghT19pungdFLMJM2hMs3EEn5WtgobD7wuQSFQu4VNaEJXH9HS3RhhLT4wgZ3hj31m3kafuxhL9vfGTRtBVLSog4zjxW3L1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestAsset(t *testing.T) {
+	id := "6f0279e9ed041c3d710a9f57d0c02928416460c4b722ae3457a11eec381c526d"
+	asset, err := NewAssetFromString(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if asset.String() != id {
+		t.Errorf("Expected %s, got %s", id, asset)
+	}
+	if !asset.IsPolicyAsset(&MainNetParams) {
+		t.Error("Expected L-BTC to be the policy asset")
+	}
+	if asset.IsPolicyAsset(&TestNetParams) {
+		t.Error("Expected mainnet L-BTC not to be the testnet policy asset")
+	}
+	if _, err := NewAssetFromString("6f02"); err == nil {
+		t.Error("Expected short asset id to fail")
+	}
+}
+
+func TestConfidentialAddress(t *testing.T) {
+	xpriv := testKey(t)
+	master, err := MasterBlindingKey(xpriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	master2, err := MasterBlindingKey(xpriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(master, master2) {
+		t.Error("Master blinding key is not deterministic")
+	}
+
+	child, err := xpriv.Child(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := NewConfidentialAddress(child, master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, pub := BlindingKey(master, addr.Script())
+	if !priv.PubKey().IsEqual(addr.BlindingKey) || !pub.IsEqual(addr.BlindingKey) {
+		t.Error("Address blinding key does not match derived key")
+	}
+
+	for _, params := range []*Params{&MainNetParams, &TestNetParams} {
+		encoded, err := addr.Encode(params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix([]byte(encoded), []byte(params.ConfidentialHRP+"1")) {
+			t.Errorf("Unexpected prefix for %s", encoded)
+		}
+		decoded, err := DecodeConfidentialAddress(encoded, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !decoded.BlindingKey.IsEqual(addr.BlindingKey) || !bytes.Equal(decoded.WitnessProgram, addr.WitnessProgram) || decoded.WitnessVersion != 0 {
+			t.Error("Decoded address does not match")
+		}
+
+		corrupt := []byte(encoded)
+		if corrupt[len(corrupt)-1] == 'q' {
+			corrupt[len(corrupt)-1] = 'p'
+		} else {
+			corrupt[len(corrupt)-1] = 'q'
+		}
+		if _, err := DecodeConfidentialAddress(string(corrupt), params); err == nil {
+			t.Error("Expected corrupted address to fail")
+		}
+
+		unconf, err := addr.Unconfidential(params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix([]byte(unconf), []byte(params.UnconfidentialHRP+"1")) {
+			t.Errorf("Unexpected prefix for %s", unconf)
+		}
+	}
+
+	encoded, err := addr.Encode(&MainNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecodeConfidentialAddress(encoded, &TestNetParams); err == nil {
+		t.Error("Expected wrong network to fail")
+	}
+}
+
+func TestPeginAddress(t *testing.T) {
+	privKey, _ := btcec.PrivKeyFromBytes(btcec.S256(), bytes.Repeat([]byte{0x01}, 32))
+	pubKey := privKey.PubKey().SerializeCompressed()
+
+	fedpegScript, err := txscript.NewScriptBuilder().
+		AddOp(txscript.OP_1).AddData(pubKey).AddOp(txscript.OP_1).AddOp(txscript.OP_CHECKMULTISIG).Script()
+	if err != nil {
+		t.Fatal(err)
+	}
+	claimScript := []byte{txscript.OP_0, txscript.OP_DATA_20}
+	claimScript = append(claimScript, bytes.Repeat([]byte{0x02}, 20)...)
+
+	tweaked, err := tweakFedpegScript(fedpegScript, claimScript)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mac := hmac.New(sha256.New, pubKey)
+	mac.Write(claimScript)
+	d := new(big.Int).Add(privKey.D, new(big.Int).SetBytes(mac.Sum(nil)))
+	d.Mod(d, btcec.S256().N)
+	tweakedPriv, _ := btcec.PrivKeyFromBytes(btcec.S256(), d.Bytes())
+
+	expected, err := txscript.NewScriptBuilder().
+		AddOp(txscript.OP_1).AddData(tweakedPriv.PubKey().SerializeCompressed()).AddOp(txscript.OP_1).AddOp(txscript.OP_CHECKMULTISIG).Script()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tweaked, expected) {
+		t.Error("Incorrectly tweaked fedpeg script")
+	}
+
+	addr, err := PeginAddress(fedpegScript, claimScript, &TestNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !addr.IsForNet(TestNetParams.ParentParams) {
+		t.Error("Pegin address is for the wrong network")
+	}
+
+	if _, err := tweakFedpegScript([]byte{txscript.OP_1}, claimScript); err == nil {
+		t.Error("Expected script without keys to fail")
+	}
+}
+
+func TestPegoutScript(t *testing.T) {
+	mainchainScript := append([]byte{txscript.OP_0, txscript.OP_DATA_20}, bytes.Repeat([]byte{0x03}, 20)...)
+	script, err := PegoutScript(mainchainScript, &MainNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushes, err := txscript.PushedData(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if script[0] != txscript.OP_RETURN || len(pushes) != 2 {
+		t.Fatal("Invalid pegout script")
+	}
+	if !bytes.Equal(pushes[0], MainNetParams.ParentParams.GenesisHash[:]) {
+		t.Error("Pegout script does not commit to the parent chain")
+	}
+	if !bytes.Equal(pushes[1], mainchainScript) {
+		t.Error("Pegout script does not commit to the mainchain script")
+	}
+}
+
+func TestExplicitFields(t *testing.T) {
+	policy := TestNetParams.PolicyAsset
+	asset, err := ExplicitAsset(append([]byte{0x01}, policy[:]...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if asset != policy {
+		t.Errorf("Expected %s, got %s", policy, asset)
+	}
+	if _, err := ExplicitAsset(append([]byte{0x0a}, policy[:]...)); err != ErrBlindedOutput {
+		t.Errorf("Expected ErrBlindedOutput, got %v", err)
+	}
+	if _, err := ExplicitAsset(policy[:]); err == nil {
+		t.Error("Expected a short asset to fail")
+	}
+
+	value, err := ExplicitValue([]byte{0x01, 0, 0, 0, 0, 0, 0x01, 0x86, 0xa0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != 100000 {
+		t.Errorf("Expected 100000, got %d", value)
+	}
+	if _, err := ExplicitValue(append([]byte{0x09}, make([]byte, 32)...)); err != ErrBlindedOutput {
+		t.Errorf("Expected ErrBlindedOutput, got %v", err)
+	}
+	if _, err := ExplicitValue([]byte{0x01, 0}); err == nil {
+		t.Error("Expected a short value to fail")
+	}
+}
+
+func TestSelectCoins(t *testing.T) {
+	params := &TestNetParams
+	token := Asset{0x01}
+	utxos := []Utxo{
+		{Asset: params.PolicyAsset, Value: 500},
+		{Asset: token, Value: 40},
+		{Asset: params.PolicyAsset, Value: 2000},
+		{Asset: token, Value: 100},
+		{Asset: token, Value: 70},
+	}
+
+	selected, change, err := SelectCoins(utxos, token, 150, 300, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selected) != 3 {
+		t.Fatalf("Expected 3 utxos, got %d", len(selected))
+	}
+	if selected[0].Value != 100 || selected[1].Value != 70 || selected[2].Value != 2000 {
+		t.Errorf("Unexpected selection %+v", selected)
+	}
+	if change[token] != 20 || change[params.PolicyAsset] != 1700 {
+		t.Errorf("Unexpected change %v", change)
+	}
+
+	// Paying L-BTC combines the amount and the fee.
+	selected, change, err = SelectCoins(utxos, params.PolicyAsset, 2000, 300, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selected) != 2 || change[params.PolicyAsset] != 200 {
+		t.Errorf("Unexpected selection %+v with change %v", selected, change)
+	}
+	if _, ok := change[token]; ok {
+		t.Error("Expected no token change")
+	}
+
+	if _, _, err := SelectCoins(utxos, token, 211, 300, params); err != base.ErrInsufficientFunds {
+		t.Errorf("Expected insufficient funds, got %v", err)
+	}
+	if _, _, err := SelectCoins(utxos, token, 10, 2600, params); err != base.ErrInsufficientFunds {
+		t.Errorf("Expected insufficient funds for the fee, got %v", err)
+	}
+}
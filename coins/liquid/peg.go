@@ -0,0 +1,84 @@
+package liquid
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcutil"
+)
+
+// PeginAddress returns the mainchain address bitcoin must be sent to in
+// order to peg it in to the sidechain. fedpegScript is the federation's
+// script as returned by getsidechaininfo and claimScript is the sidechain
+// script which will be allowed to claim the funds. Each public key in the
+// federation script is tweaked by HMAC-SHA256(pubkey, claimScript) and the
+// resulting script is wrapped in P2SH-P2WSH.
+func PeginAddress(fedpegScript, claimScript []byte, params *Params) (btcutil.Address, error) {
+	tweaked, err := tweakFedpegScript(fedpegScript, claimScript)
+	if err != nil {
+		return nil, err
+	}
+	witnessHash := sha256.Sum256(tweaked)
+	witnessScript, err := txscript.NewScriptBuilder().AddOp(txscript.OP_0).AddData(witnessHash[:]).Script()
+	if err != nil {
+		return nil, err
+	}
+	return btcutil.NewAddressScriptHash(witnessScript, params.ParentParams)
+}
+
+// PegoutScript returns the sidechain output script which burns the output's
+// value and releases it to mainchainScript on the parent chain. Liquid
+// mainnet additionally requires a PAK proof which must be supplied by the
+// node building the transaction.
+func PegoutScript(mainchainScript []byte, params *Params) ([]byte, error) {
+	if len(mainchainScript) == 0 {
+		return nil, errors.New("mainchain script is empty")
+	}
+	return txscript.NewScriptBuilder().
+		AddOp(txscript.OP_RETURN).
+		AddData(params.ParentParams.GenesisHash[:]).
+		AddData(mainchainScript).
+		Script()
+}
+
+func tweakFedpegScript(fedpegScript, claimScript []byte) ([]byte, error) {
+	pushes, err := txscript.PushedData(fedpegScript)
+	if err != nil {
+		return nil, err
+	}
+	tweaked := make([]byte, len(fedpegScript))
+	copy(tweaked, fedpegScript)
+
+	var nKeys int
+	for _, data := range pushes {
+		if len(data) != 33 {
+			continue
+		}
+		pubkey, err := btcec.ParsePubKey(data, btcec.S256())
+		if err != nil {
+			continue
+		}
+		mac := hmac.New(sha256.New, data)
+		mac.Write(claimScript)
+		tweak := mac.Sum(nil)
+
+		curve := btcec.S256()
+		tx, ty := curve.ScalarBaseMult(tweak)
+		x, y := curve.Add(pubkey.X, pubkey.Y, tx, ty)
+		newKey := (&btcec.PublicKey{Curve: curve, X: x, Y: y}).SerializeCompressed()
+
+		idx := bytes.Index(tweaked, data)
+		if idx < 0 {
+			return nil, errors.New("invalid fedpeg script")
+		}
+		copy(tweaked[idx:], newKey)
+		nKeys++
+	}
+	if nKeys == 0 {
+		return nil, errors.New("fedpeg script contains no public keys")
+	}
+	return tweaked, nil
+}
@@ -0,0 +1,149 @@
+package litecoin
+
+import (
+	"bytes"
+	"errors"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	ltcec "github.com/ltcsuite/ltcd/btcec"
+	"github.com/ltcsuite/ltcd/txscript"
+	"github.com/ltcsuite/ltcd/wire"
+	"github.com/ltcsuite/ltcutil"
+	"time"
+)
+
+var _ = base.HTLCWallet(&LitecoinWallet{})
+
+// HTLCAddress returns the P2SH address of the contract's redeem script.
+func (w *LitecoinWallet) HTLCAddress(script []byte) (iwallet.Address, error) {
+	if _, err := base.ParseHTLCScript(script); err != nil {
+		return iwallet.Address{}, err
+	}
+	addr, err := ltcutil.NewAddressScriptHash(script, w.params())
+	if err != nil {
+		return iwallet.Address{}, err
+	}
+	return iwallet.NewAddress(addr.String(), iwallet.CtLitecoin), nil
+}
+
+// SpendHTLC redeems the contract output of contractTx with the secret, or
+// refunds it if secret is nil, paying the wallet's current change address.
+// A refund has the contract's lock time and is left queued for the
+// rebroadcaster until it's final.
+func (w *LitecoinWallet) SpendHTLC(wtx iwallet.Tx, contractTx iwallet.Transaction, script, secret []byte, key btcec.PrivateKey, feeLevel iwallet.FeeLevel) (iwallet.TransactionID, error) {
+	contract, err := base.ParseHTLCScript(script)
+	if err != nil {
+		return "", err
+	}
+	if secret != nil {
+		if err := contract.CheckSecret(secret); err != nil {
+			return "", err
+		}
+	}
+	addr, err := w.HTLCAddress(script)
+	if err != nil {
+		return "", err
+	}
+	out, err := base.HTLCOutput(contractTx, addr)
+	if err != nil {
+		return "", err
+	}
+	op, err := derializeOutpoint(out.ID)
+	if err != nil {
+		return "", err
+	}
+
+	changeAddr, err := w.Keychain.CurrentAddress(true)
+	if err != nil {
+		return "", err
+	}
+	decoded, err := ltcutil.DecodeAddress(changeAddr.String(), w.params())
+	if err != nil {
+		return "", err
+	}
+	changeScript, err := txscript.PayToAddrScript(decoded)
+	if err != nil {
+		return "", err
+	}
+
+	fpb, err := w.feeProvider.GetFee(feeLevel)
+	if err != nil {
+		return "", err
+	}
+	fee := fpb.Mul(iwallet.NewAmount(base.HTLCSpendSize(script, secret != nil, len(changeScript))))
+	value := out.Amount.Sub(fee)
+	if value.Cmp(iwallet.NewAmount(0)) <= 0 || w.IsDust(value) {
+		return "", errors.New("htlc amount is too small to pay the fee")
+	}
+
+	tx := wire.NewMsgTx(wire.TxVersion)
+	in := wire.NewTxIn(op, nil, nil)
+	if secret == nil {
+		tx.LockTime = uint32(contract.LockTime)
+		in.Sequence = wire.MaxTxInSequenceNum - 1
+	}
+	tx.AddTxIn(in)
+	tx.AddTxOut(wire.NewTxOut(value.Int64(), changeScript))
+
+	privKey, _ := ltcec.PrivKeyFromBytes(ltcec.S256(), key.Serialize())
+	sig, err := txscript.RawTxInSignature(tx, 0, script, txscript.SigHashAll, privKey)
+	if err != nil {
+		return "", err
+	}
+	pubKey := privKey.PubKey().SerializeCompressed()
+	if secret != nil {
+		in.SignatureScript, err = base.HTLCRedeemSigScript(sig, pubKey, secret, script)
+	} else {
+		in.SignatureScript, err = base.HTLCRefundSigScript(sig, pubKey, script)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	txid := iwallet.TransactionID(tx.TxHash().String())
+
+	var buf bytes.Buffer
+	if err := tx.BtcEncode(&buf, wire.ProtocolVersion, wire.BaseEncoding); err != nil {
+		return txid, err
+	}
+
+	wbtx, ok := wtx.(*base.DBTx)
+	if !ok {
+		return txid, errors.New("tx is not expected type")
+	}
+
+	wbtx.OnCommit = func() error {
+		final := true
+		err := w.DB.Update(func(dbtx database.Tx) error {
+			err := dbtx.Save(&database.UnconfirmedTransaction{
+				Timestamp: time.Now(),
+				Coin:      iwallet.CtLitecoin,
+				TxBytes:   buf.Bytes(),
+				Txid:      txid.String(),
+				LockTime:  tx.LockTime,
+			})
+			if err != nil {
+				return err
+			}
+			if tx.LockTime > 0 {
+				best, err := w.BlockchainInfo()
+				if err != nil {
+					return err
+				}
+				final = base.IsLockTimeFinal(tx.LockTime, best)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if final {
+			w.BroadcastOrQueue(txid, buf.Bytes())
+		}
+		return nil
+	}
+
+	return txid, nil
+}
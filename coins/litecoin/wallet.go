@@ -14,7 +14,7 @@ import (
 	btchd "github.com/btcsuite/btcutil/hdkeychain"
 	"github.com/btcsuite/btcwallet/wallet/txsizes"
 	"github.com/cpacia/multiwallet/base"
-	"github.com/cpacia/multiwallet/client/blockbook"
+	"github.com/cpacia/multiwallet/client"
 	"github.com/cpacia/multiwallet/database"
 	iwallet "github.com/cpacia/wallet-interface"
 	"github.com/ltcsuite/ltcd/blockchain"
@@ -51,7 +51,7 @@ const (
 // remaining functions for each interface.
 type LitecoinWallet struct { // nolint
 	base.WalletBase
-	testnet     bool
+	network     base.Network
 	feeProvider base.FeeProvider
 }
 
@@ -59,16 +59,35 @@ type LitecoinWallet struct { // nolint
 // attempts to connect to the API. If it fails, it will not build.
 func NewLitecoinWallet(cfg *base.WalletConfig) (*LitecoinWallet, error) {
 	w := &LitecoinWallet{
-		testnet: cfg.Testnet,
+		network: cfg.SelectedNetwork(),
+	}
+	if w.network == base.NetworkSignet {
+		return nil, base.UnsupportedNetwork(iwallet.CtLitecoin, w.network)
+	}
+
+	chainClient, err := client.NewChainClient(cfg.ClientURL, iwallet.CtLitecoin)
+	if err != nil {
+		return nil, err
+	}
+
+	chainClient, err = client.WithFailover(chainClient, cfg.FallbackClientURLs, iwallet.CtLitecoin, cfg.Logger)
+	if err != nil {
+		return nil, err
 	}
 
-	chainClient, err := blockbook.NewBlockbookClient(cfg.ClientURL, iwallet.CtLitecoin)
+	chainClient, err = client.WithVerification(chainClient, cfg.VerifyClientURL, iwallet.CtLitecoin, cfg.Logger)
 	if err != nil {
 		return nil, err
 	}
 
-	fp := base.NewExchangeRateFeeProvider(iwallet.CtLitecoin, divisibility, cfg.ExchangeRateProvider, averageTransactionSize,
+	var fp base.FeeProvider = base.NewExchangeRateFeeProvider(iwallet.CtLitecoin, divisibility, cfg.ExchangeRateProvider, averageTransactionSize,
 		iwallet.NewAmount(maxFeePerByte), priorityTarget, normalTarget, economicTarget, superEconomicTarget)
+	if netFP := w.network.DefaultFeeProvider(); netFP != nil {
+		fp = netFP
+	}
+	if cfg.FeeProvider != nil {
+		fp = cfg.FeeProvider
+	}
 
 	w.ChainClient = chainClient
 	w.DB = cfg.DB
@@ -76,6 +95,12 @@ func NewLitecoinWallet(cfg *base.WalletConfig) (*LitecoinWallet, error) {
 	w.CoinType = iwallet.CtLitecoin
 	w.Done = make(chan struct{})
 	w.AddressFunc = w.keyToAddress
+	w.NormalizeAddress = w.normalizeAddress
+	w.GapLimit = cfg.GapLimit
+	w.KeychainOpts = cfg.KeychainOptions()
+	w.Prune = cfg.Prune
+	w.Confirmations = cfg.Confirmations
+	w.MessageMagic = "Litecoin Signed Message:\n"
 	w.feeProvider = fp
 	return w, nil
 }
@@ -87,6 +112,16 @@ func (w *LitecoinWallet) ValidateAddress(addr iwallet.Address) error {
 	return err
 }
 
+// normalizeAddress decodes and re-encodes the address so every encoding
+// of it has the same string.
+func (w *LitecoinWallet) normalizeAddress(addr iwallet.Address) (iwallet.Address, error) {
+	address, err := ltcutil.DecodeAddress(addr.String(), w.params())
+	if err != nil {
+		return iwallet.Address{}, err
+	}
+	return iwallet.NewAddress(address.EncodeAddress(), iwallet.CtLitecoin), nil
+}
+
 // IsDust returns whether the amount passed in is considered dust by network. This
 // method is called when building payout transactions from the multisig to the various
 // participants. If the amount that is supposed to be sent to a given party is below
@@ -108,8 +143,11 @@ func (w *LitecoinWallet) EstimateSpendFee(amount iwallet.Amount, feeLevel iwalle
 	err := w.DB.Update(func(dbtx database.Tx) error {
 		// Since this is an estimate we can use a dummy output address. Let's use a long one so we don't under estimate.
 		addrStr := "ltc1q0wzfm6yz9gxght997y38mfvc9lj25hrjaddyc2"
-		if w.testnet {
+		switch w.network {
+		case base.NetworkTestnet:
 			addrStr = "tltc1q0wzfm6yz9gxght997y38mfvc9lj25hrj2lwdtq"
+		case base.NetworkRegtest:
+			addrStr = "rltc1q0wzfm6yz9gxght997y38mfvc9lj25hrj0n0hm7"
 		}
 		tx, err := w.buildTx(dbtx, amount.Int64(), iwallet.NewAddress(addrStr, iwallet.CtLitecoin), feeLevel)
 		if err != nil {
@@ -161,16 +199,23 @@ func (w *LitecoinWallet) EstimateSpendFee(amount iwallet.Amount, feeLevel iwalle
 // the state changes should be discarded. Only when Commit() is called should
 // the state changes be applied and the transaction broadcasted to the network.
 func (w *LitecoinWallet) Spend(wtx iwallet.Tx, to iwallet.Address, amt iwallet.Amount, feeLevel iwallet.FeeLevel) (iwallet.TransactionID, error) {
+	if err := w.CheckDestinations(to); err != nil {
+		return "", err
+	}
 	var (
 		txid iwallet.TransactionID
 		buf  bytes.Buffer
 	)
+	var inputs [][]byte
 	err := w.DB.View(func(dbtx database.Tx) error {
 		tx, err := w.buildTx(dbtx, amt.Int64(), to, feeLevel)
 		if err != nil {
 			return err
 		}
 		txid = iwallet.TransactionID(tx.TxHash().String())
+		for _, in := range tx.TxIn {
+			inputs = append(inputs, serializeOutpoint(&in.PreviousOutPoint))
+		}
 		if err := tx.BtcEncode(&buf, wire.ProtocolVersion, wire.WitnessEncoding); err != nil {
 			return err
 		}
@@ -183,18 +228,24 @@ func (w *LitecoinWallet) Spend(wtx iwallet.Tx, to iwallet.Address, amt iwallet.A
 	}
 
 	wbtx.OnCommit = func() error {
-		return w.DB.Update(func(dbtx database.Tx) error {
+		err := w.DB.Update(func(dbtx database.Tx) error {
 			err := dbtx.Save(&database.UnconfirmedTransaction{
 				Timestamp: time.Now(),
 				Coin:      iwallet.CtLitecoin,
 				TxBytes:   buf.Bytes(),
 				Txid:      txid.String(),
+				Inputs:    base.JoinOutpoints(inputs),
 			})
 			if err != nil {
 				return err
 			}
-			return w.ChainClient.Broadcast(buf.Bytes())
+			return nil
 		})
+		if err != nil {
+			return err
+		}
+		w.BroadcastOrQueue(txid, buf.Bytes())
+		return nil
 	}
 	return txid, err
 }
@@ -203,10 +254,14 @@ func (w *LitecoinWallet) Spend(wtx iwallet.Tx, to iwallet.Address, amt iwallet.A
 // address. It is expected for most coins that the fee will be subtracted
 // from the amount sent rather than added to it.
 func (w *LitecoinWallet) SweepWallet(wtx iwallet.Tx, to iwallet.Address, level iwallet.FeeLevel) (iwallet.TransactionID, error) {
+	if err := w.CheckDestinations(to); err != nil {
+		return "", err
+	}
 	var (
 		txid iwallet.TransactionID
 		buf  bytes.Buffer
 	)
+	var inputs [][]byte
 	err := w.DB.Update(func(dbtx database.Tx) error {
 		var (
 			totalIn               ltcutil.Amount
@@ -220,6 +275,12 @@ func (w *LitecoinWallet) SweepWallet(wtx iwallet.Tx, to iwallet.Address, level i
 		if err != nil {
 			return err
 		}
+		defer base.ZeroCoinKeys(coinMap)
+		defer func() {
+			for _, key := range keyMap {
+				base.ZeroPrivKey(key)
+			}
+		}()
 
 		for coin, key := range coinMap {
 			h, err := chainhash.NewHashFromStr(coin.Hash().String())
@@ -291,6 +352,9 @@ func (w *LitecoinWallet) SweepWallet(wtx iwallet.Tx, to iwallet.Address, level i
 		}
 
 		txid = iwallet.TransactionID(tx.TxHash().String())
+		for _, in := range tx.TxIn {
+			inputs = append(inputs, serializeOutpoint(&in.PreviousOutPoint))
+		}
 		if err := tx.BtcEncode(&buf, wire.ProtocolVersion, wire.WitnessEncoding); err != nil {
 			return err
 		}
@@ -304,18 +368,24 @@ func (w *LitecoinWallet) SweepWallet(wtx iwallet.Tx, to iwallet.Address, level i
 	}
 
 	wbtx.OnCommit = func() error {
-		return w.DB.Update(func(dbtx database.Tx) error {
+		err := w.DB.Update(func(dbtx database.Tx) error {
 			err := dbtx.Save(&database.UnconfirmedTransaction{
 				Timestamp: time.Now(),
 				Coin:      iwallet.CtLitecoin,
 				TxBytes:   buf.Bytes(),
 				Txid:      txid.String(),
+				Inputs:    base.JoinOutpoints(inputs),
 			})
 			if err != nil {
 				return err
 			}
-			return w.ChainClient.Broadcast(buf.Bytes())
+			return nil
 		})
+		if err != nil {
+			return err
+		}
+		w.BroadcastOrQueue(txid, buf.Bytes())
+		return nil
 	}
 
 	return txid, err
@@ -403,6 +473,9 @@ func (w *LitecoinWallet) CreateMultisigAddress(keys []btcec.PublicKey, threshold
 // For coins like bitcoin you may need to return one signature *per input* which is
 // why a slice of signatures is returned.
 func (w *LitecoinWallet) SignMultisigTransaction(txn iwallet.Transaction, key btcec.PrivateKey, redeemScript []byte) ([]iwallet.EscrowSignature, error) {
+	if err := w.CheckEscrowRelease(redeemScript); err != nil {
+		return nil, err
+	}
 	var sigs []iwallet.EscrowSignature
 	tx := wire.NewMsgTx(1)
 	for _, from := range txn.From {
@@ -453,6 +526,12 @@ func (w *LitecoinWallet) SignMultisigTransaction(txn iwallet.Transaction, key bt
 // Note a database transaction is used here. Same rules of Commit() and
 // Rollback() apply.
 func (w *LitecoinWallet) BuildAndSend(wtx iwallet.Tx, txn iwallet.Transaction, signatures [][]iwallet.EscrowSignature, redeemScript []byte) (iwallet.TransactionID, error) {
+	if err := w.CheckEscrowRelease(redeemScript); err != nil {
+		return "", err
+	}
+	if err := w.CheckDestinations(base.PaidAddresses(txn)...); err != nil {
+		return "", err
+	}
 	tx := wire.NewMsgTx(1)
 	for _, from := range txn.From {
 		op, err := derializeOutpoint(from.ID)
@@ -523,7 +602,7 @@ func (w *LitecoinWallet) BuildAndSend(wtx iwallet.Tx, txn iwallet.Transaction, s
 	}
 
 	wbtx.OnCommit = func() error {
-		return w.DB.Update(func(dbtx database.Tx) error {
+		err := w.DB.Update(func(dbtx database.Tx) error {
 			err := dbtx.Save(&database.UnconfirmedTransaction{
 				Timestamp: time.Now(),
 				Coin:      iwallet.CtLitecoin,
@@ -533,8 +612,13 @@ func (w *LitecoinWallet) BuildAndSend(wtx iwallet.Tx, txn iwallet.Transaction, s
 			if err != nil {
 				return err
 			}
-			return w.ChainClient.Broadcast(buf.Bytes())
+			return nil
 		})
+		if err != nil {
+			return err
+		}
+		w.BroadcastOrQueue(txid, buf.Bytes())
+		return nil
 	}
 
 	return txid, nil
@@ -588,6 +672,9 @@ func (w *LitecoinWallet) CreateMultisigWithTimeout(keys []btcec.PublicKey, thres
 // ReleaseFundsAfterTimeout will release funds from the escrow. The signature will
 // be created using the timeoutKey.
 func (w *LitecoinWallet) ReleaseFundsAfterTimeout(wtx iwallet.Tx, txn iwallet.Transaction, timeoutKey btcec.PrivateKey, redeemScript []byte) (iwallet.TransactionID, error) {
+	if err := w.CheckEscrowRelease(redeemScript); err != nil {
+		return "", err
+	}
 	tx := wire.NewMsgTx(2)
 	for _, from := range txn.From {
 		op, err := derializeOutpoint(from.ID)
@@ -646,7 +733,7 @@ func (w *LitecoinWallet) ReleaseFundsAfterTimeout(wtx iwallet.Tx, txn iwallet.Tr
 	}
 
 	wbtx.OnCommit = func() error {
-		return w.DB.Update(func(dbtx database.Tx) error {
+		err := w.DB.Update(func(dbtx database.Tx) error {
 			err := dbtx.Save(&database.UnconfirmedTransaction{
 				Timestamp: time.Now(),
 				Coin:      iwallet.CtLitecoin,
@@ -656,16 +743,24 @@ func (w *LitecoinWallet) ReleaseFundsAfterTimeout(wtx iwallet.Tx, txn iwallet.Tr
 			if err != nil {
 				return err
 			}
-			return w.ChainClient.Broadcast(buf.Bytes())
+			return nil
 		})
+		if err != nil {
+			return err
+		}
+		w.BroadcastOrQueue(txid, buf.Bytes())
+		return nil
 	}
 
 	return txid, nil
 }
 
 func (w *LitecoinWallet) params() *chaincfg.Params {
-	if w.testnet {
+	switch w.network {
+	case base.NetworkTestnet:
 		return &chaincfg.TestNet4Params
+	case base.NetworkRegtest:
+		return &chaincfg.RegressionNetParams
 	}
 	return &chaincfg.MainNetParams
 }
@@ -696,6 +791,14 @@ func (w *LitecoinWallet) buildTx(dbtx database.Tx, amount int64, iaddr iwallet.A
 		return nil, err
 	}
 
+	// Zero the private keys once the transaction has been signed.
+	defer base.ZeroCoinKeys(coinKeyMap)
+	defer func() {
+		for _, wif := range additionalKeysByScript {
+			wif.PrivKey.D.SetInt64(0)
+		}
+	}()
+
 	allCoins := make([]coinset.Coin, 0, len(coinKeyMap))
 	for coin := range coinKeyMap {
 		allCoins = append(allCoins, coin)
@@ -727,6 +830,7 @@ func (w *LitecoinWallet) buildTx(dbtx database.Tx, amount int64, iaddr iwallet.A
 				err = kerr
 				return
 			}
+			defer base.ZeroKey(hdKey)
 			privKey, perr := hdKey.ECPrivKey()
 			if perr != nil {
 				err = perr
@@ -831,6 +935,15 @@ func (w *LitecoinWallet) keyToAddress(key *btchd.ExtendedKey) (iwallet.Address,
 	return iwallet.NewAddress(witnessAddr.String(), iwallet.CtLitecoin), nil
 }
 
+// VerifyVectors checks the wallet derives the published address vectors
+// for its network. There are no regtest vectors.
+func (w *LitecoinWallet) VerifyVectors() error {
+	if w.network == base.NetworkRegtest {
+		return base.ErrNoAddressVectors
+	}
+	return base.VerifyAddressVectors(base.AddressVectorsFor(iwallet.CtLitecoin, w.network.IsTest(), base.AddressTypeNativeSegwit), w.keyToAddress)
+}
+
 func lockTimeFromRedeemScript(redeemScript []byte) (uint32, error) {
 	if len(redeemScript) < 113 {
 		return 0, errors.New("redeem script invalid length")
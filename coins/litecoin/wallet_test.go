@@ -10,6 +10,7 @@ import (
 	"github.com/cpacia/multiwallet/base"
 	"github.com/cpacia/multiwallet/database"
 	"github.com/cpacia/multiwallet/database/sqlitedb"
+	"github.com/cpacia/multiwallet/log"
 	iwallet "github.com/cpacia/wallet-interface"
 	"github.com/jarcoal/httpmock"
 	"github.com/ltcsuite/ltcd/chaincfg"
@@ -17,14 +18,13 @@ import (
 	"github.com/ltcsuite/ltcd/txscript"
 	"github.com/ltcsuite/ltcd/wire"
 	"github.com/ltcsuite/ltcutil"
-	"github.com/op/go-logging"
 	"testing"
 	"time"
 )
 
 func newTestWallet() (*LitecoinWallet, error) {
 	w := &LitecoinWallet{
-		testnet:     true,
+		network:     base.NetworkTestnet,
 		feeProvider: base.NewHardCodedFeeProvider(iwallet.NewAmount(50), iwallet.NewAmount(40), iwallet.NewAmount(30), iwallet.NewAmount(20)),
 	}
 
@@ -40,7 +40,7 @@ func newTestWallet() (*LitecoinWallet, error) {
 
 	w.ChainClient = chainClient
 	w.DB = db
-	w.Logger = logging.MustGetLogger("bchtest")
+	w.Logger = log.New("bchtest")
 	w.CoinType = iwallet.CtLitecoin
 	w.Done = make(chan struct{})
 	w.AddressFunc = w.keyToAddress
@@ -1073,3 +1073,12 @@ func TestLitecoinWallet_buildTx(t *testing.T) {
 		t.Errorf("Script verificationf failed: %s", err)
 	}
 }
+
+func TestLitecoinWallet_VerifyVectors(t *testing.T) {
+	for _, network := range []base.Network{base.NetworkMainnet, base.NetworkTestnet} {
+		w := &LitecoinWallet{network: network}
+		if err := w.VerifyVectors(); err != nil {
+			t.Errorf("Network %s: %s", network, err)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package stellar
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/cpacia/proxyclient"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errAccountNotFound is returned by Horizon for accounts which have not
+// been funded.
+var errAccountNotFound = errors.New("account not found")
+
+// HorizonClient is a minimal client for the Horizon REST API.
+type HorizonClient struct {
+	url        string
+	httpClient *http.Client
+}
+
+// NewHorizonClient returns a new client for the Horizon server at the url.
+func NewHorizonClient(horizonURL string) *HorizonClient {
+	return &HorizonClient{
+		url:        strings.TrimSuffix(horizonURL, "/"),
+		httpClient: proxyclient.NewHttpClient(),
+	}
+}
+
+type horizonBalance struct {
+	Balance     string `json:"balance"`
+	AssetType   string `json:"asset_type"`
+	AssetCode   string `json:"asset_code"`
+	AssetIssuer string `json:"asset_issuer"`
+}
+
+type horizonAccount struct {
+	ID       string           `json:"id"`
+	Sequence string           `json:"sequence"`
+	Balances []horizonBalance `json:"balances"`
+}
+
+type horizonLedger struct {
+	Sequence uint64    `json:"sequence"`
+	Hash     string    `json:"hash"`
+	PrevHash string    `json:"prev_hash"`
+	ClosedAt time.Time `json:"closed_at"`
+}
+
+type horizonPayment struct {
+	ID              string    `json:"id"`
+	Type            string    `json:"type"`
+	TransactionHash string    `json:"transaction_hash"`
+	CreatedAt       time.Time `json:"created_at"`
+	From            string    `json:"from"`
+	To              string    `json:"to"`
+	Amount          string    `json:"amount"`
+	AssetType       string    `json:"asset_type"`
+	AssetCode       string    `json:"asset_code"`
+	AssetIssuer     string    `json:"asset_issuer"`
+
+	// Populated for create_account operations.
+	Funder          string `json:"funder"`
+	Account         string `json:"account"`
+	StartingBalance string `json:"starting_balance"`
+}
+
+type horizonTransaction struct {
+	Hash     string    `json:"hash"`
+	Ledger   uint64    `json:"ledger"`
+	Created  time.Time `json:"created_at"`
+	MemoType string    `json:"memo_type"`
+	Memo     string    `json:"memo"`
+}
+
+type horizonFeeStats struct {
+	LastLedgerBaseFee string `json:"last_ledger_base_fee"`
+	FeeCharged        struct {
+		P10 string `json:"p10"`
+		P50 string `json:"p50"`
+		P90 string `json:"p90"`
+	} `json:"fee_charged"`
+}
+
+func (c *HorizonClient) get(path string, v interface{}) error {
+	resp, err := c.httpClient.Get(c.url + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return errAccountNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("horizon returned status %d: %s", resp.StatusCode, string(body))
+	}
+	return json.Unmarshal(body, v)
+}
+
+// Account returns the account with the given ID. errAccountNotFound is
+// returned if the account has not been created.
+func (c *HorizonClient) Account(id string) (*horizonAccount, error) {
+	var acct horizonAccount
+	if err := c.get("/accounts/"+id, &acct); err != nil {
+		return nil, err
+	}
+	return &acct, nil
+}
+
+// LatestLedger returns the most recently closed ledger.
+func (c *HorizonClient) LatestLedger() (*horizonLedger, error) {
+	var resp struct {
+		Embedded struct {
+			Records []horizonLedger `json:"records"`
+		} `json:"_embedded"`
+	}
+	if err := c.get("/ledgers?order=desc&limit=1", &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Embedded.Records) == 0 {
+		return nil, errors.New("no ledgers returned")
+	}
+	return &resp.Embedded.Records[0], nil
+}
+
+// Payments returns the payment operations for the account, most recent
+// first.
+func (c *HorizonClient) Payments(id string, limit int) ([]horizonPayment, error) {
+	var resp struct {
+		Embedded struct {
+			Records []horizonPayment `json:"records"`
+		} `json:"_embedded"`
+	}
+	if err := c.get(fmt.Sprintf("/accounts/%s/payments?order=desc&limit=%d", id, limit), &resp); err != nil {
+		return nil, err
+	}
+	return resp.Embedded.Records, nil
+}
+
+// Transaction returns the transaction with the given hash.
+func (c *HorizonClient) Transaction(hash string) (*horizonTransaction, error) {
+	var tx horizonTransaction
+	if err := c.get("/transactions/"+hash, &tx); err != nil {
+		return nil, err
+	}
+	return &tx, nil
+}
+
+// FeeStats returns the recent fee statistics.
+func (c *HorizonClient) FeeStats() (*horizonFeeStats, error) {
+	var stats horizonFeeStats
+	if err := c.get("/fee_stats", &stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// SubmitTransaction submits the XDR encoded transaction envelope.
+func (c *HorizonClient) SubmitTransaction(envelope []byte) error {
+	form := url.Values{}
+	form.Set("tx", base64.StdEncoding.EncodeToString(envelope))
+	resp, err := c.httpClient.PostForm(c.url+"/transactions", form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("transaction submission failed with status %d: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// parseAmount converts a decimal lumen string from Horizon into stroops.
+func parseAmount(s string) (int64, error) {
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return 0, fmt.Errorf("invalid amount %s", s)
+	}
+	r.Mul(r, big.NewRat(stroopsPerLumen, 1))
+	if !r.IsInt() {
+		return 0, fmt.Errorf("invalid amount %s", s)
+	}
+	return r.Num().Int64(), nil
+}
+
+func parseUint(s string) uint64 {
+	i, _ := strconv.ParseUint(s, 10, 64)
+	return i
+}
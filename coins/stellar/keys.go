@@ -0,0 +1,71 @@
+package stellar
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	hd "github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/cpacia/multiwallet/base"
+)
+
+const (
+	hardenedOffset = 0x80000000
+
+	// stellarCoinType is the SLIP-0044 coin type for stellar.
+	stellarCoinType = 148
+)
+
+// deriveAccountKey derives the ed25519 key for the given account index.
+//
+// SEP-0005 derives keys using SLIP-0010 along the path m/44'/148'/x'
+// from the BIP39 seed. The multiwallet is only ever handed the coin level
+// extended key, never the seed, so the SLIP-0010 master key is generated
+// from the extended private key's secret instead. The path below the master
+// key follows SEP-0005.
+func deriveAccountKey(xpriv *hd.ExtendedKey, account uint32) (ed25519.PrivateKey, error) {
+	ecPriv, err := xpriv.ECPrivKey()
+	if err != nil {
+		return nil, err
+	}
+	defer base.ZeroPrivKey(ecPriv)
+	seed := ecPriv.Serialize()
+	defer base.ZeroBytes(seed)
+
+	key, chainCode := slip10Master(seed)
+	for _, idx := range []uint32{44, stellarCoinType, account} {
+		key, chainCode = slip10Child(key, chainCode, idx)
+	}
+	defer base.ZeroBytes(key)
+	return ed25519.NewKeyFromSeed(key), nil
+}
+
+func slip10Master(seed []byte) ([]byte, []byte) {
+	mac := hmac.New(sha512.New, []byte("ed25519 seed"))
+	mac.Write(seed)
+	I := mac.Sum(nil)
+	return I[:32], I[32:]
+}
+
+// slip10Child derives a hardened child. ed25519 only supports hardened
+// derivation under SLIP-0010.
+func slip10Child(key, chainCode []byte, idx uint32) ([]byte, []byte) {
+	data := make([]byte, 0, 37)
+	data = append(data, 0x00)
+	data = append(data, key...)
+	ser := make([]byte, 4)
+	binary.BigEndian.PutUint32(ser, idx+hardenedOffset)
+	data = append(data, ser...)
+
+	mac := hmac.New(sha512.New, chainCode)
+	mac.Write(data)
+	base.ZeroBytes(data)
+	base.ZeroBytes(key)
+	I := mac.Sum(nil)
+	return I[:32], I[32:]
+}
+
+// accountID returns the G... strkey for the public key.
+func accountID(pub ed25519.PublicKey) string {
+	return encodeStrKey(versionAccountID, pub)
+}
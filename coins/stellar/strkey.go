@@ -0,0 +1,66 @@
+package stellar
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	// versionAccountID is the strkey version byte for public keys. It
+	// encodes to a leading 'G'.
+	versionAccountID byte = 6 << 3
+
+	// versionSeed is the strkey version byte for secret seeds. It
+	// encodes to a leading 'S'.
+	versionSeed byte = 18 << 3
+)
+
+var errInvalidStrKey = errors.New("invalid stellar key")
+
+// encodeStrKey encodes the payload using the stellar strkey format:
+// base32(version || payload || crc16).
+func encodeStrKey(version byte, payload []byte) string {
+	raw := make([]byte, 0, len(payload)+3)
+	raw = append(raw, version)
+	raw = append(raw, payload...)
+	checksum := make([]byte, 2)
+	binary.LittleEndian.PutUint16(checksum, crc16(raw))
+	raw = append(raw, checksum...)
+	return base32.StdEncoding.EncodeToString(raw)
+}
+
+// decodeStrKey decodes a strkey and checks it has the expected version.
+func decodeStrKey(version byte, s string) ([]byte, error) {
+	raw, err := base32.StdEncoding.DecodeString(s)
+	if err != nil || len(raw) != 35 {
+		return nil, errInvalidStrKey
+	}
+	if raw[0] != version {
+		return nil, errInvalidStrKey
+	}
+	payload := raw[1:33]
+	checksum := make([]byte, 2)
+	binary.LittleEndian.PutUint16(checksum, crc16(raw[:33]))
+	if !bytes.Equal(checksum, raw[33:]) {
+		return nil, errInvalidStrKey
+	}
+	return payload, nil
+}
+
+// crc16 is the CRC16-XModem checksum used by strkey.
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
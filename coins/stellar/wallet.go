@@ -0,0 +1,454 @@
+package stellar
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	hd "github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/multiwallet/database"
+	"github.com/cpacia/multiwallet/log"
+	iwallet "github.com/cpacia/wallet-interface"
+	"gorm.io/gorm"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CtStellar is the coin type for stellar lumens.
+const CtStellar = iwallet.CoinType("XLM")
+
+const (
+	stroopsPerLumen = 10000000
+
+	// baseReserve is the minimum balance, in stroops, required to create
+	// a new account.
+	baseReserve = 10000000
+
+	// defaultBaseFee is the minimum fee per operation in stroops.
+	defaultBaseFee = 100
+
+	// txTimeout bounds how long a signed transaction remains valid.
+	txTimeout = time.Minute * 5
+
+	mainnetPassphrase = "Public Global Stellar Network ; September 2015"
+	testnetPassphrase = "Test SDF Network ; September 2015"
+)
+
+// AssetBalance is the balance of a single asset held by the account.
+// Trustline assets are reported separately from the native balance.
+type AssetBalance struct {
+	Asset   Asset
+	Balance iwallet.Amount
+}
+
+// StellarWallet is a single account stellar wallet. Unlike the UTXO coins
+// stellar is account based so the wallet always uses the same address.
+type StellarWallet struct { // nolint
+	DB       database.Database
+	Logger   log.Logger
+	Done     chan struct{}
+	CoinType iwallet.CoinType
+
+	// AddressPolicyStore holds the allow and deny lists checked by
+	// SpendWithMemo.
+	base.AddressPolicyStore
+
+	client     *HorizonClient
+	passphrase string
+	txMtx      sync.Mutex
+	stopMtx    sync.Mutex
+}
+
+// NewStellarWallet returns a new StellarWallet. The ClientURL in the config
+// should point to a Horizon server.
+func NewStellarWallet(cfg *base.WalletConfig) (*StellarWallet, error) {
+	passphrase := mainnetPassphrase
+	switch cfg.SelectedNetwork() {
+	case base.NetworkMainnet:
+	case base.NetworkTestnet:
+		passphrase = testnetPassphrase
+	default:
+		return nil, base.UnsupportedNetwork(CtStellar, cfg.SelectedNetwork())
+	}
+	return &StellarWallet{
+		DB:       cfg.DB,
+		Logger:   cfg.Logger,
+		Done:     make(chan struct{}),
+		CoinType: CtStellar,
+		AddressPolicyStore: base.AddressPolicyStore{
+			DB:       cfg.DB,
+			CoinType: CtStellar,
+			Logger:   cfg.Logger,
+		},
+		client:     NewHorizonClient(cfg.ClientURL),
+		passphrase: passphrase,
+	}, nil
+}
+
+// Begin returns a new database transaction. The spend will only be
+// submitted to the network when the transaction is committed.
+func (w *StellarWallet) Begin() (iwallet.Tx, error) {
+	w.txMtx.Lock()
+	select {
+	case <-w.Done:
+		w.txMtx.Unlock()
+		return nil, base.ErrWalletClosed
+	default:
+	}
+	return base.NewDBTx(&w.txMtx), nil
+}
+
+// WalletExists returns whether the wallet has been created.
+func (w *StellarWallet) WalletExists() bool {
+	err := w.DB.View(func(tx database.Tx) error {
+		var rec database.CoinRecord
+		return tx.Read().Where("coin = ?", w.CoinType.CurrencyCode()).First(&rec).Error
+	})
+	return !errors.Is(err, gorm.ErrRecordNotFound)
+}
+
+// CreateWallet saves the coin level key to the database. The account key
+// is derived from it when needed.
+func (w *StellarWallet) CreateWallet(xpriv hd.ExtendedKey, pw []byte, birthday time.Time) error {
+	if w.WalletExists() {
+		return fmt.Errorf("wallet already exists for coin %s", w.CoinType.CurrencyCode())
+	}
+	key, err := deriveAccountKey(&xpriv, 0)
+	if err != nil {
+		return err
+	}
+	defer base.ZeroBytes(key)
+
+	xpub, err := xpriv.Neuter()
+	if err != nil {
+		return err
+	}
+
+	return w.DB.Update(func(tx database.Tx) error {
+		return tx.Save(&database.CoinRecord{
+			MasterPriv:  xpriv.String(),
+			MasterPub:   xpub.String(),
+			Coin:        w.CoinType.CurrencyCode(),
+			Birthday:    birthday,
+			BestBlockID: strings.Repeat("0", 64),
+		})
+	})
+}
+
+// OpenWallet is a no-op for stellar. The wallet queries Horizon on demand.
+func (w *StellarWallet) OpenWallet() error {
+	return nil
+}
+
+// CloseWallet shuts down the wallet.
+func (w *StellarWallet) CloseWallet() error {
+	return w.Stop(context.Background())
+}
+
+// Start is OpenWallet under the name used by base.Lifecycle.
+func (w *StellarWallet) Start() error {
+	return w.OpenWallet()
+}
+
+// Stop refuses new transactions once the open one, if any, is committed or
+// rolled back. There are no background loops to wait on.
+func (w *StellarWallet) Stop(ctx context.Context) error {
+	w.stopMtx.Lock()
+	defer w.stopMtx.Unlock()
+
+	select {
+	case <-w.Done:
+		return nil
+	default:
+	}
+	err := base.LockContext(ctx, &w.txMtx)
+	close(w.Done)
+	if err == nil {
+		w.txMtx.Unlock()
+	}
+	return err
+}
+
+// BlockchainInfo returns the latest closed ledger.
+func (w *StellarWallet) BlockchainInfo() (iwallet.BlockInfo, error) {
+	ledger, err := w.client.LatestLedger()
+	if err != nil {
+		return iwallet.BlockInfo{}, err
+	}
+	return iwallet.BlockInfo{
+		BlockID:   iwallet.BlockID(ledger.Hash),
+		PrevBlock: iwallet.BlockID(ledger.PrevHash),
+		Height:    ledger.Sequence,
+		BlockTime: ledger.ClosedAt,
+	}, nil
+}
+
+// CurrentAddress returns the account ID.
+func (w *StellarWallet) CurrentAddress() (iwallet.Address, error) {
+	key, err := w.accountKey()
+	if err != nil {
+		return iwallet.Address{}, err
+	}
+	defer base.ZeroBytes(key)
+	return iwallet.NewAddress(accountID(key.Public().(ed25519.PublicKey)), w.CoinType), nil
+}
+
+// NewAddress returns the account ID. Stellar accounts must be funded with
+// the base reserve before use so the wallet does not generate new ones.
+func (w *StellarWallet) NewAddress() (iwallet.Address, error) {
+	return w.CurrentAddress()
+}
+
+// ValidateAddress returns an error if the address is not a valid account ID.
+func (w *StellarWallet) ValidateAddress(addr iwallet.Address) error {
+	_, err := decodeStrKey(versionAccountID, addr.String())
+	return err
+}
+
+// HasKey returns whether the address is the wallet's account.
+func (w *StellarWallet) HasKey(addr iwallet.Address) (bool, error) {
+	ours, err := w.CurrentAddress()
+	if err != nil {
+		return false, err
+	}
+	return ours.String() == addr.String(), nil
+}
+
+// IsDust returns whether the amount is below the smallest transferable unit.
+func (w *StellarWallet) IsDust(amount iwallet.Amount) bool {
+	return amount.Cmp(iwallet.NewAmount(1)) < 0
+}
+
+// Balance returns the native lumen balance. Stellar transactions are final
+// once they are included in a ledger so the unconfirmed balance is always
+// zero.
+func (w *StellarWallet) Balance() (unconfirmed iwallet.Amount, confirmed iwallet.Amount, err error) {
+	balances, err := w.Balances()
+	if err != nil {
+		return iwallet.NewAmount(0), iwallet.NewAmount(0), err
+	}
+	for _, b := range balances {
+		if b.Asset.IsNative() {
+			return iwallet.NewAmount(0), b.Balance, nil
+		}
+	}
+	return iwallet.NewAmount(0), iwallet.NewAmount(0), nil
+}
+
+// Balances returns the native balance followed by the balance of each
+// trustline asset.
+func (w *StellarWallet) Balances() ([]AssetBalance, error) {
+	addr, err := w.CurrentAddress()
+	if err != nil {
+		return nil, err
+	}
+	acct, err := w.client.Account(addr.String())
+	if errors.Is(err, errAccountNotFound) {
+		return []AssetBalance{{Balance: iwallet.NewAmount(0)}}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var balances []AssetBalance
+	for _, b := range acct.Balances {
+		amt, err := parseAmount(b.Balance)
+		if err != nil {
+			return nil, err
+		}
+		ab := AssetBalance{Balance: iwallet.NewAmount(amt)}
+		if b.AssetType != "native" {
+			ab.Asset = Asset{Code: b.AssetCode, Issuer: b.AssetIssuer}
+		}
+		balances = append(balances, ab)
+	}
+	return balances, nil
+}
+
+// Transactions returns the most recent payments to or from the account.
+func (w *StellarWallet) Transactions(limit int, offsetID iwallet.TransactionID) ([]iwallet.Transaction, error) {
+	addr, err := w.CurrentAddress()
+	if err != nil {
+		return nil, err
+	}
+	if limit <= 0 {
+		limit = 200
+	}
+	payments, err := w.client.Payments(addr.String(), limit)
+	if errors.Is(err, errAccountNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var (
+		txs       []iwallet.Transaction
+		skipUntil = offsetID != ""
+	)
+	for _, p := range payments {
+		if skipUntil {
+			if iwallet.TransactionID(p.TransactionHash) == offsetID {
+				skipUntil = false
+			}
+			continue
+		}
+		from, to, amount := p.From, p.To, p.Amount
+		if p.Type == "create_account" {
+			from, to, amount = p.Funder, p.Account, p.StartingBalance
+		} else if p.AssetType != "native" {
+			// Only native payments are reported as wallet transactions.
+			// Trustline assets are reported via Balances.
+			continue
+		}
+		amt, err := parseAmount(amount)
+		if err != nil {
+			return nil, err
+		}
+		value := iwallet.NewAmount(amt)
+		if from == addr.String() {
+			value = iwallet.NewAmount(0).Sub(value)
+		}
+		txs = append(txs, iwallet.Transaction{
+			ID:        iwallet.TransactionID(p.TransactionHash),
+			Timestamp: p.CreatedAt,
+			From:      []iwallet.SpendInfo{{Address: iwallet.NewAddress(from, w.CoinType), Amount: iwallet.NewAmount(amt)}},
+			To:        []iwallet.SpendInfo{{Address: iwallet.NewAddress(to, w.CoinType), Amount: iwallet.NewAmount(amt)}},
+			Value:     value,
+		})
+	}
+	return txs, nil
+}
+
+// EstimateSpendFee returns the fee for a single operation transaction.
+func (w *StellarWallet) EstimateSpendFee(amount iwallet.Amount, feeLevel iwallet.FeeLevel) (iwallet.Amount, error) {
+	fee, err := w.feePerOperation(feeLevel)
+	if err != nil {
+		return iwallet.NewAmount(0), err
+	}
+	return iwallet.NewAmount(fee), nil
+}
+
+// Spend sends lumens to the address without a memo.
+func (w *StellarWallet) Spend(wtx iwallet.Tx, to iwallet.Address, amt iwallet.Amount, feeLevel iwallet.FeeLevel) (iwallet.TransactionID, error) {
+	return w.SpendWithMemo(wtx, to, amt, Asset{}, Memo{}, feeLevel)
+}
+
+// SpendWithMemo sends the asset to the address with the given memo. If the
+// destination account does not exist and the asset is native, the account
+// is created instead. The transaction is submitted when wtx is committed.
+// Addresses the address policy doesn't permit are rejected.
+func (w *StellarWallet) SpendWithMemo(wtx iwallet.Tx, to iwallet.Address, amt iwallet.Amount, asset Asset, memo Memo, feeLevel iwallet.FeeLevel) (iwallet.TransactionID, error) {
+	wbtx, ok := wtx.(*base.DBTx)
+	if !ok {
+		return "", errors.New("tx is not expected type")
+	}
+	if err := w.CheckDestinations(to); err != nil {
+		return "", err
+	}
+
+	dest, err := decodeStrKey(versionAccountID, to.String())
+	if err != nil {
+		return "", err
+	}
+
+	key, err := w.accountKey()
+	if err != nil {
+		return "", err
+	}
+	defer base.ZeroBytes(key)
+	pub := key.Public().(ed25519.PublicKey)
+
+	acct, err := w.client.Account(accountID(pub))
+	if err != nil {
+		return "", err
+	}
+	seq, err := strconv.ParseInt(acct.Sequence, 10, 64)
+	if err != nil {
+		return "", err
+	}
+
+	op := operation{
+		opType:      opTypePayment,
+		destination: dest,
+		asset:       asset,
+		amount:      amt.Int64(),
+	}
+	if _, err := w.client.Account(to.String()); errors.Is(err, errAccountNotFound) {
+		if !asset.IsNative() {
+			return "", errors.New("destination account does not exist")
+		}
+		if amt.Int64() < baseReserve {
+			return "", errors.New("amount is less than the minimum balance required to create the account")
+		}
+		op.opType = opTypeCreateAccount
+	} else if err != nil {
+		return "", err
+	}
+
+	fee, err := w.feePerOperation(feeLevel)
+	if err != nil {
+		return "", err
+	}
+
+	tx := &transaction{
+		source:     pub,
+		fee:        uint32(fee),
+		seqNum:     seq + 1,
+		maxTime:    uint64(time.Now().Add(txTimeout).Unix()),
+		memo:       memo,
+		operations: []operation{op},
+	}
+	envelope, txHash, err := tx.sign(w.passphrase, key)
+	if err != nil {
+		return "", err
+	}
+	txid := iwallet.TransactionID(fmt.Sprintf("%x", txHash))
+
+	wbtx.OnCommit = func() error {
+		return w.client.SubmitTransaction(envelope)
+	}
+	return txid, nil
+}
+
+func (w *StellarWallet) feePerOperation(feeLevel iwallet.FeeLevel) (int64, error) {
+	stats, err := w.client.FeeStats()
+	if err != nil {
+		return defaultBaseFee, nil
+	}
+	var s string
+	switch feeLevel {
+	case iwallet.FlPriority:
+		s = stats.FeeCharged.P90
+	case iwallet.FlNormal:
+		s = stats.FeeCharged.P50
+	default:
+		s = stats.FeeCharged.P10
+	}
+	fee := int64(parseUint(s))
+	if fee < defaultBaseFee {
+		fee = defaultBaseFee
+	}
+	return fee, nil
+}
+
+// accountKey derives the account's private key. The caller must zero it
+// when finished.
+func (w *StellarWallet) accountKey() (ed25519.PrivateKey, error) {
+	var rec database.CoinRecord
+	err := w.DB.View(func(tx database.Tx) error {
+		return tx.Read().Where("coin = ?", w.CoinType.CurrencyCode()).First(&rec).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	if rec.EncryptedMasterKey {
+		return nil, base.ErrEncryptedKeychain
+	}
+	xpriv, err := rec.MasterPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	defer base.ZeroKey(xpriv)
+	return deriveAccountKey(xpriv, 0)
+}
@@ -0,0 +1,314 @@
+package stellar
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/multiwallet/database"
+	"github.com/cpacia/multiwallet/database/sqlitedb"
+	"github.com/cpacia/multiwallet/log"
+	iwallet "github.com/cpacia/wallet-interface"
+	"github.com/jarcoal/httpmock"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testHorizonURL = "https://horizon-testnet.stellar.org"
+
+func newTestWallet() (*StellarWallet, error) {
+	db, err := sqlitedb.NewMemoryDB()
+	if err != nil {
+		return nil, err
+	}
+	if err := database.InitializeDatabase(db); err != nil {
+		return nil, err
+	}
+
+	w, err := NewStellarWallet(&base.WalletConfig{
+		DB:        db,
+		Logger:    log.New("xlmtest"),
+		ClientURL: testHorizonURL,
+		Testnet:   true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := hdkeychain.NewKeyFromString("tprv8ZgxMBicQKsPeghT19pungdFLMJM2hMs3EEn5WtgobD7wuQSFQu4VNaEJXH9HS3RhhLT4wgZ3hj31m3kafuxhL9vfGTRtBVLSog4zjxW3L1")
+	if err != nil {
+		return nil, err
+	}
+	if err := w.CreateWallet(*key, nil, time.Now()); err != nil {
+		return nil, err
+	}
+	return w, w.OpenWallet()
+}
+
+func TestStrKey(t *testing.T) {
+	zero := encodeStrKey(versionAccountID, make([]byte, 32))
+	if zero != "GAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAWHF" {
+		t.Errorf("Unexpected account ID %s", zero)
+	}
+
+	payload := bytes.Repeat([]byte{0xab}, 32)
+	s := encodeStrKey(versionAccountID, payload)
+	if s[0] != 'G' {
+		t.Errorf("Expected G prefix, got %s", s)
+	}
+	decoded, err := decodeStrKey(versionAccountID, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded, payload) {
+		t.Error("Decoded payload does not match")
+	}
+
+	if _, err := decodeStrKey(versionSeed, s); err != errInvalidStrKey {
+		t.Error("Expected version mismatch to fail")
+	}
+	corrupt := []byte(s)
+	corrupt[10] = 'A'
+	if corrupt[10] == s[10] {
+		corrupt[10] = 'B'
+	}
+	if _, err := decodeStrKey(versionAccountID, string(corrupt)); err != errInvalidStrKey {
+		t.Error("Expected bad checksum to fail")
+	}
+}
+
+func TestSLIP10(t *testing.T) {
+	// SLIP-0010 ed25519 test vector 1.
+	seed, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+	key, chainCode := slip10Master(seed)
+	if hex.EncodeToString(key) != "2b4be7f19ee27bbf30c667b642d5f4aa69fd169872f8fc3059c08ebae2eb19e7" {
+		t.Errorf("Unexpected master key %x", key)
+	}
+	if hex.EncodeToString(chainCode) != "90046a93de5380a72b5e45010748567d5ea02bbf6522f979e05c0d8d8ca9fffb" {
+		t.Errorf("Unexpected master chain code %x", chainCode)
+	}
+	key, _ = slip10Child(key, chainCode, 0)
+	if hex.EncodeToString(key) != "68e0fe46dfb67e368c75379acec591dad19df3cde26e63b93a8e704f1dade7a3" {
+		t.Errorf("Unexpected child key %x", key)
+	}
+}
+
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		s        string
+		expected int64
+		valid    bool
+	}{
+		{"1", 10000000, true},
+		{"10.5000000", 105000000, true},
+		{"0.0000001", 1, true},
+		{"0.00000001", 0, false},
+		{"abc", 0, false},
+	}
+	for i, test := range tests {
+		amt, err := parseAmount(test.s)
+		if test.valid && err != nil {
+			t.Errorf("Test %d: unexpected error %s", i, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("Test %d: expected error", i)
+		}
+		if amt != test.expected {
+			t.Errorf("Test %d: expected %d, got %d", i, test.expected, amt)
+		}
+	}
+}
+
+func TestTransaction_Memo(t *testing.T) {
+	tx := &transaction{
+		source: make([]byte, 32),
+		fee:    100,
+		memo:   Memo{Type: MemoText, Text: strings.Repeat("a", maxMemoTextLen+1)},
+	}
+	if _, err := tx.marshal(); err == nil {
+		t.Error("Expected long memo to fail")
+	}
+	tx.memo.Text = strings.Repeat("a", maxMemoTextLen)
+	if _, err := tx.marshal(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStellarWallet_Address(t *testing.T) {
+	w, err := newTestWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr, err := w.CurrentAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.ValidateAddress(addr); err != nil {
+		t.Errorf("Address %s failed validation: %s", addr, err)
+	}
+	addr2, err := w.NewAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.String() != addr2.String() {
+		t.Error("Expected NewAddress to return the account ID")
+	}
+	has, err := w.HasKey(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !has {
+		t.Error("Expected wallet to have key")
+	}
+	if err := w.ValidateAddress(iwallet.NewAddress("abc", CtStellar)); err == nil {
+		t.Error("Expected invalid address to fail validation")
+	}
+}
+
+func TestStellarWallet_Balances(t *testing.T) {
+	w, err := newTestWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := w.CurrentAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder(http.MethodGet, fmt.Sprintf("%s/accounts/%s", testHorizonURL, addr),
+		httpmock.NewStringResponder(http.StatusOK, fmt.Sprintf(`{"id":"%s","sequence":"100","balances":[
+			{"balance":"12.5000000","asset_type":"credit_alphanum4","asset_code":"USDC","asset_issuer":"%s"},
+			{"balance":"20.0000000","asset_type":"native"}]}`, addr, addr)))
+
+	balances, err := w.Balances()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(balances) != 2 {
+		t.Fatalf("Expected 2 balances, got %d", len(balances))
+	}
+	if balances[0].Asset.Code != "USDC" || balances[0].Balance.Cmp(iwallet.NewAmount(125000000)) != 0 {
+		t.Errorf("Unexpected asset balance %v", balances[0])
+	}
+
+	_, confirmed, err := w.Balance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if confirmed.Cmp(iwallet.NewAmount(200000000)) != 0 {
+		t.Errorf("Expected 200000000 got %s", confirmed)
+	}
+}
+
+func TestStellarWallet_SpendWithMemo(t *testing.T) {
+	w, err := newTestWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := w.CurrentAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	to := iwallet.NewAddress(encodeStrKey(versionAccountID, bytes.Repeat([]byte{0x01}, 32)), CtStellar)
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder(http.MethodGet, fmt.Sprintf("%s/accounts/%s", testHorizonURL, addr),
+		httpmock.NewStringResponder(http.StatusOK, fmt.Sprintf(`{"id":"%s","sequence":"100","balances":[{"balance":"20.0000000","asset_type":"native"}]}`, addr)))
+	httpmock.RegisterResponder(http.MethodGet, fmt.Sprintf("%s/accounts/%s", testHorizonURL, to),
+		httpmock.NewStringResponder(http.StatusOK, fmt.Sprintf(`{"id":"%s","sequence":"5","balances":[]}`, to)))
+	httpmock.RegisterResponder(http.MethodGet, testHorizonURL+"/fee_stats",
+		httpmock.NewStringResponder(http.StatusOK, `{"fee_charged":{"p10":"100","p50":"150","p90":"300"}}`))
+
+	var envelope []byte
+	httpmock.RegisterResponder(http.MethodPost, testHorizonURL+"/transactions",
+		func(req *http.Request) (*http.Response, error) {
+			if err := req.ParseForm(); err != nil {
+				return nil, err
+			}
+			envelope, err = base64.StdEncoding.DecodeString(req.PostForm.Get("tx"))
+			if err != nil {
+				return nil, err
+			}
+			return httpmock.NewStringResponse(http.StatusOK, `{}`), nil
+		})
+
+	fee, err := w.EstimateSpendFee(iwallet.NewAmount(0), iwallet.FlNormal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fee.Cmp(iwallet.NewAmount(150)) != 0 {
+		t.Errorf("Expected fee of 150, got %s", fee)
+	}
+
+	wtx, err := w.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	txid, err := w.SpendWithMemo(wtx, to, iwallet.NewAmount(50000000), Asset{}, Memo{Type: MemoID, ID: 12345}, iwallet.FlNormal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wtx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if envelope == nil {
+		t.Fatal("Transaction was not submitted")
+	}
+
+	// The envelope is the envelope type, the transaction, then a single
+	// decorated signature consisting of a four byte hint and the signature.
+	sig := envelope[len(envelope)-ed25519.SignatureSize:]
+	txBytes := envelope[4 : len(envelope)-ed25519.SignatureSize-4-4-4]
+
+	var hw xdrWriter
+	networkID := sha256.Sum256([]byte(testnetPassphrase))
+	hw.Write(networkID[:])
+	hw.int32(envelopeTypeTx)
+	hw.Write(txBytes)
+	h := sha256.Sum256(hw.Bytes())
+	txHash := h[:]
+	if hex.EncodeToString(txHash) != string(txid) {
+		t.Errorf("Expected txid %x, got %s", txHash, txid)
+	}
+
+	pub, err := decodeStrKey(versionAccountID, addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ed25519.Verify(pub, txHash, sig) {
+		t.Error("Invalid signature")
+	}
+}
+
+func TestStellarWallet_SpendWithMemoAddressPolicy(t *testing.T) {
+	w, err := newTestWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	to := iwallet.NewAddress(encodeStrKey(versionAccountID, bytes.Repeat([]byte{0x01}, 32)), CtStellar)
+	if err := w.SetAddressPolicy(base.AddressDenied, "scam list", to); err != nil {
+		t.Fatal(err)
+	}
+
+	wtx, err := w.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wtx.Rollback()
+	if _, err := w.SpendWithMemo(wtx, to, iwallet.NewAmount(50000000), Asset{}, Memo{Type: MemoID, ID: 12345}, iwallet.FlNormal); !errors.Is(err, base.ErrDestinationRejected) {
+		t.Errorf("Expected ErrDestinationRejected, got %v", err)
+	}
+}
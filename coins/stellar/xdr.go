@@ -0,0 +1,245 @@
+package stellar
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+// This file contains a minimal XDR encoder for the stellar transaction
+// types the wallet needs to build: payments and account creation with an
+// optional memo. See Stellar-transaction.x in stellar-core for the schema.
+
+const (
+	envelopeTypeTx = 2
+
+	keyTypeEd25519 = 0
+
+	opTypeCreateAccount = 0
+	opTypePayment       = 1
+
+	assetTypeNative           = 0
+	assetTypeCreditAlphanum4  = 1
+	assetTypeCreditAlphanum12 = 2
+
+	// maxMemoTextLen is the maximum length of a text memo in bytes.
+	maxMemoTextLen = 28
+)
+
+// MemoType is the type of memo attached to a transaction.
+type MemoType int32
+
+const (
+	MemoNone MemoType = iota
+	MemoText
+	MemoID
+	MemoHash
+	MemoReturn
+)
+
+// Memo is an optional note attached to a transaction. Exchanges typically
+// require a text or ID memo to credit deposits to the correct user.
+type Memo struct {
+	Type MemoType
+	Text string
+	ID   uint64
+	Hash [32]byte
+}
+
+// Asset identifies either native lumens or a credit asset.
+type Asset struct {
+	Code   string
+	Issuer string
+}
+
+// IsNative returns whether the asset is XLM.
+func (a Asset) IsNative() bool {
+	return a.Code == "" && a.Issuer == ""
+}
+
+type operation struct {
+	opType      int32
+	destination []byte
+	asset       Asset
+	amount      int64
+}
+
+type transaction struct {
+	source     []byte
+	fee        uint32
+	seqNum     int64
+	minTime    uint64
+	maxTime    uint64
+	memo       Memo
+	operations []operation
+}
+
+type xdrWriter struct {
+	bytes.Buffer
+}
+
+func (w *xdrWriter) int32(i int32) {
+	binary.Write(&w.Buffer, binary.BigEndian, i)
+}
+
+func (w *xdrWriter) uint32(i uint32) {
+	binary.Write(&w.Buffer, binary.BigEndian, i)
+}
+
+func (w *xdrWriter) int64(i int64) {
+	binary.Write(&w.Buffer, binary.BigEndian, i)
+}
+
+func (w *xdrWriter) uint64(i uint64) {
+	binary.Write(&w.Buffer, binary.BigEndian, i)
+}
+
+// fixed writes fixed length opaque data padded to a multiple of four.
+func (w *xdrWriter) fixed(b []byte) {
+	w.Write(b)
+	if pad := (4 - len(b)%4) % 4; pad > 0 {
+		w.Write(make([]byte, pad))
+	}
+}
+
+// variable writes variable length opaque data or a string.
+func (w *xdrWriter) variable(b []byte) {
+	w.uint32(uint32(len(b)))
+	w.fixed(b)
+}
+
+func (w *xdrWriter) accountID(pub []byte) {
+	w.int32(keyTypeEd25519)
+	w.fixed(pub)
+}
+
+func (w *xdrWriter) asset(a Asset) error {
+	if a.IsNative() {
+		w.int32(assetTypeNative)
+		return nil
+	}
+	issuer, err := decodeStrKey(versionAccountID, a.Issuer)
+	if err != nil {
+		return err
+	}
+	code := []byte(a.Code)
+	switch {
+	case len(code) >= 1 && len(code) <= 4:
+		w.int32(assetTypeCreditAlphanum4)
+		padded := make([]byte, 4)
+		copy(padded, code)
+		w.fixed(padded)
+	case len(code) >= 5 && len(code) <= 12:
+		w.int32(assetTypeCreditAlphanum12)
+		padded := make([]byte, 12)
+		copy(padded, code)
+		w.fixed(padded)
+	default:
+		return errors.New("invalid asset code")
+	}
+	w.accountID(issuer)
+	return nil
+}
+
+func (w *xdrWriter) memo(m Memo) error {
+	w.int32(int32(m.Type))
+	switch m.Type {
+	case MemoNone:
+	case MemoText:
+		if len(m.Text) > maxMemoTextLen {
+			return errors.New("memo text too long")
+		}
+		w.variable([]byte(m.Text))
+	case MemoID:
+		w.uint64(m.ID)
+	case MemoHash, MemoReturn:
+		w.fixed(m.Hash[:])
+	default:
+		return errors.New("unknown memo type")
+	}
+	return nil
+}
+
+// marshal returns the XDR encoding of the transaction.
+func (tx *transaction) marshal() ([]byte, error) {
+	var w xdrWriter
+	w.accountID(tx.source)
+	w.uint32(tx.fee)
+	w.int64(tx.seqNum)
+
+	// Preconditions. PRECOND_TIME shares its encoding with the older
+	// optional time bounds so this is valid before and after protocol 19.
+	if tx.minTime == 0 && tx.maxTime == 0 {
+		w.int32(0)
+	} else {
+		w.int32(1)
+		w.uint64(tx.minTime)
+		w.uint64(tx.maxTime)
+	}
+
+	if err := w.memo(tx.memo); err != nil {
+		return nil, err
+	}
+
+	w.uint32(uint32(len(tx.operations)))
+	for _, op := range tx.operations {
+		w.uint32(0) // No operation source account
+		w.int32(op.opType)
+		switch op.opType {
+		case opTypeCreateAccount:
+			w.accountID(op.destination)
+			w.int64(op.amount)
+		case opTypePayment:
+			w.accountID(op.destination)
+			if err := w.asset(op.asset); err != nil {
+				return nil, err
+			}
+			w.int64(op.amount)
+		default:
+			return nil, errors.New("unsupported operation")
+		}
+	}
+	w.int32(0) // ext
+	return w.Bytes(), nil
+}
+
+// hash returns the hash of the transaction for the given network. This
+// is both the transaction ID and the message that is signed.
+func (tx *transaction) hash(networkPassphrase string) ([]byte, error) {
+	ser, err := tx.marshal()
+	if err != nil {
+		return nil, err
+	}
+	networkID := sha256.Sum256([]byte(networkPassphrase))
+
+	var w xdrWriter
+	w.Write(networkID[:])
+	w.int32(envelopeTypeTx)
+	w.Write(ser)
+	h := sha256.Sum256(w.Bytes())
+	return h[:], nil
+}
+
+// sign returns the XDR encoded transaction envelope signed by the key.
+func (tx *transaction) sign(networkPassphrase string, key ed25519.PrivateKey) (envelope []byte, txHash []byte, err error) {
+	txHash, err = tx.hash(networkPassphrase)
+	if err != nil {
+		return nil, nil, err
+	}
+	ser, err := tx.marshal()
+	if err != nil {
+		return nil, nil, err
+	}
+	pub := key.Public().(ed25519.PublicKey)
+	sig := ed25519.Sign(key, txHash)
+
+	var w xdrWriter
+	w.int32(envelopeTypeTx)
+	w.Write(ser)
+	w.uint32(1)
+	w.fixed(pub[len(pub)-4:]) // Signature hint
+	w.variable(sig)
+	return w.Bytes(), txHash, nil
+}
@@ -0,0 +1,132 @@
+package utxobase
+
+import (
+	"errors"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/coinset"
+	"github.com/btcsuite/btcwallet/wallet/txrules"
+	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/multiwallet/database"
+	"sort"
+)
+
+// maxChangelessTries bounds the search for a changeless set of inputs.
+const maxChangelessTries = 100000
+
+// changeScript returns the script change is paid to under the wallet's
+// ChangePolicy. largest is the biggest input being spent.
+func (w *Wallet) changeScript(dbtx database.Tx, largest coinset.Coin) ([]byte, error) {
+	switch w.ChangePolicy {
+	case base.ChangeReuseSource:
+		if largest == nil {
+			return nil, errors.New("no inputs selected")
+		}
+		return w.Chain.AddressToScript(string(largest.PkScript()))
+	case base.ChangeFixedAddress:
+		if w.ChangeAddress == "" {
+			return nil, errors.New("no change address configured")
+		}
+		return w.Chain.AddressToScript(w.ChangeAddress)
+	}
+	iaddr, err := w.Keychain.CurrentAddressWithTx(dbtx, true)
+	if err != nil {
+		return nil, err
+	}
+	return w.Chain.AddressToScript(iaddr.String())
+}
+
+// selectChangeless searches for a set of coins which pays the outputs and
+// the fee of a transaction without change, leaving an excess smaller than
+// the cost of creating and later spending a change output. The excess is
+// paid to the miner. It returns nil if no such set is found.
+func (w *Wallet) selectChangeless(coins []coinset.Coin, outputs []*wire.TxOut, feePerKB btcutil.Amount) ([]coinset.Coin, error) {
+	fee := func(scripts [][]byte, addChange bool) btcutil.Amount {
+		return txrules.FeeForSerializeSize(feePerKB, w.Chain.EstimateSize(scripts, outputs, addChange))
+	}
+
+	type candidate struct {
+		coin   coinset.Coin
+		script []byte
+
+		// effective is the coin's value less the fee to spend it.
+		effective btcutil.Amount
+	}
+	var candidates []candidate
+	for _, c := range coins {
+		script, err := w.Chain.AddressToScript(string(c.PkScript()))
+		if err != nil {
+			return nil, err
+		}
+		inputFee := fee([][]byte{script, script}, false) - fee([][]byte{script}, false)
+		if effective := c.Value() - inputFee; effective > 0 {
+			candidates = append(candidates, candidate{coin: c, script: script, effective: effective})
+		}
+	}
+	// A stable sort keeps coins with equal values in the order given so
+	// DeterministicBuilds selects the same ones each time.
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].effective > candidates[j].effective
+	})
+
+	var target btcutil.Amount
+	for _, out := range outputs {
+		target += btcutil.Amount(out.Value)
+	}
+	spendFee := fee([][]byte{nil, nil}, false) - fee([][]byte{nil}, false)
+	costOfChange := fee([][]byte{nil}, true) - fee([][]byte{nil}, false) + spendFee
+	lower := target + fee(nil, false)
+	upper := lower + costOfChange
+
+	// remaining[i] is the effective value of candidates i and up.
+	remaining := make([]btcutil.Amount, len(candidates)+1)
+	for i := len(candidates) - 1; i >= 0; i-- {
+		remaining[i] = remaining[i+1] + candidates[i].effective
+	}
+
+	// fits checks the selection using the exact size as the effective
+	// values may be off by rounding.
+	var selected []int
+	fits := func() bool {
+		var (
+			total   btcutil.Amount
+			scripts [][]byte
+		)
+		for _, i := range selected {
+			total += candidates[i].coin.Value()
+			scripts = append(scripts, candidates[i].script)
+		}
+		required := target + fee(scripts, false)
+		return total >= required && total <= required+costOfChange
+	}
+
+	tries := 0
+	var search func(i int, total btcutil.Amount) bool
+	search = func(i int, total btcutil.Amount) bool {
+		tries++
+		if total > upper || tries > maxChangelessTries {
+			return false
+		}
+		if total >= lower && fits() {
+			return true
+		}
+		if i == len(candidates) || total+remaining[i] < lower {
+			return false
+		}
+		selected = append(selected, i)
+		if search(i+1, total+candidates[i].effective) {
+			return true
+		}
+		selected = selected[:len(selected)-1]
+		return search(i+1, total)
+	}
+	if !search(0, 0) {
+		return nil, nil
+	}
+
+	result := make([]coinset.Coin, 0, len(selected))
+	for _, i := range selected {
+		result = append(result, candidates[i].coin)
+	}
+	return result, nil
+}
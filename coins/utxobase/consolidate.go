@@ -0,0 +1,243 @@
+package utxobase
+
+import (
+	"errors"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/coinset"
+	hd "github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/btcsuite/btcwallet/wallet/txrules"
+	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"time"
+)
+
+// ErrNothingToConsolidate is returned when fewer than two utxos are below
+// the consolidation threshold.
+var ErrNothingToConsolidate = errors.New("nothing to consolidate")
+
+// ConsolidationPlan describes the transaction Consolidate would build.
+type ConsolidationPlan struct {
+	// Outpoints are the utxos which would be merged.
+	Outpoints [][]byte
+
+	// Total is the value of the merged utxos and Fee is the fee paid to
+	// merge them now.
+	Total iwallet.Amount
+	Fee   iwallet.Amount
+
+	// Savings is the fee saved by spending one output instead of all of
+	// the merged utxos in a future transaction at the normal fee level,
+	// less the fee paid now. It is negative if consolidating costs more
+	// than it saves.
+	Savings iwallet.Amount
+}
+
+// PlanConsolidation returns the plan for merging all spendable utxos worth
+// less than threshold at the given fee level without building or signing
+// anything.
+func (w *Wallet) PlanConsolidation(threshold iwallet.Amount, feeLevel iwallet.FeeLevel) (*ConsolidationPlan, error) {
+	var plan *ConsolidationPlan
+	err := w.DB.View(func(dbtx database.Tx) error {
+		coinKeyMap, err := w.consolidationCoins(dbtx, threshold)
+		if err != nil {
+			return err
+		}
+		defer base.ZeroCoinKeys(coinKeyMap)
+
+		plan, err = w.planConsolidation(dbtx, coinKeyMap, feeLevel)
+		return err
+	})
+	return plan, err
+}
+
+// Consolidate merges all spendable utxos worth less than threshold into a
+// single output paying the wallet's change address. The fee is paid out of
+// the merged value. The transaction is saved and broadcast when wtx is
+// committed.
+func (w *Wallet) Consolidate(wtx iwallet.Tx, threshold iwallet.Amount, feeLevel iwallet.FeeLevel) (iwallet.TransactionID, error) {
+	var tx *wire.MsgTx
+	err := w.DB.View(func(dbtx database.Tx) error {
+		coinKeyMap, err := w.consolidationCoins(dbtx, threshold)
+		if err != nil {
+			return err
+		}
+		var total btcutil.Amount
+		for coin := range coinKeyMap {
+			total += coin.Value()
+		}
+		addr, err := w.Keychain.CurrentAddressWithTx(dbtx, true)
+		if err != nil {
+			base.ZeroCoinKeys(coinKeyMap)
+			return err
+		}
+		outputs := []Output{{Address: addr, Amount: iwallet.NewAmount(int64(total)), SubtractFee: true}}
+		tx, err = w.buildTx(dbtx, coinKeyMap, true, outputs, 0, feeLevel, nil)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return w.broadcastOnCommit(wtx, tx)
+}
+
+// consolidationCoins returns the spendable coins worth less than threshold.
+func (w *Wallet) consolidationCoins(dbtx database.Tx, threshold iwallet.Amount) (map[coinset.Coin]*hd.ExtendedKey, error) {
+	coinKeyMap, err := w.GatherCoins(dbtx)
+	if err != nil {
+		return nil, err
+	}
+	for coin, key := range coinKeyMap {
+		if int64(coin.Value()) >= threshold.Int64() {
+			base.ZeroKey(key)
+			delete(coinKeyMap, coin)
+		}
+	}
+	if w.SeparateSources {
+		keepOneSource(coinKeyMap)
+	}
+	if len(coinKeyMap) < 2 {
+		base.ZeroCoinKeys(coinKeyMap)
+		return nil, ErrNothingToConsolidate
+	}
+	return coinKeyMap, nil
+}
+
+func (w *Wallet) planConsolidation(dbtx database.Tx, coinKeyMap map[coinset.Coin]*hd.ExtendedKey, feeLevel iwallet.FeeLevel) (*ConsolidationPlan, error) {
+	var (
+		plan    = &ConsolidationPlan{}
+		total   btcutil.Amount
+		scripts [][]byte
+	)
+	for coin := range coinKeyMap {
+		script, err := w.Chain.AddressToScript(string(coin.PkScript()))
+		if err != nil {
+			return nil, err
+		}
+		op := wire.NewOutPoint(coin.Hash(), coin.Index())
+		plan.Outpoints = append(plan.Outpoints, SerializeOutpoint(op))
+		scripts = append(scripts, script)
+		total += coin.Value()
+	}
+
+	addr, err := w.Keychain.CurrentAddressWithTx(dbtx, true)
+	if err != nil {
+		return nil, err
+	}
+	script, err := w.Chain.AddressToScript(addr.String())
+	if err != nil {
+		return nil, err
+	}
+	outputs := []*wire.TxOut{wire.NewTxOut(int64(total), script)}
+
+	fpb, err := w.FeeProvider.GetFee(feeLevel)
+	if err != nil {
+		return nil, err
+	}
+	fee := txrules.FeeForSerializeSize(btcutil.Amount(fpb.Int64()*1000), w.Chain.EstimateSize(scripts, outputs, false))
+
+	normal, err := w.FeeProvider.GetFee(iwallet.FlNormal)
+	if err != nil {
+		return nil, err
+	}
+	extraSize := w.Chain.EstimateSize(scripts, outputs, false) - w.Chain.EstimateSize(scripts[:1], outputs, false)
+	saved := txrules.FeeForSerializeSize(btcutil.Amount(normal.Int64()*1000), extraSize)
+
+	plan.Total = iwallet.NewAmount(int64(total))
+	plan.Fee = iwallet.NewAmount(int64(fee))
+	plan.Savings = iwallet.NewAmount(int64(saved - fee))
+	return plan, nil
+}
+
+// ConsolidatorConfig configures the background consolidation job.
+type ConsolidatorConfig struct {
+	// Interval is how often fees are checked.
+	Interval time.Duration
+
+	// Threshold is the value below which utxos are merged.
+	Threshold iwallet.Amount
+
+	// FeeLevel is the fee level used for the consolidation transaction.
+	// The job only runs when this level's fee per byte is at or below
+	// MaxFeePerByte.
+	FeeLevel      iwallet.FeeLevel
+	MaxFeePerByte iwallet.Amount
+
+	// MinUtxos is the smallest number of utxos worth merging.
+	MinUtxos int
+}
+
+// Consolidator periodically merges small utxos when fees are low and doing
+// so is projected to save fees.
+type Consolidator struct {
+	wallet   *Wallet
+	cfg      ConsolidatorConfig
+	shutdown chan struct{}
+}
+
+// NewConsolidator returns a new Consolidator for the wallet.
+func NewConsolidator(w *Wallet, cfg ConsolidatorConfig) *Consolidator {
+	return &Consolidator{wallet: w, cfg: cfg, shutdown: make(chan struct{})}
+}
+
+// Start runs the consolidator until Stop is called or the wallet is closed.
+func (c *Consolidator) Start() {
+	ticker := time.NewTicker(c.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.consolidate()
+		case <-c.shutdown:
+			return
+		case <-c.wallet.Done:
+			return
+		}
+	}
+}
+
+// Stop will shutdown the consolidator.
+func (c *Consolidator) Stop() {
+	close(c.shutdown)
+}
+
+func (c *Consolidator) consolidate() {
+	w := c.wallet
+	fpb, err := w.FeeProvider.GetFee(c.cfg.FeeLevel)
+	if err != nil {
+		w.Logger.Errorf("[%s] Error fetching fee for consolidation: %s", w.CoinType, err)
+		return
+	}
+	if fpb.Cmp(c.cfg.MaxFeePerByte) > 0 {
+		return
+	}
+
+	plan, err := w.PlanConsolidation(c.cfg.Threshold, c.cfg.FeeLevel)
+	if errors.Is(err, ErrNothingToConsolidate) {
+		return
+	} else if err != nil {
+		w.Logger.Errorf("[%s] Error planning consolidation: %s", w.CoinType, err)
+		return
+	}
+	if len(plan.Outpoints) < c.cfg.MinUtxos || plan.Savings.Cmp(iwallet.NewAmount(0)) <= 0 {
+		return
+	}
+
+	wtx, err := w.Begin()
+	if err != nil {
+		w.Logger.Errorf("[%s] Error consolidating utxos: %s", w.CoinType, err)
+		return
+	}
+	txid, err := w.Consolidate(wtx, c.cfg.Threshold, c.cfg.FeeLevel)
+	if err != nil {
+		wtx.Rollback()
+		w.Logger.Errorf("[%s] Error consolidating utxos: %s", w.CoinType, err)
+		return
+	}
+	if err := wtx.Commit(); err != nil {
+		w.Logger.Errorf("[%s] Error broadcasting consolidation: %s", w.CoinType, err)
+		return
+	}
+	w.Logger.Infof("[%s] Consolidated %d utxos in %s, projected savings %s", w.CoinType, len(plan.Outpoints), txid, plan.Savings)
+}
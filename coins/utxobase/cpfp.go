@@ -0,0 +1,124 @@
+package utxobase
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcwallet/wallet/txrules"
+	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"gorm.io/gorm"
+)
+
+// ErrFeeSufficient is returned by AccelerateIncoming when the transaction
+// already pays the fee level.
+var ErrFeeSufficient = errors.New("transaction already pays the fee level")
+
+// AccelerateIncoming speeds up an unconfirmed payment to the wallet by
+// spending its outputs to the wallet's change address in a child
+// transaction paying enough fee for the parent and child together to reach
+// the fee level (child pays for parent). The parent is fetched from the
+// backend so it needs a base.RawTransactionClient. The child is saved and
+// broadcast when wtx is committed.
+func (w *Wallet) AccelerateIncoming(wtx iwallet.Tx, id iwallet.TransactionID, feeLevel iwallet.FeeLevel) (iwallet.TransactionID, error) {
+	parent, err := w.GetTransaction(id)
+	if err != nil {
+		return "", err
+	}
+	if parent.Height > 0 {
+		return "", base.ErrTransactionConfirmed
+	}
+	parentFee := iwallet.NewAmount(0)
+	for _, from := range parent.From {
+		parentFee = parentFee.Add(from.Amount)
+	}
+	for _, to := range parent.To {
+		parentFee = parentFee.Sub(to.Amount)
+	}
+
+	raw, err := w.GetRawTransaction(id)
+	if err != nil {
+		return "", err
+	}
+	var msgTx wire.MsgTx
+	if err := msgTx.Deserialize(bytes.NewReader(raw)); err != nil {
+		return "", err
+	}
+	fpb, err := w.FeeProvider.GetFee(feeLevel)
+	if err != nil {
+		return "", err
+	}
+	deficit := fpb.Mul(iwallet.NewAmount(virtualSize(&msgTx))).Sub(parentFee).Int64()
+	if deficit <= 0 {
+		return "", ErrFeeSufficient
+	}
+
+	hash, err := chainhash.NewHashFromStr(id.String())
+	if err != nil {
+		return "", err
+	}
+	var tx *wire.MsgTx
+	err = w.DB.View(func(dbtx database.Tx) error {
+		var outpoints [][]byte
+		for i := range msgTx.TxOut {
+			op := SerializeOutpoint(wire.NewOutPoint(hash, uint32(i)))
+			var record database.UtxoRecord
+			err := dbtx.Read().Where("coin = ?", w.CoinType.CurrencyCode()).Where("outpoint = ?", hex.EncodeToString(op)).First(&record).Error
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				continue
+			} else if err != nil {
+				return err
+			}
+			if !record.Frozen {
+				outpoints = append(outpoints, op)
+			}
+		}
+		if len(outpoints) == 0 {
+			return errors.New("transaction pays no spendable outputs to this wallet")
+		}
+
+		coinKeyMap, err := w.GatherSelectedCoins(dbtx, outpoints)
+		if err != nil {
+			return err
+		}
+		var total btcutil.Amount
+		for coin := range coinKeyMap {
+			total += coin.Value()
+		}
+		addr, err := w.Keychain.CurrentAddressWithTx(dbtx, true)
+		if err != nil {
+			base.ZeroCoinKeys(coinKeyMap)
+			return err
+		}
+		outputs := []Output{{Address: addr, Amount: iwallet.NewAmount(int64(total)), SubtractFee: true}}
+
+		// buildTx only pays the child's fee. The parent's shortfall is
+		// taken from the same output.
+		prepare := func(tx *wire.MsgTx, keys map[wire.OutPoint]*btcec.PrivateKey) error {
+			out := tx.TxOut[0]
+			out.Value -= deficit
+			if out.Value < 0 || txrules.IsDustAmount(btcutil.Amount(out.Value), len(out.PkScript), txrules.DefaultRelayFeePerKb) {
+				return base.ErrInsufficientFunds
+			}
+			return nil
+		}
+		tx, err = w.buildTx(dbtx, coinKeyMap, true, outputs, 0, feeLevel, prepare)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return w.broadcastOnCommit(wtx, tx)
+}
+
+// virtualSize returns the size of the transaction in virtual bytes, which
+// is its serialized size for coins without segwit.
+func virtualSize(tx *wire.MsgTx) int64 {
+	weight := tx.SerializeSizeStripped()*3 + tx.SerializeSize()
+	return int64((weight + 3) / 4)
+}
@@ -0,0 +1,81 @@
+package utxobase
+
+import (
+	"bytes"
+	"errors"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil/coinset"
+	"github.com/btcsuite/btcutil/txsort"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"sort"
+)
+
+// errUnsigned stops buildTx before it signs for BuildUnsignedTx.
+var errUnsigned = errors.New("transaction left unsigned")
+
+// BuildUnsignedTx returns the transaction SpendMulti would build to pay the
+// outputs, without signatures. Nothing is saved or broadcast.
+//
+// With DeterministicBuilds set a reviewer or cosigner running a watch-only
+// copy of the wallet, synced to the same height and using the same fee
+// rate, builds the same transaction byte for byte. They can compare it with
+// StripSignatures of the transaction they're asked to sign.
+func (w *Wallet) BuildUnsignedTx(outputs []Output, feeLevel iwallet.FeeLevel) (*wire.MsgTx, error) {
+	var unsigned *wire.MsgTx
+	err := w.DB.View(func(dbtx database.Tx) error {
+		coinKeyMap, err := w.GatherCoins(dbtx)
+		if err != nil {
+			return err
+		}
+		_, err = w.buildTx(dbtx, coinKeyMap, false, outputs, 0, feeLevel, func(tx *wire.MsgTx, _ map[wire.OutPoint]*btcec.PrivateKey) error {
+			unsigned = tx.Copy()
+			return errUnsigned
+		})
+		return err
+	})
+	if err != nil && !errors.Is(err, errUnsigned) {
+		return nil, err
+	}
+	return unsigned, nil
+}
+
+// StripSignatures returns a copy of the transaction without its input
+// scripts and witnesses.
+func StripSignatures(tx *wire.MsgTx) *wire.MsgTx {
+	stripped := tx.Copy()
+	for _, in := range stripped.TxIn {
+		in.SignatureScript = nil
+		in.Witness = nil
+	}
+	return stripped
+}
+
+// sortCoins orders the coins by outpoint so that coin selection, and so
+// the inputs and change address chosen, don't depend on the order the
+// coins were gathered in.
+func sortCoins(coins []coinset.Coin) {
+	sort.Slice(coins, func(i, j int) bool {
+		if c := bytes.Compare(coins[i].Hash()[:], coins[j].Hash()[:]); c != 0 {
+			return c < 0
+		}
+		return coins[i].Index() < coins[j].Index()
+	})
+}
+
+// canonicalSort sorts the inputs and payments as in BIP 69 and, if
+// hasChange is set, moves the change output, which buildTx adds last, to
+// the end. BIP 69 would put it wherever its value falls among the
+// payments.
+func canonicalSort(tx *wire.MsgTx, hasChange bool) {
+	if !hasChange {
+		txsort.InPlaceSort(tx)
+		return
+	}
+	l := len(tx.TxOut) - 1
+	change := tx.TxOut[l]
+	tx.TxOut = tx.TxOut[:l]
+	txsort.InPlaceSort(tx)
+	tx.TxOut = append(tx.TxOut, change)
+}
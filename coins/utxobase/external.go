@@ -0,0 +1,23 @@
+package utxobase
+
+import (
+	"bytes"
+	"github.com/btcsuite/btcd/wire"
+	iwallet "github.com/cpacia/wallet-interface"
+)
+
+// BroadcastRaw broadcasts a signed transaction built outside the wallet
+// through the wallet's broadcast queue. It's tracked in the history if it
+// involves the wallet. See base.WalletBase.BroadcastExternal.
+func (w *Wallet) BroadcastRaw(raw []byte) (iwallet.TransactionID, error) {
+	var tx wire.MsgTx
+	if err := tx.Deserialize(bytes.NewReader(raw)); err != nil {
+		return "", err
+	}
+	txid := iwallet.TransactionID(tx.TxHash().String())
+	inputs := make([][]byte, 0, len(tx.TxIn))
+	for _, in := range tx.TxIn {
+		inputs = append(inputs, SerializeOutpoint(&in.PreviousOutPoint))
+	}
+	return txid, w.BroadcastExternal(txid, raw, inputs, tx.LockTime)
+}
@@ -0,0 +1,97 @@
+package utxobase
+
+import (
+	"errors"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/cpacia/multiwallet/base"
+	iwallet "github.com/cpacia/wallet-interface"
+)
+
+var _ = base.HTLCWallet(&Wallet{})
+
+// HTLCAddress returns the P2SH address of the contract's redeem script.
+func (w *Wallet) HTLCAddress(script []byte) (iwallet.Address, error) {
+	if w.Chain.ScriptHashAddress == nil {
+		return iwallet.Address{}, errors.New("htlcs are not supported by this coin")
+	}
+	if _, err := base.ParseHTLCScript(script); err != nil {
+		return iwallet.Address{}, err
+	}
+	addr, err := w.Chain.ScriptHashAddress(script)
+	if err != nil {
+		return iwallet.Address{}, err
+	}
+	return iwallet.NewAddress(addr, w.CoinType), nil
+}
+
+// SpendHTLC redeems the contract output of contractTx with the secret, or
+// refunds it if secret is nil, paying the wallet's current change address.
+// A refund has the contract's lock time so it can be broadcast early and
+// is left queued by the rebroadcaster until it's final.
+func (w *Wallet) SpendHTLC(wtx iwallet.Tx, contractTx iwallet.Transaction, script, secret []byte, key btcec.PrivateKey, feeLevel iwallet.FeeLevel) (iwallet.TransactionID, error) {
+	contract, err := base.ParseHTLCScript(script)
+	if err != nil {
+		return "", err
+	}
+	if secret != nil {
+		if err := contract.CheckSecret(secret); err != nil {
+			return "", err
+		}
+	}
+	addr, err := w.HTLCAddress(script)
+	if err != nil {
+		return "", err
+	}
+	out, err := base.HTLCOutput(contractTx, addr)
+	if err != nil {
+		return "", err
+	}
+	op, err := DeserializeOutpoint(out.ID)
+	if err != nil {
+		return "", err
+	}
+
+	changeAddr, err := w.Keychain.CurrentAddress(true)
+	if err != nil {
+		return "", err
+	}
+	changeScript, err := w.Chain.AddressToScript(changeAddr.String())
+	if err != nil {
+		return "", err
+	}
+
+	fpb, err := w.FeeProvider.GetFee(feeLevel)
+	if err != nil {
+		return "", err
+	}
+	fee := fpb.Mul(iwallet.NewAmount(base.HTLCSpendSize(script, secret != nil, len(changeScript))))
+	value := out.Amount.Sub(fee)
+	if value.Cmp(iwallet.NewAmount(0)) <= 0 || w.IsDust(value) {
+		return "", errors.New("htlc amount is too small to pay the fee")
+	}
+
+	tx := wire.NewMsgTx(wire.TxVersion)
+	in := wire.NewTxIn(op, nil, nil)
+	if secret == nil {
+		tx.LockTime = uint32(contract.LockTime)
+		in.Sequence = wire.MaxTxInSequenceNum - 1
+	}
+	tx.AddTxIn(in)
+	tx.AddTxOut(wire.NewTxOut(value.Int64(), changeScript))
+
+	sig, err := w.Chain.SignScriptInput(tx, 0, script, out.Amount.Int64(), &key)
+	if err != nil {
+		return "", err
+	}
+	pubKey := key.PubKey().SerializeCompressed()
+	if secret != nil {
+		in.SignatureScript, err = base.HTLCRedeemSigScript(sig, pubKey, secret, script)
+	} else {
+		in.SignatureScript, err = base.HTLCRefundSigScript(sig, pubKey, script)
+	}
+	if err != nil {
+		return "", err
+	}
+	return w.CommitTx(wtx, tx)
+}
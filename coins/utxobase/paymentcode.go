@@ -0,0 +1,335 @@
+package utxobase
+
+import (
+	"bytes"
+	"errors"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"gorm.io/gorm"
+	"time"
+)
+
+// notificationAmount is paid to the notification address of a payment
+// code. It's the dust limit of a P2PKH output.
+const notificationAmount = 546
+
+var (
+	// ErrPaymentCodeNotNotified is returned when paying a payment code
+	// which the wallet hasn't sent a notification to.
+	ErrPaymentCodeNotNotified = errors.New("payment code has not been notified")
+
+	// ErrNotNotification is returned for transactions which aren't a
+	// notification to the wallet's payment code.
+	ErrNotNotification = errors.New("transaction is not a payment code notification")
+)
+
+// PaymentCode returns the wallet's BIP 47 payment code. It can be published
+// in place of an address as each sender pays it on their own chain of
+// addresses.
+func (w *Wallet) PaymentCode() (base.PaymentCode, error) {
+	return w.Keychain.PaymentCode()
+}
+
+// NotificationAddress returns the address notifications to the wallet's
+// payment code are paid to.
+func (w *Wallet) NotificationAddress() (iwallet.Address, error) {
+	pc, err := w.Keychain.PaymentCode()
+	if err != nil {
+		return iwallet.Address{}, err
+	}
+	key, err := pc.NotificationKey()
+	if err != nil {
+		return iwallet.Address{}, err
+	}
+	return w.Keychain.PaymentCodeAddress(key)
+}
+
+// NotifyPaymentCode builds the notification transaction which must be sent
+// before paying a payment code. It pays the dust limit to the code's
+// notification address and carries the wallet's own code, blinded so only
+// the code's owner can read it, in an OP_RETURN output. The blinding key is
+// the key of the transaction's first input, which must reveal its public
+// key when spent, so taproot coins can't be used. The transaction is saved
+// and broadcast when wtx is committed.
+func (w *Wallet) NotifyPaymentCode(wtx iwallet.Tx, to base.PaymentCode, feeLevel iwallet.FeeLevel) (iwallet.TransactionID, error) {
+	own, err := w.Keychain.PaymentCode()
+	if err != nil {
+		return "", err
+	}
+	notificationKey, err := to.NotificationKey()
+	if err != nil {
+		return "", err
+	}
+	notificationAddr, err := w.Keychain.PaymentCodeAddress(notificationKey)
+	if err != nil {
+		return "", err
+	}
+
+	outputs := []Output{
+		{Address: notificationAddr, Amount: iwallet.NewAmount(notificationAmount), AllowReuse: true},
+		// The payload is filled in once the inputs are sorted.
+		{Data: make([]byte, base.PaymentCodeLen)},
+	}
+	prepare := func(tx *wire.MsgTx, keys map[wire.OutPoint]*btcec.PrivateKey) error {
+		op := tx.TxIn[0].PreviousOutPoint
+		key := keys[op]
+		if key == nil {
+			return errors.New("notification input has no private key")
+		}
+		script, err := txscript.NullDataScript(base.BlindPaymentCode(own, key, SerializeOutpoint(&op), notificationKey))
+		if err != nil {
+			return err
+		}
+		for _, out := range tx.TxOut {
+			if txscript.GetScriptClass(out.PkScript) == txscript.NullDataTy {
+				out.PkScript = script
+			}
+		}
+		return nil
+	}
+
+	var tx *wire.MsgTx
+	err = w.DB.View(func(dbtx database.Tx) error {
+		var record database.PaymentCodeRecord
+		err := dbtx.Read().Where("coin=?", w.CoinType.CurrencyCode()).Where("code=?", to.String()).Where("outgoing=?", true).First(&record).Error
+		if err == nil {
+			return errors.New("payment code has already been notified")
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		coinKeyMap, err := w.GatherCoins(dbtx)
+		if err != nil {
+			return err
+		}
+		tx, err = w.buildTx(dbtx, coinKeyMap, false, outputs, 0, feeLevel, prepare)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	txid, err := w.broadcastOnCommit(wtx, tx)
+	if err != nil {
+		return txid, err
+	}
+
+	wbtx := wtx.(*base.DBTx)
+	commit := wbtx.OnCommit
+	wbtx.OnCommit = func() error {
+		err := w.DB.Update(func(dbtx database.Tx) error {
+			return dbtx.Save(&database.PaymentCodeRecord{
+				Coin:             w.CoinType.CurrencyCode(),
+				Code:             to.String(),
+				Outgoing:         true,
+				NotificationTxid: txid.String(),
+				CreatedAt:        time.Now(),
+			})
+		})
+		if err != nil {
+			return err
+		}
+		return commit()
+	}
+	return txid, nil
+}
+
+// SendToPaymentCode pays amt to the next address of the payment code. The
+// code must have been notified with NotifyPaymentCode. Each payment uses a
+// new address which only the wallet and the code's owner can link. The
+// transaction is saved and broadcast when wtx is committed.
+func (w *Wallet) SendToPaymentCode(wtx iwallet.Tx, to base.PaymentCode, amt iwallet.Amount, feeLevel iwallet.FeeLevel) (iwallet.TransactionID, error) {
+	var record database.PaymentCodeRecord
+	err := w.DB.View(func(dbtx database.Tx) error {
+		return dbtx.Read().Where("coin=?", w.CoinType.CurrencyCode()).Where("code=?", to.String()).Where("outgoing=?", true).First(&record).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", ErrPaymentCodeNotNotified
+	} else if err != nil {
+		return "", err
+	}
+
+	notificationKey, err := w.Keychain.NotificationKey()
+	if err != nil {
+		return "", err
+	}
+	defer base.ZeroPrivKey(notificationKey)
+
+	var (
+		index = record.NextIndex
+		key   *btcec.PublicKey
+	)
+	for {
+		// Indexes whose keys or shared secrets are invalid are skipped
+		// by both sides.
+		key, err = base.PaymentCodeSendKey(notificationKey, to, uint32(index))
+		if err == nil {
+			break
+		}
+		index++
+	}
+	addr, err := w.Keychain.PaymentCodeAddress(key)
+	if err != nil {
+		return "", err
+	}
+
+	txid, err := w.SpendMulti(wtx, []Output{{Address: addr, Amount: amt}}, feeLevel)
+	if err != nil {
+		return txid, err
+	}
+
+	wbtx := wtx.(*base.DBTx)
+	commit := wbtx.OnCommit
+	wbtx.OnCommit = func() error {
+		err := w.DB.Update(func(dbtx database.Tx) error {
+			record.NextIndex = index + 1
+			return dbtx.Save(&record)
+		})
+		if err != nil {
+			return err
+		}
+		return commit()
+	}
+	return txid, nil
+}
+
+// ScanPaymentCodeNotifications looks for notifications to the wallet's
+// payment code which haven't been processed. The addresses of each new code
+// are watched and the wallet is rescanned from the notification's height in
+// case they've already been paid. The ChainClient must implement
+// base.RawTransactionClient. The keychain must be unlocked.
+func (w *Wallet) ScanPaymentCodeNotifications() ([]base.PaymentCode, error) {
+	notificationAddr, err := w.NotificationAddress()
+	if err != nil {
+		return nil, err
+	}
+	txs, err := w.GetAddressTransactions(notificationAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []database.PaymentCodeRecord
+	err = w.DB.View(func(dbtx database.Tx) error {
+		return dbtx.Read().Where("coin=?", w.CoinType.CurrencyCode()).Where("outgoing=?", false).Find(&records).Error
+	})
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	processed := make(map[string]bool, len(records))
+	for _, rec := range records {
+		processed[rec.NotificationTxid] = true
+	}
+
+	var codes []base.PaymentCode
+	for _, t := range txs {
+		if processed[t.ID.String()] {
+			continue
+		}
+		raw, err := w.GetRawTransaction(t.ID)
+		if err != nil {
+			return codes, err
+		}
+		pc, err := w.ProcessPaymentCodeNotification(raw, t.Height)
+		if errors.Is(err, ErrNotNotification) {
+			continue
+		} else if err != nil {
+			return codes, err
+		}
+		codes = append(codes, pc)
+	}
+	return codes, nil
+}
+
+// ProcessPaymentCodeNotification reads the payment code from a serialized
+// notification transaction confirmed at height, or zero if it's
+// unconfirmed. The code's first addresses are derived and watched. The
+// keychain must be unlocked.
+func (w *Wallet) ProcessPaymentCodeNotification(raw []byte, height uint64) (base.PaymentCode, error) {
+	var tx wire.MsgTx
+	if err := tx.Deserialize(bytes.NewReader(raw)); err != nil {
+		return base.PaymentCode{}, err
+	}
+	notificationAddr, err := w.NotificationAddress()
+	if err != nil {
+		return base.PaymentCode{}, err
+	}
+	notificationScript, err := w.Chain.AddressToScript(notificationAddr.String())
+	if err != nil {
+		return base.PaymentCode{}, err
+	}
+
+	var (
+		paid    bool
+		payload []byte
+	)
+	for _, out := range tx.TxOut {
+		if bytes.Equal(out.PkScript, notificationScript) {
+			paid = true
+		}
+		if txscript.GetScriptClass(out.PkScript) == txscript.NullDataTy {
+			pushes, err := txscript.PushedData(out.PkScript)
+			if err == nil && len(pushes) == 1 && len(pushes[0]) == base.PaymentCodeLen {
+				payload = pushes[0]
+			}
+		}
+	}
+	if !paid || payload == nil {
+		return base.PaymentCode{}, ErrNotNotification
+	}
+	outpoint, inputKey := designatedInput(&tx)
+	if inputKey == nil {
+		return base.PaymentCode{}, ErrNotNotification
+	}
+
+	notificationKey, err := w.Keychain.NotificationKey()
+	if err != nil {
+		return base.PaymentCode{}, err
+	}
+	from, err := base.UnblindPaymentCode(payload, notificationKey, SerializeOutpoint(outpoint), inputKey)
+	base.ZeroPrivKey(notificationKey)
+	if err != nil {
+		return base.PaymentCode{}, ErrNotNotification
+	}
+
+	var addrs []iwallet.Address
+	err = w.DB.Update(func(dbtx database.Tx) error {
+		addrs, err = w.Keychain.AddIncomingPaymentCode(dbtx, from, iwallet.TransactionID(tx.TxHash().String()))
+		return err
+	})
+	if err != nil {
+		return base.PaymentCode{}, err
+	}
+	if len(addrs) > 0 {
+		for _, addr := range addrs {
+			w.ChainManager.AddAddressSubscription(addr)
+		}
+		go w.ChainManager.ScanTransactions(height)
+	}
+	return from, nil
+}
+
+// designatedInput returns the outpoint and public key of the first input
+// which reveals its key. The key is the last item of a witness or the last
+// push of a signature script.
+func designatedInput(tx *wire.MsgTx) (*wire.OutPoint, *btcec.PublicKey) {
+	for _, in := range tx.TxIn {
+		var candidate []byte
+		if len(in.Witness) > 0 {
+			candidate = in.Witness[len(in.Witness)-1]
+		} else if pushes, err := txscript.PushedData(in.SignatureScript); err == nil && len(pushes) > 0 {
+			candidate = pushes[len(pushes)-1]
+		}
+		if len(candidate) != 33 && len(candidate) != 65 {
+			continue
+		}
+		key, err := btcec.ParsePubKey(candidate, btcec.S256())
+		if err != nil {
+			continue
+		}
+		return &in.PreviousOutPoint, key
+	}
+	return nil, nil
+}
@@ -0,0 +1,80 @@
+package utxobase
+
+import (
+	"errors"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/coinset"
+	hd "github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/cpacia/multiwallet/base"
+	"sort"
+)
+
+// ErrMixedSources is returned when SeparateSources is set and the wallet
+// could only pay a spend by combining utxos from different sources.
+var ErrMixedSources = errors.New("no single utxo source can pay the spend")
+
+// coinSource returns the source of a coin, or "" if it has none.
+func coinSource(c coinset.Coin) string {
+	if coin, ok := c.(*base.Coin); ok {
+		return coin.Source
+	}
+	return ""
+}
+
+// sourceGroups splits the coins by source, keeping their order within each
+// source. Groups are ordered by total value, smallest first, so a spend is
+// paid from the smallest source which can cover it.
+func sourceGroups(coins []coinset.Coin) [][]coinset.Coin {
+	type group struct {
+		source string
+		total  btcutil.Amount
+		coins  []coinset.Coin
+	}
+	var (
+		groups []*group
+		index  = make(map[string]*group)
+	)
+	for _, c := range coins {
+		source := coinSource(c)
+		g, ok := index[source]
+		if !ok {
+			g = &group{source: source}
+			index[source] = g
+			groups = append(groups, g)
+		}
+		g.total += c.Value()
+		g.coins = append(g.coins, c)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].total != groups[j].total {
+			return groups[i].total < groups[j].total
+		}
+		return groups[i].source < groups[j].source
+	})
+	ret := make([][]coinset.Coin, 0, len(groups))
+	for _, g := range groups {
+		ret = append(ret, g.coins)
+	}
+	return ret
+}
+
+// keepOneSource removes every coin not from the source with the most coins
+// and zeroes its key. Ties go to the source which sorts first.
+func keepOneSource(coinKeyMap map[coinset.Coin]*hd.ExtendedKey) {
+	counts := make(map[string]int)
+	for coin := range coinKeyMap {
+		counts[coinSource(coin)]++
+	}
+	keep, most := "", 0
+	for source, n := range counts {
+		if n > most || (n == most && source < keep) {
+			keep, most = source, n
+		}
+	}
+	for coin, key := range coinKeyMap {
+		if coinSource(coin) != keep {
+			base.ZeroKey(key)
+			delete(coinKeyMap, coin)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package utxobase
+
+import (
+	"bytes"
+	"errors"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+)
+
+// ErrAddressReused is returned when PreventAddressReuse is enabled and an
+// output pays an address the wallet has already paid. Set AllowReuse on the
+// output to send anyway.
+var ErrAddressReused = errors.New("address has already been paid by this wallet")
+
+// checkAddressReuse returns ErrAddressReused if any output which doesn't
+// allow reuse pays to an address the wallet has previously sent to. Payments
+// to the wallet's own addresses are not counted.
+func (w *Wallet) checkAddressReuse(dbtx database.Tx, outputs []Output) error {
+	targets := make(map[string]bool)
+	for _, out := range outputs {
+		if !out.AllowReuse && out.Data == nil {
+			targets[out.Address.String()] = true
+		}
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+
+	if err := w.Keychain.SyncAddressIndex(dbtx); err != nil {
+		return err
+	}
+	index := w.Keychain.AddressIndex()
+	own := func(addr string) bool {
+		return index.Contains(iwallet.NewAddress(addr, w.CoinType))
+	}
+
+	var txRecords []database.TransactionRecord
+	if err := dbtx.Read().Where("coin=?", w.CoinType.CurrencyCode()).Find(&txRecords).Error; err != nil {
+		return err
+	}
+	for _, rec := range txRecords {
+		tx, err := rec.Transaction()
+		if err != nil {
+			return err
+		}
+		sent := false
+		for _, from := range tx.From {
+			if own(from.Address.String()) {
+				sent = true
+				break
+			}
+		}
+		if !sent {
+			continue
+		}
+		for _, to := range tx.To {
+			if targets[to.Address.String()] && !own(to.Address.String()) {
+				return ErrAddressReused
+			}
+		}
+	}
+
+	// Transactions which were just broadcast may not have been returned
+	// by the chain client yet so their outputs are checked too.
+	var scripts [][]byte
+	for addr := range targets {
+		if own(addr) {
+			continue
+		}
+		script, err := w.Chain.AddressToScript(addr)
+		if err != nil {
+			return err
+		}
+		scripts = append(scripts, script)
+	}
+	var unconfirmed []database.UnconfirmedTransaction
+	if err := dbtx.Read().Where("coin=?", w.CoinType.CurrencyCode()).Find(&unconfirmed).Error; err != nil {
+		return err
+	}
+	for _, rec := range unconfirmed {
+		var tx wire.MsgTx
+		if err := tx.BtcDecode(bytes.NewReader(rec.TxBytes), wire.ProtocolVersion, wire.WitnessEncoding); err != nil {
+			return err
+		}
+		for _, out := range tx.TxOut {
+			for _, script := range scripts {
+				if bytes.Equal(out.PkScript, script) {
+					return ErrAddressReused
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// markOutputsUsed marks the wallet's addresses paid by the transaction as
+// used so that they are not handed out again before the chain client
+// reports the transaction.
+func (w *Wallet) markOutputsUsed(dbtx database.Tx, tx *wire.MsgTx) error {
+	index := w.Keychain.AddressIndex()
+	if index.IndexesScripts() {
+		if err := w.Keychain.SyncAddressIndex(dbtx); err != nil {
+			return err
+		}
+		for _, out := range tx.TxOut {
+			addr, ok := index.AddressForScript(out.PkScript)
+			if !ok {
+				continue
+			}
+			if err := w.Keychain.MarkAddressAsUsed(dbtx, addr); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var records []database.AddressRecord
+	if err := dbtx.Read().Where("coin=?", w.CoinType.CurrencyCode()).Where("used=?", false).Find(&records).Error; err != nil {
+		return err
+	}
+	for _, rec := range records {
+		script, err := w.Chain.AddressToScript(rec.Addr)
+		if err != nil {
+			continue
+		}
+		for _, out := range tx.TxOut {
+			if bytes.Equal(out.PkScript, script) {
+				if err := w.Keychain.MarkAddressAsUsed(dbtx, iwallet.NewAddress(rec.Addr, w.CoinType)); err != nil {
+					return err
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package utxobase
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"gorm.io/gorm"
+)
+
+// checkDestinations checks the addresses paid by the outputs against the
+// wallet's address policy.
+func (w *Wallet) checkDestinations(outputs []Output) error {
+	var addrs []iwallet.Address
+	for _, out := range outputs {
+		if out.Data == nil {
+			addrs = append(addrs, out.Address)
+		}
+	}
+	return w.CheckDestinations(addrs...)
+}
+
+// checkSpendPolicy returns base.ErrSpendLimitExceeded if the transaction
+// spends more than the wallet's SpendPolicy allows.
+func (w *Wallet) checkSpendPolicy(ctx context.Context, tx *wire.MsgTx) error {
+	if !w.SpendPolicy.Enabled() {
+		return nil
+	}
+	return w.DB.View(func(dbtx database.Tx) error {
+		dbtx = base.ContextTx(ctx, dbtx)
+		amount, err := w.spentAmount(dbtx, tx)
+		if err != nil {
+			return err
+		}
+		return w.CheckSpendPolicy(dbtx, amount)
+	})
+}
+
+// spentAmount returns how much the transaction sends out of the wallet,
+// including the fee. It's the value of the wallet's utxos it spends less
+// the outputs paying the wallet's own addresses.
+func (w *Wallet) spentAmount(dbtx database.Tx, tx *wire.MsgTx) (iwallet.Amount, error) {
+	spent := iwallet.NewAmount(0)
+	for _, in := range tx.TxIn {
+		var utxo database.UtxoRecord
+		err := dbtx.Read().Where("coin=?", w.CoinType.CurrencyCode()).Where("outpoint=?", hex.EncodeToString(SerializeOutpoint(&in.PreviousOutPoint))).First(&utxo).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			continue
+		} else if err != nil {
+			return iwallet.Amount{}, err
+		}
+		spent = spent.Add(iwallet.NewAmount(utxo.Amount))
+	}
+
+	own, err := w.ownScripts(dbtx)
+	if err != nil {
+		return iwallet.Amount{}, err
+	}
+	for _, out := range tx.TxOut {
+		if own(out.PkScript) {
+			spent = spent.Sub(iwallet.NewAmount(out.Value))
+		}
+	}
+	if spent.Cmp(iwallet.NewAmount(0)) < 0 {
+		return iwallet.NewAmount(0), nil
+	}
+	return spent, nil
+}
+
+// ownScripts returns a function reporting whether an output script pays one
+// of the wallet's addresses. The keychain's address index is used if it
+// indexes scripts, otherwise the script of every address is worked out.
+func (w *Wallet) ownScripts(dbtx database.Tx) (func(script []byte) bool, error) {
+	index := w.Keychain.AddressIndex()
+	if index.IndexesScripts() {
+		if err := w.Keychain.SyncAddressIndex(dbtx); err != nil {
+			return nil, err
+		}
+		return func(script []byte) bool {
+			_, ok := index.AddressForScript(script)
+			return ok
+		}, nil
+	}
+
+	var records []database.AddressRecord
+	if err := dbtx.Read().Where("coin=?", w.CoinType.CurrencyCode()).Find(&records).Error; err != nil {
+		return nil, err
+	}
+	own := make(map[string]bool)
+	for _, rec := range records {
+		script, err := w.Chain.AddressToScript(rec.Addr)
+		if err != nil {
+			continue
+		}
+		own[string(script)] = true
+	}
+	return func(script []byte) bool {
+		return own[string(script)]
+	}, nil
+}
@@ -0,0 +1,869 @@
+// Package utxobase implements the parts of a wallet which are shared by
+// bitcoin derived UTXO coins. A coin embeds Wallet and provides a Chain
+// describing how it encodes addresses, signs inputs and serializes
+// transactions. Transactions are built using the btcd wire types. Coins
+// whose own libraries use different types convert inside their hooks.
+package utxobase
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/coinset"
+	hd "github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/btcsuite/btcutil/txsort"
+	"github.com/btcsuite/btcwallet/wallet/txrules"
+	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"time"
+)
+
+// Chain holds the coin specific functions used by Wallet. The functions
+// should capture the network parameters the coin is running on.
+type Chain struct {
+	// AddressToScript returns the output script for the encoded address.
+	AddressToScript func(addr string) ([]byte, error)
+
+	// SignTx signs every input of the transaction. The previous output
+	// scripts, values and keys are indexed by outpoint.
+	SignTx func(tx *wire.MsgTx, prevScripts map[wire.OutPoint][]byte, values map[wire.OutPoint]int64, keys map[wire.OutPoint]*btcec.PrivateKey) error
+
+	// Serialize returns the encoding of the transaction that is broadcast.
+	Serialize func(tx *wire.MsgTx) ([]byte, error)
+
+	// EstimateSize returns the size, in the unit the fee rate is quoted
+	// in, of a signed transaction spending outputs with the given scripts.
+	// A nil script is an input that has not yet been selected and should
+	// be estimated as the coin's most common input type.
+	EstimateSize func(prevScripts [][]byte, outputs []*wire.TxOut, addChange bool) int
+
+	// ChangeScriptSize is the size of the change script used when
+	// deciding whether the change would be dust.
+	ChangeScriptSize int
+
+	// EstimationAddress is the address paid to when estimating fees.
+	// A long address should be used so as not to under estimate.
+	EstimationAddress string
+
+	// Replaceable sets the sequence of every input so the transaction
+	// signals BIP 125 replaceability.
+	Replaceable bool
+
+	// ScriptHashAddress returns the encoded P2SH address of a redeem
+	// script. It's only needed by coins which support HTLCs.
+	ScriptHashAddress func(script []byte) (string, error)
+
+	// SignScriptInput returns the signature, with the sighash type
+	// appended, of input idx spending a P2SH output of the given amount
+	// with the redeem script.
+	SignScriptInput func(tx *wire.MsgTx, idx int, script []byte, amount int64, key *btcec.PrivateKey) ([]byte, error)
+}
+
+// MaxRBFSequence is the highest input sequence number which signals BIP 125
+// replaceability while still allowing the transaction's lock time.
+const MaxRBFSequence = wire.MaxTxInSequenceNum - 2
+
+// Wallet extends WalletBase with spending for UTXO coins.
+type Wallet struct {
+	base.WalletBase
+	Chain       *Chain
+	FeeProvider base.FeeProvider
+
+	// ChangePolicy selects where change is sent. ChangeAddress is the
+	// address used by base.ChangeFixedAddress.
+	ChangePolicy  base.ChangePolicy
+	ChangeAddress string
+
+	// PreventAddressReuse refuses to pay an address the wallet has
+	// already paid unless the output sets AllowReuse. The wallet's own
+	// addresses paid by a transaction are marked as used as soon as it
+	// is committed.
+	PreventAddressReuse bool
+
+	// DeterministicBuilds makes the transaction built for a spend depend
+	// only on the wallet's state, the outputs and the fee rate. Coins are
+	// selected in outpoint order and the change output is always last.
+	// See BuildUnsignedTx.
+	DeterministicBuilds bool
+
+	// SeparateSources pays each spend from the coins of a single source
+	// so funds from different sources aren't spent together. Coins
+	// without a source are a source of their own. Spends of selected
+	// utxos and sweeps spend what they're given. See base.UtxoSource.
+	SeparateSources bool
+
+	// Hold, if set, is given each signed transaction in place of saving
+	// and broadcasting it. It's used by wallets whose transactions need
+	// another party's signatures first. Hold should call CommitTx once
+	// the transaction is complete.
+	Hold func(wtx iwallet.Tx, tx *wire.MsgTx) (iwallet.TransactionID, error)
+}
+
+// ValidateAddress validates that the serialization of the address is correct
+// for this coin and network. It returns an error if it isn't.
+func (w *Wallet) ValidateAddress(addr iwallet.Address) error {
+	_, err := w.Chain.AddressToScript(addr.String())
+	return err
+}
+
+// IsDust returns whether the amount passed in is considered dust by network.
+func (w *Wallet) IsDust(amount iwallet.Amount) bool {
+	return txrules.IsDustAmount(btcutil.Amount(amount.Int64()), 25, txrules.DefaultRelayFeePerKb)
+}
+
+// EstimateSpendFee returns the anticipated fee to transfer a given amount of
+// coins out of the wallet at the provided fee level.
+func (w *Wallet) EstimateSpendFee(amount iwallet.Amount, feeLevel iwallet.FeeLevel) (iwallet.Amount, error) {
+	amt := iwallet.NewAmount(0)
+	err := w.DB.Update(func(dbtx database.Tx) error {
+		tx, err := w.BuildTx(dbtx, amount.Int64(), iwallet.NewAddress(w.Chain.EstimationAddress, w.CoinType), feeLevel)
+		if err != nil {
+			return err
+		}
+		var outval int64
+		for _, output := range tx.TxOut {
+			outval += output.Value
+		}
+		var utxoRecords []database.UtxoRecord
+		err = dbtx.Read().Where("coin = ?", w.CoinType.CurrencyCode()).Find(&utxoRecords).Error
+		if err != nil {
+			return err
+		}
+
+		var inval int64
+		for _, input := range tx.TxIn {
+			for _, utxo := range utxoRecords {
+				ser, err := hex.DecodeString(utxo.Outpoint)
+				if err != nil {
+					return err
+				}
+				op, err := DeserializeOutpoint(ser)
+				if err != nil {
+					return err
+				}
+
+				if *op == input.PreviousOutPoint {
+					inval += iwallet.NewAmount(utxo.Amount).Int64()
+					break
+				}
+			}
+		}
+		if inval < outval {
+			return errors.New("error building transaction: inputs less than outputs")
+		}
+		amt = iwallet.NewAmount(inval - outval)
+		return nil
+	})
+	return amt, err
+}
+
+// Output is a payment to an address.
+type Output struct {
+	Address iwallet.Address
+	Amount  iwallet.Amount
+
+	// SubtractFee pays the transaction fee out of this output rather
+	// than from the wallet's other coins, so that exactly Amount leaves
+	// the wallet. This is used to send an exact utxo or the whole
+	// balance. Only one output may set it.
+	SubtractFee bool
+
+	// AllowReuse permits paying an address the wallet has paid before
+	// when PreventAddressReuse is enabled.
+	AllowReuse bool
+
+	// Data, if set, makes this a zero value OP_RETURN output carrying
+	// it. Address and Amount are ignored.
+	Data []byte
+}
+
+// Spend builds and signs a transaction sending amt to the address. The
+// transaction is saved and broadcast when wtx is committed.
+func (w *Wallet) Spend(wtx iwallet.Tx, to iwallet.Address, amt iwallet.Amount, feeLevel iwallet.FeeLevel) (iwallet.TransactionID, error) {
+	return w.SpendContext(context.Background(), wtx, to, amt, feeLevel)
+}
+
+// SpendContext is like Spend but stops reading the wallet's coins when ctx
+// is done. Begin wtx with BeginContext for the commit to be bound to ctx
+// too.
+func (w *Wallet) SpendContext(ctx context.Context, wtx iwallet.Tx, to iwallet.Address, amt iwallet.Amount, feeLevel iwallet.FeeLevel) (iwallet.TransactionID, error) {
+	return w.SpendMultiContext(ctx, wtx, []Output{{Address: to, Amount: amt}}, feeLevel)
+}
+
+// SpendMulti builds and signs a single transaction paying each of the
+// outputs. Batching payments this way is cheaper than sending them one at a
+// time as the inputs and change are shared. The transaction is saved and
+// broadcast when wtx is committed.
+func (w *Wallet) SpendMulti(wtx iwallet.Tx, outputs []Output, feeLevel iwallet.FeeLevel) (iwallet.TransactionID, error) {
+	return w.SpendMultiContext(context.Background(), wtx, outputs, feeLevel)
+}
+
+// SpendMultiContext is like SpendMulti but stops reading the wallet's
+// coins when ctx is done.
+func (w *Wallet) SpendMultiContext(ctx context.Context, wtx iwallet.Tx, outputs []Output, feeLevel iwallet.FeeLevel) (iwallet.TransactionID, error) {
+	if err := w.checkDestinations(outputs); err != nil {
+		return "", err
+	}
+	var tx *wire.MsgTx
+	err := w.DB.View(func(dbtx database.Tx) error {
+		dbtx = base.ContextTx(ctx, dbtx)
+		coinKeyMap, err := w.GatherCoins(dbtx)
+		if err != nil {
+			return err
+		}
+		tx, err = w.buildTx(dbtx, coinKeyMap, false, outputs, 0, feeLevel, nil)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return w.broadcastOnCommitContext(ctx, wtx, tx)
+}
+
+// SpendWithLockTime is SpendMulti for a transaction which cannot be mined
+// until lockTime. The lock time is a block height if it is below
+// base.LockTimeThreshold and a unix timestamp otherwise. If it is not yet
+// final the transaction is saved when wtx is committed but is not broadcast
+// until the lock time passes. Until then it is listed by
+// PendingTransactions.
+func (w *Wallet) SpendWithLockTime(wtx iwallet.Tx, outputs []Output, lockTime uint32, feeLevel iwallet.FeeLevel) (iwallet.TransactionID, error) {
+	if err := w.checkDestinations(outputs); err != nil {
+		return "", err
+	}
+	var tx *wire.MsgTx
+	err := w.DB.View(func(dbtx database.Tx) error {
+		coinKeyMap, err := w.GatherCoins(dbtx)
+		if err != nil {
+			return err
+		}
+		tx, err = w.buildTx(dbtx, coinKeyMap, false, outputs, lockTime, feeLevel, nil)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return w.broadcastOnCommit(wtx, tx)
+}
+
+// SweepWallet sweeps the full balance of the wallet to the requested
+// address. The fee is subtracted from the amount sent.
+func (w *Wallet) SweepWallet(wtx iwallet.Tx, to iwallet.Address, level iwallet.FeeLevel) (iwallet.TransactionID, error) {
+	return w.SweepWalletContext(context.Background(), wtx, to, level)
+}
+
+// SweepWalletContext is like SweepWallet but stops reading the wallet's
+// coins when ctx is done.
+func (w *Wallet) SweepWalletContext(ctx context.Context, wtx iwallet.Tx, to iwallet.Address, level iwallet.FeeLevel) (iwallet.TransactionID, error) {
+	if err := w.CheckDestinations(to); err != nil {
+		return "", err
+	}
+	var tx *wire.MsgTx
+	err := w.DB.Update(func(dbtx database.Tx) error {
+		dbtx = base.ContextTx(ctx, dbtx)
+		var (
+			totalIn     int64
+			keys        = make(map[wire.OutPoint]*btcec.PrivateKey)
+			prevScripts = make(map[wire.OutPoint][]byte)
+			inVals      = make(map[wire.OutPoint]int64)
+			scripts     [][]byte
+		)
+		tx = wire.NewMsgTx(1)
+
+		coinMap, err := w.GatherCoins(dbtx)
+		if err != nil {
+			return err
+		}
+		defer base.ZeroCoinKeys(coinMap)
+		defer zeroKeys(keys)
+
+		for coin, key := range coinMap {
+			op, script, priv, err := w.prepareInput(coin, key)
+			if err != nil {
+				return err
+			}
+			tx.AddTxIn(w.newTxIn(op))
+			totalIn += int64(coin.Value())
+			inVals[*op] = int64(coin.Value())
+			keys[*op] = priv
+			prevScripts[*op] = script
+			scripts = append(scripts, script)
+		}
+
+		script, err := w.Chain.AddressToScript(to.String())
+		if err != nil {
+			return err
+		}
+		tx.AddTxOut(wire.NewTxOut(0, script))
+
+		size := w.Chain.EstimateSize(scripts, tx.TxOut, false)
+		fpb, err := w.FeeProvider.GetFee(level)
+		if err != nil {
+			return err
+		}
+		fee := fpb.Mul(iwallet.NewAmount(size)).Int64()
+
+		tx.TxOut[0].Value = totalIn - fee
+
+		// BIP 69 sorting
+		txsort.InPlaceSort(tx)
+
+		if err := w.Chain.SignTx(tx, prevScripts, inVals, keys); err != nil {
+			return errors.New("failed to sign transaction")
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return w.broadcastOnCommitContext(ctx, wtx, tx)
+}
+
+// SpendFrom builds and signs a transaction paying the outputs using only the
+// selected utxos. Every selected utxo is spent and any remainder is returned
+// as change. The outpoints are in the serialized format used by
+// iwallet.SpendInfo.ID. The transaction is saved and broadcast when wtx is
+// committed.
+func (w *Wallet) SpendFrom(wtx iwallet.Tx, outpoints [][]byte, outputs []Output, feeLevel iwallet.FeeLevel) (iwallet.TransactionID, error) {
+	if len(outpoints) == 0 {
+		return "", errors.New("no utxos selected")
+	}
+	if err := w.checkDestinations(outputs); err != nil {
+		return "", err
+	}
+	var tx *wire.MsgTx
+	err := w.DB.View(func(dbtx database.Tx) error {
+		coinKeyMap, err := w.GatherSelectedCoins(dbtx, outpoints)
+		if err != nil {
+			return err
+		}
+		tx, err = w.buildTx(dbtx, coinKeyMap, true, outputs, 0, feeLevel, nil)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return w.broadcastOnCommit(wtx, tx)
+}
+
+// BuildTx selects coins, adds change if needed, and returns a signed
+// transaction paying amount to the address.
+func (w *Wallet) BuildTx(dbtx database.Tx, amount int64, iaddr iwallet.Address, feeLevel iwallet.FeeLevel) (*wire.MsgTx, error) {
+	coinKeyMap, err := w.GatherCoins(dbtx)
+	if err != nil {
+		return nil, err
+	}
+	return w.buildTx(dbtx, coinKeyMap, false, []Output{{Address: iaddr, Amount: iwallet.NewAmount(amount)}}, 0, feeLevel, nil)
+}
+
+// buildTx builds the transaction paying the outputs from the given coins. If
+// spendAll is set every coin is used as an input, otherwise coins are
+// selected to cover the outputs and fee. Change is sent according to the
+// wallet's ChangePolicy. A non-zero lockTime is set as the
+// transaction's nLockTime. If prepare is set it's called with the sorted
+// transaction and input keys before signing and may change the outputs so
+// long as their sizes are unchanged. The coin keys are zeroed before
+// returning.
+func (w *Wallet) buildTx(dbtx database.Tx, coinKeyMap map[coinset.Coin]*hd.ExtendedKey, spendAll bool, outputs []Output, lockTime uint32, feeLevel iwallet.FeeLevel, prepare func(tx *wire.MsgTx, keys map[wire.OutPoint]*btcec.PrivateKey) error) (*wire.MsgTx, error) {
+	// Zero the private keys once the transaction has been signed.
+	defer base.ZeroCoinKeys(coinKeyMap)
+
+	if len(outputs) == 0 {
+		return nil, errors.New("no outputs")
+	}
+	if w.PreventAddressReuse {
+		if err := w.checkAddressReuse(dbtx, outputs); err != nil {
+			return nil, err
+		}
+	}
+	subtractIdx := -1
+	txOuts := make([]*wire.TxOut, 0, len(outputs))
+	for i, out := range outputs {
+		if out.SubtractFee {
+			if subtractIdx >= 0 {
+				return nil, errors.New("fee can only be subtracted from one output")
+			}
+			subtractIdx = i
+		}
+		if out.Data != nil {
+			if out.SubtractFee {
+				return nil, errors.New("fee can't be subtracted from a data output")
+			}
+			script, err := txscript.NullDataScript(out.Data)
+			if err != nil {
+				return nil, err
+			}
+			txOuts = append(txOuts, wire.NewTxOut(0, script))
+			continue
+		}
+		// Check for dust
+		script, err := w.Chain.AddressToScript(out.Address.String())
+		if err != nil {
+			return nil, err
+		}
+		if txrules.IsDustAmount(btcutil.Amount(out.Amount.Int64()), len(script), txrules.DefaultRelayFeePerKb) {
+			return nil, errors.New("dust output amount")
+		}
+		txOuts = append(txOuts, wire.NewTxOut(out.Amount.Int64(), script))
+	}
+
+	var (
+		keys        = make(map[wire.OutPoint]*btcec.PrivateKey)
+		prevScripts = make(map[wire.OutPoint][]byte)
+		inVals      = make(map[wire.OutPoint]int64)
+	)
+	defer zeroKeys(keys)
+
+	allCoins := make([]coinset.Coin, 0, len(coinKeyMap))
+	for coin := range coinKeyMap {
+		allCoins = append(allCoins, coin)
+	}
+	if w.DeterministicBuilds {
+		sortCoins(allCoins)
+	}
+	// Coins are selected from one group. Unless SeparateSources is set
+	// that's all of them.
+	groups := [][]coinset.Coin{allCoins}
+	if w.SeparateSources {
+		groups = sourceGroups(allCoins)
+	}
+	// largest is the biggest selected coin. Its address receives the
+	// change under base.ChangeReuseSource.
+	var largest coinset.Coin
+	inputSource := func(target btcutil.Amount) (btcutil.Amount, []*wire.TxIn, [][]byte, error) {
+		selected := allCoins
+		if !spendAll {
+			coinSelector := coinset.MaxValueAgeCoinSelector{MaxInputs: 10000, MinChangeAmount: txrules.DefaultRelayFeePerKb}
+			found := false
+			for _, group := range groups {
+				coins, err := coinSelector.CoinSelect(target, group)
+				if err == nil {
+					selected, found = coins.Coins(), true
+					break
+				}
+			}
+			if !found {
+				if len(groups) > 1 {
+					if _, err := coinSelector.CoinSelect(target, allCoins); err == nil {
+						return 0, nil, nil, ErrMixedSources
+					}
+				}
+				return 0, nil, nil, base.ErrInsufficientFunds
+			}
+		}
+		var (
+			total   btcutil.Amount
+			inputs  []*wire.TxIn
+			scripts [][]byte
+		)
+		largest = nil
+		for _, c := range selected {
+			op, script, priv, err := w.prepareInput(c, coinKeyMap[c])
+			if err != nil {
+				return 0, nil, nil, err
+			}
+			total += c.Value()
+			inputs = append(inputs, w.newTxIn(op))
+			keys[*op] = priv
+			prevScripts[*op] = script
+			inVals[*op] = int64(c.Value())
+			scripts = append(scripts, script)
+			if largest == nil || c.Value() > largest.Value() {
+				largest = c
+			}
+		}
+		return total, inputs, scripts, nil
+	}
+
+	// Get the fee per kilobyte
+	fpb, err := w.FeeProvider.GetFee(feeLevel)
+	if err != nil {
+		return nil, err
+	}
+	feePerKB := btcutil.Amount(fpb.Int64() * 1000)
+
+	changeSource := func() ([]byte, error) {
+		return w.changeScript(dbtx, largest)
+	}
+
+	var tx *wire.MsgTx
+	changeless := false
+	if w.ChangePolicy == base.ChangeAvoid && subtractIdx < 0 && !spendAll {
+		for _, group := range groups {
+			coins, err := w.selectChangeless(group, txOuts, feePerKB)
+			if err != nil {
+				return nil, err
+			}
+			if coins != nil {
+				allCoins, spendAll, changeless = coins, true, true
+				break
+			}
+		}
+	}
+	if changeless {
+		_, inputs, _, err := inputSource(0)
+		if err != nil {
+			return nil, err
+		}
+		tx = &wire.MsgTx{
+			Version: wire.TxVersion,
+			TxIn:    inputs,
+			TxOut:   txOuts,
+		}
+	} else if subtractIdx >= 0 {
+		tx, err = w.newUnsignedTransactionSubtractFee(txOuts, subtractIdx, feePerKB, inputSource, changeSource)
+	} else {
+		tx, err = w.newUnsignedTransaction(txOuts, feePerKB, inputSource, changeSource)
+	}
+	if errors.Is(err, base.ErrInsufficientFunds) {
+		limited, lerr := w.HasAncestorLimitedCoins(dbtx)
+		if lerr != nil {
+			return nil, lerr
+		}
+		if limited {
+			return nil, base.ErrTooManyUnconfirmedAncestors
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Each input may be within the ancestor limit on its own but not
+	// when combined.
+	parents := make([]iwallet.TransactionID, 0, len(tx.TxIn))
+	for _, in := range tx.TxIn {
+		parents = append(parents, iwallet.TransactionID(in.PreviousOutPoint.Hash.String()))
+	}
+	ancestors, err := w.UnconfirmedAncestors(dbtx, parents)
+	if err != nil {
+		return nil, err
+	}
+	if ancestors+1 > base.MaxUnconfirmedAncestors {
+		return nil, base.ErrTooManyUnconfirmedAncestors
+	}
+
+	if lockTime > 0 {
+		tx.LockTime = lockTime
+		// The lock time is ignored if every input is final.
+		for _, in := range tx.TxIn {
+			if in.Sequence == wire.MaxTxInSequenceNum {
+				in.Sequence = wire.MaxTxInSequenceNum - 1
+			}
+		}
+	}
+
+	// BIP 69 sorting
+	if w.DeterministicBuilds {
+		canonicalSort(tx, len(tx.TxOut) > len(txOuts))
+	} else {
+		txsort.InPlaceSort(tx)
+	}
+
+	if prepare != nil {
+		if err := prepare(tx, keys); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := w.Chain.SignTx(tx, prevScripts, inVals, keys); err != nil {
+		return nil, fmt.Errorf("failed to sign transaction: %s", err)
+	}
+	return tx, nil
+}
+
+// newUnsignedTransaction follows the algorithm used by btcwallet's txauthor
+// but delegates size estimation to the chain. Inputs are fetched until they
+// cover the outputs plus the fee for the estimated size. A change output is
+// added if the remainder is not dust.
+func (w *Wallet) newUnsignedTransaction(outputs []*wire.TxOut, feePerKB btcutil.Amount,
+	fetchInputs func(target btcutil.Amount) (btcutil.Amount, []*wire.TxIn, [][]byte, error),
+	fetchChange func() ([]byte, error)) (*wire.MsgTx, error) {
+
+	var targetAmount btcutil.Amount
+	for _, out := range outputs {
+		targetAmount += btcutil.Amount(out.Value)
+	}
+	estimatedSize := w.Chain.EstimateSize([][]byte{nil}, outputs, true)
+	targetFee := txrules.FeeForSerializeSize(feePerKB, estimatedSize)
+
+	for {
+		inputAmount, inputs, scripts, err := fetchInputs(targetAmount + targetFee)
+		if err != nil {
+			return nil, err
+		}
+		if inputAmount < targetAmount+targetFee {
+			return nil, base.ErrInsufficientFunds
+		}
+
+		maxSignedSize := w.Chain.EstimateSize(scripts, outputs, true)
+		maxRequiredFee := txrules.FeeForSerializeSize(feePerKB, maxSignedSize)
+		if inputAmount-targetAmount < maxRequiredFee {
+			targetFee = maxRequiredFee
+			continue
+		}
+
+		tx := &wire.MsgTx{
+			Version: wire.TxVersion,
+			TxIn:    inputs,
+			TxOut:   outputs,
+		}
+		changeAmount := inputAmount - targetAmount - maxRequiredFee
+		if changeAmount != 0 && !txrules.IsDustAmount(changeAmount, w.Chain.ChangeScriptSize, txrules.DefaultRelayFeePerKb) {
+			changeScript, err := fetchChange()
+			if err != nil {
+				return nil, err
+			}
+			// The change policy may use a script of a different
+			// size than the one assumed above.
+			l := len(outputs)
+			change := wire.NewTxOut(0, changeScript)
+			withChange := append(outputs[:l:l], change)
+			changeAmount = inputAmount - targetAmount - txrules.FeeForSerializeSize(feePerKB, w.Chain.EstimateSize(scripts, withChange, false))
+			if changeAmount > 0 && !txrules.IsDustAmount(changeAmount, len(changeScript), txrules.DefaultRelayFeePerKb) {
+				change.Value = int64(changeAmount)
+				tx.TxOut = withChange
+			}
+		}
+		return tx, nil
+	}
+}
+
+// newTxIn returns an unsigned input spending op.
+func (w *Wallet) newTxIn(op *wire.OutPoint) *wire.TxIn {
+	in := wire.NewTxIn(op, nil, nil)
+	if w.Chain.Replaceable {
+		in.Sequence = MaxRBFSequence
+	}
+	return in
+}
+
+// ErrFeeExceedsOutput is returned when the fee subtracted from an output
+// would leave it as dust.
+var ErrFeeExceedsOutput = errors.New("output is too small to pay the fee")
+
+// newUnsignedTransactionSubtractFee is newUnsignedTransaction for when the
+// fee is paid by the output at subtractIdx. Inputs only need to cover the
+// outputs. If the change would be dust it is added to the output paying the
+// fee rather than being lost to the miner.
+func (w *Wallet) newUnsignedTransactionSubtractFee(outputs []*wire.TxOut, subtractIdx int, feePerKB btcutil.Amount,
+	fetchInputs func(target btcutil.Amount) (btcutil.Amount, []*wire.TxIn, [][]byte, error),
+	fetchChange func() ([]byte, error)) (*wire.MsgTx, error) {
+
+	var targetAmount btcutil.Amount
+	for _, out := range outputs {
+		targetAmount += btcutil.Amount(out.Value)
+	}
+	inputAmount, inputs, scripts, err := fetchInputs(targetAmount)
+	if err != nil {
+		return nil, err
+	}
+	if inputAmount < targetAmount {
+		return nil, base.ErrInsufficientFunds
+	}
+
+	changeAmount := inputAmount - targetAmount
+	txOuts := outputs
+	addChange := changeAmount != 0 && !txrules.IsDustAmount(changeAmount, w.Chain.ChangeScriptSize, txrules.DefaultRelayFeePerKb)
+	if addChange {
+		changeScript, err := fetchChange()
+		if err != nil {
+			return nil, err
+		}
+		l := len(outputs)
+		txOuts = append(outputs[:l:l], wire.NewTxOut(int64(changeAmount), changeScript))
+	}
+	fee := txrules.FeeForSerializeSize(feePerKB, w.Chain.EstimateSize(scripts, txOuts, false))
+
+	payer := outputs[subtractIdx]
+	payer.Value -= int64(fee)
+	if !addChange {
+		payer.Value += int64(changeAmount)
+	}
+	if payer.Value <= 0 || txrules.IsDustAmount(btcutil.Amount(payer.Value), len(payer.PkScript), txrules.DefaultRelayFeePerKb) {
+		return nil, ErrFeeExceedsOutput
+	}
+
+	return &wire.MsgTx{
+		Version: wire.TxVersion,
+		TxIn:    inputs,
+		TxOut:   txOuts,
+	}, nil
+}
+
+// prepareInput returns the outpoint, previous output script and private key
+// for the coin. The coin's PkScript holds the encoded address. Watch-only
+// wallets have public keys so the private key is nil and Chain.SignTx must
+// sign with the wallet's Signer.
+func (w *Wallet) prepareInput(c coinset.Coin, key *hd.ExtendedKey) (*wire.OutPoint, []byte, *btcec.PrivateKey, error) {
+	h, err := chainhash.NewHashFromStr(c.Hash().String())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	op := wire.NewOutPoint(h, c.Index())
+
+	script, err := w.Chain.AddressToScript(string(c.PkScript()))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if !key.IsPrivate() {
+		return op, script, nil, nil
+	}
+	priv, err := key.ECPrivKey()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return op, script, priv, nil
+}
+
+// broadcastOnCommit passes the signed transaction to Hold if it's set and
+// otherwise checks it against the SpendPolicy and commits it with CommitTx.
+func (w *Wallet) broadcastOnCommit(wtx iwallet.Tx, tx *wire.MsgTx) (iwallet.TransactionID, error) {
+	return w.broadcastOnCommitContext(context.Background(), wtx, tx)
+}
+
+// broadcastOnCommitContext is broadcastOnCommit with the SpendPolicy check
+// bound to ctx.
+func (w *Wallet) broadcastOnCommitContext(ctx context.Context, wtx iwallet.Tx, tx *wire.MsgTx) (iwallet.TransactionID, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	if w.Hold != nil {
+		return w.Hold(wtx, tx)
+	}
+	if err := w.checkSpendPolicy(ctx, tx); err != nil {
+		return "", err
+	}
+	return w.CommitTx(wtx, tx)
+}
+
+// SendSigned is used by coins which build and sign a transaction
+// themselves. Like the transactions built by SpendMulti it's passed to Hold,
+// or checked against the SpendPolicy, and saved and broadcast when wtx is
+// committed.
+func (w *Wallet) SendSigned(wtx iwallet.Tx, tx *wire.MsgTx) (iwallet.TransactionID, error) {
+	return w.broadcastOnCommit(wtx, tx)
+}
+
+// CommitTx sets the commit hook on wtx to save the transaction as
+// unconfirmed and broadcast it. Transactions whose lock time is not yet final,
+// or whose broadcast fails, are left queued for the rebroadcaster. If wtx was
+// begun with BeginContext the save is bound to its context and the
+// transaction is only broadcast once saved.
+func (w *Wallet) CommitTx(wtx iwallet.Tx, tx *wire.MsgTx) (iwallet.TransactionID, error) {
+	txid := iwallet.TransactionID(tx.TxHash().String())
+	ser, err := w.Chain.Serialize(tx)
+	if err != nil {
+		return txid, err
+	}
+
+	wbtx, ok := wtx.(*base.DBTx)
+	if !ok {
+		return txid, errors.New("tx is not expected type")
+	}
+
+	inputs := make([][]byte, 0, len(tx.TxIn))
+	for _, in := range tx.TxIn {
+		inputs = append(inputs, SerializeOutpoint(&in.PreviousOutPoint))
+	}
+
+	wbtx.OnCommit = func() error {
+		final := true
+		err := w.DB.Update(func(dbtx database.Tx) error {
+			dbtx = base.ContextTx(wbtx.Context(), dbtx)
+			err := dbtx.Save(&database.UnconfirmedTransaction{
+				Timestamp: time.Now(),
+				Coin:      w.CoinType,
+				TxBytes:   ser,
+				Txid:      txid.String(),
+				LockTime:  tx.LockTime,
+				Inputs:    base.JoinOutpoints(inputs),
+			})
+			if err != nil {
+				return err
+			}
+			if w.PreventAddressReuse {
+				if err := w.markOutputsUsed(dbtx, tx); err != nil {
+					return err
+				}
+			}
+			if w.SpendPolicy.Enabled() {
+				amount, err := w.spentAmount(dbtx, tx)
+				if err != nil {
+					return err
+				}
+				if err := w.RecordSpend(dbtx, txid, amount); err != nil {
+					return err
+				}
+			}
+			if tx.LockTime > 0 {
+				best, err := w.BlockchainInfo()
+				if err != nil {
+					return err
+				}
+				final = base.IsLockTimeFinal(tx.LockTime, best)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if final {
+			w.BroadcastOrQueue(txid, ser)
+		}
+		return nil
+	}
+	return txid, nil
+}
+
+// SerializeWitness encodes the transaction with witness data.
+func SerializeWitness(tx *wire.MsgTx) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := tx.BtcEncode(&buf, wire.ProtocolVersion, wire.WitnessEncoding); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// SerializeBase encodes the transaction without witness data.
+func SerializeBase(tx *wire.MsgTx) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := tx.BtcEncode(&buf, wire.ProtocolVersion, wire.BaseEncoding); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DeserializeOutpoint decodes the outpoint format used by the database:
+// the 32 byte hash followed by the little endian index.
+func DeserializeOutpoint(ser []byte) (*wire.OutPoint, error) {
+	if len(ser) != 36 {
+		return nil, errors.New("invalid outpoint length")
+	}
+	h, err := chainhash.NewHash(ser[:32])
+	if err != nil {
+		return nil, err
+	}
+	return wire.NewOutPoint(h, binary.LittleEndian.Uint32(ser[32:])), nil
+}
+
+// SerializeOutpoint encodes the outpoint in the database format.
+func SerializeOutpoint(op *wire.OutPoint) []byte {
+	i := make([]byte, 4)
+	binary.LittleEndian.PutUint32(i, op.Index)
+	return append(op.Hash[:], i...)
+}
+
+func zeroKeys(keys map[wire.OutPoint]*btcec.PrivateKey) {
+	for _, key := range keys {
+		base.ZeroPrivKey(key)
+	}
+}
@@ -0,0 +1,228 @@
+package utxobase
+
+import (
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/coinset"
+	"github.com/cpacia/multiwallet/base"
+	"testing"
+)
+
+func newTestChain() *Chain {
+	return &Chain{
+		EstimateSize: func(prevScripts [][]byte, outputs []*wire.TxOut, addChange bool) int {
+			size := 10 + len(prevScripts)*100 + len(outputs)*30
+			if addChange {
+				size += 30
+			}
+			return size
+		},
+		ChangeScriptSize: 22,
+	}
+}
+
+func TestOutpointSerialization(t *testing.T) {
+	h, err := chainhash.NewHashFromStr("a8c685478265f4c14dada651969c45a65e1aeb8cd6791f2f5bb6a1d9952104d9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	op := wire.NewOutPoint(h, 7)
+
+	op2, err := DeserializeOutpoint(SerializeOutpoint(op))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *op != *op2 {
+		t.Errorf("Expected %s, got %s", op, op2)
+	}
+	if _, err := DeserializeOutpoint(make([]byte, 35)); err == nil {
+		t.Error("Expected invalid length to fail")
+	}
+}
+
+func TestWallet_newUnsignedTransaction(t *testing.T) {
+	w := &Wallet{Chain: newTestChain()}
+
+	inputSource := func(available ...int64) func(target btcutil.Amount) (btcutil.Amount, []*wire.TxIn, [][]byte, error) {
+		return func(target btcutil.Amount) (btcutil.Amount, []*wire.TxIn, [][]byte, error) {
+			var (
+				total   btcutil.Amount
+				inputs  []*wire.TxIn
+				scripts [][]byte
+			)
+			for i, val := range available {
+				if total >= target {
+					break
+				}
+				total += btcutil.Amount(val)
+				inputs = append(inputs, wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{}, uint32(i)), nil, nil))
+				scripts = append(scripts, []byte{0x00})
+			}
+			if total < target {
+				return 0, nil, nil, base.ErrInsufficientFunds
+			}
+			return total, inputs, scripts, nil
+		}
+	}
+	changeSource := func() ([]byte, error) {
+		return make([]byte, 22), nil
+	}
+
+	tests := []struct {
+		inputs      []int64
+		nInputs     int
+		change      int64
+		expectedErr error
+	}{
+		{
+			// One input covers the output and fee. Fee is 170 bytes at 1 sat/byte.
+			inputs:  []int64{100000},
+			nInputs: 1,
+			change:  100000 - 50000 - 170,
+		},
+		{
+			// The second input is needed once the fee is accounted for.
+			inputs:  []int64{50100, 10000},
+			nInputs: 2,
+			change:  60100 - 50000 - 270,
+		},
+		{
+			// The remainder is dust so it goes to the fee.
+			inputs:  []int64{50200},
+			nInputs: 1,
+			change:  0,
+		},
+		{
+			inputs:      []int64{40000},
+			expectedErr: base.ErrInsufficientFunds,
+		},
+	}
+
+	for i, test := range tests {
+		outputs := []*wire.TxOut{wire.NewTxOut(50000, make([]byte, 22))}
+		tx, err := w.newUnsignedTransaction(outputs, 1000, inputSource(test.inputs...), changeSource)
+		if err != test.expectedErr {
+			t.Errorf("Test %d: expected error %v, got %v", i, test.expectedErr, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if len(tx.TxIn) != test.nInputs {
+			t.Errorf("Test %d: expected %d inputs, got %d", i, test.nInputs, len(tx.TxIn))
+		}
+		if test.change == 0 {
+			if len(tx.TxOut) != 1 {
+				t.Errorf("Test %d: expected no change output", i)
+			}
+			continue
+		}
+		if len(tx.TxOut) != 2 {
+			t.Fatalf("Test %d: expected change output", i)
+		}
+		if tx.TxOut[1].Value != test.change {
+			t.Errorf("Test %d: expected change %d, got %d", i, test.change, tx.TxOut[1].Value)
+		}
+	}
+}
+
+func TestSortCoins(t *testing.T) {
+	var h1, h2 chainhash.Hash
+	h1[0], h2[0] = 1, 2
+	coins := []coinset.Coin{
+		&base.Coin{TxHash: &h2, TxIndex: 0},
+		&base.Coin{TxHash: &h1, TxIndex: 3},
+		&base.Coin{TxHash: &h1, TxIndex: 1},
+	}
+	sortCoins(coins)
+	if coins[0].Hash() != &h1 || coins[0].Index() != 1 || coins[1].Index() != 3 || coins[2].Hash() != &h2 {
+		t.Errorf("Coins not sorted by outpoint")
+	}
+}
+
+func TestCanonicalSort(t *testing.T) {
+	var h1, h2 chainhash.Hash
+	h1[0], h2[0] = 1, 2
+	build := func() *wire.MsgTx {
+		return &wire.MsgTx{
+			TxIn: []*wire.TxIn{
+				wire.NewTxIn(wire.NewOutPoint(&h2, 0), nil, nil),
+				wire.NewTxIn(wire.NewOutPoint(&h1, 1), nil, nil),
+			},
+			TxOut: []*wire.TxOut{
+				wire.NewTxOut(50000, []byte{0x02}),
+				wire.NewTxOut(20000, []byte{0x01}),
+				// Change
+				wire.NewTxOut(10000, []byte{0x03}),
+			},
+		}
+	}
+
+	tx := build()
+	canonicalSort(tx, true)
+	if tx.TxIn[0].PreviousOutPoint.Hash != h1 {
+		t.Error("Inputs not sorted")
+	}
+	if tx.TxOut[0].Value != 20000 || tx.TxOut[1].Value != 50000 {
+		t.Error("Payments not sorted")
+	}
+	if tx.TxOut[2].Value != 10000 {
+		t.Error("Expected change output last")
+	}
+
+	tx = build()
+	canonicalSort(tx, false)
+	if tx.TxOut[0].Value != 10000 {
+		t.Error("Expected outputs sorted as in BIP 69 without change")
+	}
+
+	// Signatures are stripped from a copy.
+	tx.TxIn[0].SignatureScript = []byte{0x01}
+	tx.TxIn[0].Witness = wire.TxWitness{{0x01}}
+	stripped := StripSignatures(tx)
+	if stripped.TxIn[0].SignatureScript != nil || stripped.TxIn[0].Witness != nil {
+		t.Error("Expected signatures to be stripped")
+	}
+	if tx.TxIn[0].SignatureScript == nil {
+		t.Error("Expected original to be unchanged")
+	}
+}
+
+func TestSourceGroups(t *testing.T) {
+	coins := []coinset.Coin{
+		&base.Coin{TxValue: 500, Source: "label:a"},
+		&base.Coin{TxValue: 100},
+		&base.Coin{TxValue: 300, Source: "label:b"},
+		&base.Coin{TxValue: 200, Source: "label:a"},
+		&base.Coin{TxValue: 300},
+	}
+	groups := sourceGroups(coins)
+	if len(groups) != 3 {
+		t.Fatalf("Expected 3 groups, got %d", len(groups))
+	}
+	// label:b totals 300, the unlabeled coins 400 and label:a 700.
+	if coinSource(groups[0][0]) != "label:b" || len(groups[1]) != 2 || coinSource(groups[1][0]) != "" {
+		t.Error("Groups not sorted by value")
+	}
+	if groups[2][0].Value() != 500 || groups[2][1].Value() != 200 {
+		t.Error("Expected coin order kept within a group")
+	}
+}
+
+func TestVirtualSize(t *testing.T) {
+	tx := wire.NewMsgTx(2)
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{}, 0), nil, nil))
+	tx.AddTxOut(wire.NewTxOut(1000, make([]byte, 22)))
+	if vsize := virtualSize(tx); vsize != int64(tx.SerializeSize()) {
+		t.Errorf("Expected a transaction without witnesses to be its serialized size %d, got %d", tx.SerializeSize(), vsize)
+	}
+
+	tx.TxIn[0].Witness = wire.TxWitness{make([]byte, 72), make([]byte, 33)}
+	stripped := tx.SerializeSizeStripped()
+	witness := tx.SerializeSize() - stripped
+	expected := int64(stripped + (witness+3)/4)
+	if vsize := virtualSize(tx); vsize != expected {
+		t.Errorf("Expected virtual size %d, got %d", expected, vsize)
+	}
+}
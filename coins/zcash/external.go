@@ -0,0 +1,84 @@
+package zcash
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	iwallet "github.com/cpacia/wallet-interface"
+	"io"
+)
+
+// BroadcastRaw broadcasts a signed version four transaction built outside
+// the wallet through the wallet's broadcast queue. It's tracked in the
+// history if it involves the wallet. See base.WalletBase.BroadcastExternal.
+func (w *ZCashWallet) BroadcastRaw(raw []byte) (iwallet.TransactionID, error) {
+	outpoints, lockTime, err := readVersion4Inputs(raw)
+	if err != nil {
+		return "", err
+	}
+	txid := iwallet.TransactionID(chainhash.DoubleHashH(raw).String())
+	inputs := make([][]byte, 0, len(outpoints))
+	for _, op := range outpoints {
+		inputs = append(inputs, serializeOutpoint(op))
+	}
+	return txid, w.BroadcastExternal(txid, raw, inputs, lockTime)
+}
+
+// readVersion4Inputs reads the transparent inputs and the lock time of a
+// transaction in the zcash version four wire format. The shielded parts
+// which follow the lock time are left unread.
+func readVersion4Inputs(raw []byte) ([]*wire.OutPoint, uint32, error) {
+	r := bytes.NewReader(raw)
+	header := make([]byte, len(txHeaderBytes)+len(txNVersionGroupIDBytes))
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, 0, err
+	}
+	if !bytes.Equal(header[:4], txHeaderBytes) || !bytes.Equal(header[4:], txNVersionGroupIDBytes) {
+		return nil, 0, errors.New("not a version four transaction")
+	}
+
+	count, err := wire.ReadVarInt(r, wire.ProtocolVersion)
+	if err != nil {
+		return nil, 0, err
+	}
+	var outpoints []*wire.OutPoint
+	for i := uint64(0); i < count; i++ {
+		var op wire.OutPoint
+		if _, err := io.ReadFull(r, op.Hash[:]); err != nil {
+			return nil, 0, err
+		}
+		if err := binary.Read(r, binary.LittleEndian, &op.Index); err != nil {
+			return nil, 0, err
+		}
+		if _, err := wire.ReadVarBytes(r, wire.ProtocolVersion, wire.MaxMessagePayload, "sigScript"); err != nil {
+			return nil, 0, err
+		}
+		var sequence uint32
+		if err := binary.Read(r, binary.LittleEndian, &sequence); err != nil {
+			return nil, 0, err
+		}
+		outpoints = append(outpoints, &op)
+	}
+
+	count, err = wire.ReadVarInt(r, wire.ProtocolVersion)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := uint64(0); i < count; i++ {
+		var value int64
+		if err := binary.Read(r, binary.LittleEndian, &value); err != nil {
+			return nil, 0, err
+		}
+		if _, err := wire.ReadVarBytes(r, wire.ProtocolVersion, wire.MaxMessagePayload, "pkScript"); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	var lockTime uint32
+	if err := binary.Read(r, binary.LittleEndian, &lockTime); err != nil {
+		return nil, 0, err
+	}
+	return outpoints, lockTime, nil
+}
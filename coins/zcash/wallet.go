@@ -17,7 +17,7 @@ import (
 	"github.com/btcsuite/btcwallet/wallet/txrules"
 	"github.com/btcsuite/btcwallet/wallet/txsizes"
 	"github.com/cpacia/multiwallet/base"
-	"github.com/cpacia/multiwallet/client/blockbook"
+	"github.com/cpacia/multiwallet/client"
 	"github.com/cpacia/multiwallet/database"
 	iwallet "github.com/cpacia/wallet-interface"
 	mbwire "github.com/martinboehm/btcd/wire"
@@ -41,6 +41,8 @@ var (
 	MainNetParams chaincfg.Params
 	// TestNetParams are parser parameters for testnet
 	TestNetParams chaincfg.Params
+	// RegtestParams are parser parameters for regtest
+	RegtestParams chaincfg.Params
 )
 
 const (
@@ -51,6 +53,8 @@ const (
 	MainnetMagic mbwire.BitcoinNet = 0x6427e924
 	// TestnetMagic is testnet network constant
 	TestnetMagic mbwire.BitcoinNet = 0xbff91afa
+	// RegtestMagic is regtest network constant
+	RegtestMagic mbwire.BitcoinNet = 0x5f3fe8aa
 
 	divisibility           = 8
 	averageTransactionSize = 226
@@ -82,13 +86,21 @@ func init() {
 	TestNetParams.AddressMagicLen = 2
 	TestNetParams.PubKeyHashAddrID = []byte{0x1D, 0x25} // base58 prefix: tm
 	TestNetParams.ScriptHashAddrID = []byte{0x1C, 0xBA} // base58 prefix: t2
+
+	RegtestParams = chaincfg.RegressionNetParams
+	RegtestParams.Net = RegtestMagic
+
+	// Address encoding magics are the same as testnet
+	RegtestParams.AddressMagicLen = 2
+	RegtestParams.PubKeyHashAddrID = []byte{0x1D, 0x25} // base58 prefix: tm
+	RegtestParams.ScriptHashAddrID = []byte{0x1C, 0xBA} // base58 prefix: t2
 }
 
 // ZCashWallet extends wallet base and implements the
 // remaining functions for each interface.
 type ZCashWallet struct { // nolint
 	base.WalletBase
-	testnet     bool
+	network     base.Network
 	feeURL      string
 	feeProvider base.FeeProvider
 }
@@ -97,17 +109,36 @@ type ZCashWallet struct { // nolint
 // attempts to connect to the API. If it fails, it will not build.
 func NewZCashWallet(cfg *base.WalletConfig) (*ZCashWallet, error) {
 	w := &ZCashWallet{
-		testnet: cfg.Testnet,
+		network: cfg.SelectedNetwork(),
 		feeURL:  cfg.FeeURL,
 	}
+	if w.network == base.NetworkSignet {
+		return nil, base.UnsupportedNetwork(iwallet.CtZCash, w.network)
+	}
+
+	chainClient, err := client.NewChainClient(cfg.ClientURL, iwallet.CtZCash)
+	if err != nil {
+		return nil, err
+	}
+
+	chainClient, err = client.WithFailover(chainClient, cfg.FallbackClientURLs, iwallet.CtZCash, cfg.Logger)
+	if err != nil {
+		return nil, err
+	}
 
-	chainClient, err := blockbook.NewBlockbookClient(cfg.ClientURL, iwallet.CtZCash)
+	chainClient, err = client.WithVerification(chainClient, cfg.VerifyClientURL, iwallet.CtZCash, cfg.Logger)
 	if err != nil {
 		return nil, err
 	}
 
-	fp := base.NewExchangeRateFeeProvider(iwallet.CtZCash, divisibility, cfg.ExchangeRateProvider, averageTransactionSize,
+	var fp base.FeeProvider = base.NewExchangeRateFeeProvider(iwallet.CtZCash, divisibility, cfg.ExchangeRateProvider, averageTransactionSize,
 		iwallet.NewAmount(maxFeePerByte), priorityTarget, normalTarget, economicTarget, superEconomicTarget)
+	if netFP := w.network.DefaultFeeProvider(); netFP != nil {
+		fp = netFP
+	}
+	if cfg.FeeProvider != nil {
+		fp = cfg.FeeProvider
+	}
 
 	w.ChainClient = chainClient
 	w.DB = cfg.DB
@@ -115,6 +146,12 @@ func NewZCashWallet(cfg *base.WalletConfig) (*ZCashWallet, error) {
 	w.CoinType = iwallet.CtZCash
 	w.Done = make(chan struct{})
 	w.AddressFunc = w.keyToAddress
+	w.NormalizeAddress = w.normalizeAddress
+	w.GapLimit = cfg.GapLimit
+	w.KeychainOpts = cfg.KeychainOptions()
+	w.Prune = cfg.Prune
+	w.Confirmations = cfg.Confirmations
+	w.MessageMagic = "Zcash Signed Message:\n"
 	w.feeProvider = fp
 	return w, nil
 }
@@ -126,6 +163,16 @@ func (w *ZCashWallet) ValidateAddress(addr iwallet.Address) error {
 	return err
 }
 
+// normalizeAddress decodes and re-encodes the address so every encoding
+// of it has the same string.
+func (w *ZCashWallet) normalizeAddress(addr iwallet.Address) (iwallet.Address, error) {
+	address, err := btcutil.DecodeAddress(addr.String(), w.params())
+	if err != nil {
+		return iwallet.Address{}, err
+	}
+	return iwallet.NewAddress(address.EncodeAddress(), iwallet.CtZCash), nil
+}
+
 // IsDust returns whether the amount passed in is considered dust by network. This
 // method is called when building payout transactions from the multisig to the various
 // participants. If the amount that is supposed to be sent to a given party is below
@@ -147,7 +194,7 @@ func (w *ZCashWallet) EstimateSpendFee(amount iwallet.Amount, feeLevel iwallet.F
 	err := w.DB.Update(func(dbtx database.Tx) error {
 		// Since this is an estimate we can use a dummy output address. Let's use a long one so we don't under estimate.
 		addrStr := "t1SV7MDC2gCsvySErQC9Pmaz69HorFLmqD9"
-		if w.testnet {
+		if w.network.IsTest() {
 			addrStr = "tmJKrg3gS4sPS7gSJ4vT8dFeqkGtfnDW4gu"
 		}
 		tx, err := w.buildTx(dbtx, amount.Int64(), iwallet.NewAddress(addrStr, iwallet.CtZCash), feeLevel)
@@ -200,16 +247,23 @@ func (w *ZCashWallet) EstimateSpendFee(amount iwallet.Amount, feeLevel iwallet.F
 // the state changes should be discarded. Only when Commit() is called should
 // the state changes be applied and the transaction broadcasted to the network.
 func (w *ZCashWallet) Spend(wtx iwallet.Tx, to iwallet.Address, amt iwallet.Amount, feeLevel iwallet.FeeLevel) (iwallet.TransactionID, error) {
+	if err := w.CheckDestinations(to); err != nil {
+		return "", err
+	}
 	var (
 		txid iwallet.TransactionID
 		buf  []byte
 	)
+	var inputs [][]byte
 	err := w.DB.View(func(dbtx database.Tx) error {
 		tx, err := w.buildTx(dbtx, amt.Int64(), to, feeLevel)
 		if err != nil {
 			return err
 		}
 		txid = iwallet.TransactionID(tx.TxHash().String())
+		for _, in := range tx.TxIn {
+			inputs = append(inputs, serializeOutpoint(&in.PreviousOutPoint))
+		}
 		buf, err = serializeVersion4Transaction(tx, 0)
 		if err != nil {
 			return err
@@ -223,18 +277,24 @@ func (w *ZCashWallet) Spend(wtx iwallet.Tx, to iwallet.Address, amt iwallet.Amou
 	}
 
 	wbtx.OnCommit = func() error {
-		return w.DB.Update(func(dbtx database.Tx) error {
+		err := w.DB.Update(func(dbtx database.Tx) error {
 			err := dbtx.Save(&database.UnconfirmedTransaction{
 				Timestamp: time.Now(),
 				Coin:      iwallet.CtZCash,
 				TxBytes:   buf,
 				Txid:      txid.String(),
+				Inputs:    base.JoinOutpoints(inputs),
 			})
 			if err != nil {
 				return err
 			}
-			return w.ChainClient.Broadcast(buf)
+			return nil
 		})
+		if err != nil {
+			return err
+		}
+		w.BroadcastOrQueue(txid, buf)
+		return nil
 	}
 	return txid, err
 }
@@ -243,10 +303,14 @@ func (w *ZCashWallet) Spend(wtx iwallet.Tx, to iwallet.Address, amt iwallet.Amou
 // address. It is expected for most coins that the fee will be subtracted
 // from the amount sent rather than added to it.
 func (w *ZCashWallet) SweepWallet(wtx iwallet.Tx, to iwallet.Address, level iwallet.FeeLevel) (iwallet.TransactionID, error) {
+	if err := w.CheckDestinations(to); err != nil {
+		return "", err
+	}
 	var (
 		txid iwallet.TransactionID
 		buf  []byte
 	)
+	var inputs [][]byte
 	err := w.DB.Update(func(dbtx database.Tx) error {
 		var (
 			totalIn               btcutil.Amount
@@ -260,6 +324,12 @@ func (w *ZCashWallet) SweepWallet(wtx iwallet.Tx, to iwallet.Address, level iwal
 		if err != nil {
 			return err
 		}
+		defer base.ZeroCoinKeys(coinMap)
+		defer func() {
+			for _, key := range keyMap {
+				base.ZeroPrivKey(key)
+			}
+		}()
 
 		for coin, key := range coinMap {
 			h, err := chainhash.NewHashFromStr(coin.Hash().String())
@@ -340,6 +410,9 @@ func (w *ZCashWallet) SweepWallet(wtx iwallet.Tx, to iwallet.Address, level iwal
 		}
 
 		txid = iwallet.TransactionID(tx.TxHash().String())
+		for _, in := range tx.TxIn {
+			inputs = append(inputs, serializeOutpoint(&in.PreviousOutPoint))
+		}
 		buf, err = serializeVersion4Transaction(tx, 0)
 		if err != nil {
 			return err
@@ -354,18 +427,24 @@ func (w *ZCashWallet) SweepWallet(wtx iwallet.Tx, to iwallet.Address, level iwal
 	}
 
 	wbtx.OnCommit = func() error {
-		return w.DB.Update(func(dbtx database.Tx) error {
+		err := w.DB.Update(func(dbtx database.Tx) error {
 			err := dbtx.Save(&database.UnconfirmedTransaction{
 				Timestamp: time.Now(),
 				Coin:      iwallet.CtZCash,
 				TxBytes:   buf,
 				Txid:      txid.String(),
+				Inputs:    base.JoinOutpoints(inputs),
 			})
 			if err != nil {
 				return err
 			}
-			return w.ChainClient.Broadcast(buf)
+			return nil
 		})
+		if err != nil {
+			return err
+		}
+		w.BroadcastOrQueue(txid, buf)
+		return nil
 	}
 
 	return txid, err
@@ -453,6 +532,9 @@ func (w *ZCashWallet) CreateMultisigAddress(keys []btcec.PublicKey, threshold in
 // For coins like bitcoin you may need to return one signature *per input* which is
 // why a slice of signatures is returned.
 func (w *ZCashWallet) SignMultisigTransaction(txn iwallet.Transaction, key btcec.PrivateKey, redeemScript []byte) ([]iwallet.EscrowSignature, error) {
+	if err := w.CheckEscrowRelease(redeemScript); err != nil {
+		return nil, err
+	}
 	var sigs []iwallet.EscrowSignature
 	tx := wire.NewMsgTx(1)
 	for _, from := range txn.From {
@@ -505,6 +587,12 @@ func (w *ZCashWallet) SignMultisigTransaction(txn iwallet.Transaction, key btcec
 // Note a database transaction is used here. Same rules of Commit() and
 // Rollback() apply.
 func (w *ZCashWallet) BuildAndSend(wtx iwallet.Tx, txn iwallet.Transaction, signatures [][]iwallet.EscrowSignature, redeemScript []byte) (iwallet.TransactionID, error) {
+	if err := w.CheckEscrowRelease(redeemScript); err != nil {
+		return "", err
+	}
+	if err := w.CheckDestinations(base.PaidAddresses(txn)...); err != nil {
+		return "", err
+	}
 	tx := wire.NewMsgTx(1)
 	for _, from := range txn.From {
 		op, err := derializeOutpoint(from.ID)
@@ -575,7 +663,7 @@ func (w *ZCashWallet) BuildAndSend(wtx iwallet.Tx, txn iwallet.Transaction, sign
 	}
 
 	wbtx.OnCommit = func() error {
-		return w.DB.Update(func(dbtx database.Tx) error {
+		err := w.DB.Update(func(dbtx database.Tx) error {
 			err := dbtx.Save(&database.UnconfirmedTransaction{
 				Timestamp: time.Now(),
 				Coin:      iwallet.CtZCash,
@@ -585,19 +673,30 @@ func (w *ZCashWallet) BuildAndSend(wtx iwallet.Tx, txn iwallet.Transaction, sign
 			if err != nil {
 				return err
 			}
-			return w.ChainClient.Broadcast(buf)
+			return nil
 		})
+		if err != nil {
+			return err
+		}
+		w.BroadcastOrQueue(txid, buf)
+		return nil
 	}
 
 	return txid, nil
 }
 
 func (w *ZCashWallet) params() *chaincfg.Params {
-	if w.testnet {
+	switch w.network {
+	case base.NetworkTestnet:
 		if !chaincfg.IsRegistered(&TestNetParams) {
 			chaincfg.Register(&TestNetParams)
 		}
 		return &TestNetParams
+	case base.NetworkRegtest:
+		if !chaincfg.IsRegistered(&RegtestParams) {
+			chaincfg.Register(&RegtestParams)
+		}
+		return &RegtestParams
 	}
 	if !chaincfg.IsRegistered(&MainNetParams) {
 		chaincfg.Register(&MainNetParams)
@@ -631,6 +730,14 @@ func (w *ZCashWallet) buildTx(dbtx database.Tx, amount int64, iaddr iwallet.Addr
 		return nil, err
 	}
 
+	// Zero the private keys once the transaction has been signed.
+	defer base.ZeroCoinKeys(coinKeyMap)
+	defer func() {
+		for _, key := range additionalKeysByScript {
+			base.ZeroPrivKey(key)
+		}
+	}()
+
 	allCoins := make([]coinset.Coin, 0, len(coinKeyMap))
 	for coin := range coinKeyMap {
 		allCoins = append(allCoins, coin)
@@ -662,6 +769,7 @@ func (w *ZCashWallet) buildTx(dbtx database.Tx, amount int64, iaddr iwallet.Addr
 				err = kerr
 				return
 			}
+			defer base.ZeroKey(hdKey)
 			privKey, perr := hdKey.ECPrivKey()
 			if perr != nil {
 				err = perr
@@ -784,6 +892,12 @@ func (w *ZCashWallet) keyToAddress(key *hdkeychain.ExtendedKey) (iwallet.Address
 	return iwallet.NewAddress(addr.String(), iwallet.CtZCash), nil
 }
 
+// VerifyVectors checks the wallet derives the published address vectors
+// for its network. Regtest addresses are the same as testnet's.
+func (w *ZCashWallet) VerifyVectors() error {
+	return base.VerifyAddressVectors(base.AddressVectorsFor(iwallet.CtZCash, w.network.IsTest(), base.AddressTypeNativeSegwit), w.keyToAddress)
+}
+
 func derializeOutpoint(ser []byte) (*wire.OutPoint, error) {
 	h, err := chainhash.NewHash(ser[:32])
 	if err != nil {
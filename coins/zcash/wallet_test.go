@@ -12,18 +12,18 @@ import (
 	"github.com/cpacia/multiwallet/base"
 	"github.com/cpacia/multiwallet/database"
 	"github.com/cpacia/multiwallet/database/sqlitedb"
+	"github.com/cpacia/multiwallet/log"
 	iwallet "github.com/cpacia/wallet-interface"
 	"github.com/jarcoal/httpmock"
 	"github.com/martinboehm/btcutil"
 	"github.com/martinboehm/btcutil/txscript"
-	"github.com/op/go-logging"
 	"testing"
 	"time"
 )
 
 func newTestWallet() (*ZCashWallet, error) {
 	w := &ZCashWallet{
-		testnet:     true,
+		network:     base.NetworkTestnet,
 		feeProvider: base.NewHardCodedFeeProvider(iwallet.NewAmount(50), iwallet.NewAmount(40), iwallet.NewAmount(30), iwallet.NewAmount(20)),
 	}
 
@@ -39,7 +39,7 @@ func newTestWallet() (*ZCashWallet, error) {
 
 	w.ChainClient = chainClient
 	w.DB = db
-	w.Logger = logging.MustGetLogger("bchtest")
+	w.Logger = log.New("bchtest")
 	w.CoinType = iwallet.CtZCash
 	w.Done = make(chan struct{})
 	w.AddressFunc = w.keyToAddress
@@ -752,6 +752,33 @@ func TestSerializeVersion4Transaction(t *testing.T) {
 	}
 }
 
+func TestReadVersion4Inputs(t *testing.T) {
+	tx, serialized, err := buildTestTx()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outpoints, lockTime, err := readVersion4Inputs(serialized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outpoints) != len(tx.TxIn) {
+		t.Fatalf("Expected %d inputs, got %d", len(tx.TxIn), len(outpoints))
+	}
+	for i, op := range outpoints {
+		if *op != tx.TxIn[i].PreviousOutPoint {
+			t.Errorf("Input %d: expected %s, got %s", i, tx.TxIn[i].PreviousOutPoint, op)
+		}
+	}
+	if lockTime != tx.LockTime {
+		t.Errorf("Expected lock time %d, got %d", tx.LockTime, lockTime)
+	}
+
+	if _, _, err := readVersion4Inputs(serialized[:40]); err == nil {
+		t.Error("Expected error reading truncated transaction")
+	}
+}
+
 func TestCalcSignatureHash(t *testing.T) {
 	tx, _, err := buildTestTx()
 	if err != nil {
@@ -775,3 +802,12 @@ func TestCalcSignatureHash(t *testing.T) {
 		t.Fatal("Failed to calculate correct sig hash")
 	}
 }
+
+func TestZCashWallet_VerifyVectors(t *testing.T) {
+	for _, network := range []base.Network{base.NetworkMainnet, base.NetworkTestnet, base.NetworkRegtest} {
+		w := &ZCashWallet{network: network}
+		if err := w.VerifyVectors(); err != nil {
+			t.Errorf("Network %s: %s", network, err)
+		}
+	}
+}
@@ -1,11 +1,15 @@
 package multiwallet
 
 import (
+	"errors"
 	"fmt"
 	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/multiwallet/coins/bitcoin/lightning"
+	"github.com/cpacia/multiwallet/log"
+	"github.com/cpacia/multiwallet/swap"
 	iwallet "github.com/cpacia/wallet-interface"
-	"github.com/op/go-logging"
 	"path"
+	"time"
 )
 
 var (
@@ -20,15 +24,54 @@ type Config struct {
 	Wallets              []iwallet.CoinType
 	WalletAPIs           map[iwallet.CoinType]APIUrls
 	UseTestnet           bool
+	Network              base.Network
 	DataDir              string
 	LogDir               string
-	LogLevel             logging.Level
+	LogLevel             log.Level
+	LogModuleLevels      map[string]log.Level
+	LogFormat            log.Format
+	LogRedactLevel       log.Level
 	ExchangeRateProvider base.ExchangeRateProvider
+	BitcoinAddressType   base.AddressType
+	BitcoinDescriptor    string
+	BitcoinReplaceByFee  bool
+	ChangePolicies       map[iwallet.CoinType]ChangePolicy
+	Confirmations        map[iwallet.CoinType]base.ConfirmationPolicy
+	PreventAddressReuse  bool
+	PassphrasePolicy     base.PassphrasePolicy
+	Prune                base.PruneConfig
+	Lightning            lightning.Client
+	SwapProviders        []swap.Provider
+	Sync                 SyncConfig
 }
 
+// ChangePolicy is the change behavior for one wallet. Address is only used
+// by base.ChangeFixedAddress.
+type ChangePolicy struct {
+	Policy  base.ChangePolicy
+	Address string
+}
+
+// APIUrls are a coin's backends on each network. Regtest backends are
+// local so there are no defaults for them.
 type APIUrls struct {
 	Mainnet string
 	Testnet string
+	Signet  string
+	Regtest string
+}
+
+// URL returns the backend for the network.
+func (u APIUrls) URL(n base.Network) string {
+	switch n {
+	case base.NetworkTestnet:
+		return u.Testnet
+	case base.NetworkSignet:
+		return u.Signet
+	case base.NetworkRegtest:
+		return u.Regtest
+	}
+	return u.Mainnet
 }
 
 // Defaults are the default options. This option will be automatically
@@ -48,6 +91,7 @@ var Defaults = func(cfg *Config) error {
 		iwallet.CtBitcoin: {
 			Mainnet: "https://btc.blockbook.api.openbazaar.org/api",
 			Testnet: "https://tbtc.blockbook.api.openbazaar.org/api",
+			Signet:  "esplora+https://mempool.space/signet/api",
 		},
 		iwallet.CtLitecoin: {
 			Mainnet: "https://ltc.blockbook.api.openbazaar.org/api",
@@ -58,10 +102,15 @@ var Defaults = func(cfg *Config) error {
 			Testnet: "https://tzec.blockbook.api.openbazaar.org/api",
 		},
 	}
-	cfg.LogLevel = logging.INFO
+	cfg.LogLevel = log.LevelInfo
 	cfg.DataDir = DefaultHomeDir
 	cfg.LogDir = DefaultLogDir
 	cfg.ExchangeRateProvider = base.NewDefaultExchangeRateProvider("https://ticker.openbazaar.org/api")
+	cfg.Sync = SyncConfig{
+		RequestsPerSecond: 20,
+		Burst:             20,
+		Stagger:           time.Second * 2,
+	}
 	return nil
 }
 
@@ -105,7 +154,29 @@ func Testnet(testnet bool) Option {
 	}
 }
 
-// Wallets configures the multiwallet to use the provided wallets.
+// Network configures the multiwallet to use the given network for all
+// coins. Coins which don't have the network fail to build. Regtest needs
+// WalletAPIs pointing at the local backends.
+//
+// Defaults to mainnet, or testnet if Testnet is set.
+func Network(network base.Network) Option {
+	return func(cfg *Config) error {
+		cfg.Network = network
+		return nil
+	}
+}
+
+// network returns the network selected by the config.
+func (cfg *Config) network() base.Network {
+	if cfg.Network == base.NetworkMainnet && cfg.UseTestnet {
+		return base.NetworkTestnet
+	}
+	return cfg.Network
+}
+
+// Wallets configures the multiwallet to use the provided wallets. Forks
+// registered with fork.Register can be included once their WalletAPIs are
+// configured.
 //
 // Defaults to all implemented wallets.
 func Wallets(wallets []iwallet.CoinType) Option {
@@ -132,13 +203,49 @@ func WalletAPIs(apis map[iwallet.CoinType]APIUrls) Option {
 // LogLevel sets the log level for the wallet.
 //
 // Defaults to INFO.
-func LogLevel(level logging.Level) Option {
+func LogLevel(level log.Level) Option {
 	return func(cfg *Config) error {
 		cfg.LogLevel = level
 		return nil
 	}
 }
 
+// LogModuleLevel overrides the log level of one module, such as chain,
+// rebroadcaster or api.
+//
+// Defaults to the LogLevel.
+func LogModuleLevel(module string, level log.Level) Option {
+	return func(cfg *Config) error {
+		if cfg.LogModuleLevels == nil {
+			cfg.LogModuleLevels = make(map[string]log.Level)
+		}
+		cfg.LogModuleLevels[module] = level
+		return nil
+	}
+}
+
+// LogFormat sets the encoding of log records. Use log.FormatJSON for
+// machine parsable logs.
+//
+// Defaults to log.FormatText.
+func LogFormat(format log.Format) Option {
+	return func(cfg *Config) error {
+		cfg.LogFormat = format
+		return nil
+	}
+}
+
+// LogRedactLevel sets the least severe level at which addresses and public
+// keys are redacted from the logs. Private keys are always redacted.
+//
+// Defaults to DEBUG which redacts them everywhere.
+func LogRedactLevel(level log.Level) Option {
+	return func(cfg *Config) error {
+		cfg.LogRedactLevel = level
+		return nil
+	}
+}
+
 // ExchangeRateProvider sets an ExchangeRateProvider.
 //
 // Defaults to a default provider.
@@ -148,3 +255,171 @@ func ExchangeRateProvider(erp base.ExchangeRateProvider) Option {
 		return nil
 	}
 }
+
+// BitcoinAddressType sets the type of address generated by the Bitcoin
+// wallet. This must be set before the wallet is created and not changed
+// afterwards.
+//
+// Defaults to native segwit.
+func BitcoinAddressType(addrType base.AddressType) Option {
+	return func(cfg *Config) error {
+		cfg.BitcoinAddressType = addrType
+		return nil
+	}
+}
+
+// BitcoinDescriptor derives the Bitcoin wallet's addresses per an output
+// script descriptor instead of BitcoinAddressType. The wallet is created
+// from the descriptor's key. See base.WalletConfig.Descriptor.
+func BitcoinDescriptor(descriptor string) Option {
+	return func(cfg *Config) error {
+		if _, err := base.ParseDescriptor(descriptor); err != nil {
+			return err
+		}
+		cfg.BitcoinDescriptor = descriptor
+		return nil
+	}
+}
+
+// BitcoinReplaceByFee marks transactions sent by the Bitcoin wallet as
+// replaceable so that BumpFee can be used if they get stuck.
+//
+// Defaults to false.
+func BitcoinReplaceByFee(enabled bool) Option {
+	return func(cfg *Config) error {
+		cfg.BitcoinReplaceByFee = enabled
+		return nil
+	}
+}
+
+// WalletChangePolicy sets where the wallet for the coin sends change. It is
+// supported by Bitcoin and Bitcoin Cash.
+//
+// Defaults to base.ChangeInternal.
+func WalletChangePolicy(coinType iwallet.CoinType, policy base.ChangePolicy, addr string) Option {
+	return func(cfg *Config) error {
+		if policy == base.ChangeFixedAddress && addr == "" {
+			return fmt.Errorf("%s change address is required", coinType.CurrencyCode())
+		}
+		if cfg.ChangePolicies == nil {
+			cfg.ChangePolicies = make(map[iwallet.CoinType]ChangePolicy)
+		}
+		cfg.ChangePolicies[coinType] = ChangePolicy{Policy: policy, Address: addr}
+		return nil
+	}
+}
+
+// WalletConfirmations sets how many confirmations the coin's transactions
+// need before their funds count as confirmed in the balance, a
+// base.TransactionSettledEvent is emitted and, for escrows, they can be
+// released.
+//
+// Defaults to base.DefaultConfirmations for every coin.
+func WalletConfirmations(coinType iwallet.CoinType, policy base.ConfirmationPolicy) Option {
+	return func(cfg *Config) error {
+		if cfg.Confirmations == nil {
+			cfg.Confirmations = make(map[iwallet.CoinType]base.ConfirmationPolicy)
+		}
+		cfg.Confirmations[coinType] = policy
+		return nil
+	}
+}
+
+// PreventAddressReuse enables strict address reuse prevention. Wallets
+// refuse to pay an address they have already paid and never hand out an
+// address once a transaction paying it has been seen or sent. It is
+// supported by Bitcoin and Bitcoin Cash.
+//
+// Defaults to false.
+func PreventAddressReuse(enabled bool) Option {
+	return func(cfg *Config) error {
+		cfg.PreventAddressReuse = enabled
+		return nil
+	}
+}
+
+// PassphrasePolicy sets the strength required of new wallet passphrases.
+// See base.PassphrasePolicy.
+//
+// Defaults to accepting any passphrase.
+func PassphrasePolicy(policy base.PassphrasePolicy) Option {
+	return func(cfg *Config) error {
+		if policy.MinScore < 0 || policy.MinScore > 4 {
+			return errors.New("passphrase score must be between 0 and 4")
+		}
+		cfg.PassphrasePolicy = policy
+		return nil
+	}
+}
+
+// Prune configures pruning of old, fully spent transaction history. See
+// base.PruneConfig. Set Disabled to keep the full history for audits.
+//
+// Defaults to pruning transactions older than base.DefaultPruneAge with
+// base.DefaultPruneConfirmations.
+func Prune(pruneCfg base.PruneConfig) Option {
+	return func(cfg *Config) error {
+		cfg.Prune = pruneCfg
+		return nil
+	}
+}
+
+// Lightning enables lightning payments in the Bitcoin wallet using the
+// provided client.
+//
+// Defaults to nil which disables lightning.
+func Lightning(client lightning.Client) Option {
+	return func(cfg *Config) error {
+		cfg.Lightning = client
+		return nil
+	}
+}
+
+// SwapProviders adds exchanges which swaps between the wallets can be made
+// through. See Multiwallet.Swaps.
+//
+// Defaults to none.
+func SwapProviders(providers ...swap.Provider) Option {
+	return func(cfg *Config) error {
+		cfg.SwapProviders = append(cfg.SwapProviders, providers...)
+		return nil
+	}
+}
+
+// SyncRateLimit sets how many chain client requests per second the wallets
+// may make between them while syncing, and how many may be made at once.
+// Zero requests per second is unlimited.
+//
+// Defaults to 20 requests per second with bursts of 20.
+func SyncRateLimit(requestsPerSecond float64, burst int) Option {
+	return func(cfg *Config) error {
+		if requestsPerSecond < 0 || burst < 0 {
+			return errors.New("sync rate limit can't be negative")
+		}
+		cfg.Sync.RequestsPerSecond = requestsPerSecond
+		cfg.Sync.Burst = burst
+		return nil
+	}
+}
+
+// SyncStagger sets the delay between one wallet starting to sync and the
+// next.
+//
+// Defaults to two seconds.
+func SyncStagger(stagger time.Duration) Option {
+	return func(cfg *Config) error {
+		cfg.Sync.Stagger = stagger
+		return nil
+	}
+}
+
+// ActiveCoin sets the coin whose sync goes first. It can be changed later
+// with Multiwallet.SetActiveCoin.
+//
+// Defaults to none.
+func ActiveCoin(coinType iwallet.CoinType) Option {
+	return func(cfg *Config) error {
+		cfg.Sync.ActiveCoin = coinType
+		return nil
+	}
+}
@@ -0,0 +1,473 @@
+// Package config loads the multiwallet's configuration from a TOML or YAML
+// file. The file selects the enabled coins and, for each, its backends,
+// fee policy and keychain settings, along with the logging, proxy and API
+// settings shared by all of them. For example:
+//
+//	testnet = false
+//	proxy = "socks5://127.0.0.1:9050"
+//
+//	[log]
+//	level = "info"
+//	format = "json"
+//
+//	[api]
+//	listen = "127.0.0.1:8080"
+//	token = "a long random string"
+//	allowed_origins = ["http://localhost:3000"]
+//
+//	[coins.btc]
+//	backends = ["esplora+https://blockstream.info/api", "https://btc1.trezor.io/api"]
+//	lookahead = 20
+//	address_type = "nested-segwit"
+//
+//	[coins.btc.fees]
+//	priority = 50
+//	normal = 20
+//	economic = 10
+//	super_economic = 1
+//
+//	[coins.bch]
+//	enabled = false
+//
+// Coins without a section are enabled with the default backends.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/cpacia/multiwallet"
+	"github.com/cpacia/multiwallet/api"
+	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/multiwallet/database"
+	"github.com/cpacia/multiwallet/log"
+	"github.com/cpacia/proxyclient"
+	iwallet "github.com/cpacia/wallet-interface"
+	"golang.org/x/net/proxy"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Format is the encoding of a config file.
+type Format int
+
+const (
+	FormatTOML Format = iota
+	FormatYAML
+)
+
+// Config is the contents of a config file.
+type Config struct {
+	DataDir string `toml:"datadir" yaml:"datadir"`
+	Testnet bool   `toml:"testnet" yaml:"testnet"`
+
+	// Network is mainnet, testnet, signet or regtest. If empty testnet is
+	// used when Testnet is set and mainnet otherwise.
+	Network string `toml:"network" yaml:"network"`
+
+	// Proxy is a socks5:// URL, such as a local Tor client, which all
+	// backend connections are made through.
+	Proxy string `toml:"proxy" yaml:"proxy"`
+
+	Log   LogConfig             `toml:"log" yaml:"log"`
+	API   APIConfig             `toml:"api" yaml:"api"`
+	Coins map[string]CoinConfig `toml:"coins" yaml:"coins"`
+}
+
+// LogConfig holds the logging settings. Levels and formats are given by
+// name, such as "debug" or "json".
+type LogConfig struct {
+	Level       string            `toml:"level" yaml:"level"`
+	Format      string            `toml:"format" yaml:"format"`
+	Modules     map[string]string `toml:"modules" yaml:"modules"`
+	RedactLevel string            `toml:"redact_level" yaml:"redact_level"`
+}
+
+// APIConfig holds the settings of the HTTP API. The API is disabled if
+// Listen is empty. Token is the bearer token clients must send and is
+// required when the API is enabled.
+type APIConfig struct {
+	Listen         string   `toml:"listen" yaml:"listen"`
+	Token          string   `toml:"token" yaml:"token"`
+	AllowedOrigins []string `toml:"allowed_origins" yaml:"allowed_origins"`
+}
+
+// CoinConfig holds the settings of one coin. Its key in Config.Coins is
+// the coin's currency code.
+type CoinConfig struct {
+	// Enabled defaults to true.
+	Enabled *bool `toml:"enabled" yaml:"enabled"`
+
+	// Backends and TestnetBackends, SignetBackends and RegtestBackends
+	// are the backend URLs for each network in order of preference. Later
+	// ones are only used when the earlier ones can't be reached. If empty
+	// the default backend is used. There are no default regtest backends.
+	Backends        []string `toml:"backends" yaml:"backends"`
+	TestnetBackends []string `toml:"testnet_backends" yaml:"testnet_backends"`
+	SignetBackends  []string `toml:"signet_backends" yaml:"signet_backends"`
+	RegtestBackends []string `toml:"regtest_backends" yaml:"regtest_backends"`
+
+	// VerifyBackend is an optional second backend which responses are
+	// checked against. See base.VerifyingClient.
+	VerifyBackend string `toml:"verify_backend" yaml:"verify_backend"`
+
+	FeeURL string    `toml:"fee_url" yaml:"fee_url"`
+	Fees   FeePolicy `toml:"fees" yaml:"fees"`
+
+	Lookahead           int    `toml:"lookahead" yaml:"lookahead"`
+	GapLimit            int    `toml:"gap_limit" yaml:"gap_limit"`
+	AddressType         string `toml:"address_type" yaml:"address_type"`
+	ReplaceByFee        bool   `toml:"replace_by_fee" yaml:"replace_by_fee"`
+	PreventAddressReuse bool   `toml:"prevent_address_reuse" yaml:"prevent_address_reuse"`
+
+	// Confirmations and EscrowConfirmations are the coin's
+	// base.ConfirmationPolicy.
+	Confirmations       uint64 `toml:"confirmations" yaml:"confirmations"`
+	EscrowConfirmations uint64 `toml:"escrow_confirmations" yaml:"escrow_confirmations"`
+
+	// CosignerKey is the extended public key of a second device which
+	// must approve every spend. See base.WalletConfig.CosignerKey.
+	CosignerKey string `toml:"cosigner_key" yaml:"cosigner_key"`
+
+	// Descriptor is an output script descriptor of the wallet's
+	// addresses. See base.WalletConfig.Descriptor.
+	Descriptor string `toml:"descriptor" yaml:"descriptor"`
+
+	// Offline exports spends for an air-gapped wallet to sign. See
+	// base.WalletConfig.Offline.
+	Offline bool `toml:"offline" yaml:"offline"`
+}
+
+// FeePolicy fixes the fee rate, in the coin's base unit per byte, of each
+// fee level. If Normal is zero the coin's fee provider is used instead.
+type FeePolicy struct {
+	Priority      uint64 `toml:"priority" yaml:"priority"`
+	Normal        uint64 `toml:"normal" yaml:"normal"`
+	Economic      uint64 `toml:"economic" yaml:"economic"`
+	SuperEconomic uint64 `toml:"super_economic" yaml:"super_economic"`
+}
+
+// Load reads the config file at path. The format is picked by the file's
+// extension: .yaml or .yml for YAML and anything else for TOML.
+func Load(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	format := FormatTOML
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		format = FormatYAML
+	}
+	cfg, err := Parse(data, format)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return cfg, nil
+}
+
+// Parse decodes and validates a config.
+func Parse(data []byte, format Format) (*Config, error) {
+	var cfg Config
+	switch format {
+	case FormatYAML:
+		if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+			return nil, err
+		}
+	default:
+		md, err := toml.Decode(string(data), &cfg)
+		if err != nil {
+			return nil, err
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return nil, fmt.Errorf("unknown key %s", undecoded[0])
+		}
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// supportedCoins are the coins which can be configured.
+var supportedCoins = []iwallet.CoinType{
+	iwallet.CtBitcoin,
+	iwallet.CtBitcoinCash,
+	iwallet.CtLitecoin,
+	iwallet.CtZCash,
+}
+
+func coinType(code string) (iwallet.CoinType, error) {
+	for _, ct := range supportedCoins {
+		if strings.EqualFold(ct.CurrencyCode(), code) {
+			return ct, nil
+		}
+	}
+	return "", fmt.Errorf("unknown coin %s", code)
+}
+
+func (cfg *Config) validate() error {
+	if cfg.Proxy != "" {
+		if _, err := proxyDialer(cfg.Proxy); err != nil {
+			return err
+		}
+	}
+	if _, err := cfg.LogBackendConfig(); err != nil {
+		return err
+	}
+	if _, err := cfg.network(); err != nil {
+		return err
+	}
+	if cfg.API.Listen != "" && cfg.API.Token == "" {
+		return errors.New("api.token is required when the api is enabled")
+	}
+	for code, cc := range cfg.Coins {
+		if _, err := coinType(code); err != nil {
+			return err
+		}
+		if _, err := parseAddressType(cc.AddressType); err != nil {
+			return fmt.Errorf("coins.%s: %s", code, err)
+		}
+		if cc.Descriptor != "" {
+			if _, err := base.ParseDescriptor(cc.Descriptor); err != nil {
+				return fmt.Errorf("coins.%s: descriptor: %s", code, err)
+			}
+		}
+		if cc.Lookahead < 0 {
+			return fmt.Errorf("coins.%s: lookahead must not be negative", code)
+		}
+		if cc.GapLimit < 0 {
+			return fmt.Errorf("coins.%s: gap_limit must not be negative", code)
+		}
+		if f := cc.Fees; f.Normal == 0 && (f.Priority != 0 || f.Economic != 0 || f.SuperEconomic != 0) {
+			return fmt.Errorf("coins.%s: fees.normal is required when fees are set", code)
+		}
+	}
+	return nil
+}
+
+// EnabledCoins returns the enabled coins sorted by currency code.
+func (cfg *Config) EnabledCoins() []iwallet.CoinType {
+	var coins []iwallet.CoinType
+	for _, ct := range supportedCoins {
+		if cc, ok := cfg.coin(ct); ok && cc.Enabled != nil && !*cc.Enabled {
+			continue
+		}
+		coins = append(coins, ct)
+	}
+	sort.Slice(coins, func(i, j int) bool {
+		return coins[i].CurrencyCode() < coins[j].CurrencyCode()
+	})
+	return coins
+}
+
+// network returns the network selected by the file.
+func (cfg *Config) network() (base.Network, error) {
+	if cfg.Network == "" && cfg.Testnet {
+		return base.NetworkTestnet, nil
+	}
+	return base.ParseNetwork(strings.ToLower(cfg.Network))
+}
+
+// backends returns the coin's backends for the network.
+func (cc CoinConfig) backends(network base.Network) []string {
+	switch network {
+	case base.NetworkTestnet:
+		return cc.TestnetBackends
+	case base.NetworkSignet:
+		return cc.SignetBackends
+	case base.NetworkRegtest:
+		return cc.RegtestBackends
+	}
+	return cc.Backends
+}
+
+// coin returns the section for the coin, if there is one.
+func (cfg *Config) coin(ct iwallet.CoinType) (CoinConfig, bool) {
+	for code, cc := range cfg.Coins {
+		if strings.EqualFold(code, ct.CurrencyCode()) {
+			return cc, true
+		}
+	}
+	return CoinConfig{}, false
+}
+
+// LogBackendConfig returns the log.Config selected by the log section. The
+// output is left for the caller to set.
+func (cfg *Config) LogBackendConfig() (log.Config, error) {
+	var (
+		lc  = log.Config{Level: log.LevelInfo, ModuleLevels: make(map[string]log.Level)}
+		err error
+	)
+	if cfg.Log.Level != "" {
+		if lc.Level, err = log.ParseLevel(cfg.Log.Level); err != nil {
+			return lc, err
+		}
+	}
+	if cfg.Log.RedactLevel != "" {
+		if lc.RedactLevel, err = log.ParseLevel(cfg.Log.RedactLevel); err != nil {
+			return lc, err
+		}
+	}
+	for module, name := range cfg.Log.Modules {
+		level, err := log.ParseLevel(name)
+		if err != nil {
+			return lc, err
+		}
+		lc.ModuleLevels[module] = level
+	}
+	switch strings.ToLower(cfg.Log.Format) {
+	case "", "text":
+		lc.Format = log.FormatText
+	case "json":
+		lc.Format = log.FormatJSON
+	default:
+		return lc, fmt.Errorf("unknown log format %q", cfg.Log.Format)
+	}
+	return lc, nil
+}
+
+// APIServerConfig returns the api.Config selected by the api section. The
+// API should not be started if ListenAddr is empty.
+func (cfg *Config) APIServerConfig(logger log.Logger) api.Config {
+	return api.Config{
+		ListenAddr:     cfg.API.Listen,
+		APIToken:       cfg.API.Token,
+		AllowedOrigins: cfg.API.AllowedOrigins,
+		Logger:         logger,
+	}
+}
+
+// ApplyProxy routes all backend connections through the configured proxy.
+// The proxy is process wide so this must be called before any wallet is
+// built. It does nothing if no proxy is configured.
+func (cfg *Config) ApplyProxy() error {
+	if cfg.Proxy == "" {
+		return nil
+	}
+	dialer, err := proxyDialer(cfg.Proxy)
+	if err != nil {
+		return err
+	}
+	proxyclient.SetProxy(dialer)
+	return nil
+}
+
+func proxyDialer(proxyURL string) (proxy.Dialer, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy: %s", err)
+	}
+	if u.Scheme != "socks5" {
+		return nil, errors.New("proxy must be a socks5:// URL")
+	}
+	var auth *proxy.Auth
+	if u.User != nil {
+		pw, _ := u.User.Password()
+		auth = &proxy.Auth{User: u.User.Username(), Password: pw}
+	}
+	return proxy.SOCKS5("tcp", u.Host, auth, proxy.Direct)
+}
+
+// WalletConfigs returns the config of each enabled coin's wallet, ready to
+// be passed to the coin's constructor, and applies the proxy. The wallets
+// share db and logger. Coins without backends in the file use the
+// multiwallet's defaults.
+func (cfg *Config) WalletConfigs(db database.Database, logger log.Logger, erp base.ExchangeRateProvider) (map[iwallet.CoinType]*base.WalletConfig, error) {
+	if err := cfg.ApplyProxy(); err != nil {
+		return nil, err
+	}
+
+	var defaults multiwallet.Config
+	if err := multiwallet.Defaults(&defaults); err != nil {
+		return nil, err
+	}
+	if erp == nil {
+		erp = defaults.ExchangeRateProvider
+	}
+
+	network, err := cfg.network()
+	if err != nil {
+		return nil, err
+	}
+
+	configs := make(map[iwallet.CoinType]*base.WalletConfig)
+	for _, ct := range cfg.EnabledCoins() {
+		cc, _ := cfg.coin(ct)
+
+		backends := cc.backends(network)
+		if len(backends) == 0 {
+			def := defaults.WalletAPIs[ct].URL(network)
+			if def == "" {
+				return nil, fmt.Errorf("no %s backend configured for %s", network, ct.CurrencyCode())
+			}
+			backends = []string{def}
+		}
+
+		addrType, err := parseAddressType(cc.AddressType)
+		if err != nil {
+			return nil, err
+		}
+
+		wc := &base.WalletConfig{
+			DB:                   db,
+			Logger:               logger,
+			Testnet:              network == base.NetworkTestnet,
+			Network:              network,
+			ClientURL:            backends[0],
+			FallbackClientURLs:   backends[1:],
+			VerifyClientURL:      cc.VerifyBackend,
+			FeeURL:               cc.FeeURL,
+			ExchangeRateProvider: erp,
+			AddressType:          addrType,
+			LookaheadWindow:      cc.Lookahead,
+			GapLimit:             cc.GapLimit,
+			ReplaceByFee:         cc.ReplaceByFee,
+			PreventAddressReuse:  cc.PreventAddressReuse,
+			CosignerKey:          cc.CosignerKey,
+			Descriptor:           cc.Descriptor,
+			Offline:              cc.Offline,
+			Confirmations: base.ConfirmationPolicy{
+				Settled: cc.Confirmations,
+				Escrow:  cc.EscrowConfirmations,
+			},
+		}
+		if f := cc.Fees; f.Normal > 0 {
+			wc.FeeProvider = base.NewHardCodedFeeProvider(
+				feeRate(f.Priority, f.Normal),
+				feeRate(f.Normal, f.Normal),
+				feeRate(f.Economic, f.Normal),
+				feeRate(f.SuperEconomic, f.Normal),
+			)
+		}
+		configs[ct] = wc
+	}
+	return configs, nil
+}
+
+// feeRate returns rate as an amount, or normal if rate isn't set.
+func feeRate(rate, normal uint64) iwallet.Amount {
+	if rate == 0 {
+		rate = normal
+	}
+	return iwallet.NewAmount(strconv.FormatUint(rate, 10))
+}
+
+func parseAddressType(s string) (base.AddressType, error) {
+	switch strings.ToLower(s) {
+	case "", "native-segwit", "segwit":
+		return base.AddressTypeNativeSegwit, nil
+	case "nested-segwit":
+		return base.AddressTypeNestedSegwit, nil
+	case "legacy":
+		return base.AddressTypeLegacy, nil
+	case "taproot":
+		return base.AddressTypeTaproot, nil
+	}
+	return 0, fmt.Errorf("unknown address type %q", s)
+}
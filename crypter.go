@@ -0,0 +1,375 @@
+package multiwallet
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/cpacia/multiwallet/base"
+	iwallet "github.com/cpacia/wallet-interface"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrPassphrasesDiffer is returned when a wallet's passphrase isn't the one
+// given for all of them. Migrate moves such wallets to one passphrase.
+var ErrPassphrasesDiffer = errors.New("wallet passphrases differ")
+
+// passphraser is implemented by wallets whose keys can be encrypted under a
+// passphrase.
+type passphraser interface {
+	iwallet.WalletCrypter
+	HasPassphrase() (bool, error)
+	VerifyPassphrase(pw []byte) error
+	IsLocked() bool
+	IsWatchOnly() bool
+	TimeUntilLock() time.Duration
+	SetRecoveryHint(pw []byte, hint string) error
+	RecoveryHint() (string, error)
+	DecryptWithSeed(seed []byte, coinIndex uint32) error
+}
+
+// MultiwalletCrypter keeps the keys of every wallet encrypted under a
+// single passphrase so they're unlocked and locked together. Each change is
+// checked against every wallet before it's made and undone if any wallet
+// fails, so the wallets never end up under different passphrases.
+// Watch-only wallets have no keys to encrypt and are skipped.
+type MultiwalletCrypter struct {
+	coins   []iwallet.CoinType
+	wallets map[iwallet.CoinType]passphraser
+
+	mtx sync.Mutex
+}
+
+// NewMultiwalletCrypter returns a crypter over the wallets which can be
+// encrypted.
+func NewMultiwalletCrypter(wallets map[iwallet.CoinType]iwallet.Wallet) *MultiwalletCrypter {
+	c := &MultiwalletCrypter{wallets: make(map[iwallet.CoinType]passphraser)}
+	for ct, wl := range wallets {
+		if p, ok := wl.(passphraser); ok {
+			c.coins = append(c.coins, ct)
+			c.wallets[ct] = p
+		}
+	}
+	sort.Slice(c.coins, func(i, j int) bool {
+		return c.coins[i].CurrencyCode() < c.coins[j].CurrencyCode()
+	})
+	return c
+}
+
+// Encrypted returns whether any wallet has a passphrase.
+func (c *MultiwalletCrypter) Encrypted() (bool, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	encrypted, _, err := c.partition()
+	return len(encrypted) > 0, err
+}
+
+// Check returns the wallets without a passphrase and those with one other
+// than pw. Both are empty once the wallets share pw. Like Unlock each
+// wallet pw doesn't open counts as a failed attempt.
+func (c *MultiwalletCrypter) Check(pw []byte) (unencrypted, differ []iwallet.CoinType, err error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	encrypted, unencrypted, err := c.partition()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, ct := range encrypted {
+		if err := c.wallets[ct].VerifyPassphrase(pw); err != nil {
+			differ = append(differ, ct)
+		}
+	}
+	return unencrypted, differ, nil
+}
+
+// SetPassphrase encrypts every wallet without a passphrase under pw. Any
+// wallet which already has one must have pw.
+func (c *MultiwalletCrypter) SetPassphrase(pw []byte) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	encrypted, unencrypted, err := c.partition()
+	if err != nil {
+		return err
+	}
+	if err := c.verify(encrypted, pw); err != nil {
+		return err
+	}
+	return c.apply(unencrypted, func(_ iwallet.CoinType, p passphraser) error {
+		return p.SetPassphase(pw)
+	}, func(_ iwallet.CoinType, p passphraser) error {
+		return p.RemovePassphrase(pw)
+	})
+}
+
+// ChangePassphrase changes the passphrase of every wallet from old to new.
+// The wallets are locked first.
+func (c *MultiwalletCrypter) ChangePassphrase(old, new []byte) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	encrypted, _, err := c.partition()
+	if err != nil {
+		return err
+	}
+	if len(encrypted) == 0 {
+		return errors.New("wallets are not encrypted")
+	}
+	if err := c.verify(encrypted, old); err != nil {
+		return err
+	}
+	if err := c.lock(encrypted); err != nil {
+		return err
+	}
+	return c.apply(encrypted, func(_ iwallet.CoinType, p passphraser) error {
+		return p.ChangePassphrase(old, new)
+	}, func(_ iwallet.CoinType, p passphraser) error {
+		return p.ChangePassphrase(new, old)
+	})
+}
+
+// RemovePassphrase decrypts every wallet's keys.
+func (c *MultiwalletCrypter) RemovePassphrase(pw []byte) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	encrypted, _, err := c.partition()
+	if err != nil {
+		return err
+	}
+	if len(encrypted) == 0 {
+		return errors.New("wallets are not encrypted")
+	}
+	if err := c.verify(encrypted, pw); err != nil {
+		return err
+	}
+	if err := c.lock(encrypted); err != nil {
+		return err
+	}
+	return c.apply(encrypted, func(_ iwallet.CoinType, p passphraser) error {
+		return p.RemovePassphrase(pw)
+	}, func(_ iwallet.CoinType, p passphraser) error {
+		return p.SetPassphase(pw)
+	})
+}
+
+// Migrate moves wallets encrypted under their own passphrases to pw.
+// passphrases holds the current passphrase of each wallet whose passphrase
+// isn't pw. Wallets without a passphrase are encrypted under pw.
+func (c *MultiwalletCrypter) Migrate(passphrases map[iwallet.CoinType][]byte, pw []byte) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	encrypted, unencrypted, err := c.partition()
+	if err != nil {
+		return err
+	}
+	var moved []iwallet.CoinType
+	for _, ct := range encrypted {
+		old, ok := passphrases[ct]
+		if !ok {
+			old = pw
+		}
+		if err := c.wallets[ct].VerifyPassphrase(old); err != nil {
+			return fmt.Errorf("%w: %s wallet: %s", ErrPassphrasesDiffer, ct.CurrencyCode(), err)
+		}
+		if !bytes.Equal(old, pw) {
+			moved = append(moved, ct)
+		}
+	}
+	if err := c.lock(moved); err != nil {
+		return err
+	}
+	err = c.apply(moved, func(ct iwallet.CoinType, p passphraser) error {
+		return p.ChangePassphrase(passphrases[ct], pw)
+	}, func(ct iwallet.CoinType, p passphraser) error {
+		return p.ChangePassphrase(pw, passphrases[ct])
+	})
+	if err != nil {
+		return err
+	}
+	err = c.apply(unencrypted, func(_ iwallet.CoinType, p passphraser) error {
+		return p.SetPassphase(pw)
+	}, func(_ iwallet.CoinType, p passphraser) error {
+		return p.RemovePassphrase(pw)
+	})
+	if err != nil {
+		for _, ct := range moved {
+			c.wallets[ct].ChangePassphrase(pw, passphrases[ct])
+		}
+		return err
+	}
+	return nil
+}
+
+// SetRecoveryHint saves a hint to the passphrase in every encrypted wallet.
+// See base.Keychain.SetRecoveryHint.
+func (c *MultiwalletCrypter) SetRecoveryHint(pw []byte, hint string) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	encrypted, _, err := c.partition()
+	if err != nil {
+		return err
+	}
+	if len(encrypted) == 0 {
+		return errors.New("wallets are not encrypted")
+	}
+	if err := c.verify(encrypted, pw); err != nil {
+		return err
+	}
+	for _, ct := range encrypted {
+		if err := c.wallets[ct].SetRecoveryHint(pw, hint); err != nil {
+			return fmt.Errorf("error saving %s recovery hint: %s", ct.CurrencyCode(), err)
+		}
+	}
+	return nil
+}
+
+// RecoveryHint returns the hint to the passphrase, or an empty string if
+// none was saved.
+func (c *MultiwalletCrypter) RecoveryHint() (string, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	encrypted, _, err := c.partition()
+	if err != nil {
+		return "", err
+	}
+	for _, ct := range encrypted {
+		hint, err := c.wallets[ct].RecoveryHint()
+		if err != nil || hint != "" {
+			return hint, err
+		}
+	}
+	return "", nil
+}
+
+// DecryptWithSeed removes the passphrase from every encrypted wallet using
+// the seed they were created from, for when the passphrase is lost.
+// coinIndexes holds the BIP 44 coin type each wallet's key was derived
+// with. Wallets the seed doesn't match are left encrypted and
+// base.ErrSeedMismatch is returned once the rest are decrypted. A new
+// passphrase should be set with SetPassphrase straight away.
+func (c *MultiwalletCrypter) DecryptWithSeed(seed []byte, coinIndexes map[iwallet.CoinType]uint32) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	encrypted, _, err := c.partition()
+	if err != nil {
+		return err
+	}
+	var mismatched []string
+	for _, ct := range encrypted {
+		index, ok := coinIndexes[ct]
+		if !ok {
+			return fmt.Errorf("no coin index for the %s wallet", ct.CurrencyCode())
+		}
+		err := c.wallets[ct].DecryptWithSeed(seed, index)
+		if errors.Is(err, base.ErrSeedMismatch) {
+			mismatched = append(mismatched, ct.CurrencyCode())
+		} else if err != nil {
+			return fmt.Errorf("error decrypting %s wallet: %s", ct.CurrencyCode(), err)
+		}
+	}
+	if len(mismatched) > 0 {
+		return fmt.Errorf("%w: %s", base.ErrSeedMismatch, strings.Join(mismatched, ", "))
+	}
+	return nil
+}
+
+// UnlockAll unlocks every locked wallet with the passphrase. If any wallet
+// fails to unlock the ones already unlocked are locked again and the error
+// is returned.
+func (c *MultiwalletCrypter) UnlockAll(pw []byte, howLong time.Duration) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	var unlocked []passphraser
+	for _, ct := range c.coins {
+		p := c.wallets[ct]
+		if !p.IsLocked() {
+			continue
+		}
+		if err := p.Unlock(pw, howLong); err != nil {
+			for _, u := range unlocked {
+				u.Lock()
+			}
+			return fmt.Errorf("error unlocking %s wallet: %s", ct.CurrencyCode(), err)
+		}
+		unlocked = append(unlocked, p)
+	}
+	return nil
+}
+
+// LockAll locks every wallet which is currently unlocked.
+func (c *MultiwalletCrypter) LockAll() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.lock(c.coins)
+}
+
+// partition splits the wallets into those with a passphrase and those
+// without. Watch-only wallets are in neither.
+func (c *MultiwalletCrypter) partition() (encrypted, unencrypted []iwallet.CoinType, err error) {
+	for _, ct := range c.coins {
+		p := c.wallets[ct]
+		if p.IsWatchOnly() {
+			continue
+		}
+		has, err := p.HasPassphrase()
+		if err != nil {
+			return nil, nil, err
+		}
+		if has {
+			encrypted = append(encrypted, ct)
+		} else {
+			unencrypted = append(unencrypted, ct)
+		}
+	}
+	return encrypted, unencrypted, nil
+}
+
+// verify returns ErrPassphrasesDiffer if pw isn't the passphrase of every
+// one of the wallets.
+func (c *MultiwalletCrypter) verify(coins []iwallet.CoinType, pw []byte) error {
+	for _, ct := range coins {
+		if err := c.wallets[ct].VerifyPassphrase(pw); err != nil {
+			return fmt.Errorf("%w: %s wallet: %s", ErrPassphrasesDiffer, ct.CurrencyCode(), err)
+		}
+	}
+	return nil
+}
+
+// lock locks each of the wallets which is unlocked.
+func (c *MultiwalletCrypter) lock(coins []iwallet.CoinType) error {
+	for _, ct := range coins {
+		p := c.wallets[ct]
+		if p.IsLocked() || p.TimeUntilLock() == 0 {
+			continue
+		}
+		if err := p.Lock(); err != nil {
+			return fmt.Errorf("error locking %s wallet: %s", ct.CurrencyCode(), err)
+		}
+	}
+	return nil
+}
+
+// apply runs do on each wallet in turn. If it fails undo is run on the
+// wallets already done, last first, and the error returned.
+func (c *MultiwalletCrypter) apply(coins []iwallet.CoinType, do, undo func(ct iwallet.CoinType, p passphraser) error) error {
+	for i, ct := range coins {
+		if err := do(ct, c.wallets[ct]); err != nil {
+			for j := i - 1; j >= 0; j-- {
+				undo(coins[j], c.wallets[coins[j]])
+			}
+			return fmt.Errorf("error updating %s wallet: %s", ct.CurrencyCode(), err)
+		}
+	}
+	return nil
+}
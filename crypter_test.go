@@ -0,0 +1,144 @@
+package multiwallet
+
+import (
+	"crypto/rand"
+	"errors"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/multiwallet/database"
+	"github.com/cpacia/multiwallet/database/memorydb"
+	"github.com/cpacia/multiwallet/log"
+	"github.com/cpacia/multiwallet/testutil"
+	iwallet "github.com/cpacia/wallet-interface"
+	"testing"
+	"time"
+)
+
+// newTestCrypterWallets returns a started multiwallet with two mock wallets
+// sharing one database.
+func newTestCrypterWallets(t *testing.T) (*Multiwallet, []*testutil.Wallet) {
+	db, err := memorydb.NewMemoryDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.InitializeDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+	logger := log.New("multiwallet")
+	chain := testutil.NewChain()
+	wallets := make(map[iwallet.CoinType]iwallet.Wallet)
+	var mocks []*testutil.Wallet
+	for _, ct := range []iwallet.CoinType{iwallet.CtMock, iwallet.CtBitcoin} {
+		w, err := testutil.NewWallet(&base.WalletConfig{DB: db, Logger: logger}, chain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.CoinType = ct
+		seed := make([]byte, hdkeychain.RecommendedSeedLen)
+		if _, err := rand.Read(seed); err != nil {
+			t.Fatal(err)
+		}
+		xpriv, err := hdkeychain.NewMaster(seed, &chaincfg.RegressionNetParams)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.CreateWallet(*xpriv, nil, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		wallets[ct] = w
+		mocks = append(mocks, w)
+	}
+	mw := newMultiwallet(db, logger, nil, wallets)
+	if err := mw.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return mw, mocks
+}
+
+func TestMultiwalletCrypter(t *testing.T) {
+	mw, wallets := newTestCrypterWallets(t)
+	defer mw.Close()
+	crypter := mw.Crypter()
+
+	pw := []byte("letmein")
+	if err := crypter.SetPassphrase(pw); err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range wallets {
+		if !w.IsLocked() {
+			t.Errorf("Expected %s wallet to be locked", w.CoinType.CurrencyCode())
+		}
+	}
+	if err := crypter.UnlockAll(pw, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := crypter.LockAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	newPw := []byte("opensesame")
+	if err := crypter.ChangePassphrase(pw, newPw); err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range wallets {
+		if err := w.VerifyPassphrase(newPw); err != nil {
+			t.Errorf("Expected %s wallet to have the new passphrase: %s", w.CoinType.CurrencyCode(), err)
+		}
+	}
+
+	if err := crypter.RemovePassphrase(newPw); err != nil {
+		t.Fatal(err)
+	}
+	if encrypted, err := crypter.Encrypted(); err != nil || encrypted {
+		t.Errorf("Expected wallets to be decrypted, got %t, %v", encrypted, err)
+	}
+
+	if err := crypter.SetPassphrase(pw); err != nil {
+		t.Fatal(err)
+	}
+	if err := crypter.ChangePassphrase([]byte("wrong"), newPw); !errors.Is(err, ErrPassphrasesDiffer) {
+		t.Errorf("Expected ErrPassphrasesDiffer, got %v", err)
+	}
+}
+
+func TestMultiwalletCrypter_Migrate(t *testing.T) {
+	mw, wallets := newTestCrypterWallets(t)
+	defer mw.Close()
+	crypter := mw.Crypter()
+
+	// Only the bitcoin wallet has its own passphrase.
+	btcPw := []byte("bitcoin")
+	if err := wallets[1].SetPassphase(btcPw); err != nil {
+		t.Fatal(err)
+	}
+
+	pw := []byte("letmein")
+	unencrypted, differ, err := crypter.Check(pw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unencrypted) != 1 || unencrypted[0] != iwallet.CtMock || len(differ) != 1 || differ[0] != iwallet.CtBitcoin {
+		t.Fatalf("Unexpected check %v, %v", unencrypted, differ)
+	}
+
+	if err := crypter.SetPassphrase(pw); !errors.Is(err, ErrPassphrasesDiffer) {
+		t.Errorf("Expected ErrPassphrasesDiffer, got %v", err)
+	}
+
+	// Wait out the backoff from checking pw against the bitcoin wallet.
+	time.Sleep(time.Second)
+	if err := crypter.Migrate(map[iwallet.CoinType][]byte{iwallet.CtBitcoin: btcPw}, pw); err != nil {
+		t.Fatal(err)
+	}
+	unencrypted, differ, err = crypter.Check(pw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unencrypted) != 0 || len(differ) != 0 {
+		t.Errorf("Expected every wallet to use the passphrase, got %v, %v", unencrypted, differ)
+	}
+	if err := mw.UnlockAll(pw, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+}
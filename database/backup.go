@@ -0,0 +1,356 @@
+package database
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/pbkdf2"
+	"gorm.io/gorm"
+	"io"
+	"time"
+)
+
+const (
+	// BackupVersion is the current version of the backup format.
+	BackupVersion = 1
+
+	backupKdfRounds = 8192
+	backupKeyLen    = 32
+	backupSaltLen   = 32
+
+	// maxBackupKdfRounds bounds the rounds read from a backup's header,
+	// which isn't authenticated until the key has been derived, so a
+	// crafted file can't make the import hang.
+	maxBackupKdfRounds = 1 << 20
+)
+
+var (
+	// backupMagic prefixes every backup file so that we can quickly
+	// reject files that aren't wallet backups.
+	backupMagic = []byte("MWBACKUP")
+
+	// ErrInvalidBackup means the backup is malformed or could not be
+	// decrypted with the provided passphrase.
+	ErrInvalidBackup = errors.New("invalid backup or incorrect passphrase")
+
+	// ErrDatabaseNotEmpty is returned when trying to restore a backup into
+	// a database that already contains wallets.
+	ErrDatabaseNotEmpty = errors.New("backup can only be restored into an empty database")
+)
+
+// Backup is the plaintext contents of a wallet backup.
+type Backup struct {
+	Version              int
+	Created              time.Time
+	Coins                []CoinRecord
+	Addresses            []AddressRecord
+	WatchAddresses       []WatchedAddressRecord
+	Transactions         []TransactionRecord
+	Summaries            []TransactionSummary
+	Utxos                []UtxoRecord
+	Unconfirmed          []UnconfirmedTransaction
+	Escrows              []EscrowRecord
+	Vaults               []VaultRecord
+	Cosigns              []CosignRecord
+	Signings             []SigningRecord
+	PaymentCodes         []PaymentCodeRecord
+	PaymentCodeAddresses []PaymentCodeAddressRecord
+	SilentPayments       []SilentPaymentOutputRecord
+	TransactionMetadata  []TransactionMetadataRecord
+	Invoices             []InvoiceRecord
+	AddressPolicies      []AddressPolicyRecord
+	RejectedSpends       []RejectedSpendRecord
+	Swaps                []SwapRecord
+	AtomicSwaps          []AtomicSwapRecord
+	Nonces               []NonceRecord
+	Spends               []SpendRecord
+	TokenTransfers       []TokenTransferRecord
+	TokenSyncs           []TokenSyncRecord
+	Headers              []HeaderRecord
+}
+
+// ExportBackup serializes the entire contents of the database and encrypts
+// it with a key derived from the passphrase. The returned blob has the format:
+//
+//	magic || version (uint16) || kdf rounds (uint32) || salt || nonce || ciphertext
+//
+// Encryption is done with AES-256-GCM so tampering with the blob will cause
+// the import to fail.
+func ExportBackup(db Database, pw []byte) ([]byte, error) {
+	backup := Backup{
+		Version: BackupVersion,
+		Created: time.Now(),
+	}
+	err := db.View(func(tx Tx) error {
+		models := []interface{}{
+			&backup.Coins,
+			&backup.Addresses,
+			&backup.WatchAddresses,
+			&backup.Transactions,
+			&backup.Summaries,
+			&backup.Utxos,
+			&backup.Unconfirmed,
+			&backup.Escrows,
+			&backup.Vaults,
+			&backup.Cosigns,
+			&backup.Signings,
+			&backup.PaymentCodes,
+			&backup.PaymentCodeAddresses,
+			&backup.SilentPayments,
+			&backup.TransactionMetadata,
+			&backup.Invoices,
+			&backup.AddressPolicies,
+			&backup.RejectedSpends,
+			&backup.Swaps,
+			&backup.AtomicSwaps,
+			&backup.Nonces,
+			&backup.Spends,
+			&backup.TokenTransfers,
+			&backup.TokenSyncs,
+			&backup.Headers,
+		}
+		for _, model := range models {
+			if err := tx.Read().Find(model).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := json.Marshal(&backup)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, backupSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	gcm, err := newBackupCipher(pw, salt, backupKdfRounds)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, len(backupMagic)+6+len(salt)+len(nonce))
+	header = append(header, backupMagic...)
+	header = append(header, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(header[len(backupMagic):], BackupVersion)
+	binary.BigEndian.PutUint32(header[len(backupMagic)+2:], backupKdfRounds)
+	header = append(header, salt...)
+	header = append(header, nonce...)
+
+	// The header is authenticated as additional data so the version and
+	// kdf parameters can't be altered.
+	return gcm.Seal(header, nonce, plaintext, header), nil
+}
+
+// DecryptBackup decrypts and deserializes a backup blob created by ExportBackup.
+func DecryptBackup(blob []byte, pw []byte) (*Backup, error) {
+	prefixLen := len(backupMagic) + 6 + backupSaltLen
+	if len(blob) < prefixLen || !bytes.Equal(blob[:len(backupMagic)], backupMagic) {
+		return nil, ErrInvalidBackup
+	}
+
+	version := binary.BigEndian.Uint16(blob[len(backupMagic):])
+	if version == 0 || version > BackupVersion {
+		return nil, fmt.Errorf("unsupported backup version %d", version)
+	}
+	rounds := binary.BigEndian.Uint32(blob[len(backupMagic)+2:])
+	if rounds < backupKdfRounds || rounds > maxBackupKdfRounds {
+		return nil, ErrInvalidBackup
+	}
+	salt := blob[len(backupMagic)+6 : prefixLen]
+
+	gcm, err := newBackupCipher(pw, salt, int(rounds))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(blob) < prefixLen+gcm.NonceSize() {
+		return nil, ErrInvalidBackup
+	}
+	header := blob[:prefixLen+gcm.NonceSize()]
+	nonce := header[prefixLen:]
+
+	plaintext, err := gcm.Open(nil, nonce, blob[len(header):], header)
+	if err != nil {
+		return nil, ErrInvalidBackup
+	}
+
+	var backup Backup
+	if err := json.Unmarshal(plaintext, &backup); err != nil {
+		return nil, err
+	}
+	return &backup, nil
+}
+
+// ImportBackup decrypts the backup and writes its contents into the
+// database. The database must be initialized and must not already contain
+// any wallets.
+func ImportBackup(db Database, blob []byte, pw []byte) error {
+	backup, err := DecryptBackup(blob, pw)
+	if err != nil {
+		return err
+	}
+
+	return db.Update(func(tx Tx) error {
+		var existing []CoinRecord
+		if err := tx.Read().Find(&existing).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		if len(existing) > 0 {
+			return ErrDatabaseNotEmpty
+		}
+
+		for i := range backup.Coins {
+			if err := tx.Save(&backup.Coins[i]); err != nil {
+				return err
+			}
+		}
+		for i := range backup.Addresses {
+			if err := tx.Save(&backup.Addresses[i]); err != nil {
+				return err
+			}
+		}
+		for i := range backup.WatchAddresses {
+			if err := tx.Save(&backup.WatchAddresses[i]); err != nil {
+				return err
+			}
+		}
+		for i := range backup.Transactions {
+			if err := tx.Save(&backup.Transactions[i]); err != nil {
+				return err
+			}
+		}
+		for i := range backup.Summaries {
+			if err := tx.Save(&backup.Summaries[i]); err != nil {
+				return err
+			}
+		}
+		for i := range backup.Utxos {
+			if err := tx.Save(&backup.Utxos[i]); err != nil {
+				return err
+			}
+		}
+		for i := range backup.Unconfirmed {
+			if err := tx.Save(&backup.Unconfirmed[i]); err != nil {
+				return err
+			}
+		}
+		for i := range backup.Escrows {
+			if err := tx.Save(&backup.Escrows[i]); err != nil {
+				return err
+			}
+		}
+		for i := range backup.Vaults {
+			if err := tx.Save(&backup.Vaults[i]); err != nil {
+				return err
+			}
+		}
+		for i := range backup.Cosigns {
+			if err := tx.Save(&backup.Cosigns[i]); err != nil {
+				return err
+			}
+		}
+		for i := range backup.Signings {
+			if err := tx.Save(&backup.Signings[i]); err != nil {
+				return err
+			}
+		}
+		for i := range backup.PaymentCodes {
+			if err := tx.Save(&backup.PaymentCodes[i]); err != nil {
+				return err
+			}
+		}
+		for i := range backup.PaymentCodeAddresses {
+			if err := tx.Save(&backup.PaymentCodeAddresses[i]); err != nil {
+				return err
+			}
+		}
+		for i := range backup.SilentPayments {
+			if err := tx.Save(&backup.SilentPayments[i]); err != nil {
+				return err
+			}
+		}
+		for i := range backup.TransactionMetadata {
+			if err := tx.Save(&backup.TransactionMetadata[i]); err != nil {
+				return err
+			}
+		}
+		for i := range backup.Invoices {
+			if err := tx.Save(&backup.Invoices[i]); err != nil {
+				return err
+			}
+		}
+		for i := range backup.AddressPolicies {
+			if err := tx.Save(&backup.AddressPolicies[i]); err != nil {
+				return err
+			}
+		}
+		for i := range backup.RejectedSpends {
+			if err := tx.Save(&backup.RejectedSpends[i]); err != nil {
+				return err
+			}
+		}
+		for i := range backup.Swaps {
+			if err := tx.Save(&backup.Swaps[i]); err != nil {
+				return err
+			}
+		}
+		for i := range backup.AtomicSwaps {
+			if err := tx.Save(&backup.AtomicSwaps[i]); err != nil {
+				return err
+			}
+		}
+		for i := range backup.Nonces {
+			if err := tx.Save(&backup.Nonces[i]); err != nil {
+				return err
+			}
+		}
+		for i := range backup.Spends {
+			if err := tx.Save(&backup.Spends[i]); err != nil {
+				return err
+			}
+		}
+		for i := range backup.TokenTransfers {
+			if err := tx.Save(&backup.TokenTransfers[i]); err != nil {
+				return err
+			}
+		}
+		for i := range backup.TokenSyncs {
+			if err := tx.Save(&backup.TokenSyncs[i]); err != nil {
+				return err
+			}
+		}
+		for i := range backup.Headers {
+			if err := tx.Save(&backup.Headers[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func newBackupCipher(pw, salt []byte, rounds int) (cipher.AEAD, error) {
+	dk := pbkdf2.Key(pw, salt, rounds, backupKeyLen, sha512.New)
+	block, err := aes.NewCipher(dk)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
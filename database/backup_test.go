@@ -0,0 +1,158 @@
+package database_test
+
+import (
+	"encoding/binary"
+	"github.com/cpacia/multiwallet/database"
+	"github.com/cpacia/multiwallet/database/sqlitedb"
+	"testing"
+	"time"
+)
+
+func newTestDB(t *testing.T) database.Database {
+	db, err := sqlitedb.NewMemoryDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.InitializeDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestExportImportBackup(t *testing.T) {
+	db := newTestDB(t)
+
+	err := db.Update(func(tx database.Tx) error {
+		if err := tx.Save(&database.CoinRecord{Coin: "TMCK", MasterPub: "xpub"}); err != nil {
+			return err
+		}
+		if err := tx.Save(&database.AddressRecord{Addr: "abc", Coin: "TMCK", Label: "savings"}); err != nil {
+			return err
+		}
+		if err := tx.Save(&database.TransactionRecord{Txid: "1234", Coin: "TMCK"}); err != nil {
+			return err
+		}
+		if err := tx.Save(&database.NonceRecord{Account: "0xabc", Nonce: 7, Txid: "5678"}); err != nil {
+			return err
+		}
+		if err := tx.Save(&database.SpendRecord{Txid: "1234", Coin: "TMCK", Amount: "1000", Timestamp: time.Now()}); err != nil {
+			return err
+		}
+		if err := tx.Save(&database.TokenTransferRecord{ID: "5678:0", Token: "0xdef", Account: "0xabc", Txid: "5678", Value: "1000"}); err != nil {
+			return err
+		}
+		if err := tx.Save(&database.TokenSyncRecord{Token: "0xdef", Account: "0xabc", BlockNumber: 12}); err != nil {
+			return err
+		}
+		if err := tx.Save(&database.HeaderRecord{Coin: "TMCK", Height: 100, Hash: "00ab"}); err != nil {
+			return err
+		}
+		return tx.Save(&database.UtxoRecord{Outpoint: "1234:0", Amount: "1000", Coin: "TMCK"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blob, err := database.ExportBackup(db, []byte("letmein"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := database.DecryptBackup(blob, []byte("wrong")); err != database.ErrInvalidBackup {
+		t.Errorf("Expected ErrInvalidBackup got %v", err)
+	}
+
+	if err := database.ImportBackup(db, blob, []byte("letmein")); err != database.ErrDatabaseNotEmpty {
+		t.Errorf("Expected ErrDatabaseNotEmpty got %v", err)
+	}
+
+	db2 := newTestDB(t)
+	if err := database.ImportBackup(db2, blob, []byte("letmein")); err != nil {
+		t.Fatal(err)
+	}
+
+	err = db2.View(func(tx database.Tx) error {
+		var addr database.AddressRecord
+		if err := tx.Read().Where("addr=?", "abc").First(&addr).Error; err != nil {
+			return err
+		}
+		if addr.Label != "savings" {
+			t.Errorf("Expected label savings got %s", addr.Label)
+		}
+		var utxos []database.UtxoRecord
+		if err := tx.Read().Find(&utxos).Error; err != nil {
+			return err
+		}
+		if len(utxos) != 1 {
+			t.Errorf("Expected 1 utxo got %d", len(utxos))
+		}
+		var txs []database.TransactionRecord
+		if err := tx.Read().Find(&txs).Error; err != nil {
+			return err
+		}
+		if len(txs) != 1 {
+			t.Errorf("Expected 1 tx got %d", len(txs))
+		}
+		var nonces []database.NonceRecord
+		if err := tx.Read().Find(&nonces).Error; err != nil {
+			return err
+		}
+		if len(nonces) != 1 {
+			t.Errorf("Expected 1 nonce got %d", len(nonces))
+		}
+		var spends []database.SpendRecord
+		if err := tx.Read().Find(&spends).Error; err != nil {
+			return err
+		}
+		if len(spends) != 1 {
+			t.Errorf("Expected 1 spend got %d", len(spends))
+		}
+		var transfers []database.TokenTransferRecord
+		if err := tx.Read().Find(&transfers).Error; err != nil {
+			return err
+		}
+		if len(transfers) != 1 {
+			t.Errorf("Expected 1 token transfer got %d", len(transfers))
+		}
+		var syncs []database.TokenSyncRecord
+		if err := tx.Read().Find(&syncs).Error; err != nil {
+			return err
+		}
+		if len(syncs) != 1 {
+			t.Errorf("Expected 1 token sync got %d", len(syncs))
+		}
+		var headers []database.HeaderRecord
+		if err := tx.Read().Find(&headers).Error; err != nil {
+			return err
+		}
+		if len(headers) != 1 {
+			t.Errorf("Expected 1 header got %d", len(headers))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDecryptBackup_Header(t *testing.T) {
+	blob, err := database.ExportBackup(newTestDB(t), []byte("letmein"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const versionOffset, roundsOffset = 8, 10
+
+	tampered := append([]byte(nil), blob...)
+	binary.BigEndian.PutUint16(tampered[versionOffset:], 0)
+	if _, err := database.DecryptBackup(tampered, []byte("letmein")); err == nil {
+		t.Error("Expected version 0 to be rejected")
+	}
+
+	for _, rounds := range []uint32{0, 1, 8191, 0xffffffff} {
+		tampered := append([]byte(nil), blob...)
+		binary.BigEndian.PutUint32(tampered[roundsOffset:], rounds)
+		if _, err := database.DecryptBackup(tampered, []byte("letmein")); err != database.ErrInvalidBackup {
+			t.Errorf("Expected %d rounds to be rejected, got %v", rounds, err)
+		}
+	}
+}
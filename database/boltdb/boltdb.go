@@ -0,0 +1,170 @@
+// Package boltdb implements the Database interface over a bbolt key-value
+// store. Unlike sqlitedb it's pure Go so it can be used where building
+// sqlite with cgo is a problem.
+//
+// Each model is kept in its own bucket, keyed by its primary key, as JSON.
+// Tx.Save, Update, Delete and Migrate and the whole of the Store are
+// supported. Tx.Read can't be, as there is no sql database to query, and
+// every query made through it fails with ErrSQLUnsupported. Code using Read
+// has to move to the Store before it can run on this backend.
+package boltdb
+
+import (
+	"github.com/cpacia/multiwallet/database"
+	"github.com/cpacia/multiwallet/database/internal/kvdb"
+	bolt "go.etcd.io/bbolt"
+	"gorm.io/gorm"
+	"os"
+	"path"
+	"time"
+)
+
+const (
+	DatabaseName = "multiwallet.bolt"
+)
+
+var (
+	ErrReadOnly = kvdb.ErrReadOnly
+)
+
+// DB is an implementation of the Database interface using a bbolt file.
+type DB struct {
+	bolt    *bolt.DB
+	sql     *gorm.DB
+	schemas kvdb.Tables
+}
+
+// NewBoltDB opens, or creates, the bbolt database in the data directory.
+func NewBoltDB(dataDir string) (database.Database, error) {
+	return open(path.Join(dataDir, DatabaseName))
+}
+
+func open(filePath string) (*DB, error) {
+	bdb, err := bolt.Open(filePath, os.FileMode(0600), &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	sql, err := openUnsupportedSQL()
+	if err != nil {
+		bdb.Close()
+		return nil, err
+	}
+	return &DB{bolt: bdb, sql: sql}, nil
+}
+
+// Store returns the database's context-aware Store. Outside of Atomic
+// each call runs in its own bolt transaction.
+func (db *DB) Store() database.Store {
+	return kvdb.NewStore(func(writable bool, fn func(t *kvdb.Tx) error) error {
+		return db.withTx(writable, func(t *tx) error {
+			return fn(t.Tx)
+		})
+	})
+}
+
+// View invokes the passed function in the context of a managed
+// read-only transaction.  Any errors returned from the user-supplied
+// function are returned from this function.
+//
+// Calling Rollback or Commit on the transaction passed to the
+// user-supplied function will result in a panic.
+func (db *DB) View(fn func(tx database.Tx) error) error {
+	return db.withTx(false, func(t *tx) error {
+		return fn(t)
+	})
+}
+
+// Update invokes the passed function in the context of a managed
+// read-write transaction.  Any errors returned from the user-supplied
+// function will cause the transaction to be rolled back and are
+// returned from this function.  Otherwise, the transaction is committed
+// when the user-supplied function returns a nil error.
+//
+// Calling Rollback or Commit on the transaction passed to the
+// user-supplied function will result in a panic.
+func (db *DB) Update(fn func(tx database.Tx) error) error {
+	return db.withTx(true, func(t *tx) error {
+		return fn(t)
+	})
+}
+
+// Close cleanly shuts down the database and syncs all data.  It will
+// block until all database transactions have been finalized (rolled
+// back or committed).
+func (db *DB) Close() error {
+	return db.bolt.Close()
+}
+
+func (db *DB) withTx(writable bool, fn func(t *tx) error) error {
+	btx, err := db.bolt.Begin(writable)
+	if err != nil {
+		return err
+	}
+	t := &tx{db: db, btx: btx}
+	t.Tx = kvdb.NewTx(&db.schemas, t, writable)
+	if err := fn(t); err != nil {
+		t.Rollback()
+		return err
+	}
+	return t.Commit()
+}
+
+// tx embeds the record operations of kvdb.Tx and keeps each table's rows
+// in a bucket.
+type tx struct {
+	*kvdb.Tx
+
+	db  *DB
+	btx *bolt.Tx
+
+	closed bool
+}
+
+// Commit commits all changes that have been made to the db or public data.
+// Depending on the backend implementation this could be to a cache that
+// is periodically synced to persistent storage or directly to persistent
+// storage.  In any case, all transactions which are started after the commit
+// finishes will include all changes made by this transaction.  Calling this
+// function on a managed transaction will result in a panic.
+func (t *tx) Commit() error {
+	if t.closed {
+		panic("tx already closed")
+	}
+
+	defer func() { t.closed = true }()
+
+	if !t.Writable() {
+		return t.btx.Rollback()
+	}
+	return t.btx.Commit()
+}
+
+// Rollback undoes all changes that have been made to the db or public
+// data.  Calling this function on a managed transaction will result in
+// a panic.
+func (t *tx) Rollback() error {
+	if t.closed {
+		panic("tx already closed")
+	}
+
+	defer func() { t.closed = true }()
+
+	return t.btx.Rollback()
+}
+
+// Read returns a sql database on which every query fails with
+// ErrSQLUnsupported.
+func (t *tx) Read() *gorm.DB {
+	return t.db.sql
+}
+
+// Bucket returns the table's bucket.
+func (t *tx) Bucket(name string, create bool) (kvdb.Bucket, error) {
+	if create {
+		return t.btx.CreateBucketIfNotExists([]byte(name))
+	}
+	if b := t.btx.Bucket([]byte(name)); b != nil {
+		return b, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,217 @@
+package boltdb
+
+import (
+	"context"
+	"errors"
+	"github.com/cpacia/multiwallet/database"
+	"github.com/cpacia/multiwallet/database/sqlitedb"
+	iwallet "github.com/cpacia/wallet-interface"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func newTestDB(t *testing.T) (database.Database, func()) {
+	dir, err := ioutil.TempDir("", "boltdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewBoltDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.InitializeDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestBoltDB_UpdateAndView(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+
+	err := db.Update(func(tx database.Tx) error {
+		for _, rec := range []*database.AddressRecord{
+			{Addr: "a", KeyIndex: 0, Coin: iwallet.CtBitcoin},
+			{Addr: "b", KeyIndex: 1, Coin: iwallet.CtBitcoin},
+			{Addr: "c", KeyIndex: 2, Coin: iwallet.CtBitcoin},
+			{Addr: "d", KeyIndex: 0, Coin: iwallet.CtBitcoinCash},
+		} {
+			if err := tx.Save(rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Update(func(tx database.Tx) error {
+		if err := tx.Update("used", true, map[string]interface{}{"coin = ?": iwallet.CtBitcoin, "key_index <= ?": 1}, &database.AddressRecord{}); err != nil {
+			return err
+		}
+		return tx.Delete("addr", "c", &database.AddressRecord{})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addrs, err := db.Store().ListAddresses(context.Background(), iwallet.CtBitcoin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 2 {
+		t.Fatalf("Expected 2 addresses, got %d", len(addrs))
+	}
+	for _, addr := range addrs {
+		if !addr.Used {
+			t.Errorf("Expected address %s to be used", addr.Addr)
+		}
+	}
+
+	// A failed update is rolled back.
+	errAbort := errors.New("abort")
+	err = db.Update(func(tx database.Tx) error {
+		if err := tx.Delete("coin", iwallet.CtBitcoin, &database.AddressRecord{}); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	if err != errAbort {
+		t.Fatalf("Expected abort error, got %v", err)
+	}
+	addrs, err = db.Store().ListAddresses(context.Background(), iwallet.CtBitcoin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 2 {
+		t.Errorf("Expected 2 addresses, got %d", len(addrs))
+	}
+
+	err = db.View(func(tx database.Tx) error {
+		if err := tx.Save(&database.AddressRecord{Addr: "e"}); err != ErrReadOnly {
+			t.Errorf("Expected ErrReadOnly, got %v", err)
+		}
+		var records []database.AddressRecord
+		if err := tx.Read().Where("coin=?", iwallet.CtBitcoin).Find(&records).Error; err != ErrSQLUnsupported {
+			t.Errorf("Expected ErrSQLUnsupported, got %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBoltDB_Store(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+
+	store := db.Store()
+	ctx := context.Background()
+	now := time.Now()
+
+	err := store.Atomic(ctx, func(s database.Store) error {
+		if err := s.SaveTransaction(ctx, &database.TransactionRecord{Txid: "a", Coin: iwallet.CtBitcoinCash, Timestamp: now.Add(-time.Hour)}); err != nil {
+			return err
+		}
+		return s.SaveTransaction(ctx, &database.TransactionRecord{Txid: "b", Coin: iwallet.CtBitcoinCash, Timestamp: now})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	txs, err := store.ListTransactions(ctx, iwallet.CtBitcoinCash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txs) != 2 || txs[0].Txid != "b" {
+		t.Errorf("Expected newest transaction first, got %v", txs)
+	}
+	if _, err := store.GetTransaction(ctx, iwallet.CtBitcoinCash, "a"); err != nil {
+		t.Error(err)
+	}
+	if _, err := store.GetTransaction(ctx, iwallet.CtBitcoin, "a"); err != database.ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	if err := store.SaveUtxo(ctx, &database.UtxoRecord{Outpoint: "aa", Coin: iwallet.CtBitcoinCash}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteUtxo(ctx, iwallet.CtBitcoinCash, "aa"); err != nil {
+		t.Fatal(err)
+	}
+	utxos, err := store.ListUtxos(ctx, iwallet.CtBitcoinCash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(utxos) != 0 {
+		t.Errorf("Expected utxo to be deleted")
+	}
+}
+
+func TestMigrateFromSQL(t *testing.T) {
+	src, err := sqlitedb.NewMemoryDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.InitializeDatabase(src); err != nil {
+		t.Fatal(err)
+	}
+	err = src.Update(func(tx database.Tx) error {
+		if err := tx.Save(&database.CoinRecord{Coin: iwallet.CtBitcoin, BestBlockHeight: 100}); err != nil {
+			return err
+		}
+		if err := tx.Save(&database.HeaderRecord{Coin: iwallet.CtBitcoin, Height: 1, Hash: "abc"}); err != nil {
+			return err
+		}
+		return tx.Save(&database.HeaderRecord{Coin: iwallet.CtBitcoin, Height: 2, Hash: "def"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "boltdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := MigrateFromSQL(src, dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := MigrateFromSQL(src, dir); err != ErrDatabaseExists {
+		t.Errorf("Expected ErrDatabaseExists, got %v", err)
+	}
+
+	db, err := NewBoltDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	coin, err := db.Store().GetCoin(context.Background(), iwallet.CtBitcoin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if coin.BestBlockHeight != 100 {
+		t.Errorf("Expected height 100, got %d", coin.BestBlockHeight)
+	}
+	err = db.View(func(dbtx database.Tx) error {
+		var headers []database.HeaderRecord
+		if err := dbtx.(*tx).Find(&headers); err != nil {
+			return err
+		}
+		if len(headers) != 2 {
+			t.Errorf("Expected 2 headers, got %d", len(headers))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,55 @@
+package boltdb
+
+import (
+	"errors"
+	"github.com/cpacia/multiwallet/database"
+	"gorm.io/gorm"
+	"os"
+	"path"
+	"reflect"
+)
+
+// ErrDatabaseExists is returned by MigrateFromSQL if there is already a
+// bolt database in the data directory.
+var ErrDatabaseExists = errors.New("bolt database already exists")
+
+// MigrateFromSQL copies every record in the sql database into a new bolt
+// database in the data directory. If the copy fails the new database is
+// removed so it can be retried.
+func MigrateFromSQL(src database.Database, dataDir string) (err error) {
+	filePath := path.Join(dataDir, DatabaseName)
+	if _, err := os.Stat(filePath); err == nil {
+		return ErrDatabaseExists
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	dst, err := open(filePath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		dst.Close()
+		if err != nil {
+			os.Remove(filePath)
+		}
+	}()
+
+	if err := database.InitializeDatabase(dst); err != nil {
+		return err
+	}
+	return src.View(func(stx database.Tx) error {
+		return dst.withTx(true, func(dtx *tx) error {
+			for _, model := range database.Models() {
+				records := reflect.New(reflect.SliceOf(reflect.TypeOf(model).Elem()))
+				if err := stx.Read().Find(records.Interface()).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+					return err
+				}
+				if err := dtx.SaveAll(records.Interface()); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
@@ -0,0 +1,82 @@
+package boltdb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/callbacks"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/logger"
+	"gorm.io/gorm/migrator"
+	"gorm.io/gorm/schema"
+)
+
+// ErrSQLUnsupported is returned by queries made through Tx.Read.
+var ErrSQLUnsupported = errors.New("sql queries are not supported by the bolt database")
+
+// openUnsupportedSQL returns the gorm database handed out by Tx.Read.
+// Queries are built as normal but fail when they're executed.
+func openUnsupportedSQL() (*gorm.DB, error) {
+	return gorm.Open(unsupportedDialector{}, &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+}
+
+type unsupportedDialector struct{}
+
+func (unsupportedDialector) Name() string {
+	return "bolt"
+}
+
+func (d unsupportedDialector) Initialize(db *gorm.DB) error {
+	callbacks.RegisterDefaultCallbacks(db, &callbacks.Config{})
+	db.ConnPool = unsupportedConnPool{}
+	return nil
+}
+
+func (d unsupportedDialector) Migrator(db *gorm.DB) gorm.Migrator {
+	return migrator.Migrator{Config: migrator.Config{DB: db, Dialector: d}}
+}
+
+func (unsupportedDialector) DataTypeOf(field *schema.Field) string {
+	return string(field.DataType)
+}
+
+func (unsupportedDialector) DefaultValueOf(field *schema.Field) clause.Expression {
+	return clause.Expr{SQL: "DEFAULT"}
+}
+
+func (unsupportedDialector) BindVarTo(writer clause.Writer, stmt *gorm.Statement, v interface{}) {
+	writer.WriteByte('?')
+}
+
+func (unsupportedDialector) QuoteTo(writer clause.Writer, str string) {
+	writer.WriteByte('"')
+	writer.WriteString(str)
+	writer.WriteByte('"')
+}
+
+func (unsupportedDialector) Explain(sql string, vars ...interface{}) string {
+	return logger.ExplainSQL(sql, nil, `"`, vars...)
+}
+
+type unsupportedConnPool struct{}
+
+func (unsupportedConnPool) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	return nil, ErrSQLUnsupported
+}
+
+func (unsupportedConnPool) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return nil, ErrSQLUnsupported
+}
+
+func (unsupportedConnPool) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return nil, ErrSQLUnsupported
+}
+
+// QueryRowContext can't return an error so it returns nil. Row and Scan
+// on the gorm database must not be used.
+func (unsupportedConnPool) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return nil
+}
@@ -33,6 +33,10 @@ type Tx interface {
 	// it will be overridden.
 	Save(i interface{}) error
 
+	// SaveAll saves a slice of models, or of pointers to models, using as
+	// few statements as possible. Existing models are overridden.
+	SaveAll(models interface{}) error
+
 	// Update will update the given key to the value for the given model. The
 	// where map can be used to impose extra conditions on which specific model
 	// gets updated. The map key must be of the format "key = ?". This allows
@@ -69,6 +73,10 @@ type Database interface {
 	// user-supplied function will result in a panic.
 	Update(fn func(tx Tx) error) error
 
+	// Store returns the database's context-aware Store. New code should
+	// prefer it over View and Update, which expose the sql database.
+	Store() Store
+
 	// Close cleanly shuts down the database and syncs all data.  It will
 	// block until all database transactions have been finalized (rolled
 	// back or committed).
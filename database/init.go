@@ -1,16 +1,39 @@
 package database
 
+// Models returns an instance of each model stored in the database.
+func Models() []interface{} {
+	return []interface{}{
+		&CoinRecord{},
+		&UtxoRecord{},
+		&TransactionRecord{},
+		&TransactionSummary{},
+		&TransactionMetadataRecord{},
+		&AddressRecord{},
+		&WatchedAddressRecord{},
+		&UnconfirmedTransaction{},
+		&HeaderRecord{},
+		&EscrowRecord{},
+		&InvoiceRecord{},
+		&SwapRecord{},
+		&AtomicSwapRecord{},
+		&SpendRecord{},
+		&AddressPolicyRecord{},
+		&RejectedSpendRecord{},
+		&VaultRecord{},
+		&CosignRecord{},
+		&SigningRecord{},
+		&PaymentCodeRecord{},
+		&PaymentCodeAddressRecord{},
+		&SilentPaymentOutputRecord{},
+		&NonceRecord{},
+		&TokenTransferRecord{},
+		&TokenSyncRecord{},
+	}
+}
+
 func InitializeDatabase(db Database) error {
 	return db.Update(func(tx Tx) error {
-		models := []interface{}{
-			&CoinRecord{},
-			&UtxoRecord{},
-			&TransactionRecord{},
-			&AddressRecord{},
-			&WatchedAddressRecord{},
-			&UnconfirmedTransaction{},
-		}
-		for _, model := range models {
+		for _, model := range Models() {
 			if err := tx.Migrate(model); err != nil {
 				return err
 			}
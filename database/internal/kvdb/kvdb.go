@@ -0,0 +1,263 @@
+// Package kvdb holds the parts of the key-value database backends which
+// don't depend on where the rows are kept: the tables built from the gorm
+// schemas, where conditions and their evaluation, the record operations of
+// database.Tx and the Store. Each backend supplies the Buckets a
+// transaction's rows are read from and written to.
+//
+// Records are kept as JSON, one bucket per model, keyed by their primary
+// key.
+package kvdb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+var (
+	// ErrReadOnly is returned when a read-only transaction is written to.
+	ErrReadOnly = errors.New("tx is read only")
+
+	// ErrUnsupportedQuery is returned for conditions and queries the
+	// backends can't evaluate.
+	ErrUnsupportedQuery = errors.New("unsupported query")
+)
+
+// Bucket holds a table's rows in a transaction.
+type Bucket interface {
+	Put(key, value []byte) error
+	Delete(key []byte) error
+
+	// ForEach invokes fn with each row in key order. The key and value
+	// are only valid until fn returns and fn must not change the bucket.
+	ForEach(fn func(key, value []byte) error) error
+}
+
+// Buckets opens the buckets of a backend's transaction.
+type Buckets interface {
+	// Bucket returns the named bucket. If it doesn't exist it's created
+	// if create is set and otherwise nil is returned.
+	Bucket(name string, create bool) (Bucket, error)
+}
+
+// Tx implements the record operations of database.Tx over a backend's
+// buckets. The backends embed it in their transactions.
+type Tx struct {
+	tables   *Tables
+	buckets  Buckets
+	writable bool
+}
+
+// NewTx returns a Tx which reads and writes the buckets.
+func NewTx(tables *Tables, buckets Buckets, writable bool) *Tx {
+	return &Tx{tables: tables, buckets: buckets, writable: writable}
+}
+
+// Writable returns whether the transaction may be written to.
+func (t *Tx) Writable() bool {
+	return t.writable
+}
+
+// Table returns the table for the model.
+func (t *Tx) Table(model interface{}) (*Table, error) {
+	return t.tables.Table(model)
+}
+
+// Save will save the passed in model to the database. If it already exists
+// it will be overridden.
+func (t *Tx) Save(model interface{}) error {
+	if !t.writable {
+		return ErrReadOnly
+	}
+	return t.put(model)
+}
+
+// SaveAll saves each of the models.
+func (t *Tx) SaveAll(models interface{}) error {
+	if !t.writable {
+		return ErrReadOnly
+	}
+	v := reflect.Indirect(reflect.ValueOf(models))
+	if v.Kind() != reflect.Slice {
+		return fmt.Errorf("cannot save %T, expected a slice", models)
+	}
+	for i := 0; i < v.Len(); i++ {
+		model := v.Index(i)
+		if model.Kind() != reflect.Ptr {
+			model = model.Addr()
+		}
+		if err := t.put(model.Interface()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Update will update the given key to the value for the given model. The
+// where map keys must be of the format "key = ?", where the operator may
+// also be one of !=, <, <=, > or >=.
+func (t *Tx) Update(key string, value interface{}, where map[string]interface{}, model interface{}) error {
+	if !t.writable {
+		return ErrReadOnly
+	}
+	conds := make([]Condition, 0, len(where))
+	for k, v := range where {
+		cond, err := ParseCondition(k, v)
+		if err != nil {
+			return err
+		}
+		conds = append(conds, cond)
+	}
+	return t.UpdateWhere(model, key, value, conds)
+}
+
+// Delete will delete all models of the given type from the database where
+// field == key.
+func (t *Tx) Delete(key string, value interface{}, model interface{}) error {
+	if !t.writable {
+		return ErrReadOnly
+	}
+	_, err := t.DeleteWhere(model, []Condition{Eq(key, value)})
+	return err
+}
+
+// Migrate creates the model's bucket. Records are stored as JSON so there
+// is no schema to migrate.
+func (t *Tx) Migrate(model interface{}) error {
+	if !t.writable {
+		return ErrReadOnly
+	}
+	tbl, err := t.tables.Table(model)
+	if err != nil {
+		return err
+	}
+	_, err = t.buckets.Bucket(tbl.Name, true)
+	return err
+}
+
+// put saves the record, which must be a pointer to a model.
+func (t *Tx) put(model interface{}) error {
+	tbl, err := t.tables.Table(model)
+	if err != nil {
+		return err
+	}
+	rv := reflect.ValueOf(model)
+	for rv.Kind() == reflect.Ptr && rv.Elem().Kind() == reflect.Ptr {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("cannot save %T", model)
+	}
+	ser, err := json.Marshal(rv.Interface())
+	if err != nil {
+		return err
+	}
+	b, err := t.buckets.Bucket(tbl.Name, true)
+	if err != nil {
+		return err
+	}
+	return b.Put(tbl.Key(rv.Elem()), ser)
+}
+
+// Each invokes fn, in primary key order, with each of the table's records
+// which meet the conditions. The key is only valid until fn returns.
+func (t *Tx) Each(tbl *Table, conds []Condition, fn func(key []byte, record reflect.Value) error) error {
+	b, err := t.buckets.Bucket(tbl.Name, false)
+	if err != nil || b == nil {
+		return err
+	}
+	return b.ForEach(func(k, v []byte) error {
+		record := reflect.New(tbl.Schema.ModelType)
+		if err := json.Unmarshal(v, record.Interface()); err != nil {
+			return err
+		}
+		ok, err := tbl.Matches(record.Elem(), conds)
+		if err != nil || !ok {
+			return err
+		}
+		return fn(k, record)
+	})
+}
+
+// Find appends the records which meet the conditions to out, which must be
+// a pointer to a slice of models.
+func (t *Tx) Find(out interface{}, conds ...Condition) error {
+	tbl, err := t.tables.Table(out)
+	if err != nil {
+		return err
+	}
+	slice := reflect.ValueOf(out).Elem()
+	return t.Each(tbl, conds, func(_ []byte, record reflect.Value) error {
+		slice.Set(reflect.Append(slice, record.Elem()))
+		return nil
+	})
+}
+
+// UpdateWhere sets the column to value on the records which meet the
+// conditions.
+func (t *Tx) UpdateWhere(model interface{}, column string, value interface{}, conds []Condition) error {
+	tbl, err := t.tables.Table(model)
+	if err != nil {
+		return err
+	}
+	field := tbl.Schema.LookUpField(column)
+	if field == nil {
+		return fmt.Errorf("unknown column %s", column)
+	}
+	var records []reflect.Value
+	err = t.Each(tbl, conds, func(_ []byte, record reflect.Value) error {
+		records = append(records, record)
+		return nil
+	})
+	if err != nil || len(records) == 0 {
+		return err
+	}
+	b, err := t.buckets.Bucket(tbl.Name, true)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		oldKey := tbl.Key(record.Elem())
+		fv := field.ReflectValueOf(record.Elem())
+		v := reflect.ValueOf(value)
+		if !v.Type().ConvertibleTo(fv.Type()) {
+			return fmt.Errorf("cannot set %s to %T", column, value)
+		}
+		fv.Set(v.Convert(fv.Type()))
+		if err := b.Delete(oldKey); err != nil {
+			return err
+		}
+		if err := t.put(record.Interface()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteWhere deletes the records which meet the conditions and returns
+// the number deleted.
+func (t *Tx) DeleteWhere(model interface{}, conds []Condition) (int, error) {
+	tbl, err := t.tables.Table(model)
+	if err != nil {
+		return 0, err
+	}
+	var keys [][]byte
+	err = t.Each(tbl, conds, func(key []byte, _ reflect.Value) error {
+		keys = append(keys, append([]byte(nil), key...))
+		return nil
+	})
+	if err != nil || len(keys) == 0 {
+		return 0, err
+	}
+	b, err := t.buckets.Bucket(tbl.Name, true)
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range keys {
+		if err := b.Delete(key); err != nil {
+			return 0, err
+		}
+	}
+	return len(keys), nil
+}
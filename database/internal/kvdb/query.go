@@ -0,0 +1,134 @@
+package kvdb
+
+import (
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+	"strings"
+)
+
+// WhereConditions converts the statement's where clause to conditions.
+// Only conditions joined with AND are supported.
+func WhereConditions(tbl *Table, stmt *gorm.Statement) ([]Condition, error) {
+	c, ok := stmt.Clauses["WHERE"]
+	if !ok {
+		return nil, nil
+	}
+	where, ok := c.Expression.(clause.Where)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", ErrUnsupportedQuery, c.Expression)
+	}
+	conds := make([]Condition, 0, len(where.Exprs))
+	for _, expr := range where.Exprs {
+		var (
+			cond Condition
+			err  error
+		)
+		switch e := expr.(type) {
+		case clause.Expr:
+			if len(e.Vars) != 1 {
+				return nil, fmt.Errorf("%w: %q", ErrUnsupportedQuery, e.SQL)
+			}
+			cond, err = ParseCondition(e.SQL, e.Vars[0])
+		case clause.Eq:
+			cond, err = columnCondition(tbl, e.Column, "=", e.Value)
+		case clause.Neq:
+			cond, err = columnCondition(tbl, e.Column, "!=", e.Value)
+		case clause.Lt:
+			cond, err = columnCondition(tbl, e.Column, "<", e.Value)
+		case clause.Lte:
+			cond, err = columnCondition(tbl, e.Column, "<=", e.Value)
+		case clause.Gt:
+			cond, err = columnCondition(tbl, e.Column, ">", e.Value)
+		case clause.Gte:
+			cond, err = columnCondition(tbl, e.Column, ">=", e.Value)
+		default:
+			err = fmt.Errorf("%w: %T", ErrUnsupportedQuery, expr)
+		}
+		if err != nil {
+			return nil, err
+		}
+		conds = append(conds, cond)
+	}
+	return conds, nil
+}
+
+// columnCondition builds a condition from a gorm column, which may be a
+// name or a clause.Column.
+func columnCondition(tbl *Table, column interface{}, op string, value interface{}) (Condition, error) {
+	var name string
+	switch c := column.(type) {
+	case string:
+		name = c
+	case clause.Column:
+		name = c.Name
+	default:
+		return Condition{}, fmt.Errorf("%w: column %T", ErrUnsupportedQuery, column)
+	}
+	if name == clause.PrimaryKey {
+		if len(tbl.Schema.PrimaryFields) != 1 {
+			return Condition{}, fmt.Errorf("%w: %s has a composite primary key", ErrUnsupportedQuery, tbl.Name)
+		}
+		name = tbl.Schema.PrimaryFields[0].DBName
+	}
+	return Condition{Column: name, Op: op, Value: value}, nil
+}
+
+// Ordering is a field a query's results are sorted by.
+type Ordering struct {
+	Field *schema.Field
+	Desc  bool
+}
+
+// OrderBy returns the fields the statement orders by. Raw columns may be
+// of the form "column", "column asc" or "column desc", separated by
+// commas.
+func OrderBy(tbl *Table, stmt *gorm.Statement) ([]Ordering, error) {
+	c, ok := stmt.Clauses["ORDER BY"]
+	if !ok {
+		return nil, nil
+	}
+	ob, ok := c.Expression.(clause.OrderBy)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", ErrUnsupportedQuery, c.Expression)
+	}
+	var order []Ordering
+	add := func(name string, desc bool) error {
+		if name == clause.PrimaryKey {
+			for _, field := range tbl.Schema.PrimaryFields {
+				order = append(order, Ordering{Field: field, Desc: desc})
+			}
+			return nil
+		}
+		field := tbl.Schema.LookUpField(name)
+		if field == nil {
+			return fmt.Errorf("unknown column %s", name)
+		}
+		order = append(order, Ordering{Field: field, Desc: desc})
+		return nil
+	}
+	for _, col := range ob.Columns {
+		if !col.Column.Raw {
+			if err := add(col.Column.Name, col.Desc); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		for _, part := range strings.Split(col.Column.Name, ",") {
+			fields := strings.Fields(part)
+			desc := col.Desc
+			switch {
+			case len(fields) == 2 && strings.EqualFold(fields[1], "desc"):
+				desc = true
+			case len(fields) == 2 && strings.EqualFold(fields[1], "asc"):
+			case len(fields) != 1:
+				return nil, fmt.Errorf("%w: order by %q", ErrUnsupportedQuery, part)
+			}
+			if err := add(fields[0], desc); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return order, nil
+}
@@ -0,0 +1,173 @@
+package kvdb
+
+import (
+	"context"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"sort"
+)
+
+// Store implements database.Store over a backend. Outside of Atomic each
+// call runs in its own transaction.
+type Store struct {
+	withTx func(writable bool, fn func(t *Tx) error) error
+	tx     *Tx
+}
+
+// NewStore returns a Store whose calls run in the transactions begun by
+// withTx.
+func NewStore(withTx func(writable bool, fn func(t *Tx) error) error) *Store {
+	return &Store{withTx: withTx}
+}
+
+// run invokes fn in the Atomic transaction or a new one.
+func (s *Store) run(ctx context.Context, writable bool, fn func(t *Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if s.tx != nil {
+		if writable && !s.tx.writable {
+			return ErrReadOnly
+		}
+		return fn(s.tx)
+	}
+	return s.withTx(writable, fn)
+}
+
+// Atomic invokes fn with a Store backed by a single transaction. A
+// nested call joins the outer transaction.
+func (s *Store) Atomic(ctx context.Context, fn func(store database.Store) error) error {
+	return s.run(ctx, true, func(t *Tx) error {
+		return fn(&Store{withTx: s.withTx, tx: t})
+	})
+}
+
+func (s *Store) GetCoin(ctx context.Context, coinType iwallet.CoinType) (*database.CoinRecord, error) {
+	var records []database.CoinRecord
+	err := s.run(ctx, false, func(t *Tx) error {
+		return t.Find(&records, Eq("coin", coinType.CurrencyCode()))
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, database.ErrNotFound
+	}
+	return &records[0], nil
+}
+
+func (s *Store) SaveCoin(ctx context.Context, record *database.CoinRecord) error {
+	return s.run(ctx, true, func(t *Tx) error {
+		return t.put(record)
+	})
+}
+
+func (s *Store) GetAddress(ctx context.Context, addr iwallet.Address) (*database.AddressRecord, error) {
+	var records []database.AddressRecord
+	err := s.run(ctx, false, func(t *Tx) error {
+		return t.Find(&records, Eq("addr", addr.String()), Eq("coin", addr.CoinType.CurrencyCode()))
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, database.ErrNotFound
+	}
+	return &records[0], nil
+}
+
+func (s *Store) ListAddresses(ctx context.Context, coinType iwallet.CoinType) ([]database.AddressRecord, error) {
+	var records []database.AddressRecord
+	err := s.run(ctx, false, func(t *Tx) error {
+		return t.Find(&records, Eq("coin", coinType.CurrencyCode()))
+	})
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Change != records[j].Change {
+			return !records[i].Change
+		}
+		return records[i].KeyIndex < records[j].KeyIndex
+	})
+	return records, err
+}
+
+func (s *Store) SaveAddress(ctx context.Context, record *database.AddressRecord) error {
+	return s.run(ctx, true, func(t *Tx) error {
+		return t.put(record)
+	})
+}
+
+func (s *Store) ListUtxos(ctx context.Context, coinType iwallet.CoinType) ([]database.UtxoRecord, error) {
+	var records []database.UtxoRecord
+	err := s.run(ctx, false, func(t *Tx) error {
+		return t.Find(&records, Eq("coin", coinType.CurrencyCode()))
+	})
+	return records, err
+}
+
+func (s *Store) SaveUtxo(ctx context.Context, record *database.UtxoRecord) error {
+	return s.run(ctx, true, func(t *Tx) error {
+		return t.put(record)
+	})
+}
+
+func (s *Store) DeleteUtxo(ctx context.Context, coinType iwallet.CoinType, outpoint string) error {
+	return s.run(ctx, true, func(t *Tx) error {
+		_, err := t.DeleteWhere(&database.UtxoRecord{}, []Condition{Eq("coin", coinType.CurrencyCode()), Eq("outpoint", outpoint)})
+		return err
+	})
+}
+
+func (s *Store) GetTransaction(ctx context.Context, coinType iwallet.CoinType, id iwallet.TransactionID) (*database.TransactionRecord, error) {
+	var records []database.TransactionRecord
+	err := s.run(ctx, false, func(t *Tx) error {
+		return t.Find(&records, Eq("coin", coinType.CurrencyCode()), Eq("txid", id.String()))
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, database.ErrNotFound
+	}
+	return &records[0], nil
+}
+
+func (s *Store) ListTransactions(ctx context.Context, coinType iwallet.CoinType) ([]database.TransactionRecord, error) {
+	var records []database.TransactionRecord
+	err := s.run(ctx, false, func(t *Tx) error {
+		return t.Find(&records, Eq("coin", coinType.CurrencyCode()))
+	})
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Timestamp.After(records[j].Timestamp)
+	})
+	return records, err
+}
+
+func (s *Store) SaveTransaction(ctx context.Context, record *database.TransactionRecord) error {
+	return s.run(ctx, true, func(t *Tx) error {
+		return t.put(record)
+	})
+}
+
+func (s *Store) ListUnconfirmed(ctx context.Context, coinType iwallet.CoinType) ([]database.UnconfirmedTransaction, error) {
+	var records []database.UnconfirmedTransaction
+	err := s.run(ctx, false, func(t *Tx) error {
+		return t.Find(&records, Eq("coin", coinType.CurrencyCode()))
+	})
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Timestamp.Before(records[j].Timestamp)
+	})
+	return records, err
+}
+
+func (s *Store) SaveUnconfirmed(ctx context.Context, record *database.UnconfirmedTransaction) error {
+	return s.run(ctx, true, func(t *Tx) error {
+		return t.put(record)
+	})
+}
+
+func (s *Store) DeleteUnconfirmed(ctx context.Context, coinType iwallet.CoinType, id iwallet.TransactionID) error {
+	return s.run(ctx, true, func(t *Tx) error {
+		_, err := t.DeleteWhere(&database.UnconfirmedTransaction{}, []Condition{Eq("coin", coinType.CurrencyCode()), Eq("txid", id.String())})
+		return err
+	})
+}
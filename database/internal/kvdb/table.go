@@ -0,0 +1,207 @@
+package kvdb
+
+import (
+	"bytes"
+	"fmt"
+	"gorm.io/gorm/schema"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Table describes how a model is stored. The gorm schema is used so the
+// primary key and column names match the sql backend.
+type Table struct {
+	Schema *schema.Schema
+	Name   string
+}
+
+// Tables caches the tables of the models. The zero value is ready to use.
+type Tables struct {
+	tables sync.Map
+}
+
+// Table returns the table for a model, which may be a pointer to a struct
+// or to a slice of structs.
+func (ts *Tables) Table(model interface{}) (*Table, error) {
+	typ := reflect.TypeOf(model)
+	for typ.Kind() == reflect.Ptr || typ.Kind() == reflect.Slice {
+		typ = typ.Elem()
+	}
+	if tbl, ok := ts.tables.Load(typ); ok {
+		return tbl.(*Table), nil
+	}
+	s, err := schema.Parse(reflect.New(typ).Interface(), &sync.Map{}, schema.NamingStrategy{})
+	if err != nil {
+		return nil, err
+	}
+	if len(s.PrimaryFields) == 0 {
+		return nil, fmt.Errorf("model %s has no primary key", s.Name)
+	}
+	tbl := &Table{Schema: s, Name: s.Table}
+	ts.tables.Store(typ, tbl)
+	return tbl, nil
+}
+
+// Key joins the record's primary key fields.
+func (tbl *Table) Key(record reflect.Value) []byte {
+	parts := make([]string, len(tbl.Schema.PrimaryFields))
+	for i, field := range tbl.Schema.PrimaryFields {
+		parts[i] = fmt.Sprint(field.ReflectValueOf(record).Interface())
+	}
+	return []byte(strings.Join(parts, "\x00"))
+}
+
+// Condition is a comparison of a column against a value.
+type Condition struct {
+	Column string
+	Op     string
+	Value  interface{}
+}
+
+// Eq returns the condition that the column equals the value.
+func Eq(column string, value interface{}) Condition {
+	return Condition{Column: column, Op: "=", Value: value}
+}
+
+// ParseCondition parses a where clause of the form "column op ?".
+func ParseCondition(clause string, value interface{}) (Condition, error) {
+	clause = strings.TrimSpace(clause)
+	if !strings.HasSuffix(clause, "?") {
+		return Condition{}, fmt.Errorf("%w: %q", ErrUnsupportedQuery, clause)
+	}
+	clause = strings.TrimSpace(strings.TrimSuffix(clause, "?"))
+	for _, op := range []string{">=", "<=", "!=", "<>", "=", "<", ">"} {
+		if strings.HasSuffix(clause, op) {
+			column := strings.TrimSpace(strings.TrimSuffix(clause, op))
+			if column == "" || strings.ContainsAny(column, " ()") {
+				break
+			}
+			if op == "<>" {
+				op = "!="
+			}
+			return Condition{Column: column, Op: op, Value: value}, nil
+		}
+	}
+	return Condition{}, fmt.Errorf("%w: %q", ErrUnsupportedQuery, clause)
+}
+
+// Matches reports whether the record meets all the conditions.
+func (tbl *Table) Matches(record reflect.Value, conds []Condition) (bool, error) {
+	for _, cond := range conds {
+		field := tbl.Schema.LookUpField(cond.Column)
+		if field == nil {
+			return false, fmt.Errorf("unknown column %s", cond.Column)
+		}
+		cmp, err := Compare(field.ReflectValueOf(record), reflect.ValueOf(cond.Value))
+		if err != nil {
+			return false, err
+		}
+		var ok bool
+		switch cond.Op {
+		case "=":
+			ok = cmp == 0
+		case "!=":
+			ok = cmp != 0
+		case "<":
+			ok = cmp < 0
+		case "<=":
+			ok = cmp <= 0
+		case ">":
+			ok = cmp > 0
+		case ">=":
+			ok = cmp >= 0
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// Compare orders a field's value against a condition's value. The value
+// may be of any type with the same kind as the field, so a CoinType can be
+// compared to a string column.
+func Compare(a, b reflect.Value) (int, error) {
+	for b.Kind() == reflect.Ptr && !b.IsNil() {
+		b = b.Elem()
+	}
+	if !b.IsValid() {
+		return 0, fmt.Errorf("cannot compare %s with nil", a.Type())
+	}
+	switch a.Kind() {
+	case reflect.String:
+		if b.Kind() == reflect.String {
+			return strings.Compare(a.String(), b.String()), nil
+		}
+	case reflect.Bool:
+		if b.Kind() == reflect.Bool {
+			if a.Bool() == b.Bool() {
+				return 0, nil
+			}
+			if b.Bool() {
+				return -1, nil
+			}
+			return 1, nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		x, okA := toInt(a)
+		y, okB := toInt(b)
+		if okA && okB {
+			switch {
+			case x.neg != y.neg:
+				if x.neg {
+					return -1, nil
+				}
+				return 1, nil
+			case x.mag == y.mag:
+				return 0, nil
+			case (x.mag < y.mag) != x.neg:
+				return -1, nil
+			default:
+				return 1, nil
+			}
+		}
+	case reflect.Slice:
+		if a.Type().Elem().Kind() == reflect.Uint8 && b.Kind() == reflect.Slice && b.Type().Elem().Kind() == reflect.Uint8 {
+			return bytes.Compare(a.Bytes(), b.Bytes()), nil
+		}
+	case reflect.Struct:
+		if a.Type() == timeType && b.Type() == timeType {
+			x, y := a.Interface().(time.Time), b.Interface().(time.Time)
+			switch {
+			case x.Before(y):
+				return -1, nil
+			case x.After(y):
+				return 1, nil
+			}
+			return 0, nil
+		}
+	}
+	return 0, fmt.Errorf("cannot compare %s with %s", a.Type(), b.Type())
+}
+
+// integer is a sign and magnitude so signed and unsigned values compare
+// without overflow.
+type integer struct {
+	neg bool
+	mag uint64
+}
+
+func toInt(v reflect.Value) (integer, bool) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n := v.Int()
+		if n < 0 {
+			return integer{neg: true, mag: uint64(-n)}, true
+		}
+		return integer{mag: uint64(n)}, true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return integer{mag: v.Uint()}, true
+	}
+	return integer{}, false
+}
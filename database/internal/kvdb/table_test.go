@@ -0,0 +1,68 @@
+package kvdb
+
+import (
+	"errors"
+	iwallet "github.com/cpacia/wallet-interface"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseCondition(t *testing.T) {
+	tests := []struct {
+		clause string
+		column string
+		op     string
+	}{
+		{"coin = ?", "coin", "="},
+		{"coin=?", "coin", "="},
+		{"height >= ?", "height", ">="},
+		{"height<?", "height", "<"},
+		{"txid <> ?", "txid", "!="},
+	}
+	for _, test := range tests {
+		cond, err := ParseCondition(test.clause, 1)
+		if err != nil {
+			t.Errorf("%q: %s", test.clause, err)
+			continue
+		}
+		if cond.Column != test.column || cond.Op != test.op {
+			t.Errorf("%q: got %+v", test.clause, cond)
+		}
+	}
+	for _, clause := range []string{"coin", "coin = 1", "coin = ? OR used = ?", "(coin) = ?", "= ?"} {
+		if _, err := ParseCondition(clause, 1); !errors.Is(err, ErrUnsupportedQuery) {
+			t.Errorf("%q: expected ErrUnsupportedQuery, got %v", clause, err)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		a, b interface{}
+		cmp  int
+	}{
+		{"BTC", iwallet.CoinType("BTC"), 0},
+		{"a", "b", -1},
+		{int64(-1), uint64(1), -1},
+		{uint32(5), 5, 0},
+		{uint64(1 << 63), int64(-1), 1},
+		{true, false, 1},
+		{[]byte{1}, []byte{1, 0}, -1},
+		{now, now.Add(time.Second), -1},
+	}
+	for _, test := range tests {
+		cmp, err := Compare(reflect.ValueOf(test.a), reflect.ValueOf(test.b))
+		if err != nil {
+			t.Errorf("%v, %v: %s", test.a, test.b, err)
+			continue
+		}
+		if cmp != test.cmp {
+			t.Errorf("%v, %v: expected %d, got %d", test.a, test.b, test.cmp, cmp)
+		}
+	}
+	if _, err := Compare(reflect.ValueOf("1"), reflect.ValueOf(1)); err == nil {
+		t.Error("Expected a string and an int not to compare")
+	}
+}
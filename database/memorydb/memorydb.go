@@ -0,0 +1,211 @@
+// Package memorydb implements the Database interface entirely in memory.
+// It needs neither cgo nor a file so it suits unit tests and simulations
+// of wallet flows.
+//
+// Records are kept as JSON in per-model tables keyed by their primary key.
+// Queries made through Tx.Read are evaluated in Go by a gorm dialector, so
+// existing code runs unchanged, but only the subset of sql the wallets use
+// is understood: Where conditions of the form "column op ?", Order by
+// columns, Limit, Offset, Find, First, Count and Delete. Anything else
+// fails with ErrUnsupportedQuery. Rows are returned in primary key order
+// unless the query orders them, so results are deterministic.
+package memorydb
+
+import (
+	"github.com/cpacia/multiwallet/database"
+	"github.com/cpacia/multiwallet/database/internal/kvdb"
+	"gorm.io/gorm"
+	"sort"
+	"sync"
+)
+
+var (
+	ErrReadOnly = kvdb.ErrReadOnly
+)
+
+// DB is an implementation of the Database interface held in memory.
+type DB struct {
+	tables  map[string]map[string][]byte
+	sql     *gorm.DB
+	schemas kvdb.Tables
+	mtx     sync.Mutex
+}
+
+// NewMemoryDB returns a new, empty database.
+func NewMemoryDB() (database.Database, error) {
+	sql, err := openSQL()
+	if err != nil {
+		return nil, err
+	}
+	return &DB{tables: make(map[string]map[string][]byte), sql: sql}, nil
+}
+
+// Store returns the database's context-aware Store.
+func (db *DB) Store() database.Store {
+	return kvdb.NewStore(func(writable bool, fn func(t *kvdb.Tx) error) error {
+		return db.withTx(writable, func(t *tx) error {
+			return fn(t.Tx)
+		})
+	})
+}
+
+// View invokes the passed function in the context of a managed
+// read-only transaction.  Any errors returned from the user-supplied
+// function are returned from this function.
+//
+// Calling Rollback or Commit on the transaction passed to the
+// user-supplied function will result in a panic.
+func (db *DB) View(fn func(tx database.Tx) error) error {
+	return db.withTx(false, func(t *tx) error {
+		return fn(t)
+	})
+}
+
+// Update invokes the passed function in the context of a managed
+// read-write transaction.  Any errors returned from the user-supplied
+// function will cause the transaction to be rolled back and are
+// returned from this function.  Otherwise, the transaction is committed
+// when the user-supplied function returns a nil error.
+//
+// Calling Rollback or Commit on the transaction passed to the
+// user-supplied function will result in a panic.
+func (db *DB) Update(fn func(tx database.Tx) error) error {
+	return db.withTx(true, func(t *tx) error {
+		return fn(t)
+	})
+}
+
+// Close does nothing. The data is discarded when the DB is garbage
+// collected.
+func (db *DB) Close() error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+
+	return nil
+}
+
+// withTx runs fn in a transaction. Transactions are serialized, like the
+// sqlite backend, and a writable one works on copies of the tables it
+// changes which replace the originals on commit.
+func (db *DB) withTx(writable bool, fn func(t *tx) error) error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+
+	t := &tx{db: db, tables: db.tables}
+	if writable {
+		t.tables = make(map[string]map[string][]byte, len(db.tables))
+		for name, rows := range db.tables {
+			t.tables[name] = rows
+		}
+		t.copied = make(map[string]bool)
+	}
+	t.Tx = kvdb.NewTx(&db.schemas, t, writable)
+	if err := fn(t); err != nil {
+		t.Rollback()
+		return err
+	}
+	return t.Commit()
+}
+
+// tx embeds the record operations of kvdb.Tx and keeps each table's rows
+// in a map.
+type tx struct {
+	*kvdb.Tx
+
+	db     *DB
+	tables map[string]map[string][]byte
+	copied map[string]bool
+
+	closed bool
+}
+
+// Commit commits all changes that have been made to the db or public data.
+// Depending on the backend implementation this could be to a cache that
+// is periodically synced to persistent storage or directly to persistent
+// storage.  In any case, all transactions which are started after the commit
+// finishes will include all changes made by this transaction.  Calling this
+// function on a managed transaction will result in a panic.
+func (t *tx) Commit() error {
+	if t.closed {
+		panic("tx already closed")
+	}
+
+	defer func() { t.closed = true }()
+
+	if t.Writable() {
+		t.db.tables = t.tables
+	}
+	return nil
+}
+
+// Rollback undoes all changes that have been made to the db or public
+// data.  Calling this function on a managed transaction will result in
+// a panic.
+func (t *tx) Rollback() error {
+	if t.closed {
+		panic("tx already closed")
+	}
+
+	defer func() { t.closed = true }()
+
+	return nil
+}
+
+// Read returns a gorm database whose queries are evaluated against this
+// transaction.
+func (t *tx) Read() *gorm.DB {
+	return t.db.sql.WithContext(withTx(t))
+}
+
+// Bucket returns the table's rows in the transaction. When create is set
+// the table is created if needed and copied the first time so the
+// committed data is left alone until the transaction commits.
+func (t *tx) Bucket(name string, create bool) (kvdb.Bucket, error) {
+	if !create {
+		if _, ok := t.tables[name]; !ok {
+			return nil, nil
+		}
+		return &bucket{t: t, name: name}, nil
+	}
+	if !t.copied[name] {
+		rows := t.tables[name]
+		cp := make(map[string][]byte, len(rows))
+		for k, v := range rows {
+			cp[k] = v
+		}
+		t.tables[name] = cp
+		t.copied[name] = true
+	}
+	return &bucket{t: t, name: name}, nil
+}
+
+// bucket is a table's rows in a transaction.
+type bucket struct {
+	t    *tx
+	name string
+}
+
+func (b *bucket) Put(key, value []byte) error {
+	b.t.tables[b.name][string(key)] = value
+	return nil
+}
+
+func (b *bucket) Delete(key []byte) error {
+	delete(b.t.tables[b.name], string(key))
+	return nil
+}
+
+func (b *bucket) ForEach(fn func(key, value []byte) error) error {
+	rows := b.t.tables[b.name]
+	keys := make([]string, 0, len(rows))
+	for k := range rows {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := fn([]byte(k), rows[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package memorydb
+
+import (
+	"context"
+	"errors"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"gorm.io/gorm"
+	"testing"
+	"time"
+)
+
+func newTestDB(t *testing.T) database.Database {
+	db, err := NewMemoryDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.InitializeDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestMemoryDB_UpdateAndView(t *testing.T) {
+	db := newTestDB(t)
+
+	err := db.Update(func(tx database.Tx) error {
+		return tx.SaveAll([]*database.AddressRecord{
+			{Addr: "c", KeyIndex: 2, Coin: iwallet.CtBitcoin},
+			{Addr: "a", KeyIndex: 0, Coin: iwallet.CtBitcoin},
+			{Addr: "b", KeyIndex: 1, Coin: iwallet.CtBitcoin},
+			{Addr: "d", KeyIndex: 0, Coin: iwallet.CtBitcoinCash},
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Update(func(tx database.Tx) error {
+		if err := tx.Update("used", true, map[string]interface{}{"coin = ?": iwallet.CtBitcoin, "key_index <= ?": 1}, &database.AddressRecord{}); err != nil {
+			return err
+		}
+		return tx.Delete("addr", "c", &database.AddressRecord{})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.View(func(tx database.Tx) error {
+		var records []database.AddressRecord
+		if err := tx.Read().Where("coin=?", iwallet.CtBitcoin).Find(&records).Error; err != nil {
+			return err
+		}
+		if len(records) != 2 || records[0].Addr != "a" || records[1].Addr != "b" {
+			t.Errorf("Expected addresses a and b in key order, got %v", records)
+		}
+		for _, rec := range records {
+			if !rec.Used {
+				t.Errorf("Expected address %s to be used", rec.Addr)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed update is rolled back.
+	errAbort := errors.New("abort")
+	err = db.Update(func(tx database.Tx) error {
+		if err := tx.Delete("coin", iwallet.CtBitcoin, &database.AddressRecord{}); err != nil {
+			return err
+		}
+		var records []database.AddressRecord
+		if err := tx.Read().Where("coin=?", iwallet.CtBitcoin).Find(&records).Error; err != nil {
+			return err
+		}
+		if len(records) != 0 {
+			t.Errorf("Expected the transaction to see its own deletes")
+		}
+		return errAbort
+	})
+	if err != errAbort {
+		t.Fatalf("Expected abort error, got %v", err)
+	}
+	addrs, err := db.Store().ListAddresses(context.Background(), iwallet.CtBitcoin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 2 {
+		t.Errorf("Expected 2 addresses, got %d", len(addrs))
+	}
+
+	err = db.View(func(tx database.Tx) error {
+		if err := tx.Save(&database.AddressRecord{Addr: "e"}); err != ErrReadOnly {
+			t.Errorf("Expected ErrReadOnly, got %v", err)
+		}
+		var records []database.AddressRecord
+		if err := tx.Read().Where("coin=? OR used=?", iwallet.CtBitcoin, true).Find(&records).Error; !errors.Is(err, ErrUnsupportedQuery) {
+			t.Errorf("Expected ErrUnsupportedQuery, got %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryDB_Read(t *testing.T) {
+	db := newTestDB(t)
+
+	now := time.Now()
+	err := db.Update(func(tx database.Tx) error {
+		for i, txid := range []string{"a", "b", "c", "d"} {
+			err := tx.Save(&database.TransactionRecord{
+				Txid:        txid,
+				Coin:        iwallet.CtBitcoin,
+				BlockHeight: uint64(i),
+				Timestamp:   now.Add(time.Minute * time.Duration(i)),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.View(func(tx database.Tx) error {
+		var records []database.TransactionRecord
+		if err := tx.Read().Where("coin=?", iwallet.CtBitcoin).Where("block_height>?", 0).Order("timestamp desc").Limit(2).Find(&records).Error; err != nil {
+			return err
+		}
+		if len(records) != 2 || records[0].Txid != "d" || records[1].Txid != "c" {
+			t.Errorf("Unexpected records %v", records)
+		}
+
+		records = nil
+		if err := tx.Read().Where("coin=?", iwallet.CtBitcoin).Where("timestamp < ?", now.Add(time.Minute*2)).Order("timestamp asc").Find(&records).Error; err != nil {
+			return err
+		}
+		if len(records) != 2 || records[0].Txid != "a" || records[1].Txid != "b" {
+			t.Errorf("Unexpected records %v", records)
+		}
+
+		var record database.TransactionRecord
+		if err := tx.Read().Order("block_height desc").Where("coin=?", iwallet.CtBitcoin).First(&record).Error; err != nil {
+			return err
+		}
+		if record.Txid != "d" {
+			t.Errorf("Expected d, got %s", record.Txid)
+		}
+		if err := tx.Read().Where("txid=?", "e").First(&record).Error; !errors.Is(err, gorm.ErrRecordNotFound) {
+			t.Errorf("Expected ErrRecordNotFound, got %v", err)
+		}
+
+		var count int64
+		if err := tx.Read().Model(&database.TransactionRecord{}).Where("block_height >= ?", 2).Count(&count).Error; err != nil {
+			return err
+		}
+		if count != 2 {
+			t.Errorf("Expected count 2, got %d", count)
+		}
+		if err := tx.Read().Where("block_height > ?", 2).Delete(&database.TransactionRecord{}).Error; err != ErrReadOnly {
+			t.Errorf("Expected ErrReadOnly, got %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Update(func(tx database.Tx) error {
+		return tx.Read().Where("coin=?", iwallet.CtBitcoin).Where("block_height > ?", 1).Delete(&database.TransactionRecord{}).Error
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.View(func(tx database.Tx) error {
+		var records []database.TransactionRecord
+		if err := tx.Read().Find(&records).Error; err != nil {
+			return err
+		}
+		if len(records) != 2 || records[0].Txid != "a" || records[1].Txid != "b" {
+			t.Errorf("Unexpected records after delete %v", records)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryDB_Store(t *testing.T) {
+	db := newTestDB(t)
+
+	store := db.Store()
+	ctx := context.Background()
+	now := time.Now()
+
+	err := store.Atomic(ctx, func(s database.Store) error {
+		if err := s.SaveTransaction(ctx, &database.TransactionRecord{Txid: "a", Coin: iwallet.CtBitcoinCash, Timestamp: now.Add(-time.Hour)}); err != nil {
+			return err
+		}
+		return s.SaveTransaction(ctx, &database.TransactionRecord{Txid: "b", Coin: iwallet.CtBitcoinCash, Timestamp: now})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	txs, err := store.ListTransactions(ctx, iwallet.CtBitcoinCash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txs) != 2 || txs[0].Txid != "b" {
+		t.Errorf("Expected newest transaction first, got %v", txs)
+	}
+	if _, err := store.GetTransaction(ctx, iwallet.CtBitcoin, "a"); err != database.ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	if err := store.SaveUtxo(ctx, &database.UtxoRecord{Outpoint: "aa", Coin: iwallet.CtBitcoinCash}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteUtxo(ctx, iwallet.CtBitcoinCash, "aa"); err != nil {
+		t.Fatal(err)
+	}
+	utxos, err := store.ListUtxos(ctx, iwallet.CtBitcoinCash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(utxos) != 0 {
+		t.Errorf("Expected utxo to be deleted")
+	}
+}
@@ -0,0 +1,250 @@
+package memorydb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/cpacia/multiwallet/database/internal/kvdb"
+	"gorm.io/gorm"
+	"gorm.io/gorm/callbacks"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/logger"
+	"gorm.io/gorm/migrator"
+	"gorm.io/gorm/schema"
+	"reflect"
+	"sort"
+)
+
+// ErrUnsupportedQuery is returned by queries made through Tx.Read which
+// the memory database can't evaluate.
+var ErrUnsupportedQuery = kvdb.ErrUnsupportedQuery
+
+type txKey struct{}
+
+// withTx returns the context the transaction's queries are made with.
+func withTx(t *tx) context.Context {
+	return context.WithValue(context.Background(), txKey{}, t)
+}
+
+// openSQL returns the gorm database handed out by Tx.Read. Statements are
+// built as normal and evaluated in memory instead of being sent to a sql
+// database.
+func openSQL() (*gorm.DB, error) {
+	return gorm.Open(dialector{}, &gorm.Config{
+		AllowGlobalUpdate:      true,
+		SkipDefaultTransaction: true,
+		Logger:                 logger.Default.LogMode(logger.Silent),
+	})
+}
+
+type dialector struct{}
+
+func (dialector) Name() string {
+	return "memory"
+}
+
+func (d dialector) Initialize(db *gorm.DB) error {
+	callbacks.RegisterDefaultCallbacks(db, &callbacks.Config{})
+	db.ConnPool = unsupportedConnPool{}
+	if err := db.Callback().Query().Replace("gorm:query", queryCallback); err != nil {
+		return err
+	}
+	return db.Callback().Delete().Replace("gorm:delete", deleteCallback)
+}
+
+func (d dialector) Migrator(db *gorm.DB) gorm.Migrator {
+	return migrator.Migrator{Config: migrator.Config{DB: db, Dialector: d}}
+}
+
+func (dialector) DataTypeOf(field *schema.Field) string {
+	return string(field.DataType)
+}
+
+func (dialector) DefaultValueOf(field *schema.Field) clause.Expression {
+	return clause.Expr{SQL: "DEFAULT"}
+}
+
+func (dialector) BindVarTo(writer clause.Writer, stmt *gorm.Statement, v interface{}) {
+	writer.WriteByte('?')
+}
+
+func (dialector) QuoteTo(writer clause.Writer, str string) {
+	writer.WriteByte('"')
+	writer.WriteString(str)
+	writer.WriteByte('"')
+}
+
+func (dialector) Explain(sql string, vars ...interface{}) string {
+	return logger.ExplainSQL(sql, nil, `"`, vars...)
+}
+
+// statement returns the transaction, table and conditions of the
+// statement.
+func statement(db *gorm.DB) (*tx, *kvdb.Table, []kvdb.Condition, error) {
+	stmt := db.Statement
+	t, ok := stmt.Context.Value(txKey{}).(*tx)
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("%w: queries must be made through Tx.Read", ErrUnsupportedQuery)
+	}
+	if stmt.Schema == nil {
+		return nil, nil, nil, fmt.Errorf("%w: no model", ErrUnsupportedQuery)
+	}
+	tbl, err := t.Table(reflect.New(stmt.Schema.ModelType).Interface())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	conds, err := kvdb.WhereConditions(tbl, stmt)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return t, tbl, conds, nil
+}
+
+// queryCallback runs a query statement against the transaction in its
+// context and scans the result into the destination.
+func queryCallback(db *gorm.DB) {
+	if db.Error != nil {
+		return
+	}
+	stmt := db.Statement
+	t, tbl, conds, err := statement(db)
+	if err != nil {
+		db.AddError(err)
+		return
+	}
+	order, err := kvdb.OrderBy(tbl, stmt)
+	if err != nil {
+		db.AddError(err)
+		return
+	}
+
+	var records []reflect.Value
+	err = t.Each(tbl, conds, func(_ []byte, record reflect.Value) error {
+		records = append(records, record.Elem())
+		return nil
+	})
+	if err != nil {
+		db.AddError(err)
+		return
+	}
+
+	// Count ignores the order and limit.
+	if count, ok := stmt.Dest.(*int64); ok {
+		*count = int64(len(records))
+		db.RowsAffected = int64(len(records))
+		return
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		for _, o := range order {
+			cmp, _ := kvdb.Compare(o.Field.ReflectValueOf(records[i]), o.Field.ReflectValueOf(records[j]))
+			if cmp != 0 {
+				return (cmp < 0) != o.Desc
+			}
+		}
+		return false
+	})
+	if c, ok := stmt.Clauses["LIMIT"]; ok {
+		if limit, ok := c.Expression.(clause.Limit); ok {
+			if limit.Offset > 0 {
+				if limit.Offset >= len(records) {
+					records = nil
+				} else {
+					records = records[limit.Offset:]
+				}
+			}
+			if limit.Limit > 0 && limit.Limit < len(records) {
+				records = records[:limit.Limit]
+			}
+		}
+	}
+	db.RowsAffected = int64(len(records))
+
+	dest := stmt.ReflectValue
+	switch dest.Kind() {
+	case reflect.Slice:
+		elem := dest.Type().Elem()
+		slice := reflect.MakeSlice(dest.Type(), 0, len(records))
+		for _, record := range records {
+			switch {
+			case elem == record.Type():
+				slice = reflect.Append(slice, record)
+			case elem.Kind() == reflect.Ptr && elem.Elem() == record.Type():
+				ptr := reflect.New(record.Type())
+				ptr.Elem().Set(record)
+				slice = reflect.Append(slice, ptr)
+			default:
+				db.AddError(fmt.Errorf("%w: cannot scan %s into %s", ErrUnsupportedQuery, record.Type(), elem))
+				return
+			}
+		}
+		dest.Set(slice)
+	case reflect.Struct:
+		if len(records) == 0 {
+			if stmt.RaiseErrorOnNotFound {
+				db.AddError(gorm.ErrRecordNotFound)
+			}
+			return
+		}
+		if dest.Type() != records[0].Type() {
+			db.AddError(fmt.Errorf("%w: cannot scan %s into %s", ErrUnsupportedQuery, records[0].Type(), dest.Type()))
+			return
+		}
+		dest.Set(records[0])
+	default:
+		db.AddError(fmt.Errorf("%w: cannot scan into %s", ErrUnsupportedQuery, dest.Type()))
+	}
+}
+
+// deleteCallback deletes the records which meet the statement's
+// conditions. If the model's primary key is set only that record is
+// deleted.
+func deleteCallback(db *gorm.DB) {
+	if db.Error != nil {
+		return
+	}
+	t, tbl, conds, err := statement(db)
+	if err != nil {
+		db.AddError(err)
+		return
+	}
+	if !t.Writable() {
+		db.AddError(ErrReadOnly)
+		return
+	}
+	if db.Statement.ReflectValue.Kind() == reflect.Struct {
+		for _, field := range tbl.Schema.PrimaryFields {
+			if v, zero := field.ValueOf(db.Statement.ReflectValue); !zero {
+				conds = append(conds, kvdb.Eq(field.DBName, v))
+			}
+		}
+	}
+	n, err := t.DeleteWhere(db.Statement.Model, conds)
+	if err != nil {
+		db.AddError(err)
+		return
+	}
+	db.RowsAffected = int64(n)
+}
+
+// unsupportedConnPool fails every statement which isn't evaluated in
+// memory, such as updates or raw sql made through Tx.Read.
+type unsupportedConnPool struct{}
+
+func (unsupportedConnPool) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	return nil, ErrUnsupportedQuery
+}
+
+func (unsupportedConnPool) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return nil, ErrUnsupportedQuery
+}
+
+func (unsupportedConnPool) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return nil, ErrUnsupportedQuery
+}
+
+// QueryRowContext can't return an error so it returns nil. Row and Scan
+// on the gorm database must not be used.
+func (unsupportedConnPool) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return nil
+}
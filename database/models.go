@@ -19,6 +19,24 @@ type CoinRecord struct {
 	Birthday           time.Time
 	BestBlockHeight    uint64
 	BestBlockID        string
+
+	// PaymentCode is the wallet's BIP 47 payment code. It's saved the
+	// first time the private key is available so it can be shown while
+	// the wallet is locked.
+	PaymentCode string
+
+	// SilentPaymentScanKey and SilentPaymentSpendKey are the hex encoded
+	// BIP 352 scan private key and spend public key. Like the payment
+	// code they're saved when the private key is first available so the
+	// wallet can scan for payments while locked. SilentPaymentHeight is
+	// the next block to scan.
+	SilentPaymentScanKey  string
+	SilentPaymentSpendKey string
+	SilentPaymentHeight   uint64
+
+	// RecoveryHint is the encrypted hint to the passphrase saved by
+	// Keychain.SetRecoveryHint.
+	RecoveryHint string
 }
 
 func (c *CoinRecord) MasterPrivateKey() (*hd.ExtendedKey, error) {
@@ -40,11 +58,14 @@ func (c *CoinRecord) BlockchainInfo() iwallet.BlockInfo {
 }
 
 type AddressRecord struct {
-	Addr     string `gorm:"primary_key"`
-	KeyIndex int
-	Change   bool
-	Used     bool
-	Coin     string `gorm:"index"`
+	Addr      string `gorm:"primary_key"`
+	KeyIndex  int
+	Change    bool
+	Used      bool
+	Coin      string `gorm:"index"`
+	Label     string
+	Notes     string
+	CreatedAt time.Time
 }
 
 func (ar *AddressRecord) Address() iwallet.Address {
@@ -63,19 +84,71 @@ type TransactionRecord struct {
 	BlockHeight            uint64
 	Timestamp              time.Time
 	Coin                   string `gorm:"index"`
+
+	// BlockID is the block the transaction confirmed in. It's used to
+	// detect transactions reorged out of the main chain.
+	BlockID string
+
+	// ConflictedBy is the ID of a transaction spending the same inputs
+	// as this unconfirmed transaction. If it confirms this one never
+	// will.
+	ConflictedBy string
+
+	// Status is one of the TxStatus values. ReplacedBy is the ID of the
+	// transaction which replaced this one if its status is
+	// TxStatusReplaced.
+	Status     string
+	ReplacedBy string
+
+	// Settled is set once the transaction has the confirmations needed
+	// to settle it and a TransactionSettledEvent has been emitted. It's
+	// cleared when the record is saved again with a new height.
+	Settled bool
 }
 
+// The statuses of a TransactionRecord. Records saved before statuses were
+// recorded have none and are pending or confirmed by their height.
+const (
+	// TxStatusPending transactions are unconfirmed.
+	TxStatusPending = "pending"
+
+	// TxStatusConfirmed transactions are in a block.
+	TxStatusConfirmed = "confirmed"
+
+	// TxStatusReplaced transactions were replaced by the wallet with
+	// another spending the same inputs, such as by a fee bump.
+	TxStatusReplaced = "replaced"
+
+	// TxStatusConflicted transactions are unconfirmed and double spent
+	// by the transaction in ConflictedBy.
+	TxStatusConflicted = "conflicted"
+
+	// TxStatusAbandoned transactions were dropped by the user so their
+	// inputs could be spent again.
+	TxStatusAbandoned = "abandoned"
+)
+
 func NewTransactionRecord(tx iwallet.Transaction, coinType iwallet.CoinType) (*TransactionRecord, error) {
 	out, err := json.MarshalIndent(&tx, "", "    ")
 	if err != nil {
 		return nil, err
 	}
+	var blockID string
+	if tx.Height > 0 && tx.BlockInfo != nil {
+		blockID = tx.BlockInfo.BlockID.String()
+	}
+	status := TxStatusPending
+	if tx.Height > 0 {
+		status = TxStatusConfirmed
+	}
 	return &TransactionRecord{
 		Txid:                   tx.ID.String(),
 		SerlializedTransaction: out,
 		BlockHeight:            tx.Height,
 		Timestamp:              tx.Timestamp,
 		Coin:                   coinType.CurrencyCode(),
+		BlockID:                blockID,
+		Status:                 status,
 	}, nil
 }
 
@@ -95,10 +168,48 @@ func (tr *TransactionRecord) Height() uint64 {
 	return tr.BlockHeight
 }
 
+// Dropped returns whether the unconfirmed transaction was replaced or
+// abandoned and so is left out of the wallet's utxos.
+func (tr *TransactionRecord) Dropped() bool {
+	return tr.BlockHeight == 0 && (tr.Status == TxStatusReplaced || tr.Status == TxStatusAbandoned)
+}
+
 func (tr *TransactionRecord) CoinType() iwallet.CoinType {
 	return iwallet.CoinType(tr.Coin)
 }
 
+// TransactionSummary replaces a TransactionRecord removed by history
+// pruning. It keeps the fields needed to export the transaction but not
+// the transaction itself.
+type TransactionSummary struct {
+	Txid        string `gorm:"primary_key;unique;not null"`
+	BlockHeight uint64
+	Timestamp   time.Time
+	Coin        string `gorm:"index"`
+
+	// Value is the net change to the wallet's balance and Fee the fee
+	// paid by the wallet, if any.
+	Value string
+	Fee   string
+
+	// From and To are the addresses of the inputs and outputs joined
+	// with semicolons.
+	From string
+	To   string
+}
+
+// TransactionMetadataRecord is user supplied bookkeeping metadata for a
+// transaction. It's kept apart from the TransactionRecord so it can be set
+// before the transaction is saved and survives history pruning.
+type TransactionMetadataRecord struct {
+	Txid      string `gorm:"primary_key"`
+	Coin      string `gorm:"index"`
+	Note      string
+	Category  string `gorm:"index"`
+	OrderID   string `gorm:"index"`
+	UpdatedAt time.Time
+}
+
 type UtxoRecord struct {
 	Outpoint  string `gorm:"primary_key;unique;not null"`
 	Height    uint64
@@ -106,6 +217,13 @@ type UtxoRecord struct {
 	Amount    string
 	Address   string
 	Coin      string `gorm:"index"`
+
+	// Frozen utxos are excluded from coin selection.
+	Frozen bool
+
+	// Source is where the utxo came from, such as the invoice it paid.
+	// It's empty if the source isn't known. See base.UtxoSource.
+	Source string
 }
 
 type UnconfirmedTransaction struct {
@@ -113,4 +231,304 @@ type UnconfirmedTransaction struct {
 	TxBytes   []byte
 	Timestamp time.Time
 	Coin      string `gorm:"index"`
+
+	// LockTime is the transaction's nLockTime. Transactions are held
+	// back from broadcast until it is final.
+	LockTime uint32
+
+	// Attempts is the number of times the transaction has been handed
+	// to the chain client and LastError the error from the most recent
+	// failed attempt. NextAttempt is when the rebroadcaster will retry.
+	Attempts    int
+	LastAttempt time.Time
+	NextAttempt time.Time
+	LastError   string
+
+	// Seen is set once the chain client reports the transaction in the
+	// mempool. The record is deleted when the transaction confirms.
+	Seen bool
+
+	// Inputs are the hex encoded outpoints the transaction spends,
+	// separated by semicolons. They're kept out of coin selection while
+	// the transaction is queued so spends made while the backend is
+	// unreachable don't spend the same coins.
+	Inputs string
+}
+
+// EscrowRecord is a multisig escrow address the wallet participates in.
+type EscrowRecord struct {
+	Addr         string `gorm:"primary_key"`
+	Coin         string `gorm:"index"`
+	RedeemScript []byte
+	Role         string
+	Threshold    int
+	CreatedAt    time.Time
+
+	// Counterparties are the hex encoded keys of the other parties
+	// joined with semicolons.
+	Counterparties string
+
+	// Timeout is how long after funding the escrow can be released
+	// without the other parties' signatures. It's zero for escrows
+	// without a timeout.
+	Timeout time.Duration
+
+	// FundedAmount is the total paid into the escrow. FundingTxids and
+	// ReleaseTxids are the transactions paying into and spending from
+	// it joined with semicolons.
+	FundedAmount string
+	FundingTxids string
+	ReleaseTxids string
+}
+
+// InvoiceRecord is a request for payment bound to one of the wallet's
+// addresses.
+type InvoiceRecord struct {
+	ID        string `gorm:"primary_key"`
+	Coin      string `gorm:"index"`
+	Addr      string `gorm:"index"`
+	Amount    string
+	Memo      string
+	Status    string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+
+	// Paid is the total paid to the address and Txids the transactions
+	// paying it joined with semicolons. ResolvedAt is zero until the
+	// invoice leaves the pending status.
+	Paid       string
+	Txids      string
+	ResolvedAt time.Time
+}
+
+// VaultRecord is a spend paid into a vault. It's keyed by the ID of the
+// transaction paying the vault.
+type VaultRecord struct {
+	Txid      string `gorm:"primary_key"`
+	Coin      string `gorm:"index"`
+	Status    string
+	CreatedAt time.Time
+
+	// Outpoint is the serialized vault output and Amount its value.
+	// Script is the vault's witness script and HotAddr the wallet
+	// address whose key releases it.
+	Outpoint []byte
+	Amount   string
+	Script   []byte
+	HotAddr  string
+
+	// Destination and DestAmount are the payment released from the
+	// vault. Delay is the number of confirmations the vault transaction
+	// needs first.
+	Destination string
+	DestAmount  string
+	Delay       uint32
+
+	// SpendTxid is the transaction releasing or cancelling the vault.
+	SpendTxid string
+}
+
+// CosignRecord is a spend waiting for, or given, the cosigner's approval.
+// Request is the JSON encoded base.CosignRequest.
+type CosignRecord struct {
+	Txid      string `gorm:"primary_key"`
+	Coin      string `gorm:"index"`
+	Status    string
+	CreatedAt time.Time
+	Request   []byte
+}
+
+// SigningRecord is a spend from a watch-only wallet waiting for, or given,
+// the offline wallet's signatures. Request is the JSON encoded
+// base.SigningRequest.
+type SigningRecord struct {
+	Txid      string `gorm:"primary_key"`
+	Coin      string `gorm:"index"`
+	Status    string
+	CreatedAt time.Time
+	Request   []byte
+}
+
+// PaymentCodeRecord is a BIP 47 payment code the wallet has exchanged a
+// notification with. Outgoing codes were notified by the wallet and
+// NextIndex is the index of the next address to pay. Incoming codes
+// notified the wallet.
+type PaymentCodeRecord struct {
+	Coin             string `gorm:"primary_key"`
+	Code             string `gorm:"primary_key"`
+	Outgoing         bool   `gorm:"primary_key"`
+	NotificationTxid string
+	NextIndex        int
+	CreatedAt        time.Time
+}
+
+// PaymentCodeAddressRecord is an address the wallet receives payments from
+// an incoming payment code on. KeyIndex is the index of the address in the
+// code's chain.
+type PaymentCodeAddressRecord struct {
+	Addr      string `gorm:"primary_key"`
+	Coin      string `gorm:"index"`
+	Code      string `gorm:"index"`
+	KeyIndex  int
+	Used      bool
+	CreatedAt time.Time
+}
+
+// SilentPaymentOutputRecord is a taproot output paid to the wallet's
+// silent payment address. Tweak is the hex encoded scalar added to the
+// spend key to get the output's key.
+type SilentPaymentOutputRecord struct {
+	Addr      string `gorm:"primary_key"`
+	Coin      string `gorm:"index"`
+	Tweak     string
+	Txid      string
+	Used      bool
+	CreatedAt time.Time
+}
+
+// SwapRecord is an exchange of one of the wallet's coins for another
+// through a swap provider.
+type SwapRecord struct {
+	ID       string `gorm:"primary_key"`
+	Provider string
+	OrderID  string
+	FromCoin string `gorm:"index"`
+	ToCoin   string `gorm:"index"`
+	State    string `gorm:"index"`
+
+	// Amount is sent to DepositAddr, ExpectedAmount is the provider's
+	// quote and ReceivedAmount is what arrived at PayoutAddr.
+	Amount         string
+	ExpectedAmount string
+	ReceivedAmount string
+
+	DepositAddr string
+	PayoutAddr  string
+	RefundAddr  string
+	DepositTxid string
+	PayoutTxid  string
+
+	// Error is why a failed swap failed.
+	Error     string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// AtomicSwapRecord is an HTLC based atomic swap between two of the wallet's
+// UTXO coins and another party. The key the wallet uses in both contracts
+// is derived from the OwnCoin keychain at KeyIndex. Only its hex encoded
+// PublicKey is saved. The initiator generates the Secret, the participant
+// learns it when the initiator redeems.
+type AtomicSwapRecord struct {
+	ID        string `gorm:"primary_key"`
+	Role      string
+	State     string `gorm:"index"`
+	OwnCoin   string
+	OtherCoin string
+
+	// OwnAmount is locked in the wallet's contract on OwnCoin in exchange
+	// for OtherAmount from the counterparty's contract on OtherCoin.
+	OwnAmount   string
+	OtherAmount string
+
+	SecretHash string
+	Secret     string
+	KeyIndex   uint32
+	PublicKey  string
+
+	OwnContract       []byte
+	OwnContractAddr   string
+	OwnContractTxid   string
+	OtherContract     []byte
+	OtherContractAddr string
+	OtherContractTxid string
+	RedeemTxid        string
+	RefundTxid        string
+
+	// LockTime is when the wallet's own contract can be refunded.
+	LockTime  time.Time
+	Error     string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// AddressPolicyRecord allows or denies spends to a destination address.
+// Policy is "allow" or "deny".
+type AddressPolicyRecord struct {
+	Addr      string `gorm:"primary_key"`
+	Coin      string `gorm:"index"`
+	Policy    string `gorm:"index"`
+	Reason    string
+	CreatedAt time.Time
+}
+
+// RejectedSpendRecord is an audit log entry for a spend refused by the
+// address policy.
+type RejectedSpendRecord struct {
+	ID        string `gorm:"primary_key"`
+	Coin      string `gorm:"index"`
+	Addr      string
+	Reason    string
+	Timestamp time.Time
+}
+
+// SpendRecord is the amount a transaction sent out of the wallet. They're
+// saved when a spend is committed and used to enforce the rolling daily
+// spend limit.
+type SpendRecord struct {
+	Txid      string `gorm:"primary_key"`
+	Coin      string `gorm:"index"`
+	Amount    string
+	Timestamp time.Time `gorm:"index"`
+}
+
+// HeaderRecord is a block header in a coin's locally verified chain.
+type HeaderRecord struct {
+	Coin   string `gorm:"primary_key"`
+	Height uint64 `gorm:"primary_key;autoIncrement:false"`
+	Hash   string `gorm:"index"`
+	Header []byte
+}
+
+// NonceRecord is an Ethereum transaction sent at a nonce which isn't
+// confirmed yet. When the transaction is replaced at the same nonce Txid,
+// Tx and GasPrice are overwritten and the old txid is appended to the
+// comma separated Replaced. Tx is the RLP encoded signed transaction.
+type NonceRecord struct {
+	Account   string `gorm:"primary_key"`
+	Nonce     uint64 `gorm:"primary_key;autoIncrement:false"`
+	Txid      string `gorm:"index"`
+	Tx        []byte
+	GasPrice  string
+	Replaced  string
+	Cancelled bool
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// TokenTransferRecord is an ERC20 Transfer event to or from an account.
+// ID is the token, account, txid and log index joined by colons. Value is
+// the decimal amount in the token's smallest unit. A transfer the wallet
+// has sent which isn't in a block yet has a BlockNumber of zero.
+type TokenTransferRecord struct {
+	ID          string `gorm:"primary_key"`
+	Token       string `gorm:"index"`
+	Account     string `gorm:"index"`
+	Txid        string `gorm:"index"`
+	LogIndex    uint
+	From        string
+	To          string
+	Value       string
+	BlockNumber uint64
+	BlockHash   string
+	Timestamp   time.Time
+}
+
+// TokenSyncRecord is the last block whose Transfer events for the token
+// have been saved for the account. The wallet's own account and each
+// address it watches have one.
+type TokenSyncRecord struct {
+	Token       string `gorm:"primary_key"`
+	Account     string `gorm:"primary_key"`
+	BlockNumber uint64
 }
@@ -10,11 +10,16 @@ import (
 	"log"
 	"os"
 	"path"
+	"reflect"
 	"sync"
 )
 
 const (
 	DatabaseName = "multiwallet.db"
+
+	// saveBatchSize is the number of rows inserted per statement by
+	// SaveAll. It keeps the bound variables below sqlite's limit of 999.
+	saveBatchSize = 50
 )
 
 var (
@@ -182,6 +187,30 @@ func (t *tx) Save(model interface{}) error {
 	return t.dbtx.Save(model).Error
 }
 
+// SaveAll saves the models with multi-row upserts of up to saveBatchSize
+// rows each.
+func (t *tx) SaveAll(models interface{}) error {
+	if !t.isForWrites {
+		return ErrReadOnly
+	}
+	v := reflect.Indirect(reflect.ValueOf(models))
+	if v.Kind() != reflect.Slice {
+		return fmt.Errorf("cannot save %T, expected a slice", models)
+	}
+	for i := 0; i < v.Len(); i += saveBatchSize {
+		end := i + saveBatchSize
+		if end > v.Len() {
+			end = v.Len()
+		}
+		batch := reflect.New(v.Type())
+		batch.Elem().Set(v.Slice(i, end))
+		if err := t.dbtx.Save(batch.Interface()).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Read returns the underlying sql database in a read-only mode so that
 // queries can be made against it.
 func (t *tx) Read() *gorm.DB {
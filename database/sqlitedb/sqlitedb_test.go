@@ -2,6 +2,7 @@ package sqlitedb
 
 import (
 	"errors"
+	"fmt"
 	"github.com/cpacia/multiwallet/database"
 	"gorm.io/gorm"
 	"testing"
@@ -178,3 +179,99 @@ func TestSqliteDB_CRUD(t *testing.T) {
 		t.Error("Failed to delete utxo from the database")
 	}
 }
+
+func TestSqliteDB_SaveAll(t *testing.T) {
+	db, err := NewMemoryDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.InitializeDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+
+	// More records than fit in one statement.
+	records := newAddressRecords(saveBatchSize*2 + 1)
+	err = db.Update(func(tx database.Tx) error {
+		return tx.SaveAll(records)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Existing records are overridden.
+	records[0].Used = true
+	err = db.Update(func(tx database.Tx) error {
+		return tx.SaveAll([]*database.AddressRecord{&records[0]})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var saved []database.AddressRecord
+	err = db.View(func(tx database.Tx) error {
+		if err := tx.SaveAll(records); err != ErrReadOnly {
+			t.Errorf("Expected ErrReadOnly, got %v", err)
+		}
+		return tx.Read().Order("key_index asc").Find(&saved).Error
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != len(records) {
+		t.Fatalf("Expected %d records, got %d", len(records), len(saved))
+	}
+	if !saved[0].Used || saved[1].Used {
+		t.Error("Expected only the first record to be updated")
+	}
+}
+
+func newAddressRecords(n int) []database.AddressRecord {
+	records := make([]database.AddressRecord, n)
+	for i := range records {
+		records[i] = database.AddressRecord{
+			Addr:     fmt.Sprintf("addr%d", i),
+			KeyIndex: i,
+			Coin:     "MCK",
+		}
+	}
+	return records
+}
+
+func BenchmarkTx_Save(b *testing.B) {
+	benchmarkSave(b, func(tx database.Tx, records []database.AddressRecord) error {
+		for i := range records {
+			if err := tx.Save(&records[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func BenchmarkTx_SaveAll(b *testing.B) {
+	benchmarkSave(b, func(tx database.Tx, records []database.AddressRecord) error {
+		return tx.SaveAll(records)
+	})
+}
+
+// benchmarkSave measures saving a rescan's worth of new addresses.
+func benchmarkSave(b *testing.B, save func(tx database.Tx, records []database.AddressRecord) error) {
+	db, err := NewMemoryDB()
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := database.InitializeDatabase(db); err != nil {
+		b.Fatal(err)
+	}
+	records := newAddressRecords(1000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := db.Update(func(tx database.Tx) error {
+			return save(tx, records)
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
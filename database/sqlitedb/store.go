@@ -0,0 +1,176 @@
+package sqlitedb
+
+import (
+	"context"
+	"errors"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"gorm.io/gorm"
+)
+
+// store implements database.Store over the sqlite database. Outside of
+// Atomic each call takes the DB's mutex for its duration. Inside Atomic
+// dbtx is the open transaction and the mutex is already held.
+type store struct {
+	fdb  *DB
+	dbtx *gorm.DB
+}
+
+// Store returns the database's context-aware Store.
+func (fdb *DB) Store() database.Store {
+	return &store{fdb: fdb}
+}
+
+// run invokes fn with a handle bound to ctx.
+func (s *store) run(ctx context.Context, fn func(db *gorm.DB) error) error {
+	if s.dbtx != nil {
+		return fn(s.dbtx.WithContext(ctx))
+	}
+	s.fdb.mtx.Lock()
+	defer s.fdb.mtx.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return fn(s.fdb.db.WithContext(ctx))
+}
+
+// Atomic invokes fn with a Store backed by a single sql transaction. A
+// nested call joins the outer transaction.
+func (s *store) Atomic(ctx context.Context, fn func(store database.Store) error) error {
+	if s.dbtx != nil {
+		return fn(s)
+	}
+	s.fdb.mtx.Lock()
+	defer s.fdb.mtx.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	dbtx := s.fdb.db.WithContext(ctx).Begin()
+	if dbtx.Error != nil {
+		return dbtx.Error
+	}
+	if err := fn(&store{fdb: s.fdb, dbtx: dbtx}); err != nil {
+		dbtx.Rollback()
+		return err
+	}
+	return dbtx.Commit().Error
+}
+
+// first loads the first record matching the query into model, translating
+// gorm's not found error.
+func first(db *gorm.DB, model interface{}) error {
+	err := db.First(model).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return database.ErrNotFound
+	}
+	return err
+}
+
+func (s *store) GetCoin(ctx context.Context, coinType iwallet.CoinType) (*database.CoinRecord, error) {
+	var record database.CoinRecord
+	err := s.run(ctx, func(db *gorm.DB) error {
+		return first(db.Where("coin=?", coinType.CurrencyCode()), &record)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func (s *store) SaveCoin(ctx context.Context, record *database.CoinRecord) error {
+	return s.run(ctx, func(db *gorm.DB) error {
+		return db.Save(record).Error
+	})
+}
+
+func (s *store) GetAddress(ctx context.Context, addr iwallet.Address) (*database.AddressRecord, error) {
+	var record database.AddressRecord
+	err := s.run(ctx, func(db *gorm.DB) error {
+		return first(db.Where("addr=?", addr.String()).Where("coin=?", addr.CoinType.CurrencyCode()), &record)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func (s *store) ListAddresses(ctx context.Context, coinType iwallet.CoinType) ([]database.AddressRecord, error) {
+	var records []database.AddressRecord
+	err := s.run(ctx, func(db *gorm.DB) error {
+		return db.Where("coin=?", coinType.CurrencyCode()).Order("change asc").Order("key_index asc").Find(&records).Error
+	})
+	return records, err
+}
+
+func (s *store) SaveAddress(ctx context.Context, record *database.AddressRecord) error {
+	return s.run(ctx, func(db *gorm.DB) error {
+		return db.Save(record).Error
+	})
+}
+
+func (s *store) ListUtxos(ctx context.Context, coinType iwallet.CoinType) ([]database.UtxoRecord, error) {
+	var records []database.UtxoRecord
+	err := s.run(ctx, func(db *gorm.DB) error {
+		return db.Where("coin=?", coinType.CurrencyCode()).Find(&records).Error
+	})
+	return records, err
+}
+
+func (s *store) SaveUtxo(ctx context.Context, record *database.UtxoRecord) error {
+	return s.run(ctx, func(db *gorm.DB) error {
+		return db.Save(record).Error
+	})
+}
+
+func (s *store) DeleteUtxo(ctx context.Context, coinType iwallet.CoinType, outpoint string) error {
+	return s.run(ctx, func(db *gorm.DB) error {
+		return db.Where("coin=?", coinType.CurrencyCode()).Where("outpoint=?", outpoint).Delete(&database.UtxoRecord{}).Error
+	})
+}
+
+func (s *store) GetTransaction(ctx context.Context, coinType iwallet.CoinType, id iwallet.TransactionID) (*database.TransactionRecord, error) {
+	var record database.TransactionRecord
+	err := s.run(ctx, func(db *gorm.DB) error {
+		return first(db.Where("coin=?", coinType.CurrencyCode()).Where("txid=?", id.String()), &record)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func (s *store) ListTransactions(ctx context.Context, coinType iwallet.CoinType) ([]database.TransactionRecord, error) {
+	var records []database.TransactionRecord
+	err := s.run(ctx, func(db *gorm.DB) error {
+		return db.Where("coin=?", coinType.CurrencyCode()).Order("timestamp desc").Find(&records).Error
+	})
+	return records, err
+}
+
+func (s *store) SaveTransaction(ctx context.Context, record *database.TransactionRecord) error {
+	return s.run(ctx, func(db *gorm.DB) error {
+		return db.Save(record).Error
+	})
+}
+
+func (s *store) ListUnconfirmed(ctx context.Context, coinType iwallet.CoinType) ([]database.UnconfirmedTransaction, error) {
+	var records []database.UnconfirmedTransaction
+	err := s.run(ctx, func(db *gorm.DB) error {
+		return db.Where("coin=?", coinType.CurrencyCode()).Order("timestamp asc").Find(&records).Error
+	})
+	return records, err
+}
+
+func (s *store) SaveUnconfirmed(ctx context.Context, record *database.UnconfirmedTransaction) error {
+	return s.run(ctx, func(db *gorm.DB) error {
+		return db.Save(record).Error
+	})
+}
+
+func (s *store) DeleteUnconfirmed(ctx context.Context, coinType iwallet.CoinType, id iwallet.TransactionID) error {
+	return s.run(ctx, func(db *gorm.DB) error {
+		return db.Where("coin=?", coinType.CurrencyCode()).Where("txid=?", id.String()).Delete(&database.UnconfirmedTransaction{}).Error
+	})
+}
@@ -0,0 +1,144 @@
+package sqlitedb
+
+import (
+	"context"
+	"errors"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"testing"
+)
+
+func newTestStore(t *testing.T) database.Store {
+	db, err := NewMemoryDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.InitializeDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+	return db.Store()
+}
+
+func TestStore_Utxos(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+
+	for _, rec := range []*database.UtxoRecord{
+		{Outpoint: "aa", Amount: "1000", Coin: iwallet.CtBitcoinCash.CurrencyCode()},
+		{Outpoint: "bb", Amount: "2000", Coin: iwallet.CtBitcoinCash.CurrencyCode()},
+		{Outpoint: "cc", Amount: "3000", Coin: iwallet.CtBitcoin.CurrencyCode()},
+	} {
+		if err := store.SaveUtxo(ctx, rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	utxos, err := store.ListUtxos(ctx, iwallet.CtBitcoinCash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(utxos) != 2 {
+		t.Errorf("Expected 2 utxos, got %d", len(utxos))
+	}
+
+	if err := store.DeleteUtxo(ctx, iwallet.CtBitcoinCash, "aa"); err != nil {
+		t.Fatal(err)
+	}
+	// Outputs of other coins aren't touched.
+	if err := store.DeleteUtxo(ctx, iwallet.CtBitcoinCash, "cc"); err != nil {
+		t.Fatal(err)
+	}
+	utxos, err = store.ListUtxos(ctx, iwallet.CtBitcoinCash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(utxos) != 1 || utxos[0].Outpoint != "bb" {
+		t.Errorf("Expected only utxo bb, got %v", utxos)
+	}
+	utxos, err = store.ListUtxos(ctx, iwallet.CtBitcoin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(utxos) != 1 {
+		t.Errorf("Expected 1 utxo, got %d", len(utxos))
+	}
+}
+
+func TestStore_NotFound(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+
+	if _, err := store.GetCoin(ctx, iwallet.CtBitcoinCash); err != database.ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if _, err := store.GetTransaction(ctx, iwallet.CtBitcoinCash, "abc"); err != database.ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if _, err := store.GetAddress(ctx, iwallet.NewAddress("abc", iwallet.CtBitcoinCash)); err != database.ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	if err := store.SaveCoin(ctx, &database.CoinRecord{Coin: iwallet.CtBitcoinCash.CurrencyCode(), BestBlockHeight: 10}); err != nil {
+		t.Fatal(err)
+	}
+	rec, err := store.GetCoin(ctx, iwallet.CtBitcoinCash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.BestBlockHeight != 10 {
+		t.Errorf("Expected height 10, got %d", rec.BestBlockHeight)
+	}
+}
+
+func TestStore_Atomic(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+
+	errAbort := errors.New("abort")
+	err := store.Atomic(ctx, func(s database.Store) error {
+		if err := s.SaveUnconfirmed(ctx, &database.UnconfirmedTransaction{Txid: "abc", Coin: iwallet.CtBitcoinCash.CurrencyCode()}); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	if err != errAbort {
+		t.Fatalf("Expected abort error, got %v", err)
+	}
+	txs, err := store.ListUnconfirmed(ctx, iwallet.CtBitcoinCash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txs) != 0 {
+		t.Error("Expected aborted save to be rolled back")
+	}
+
+	err = store.Atomic(ctx, func(s database.Store) error {
+		if err := s.SaveUnconfirmed(ctx, &database.UnconfirmedTransaction{Txid: "abc", Coin: iwallet.CtBitcoinCash.CurrencyCode()}); err != nil {
+			return err
+		}
+		return s.SaveTransaction(ctx, &database.TransactionRecord{Txid: "abc", Coin: iwallet.CtBitcoinCash.CurrencyCode()})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetTransaction(ctx, iwallet.CtBitcoinCash, "abc"); err != nil {
+		t.Error(err)
+	}
+
+	if err := store.DeleteUnconfirmed(ctx, iwallet.CtBitcoinCash, "abc"); err != nil {
+		t.Fatal(err)
+	}
+	txs, err = store.ListUnconfirmed(ctx, iwallet.CtBitcoinCash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txs) != 0 {
+		t.Error("Expected unconfirmed transaction to be deleted")
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := store.SaveUtxo(cancelled, &database.UtxoRecord{Outpoint: "aa"}); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
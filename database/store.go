@@ -0,0 +1,87 @@
+package database
+
+import (
+	"context"
+	"errors"
+	iwallet "github.com/cpacia/wallet-interface"
+)
+
+// ErrNotFound is returned by the Store when a requested record doesn't
+// exist.
+var ErrNotFound = errors.New("record not found")
+
+// CoinStore persists the per-coin wallet state.
+type CoinStore interface {
+	// GetCoin returns the coin's record or ErrNotFound.
+	GetCoin(ctx context.Context, coinType iwallet.CoinType) (*CoinRecord, error)
+
+	// SaveCoin inserts or replaces the coin's record.
+	SaveCoin(ctx context.Context, record *CoinRecord) error
+}
+
+// AddressStore persists the addresses derived by the wallet's keychain.
+type AddressStore interface {
+	// GetAddress returns the address's record or ErrNotFound.
+	GetAddress(ctx context.Context, addr iwallet.Address) (*AddressRecord, error)
+
+	// ListAddresses returns all of the coin's addresses, external ones
+	// first, ordered by key index.
+	ListAddresses(ctx context.Context, coinType iwallet.CoinType) ([]AddressRecord, error)
+
+	// SaveAddress inserts or replaces the address's record.
+	SaveAddress(ctx context.Context, record *AddressRecord) error
+}
+
+// UtxoStore persists the wallet's unspent outputs.
+type UtxoStore interface {
+	// ListUtxos returns all of the coin's unspent outputs.
+	ListUtxos(ctx context.Context, coinType iwallet.CoinType) ([]UtxoRecord, error)
+
+	// SaveUtxo inserts or replaces the output's record.
+	SaveUtxo(ctx context.Context, record *UtxoRecord) error
+
+	// DeleteUtxo removes the output. It's not an error if it doesn't
+	// exist.
+	DeleteUtxo(ctx context.Context, coinType iwallet.CoinType, outpoint string) error
+}
+
+// TxStore persists the wallet's transactions and the ones it has
+// broadcast which are not yet confirmed.
+type TxStore interface {
+	// GetTransaction returns the transaction's record or ErrNotFound.
+	GetTransaction(ctx context.Context, coinType iwallet.CoinType, id iwallet.TransactionID) (*TransactionRecord, error)
+
+	// ListTransactions returns all of the coin's transactions, newest
+	// first.
+	ListTransactions(ctx context.Context, coinType iwallet.CoinType) ([]TransactionRecord, error)
+
+	// SaveTransaction inserts or replaces the transaction's record.
+	SaveTransaction(ctx context.Context, record *TransactionRecord) error
+
+	// ListUnconfirmed returns the coin's transactions queued for
+	// broadcast, oldest first.
+	ListUnconfirmed(ctx context.Context, coinType iwallet.CoinType) ([]UnconfirmedTransaction, error)
+
+	// SaveUnconfirmed inserts or replaces the queued transaction.
+	SaveUnconfirmed(ctx context.Context, record *UnconfirmedTransaction) error
+
+	// DeleteUnconfirmed removes the queued transaction. It's not an error
+	// if it doesn't exist.
+	DeleteUnconfirmed(ctx context.Context, coinType iwallet.CoinType, id iwallet.TransactionID) error
+}
+
+// Store is a storage engine agnostic view of the wallet's data. Unlike Tx
+// it doesn't expose the underlying database so it can be implemented by
+// engines other than sql. Each method is atomic on its own; use Atomic to
+// group several together.
+type Store interface {
+	CoinStore
+	AddressStore
+	UtxoStore
+	TxStore
+
+	// Atomic invokes fn with a Store whose changes are committed together
+	// when it returns nil and discarded if it returns an error, which is
+	// returned from Atomic. The Store must not be used after fn returns.
+	Atomic(ctx context.Context, fn func(store Store) error) error
+}
@@ -0,0 +1,157 @@
+package headers
+
+import (
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/wire"
+	"math/big"
+)
+
+// chainView gives the difficulty rules access to the ancestors of the
+// header being validated. It returns false for headers below the store's
+// checkpoint.
+type chainView interface {
+	headerAt(height uint64) (*wire.BlockHeader, bool)
+}
+
+// bitcoinNextBits implements Bitcoin's difficulty adjustment, retargeting
+// every two weeks of blocks against the first block of the period.
+func bitcoinNextBits(p *Params, view chainView, height uint64, header *wire.BlockHeader) (uint32, bool) {
+	return retargetNextBits(p, view, height, header, false)
+}
+
+// litecoinNextBits implements Litecoin's difficulty adjustment. It differs
+// from Bitcoin's by measuring each period from the last block of the
+// previous one, fixing Bitcoin's off by one.
+func litecoinNextBits(p *Params, view chainView, height uint64, header *wire.BlockHeader) (uint32, bool) {
+	return retargetNextBits(p, view, height, header, true)
+}
+
+func retargetNextBits(p *Params, view chainView, height uint64, header *wire.BlockHeader, fullPeriod bool) (uint32, bool) {
+	prev, ok := view.headerAt(height - 1)
+	if !ok {
+		return 0, false
+	}
+	if p.NoRetargeting {
+		return prev.Bits, true
+	}
+
+	interval := uint64(p.TargetTimespan / p.TargetTimePerBlock)
+	if height%interval != 0 {
+		if !p.ReduceMinDifficulty {
+			return prev.Bits, true
+		}
+		if header.Timestamp.After(prev.Timestamp.Add(p.TargetTimePerBlock * 2)) {
+			return p.PowLimitBits, true
+		}
+		// Otherwise use the bits of the last block which wasn't mined
+		// at the minimum difficulty.
+		h := height - 1
+		for h%interval != 0 && prev.Bits == p.PowLimitBits {
+			h--
+			if prev, ok = view.headerAt(h); !ok {
+				return 0, false
+			}
+		}
+		return prev.Bits, true
+	}
+
+	lookback := interval
+	if fullPeriod && height != interval {
+		lookback++
+	}
+	first, ok := view.headerAt(height - lookback)
+	if !ok {
+		return 0, false
+	}
+
+	timespan := int64(p.TargetTimespan.Seconds())
+	actual := prev.Timestamp.Unix() - first.Timestamp.Unix()
+	if min := timespan / p.RetargetAdjustmentFactor; actual < min {
+		actual = min
+	} else if max := timespan * p.RetargetAdjustmentFactor; actual > max {
+		actual = max
+	}
+
+	target := blockchain.CompactToBig(prev.Bits)
+	// Litecoin shifts the target down a bit before multiplying when it
+	// could overflow 256 bits, losing its lowest bit.
+	shift := fullPeriod && target.BitLen() > 235
+	if shift {
+		target.Rsh(target, 1)
+	}
+	target.Mul(target, big.NewInt(actual))
+	target.Div(target, big.NewInt(timespan))
+	if shift {
+		target.Lsh(target, 1)
+	}
+	if target.Cmp(p.PowLimit) > 0 {
+		target.Set(p.PowLimit)
+	}
+	return blockchain.BigToCompact(target), true
+}
+
+// asertAnchor is the block Bitcoin Cash's aserti3-2d algorithm measures
+// the chain's schedule from.
+type asertAnchor struct {
+	height          uint64
+	bits            uint32
+	parentTimestamp int64
+}
+
+var (
+	mainnetASERTAnchor = asertAnchor{height: 661647, bits: 0x1804dafe, parentTimestamp: 1605447844}
+	testnetASERTAnchor = asertAnchor{height: 1421481, bits: 0x1d00ffff, parentTimestamp: 1605445400}
+)
+
+// asertHalfLife is the time the chain must fall behind or ahead of
+// schedule for the difficulty to halve or double.
+const asertHalfLife = 2 * 24 * 60 * 60
+
+// asertNextBits implements Bitcoin Cash's aserti3-2d difficulty algorithm.
+// Headers at or before the anchor are not checked.
+func asertNextBits(p *Params, view chainView, height uint64, header *wire.BlockHeader) (uint32, bool) {
+	prev, ok := view.headerAt(height - 1)
+	if !ok {
+		return 0, false
+	}
+	if p.NoRetargeting {
+		return prev.Bits, true
+	}
+	if p.asert == nil || height <= p.asert.height {
+		return 0, false
+	}
+	if p.ReduceMinDifficulty && header.Timestamp.After(prev.Timestamp.Add(p.TargetTimePerBlock*2)) {
+		return p.PowLimitBits, true
+	}
+	timeDiff := prev.Timestamp.Unix() - p.asert.parentTimestamp
+	heightDiff := int64(height - 1 - p.asert.height)
+	return asertBits(p.asert.bits, timeDiff, heightDiff, int64(p.TargetTimePerBlock.Seconds()), p.PowLimit, p.PowLimitBits), true
+}
+
+// asertBits computes the aserti3-2d target for the block after one
+// heightDiff blocks and timeDiff seconds past the anchor. The exponential
+// is approximated with the cubic polynomial from the specification so the
+// result matches other implementations exactly.
+func asertBits(anchorBits uint32, timeDiff, heightDiff, spacing int64, powLimit *big.Int, powLimitBits uint32) uint32 {
+	exponent := ((timeDiff - spacing*(heightDiff+1)) * 65536) / asertHalfLife
+	shifts := exponent >> 16
+	frac := uint64(uint16(exponent))
+
+	factor := uint64(65536) + ((195766423245049*frac + 971821376*frac*frac + 5127*frac*frac*frac + (1 << 47)) >> 48)
+	target := blockchain.CompactToBig(anchorBits)
+	target.Mul(target, new(big.Int).SetUint64(factor))
+
+	shifts -= 16
+	if shifts <= 0 {
+		target.Rsh(target, uint(-shifts))
+	} else {
+		target.Lsh(target, uint(shifts))
+	}
+	if target.Sign() == 0 {
+		return blockchain.BigToCompact(big.NewInt(1))
+	}
+	if target.Cmp(powLimit) > 0 {
+		return powLimitBits
+	}
+	return blockchain.BigToCompact(target)
+}
@@ -0,0 +1,121 @@
+package headers
+
+import (
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+	ltcchaincfg "github.com/ltcsuite/ltcd/chaincfg"
+	"testing"
+	"time"
+)
+
+type mapView map[uint64]*wire.BlockHeader
+
+func (v mapView) headerAt(height uint64) (*wire.BlockHeader, bool) {
+	header, ok := v[height]
+	return header, ok
+}
+
+func TestBitcoinNextBits(t *testing.T) {
+	params := BitcoinParams(&chaincfg.MainNetParams)
+	start := time.Unix(1600000000, 0)
+
+	view := mapView{
+		0:    {Bits: 0x1c00ffff, Timestamp: start},
+		2015: {Bits: 0x1c00ffff, Timestamp: start.Add(params.TargetTimespan / 2)},
+	}
+	header := &wire.BlockHeader{Timestamp: start.Add(params.TargetTimespan / 2)}
+
+	// Blocks came twice as fast so the target halves.
+	bits, ok := params.nextBits(params, view, 2016, header)
+	if !ok {
+		t.Fatal("Expected bits to be checked")
+	}
+	if bits != 0x1b7fff80 {
+		t.Errorf("Expected bits 1b7fff80, got %08x", bits)
+	}
+
+	// Between retargets the bits don't change.
+	bits, ok = params.nextBits(params, view, 2016+2015, header)
+	if ok {
+		t.Errorf("Expected missing parent to skip check, got %08x", bits)
+	}
+	view[2016] = &wire.BlockHeader{Bits: 0x1b7fff80, Timestamp: start}
+	bits, _ = params.nextBits(params, view, 2017, header)
+	if bits != 0x1b7fff80 {
+		t.Errorf("Expected bits 1b7fff80, got %08x", bits)
+	}
+
+	// Adjustment is limited to a factor of four.
+	view[2015].Timestamp = start.Add(time.Hour)
+	bits, _ = params.nextBits(params, view, 2016, header)
+	if bits != 0x1b3fffc0 {
+		t.Errorf("Expected bits 1b3fffc0, got %08x", bits)
+	}
+}
+
+func TestBitcoinNextBits_MinDifficulty(t *testing.T) {
+	params := BitcoinParams(&chaincfg.TestNet3Params)
+	start := time.Unix(1600000000, 0)
+
+	view := mapView{
+		2016: {Bits: 0x1c00ffff, Timestamp: start},
+		2017: {Bits: params.PowLimitBits, Timestamp: start.Add(time.Hour)},
+	}
+
+	// A block more than twenty minutes after its parent may be mined at
+	// the minimum difficulty.
+	bits, _ := params.nextBits(params, view, 2018, &wire.BlockHeader{Timestamp: start.Add(time.Hour * 2)})
+	if bits != params.PowLimitBits {
+		t.Errorf("Expected minimum difficulty, got %08x", bits)
+	}
+
+	// Otherwise it returns to the last real difficulty.
+	bits, _ = params.nextBits(params, view, 2018, &wire.BlockHeader{Timestamp: start.Add(time.Hour + time.Minute)})
+	if bits != 0x1c00ffff {
+		t.Errorf("Expected bits 1c00ffff, got %08x", bits)
+	}
+}
+
+func TestLitecoinNextBits(t *testing.T) {
+	params := LitecoinParams(&ltcchaincfg.MainNetParams)
+	start := time.Unix(1600000000, 0)
+
+	// Litecoin measures the period from the last block of the previous
+	// one.
+	view := mapView{
+		2015: {Bits: 0x1c00ffff, Timestamp: start},
+		4031: {Bits: 0x1c00ffff, Timestamp: start.Add(params.TargetTimespan / 2)},
+	}
+	bits, ok := params.nextBits(params, view, 4032, &wire.BlockHeader{})
+	if !ok {
+		t.Fatal("Expected bits to be checked")
+	}
+	if bits != 0x1b7fff80 {
+		t.Errorf("Expected bits 1b7fff80, got %08x", bits)
+	}
+}
+
+func TestASERTBits(t *testing.T) {
+	params := BitcoinParams(&chaincfg.MainNetParams)
+	tests := []struct {
+		timeDiff   int64
+		heightDiff int64
+		bits       uint32
+	}{
+		// On schedule.
+		{600, 0, 0x1c00ffff},
+		{600 * 1001, 1000, 0x1c00ffff},
+		// A half life behind schedule doubles the target.
+		{600 + asertHalfLife, 0, 0x1c01fffe},
+		// A half life ahead of schedule halves it.
+		{600 - asertHalfLife, 0, 0x1b7fff80},
+		// The target never exceeds the limit.
+		{600 + asertHalfLife*100, 0, params.PowLimitBits},
+	}
+	for _, test := range tests {
+		bits := asertBits(0x1c00ffff, test.timeDiff, test.heightDiff, 600, params.PowLimit, params.PowLimitBits)
+		if bits != test.bits {
+			t.Errorf("Time diff %d, height diff %d: expected %08x, got %08x", test.timeDiff, test.heightDiff, test.bits, bits)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package headers
+
+import (
+	"errors"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// ErrInvalidMerkleProof is returned when a merkle branch doesn't commit
+// the transaction to the header's merkle root.
+var ErrInvalidMerkleProof = errors.New("invalid merkle proof")
+
+// MerkleRoot computes the merkle root committed to by a branch linking the
+// transaction at index in the block to the root. The branch is ordered
+// from the leaves up.
+func MerkleRoot(txid chainhash.Hash, index uint32, branch []chainhash.Hash) chainhash.Hash {
+	var buf [chainhash.HashSize * 2]byte
+	hash := txid
+	for _, sibling := range branch {
+		if index&1 == 0 {
+			copy(buf[:chainhash.HashSize], hash[:])
+			copy(buf[chainhash.HashSize:], sibling[:])
+		} else {
+			copy(buf[:chainhash.HashSize], sibling[:])
+			copy(buf[chainhash.HashSize:], hash[:])
+		}
+		hash = chainhash.DoubleHashH(buf[:])
+		index >>= 1
+	}
+	return hash
+}
+
+// MerkleBranchFromPartialTree extracts the branch of the single transaction
+// matched by a BIP37 partial merkle tree, as found in a merkleblock message
+// or returned by bitcoind's gettxoutproof, and checks it against the
+// merkle root.
+func MerkleBranchFromPartialTree(mb *wire.MsgMerkleBlock) (txid chainhash.Hash, index uint32, branch []chainhash.Hash, err error) {
+	if mb.Transactions == 0 {
+		return txid, 0, nil, ErrInvalidMerkleProof
+	}
+	pt := &partialTree{
+		numTx:  mb.Transactions,
+		hashes: mb.Hashes,
+		flags:  mb.Flags,
+	}
+	var height uint
+	for pt.width(height) > 1 {
+		height++
+	}
+	root, _, err := pt.traverse(height, 0)
+	if err != nil {
+		return txid, 0, nil, err
+	}
+	if pt.matches != 1 || pt.hashPos != len(pt.hashes) || (pt.bitPos+7)/8 != len(pt.flags) {
+		return txid, 0, nil, ErrInvalidMerkleProof
+	}
+	if root != mb.Header.MerkleRoot {
+		return txid, 0, nil, ErrInvalidMerkleProof
+	}
+	return pt.txid, pt.index, pt.branch, nil
+}
+
+type partialTree struct {
+	numTx   uint32
+	hashes  []*chainhash.Hash
+	flags   []byte
+	hashPos int
+	bitPos  int
+
+	matches int
+	txid    chainhash.Hash
+	index   uint32
+	branch  []chainhash.Hash
+}
+
+func (pt *partialTree) width(height uint) uint32 {
+	return (pt.numTx + (1 << height) - 1) >> height
+}
+
+// traverse computes the hash of the node at height and pos, recording the
+// branch of the matched leaf as the recursion unwinds. It returns whether
+// the node contains the match.
+func (pt *partialTree) traverse(height uint, pos uint32) (chainhash.Hash, bool, error) {
+	if pt.bitPos >= len(pt.flags)*8 {
+		return chainhash.Hash{}, false, ErrInvalidMerkleProof
+	}
+	flag := pt.flags[pt.bitPos/8]&(1<<(uint(pt.bitPos)%8)) != 0
+	pt.bitPos++
+
+	if height == 0 || !flag {
+		if pt.hashPos >= len(pt.hashes) {
+			return chainhash.Hash{}, false, ErrInvalidMerkleProof
+		}
+		hash := *pt.hashes[pt.hashPos]
+		pt.hashPos++
+		if height == 0 && flag {
+			pt.matches++
+			pt.txid = hash
+			pt.index = pos
+			return hash, true, nil
+		}
+		return hash, false, nil
+	}
+
+	left, leftMatch, err := pt.traverse(height-1, pos*2)
+	if err != nil {
+		return chainhash.Hash{}, false, err
+	}
+	right, rightMatch := left, false
+	if pos*2+1 < pt.width(height-1) {
+		right, rightMatch, err = pt.traverse(height-1, pos*2+1)
+		if err != nil {
+			return chainhash.Hash{}, false, err
+		}
+	}
+	if leftMatch {
+		pt.branch = append(pt.branch, right)
+	}
+	if rightMatch {
+		pt.branch = append(pt.branch, left)
+	}
+	var buf [chainhash.HashSize * 2]byte
+	copy(buf[:chainhash.HashSize], left[:])
+	copy(buf[chainhash.HashSize:], right[:])
+	return chainhash.DoubleHashH(buf[:]), leftMatch || rightMatch, nil
+}
+
+// VerifyMerkleProof checks that the transaction is committed to the header
+// at height in the store.
+func (s *Store) VerifyMerkleProof(txid chainhash.Hash, height uint64, index uint32, branch []chainhash.Hash) error {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	if height > s.tipHeight() {
+		return ErrUnverifiedHeight
+	}
+	header, ok := s.headerAt(height)
+	if !ok {
+		return ErrHeaderNotFound
+	}
+	if MerkleRoot(txid, index, branch) != header.MerkleRoot {
+		return ErrInvalidMerkleProof
+	}
+	return nil
+}
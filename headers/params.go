@@ -0,0 +1,230 @@
+// Package headers stores and validates block headers for the UTXO coins so
+// that the confirmations reported by a backend can be checked against a
+// chain whose proof of work, difficulty and timestamps were verified
+// locally.
+//
+// Bitcoin, Bitcoin Cash and Litecoin are supported. ZCash headers commit to
+// an Equihash solution and don't fit the 80 byte header format so they can't
+// be verified here.
+package headers
+
+import (
+	"bytes"
+	"errors"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	iwallet "github.com/cpacia/wallet-interface"
+	bchchaincfg "github.com/gcash/bchd/chaincfg"
+	ltcchaincfg "github.com/ltcsuite/ltcd/chaincfg"
+	"golang.org/x/crypto/scrypt"
+	"math/big"
+	"time"
+)
+
+// Checkpoint is a header which the store trusts without validation. The
+// store is built on top of it, so it should be recent enough to keep the
+// number of headers to download small but old enough that it won't be
+// reorged. For Bitcoin and Litecoin it should be on a difficulty adjustment
+// boundary, otherwise the first retarget after it can't be checked.
+type Checkpoint struct {
+	Height uint64
+	Header wire.BlockHeader
+}
+
+// Params are the consensus rules a chain of headers is validated against.
+type Params struct {
+	Name     string
+	CoinType iwallet.CoinType
+
+	// Checkpoint is the first header in the store. It defaults to the
+	// genesis block.
+	Checkpoint Checkpoint
+
+	PowLimit                 *big.Int
+	PowLimitBits             uint32
+	TargetTimespan           time.Duration
+	TargetTimePerBlock       time.Duration
+	RetargetAdjustmentFactor int64
+
+	// ReduceMinDifficulty allows a block to be mined at the minimum
+	// difficulty if it comes more than twice the target spacing after
+	// its parent, as on the test networks.
+	ReduceMinDifficulty bool
+
+	// NoRetargeting disables difficulty adjustment, as on regtest.
+	NoRetargeting bool
+
+	// PowHash returns the hash compared against the header's target.
+	PowHash func(header *wire.BlockHeader) chainhash.Hash
+
+	// nextBits returns the bits required of the header at height.
+	nextBits func(p *Params, view chainView, height uint64, header *wire.BlockHeader) (uint32, bool)
+
+	// asert is the anchor of Bitcoin Cash's aserti3-2d difficulty
+	// algorithm.
+	asert *asertAnchor
+}
+
+// BitcoinParams returns the header rules for a Bitcoin network.
+func BitcoinParams(params *chaincfg.Params) *Params {
+	return &Params{
+		Name:     params.Name,
+		CoinType: iwallet.CtBitcoin,
+		Checkpoint: Checkpoint{
+			Header: params.GenesisBlock.Header,
+		},
+		PowLimit:                 params.PowLimit,
+		PowLimitBits:             params.PowLimitBits,
+		TargetTimespan:           params.TargetTimespan,
+		TargetTimePerBlock:       params.TargetTimePerBlock,
+		RetargetAdjustmentFactor: params.RetargetAdjustmentFactor,
+		ReduceMinDifficulty:      params.ReduceMinDifficulty,
+		NoRetargeting:            params.PoWNoRetargeting,
+		PowHash:                  blockHash,
+		nextBits:                 bitcoinNextBits,
+	}
+}
+
+// LitecoinParams returns the header rules for a Litecoin network.
+func LitecoinParams(params *ltcchaincfg.Params) *Params {
+	genesis := params.GenesisBlock.Header
+	return &Params{
+		Name:     params.Name,
+		CoinType: iwallet.CtLitecoin,
+		Checkpoint: Checkpoint{
+			Header: wire.BlockHeader{
+				Version:    genesis.Version,
+				PrevBlock:  chainhash.Hash(genesis.PrevBlock),
+				MerkleRoot: chainhash.Hash(genesis.MerkleRoot),
+				Timestamp:  genesis.Timestamp,
+				Bits:       genesis.Bits,
+				Nonce:      genesis.Nonce,
+			},
+		},
+		PowLimit:                 params.PowLimit,
+		PowLimitBits:             params.PowLimitBits,
+		TargetTimespan:           params.TargetTimespan,
+		TargetTimePerBlock:       params.TargetTimePerBlock,
+		RetargetAdjustmentFactor: params.RetargetAdjustmentFactor,
+		ReduceMinDifficulty:      params.ReduceMinDifficulty,
+		NoRetargeting:            params.PoWNoRetargeting,
+		PowHash:                  scryptHash,
+		nextBits:                 litecoinNextBits,
+	}
+}
+
+// BitcoinCashParams returns the header rules for a Bitcoin Cash network.
+// Difficulty is only checked after the aserti3-2d activation. Earlier
+// headers are still checked to meet the target their bits commit to.
+func BitcoinCashParams(params *bchchaincfg.Params) *Params {
+	genesis := params.GenesisBlock.Header
+	p := &Params{
+		Name:     params.Name,
+		CoinType: iwallet.CtBitcoinCash,
+		Checkpoint: Checkpoint{
+			Header: wire.BlockHeader{
+				Version:    genesis.Version,
+				PrevBlock:  chainhash.Hash(genesis.PrevBlock),
+				MerkleRoot: chainhash.Hash(genesis.MerkleRoot),
+				Timestamp:  genesis.Timestamp,
+				Bits:       genesis.Bits,
+				Nonce:      genesis.Nonce,
+			},
+		},
+		PowLimit:                 params.PowLimit,
+		PowLimitBits:             params.PowLimitBits,
+		TargetTimespan:           params.TargetTimespan,
+		TargetTimePerBlock:       params.TargetTimePerBlock,
+		RetargetAdjustmentFactor: params.RetargetAdjustmentFactor,
+		ReduceMinDifficulty:      params.ReduceMinDifficulty,
+		NoRetargeting:            params.PoWNoRetargeting,
+		PowHash:                  blockHash,
+		nextBits:                 asertNextBits,
+	}
+	switch params.Name {
+	case bchchaincfg.MainNetParams.Name:
+		p.asert = &mainnetASERTAnchor
+	case bchchaincfg.TestNet3Params.Name:
+		p.asert = &testnetASERTAnchor
+	}
+	return p
+}
+
+// ParamsForCoin returns the header rules for the coin's main or test
+// network.
+func ParamsForCoin(coinType iwallet.CoinType, testnet bool) (*Params, error) {
+	switch coinType {
+	case iwallet.CtBitcoin:
+		if testnet {
+			return BitcoinParams(&chaincfg.TestNet3Params), nil
+		}
+		return BitcoinParams(&chaincfg.MainNetParams), nil
+	case iwallet.CtBitcoinCash:
+		if testnet {
+			return BitcoinCashParams(&bchchaincfg.TestNet3Params), nil
+		}
+		return BitcoinCashParams(&bchchaincfg.MainNetParams), nil
+	case iwallet.CtLitecoin:
+		if testnet {
+			return LitecoinParams(&ltcchaincfg.TestNet4Params), nil
+		}
+		return LitecoinParams(&ltcchaincfg.MainNetParams), nil
+	}
+	return nil, errors.New("headers are not supported for coin")
+}
+
+// ParamsForGenesis returns the header rules for the coin's network with
+// the given genesis block. It's used to pick the network a backend is on.
+func ParamsForGenesis(coinType iwallet.CoinType, genesis chainhash.Hash) (*Params, error) {
+	var candidates []*Params
+	switch coinType {
+	case iwallet.CtBitcoin:
+		candidates = []*Params{
+			BitcoinParams(&chaincfg.MainNetParams),
+			BitcoinParams(&chaincfg.TestNet3Params),
+			BitcoinParams(&chaincfg.RegressionNetParams),
+		}
+	case iwallet.CtBitcoinCash:
+		candidates = []*Params{
+			BitcoinCashParams(&bchchaincfg.MainNetParams),
+			BitcoinCashParams(&bchchaincfg.TestNet3Params),
+			BitcoinCashParams(&bchchaincfg.RegressionNetParams),
+		}
+	case iwallet.CtLitecoin:
+		candidates = []*Params{
+			LitecoinParams(&ltcchaincfg.MainNetParams),
+			LitecoinParams(&ltcchaincfg.TestNet4Params),
+			LitecoinParams(&ltcchaincfg.RegressionNetParams),
+		}
+	default:
+		return nil, errors.New("headers are not supported for coin")
+	}
+	for _, params := range candidates {
+		if params.Checkpoint.Header.BlockHash() == genesis {
+			return params, nil
+		}
+	}
+	return nil, errors.New("unknown genesis block")
+}
+
+func blockHash(header *wire.BlockHeader) chainhash.Hash {
+	return header.BlockHash()
+}
+
+// scryptHash is Litecoin's proof of work hash. It's scrypt with N=1024,
+// r=1, p=1 over the serialized header, which is used as both the password
+// and the salt.
+func scryptHash(header *wire.BlockHeader) chainhash.Hash {
+	var buf bytes.Buffer
+	if err := header.Serialize(&buf); err != nil {
+		return chainhash.Hash{}
+	}
+	out, err := scrypt.Key(buf.Bytes(), buf.Bytes(), 1024, 1, 1, chainhash.HashSize)
+	if err != nil {
+		return chainhash.Hash{}
+	}
+	var hash chainhash.Hash
+	copy(hash[:], out)
+	return hash
+}
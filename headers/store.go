@@ -0,0 +1,385 @@
+package headers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"gorm.io/gorm"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// medianTimeBlocks is the number of previous blocks whose median
+	// timestamp a new header must be after.
+	medianTimeBlocks = 11
+
+	// maxTimeOffset is how far into the future a header's timestamp may
+	// be.
+	maxTimeOffset = 2 * time.Hour
+
+	// maxLocatorHashes bounds the size of a block locator.
+	maxLocatorHashes = 64
+)
+
+var (
+	// ErrHeadersDoNotConnect is returned when a batch of headers doesn't
+	// build on any header in the store.
+	ErrHeadersDoNotConnect = errors.New("headers do not connect to chain")
+
+	// ErrHeaderNotFound is returned when there is no header at a height.
+	ErrHeaderNotFound = errors.New("header not found")
+
+	// ErrUnverifiedHeight is returned when a confirmation is above the
+	// tip of the store.
+	ErrUnverifiedHeight = errors.New("block height not yet verified")
+
+	// ErrNotInChain is returned when a block reported by a backend is
+	// not the block at its height in the store.
+	ErrNotInChain = errors.New("block is not in the verified chain")
+)
+
+// Store is a chain of validated block headers for a single coin, built on
+// top of a checkpoint and persisted in the database. When presented with a
+// fork it follows the chain with the most work.
+type Store struct {
+	db     database.Database
+	params *Params
+
+	mtx     sync.RWMutex
+	base    uint64
+	headers []wire.BlockHeader
+	hashes  []chainhash.Hash
+	heights map[chainhash.Hash]uint64
+
+	now func() time.Time
+}
+
+// NewStore loads the coin's headers from the database, initializing the
+// store with the checkpoint if it's empty.
+func NewStore(db database.Database, params *Params) (*Store, error) {
+	s := &Store{
+		db:      db,
+		params:  params,
+		base:    params.Checkpoint.Height,
+		heights: make(map[chainhash.Hash]uint64),
+		now:     time.Now,
+	}
+
+	var records []database.HeaderRecord
+	err := db.View(func(dbtx database.Tx) error {
+		return dbtx.Read().Where("coin=?", params.CoinType.CurrencyCode()).Where("height >= ?", s.base).Order("height asc").Find(&records).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	checkpointHash := params.Checkpoint.Header.BlockHash()
+	if len(records) == 0 {
+		s.append(params.Checkpoint.Header)
+		err := db.Update(func(dbtx database.Tx) error {
+			return saveHeaders(dbtx, params.CoinType, s.base, s.headers)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+
+	for i, rec := range records {
+		var header wire.BlockHeader
+		if err := header.Deserialize(bytes.NewReader(rec.Header)); err != nil {
+			return nil, err
+		}
+		if rec.Height != s.base+uint64(i) {
+			return nil, fmt.Errorf("missing stored header at height %d", s.base+uint64(i))
+		}
+		if i == 0 && header.BlockHash() != checkpointHash {
+			return nil, errors.New("stored headers do not match checkpoint")
+		}
+		if i > 0 && header.PrevBlock != s.hashes[i-1] {
+			return nil, fmt.Errorf("stored header at height %d does not connect", rec.Height)
+		}
+		s.append(header)
+	}
+	return s, nil
+}
+
+// LoadCheckpoint returns the first header stored for the coin, which is
+// the checkpoint the store was created with. It returns false if no
+// headers have been stored.
+func LoadCheckpoint(db database.Database, coinType iwallet.CoinType) (Checkpoint, bool, error) {
+	var rec database.HeaderRecord
+	err := db.View(func(dbtx database.Tx) error {
+		return dbtx.Read().Where("coin=?", coinType.CurrencyCode()).Order("height asc").First(&rec).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return Checkpoint{}, false, nil
+	} else if err != nil {
+		return Checkpoint{}, false, err
+	}
+	var header wire.BlockHeader
+	if err := header.Deserialize(bytes.NewReader(rec.Header)); err != nil {
+		return Checkpoint{}, false, err
+	}
+	return Checkpoint{Height: rec.Height, Header: header}, true, nil
+}
+
+// Params returns the rules the store validates headers against.
+func (s *Store) Params() *Params {
+	return s.params
+}
+
+// Tip returns the best header and its height.
+func (s *Store) Tip() (wire.BlockHeader, uint64) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.headers[len(s.headers)-1], s.tipHeight()
+}
+
+// HeaderAt returns the header at height in the best chain.
+func (s *Store) HeaderAt(height uint64) (wire.BlockHeader, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	header, ok := s.headerAt(height)
+	if !ok {
+		return wire.BlockHeader{}, ErrHeaderNotFound
+	}
+	return *header, nil
+}
+
+// HeightOf returns the height of the block if it's in the best chain.
+func (s *Store) HeightOf(hash chainhash.Hash) (uint64, bool) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	height, ok := s.heights[hash]
+	return height, ok
+}
+
+// Locator returns a block locator for the best chain. It contains the ten
+// most recent hashes followed by hashes exponentially further back and
+// ends with the checkpoint.
+func (s *Store) Locator() []*chainhash.Hash {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	var (
+		locator []*chainhash.Hash
+		step    = 1
+		i       = len(s.hashes) - 1
+	)
+	for i > 0 && len(locator) < maxLocatorHashes-1 {
+		hash := s.hashes[i]
+		locator = append(locator, &hash)
+		if len(locator) >= 10 {
+			step *= 2
+		}
+		i -= step
+	}
+	checkpoint := s.hashes[0]
+	return append(locator, &checkpoint)
+}
+
+// VerifyConfirmation checks that the block a backend reported a
+// transaction confirmed in is the block at that height in the store.
+// ErrUnverifiedHeight is returned if the store hasn't synced to the height
+// yet.
+func (s *Store) VerifyConfirmation(blockID iwallet.BlockID, height uint64) error {
+	hash, err := chainhash.NewHashFromStr(blockID.String())
+	if err != nil {
+		return err
+	}
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	if height > s.tipHeight() {
+		return ErrUnverifiedHeight
+	}
+	if height < s.base {
+		// Below the checkpoint the store can't say.
+		return nil
+	}
+	if s.hashes[height-s.base] != *hash {
+		return ErrNotInChain
+	}
+	return nil
+}
+
+// Connect validates the headers and adds them to the store. If they fork
+// from the best chain they replace it only if they have more work. It
+// returns whether the best chain changed and the height of the last block
+// the old and new chains have in common.
+func (s *Store) Connect(headers []*wire.BlockHeader) (bool, uint64, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if len(headers) == 0 {
+		return false, 0, nil
+	}
+	forkHeight, ok := s.heights[headers[0].PrevBlock]
+	if !ok {
+		return false, 0, ErrHeadersDoNotConnect
+	}
+
+	// Skip any headers we already have.
+	for len(headers) > 0 && forkHeight < s.tipHeight() && s.hashes[forkHeight+1-s.base] == headers[0].BlockHash() {
+		forkHeight++
+		headers = headers[1:]
+	}
+	if len(headers) == 0 {
+		return false, forkHeight, nil
+	}
+
+	view := &forkView{store: s, forkHeight: forkHeight}
+	for i, header := range headers {
+		height := forkHeight + 1 + uint64(i)
+		if header.PrevBlock != view.tipHash() {
+			return false, 0, errors.New("headers are not continuous")
+		}
+		if err := s.checkHeader(view, height, header); err != nil {
+			return false, 0, fmt.Errorf("invalid header at height %d: %s", height, err)
+		}
+		view.headers = append(view.headers, *header)
+	}
+
+	if forkHeight < s.tipHeight() {
+		oldWork, newWork := new(big.Int), new(big.Int)
+		for _, header := range s.headers[forkHeight+1-s.base:] {
+			oldWork.Add(oldWork, blockchain.CalcWork(header.Bits))
+		}
+		for _, header := range view.headers {
+			newWork.Add(newWork, blockchain.CalcWork(header.Bits))
+		}
+		if newWork.Cmp(oldWork) <= 0 {
+			return false, forkHeight, nil
+		}
+	}
+
+	err := s.db.Update(func(dbtx database.Tx) error {
+		if forkHeight < s.tipHeight() {
+			err := dbtx.Read().Where("coin=?", s.params.CoinType.CurrencyCode()).Where("height > ?", forkHeight).Delete(&database.HeaderRecord{}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return saveHeaders(dbtx, s.params.CoinType, forkHeight+1, view.headers)
+	})
+	if err != nil {
+		return false, 0, err
+	}
+
+	for _, hash := range s.hashes[forkHeight+1-s.base:] {
+		delete(s.heights, hash)
+	}
+	s.headers = s.headers[:forkHeight+1-s.base]
+	s.hashes = s.hashes[:forkHeight+1-s.base]
+	for _, header := range view.headers {
+		s.append(header)
+	}
+	return true, forkHeight, nil
+}
+
+// checkHeader validates the header's proof of work, difficulty and
+// timestamp against its ancestors in view.
+func (s *Store) checkHeader(view chainView, height uint64, header *wire.BlockHeader) error {
+	target := blockchain.CompactToBig(header.Bits)
+	if target.Sign() <= 0 || target.Cmp(s.params.PowLimit) > 0 {
+		return errors.New("target is out of range")
+	}
+	hash := s.params.PowHash(header)
+	if blockchain.HashToBig(&hash).Cmp(target) > 0 {
+		return errors.New("hash is above target")
+	}
+
+	if bits, ok := s.params.nextBits(s.params, view, height, header); ok && bits != header.Bits {
+		return fmt.Errorf("bits %08x do not match required %08x", header.Bits, bits)
+	}
+
+	var timestamps []int64
+	for h := height; h > 0 && len(timestamps) < medianTimeBlocks; h-- {
+		prev, ok := view.headerAt(h - 1)
+		if !ok {
+			break
+		}
+		timestamps = append(timestamps, prev.Timestamp.Unix())
+	}
+	if len(timestamps) > 0 {
+		sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+		if header.Timestamp.Unix() <= timestamps[len(timestamps)/2] {
+			return errors.New("timestamp is not after median time past")
+		}
+	}
+	if header.Timestamp.After(s.now().Add(maxTimeOffset)) {
+		return errors.New("timestamp is too far in the future")
+	}
+	return nil
+}
+
+func (s *Store) tipHeight() uint64 {
+	return s.base + uint64(len(s.headers)-1)
+}
+
+func (s *Store) headerAt(height uint64) (*wire.BlockHeader, bool) {
+	if height < s.base || height > s.tipHeight() {
+		return nil, false
+	}
+	return &s.headers[height-s.base], true
+}
+
+func (s *Store) append(header wire.BlockHeader) {
+	hash := header.BlockHash()
+	s.headers = append(s.headers, header)
+	s.hashes = append(s.hashes, hash)
+	s.heights[hash] = s.tipHeight()
+}
+
+// forkView is the store's best chain up to forkHeight followed by the
+// headers being connected.
+type forkView struct {
+	store      *Store
+	forkHeight uint64
+	headers    []wire.BlockHeader
+}
+
+func (v *forkView) headerAt(height uint64) (*wire.BlockHeader, bool) {
+	if height <= v.forkHeight {
+		return v.store.headerAt(height)
+	}
+	i := height - v.forkHeight - 1
+	if i >= uint64(len(v.headers)) {
+		return nil, false
+	}
+	return &v.headers[i], true
+}
+
+func (v *forkView) tipHash() chainhash.Hash {
+	if len(v.headers) == 0 {
+		return v.store.hashes[v.forkHeight-v.store.base]
+	}
+	return v.headers[len(v.headers)-1].BlockHash()
+}
+
+func saveHeaders(dbtx database.Tx, coinType iwallet.CoinType, height uint64, headers []wire.BlockHeader) error {
+	for i, header := range headers {
+		var buf bytes.Buffer
+		if err := header.Serialize(&buf); err != nil {
+			return err
+		}
+		err := dbtx.Save(&database.HeaderRecord{
+			Coin:   coinType.CurrencyCode(),
+			Height: height + uint64(i),
+			Hash:   header.BlockHash().String(),
+			Header: buf.Bytes(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
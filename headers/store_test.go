@@ -0,0 +1,259 @@
+package headers
+
+import (
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/cpacia/multiwallet/database"
+	"github.com/cpacia/multiwallet/database/sqlitedb"
+	iwallet "github.com/cpacia/wallet-interface"
+	"testing"
+	"time"
+)
+
+func newTestStore(t *testing.T) (*Store, database.Database) {
+	db, err := sqlitedb.NewMemoryDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.InitializeDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewStore(db, BitcoinParams(&chaincfg.RegressionNetParams))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, db
+}
+
+// solve increments the header's nonce until it meets its target.
+func solve(s *Store, header *wire.BlockHeader) {
+	target := blockchain.CompactToBig(header.Bits)
+	for {
+		hash := s.params.PowHash(header)
+		if blockchain.HashToBig(&hash).Cmp(target) <= 0 {
+			return
+		}
+		header.Nonce++
+	}
+}
+
+// mineHeaders returns n regtest headers building on prev.
+func mineHeaders(s *Store, prev *wire.BlockHeader, n int, salt uint32) []*wire.BlockHeader {
+	headers := make([]*wire.BlockHeader, 0, n)
+	for i := 0; i < n; i++ {
+		header := &wire.BlockHeader{
+			Version:   1,
+			PrevBlock: prev.BlockHash(),
+			Timestamp: prev.Timestamp.Add(time.Minute * 10),
+			Bits:      s.params.PowLimitBits,
+			Nonce:     salt << 16,
+		}
+		solve(s, header)
+		headers = append(headers, header)
+		prev = header
+	}
+	return headers
+}
+
+func TestStore_Connect(t *testing.T) {
+	store, db := newTestStore(t)
+	defer db.Close()
+
+	genesis, height := store.Tip()
+	if height != 0 || genesis.BlockHash() != *chaincfg.RegressionNetParams.GenesisHash {
+		t.Fatal("Expected store to start at genesis")
+	}
+
+	headers := mineHeaders(store, &genesis, 10, 0)
+	changed, _, err := store.Connect(headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Error("Expected chain to change")
+	}
+	tip, height := store.Tip()
+	if height != 10 || tip.BlockHash() != headers[9].BlockHash() {
+		t.Errorf("Expected tip at height 10, got %d", height)
+	}
+
+	// Connecting the same headers again is a no-op.
+	changed, _, err = store.Connect(headers[5:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed {
+		t.Error("Expected chain not to change")
+	}
+
+	// A shorter fork is ignored.
+	changed, _, err = store.Connect(mineHeaders(store, headers[6], 2, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed {
+		t.Error("Expected shorter fork to be ignored")
+	}
+
+	// A longer fork replaces the best chain.
+	fork := mineHeaders(store, headers[6], 5, 2)
+	changed, forkHeight, err := store.Connect(fork)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed || forkHeight != 7 {
+		t.Errorf("Expected reorg at height 7, got %d", forkHeight)
+	}
+	if _, height = store.Tip(); height != 12 {
+		t.Errorf("Expected tip at height 12, got %d", height)
+	}
+	if _, ok := store.HeightOf(headers[9].BlockHash()); ok {
+		t.Error("Expected orphaned header to be removed")
+	}
+
+	// The chain is reloaded from the database.
+	reloaded, err := NewStore(db, store.params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tip, height = reloaded.Tip()
+	if height != 12 || tip.BlockHash() != fork[4].BlockHash() {
+		t.Errorf("Expected reloaded tip at height 12, got %d", height)
+	}
+	var count int64
+	err = db.View(func(dbtx database.Tx) error {
+		return dbtx.Read().Model(&database.HeaderRecord{}).Where("coin=?", iwallet.CtBitcoin.CurrencyCode()).Count(&count).Error
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 13 {
+		t.Errorf("Expected 13 stored headers, got %d", count)
+	}
+
+	if _, _, err := store.Connect(mineHeaders(store, &wire.BlockHeader{PrevBlock: chainhash.Hash{1}}, 1, 3)); err != ErrHeadersDoNotConnect {
+		t.Errorf("Expected ErrHeadersDoNotConnect, got %v", err)
+	}
+}
+
+func TestStore_CheckHeader(t *testing.T) {
+	store, db := newTestStore(t)
+	defer db.Close()
+
+	genesis, _ := store.Tip()
+	headers := mineHeaders(store, &genesis, 12, 0)
+	if _, _, err := store.Connect(headers[:11]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Bits must match the difficulty rules.
+	bad := *headers[11]
+	bad.Bits = 0x1d00ffff
+	if _, _, err := store.Connect([]*wire.BlockHeader{&bad}); err == nil {
+		t.Error("Expected error for incorrect bits")
+	}
+
+	// The hash must meet the target.
+	bad = *headers[11]
+	target := blockchain.CompactToBig(bad.Bits)
+	for {
+		hash := store.params.PowHash(&bad)
+		if blockchain.HashToBig(&hash).Cmp(target) > 0 {
+			break
+		}
+		bad.Nonce++
+	}
+	if _, _, err := store.Connect([]*wire.BlockHeader{&bad}); err == nil {
+		t.Error("Expected error for invalid proof of work")
+	}
+
+	// The timestamp must be after the median of the last 11 blocks.
+	bad = *headers[11]
+	bad.Timestamp = headers[5].Timestamp
+	solve(store, &bad)
+	if _, _, err := store.Connect([]*wire.BlockHeader{&bad}); err == nil {
+		t.Error("Expected error for timestamp before median time past")
+	}
+
+	// Or too far in the future.
+	store.now = func() time.Time { return headers[11].Timestamp.Add(-time.Hour * 3) }
+	if _, _, err := store.Connect(headers[11:]); err == nil {
+		t.Error("Expected error for timestamp in the future")
+	}
+}
+
+func TestStore_VerifyConfirmation(t *testing.T) {
+	store, db := newTestStore(t)
+	defer db.Close()
+
+	genesis, _ := store.Tip()
+	headers := mineHeaders(store, &genesis, 3, 0)
+	if _, _, err := store.Connect(headers); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.VerifyConfirmation(iwallet.BlockID(headers[1].BlockHash().String()), 2); err != nil {
+		t.Errorf("Expected confirmation to verify, got %s", err)
+	}
+	if err := store.VerifyConfirmation(iwallet.BlockID(headers[1].BlockHash().String()), 3); err != ErrNotInChain {
+		t.Errorf("Expected ErrNotInChain, got %v", err)
+	}
+	if err := store.VerifyConfirmation(iwallet.BlockID(headers[1].BlockHash().String()), 4); err != ErrUnverifiedHeight {
+		t.Errorf("Expected ErrUnverifiedHeight, got %v", err)
+	}
+}
+
+func TestMerkleRoot(t *testing.T) {
+	txids := []chainhash.Hash{{1}, {2}, {3}}
+	hashPair := func(a, b chainhash.Hash) chainhash.Hash {
+		return chainhash.DoubleHashH(append(a[:], b[:]...))
+	}
+	left := hashPair(txids[0], txids[1])
+	right := hashPair(txids[2], txids[2])
+	root := hashPair(left, right)
+
+	if MerkleRoot(txids[1], 1, []chainhash.Hash{txids[0], right}) != root {
+		t.Error("Incorrect root for index 1")
+	}
+	if MerkleRoot(txids[2], 2, []chainhash.Hash{txids[2], left}) != root {
+		t.Error("Incorrect root for index 2")
+	}
+	if MerkleRoot(txids[2], 0, []chainhash.Hash{txids[2], left}) == root {
+		t.Error("Expected wrong index not to match")
+	}
+}
+
+func TestMerkleBranchFromPartialTree(t *testing.T) {
+	txids := []chainhash.Hash{{1}, {2}, {3}}
+	hashPair := func(a, b chainhash.Hash) chainhash.Hash {
+		return chainhash.DoubleHashH(append(a[:], b[:]...))
+	}
+	left := hashPair(txids[0], txids[1])
+	right := hashPair(txids[2], txids[2])
+
+	// The tree matching the second transaction is walked depth first:
+	// root, left node, txid 0, txid 1 (matched), right node.
+	mb := &wire.MsgMerkleBlock{
+		Header:       wire.BlockHeader{MerkleRoot: hashPair(left, right)},
+		Transactions: 3,
+		Hashes:       []*chainhash.Hash{&txids[0], &txids[1], &right},
+		Flags:        []byte{0x0b},
+	}
+	txid, index, branch, err := MerkleBranchFromPartialTree(mb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txid != txids[1] || index != 1 {
+		t.Errorf("Expected txid 1 at index 1, got %s at %d", txid, index)
+	}
+	if len(branch) != 2 || branch[0] != txids[0] || branch[1] != right {
+		t.Errorf("Incorrect branch %v", branch)
+	}
+
+	mb.Header.MerkleRoot = left
+	if _, _, _, err := MerkleBranchFromPartialTree(mb); err != ErrInvalidMerkleProof {
+		t.Errorf("Expected ErrInvalidMerkleProof, got %v", err)
+	}
+}
@@ -0,0 +1,378 @@
+// Package history queries the transaction history of every coin wallet
+// sharing a database as one stream. Results are ordered by timestamp, with
+// the coin and txid breaking ties, and paged with cursors which stay valid
+// as new transactions arrive.
+package history
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/multiwallet/database"
+	"github.com/cpacia/multiwallet/swap"
+	iwallet "github.com/cpacia/wallet-interface"
+	"gorm.io/gorm"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidCursor is returned when a cursor passed to After wasn't
+// returned by a previous query.
+var ErrInvalidCursor = errors.New("invalid history cursor")
+
+// Direction filters transactions by whether they add to or take from the
+// wallet's balance.
+type Direction int
+
+const (
+	// AnyDirection returns both incoming and outgoing transactions.
+	AnyDirection Direction = iota
+
+	// Incoming returns transactions with a positive value.
+	Incoming
+
+	// Outgoing returns transactions with a negative value.
+	Outgoing
+)
+
+// SortOrder is the order entries are returned in.
+type SortOrder int
+
+const (
+	// NewestFirst returns the most recent transactions first. This is the
+	// default.
+	NewestFirst SortOrder = iota
+
+	// OldestFirst returns the oldest transactions first.
+	OldestFirst
+)
+
+// Entry is a transaction in the history along with the labels of the
+// wallet addresses it involves and its metadata.
+type Entry struct {
+	Coin        iwallet.CoinType
+	Transaction iwallet.Transaction
+	Labels      map[iwallet.Address]string
+	Metadata    base.TransactionMetadata
+
+	// Swap is set if the transaction is the deposit or payout of a
+	// swap between the wallets.
+	Swap *swap.Swap
+
+	// Cursor can be passed to After to continue from this entry.
+	Cursor string
+}
+
+// Page is one page of query results. Next is the cursor of the last entry
+// and is empty if there are no more results.
+type Page struct {
+	Entries []Entry
+	Next    string
+}
+
+// Query selects transactions from the history. It's built by chaining its
+// methods and run with Execute. Unset filters match everything.
+type Query struct {
+	db        database.Database
+	coins     []iwallet.CoinType
+	from, to  time.Time
+	direction Direction
+	minAmount *iwallet.Amount
+	label     string
+	category  string
+	limit     int
+	after     string
+	order     SortOrder
+}
+
+// NewQuery returns a query over every wallet in the database.
+func NewQuery(db database.Database) *Query {
+	return &Query{db: db, limit: -1}
+}
+
+// Coins restricts the query to the given coins.
+func (q *Query) Coins(coins ...iwallet.CoinType) *Query {
+	q.coins = coins
+	return q
+}
+
+// Between restricts the query to transactions at or after from and before
+// to. A zero time leaves that end of the range open.
+func (q *Query) Between(from, to time.Time) *Query {
+	q.from, q.to = from, to
+	return q
+}
+
+// Direction restricts the query to incoming or outgoing transactions.
+func (q *Query) Direction(d Direction) *Query {
+	q.direction = d
+	return q
+}
+
+// MinAmount restricts the query to transactions which change the balance
+// by at least amt in either direction. The amount is in the coin's base
+// unit so it's mostly useful together with Coins.
+func (q *Query) MinAmount(amt iwallet.Amount) *Query {
+	q.minAmount = &amt
+	return q
+}
+
+// Label restricts the query to transactions involving a wallet address
+// with the label.
+func (q *Query) Label(label string) *Query {
+	q.label = label
+	return q
+}
+
+// Category restricts the query to transactions tagged with the category.
+func (q *Query) Category(category string) *Query {
+	q.category = category
+	return q
+}
+
+// Limit sets the maximum number of entries in a page. A negative limit
+// returns every result.
+func (q *Query) Limit(n int) *Query {
+	q.limit = n
+	return q
+}
+
+// After continues the query from the entry with the given cursor. The
+// query's sort order must be the same as the one which returned it.
+func (q *Query) After(cursor string) *Query {
+	q.after = cursor
+	return q
+}
+
+// Sort sets the order entries are returned in.
+func (q *Query) Sort(order SortOrder) *Query {
+	q.order = order
+	return q
+}
+
+// Execute runs the query and returns a page of results.
+func (q *Query) Execute() (*Page, error) {
+	var after *position
+	if q.after != "" {
+		p, err := decodeCursor(q.after)
+		if err != nil {
+			return nil, err
+		}
+		after = p
+	}
+
+	var (
+		records  []database.TransactionRecord
+		labels   = make(map[iwallet.CoinType]map[iwallet.Address]string)
+		metadata = make(map[string]base.TransactionMetadata)
+		swaps    map[string]swap.Swap
+	)
+	err := q.db.View(func(dbtx database.Tx) error {
+		coins := q.coins
+		if len(coins) == 0 {
+			coins = []iwallet.CoinType{""}
+		}
+		for _, ct := range coins {
+			recs, err := q.transactions(dbtx, ct)
+			if err != nil {
+				return err
+			}
+			records = append(records, recs...)
+		}
+
+		var addrs []database.AddressRecord
+		err := dbtx.Read().Where("label <> ?", "").Find(&addrs).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		for _, rec := range addrs {
+			ct := iwallet.CoinType(rec.Coin)
+			if labels[ct] == nil {
+				labels[ct] = make(map[iwallet.Address]string)
+			}
+			labels[ct][rec.Address()] = rec.Label
+		}
+
+		var tags []database.TransactionMetadataRecord
+		err = dbtx.Read().Find(&tags).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		for _, rec := range tags {
+			metadata[rec.Coin+":"+rec.Txid] = base.TransactionMetadata{
+				Note:     rec.Note,
+				Category: rec.Category,
+				OrderID:  rec.OrderID,
+			}
+		}
+
+		swaps, err = swap.Transactions(dbtx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	positions := make([]position, len(records))
+	for i, rec := range records {
+		positions[i] = position{timestamp: rec.Timestamp.UnixNano(), coin: rec.Coin, txid: rec.Txid}
+	}
+	idx := make([]int, len(records))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.Slice(idx, func(i, j int) bool {
+		return q.before(positions[idx[i]], positions[idx[j]])
+	})
+
+	page := &Page{}
+	for _, i := range idx {
+		if after != nil && !q.before(*after, positions[i]) {
+			continue
+		}
+		tx, err := records[i].Transaction()
+		if err != nil {
+			return nil, err
+		}
+		entry := Entry{
+			Coin:        iwallet.CoinType(records[i].Coin),
+			Transaction: tx,
+			Labels:      make(map[iwallet.Address]string),
+			Metadata:    metadata[records[i].Coin+":"+records[i].Txid],
+			Cursor:      positions[i].encode(),
+		}
+		if s, ok := swaps[records[i].Coin+":"+records[i].Txid]; ok {
+			entry.Swap = &s
+		}
+		coinLabels := labels[entry.Coin]
+		for _, from := range tx.From {
+			if label, ok := coinLabels[from.Address]; ok {
+				entry.Labels[from.Address] = label
+			}
+		}
+		for _, to := range tx.To {
+			if label, ok := coinLabels[to.Address]; ok {
+				entry.Labels[to.Address] = label
+			}
+		}
+		if !q.matches(&entry) {
+			continue
+		}
+		if q.limit >= 0 && len(page.Entries) == q.limit {
+			page.Next = page.Entries[len(page.Entries)-1].Cursor
+			break
+		}
+		page.Entries = append(page.Entries, entry)
+	}
+	return page, nil
+}
+
+// transactions returns the records of the coin in the query's time range,
+// or of every coin if ct is empty.
+func (q *Query) transactions(dbtx database.Tx, ct iwallet.CoinType) ([]database.TransactionRecord, error) {
+	query := dbtx.Read()
+	if ct != "" {
+		query = query.Where("coin=?", ct.CurrencyCode())
+	}
+	if !q.from.IsZero() {
+		query = query.Where("timestamp >= ?", q.from)
+	}
+	if !q.to.IsZero() {
+		query = query.Where("timestamp < ?", q.to)
+	}
+	var records []database.TransactionRecord
+	err := query.Find(&records).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	return records, nil
+}
+
+// matches applies the filters which need the decoded transaction.
+func (q *Query) matches(entry *Entry) bool {
+	value := entry.Transaction.Value
+	zero := iwallet.NewAmount(0)
+	switch q.direction {
+	case Incoming:
+		if value.Cmp(zero) <= 0 {
+			return false
+		}
+	case Outgoing:
+		if value.Cmp(zero) >= 0 {
+			return false
+		}
+	}
+	if q.minAmount != nil {
+		if value.Cmp(zero) < 0 {
+			value = zero.Sub(value)
+		}
+		if value.Cmp(*q.minAmount) < 0 {
+			return false
+		}
+	}
+	if q.label != "" {
+		found := false
+		for _, label := range entry.Labels {
+			if label == q.label {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if q.category != "" && entry.Metadata.Category != q.category {
+		return false
+	}
+	return true
+}
+
+// before returns whether a sorts before b in the query's order.
+func (q *Query) before(a, b position) bool {
+	if q.order == OldestFirst {
+		return a.less(b)
+	}
+	return b.less(a)
+}
+
+// position is the sort key of an entry and the contents of its cursor.
+type position struct {
+	timestamp int64
+	coin      string
+	txid      string
+}
+
+func (p position) less(o position) bool {
+	if p.timestamp != o.timestamp {
+		return p.timestamp < o.timestamp
+	}
+	if p.coin != o.coin {
+		return p.coin < o.coin
+	}
+	return p.txid < o.txid
+}
+
+func (p position) encode() string {
+	s := fmt.Sprintf("%d:%s:%s", p.timestamp, p.coin, p.txid)
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+func decodeCursor(cursor string) (*position, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	parts := strings.SplitN(string(b), ":", 3)
+	if len(parts) != 3 {
+		return nil, ErrInvalidCursor
+	}
+	ts, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &position{timestamp: ts, coin: parts[1], txid: parts[2]}, nil
+}
@@ -0,0 +1,162 @@
+package history
+
+import (
+	"github.com/cpacia/multiwallet/database"
+	"github.com/cpacia/multiwallet/database/memorydb"
+	iwallet "github.com/cpacia/wallet-interface"
+	"testing"
+	"time"
+)
+
+func setupDB(t *testing.T) database.Database {
+	db, err := memorydb.NewMemoryDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.InitializeDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+
+	txs := []struct {
+		coin  iwallet.CoinType
+		id    string
+		ts    int64
+		value int64
+		addr  string
+	}{
+		{iwallet.CtBitcoin, "b1", 1000, 50000, "btc-savings"},
+		{iwallet.CtLitecoin, "l1", 2000, -20000, "ltc-1"},
+		{iwallet.CtBitcoin, "b2", 3000, -10000, "btc-2"},
+		{iwallet.CtBitcoinCash, "c1", 3000, 700000, "bch-1"},
+		{iwallet.CtBitcoin, "b3", 4000, 900, "btc-savings"},
+	}
+	err = db.Update(func(dbtx database.Tx) error {
+		for _, tx := range txs {
+			addr := iwallet.NewAddress(tx.addr, tx.coin)
+			rec, err := database.NewTransactionRecord(iwallet.Transaction{
+				ID:        iwallet.TransactionID(tx.id),
+				Timestamp: time.Unix(tx.ts, 0),
+				Value:     iwallet.NewAmount(tx.value),
+				To:        []iwallet.SpendInfo{{Address: addr, Amount: iwallet.NewAmount(tx.value)}},
+			}, tx.coin)
+			if err != nil {
+				return err
+			}
+			if err := dbtx.Save(rec); err != nil {
+				return err
+			}
+		}
+		err := dbtx.Save(&database.AddressRecord{Addr: "btc-savings", Coin: iwallet.CtBitcoin.CurrencyCode(), Label: "savings"})
+		if err != nil {
+			return err
+		}
+		return dbtx.Save(&database.TransactionMetadataRecord{Txid: "l1", Coin: iwallet.CtLitecoin.CurrencyCode(), Category: "rent"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func txids(page *Page) []string {
+	ids := make([]string, 0, len(page.Entries))
+	for _, e := range page.Entries {
+		ids = append(ids, e.Transaction.ID.String())
+	}
+	return ids
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestQuery_Filters(t *testing.T) {
+	db := setupDB(t)
+
+	tests := []struct {
+		name     string
+		query    *Query
+		expected []string
+	}{
+		{"all", NewQuery(db), []string{"b3", "b2", "c1", "l1", "b1"}},
+		{"oldest first", NewQuery(db).Sort(OldestFirst), []string{"b1", "l1", "c1", "b2", "b3"}},
+		{"coins", NewQuery(db).Coins(iwallet.CtBitcoin, iwallet.CtLitecoin), []string{"b3", "b2", "l1", "b1"}},
+		{"time range", NewQuery(db).Between(time.Unix(2000, 0), time.Unix(4000, 0)), []string{"b2", "c1", "l1"}},
+		{"incoming", NewQuery(db).Direction(Incoming), []string{"b3", "c1", "b1"}},
+		{"outgoing", NewQuery(db).Direction(Outgoing), []string{"b2", "l1"}},
+		{"min amount", NewQuery(db).MinAmount(iwallet.NewAmount(20000)), []string{"c1", "l1", "b1"}},
+		{"label", NewQuery(db).Label("savings"), []string{"b3", "b1"}},
+		{"category", NewQuery(db).Category("rent"), []string{"l1"}},
+	}
+	for _, test := range tests {
+		page, err := test.query.Execute()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ids := txids(page); !equal(ids, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, ids)
+		}
+		if page.Next != "" {
+			t.Errorf("%s: expected no next cursor", test.name)
+		}
+	}
+}
+
+func TestQuery_Pagination(t *testing.T) {
+	db := setupDB(t)
+
+	var (
+		all    []string
+		cursor string
+	)
+	for {
+		q := NewQuery(db).Limit(2)
+		if cursor != "" {
+			q.After(cursor)
+		}
+		page, err := q.Execute()
+		if err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, txids(page)...)
+
+		// A transaction arriving between pages doesn't shift the
+		// remaining results.
+		if cursor == "" {
+			err := db.Update(func(dbtx database.Tx) error {
+				rec, err := database.NewTransactionRecord(iwallet.Transaction{
+					ID:        "new",
+					Timestamp: time.Unix(5000, 0),
+					Value:     iwallet.NewAmount(1),
+				}, iwallet.CtBitcoin)
+				if err != nil {
+					return err
+				}
+				return dbtx.Save(rec)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if page.Next == "" {
+			break
+		}
+		cursor = page.Next
+	}
+	expected := []string{"b3", "b2", "c1", "l1", "b1"}
+	if !equal(all, expected) {
+		t.Errorf("Expected %v, got %v", expected, all)
+	}
+
+	if _, err := NewQuery(db).After("not a cursor").Execute(); err != ErrInvalidCursor {
+		t.Errorf("Expected ErrInvalidCursor, got %v", err)
+	}
+}
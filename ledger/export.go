@@ -0,0 +1,114 @@
+package ledger
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/cpacia/multiwallet/base"
+	iwallet "github.com/cpacia/wallet-interface"
+	"io"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Format is the encoding used by Write.
+type Format int
+
+const (
+	// FormatLedger writes a ledger-cli journal. Amounts are in whole
+	// coins with the currency code as the commodity.
+	FormatLedger Format = iota
+
+	// FormatQuickBooks writes a QuickBooks journal entry import CSV
+	// with one row per posting. Rows with the same Journal No belong to
+	// the same entry. Amounts are in whole coins.
+	FormatQuickBooks
+)
+
+// Write encodes the entries to out in the given format.
+func Write(out io.Writer, entries []Entry, format Format) error {
+	switch format {
+	case FormatLedger:
+		return writeLedger(out, entries)
+	case FormatQuickBooks:
+		return writeQuickBooks(out, entries)
+	}
+	return errors.New("unknown ledger format")
+}
+
+func writeLedger(out io.Writer, entries []Entry) error {
+	for i, e := range entries {
+		if i > 0 {
+			if _, err := io.WriteString(out, "\n"); err != nil {
+				return err
+			}
+		}
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "%s * %s\n", e.Timestamp.UTC().Format("2006/01/02"), e.payee())
+		fmt.Fprintf(&sb, "    ; Txid: %s\n", e.Txid)
+		if e.Category != "" {
+			fmt.Fprintf(&sb, "    ; Category: %s\n", e.Category)
+		}
+		for _, p := range e.Postings {
+			fmt.Fprintf(&sb, "    %-40s  %s %s\n", p.Account, formatAmount(p.Amount, e.Coin), e.Coin.CurrencyCode())
+		}
+		if _, err := io.WriteString(out, sb.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeQuickBooks(out io.Writer, entries []Entry) error {
+	w := csv.NewWriter(out)
+	header := []string{"Journal No", "Journal Date", "Account Name", "Debits", "Credits", "Description", "Memo"}
+	if err := w.Write(header); err != nil {
+		return err
+	}
+	zero := iwallet.NewAmount(0)
+	for i, e := range entries {
+		for _, p := range e.Postings {
+			var debit, credit string
+			if p.Amount.Cmp(zero) > 0 {
+				debit = formatAmount(p.Amount, e.Coin)
+			} else {
+				credit = formatAmount(zero.Sub(p.Amount), e.Coin)
+			}
+			row := []string{
+				strconv.Itoa(i + 1),
+				e.Timestamp.UTC().Format("01/02/2006"),
+				p.Account,
+				debit,
+				credit,
+				e.payee(),
+				fmt.Sprintf("%s %s", e.Coin.CurrencyCode(), e.Txid),
+			}
+			if err := w.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// payee is the entry's description, or its kind if it has none.
+func (e Entry) payee() string {
+	if e.Description != "" {
+		return e.Description
+	}
+	return string(e.Kind)
+}
+
+// formatAmount converts the amount from the coin's base unit to whole
+// coins.
+func formatAmount(amount iwallet.Amount, coinType iwallet.CoinType) string {
+	v, ok := new(big.Int).SetString(amount.String(), 10)
+	if !ok {
+		return amount.String()
+	}
+	decimals := base.CoinDecimals(coinType)
+	divisor := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimals)), nil)
+	return new(big.Rat).SetFrac(v, divisor).FloatString(decimals)
+}
@@ -0,0 +1,358 @@
+// Package ledger turns the wallets' transactions into double-entry
+// bookkeeping. Each transaction becomes a journal entry whose postings
+// debit and credit accounts in the business's chart of accounts, and the
+// journal can be written in formats accounting software imports.
+package ledger
+
+import (
+	"errors"
+	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"gorm.io/gorm"
+	"sort"
+	"time"
+)
+
+// Kind is what a journal entry or posting records.
+type Kind string
+
+const (
+	// KindReceive is a payment into the wallet.
+	KindReceive Kind = "receive"
+
+	// KindSend is a payment out of the wallet.
+	KindSend Kind = "send"
+
+	// KindFee is the network fee paid by the wallet. It's only used for
+	// postings.
+	KindFee Kind = "fee"
+
+	// KindTransfer moves coins between the wallet's own addresses so
+	// only the fee leaves the wallet.
+	KindTransfer Kind = "transfer"
+
+	// KindEscrowLock pays into an escrow the wallet funded as the buyer.
+	KindEscrowLock Kind = "escrow-lock"
+
+	// KindEscrowRelease spends from an escrow the wallet funded as the
+	// buyer, either back to the wallet or to the vendor.
+	KindEscrowRelease Kind = "escrow-release"
+)
+
+// Accounts is the chart of accounts entries are posted to. Wallet and
+// Escrow are asset accounts and are suffixed with ":" and the coin's
+// currency code so each coin has its own. Income and Expenses are the
+// counter accounts for payments in and out unless the transaction's
+// category is mapped to another account in Categories.
+type Accounts struct {
+	Wallet   string
+	Escrow   string
+	Income   string
+	Expenses string
+	Fees     string
+
+	Categories map[string]string
+}
+
+// DefaultAccounts returns a chart of accounts with the usual top level
+// account names.
+func DefaultAccounts() Accounts {
+	return Accounts{
+		Wallet:   "Assets:Wallet",
+		Escrow:   "Assets:Escrow",
+		Income:   "Income:Receipts",
+		Expenses: "Expenses:Payments",
+		Fees:     "Expenses:Fees",
+	}
+}
+
+// counter returns the account for payments to or from others in the
+// category, or def if it isn't mapped.
+func (a Accounts) counter(category, def string) string {
+	if account, ok := a.Categories[category]; ok && category != "" {
+		return account
+	}
+	return def
+}
+
+// Posting is one line of a journal entry. A positive Amount is a debit and
+// a negative Amount a credit, in the coin's base unit.
+type Posting struct {
+	Account string
+	Amount  iwallet.Amount
+	Kind    Kind
+}
+
+// Entry is the journal entry for a transaction. Its postings sum to zero.
+// Description is the transaction's note, if it has one.
+type Entry struct {
+	Coin        iwallet.CoinType
+	Txid        iwallet.TransactionID
+	Timestamp   time.Time
+	Kind        Kind
+	Description string
+	Category    string
+	Postings    []Posting
+}
+
+// Build returns the journal entries for the transactions of the given
+// coins, or of every coin if none are given, oldest first. Transactions
+// which don't move any of the wallet's coins are skipped.
+//
+// Transactions removed by history pruning are journaled from their
+// summaries. Their escrow payments can't be told apart so they're posted
+// as sends and receives.
+func Build(db database.Database, accounts Accounts, coins ...iwallet.CoinType) ([]Entry, error) {
+	include := func(coin string) bool {
+		if len(coins) == 0 {
+			return true
+		}
+		for _, ct := range coins {
+			if ct.CurrencyCode() == coin {
+				return true
+			}
+		}
+		return false
+	}
+
+	var (
+		records   []database.TransactionRecord
+		summaries []database.TransactionSummary
+		own       = make(map[string]map[iwallet.Address]bool)
+		escrows   = make(map[string]map[iwallet.Address]bool)
+		metadata  = make(map[string]base.TransactionMetadata)
+	)
+	err := db.View(func(dbtx database.Tx) error {
+		if err := find(dbtx, &records); err != nil {
+			return err
+		}
+		if err := find(dbtx, &summaries); err != nil {
+			return err
+		}
+
+		var addrs []database.AddressRecord
+		if err := find(dbtx, &addrs); err != nil {
+			return err
+		}
+		for _, rec := range addrs {
+			if own[rec.Coin] == nil {
+				own[rec.Coin] = make(map[iwallet.Address]bool)
+			}
+			own[rec.Coin][rec.Address()] = true
+		}
+
+		// Only escrows the wallet funds hold its coins. Payments
+		// from other escrows are ordinary receives.
+		var escrowRecs []database.EscrowRecord
+		if err := find(dbtx, &escrowRecs); err != nil {
+			return err
+		}
+		for _, rec := range escrowRecs {
+			if rec.Role != string(base.EscrowRoleBuyer) {
+				continue
+			}
+			if escrows[rec.Coin] == nil {
+				escrows[rec.Coin] = make(map[iwallet.Address]bool)
+			}
+			escrows[rec.Coin][iwallet.NewAddress(rec.Addr, iwallet.CoinType(rec.Coin))] = true
+		}
+
+		var tags []database.TransactionMetadataRecord
+		if err := find(dbtx, &tags); err != nil {
+			return err
+		}
+		for _, rec := range tags {
+			metadata[rec.Coin+":"+rec.Txid] = base.TransactionMetadata{
+				Note:     rec.Note,
+				Category: rec.Category,
+				OrderID:  rec.OrderID,
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	for _, rec := range records {
+		if !include(rec.Coin) {
+			continue
+		}
+		tx, err := rec.Transaction()
+		if err != nil {
+			return nil, err
+		}
+		entry := Entry{
+			Coin:      iwallet.CoinType(rec.Coin),
+			Txid:      tx.ID,
+			Timestamp: rec.Timestamp,
+		}
+		entry.setMetadata(metadata[rec.Coin+":"+rec.Txid])
+		if entry.postTransaction(tx, accounts, own[rec.Coin], escrows[rec.Coin]) {
+			entries = append(entries, entry)
+		}
+	}
+	for _, summary := range summaries {
+		if !include(summary.Coin) {
+			continue
+		}
+		entry := Entry{
+			Coin:      iwallet.CoinType(summary.Coin),
+			Txid:      iwallet.TransactionID(summary.Txid),
+			Timestamp: summary.Timestamp,
+		}
+		entry.setMetadata(metadata[summary.Coin+":"+summary.Txid])
+		if entry.postSummary(summary, accounts) {
+			entries = append(entries, entry)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if !a.Timestamp.Equal(b.Timestamp) {
+			return a.Timestamp.Before(b.Timestamp)
+		}
+		if a.Coin != b.Coin {
+			return a.Coin < b.Coin
+		}
+		return a.Txid < b.Txid
+	})
+	return entries, nil
+}
+
+func find(dbtx database.Tx, dest interface{}) error {
+	err := dbtx.Read().Find(dest).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+	return nil
+}
+
+func (e *Entry) setMetadata(metadata base.TransactionMetadata) {
+	e.Description = metadata.Note
+	e.Category = metadata.Category
+}
+
+// postTransaction adds the postings for the transaction and returns
+// whether it moves any of the wallet's coins. The wallet's inputs pay
+// for everything else in the transaction so the fee is posted whenever
+// any input is the wallet's.
+func (e *Entry) postTransaction(tx iwallet.Transaction, accounts Accounts, own, escrows map[iwallet.Address]bool) bool {
+	var (
+		zero                           = iwallet.NewAmount(0)
+		ownIn, escrowIn, externalIn    = zero, zero, zero
+		ownOut, escrowOut, externalOut = zero, zero, zero
+	)
+	for _, from := range tx.From {
+		switch {
+		case own[from.Address]:
+			ownIn = ownIn.Add(from.Amount)
+		case escrows[from.Address]:
+			escrowIn = escrowIn.Add(from.Amount)
+		default:
+			externalIn = externalIn.Add(from.Amount)
+		}
+	}
+	for _, to := range tx.To {
+		switch {
+		case own[to.Address]:
+			ownOut = ownOut.Add(to.Amount)
+		case escrows[to.Address]:
+			escrowOut = escrowOut.Add(to.Amount)
+		default:
+			externalOut = externalOut.Add(to.Amount)
+		}
+	}
+
+	walletAccount := accounts.Wallet + ":" + e.Coin.CurrencyCode()
+	escrowAccount := accounts.Escrow + ":" + e.Coin.CurrencyCode()
+	income := accounts.counter(e.Category, accounts.Income)
+
+	spent := ownIn.Cmp(zero) > 0 || escrowIn.Cmp(zero) > 0
+	if !spent {
+		received := ownOut.Add(escrowOut)
+		if received.Cmp(zero) == 0 {
+			return false
+		}
+		e.Kind = KindReceive
+		e.post(walletAccount, ownOut, KindReceive)
+		e.post(escrowAccount, escrowOut, KindEscrowLock)
+		e.post(income, zero.Sub(received), KindReceive)
+		return true
+	}
+
+	switch {
+	case escrowIn.Cmp(zero) > 0:
+		e.Kind = KindEscrowRelease
+	case escrowOut.Cmp(zero) > 0:
+		e.Kind = KindEscrowLock
+	case externalOut.Cmp(zero) == 0:
+		e.Kind = KindTransfer
+	default:
+		e.Kind = KindSend
+	}
+	totalIn := ownIn.Add(escrowIn).Add(externalIn)
+	totalOut := ownOut.Add(escrowOut).Add(externalOut)
+
+	e.post(walletAccount, ownOut.Sub(ownIn), e.Kind)
+	e.post(escrowAccount, escrowOut.Sub(escrowIn), e.Kind)
+	e.post(accounts.counter(e.Category, accounts.Expenses), externalOut, KindSend)
+	e.post(income, zero.Sub(externalIn), KindReceive)
+	e.post(accounts.Fees, totalIn.Sub(totalOut), KindFee)
+	return true
+}
+
+// postSummary adds the postings for a pruned transaction from its net
+// value and fee.
+func (e *Entry) postSummary(summary database.TransactionSummary, accounts Accounts) bool {
+	var (
+		zero          = iwallet.NewAmount(0)
+		value         = iwallet.NewAmount(summary.Value)
+		fee           = zero
+		walletAccount = accounts.Wallet + ":" + e.Coin.CurrencyCode()
+	)
+	if summary.Fee != "" {
+		fee = iwallet.NewAmount(summary.Fee)
+	}
+	switch value.Cmp(zero) {
+	case 0:
+		return false
+	case 1:
+		e.Kind = KindReceive
+		e.post(walletAccount, value, KindReceive)
+		e.post(accounts.counter(e.Category, accounts.Income), zero.Sub(value), KindReceive)
+		return true
+	}
+	paid := zero.Sub(value).Sub(fee)
+	e.Kind = KindSend
+	if paid.Cmp(zero) <= 0 {
+		e.Kind = KindTransfer
+	}
+	e.post(walletAccount, value, e.Kind)
+	e.post(accounts.counter(e.Category, accounts.Expenses), paid, KindSend)
+	e.post(accounts.Fees, fee, KindFee)
+	return true
+}
+
+// post adds amount to the entry's posting for the account and kind,
+// dropping it if it nets to zero.
+func (e *Entry) post(account string, amount iwallet.Amount, kind Kind) {
+	zero := iwallet.NewAmount(0)
+	if amount.Cmp(zero) == 0 {
+		return
+	}
+	for i := range e.Postings {
+		p := &e.Postings[i]
+		if p.Account != account || p.Kind != kind {
+			continue
+		}
+		p.Amount = p.Amount.Add(amount)
+		if p.Amount.Cmp(zero) == 0 {
+			e.Postings = append(e.Postings[:i], e.Postings[i+1:]...)
+		}
+		return
+	}
+	e.Postings = append(e.Postings, Posting{Account: account, Amount: amount, Kind: kind})
+}
@@ -0,0 +1,169 @@
+package ledger
+
+import (
+	"bytes"
+	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/multiwallet/database"
+	"github.com/cpacia/multiwallet/database/memorydb"
+	iwallet "github.com/cpacia/wallet-interface"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuild(t *testing.T) {
+	db, err := memorydb.NewMemoryDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.InitializeDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+
+	ct := iwallet.CtBitcoin
+	addr := func(s string) iwallet.Address {
+		return iwallet.NewAddress(s, ct)
+	}
+	spend := func(a string, amt int64) iwallet.SpendInfo {
+		return iwallet.SpendInfo{Address: addr(a), Amount: iwallet.NewAmount(amt)}
+	}
+	txs := []iwallet.Transaction{
+		{
+			ID:   "receive",
+			From: []iwallet.SpendInfo{spend("customer", 100000)},
+			To:   []iwallet.SpendInfo{spend("own1", 90000), spend("customer-change", 10000)},
+		},
+		{
+			ID:   "send",
+			From: []iwallet.SpendInfo{spend("own1", 90000)},
+			To:   []iwallet.SpendInfo{spend("supplier", 50000), spend("own2", 39000)},
+		},
+		{
+			ID:   "transfer",
+			From: []iwallet.SpendInfo{spend("own2", 39000)},
+			To:   []iwallet.SpendInfo{spend("own3", 38500)},
+		},
+		{
+			ID:   "lock",
+			From: []iwallet.SpendInfo{spend("own3", 38500)},
+			To:   []iwallet.SpendInfo{spend("escrow", 30000), spend("own4", 8000)},
+		},
+		{
+			ID:   "release",
+			From: []iwallet.SpendInfo{spend("escrow", 30000)},
+			To:   []iwallet.SpendInfo{spend("vendor", 29000)},
+		},
+		{
+			ID:   "unrelated",
+			From: []iwallet.SpendInfo{spend("a", 1000)},
+			To:   []iwallet.SpendInfo{spend("b", 900)},
+		},
+	}
+	err = db.Update(func(dbtx database.Tx) error {
+		for i, tx := range txs {
+			tx.Timestamp = time.Unix(int64(1000*(i+1)), 0)
+			rec, err := database.NewTransactionRecord(tx, ct)
+			if err != nil {
+				return err
+			}
+			if err := dbtx.Save(rec); err != nil {
+				return err
+			}
+		}
+		for _, a := range []string{"own1", "own2", "own3", "own4"} {
+			if err := dbtx.Save(&database.AddressRecord{Addr: a, Coin: ct.CurrencyCode()}); err != nil {
+				return err
+			}
+		}
+		err := dbtx.Save(&database.EscrowRecord{Addr: "escrow", Coin: ct.CurrencyCode(), Role: string(base.EscrowRoleBuyer)})
+		if err != nil {
+			return err
+		}
+		err = dbtx.Save(&database.TransactionSummary{
+			Txid:      "pruned",
+			Coin:      ct.CurrencyCode(),
+			Timestamp: time.Unix(500, 0),
+			Value:     "-2500",
+			Fee:       "500",
+		})
+		if err != nil {
+			return err
+		}
+		return dbtx.Save(&database.TransactionMetadataRecord{Txid: "send", Coin: ct.CurrencyCode(), Category: "inventory", Note: "Widgets"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accounts := DefaultAccounts()
+	accounts.Categories = map[string]string{"inventory": "Expenses:Inventory"}
+	entries, err := Build(db, accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type posting struct {
+		account string
+		amount  int64
+	}
+	expected := []struct {
+		txid     string
+		kind     Kind
+		postings []posting
+	}{
+		{"pruned", KindSend, []posting{{"Assets:Wallet:BTC", -2500}, {"Expenses:Payments", 2000}, {"Expenses:Fees", 500}}},
+		{"receive", KindReceive, []posting{{"Assets:Wallet:BTC", 90000}, {"Income:Receipts", -90000}}},
+		{"send", KindSend, []posting{{"Assets:Wallet:BTC", -51000}, {"Expenses:Inventory", 50000}, {"Expenses:Fees", 1000}}},
+		{"transfer", KindTransfer, []posting{{"Assets:Wallet:BTC", -500}, {"Expenses:Fees", 500}}},
+		{"lock", KindEscrowLock, []posting{{"Assets:Wallet:BTC", -30500}, {"Assets:Escrow:BTC", 30000}, {"Expenses:Fees", 500}}},
+		{"release", KindEscrowRelease, []posting{{"Assets:Escrow:BTC", -30000}, {"Expenses:Payments", 29000}, {"Expenses:Fees", 1000}}},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("Expected %d entries, got %d", len(expected), len(entries))
+	}
+	for i, exp := range expected {
+		e := entries[i]
+		if e.Txid.String() != exp.txid || e.Kind != exp.kind {
+			t.Errorf("Entry %d: expected %s %s, got %s %s", i, exp.kind, exp.txid, e.Kind, e.Txid)
+			continue
+		}
+		if len(e.Postings) != len(exp.postings) {
+			t.Errorf("%s: expected %d postings, got %+v", exp.txid, len(exp.postings), e.Postings)
+			continue
+		}
+		for j, p := range exp.postings {
+			if e.Postings[j].Account != p.account || e.Postings[j].Amount.Cmp(iwallet.NewAmount(p.amount)) != 0 {
+				t.Errorf("%s: expected posting %s %d, got %s %s", exp.txid, p.account, p.amount, e.Postings[j].Account, e.Postings[j].Amount)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := Write(&buf, entries[2:3], FormatLedger); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"1970/01/01 * Widgets",
+		"; Txid: send",
+		"; Category: inventory",
+		"Expenses:Inventory",
+		"0.00050000 BTC",
+		"-0.00051000 BTC",
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("Expected ledger output to contain %q, got:\n%s", line, buf.String())
+		}
+	}
+
+	buf.Reset()
+	if err := Write(&buf, entries[:1], FormatQuickBooks); err != nil {
+		t.Fatal(err)
+	}
+	csv := "Journal No,Journal Date,Account Name,Debits,Credits,Description,Memo\n" +
+		"1,01/01/1970,Assets:Wallet:BTC,,0.00002500,send,BTC pruned\n" +
+		"1,01/01/1970,Expenses:Payments,0.00002000,,send,BTC pruned\n" +
+		"1,01/01/1970,Expenses:Fees,0.00000500,,send,BTC pruned\n"
+	if buf.String() != csv {
+		t.Errorf("Unexpected QuickBooks output:\n%s", buf.String())
+	}
+}
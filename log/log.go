@@ -0,0 +1,300 @@
+// Package log is the multiwallet's structured, leveled logger. Records
+// carry a module and optional fields such as the coin and txid, can be
+// written as text or JSON, and have addresses and keys redacted.
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a record.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarning
+	LevelError
+)
+
+var levelNames = []string{"DEBUG", "INFO", "WARNING", "ERROR"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("LEVEL(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses the name of a level. It is case insensitive.
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	if strings.EqualFold(s, "warn") {
+		return LevelWarning, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// Field names used by the multiwallet.
+const (
+	FieldModule = "module"
+	FieldCoin   = "coin"
+	FieldTxid   = "txid"
+)
+
+// Logger writes leveled records. Messages are formatted with fmt.Sprintf
+// after any addresses and keys in args have been redacted.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warningf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+
+	// With returns a logger which adds the field to every record.
+	With(key string, value interface{}) Logger
+
+	// Module returns a logger for the named module with the same
+	// fields. Records are filtered with the module's level.
+	Module(name string) Logger
+}
+
+// Format is the encoding of records.
+type Format int
+
+const (
+	// FormatText writes one line per record with the fields as
+	// key=value pairs after the message.
+	FormatText Format = iota
+
+	// FormatJSON writes one JSON object per line.
+	FormatJSON
+)
+
+// Config configures a Backend.
+type Config struct {
+	// Output is where records are written. Defaults to os.Stdout.
+	Output io.Writer
+
+	Format Format
+
+	// Level is the least severe level written for modules without an
+	// override in ModuleLevels.
+	Level        Level
+	ModuleLevels map[string]Level
+
+	// RedactLevel is the least severe level at which addresses and
+	// public keys are redacted. The zero value redacts them in every
+	// record; LevelInfo would only show them in debug records. Private
+	// keys are always redacted.
+	RedactLevel Level
+}
+
+// Backend writes the records of all the loggers it creates.
+type Backend struct {
+	mtx sync.Mutex
+	cfg Config
+}
+
+// NewBackend returns a new Backend.
+func NewBackend(cfg Config) *Backend {
+	if cfg.Output == nil {
+		cfg.Output = os.Stdout
+	}
+	levels := make(map[string]Level, len(cfg.ModuleLevels))
+	for module, level := range cfg.ModuleLevels {
+		levels[module] = level
+	}
+	cfg.ModuleLevels = levels
+	return &Backend{cfg: cfg}
+}
+
+// Logger returns a logger for the module.
+func (b *Backend) Logger(module string) Logger {
+	return &logger{backend: b, module: module}
+}
+
+// SetLevel sets the level of a module. If module is empty the default
+// level is set.
+func (b *Backend) SetLevel(module string, level Level) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if module == "" {
+		b.cfg.Level = level
+		return
+	}
+	b.cfg.ModuleLevels[module] = level
+}
+
+func (b *Backend) enabled(module string, level Level) bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	min, ok := b.cfg.ModuleLevels[module]
+	if !ok {
+		min = b.cfg.Level
+	}
+	return level >= min
+}
+
+func (b *Backend) redact(level Level) bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	return level >= b.cfg.RedactLevel
+}
+
+func (b *Backend) write(rec *record) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	var line []byte
+	switch b.cfg.Format {
+	case FormatJSON:
+		line = rec.json()
+	default:
+		line = rec.text()
+	}
+	b.cfg.Output.Write(append(line, '\n'))
+}
+
+var defaultBackend = NewBackend(Config{Output: os.Stdout, Level: LevelInfo})
+
+// New returns a logger for the module which writes text to stdout at
+// LevelInfo.
+func New(module string) Logger {
+	return defaultBackend.Logger(module)
+}
+
+type field struct {
+	key   string
+	value interface{}
+}
+
+type logger struct {
+	backend *Backend
+	module  string
+	fields  []field
+}
+
+func (l *logger) Debugf(format string, args ...interface{}) {
+	l.logf(LevelDebug, format, args)
+}
+
+func (l *logger) Infof(format string, args ...interface{}) {
+	l.logf(LevelInfo, format, args)
+}
+
+func (l *logger) Warningf(format string, args ...interface{}) {
+	l.logf(LevelWarning, format, args)
+}
+
+func (l *logger) Errorf(format string, args ...interface{}) {
+	l.logf(LevelError, format, args)
+}
+
+func (l *logger) With(key string, value interface{}) Logger {
+	fields := make([]field, 0, len(l.fields)+1)
+	for _, f := range l.fields {
+		if f.key != key {
+			fields = append(fields, f)
+		}
+	}
+	return &logger{
+		backend: l.backend,
+		module:  l.module,
+		fields:  append(fields, field{key, value}),
+	}
+}
+
+func (l *logger) Module(name string) Logger {
+	return &logger{backend: l.backend, module: name, fields: l.fields}
+}
+
+func (l *logger) logf(level Level, format string, args []interface{}) {
+	if !l.backend.enabled(l.module, level) {
+		return
+	}
+	redact := l.backend.redact(level)
+	redacted := make([]interface{}, len(args))
+	for i, arg := range args {
+		redacted[i] = redactValue(arg, redact)
+	}
+	rec := &record{
+		time:    time.Now(),
+		level:   level,
+		module:  l.module,
+		message: fmt.Sprintf(format, redacted...),
+		fields:  make([]field, 0, len(l.fields)),
+	}
+	for _, f := range l.fields {
+		rec.fields = append(rec.fields, field{f.key, redactField(f.key, f.value, redact)})
+	}
+	l.backend.write(rec)
+}
+
+type record struct {
+	time    time.Time
+	level   Level
+	module  string
+	message string
+	fields  []field
+}
+
+const timeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+func (r *record) text() []byte {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s [%s] [%s] %s", r.time.Format(timeFormat), r.level, r.module, r.message)
+	for _, f := range r.fields {
+		value := fmt.Sprint(f.value)
+		if strings.ContainsAny(value, " \"=") {
+			value = fmt.Sprintf("%q", value)
+		}
+		fmt.Fprintf(&sb, " %s=%s", f.key, value)
+	}
+	return []byte(sb.String())
+}
+
+func (r *record) json() []byte {
+	obj := map[string]interface{}{
+		"time":      r.time.Format(timeFormat),
+		"level":     r.level.String(),
+		FieldModule: r.module,
+		"msg":       r.message,
+	}
+	for _, f := range r.fields {
+		if _, ok := obj[f.key]; ok {
+			continue
+		}
+		switch v := f.value.(type) {
+		case fmt.Stringer:
+			obj[f.key] = v.String()
+		case error:
+			obj[f.key] = v.Error()
+		default:
+			obj[f.key] = v
+		}
+	}
+	b, err := json.Marshal(obj)
+	if err != nil {
+		// A field couldn't be encoded so write the record without them.
+		b, _ = json.Marshal(map[string]string{
+			"time":      r.time.Format(timeFormat),
+			"level":     r.level.String(),
+			FieldModule: r.module,
+			"msg":       r.message,
+		})
+	}
+	return b
+}
@@ -0,0 +1,112 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/btcsuite/btcd/btcec"
+	iwallet "github.com/cpacia/wallet-interface"
+	"strings"
+	"testing"
+)
+
+func TestLogger_Levels(t *testing.T) {
+	var buf bytes.Buffer
+	backend := NewBackend(Config{
+		Output:       &buf,
+		Level:        LevelWarning,
+		ModuleLevels: map[string]Level{"chain": LevelDebug},
+	})
+
+	wallet := backend.Logger("wallet")
+	wallet.Infof("hidden")
+	wallet.Warningf("shown")
+	wallet.Module("chain").Debugf("chain debug")
+
+	out := buf.String()
+	if strings.Contains(out, "hidden") {
+		t.Error("Expected info record to be filtered")
+	}
+	if !strings.Contains(out, "[WARNING] [wallet] shown") {
+		t.Errorf("Expected warning record, got %q", out)
+	}
+	if !strings.Contains(out, "[DEBUG] [chain] chain debug") {
+		t.Errorf("Expected chain module override, got %q", out)
+	}
+
+	buf.Reset()
+	backend.SetLevel("wallet", LevelInfo)
+	wallet.Infof("now shown")
+	if !strings.Contains(buf.String(), "now shown") {
+		t.Error("Expected SetLevel to lower the wallet level")
+	}
+}
+
+func TestLogger_JSON(t *testing.T) {
+	var buf bytes.Buffer
+	backend := NewBackend(Config{Output: &buf, Format: FormatJSON, RedactLevel: LevelError + 1})
+
+	backend.Logger("chain").With(FieldCoin, iwallet.CtBitcoin.CurrencyCode()).With(FieldTxid, "abcd").Infof("saved %d transactions", 2)
+
+	var rec map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"level":  "INFO",
+		"module": "chain",
+		"msg":    "saved 2 transactions",
+		"coin":   iwallet.CtBitcoin.CurrencyCode(),
+		"txid":   "abcd",
+	}
+	for k, v := range expected {
+		if rec[k] != v {
+			t.Errorf("Expected %s=%v, got %v", k, v, rec[k])
+		}
+	}
+}
+
+func TestLogger_Redaction(t *testing.T) {
+	addr := iwallet.NewAddress("bc1qar0srrr7xfkvy5l643lydnw9re59gtzzwf5mdq", iwallet.CtBitcoin)
+	priv, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		redactLevel Level
+		level       Level
+		showAddress bool
+	}{
+		{LevelDebug, LevelDebug, false},
+		{LevelDebug, LevelError, false},
+		{LevelInfo, LevelDebug, true},
+		{LevelInfo, LevelInfo, false},
+	}
+	for i, test := range tests {
+		var buf bytes.Buffer
+		l := NewBackend(Config{Output: &buf, RedactLevel: test.redactLevel}).Logger("test")
+		l = l.With("address", addr.String()).With("seed", "deadbeef")
+
+		logf := map[Level]func(string, ...interface{}){
+			LevelDebug:   l.Debugf,
+			LevelInfo:    l.Infof,
+			LevelWarning: l.Warningf,
+			LevelError:   l.Errorf,
+		}[test.level]
+		logf("paying %s with %v %s", addr, priv, Sensitive("label"))
+
+		out := buf.String()
+		if got := strings.Count(out, addr.String()); (got == 2) != test.showAddress {
+			t.Errorf("Test %d: expected address shown %v, got %q", i, test.showAddress, out)
+		}
+		if strings.Contains(out, "label") != test.showAddress {
+			t.Errorf("Test %d: expected sensitive value shown %v, got %q", i, test.showAddress, out)
+		}
+		if !strings.Contains(out, "with [redacted]") || !strings.Contains(out, "seed=[redacted]") {
+			t.Errorf("Test %d: expected secrets to be redacted, got %q", i, out)
+		}
+		if !test.showAddress && !strings.Contains(out, "bc1q…5mdq") {
+			t.Errorf("Test %d: expected redacted address, got %q", i, out)
+		}
+	}
+}
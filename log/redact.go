@@ -0,0 +1,103 @@
+package log
+
+import (
+	"fmt"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcutil/hdkeychain"
+	iwallet "github.com/cpacia/wallet-interface"
+	"strings"
+)
+
+// redacted replaces values which are never logged.
+const redacted = "[redacted]"
+
+// sensitiveFields are redacted like addresses and secretFields are never
+// logged.
+var (
+	sensitiveFields = map[string]bool{"address": true, "addr": true, "xpub": true}
+	secretFields    = map[string]bool{"key": true, "xpriv": true, "seed": true, "passphrase": true, "password": true}
+)
+
+type sensitive struct {
+	value interface{}
+}
+
+type secret struct{}
+
+func (secret) String() string {
+	return redacted
+}
+
+// Sensitive marks a value to be redacted like an address. Addresses and
+// public keys don't need to be marked.
+func Sensitive(v interface{}) interface{} {
+	return sensitive{v}
+}
+
+// Secret marks a value which is never logged. Private keys don't need to
+// be marked.
+func Secret(v interface{}) interface{} {
+	return secret{}
+}
+
+// redactValue returns the value to log in place of v.
+func redactValue(v interface{}, redact bool) interface{} {
+	switch t := v.(type) {
+	case secret, *btcec.PrivateKey, btcec.PrivateKey:
+		return redacted
+	case *hdkeychain.ExtendedKey:
+		if t == nil {
+			return v
+		}
+		if t.IsPrivate() {
+			return redacted
+		}
+		if redact {
+			return redactString(t.String())
+		}
+	case iwallet.Address:
+		if redact {
+			return redactString(t.String())
+		}
+	case []iwallet.Address:
+		if redact {
+			addrs := make([]string, len(t))
+			for i, addr := range t {
+				addrs[i] = redactString(addr.String())
+			}
+			return addrs
+		}
+	case sensitive:
+		if redact {
+			return redactString(fmt.Sprint(t.value))
+		}
+		return t.value
+	}
+	return v
+}
+
+func redactField(key string, v interface{}, redact bool) interface{} {
+	key = strings.ToLower(key)
+	if secretFields[key] {
+		return redacted
+	}
+	if redact && sensitiveFields[key] {
+		if r := redactValue(v, false); r == redacted {
+			return r
+		}
+		if s, ok := v.(sensitive); ok {
+			v = s.value
+		}
+		return redactString(fmt.Sprint(v))
+	}
+	return redactValue(v, redact)
+}
+
+// redactString keeps the first and last four characters of s so records
+// about the same address can still be matched up.
+func redactString(s string) string {
+	if len(s) <= 12 {
+		return "…"
+	}
+	return s[:4] + "…" + s[len(s)-4:]
+}
@@ -0,0 +1,139 @@
+package mpc
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"math/big"
+)
+
+var one = big.NewInt(1)
+
+// PaillierPublicKey is a Paillier public key. Ciphertexts can be added
+// together and multiplied by constants without the private key, which is
+// what lets the server compute its part of a signature on the client's
+// encrypted share.
+type PaillierPublicKey struct {
+	N *big.Int `json:"n"`
+}
+
+// PaillierPrivateKey is a Paillier private key.
+type PaillierPrivateKey struct {
+	PaillierPublicKey
+	Lambda *big.Int `json:"lambda"`
+	Mu     *big.Int `json:"mu"`
+}
+
+// GeneratePaillierKey returns a new key with a modulus of the given size.
+func GeneratePaillierKey(random io.Reader, bits int) (*PaillierPrivateKey, error) {
+	for {
+		p, err := rand.Prime(random, bits/2)
+		if err != nil {
+			return nil, err
+		}
+		q, err := rand.Prime(random, bits/2)
+		if err != nil {
+			return nil, err
+		}
+		if p.Cmp(q) == 0 {
+			continue
+		}
+		n := new(big.Int).Mul(p, q)
+		pm1 := new(big.Int).Sub(p, one)
+		qm1 := new(big.Int).Sub(q, one)
+		lambda := new(big.Int).Mul(pm1, qm1)
+		// With g = n + 1, mu is the inverse of lambda mod n.
+		mu := new(big.Int).ModInverse(lambda, n)
+		if mu == nil {
+			continue
+		}
+		return &PaillierPrivateKey{
+			PaillierPublicKey: PaillierPublicKey{N: n},
+			Lambda:            lambda,
+			Mu:                mu,
+		}, nil
+	}
+}
+
+func (pk *PaillierPublicKey) n2() *big.Int {
+	return new(big.Int).Mul(pk.N, pk.N)
+}
+
+// Encrypt returns the encryption of m, which must be less than N.
+func (pk *PaillierPublicKey) Encrypt(random io.Reader, m *big.Int) (*big.Int, error) {
+	c, _, err := pk.encrypt(random, m)
+	return c, err
+}
+
+// encrypt returns the encryption of m along with the randomness it was
+// encrypted with, which proofs about the ciphertext need.
+func (pk *PaillierPublicKey) encrypt(random io.Reader, m *big.Int) (*big.Int, *big.Int, error) {
+	if m.Sign() < 0 || m.Cmp(pk.N) >= 0 {
+		return nil, nil, errors.New("paillier: message out of range")
+	}
+	var r *big.Int
+	for {
+		var err error
+		r, err = rand.Int(random, pk.N)
+		if err != nil {
+			return nil, nil, err
+		}
+		if r.Sign() > 0 && new(big.Int).GCD(nil, nil, r, pk.N).Cmp(one) == 0 {
+			break
+		}
+	}
+	c, err := pk.encryptWithNonce(m, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, r, nil
+}
+
+// encryptWithNonce returns the encryption of m with the randomness r. It's
+// used to check the opening of a ciphertext.
+func (pk *PaillierPublicKey) encryptWithNonce(m, r *big.Int) (*big.Int, error) {
+	if m.Sign() < 0 || m.Cmp(pk.N) >= 0 {
+		return nil, errors.New("paillier: message out of range")
+	}
+	if r.Sign() <= 0 || r.Cmp(pk.N) >= 0 {
+		return nil, errors.New("paillier: randomness out of range")
+	}
+	n2 := pk.n2()
+	// (n+1)^m = 1 + m*n mod n^2
+	gm := new(big.Int).Mul(m, pk.N)
+	gm.Add(gm, one)
+	gm.Mod(gm, n2)
+	rn := new(big.Int).Exp(r, pk.N, n2)
+	return gm.Mul(gm, rn).Mod(gm, n2), nil
+}
+
+// validCiphertext returns whether c is an element of Z*_{n^2}, which every
+// honestly produced ciphertext is.
+func (pk *PaillierPublicKey) validCiphertext(c *big.Int) bool {
+	return c != nil && c.Sign() > 0 && c.Cmp(pk.n2()) < 0 && new(big.Int).GCD(nil, nil, c, pk.N).Cmp(one) == 0
+}
+
+// Add returns the encryption of the sum of the plaintexts of c1 and c2.
+func (pk *PaillierPublicKey) Add(c1, c2 *big.Int) *big.Int {
+	c := new(big.Int).Mul(c1, c2)
+	return c.Mod(c, pk.n2())
+}
+
+// Mul returns the encryption of the plaintext of c multiplied by k.
+func (pk *PaillierPublicKey) Mul(c, k *big.Int) *big.Int {
+	return new(big.Int).Exp(c, k, pk.n2())
+}
+
+// Decrypt returns the plaintext of c.
+func (sk *PaillierPrivateKey) Decrypt(c *big.Int) (*big.Int, error) {
+	n2 := sk.n2()
+	if c.Sign() <= 0 || c.Cmp(n2) >= 0 {
+		return nil, errors.New("paillier: ciphertext out of range")
+	}
+	// L(c^lambda mod n^2) * mu mod n where L(x) = (x-1)/n
+	u := new(big.Int).Exp(c, sk.Lambda, n2)
+	u.Sub(u, one)
+	u.Div(u, sk.N)
+	u.Mul(u, sk.Mu)
+	return u.Mod(u, sk.N), nil
+}
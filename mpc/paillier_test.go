@@ -0,0 +1,43 @@
+package mpc
+
+import (
+	"crypto/rand"
+	"math/big"
+	"testing"
+)
+
+func TestPaillier(t *testing.T) {
+	key, err := GeneratePaillierKey(rand.Reader, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c1, err := key.Encrypt(rand.Reader, big.NewInt(20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := key.Encrypt(rand.Reader, big.NewInt(22))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum, err := key.Decrypt(key.Add(c1, c2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum.Int64() != 42 {
+		t.Errorf("Expected 42, got %s", sum)
+	}
+
+	product, err := key.Decrypt(key.Mul(c1, big.NewInt(3)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if product.Int64() != 60 {
+		t.Errorf("Expected 60, got %s", product)
+	}
+
+	if _, err := key.Encrypt(rand.Reader, key.N); err == nil {
+		t.Error("Expected error encrypting a message out of range")
+	}
+}
@@ -0,0 +1,504 @@
+package mpc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"github.com/btcsuite/btcd/btcec"
+	"math/big"
+	"sync"
+)
+
+const (
+	// paillierProofRounds is the number of N-th roots in a PaillierProof.
+	// A modulus which isn't coprime to its totient has a prime factor of
+	// at least smallPrimeBound dividing both, so each root exists with
+	// probability at most 2^-16 and the proof is sound to 2^-128.
+	paillierProofRounds = 8
+
+	// smallPrimeBound is the bound below which a Paillier modulus must
+	// have no prime factors.
+	smallPrimeBound = 1 << 16
+
+	// rangeProofRounds is the statistical security parameter of the
+	// range proof. A client whose encrypted share is out of range passes
+	// with probability 2^-40.
+	rangeProofRounds = 40
+
+	// nonceSize is the size of the nonces each party contributes to a
+	// session ID.
+	nonceSize = 32
+)
+
+var (
+	smallPrimesOnce sync.Once
+	smallPrimes     *big.Int
+)
+
+// EncryptedShare is the client's share encrypted under its Paillier key
+// with the first message of the proofs the server checks before using it.
+type EncryptedShare struct {
+	Paillier      *PaillierPublicKey `json:"paillier"`
+	PaillierProof *PaillierProof     `json:"paillierProof"`
+	EncX1         *big.Int           `json:"encX1"`
+	Range         *RangeCommitment   `json:"range"`
+}
+
+// PaillierProof proves a Paillier modulus N is coprime to its totient,
+// which Paillier encryption relies on, by giving N-th roots of values
+// derived from the session ID. Only such a modulus has N-th roots of most
+// elements. It's the proof of Goldberg, Reyzin, Sagga and Baldimtsi,
+// "Efficient Noninteractive Certification of RSA Moduli and Beyond" (2019).
+type PaillierProof struct {
+	Sigma []*big.Int `json:"sigma"`
+}
+
+// RangeCommitment is the first message of the range proof of Lindell's
+// appendix A, which shows the encrypted share is less than 2q so the
+// server's computations on it can't wrap the Paillier modulus. Each pair
+// of ciphertexts encrypts some w in [q, 2q) and w-q in random order.
+type RangeCommitment struct {
+	C1 []*big.Int `json:"c1"`
+	C2 []*big.Int `json:"c2"`
+}
+
+// RangeOpening answers one challenge bit of the range proof. For a zero
+// bit both ciphertexts of the pair are opened. For a one bit the sum of the
+// share and the J'th ciphertext is opened and must be in [q, 2q).
+type RangeOpening struct {
+	V1 *big.Int `json:"v1,omitempty"`
+	R1 *big.Int `json:"r1,omitempty"`
+	V2 *big.Int `json:"v2,omitempty"`
+	R2 *big.Int `json:"r2,omitempty"`
+	J  int      `json:"j,omitempty"`
+	Z  *big.Int `json:"z,omitempty"`
+	R  *big.Int `json:"r,omitempty"`
+}
+
+// ShareChallenge is the server's challenge to the client's encrypted
+// share. Range holds the range proof's challenge bits. C and Commitment
+// are the first message of Lindell's PDL proof: C encrypts a*x1+b for
+// random a and b which the server commits to.
+type ShareChallenge struct {
+	Range      []byte   `json:"range"`
+	C          *big.Int `json:"c"`
+	Commitment []byte   `json:"commitment"`
+}
+
+// ShareResponse is the client's answer to a ShareChallenge. Commitment
+// commits to the point of the decryption of the challenge's C.
+type ShareResponse struct {
+	Range      []*RangeOpening `json:"range"`
+	Commitment []byte          `json:"commitment"`
+}
+
+// ShareReveal opens the server's commitment to a and b so the client can
+// check C was computed honestly before revealing its point.
+type ShareReveal struct {
+	A    *big.Int `json:"a"`
+	B    *big.Int `json:"b"`
+	Salt []byte   `json:"salt"`
+}
+
+// ShareOpening opens the client's commitment. The server accepts the
+// encrypted share if QHat is a*Q1 + b*G.
+type ShareOpening struct {
+	QHat []byte `json:"qHat"`
+	Salt []byte `json:"salt"`
+}
+
+// shareProver is the client's side of the proofs about its encrypted
+// share.
+type shareProver struct {
+	sid       []byte
+	x1        *big.Int
+	r         *big.Int
+	paillier  *PaillierPrivateKey
+	v1, r1    []*big.Int
+	v2, r2    []*big.Int
+	challenge *ShareChallenge
+	alpha     *big.Int
+	qHat      []byte
+	salt      []byte
+}
+
+// newShareProver encrypts the share and starts the proofs about it.
+func newShareProver(sid []byte, x1 *big.Int, paillier *PaillierPrivateKey) (*shareProver, *EncryptedShare, error) {
+	encX1, r, err := paillier.encrypt(rand.Reader, x1)
+	if err != nil {
+		return nil, nil, err
+	}
+	paillierProof, err := provePaillierKey(sid, paillier)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p := &shareProver{sid: sid, x1: x1, r: r, paillier: paillier}
+	commitment := &RangeCommitment{}
+	for i := 0; i < rangeProofRounds; i++ {
+		w, err := rand.Int(rand.Reader, curve.N)
+		if err != nil {
+			return nil, nil, err
+		}
+		v1, v2 := new(big.Int).Add(w, curve.N), w
+		swap, err := rand.Int(rand.Reader, big.NewInt(2))
+		if err != nil {
+			return nil, nil, err
+		}
+		if swap.Sign() != 0 {
+			v1, v2 = v2, v1
+		}
+		c1, r1, err := paillier.encrypt(rand.Reader, v1)
+		if err != nil {
+			return nil, nil, err
+		}
+		c2, r2, err := paillier.encrypt(rand.Reader, v2)
+		if err != nil {
+			return nil, nil, err
+		}
+		p.v1, p.r1 = append(p.v1, v1), append(p.r1, r1)
+		p.v2, p.r2 = append(p.v2, v2), append(p.r2, r2)
+		commitment.C1 = append(commitment.C1, c1)
+		commitment.C2 = append(commitment.C2, c2)
+	}
+	return p, &EncryptedShare{
+		Paillier:      &paillier.PaillierPublicKey,
+		PaillierProof: paillierProof,
+		EncX1:         encX1,
+		Range:         commitment,
+	}, nil
+}
+
+// respond answers the server's challenge. It may only be called once as
+// answering two challenges would reveal the share.
+func (p *shareProver) respond(ch *ShareChallenge) (*ShareResponse, error) {
+	if p.challenge != nil {
+		return nil, errors.New("mpc: share challenge already answered")
+	}
+	if ch == nil || len(ch.Range) != (rangeProofRounds+7)/8 || len(ch.Commitment) != sha256.Size || ch.C == nil {
+		return nil, errors.New("mpc: invalid share challenge")
+	}
+	alpha, err := p.paillier.Decrypt(ch.C)
+	if err != nil {
+		return nil, err
+	}
+	p.challenge = ch
+
+	n := p.paillier.N
+	twoQ := new(big.Int).Lsh(curve.N, 1)
+	resp := &ShareResponse{}
+	for i := 0; i < rangeProofRounds; i++ {
+		if challengeBit(ch.Range, i) == 0 {
+			resp.Range = append(resp.Range, &RangeOpening{V1: p.v1[i], R1: p.r1[i], V2: p.v2[i], R2: p.r2[i]})
+			continue
+		}
+		// One of x1+v1 and x1+v2 is in [q, 2q).
+		j, z, r := 1, new(big.Int).Add(p.x1, p.v1[i]), p.r1[i]
+		if z.Cmp(curve.N) < 0 || z.Cmp(twoQ) >= 0 {
+			j, z, r = 2, new(big.Int).Add(p.x1, p.v2[i]), p.r2[i]
+		}
+		rz := new(big.Int).Mul(p.r, r)
+		resp.Range = append(resp.Range, &RangeOpening{J: j, Z: z, R: rz.Mod(rz, n)})
+	}
+
+	qHat := scalarBaseMult(new(big.Int).Mod(alpha, curve.N))
+	salt, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	p.alpha = alpha
+	p.qHat = qHat.SerializeCompressed()
+	p.salt = salt
+	resp.Commitment = commit("pdl q", p.sid, salt, p.qHat)
+	return resp, nil
+}
+
+// finish checks the server computed its challenge honestly and opens the
+// client's commitment.
+func (p *shareProver) finish(rev *ShareReveal) (*ShareOpening, error) {
+	if p.alpha == nil {
+		return nil, errors.New("mpc: share challenge not answered")
+	}
+	if rev == nil || rev.A == nil || rev.B == nil {
+		return nil, errors.New("mpc: invalid share reveal")
+	}
+	if !equalBytes(commit("pdl ab", p.sid, rev.Salt, rev.A.Bytes(), rev.B.Bytes()), p.challenge.Commitment) {
+		return nil, ErrInvalidProof
+	}
+	qSquared := new(big.Int).Mul(curve.N, curve.N)
+	if rev.A.Sign() <= 0 || rev.A.Cmp(curve.N) >= 0 || rev.B.Sign() < 0 || rev.B.Cmp(qSquared) >= 0 {
+		return nil, ErrInvalidProof
+	}
+	expected := new(big.Int).Mul(rev.A, p.x1)
+	expected.Add(expected, rev.B)
+	if expected.Cmp(p.alpha) != 0 {
+		return nil, ErrInvalidProof
+	}
+	return &ShareOpening{QHat: p.qHat, Salt: p.salt}, nil
+}
+
+// shareVerifier is the server's side of the proofs about the client's
+// encrypted share.
+type shareVerifier struct {
+	sid        []byte
+	share      *EncryptedShare
+	challenge  *ShareChallenge
+	a, b       *big.Int
+	salt       []byte
+	qPrime     *btcec.PublicKey
+	commitment []byte
+}
+
+// newShareVerifier checks the Paillier key and returns the challenge to
+// the encrypted share of the client's point q1.
+func newShareVerifier(sid []byte, q1 *btcec.PublicKey, share *EncryptedShare) (*shareVerifier, *ShareChallenge, error) {
+	if share == nil || share.Paillier == nil || share.Range == nil {
+		return nil, nil, errors.New("mpc: invalid encrypted share")
+	}
+	pk := share.Paillier
+	if !share.PaillierProof.verify(sid, pk) {
+		return nil, nil, errors.New("mpc: invalid paillier key")
+	}
+	if !pk.validCiphertext(share.EncX1) || len(share.Range.C1) != rangeProofRounds || len(share.Range.C2) != rangeProofRounds {
+		return nil, nil, errors.New("mpc: invalid encrypted share")
+	}
+	for i := 0; i < rangeProofRounds; i++ {
+		if !pk.validCiphertext(share.Range.C1[i]) || !pk.validCiphertext(share.Range.C2[i]) {
+			return nil, nil, errors.New("mpc: invalid encrypted share")
+		}
+	}
+
+	e := make([]byte, (rangeProofRounds+7)/8)
+	if _, err := rand.Read(e); err != nil {
+		return nil, nil, err
+	}
+	a, err := randScalar()
+	if err != nil {
+		return nil, nil, err
+	}
+	b, err := rand.Int(rand.Reader, new(big.Int).Mul(curve.N, curve.N))
+	if err != nil {
+		return nil, nil, err
+	}
+	encB, err := pk.Encrypt(rand.Reader, b)
+	if err != nil {
+		return nil, nil, err
+	}
+	salt, err := newNonce()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	aQ1 := scalarMult(q1, a)
+	bG := scalarBaseMult(new(big.Int).Mod(b, curve.N))
+	x, y := curve.Add(aQ1.X, aQ1.Y, bG.X, bG.Y)
+
+	ch := &ShareChallenge{
+		Range:      e,
+		C:          pk.Add(pk.Mul(share.EncX1, a), encB),
+		Commitment: commit("pdl ab", sid, salt, a.Bytes(), b.Bytes()),
+	}
+	return &shareVerifier{
+		sid:       sid,
+		share:     share,
+		challenge: ch,
+		a:         a,
+		b:         b,
+		salt:      salt,
+		qPrime:    &btcec.PublicKey{Curve: curve, X: x, Y: y},
+	}, ch, nil
+}
+
+// reveal checks the range proof and opens the server's commitment. It
+// may only be called once.
+func (v *shareVerifier) reveal(resp *ShareResponse) (*ShareReveal, error) {
+	if v.commitment != nil {
+		return nil, errors.New("mpc: share response already received")
+	}
+	if resp == nil || len(resp.Range) != rangeProofRounds || len(resp.Commitment) != sha256.Size {
+		return nil, ErrInvalidProof
+	}
+	for i, o := range resp.Range {
+		if !v.verifyRangeOpening(i, o) {
+			return nil, ErrInvalidProof
+		}
+	}
+	v.commitment = resp.Commitment
+	return &ShareReveal{A: v.a, B: v.b, Salt: v.salt}, nil
+}
+
+// finish checks the client's point matches the challenge, which proves
+// the encrypted share is the discrete log of q1.
+func (v *shareVerifier) finish(op *ShareOpening) error {
+	if v.commitment == nil {
+		return errors.New("mpc: share response not received")
+	}
+	if op == nil || !equalBytes(commit("pdl q", v.sid, op.Salt, op.QHat), v.commitment) {
+		return ErrInvalidProof
+	}
+	qHat, err := btcec.ParsePubKey(op.QHat, curve)
+	if err != nil || !qHat.IsEqual(v.qPrime) {
+		return ErrInvalidProof
+	}
+	return nil
+}
+
+func (v *shareVerifier) verifyRangeOpening(i int, o *RangeOpening) bool {
+	if o == nil {
+		return false
+	}
+	pk := v.share.Paillier
+	c1, c2 := v.share.Range.C1[i], v.share.Range.C2[i]
+	twoQ := new(big.Int).Lsh(curve.N, 1)
+	inRange := func(x *big.Int) bool {
+		return x != nil && x.Cmp(curve.N) >= 0 && x.Cmp(twoQ) < 0
+	}
+	opens := func(c, m, r *big.Int) bool {
+		if m == nil || r == nil {
+			return false
+		}
+		enc, err := pk.encryptWithNonce(m, r)
+		return err == nil && enc.Cmp(c) == 0
+	}
+
+	if challengeBit(v.challenge.Range, i) == 0 {
+		if !opens(c1, o.V1, o.R1) || !opens(c2, o.V2, o.R2) {
+			return false
+		}
+		return (inRange(o.V1) && new(big.Int).Sub(o.V1, curve.N).Cmp(o.V2) == 0) ||
+			(inRange(o.V2) && new(big.Int).Sub(o.V2, curve.N).Cmp(o.V1) == 0)
+	}
+	var cj *big.Int
+	switch o.J {
+	case 1:
+		cj = c1
+	case 2:
+		cj = c2
+	default:
+		return false
+	}
+	return inRange(o.Z) && opens(pk.Add(v.share.EncX1, cj), o.Z, o.R)
+}
+
+// provePaillierKey returns the proof that the key's modulus is coprime to
+// its totient.
+func provePaillierKey(sid []byte, sk *PaillierPrivateKey) (*PaillierProof, error) {
+	// Lambda is the totient of N.
+	d := new(big.Int).ModInverse(sk.N, sk.Lambda)
+	if d == nil {
+		return nil, errors.New("mpc: invalid paillier key")
+	}
+	proof := &PaillierProof{}
+	for i := 0; i < paillierProofRounds; i++ {
+		rho := paillierChallenge(sid, sk.N, i)
+		proof.Sigma = append(proof.Sigma, new(big.Int).Exp(rho, d, sk.N))
+	}
+	return proof, nil
+}
+
+// verify checks the modulus is large enough, has no small factors and
+// that each sigma is an N-th root of its challenge.
+func (proof *PaillierProof) verify(sid []byte, pk *PaillierPublicKey) bool {
+	if proof == nil || len(proof.Sigma) != paillierProofRounds || pk == nil || pk.N == nil {
+		return false
+	}
+	n := pk.N
+	if n.BitLen() < PaillierBits || n.Bit(0) == 0 {
+		return false
+	}
+	if new(big.Int).GCD(nil, nil, n, smallPrimesProduct()).Cmp(one) != 0 {
+		return false
+	}
+	for i, sigma := range proof.Sigma {
+		if sigma == nil || sigma.Sign() <= 0 || sigma.Cmp(n) >= 0 {
+			return false
+		}
+		rho := paillierChallenge(sid, n, i)
+		if new(big.Int).GCD(nil, nil, rho, n).Cmp(one) != 0 {
+			return false
+		}
+		if new(big.Int).Exp(sigma, n, n).Cmp(rho) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// paillierChallenge derives the i'th value whose N-th root the prover must
+// give. The hash is expanded to 128 bits more than N so the value is close
+// to uniform.
+func paillierChallenge(sid []byte, n *big.Int, i int) *big.Int {
+	size := (n.BitLen() + 128 + 7) / 8
+	var buf []byte
+	for ctr := uint32(0); len(buf) < size; ctr++ {
+		buf = append(buf, hashParts([]byte("multiwallet mpc paillier proof"), sid, n.Bytes(), uint32Bytes(uint32(i)), uint32Bytes(ctr))...)
+	}
+	rho := new(big.Int).SetBytes(buf[:size])
+	return rho.Mod(rho, n)
+}
+
+// smallPrimesProduct returns the product of the primes below
+// smallPrimeBound.
+func smallPrimesProduct() *big.Int {
+	smallPrimesOnce.Do(func() {
+		composite := make([]bool, smallPrimeBound)
+		smallPrimes = big.NewInt(1)
+		for i := 2; i < smallPrimeBound; i++ {
+			if composite[i] {
+				continue
+			}
+			smallPrimes.Mul(smallPrimes, big.NewInt(int64(i)))
+			for j := i * i; j < smallPrimeBound; j += i {
+				composite[j] = true
+			}
+		}
+	})
+	return smallPrimes
+}
+
+// sessionID returns the ID of a session from each party's nonce. Every
+// proof and commitment in the session is bound to it.
+func sessionID(tag string, nonces ...[]byte) []byte {
+	parts := append([][]byte{[]byte("multiwallet mpc session " + tag)}, nonces...)
+	return hashParts(parts...)
+}
+
+// commit returns a hash commitment to the parts.
+func commit(tag string, sid, salt []byte, parts ...[]byte) []byte {
+	return hashParts(append([][]byte{[]byte("multiwallet mpc commitment " + tag), sid, salt}, parts...)...)
+}
+
+// hashParts hashes the parts with their lengths so different splits of
+// the same bytes hash differently.
+func hashParts(parts ...[]byte) []byte {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write(uint32Bytes(uint32(len(p))))
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+func newNonce() ([]byte, error) {
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+func challengeBit(e []byte, i int) uint {
+	return uint(e[i/8]>>(uint(i)%8)) & 1
+}
+
+func uint32Bytes(i uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, i)
+	return b
+}
+
+func equalBytes(a, b []byte) bool {
+	return len(a) == len(b) && subtle.ConstantTimeCompare(a, b) == 1
+}
@@ -0,0 +1,97 @@
+package mpc
+
+import (
+	"encoding/hex"
+	"errors"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/cpacia/multiwallet/base"
+	"sync"
+)
+
+// Server is the server's side of signing as seen by the client. A
+// LocalServer runs it in the same process; a remote signing service
+// implements it over its own transport and decides which digests to sign.
+type Server interface {
+	// StartSign answers the client's commitment with the server's nonce
+	// point.
+	StartSign(req *SignRequest) (*SignChallenge, error)
+
+	// FinishSign checks the client's decommitment and returns the
+	// encrypted signature for the session it names.
+	FinishSign(dec *SignDecommitment) (*SignResponse, error)
+}
+
+// LocalServer is a Server for a ServerShare in the same process. It keeps
+// each signing session until it's finished.
+type LocalServer struct {
+	share    *ServerShare
+	sessions map[string]*ServerSign
+	mtx      sync.Mutex
+}
+
+// NewLocalServer returns a Server which signs with the share.
+func NewLocalServer(share *ServerShare) *LocalServer {
+	return &LocalServer{share: share, sessions: make(map[string]*ServerSign)}
+}
+
+// StartSign implements Server.
+func (s *LocalServer) StartSign(req *SignRequest) (*SignChallenge, error) {
+	ss, ch, err := s.share.StartSign(req)
+	if err != nil {
+		return nil, err
+	}
+	s.mtx.Lock()
+	s.sessions[hex.EncodeToString(ss.SessionID())] = ss
+	s.mtx.Unlock()
+	return ch, nil
+}
+
+// FinishSign implements Server.
+func (s *LocalServer) FinishSign(dec *SignDecommitment) (*SignResponse, error) {
+	if dec == nil {
+		return nil, errors.New("mpc: invalid sign decommitment")
+	}
+	id := hex.EncodeToString(dec.SessionID)
+	s.mtx.Lock()
+	ss, ok := s.sessions[id]
+	delete(s.sessions, id)
+	s.mtx.Unlock()
+	if !ok {
+		return nil, errors.New("mpc: unknown signing session")
+	}
+	return ss.Finish(dec)
+}
+
+// Signer is a base.Signer which signs with the client share, running the
+// protocol with the server for each signature. Wallets which use it are
+// created with CreateWatchOnlyWallet from the share's AccountKey.
+type Signer struct {
+	share  *ClientShare
+	server Server
+}
+
+// NewSigner returns a Signer for the client share and its server.
+func NewSigner(share *ClientShare, server Server) *Signer {
+	return &Signer{share: share, server: server}
+}
+
+// Sign returns the joint signature of the digest by the key at the path.
+func (s *Signer) Sign(path base.KeyPath, digest []byte) (*btcec.Signature, error) {
+	cs, req, err := s.share.StartSign(path, digest)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := s.server.StartSign(req)
+	if err != nil {
+		return nil, err
+	}
+	dec, err := cs.Decommit(ch)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.server.FinishSign(dec)
+	if err != nil {
+		return nil, err
+	}
+	return cs.Finish(resp)
+}
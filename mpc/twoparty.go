@@ -0,0 +1,890 @@
+// Package mpc implements two-party ECDSA in which a key is split between a
+// client and a server so that neither can sign alone. The signatures are
+// ordinary ECDSA signatures for the joint public key so they're spent to
+// and verified exactly like single key addresses.
+//
+// The protocol is Lindell's "Fast Secure Two-Party ECDSA Signing" (2017).
+// The private key is x = x1*x2 where x1 is the client's share and x2 the
+// server's. The server holds the client's share encrypted under the
+// client's Paillier key and uses it to compute an encrypted signature which
+// only the client can finish. Each party proves knowledge of its key and
+// nonce shares with a Schnorr proof.
+//
+// Key generation and signing start with the client committing to its
+// point so neither party can pick its share after seeing the other's.
+// Before the server accepts an encrypted share, at key generation and at
+// every refresh, the client proves its Paillier modulus is coprime to its
+// totient, that the share is in range and, with Lindell's PDL proof, that
+// it's the discrete log of the client's point. Every proof and commitment
+// is bound to a session ID made from both parties' nonces.
+package mpc
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	hd "github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/cpacia/multiwallet/base"
+	"math/big"
+)
+
+// PaillierBits is the size of the Paillier modulus. It must be large
+// enough that the server's encrypted computation never wraps.
+const PaillierBits = 2048
+
+// ErrInvalidProof is returned when a party's proof or commitment doesn't
+// verify.
+var ErrInvalidProof = errors.New("mpc: invalid proof")
+
+var curve = btcec.S256()
+
+// ClientShare is the client's share of a key and the Paillier key its
+// share is encrypted with.
+type ClientShare struct {
+	X1        *big.Int            `json:"x1"`
+	Paillier  *PaillierPrivateKey `json:"paillier"`
+	PublicKey []byte              `json:"publicKey"`
+	ChainCode []byte              `json:"chainCode"`
+}
+
+// ServerShare is the server's share of a key along with the client's share
+// encrypted under the client's Paillier key.
+type ServerShare struct {
+	X2        *big.Int           `json:"x2"`
+	Paillier  *PaillierPublicKey `json:"paillier"`
+	EncX1     *big.Int           `json:"encX1"`
+	PublicKey []byte             `json:"publicKey"`
+	ChainCode []byte             `json:"chainCode"`
+}
+
+// DLogProof is a Schnorr proof of knowledge of the discrete log of a point.
+type DLogProof struct {
+	A []byte   `json:"a"`
+	Z *big.Int `json:"z"`
+}
+
+// KeyGenRequest is the client's first key generation message. It commits
+// to the client's point.
+type KeyGenRequest struct {
+	Nonce      []byte `json:"nonce"`
+	Commitment []byte `json:"commitment"`
+}
+
+// KeyGenResponse is the server's reply to a KeyGenRequest.
+type KeyGenResponse struct {
+	Nonce []byte     `json:"nonce"`
+	Q2    []byte     `json:"q2"`
+	Proof *DLogProof `json:"proof"`
+}
+
+// KeyGenDecommitment opens the client's commitment and gives the server
+// the client's encrypted share. The server replies with a ShareChallenge.
+type KeyGenDecommitment struct {
+	Q1    []byte          `json:"q1"`
+	Salt  []byte          `json:"salt"`
+	Proof *DLogProof      `json:"proof"`
+	Share *EncryptedShare `json:"share"`
+}
+
+// ClientKeyGen is the client's state during key generation.
+type ClientKeyGen struct {
+	x1       *big.Int
+	q1       *btcec.PublicKey
+	paillier *PaillierPrivateKey
+	nonce    []byte
+	salt     []byte
+	q2       *btcec.PublicKey
+	prover   *shareProver
+}
+
+// ServerKeyGen is the server's state during key generation.
+type ServerKeyGen struct {
+	sid        []byte
+	clientSID  []byte
+	commitment []byte
+	x2         *big.Int
+	q2         *btcec.PublicKey
+	q1         *btcec.PublicKey
+	verifier   *shareVerifier
+}
+
+// NewClientKeyGen starts generating a new key. The messages are exchanged
+// with the server in this order:
+//
+//	client: NewClientKeyGen        -> KeyGenRequest
+//	server: NewServerKeyGen        -> KeyGenResponse
+//	client: ClientKeyGen.Decommit  -> KeyGenDecommitment
+//	server: ServerKeyGen.Challenge -> ShareChallenge
+//	client: ClientKeyGen.Respond   -> ShareResponse
+//	server: ServerKeyGen.Reveal    -> ShareReveal
+//	client: ClientKeyGen.Finish    -> ShareOpening and the ClientShare
+//	server: ServerKeyGen.Finish    -> the ServerShare
+func NewClientKeyGen() (*ClientKeyGen, *KeyGenRequest, error) {
+	x1, err := randScalar()
+	if err != nil {
+		return nil, nil, err
+	}
+	paillier, err := GeneratePaillierKey(rand.Reader, PaillierBits)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, nil, err
+	}
+	salt, err := newNonce()
+	if err != nil {
+		return nil, nil, err
+	}
+	q1 := scalarBaseMult(x1)
+	kg := &ClientKeyGen{x1: x1, q1: q1, paillier: paillier, nonce: nonce, salt: salt}
+	return kg, &KeyGenRequest{
+		Nonce:      nonce,
+		Commitment: commit("keygen q1", nonce, salt, q1.SerializeCompressed()),
+	}, nil
+}
+
+// NewServerKeyGen is the server's side of key generation. It returns the
+// server's state and the response for the client.
+func NewServerKeyGen(req *KeyGenRequest) (*ServerKeyGen, *KeyGenResponse, error) {
+	if req == nil || len(req.Nonce) != nonceSize || len(req.Commitment) != sha256.Size {
+		return nil, nil, errors.New("mpc: invalid key generation request")
+	}
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, nil, err
+	}
+	sid := sessionID("keygen", req.Nonce, nonce)
+
+	x2, err := randScalar()
+	if err != nil {
+		return nil, nil, err
+	}
+	q2 := scalarBaseMult(x2)
+	proof, err := proveDLog(sid, x2, q2)
+	if err != nil {
+		return nil, nil, err
+	}
+	skg := &ServerKeyGen{
+		sid:        sid,
+		clientSID:  req.Nonce,
+		commitment: req.Commitment,
+		x2:         x2,
+		q2:         q2,
+	}
+	return skg, &KeyGenResponse{Nonce: nonce, Q2: q2.SerializeCompressed(), Proof: proof}, nil
+}
+
+// Decommit checks the server's proof and opens the client's commitment
+// along with its encrypted share.
+func (kg *ClientKeyGen) Decommit(resp *KeyGenResponse) (*KeyGenDecommitment, error) {
+	if kg.prover != nil {
+		return nil, errors.New("mpc: key generation already decommitted")
+	}
+	if resp == nil || len(resp.Nonce) != nonceSize {
+		return nil, errors.New("mpc: invalid key generation response")
+	}
+	sid := sessionID("keygen", kg.nonce, resp.Nonce)
+	q2, err := btcec.ParsePubKey(resp.Q2, curve)
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Proof.verify(sid, q2) {
+		return nil, ErrInvalidProof
+	}
+	proof, err := proveDLog(sid, kg.x1, kg.q1)
+	if err != nil {
+		return nil, err
+	}
+	prover, share, err := newShareProver(sid, kg.x1, kg.paillier)
+	if err != nil {
+		return nil, err
+	}
+	kg.q2 = q2
+	kg.prover = prover
+	return &KeyGenDecommitment{
+		Q1:    kg.q1.SerializeCompressed(),
+		Salt:  kg.salt,
+		Proof: proof,
+		Share: share,
+	}, nil
+}
+
+// Challenge checks the client's decommitment and Paillier key and returns
+// the challenge to its encrypted share.
+func (skg *ServerKeyGen) Challenge(dec *KeyGenDecommitment) (*ShareChallenge, error) {
+	if skg.verifier != nil {
+		return nil, errors.New("mpc: key generation already challenged")
+	}
+	if dec == nil || !equalBytes(commit("keygen q1", skg.clientSID, dec.Salt, dec.Q1), skg.commitment) {
+		return nil, ErrInvalidProof
+	}
+	q1, err := btcec.ParsePubKey(dec.Q1, curve)
+	if err != nil {
+		return nil, err
+	}
+	if !dec.Proof.verify(skg.sid, q1) {
+		return nil, ErrInvalidProof
+	}
+	verifier, ch, err := newShareVerifier(skg.sid, q1, dec.Share)
+	if err != nil {
+		return nil, err
+	}
+	skg.q1 = q1
+	skg.verifier = verifier
+	return ch, nil
+}
+
+// Respond answers the server's challenge to the encrypted share.
+func (kg *ClientKeyGen) Respond(ch *ShareChallenge) (*ShareResponse, error) {
+	if kg.prover == nil {
+		return nil, errors.New("mpc: key generation not decommitted")
+	}
+	return kg.prover.respond(ch)
+}
+
+// Reveal checks the client's range proof and opens the server's PDL
+// commitment.
+func (skg *ServerKeyGen) Reveal(resp *ShareResponse) (*ShareReveal, error) {
+	if skg.verifier == nil {
+		return nil, errors.New("mpc: key generation not challenged")
+	}
+	return skg.verifier.reveal(resp)
+}
+
+// Finish checks the server's PDL challenge was honest and returns the
+// client's share along with the opening the server needs to finish.
+func (kg *ClientKeyGen) Finish(rev *ShareReveal) (*ClientShare, *ShareOpening, error) {
+	if kg.prover == nil {
+		return nil, nil, errors.New("mpc: key generation not decommitted")
+	}
+	opening, err := kg.prover.finish(rev)
+	if err != nil {
+		return nil, nil, err
+	}
+	q := scalarMult(kg.q2, kg.x1)
+	return &ClientShare{
+		X1:        kg.x1,
+		Paillier:  kg.paillier,
+		PublicKey: q.SerializeCompressed(),
+		ChainCode: chainCode(kg.q1, kg.q2),
+	}, opening, nil
+}
+
+// Finish completes the PDL proof and returns the server's share. Until it
+// succeeds the client's encrypted share must not be used.
+func (skg *ServerKeyGen) Finish(opening *ShareOpening) (*ServerShare, error) {
+	if skg.verifier == nil {
+		return nil, errors.New("mpc: key generation not challenged")
+	}
+	if err := skg.verifier.finish(opening); err != nil {
+		return nil, err
+	}
+	q := scalarMult(skg.q1, skg.x2)
+	return &ServerShare{
+		X2:        skg.x2,
+		Paillier:  skg.verifier.share.Paillier,
+		EncX1:     skg.verifier.share.EncX1,
+		PublicKey: q.SerializeCompressed(),
+		ChainCode: chainCode(skg.q1, skg.q2),
+	}, nil
+}
+
+// AccountKey returns the extended public key of the joint key. Wallets
+// created from it with CreateWatchOnlyWallet spend using a Signer.
+func (c *ClientShare) AccountKey(params *chaincfg.Params) *hd.ExtendedKey {
+	return hd.NewExtendedKey(params.HDPublicKeyID[:], c.PublicKey, c.ChainCode, []byte{0, 0, 0, 0}, 0, 0, false)
+}
+
+// SignRequest is the client's first signing message. It commits to the
+// client's nonce point. The server should check the digest is one it's
+// willing to sign before replying.
+type SignRequest struct {
+	Path       base.KeyPath `json:"path"`
+	Digest     []byte       `json:"digest"`
+	Nonce      []byte       `json:"nonce"`
+	Commitment []byte       `json:"commitment"`
+}
+
+// SignChallenge is the server's reply to a SignRequest.
+type SignChallenge struct {
+	Nonce []byte     `json:"nonce"`
+	R2    []byte     `json:"r2"`
+	Proof *DLogProof `json:"proof"`
+}
+
+// SignDecommitment opens the client's commitment. SessionID identifies the
+// signing session to the server.
+type SignDecommitment struct {
+	SessionID []byte     `json:"sessionID"`
+	R1        []byte     `json:"r1"`
+	Salt      []byte     `json:"salt"`
+	Proof     *DLogProof `json:"proof"`
+}
+
+// SignResponse is the server's reply to a SignDecommitment. C3 is the
+// encrypted signature which the client decrypts and finishes.
+type SignResponse struct {
+	C3 *big.Int `json:"c3"`
+}
+
+// ClientSign is the client's state while signing.
+type ClientSign struct {
+	share  *ClientShare
+	k1     *big.Int
+	r1     *btcec.PublicKey
+	nonce  []byte
+	salt   []byte
+	r2     *btcec.PublicKey
+	path   base.KeyPath
+	digest []byte
+}
+
+// ServerSign is the server's state while signing.
+type ServerSign struct {
+	share      *ServerShare
+	sid        []byte
+	clientSID  []byte
+	commitment []byte
+	path       base.KeyPath
+	digest     []byte
+	k2         *big.Int
+	done       bool
+}
+
+// StartSign starts signing the digest with the key at the path. The
+// messages are exchanged with the server in this order:
+//
+//	client: ClientShare.StartSign  -> SignRequest
+//	server: ServerShare.StartSign  -> SignChallenge
+//	client: ClientSign.Decommit    -> SignDecommitment
+//	server: ServerSign.Finish      -> SignResponse
+//	client: ClientSign.Finish      -> the signature
+func (c *ClientShare) StartSign(path base.KeyPath, digest []byte) (*ClientSign, *SignRequest, error) {
+	if len(digest) != 32 {
+		return nil, nil, errors.New("mpc: digest must be 32 bytes")
+	}
+	k1, err := randScalar()
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, nil, err
+	}
+	salt, err := newNonce()
+	if err != nil {
+		return nil, nil, err
+	}
+	r1 := scalarBaseMult(k1)
+	cs := &ClientSign{share: c, k1: k1, r1: r1, nonce: nonce, salt: salt, path: path, digest: digest}
+	return cs, &SignRequest{
+		Path:       path,
+		Digest:     digest,
+		Nonce:      nonce,
+		Commitment: commit("sign r1", nonce, salt, r1.SerializeCompressed()),
+	}, nil
+}
+
+// StartSign is the server's side of signing. It picks the server's nonce
+// share and proves knowledge of it.
+func (s *ServerShare) StartSign(req *SignRequest) (*ServerSign, *SignChallenge, error) {
+	if req == nil || len(req.Digest) != 32 {
+		return nil, nil, errors.New("mpc: digest must be 32 bytes")
+	}
+	if len(req.Nonce) != nonceSize || len(req.Commitment) != sha256.Size {
+		return nil, nil, errors.New("mpc: invalid sign request")
+	}
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, nil, err
+	}
+	sid := sessionID("sign", req.Nonce, nonce)
+
+	k2, err := randScalar()
+	if err != nil {
+		return nil, nil, err
+	}
+	r2 := scalarBaseMult(k2)
+	proof, err := proveDLog(sid, k2, r2)
+	if err != nil {
+		return nil, nil, err
+	}
+	ss := &ServerSign{
+		share:      s,
+		sid:        sid,
+		clientSID:  req.Nonce,
+		commitment: req.Commitment,
+		path:       req.Path,
+		digest:     req.Digest,
+		k2:         k2,
+	}
+	return ss, &SignChallenge{Nonce: nonce, R2: r2.SerializeCompressed(), Proof: proof}, nil
+}
+
+// SessionID returns the ID of the signing session.
+func (ss *ServerSign) SessionID() []byte {
+	return ss.sid
+}
+
+// Decommit checks the server's proof and opens the client's commitment.
+func (cs *ClientSign) Decommit(ch *SignChallenge) (*SignDecommitment, error) {
+	if cs.r2 != nil {
+		return nil, errors.New("mpc: signature already decommitted")
+	}
+	if ch == nil || len(ch.Nonce) != nonceSize {
+		return nil, errors.New("mpc: invalid sign challenge")
+	}
+	sid := sessionID("sign", cs.nonce, ch.Nonce)
+	r2, err := btcec.ParsePubKey(ch.R2, curve)
+	if err != nil {
+		return nil, err
+	}
+	if !ch.Proof.verify(sid, r2) {
+		return nil, ErrInvalidProof
+	}
+	proof, err := proveDLog(sid, cs.k1, cs.r1)
+	if err != nil {
+		return nil, err
+	}
+	cs.r2 = r2
+	return &SignDecommitment{
+		SessionID: sid,
+		R1:        cs.r1.SerializeCompressed(),
+		Salt:      cs.salt,
+		Proof:     proof,
+	}, nil
+}
+
+// Finish computes the signature, encrypted under the client's Paillier key,
+// from the server's shares of the key and nonce and the client's encrypted
+// key share. It may only be called once per session.
+func (ss *ServerSign) Finish(dec *SignDecommitment) (*SignResponse, error) {
+	if ss.done {
+		return nil, errors.New("mpc: signing session already finished")
+	}
+	ss.done = true
+	if dec == nil || !equalBytes(dec.SessionID, ss.sid) {
+		return nil, errors.New("mpc: wrong signing session")
+	}
+	if !equalBytes(commit("sign r1", ss.clientSID, dec.Salt, dec.R1), ss.commitment) {
+		return nil, ErrInvalidProof
+	}
+	r1, err := btcec.ParsePubKey(dec.R1, curve)
+	if err != nil {
+		return nil, err
+	}
+	if !dec.Proof.verify(ss.sid, r1) {
+		return nil, ErrInvalidProof
+	}
+	s := ss.share
+	q, err := btcec.ParsePubKey(s.PublicKey, curve)
+	if err != nil {
+		return nil, err
+	}
+	t, _, err := pathTweak(q, s.ChainCode, ss.path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := new(big.Int).Mod(scalarMult(r1, ss.k2).X, curve.N)
+	if r.Sign() == 0 {
+		return nil, errors.New("mpc: invalid nonce")
+	}
+
+	// c1 = Enc(rho*q + k2^-1 * (m + r*t)) where rho masks the sum.
+	// c2 = Enc(x1)^(k2^-1 * r * x2)
+	// c3 = c1 + c2 = Enc(k2^-1 * (m + r*(x1*x2 + t)) mod q + rho'*q)
+	k2Inv := new(big.Int).ModInverse(ss.k2, curve.N)
+	m := new(big.Int).SetBytes(ss.digest)
+	plain := new(big.Int).Mul(r, t)
+	plain.Add(plain, m)
+	plain.Mul(plain, k2Inv)
+	plain.Mod(plain, curve.N)
+
+	qSquared := new(big.Int).Mul(curve.N, curve.N)
+	rho, err := rand.Int(rand.Reader, qSquared)
+	if err != nil {
+		return nil, err
+	}
+	plain.Add(plain, rho.Mul(rho, curve.N))
+	c1, err := s.Paillier.Encrypt(rand.Reader, plain)
+	if err != nil {
+		return nil, err
+	}
+
+	v := new(big.Int).Mul(k2Inv, r)
+	v.Mul(v, s.X2)
+	v.Mod(v, curve.N)
+	c2 := s.Paillier.Mul(s.EncX1, v)
+
+	return &SignResponse{C3: s.Paillier.Add(c1, c2)}, nil
+}
+
+// Finish decrypts the server's response into the signature and checks it.
+func (cs *ClientSign) Finish(resp *SignResponse) (*btcec.Signature, error) {
+	if cs.r2 == nil {
+		return nil, errors.New("mpc: signature not decommitted")
+	}
+	if resp == nil || resp.C3 == nil {
+		return nil, errors.New("mpc: invalid sign response")
+	}
+	r := new(big.Int).Mod(scalarMult(cs.r2, cs.k1).X, curve.N)
+
+	sPrime, err := cs.share.Paillier.Decrypt(resp.C3)
+	if err != nil {
+		return nil, err
+	}
+	s := sPrime.Mod(sPrime, curve.N)
+	s.Mul(s, new(big.Int).ModInverse(cs.k1, curve.N))
+	s.Mod(s, curve.N)
+
+	// Use the low S value required by BIP 62.
+	halfOrder := new(big.Int).Rsh(curve.N, 1)
+	if s.Cmp(halfOrder) > 0 {
+		s.Sub(curve.N, s)
+	}
+	sig := &btcec.Signature{R: r, S: s}
+
+	q, err := btcec.ParsePubKey(cs.share.PublicKey, curve)
+	if err != nil {
+		return nil, err
+	}
+	_, pub, err := pathTweak(q, cs.share.ChainCode, cs.path)
+	if err != nil {
+		return nil, err
+	}
+	if !sig.Verify(cs.digest, pub) {
+		return nil, errors.New("mpc: server returned an invalid signature")
+	}
+	return sig, nil
+}
+
+// RefreshOffer is the server's refresh message. Both shares are multiplied
+// by R, or its inverse, which leaves the joint key unchanged but makes the
+// old shares useless when combined with new ones.
+type RefreshOffer struct {
+	R     *big.Int `json:"r"`
+	Nonce []byte   `json:"nonce"`
+}
+
+// RefreshRequest is the client's reply to a RefreshOffer. The client's new
+// share is encrypted under a new Paillier key. The server replies with a
+// ShareChallenge.
+type RefreshRequest struct {
+	Nonce []byte          `json:"nonce"`
+	Q1    []byte          `json:"q1"`
+	Proof *DLogProof      `json:"proof"`
+	Share *EncryptedShare `json:"share"`
+}
+
+// ServerRefresh is the server's state while refreshing.
+type ServerRefresh struct {
+	share    *ServerShare
+	r        *big.Int
+	nonce    []byte
+	x2       *big.Int
+	verifier *shareVerifier
+}
+
+// ClientRefresh is the client's state while refreshing.
+type ClientRefresh struct {
+	share  *ClientShare
+	prover *shareProver
+}
+
+// StartRefresh starts refreshing the shares. The messages are exchanged
+// with the client in this order:
+//
+//	server: ServerShare.StartRefresh -> RefreshOffer
+//	client: ClientShare.Refresh      -> RefreshRequest
+//	server: ServerRefresh.Challenge  -> ShareChallenge
+//	client: ClientRefresh.Respond    -> ShareResponse
+//	server: ServerRefresh.Reveal     -> ShareReveal
+//	client: ClientRefresh.Finish     -> ShareOpening and the new ClientShare
+//	server: ServerRefresh.Finish     -> the new ServerShare
+func (s *ServerShare) StartRefresh() (*ServerRefresh, *RefreshOffer, error) {
+	r, err := randScalar()
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &ServerRefresh{share: s, r: r, nonce: nonce}, &RefreshOffer{R: r, Nonce: nonce}, nil
+}
+
+// Refresh starts the client's side of refreshing the shares for the
+// server's offer.
+func (c *ClientShare) Refresh(offer *RefreshOffer) (*ClientRefresh, *RefreshRequest, error) {
+	if offer == nil || offer.R == nil || offer.R.Sign() <= 0 || offer.R.Cmp(curve.N) >= 0 || len(offer.Nonce) != nonceSize {
+		return nil, nil, errors.New("mpc: invalid refresh offer")
+	}
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, nil, err
+	}
+	sid := sessionID("refresh", offer.Nonce, nonce)
+
+	x1 := new(big.Int).Mul(c.X1, offer.R)
+	x1.Mod(x1, curve.N)
+	paillier, err := GeneratePaillierKey(rand.Reader, PaillierBits)
+	if err != nil {
+		return nil, nil, err
+	}
+	q1 := scalarBaseMult(x1)
+	proof, err := proveDLog(sid, x1, q1)
+	if err != nil {
+		return nil, nil, err
+	}
+	prover, share, err := newShareProver(sid, x1, paillier)
+	if err != nil {
+		return nil, nil, err
+	}
+	cr := &ClientRefresh{
+		share: &ClientShare{
+			X1:        x1,
+			Paillier:  paillier,
+			PublicKey: c.PublicKey,
+			ChainCode: c.ChainCode,
+		},
+		prover: prover,
+	}
+	return cr, &RefreshRequest{
+		Nonce: nonce,
+		Q1:    q1.SerializeCompressed(),
+		Proof: proof,
+		Share: share,
+	}, nil
+}
+
+// Challenge checks the client's new share still combines with the
+// server's into the same key and returns the challenge to its encrypted
+// share.
+func (sr *ServerRefresh) Challenge(req *RefreshRequest) (*ShareChallenge, error) {
+	if sr.verifier != nil {
+		return nil, errors.New("mpc: refresh already challenged")
+	}
+	if req == nil || len(req.Nonce) != nonceSize {
+		return nil, errors.New("mpc: invalid refresh request")
+	}
+	sid := sessionID("refresh", sr.nonce, req.Nonce)
+	q1, err := btcec.ParsePubKey(req.Q1, curve)
+	if err != nil {
+		return nil, err
+	}
+	if !req.Proof.verify(sid, q1) {
+		return nil, ErrInvalidProof
+	}
+	x2 := new(big.Int).ModInverse(sr.r, curve.N)
+	x2.Mul(x2, sr.share.X2)
+	x2.Mod(x2, curve.N)
+	if !scalarMult(q1, x2).IsEqual(mustParsePubKey(sr.share.PublicKey)) {
+		return nil, errors.New("mpc: refreshed shares don't match the key")
+	}
+	verifier, ch, err := newShareVerifier(sid, q1, req.Share)
+	if err != nil {
+		return nil, err
+	}
+	sr.x2 = x2
+	sr.verifier = verifier
+	return ch, nil
+}
+
+// Respond answers the server's challenge to the encrypted share.
+func (cr *ClientRefresh) Respond(ch *ShareChallenge) (*ShareResponse, error) {
+	return cr.prover.respond(ch)
+}
+
+// Reveal checks the client's range proof and opens the server's PDL
+// commitment.
+func (sr *ServerRefresh) Reveal(resp *ShareResponse) (*ShareReveal, error) {
+	if sr.verifier == nil {
+		return nil, errors.New("mpc: refresh not challenged")
+	}
+	return sr.verifier.reveal(resp)
+}
+
+// Finish checks the server's PDL challenge was honest and returns the
+// client's new share along with the opening the server needs to finish.
+// The old share should be deleted once the server has finished.
+func (cr *ClientRefresh) Finish(rev *ShareReveal) (*ClientShare, *ShareOpening, error) {
+	opening, err := cr.prover.finish(rev)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cr.share, opening, nil
+}
+
+// Finish completes the PDL proof and returns the server's new share.
+func (sr *ServerRefresh) Finish(opening *ShareOpening) (*ServerShare, error) {
+	if sr.verifier == nil {
+		return nil, errors.New("mpc: refresh not challenged")
+	}
+	if err := sr.verifier.finish(opening); err != nil {
+		return nil, err
+	}
+	return &ServerShare{
+		X2:        sr.x2,
+		Paillier:  sr.verifier.share.Paillier,
+		EncX1:     sr.verifier.share.EncX1,
+		PublicKey: sr.share.PublicKey,
+		ChainCode: sr.share.ChainCode,
+	}, nil
+}
+
+// RecoverKey combines the shares into the full private key. It's used to
+// move the funds out if either party is lost for good.
+func RecoverKey(c *ClientShare, s *ServerShare) (*btcec.PrivateKey, error) {
+	x := new(big.Int).Mul(c.X1, s.X2)
+	x.Mod(x, curve.N)
+	priv, pub := btcec.PrivKeyFromBytes(curve, paddedBytes(x))
+	if !pub.IsEqual(mustParsePubKey(c.PublicKey)) {
+		base.ZeroPrivKey(priv)
+		return nil, errors.New("mpc: shares don't belong to the same key")
+	}
+	return priv, nil
+}
+
+// RecoverAccountKey returns the extended private key matching the shares'
+// AccountKey. It can be used to create an ordinary wallet holding the same
+// addresses.
+func RecoverAccountKey(c *ClientShare, s *ServerShare, params *chaincfg.Params) (*hd.ExtendedKey, error) {
+	priv, err := RecoverKey(c, s)
+	if err != nil {
+		return nil, err
+	}
+	defer base.ZeroPrivKey(priv)
+	return hd.NewExtendedKey(params.HDPrivateKeyID[:], paddedBytes(priv.D), c.ChainCode, []byte{0, 0, 0, 0}, 0, 0, true), nil
+}
+
+// pathTweak returns the sum of the BIP 32 tweaks which derive the key at
+// the path from the account key, along with the derived public key. The
+// private key at the path is the account private key plus the tweak.
+func pathTweak(accountKey *btcec.PublicKey, chainCode []byte, path base.KeyPath) (*big.Int, *btcec.PublicKey, error) {
+	change := uint32(0)
+	if path.Change {
+		change = 1
+	}
+	total := new(big.Int)
+	pub, cc := accountKey, chainCode
+	for _, i := range []uint32{change, path.Index} {
+		if i >= hd.HardenedKeyStart {
+			return nil, nil, errors.New("mpc: hardened keys can't be derived")
+		}
+		data := make([]byte, 37)
+		copy(data, pub.SerializeCompressed())
+		binary.BigEndian.PutUint32(data[33:], i)
+		mac := hmac.New(sha512.New, cc)
+		mac.Write(data)
+		ilr := mac.Sum(nil)
+
+		il := new(big.Int).SetBytes(ilr[:32])
+		if il.Cmp(curve.N) >= 0 {
+			return nil, nil, hd.ErrInvalidChild
+		}
+		x, y := curve.ScalarBaseMult(ilr[:32])
+		x, y = curve.Add(x, y, pub.X, pub.Y)
+		if x.Sign() == 0 && y.Sign() == 0 {
+			return nil, nil, hd.ErrInvalidChild
+		}
+		pub = &btcec.PublicKey{Curve: curve, X: x, Y: y}
+		cc = ilr[32:]
+		total.Add(total, il)
+	}
+	return total.Mod(total, curve.N), pub, nil
+}
+
+// chainCode returns the chain code of the joint account key. It's derived
+// from both parties' points so neither picks it alone.
+func chainCode(q1, q2 *btcec.PublicKey) []byte {
+	h := sha256.New()
+	h.Write([]byte("multiwallet mpc chain code"))
+	h.Write(q1.SerializeCompressed())
+	h.Write(q2.SerializeCompressed())
+	return h.Sum(nil)
+}
+
+// proveDLog returns a proof of knowledge of x where p = x*G, bound to the
+// session.
+func proveDLog(sid []byte, x *big.Int, p *btcec.PublicKey) (*DLogProof, error) {
+	k, err := randScalar()
+	if err != nil {
+		return nil, err
+	}
+	a := scalarBaseMult(k)
+	e := proofChallenge(sid, p, a)
+	z := new(big.Int).Mul(e, x)
+	z.Add(z, k)
+	z.Mod(z, curve.N)
+	return &DLogProof{A: a.SerializeCompressed(), Z: z}, nil
+}
+
+// verify checks z*G = A + e*P.
+func (proof *DLogProof) verify(sid []byte, p *btcec.PublicKey) bool {
+	if proof == nil || proof.Z == nil || proof.Z.Sign() < 0 || proof.Z.Cmp(curve.N) >= 0 {
+		return false
+	}
+	a, err := btcec.ParsePubKey(proof.A, curve)
+	if err != nil {
+		return false
+	}
+	e := proofChallenge(sid, p, a)
+	lhs := scalarBaseMult(proof.Z)
+	ep := scalarMult(p, e)
+	x, y := curve.Add(a.X, a.Y, ep.X, ep.Y)
+	return lhs.X.Cmp(x) == 0 && lhs.Y.Cmp(y) == 0
+}
+
+func proofChallenge(sid []byte, p, a *btcec.PublicKey) *big.Int {
+	h := sha256.New()
+	h.Write([]byte("multiwallet mpc dlog proof"))
+	h.Write(sid)
+	h.Write(p.SerializeCompressed())
+	h.Write(a.SerializeCompressed())
+	e := new(big.Int).SetBytes(h.Sum(nil))
+	return e.Mod(e, curve.N)
+}
+
+func randScalar() (*big.Int, error) {
+	for {
+		k, err := rand.Int(rand.Reader, curve.N)
+		if err != nil {
+			return nil, err
+		}
+		if k.Sign() > 0 {
+			return k, nil
+		}
+	}
+}
+
+func scalarBaseMult(k *big.Int) *btcec.PublicKey {
+	x, y := curve.ScalarBaseMult(paddedBytes(k))
+	return &btcec.PublicKey{Curve: curve, X: x, Y: y}
+}
+
+func scalarMult(p *btcec.PublicKey, k *big.Int) *btcec.PublicKey {
+	x, y := curve.ScalarMult(p.X, p.Y, paddedBytes(k))
+	return &btcec.PublicKey{Curve: curve, X: x, Y: y}
+}
+
+func mustParsePubKey(b []byte) *btcec.PublicKey {
+	pub, err := btcec.ParsePubKey(b, curve)
+	if err != nil {
+		return &btcec.PublicKey{Curve: curve, X: new(big.Int), Y: new(big.Int)}
+	}
+	return pub
+}
+
+func paddedBytes(k *big.Int) []byte {
+	b := make([]byte, 32)
+	kb := k.Bytes()
+	copy(b[32-len(kb):], kb)
+	return b
+}
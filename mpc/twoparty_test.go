@@ -0,0 +1,279 @@
+package mpc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/cpacia/multiwallet/base"
+	"math/big"
+	"testing"
+)
+
+func newTestShares(t *testing.T) (*ClientShare, *ServerShare) {
+	kg, req, err := NewClientKeyGen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	skg, resp, err := NewServerKeyGen(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec, err := kg.Decommit(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server, err := runShareProofs(kg, skg, dec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+// runShareProofs runs the rest of key generation after the decommitment.
+func runShareProofs(kg *ClientKeyGen, skg *ServerKeyGen, dec *KeyGenDecommitment) (*ClientShare, *ServerShare, error) {
+	ch, err := skg.Challenge(dec)
+	if err != nil {
+		return nil, nil, err
+	}
+	shareResp, err := kg.Respond(ch)
+	if err != nil {
+		return nil, nil, err
+	}
+	rev, err := skg.Reveal(shareResp)
+	if err != nil {
+		return nil, nil, err
+	}
+	client, opening, err := kg.Finish(rev)
+	if err != nil {
+		return nil, nil, err
+	}
+	server, err := skg.Finish(opening)
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, server, nil
+}
+
+func TestTwoParty(t *testing.T) {
+	client, server := newTestShares(t)
+	if string(client.PublicKey) != string(server.PublicKey) {
+		t.Fatal("Client and server derived different public keys")
+	}
+	if string(client.ChainCode) != string(server.ChainCode) {
+		t.Fatal("Client and server derived different chain codes")
+	}
+
+	// The signature must verify against the key derived from the
+	// recovered account key by ordinary BIP 32 derivation.
+	accountKey, err := RecoverAccountKey(client, server, &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xpub := client.AccountKey(&chaincfg.MainNetParams)
+	neutered, err := accountKey.Neuter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if neutered.String() != xpub.String() {
+		t.Errorf("Expected recovered account key %s, got %s", xpub, neutered)
+	}
+
+	path := base.KeyPath{Change: true, Index: 7}
+	chain, err := accountKey.Child(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	child, err := chain.Child(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	childPub, err := child.ECPubKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest := sha256.Sum256([]byte("test"))
+	signer := NewSigner(client, NewLocalServer(server))
+	sig, err := signer.Sign(path, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sig.Verify(digest[:], childPub) {
+		t.Error("Signature doesn't verify against the derived key")
+	}
+
+	// Refreshed shares sign for the same key but don't combine with the
+	// old ones.
+	sr, offer, err := server.StartRefresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cr, refreshReq, err := client.Refresh(offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, err := sr.Challenge(refreshReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shareResp, err := cr.Respond(ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev, err := sr.Reveal(shareResp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newClient, opening, err := cr.Finish(rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newServer, err := sr.Finish(opening)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newClient.X1.Cmp(client.X1) == 0 || newServer.X2.Cmp(server.X2) == 0 {
+		t.Error("Refresh didn't change the shares")
+	}
+	sig, err = NewSigner(newClient, NewLocalServer(newServer)).Sign(path, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sig.Verify(digest[:], childPub) {
+		t.Error("Signature with refreshed shares doesn't verify")
+	}
+	if _, err := RecoverKey(newClient, newServer); err != nil {
+		t.Error(err)
+	}
+	if _, err := RecoverKey(newClient, server); err == nil {
+		t.Error("Expected error recovering from an old and a new share")
+	}
+}
+
+func TestTwoParty_InvalidProof(t *testing.T) {
+	client, server := newTestShares(t)
+
+	digest := sha256.Sum256([]byte("test"))
+	cs, req, err := client.StartSign(base.KeyPath{}, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, ch, err := server.StartSign(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec, err := cs.Decommit(ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec.Proof.Z.Add(dec.Proof.Z, one)
+	if _, err := ss.Finish(dec); err != ErrInvalidProof {
+		t.Errorf("Expected ErrInvalidProof, got %v", err)
+	}
+	dec.Proof.Z.Sub(dec.Proof.Z, one)
+	if _, err := ss.Finish(dec); err == nil {
+		t.Error("Expected error finishing a signing session twice")
+	}
+}
+
+func TestTwoParty_SignCommitment(t *testing.T) {
+	client, server := newTestShares(t)
+
+	digest := sha256.Sum256([]byte("test"))
+	cs, req, err := client.StartSign(base.KeyPath{}, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, ch, err := server.StartSign(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec, err := cs.Decommit(ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A client can't swap its nonce point after seeing the server's.
+	other, _, err := client.StartSign(base.KeyPath{}, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec.R1 = other.r1.SerializeCompressed()
+	if _, err := ss.Finish(dec); err != ErrInvalidProof {
+		t.Errorf("Expected ErrInvalidProof, got %v", err)
+	}
+}
+
+func TestTwoParty_SessionBinding(t *testing.T) {
+	kg, req, err := NewClientKeyGen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, resp, err := NewServerKeyGen(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A proof from one session doesn't verify in another.
+	_, replayed, err := NewServerKeyGen(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Proof = replayed.Proof
+	if _, err := kg.Decommit(resp); err != ErrInvalidProof {
+		t.Errorf("Expected ErrInvalidProof, got %v", err)
+	}
+}
+
+func TestTwoParty_InvalidShare(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(kg *ClientKeyGen, dec *KeyGenDecommitment)
+	}{
+		{
+			name: "paillier proof",
+			tamper: func(kg *ClientKeyGen, dec *KeyGenDecommitment) {
+				dec.Share.PaillierProof.Sigma[0].Add(dec.Share.PaillierProof.Sigma[0], one)
+			},
+		},
+		{
+			name: "even modulus",
+			tamper: func(kg *ClientKeyGen, dec *KeyGenDecommitment) {
+				dec.Share.Paillier = &PaillierPublicKey{N: new(big.Int).Lsh(dec.Share.Paillier.N, 1)}
+			},
+		},
+		{
+			name: "wrong share",
+			tamper: func(kg *ClientKeyGen, dec *KeyGenDecommitment) {
+				// Encrypt x1+1 so the range proof passes but the
+				// PDL proof doesn't.
+				x := new(big.Int).Add(kg.x1, one)
+				c, r, err := kg.paillier.encrypt(rand.Reader, x)
+				if err != nil {
+					t.Fatal(err)
+				}
+				dec.Share.EncX1 = c
+				kg.prover.x1 = x
+				kg.prover.r = r
+			},
+		},
+	}
+	for _, test := range tests {
+		kg, req, err := NewClientKeyGen()
+		if err != nil {
+			t.Fatal(err)
+		}
+		skg, resp, err := NewServerKeyGen(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dec, err := kg.Decommit(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.tamper(kg, dec)
+		if _, _, err := runShareProofs(kg, skg, dec); err == nil {
+			t.Errorf("%s: expected key generation to fail", test.name)
+		}
+	}
+}
@@ -1,43 +1,85 @@
 package multiwallet
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"github.com/cpacia/multiwallet/atomicswap"
 	"github.com/cpacia/multiwallet/base"
 	"github.com/cpacia/multiwallet/coins/bitcoin"
 	"github.com/cpacia/multiwallet/coins/bitcoincash"
+	"github.com/cpacia/multiwallet/coins/fork"
 	"github.com/cpacia/multiwallet/coins/litecoin"
 	"github.com/cpacia/multiwallet/coins/zcash"
 	"github.com/cpacia/multiwallet/database"
 	"github.com/cpacia/multiwallet/database/sqlitedb"
+	"github.com/cpacia/multiwallet/history"
+	"github.com/cpacia/multiwallet/ledger"
+	"github.com/cpacia/multiwallet/log"
+	"github.com/cpacia/multiwallet/swap"
 	iwallet "github.com/cpacia/wallet-interface"
 	"github.com/natefinch/lumberjack"
-	"github.com/op/go-logging"
+	"io"
 	"os"
 	"path"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
 var (
 	defaultLogFilename = "multiwallet.log"
 	ErrUnsuppertedCoin = errors.New("multiwallet does not contain an implementation for the given coin")
-	fileLogFormat      = logging.MustStringFormatter(`%{time:2006-01-02 T15:04:05.000} [%{level}] [%{module}] %{message}`)
-	stdoutLogFormat    = logging.MustStringFormatter(`%{color:reset}%{color}%{time:15:04:05} [%{level}] [%{module}] %{message}`)
 )
 
-type Multiwallet map[iwallet.CoinType]iwallet.Wallet
+// Multiwallet owns the database shared by the coin wallets and the wallet
+// for each enabled coin. It opens and closes the wallets together,
+// multiplexes their notifications and exposes operations across all of
+// them.
+type Multiwallet struct {
+	db      database.Database
+	logger  log.Logger
+	erp     base.ExchangeRateProvider
+	wallets map[iwallet.CoinType]iwallet.Wallet
+	swaps   *swap.Manager
+	atomic  *atomicswap.Manager
+	crypter *MultiwalletCrypter
+	syncer  *SyncCoordinator
 
-func NewMultiwallet(opts ...Option) (Multiwallet, error) {
+	mtx       sync.Mutex
+	txSubs    []chan CoinTransaction
+	blockSubs []chan CoinBlock
+	started   bool
+	done      chan struct{}
+
+	// forwarders tracks the forwardNotifications goroutines.
+	forwarders sync.WaitGroup
+}
+
+// CoinTransaction is a transaction pushed or returned by one of the
+// wallets.
+type CoinTransaction struct {
+	CoinType    iwallet.CoinType
+	Transaction iwallet.Transaction
+}
+
+// CoinBlock is a new block seen by one of the wallets.
+type CoinBlock struct {
+	CoinType  iwallet.CoinType
+	BlockInfo iwallet.BlockInfo
+}
+
+// NewMultiwallet builds the wallet for each coin in the config on top of
+// one shared database. The wallets must be created, if they don't exist
+// yet, and then opened with Start.
+func NewMultiwallet(opts ...Option) (*Multiwallet, error) {
 	var cfg Config
 	if err := cfg.Apply(append([]Option{Defaults}, opts...)...); err != nil {
 		return nil, err
 	}
 
-	logger := logging.MustGetLogger("multiwallet")
-
-	backendStdout := logging.NewLogBackend(os.Stdout, "", 0)
-	backendStdoutFormatter := logging.NewBackendFormatter(backendStdout, stdoutLogFormat)
-
+	var output io.Writer = os.Stdout
 	if cfg.LogDir != "" {
 		rotator := &lumberjack.Logger{
 			Filename:   path.Join(cfg.LogDir, defaultLogFilename),
@@ -45,17 +87,15 @@ func NewMultiwallet(opts ...Option) (Multiwallet, error) {
 			MaxBackups: 3,
 			MaxAge:     30, // Days
 		}
-
-		backendFile := logging.NewLogBackend(rotator, "", 0)
-		backendFileFormatter := logging.NewBackendFormatter(backendFile, fileLogFormat)
-		leveledBackend := logging.MultiLogger(backendStdoutFormatter, backendFileFormatter)
-		leveledBackend.SetLevel(cfg.LogLevel, "")
-		logger.SetBackend(leveledBackend)
-	} else {
-		leveledBackend := logging.AddModuleLevel(backendStdoutFormatter)
-		leveledBackend.SetLevel(cfg.LogLevel, "")
-		logger.SetBackend(leveledBackend)
+		output = io.MultiWriter(os.Stdout, rotator)
 	}
+	logger := log.NewBackend(log.Config{
+		Output:       output,
+		Format:       cfg.LogFormat,
+		Level:        cfg.LogLevel,
+		ModuleLevels: cfg.LogModuleLevels,
+		RedactLevel:  cfg.LogRedactLevel,
+	}).Logger("multiwallet")
 
 	os.MkdirAll(cfg.DataDir, os.ModePerm)
 	db, err := sqlitedb.NewSqliteDB(cfg.DataDir)
@@ -67,20 +107,27 @@ func NewMultiwallet(opts ...Option) (Multiwallet, error) {
 		return nil, err
 	}
 
+	network := cfg.network()
 	multiwallet := make(map[iwallet.CoinType]iwallet.Wallet)
 	for _, coinType := range cfg.Wallets {
 		switch coinType {
 		case iwallet.CtBitcoinCash:
-			clientURL := cfg.WalletAPIs[coinType].Mainnet
-			if cfg.UseTestnet {
-				clientURL = cfg.WalletAPIs[coinType].Testnet
+			clientURL := cfg.WalletAPIs[coinType].URL(network)
+			if clientURL == "" {
+				return nil, fmt.Errorf("no %s api configured for %s", network, coinType.CurrencyCode())
 			}
 			w, err := bitcoincash.NewBitcoinCashWallet(&base.WalletConfig{
 				Logger:               logger,
 				DB:                   db,
 				ClientURL:            clientURL,
-				Testnet:              cfg.UseTestnet,
+				Network:              network,
 				ExchangeRateProvider: cfg.ExchangeRateProvider,
+				ChangePolicy:         cfg.ChangePolicies[coinType].Policy,
+				ChangeAddress:        cfg.ChangePolicies[coinType].Address,
+				PreventAddressReuse:  cfg.PreventAddressReuse,
+				PassphrasePolicy:     cfg.PassphrasePolicy,
+				Prune:                cfg.Prune,
+				Confirmations:        cfg.Confirmations[coinType],
 			})
 			if err != nil {
 				return nil, err
@@ -88,33 +135,48 @@ func NewMultiwallet(opts ...Option) (Multiwallet, error) {
 
 			multiwallet[coinType] = w
 		case iwallet.CtBitcoin:
-			clientURL := cfg.WalletAPIs[coinType].Mainnet
-			if cfg.UseTestnet {
-				clientURL = cfg.WalletAPIs[coinType].Testnet
+			clientURL := cfg.WalletAPIs[coinType].URL(network)
+			if clientURL == "" {
+				return nil, fmt.Errorf("no %s api configured for %s", network, coinType.CurrencyCode())
 			}
 			w, err := bitcoin.NewBitcoinWallet(&base.WalletConfig{
-				Logger:    logger,
-				DB:        db,
-				ClientURL: clientURL,
-				Testnet:   cfg.UseTestnet,
-				FeeURL:    "https://btc.fees.openbazaar.org",
+				Logger:              logger,
+				DB:                  db,
+				ClientURL:           clientURL,
+				Network:             network,
+				FeeURL:              "https://btc.fees.openbazaar.org",
+				AddressType:         cfg.BitcoinAddressType,
+				Descriptor:          cfg.BitcoinDescriptor,
+				ReplaceByFee:        cfg.BitcoinReplaceByFee,
+				ChangePolicy:        cfg.ChangePolicies[coinType].Policy,
+				ChangeAddress:       cfg.ChangePolicies[coinType].Address,
+				PreventAddressReuse: cfg.PreventAddressReuse,
+				PassphrasePolicy:    cfg.PassphrasePolicy,
+				Prune:               cfg.Prune,
+				Confirmations:       cfg.Confirmations[coinType],
 			})
 			if err != nil {
 				return nil, err
 			}
+			if cfg.Lightning != nil {
+				w.EnableLightning(cfg.Lightning)
+			}
 
 			multiwallet[coinType] = w
 		case iwallet.CtLitecoin:
-			clientURL := cfg.WalletAPIs[coinType].Mainnet
-			if cfg.UseTestnet {
-				clientURL = cfg.WalletAPIs[coinType].Testnet
+			clientURL := cfg.WalletAPIs[coinType].URL(network)
+			if clientURL == "" {
+				return nil, fmt.Errorf("no %s api configured for %s", network, coinType.CurrencyCode())
 			}
 			w, err := litecoin.NewLitecoinWallet(&base.WalletConfig{
 				Logger:               logger,
 				DB:                   db,
 				ClientURL:            clientURL,
-				Testnet:              cfg.UseTestnet,
+				Network:              network,
 				ExchangeRateProvider: cfg.ExchangeRateProvider,
+				PassphrasePolicy:     cfg.PassphrasePolicy,
+				Prune:                cfg.Prune,
+				Confirmations:        cfg.Confirmations[coinType],
 			})
 			if err != nil {
 				return nil, err
@@ -122,16 +184,19 @@ func NewMultiwallet(opts ...Option) (Multiwallet, error) {
 
 			multiwallet[coinType] = w
 		case iwallet.CtZCash:
-			clientURL := cfg.WalletAPIs[coinType].Mainnet
-			if cfg.UseTestnet {
-				clientURL = cfg.WalletAPIs[coinType].Testnet
+			clientURL := cfg.WalletAPIs[coinType].URL(network)
+			if clientURL == "" {
+				return nil, fmt.Errorf("no %s api configured for %s", network, coinType.CurrencyCode())
 			}
 			w, err := zcash.NewZCashWallet(&base.WalletConfig{
 				Logger:               logger,
 				DB:                   db,
 				ClientURL:            clientURL,
-				Testnet:              cfg.UseTestnet,
+				Network:              network,
 				ExchangeRateProvider: cfg.ExchangeRateProvider,
+				PassphrasePolicy:     cfg.PassphrasePolicy,
+				Prune:                cfg.Prune,
+				Confirmations:        cfg.Confirmations[coinType],
 			})
 			if err != nil {
 				return nil, err
@@ -139,36 +204,516 @@ func NewMultiwallet(opts ...Option) (Multiwallet, error) {
 
 			multiwallet[coinType] = w
 		default:
-			return nil, fmt.Errorf("a wallet implementation for %s does not exist", coinType.CurrencyCode())
+			if _, ok := fork.Lookup(coinType, network); !ok {
+				return nil, fmt.Errorf("a wallet implementation for %s does not exist", coinType.CurrencyCode())
+			}
+			clientURL := cfg.WalletAPIs[coinType].URL(network)
+			if clientURL == "" {
+				return nil, fmt.Errorf("no %s api configured for %s", network, coinType.CurrencyCode())
+			}
+			w, err := fork.NewForkWallet(&base.WalletConfig{
+				Logger:               logger,
+				DB:                   db,
+				ClientURL:            clientURL,
+				Network:              network,
+				ExchangeRateProvider: cfg.ExchangeRateProvider,
+				ChangePolicy:         cfg.ChangePolicies[coinType].Policy,
+				ChangeAddress:        cfg.ChangePolicies[coinType].Address,
+				PreventAddressReuse:  cfg.PreventAddressReuse,
+				PassphrasePolicy:     cfg.PassphrasePolicy,
+				Prune:                cfg.Prune,
+				Confirmations:        cfg.Confirmations[coinType],
+			}, coinType)
+			if err != nil {
+				return nil, err
+			}
+
+			multiwallet[coinType] = w
 		}
 	}
 
-	return multiwallet, nil
+	mw := newMultiwallet(db, logger, cfg.ExchangeRateProvider, multiwallet)
+	mw.syncer = NewSyncCoordinator(cfg.Wallets, cfg.Sync)
+	for _, p := range cfg.SwapProviders {
+		mw.swaps.AddProvider(p)
+	}
+	return mw, nil
+}
+
+func newMultiwallet(db database.Database, logger log.Logger, erp base.ExchangeRateProvider, wallets map[iwallet.CoinType]iwallet.Wallet) *Multiwallet {
+	var coins []iwallet.CoinType
+	htlcWallets := make(map[iwallet.CoinType]atomicswap.Wallet)
+	for ct, wl := range wallets {
+		coins = append(coins, ct)
+		if aw, ok := wl.(atomicswap.Wallet); ok {
+			htlcWallets[ct] = aw
+		}
+	}
+	return &Multiwallet{
+		db:      db,
+		logger:  logger,
+		erp:     erp,
+		wallets: wallets,
+		swaps:   swap.NewManager(db, logger, wallets),
+		atomic:  atomicswap.NewManager(db, logger, htlcWallets),
+		crypter: NewMultiwalletCrypter(wallets),
+		syncer:  NewSyncCoordinator(coins, SyncConfig{}),
+		done:    make(chan struct{}),
+	}
 }
 
+// Start opens every wallet and starts forwarding their notifications to
+// the multiwallet's subscribers. Each wallet must already exist. The
+// wallets sync in parallel, paced by the SyncCoordinator.
 func (w *Multiwallet) Start() error {
-	for _, wallet := range *w {
-		if err := wallet.OpenWallet(); err != nil {
-			return err
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if w.started {
+		return errors.New("multiwallet already started")
+	}
+	for ct, wl := range w.wallets {
+		if !wl.WalletExists() {
+			return fmt.Errorf("%s wallet has not been created", ct.CurrencyCode())
+		}
+	}
+	w.syncer.Start()
+	opened := make(map[iwallet.CoinType]iwallet.Wallet)
+	for ct, wl := range w.wallets {
+		if s, ok := wl.(base.Syncer); ok {
+			s.SetSyncPacer(w.syncer)
 		}
+		if err := wl.OpenWallet(); err != nil {
+			// Close the wallets already opened so Start can be
+			// called again.
+			for oct, owl := range opened {
+				w.stopWallet(context.Background(), oct, owl)
+			}
+			w.syncer.Stop()
+			return fmt.Errorf("error opening %s wallet: %s", ct.CurrencyCode(), err)
+		}
+		opened[ct] = wl
+	}
+
+	// done is recreated as Stop closes it.
+	w.done = make(chan struct{})
+	for ct, wl := range w.wallets {
+		w.forwarders.Add(1)
+		go w.forwardNotifications(ct, wl, w.done)
 	}
+	w.swaps.Start()
+	w.atomic.Start()
+	w.started = true
 	return nil
 }
 
+// Stop shuts down every wallet without closing the shared database.
+// Wallets implementing base.Lifecycle are stopped gracefully, in parallel,
+// and the others are closed. All the wallets are stopped even if one fails
+// and the first error is returned. If ctx is done before a wallet has
+// finished stopping, that wallet returns ctx.Err().
+func (w *Multiwallet) Stop(ctx context.Context) error {
+	w.mtx.Lock()
+	if !w.started {
+		w.mtx.Unlock()
+		return nil
+	}
+	close(w.done)
+	w.started = false
+	w.mtx.Unlock()
+
+	w.swaps.Stop()
+	w.atomic.Stop()
+
+	var (
+		wg       sync.WaitGroup
+		errMtx   sync.Mutex
+		firstErr error
+	)
+	for ct, wl := range w.wallets {
+		wg.Add(1)
+		go func(ct iwallet.CoinType, wl iwallet.Wallet) {
+			defer wg.Done()
+
+			if err := w.stopWallet(ctx, ct, wl); err != nil {
+				errMtx.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				errMtx.Unlock()
+			}
+		}(ct, wl)
+	}
+	wg.Wait()
+	w.forwarders.Wait()
+	w.syncer.Stop()
+	return firstErr
+}
+
+// stopWallet stops the wallet gracefully if it implements base.Lifecycle
+// and closes it otherwise. Errors are logged as well as returned.
+func (w *Multiwallet) stopWallet(ctx context.Context, ct iwallet.CoinType, wl iwallet.Wallet) error {
+	var err error
+	if lc, ok := wl.(base.Lifecycle); ok {
+		err = lc.Stop(ctx)
+	} else {
+		err = wl.CloseWallet()
+	}
+	if err != nil {
+		w.logger.Errorf("Error stopping %s wallet: %s", ct.CurrencyCode(), err)
+	}
+	return err
+}
+
+// Close stops every wallet, waiting for them to finish, and then closes
+// the shared database.
 func (w *Multiwallet) Close() error {
-	for _, wallet := range *w {
-		if err := wallet.CloseWallet(); err != nil {
-			return err
-		}
+	err := w.Stop(context.Background())
+	if cerr := w.db.Close(); cerr != nil && err == nil {
+		err = cerr
 	}
-	return nil
+	return err
+}
+
+// Backup returns an encrypted snapshot of the shared database. See
+// database.ExportBackup.
+func (w *Multiwallet) Backup(pw []byte) ([]byte, error) {
+	return database.ExportBackup(w.db, pw)
+}
+
+// Wallet returns the wallet for the coin.
+func (w *Multiwallet) Wallet(coinType iwallet.CoinType) (iwallet.Wallet, error) {
+	wl, ok := w.wallets[coinType]
+	if !ok {
+		return nil, ErrUnsuppertedCoin
+	}
+	return wl, nil
+}
+
+// CoinTypes returns the coin of each wallet sorted by currency code.
+func (w *Multiwallet) CoinTypes() []iwallet.CoinType {
+	coins := make([]iwallet.CoinType, 0, len(w.wallets))
+	for ct := range w.wallets {
+		coins = append(coins, ct)
+	}
+	sort.Slice(coins, func(i, j int) bool {
+		return coins[i].CurrencyCode() < coins[j].CurrencyCode()
+	})
+	return coins
 }
 
 func (w *Multiwallet) WalletForCurrencyCode(currencyCode string) (iwallet.Wallet, error) {
-	for cc, wl := range *w {
+	for cc, wl := range w.wallets {
 		if strings.ToUpper(cc.CurrencyCode()) == strings.ToUpper(currencyCode) || strings.ToUpper(cc.CurrencyCode()) == "T"+strings.ToUpper(currencyCode) {
 			return wl, nil
 		}
 	}
 	return nil, ErrUnsuppertedCoin
 }
+
+// historyExporter is implemented by wallets which can export their
+// transaction history.
+type historyExporter interface {
+	ExportHistory(erp base.ExchangeRateProvider) ([]base.ExportedTransaction, error)
+}
+
+// ExportHistory writes the transaction history of the given coins, or of
+// every wallet if none are given, to out in the requested format.
+// Transactions from all coins are ordered by time. Fiat values are
+// computed with erp which may be nil.
+func (w *Multiwallet) ExportHistory(out io.Writer, format base.ExportFormat, erp base.ExchangeRateProvider, coins ...iwallet.CoinType) error {
+	if len(coins) == 0 {
+		coins = w.CoinTypes()
+	}
+	var txs []base.ExportedTransaction
+	for _, ct := range coins {
+		wl, ok := w.wallets[ct]
+		if !ok {
+			return ErrUnsuppertedCoin
+		}
+		exporter, ok := wl.(historyExporter)
+		if !ok {
+			return fmt.Errorf("%s wallet does not support exporting history", ct.CurrencyCode())
+		}
+		exported, err := exporter.ExportHistory(erp)
+		if err != nil {
+			return err
+		}
+		txs = append(txs, exported...)
+	}
+	sort.SliceStable(txs, func(i, j int) bool {
+		return txs[i].Timestamp.Before(txs[j].Timestamp)
+	})
+	return base.WriteHistory(out, txs, format)
+}
+
+// rawBroadcaster is implemented by wallets which can broadcast and track
+// transactions built outside the wallet.
+type rawBroadcaster interface {
+	BroadcastRaw(raw []byte) (iwallet.TransactionID, error)
+	IngestExternalTransaction(txid iwallet.TransactionID) error
+}
+
+func (w *Multiwallet) rawBroadcaster(coinType iwallet.CoinType) (rawBroadcaster, error) {
+	wl, ok := w.wallets[coinType]
+	if !ok {
+		return nil, ErrUnsuppertedCoin
+	}
+	rb, ok := wl.(rawBroadcaster)
+	if !ok {
+		return nil, fmt.Errorf("%s wallet does not support external transactions", coinType.CurrencyCode())
+	}
+	return rb, nil
+}
+
+// BroadcastRaw broadcasts a signed transaction built outside the wallet,
+// such as one signed on another device, through the coin's broadcast
+// queue and returns its txid. If the backend can't be reached it's retried
+// like the wallet's own spends. The transaction is tracked in the history
+// if it involves the wallet.
+func (w *Multiwallet) BroadcastRaw(coinType iwallet.CoinType, raw []byte) (iwallet.TransactionID, error) {
+	rb, err := w.rawBroadcaster(coinType)
+	if err != nil {
+		return "", err
+	}
+	return rb.BroadcastRaw(raw)
+}
+
+// IngestExternalTransaction fetches a transaction broadcast outside the
+// wallet from the coin's backend and tracks it in the history. It returns
+// base.ErrNotWalletTransaction if the transaction doesn't involve the
+// wallet.
+func (w *Multiwallet) IngestExternalTransaction(coinType iwallet.CoinType, txid iwallet.TransactionID) error {
+	rb, err := w.rawBroadcaster(coinType)
+	if err != nil {
+		return err
+	}
+	return rb.IngestExternalTransaction(txid)
+}
+
+// CoinBalance is a wallet's balance breakdown and its value in USD.
+type CoinBalance struct {
+	base.Balance
+	USD base.FiatBalance
+}
+
+// balanceReporter is implemented by wallets which can break their balance
+// down by spendability.
+type balanceReporter interface {
+	Balances() (base.Balance, error)
+}
+
+// Balances returns the balance breakdown of each wallet along with the USD
+// value of all wallets combined. Wallets which can't break their balance
+// down report it as confirmed and unconfirmed only. If erp is nil the fiat
+// values are left empty.
+func (w *Multiwallet) Balances(erp base.ExchangeRateProvider) (map[iwallet.CoinType]CoinBalance, base.FiatBalance, error) {
+	var (
+		balances = make(map[iwallet.CoinType]CoinBalance)
+		total    base.FiatBalance
+	)
+	for ct, wl := range w.wallets {
+		var balance base.Balance
+		if reporter, ok := wl.(balanceReporter); ok {
+			b, err := reporter.Balances()
+			if err != nil {
+				return nil, total, err
+			}
+			balance = b
+		} else {
+			unconfirmed, confirmed, err := wl.Balance()
+			if err != nil {
+				return nil, total, err
+			}
+			balance = base.Balance{
+				Confirmed:   confirmed,
+				Unconfirmed: unconfirmed,
+				Immature:    iwallet.NewAmount(0),
+				WatchOnly:   iwallet.NewAmount(0),
+				Frozen:      iwallet.NewAmount(0),
+			}
+		}
+		cb := CoinBalance{Balance: balance}
+		if erp != nil {
+			rate, err := erp.GetUSDRate(ct)
+			if err != nil {
+				return nil, total, err
+			}
+			cb.USD = balance.USDValue(ct, rate)
+			total = total.Add(cb.USD)
+		}
+		balances[ct] = cb
+	}
+	return balances, total, nil
+}
+
+// TotalBalance returns the USD value of all the wallets combined using the
+// configured ExchangeRateProvider.
+func (w *Multiwallet) TotalBalance() (base.FiatBalance, error) {
+	if w.erp == nil {
+		return base.FiatBalance{}, errors.New("no exchange rate provider configured")
+	}
+	_, total, err := w.Balances(w.erp)
+	return total, err
+}
+
+// Transactions returns the most recent transactions of every wallet, up to
+// limit in total, sorted last to first.
+func (w *Multiwallet) Transactions(limit int) ([]CoinTransaction, error) {
+	var txs []CoinTransaction
+	for ct, wl := range w.wallets {
+		coinTxs, err := wl.Transactions(limit, "")
+		if err != nil {
+			return nil, err
+		}
+		for _, tx := range coinTxs {
+			txs = append(txs, CoinTransaction{CoinType: ct, Transaction: tx})
+		}
+	}
+	sort.SliceStable(txs, func(i, j int) bool {
+		return txs[i].Transaction.Timestamp.After(txs[j].Transaction.Timestamp)
+	})
+	if limit >= 0 && len(txs) > limit {
+		txs = txs[:limit]
+	}
+	return txs, nil
+}
+
+// History returns a query over the transaction history of every wallet.
+// See the history package for the filters.
+func (w *Multiwallet) History() *history.Query {
+	return history.NewQuery(w.db).Coins(w.CoinTypes()...)
+}
+
+// Swaps returns the manager for swaps between the wallets. Providers are
+// added with the SwapProviders option or Manager.AddProvider.
+func (w *Multiwallet) Swaps() *swap.Manager {
+	return w.swaps
+}
+
+// AtomicSwaps returns the manager for HTLC atomic swaps between the
+// wallets' UTXO coins and another party.
+func (w *Multiwallet) AtomicSwaps() *atomicswap.Manager {
+	return w.atomic
+}
+
+// Ledger returns the double-entry journal of every wallet's transactions
+// posted to the given accounts. See the ledger package for writing it out.
+func (w *Multiwallet) Ledger(accounts ledger.Accounts) ([]ledger.Entry, error) {
+	return ledger.Build(w.db, accounts, w.CoinTypes()...)
+}
+
+// Crypter returns the crypter which keeps every wallet under one
+// passphrase.
+func (w *Multiwallet) Crypter() *MultiwalletCrypter {
+	return w.crypter
+}
+
+// UnlockAll unlocks every locked wallet with the same passphrase. Wallets
+// which aren't encrypted are skipped. If any wallet fails to unlock the
+// ones already unlocked are locked again and the error is returned.
+func (w *Multiwallet) UnlockAll(pw []byte, howLong time.Duration) error {
+	return w.crypter.UnlockAll(pw, howLong)
+}
+
+// LockAll locks every wallet which is currently unlocked.
+func (w *Multiwallet) LockAll() error {
+	return w.crypter.LockAll()
+}
+
+// SubscribeTransactions returns a chan over which the transactions pushed
+// by every wallet are sent. The chan must be drained or the wallets will
+// block.
+func (w *Multiwallet) SubscribeTransactions() <-chan CoinTransaction {
+	ch := make(chan CoinTransaction)
+	w.mtx.Lock()
+	w.txSubs = append(w.txSubs, ch)
+	w.mtx.Unlock()
+	return ch
+}
+
+// SubscribeBlocks returns a chan over which the new blocks seen by every
+// wallet are sent. The chan must be drained or the wallets will block.
+func (w *Multiwallet) SubscribeBlocks() <-chan CoinBlock {
+	ch := make(chan CoinBlock)
+	w.mtx.Lock()
+	w.blockSubs = append(w.blockSubs, ch)
+	w.mtx.Unlock()
+	return ch
+}
+
+// forwardNotifications sends the wallet's transactions and blocks to the
+// multiwallet's subscribers until done is closed by Stop.
+func (w *Multiwallet) forwardNotifications(coinType iwallet.CoinType, wl iwallet.Wallet, done <-chan struct{}) {
+	defer w.forwarders.Done()
+
+	txChan := wl.SubscribeTransactions()
+	blockChan := wl.SubscribeBlocks()
+	for {
+		select {
+		case tx := <-txChan:
+			if err := w.swaps.HandleTransaction(coinType, tx); err != nil {
+				w.logger.Errorf("Error updating swaps for %s transaction %s: %s", coinType.CurrencyCode(), tx.ID, err)
+			}
+			if err := w.atomic.HandleTransaction(coinType, tx); err != nil {
+				w.logger.Errorf("Error updating atomic swaps for %s transaction %s: %s", coinType.CurrencyCode(), tx.ID, err)
+			}
+			w.mtx.Lock()
+			subs := w.txSubs
+			w.mtx.Unlock()
+			for _, sub := range subs {
+				select {
+				case sub <- CoinTransaction{CoinType: coinType, Transaction: tx}:
+				case <-done:
+					return
+				}
+			}
+		case blockInfo := <-blockChan:
+			w.mtx.Lock()
+			subs := w.blockSubs
+			w.mtx.Unlock()
+			for _, sub := range subs {
+				select {
+				case sub <- CoinBlock{CoinType: coinType, BlockInfo: blockInfo}:
+				case <-done:
+					return
+				}
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// vectorVerifier is implemented by wallets which can check their address
+// derivation against the published vectors.
+type vectorVerifier interface {
+	VerifyVectors() error
+}
+
+// VerifyVectors checks the given coins, or every wallet which publishes
+// vectors if none are given, derive the published address vectors for
+// their network. Builds should pass this before they're trusted with funds.
+func (w *Multiwallet) VerifyVectors(coins ...iwallet.CoinType) error {
+	explicit := len(coins) > 0
+	if !explicit {
+		coins = w.CoinTypes()
+	}
+	for _, ct := range coins {
+		wl, ok := w.wallets[ct]
+		if !ok {
+			return ErrUnsuppertedCoin
+		}
+		verifier, ok := wl.(vectorVerifier)
+		if !ok {
+			if explicit {
+				return fmt.Errorf("%s wallet does not publish address vectors", ct.CurrencyCode())
+			}
+			continue
+		}
+		if err := verifier.VerifyVectors(); err != nil {
+			return fmt.Errorf("%s: %s", ct.CurrencyCode(), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+package multiwallet
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/multiwallet/database"
+	"github.com/cpacia/multiwallet/database/memorydb"
+	"github.com/cpacia/multiwallet/log"
+	"github.com/cpacia/multiwallet/testutil"
+	iwallet "github.com/cpacia/wallet-interface"
+	"testing"
+	"time"
+)
+
+func newTestMultiwallet(t *testing.T, chain *testutil.Chain, create bool) (*Multiwallet, *testutil.Wallet) {
+	db, err := memorydb.NewMemoryDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.InitializeDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+	logger := log.New("multiwallet")
+	w, err := testutil.NewWallet(&base.WalletConfig{DB: db, Logger: logger}, chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if create {
+		seed := make([]byte, hdkeychain.RecommendedSeedLen)
+		if _, err := rand.Read(seed); err != nil {
+			t.Fatal(err)
+		}
+		xpriv, err := hdkeychain.NewMaster(seed, &chaincfg.RegressionNetParams)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.CreateWallet(*xpriv, nil, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mw := newMultiwallet(db, logger, nil, map[iwallet.CoinType]iwallet.Wallet{iwallet.CtMock: w})
+	return mw, w
+}
+
+func TestMultiwallet_Start(t *testing.T) {
+	mw, _ := newTestMultiwallet(t, testutil.NewChain(), false)
+	if err := mw.Start(); err == nil {
+		t.Error("Expected error starting with a wallet which hasn't been created")
+	}
+}
+
+func TestMultiwallet_Notifications(t *testing.T) {
+	chain := testutil.NewChain()
+	mw, w := newTestMultiwallet(t, chain, true)
+
+	txSub := mw.SubscribeTransactions()
+	blockSub := mw.SubscribeBlocks()
+	if err := mw.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer mw.Close()
+
+	addr, err := w.CurrentAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	funding, err := chain.Fund(addr, iwallet.NewAmount(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case tx := <-txSub:
+		if tx.CoinType != iwallet.CtMock || tx.Transaction.ID != funding.ID {
+			t.Errorf("Unexpected notification %+v", tx)
+		}
+	case <-time.After(time.Second * 10):
+		t.Fatal("timed out waiting on transaction")
+	}
+
+	chain.MineBlocks(1)
+	for {
+		select {
+		case blk := <-blockSub:
+			if blk.CoinType != iwallet.CtMock || blk.BlockInfo.Height != 1 {
+				t.Errorf("Unexpected block %+v", blk)
+			}
+		case <-txSub:
+			// The confirmation of the funding transaction.
+			continue
+		case <-time.After(time.Second * 10):
+			t.Fatal("timed out waiting on block")
+		}
+		break
+	}
+
+	if err := w.WaitForTransaction(funding.ID, 1, time.Second*10); err != nil {
+		t.Fatal(err)
+	}
+	txs, err := mw.Transactions(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txs) != 1 || txs[0].CoinType != iwallet.CtMock || txs[0].Transaction.ID != funding.ID {
+		t.Errorf("Unexpected transactions %+v", txs)
+	}
+}
+
+func TestMultiwallet_UnlockAll(t *testing.T) {
+	mw, w := newTestMultiwallet(t, testutil.NewChain(), true)
+	if err := mw.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer mw.Close()
+
+	pw := []byte("letmein")
+	if err := w.SetPassphase(pw); err != nil {
+		t.Fatal(err)
+	}
+	if !w.IsLocked() {
+		t.Fatal("Expected wallet to be locked")
+	}
+	if err := mw.UnlockAll([]byte("wrong"), time.Minute); err == nil {
+		t.Error("Expected error unlocking with the wrong passphrase")
+	}
+	if err := mw.UnlockAll(pw, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if w.IsLocked() {
+		t.Error("Expected wallet to be unlocked")
+	}
+	if err := mw.LockAll(); err != nil {
+		t.Fatal(err)
+	}
+	if !w.IsLocked() {
+		t.Error("Expected wallet to be locked")
+	}
+}
+
+func TestMultiwallet_Stop(t *testing.T) {
+	mw, w := newTestMultiwallet(t, testutil.NewChain(), true)
+	txSub := mw.SubscribeTransactions()
+	if err := mw.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	if err := mw.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Begin(); err != base.ErrWalletClosed {
+		t.Errorf("Expected wallet closed, got %v", err)
+	}
+	select {
+	case tx := <-txSub:
+		t.Errorf("Unexpected transaction after stop %+v", tx)
+	default:
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// lifecycleWallet counts the times it's opened and closed. OpenWallet
+// fails if fail is set.
+type lifecycleWallet struct {
+	iwallet.Wallet
+	fail   bool
+	opened int
+	closed int
+}
+
+func (w *lifecycleWallet) WalletExists() bool { return true }
+
+func (w *lifecycleWallet) OpenWallet() error {
+	if w.fail {
+		return errors.New("open failed")
+	}
+	w.opened++
+	return nil
+}
+
+func (w *lifecycleWallet) CloseWallet() error {
+	w.closed++
+	return nil
+}
+
+func (w *lifecycleWallet) SubscribeTransactions() <-chan iwallet.Transaction {
+	return make(chan iwallet.Transaction)
+}
+
+func (w *lifecycleWallet) SubscribeBlocks() <-chan iwallet.BlockInfo {
+	return make(chan iwallet.BlockInfo)
+}
+
+func TestMultiwallet_StartFailure(t *testing.T) {
+	db, err := memorydb.NewMemoryDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.InitializeDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+	good := &lifecycleWallet{}
+	bad := &lifecycleWallet{fail: true}
+	mw := newMultiwallet(db, log.New("multiwallet"), nil, map[iwallet.CoinType]iwallet.Wallet{
+		iwallet.CtMock:    good,
+		iwallet.CtBitcoin: bad,
+	})
+
+	// Whichever order the wallets are opened in, the good one is closed
+	// again.
+	if err := mw.Start(); err == nil {
+		t.Fatal("Expected error starting with a wallet which fails to open")
+	}
+	if good.opened != good.closed {
+		t.Errorf("Expected the opened wallet to be closed, opened %d closed %d", good.opened, good.closed)
+	}
+
+	bad.fail = false
+	if err := mw.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mw.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMultiwallet_Restart(t *testing.T) {
+	db, err := memorydb.NewMemoryDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.InitializeDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+	wl := &lifecycleWallet{}
+	mw := newMultiwallet(db, log.New("multiwallet"), nil, map[iwallet.CoinType]iwallet.Wallet{iwallet.CtMock: wl})
+
+	for i := 0; i < 2; i++ {
+		if err := mw.Start(); err != nil {
+			t.Fatal(err)
+		}
+		if err := mw.Stop(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if wl.opened != 2 || wl.closed != 2 {
+		t.Errorf("Expected 2 opens and closes, got %d and %d", wl.opened, wl.closed)
+	}
+}
@@ -0,0 +1,72 @@
+package swap
+
+import (
+	iwallet "github.com/cpacia/wallet-interface"
+	"time"
+)
+
+// Quote is a provider's offer to exchange Amount of From for
+// ExpectedAmount of To. ID is the provider's reference for the quote, if
+// it has one, and Expires is zero if the quote doesn't expire.
+type Quote struct {
+	Provider       string
+	ID             string
+	From           iwallet.CoinType
+	To             iwallet.CoinType
+	Amount         iwallet.Amount
+	ExpectedAmount iwallet.Amount
+	Expires        time.Time
+}
+
+// Order is an exchange created from a quote. The provider pays out once
+// the quoted amount is sent to DepositAddress.
+type Order struct {
+	ID             string
+	DepositAddress iwallet.Address
+	ExpectedAmount iwallet.Amount
+}
+
+// OrderState is the progress of an order as reported by its provider.
+type OrderState int
+
+const (
+	// OrderWaiting orders haven't received the deposit yet.
+	OrderWaiting OrderState = iota
+
+	// OrderExchanging orders have received the deposit and are being
+	// exchanged.
+	OrderExchanging
+
+	// OrderPaid orders have sent the payout.
+	OrderPaid
+
+	// OrderFailed orders won't pay out. The deposit, if any, is refunded
+	// to the refund address.
+	OrderFailed
+)
+
+// OrderStatus is the state of an order. PayoutTxid is set once the order
+// is paid and Reason if it failed.
+type OrderStatus struct {
+	State      OrderState
+	PayoutTxid iwallet.TransactionID
+	Reason     string
+}
+
+// Provider is an exchange which converts one coin into another, such as a
+// ChangeNOW or SideShift style API, or an atomic swap counterparty.
+type Provider interface {
+	// Name identifies the provider in swaps and quotes.
+	Name() string
+
+	// Quote returns the provider's offer to exchange amount of from
+	// for to.
+	Quote(from, to iwallet.CoinType, amount iwallet.Amount) (Quote, error)
+
+	// CreateOrder creates an order for the quote paying out to payout.
+	// If the order fails the deposit is returned to refund.
+	CreateOrder(quote Quote, payout, refund iwallet.Address) (Order, error)
+
+	// OrderStatus returns the state of the order with the given ID.
+	OrderStatus(orderID string) (OrderStatus, error)
+}
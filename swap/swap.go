@@ -0,0 +1,466 @@
+// Package swap moves value from one coin wallet to another through an
+// exchange. A swap sends coins from the source wallet to a provider's
+// deposit address and is complete once the provider's payout reaches a
+// fresh address of the destination wallet. The state of each swap is kept
+// in the database so it survives restarts and is shown in the history.
+package swap
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/multiwallet/database"
+	"github.com/cpacia/multiwallet/log"
+	iwallet "github.com/cpacia/wallet-interface"
+	"gorm.io/gorm"
+	"sort"
+	"sync"
+	"time"
+)
+
+// pollInterval is how often the Manager asks providers for the status of
+// swaps in progress.
+const pollInterval = time.Second * 30
+
+var (
+	// ErrUnknownProvider is returned for a provider which hasn't been
+	// added to the Manager.
+	ErrUnknownProvider = errors.New("unknown swap provider")
+
+	// ErrUnknownWallet is returned for a coin the Manager has no wallet
+	// for.
+	ErrUnknownWallet = errors.New("no wallet for swap coin")
+
+	// ErrQuoteExpired is returned by Execute for a quote past its
+	// expiry.
+	ErrQuoteExpired = errors.New("swap quote has expired")
+
+	// ErrSwapNotFound is returned for an unknown swap ID.
+	ErrSwapNotFound = errors.New("swap not found")
+)
+
+// State is the progress of a swap.
+type State string
+
+const (
+	// StateCreated swaps have an order but the deposit hasn't been
+	// sent.
+	StateCreated State = "created"
+
+	// StateSent swaps have sent the deposit to the provider.
+	StateSent State = "sent"
+
+	// StateExchanging swaps have had their deposit received by the
+	// provider.
+	StateExchanging State = "exchanging"
+
+	// StateReceived swaps have had the payout seen by the destination
+	// wallet.
+	StateReceived State = "received"
+
+	// StateFailed swaps won't complete. Error is set to the reason.
+	StateFailed State = "failed"
+)
+
+// pending returns whether swaps in the state are waiting on the provider.
+func (s State) pending() bool {
+	return s == StateSent || s == StateExchanging
+}
+
+// Swap is an exchange of one coin for another.
+type Swap struct {
+	ID             string
+	Provider       string
+	OrderID        string
+	From           iwallet.CoinType
+	To             iwallet.CoinType
+	State          State
+	Amount         iwallet.Amount
+	ExpectedAmount iwallet.Amount
+	ReceivedAmount iwallet.Amount
+	DepositAddress iwallet.Address
+	PayoutAddress  iwallet.Address
+	RefundAddress  iwallet.Address
+	DepositTxid    iwallet.TransactionID
+	PayoutTxid     iwallet.TransactionID
+	Error          string
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+// UpdatedEvent is emitted each time a swap changes state.
+type UpdatedEvent struct {
+	Swap Swap
+}
+
+// Manager executes swaps between its wallets and follows them through to
+// completion. Swaps move to exchanging and failed as reported by their
+// provider and to received when the destination wallet sees the payout,
+// which HandleTransaction must be called with.
+//
+// Events are emitted on Bus as *UpdatedEvent.
+type Manager struct {
+	Bus base.Bus
+
+	db      database.Database
+	wallets map[iwallet.CoinType]iwallet.Wallet
+	logger  log.Logger
+
+	shutdownMtx sync.Mutex
+	shutdown    chan struct{}
+
+	mtx       sync.RWMutex
+	providers map[string]Provider
+}
+
+// NewManager returns a new Manager swapping between the wallets.
+func NewManager(db database.Database, logger log.Logger, wallets map[iwallet.CoinType]iwallet.Wallet) *Manager {
+	if logger == nil {
+		logger = log.New("swap")
+	}
+	return &Manager{
+		Bus:       base.NewBus(),
+		db:        db,
+		wallets:   wallets,
+		logger:    logger.Module("swap"),
+		shutdown:  make(chan struct{}),
+		providers: make(map[string]Provider),
+	}
+}
+
+// AddProvider makes the provider available for quotes and swaps,
+// replacing any provider with the same name.
+func (m *Manager) AddProvider(p Provider) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.providers[p.Name()] = p
+}
+
+func (m *Manager) provider(name string) (Provider, error) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	p, ok := m.providers[name]
+	if !ok {
+		return nil, ErrUnknownProvider
+	}
+	return p, nil
+}
+
+// Start polls the providers of swaps in progress in the background until
+// Stop is called. The Manager can be started again once it's stopped.
+func (m *Manager) Start() {
+	m.shutdownMtx.Lock()
+	shutdown := m.shutdown
+	m.shutdownMtx.Unlock()
+
+	go m.pollLoop(shutdown)
+}
+
+func (m *Manager) pollLoop(shutdown <-chan struct{}) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := m.Poll(); err != nil {
+				m.logger.Errorf("Error polling swap providers: %s", err)
+			}
+		case <-shutdown:
+			return
+		}
+	}
+}
+
+// Stop will shutdown the Manager.
+func (m *Manager) Stop() {
+	m.shutdownMtx.Lock()
+	defer m.shutdownMtx.Unlock()
+
+	close(m.shutdown)
+	m.shutdown = make(chan struct{})
+}
+
+// Quote asks the provider for the amount of to it will pay for amount of
+// from.
+func (m *Manager) Quote(provider string, from, to iwallet.CoinType, amount iwallet.Amount) (Quote, error) {
+	if from == to {
+		return Quote{}, errors.New("can't swap a coin for itself")
+	}
+	if m.wallets[from] == nil || m.wallets[to] == nil {
+		return Quote{}, ErrUnknownWallet
+	}
+	p, err := m.provider(provider)
+	if err != nil {
+		return Quote{}, err
+	}
+	return p.Quote(from, to, amount)
+}
+
+// Execute creates an order for the quote and sends the deposit from the
+// source wallet. The payout goes to a new address of the destination
+// wallet and refunds to the source wallet's current address. If the
+// deposit can't be sent the swap is saved as failed and the error is
+// returned.
+func (m *Manager) Execute(quote Quote, feeLevel iwallet.FeeLevel) (Swap, error) {
+	if !quote.Expires.IsZero() && time.Now().After(quote.Expires) {
+		return Swap{}, ErrQuoteExpired
+	}
+	p, err := m.provider(quote.Provider)
+	if err != nil {
+		return Swap{}, err
+	}
+	from, to := m.wallets[quote.From], m.wallets[quote.To]
+	if from == nil || to == nil {
+		return Swap{}, ErrUnknownWallet
+	}
+
+	payout, err := to.NewAddress()
+	if err != nil {
+		return Swap{}, err
+	}
+	refund, err := from.CurrentAddress()
+	if err != nil {
+		return Swap{}, err
+	}
+	order, err := p.CreateOrder(quote, payout, refund)
+	if err != nil {
+		return Swap{}, err
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return Swap{}, err
+	}
+	now := time.Now()
+	record := &database.SwapRecord{
+		ID:             hex.EncodeToString(id),
+		Provider:       p.Name(),
+		OrderID:        order.ID,
+		FromCoin:       quote.From.CurrencyCode(),
+		ToCoin:         quote.To.CurrencyCode(),
+		State:          string(StateCreated),
+		Amount:         quote.Amount.String(),
+		ExpectedAmount: order.ExpectedAmount.String(),
+		ReceivedAmount: "0",
+		DepositAddr:    order.DepositAddress.String(),
+		PayoutAddr:     payout.String(),
+		RefundAddr:     refund.String(),
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	}
+	// The order is saved before the deposit is sent so a crash in
+	// between leaves a record of it.
+	if err := m.save(record); err != nil {
+		return Swap{}, err
+	}
+
+	txid, err := m.sendDeposit(from, order.DepositAddress, quote.Amount, feeLevel)
+	if err != nil {
+		record.State, record.Error = string(StateFailed), err.Error()
+		if serr := m.save(record); serr != nil {
+			m.logger.Errorf("Error saving failed swap %s: %s", record.ID, serr)
+		}
+		return swapFromRecord(record), err
+	}
+	record.State, record.DepositTxid = string(StateSent), txid.String()
+	if err := m.save(record); err != nil {
+		return Swap{}, err
+	}
+	return swapFromRecord(record), nil
+}
+
+func (m *Manager) sendDeposit(wallet iwallet.Wallet, to iwallet.Address, amount iwallet.Amount, feeLevel iwallet.FeeLevel) (iwallet.TransactionID, error) {
+	wtx, err := wallet.Begin()
+	if err != nil {
+		return "", err
+	}
+	txid, err := wallet.Spend(wtx, to, amount, feeLevel)
+	if err != nil {
+		wtx.Rollback()
+		return "", err
+	}
+	if err := wtx.Commit(); err != nil {
+		return "", err
+	}
+	return txid, nil
+}
+
+// Poll asks the providers for the status of each swap in progress and
+// updates them. Swaps whose provider has been removed are left as they
+// are.
+func (m *Manager) Poll() error {
+	records, err := m.records()
+	if err != nil {
+		return err
+	}
+	for i := range records {
+		record := &records[i]
+		if !State(record.State).pending() {
+			continue
+		}
+		p, err := m.provider(record.Provider)
+		if err != nil {
+			continue
+		}
+		status, err := p.OrderStatus(record.OrderID)
+		if err != nil {
+			m.logger.Warningf("Error fetching status of swap %s from %s: %s", record.ID, record.Provider, err)
+			continue
+		}
+		changed := false
+		switch status.State {
+		case OrderExchanging, OrderPaid:
+			if record.State == string(StateSent) {
+				record.State, changed = string(StateExchanging), true
+			}
+			if status.PayoutTxid != "" && record.PayoutTxid == "" {
+				record.PayoutTxid, changed = status.PayoutTxid.String(), true
+			}
+		case OrderFailed:
+			record.State, record.Error, changed = string(StateFailed), status.Reason, true
+		}
+		if changed {
+			if err := m.save(record); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// HandleTransaction completes the swaps whose payout address the
+// transaction pays. It should be called with each transaction pushed by
+// the wallets.
+func (m *Manager) HandleTransaction(coinType iwallet.CoinType, tx iwallet.Transaction) error {
+	records, err := m.records()
+	if err != nil {
+		return err
+	}
+	for i := range records {
+		record := &records[i]
+		if record.ToCoin != coinType.CurrencyCode() || !State(record.State).pending() {
+			continue
+		}
+		received := iwallet.NewAmount(0)
+		for _, to := range tx.To {
+			if to.Address.String() == record.PayoutAddr {
+				received = received.Add(to.Amount)
+			}
+		}
+		if received.Cmp(iwallet.NewAmount(0)) == 0 {
+			continue
+		}
+		record.State = string(StateReceived)
+		record.PayoutTxid = tx.ID.String()
+		record.ReceivedAmount = received.String()
+		if err := m.save(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get returns the swap with the given ID.
+func (m *Manager) Get(id string) (Swap, error) {
+	var record database.SwapRecord
+	err := m.db.View(func(dbtx database.Tx) error {
+		return dbtx.Read().Where("id=?", id).First(&record).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return Swap{}, ErrSwapNotFound
+	} else if err != nil {
+		return Swap{}, err
+	}
+	return swapFromRecord(&record), nil
+}
+
+// List returns every swap, newest first.
+func (m *Manager) List() ([]Swap, error) {
+	records, err := m.records()
+	if err != nil {
+		return nil, err
+	}
+	swaps := make([]Swap, 0, len(records))
+	for i := range records {
+		swaps = append(swaps, swapFromRecord(&records[i]))
+	}
+	sort.Slice(swaps, func(i, j int) bool {
+		return swaps[i].CreatedAt.After(swaps[j].CreatedAt)
+	})
+	return swaps, nil
+}
+
+func (m *Manager) records() ([]database.SwapRecord, error) {
+	var records []database.SwapRecord
+	err := m.db.View(func(dbtx database.Tx) error {
+		return dbtx.Read().Find(&records).Error
+	})
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	return records, nil
+}
+
+// save saves the record and emits an UpdatedEvent for it.
+func (m *Manager) save(record *database.SwapRecord) error {
+	record.UpdatedAt = time.Now()
+	err := m.db.Update(func(dbtx database.Tx) error {
+		return dbtx.Save(record)
+	})
+	if err != nil {
+		return err
+	}
+	m.logger.Infof("Swap %s of %s to %s is %s", record.ID, record.FromCoin, record.ToCoin, record.State)
+	m.Bus.Emit(&UpdatedEvent{Swap: swapFromRecord(record)})
+	return nil
+}
+
+// Transactions returns the swaps whose deposit or payout is each
+// transaction, keyed by the coin's currency code and the txid joined with
+// a colon.
+func Transactions(dbtx database.Tx) (map[string]Swap, error) {
+	var records []database.SwapRecord
+	err := dbtx.Read().Find(&records).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	swaps := make(map[string]Swap)
+	for i := range records {
+		s := swapFromRecord(&records[i])
+		if s.DepositTxid != "" {
+			swaps[fmt.Sprintf("%s:%s", records[i].FromCoin, s.DepositTxid)] = s
+		}
+		if s.PayoutTxid != "" {
+			swaps[fmt.Sprintf("%s:%s", records[i].ToCoin, s.PayoutTxid)] = s
+		}
+	}
+	return swaps, nil
+}
+
+func swapFromRecord(record *database.SwapRecord) Swap {
+	from, to := iwallet.CoinType(record.FromCoin), iwallet.CoinType(record.ToCoin)
+	return Swap{
+		ID:             record.ID,
+		Provider:       record.Provider,
+		OrderID:        record.OrderID,
+		From:           from,
+		To:             to,
+		State:          State(record.State),
+		Amount:         iwallet.NewAmount(record.Amount),
+		ExpectedAmount: iwallet.NewAmount(record.ExpectedAmount),
+		ReceivedAmount: iwallet.NewAmount(record.ReceivedAmount),
+		DepositAddress: iwallet.NewAddress(record.DepositAddr, from),
+		PayoutAddress:  iwallet.NewAddress(record.PayoutAddr, to),
+		RefundAddress:  iwallet.NewAddress(record.RefundAddr, from),
+		DepositTxid:    iwallet.TransactionID(record.DepositTxid),
+		PayoutTxid:     iwallet.TransactionID(record.PayoutTxid),
+		Error:          record.Error,
+		CreatedAt:      record.CreatedAt,
+		UpdatedAt:      record.UpdatedAt,
+	}
+}
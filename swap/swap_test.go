@@ -0,0 +1,162 @@
+package swap
+
+import (
+	"errors"
+	"github.com/cpacia/multiwallet/testutil"
+	iwallet "github.com/cpacia/wallet-interface"
+	"testing"
+	"time"
+)
+
+const depositAddr = "0101010101010101010101010101010101010101"
+
+type mockProvider struct {
+	status OrderStatus
+	payout iwallet.Address
+}
+
+func (p *mockProvider) Name() string { return "mock" }
+
+func (p *mockProvider) Quote(from, to iwallet.CoinType, amount iwallet.Amount) (Quote, error) {
+	return Quote{
+		Provider:       p.Name(),
+		ID:             "quote",
+		From:           from,
+		To:             to,
+		Amount:         amount,
+		ExpectedAmount: amount.Mul(iwallet.NewAmount(2)),
+	}, nil
+}
+
+func (p *mockProvider) CreateOrder(quote Quote, payout, refund iwallet.Address) (Order, error) {
+	p.payout = payout
+	return Order{
+		ID:             "order",
+		DepositAddress: iwallet.NewAddress(depositAddr, quote.From),
+		ExpectedAmount: quote.ExpectedAmount,
+	}, nil
+}
+
+func (p *mockProvider) OrderStatus(orderID string) (OrderStatus, error) {
+	if orderID != "order" {
+		return OrderStatus{}, errors.New("unknown order")
+	}
+	return p.status, nil
+}
+
+func TestManager(t *testing.T) {
+	chain := testutil.NewChain()
+	w, err := testutil.NewTestWallet(chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.CloseWallet()
+
+	addr, err := w.CurrentAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chain.Fund(addr, iwallet.NewAmount(100000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WaitForBalance(iwallet.NewAmount(100000), iwallet.NewAmount(0), time.Second*10); err != nil {
+		t.Fatal(err)
+	}
+
+	// The mock wallet stands in for both coins.
+	m := NewManager(w.DB, nil, map[iwallet.CoinType]iwallet.Wallet{
+		iwallet.CtMock:    w,
+		iwallet.CtBitcoin: w,
+	})
+	if _, err := m.Quote("mock", iwallet.CtMock, iwallet.CtBitcoin, iwallet.NewAmount(40000)); err != ErrUnknownProvider {
+		t.Errorf("Expected ErrUnknownProvider, got %v", err)
+	}
+
+	p := &mockProvider{}
+	m.AddProvider(p)
+	if _, err := m.Quote("mock", iwallet.CtMock, iwallet.CtLitecoin, iwallet.NewAmount(40000)); err != ErrUnknownWallet {
+		t.Errorf("Expected ErrUnknownWallet, got %v", err)
+	}
+	quote, err := m.Quote("mock", iwallet.CtMock, iwallet.CtBitcoin, iwallet.NewAmount(40000))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expired := quote
+	expired.Expires = time.Now().Add(-time.Minute)
+	if _, err := m.Execute(expired, iwallet.FlNormal); err != ErrQuoteExpired {
+		t.Errorf("Expected ErrQuoteExpired, got %v", err)
+	}
+
+	s, err := m.Execute(quote, iwallet.FlNormal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.State != StateSent || s.DepositTxid == "" || s.PayoutAddress.String() != p.payout.String() {
+		t.Errorf("Unexpected swap %+v", s)
+	}
+	if err := w.WaitForTransaction(s.DepositTxid, 0, time.Second*10); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing changes while the provider waits for the deposit.
+	if err := m.Poll(); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = m.Get(s.ID); err != nil || s.State != StateSent {
+		t.Errorf("Expected sent, got %s, %v", s.State, err)
+	}
+
+	p.status = OrderStatus{State: OrderExchanging}
+	if err := m.Poll(); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = m.Get(s.ID); err != nil || s.State != StateExchanging {
+		t.Errorf("Expected exchanging, got %s, %v", s.State, err)
+	}
+
+	// Transactions for the other coin don't complete the swap.
+	payout := iwallet.Transaction{
+		ID: "payout",
+		To: []iwallet.SpendInfo{{Address: p.payout, Amount: iwallet.NewAmount(79000)}},
+	}
+	if err := m.HandleTransaction(iwallet.CtMock, payout); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = m.Get(s.ID); err != nil || s.State != StateExchanging {
+		t.Errorf("Expected exchanging, got %s, %v", s.State, err)
+	}
+	if err := m.HandleTransaction(iwallet.CtBitcoin, payout); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = m.Get(s.ID); err != nil || s.State != StateReceived {
+		t.Errorf("Expected received, got %s, %v", s.State, err)
+	}
+	if s.PayoutTxid != "payout" || s.ReceivedAmount.Cmp(iwallet.NewAmount(79000)) != 0 {
+		t.Errorf("Unexpected payout %s of %s", s.PayoutTxid, s.ReceivedAmount)
+	}
+
+	// A failed order is recorded with the provider's reason.
+	s2, err := m.Execute(quote, iwallet.FlNormal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.status = OrderStatus{State: OrderFailed, Reason: "deposit too small"}
+	if err := m.Poll(); err != nil {
+		t.Fatal(err)
+	}
+	if s2, err = m.Get(s2.ID); err != nil || s2.State != StateFailed || s2.Error != "deposit too small" {
+		t.Errorf("Expected failed swap, got %+v, %v", s2, err)
+	}
+
+	swaps, err := m.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(swaps) != 2 || swaps[0].ID != s2.ID {
+		t.Errorf("Expected 2 swaps newest first, got %+v", swaps)
+	}
+	if _, err := m.Get("unknown"); err != ErrSwapNotFound {
+		t.Errorf("Expected ErrSwapNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,285 @@
+package multiwallet
+
+import (
+	"github.com/cpacia/multiwallet/base"
+	iwallet "github.com/cpacia/wallet-interface"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SyncConfig configures how the wallets' chain syncs share resources.
+type SyncConfig struct {
+	// RequestsPerSecond is how many chain client requests the wallets
+	// may make between them while syncing. Zero is unlimited.
+	RequestsPerSecond float64
+
+	// Burst is how many requests may be made at once after the wallets
+	// have been idle. It's at least one.
+	Burst int
+
+	// Stagger is the delay between one wallet starting to sync and the
+	// next.
+	Stagger time.Duration
+
+	// ActiveCoin is the coin whose sync goes first. See
+	// SyncCoordinator.SetActive.
+	ActiveCoin iwallet.CoinType
+}
+
+// SyncCoordinator is the base.SyncPacer shared by the multiwallet's
+// wallets. Each coin syncs in its own goroutine but they start one after
+// the other, Stagger apart, and draw their chain client requests from one
+// token bucket. The active coin starts first and its requests are served
+// before the others', which take turns.
+type SyncCoordinator struct {
+	coins    []iwallet.CoinType
+	interval time.Duration
+	burst    int
+	stagger  time.Duration
+
+	mtx     sync.Mutex
+	active  iwallet.CoinType
+	started time.Time
+	changed chan struct{}
+	tokens  float64
+	refill  time.Time
+	waiting map[iwallet.CoinType][]chan struct{}
+	last    int
+	timer   *time.Timer
+}
+
+// NewSyncCoordinator returns a SyncCoordinator for the coins.
+func NewSyncCoordinator(coins []iwallet.CoinType, cfg SyncConfig) *SyncCoordinator {
+	c := &SyncCoordinator{
+		coins:   append([]iwallet.CoinType(nil), coins...),
+		burst:   cfg.Burst,
+		stagger: cfg.Stagger,
+		active:  cfg.ActiveCoin,
+		started: time.Now(),
+		changed: make(chan struct{}),
+		waiting: make(map[iwallet.CoinType][]chan struct{}),
+		last:    -1,
+	}
+	sort.Slice(c.coins, func(i, j int) bool {
+		return c.coins[i].CurrencyCode() < c.coins[j].CurrencyCode()
+	})
+	if cfg.RequestsPerSecond > 0 {
+		c.interval = time.Duration(float64(time.Second) / cfg.RequestsPerSecond)
+	}
+	if c.burst < 1 {
+		c.burst = 1
+	}
+	c.tokens = float64(c.burst)
+	c.refill = time.Now()
+	return c
+}
+
+// Start restarts the staggering of the syncs from now. It's called as the
+// wallets are opened.
+func (c *SyncCoordinator) Start() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.started = time.Now()
+}
+
+// Stop cancels the timer for the next token. Requests still waiting are
+// cancelled by their done channels.
+func (c *SyncCoordinator) Stop() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+}
+
+// SetActive makes the coin's sync go first. If it hasn't started it does
+// so straight away and its requests are served before any other coin's.
+func (c *SyncCoordinator) SetActive(coinType iwallet.CoinType) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.active = coinType
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// Active returns the active coin.
+func (c *SyncCoordinator) Active() iwallet.CoinType {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.active
+}
+
+// Begin blocks until it's the coin's turn to start syncing. The active coin
+// goes first and the others follow in currency code order.
+func (c *SyncCoordinator) Begin(coinType iwallet.CoinType, done <-chan struct{}) bool {
+	for {
+		c.mtx.Lock()
+		wait := time.Until(c.started.Add(time.Duration(c.position(coinType)) * c.stagger))
+		changed := c.changed
+		c.mtx.Unlock()
+
+		if wait <= 0 {
+			return true
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+			return true
+		case <-changed:
+			timer.Stop()
+		case <-done:
+			timer.Stop()
+			return false
+		}
+	}
+}
+
+// position returns the coin's place in the order the syncs start.
+func (c *SyncCoordinator) position(coinType iwallet.CoinType) int {
+	if coinType == c.active {
+		return 0
+	}
+	pos := 0
+	for _, ct := range c.coins {
+		if ct == coinType {
+			break
+		}
+		if ct != c.active {
+			pos++
+		}
+	}
+	if c.isCoin(c.active) {
+		pos++
+	}
+	return pos
+}
+
+func (c *SyncCoordinator) isCoin(coinType iwallet.CoinType) bool {
+	for _, ct := range c.coins {
+		if ct == coinType {
+			return true
+		}
+	}
+	return false
+}
+
+// Request blocks until the coin may make its next chain client request.
+func (c *SyncCoordinator) Request(coinType iwallet.CoinType, done <-chan struct{}) bool {
+	if c.interval == 0 {
+		return true
+	}
+	ready := make(chan struct{})
+
+	c.mtx.Lock()
+	c.waiting[coinType] = append(c.waiting[coinType], ready)
+	c.dispatch()
+	c.mtx.Unlock()
+
+	select {
+	case <-ready:
+		return true
+	case <-done:
+	}
+
+	// The request may have been granted as done was closed, in which
+	// case the token is simply spent.
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	queue := c.waiting[coinType]
+	for i, ch := range queue {
+		if ch == ready {
+			c.waiting[coinType] = append(queue[:i:i], queue[i+1:]...)
+			break
+		}
+	}
+	return false
+}
+
+// dispatch grants waiting requests the tokens available and, if any are
+// left waiting, sets a timer for when the next token is due. It must be
+// called with the mutex held.
+func (c *SyncCoordinator) dispatch() {
+	now := time.Now()
+	c.tokens += float64(now.Sub(c.refill)) / float64(c.interval)
+	if c.tokens > float64(c.burst) {
+		c.tokens = float64(c.burst)
+	}
+	c.refill = now
+
+	for c.tokens >= 1 {
+		coinType, ok := c.next()
+		if !ok {
+			return
+		}
+		queue := c.waiting[coinType]
+		close(queue[0])
+		c.waiting[coinType] = queue[1:]
+		c.tokens--
+	}
+
+	if c.timer == nil && c.pending() {
+		wait := time.Duration((1 - c.tokens) * float64(c.interval))
+		c.timer = time.AfterFunc(wait, func() {
+			c.mtx.Lock()
+			defer c.mtx.Unlock()
+
+			c.timer = nil
+			c.dispatch()
+		})
+	}
+}
+
+// next returns the coin whose request is served next. The active coin's
+// are served first and then each coin takes a turn.
+func (c *SyncCoordinator) next() (iwallet.CoinType, bool) {
+	if len(c.waiting[c.active]) > 0 {
+		return c.active, true
+	}
+	for i := 1; i <= len(c.coins); i++ {
+		idx := (c.last + i) % len(c.coins)
+		if len(c.waiting[c.coins[idx]]) > 0 {
+			c.last = idx
+			return c.coins[idx], true
+		}
+	}
+	// Coins which weren't given to the coordinator are served last.
+	for ct, queue := range c.waiting {
+		if len(queue) > 0 {
+			return ct, true
+		}
+	}
+	return "", false
+}
+
+func (c *SyncCoordinator) pending() bool {
+	for _, queue := range c.waiting {
+		if len(queue) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// SyncStatus returns the state of each wallet's chain sync.
+func (w *Multiwallet) SyncStatus() map[iwallet.CoinType]base.SyncStatus {
+	statuses := make(map[iwallet.CoinType]base.SyncStatus)
+	for ct, wl := range w.wallets {
+		if s, ok := wl.(base.Syncer); ok {
+			statuses[ct] = s.SyncStatus()
+		}
+	}
+	return statuses
+}
+
+// SetActiveCoin makes the coin's sync go first. It's typically the coin the
+// user is looking at.
+func (w *Multiwallet) SetActiveCoin(coinType iwallet.CoinType) {
+	w.syncer.SetActive(coinType)
+}
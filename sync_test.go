@@ -0,0 +1,171 @@
+package multiwallet
+
+import (
+	"github.com/cpacia/multiwallet/testutil"
+	iwallet "github.com/cpacia/wallet-interface"
+	"testing"
+	"time"
+)
+
+func TestSyncCoordinator_Begin(t *testing.T) {
+	c := NewSyncCoordinator([]iwallet.CoinType{iwallet.CtZCash, iwallet.CtBitcoin, iwallet.CtLitecoin}, SyncConfig{
+		Stagger:    time.Millisecond * 200,
+		ActiveCoin: iwallet.CtLitecoin,
+	})
+	done := make(chan struct{})
+
+	began := make(chan iwallet.CoinType, 3)
+	for _, ct := range []iwallet.CoinType{iwallet.CtZCash, iwallet.CtBitcoin, iwallet.CtLitecoin} {
+		go func(ct iwallet.CoinType) {
+			if c.Begin(ct, done) {
+				began <- ct
+			}
+		}(ct)
+	}
+	for _, expected := range []iwallet.CoinType{iwallet.CtLitecoin, iwallet.CtBitcoin, iwallet.CtZCash} {
+		select {
+		case ct := <-began:
+			if ct != expected {
+				t.Errorf("Expected %s to begin, got %s", expected, ct)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("timed out waiting on sync to begin")
+		}
+	}
+
+	// Making a waiting coin active starts it straight away.
+	c.Start()
+	result := make(chan bool)
+	go func() {
+		result <- c.Begin(iwallet.CtZCash, done)
+	}()
+	time.Sleep(time.Millisecond * 50)
+	c.SetActive(iwallet.CtZCash)
+	select {
+	case ok := <-result:
+		if !ok {
+			t.Error("Expected the active coin to begin")
+		}
+	case <-time.After(time.Millisecond * 100):
+		t.Fatal("Expected the active coin to begin straight away")
+	}
+
+	c.Start()
+	go func() {
+		result <- c.Begin(iwallet.CtBitcoin, done)
+	}()
+	close(done)
+	if <-result {
+		t.Error("Expected Begin to return false once done is closed")
+	}
+}
+
+func TestSyncCoordinator_Request(t *testing.T) {
+	c := NewSyncCoordinator([]iwallet.CoinType{iwallet.CtBitcoin, iwallet.CtLitecoin, iwallet.CtZCash}, SyncConfig{
+		RequestsPerSecond: 20,
+		Burst:             1,
+		ActiveCoin:        iwallet.CtZCash,
+	})
+	done := make(chan struct{})
+
+	// The burst is spent straight away.
+	if !c.Request(iwallet.CtBitcoin, done) {
+		t.Fatal("Expected the first request to be granted")
+	}
+
+	served := make(chan iwallet.CoinType, 6)
+	request := func(ct iwallet.CoinType) {
+		if c.Request(ct, done) {
+			served <- ct
+		}
+	}
+	for _, ct := range []iwallet.CoinType{iwallet.CtBitcoin, iwallet.CtBitcoin, iwallet.CtLitecoin, iwallet.CtLitecoin} {
+		go request(ct)
+	}
+	time.Sleep(time.Millisecond * 10)
+	go request(iwallet.CtZCash)
+	time.Sleep(time.Millisecond * 10)
+
+	var order []iwallet.CoinType
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		select {
+		case ct := <-served:
+			order = append(order, ct)
+		case <-time.After(time.Second * 5):
+			t.Fatal("timed out waiting on request")
+		}
+	}
+	if elapsed := time.Since(start); elapsed < time.Millisecond*150 {
+		t.Errorf("Expected requests to be paced, took %s", elapsed)
+	}
+	if order[0] != iwallet.CtZCash {
+		t.Errorf("Expected the active coin to be served first, got %v", order)
+	}
+	counts := make(map[iwallet.CoinType]int)
+	for _, ct := range order[1:3] {
+		counts[ct]++
+	}
+	if counts[iwallet.CtBitcoin] != 1 || counts[iwallet.CtLitecoin] != 1 {
+		t.Errorf("Expected the other coins to take turns, got %v", order)
+	}
+
+	// Closing done abandons a waiting request.
+	slow := NewSyncCoordinator([]iwallet.CoinType{iwallet.CtBitcoin}, SyncConfig{RequestsPerSecond: 0.01})
+	slow.Request(iwallet.CtBitcoin, done)
+	cancel := make(chan struct{})
+	result := make(chan bool)
+	go func() {
+		result <- slow.Request(iwallet.CtBitcoin, cancel)
+	}()
+	time.Sleep(time.Millisecond * 10)
+	close(cancel)
+	select {
+	case ok := <-result:
+		if ok {
+			t.Error("Expected the request to be abandoned")
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting on abandoned request")
+	}
+	if slow.pending() {
+		t.Error("Expected the abandoned request to be removed")
+	}
+
+	unlimited := NewSyncCoordinator(nil, SyncConfig{})
+	for i := 0; i < 100; i++ {
+		if !unlimited.Request(iwallet.CtBitcoin, done) {
+			t.Fatal("Expected unlimited requests to be granted")
+		}
+	}
+}
+
+func TestMultiwallet_SyncStatus(t *testing.T) {
+	chain := testutil.NewChain()
+	mw, _ := newTestMultiwallet(t, chain, true)
+	if status := mw.SyncStatus()[iwallet.CtMock]; status.Started || status.Synced {
+		t.Errorf("Expected the sync not to have started, got %+v", status)
+	}
+
+	if err := mw.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer mw.Close()
+	chain.MineBlocks(2)
+
+	deadline := time.After(time.Second * 10)
+	for {
+		status := mw.SyncStatus()[iwallet.CtMock]
+		if status.Synced && status.Height == 2 {
+			if !status.Started || status.Progress != 100 || status.LastError != nil {
+				t.Errorf("Unexpected status %+v", status)
+			}
+			return
+		}
+		select {
+		case <-deadline:
+			t.Fatalf("timed out waiting on sync, got %+v", status)
+		case <-time.After(time.Millisecond * 50):
+		}
+	}
+}
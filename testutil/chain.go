@@ -0,0 +1,650 @@
+// Package testutil provides a simulated blockchain and a mock coin wallet
+// so applications built on the multiwallet can integration test payment
+// and escrow flows without a network.
+//
+// A Chain only mines blocks when told to, so tests decide exactly when
+// transactions confirm, and it can reorg any number of blocks. Wallets
+// created with NewWallet or NewTestWallet use it as their ChainClient and
+// build unsigned transactions which the Chain validates for double spends.
+package testutil
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/cpacia/multiwallet/base"
+	iwallet "github.com/cpacia/wallet-interface"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrTransactionNotFound is returned by GetTransaction for transactions
+	// the Chain hasn't seen or has evicted.
+	ErrTransactionNotFound = errors.New("transaction not found")
+
+	// ErrDoubleSpend is returned when a transaction spends an output which
+	// is already spent by another transaction.
+	ErrDoubleSpend = errors.New("txn-mempool-conflict")
+
+	// ErrMissingInputs is returned when a transaction spends an output of a
+	// known transaction which doesn't exist.
+	ErrMissingInputs = errors.New("missing-inputs")
+)
+
+// FaucetAddress is the address which funds created by Fund are sent from.
+var FaucetAddress = iwallet.NewAddress(hex.EncodeToString(make([]byte, 20)), iwallet.CtMock)
+
+// Chain is a simulated blockchain. It implements base.ChainClient and
+// base.MempoolClient and may be shared by any number of wallets.
+//
+// Broadcast transactions wait in the mempool until MineBlocks is called.
+// Notifications are delivered to each subscription in order but without
+// blocking the Chain, so tests should wait for wallets to catch up rather
+// than assume they have processed a block when MineBlocks returns.
+type Chain struct {
+	mtx      sync.Mutex
+	blocks   []iwallet.BlockInfo
+	txs      map[iwallet.TransactionID]*iwallet.Transaction
+	history  []iwallet.TransactionID
+	mempool  []iwallet.TransactionID
+	outputs  map[string]iwallet.SpendInfo
+	spends   map[string]iwallet.TransactionID
+	txSubs   map[*txSubscription]struct{}
+	blkFeeds map[*feed]struct{}
+	memFeeds map[*feed]struct{}
+	nonce    uint64
+
+	returnErr error
+}
+
+type txSubscription struct {
+	addrs map[iwallet.Address]bool
+	feed  *feed
+}
+
+// NewChain returns a Chain holding only a genesis block.
+func NewChain() *Chain {
+	c := &Chain{
+		txs:      make(map[iwallet.TransactionID]*iwallet.Transaction),
+		outputs:  make(map[string]iwallet.SpendInfo),
+		spends:   make(map[string]iwallet.TransactionID),
+		txSubs:   make(map[*txSubscription]struct{}),
+		blkFeeds: make(map[*feed]struct{}),
+		memFeeds: make(map[*feed]struct{}),
+	}
+	c.blocks = append(c.blocks, iwallet.BlockInfo{
+		BlockID:   iwallet.BlockID(chainhash.Hash{}.String()),
+		Height:    0,
+		BlockTime: time.Now(),
+	})
+	return c
+}
+
+// SetErrorResponse makes every call to the Chain's client methods fail
+// with err until it is called again with nil. It can be used to simulate
+// an unreachable backend.
+func (c *Chain) SetErrorResponse(err error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.returnErr = err
+}
+
+// MineBlocks mines n blocks and returns them. The mempool is confirmed in
+// the first one.
+func (c *Chain) MineBlocks(n int) []iwallet.BlockInfo {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.mineBlocks(n)
+}
+
+// Reorg replaces the top depth blocks with depth+1 new empty ones so the
+// new branch becomes the best chain. Transactions confirmed in the
+// replaced blocks are returned to the mempool.
+func (c *Chain) Reorg(depth int) ([]iwallet.BlockInfo, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if depth <= 0 || depth >= len(c.blocks) {
+		return nil, fmt.Errorf("cannot reorg %d blocks at height %d", depth, c.tip().Height)
+	}
+	c.blocks = c.blocks[:len(c.blocks)-depth]
+	forkHeight := c.tip().Height
+
+	var reverted []iwallet.TransactionID
+	for _, txid := range c.history {
+		tx := c.txs[txid]
+		if tx.Height > forkHeight {
+			tx.Height = 0
+			tx.BlockInfo = nil
+			reverted = append(reverted, txid)
+		}
+	}
+	c.mempool = append(reverted, c.mempool...)
+	return c.mineBlocks(depth + 1), nil
+}
+
+// Fund sends amount to the address from the faucet and returns the
+// transaction. It is unconfirmed until the next block is mined.
+func (c *Chain) Fund(addr iwallet.Address, amount iwallet.Amount) (iwallet.Transaction, error) {
+	c.mtx.Lock()
+	c.nonce++
+	nonce := c.nonce
+	c.mtx.Unlock()
+
+	var seed [8]byte
+	binary.BigEndian.PutUint64(seed[:], nonce)
+	faucet := chainhash.DoubleHashH(append([]byte("faucet"), seed[:]...))
+
+	tx := iwallet.Transaction{
+		From: []iwallet.SpendInfo{{
+			ID:      outpoint(faucet, 0),
+			Address: FaucetAddress,
+			Amount:  amount,
+		}},
+		To: []iwallet.SpendInfo{{
+			Address: addr,
+			Amount:  amount,
+		}},
+	}
+	tx.ID = transactionID(tx)
+	if err := c.Send(tx); err != nil {
+		return iwallet.Transaction{}, err
+	}
+	return c.GetTransaction(tx.ID)
+}
+
+// Send adds the transaction to the mempool and notifies subscribers. The
+// IDs of outputs which don't have one are set from the txid and index.
+// Sending a transaction the Chain already has is a no-op.
+func (c *Chain) Send(tx iwallet.Transaction) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.returnErr != nil {
+		return c.returnErr
+	}
+	if tx.ID == "" {
+		return errors.New("transaction has no id")
+	}
+	if _, ok := c.txs[tx.ID]; ok {
+		return nil
+	}
+	h, err := chainhash.NewHashFromStr(tx.ID.String())
+	if err != nil {
+		return err
+	}
+	if len(tx.To) == 0 {
+		return errors.New("transaction has no outputs")
+	}
+
+	var (
+		in  = iwallet.NewAmount(0)
+		out = iwallet.NewAmount(0)
+	)
+	from := make([]iwallet.SpendInfo, len(tx.From))
+	for i, input := range tx.From {
+		op := hex.EncodeToString(input.ID)
+		if spender, ok := c.spends[op]; ok {
+			return fmt.Errorf("%w: %s already spent by %s", ErrDoubleSpend, op, spender)
+		}
+		if prev, ok := c.outputs[op]; ok {
+			input.Address = prev.Address
+			input.Amount = prev.Amount
+		} else if len(input.ID) == chainhash.HashSize+4 {
+			prevID, _ := chainhash.NewHash(input.ID[:chainhash.HashSize])
+			if _, ok := c.txs[iwallet.TransactionID(prevID.String())]; ok {
+				return fmt.Errorf("%w: %s", ErrMissingInputs, op)
+			}
+		}
+		in = in.Add(input.Amount)
+		from[i] = input
+	}
+	to := make([]iwallet.SpendInfo, len(tx.To))
+	for i, output := range tx.To {
+		if len(output.ID) == 0 {
+			output.ID = outpoint(*h, uint32(i))
+		}
+		out = out.Add(output.Amount)
+		to[i] = output
+	}
+	if in.Cmp(out) < 0 {
+		return fmt.Errorf("inputs of %s are less than outputs of %s", in, out)
+	}
+
+	tx.From = from
+	tx.To = to
+	tx.Height = 0
+	tx.BlockInfo = nil
+	tx.Timestamp = time.Now()
+
+	for _, input := range tx.From {
+		c.spends[hex.EncodeToString(input.ID)] = tx.ID
+	}
+	for _, output := range tx.To {
+		c.outputs[hex.EncodeToString(output.ID)] = output
+	}
+	c.txs[tx.ID] = &tx
+	c.history = append(c.history, tx.ID)
+	c.mempool = append(c.mempool, tx.ID)
+
+	c.notifyTransaction(tx)
+	for f := range c.memFeeds {
+		f.push(tx)
+	}
+	return nil
+}
+
+// Evict removes the transaction, and any unconfirmed transactions spending
+// from it, from the mempool as if they had been dropped by the network.
+// Subscribers aren't notified.
+func (c *Chain) Evict(txid iwallet.TransactionID) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	tx, ok := c.txs[txid]
+	if !ok {
+		return ErrTransactionNotFound
+	}
+	if tx.Height > 0 {
+		return fmt.Errorf("transaction %s is confirmed", txid)
+	}
+	c.evict(tx)
+	return nil
+}
+
+// Mempool returns the IDs of the unconfirmed transactions in the order
+// they were sent.
+func (c *Chain) Mempool() []iwallet.TransactionID {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return append([]iwallet.TransactionID(nil), c.mempool...)
+}
+
+// GetBlockchainInfo returns the best block.
+func (c *Chain) GetBlockchainInfo() (iwallet.BlockInfo, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.returnErr != nil {
+		return iwallet.BlockInfo{}, c.returnErr
+	}
+	return c.tip(), nil
+}
+
+// GetAddressTransactions returns the transactions paying to or spending
+// from the address which are unconfirmed or confirmed at or above
+// fromHeight, in the order they were sent.
+func (c *Chain) GetAddressTransactions(addr iwallet.Address, fromHeight uint64) ([]iwallet.Transaction, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.returnErr != nil {
+		return nil, c.returnErr
+	}
+	var txs []iwallet.Transaction
+	for _, txid := range c.history {
+		tx, ok := c.txs[txid]
+		if !ok || (tx.Height > 0 && tx.Height < fromHeight) {
+			continue
+		}
+		if involves(*tx, func(a iwallet.Address) bool { return a == addr }) {
+			txs = append(txs, copyTransaction(tx))
+		}
+	}
+	return txs, nil
+}
+
+// GetTransaction returns the transaction with its current confirmation.
+func (c *Chain) GetTransaction(id iwallet.TransactionID) (iwallet.Transaction, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.returnErr != nil {
+		return iwallet.Transaction{}, c.returnErr
+	}
+	tx, ok := c.txs[id]
+	if !ok {
+		return iwallet.Transaction{}, ErrTransactionNotFound
+	}
+	return copyTransaction(tx), nil
+}
+
+// IsBlockInMainChain returns whether the block is in the best chain.
+func (c *Chain) IsBlockInMainChain(block iwallet.BlockInfo) (bool, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.returnErr != nil {
+		return false, c.returnErr
+	}
+	if block.Height >= uint64(len(c.blocks)) {
+		return false, nil
+	}
+	return c.blocks[block.Height].BlockID == block.BlockID, nil
+}
+
+// GetMerkleProof always returns base.ErrMerkleProofUnsupported.
+func (c *Chain) GetMerkleProof(id iwallet.TransactionID) (*base.MerkleProof, error) {
+	return nil, base.ErrMerkleProofUnsupported
+}
+
+// SubscribeTransactions returns a subscription to transactions involving
+// the addresses. Confirmed transactions are sent again when they are mined.
+func (c *Chain) SubscribeTransactions(addrs []iwallet.Address) (*base.TransactionSubscription, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.returnErr != nil {
+		return nil, c.returnErr
+	}
+
+	s := &txSubscription{addrs: make(map[iwallet.Address]bool)}
+	for _, addr := range addrs {
+		s.addrs[addr] = true
+	}
+	sub := &base.TransactionSubscription{
+		Out:         make(chan iwallet.Transaction),
+		Subscribe:   make(chan []iwallet.Address),
+		Unsubscribe: make(chan []iwallet.Address),
+	}
+	s.feed = newFeed(func(v interface{}, done <-chan struct{}) {
+		select {
+		case sub.Out <- v.(iwallet.Transaction):
+		case <-done:
+		}
+	})
+	sub.Close = func() {
+		c.mtx.Lock()
+		delete(c.txSubs, s)
+		c.mtx.Unlock()
+		s.feed.close()
+	}
+	c.txSubs[s] = struct{}{}
+
+	go func() {
+		for {
+			select {
+			case addrs := <-sub.Subscribe:
+				c.mtx.Lock()
+				for _, addr := range addrs {
+					s.addrs[addr] = true
+				}
+				c.mtx.Unlock()
+			case addrs := <-sub.Unsubscribe:
+				c.mtx.Lock()
+				for _, addr := range addrs {
+					delete(s.addrs, addr)
+				}
+				c.mtx.Unlock()
+			case <-s.feed.done:
+				return
+			}
+		}
+	}()
+	return sub, nil
+}
+
+// SubscribeBlocks returns a subscription to new blocks.
+func (c *Chain) SubscribeBlocks() (*base.BlockSubscription, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.returnErr != nil {
+		return nil, c.returnErr
+	}
+
+	sub := &base.BlockSubscription{Out: make(chan iwallet.BlockInfo)}
+	f := newFeed(func(v interface{}, done <-chan struct{}) {
+		select {
+		case sub.Out <- v.(iwallet.BlockInfo):
+		case <-done:
+		}
+	})
+	sub.Close = func() {
+		c.mtx.Lock()
+		delete(c.blkFeeds, f)
+		c.mtx.Unlock()
+		f.close()
+	}
+	c.blkFeeds[f] = struct{}{}
+	return sub, nil
+}
+
+// SubscribeMempool returns a subscription to every transaction entering
+// the mempool.
+func (c *Chain) SubscribeMempool() (*base.MempoolSubscription, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.returnErr != nil {
+		return nil, c.returnErr
+	}
+
+	sub := &base.MempoolSubscription{Out: make(chan iwallet.Transaction, base.MempoolBufferSize)}
+	f := newFeed(func(v interface{}, done <-chan struct{}) {
+		select {
+		case sub.Out <- v.(iwallet.Transaction):
+		case <-done:
+		}
+	})
+	sub.Close = func() {
+		c.mtx.Lock()
+		delete(c.memFeeds, f)
+		c.mtx.Unlock()
+		f.close()
+	}
+	c.memFeeds[f] = struct{}{}
+	return sub, nil
+}
+
+// Broadcast decodes a transaction serialized by a mock Wallet and sends
+// it.
+func (c *Chain) Broadcast(serializedTx []byte) error {
+	var tx iwallet.Transaction
+	if err := json.Unmarshal(serializedTx, &tx); err != nil {
+		return err
+	}
+	return c.Send(tx)
+}
+
+// Open does nothing.
+func (c *Chain) Open() error {
+	return nil
+}
+
+// Close does nothing. The Chain may be shared so it's left running when a
+// wallet using it is closed.
+func (c *Chain) Close() error {
+	return nil
+}
+
+func (c *Chain) tip() iwallet.BlockInfo {
+	return c.blocks[len(c.blocks)-1]
+}
+
+// mineBlocks must be called with the lock held.
+func (c *Chain) mineBlocks(n int) []iwallet.BlockInfo {
+	mined := make([]iwallet.BlockInfo, 0, n)
+	for i := 0; i < n; i++ {
+		prev := c.tip()
+		c.nonce++
+
+		var seed [8]byte
+		binary.BigEndian.PutUint64(seed[:], c.nonce)
+		block := iwallet.BlockInfo{
+			BlockID:   iwallet.BlockID(chainhash.DoubleHashH(append([]byte(prev.BlockID), seed[:]...)).String()),
+			PrevBlock: prev.BlockID,
+			Height:    prev.Height + 1,
+			BlockTime: time.Now(),
+		}
+		c.blocks = append(c.blocks, block)
+
+		for _, txid := range c.mempool {
+			tx := c.txs[txid]
+			tx.Height = block.Height
+			tx.BlockInfo = &block
+			tx.Timestamp = block.BlockTime
+			c.notifyTransaction(*tx)
+		}
+		c.mempool = nil
+
+		for f := range c.blkFeeds {
+			f.push(block)
+		}
+		mined = append(mined, block)
+	}
+	return mined
+}
+
+// evict must be called with the lock held.
+func (c *Chain) evict(tx *iwallet.Transaction) {
+	if _, ok := c.txs[tx.ID]; !ok {
+		return
+	}
+	delete(c.txs, tx.ID)
+	for _, output := range tx.To {
+		if spender, ok := c.spends[hex.EncodeToString(output.ID)]; ok {
+			if child, ok := c.txs[spender]; ok && child.Height == 0 {
+				c.evict(child)
+			}
+		}
+	}
+	for _, input := range tx.From {
+		delete(c.spends, hex.EncodeToString(input.ID))
+	}
+	for _, output := range tx.To {
+		delete(c.outputs, hex.EncodeToString(output.ID))
+	}
+	c.mempool = removeID(c.mempool, tx.ID)
+	c.history = removeID(c.history, tx.ID)
+}
+
+// notifyTransaction must be called with the lock held.
+func (c *Chain) notifyTransaction(tx iwallet.Transaction) {
+	for s := range c.txSubs {
+		if involves(tx, func(a iwallet.Address) bool { return s.addrs[a] }) {
+			s.feed.push(copyTransaction(&tx))
+		}
+	}
+}
+
+func involves(tx iwallet.Transaction, match func(iwallet.Address) bool) bool {
+	for _, input := range tx.From {
+		if match(input.Address) {
+			return true
+		}
+	}
+	for _, output := range tx.To {
+		if match(output.Address) {
+			return true
+		}
+	}
+	return false
+}
+
+func copyTransaction(tx *iwallet.Transaction) iwallet.Transaction {
+	cp := *tx
+	if tx.BlockInfo != nil {
+		block := *tx.BlockInfo
+		cp.BlockInfo = &block
+	}
+	cp.From = append([]iwallet.SpendInfo(nil), tx.From...)
+	cp.To = append([]iwallet.SpendInfo(nil), tx.To...)
+	return cp
+}
+
+func removeID(ids []iwallet.TransactionID, id iwallet.TransactionID) []iwallet.TransactionID {
+	for i := range ids {
+		if ids[i] == id {
+			return append(ids[:i:i], ids[i+1:]...)
+		}
+	}
+	return ids
+}
+
+// outpoint serializes an outpoint in the format used by
+// iwallet.SpendInfo.ID: the hash followed by the little endian index.
+func outpoint(h chainhash.Hash, index uint32) []byte {
+	ser := make([]byte, chainhash.HashSize+4)
+	copy(ser, h[:])
+	binary.LittleEndian.PutUint32(ser[chainhash.HashSize:], index)
+	return ser
+}
+
+// transactionID hashes the transaction's inputs and outputs. Output IDs
+// are derived from the txid so they aren't included.
+func transactionID(tx iwallet.Transaction) iwallet.TransactionID {
+	type output struct {
+		Address string
+		Amount  string
+	}
+	var data struct {
+		From [][]byte
+		To   []output
+	}
+	for _, input := range tx.From {
+		data.From = append(data.From, input.ID)
+	}
+	for _, out := range tx.To {
+		data.To = append(data.To, output{Address: out.Address.String(), Amount: out.Amount.String()})
+	}
+	ser, _ := json.Marshal(data)
+	return iwallet.TransactionID(chainhash.DoubleHashH(ser).String())
+}
+
+// feed delivers values to a subscriber in order from its own goroutine so
+// a subscriber which stops reading can't stall the Chain.
+type feed struct {
+	mtx     sync.Mutex
+	pending []interface{}
+	wake    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newFeed(deliver func(v interface{}, done <-chan struct{})) *feed {
+	f := &feed{
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	go func() {
+		for {
+			f.mtx.Lock()
+			pending := f.pending
+			f.pending = nil
+			f.mtx.Unlock()
+
+			for _, v := range pending {
+				deliver(v, f.done)
+			}
+			select {
+			case <-f.wake:
+			case <-f.done:
+				return
+			}
+		}
+	}()
+	return f
+}
+
+func (f *feed) push(v interface{}) {
+	f.mtx.Lock()
+	f.pending = append(f.pending, v)
+	f.mtx.Unlock()
+
+	select {
+	case f.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (f *feed) close() {
+	f.once.Do(func() { close(f.done) })
+}
@@ -0,0 +1,135 @@
+package testutil
+
+import (
+	"errors"
+	iwallet "github.com/cpacia/wallet-interface"
+	"testing"
+	"time"
+)
+
+func TestChain_MineAndReorg(t *testing.T) {
+	chain := NewChain()
+	addr := iwallet.NewAddress("aa", iwallet.CtMock)
+
+	sub, err := chain.SubscribeTransactions([]iwallet.Address{addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	funding, err := chain.Fund(addr, iwallet.NewAmount(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case tx := <-sub.Out:
+		if tx.ID != funding.ID || tx.Height != 0 {
+			t.Errorf("Unexpected notification %+v", tx)
+		}
+	case <-time.After(time.Second * 10):
+		t.Fatal("timed out waiting on transaction")
+	}
+
+	blocks := chain.MineBlocks(3)
+	if len(blocks) != 3 || blocks[2].Height != 3 {
+		t.Fatalf("Unexpected blocks %v", blocks)
+	}
+	select {
+	case tx := <-sub.Out:
+		if tx.ID != funding.ID || tx.Height != 1 {
+			t.Errorf("Expected confirmation at height 1, got %d", tx.Height)
+		}
+	case <-time.After(time.Second * 10):
+		t.Fatal("timed out waiting on confirmation")
+	}
+	if len(chain.Mempool()) != 0 {
+		t.Error("Expected mempool to be empty")
+	}
+
+	txs, err := chain.GetAddressTransactions(addr, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txs) != 0 {
+		t.Errorf("Expected no transactions from height 2, got %d", len(txs))
+	}
+
+	newBlocks, err := chain.Reorg(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(newBlocks) != 4 || newBlocks[0].PrevBlock != chainBlock(t, chain, 0).BlockID {
+		t.Errorf("Unexpected reorg blocks %v", newBlocks)
+	}
+	if inMain, err := chain.IsBlockInMainChain(blocks[0]); err != nil || inMain {
+		t.Errorf("Expected reorged block to be out of the main chain, got %v %v", inMain, err)
+	}
+	tx, err := chain.GetTransaction(funding.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.Height != 0 || len(chain.Mempool()) != 1 {
+		t.Errorf("Expected reorged transaction back in the mempool")
+	}
+}
+
+func TestChain_Send(t *testing.T) {
+	chain := NewChain()
+	addr := iwallet.NewAddress("aa", iwallet.CtMock)
+
+	funding, err := chain.Fund(addr, iwallet.NewAmount(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spend := func(amount int64) iwallet.Transaction {
+		tx := iwallet.Transaction{
+			From: []iwallet.SpendInfo{{ID: funding.To[0].ID}},
+			To:   []iwallet.SpendInfo{{Address: iwallet.NewAddress("bb", iwallet.CtMock), Amount: iwallet.NewAmount(amount)}},
+		}
+		tx.ID = transactionID(tx)
+		return tx
+	}
+
+	if err := chain.Send(spend(1001)); err == nil {
+		t.Error("Expected error spending more than the inputs")
+	}
+	tx1 := spend(900)
+	if err := chain.Send(tx1); err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.Send(tx1); err != nil {
+		t.Errorf("Expected resending to be a no-op, got %v", err)
+	}
+	if err := chain.Send(spend(800)); !errors.Is(err, ErrDoubleSpend) {
+		t.Errorf("Expected ErrDoubleSpend, got %v", err)
+	}
+
+	sent, err := chain.GetTransaction(tx1.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent.From[0].Address != addr || sent.From[0].Amount.Cmp(iwallet.NewAmount(1000)) != 0 {
+		t.Errorf("Expected input metadata to be filled in, got %+v", sent.From[0])
+	}
+
+	if err := chain.Evict(funding.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chain.GetTransaction(tx1.ID); err != ErrTransactionNotFound {
+		t.Errorf("Expected child to be evicted, got %v", err)
+	}
+	if len(chain.Mempool()) != 0 {
+		t.Errorf("Expected empty mempool, got %v", chain.Mempool())
+	}
+}
+
+func chainBlock(t *testing.T, chain *Chain, height uint64) iwallet.BlockInfo {
+	chain.mtx.Lock()
+	defer chain.mtx.Unlock()
+
+	if height >= uint64(len(chain.blocks)) {
+		t.Fatalf("No block at height %d", height)
+	}
+	return chain.blocks[height]
+}
@@ -0,0 +1,253 @@
+package testutil
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/btcec"
+	iwallet "github.com/cpacia/wallet-interface"
+	"io"
+	"time"
+)
+
+// Mock redeem scripts are a version byte, the threshold, the number of
+// keys and the compressed keys. Scripts with a timeout also hold the
+// number of blocks before the timeout key can release the funds,
+// followed by the timeout key.
+const (
+	scriptMultisig            byte = 0
+	scriptMultisigWithTimeout byte = 1
+
+	maxMultisigKeys = 8
+)
+
+// redeemScript is a decoded mock redeem script.
+type redeemScript struct {
+	threshold     int
+	keys          []*btcec.PublicKey
+	timeoutBlocks uint32
+	timeoutKey    *btcec.PublicKey
+}
+
+func parseRedeemScript(script []byte) (*redeemScript, error) {
+	if len(script) < 3 {
+		return nil, errors.New("redeem script too short")
+	}
+	rs := &redeemScript{threshold: int(script[1])}
+	n := int(script[2])
+	r := bytes.NewReader(script[3:])
+	for i := 0; i < n; i++ {
+		key, err := readKey(r)
+		if err != nil {
+			return nil, err
+		}
+		rs.keys = append(rs.keys, key)
+	}
+	switch script[0] {
+	case scriptMultisig:
+	case scriptMultisigWithTimeout:
+		if err := binary.Read(r, binary.BigEndian, &rs.timeoutBlocks); err != nil {
+			return nil, err
+		}
+		key, err := readKey(r)
+		if err != nil {
+			return nil, err
+		}
+		rs.timeoutKey = key
+	default:
+		return nil, fmt.Errorf("unknown redeem script version %d", script[0])
+	}
+	if r.Len() != 0 {
+		return nil, errors.New("trailing bytes in redeem script")
+	}
+	return rs, nil
+}
+
+func readKey(r *bytes.Reader) (*btcec.PublicKey, error) {
+	ser := make([]byte, btcec.PubKeyBytesLenCompressed)
+	if _, err := io.ReadFull(r, ser); err != nil {
+		return nil, err
+	}
+	return btcec.ParsePubKey(ser, btcec.S256())
+}
+
+// EstimateEscrowFee estimates the fee to release the funds from escrow
+// assuming a single input.
+func (w *Wallet) EstimateEscrowFee(threshold int, level iwallet.FeeLevel) (iwallet.Amount, error) {
+	nOuts := 2
+	if threshold == 1 {
+		nOuts = 1
+	}
+	size := txOverheadSize + threshold*72 + (threshold+1)*btcec.PubKeyBytesLenCompressed + nOuts*outputSize
+	return iwallet.NewAmount(int64(size) * feePerByte(level)), nil
+}
+
+// CreateMultisigAddress returns a threshold multisig address for the keys
+// and its redeem script. The result is deterministic for the same keys in
+// the same order.
+func (w *Wallet) CreateMultisigAddress(keys []btcec.PublicKey, threshold int) (iwallet.Address, []byte, error) {
+	script, err := multisigScript(scriptMultisig, keys, threshold)
+	if err != nil {
+		return iwallet.Address{}, nil, err
+	}
+	return scriptAddress(script), script, nil
+}
+
+// CreateMultisigWithTimeout is the same as CreateMultisigAddress but the
+// funds may also be released by the timeout key once the escrow output
+// has timeout worth of confirmations, at six blocks an hour.
+func (w *Wallet) CreateMultisigWithTimeout(keys []btcec.PublicKey, threshold int, timeout time.Duration, timeoutKey btcec.PublicKey) (iwallet.Address, []byte, error) {
+	script, err := multisigScript(scriptMultisigWithTimeout, keys, threshold)
+	if err != nil {
+		return iwallet.Address{}, nil, err
+	}
+	var blocks [4]byte
+	binary.BigEndian.PutUint32(blocks[:], uint32(timeout.Hours()*6))
+	script = append(script, blocks[:]...)
+	script = append(script, timeoutKey.SerializeCompressed()...)
+	return scriptAddress(script), script, nil
+}
+
+// SignMultisigTransaction returns the key's signature for each input of
+// the transaction.
+func (w *Wallet) SignMultisigTransaction(txn iwallet.Transaction, key btcec.PrivateKey, redeemScript []byte) ([]iwallet.EscrowSignature, error) {
+	if _, err := parseRedeemScript(redeemScript); err != nil {
+		return nil, err
+	}
+	sigs := make([]iwallet.EscrowSignature, 0, len(txn.From))
+	for i := range txn.From {
+		sig, err := key.Sign(sigHash(txn, i, redeemScript))
+		if err != nil {
+			return nil, err
+		}
+		sigs = append(sigs, iwallet.EscrowSignature{Index: i, Signature: sig.Serialize()})
+	}
+	return sigs, nil
+}
+
+// BuildAndSend checks there are threshold valid signatures for each input
+// and sends the transaction when wtx is committed.
+func (w *Wallet) BuildAndSend(wtx iwallet.Tx, txn iwallet.Transaction, signatures [][]iwallet.EscrowSignature, redeemScript []byte) (iwallet.TransactionID, error) {
+	rs, err := parseRedeemScript(redeemScript)
+	if err != nil {
+		return "", err
+	}
+	for _, sigs := range signatures {
+		if len(sigs) != len(txn.From) {
+			return "", errors.New("incorrect number of signatures")
+		}
+	}
+	for i := range txn.From {
+		hash := sigHash(txn, i, redeemScript)
+		signed := make(map[int]bool)
+		for _, sigs := range signatures {
+			for _, sig := range sigs {
+				if sig.Index != i {
+					continue
+				}
+				parsed, err := btcec.ParseDERSignature(sig.Signature, btcec.S256())
+				if err != nil {
+					return "", err
+				}
+				for k, key := range rs.keys {
+					if parsed.Verify(hash, key) {
+						signed[k] = true
+					}
+				}
+			}
+		}
+		if len(signed) < rs.threshold {
+			return "", fmt.Errorf("input %d has %d of %d required signatures", i, len(signed), rs.threshold)
+		}
+	}
+	return w.broadcastOnCommit(wtx, escrowTransaction(txn))
+}
+
+// ReleaseFundsAfterTimeout releases the funds from escrow with the timeout
+// key. It fails if any escrow output doesn't yet have enough
+// confirmations.
+func (w *Wallet) ReleaseFundsAfterTimeout(wtx iwallet.Tx, txn iwallet.Transaction, timeoutKey btcec.PrivateKey, redeemScript []byte) (iwallet.TransactionID, error) {
+	rs, err := parseRedeemScript(redeemScript)
+	if err != nil {
+		return "", err
+	}
+	if rs.timeoutKey == nil {
+		return "", errors.New("redeem script has no timeout")
+	}
+	if !rs.timeoutKey.IsEqual(timeoutKey.PubKey()) {
+		return "", errors.New("incorrect timeout key")
+	}
+	best, err := w.chain.GetBlockchainInfo()
+	if err != nil {
+		return "", err
+	}
+	for _, from := range txn.From {
+		txid, _, err := outpointTxid(from.ID)
+		if err != nil {
+			return "", err
+		}
+		prev, err := w.chain.GetTransaction(txid)
+		if err != nil {
+			return "", err
+		}
+		if prev.Height == 0 || best.Height-prev.Height+1 < uint64(rs.timeoutBlocks) {
+			return "", errors.New("escrow timeout has not expired")
+		}
+	}
+	return w.broadcastOnCommit(wtx, escrowTransaction(txn))
+}
+
+func multisigScript(version byte, keys []btcec.PublicKey, threshold int) ([]byte, error) {
+	if threshold < 1 || len(keys) < threshold {
+		return nil, fmt.Errorf("unable to generate multisig script with "+
+			"%d required signatures when there are only %d public "+
+			"keys available", threshold, len(keys))
+	}
+	if len(keys) > maxMultisigKeys {
+		return nil, fmt.Errorf("unable to generate multisig script with "+
+			"more than %d public keys", maxMultisigKeys)
+	}
+	script := []byte{version, byte(threshold), byte(len(keys))}
+	for _, key := range keys {
+		script = append(script, key.SerializeCompressed()...)
+	}
+	return script, nil
+}
+
+func scriptAddress(script []byte) iwallet.Address {
+	h := sha256.Sum256(script)
+	return iwallet.NewAddress(hex.EncodeToString(h[:]), iwallet.CtMock)
+}
+
+// sigHash is the hash signed for an input. It commits to the redeem
+// script, the input index and the transaction's inputs and outputs.
+func sigHash(txn iwallet.Transaction, index int, redeemScript []byte) []byte {
+	h := sha256.New()
+	h.Write(redeemScript)
+	binary.Write(h, binary.BigEndian, uint32(index))
+	for _, from := range txn.From {
+		h.Write(from.ID)
+	}
+	for _, to := range txn.To {
+		h.Write([]byte(to.Address.String()))
+		h.Write([]byte(to.Amount.String()))
+	}
+	return h.Sum(nil)
+}
+
+// escrowTransaction copies the inputs and outputs of txn into a new
+// transaction. The Chain fills in the escrow inputs' addresses and
+// amounts.
+func escrowTransaction(txn iwallet.Transaction) iwallet.Transaction {
+	var tx iwallet.Transaction
+	for _, from := range txn.From {
+		tx.From = append(tx.From, iwallet.SpendInfo{ID: from.ID, Address: from.Address, Amount: from.Amount})
+	}
+	for _, to := range txn.To {
+		tx.To = append(tx.To, iwallet.SpendInfo{Address: to.Address, Amount: to.Amount})
+	}
+	return tx
+}
@@ -0,0 +1,68 @@
+package testutil
+
+import (
+	"fmt"
+	"github.com/cpacia/multiwallet/database"
+	iwallet "github.com/cpacia/wallet-interface"
+	"time"
+)
+
+// pollInterval is how often WaitFor checks its condition.
+const pollInterval = time.Millisecond * 20
+
+// WaitFor polls cond until it returns true or the timeout passes. Wallets
+// process notifications from the Chain asynchronously so tests use it to
+// wait for them to catch up.
+func WaitFor(timeout time.Duration, cond func() bool) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		if cond() {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("condition not met after %s", timeout)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// WaitForHeight waits until the wallet has processed the block at height.
+func (w *Wallet) WaitForHeight(height uint64, timeout time.Duration) error {
+	return WaitFor(timeout, func() bool {
+		info, err := w.BlockchainInfo()
+		return err == nil && info.Height >= height
+	})
+}
+
+// WaitForBalance waits until the wallet's unconfirmed and confirmed
+// balances are the given amounts.
+func (w *Wallet) WaitForBalance(unconfirmed, confirmed iwallet.Amount, timeout time.Duration) error {
+	err := WaitFor(timeout, func() bool {
+		unconf, conf, err := w.Balance()
+		return err == nil && unconf.Cmp(unconfirmed) == 0 && conf.Cmp(confirmed) == 0
+	})
+	if err != nil {
+		unconf, conf, _ := w.Balance()
+		return fmt.Errorf("expected balance %s/%s, got %s/%s", unconfirmed, confirmed, unconf, conf)
+	}
+	return nil
+}
+
+// WaitForTransaction waits until the wallet has saved the transaction
+// with at least the given number of confirmations.
+func (w *Wallet) WaitForTransaction(txid iwallet.TransactionID, confirmations uint64, timeout time.Duration) error {
+	return WaitFor(timeout, func() bool {
+		var record database.TransactionRecord
+		err := w.DB.View(func(dbtx database.Tx) error {
+			return dbtx.Read().Where("coin=?", w.CoinType.CurrencyCode()).Where("txid=?", txid.String()).First(&record).Error
+		})
+		if err != nil {
+			return false
+		}
+		if confirmations == 0 {
+			return true
+		}
+		info, err := w.BlockchainInfo()
+		return err == nil && record.BlockHeight > 0 && info.Height >= record.BlockHeight && info.Height-record.BlockHeight+1 >= confirmations
+	})
+}
@@ -0,0 +1,356 @@
+package testutil
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcutil/coinset"
+	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/cpacia/multiwallet/base"
+	"github.com/cpacia/multiwallet/database"
+	"github.com/cpacia/multiwallet/database/memorydb"
+	"github.com/cpacia/multiwallet/log"
+	iwallet "github.com/cpacia/wallet-interface"
+	"sort"
+	"time"
+)
+
+// Assert interfaces
+var _ = iwallet.Wallet(&Wallet{})
+var _ = iwallet.WalletCrypter(&Wallet{})
+var _ = iwallet.Escrow(&Wallet{})
+var _ = iwallet.EscrowWithTimeout(&Wallet{})
+
+const (
+	dustLimit      = 546
+	txOverheadSize = 10
+	inputSize      = 148
+	outputSize     = 34
+)
+
+// Wallet is a mock coin wallet which uses a Chain as its backend. It
+// implements the same interfaces as the real coins on top of
+// base.WalletBase, but its transactions are serialized as JSON and
+// escrow signatures only commit to the transaction's inputs and outputs,
+// so nothing it sends is valid on a real network.
+type Wallet struct {
+	base.WalletBase
+	chain *Chain
+}
+
+// NewWallet returns a new mock Wallet using the chain as its backend.
+func NewWallet(cfg *base.WalletConfig, chain *Chain) (*Wallet, error) {
+	if cfg.DB == nil {
+		return nil, errors.New("a database is required")
+	}
+	w := &Wallet{chain: chain}
+	w.ChainClient = chain
+	w.DB = cfg.DB
+	w.Logger = cfg.Logger
+	w.CoinType = iwallet.CtMock
+	w.Done = make(chan struct{})
+	w.AddressFunc = keyToAddress
+	w.GapLimit = cfg.GapLimit
+	w.Prune = cfg.Prune
+	w.Confirmations = cfg.Confirmations
+	return w, nil
+}
+
+// NewTestWallet creates and opens a Wallet from a random seed with an
+// in-memory database. The wallet's own rebroadcaster and pruner run as
+// normal so it should be closed when the test is done.
+func NewTestWallet(chain *Chain) (*Wallet, error) {
+	db, err := memorydb.NewMemoryDB()
+	if err != nil {
+		return nil, err
+	}
+	if err := database.InitializeDatabase(db); err != nil {
+		return nil, err
+	}
+	logger := log.New("testutil")
+	w, err := NewWallet(&base.WalletConfig{DB: db, Logger: logger}, chain)
+	if err != nil {
+		return nil, err
+	}
+
+	seed := make([]byte, hdkeychain.RecommendedSeedLen)
+	if _, err := rand.Read(seed); err != nil {
+		return nil, err
+	}
+	xpriv, err := hdkeychain.NewMaster(seed, &chaincfg.RegressionNetParams)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.CreateWallet(*xpriv, nil, time.Now()); err != nil {
+		return nil, err
+	}
+	if err := w.OpenWallet(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// ValidateAddress returns an error if the address is not a 20 or 32 byte
+// hex string.
+func (w *Wallet) ValidateAddress(addr iwallet.Address) error {
+	b, err := hex.DecodeString(addr.String())
+	if err != nil {
+		return err
+	}
+	if len(b) != 20 && len(b) != 32 {
+		return errors.New("invalid address length")
+	}
+	return nil
+}
+
+// IsDust returns whether the amount is below the dust limit of 546.
+func (w *Wallet) IsDust(amount iwallet.Amount) bool {
+	return amount.Cmp(iwallet.NewAmount(dustLimit)) < 0
+}
+
+// EstimateSpendFee returns the fee a transaction sending amount would pay
+// using the wallet's current coins.
+func (w *Wallet) EstimateSpendFee(amount iwallet.Amount, feeLevel iwallet.FeeLevel) (iwallet.Amount, error) {
+	var fee iwallet.Amount
+	err := w.DB.View(func(dbtx database.Tx) error {
+		coinMap, err := w.GatherCoins(dbtx)
+		if err != nil {
+			return err
+		}
+		defer base.ZeroCoinKeys(coinMap)
+
+		_, fee, err = selectCoins(coinMap, amount, feeLevel)
+		return err
+	})
+	return fee, err
+}
+
+// Spend sends amt to the address. The transaction is saved and broadcast
+// when wtx is committed.
+func (w *Wallet) Spend(wtx iwallet.Tx, to iwallet.Address, amt iwallet.Amount, feeLevel iwallet.FeeLevel) (iwallet.TransactionID, error) {
+	if err := w.ValidateAddress(to); err != nil {
+		return "", err
+	}
+	if w.IsDust(amt) {
+		return "", errors.New("dust output amount")
+	}
+	if w.Keychain.IsEncrypted() {
+		return "", base.ErrEncryptedKeychain
+	}
+	var tx iwallet.Transaction
+	err := w.DB.View(func(dbtx database.Tx) error {
+		coinMap, err := w.GatherCoins(dbtx)
+		if err != nil {
+			return err
+		}
+		defer base.ZeroCoinKeys(coinMap)
+
+		coins, fee, err := selectCoins(coinMap, amt, feeLevel)
+		if err != nil {
+			return err
+		}
+		tx = transactionFromCoins(coins)
+		tx.To = append(tx.To, iwallet.SpendInfo{Address: to, Amount: amt})
+
+		change := totalValue(coins).Sub(amt).Sub(fee)
+		if change.Cmp(iwallet.NewAmount(0)) > 0 {
+			changeAddr, err := w.Keychain.CurrentAddressWithTx(dbtx, true)
+			if err != nil {
+				return err
+			}
+			tx.To = append(tx.To, iwallet.SpendInfo{Address: changeAddr, Amount: change})
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return w.broadcastOnCommit(wtx, tx)
+}
+
+// SweepWallet sends the full balance of the wallet to the address. The fee
+// is subtracted from the amount sent.
+func (w *Wallet) SweepWallet(wtx iwallet.Tx, to iwallet.Address, level iwallet.FeeLevel) (iwallet.TransactionID, error) {
+	if err := w.ValidateAddress(to); err != nil {
+		return "", err
+	}
+	if w.Keychain.IsEncrypted() {
+		return "", base.ErrEncryptedKeychain
+	}
+	var tx iwallet.Transaction
+	err := w.DB.View(func(dbtx database.Tx) error {
+		coinMap, err := w.GatherCoins(dbtx)
+		if err != nil {
+			return err
+		}
+		defer base.ZeroCoinKeys(coinMap)
+
+		coins := sortedCoins(coinMap)
+		if len(coins) == 0 {
+			return errors.New("no coins to sweep")
+		}
+		amount := totalValue(coins).Sub(estimateFee(len(coins), 1, level))
+		if w.IsDust(amount) {
+			return errors.New("insufficient funds to pay the fee")
+		}
+		tx = transactionFromCoins(coins)
+		tx.To = append(tx.To, iwallet.SpendInfo{Address: to, Amount: amount})
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return w.broadcastOnCommit(wtx, tx)
+}
+
+// broadcastOnCommit sets the commit hook on wtx to save the transaction as
+// unconfirmed and broadcast it.
+func (w *Wallet) broadcastOnCommit(wtx iwallet.Tx, tx iwallet.Transaction) (iwallet.TransactionID, error) {
+	tx.ID = transactionID(tx)
+	h, err := chainhash.NewHashFromStr(tx.ID.String())
+	if err != nil {
+		return "", err
+	}
+	for i := range tx.To {
+		tx.To[i].ID = outpoint(*h, uint32(i))
+	}
+	ser, err := json.Marshal(&tx)
+	if err != nil {
+		return tx.ID, err
+	}
+
+	wbtx, ok := wtx.(*base.DBTx)
+	if !ok {
+		return tx.ID, errors.New("tx is not expected type")
+	}
+
+	wbtx.OnCommit = func() error {
+		err := w.DB.Update(func(dbtx database.Tx) error {
+			return dbtx.Save(&database.UnconfirmedTransaction{
+				Timestamp: time.Now(),
+				Coin:      w.CoinType.CurrencyCode(),
+				TxBytes:   ser,
+				Txid:      tx.ID.String(),
+			})
+		})
+		if err != nil {
+			return err
+		}
+		w.BroadcastOrQueue(tx.ID, ser)
+		return nil
+	}
+	return tx.ID, nil
+}
+
+// keyToAddress returns the hex encoded sha256 hash of the key's compressed
+// public key.
+func keyToAddress(key *hdkeychain.ExtendedKey) (iwallet.Address, error) {
+	pub, err := key.ECPubKey()
+	if err != nil {
+		return iwallet.Address{}, err
+	}
+	h := sha256.Sum256(pub.SerializeCompressed())
+	return iwallet.NewAddress(hex.EncodeToString(h[:]), iwallet.CtMock), nil
+}
+
+// feePerByte returns the fee rate for the level.
+func feePerByte(level iwallet.FeeLevel) int64 {
+	switch level {
+	case iwallet.FlPriority:
+		return 50
+	case iwallet.FlEconomic:
+		return 5
+	default:
+		return 20
+	}
+}
+
+// estimateFee returns the fee for a transaction with the given number of
+// inputs and outputs.
+func estimateFee(nIns, nOuts int, level iwallet.FeeLevel) iwallet.Amount {
+	size := txOverheadSize + nIns*inputSize + nOuts*outputSize
+	return iwallet.NewAmount(int64(size) * feePerByte(level))
+}
+
+// sortedCoins returns the coins largest first so selection doesn't depend
+// on map order.
+func sortedCoins(coinMap map[coinset.Coin]*hdkeychain.ExtendedKey) []coinset.Coin {
+	coins := make([]coinset.Coin, 0, len(coinMap))
+	for c := range coinMap {
+		coins = append(coins, c)
+	}
+	sort.Slice(coins, func(i, j int) bool {
+		if coins[i].Value() != coins[j].Value() {
+			return coins[i].Value() > coins[j].Value()
+		}
+		if *coins[i].Hash() != *coins[j].Hash() {
+			return coins[i].Hash().String() < coins[j].Hash().String()
+		}
+		return coins[i].Index() < coins[j].Index()
+	})
+	return coins
+}
+
+// selectCoins picks the largest coins until they cover amount and the fee
+// for a transaction with change. It returns the coins and the fee.
+func selectCoins(coinMap map[coinset.Coin]*hdkeychain.ExtendedKey, amount iwallet.Amount, level iwallet.FeeLevel) ([]coinset.Coin, iwallet.Amount, error) {
+	var (
+		selected []coinset.Coin
+		total    = iwallet.NewAmount(0)
+	)
+	for _, c := range sortedCoins(coinMap) {
+		selected = append(selected, c)
+		total = total.Add(iwallet.NewAmount(int64(c.Value())))
+
+		fee := estimateFee(len(selected), 2, level)
+		if total.Cmp(amount.Add(fee)) < 0 {
+			continue
+		}
+		// Leave out the change output if it would be dust.
+		if change := total.Sub(amount).Sub(fee); change.Cmp(iwallet.NewAmount(dustLimit)) < 0 {
+			fee = total.Sub(amount)
+		}
+		return selected, fee, nil
+	}
+	return nil, iwallet.NewAmount(0), base.ErrInsufficientFunds
+}
+
+func totalValue(coins []coinset.Coin) iwallet.Amount {
+	total := iwallet.NewAmount(0)
+	for _, c := range coins {
+		total = total.Add(iwallet.NewAmount(int64(c.Value())))
+	}
+	return total
+}
+
+// transactionFromCoins returns a transaction spending the coins.
+func transactionFromCoins(coins []coinset.Coin) iwallet.Transaction {
+	var tx iwallet.Transaction
+	for _, c := range coins {
+		tx.From = append(tx.From, iwallet.SpendInfo{
+			ID:      outpoint(*c.Hash(), c.Index()),
+			Address: iwallet.NewAddress(string(c.PkScript()), iwallet.CtMock),
+			Amount:  iwallet.NewAmount(int64(c.Value())),
+		})
+	}
+	return tx
+}
+
+// outpointTxid returns the ID of the transaction the serialized outpoint
+// refers to.
+func outpointTxid(ser []byte) (iwallet.TransactionID, uint32, error) {
+	if len(ser) != chainhash.HashSize+4 {
+		return "", 0, fmt.Errorf("invalid outpoint length %d", len(ser))
+	}
+	h, err := chainhash.NewHash(ser[:chainhash.HashSize])
+	if err != nil {
+		return "", 0, err
+	}
+	return iwallet.TransactionID(h.String()), binary.LittleEndian.Uint32(ser[chainhash.HashSize:]), nil
+}
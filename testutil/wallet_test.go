@@ -0,0 +1,180 @@
+package testutil
+
+import (
+	"github.com/btcsuite/btcd/btcec"
+	iwallet "github.com/cpacia/wallet-interface"
+	"testing"
+	"time"
+)
+
+func newTestWallets(t *testing.T, chain *Chain, n int) []*Wallet {
+	wallets := make([]*Wallet, n)
+	for i := range wallets {
+		w, err := NewTestWallet(chain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wallets[i] = w
+	}
+	return wallets
+}
+
+func TestWallet_Spend(t *testing.T) {
+	chain := NewChain()
+	wallets := newTestWallets(t, chain, 2)
+	alice, bob := wallets[0], wallets[1]
+
+	addr, err := alice.CurrentAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chain.Fund(addr, iwallet.NewAmount(100000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.WaitForBalance(iwallet.NewAmount(100000), iwallet.NewAmount(0), time.Second*10); err != nil {
+		t.Fatal(err)
+	}
+	chain.MineBlocks(1)
+	if err := alice.WaitForBalance(iwallet.NewAmount(0), iwallet.NewAmount(100000), time.Second*10); err != nil {
+		t.Fatal(err)
+	}
+
+	fee, err := alice.EstimateSpendFee(iwallet.NewAmount(40000), iwallet.FlNormal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fee.Cmp(iwallet.NewAmount(4520)) != 0 {
+		t.Errorf("Expected fee 4520, got %s", fee)
+	}
+
+	to, err := bob.CurrentAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wtx, err := alice.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	txid, err := alice.Spend(wtx, to, iwallet.NewAmount(40000), iwallet.FlNormal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wtx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bob.WaitForBalance(iwallet.NewAmount(40000), iwallet.NewAmount(0), time.Second*10); err != nil {
+		t.Fatal(err)
+	}
+	chain.MineBlocks(2)
+	if err := alice.WaitForTransaction(txid, 2, time.Second*10); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.WaitForBalance(iwallet.NewAmount(0), iwallet.NewAmount(40000), time.Second*10); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.WaitForBalance(iwallet.NewAmount(0), iwallet.NewAmount(55480), time.Second*10); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWallet_Escrow(t *testing.T) {
+	chain := NewChain()
+	wallets := newTestWallets(t, chain, 2)
+	buyer, vendor := wallets[0], wallets[1]
+
+	addr, err := buyer.CurrentAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chain.Fund(addr, iwallet.NewAmount(100000)); err != nil {
+		t.Fatal(err)
+	}
+	chain.MineBlocks(1)
+	if err := buyer.WaitForBalance(iwallet.NewAmount(0), iwallet.NewAmount(100000), time.Second*10); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		privs = make([]*btcec.PrivateKey, 3)
+		pubs  = make([]btcec.PublicKey, 3)
+	)
+	for i := range privs {
+		priv, err := btcec.NewPrivateKey(btcec.S256())
+		if err != nil {
+			t.Fatal(err)
+		}
+		privs[i] = priv
+		pubs[i] = *priv.PubKey()
+	}
+	escrowAddr, script, err := buyer.CreateMultisigWithTimeout(pubs, 2, time.Hour, *privs[0].PubKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wtx, err := buyer.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fundingID, err := buyer.Spend(wtx, escrowAddr, iwallet.NewAmount(50000), iwallet.FlNormal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wtx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	chain.MineBlocks(1)
+
+	funding, err := chain.GetTransaction(fundingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var release iwallet.Transaction
+	for _, out := range funding.To {
+		if out.Address == escrowAddr {
+			release.From = append(release.From, out)
+		}
+	}
+	payTo, err := vendor.CurrentAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	release.To = []iwallet.SpendInfo{{Address: payTo, Amount: iwallet.NewAmount(45000)}}
+
+	// The timeout of six blocks hasn't passed.
+	wtx, err = buyer.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := buyer.ReleaseFundsAfterTimeout(wtx, release, *privs[0], script); err == nil {
+		t.Error("Expected error releasing funds before the timeout")
+	}
+	wtx.Rollback()
+
+	var sigs [][]iwallet.EscrowSignature
+	for _, priv := range privs[1:] {
+		s, err := vendor.SignMultisigTransaction(release, *priv, script)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sigs = append(sigs, s)
+	}
+
+	wtx, err = vendor.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vendor.BuildAndSend(wtx, release, sigs[:1], script); err == nil {
+		t.Error("Expected error building with one signature")
+	}
+	if _, err := vendor.BuildAndSend(wtx, release, sigs, script); err != nil {
+		t.Fatal(err)
+	}
+	if err := wtx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	chain.MineBlocks(1)
+	if err := vendor.WaitForBalance(iwallet.NewAmount(0), iwallet.NewAmount(45000), time.Second*10); err != nil {
+		t.Fatal(err)
+	}
+}